@@ -0,0 +1,645 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"x-ui/config"
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/util/common"
+	"x-ui/web/entity"
+	"x-ui/web/locale"
+	"x-ui/web/service"
+	"x-ui/xray"
+
+	"gorm.io/gorm"
+)
+
+// The client, inbound and sub commands work on the database, whether the panel
+// runs or not. Writes wait for each other in the database, and a change asks
+// the panel to restart Xray with it, which the panel does within 30 seconds.
+
+// cliActor is who the commands make their changes as in the audit log
+const cliActor = "cli"
+
+// cliCommand is a command with the flags all of them have, and -dry-run for
+// those that change something.
+type cliCommand struct {
+	*flag.FlagSet
+	json   bool
+	dryRun bool
+}
+
+func newCliCommand(name string, usage string, changes bool) *cliCommand {
+	cmd := &cliCommand{FlagSet: flag.NewFlagSet(name, flag.ExitOnError)}
+	cmd.BoolVar(&cmd.json, "json", false, "Print the result as JSON")
+	if changes {
+		cmd.BoolVar(&cmd.dryRun, "dry-run", false, "Check the change and show its result without making it")
+	}
+	cmd.Usage = func() {
+		fmt.Printf("Usage: x-ui %s %s\n", name, usage)
+		cmd.PrintDefaults()
+	}
+	return cmd
+}
+
+// run parses args, opens the database and prints the result of do: its data
+// in the envelope of the API with -json, its text otherwise. It exits with 1
+// if do fails.
+func (cmd *cliCommand) run(args []string, do func() (any, string, error)) {
+	cmd.Parse(args)
+	var data any
+	var text string
+	err := database.InitDSN(config.GetDBDSN())
+	if err == nil {
+		data, text, err = do()
+	}
+
+	if cmd.json {
+		response := entity.Response{Success: err == nil, Data: data}
+		if err != nil {
+			code := locale.ErrRequestFailed
+			if coded, ok := locale.CodeOf(err); ok {
+				code = coded.Code
+			}
+			response.Error = &entity.ResponseError{Code: code, Message: strings.TrimSpace(err.Error())}
+		}
+		out, _ := json.MarshalIndent(response, "", "  ")
+		fmt.Println(string(out))
+	} else if err != nil {
+		fmt.Println("Error:", strings.TrimSpace(err.Error()))
+	} else {
+		fmt.Print(text)
+	}
+	if err != nil {
+		os.Exit(1)
+	}
+}
+
+// cliClient is a client after a command, or as it would be after it with
+// -dry-run.
+type cliClient struct {
+	DryRun    bool                `json:"dryRun,omitempty"`
+	InboundId int                 `json:"inboundId"`
+	Client    model.Client        `json:"client"`
+	Traffic   *xray.ClientTraffic `json:"traffic,omitempty"`
+	SubUrl    string              `json:"subUrl,omitempty"`
+}
+
+// cliInbound is an inbound in the list of inbounds.
+type cliInbound struct {
+	Id         int    `json:"id"`
+	Remark     string `json:"remark"`
+	Protocol   string `json:"protocol"`
+	Listen     string `json:"listen"`
+	Port       int    `json:"port"`
+	Enable     bool   `json:"enable"`
+	Clients    int    `json:"clients"`
+	Up         int64  `json:"up"`
+	Down       int64  `json:"down"`
+	Total      int64  `json:"total"`
+	ExpiryTime int64  `json:"expiryTime"`
+}
+
+func runClientCommand(args []string) {
+	action := ""
+	if len(args) > 0 {
+		action, args = args[0], args[1:]
+	}
+	switch action {
+	case "add":
+		cmd := newCliCommand("client add", "-inbound id -email name [-gb quota] [-days days] [-dry-run] [-json]", true)
+		inboundId := cmd.Int("inbound", 0, "ID of the inbound to add the client to")
+		email := cmd.String("email", "", "Email of the client")
+		gb := cmd.Float64("gb", 0, "Traffic quota in GB, 0 for none")
+		days := cmd.Int("days", 0, "Days until the client expires, 0 for never")
+		cmd.run(args, func() (any, string, error) {
+			return addCliClient(*inboundId, *email, *gb, *days, cmd.dryRun)
+		})
+	case "renew":
+		cmd := newCliCommand("client renew", "-email name -days days [-gb quota] [-reset] [-dry-run] [-json]", true)
+		email := cmd.String("email", "", "Email of the client")
+		days := cmd.Int("days", 0, "Days to extend the expiry by, from now if the client expired")
+		gb := cmd.Float64("gb", 0, "GB to add to the traffic quota of the client")
+		reset := cmd.Bool("reset", false, "Reset the traffic of the client")
+		cmd.run(args, func() (any, string, error) {
+			return renewCliClient(*email, &service.ClientRenew{Days: *days, AddGB: *gb, ResetTraffic: *reset}, cmd.dryRun)
+		})
+	case "reset":
+		cmd := newCliCommand("client reset", "-email name [-dry-run] [-json]", true)
+		email := cmd.String("email", "", "Email of the client")
+		cmd.run(args, func() (any, string, error) {
+			return resetCliClient(*email, cmd.dryRun)
+		})
+	case "enable", "disable":
+		cmd := newCliCommand("client "+action, "-email name [-dry-run] [-json]", true)
+		email := cmd.String("email", "", "Email of the client")
+		cmd.run(args, func() (any, string, error) {
+			return enableCliClient(*email, action == "enable", cmd.dryRun)
+		})
+	case "delete":
+		cmd := newCliCommand("client delete", "-email name [-permanent] [-dry-run] [-json]", true)
+		email := cmd.String("email", "", "Email of the client")
+		permanent := cmd.Bool("permanent", false, "Delete the client rather than moving it to the trash")
+		cmd.run(args, func() (any, string, error) {
+			return deleteCliClient(*email, *permanent, cmd.dryRun)
+		})
+	case "list":
+		cmd := newCliCommand("client list", "[-tag tag] [-json]", false)
+		tag := cmd.String("tag", "", "Only list the clients with this tag")
+		cmd.run(args, func() (any, string, error) {
+			return listCliClients(*tag)
+		})
+	default:
+		fmt.Println("Usage: x-ui client add|renew|reset|enable|disable|delete|list [flags]")
+		fmt.Println("Run x-ui client <command> -h for the flags of a command.")
+		os.Exit(2)
+	}
+}
+
+func runInboundCommand(args []string) {
+	if len(args) == 0 || args[0] != "list" {
+		fmt.Println("Usage: x-ui inbound list [-json]")
+		os.Exit(2)
+	}
+	cmd := newCliCommand("inbound list", "[-json]", false)
+	cmd.run(args[1:], listCliInbounds)
+}
+
+func runSubCommand(args []string) {
+	if len(args) == 0 || args[0] != "url" {
+		fmt.Println("Usage: x-ui sub url -email name [-host host] [-json]")
+		os.Exit(2)
+	}
+	cmd := newCliCommand("sub url", "-email name [-host host] [-json]", false)
+	email := cmd.String("email", "", "Email of the client")
+	host := cmd.String("host", "", "Host of the panel, the web domain or the hostname by default")
+	cmd.run(args[1:], func() (any, string, error) {
+		return cliSubUrl(*email, *host)
+	})
+}
+
+func runSetupCommand(args []string) {
+	cmd := newCliCommand("setup", "[-print-credentials] [-reset] [-username name] [-password text] [-port port] [-webBasePath path] [-webCert file -webCertKey file] [-acmeDomain domain -acmeEmail email] [-json]", false)
+	form := &service.SetupForm{}
+	printCredentials := cmd.Bool("print-credentials", false, "Generate what is not given, the password included, and print the credentials once")
+	reset := cmd.Bool("reset", false, "Let the panel be set up again, its users keep their passwords until it is")
+	cmd.StringVar(&form.Username, "username", "", "Username of the admin, generated by default")
+	cmd.StringVar(&form.Password, "password", "", "Password of the admin, generated with -print-credentials")
+	cmd.IntVar(&form.WebPort, "port", 0, "Port of the panel, a free random one by default")
+	cmd.StringVar(&form.WebBasePath, "webBasePath", "", "Base path of the panel, a random one by default")
+	cmd.StringVar(&form.CertFile, "webCert", "", "Certificate file of the panel")
+	cmd.StringVar(&form.KeyFile, "webCertKey", "", "Private key file of the panel")
+	cmd.StringVar(&form.AcmeDomain, "acmeDomain", "", "Domain to issue the certificate of the panel for over ACME, with HTTP-01 on port 80")
+	cmd.StringVar(&form.AcmeEmail, "acmeEmail", "", "Email of the ACME account")
+	cmd.run(args, func() (any, string, error) {
+		setupService := service.SetupService{}
+		if *reset {
+			if err := setupService.ResetSetup(); err != nil {
+				return nil, "", err
+			}
+			if form.Password == "" && !*printCredentials {
+				return map[string]string{"state": service.SetupPending}, "The panel can be set up again, on its setup page or with x-ui setup.\n", nil
+			}
+		}
+		return cliSetup(form, *printCredentials)
+	})
+}
+
+// cliSetup sets up the panel like its setup page does. A certificate over ACME
+// is issued right away.
+func cliSetup(form *service.SetupForm, printCredentials bool) (any, string, error) {
+	if form.Password == "" && !printCredentials {
+		return nil, "", common.NewError("give the password with -password, or have one generated with -print-credentials")
+	}
+	setupService := service.SetupService{}
+	if err := setupService.InitSetup(); err != nil {
+		return nil, "", err
+	}
+	result, err := setupService.Setup(form)
+	if err != nil {
+		return nil, "", err
+	}
+	auditService := service.AuditService{}
+	auditService.Record(&model.AuditLog{
+		Actor:      cliActor,
+		Action:     "panel.setup",
+		EntityType: "panel",
+		Success:    true,
+	})
+
+	var text strings.Builder
+	fmt.Fprintln(&text, "The panel is set up.")
+	if printCredentials {
+		fmt.Fprintln(&text, "username:", result.Username)
+		if result.Password != "" {
+			fmt.Fprintln(&text, "password:", result.Password)
+		}
+	}
+	fmt.Fprintln(&text, "port:", result.WebPort)
+	fmt.Fprintln(&text, "webBasePath:", result.WebBasePath)
+	if result.AcmeDomain != "" {
+		if err := setupService.IssueSetupCertificate(result.AcmeDomain); err != nil {
+			fmt.Fprintln(&text, "Issuing the certificate of", result.AcmeDomain, "failed, issue it from the settings of the panel:", err)
+		} else {
+			fmt.Fprintln(&text, "certificate:", result.AcmeDomain)
+		}
+	}
+	if result.Password != "" {
+		fmt.Fprintln(&text, "The password is not shown again, keep it now.")
+	}
+	fmt.Fprintln(&text, "Restart the panel for the changes to take effect: x-ui restart")
+	return result, text.String(), nil
+}
+
+// findCliClient returns the client with email, with its inbound and traffic.
+func findCliClient(email string) (*cliClient, *model.Inbound, error) {
+	if email == "" {
+		return nil, nil, common.NewError("the email of the client is required")
+	}
+	inboundService := service.InboundService{}
+	traffic, inbound, err := inboundService.GetClientInboundByEmail(email)
+	if err != nil {
+		return nil, nil, err
+	}
+	if inbound == nil {
+		return nil, nil, common.NewError("client not found:", email)
+	}
+	clients, err := inboundService.GetClients(inbound)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, client := range clients {
+		if client.Email == email {
+			return &cliClient{InboundId: inbound.Id, Client: client, Traffic: traffic}, inbound, nil
+		}
+	}
+	return nil, nil, common.NewError("client not found:", email)
+}
+
+// recordCliChange writes a change of a client to the audit log.
+func recordCliChange(action string, email string, err error, before any, after any) {
+	entry := &model.AuditLog{
+		Actor:      cliActor,
+		Action:     action,
+		EntityType: "client",
+		EntityId:   email,
+		Success:    err == nil,
+	}
+	if err == nil && after != nil {
+		entry.Diff = service.AuditDiff(before, after)
+	}
+	auditService := service.AuditService{}
+	auditService.Record(entry)
+}
+
+// applyCliChange asks the panel to restart Xray with a change made.
+func applyCliChange() string {
+	xrayService := service.XrayService{}
+	if err := xrayService.RequestRestart(); err != nil {
+		fmt.Fprintln(os.Stderr, "Asking the panel to restart Xray failed, restart it from the panel:", err)
+		return ""
+	}
+	return "The panel applies the change to Xray within 30 seconds.\n"
+}
+
+func addCliClient(inboundId int, email string, gb float64, days int, dryRun bool) (any, string, error) {
+	if inboundId == 0 {
+		return nil, "", common.NewError("the inbound is required")
+	}
+	if email == "" {
+		return nil, "", common.NewError("the email of the client is required")
+	}
+	if days < 0 {
+		return nil, "", common.NewError("days must not be negative")
+	}
+	inboundService := service.InboundService{}
+	inbound, err := inboundService.GetInbound(inboundId)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, "", common.NewError("inbound not found:", inboundId)
+	} else if err != nil {
+		return nil, "", err
+	}
+	var expiryTime int64
+	if days > 0 {
+		expiryTime = time.Now().AddDate(0, 0, days).UnixMilli()
+	}
+	client, settings, err := service.NewClient(inbound, email, gb, expiryTime)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := inboundService.CheckNewClients(inbound, []model.Client{*client}); err != nil {
+		return nil, "", err
+	}
+
+	result := &cliClient{DryRun: dryRun, InboundId: inbound.Id, Client: *client}
+	if dryRun {
+		return result, describeCliClient(result, "would be added to"), nil
+	}
+	_, err = inboundService.AddInboundClient(&model.Inbound{Id: inbound.Id, Settings: settings})
+	recordCliChange("client.add", email, err, map[string]any{}, map[string]any{"inboundId": inbound.Id})
+	if err != nil {
+		return nil, "", err
+	}
+	result, _, err = findCliClient(email)
+	if err != nil {
+		return nil, "", err
+	}
+	result.SubUrl = cliSubLink(result.Client.SubID, "")
+	return result, describeCliClient(result, "added to") + applyCliChange(), nil
+}
+
+func renewCliClient(email string, renew *service.ClientRenew, dryRun bool) (any, string, error) {
+	before, _, err := findCliClient(email)
+	if err != nil {
+		return nil, "", err
+	}
+	inboundService := service.InboundService{}
+	if dryRun {
+		renewed, err := inboundService.PreviewRenewClient(email, renew)
+		if err != nil {
+			return nil, "", err
+		}
+		result := *before
+		result.DryRun = true
+		result.Client.ExpiryTime, result.Client.TotalGB = renewed.ExpiryTime, renewed.TotalGB
+		if renew.ResetTraffic {
+			result.Traffic = resetCliTraffic(before.Traffic)
+		}
+		return &result, describeCliClient(&result, "would be renewed in"), nil
+	}
+
+	_, _, err = inboundService.RenewClient(email, renew, "")
+	if err != nil {
+		recordCliChange("client.renew", email, err, nil, nil)
+		return nil, "", err
+	}
+	result, _, err := findCliClient(email)
+	if err != nil {
+		return nil, "", err
+	}
+	recordCliChange("client.renew", email, nil, before.Client, result.Client)
+	return result, describeCliClient(result, "renewed in") + applyCliChange(), nil
+}
+
+// resetCliTraffic returns traffic as a reset leaves it: zeroed and enabled,
+// unless an admin disabled the client.
+func resetCliTraffic(traffic *xray.ClientTraffic) *xray.ClientTraffic {
+	if traffic == nil {
+		return nil
+	}
+	reset := *traffic
+	reset.Up, reset.Down, reset.Enable = 0, 0, true
+	if reset.DisabledReason != service.ClientDisabledAdmin {
+		reset.DisabledReason, reset.DisabledAt = "", 0
+	}
+	return &reset
+}
+
+func resetCliClient(email string, dryRun bool) (any, string, error) {
+	before, _, err := findCliClient(email)
+	if err != nil {
+		return nil, "", err
+	}
+	if dryRun {
+		result := *before
+		result.DryRun = true
+		result.Traffic = resetCliTraffic(before.Traffic)
+		return &result, describeCliClient(&result, "would have its traffic reset in"), nil
+	}
+
+	inboundService := service.InboundService{}
+	_, err = inboundService.ResetClientTraffic(before.InboundId, email, false)
+	recordCliChange("client.resetTraffic", email, err, nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	result, _, err := findCliClient(email)
+	if err != nil {
+		return nil, "", err
+	}
+	return result, describeCliClient(result, "had its traffic reset in") + applyCliChange(), nil
+}
+
+func enableCliClient(email string, enable bool, dryRun bool) (any, string, error) {
+	before, _, err := findCliClient(email)
+	if err != nil {
+		return nil, "", err
+	}
+	action, done := "client.disable", "disabled in"
+	if enable {
+		action, done = "client.enable", "enabled in"
+	}
+	patch := service.ClientPatch{Enable: &enable}
+	if dryRun {
+		result := *before
+		result.DryRun = true
+		if result.Client, err = patch.Preview(before.Client, time.Now().UnixMilli()); err != nil {
+			return nil, "", err
+		}
+		return &result, describeCliClient(&result, "would be "+done), nil
+	}
+
+	inboundService := service.InboundService{}
+	update := &service.BulkClientUpdate{
+		BulkClientSelection: service.BulkClientSelection{
+			Clients: []service.ClientRef{{InboundId: before.InboundId, Email: email}},
+			Strict:  true,
+		},
+		Patch: patch,
+	}
+	results, _, err := inboundService.UpdateBulkClients(update, 1)
+	if err == nil && !results[0].Ok {
+		err = common.NewError(results[0].Error)
+	}
+	if err != nil {
+		recordCliChange(action, email, err, nil, nil)
+		return nil, "", err
+	}
+	result, _, err := findCliClient(email)
+	if err != nil {
+		return nil, "", err
+	}
+	recordCliChange(action, email, nil, before.Client, result.Client)
+	return result, describeCliClient(result, done) + applyCliChange(), nil
+}
+
+func deleteCliClient(email string, permanent bool, dryRun bool) (any, string, error) {
+	before, inbound, err := findCliClient(email)
+	if err != nil {
+		return nil, "", err
+	}
+	done := "moved to the trash of"
+	if permanent {
+		done = "deleted from"
+	}
+	inboundService := service.InboundService{}
+	if dryRun {
+		// An inbound keeps at least one client
+		clients, err := inboundService.GetClients(inbound)
+		if err != nil {
+			return nil, "", err
+		}
+		if len(clients) < 2 {
+			return nil, "", common.NewError("no client remained in Inbound")
+		}
+		result := *before
+		result.DryRun = true
+		return &result, describeCliClient(&result, "would be "+done), nil
+	}
+
+	sel := &service.BulkClientSelection{
+		Clients: []service.ClientRef{{InboundId: before.InboundId, Email: email}},
+		Strict:  true,
+	}
+	results, _, err := inboundService.DelBulkClients(sel, 1, cliActor, permanent)
+	if err == nil && !results[0].Ok {
+		err = common.NewError(results[0].Error)
+	}
+	recordCliChange("client.delete", email, err, nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	return before, describeCliClient(before, done) + applyCliChange(), nil
+}
+
+func listCliClients(tag string) (any, string, error) {
+	inboundService := service.InboundService{}
+	clients := make([]service.ClientListItem, 0)
+	for {
+		page, total, err := inboundService.ListClients(tag, 500, len(clients))
+		if err != nil {
+			return nil, "", err
+		}
+		clients = append(clients, page...)
+		if len(page) == 0 || int64(len(clients)) >= total {
+			break
+		}
+	}
+
+	text := &strings.Builder{}
+	w := tabwriter.NewWriter(text, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "EMAIL\tINBOUND\tENABLED\tUSED\tQUOTA\tEXPIRES\tTAGS")
+	for _, client := range clients {
+		fmt.Fprintf(w, "%s\t%d\t%t\t%s\t%s\t%s\t%s\n", client.Email, client.InboundId, client.Enable,
+			common.FormatTraffic(client.Up+client.Down), cliQuota(client.Total), cliExpiry(client.ExpiryTime),
+			strings.Join(client.Tags, ","))
+	}
+	w.Flush()
+	return clients, text.String(), nil
+}
+
+func listCliInbounds() (any, string, error) {
+	inboundService := service.InboundService{}
+	all, err := inboundService.GetAllInbounds()
+	if err != nil {
+		return nil, "", err
+	}
+	inbounds := make([]cliInbound, 0, len(all))
+	for _, inbound := range all {
+		clients, _ := inboundService.GetClients(inbound)
+		inbounds = append(inbounds, cliInbound{
+			Id:         inbound.Id,
+			Remark:     inbound.Remark,
+			Protocol:   string(inbound.Protocol),
+			Listen:     inbound.Listen,
+			Port:       inbound.Port,
+			Enable:     inbound.Enable,
+			Clients:    len(clients),
+			Up:         inbound.Up,
+			Down:       inbound.Down,
+			Total:      inbound.Total,
+			ExpiryTime: inbound.ExpiryTime,
+		})
+	}
+
+	text := &strings.Builder{}
+	w := tabwriter.NewWriter(text, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tREMARK\tPROTOCOL\tPORT\tENABLED\tCLIENTS\tUSED")
+	for _, inbound := range inbounds {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%t\t%d\t%s\n", inbound.Id, inbound.Remark, inbound.Protocol, inbound.Port,
+			inbound.Enable, inbound.Clients, common.FormatTraffic(inbound.Up+inbound.Down))
+	}
+	w.Flush()
+	return inbounds, text.String(), nil
+}
+
+// cliSubLink returns the subscription URL of subId, or "" if there is none.
+func cliSubLink(subId string, host string) string {
+	settingService := service.SettingService{}
+	if host == "" {
+		host, _ = settingService.GetWebDomain()
+	}
+	if host == "" {
+		host, _ = os.Hostname()
+	}
+	link, _ := settingService.GetSubLink(host, subId)
+	return link
+}
+
+func cliSubUrl(email string, host string) (any, string, error) {
+	client, _, err := findCliClient(email)
+	if err != nil {
+		return nil, "", err
+	}
+	link := cliSubLink(client.Client.SubID, host)
+	if link == "" {
+		return nil, "", common.NewError("the client has no subscription, or subscriptions are disabled")
+	}
+	data := map[string]string{"email": email, "subId": client.Client.SubID, "url": link}
+	return data, link + "\n", nil
+}
+
+// describeCliClient writes what a command did to a client, or would do.
+func describeCliClient(result *cliClient, done string) string {
+	text := &strings.Builder{}
+	if result.DryRun {
+		text.WriteString("Dry run, nothing was changed.\n")
+	}
+	client := result.Client
+	fmt.Fprintf(text, "Client %s %s inbound %d\n", client.Email, done, result.InboundId)
+	switch {
+	case client.ID != "":
+		fmt.Fprintf(text, "  id:       %s\n", client.ID)
+	case client.Password != "":
+		fmt.Fprintf(text, "  password: %s\n", client.Password)
+	}
+	fmt.Fprintf(text, "  enabled:  %t\n", client.Enable)
+	fmt.Fprintf(text, "  quota:    %s\n", cliQuota(client.TotalGB))
+	if result.Traffic != nil {
+		fmt.Fprintf(text, "  used:     %s\n", common.FormatTraffic(result.Traffic.Up+result.Traffic.Down))
+	}
+	fmt.Fprintf(text, "  expires:  %s\n", cliExpiry(client.ExpiryTime))
+	if result.SubUrl != "" {
+		fmt.Fprintf(text, "  sub:      %s\n", result.SubUrl)
+	}
+	return text.String()
+}
+
+func cliQuota(total int64) string {
+	if total <= 0 {
+		return "unlimited"
+	}
+	return common.FormatTraffic(total)
+}
+
+// cliExpiry writes an expiry in unix milliseconds, negative for a validity
+// counted from the first use.
+func cliExpiry(expiryTime int64) string {
+	const day = int64(24 * time.Hour / time.Millisecond)
+	switch {
+	case expiryTime == 0:
+		return "never"
+	case expiryTime < 0:
+		return strconv.FormatInt(-expiryTime/day, 10) + " days after the first use"
+	}
+	return time.UnixMilli(expiryTime).Format("2006-01-02 15:04")
+}
@@ -0,0 +1,157 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// integrityErrors is how many of the problems integrity_check finds are told
+const integrityErrors = 5
+
+// BackupTo writes a copy of the database to path with the online backup API of
+// SQLite, which reads every committed page, those still in the WAL included,
+// while the other connections go on writing. The copy is a single file in the
+// DELETE journal mode, to be moved or archived as is.
+func BackupTo(path string) error {
+	if !IsSQLite() {
+		return ErrNotSQLite
+	}
+	defer LockFile()()
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	ctx := context.Background()
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	src, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	destDB, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return err
+	}
+	defer destDB.Close()
+	dest, err := destDB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+
+	err = dest.Raw(func(destConn any) error {
+		return src.Raw(func(srcConn any) error {
+			destSQLite, ok := destConn.(*sqlite3.SQLiteConn)
+			srcSQLite, ok2 := srcConn.(*sqlite3.SQLiteConn)
+			if !ok || !ok2 {
+				return errors.New("the database connection is not a SQLite one")
+			}
+			backup, err := destSQLite.Backup("main", srcSQLite, "main")
+			if err != nil {
+				return err
+			}
+			// All the pages in one step, which a write meanwhile doesn't restart
+			err = retryBusy(func() error {
+				_, err := backup.Step(-1)
+				return err
+			})
+			if finishErr := backup.Finish(); err == nil {
+				err = finishErr
+			}
+			return err
+		})
+	})
+	if err != nil {
+		return err
+	}
+	_, err = dest.ExecContext(ctx, "PRAGMA journal_mode=DELETE")
+	return err
+}
+
+// CheckIntegrity opens the SQLite database at path on its own and runs
+// integrity_check on it, for a backup or a file to import. It returns the
+// first problems found, if any.
+func CheckIntegrity(path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	checkDB, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer checkDB.Close()
+	rows, err := checkDB.Query("PRAGMA integrity_check")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var problems []string
+	for rows.Next() {
+		var result string
+		if err := rows.Scan(&result); err != nil {
+			return err
+		}
+		if result != "ok" && len(problems) < integrityErrors {
+			problems = append(problems, result)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("the database is corrupt: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// ReadTable returns the rows of table of the SQLite database at path, opened
+// read-only, by column; none if it has no such table.
+func ReadTable(path string, table string) ([]map[string]any, error) {
+	readDB, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	defer readDB.Close()
+	var count int
+	if err := readDB.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&count); err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, nil
+	}
+	rows, err := readDB.Query(`SELECT * FROM "` + strings.ReplaceAll(table, `"`, `""`) + `"`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	var result []map[string]any
+	for rows.Next() {
+		values := make([]any, len(columns))
+		pointers := make([]any, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, err
+		}
+		row := make(map[string]any, len(columns))
+		for i, column := range columns {
+			row[column] = values[i]
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
@@ -0,0 +1,122 @@
+package database
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/logger"
+)
+
+// copyBatch is how many rows of a table are copied at once
+const copyBatch = 500
+
+// CopyTo copies every table of the open database to the database of dsn, see
+// ParseDSN. The tables of the target are migrated first and must be empty, and
+// the rows keep their ids. copied is called after each table with its rows.
+// The panel should be stopped meanwhile, so that nothing is written after its
+// table was copied.
+func CopyTo(dsn string, copied func(table string, rows int64)) error {
+	name, source, err := ParseDSN(dsn)
+	if err != nil {
+		return err
+	}
+	if err := makeDir(name, source); err != nil {
+		return err
+	}
+	target, err := gorm.Open(dialector(name, source, DefaultOptions), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if sqlDB, err := target.DB(); err == nil {
+			sqlDB.Close()
+		}
+	}()
+
+	for _, model := range models {
+		if err := target.AutoMigrate(model); err != nil {
+			return fmt.Errorf("migrating the target database: %w", err)
+		}
+	}
+	for _, model := range models {
+		var count int64
+		if err := target.Model(model).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return fmt.Errorf("the table %s of the target database is not empty", tableOf(target, model))
+		}
+	}
+
+	for _, model := range models {
+		rows, err := copyTable(target, model)
+		if err != nil {
+			return fmt.Errorf("copying %s: %w", tableOf(db, model), err)
+		}
+		if name == DialectPostgres {
+			if err := resetSequence(target, model); err != nil {
+				return fmt.Errorf("resetting the id sequence of %s: %w", tableOf(db, model), err)
+			}
+		}
+		if copied != nil {
+			copied(tableOf(db, model), rows)
+		}
+	}
+	return nil
+}
+
+func tableOf(tx *gorm.DB, model any) string {
+	stmt := &gorm.Statement{DB: tx}
+	if err := stmt.Parse(model); err != nil {
+		return fmt.Sprintf("%T", model)
+	}
+	return stmt.Schema.Table
+}
+
+// copyTable copies the rows of the table of model to target in batches, by the
+// order of their primary key, and returns how many there were. All the columns
+// are written, zero values included, and none of the associations.
+func copyTable(target *gorm.DB, model any) (int64, error) {
+	stmt := &gorm.Statement{DB: db}
+	if err := stmt.Parse(model); err != nil {
+		return 0, err
+	}
+	order := strings.Join(stmt.Schema.PrimaryFieldDBNames, ", ")
+	var copied int64
+	for {
+		batch := reflect.New(reflect.SliceOf(reflect.TypeOf(model).Elem()))
+		err := db.Model(model).Order(order).Offset(int(copied)).Limit(copyBatch).Find(batch.Interface()).Error
+		if err != nil {
+			return copied, err
+		}
+		n := batch.Elem().Len()
+		if n == 0 {
+			return copied, nil
+		}
+		if err := target.Select("*").Omit(clause.Associations).Create(batch.Interface()).Error; err != nil {
+			return copied, err
+		}
+		copied += int64(n)
+		if n < copyBatch {
+			return copied, nil
+		}
+	}
+}
+
+// resetSequence makes the id sequence of a PostgreSQL table go on after the
+// ids copied into it, which didn't take theirs from it.
+func resetSequence(target *gorm.DB, model any) error {
+	stmt := &gorm.Statement{DB: target}
+	if err := stmt.Parse(model); err != nil {
+		return err
+	}
+	field := stmt.Schema.PrioritizedPrimaryField
+	if field == nil || !field.AutoIncrement {
+		return nil
+	}
+	return target.Exec("SELECT setval(pg_get_serial_sequence(?, ?), COALESCE(MAX(?), 0) + 1, false) FROM ?",
+		stmt.Schema.Table, field.DBName, clause.Column{Name: field.DBName}, clause.Table{Name: stmt.Schema.Table}).Error
+}
@@ -14,7 +14,6 @@ import (
 	"x-ui/util/crypto"
 	"x-ui/xray"
 
-	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
 )
@@ -26,16 +25,45 @@ const (
 	defaultPassword = "admin"
 )
 
+// models are the tables of the panel, a table before those referencing it.
+var models = []any{
+	&model.User{},
+	&model.Inbound{},
+	&model.OutboundTraffics{},
+	&model.Setting{},
+	&model.InboundClientIps{},
+	&xray.ClientTraffic{},
+	&model.HistoryOfSeeders{},
+	&model.LoginLockout{},
+	&model.WebAuthnCredential{},
+	&model.ApiToken{},
+	&model.AuditLog{},
+	&model.LoginSession{},
+	&model.RotatedRefreshToken{},
+	&model.ClientRenewal{},
+	&model.TrashEntry{},
+	&model.TrafficHistory{},
+	&model.HourlyTraffic{},
+	&model.StatusMinute{},
+	&model.GeoDay{},
+	&model.XrayCounter{},
+	&model.InboundTemplate{},
+	&model.Outbound{},
+	&model.RoutingRule{},
+	&model.Balancer{},
+	&model.TelegramUser{},
+	&model.WebhookDelivery{},
+	&model.CrashReport{},
+	&model.SubAccess{},
+	&model.Node{},
+	&model.NodeInbound{},
+	&model.NodeClientTraffic{},
+	&model.ConnBlock{},
+	&model.ClientShare{},
+	&model.Trial{},
+}
+
 func initModels() error {
-	models := []any{
-		&model.User{},
-		&model.Inbound{},
-		&model.OutboundTraffics{},
-		&model.Setting{},
-		&model.InboundClientIps{},
-		&xray.ClientTraffic{},
-		&model.HistoryOfSeeders{},
-	}
 	for _, model := range models {
 		if err := db.AutoMigrate(model); err != nil {
 			log.Printf("Error auto migrating model: %v", err)
@@ -52,7 +80,7 @@ func initUser() error {
 		return err
 	}
 	if empty {
-		hashedPassword, err := crypto.HashPasswordAsBcrypt(defaultPassword)
+		hashedPassword, err := crypto.HashPassword(defaultPassword)
 
 		if err != nil {
 			log.Printf("Error hashing default password: %v", err)
@@ -60,14 +88,48 @@ func initUser() error {
 		}
 
 		user := &model.User{
-			Username: defaultUsername,
-			Password: hashedPassword,
+			Username:     defaultUsername,
+			Password:     hashedPassword,
+			Role:         model.RoleAdmin,
+			WeakPassword: true,
 		}
 		return db.Create(user).Error
 	}
 	return nil
 }
 
+// migrateUserRoles makes admins of the users created before roles existed, which
+// is the single user of older panels.
+func migrateUserRoles() error {
+	return db.Model(model.User{}).
+		Where("role IS NULL OR role = ?", "").
+		Update("role", model.RoleAdmin).
+		Error
+}
+
+// flagDefaultPasswords marks the users of older panels that still have the
+// default password as weak, once. Other weak passwords are only found when they
+// are used to log in.
+func flagDefaultPasswords() error {
+	var count int64
+	err := db.Model(&model.HistoryOfSeeders{}).Where("seeder_name = ?", "WeakPasswordFlag").Count(&count).Error
+	if err != nil || count > 0 {
+		return err
+	}
+	var users []model.User
+	if err := db.Find(&users).Error; err != nil {
+		return err
+	}
+	for _, user := range users {
+		if !user.WeakPassword && crypto.CheckPasswordHash(user.Password, defaultPassword) {
+			if err := db.Model(&user).Update("weak_password", true).Error; err != nil {
+				return err
+			}
+		}
+	}
+	return db.Create(&model.HistoryOfSeeders{SeederName: "WeakPasswordFlag"}).Error
+}
+
 func runSeeders(isUsersEmpty bool) error {
 	empty, err := isTableEmpty("history_of_seeders")
 	if err != nil {
@@ -89,7 +151,7 @@ func runSeeders(isUsersEmpty bool) error {
 			db.Find(&users)
 
 			for _, user := range users {
-				hashedPassword, err := crypto.HashPasswordAsBcrypt(user.Password)
+				hashedPassword, err := crypto.HashPassword(user.Password)
 				if err != nil {
 					log.Printf("Error hashing password for user '%s': %v", user.Username, err)
 					return err
@@ -113,12 +175,20 @@ func isTableEmpty(tableName string) (bool, error) {
 	return count == 0, err
 }
 
+// InitDB opens the SQLite database at dbPath, see InitDSN.
 func InitDB(dbPath string) error {
-	dir := path.Dir(dbPath)
-	err := os.MkdirAll(dir, fs.ModePerm)
+	return InitDSN(DialectSQLite + ":" + dbPath)
+}
+
+// InitDSN opens the database of dsn, see ParseDSN, and migrates it.
+func InitDSN(dsn string) error {
+	name, source, err := ParseDSN(dsn)
 	if err != nil {
 		return err
 	}
+	if err := makeDir(name, source); err != nil {
+		return err
+	}
 
 	var gormLogger logger.Interface
 
@@ -131,21 +201,58 @@ func InitDB(dbPath string) error {
 	c := &gorm.Config{
 		Logger: gormLogger,
 	}
-	db, err = gorm.Open(sqlite.Open(dbPath), c)
+	db, err = gorm.Open(dialector(name, source, DefaultOptions), c)
 	if err != nil {
 		return err
 	}
+	dialect = name
 
 	if err := initModels(); err != nil {
 		return err
 	}
 
+	options, err := readOptions()
+	if err != nil {
+		return err
+	}
+	if name == DialectSQLite && options != DefaultOptions {
+		if err := CloseDB(); err != nil {
+			return err
+		}
+		if db, err = gorm.Open(dialector(name, source, options), c); err != nil {
+			return err
+		}
+	}
+	if err := setPool(options); err != nil {
+		return err
+	}
+	if err := watchWrites(db); err != nil {
+		return err
+	}
+	if err := watchQueryTime(db); err != nil {
+		return err
+	}
+
 	isUsersEmpty, err := isTableEmpty("users")
 
 	if err := initUser(); err != nil {
 		return err
 	}
-	return runSeeders(isUsersEmpty)
+	if err := migrateUserRoles(); err != nil {
+		return err
+	}
+	if err := runSeeders(isUsersEmpty); err != nil {
+		return err
+	}
+	return flagDefaultPasswords()
+}
+
+// makeDir makes the folder of a SQLite database, for it to be created in.
+func makeDir(name string, source string) error {
+	if name != DialectSQLite {
+		return nil
+	}
+	return os.MkdirAll(path.Dir(source), fs.ModePerm)
 }
 
 func CloseDB() error {
@@ -178,6 +285,9 @@ func IsSQLiteDB(file io.ReaderAt) (bool, error) {
 }
 
 func Checkpoint() error {
+	if !IsSQLite() {
+		return nil
+	}
 	// Update WAL
 	err := db.Exec("PRAGMA wal_checkpoint;").Error
 	if err != nil {
@@ -0,0 +1,175 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"x-ui/config"
+)
+
+const (
+	// vacuumPages is how many free pages an incremental vacuum step gives back,
+	// a statement short enough for the writes waiting on it
+	vacuumPages = 1024
+	// vacuumPause is the wait between two steps, for the waiting writes to run
+	vacuumPause = 50 * time.Millisecond
+)
+
+// ErrFileBusy is returned by Optimize while the database file is backed up,
+// replaced by an import or optimized already.
+var ErrFileBusy = errors.New("the database is being backed up, restored or optimized")
+
+// fileLock is held while the database file is backed up, replaced or vacuumed
+var fileLock sync.Mutex
+
+// LockFile waits for the database file to be free and keeps it from being
+// backed up or vacuumed until the returned unlock is called, for an import to
+// replace it.
+func LockFile() (unlock func()) {
+	fileLock.Lock()
+	return fileLock.Unlock
+}
+
+// Size returns how many bytes the database takes: the file and its WAL for
+// SQLite, the data and the indexes of its tables for the other databases.
+func Size() (int64, error) {
+	switch dialect {
+	case DialectPostgres:
+		var size int64
+		err := db.Raw("SELECT pg_database_size(current_database())").Scan(&size).Error
+		return size, err
+	case DialectMySQL:
+		var size int64
+		err := db.Raw("SELECT COALESCE(SUM(data_length + index_length), 0) FROM information_schema.tables WHERE table_schema = DATABASE()").
+			Scan(&size).Error
+		return size, err
+	}
+	var size int64
+	for _, path := range []string{config.GetDBPath(), config.GetDBPath() + "-wal"} {
+		info, err := os.Stat(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return 0, err
+		}
+		size += info.Size()
+	}
+	return size, nil
+}
+
+// OptimizeReport is what Optimize did.
+type OptimizeReport struct {
+	SizeBefore int64 `json:"sizeBefore"`
+	SizeAfter  int64 `json:"sizeAfter"`
+	// Incremental tells that the free pages were given back a few at a time,
+	// not by rebuilding the whole database with VACUUM
+	Incremental bool `json:"incremental"`
+}
+
+// Optimize gives the free space of the database back to the disk and refreshes
+// the statistics of its query planner. A SQLite database in incremental
+// auto_vacuum mode, as every database is once vacuumed, frees its pages in
+// short steps that let the other writes through; otherwise it is rebuilt with
+// VACUUM, which holds the write lock until it is done. It returns ErrFileBusy
+// without waiting if the file is being backed up or restored.
+func Optimize() (*OptimizeReport, error) {
+	if !fileLock.TryLock() {
+		return nil, ErrFileBusy
+	}
+	defer fileLock.Unlock()
+
+	report := &OptimizeReport{}
+	var err error
+	if report.SizeBefore, err = Size(); err != nil {
+		return nil, err
+	}
+	switch dialect {
+	case DialectPostgres:
+		err = db.Exec("VACUUM (ANALYZE)").Error
+	case DialectMySQL:
+		err = optimizeTables()
+	default:
+		report.Incremental, err = vacuumSQLite()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if report.SizeAfter, err = Size(); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// optimizeTables rebuilds the MySQL tables one by one, which InnoDB does
+// online.
+func optimizeTables() error {
+	names := make([]string, len(models))
+	for i, model := range models {
+		names[i] = "`" + strings.ReplaceAll(tableOf(db, model), "`", "``") + "`"
+	}
+	for _, name := range names {
+		if err := db.Exec("OPTIMIZE TABLE " + name).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// vacuumSQLite checkpoints the WAL, frees the pages of the database and
+// analyzes it, then truncates the WAL the vacuum was written to, for the file
+// to shrink. It tells if the pages were freed incrementally.
+func vacuumSQLite() (bool, error) {
+	if err := checkpointTruncate(); err != nil {
+		return false, err
+	}
+	var mode int
+	if err := db.Raw("PRAGMA auto_vacuum").Scan(&mode).Error; err != nil {
+		return false, err
+	}
+	// 2 is INCREMENTAL. A database of another mode takes the mode the
+	// connections set with its VACUUM, see dsn
+	incremental := mode == 2
+	if incremental {
+		step := fmt.Sprintf("PRAGMA incremental_vacuum(%d)", vacuumPages)
+		for last := int64(-1); ; {
+			var free int64
+			if err := db.Raw("PRAGMA freelist_count").Scan(&free).Error; err != nil {
+				return true, err
+			}
+			if free == 0 || free == last {
+				break
+			}
+			last = free
+			err := retryBusy(func() error {
+				rows, err := db.Raw(step).Rows()
+				if err != nil {
+					return err
+				}
+				// The pragma frees a page each time it's stepped
+				for rows.Next() {
+				}
+				rows.Close()
+				return rows.Err()
+			})
+			if err != nil {
+				return true, err
+			}
+			time.Sleep(vacuumPause)
+		}
+	} else if err := retryBusy(func() error { return db.Exec("VACUUM").Error }); err != nil {
+		return false, err
+	}
+	if err := retryBusy(func() error { return db.Exec("ANALYZE").Error }); err != nil {
+		return incremental, err
+	}
+	return incremental, checkpointTruncate()
+}
+
+func checkpointTruncate() error {
+	return retryBusy(func() error { return db.Exec("PRAGMA wal_checkpoint(TRUNCATE)").Error })
+}
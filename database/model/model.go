@@ -1,7 +1,10 @@
 package model
 
 import (
+	"encoding/json"
 	"fmt"
+	"hash/fnv"
+	"strconv"
 
 	"x-ui/util/json_util"
 	"x-ui/xray"
@@ -20,10 +23,56 @@ const (
 	WireGuard   Protocol = "wireguard"
 )
 
+// Roles of panel users, from the most to the least privileged
+const (
+	RoleAdmin    = "admin"
+	RoleOperator = "operator"
+	RoleViewer   = "viewer"
+)
+
 type User struct {
 	Id       int    `json:"id" gorm:"primaryKey;autoIncrement"`
 	Username string `json:"username"`
 	Password string `json:"password"`
+	Role     string `json:"role" gorm:"default:admin"`
+	// WeakPassword tells whether the password was a default or weak one when it
+	// was last set or used to log in, the password itself is never kept
+	WeakPassword bool `json:"weakPassword"`
+
+	// TgChatId links the user to a Telegram chat, so the bot can act with the
+	// user's role; zero means the user has no chat
+	TgChatId int64 `json:"tgChatId"`
+
+	// TOTP two-factor authentication; the secret is encrypted with the panel secret
+	// and recovery codes are stored as a JSON array of SHA-256 hashes
+	TotpSecret    string `json:"-"`
+	TotpEnabled   bool   `json:"totpEnabled"`
+	TotpEnabledAt int64  `json:"-"`
+	TotpLastStep  int64  `json:"-"`
+	RecoveryCodes string `json:"-"`
+
+	// SessionLimits override the session limits of the settings for the user,
+	// nil keeps them all
+	SessionLimits *SessionLimits `json:"sessionLimits,omitempty" gorm:"serializer:json"`
+}
+
+// SessionLimits are the limits of the login sessions of a user, in minutes: how
+// long a session may go unused and how long it lasts at most, and how many the
+// user may have at once. A nil limit is the one of the settings, zero is none.
+type SessionLimits struct {
+	IdleMinutes     *int `json:"idleMinutes,omitempty"`
+	LifetimeMinutes *int `json:"lifetimeMinutes,omitempty"`
+	MaxSessions     *int `json:"maxSessions,omitempty"`
+}
+
+// InboundClientCounts counts the clients of an inbound that are active and
+// that are disabled, by the reason they are.
+type InboundClientCounts struct {
+	Active  int `json:"active"`
+	Quota   int `json:"quota"`
+	Expiry  int `json:"expiry"`
+	Admin   int `json:"admin"`
+	IpLimit int `json:"ipLimit"`
 }
 
 type Inbound struct {
@@ -36,10 +85,61 @@ type Inbound struct {
 	Enable      bool                 `json:"enable" form:"enable"`
 	ExpiryTime  int64                `json:"expiryTime" form:"expiryTime"`
 	ClientStats []xray.ClientTraffic `gorm:"foreignKey:InboundId;references:Id" json:"clientStats" form:"clientStats"`
+	// ClientCounts counts the clients by state, in inbound lists
+	ClientCounts *InboundClientCounts `json:"clientCounts,omitempty" form:"-" gorm:"-"`
+	// RemarkTemplate overrides the remark template of the settings for the
+	// links of the clients of the inbound
+	RemarkTemplate string `json:"remarkTemplate" form:"remarkTemplate"`
+	// SubIncludeDisabled overrides whether the subscriptions of the settings
+	// list the expired and depleted clients of the inbound: "" keeps the
+	// settings, SubIncludeDisabledOn lists them and SubIncludeDisabledOff
+	// leaves them out
+	SubIncludeDisabled string `json:"subIncludeDisabled" form:"subIncludeDisabled"`
+	// ClientDefaults are the link options of the clients of the inbound, in
+	// JSON in forms; clients override them with their own
+	ClientDefaults *LinkOptions `json:"clientDefaults,omitempty" form:"clientDefaults" gorm:"serializer:json"`
+	// RandomPort asks for a random free port on creation, like port 0
+	RandomPort bool `json:"randomPort,omitempty" form:"randomPort" gorm:"-"`
+	// TemplateId creates the inbound from a template, with the fields that are
+	// set overriding it
+	TemplateId int `json:"templateId,omitempty" form:"templateId" gorm:"-"`
+	// RegenerateRealityKeys replaces the Reality key pair on creation or update
+	RegenerateRealityKeys bool `json:"regenerateRealityKeys,omitempty" form:"regenerateRealityKeys" gorm:"-"`
+	// MigrateShadowsocksKeys gives a Shadowsocks inbound and all its clients new
+	// keys on update, as a change between methods with other keys needs
+	MigrateShadowsocksKeys bool `json:"migrateShadowsocksKeys,omitempty" form:"migrateShadowsocksKeys" gorm:"-"`
+	// Schedule enables and disables the inbound at times of the week; it is
+	// set on its own endpoint, never by updates of the inbound
+	Schedule *InboundSchedule `json:"schedule,omitempty" form:"-" gorm:"serializer:json"`
+	// ScheduleOverride is when a manual enable or disable of a scheduled
+	// inbound gives way to the schedule again, in ms
+	ScheduleOverride int64 `json:"scheduleOverride,omitempty" form:"-"`
+	// ScheduleState is where the schedule stands, in inbound lists
+	ScheduleState *InboundScheduleState `json:"scheduleState,omitempty" form:"-" gorm:"-"`
+	// RealityDests are the dests a Reality inbound falls back to, in order,
+	// when its dest keeps failing the health checks; they are set on their own
+	// endpoint, never by updates of the inbound
+	RealityDests []string `json:"realityDests,omitempty" form:"-" gorm:"serializer:json"`
+	// RealityHealth is how the health checks of the dests of a Reality inbound
+	// went, its dest first, in inbound lists
+	RealityHealth []RealityDestHealth `json:"realityHealth,omitempty" form:"-" gorm:"-"`
+	// Limits bound the clients of the inbound, for the operators managing
+	// them; they are set on their own endpoint by admins, never by updates of
+	// the inbound
+	Limits *InboundLimits `json:"limits,omitempty" form:"-" gorm:"serializer:json"`
+	// LimitUsage is what the clients take of the limits, in inbound lists
+	LimitUsage *InboundLimitUsage `json:"limitUsage,omitempty" form:"-" gorm:"-"`
+	// ConnLimits bound the connections a single source IP makes to the inbound;
+	// they are set on their own endpoint by admins, never by updates of the
+	// inbound
+	ConnLimits *InboundConnLimits `json:"connLimits,omitempty" form:"-" gorm:"serializer:json"`
+	// BindState is why Xray doesn't listen on the inbound, in inbound lists
+	BindState *InboundBindState `json:"bindState,omitempty" form:"-" gorm:"-"`
 
 	// config part
 	Listen         string   `json:"listen" form:"listen"`
 	Port           int      `json:"port" form:"port"`
+	PortEnd        int      `json:"portEnd,omitempty" form:"portEnd"` // last port of a port range, 0 for a single port
 	Protocol       Protocol `json:"protocol" form:"protocol"`
 	Settings       string   `json:"settings" form:"settings"`
 	StreamSettings string   `json:"streamSettings" form:"streamSettings"`
@@ -48,6 +148,114 @@ type Inbound struct {
 	Allocate       string   `json:"allocate" form:"allocate"`
 }
 
+// InboundSchedule enables an inbound within its windows and disables it
+// outside of them, in the time zone of the panel; the off mode does the
+// reverse.
+type InboundSchedule struct {
+	Mode    string           `json:"mode"`
+	Windows []ScheduleWindow `json:"windows"`
+}
+
+// The modes of inbound schedules: whether the inbound is on or off within the
+// windows.
+const (
+	ScheduleModeOn  = "on"
+	ScheduleModeOff = "off"
+)
+
+// ScheduleWindow is a time of the week: from Start to End, "15:04" times, on
+// each of Days, 0 being Sunday, or every day if none is given; a window that
+// ends at or before its start ends on the next day. A window with a Cron spec
+// starts at the times of the spec instead and lasts Minutes.
+type ScheduleWindow struct {
+	Days    []int  `json:"days,omitempty"`
+	Start   string `json:"start,omitempty"`
+	End     string `json:"end,omitempty"`
+	Cron    string `json:"cron,omitempty"`
+	Minutes int    `json:"minutes,omitempty"`
+}
+
+// RealityDestHealth is how the health checks of a dest of a Reality inbound
+// went: the last one, checked at CheckedAt in ms, with the latency of its
+// fastest handshake in ms, and how many failed in a row.
+type RealityDestHealth struct {
+	Dest      string `json:"dest"`
+	Ok        bool   `json:"ok"`
+	Latency   int64  `json:"latency"`
+	Failures  int    `json:"failures"`
+	Error     string `json:"error,omitempty"`
+	CheckedAt int64  `json:"checkedAt"`
+}
+
+// InboundScheduleState tells whether the schedule of an inbound has it on now,
+// whether a manual change holds over it and when it next switches the inbound,
+// in ms.
+type InboundScheduleState struct {
+	On             bool  `json:"on"`
+	Overridden     bool  `json:"overridden"`
+	NextTransition int64 `json:"nextTransition,omitempty"`
+}
+
+// InboundBindState is an inbound that failed to bind its port: why, and since
+// when in ms. The config of Xray goes without the inbound until its bind is
+// retried or its port changes.
+type InboundBindState struct {
+	State  string `json:"state"`
+	Reason string `json:"reason"`
+	Since  int64  `json:"since"`
+}
+
+// BindStateError is the state of an inbound that failed to bind its port.
+const BindStateError = "error"
+
+// InboundLimits bound the clients of an inbound, whoever adds or changes them;
+// zero is no limit. Limits below what the clients take already keep them as
+// they are, only changes that would take more are refused.
+type InboundLimits struct {
+	MaxClients          int   `json:"maxClients"`
+	MaxTotalAssignedGB  int64 `json:"maxTotalAssignedGB"`
+	MaxClientExpiryDays int   `json:"maxClientExpiryDays"`
+	// AllowUnlimited lets clients go without a traffic limit or an expiry
+	// despite the limits on them, which they take nothing of then
+	AllowUnlimited bool `json:"allowUnlimited"`
+}
+
+// InboundLimitUsage is how many clients an inbound has and the traffic limits
+// they are assigned, in GB.
+type InboundLimitUsage struct {
+	Clients    int     `json:"clients"`
+	AssignedGB float64 `json:"assignedGB"`
+}
+
+// InboundConnLimits are the most connections a single source IP may have open
+// to an inbound at once and may open to it in a minute, 0 for no limit. An IP
+// going over one is blocked from the port of the inbound for a while.
+type InboundConnLimits struct {
+	MaxConnsPerIP        int `json:"maxConnsPerIP"`
+	MaxNewConnsPerMinute int `json:"maxNewConnsPerMinute"`
+}
+
+// ConnBlock is a source IP blocked from the port of an inbound, a port range
+// like "443-450" for inbounds with one, for going over a connection limit of
+// the inbound. Limit names the limit and Count is how far the IP went.
+type ConnBlock struct {
+	Id        int    `json:"id" gorm:"primaryKey;autoIncrement"`
+	Ip        string `json:"ip" gorm:"index"`
+	InboundId int    `json:"inboundId" gorm:"index"`
+	Port      string `json:"port"`
+	Limit     string `json:"limit"`
+	Count     int    `json:"count"`
+	CreatedAt int64  `json:"createdAt"`
+	ExpiresAt int64  `json:"expiresAt" gorm:"index"`
+}
+
+// The overrides of inbounds for their expired and depleted clients in
+// subscriptions.
+const (
+	SubIncludeDisabledOn  = "include"
+	SubIncludeDisabledOff = "exclude"
+)
+
 type OutboundTraffics struct {
 	Id    int    `json:"id" form:"id" gorm:"primaryKey;autoIncrement"`
 	Tag   string `json:"tag" form:"tag" gorm:"unique"`
@@ -60,6 +268,282 @@ type InboundClientIps struct {
 	Id          int    `json:"id" gorm:"primaryKey;autoIncrement"`
 	ClientEmail string `json:"clientEmail" form:"clientEmail" gorm:"unique"`
 	Ips         string `json:"ips" form:"ips"`
+	// BlockedIps are the IPs the client was disabled for, beyond its IP limit
+	BlockedIps string `json:"blockedIps" form:"-"`
+	BlockedAt  int64  `json:"blockedAt" form:"-"`
+}
+
+// LoginLockout counts failed logins of a username from an IP address. Times are
+// unix milliseconds; LockedUntil is zero while the pair is not locked.
+type LoginLockout struct {
+	Id           int    `json:"id" gorm:"primaryKey;autoIncrement"`
+	Ip           string `json:"ip" gorm:"size:255;uniqueIndex:idx_lockout_ip_username"`
+	Username     string `json:"username" gorm:"size:255;uniqueIndex:idx_lockout_ip_username"`
+	Failures     int    `json:"failures"`
+	FirstFailure int64  `json:"firstFailure"`
+	LastFailure  int64  `json:"lastFailure"`
+	LockedUntil  int64  `json:"lockedUntil"`
+}
+
+// WebAuthnCredential is a passkey registered by a panel user. Credential holds the
+// JSON encoded webauthn.Credential, CredentialId its base64url ID for lookups.
+type WebAuthnCredential struct {
+	Id           int    `json:"id" gorm:"primaryKey;autoIncrement"`
+	UserId       int    `json:"-" gorm:"index"`
+	Nickname     string `json:"nickname"`
+	CredentialId string `json:"-" gorm:"size:255;uniqueIndex"`
+	Credential   string `json:"-"`
+	CreatedAt    int64  `json:"createdAt"`
+	LastUsedAt   int64  `json:"lastUsedAt"`
+}
+
+// ApiToken is a personal access token for the panel API. Only the SHA-256 hash of
+// the secret is stored; Prefix keeps its first characters to tell tokens apart.
+// Times are unix milliseconds, ExpiresAt zero means the token never expires.
+type ApiToken struct {
+	Id         int    `json:"id" gorm:"primaryKey;autoIncrement"`
+	UserId     int    `json:"-" gorm:"index"`
+	Name       string `json:"name"`
+	Prefix     string `json:"prefix"`
+	TokenHash  string `json:"-" gorm:"size:255;uniqueIndex"`
+	Scope      string `json:"scope"`
+	ExpiresAt  int64  `json:"expiresAt"`
+	CreatedAt  int64  `json:"createdAt"`
+	LastUsedAt int64  `json:"lastUsedAt"`
+}
+
+// ClientShare is a link handed out for managing a single client without
+// logging in, until ExpiresAt or until it is revoked. The link carries a random
+// secret and only its hash is stored. The holder can see the usage of the
+// client, reset its traffic and extend its expiry, by MaxExtendDays days at
+// most over the life of the link.
+type ClientShare struct {
+	Id            int    `json:"id" gorm:"primaryKey;autoIncrement"`
+	Email         string `json:"email" gorm:"index"`
+	Prefix        string `json:"prefix"`
+	TokenHash     string `json:"-" gorm:"size:255;uniqueIndex"`
+	CreatedBy     string `json:"createdBy"`
+	MaxExtendDays int    `json:"maxExtendDays"`
+	ExtendedDays  int    `json:"extendedDays"`
+	CreatedAt     int64  `json:"createdAt"`
+	ExpiresAt     int64  `json:"expiresAt"`
+	RevokedAt     int64  `json:"revokedAt"`
+	LastUsedAt    int64  `json:"lastUsedAt"`
+}
+
+// LoginSession is a panel login. The session cookie carries a random id and only
+// its hash is stored. ExpiresAt is zero for sessions that last until the browser
+// is closed.
+type LoginSession struct {
+	Id           int    `json:"id" gorm:"primaryKey;autoIncrement"`
+	TokenHash    string `json:"-" gorm:"size:255;uniqueIndex"`
+	UserId       int    `json:"-" gorm:"index"`
+	Ip           string `json:"ip"`
+	UserAgent    string `json:"userAgent"`
+	CreatedAt    int64  `json:"createdAt"`
+	LastActiveAt int64  `json:"lastActiveAt"`
+	ExpiresAt    int64  `json:"expiresAt"`
+
+	// A remember-me session outlives ExpiresAt through its refresh token, bound
+	// to the device it was issued to and rotated on every refresh until
+	// RefreshExpiresAt
+	RememberMe       bool   `json:"rememberMe"`
+	RefreshHash      string `json:"-" gorm:"size:255;index"`
+	DeviceHash       string `json:"-"`
+	RefreshExpiresAt int64  `json:"refreshExpiresAt"`
+	RefreshedAt      int64  `json:"refreshedAt"`
+}
+
+// RotatedRefreshToken is a refresh token of a remember-me session that was
+// replaced by a newer one, kept to tell when it is presented again.
+type RotatedRefreshToken struct {
+	Id        int    `json:"id" gorm:"primaryKey;autoIncrement"`
+	TokenHash string `json:"-" gorm:"size:255;uniqueIndex"`
+	SessionId int    `json:"sessionId" gorm:"index"`
+	RotatedAt int64  `json:"rotatedAt"`
+	ExpiresAt int64  `json:"expiresAt"`
+}
+
+// TelegramUser is a Telegram user the bot has heard from, to find the chat id
+// of a @username. Username is lowercase, as Telegram doesn't tell them apart by
+// case.
+type TelegramUser struct {
+	Id        int64  `json:"id" gorm:"primaryKey;autoIncrement:false"`
+	Username  string `json:"username" gorm:"index"`
+	FirstName string `json:"firstName"`
+	SeenAt    int64  `json:"seenAt"`
+}
+
+// AuditLog records a change made through the panel or the API. Diff is a JSON
+// object of the changed fields as [old, new] pairs, with secrets redacted.
+type AuditLog struct {
+	Id         int    `json:"id" gorm:"primaryKey;autoIncrement"`
+	CreatedAt  int64  `json:"createdAt" gorm:"index"`
+	Actor      string `json:"actor"`
+	Action     string `json:"action"`
+	EntityType string `json:"entityType" gorm:"index:idx_audit_entity"`
+	EntityId   string `json:"entityId" gorm:"index:idx_audit_entity"`
+	Ip         string `json:"ip"`
+	Success    bool   `json:"success"`
+	Diff       string `json:"diff,omitempty"`
+}
+
+// SubAccess is a fetch of a subscription: the clients it listed, where it was
+// fetched from, by which app and on which device, by the label of its URL if it
+// has one. Emails is ",email1,email2," for querying.
+type SubAccess struct {
+	Id        int      `json:"id" gorm:"primaryKey;autoIncrement"`
+	SubId     string   `json:"subId" gorm:"index:idx_sub_access_sub"`
+	Emails    string   `json:"-"`
+	Clients   []string `json:"emails" gorm:"-"`
+	Ip        string   `json:"ip"`
+	UserAgent string   `json:"userAgent"`
+	Device    string   `json:"device,omitempty" gorm:"not null;default:''"`
+	CreatedAt int64    `json:"createdAt" gorm:"index;index:idx_sub_access_sub"`
+}
+
+// InboundTemplate is a named inbound without port and remark, to create inbounds
+// from. Its settings have no clients. The built-in templates are not stored and
+// have negative ids.
+type InboundTemplate struct {
+	Id      int    `json:"id" form:"id" gorm:"primaryKey;autoIncrement"`
+	Name    string `json:"name" form:"name" gorm:"unique"`
+	Builtin bool   `json:"builtin" form:"builtin" gorm:"-"`
+	// NewReality generates a new Reality key pair for every inbound created from
+	// the template, instead of reusing the one of the template
+	NewReality     bool     `json:"newReality" form:"newReality"`
+	Listen         string   `json:"listen" form:"listen"`
+	Protocol       Protocol `json:"protocol" form:"protocol"`
+	Settings       string   `json:"settings" form:"settings"`
+	StreamSettings string   `json:"streamSettings" form:"streamSettings"`
+	Sniffing       string   `json:"sniffing" form:"sniffing"`
+	Allocate       string   `json:"allocate" form:"allocate"`
+	RemarkTemplate string   `json:"remarkTemplate" form:"remarkTemplate"`
+	CreatedAt      int64    `json:"createdAt" form:"createdAt"`
+}
+
+// ClientRenewal remembers a renewal made with an idempotency key, so that a
+// retried request returns the same result instead of renewing again.
+type ClientRenewal struct {
+	Id        int    `json:"id" gorm:"primaryKey;autoIncrement"`
+	Key       string `json:"key" gorm:"unique"`
+	Email     string `json:"email"`
+	Result    string `json:"result"`
+	CreatedAt int64  `json:"createdAt" gorm:"index"`
+}
+
+// Kinds of the entries of the trash.
+const (
+	TrashInbound = "inbound"
+	TrashClient  = "client"
+)
+
+// TrashEntry is a deleted inbound, with its clients and their traffic, or a
+// deleted client of an inbound, kept to be restored until it is purged. Data is
+// the JSON of what was deleted.
+type TrashEntry struct {
+	Id        int    `json:"id" gorm:"primaryKey;autoIncrement"`
+	Kind      string `json:"kind"`
+	InboundId int    `json:"inboundId"`
+	Remark    string `json:"remark"`
+	Port      int    `json:"port"`
+	// Email is the email of a deleted client, Clients the number of clients
+	// of a deleted inbound
+	Email     string `json:"email,omitempty"`
+	Clients   int    `json:"clients,omitempty"`
+	Data      string `json:"-"`
+	DeletedAt int64  `json:"deletedAt" gorm:"index"`
+	DeletedBy string `json:"deletedBy"`
+}
+
+// TrafficHistory is the usage of a client in a period that ended with a
+// scheduled traffic reset.
+type TrafficHistory struct {
+	Id          int    `json:"id" gorm:"primaryKey;autoIncrement"`
+	InboundId   int    `json:"inboundId"`
+	Email       string `json:"email" gorm:"index"`
+	Up          int64  `json:"up"`
+	Down        int64  `json:"down"`
+	Total       int64  `json:"total"`
+	PeriodStart int64  `json:"periodStart"`
+	PeriodEnd   int64  `json:"periodEnd" gorm:"index"`
+	// CarriedIn is the part of Total carried over from the period before, and
+	// CarriedOver what the reset carried over of it to the next one
+	CarriedIn   int64 `json:"carriedIn"`
+	CarriedOver int64 `json:"carriedOver"`
+}
+
+// The entities the traffic history is kept for.
+const (
+	TrafficEntityInbound = "inbound"
+	TrafficEntityClient  = "client"
+	TrafficEntityPanel   = "panel"
+)
+
+// HourlyTraffic is the traffic an inbound, a client or the whole panel made
+// within an hour, for the charts of the traffic history. EntityId is the id of
+// the inbound, the email of the client, or empty for the panel.
+//
+// The primary key serves the series of an entity over a range of hours, the
+// index on Hour the pruning of the hours past the retention.
+type HourlyTraffic struct {
+	Entity   string `json:"entity" gorm:"primaryKey"`
+	EntityId string `json:"entityId" gorm:"primaryKey"`
+	Hour     int64  `json:"hour" gorm:"primaryKey;autoIncrement:false;index"`
+	Up       int64  `json:"up"`
+	Down     int64  `json:"down"`
+}
+
+func (HourlyTraffic) TableName() string {
+	return "traffic_history"
+}
+
+// StatusMinute is the status of the server averaged over a minute, for the
+// charts of the status history. Minute is when it started, in milliseconds;
+// the rates are in bytes per second.
+type StatusMinute struct {
+	Minute   int64   `json:"minute" gorm:"primaryKey;autoIncrement:false"`
+	Cpu      float64 `json:"cpu"`
+	Mem      int64   `json:"mem"`
+	Swap     int64   `json:"swap"`
+	Disk     int64   `json:"disk"`
+	NetUp    int64   `json:"netUp"`
+	NetDown  int64   `json:"netDown"`
+	TcpCount int     `json:"tcpCount"`
+	XrayMem  int64   `json:"xrayMem"`
+}
+
+func (StatusMinute) TableName() string {
+	return "status_history"
+}
+
+// GeoDay is the connections a client made from a country within a day and the
+// traffic it made from there, for the geo stats. Day is when it started, in
+// milliseconds; Country is the ISO code, empty if the database doesn't know
+// the addresses. The addresses themselves are not kept.
+type GeoDay struct {
+	Day         int64  `json:"day" gorm:"primaryKey;autoIncrement:false;index"`
+	Country     string `json:"country" gorm:"primaryKey"`
+	Email       string `json:"email" gorm:"primaryKey"`
+	Connections int64  `json:"connections"`
+	Up          int64  `json:"up"`
+	Down        int64  `json:"down"`
+}
+
+func (GeoDay) TableName() string {
+	return "geo_stats"
+}
+
+// XrayCounterStarted is the name of the XrayCounter holding when the Xray
+// process the counters were read from started, in milliseconds.
+const XrayCounterStarted = "xray>>>started"
+
+// XrayCounter is the last value of a stat counter of Xray counted as traffic,
+// so that a restart of the panel goes on from it instead of counting the
+// traffic again.
+type XrayCounter struct {
+	Name  string `json:"name" gorm:"primaryKey"`
+	Value int64  `json:"value"`
 }
 
 type HistoryOfSeeders struct {
@@ -67,16 +551,48 @@ type HistoryOfSeeders struct {
 	SeederName string `json:"seederName"`
 }
 
+// PortRange returns the first and the last port the inbound listens on, the
+// same for a single port.
+func (i *Inbound) PortRange() (int, int) {
+	if i.PortEnd > i.Port {
+		return i.Port, i.PortEnd
+	}
+	return i.Port, i.Port
+}
+
+// PortString returns the port of the inbound as Xray takes it, "start-end" for a
+// port range.
+func (i *Inbound) PortString() string {
+	if start, end := i.PortRange(); start != end {
+		return fmt.Sprintf("%d-%d", start, end)
+	}
+	return strconv.Itoa(i.Port)
+}
+
+// ClientPort returns the port of the range of the inbound that the links of the
+// client with email connect to. It is picked from the email, so it stays the
+// same.
+func (i *Inbound) ClientPort(email string) int {
+	start, end := i.PortRange()
+	hash := fnv.New32a()
+	hash.Write([]byte(email))
+	return start + int(hash.Sum32()%uint32(end-start+1))
+}
+
 func (i *Inbound) GenXrayInboundConfig() *xray.InboundConfig {
 	listen := i.Listen
 	if listen != "" {
 		listen = fmt.Sprintf("\"%v\"", listen)
 	}
+	port := strconv.Itoa(i.Port)
+	if i.PortEnd > i.Port {
+		port = fmt.Sprintf("\"%v\"", i.PortString())
+	}
 	return &xray.InboundConfig{
 		Listen:         json_util.RawMessage(listen),
-		Port:           i.Port,
+		Port:           json_util.RawMessage(port),
 		Protocol:       string(i.Protocol),
-		Settings:       json_util.RawMessage(i.Settings),
+		Settings:       json_util.RawMessage(i.xraySettings()),
 		StreamSettings: json_util.RawMessage(i.StreamSettings),
 		Tag:            i.Tag,
 		Sniffing:       json_util.RawMessage(i.Sniffing),
@@ -84,6 +600,170 @@ func (i *Inbound) GenXrayInboundConfig() *xray.InboundConfig {
 	}
 }
 
+// wireguardPeerKeys are the fields of the clients of a WireGuard inbound Xray
+// takes for its peers.
+var wireguardPeerKeys = []string{"publicKey", "preSharedKey", "allowedIPs", "keepAlive"}
+
+// xraySettings returns the settings of the inbound for Xray. A WireGuard inbound
+// keeps its peers as clients, with the fields of the panel; Xray gets those
+// enabled as peers.
+func (i *Inbound) xraySettings() string {
+	if i.Protocol != WireGuard {
+		return i.Settings
+	}
+	settings := map[string]any{}
+	if err := json.Unmarshal([]byte(i.Settings), &settings); err != nil {
+		return i.Settings
+	}
+	// The settings of before the clients have their peers for Xray
+	if _, ok := settings["clients"]; !ok {
+		return i.Settings
+	}
+	clients, _ := settings["clients"].([]any)
+	peers := make([]any, 0, len(clients))
+	for _, item := range clients {
+		client, ok := item.(map[string]any)
+		if !ok {
+			continue
+		}
+		if enable, ok := client["enable"].(bool); ok && !enable {
+			continue
+		}
+		peer := map[string]any{}
+		for _, key := range wireguardPeerKeys {
+			if value, ok := client[key]; ok {
+				peer[key] = value
+			}
+		}
+		peers = append(peers, peer)
+	}
+	delete(settings, "clients")
+	delete(settings, "subnet")
+	settings["peers"] = peers
+	data, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return i.Settings
+	}
+	return string(data)
+}
+
+// Outbound is an outbound of Xray kept by the panel, added to the generated config
+// after the outbounds of the config template.
+type Outbound struct {
+	Id             int    `json:"id" form:"id" gorm:"primaryKey;autoIncrement"`
+	Tag            string `json:"tag" form:"tag" gorm:"unique"`
+	Protocol       string `json:"protocol" form:"protocol"`
+	SendThrough    string `json:"sendThrough" form:"sendThrough"`
+	Settings       string `json:"settings" form:"settings"`
+	StreamSettings string `json:"streamSettings" form:"streamSettings"`
+	Mux            string `json:"mux" form:"mux"`
+	UpdatedAt      int64  `json:"updatedAt" form:"-" gorm:"autoUpdateTime:milli"`
+}
+
+// GenXrayOutboundConfig returns the config of the outbound for Xray.
+func (o *Outbound) GenXrayOutboundConfig() map[string]any {
+	config := map[string]any{
+		"tag":      o.Tag,
+		"protocol": o.Protocol,
+		"settings": json_util.RawMessage(o.Settings),
+	}
+	if o.SendThrough != "" {
+		config["sendThrough"] = o.SendThrough
+	}
+	if o.StreamSettings != "" {
+		config["streamSettings"] = json_util.RawMessage(o.StreamSettings)
+	}
+	if o.Mux != "" {
+		config["mux"] = json_util.RawMessage(o.Mux)
+	}
+	return config
+}
+
+// RoutingRule is a routing rule of Xray kept by the panel. The rules are added to
+// the generated config by position, after those of the config template.
+type RoutingRule struct {
+	Id         int      `json:"id" form:"id" gorm:"primaryKey;autoIncrement"`
+	Position   int      `json:"position" form:"-"`
+	Remark     string   `json:"remark" form:"remark"`
+	Domain     []string `json:"domain,omitempty" form:"domain" gorm:"serializer:json"`
+	Ip         []string `json:"ip,omitempty" form:"ip" gorm:"serializer:json"`
+	Port       string   `json:"port,omitempty" form:"port"`
+	SourcePort string   `json:"sourcePort,omitempty" form:"sourcePort"`
+	Network    string   `json:"network,omitempty" form:"network"`
+	Protocol   []string `json:"protocol,omitempty" form:"protocol" gorm:"serializer:json"`
+	InboundTag []string `json:"inboundTag,omitempty" form:"inboundTag" gorm:"serializer:json"`
+	// User are the emails of the clients the rule applies to
+	User        []string `json:"user,omitempty" form:"user" gorm:"serializer:json"`
+	OutboundTag string   `json:"outboundTag,omitempty" form:"outboundTag"`
+	BalancerTag string   `json:"balancerTag,omitempty" form:"balancerTag"`
+}
+
+// GenXrayRuleConfig returns the config of the rule for Xray.
+func (r *RoutingRule) GenXrayRuleConfig() map[string]any {
+	config := map[string]any{"type": "field"}
+	for key, value := range map[string][]string{
+		"domain":     r.Domain,
+		"ip":         r.Ip,
+		"protocol":   r.Protocol,
+		"inboundTag": r.InboundTag,
+		"user":       r.User,
+	} {
+		if len(value) > 0 {
+			config[key] = value
+		}
+	}
+	for key, value := range map[string]string{
+		"port":        r.Port,
+		"sourcePort":  r.SourcePort,
+		"network":     r.Network,
+		"outboundTag": r.OutboundTag,
+		"balancerTag": r.BalancerTag,
+	} {
+		if value != "" {
+			config[key] = value
+		}
+	}
+	return config
+}
+
+// Balancer is a balancer of Xray kept by the panel, sending the traffic of the
+// routing rules to it to one of the outbounds its selector matches.
+type Balancer struct {
+	Id  int    `json:"id" form:"id" gorm:"primaryKey;autoIncrement"`
+	Tag string `json:"tag" form:"tag" gorm:"unique"`
+	// Selector are prefixes of the tags of the outbounds of the balancer
+	Selector []string `json:"selector" form:"selector" gorm:"serializer:json"`
+	// Strategy is random, roundRobin, leastPing or leastLoad
+	Strategy    string `json:"strategy" form:"strategy"`
+	FallbackTag string `json:"fallbackTag,omitempty" form:"fallbackTag"`
+}
+
+// GenXrayBalancerConfig returns the config of the balancer for Xray.
+func (b *Balancer) GenXrayBalancerConfig() map[string]any {
+	config := map[string]any{
+		"tag":      b.Tag,
+		"selector": b.Selector,
+		"strategy": map[string]any{"type": b.Strategy},
+	}
+	if b.FallbackTag != "" {
+		config["fallbackTag"] = b.FallbackTag
+	}
+	return config
+}
+
+// Sniffing is the sniffing of an inbound, as Xray takes it.
+type Sniffing struct {
+	Enabled bool `json:"enabled"`
+	// DestOverride lists the sniffed protocols: http, tls, quic, fakedns and
+	// fakedns+others
+	DestOverride []string `json:"destOverride"`
+	MetadataOnly bool     `json:"metadataOnly"`
+	RouteOnly    bool     `json:"routeOnly"`
+	// DomainsExcluded are the domains not overridden, in the format of routing
+	// rules
+	DomainsExcluded []string `json:"domainsExcluded,omitempty"`
+}
+
 type Setting struct {
 	Id    int    `json:"id" form:"id" gorm:"primaryKey;autoIncrement"`
 	Key   string `json:"key" form:"key"`
@@ -104,4 +784,206 @@ type Client struct {
 	SubID      string `json:"subId" form:"subId"`
 	Comment    string `json:"comment" form:"comment"`
 	Reset      int    `json:"reset" form:"reset"`
+	// Tags are lowercase labels to select clients by
+	Tags []string `json:"tags,omitempty" form:"tags"`
+	// ResetPolicy zeroes the traffic daily, weekly or monthly
+	ResetPolicy string `json:"resetPolicy,omitempty" form:"resetPolicy"`
+	// ResetDay is the weekday of weekly resets, 1 for Monday to 7 for Sunday,
+	// or the day of the month of monthly ones, moved to the last day of
+	// shorter months
+	ResetDay int `json:"resetDay,omitempty" form:"resetDay"`
+	// CarryOver adds the unused traffic of a period to the quota of the next
+	// on a scheduled reset, up to CarryCapGB bytes if it is above 0
+	CarryOver  bool  `json:"carryOver,omitempty" form:"carryOver"`
+	CarryCapGB int64 `json:"carryCapGB,omitempty" form:"carryCapGB"`
+	// ExcludeFromSub leaves the client out of the subscription of its subId,
+	// for devices with a static config
+	ExcludeFromSub bool `json:"excludeFromSub,omitempty" form:"excludeFromSub"`
+	// SubUpdates is how often apps update the subscription of the client, in
+	// hours, instead of the interval of the settings
+	SubUpdates int `json:"subUpdates,omitempty" form:"subUpdates"`
+	// SubAggregate merges the remote subscriptions of the settings into the
+	// subscription of the client, as ?aggregate=1 does
+	SubAggregate bool `json:"subAggregate,omitempty" form:"subAggregate"`
+	// OutboundTag sends the traffic of the client to the outbound with the
+	// tag, before the routing rules
+	OutboundTag string `json:"outboundTag,omitempty" form:"outboundTag"`
+	// LinkOptions override the ClientDefaults of the inbound in the links and
+	// subscriptions of the client
+	LinkOptions *LinkOptions `json:"linkOptions,omitempty" form:"-"`
+	// The keys and addresses of a peer of a WireGuard inbound; the private key
+	// is kept for the config of the peer, Xray only gets the public one
+	PrivateKey   string   `json:"privateKey,omitempty" form:"privateKey"`
+	PublicKey    string   `json:"publicKey,omitempty" form:"publicKey"`
+	PreSharedKey string   `json:"preSharedKey,omitempty" form:"preSharedKey"`
+	AllowedIPs   []string `json:"allowedIPs,omitempty" form:"allowedIPs"`
+	KeepAlive    int      `json:"keepAlive,omitempty" form:"keepAlive"`
+}
+
+// LinkOptions tune the configurations the links and subscriptions give clients,
+// without being part of the config of Xray. The fields left unset keep what the
+// stream settings of the inbound give. The formats that can't express a field
+// leave it out: mux.cool is only in the Xray JSON subscription, and the gRPC
+// multi mode is not in the Clash and sing-box ones.
+type LinkOptions struct {
+	// Mux enables or disables mux.cool, with MuxConcurrency sub-connections,
+	// 0 for the default of Xray; a concurrency alone enables it
+	Mux            *bool `json:"mux,omitempty"`
+	MuxConcurrency int   `json:"muxConcurrency,omitempty"`
+	// ALPN, Fingerprint and AllowInsecure are those of TLS; Fingerprint is
+	// the one of REALITY too
+	ALPN          []string `json:"alpn,omitempty"`
+	Fingerprint   string   `json:"fingerprint,omitempty"`
+	AllowInsecure *bool    `json:"allowInsecure,omitempty"`
+	// WSEarlyData is the size of the early data of WebSocket, sent in the
+	// WSEarlyDataHeader header; links can only send it in
+	// Sec-WebSocket-Protocol, the default
+	WSEarlyData       int    `json:"wsEarlyData,omitempty"`
+	WSEarlyDataHeader string `json:"wsEarlyDataHeader,omitempty"`
+	GRPCMultiMode     *bool  `json:"grpcMultiMode,omitempty"`
+}
+
+// Merge returns the options with the fields override sets replacing them.
+func (o LinkOptions) Merge(override *LinkOptions) LinkOptions {
+	if override == nil {
+		return o
+	}
+	if override.Mux != nil {
+		o.Mux = override.Mux
+	}
+	if override.MuxConcurrency != 0 {
+		o.MuxConcurrency = override.MuxConcurrency
+	}
+	if len(override.ALPN) > 0 {
+		o.ALPN = override.ALPN
+	}
+	if override.Fingerprint != "" {
+		o.Fingerprint = override.Fingerprint
+	}
+	if override.AllowInsecure != nil {
+		o.AllowInsecure = override.AllowInsecure
+	}
+	if override.WSEarlyData != 0 {
+		o.WSEarlyData = override.WSEarlyData
+		o.WSEarlyDataHeader = override.WSEarlyDataHeader
+	}
+	if override.GRPCMultiMode != nil {
+		o.GRPCMultiMode = override.GRPCMultiMode
+	}
+	return o
+}
+
+// The states of a webhook delivery.
+const (
+	WebhookPending   = "pending"
+	WebhookDelivered = "delivered"
+	WebhookFailed    = "failed"
+)
+
+// WebhookDelivery is an event queued for a webhook, and how its last attempt
+// went. Payload is the JSON body that is posted, the same on every attempt.
+type WebhookDelivery struct {
+	Id      int    `json:"id" gorm:"primaryKey;autoIncrement"`
+	Webhook string `json:"webhook"`
+	Event   string `json:"event"`
+	EventId string `json:"eventId"`
+	Url     string `json:"url"`
+	Payload string `json:"payload"`
+	Status  string `json:"status" gorm:"index:idx_webhook_due"`
+	// Attempts is how many times it was posted, NextAttemptAt when it is due
+	// again while pending
+	Attempts      int    `json:"attempts"`
+	NextAttemptAt int64  `json:"nextAttemptAt" gorm:"index:idx_webhook_due"`
+	ResponseCode  int    `json:"responseCode"`
+	Error         string `json:"error,omitempty"`
+	CreatedAt     int64  `json:"createdAt" gorm:"index"`
+	LastAttemptAt int64  `json:"lastAttemptAt"`
+}
+
+// CrashReport is an exit of Xray the panel didn't ask for, at Time in ms.
+// Stderr is the end of what Xray wrote to stderr, Uptime how long it ran in
+// seconds; Attempt is the restart it led to, and Restarted whether Xray came
+// back up with it.
+type CrashReport struct {
+	Id        int    `json:"id" gorm:"primaryKey;autoIncrement"`
+	Time      int64  `json:"time" gorm:"index"`
+	ExitCode  int    `json:"exitCode"`
+	Signal    string `json:"signal,omitempty"`
+	Uptime    int64  `json:"uptime"`
+	Version   string `json:"version"`
+	Stderr    string `json:"stderr"`
+	Attempt   int    `json:"attempt"`
+	Restarted bool   `json:"restarted"`
+}
+
+// The policies of a node for the inbounds changed on it since they were last
+// pushed.
+const (
+	// NodeMasterWins pushes the inbound of the panel over the change
+	NodeMasterWins = "master"
+	// NodeManual keeps the change until a conflict is resolved
+	NodeManual = "manual"
+)
+
+// Node is a remote panel the inbounds and the clients of the panel are pushed
+// to through its API, and the traffic of the clients pulled back from.
+type Node struct {
+	Id   int    `json:"id" form:"id" gorm:"primaryKey;autoIncrement"`
+	Name string `json:"name" form:"name" gorm:"unique"`
+	// ApiUrl is the URL of the node panel, with its base path
+	ApiUrl string `json:"apiUrl" form:"apiUrl"`
+	// Token is an admin API token of the node, stored encrypted
+	Token  string `json:"token" form:"token"`
+	Enable bool   `json:"enable" form:"enable"`
+	// Inbounds are the tags of the inbounds pushed to the node, all of them
+	// for none
+	Inbounds       []string `json:"inbounds" form:"inbounds" gorm:"serializer:json"`
+	ConflictPolicy string   `json:"conflictPolicy" form:"conflictPolicy"`
+
+	// The health of the node as of its last sync, Latency in milliseconds
+	Healthy    bool   `json:"healthy" form:"-"`
+	XrayState  string `json:"xrayState,omitempty" form:"-"`
+	Latency    int64  `json:"latency" form:"-"`
+	LastError  string `json:"lastError,omitempty" form:"-"`
+	LastSyncAt int64  `json:"lastSyncAt" form:"-"`
+	// Conflicts counts the inbounds with an open conflict, in node lists
+	Conflicts int `json:"conflicts" form:"-" gorm:"-"`
+}
+
+// NodeInbound is an inbound of the panel as last pushed to a node: the hashes
+// of what was pushed and of what the node had after, and the traffic counters
+// of the node as last pulled. Conflict is the hash of the inbound changed on
+// the node while the conflict is open.
+type NodeInbound struct {
+	Id         int    `json:"id" gorm:"primaryKey;autoIncrement"`
+	NodeId     int    `json:"nodeId" gorm:"uniqueIndex:idx_node_inbound"`
+	Tag        string `json:"tag" gorm:"uniqueIndex:idx_node_inbound"`
+	Pushed     string `json:"-"`
+	Remote     string `json:"-"`
+	Conflict   string `json:"-"`
+	ConflictAt int64  `json:"conflictAt,omitempty"`
+	PushedAt   int64  `json:"pushedAt"`
+	Up         int64  `json:"up"`
+	Down       int64  `json:"down"`
+}
+
+// NodeClientTraffic is the traffic of a client on a node as last pulled.
+type NodeClientTraffic struct {
+	Id     int    `json:"id" gorm:"primaryKey;autoIncrement"`
+	NodeId int    `json:"nodeId" gorm:"uniqueIndex:idx_node_client"`
+	Email  string `json:"email" gorm:"uniqueIndex:idx_node_client"`
+	Up     int64  `json:"up"`
+	Down   int64  `json:"down"`
+}
+
+// Trial is a trial client handed out by the public trial endpoint, with the IP
+// it went to, by the source it counts as, and the Telegram user that confirmed
+// it, for the daily caps and the cooldown.
+type Trial struct {
+	Id        int    `json:"id" gorm:"primaryKey;autoIncrement"`
+	Email     string `json:"email"`
+	Ip        string `json:"ip"`
+	Source    string `json:"source" gorm:"index"`
+	TgId      int64  `json:"tgId" gorm:"index"`
+	CreatedAt int64  `json:"createdAt" gorm:"index"`
 }
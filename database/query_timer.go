@@ -0,0 +1,101 @@
+package database
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const queryStartKey = "xui:query_start"
+
+// QueryTimer adds up the time taken by the queries made with a context that
+// carries it, see WithQueryTimer.
+type QueryTimer struct {
+	nanos   atomic.Int64
+	queries atomic.Int64
+}
+
+type queryTimerKey struct{}
+
+// WithQueryTimer returns ctx carrying a new QueryTimer, for the queries made
+// with db.WithContext of the returned context to be timed.
+func WithQueryTimer(ctx context.Context) (context.Context, *QueryTimer) {
+	timer := &QueryTimer{}
+	return context.WithValue(ctx, queryTimerKey{}, timer), timer
+}
+
+// QueryTimerOf returns the QueryTimer ctx carries, or nil.
+func QueryTimerOf(ctx context.Context) *QueryTimer {
+	if ctx == nil {
+		return nil
+	}
+	timer, _ := ctx.Value(queryTimerKey{}).(*QueryTimer)
+	return timer
+}
+
+// Duration returns the time taken by the timed queries.
+func (t *QueryTimer) Duration() time.Duration {
+	return time.Duration(t.nanos.Load())
+}
+
+// Queries returns how many queries were timed.
+func (t *QueryTimer) Queries() int64 {
+	return t.queries.Load()
+}
+
+// watchQueryTime times the statements of db made with a context carrying a
+// QueryTimer. The others only pay for the look up of the context.
+func watchQueryTime(db *gorm.DB) error {
+	before := func(tx *gorm.DB) {
+		if QueryTimerOf(tx.Statement.Context) != nil {
+			tx.InstanceSet(queryStartKey, time.Now())
+		}
+	}
+	after := func(tx *gorm.DB) {
+		timer := QueryTimerOf(tx.Statement.Context)
+		if timer == nil {
+			return
+		}
+		if start, ok := tx.InstanceGet(queryStartKey); ok {
+			timer.nanos.Add(int64(time.Since(start.(time.Time))))
+			timer.queries.Add(1)
+		}
+	}
+	callbacks := db.Callback()
+	if err := callbacks.Create().Before("gorm:create").Register("xui:query_start", before); err != nil {
+		return err
+	}
+	if err := callbacks.Create().After("gorm:create").Register("xui:query_end", after); err != nil {
+		return err
+	}
+	if err := callbacks.Query().Before("gorm:query").Register("xui:query_start", before); err != nil {
+		return err
+	}
+	if err := callbacks.Query().After("gorm:query").Register("xui:query_end", after); err != nil {
+		return err
+	}
+	if err := callbacks.Update().Before("gorm:update").Register("xui:query_start", before); err != nil {
+		return err
+	}
+	if err := callbacks.Update().After("gorm:update").Register("xui:query_end", after); err != nil {
+		return err
+	}
+	if err := callbacks.Delete().Before("gorm:delete").Register("xui:query_start", before); err != nil {
+		return err
+	}
+	if err := callbacks.Delete().After("gorm:delete").Register("xui:query_end", after); err != nil {
+		return err
+	}
+	if err := callbacks.Row().Before("gorm:row").Register("xui:query_start", before); err != nil {
+		return err
+	}
+	if err := callbacks.Row().After("gorm:row").Register("xui:query_end", after); err != nil {
+		return err
+	}
+	if err := callbacks.Raw().Before("gorm:raw").Register("xui:query_start", before); err != nil {
+		return err
+	}
+	return callbacks.Raw().After("gorm:raw").Register("xui:query_end", after)
+}
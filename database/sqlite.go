@@ -0,0 +1,167 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"x-ui/database/model"
+
+	"github.com/mattn/go-sqlite3"
+	"gorm.io/gorm"
+)
+
+// Options are how the database is opened, all but MaxConnections for SQLite
+// only. They are read from the settings of the panel, so a change applies once
+// it restarts.
+type Options struct {
+	// JournalMode is WAL, DELETE or TRUNCATE
+	JournalMode string
+	// Synchronous is OFF, NORMAL or FULL
+	Synchronous string
+	// BusyTimeout is how long a statement waits for a lock, in milliseconds
+	BusyTimeout int
+	// MaxConnections is how many connections the pool opens at most
+	MaxConnections int
+}
+
+// DefaultOptions let readers run along a writer, and make a writer wait a few
+// seconds for another one instead of failing.
+var DefaultOptions = Options{
+	JournalMode:    "WAL",
+	Synchronous:    "NORMAL",
+	BusyTimeout:    5000,
+	MaxConnections: 8,
+}
+
+const (
+	// busyRetries is how many times beginning a transaction is tried again when
+	// the database stays locked past the busy timeout
+	busyRetries = 4
+	// busyBackoff is the wait before the first retry, doubled for each next one
+	busyBackoff = 50 * time.Millisecond
+)
+
+// dsn returns the data source of the database at dbPath with options. Write
+// transactions take the write lock when they begin, so two of them never
+// deadlock upgrading their locks and wait on each other within the timeout.
+// New databases, and older ones once vacuumed, free their pages
+// incrementally, see Optimize.
+func dsn(dbPath string, options Options) string {
+	return fmt.Sprintf("%s?_journal_mode=%s&_synchronous=%s&_busy_timeout=%d&_txlock=immediate&_auto_vacuum=incremental",
+		dbPath, options.JournalMode, options.Synchronous, options.BusyTimeout)
+}
+
+// readOptions returns the options of the settings, the default options
+// for those not set.
+func readOptions() (Options, error) {
+	options := DefaultOptions
+	var settings []model.Setting
+	err := db.Model(model.Setting{}).
+		Where(map[string]any{"key": []string{"dbJournalMode", "dbSynchronous", "dbBusyTimeout", "dbMaxConnections"}}).
+		Find(&settings).Error
+	if err != nil {
+		return options, err
+	}
+	for _, setting := range settings {
+		switch setting.Key {
+		case "dbJournalMode":
+			options.JournalMode = setting.Value
+		case "dbSynchronous":
+			options.Synchronous = setting.Value
+		case "dbBusyTimeout":
+			if timeout, err := strconv.Atoi(setting.Value); err == nil {
+				options.BusyTimeout = timeout
+			}
+		case "dbMaxConnections":
+			if connections, err := strconv.Atoi(setting.Value); err == nil && connections > 0 {
+				options.MaxConnections = connections
+			}
+		}
+	}
+	return options, nil
+}
+
+func setPool(options Options) error {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	sqlDB.SetMaxOpenConns(options.MaxConnections)
+	sqlDB.SetMaxIdleConns(options.MaxConnections)
+	return nil
+}
+
+// IsBusy tells if err is SQLite failing to get a lock on the database.
+func IsBusy(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && (sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked)
+}
+
+// retryBusy runs do until it isn't failing on a locked database, waiting a
+// jittered backoff between the tries.
+func retryBusy(do func() error) error {
+	backoff := busyBackoff
+	for try := 0; ; try++ {
+		err := do()
+		if try == busyRetries || !IsBusy(err) {
+			return err
+		}
+		time.Sleep(backoff/2 + rand.N(backoff))
+		backoff *= 2
+	}
+}
+
+// Begin begins a write transaction, tried again while the database is locked.
+func Begin() *gorm.DB {
+	var tx *gorm.DB
+	retryBusy(func() error {
+		tx = db.Begin()
+		return tx.Error
+	})
+	return tx
+}
+
+// Transaction runs fn in a write transaction begun by Begin, committed if fn
+// returns no error and rolled back otherwise. fn runs once.
+func Transaction(fn func(tx *gorm.DB) error) error {
+	tx := Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			tx.Rollback()
+		}
+	}()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	committed = true
+	return tx.Commit().Error
+}
+
+// Backup returns a copy of the database with every committed write, made with
+// VACUUM INTO so that the writes still in the WAL are included. Other databases
+// are backed up with their own tools.
+func Backup() ([]byte, error) {
+	if !IsSQLite() {
+		return nil, ErrNotSQLite
+	}
+	defer LockFile()()
+	dir, err := os.MkdirTemp("", "x-ui-backup-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	backupPath := filepath.Join(dir, "x-ui.db")
+	if err := retryBusy(func() error { return db.Exec("VACUUM INTO ?", backupPath).Error }); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(backupPath)
+}
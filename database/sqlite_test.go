@@ -0,0 +1,178 @@
+package database
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"x-ui/database/model"
+
+	"github.com/mattn/go-sqlite3"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func testDB(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "x-ui.db")
+	if err := InitDB(path); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { CloseDB() })
+	return path
+}
+
+func TestSQLiteOptions(t *testing.T) {
+	path := testDB(t)
+	var journalMode string
+	if err := db.Raw("PRAGMA journal_mode").Scan(&journalMode).Error; err != nil {
+		t.Fatal(err)
+	}
+	if journalMode != "wal" {
+		t.Errorf("journal mode %s, want wal", journalMode)
+	}
+	var timeout int
+	if err := db.Raw("PRAGMA busy_timeout").Scan(&timeout).Error; err != nil {
+		t.Fatal(err)
+	}
+	if timeout != DefaultOptions.BusyTimeout {
+		t.Errorf("busy timeout %d, want %d", timeout, DefaultOptions.BusyTimeout)
+	}
+
+	// The settings apply once the database is opened again
+	for key, value := range map[string]string{"dbBusyTimeout": "1234", "dbMaxConnections": "2", "dbSynchronous": "FULL"} {
+		if err := db.Create(&model.Setting{Key: key, Value: value}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	options, err := readOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Options{JournalMode: "WAL", Synchronous: "FULL", BusyTimeout: 1234, MaxConnections: 2}); options != want {
+		t.Errorf("options %+v, want %+v", options, want)
+	}
+	if err := CloseDB(); err != nil {
+		t.Fatal(err)
+	}
+	if err := InitDB(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Raw("PRAGMA busy_timeout").Scan(&timeout).Error; err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, _ := db.DB()
+	if timeout != 1234 || sqlDB.Stats().MaxOpenConnections != 2 {
+		t.Errorf("reopened with busy timeout %d and %d connections", timeout, sqlDB.Stats().MaxOpenConnections)
+	}
+}
+
+func TestRetryBusy(t *testing.T) {
+	busy := sqlite3.Error{Code: sqlite3.ErrBusy}
+	tries := 0
+	err := retryBusy(func() error {
+		if tries++; tries < 3 {
+			return busy
+		}
+		return nil
+	})
+	if err != nil || tries != 3 {
+		t.Errorf("retried %d times to %v, want 3 to none", tries, err)
+	}
+
+	tries = 0
+	other := errors.New("no such table")
+	if err := retryBusy(func() error { tries++; return other }); err != other || tries != 1 {
+		t.Errorf("an error other than busy was retried %d times to %v", tries, err)
+	}
+
+	tries = 0
+	if err := retryBusy(func() error { tries++; return busy }); !IsBusy(err) || tries != busyRetries+1 {
+		t.Errorf("a database staying locked was tried %d times to %v, want %d", tries, err, busyRetries+1)
+	}
+}
+
+// TestConcurrentReadsAndWrites hammers the database with transactions that read
+// before they write, which fail upgrading their locks without _txlock=immediate,
+// along with readers.
+func TestConcurrentReadsAndWrites(t *testing.T) {
+	testDB(t)
+	const workers, operations = 16, 50
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*workers*operations)
+	for w := range workers {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := range operations {
+				errs <- Transaction(func(tx *gorm.DB) error {
+					var count int64
+					if err := tx.Model(model.Setting{}).Where("key LIKE ?", "stress-%").Count(&count).Error; err != nil {
+						return err
+					}
+					key := "stress-" + strconv.Itoa(w) + "-" + strconv.Itoa(i)
+					return tx.Create(&model.Setting{Key: key, Value: strconv.FormatInt(count, 10)}).Error
+				})
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for range operations {
+				var settings []model.Setting
+				errs <- db.Where("key LIKE ?", "stress-%").Limit(100).Find(&settings).Error
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	failed := 0
+	for err := range errs {
+		if err != nil {
+			if failed++; failed <= 5 {
+				t.Error(err)
+			}
+		}
+	}
+	if failed > 0 {
+		t.Errorf("%d of %d operations failed", failed, 2*workers*operations)
+	}
+	var count int64
+	db.Model(model.Setting{}).Where("key LIKE ?", "stress-%").Count(&count)
+	if count != workers*operations {
+		t.Errorf("%d rows written, want %d", count, workers*operations)
+	}
+}
+
+func TestBackupHasWalWrites(t *testing.T) {
+	testDB(t)
+	// The write stays in the WAL, the database file doesn't have it yet
+	if err := db.Create(&model.Setting{Key: "backup-test", Value: "in the wal"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	data, err := Backup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := IsSQLiteDB(bytes.NewReader(data)); !ok || err != nil {
+		t.Fatalf("the backup is not a SQLite database: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "backup.db")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	backup, err := gorm.Open(sqlite.Open(path), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sqlDB, err := backup.DB(); err == nil {
+		defer sqlDB.Close()
+	}
+	var setting model.Setting
+	if err := backup.Where("key = ?", "backup-test").First(&setting).Error; err != nil || setting.Value != "in the wal" {
+		t.Errorf("the backup has %+v, %v", setting, err)
+	}
+}
@@ -0,0 +1,110 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+
+	"gorm.io/gorm"
+)
+
+var (
+	writesLock sync.Mutex
+	writes     = map[string]uint64{}
+	// opens counts the times the database was opened, a restore or an import
+	// changes all of it
+	opens uint64
+)
+
+// Writes returns a number that changes whenever rows of one of tables are
+// created, changed or deleted through the models, for what is built from them
+// to tell whether it is still up to date. The writes of a transaction count
+// once it commits, so what is built before then is not taken for up to date
+// with them. The raw statements of the traffic flushes and the migrations are
+// not counted.
+func Writes(tables ...string) uint64 {
+	writesLock.Lock()
+	defer writesLock.Unlock()
+	count := opens
+	for _, table := range tables {
+		count += writes[table]
+	}
+	return count
+}
+
+// countingPool is the pool of the database beginning the transactions as
+// countingTx.
+type countingPool struct {
+	*sql.DB
+}
+
+func (p countingPool) BeginTx(ctx context.Context, opts *sql.TxOptions) (gorm.ConnPool, error) {
+	tx, err := p.DB.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &countingTx{Tx: tx, db: p.DB, tables: map[string]bool{}}, nil
+}
+
+func (p countingPool) GetDBConn() (*sql.DB, error) {
+	return p.DB, nil
+}
+
+// countingTx is a transaction counting the writes to its tables when it
+// commits.
+type countingTx struct {
+	*sql.Tx
+	db     *sql.DB
+	tables map[string]bool
+}
+
+func (tx *countingTx) Commit() error {
+	if err := tx.Tx.Commit(); err != nil {
+		return err
+	}
+	writesLock.Lock()
+	defer writesLock.Unlock()
+	for table := range tx.tables {
+		writes[table]++
+	}
+	return nil
+}
+
+func (tx *countingTx) GetDBConn() (*sql.DB, error) {
+	return tx.db, nil
+}
+
+// watchWrites counts the writes of db to each table, see Writes.
+func watchWrites(db *gorm.DB) error {
+	writesLock.Lock()
+	opens++
+	writesLock.Unlock()
+
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	db.ConnPool = countingPool{sqlDB}
+	db.Statement.ConnPool = db.ConnPool
+
+	count := func(tx *gorm.DB) {
+		if tx.Error != nil || tx.RowsAffected == 0 || tx.Statement.Table == "" {
+			return
+		}
+		writesLock.Lock()
+		defer writesLock.Unlock()
+		if pending, ok := tx.Statement.ConnPool.(*countingTx); ok {
+			pending.tables[tx.Statement.Table] = true
+			return
+		}
+		writes[tx.Statement.Table]++
+	}
+	callbacks := db.Callback()
+	if err := callbacks.Create().After("gorm:create").Register("xui:count_writes", count); err != nil {
+		return err
+	}
+	if err := callbacks.Update().After("gorm:update").Register("xui:count_writes", count); err != nil {
+		return err
+	}
+	return callbacks.Delete().After("gorm:delete").Register("xui:count_writes", count)
+}
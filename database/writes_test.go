@@ -0,0 +1,46 @@
+package database
+
+import (
+	"testing"
+
+	"x-ui/database/model"
+)
+
+func TestWritesCountOnCommit(t *testing.T) {
+	testDB(t)
+	before, inbounds := Writes("settings"), Writes("inbounds")
+
+	// What is built while a transaction is open is from the rows before it, so
+	// the count it is built with must change once the transaction commits
+	tx := Begin()
+	if err := tx.Create(&model.Setting{Key: "writes-test", Value: "1"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if Writes("settings") != before {
+		t.Error("the writes of a transaction count before it commits")
+	}
+	if err := tx.Commit().Error; err != nil {
+		t.Fatal(err)
+	}
+	committed := Writes("settings")
+	if committed == before {
+		t.Error("the writes of a committed transaction are not counted")
+	}
+
+	tx = Begin()
+	tx.Model(model.Setting{}).Where("key = ?", "writes-test").Update("value", "2")
+	tx.Rollback()
+	if Writes("settings") != committed {
+		t.Error("the writes of a rolled back transaction are counted")
+	}
+
+	if err := db.Model(model.Setting{}).Where("key = ?", "writes-test").Update("value", "3").Error; err != nil {
+		t.Fatal(err)
+	}
+	if Writes("settings") == committed {
+		t.Error("a write out of a transaction is not counted")
+	}
+	if Writes("inbounds") != inbounds {
+		t.Error("the writes to settings are counted for inbounds")
+	}
+}
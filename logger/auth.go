@@ -0,0 +1,106 @@
+package logger
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuthFailRegex matches failed logins in the auth log; <HOST> is the fail2ban
+// placeholder for the offending address.
+const AuthFailRegex = `^\S+ LOGIN FAILURE ip=<HOST> user=".*" reason=\S+$`
+
+// AuthDatePattern tells fail2ban how to read the timestamp at the start of each line.
+const AuthDatePattern = `^%%Y-%%m-%%dT%%H:%%M:%%SZ`
+
+var (
+	authMu  sync.Mutex
+	authLog io.WriteCloser
+	// authFailures counts the failed logins of the last hour by the minute,
+	// authFailureMinutes holding the minute of each count
+	authFailures       [60]int
+	authFailureMinutes [60]int64
+)
+
+// SetAuthLog sets the writer used by Auth, closing the previous one.
+func SetAuthLog(w io.WriteCloser) {
+	authMu.Lock()
+	defer authMu.Unlock()
+	if authLog != nil {
+		authLog.Close()
+	}
+	authLog = w
+}
+
+// Auth writes a login event to the auth log as a single line:
+//
+//	2025-01-02T15:04:05Z LOGIN FAILURE ip=1.2.3.4 user="admin" reason=bad_password
+//
+// Every field is sanitized so user input can't forge extra lines or fields.
+func Auth(success bool, ip string, username string, reason string) {
+	authMu.Lock()
+	defer authMu.Unlock()
+	if !success {
+		minute := time.Now().Unix() / 60
+		if authFailureMinutes[minute%60] != minute {
+			authFailureMinutes[minute%60], authFailures[minute%60] = minute, 0
+		}
+		authFailures[minute%60]++
+	}
+	if authLog == nil {
+		return
+	}
+
+	result := "FAILURE"
+	if success {
+		result = "SUCCESS"
+	}
+	line := fmt.Sprintf("%s LOGIN %s ip=%s user=%s",
+		time.Now().UTC().Format("2006-01-02T15:04:05Z"), result, sanitizeIP(ip), strconv.QuoteToASCII(username))
+	if reason != "" {
+		line += " reason=" + sanitizeToken(reason)
+	}
+	if _, err := io.WriteString(authLog, line+"\n"); err != nil {
+		Debug("write auth log failed:", err)
+	}
+}
+
+// AuthFailures returns how many logins failed in the last hour.
+func AuthFailures() int {
+	authMu.Lock()
+	defer authMu.Unlock()
+	minute := time.Now().Unix() / 60
+	count := 0
+	for i, at := range authFailureMinutes {
+		if minute-at < 60 {
+			count += authFailures[i]
+		}
+	}
+	return count
+}
+
+func sanitizeIP(ip string) string {
+	parsed := net.ParseIP(strings.TrimSpace(ip))
+	if parsed == nil {
+		return "invalid"
+	}
+	return parsed.String()
+}
+
+// sanitizeToken keeps only characters that are safe in an unquoted log field.
+func sanitizeToken(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-' {
+			b.WriteRune(r)
+		}
+	}
+	if b.Len() == 0 {
+		return "unknown"
+	}
+	return b.String()
+}
@@ -0,0 +1,47 @@
+package logger
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+type authTestLog struct{ strings.Builder }
+
+func (l *authTestLog) Close() error { return nil }
+
+func TestAuthFailures(t *testing.T) {
+	authFailures, authFailureMinutes = [60]int{}, [60]int64{}
+	log := &authTestLog{}
+	SetAuthLog(log)
+	defer SetAuthLog(nil)
+
+	for range 3 {
+		Auth(false, "192.0.2.1", "admin", "bad_password")
+	}
+	Auth(true, "192.0.2.1", "admin", "")
+	if n := AuthFailures(); n != 3 {
+		t.Errorf("%d failed logins, want 3", n)
+	}
+	if lines := strings.Count(log.String(), "LOGIN FAILURE"); lines != 3 {
+		t.Errorf("%d failures in the auth log: %s", lines, log.String())
+	}
+
+	// The counts of the minutes of the last hour add up, older ones are left out
+	minute := time.Now().Unix() / 60
+	authMu.Lock()
+	authFailureMinutes[(minute-59)%60], authFailures[(minute-59)%60] = minute-59, 2
+	authFailureMinutes[(minute-30)%60], authFailures[(minute-30)%60] = minute-120, 5
+	authMu.Unlock()
+	if n := AuthFailures(); n != 5 {
+		t.Errorf("%d failed logins in the last hour, want 5", n)
+	}
+	// A minute an hour later starts a count of its own
+	authMu.Lock()
+	authFailureMinutes[minute%60] = minute - 60
+	authMu.Unlock()
+	Auth(false, "192.0.2.1", "admin", "bad_password")
+	if n := AuthFailures(); n != 3 {
+		t.Errorf("%d failed logins after an hour, want 3", n)
+	}
+}
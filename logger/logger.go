@@ -1,16 +1,25 @@
 package logger
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"log/slog"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/op/go-logging"
 )
 
 var (
-	logger    *logging.Logger
-	logBuffer []struct {
+	logger     *logging.Logger
+	jsonLogger *slog.Logger
+	logLevel   logging.Level
+	// bufferLock guards logBuffer, logged to from any goroutine
+	bufferLock sync.Mutex
+	logBuffer  []struct {
 		time  string
 		level logging.Level
 		log   string
@@ -45,60 +54,225 @@ func InitLogger(level logging.Level) {
 	newLogger.SetBackend(backendLeveled)
 
 	logger = newLogger
+	logLevel = level
+	if jsonLogger != nil {
+		jsonLogger = newJSONLogger(level)
+	}
+}
+
+// SetFormat switches the log output between the default "text" format and "json",
+// where every line is a JSON object produced by log/slog.
+func SetFormat(format string) {
+	if format == "json" {
+		jsonLogger = newJSONLogger(logLevel)
+	} else {
+		jsonLogger = nil
+	}
+}
+
+// IsJSON reports whether logs are currently written as JSON.
+func IsJSON() bool {
+	return jsonLogger != nil
+}
+
+const slogLevelNotice = slog.LevelInfo + 2
+
+func newJSONLogger(level logging.Level) *slog.Logger {
+	return slog.New(jsonHandler(os.Stderr, toSlogLevel(level)))
+}
+
+// NewJSONHandler returns a handler that writes records of all levels to w as
+// the JSON lines of the panel log, for the logs kept in their own files.
+func NewJSONHandler(w io.Writer) slog.Handler {
+	return jsonHandler(w, slog.LevelDebug)
+}
+
+func jsonHandler(w io.Writer, level slog.Level) slog.Handler {
+	return slog.NewJSONHandler(w, &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) > 0 {
+				return a
+			}
+			switch a.Key {
+			case slog.TimeKey:
+				a.Key = "ts"
+				a.Value = slog.StringValue(a.Value.Time().UTC().Format(time.RFC3339Nano))
+			case slog.LevelKey:
+				if lvl, ok := a.Value.Any().(slog.Level); ok {
+					a.Value = slog.StringValue(slogLevelName(lvl))
+				}
+			}
+			return a
+		},
+	})
+}
+
+func toSlogLevel(level logging.Level) slog.Level {
+	switch level {
+	case logging.DEBUG:
+		return slog.LevelDebug
+	case logging.INFO:
+		return slog.LevelInfo
+	case logging.NOTICE:
+		return slogLevelNotice
+	case logging.WARNING:
+		return slog.LevelWarn
+	default:
+		return slog.LevelError
+	}
+}
+
+func slogLevelName(level slog.Level) string {
+	switch {
+	case level < slog.LevelInfo:
+		return "DEBUG"
+	case level < slogLevelNotice:
+		return "INFO"
+	case level < slog.LevelWarn:
+		return "NOTICE"
+	case level < slog.LevelError:
+		return "WARNING"
+	default:
+		return "ERROR"
+	}
+}
+
+func logJSON(level logging.Level, msg string, attrs ...slog.Attr) {
+	jsonLogger.LogAttrs(context.Background(), toSlogLevel(level), msg, attrs...)
+}
+
+// sprintln formats args the same way go-logging does for the non-f variants.
+func sprintln(args ...any) string {
+	return strings.TrimSuffix(fmt.Sprintln(args...), "\n")
+}
+
+// LogAttrs writes a message with structured fields. In json mode the fields become
+// keys of the JSON object, in text mode they are appended as key=value pairs.
+func LogAttrs(level logging.Level, msg string, attrs ...slog.Attr) {
+	var b strings.Builder
+	b.WriteString(msg)
+	for _, a := range attrs {
+		b.WriteString(" ")
+		b.WriteString(a.Key)
+		b.WriteString("=")
+		b.WriteString(a.Value.String())
+	}
+	text := b.String()
+	if jsonLogger != nil {
+		logJSON(level, msg, attrs...)
+		addToBuffer(level.String(), text)
+		return
+	}
+
+	switch level {
+	case logging.DEBUG:
+		logger.Debug(text)
+	case logging.INFO:
+		logger.Info(text)
+	case logging.NOTICE:
+		logger.Notice(text)
+	case logging.WARNING:
+		logger.Warning(text)
+	default:
+		logger.Error(text)
+	}
+	addToBuffer(level.String(), text)
 }
 
 func Debug(args ...any) {
-	logger.Debug(args...)
+	if jsonLogger != nil {
+		logJSON(logging.DEBUG, sprintln(args...))
+	} else {
+		logger.Debug(args...)
+	}
 	addToBuffer("DEBUG", fmt.Sprint(args...))
 }
 
 func Debugf(format string, args ...any) {
-	logger.Debugf(format, args...)
+	if jsonLogger != nil {
+		logJSON(logging.DEBUG, fmt.Sprintf(format, args...))
+	} else {
+		logger.Debugf(format, args...)
+	}
 	addToBuffer("DEBUG", fmt.Sprintf(format, args...))
 }
 
 func Info(args ...any) {
-	logger.Info(args...)
+	if jsonLogger != nil {
+		logJSON(logging.INFO, sprintln(args...))
+	} else {
+		logger.Info(args...)
+	}
 	addToBuffer("INFO", fmt.Sprint(args...))
 }
 
 func Infof(format string, args ...any) {
-	logger.Infof(format, args...)
+	if jsonLogger != nil {
+		logJSON(logging.INFO, fmt.Sprintf(format, args...))
+	} else {
+		logger.Infof(format, args...)
+	}
 	addToBuffer("INFO", fmt.Sprintf(format, args...))
 }
 
 func Notice(args ...any) {
-	logger.Notice(args...)
+	if jsonLogger != nil {
+		logJSON(logging.NOTICE, sprintln(args...))
+	} else {
+		logger.Notice(args...)
+	}
 	addToBuffer("NOTICE", fmt.Sprint(args...))
 }
 
 func Noticef(format string, args ...any) {
-	logger.Noticef(format, args...)
+	if jsonLogger != nil {
+		logJSON(logging.NOTICE, fmt.Sprintf(format, args...))
+	} else {
+		logger.Noticef(format, args...)
+	}
 	addToBuffer("NOTICE", fmt.Sprintf(format, args...))
 }
 
 func Warning(args ...any) {
-	logger.Warning(args...)
+	if jsonLogger != nil {
+		logJSON(logging.WARNING, sprintln(args...))
+	} else {
+		logger.Warning(args...)
+	}
 	addToBuffer("WARNING", fmt.Sprint(args...))
 }
 
 func Warningf(format string, args ...any) {
-	logger.Warningf(format, args...)
+	if jsonLogger != nil {
+		logJSON(logging.WARNING, fmt.Sprintf(format, args...))
+	} else {
+		logger.Warningf(format, args...)
+	}
 	addToBuffer("WARNING", fmt.Sprintf(format, args...))
 }
 
 func Error(args ...any) {
-	logger.Error(args...)
+	if jsonLogger != nil {
+		logJSON(logging.ERROR, sprintln(args...))
+	} else {
+		logger.Error(args...)
+	}
 	addToBuffer("ERROR", fmt.Sprint(args...))
 }
 
 func Errorf(format string, args ...any) {
-	logger.Errorf(format, args...)
+	if jsonLogger != nil {
+		logJSON(logging.ERROR, fmt.Sprintf(format, args...))
+	} else {
+		logger.Errorf(format, args...)
+	}
 	addToBuffer("ERROR", fmt.Sprintf(format, args...))
 }
 
 func addToBuffer(level string, newLog string) {
 	t := time.Now()
+	bufferLock.Lock()
 	if len(logBuffer) >= 10240 {
 		logBuffer = logBuffer[1:]
 	}
@@ -113,12 +287,16 @@ func addToBuffer(level string, newLog string) {
 		level: logLevel,
 		log:   newLog,
 	})
+	bufferLock.Unlock()
+	persist(logLevel, newLog)
 }
 
 func GetLogs(c int, level string) []string {
 	var output []string
 	logLevel, _ := logging.LogLevel(level)
 
+	bufferLock.Lock()
+	defer bufferLock.Unlock()
 	for i := len(logBuffer) - 1; i >= 0 && len(output) <= c; i-- {
 		if logBuffer[i].level <= logLevel {
 			output = append(output, fmt.Sprintf("%s %s - %s", logBuffer[i].time, logBuffer[i].level, logBuffer[i].log))
@@ -0,0 +1,171 @@
+package logger
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const backupTimeFormat = "20060102-150405"
+
+// RotatingFile is an io.WriteCloser that appends to a file and rotates it once it
+// grows past MaxSize bytes. Rotated files are renamed to <name>-<timestamp><ext>
+// and pruned by count (MaxBackups) and age (MaxAge); zero disables a limit.
+type RotatingFile struct {
+	Path       string
+	MaxSize    int64
+	MaxBackups int
+	MaxAge     time.Duration
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// NewRotatingFile creates a rotating writer; sizes are in megabytes and age in days.
+func NewRotatingFile(path string, maxSizeMB int, maxBackups int, maxAgeDays int) *RotatingFile {
+	return &RotatingFile{
+		Path:       path,
+		MaxSize:    int64(maxSizeMB) * 1024 * 1024,
+		MaxBackups: maxBackups,
+		MaxAge:     time.Duration(maxAgeDays) * 24 * time.Hour,
+	}
+}
+
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file == nil {
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	if r.MaxSize > 0 && r.size+int64(len(p)) > r.MaxSize && r.size > 0 {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+func (r *RotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(r.Path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(r.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.file = f
+	r.size = info.Size()
+	return nil
+}
+
+func (r *RotatingFile) rotate() error {
+	if r.file != nil {
+		r.file.Close()
+		r.file = nil
+	}
+	ext := filepath.Ext(r.Path)
+	base := strings.TrimSuffix(r.Path, ext)
+	stamp := time.Now().Format(backupTimeFormat)
+	backup := base + "-" + stamp + ext
+	for i := 1; ; i++ {
+		if _, err := os.Stat(backup); err != nil {
+			break
+		}
+		backup = fmt.Sprintf("%s-%s.%d%s", base, stamp, i, ext)
+	}
+	if err := os.Rename(r.Path, backup); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	r.prune()
+	return r.open()
+}
+
+// prune removes rotated files over the count and age limits, oldest first.
+func (r *RotatingFile) prune() {
+	ext := filepath.Ext(r.Path)
+	base := strings.TrimSuffix(r.Path, ext)
+	matches, err := filepath.Glob(base + "-*" + ext)
+	if err != nil {
+		return
+	}
+	// the timestamp suffix sorts chronologically
+	sort.Sort(sort.Reverse(sort.StringSlice(matches)))
+	for i, m := range matches {
+		remove := r.MaxBackups > 0 && i >= r.MaxBackups
+		if !remove && r.MaxAge > 0 {
+			if info, err := os.Stat(m); err == nil && time.Since(info.ModTime()) > r.MaxAge {
+				remove = true
+			}
+		}
+		if remove {
+			os.Remove(m)
+		}
+	}
+}
+
+// TailFile returns the last n lines of the file at path, oldest first.
+func TailFile(path string, n int) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	const chunk = 64 * 1024
+	var buf []byte
+	offset := info.Size()
+	for offset > 0 && bytes.Count(buf, []byte("\n")) <= n {
+		size := int64(chunk)
+		if offset < size {
+			size = offset
+		}
+		offset -= size
+		part := make([]byte, size)
+		if _, err := f.ReadAt(part, offset); err != nil && err != io.EOF {
+			return nil, err
+		}
+		buf = append(part, buf...)
+	}
+
+	lines := strings.Split(strings.TrimRight(string(buf), "\n"), "\n")
+	if len(lines) == 1 && lines[0] == "" {
+		return []string{}, nil
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines, nil
+}
@@ -0,0 +1,109 @@
+package logger
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRotatingFileRotatesAndPrunes(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	r := &RotatingFile{Path: path, MaxSize: 100, MaxBackups: 2}
+	defer r.Close()
+
+	line := strings.Repeat("x", 39) + "\n"
+	for range 10 {
+		if _, err := r.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() > r.MaxSize {
+		t.Errorf("the log has %d bytes, over its %d", info.Size(), r.MaxSize)
+	}
+	backups, _ := filepath.Glob(filepath.Join(dir, "access-*.log"))
+	if len(backups) != r.MaxBackups {
+		t.Errorf("%d backups are kept, want %d: %v", len(backups), r.MaxBackups, backups)
+	}
+}
+
+func TestRotatingFileKeepsLargeWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	r := &RotatingFile{Path: path, MaxSize: 10}
+	defer r.Close()
+
+	// A write larger than the limit goes into a file of its own whole
+	big := strings.Repeat("y", 50) + "\n"
+	for _, data := range []string{"a\n", big} {
+		if _, err := r.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != big {
+		t.Errorf("the log has %q, want the large write", data)
+	}
+}
+
+func TestRotatingFilePrunesByAge(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	old := filepath.Join(dir, "access-20200101-000000.log")
+	if err := os.WriteFile(old, []byte("old\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Add(-48 * time.Hour)
+	os.Chtimes(old, past, past)
+
+	r := &RotatingFile{Path: path, MaxSize: 4, MaxAge: 24 * time.Hour}
+	defer r.Close()
+	r.Write([]byte("one\n"))
+	r.Write([]byte("two\n"))
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Error("a backup over the age limit was kept")
+	}
+}
+
+func TestTailFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	var content strings.Builder
+	// Enough lines to span more than one read chunk
+	for i := range 5000 {
+		fmt.Fprintf(&content, "line %d %s\n", i, strings.Repeat("z", 20))
+	}
+	if err := os.WriteFile(path, []byte(content.String()), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	lines, err := TailFile(path, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "line 4997 ") || !strings.HasPrefix(lines[2], "line 4999 ") {
+		t.Errorf("TailFile(3) = %q", lines)
+	}
+	lines, _ = TailFile(path, 4000)
+	if len(lines) != 4000 || !strings.HasPrefix(lines[0], "line 1000 ") {
+		t.Errorf("TailFile(4000) returned %d lines from %q", len(lines), lines[0])
+	}
+	lines, _ = TailFile(path, 10000)
+	if len(lines) != 5000 {
+		t.Errorf("TailFile(10000) returned %d lines, want all 5000", len(lines))
+	}
+
+	empty := filepath.Join(t.TempDir(), "empty.log")
+	os.WriteFile(empty, nil, 0640)
+	if lines, err := TailFile(empty, 10); err != nil || len(lines) != 0 {
+		t.Errorf("TailFile of an empty file = %q, %v", lines, err)
+	}
+}
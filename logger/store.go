@@ -0,0 +1,240 @@
+package logger
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+const (
+	// appLogQueue is how many entries wait to be written at most; past half of
+	// it the debug entries are dropped, past all of it every entry is
+	appLogQueue = 4096
+	// AppLogMaxLimit is the most entries a query of the app log returns
+	AppLogMaxLimit = 5000
+	// appLogOff is the level of appLogMin with nothing persisted
+	appLogOff = -1
+)
+
+// AppLogEntry is a log line as it is persisted in the app log. Component is the
+// source file that logged it, like "tgbot" or "xray".
+type AppLogEntry struct {
+	Time      int64  `json:"ts"`
+	Level     string `json:"level"`
+	Component string `json:"component"`
+	RequestId string `json:"requestId,omitempty"`
+	Msg       string `json:"msg"`
+}
+
+// AppLogFilter selects entries of the app log: those at Level or more severe,
+// of Component, with Query in their message. Zero values match everything.
+type AppLogFilter struct {
+	Level     string
+	Component string
+	Query     string
+	Limit     int
+}
+
+var (
+	appLogMin     atomic.Int32
+	appLogDropped atomic.Int64
+	appLogQueued  = make(chan AppLogEntry, appLogQueue)
+	appLogStart   sync.Once
+	appLogMu      sync.Mutex
+	appLogFile    *RotatingFile
+	appLogRedact  atomic.Value
+
+	requestIdPattern = regexp.MustCompile(`requestId=(\S+)`)
+)
+
+func init() {
+	appLogMin.Store(appLogOff)
+}
+
+// SetAppLog persists the entries at level or more severe to file, in addition
+// to the output, closing the previous file. A nil file persists nothing.
+func SetAppLog(file *RotatingFile, level logging.Level) {
+	appLogMu.Lock()
+	if appLogFile != nil {
+		appLogFile.Close()
+	}
+	appLogFile = file
+	appLogMu.Unlock()
+	if file == nil {
+		appLogMin.Store(appLogOff)
+		return
+	}
+	appLogMin.Store(int32(level))
+	appLogStart.Do(func() { go writeAppLog() })
+}
+
+// SetRedactor sets how the messages are redacted before they are persisted.
+func SetRedactor(redact func(string) string) {
+	appLogRedact.Store(redact)
+}
+
+// ParseLevel returns the level of a name like "warn" or "WARNING".
+func ParseLevel(name string) (logging.Level, error) {
+	if strings.EqualFold(name, "warn") {
+		return logging.WARNING, nil
+	}
+	return logging.LogLevel(strings.ToUpper(name))
+}
+
+// persist queues a log line for the app log. It never blocks: a full queue drops
+// the line, and a queue half full already drops the debug lines, which are
+// counted and reported once the queue drains. It is called through addToBuffer
+// by the logging functions, which the component is derived from.
+func persist(level logging.Level, msg string) {
+	if min := appLogMin.Load(); min == appLogOff || int32(level) > min {
+		return
+	}
+	if level == logging.DEBUG && len(appLogQueued) >= appLogQueue/2 {
+		appLogDropped.Add(1)
+		return
+	}
+	entry := AppLogEntry{
+		Time:      time.Now().UnixMilli(),
+		Level:     strings.ToLower(level.String()),
+		Component: "panel",
+		Msg:       msg,
+	}
+	// persist, addToBuffer, the logging function and then its caller
+	if _, file, _, ok := runtime.Caller(3); ok {
+		entry.Component = strings.TrimSuffix(filepath.Base(file), ".go")
+	}
+	if match := requestIdPattern.FindStringSubmatch(msg); match != nil {
+		entry.RequestId = match[1]
+	}
+	select {
+	case appLogQueued <- entry:
+	default:
+		appLogDropped.Add(1)
+	}
+}
+
+// writeAppLog writes the queued entries to the app log as JSON lines.
+func writeAppLog() {
+	for entry := range appLogQueued {
+		if redact, ok := appLogRedact.Load().(func(string) string); ok {
+			entry.Msg = redact(entry.Msg)
+		}
+		writeAppLogEntry(entry)
+		if len(appLogQueued) == 0 {
+			if dropped := appLogDropped.Swap(0); dropped > 0 {
+				writeAppLogEntry(AppLogEntry{
+					Time:      time.Now().UnixMilli(),
+					Level:     "warning",
+					Component: "logger",
+					Msg:       "app log was too busy, " + strconv.FormatInt(dropped, 10) + " entries were dropped",
+				})
+			}
+		}
+	}
+}
+
+func writeAppLogEntry(entry AppLogEntry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	appLogMu.Lock()
+	defer appLogMu.Unlock()
+	if appLogFile == nil {
+		return
+	}
+	appLogFile.Write(append(line, '\n'))
+}
+
+// appLogFiles returns the files of the app log, the current one first and then
+// the rotated ones, newest first.
+func appLogFiles() []string {
+	appLogMu.Lock()
+	file := appLogFile
+	appLogMu.Unlock()
+	if file == nil {
+		return nil
+	}
+	ext := filepath.Ext(file.Path)
+	rotated, _ := filepath.Glob(strings.TrimSuffix(file.Path, ext) + "-*" + ext)
+	sort.Sort(sort.Reverse(sort.StringSlice(rotated)))
+	return append([]string{file.Path}, rotated...)
+}
+
+// QueryAppLog returns the entries of the app log matching filter, newest first.
+func QueryAppLog(filter AppLogFilter) ([]AppLogEntry, error) {
+	level := logging.DEBUG
+	if filter.Level != "" {
+		var err error
+		if level, err = ParseLevel(filter.Level); err != nil {
+			return nil, err
+		}
+	}
+	if filter.Limit <= 0 || filter.Limit > AppLogMaxLimit {
+		filter.Limit = AppLogMaxLimit
+	}
+	query := strings.ToLower(filter.Query)
+
+	entries := make([]AppLogEntry, 0)
+	for _, path := range appLogFiles() {
+		data, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+		for i := len(lines) - 1; i >= 0; i-- {
+			entry := AppLogEntry{}
+			if json.Unmarshal([]byte(lines[i]), &entry) != nil {
+				continue
+			}
+			if entryLevel, err := ParseLevel(entry.Level); err != nil || entryLevel > level {
+				continue
+			}
+			if filter.Component != "" && !strings.EqualFold(entry.Component, filter.Component) {
+				continue
+			}
+			if query != "" && !strings.Contains(strings.ToLower(entry.Msg), query) {
+				continue
+			}
+			entries = append(entries, entry)
+			if len(entries) >= filter.Limit {
+				return entries, nil
+			}
+		}
+	}
+	return entries, nil
+}
+
+// WriteAppLog writes all of the app log to w, oldest first.
+func WriteAppLog(w io.Writer) error {
+	files := appLogFiles()
+	buffered := bufio.NewWriter(w)
+	for i := len(files) - 1; i >= 0; i-- {
+		f, err := os.Open(files[i])
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		_, err = io.Copy(buffered, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return buffered.Flush()
+}
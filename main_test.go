@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/web/service"
+)
+
+func setTestSetting(t *testing.T, key string, value string) {
+	t.Helper()
+	db := database.GetDB()
+	if err := db.Where("key = ?", key).Delete(&model.Setting{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create(&model.Setting{Key: key, Value: value}).Error; err != nil {
+		t.Fatal(err)
+	}
+	service.InvalidateSettings()
+}
+
+func TestStartWatchdog(t *testing.T) {
+	// Outside of systemd there is nothing to stop
+	t.Setenv("NOTIFY_SOCKET", "")
+	startWatchdog()()
+
+	if err := database.InitDB(t.TempDir() + "/x-ui.db"); err != nil {
+		t.Fatal(err)
+	}
+	// Alive with the database alone
+	setTestSetting(t, "webEnable", "false")
+	setTestSetting(t, "subEnable", "false")
+
+	socket := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", socket)
+	t.Setenv("WATCHDOG_USEC", "200000")
+	t.Setenv("WATCHDOG_PID", "")
+	receive := func(timeout time.Duration) (string, bool) {
+		buf := make([]byte, 4096)
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		n, err := conn.Read(buf)
+		return string(buf[:n]), err == nil
+	}
+
+	stop := startWatchdog()
+	defer stop()
+	const status = "STATUS=serving, xray stopped, 0 inbounds"
+	for range 3 {
+		if datagram, ok := receive(2 * time.Second); datagram != status+"\nWATCHDOG=1" {
+			t.Fatalf("systemd got %q %v, want the status and a ping", datagram, ok)
+		}
+	}
+
+	// A panel whose listener is gone keeps its status but isn't pinged
+	setTestSetting(t, "webEnable", "true")
+	for {
+		datagram, ok := receive(2 * time.Second)
+		if !ok {
+			t.Fatal("systemd got nothing")
+		}
+		if strings.HasSuffix(datagram, "WATCHDOG=1") {
+			continue
+		}
+		if datagram != status {
+			t.Fatalf("systemd got %q, want the status", datagram)
+		}
+		break
+	}
+
+	stop()
+	// A tick may have been on its way
+	receive(300 * time.Millisecond)
+	if datagram, ok := receive(500 * time.Millisecond); ok {
+		t.Errorf("systemd got %q after the watchdog was stopped", datagram)
+	}
+}
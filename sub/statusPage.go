@@ -0,0 +1,162 @@
+package sub
+
+import (
+	"bytes"
+	_ "embed"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"x-ui/logger"
+	"x-ui/web/locale"
+	"x-ui/web/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+//go:embed statusPage.html
+var statusPageHTML string
+
+var statusPageTemplate = template.Must(template.New("statusPage").Parse(statusPageHTML))
+
+// statusPageKeys are the messages of the page, under pages.statusPage.
+var statusPageKeys = []string{
+	"title", "up", "down", "latency", "load", "low", "medium", "high", "updated", "empty",
+}
+
+// statusPage is the public status page of the inbounds picked in the
+// statusPage settings. Each status is checked once per ttl at most, whoever
+// asks for it in between gets it from the cache.
+type statusPage struct {
+	title    string
+	inbounds []int
+	fields   []string
+	capacity int
+	ttl      time.Duration
+
+	statusPageService service.StatusPageService
+
+	lock    sync.Mutex
+	status  *service.PublicStatus
+	checked time.Time
+}
+
+func newStatusPage(title string, inbounds []int, fields []string, capacity int, ttl int) *statusPage {
+	return &statusPage{
+		title:    title,
+		inbounds: inbounds,
+		fields:   fields,
+		capacity: capacity,
+		ttl:      time.Duration(ttl) * time.Second,
+	}
+}
+
+// get returns the cached status, checking the inbounds again when it is older
+// than ttl. The lock is held over the checks, so requests coming meanwhile
+// wait for them instead of running their own.
+func (p *statusPage) get() (*service.PublicStatus, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.status != nil && time.Since(p.checked) < p.ttl {
+		return p.status, nil
+	}
+	status, err := p.statusPageService.PublicStatus(p.inbounds, p.fields, p.capacity)
+	if err != nil {
+		return nil, err
+	}
+	p.status, p.checked = status, time.Now()
+	return status, nil
+}
+
+// serve replies the status in JSON, or as a page to browsers asking for an
+// HTML document without ?format=json.
+func (p *statusPage) serve(c *gin.Context) {
+	status, err := p.get()
+	if err != nil {
+		logger.Warning("Unable to check the inbounds of the status page:", err)
+		c.Status(http.StatusServiceUnavailable)
+		return
+	}
+	maxAge := max(int(p.ttl.Seconds()-time.Since(time.UnixMilli(status.UpdatedAt)).Seconds()), 0)
+	c.Header("Cache-Control", "public, max-age="+strconv.Itoa(maxAge))
+	c.Header("X-Robots-Tag", "noindex, nofollow")
+	if c.Query("format") == "json" || !strings.Contains(c.GetHeader("Accept"), "text/html") {
+		c.JSON(http.StatusOK, status)
+		return
+	}
+	page, err := p.render(c, status)
+	if err != nil {
+		logger.Warning("Unable to render the status page:", err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	c.Data(http.StatusOK, "text/html; charset=utf-8", page)
+}
+
+type statusPageInbound struct {
+	Name    string
+	Up      bool
+	State   string
+	Latency string
+	Load    string
+	// Level is the load of the inbound, for its style
+	Level string
+}
+
+type statusPageData struct {
+	Lang     string
+	T        map[string]string
+	Title    string
+	Refresh  int
+	Updated  string
+	Inbounds []statusPageInbound
+}
+
+// render writes the page of status. It works without JavaScript, reloading
+// itself once the status is due to be checked again.
+func (p *statusPage) render(c *gin.Context, status *service.PublicStatus) ([]byte, error) {
+	langs := locale.RequestLanguages(c)
+	data := &statusPageData{
+		Lang:     "en",
+		T:        map[string]string{},
+		Title:    p.title,
+		Refresh:  int(p.ttl.Seconds()),
+		Updated:  time.UnixMilli(status.UpdatedAt).Format("2006-01-02 15:04:05"),
+		Inbounds: make([]statusPageInbound, 0, len(status.Inbounds)),
+	}
+	if len(langs) > 0 {
+		data.Lang = strings.SplitN(strings.SplitN(langs[0], ",", 2)[0], ";", 2)[0]
+	}
+	for _, key := range statusPageKeys {
+		data.T[key] = locale.Localize(langs, "pages.statusPage."+key)
+	}
+	if data.Title == "" {
+		data.Title = data.T["title"]
+	}
+	for _, inbound := range status.Inbounds {
+		row := statusPageInbound{
+			Name:  inbound.Name,
+			Up:    inbound.State == service.StatusUp,
+			Level: inbound.Load,
+		}
+		if inbound.State != "" {
+			row.State = data.T[inbound.State]
+		}
+		if inbound.Latency != nil {
+			row.Latency = strconv.FormatInt(*inbound.Latency, 10) + " ms"
+		}
+		if inbound.Load != "" {
+			row.Load = data.T[inbound.Load]
+		}
+		data.Inbounds = append(data.Inbounds, row)
+	}
+
+	var page bytes.Buffer
+	if err := statusPageTemplate.Execute(&page, data); err != nil {
+		return nil, err
+	}
+	return page.Bytes(), nil
+}
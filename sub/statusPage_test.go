@@ -0,0 +1,161 @@
+package sub
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/web/entity"
+	"x-ui/web/service"
+	"x-ui/xray"
+
+	"github.com/gin-gonic/gin"
+)
+
+// statusTestInbounds saves two inbounds for the status page, one with a client
+// and its traffic, and returns their ids.
+func statusTestInbounds(t *testing.T) []int {
+	t.Helper()
+	if err := database.InitDB(t.TempDir() + "/x-ui.db"); err != nil {
+		t.Fatal(err)
+	}
+	db := database.GetDB()
+	inbounds := []*model.Inbound{
+		{Remark: "Frankfurt <1>", Enable: true, Port: 30601, Protocol: model.VLESS, Tag: "inbound-30601", Up: 123456789,
+			Settings: `{"clients":[{"id":"5d2b3f8c-1a9e-4c6d-b7f0-8e4a2c1d6b55","email":"alice@example.com","enable":true}]}`},
+		{Remark: "Paris", Enable: false, Port: 30602, Protocol: model.Trojan, Tag: "inbound-30602", Settings: `{"clients":[]}`},
+	}
+	for _, inbound := range inbounds {
+		if err := db.Create(inbound).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Create(&xray.ClientTraffic{InboundId: inbounds[0].Id, Enable: true, Email: "alice@example.com", Down: 987654321}).Error; err != nil {
+		t.Fatal(err)
+	}
+	return []int{inbounds[1].Id, inbounds[0].Id}
+}
+
+func statusTestRequest(engine *gin.Engine, path string, accept string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	if accept != "" {
+		r.Header.Set("Accept", accept)
+	}
+	engine.ServeHTTP(w, r)
+	return w
+}
+
+func TestStatusPage(t *testing.T) {
+	ids := statusTestInbounds(t)
+	page := newStatusPage("", ids, []string{entity.StatusPageState, entity.StatusPageLatency, entity.StatusPageLoad}, 100, 60)
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.GET("/status/abc", page.serve)
+
+	// JSON by default, and to browsers asking for it
+	for _, path := range []string{"/status/abc", "/status/abc?format=json"} {
+		accept := ""
+		if strings.Contains(path, "format") {
+			accept = "text/html,application/xhtml+xml"
+		}
+		w := statusTestRequest(engine, path, accept)
+		if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+			t.Fatalf("%s replied %d in %s", path, w.Code, w.Header().Get("Content-Type"))
+		}
+		var status service.PublicStatus
+		if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+			t.Fatal(err)
+		}
+		// Xray isn't running: both are down
+		if len(status.Inbounds) != 2 || status.Inbounds[0].Name != "Paris" || status.Inbounds[1].State != service.StatusDown {
+			t.Errorf("%s replied %s", path, w.Body)
+		}
+		if w.Header().Get("X-Robots-Tag") != "noindex, nofollow" || !strings.HasPrefix(w.Header().Get("Cache-Control"), "public, max-age=") {
+			t.Errorf("%s has the headers %v", path, w.Header())
+		}
+	}
+
+	w := statusTestRequest(engine, "/status/abc", "text/html,application/xhtml+xml;q=0.9")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Fatalf("the page replied %d in %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	html := w.Body.String()
+	if !strings.Contains(html, "Frankfurt &lt;1&gt;") || !strings.Contains(html, "Paris") || !strings.Contains(html, `content="60"`) {
+		t.Errorf("the page is %s", html)
+	}
+
+	// Neither page tells the clients, the ports, the tags nor the traffic
+	body := statusTestRequest(engine, "/status/abc", "").Body.String() + html
+	for _, secret := range []string{"alice", "5d2b3f8c", "30601", "30602", "inbound-", "123456789", "987654321", "vless", "trojan"} {
+		if strings.Contains(body, secret) {
+			t.Errorf("the status page tells %q", secret)
+		}
+	}
+}
+
+func TestStatusPageCache(t *testing.T) {
+	ids := statusTestInbounds(t)
+	page := newStatusPage("", ids, []string{entity.StatusPageState}, 100, 60)
+	status, err := page.get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := database.GetDB().Model(&model.Inbound{}).Where("id = ?", ids[0]).Update("remark", "Lyon").Error; err != nil {
+		t.Fatal(err)
+	}
+	// Within the cache time the inbounds aren't checked again
+	for range 10 {
+		if cached, err := page.get(); err != nil || cached != status {
+			t.Fatalf("the status was checked again: %+v, %v", cached, err)
+		}
+	}
+	page.checked = page.checked.Add(-61 * time.Second)
+	if checked, err := page.get(); err != nil || checked == status || checked.Inbounds[0].Name != "Lyon" {
+		t.Errorf("the expired status is %+v, %v", checked, err)
+	}
+}
+
+func TestStatusPageRoute(t *testing.T) {
+	statusTestInbounds(t)
+	settings := map[string]string{
+		"statusPage":         "true",
+		"statusPagePath":     "/status/q8Xr2mLd0pWz7bVn/",
+		"statusPageInbounds": "1,2",
+		"statusPageTitle":    "Nodes",
+	}
+	for key, value := range settings {
+		if err := database.GetDB().Create(&model.Setting{Key: key, Value: value}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	service.InvalidateSettings()
+	engine, err := NewServer().initRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := statusTestRequest(engine, "/status/q8Xr2mLd0pWz7bVn", "text/html")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "<title>Nodes</title>") {
+		t.Errorf("the status page replied %d: %s", w.Code, w.Body)
+	}
+	if w := statusTestRequest(engine, "/status/", ""); w.Code != http.StatusNotFound {
+		t.Errorf("the status page is served without its random path: %d", w.Code)
+	}
+
+	// Off, the path is unknown
+	if err := database.GetDB().Model(&model.Setting{}).Where("key = ?", "statusPage").Update("value", "false").Error; err != nil {
+		t.Fatal(err)
+	}
+	service.InvalidateSettings()
+	if engine, err = NewServer().initRouter(); err != nil {
+		t.Fatal(err)
+	}
+	if w := statusTestRequest(engine, "/status/q8Xr2mLd0pWz7bVn", ""); w.Code != http.StatusNotFound {
+		t.Errorf("the status page turned off replied %d", w.Code)
+	}
+}
@@ -3,14 +3,16 @@ package sub
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"io"
 	"net"
 	"net/http"
-	"strconv"
+	"strings"
 
 	"x-ui/config"
 	"x-ui/logger"
 	"x-ui/util/common"
+	"x-ui/web/entity"
 	"x-ui/web/middleware"
 	"x-ui/web/network"
 	"x-ui/web/service"
@@ -19,8 +21,9 @@ import (
 )
 
 type Server struct {
-	httpServer *http.Server
-	listener   net.Listener
+	httpServer   *http.Server
+	listener     net.Listener
+	certReloader *service.CertReloader
 
 	sub            *SUBController
 	settingService service.SettingService
@@ -46,7 +49,26 @@ func (s *Server) initRouter() (*gin.Engine, error) {
 		gin.SetMode(gin.ReleaseMode)
 	}
 
-	engine := gin.Default()
+	// Without the recovery of gin.Default, which would take the panics first
+	engine := gin.New()
+	if config.IsDebug() {
+		engine.Use(gin.Logger())
+	}
+
+	trustedProxies, err := s.settingService.GetTrustedProxies()
+	if err != nil {
+		return nil, err
+	}
+	trustedProxyHeader, err := s.settingService.GetTrustedProxyHeader()
+	if err != nil {
+		return nil, err
+	}
+	if err := middleware.SetTrustedProxies(engine, trustedProxies, trustedProxyHeader); err != nil {
+		return nil, err
+	}
+
+	engine.Use(middleware.RequestID())
+	engine.Use(middleware.RecoveryJSON())
 
 	subDomain, err := s.settingService.GetSubDomain()
 	if err != nil {
@@ -57,6 +79,26 @@ func (s *Server) initRouter() (*gin.Engine, error) {
 		engine.Use(middleware.DomainValidatorMiddleware(subDomain))
 	}
 
+	allSetting, err := s.settingService.GetAllSetting()
+	if err != nil {
+		return nil, err
+	}
+	engine.Use(middleware.SlowRequests(allSetting.SlowRequestConfig(allSetting.SubBasePath)))
+	if allSetting.SubSecurityHeaders {
+		engine.Use(middleware.SecurityHeaders(allSetting.SecurityHeadersConfig().ForSubscription()))
+	}
+	if allSetting.CompressionEnable {
+		engine.Use(middleware.Compress(allSetting.CompressConfig()))
+	}
+	// A 503 keeps the clients on their configs, an empty list would wipe them
+	engine.Use(middleware.Maintenance(func() middleware.MaintenanceState {
+		state, err := s.settingService.GetMaintenance()
+		if err != nil {
+			logger.Warning("Unable to get the maintenance mode:", err)
+		}
+		return state
+	}, nil))
+
 	LinksPath, err := s.settingService.GetSubPath()
 	if err != nil {
 		return nil, err
@@ -112,11 +154,110 @@ func (s *Server) initRouter() (*gin.Engine, error) {
 		SubTitle = ""
 	}
 
-	g := engine.Group("/")
+	SubClashRules, err := s.settingService.GetSubClashRules()
+	if err != nil {
+		SubClashRules = ""
+	}
+
+	SubSingboxVersion, err := s.settingService.GetSubSingboxVersion()
+	if err != nil {
+		SubSingboxVersion = "1.11"
+	}
+
+	SubSingboxDns, err := s.settingService.GetSubSingboxDns()
+	if err != nil {
+		SubSingboxDns = ""
+	}
+
+	SubSingboxRoute, err := s.settingService.GetSubSingboxRoute()
+	if err != nil {
+		SubSingboxRoute = ""
+	}
+
+	SubCache, err := s.settingService.GetSubCache()
+	if err != nil {
+		SubCache = true
+	}
+
+	SubCacheGranularity, err := s.settingService.GetSubCacheGranularity()
+	if err != nil {
+		SubCacheGranularity = 10
+	}
+
+	var Page *subPage
+	if SubPage, err := s.settingService.GetSubPage(); err == nil && SubPage {
+		SubPageTitle, _ := s.settingService.GetSubPageTitle()
+		SubPageLogo, _ := s.settingService.GetSubPageLogo()
+		SubPageSupport, _ := s.settingService.GetSubPageSupport()
+		SubURI, _ := s.settingService.GetSubURI()
+		Page = newSubPage(SubPageTitle, SubPageLogo, SubPageSupport, SubURI)
+	}
+
+	var Aggregator *subAggregator
+	SubRemotes, err := s.settingService.GetSubRemotes()
+	if err != nil {
+		return nil, err
+	}
+	Remotes, err := entity.ParseSubRemotes(SubRemotes)
+	if err != nil {
+		logger.Warning("Unable to parse the remote subscriptions:", err)
+	} else if len(Remotes) > 0 {
+		SubRemoteTimeout, err := s.settingService.GetSubRemoteTimeout()
+		if err != nil || SubRemoteTimeout <= 0 {
+			SubRemoteTimeout = 5
+		}
+		SubRemoteTTL, err := s.settingService.GetSubRemoteTTL()
+		if err != nil {
+			SubRemoteTTL = 300
+		}
+		Aggregator = newSubAggregator(Remotes, SubRemoteTimeout, SubRemoteTTL)
+	}
+
+	var Status *statusPage
+	StatusPagePath := ""
+	if StatusPage, err := s.settingService.GetStatusPage(); err == nil && StatusPage {
+		StatusPagePath, _ = s.settingService.GetStatusPagePath()
+		StatusPageTitle, _ := s.settingService.GetStatusPageTitle()
+		StatusPageInbounds, _ := s.settingService.GetStatusPageInbounds()
+		StatusPageFields, _ := s.settingService.GetStatusPageFields()
+		StatusPageCapacity, _ := s.settingService.GetStatusPageCapacity()
+		StatusPageTTL, err := s.settingService.GetStatusPageTTL()
+		if err != nil || StatusPageTTL < entity.MinStatusPageTTL {
+			StatusPageTTL = entity.MinStatusPageTTL
+		}
+		Inbounds, err1 := entity.ParseStatusPageInbounds(StatusPageInbounds)
+		Fields, err2 := entity.ParseStatusPageFields(StatusPageFields)
+		if err := common.Combine(err1, err2); err != nil {
+			logger.Warning("Unable to parse the status page settings:", err)
+		} else {
+			Status = newStatusPage(StatusPageTitle, Inbounds, Fields, StatusPageCapacity, StatusPageTTL)
+		}
+	}
+
+	var Trial *trialEndpoint
+	TrialPath, _ := s.settingService.GetTrialPath()
+	if TrialInbound, err := s.settingService.GetTrialInbound(); err == nil && TrialInbound > 0 && TrialPath != "" {
+		Trial = newTrialEndpoint(RemarkModel)
+	}
+
+	BasePath, err := s.settingService.GetSubBasePath()
+	if err != nil {
+		return nil, err
+	}
+
+	g := engine.Group(BasePath)
 
 	s.sub = NewSUBController(
 		g, LinksPath, JsonPath, Encrypt, ShowInfo, RemarkModel, SubUpdates,
-		SubJsonFragment, SubJsonNoises, SubJsonMux, SubJsonRules, SubTitle)
+		SubJsonFragment, SubJsonNoises, SubJsonMux, SubJsonRules, SubTitle, SubClashRules,
+		SubSingboxVersion, SubSingboxDns, SubSingboxRoute, SubCache, SubCacheGranularity, Page, Aggregator)
+	if Status != nil {
+		g.GET(strings.TrimSuffix(StatusPagePath, "/"), Status.serve)
+	}
+	if Trial != nil {
+		g.GET(strings.TrimSuffix(TrialPath, "/"), Trial.offer)
+		g.POST(strings.TrimSuffix(TrialPath, "/"), Trial.request)
+	}
 
 	return engine, nil
 }
@@ -137,16 +278,16 @@ func (s *Server) Start() (err error) {
 		return nil
 	}
 
-	engine, err := s.initRouter()
-	if err != nil {
+	if err := s.settingService.CheckListeners(); err != nil {
 		return err
 	}
 
-	certFile, err := s.settingService.GetSubCertFile()
+	engine, err := s.initRouter()
 	if err != nil {
 		return err
 	}
-	keyFile, err := s.settingService.GetSubKeyFile()
+
+	certFile, keyFile, err := s.settingService.GetSubCert()
 	if err != nil {
 		return err
 	}
@@ -159,18 +300,31 @@ func (s *Server) Start() (err error) {
 		return err
 	}
 
-	listenAddr := net.JoinHostPort(listen, strconv.Itoa(port))
-	listener, err := net.Listen("tcp", listenAddr)
+	socketMode, err := s.settingService.GetSocketMode()
+	if err != nil {
+		return err
+	}
+	socketOwner, err := s.settingService.GetSocketOwner()
+	if err != nil {
+		return err
+	}
+	listener, err := network.Listen(listen, port, socketMode, socketOwner)
 	if err != nil {
 		return err
 	}
 
-	if certFile != "" || keyFile != "" {
-		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if socketPath, ok := network.UnixSocketPath(listen); ok {
+		// TLS is up to the reverse proxy in front of the socket
+		logger.Info("Sub server running HTTP on unix socket", socketPath)
+	} else if certFile != "" || keyFile != "" {
+		// The certificate is reloaded when its files change
+		reloader, err := service.NewCertReloader("subscription", certFile, keyFile)
 		if err == nil {
 			c := &tls.Config{
-				Certificates: []tls.Certificate{cert},
+				GetCertificate: reloader.GetCertificate,
 			}
+			service.RegisterCertReloader(reloader)
+			s.certReloader = reloader
 			listener = network.NewAutoHttpsListener(listener)
 			listener = tls.NewListener(listener, c)
 			logger.Info("Sub server running HTTPS on", listener.Addr())
@@ -194,20 +348,35 @@ func (s *Server) Start() (err error) {
 	return nil
 }
 
+// Stop drains the in-flight subscription requests and shuts the server down.
 func (s *Server) Stop() error {
 	s.cancel()
 
 	var err1 error
 	var err2 error
 	if s.httpServer != nil {
-		err1 = s.httpServer.Shutdown(s.ctx)
+		err1 = network.Shutdown("Sub server", s.httpServer, s.settingService.GetShutdownTimeout())
 	}
 	if s.listener != nil {
-		err2 = s.listener.Close()
+		if err := s.listener.Close(); !errors.Is(err, net.ErrClosed) {
+			err2 = err
+		}
+	}
+	if s.certReloader != nil {
+		service.UnregisterCertReloader(s.certReloader)
 	}
 	return common.Combine(err1, err2)
 }
 
+// GetListenAddr returns the address the server accepts connections on, or nil
+// if it isn't listening.
+func (s *Server) GetListenAddr() net.Addr {
+	if s.listener == nil || s.ctx.Err() != nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
 func (s *Server) GetCtx() context.Context {
 	return s.ctx
 }
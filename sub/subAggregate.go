@@ -0,0 +1,222 @@
+package sub
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"x-ui/config"
+	"x-ui/logger"
+	"x-ui/web/entity"
+)
+
+// subRemoteMaxBody bounds the size of the subscription of a remote.
+const subRemoteMaxBody = 4 << 20
+
+// remoteSub is what a remote served for a subscription.
+type remoteSub struct {
+	links []string
+	// userinfo is the Subscription-Userinfo header of the remote, nil if it
+	// sent none
+	userinfo map[string]int64
+	fetched  time.Time
+}
+
+// subAggregator merges the subscriptions of other panels into the local ones.
+// The remotes are fetched side by side, and what they served is kept for ttl
+// so that a slow or dead remote doesn't hold every refresh up.
+type subAggregator struct {
+	remotes []entity.SubRemote
+	timeout time.Duration
+	ttl     time.Duration
+	client  *http.Client
+
+	lock sync.Mutex
+	// subs are the last subscriptions the remotes served, by URL, failed
+	// fetches are when the URL was last tried
+	subs   map[string]*remoteSub
+	failed map[string]time.Time
+}
+
+func newSubAggregator(remotes []entity.SubRemote, timeout int, ttl int) *subAggregator {
+	return &subAggregator{
+		remotes: remotes,
+		timeout: time.Duration(timeout) * time.Second,
+		ttl:     time.Duration(ttl) * time.Second,
+		client:  &http.Client{Timeout: time.Duration(timeout) * time.Second},
+		subs:    map[string]*remoteSub{},
+		failed:  map[string]time.Time{},
+	}
+}
+
+// aggregate returns the links of the subscription subId on all the remotes
+// after links, without the ones listed already, and header with their traffic
+// added. A remote that can't be fetched has an entry telling so instead, and
+// leaves the quota out of the header.
+func (a *subAggregator) aggregate(s *SubService, subId string, links []string, header *subHeader) ([]string, *subHeader) {
+	subs := make([]*remoteSub, len(a.remotes))
+	var wg sync.WaitGroup
+	for i, remote := range a.remotes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			subs[i] = a.get(remote, subId)
+		}()
+	}
+	wg.Wait()
+
+	merged := *header
+	result := make([]string, 0, len(links))
+	seen := map[string]bool{}
+	for _, link := range links {
+		if !seen[link] {
+			seen[link] = true
+			result = append(result, link)
+		}
+	}
+	for i, sub := range subs {
+		if sub == nil {
+			inbound, client := remarkClient("⚠️ " + a.remotes[i].Name + " is unavailable")
+			result = append(result, s.getLink(inbound, client.Email))
+			merged.unlimited = true
+			continue
+		}
+		for _, link := range sub.links {
+			if !seen[link] {
+				seen[link] = true
+				result = append(result, link)
+			}
+		}
+		merged.addRemote(sub.userinfo)
+	}
+	return result, &merged
+}
+
+// get returns the subscription subId of remote, from the ones kept if it is
+// recent enough, or nil if it can't be fetched and none was kept.
+func (a *subAggregator) get(remote entity.SubRemote, subId string) *remoteSub {
+	subURL := remote.URL
+	if strings.Contains(subURL, "{subId}") {
+		subURL = strings.ReplaceAll(subURL, "{subId}", subId)
+	} else {
+		subURL += subId
+	}
+
+	a.lock.Lock()
+	sub := a.subs[subURL]
+	failed, hasFailed := a.failed[subURL]
+	a.lock.Unlock()
+	if sub != nil && time.Since(sub.fetched) < a.ttl {
+		return sub
+	}
+	// A failed remote is tried again once per ttl, stale links are better
+	// than waiting for its timeout on every fetch
+	if hasFailed && time.Since(failed) < a.ttl {
+		return sub
+	}
+
+	fetched, err := a.fetch(remote, subURL)
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if err != nil {
+		logger.Warningf("Unable to fetch the remote subscription %s: %v", remote.Name, err)
+		a.failed[subURL] = time.Now()
+		return sub
+	}
+	delete(a.failed, subURL)
+	a.subs[subURL] = fetched
+	return fetched
+}
+
+func (a *subAggregator) fetch(remote entity.SubRemote, subURL string) (*remoteSub, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), a.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, subURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "x-ui/"+config.GetVersion())
+	for name, value := range remote.Headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, subRemoteMaxBody))
+	if err != nil {
+		return nil, err
+	}
+	return &remoteSub{
+		links:    parseSubLinks(body),
+		userinfo: parseUserinfo(resp.Header.Get("Subscription-Userinfo")),
+		fetched:  time.Now(),
+	}, nil
+}
+
+// parseSubLinks returns the links of a subscription, plain or base64 encoded.
+func parseSubLinks(body []byte) []string {
+	text := strings.TrimSpace(string(body))
+	if !strings.Contains(text, "://") {
+		compact := strings.Join(strings.Fields(text), "")
+		for _, encoding := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+			if decoded, err := encoding.DecodeString(compact); err == nil {
+				text = string(decoded)
+				break
+			}
+		}
+	}
+	links := make([]string, 0)
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.TrimSpace(line); strings.Contains(line, "://") {
+			links = append(links, line)
+		}
+	}
+	return links
+}
+
+// parseUserinfo parses a Subscription-Userinfo header like
+// "upload=1; download=2; total=3; expire=4", nil if there is none.
+func parseUserinfo(value string) map[string]int64 {
+	if value == "" {
+		return nil
+	}
+	userinfo := map[string]int64{}
+	for _, field := range strings.Split(value, ";") {
+		key, number, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok {
+			continue
+		}
+		if n, err := strconv.ParseInt(strings.TrimSpace(number), 10, 64); err == nil {
+			userinfo[strings.TrimSpace(key)] = n
+		}
+	}
+	return userinfo
+}
+
+// addRemote adds the traffic of the userinfo header of a remote. A remote
+// without a quota, or without the header, leaves the quota out; its expiry
+// counts when it is nearer.
+func (h *subHeader) addRemote(userinfo map[string]int64) {
+	total, hasTotal := userinfo["total"]
+	if !hasTotal || total <= 0 {
+		h.unlimited = true
+	} else {
+		h.total += total
+	}
+	h.up += userinfo["upload"]
+	h.down += userinfo["download"]
+	if expire := userinfo["expire"] * 1000; expire > 0 && (h.expiry == 0 || expire < h.expiry) {
+		h.expiry = expire
+	}
+}
@@ -0,0 +1,136 @@
+package sub
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"x-ui/database"
+	"x-ui/web/service"
+)
+
+// subCacheTables are the tables subscriptions are built from, a write to any of
+// them drops the cached ones.
+var subCacheTables = []string{"inbounds", "client_traffics", "settings"}
+
+const (
+	// subCacheMaxEntries bounds the memory of the cache, whose keys include the
+	// host the request was sent to
+	subCacheMaxEntries = 10000
+	// subCacheMaxAge bounds how late what changes with the time alone, such
+	// as the days left in the remarks, gets
+	subCacheMaxAge = time.Hour
+)
+
+// subReply is a built subscription: its body and the headers it is sent with,
+// and the clients it is of.
+type subReply struct {
+	contentType string
+	header      http.Header
+	body        []byte
+	etag        string
+	emails      []string
+	// uncached replies are built for every request
+	uncached bool
+}
+
+func newSubReply(contentType string, header http.Header, body []byte) *subReply {
+	hash := sha256.New()
+	hash.Write([]byte(contentType))
+	keys := make([]string, 0, len(header))
+	for key := range header {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		hash.Write([]byte("\n" + key + ": " + strings.Join(header[key], ", ")))
+	}
+	hash.Write([]byte("\n\n"))
+	hash.Write(body)
+	return &subReply{
+		contentType: contentType,
+		header:      header,
+		body:        body,
+		etag:        `"` + hex.EncodeToString(hash.Sum(nil)[:16]) + `"`,
+	}
+}
+
+// matches tells whether the If-None-Match header ifNoneMatch names the reply.
+func (r *subReply) matches(ifNoneMatch string) bool {
+	for _, etag := range strings.Split(ifNoneMatch, ",") {
+		etag = strings.TrimSpace(etag)
+		if etag == "*" || strings.TrimPrefix(etag, "W/") == r.etag {
+			return true
+		}
+	}
+	return false
+}
+
+type subCacheKey struct {
+	subId  string
+	format string
+	host   string
+}
+
+type subCacheEntry struct {
+	reply *subReply
+	// writes is the count of the writes to the tables it was built from
+	writes uint64
+	// traffic is the traffic of the clients written when it was built
+	traffic int64
+	built   time.Time
+}
+
+// subCache keeps the built subscriptions until what they are built from
+// changes, or the traffic of their clients moves by granularity bytes.
+type subCache struct {
+	granularity int64
+
+	lock    sync.Mutex
+	entries map[subCacheKey]*subCacheEntry
+}
+
+func newSubCache(granularityMB int) *subCache {
+	return &subCache{
+		granularity: int64(granularityMB) * 1024 * 1024,
+		entries:     map[subCacheKey]*subCacheEntry{},
+	}
+}
+
+// get returns the cached reply of key, nil if there is none or it is out of
+// date. It does not read the database.
+func (c *subCache) get(key subCacheKey) *subReply {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entry := c.entries[key]
+	if entry == nil {
+		return nil
+	}
+	moved := service.WrittenTraffic(entry.reply.emails) - entry.traffic
+	if entry.writes != database.Writes(subCacheTables...) ||
+		time.Since(entry.built) > subCacheMaxAge ||
+		(moved > 0 && moved >= c.granularity) {
+		delete(c.entries, key)
+		return nil
+	}
+	return entry.reply
+}
+
+// put caches reply for key, built from the tables as they were after writes.
+func (c *subCache) put(key subCacheKey, reply *subReply, writes uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.entries) >= subCacheMaxEntries {
+		c.entries = map[subCacheKey]*subCacheEntry{}
+	}
+	c.entries[key] = &subCacheEntry{
+		reply:   reply,
+		writes:  writes,
+		traffic: service.WrittenTraffic(reply.emails),
+		built:   time.Now(),
+	}
+}
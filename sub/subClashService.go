@@ -0,0 +1,351 @@
+package sub
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/web/entity"
+
+	"gopkg.in/yaml.v3"
+)
+
+// clashGroupName is the group of all the proxies of a Clash subscription, the
+// policy its rules send traffic to.
+const clashGroupName = "PROXY"
+
+type clashConfig struct {
+	MixedPort   int           `yaml:"mixed-port"`
+	AllowLan    bool          `yaml:"allow-lan"`
+	Mode        string        `yaml:"mode"`
+	LogLevel    string        `yaml:"log-level"`
+	Proxies     []*clashProxy `yaml:"proxies"`
+	ProxyGroups []clashGroup  `yaml:"proxy-groups"`
+	Rules       []string      `yaml:"rules"`
+}
+
+type clashGroup struct {
+	Name    string   `yaml:"name"`
+	Type    string   `yaml:"type"`
+	Proxies []string `yaml:"proxies"`
+}
+
+// clashProxy is a proxy of mihomo, the Clash.Meta core. The fields are written
+// in this order.
+type clashProxy struct {
+	Name              string            `yaml:"name"`
+	Type              string            `yaml:"type"`
+	Server            string            `yaml:"server"`
+	Port              int               `yaml:"port"`
+	UUID              string            `yaml:"uuid,omitempty"`
+	AlterId           *int              `yaml:"alterId,omitempty"`
+	Cipher            string            `yaml:"cipher,omitempty"`
+	Password          string            `yaml:"password,omitempty"`
+	Flow              string            `yaml:"flow,omitempty"`
+	UDP               bool              `yaml:"udp"`
+	TLS               bool              `yaml:"tls,omitempty"`
+	ServerName        string            `yaml:"servername,omitempty"`
+	SNI               string            `yaml:"sni,omitempty"`
+	ALPN              []string          `yaml:"alpn,omitempty"`
+	SkipCertVerify    bool              `yaml:"skip-cert-verify,omitempty"`
+	ClientFingerprint string            `yaml:"client-fingerprint,omitempty"`
+	RealityOpts       *clashRealityOpts `yaml:"reality-opts,omitempty"`
+	Network           string            `yaml:"network,omitempty"`
+	WSOpts            *clashWSOpts      `yaml:"ws-opts,omitempty"`
+	GrpcOpts          *clashGrpcOpts    `yaml:"grpc-opts,omitempty"`
+	HTTPOpts          *clashHTTPOpts    `yaml:"http-opts,omitempty"`
+	XHTTPOpts         *clashXHTTPOpts   `yaml:"xhttp-opts,omitempty"`
+}
+
+type clashRealityOpts struct {
+	PublicKey string `yaml:"public-key"`
+	ShortId   string `yaml:"short-id,omitempty"`
+}
+
+type clashWSOpts struct {
+	Path                string            `yaml:"path,omitempty"`
+	Headers             map[string]string `yaml:"headers,omitempty"`
+	MaxEarlyData        int               `yaml:"max-early-data,omitempty"`
+	EarlyDataHeaderName string            `yaml:"early-data-header-name,omitempty"`
+	V2rayHTTPUpgrade    bool              `yaml:"v2ray-http-upgrade,omitempty"`
+}
+
+type clashGrpcOpts struct {
+	ServiceName string `yaml:"grpc-service-name"`
+}
+
+type clashXHTTPOpts struct {
+	Path string `yaml:"path,omitempty"`
+	Host string `yaml:"host,omitempty"`
+	Mode string `yaml:"mode,omitempty"`
+}
+
+type clashHTTPOpts struct {
+	Method  string              `yaml:"method,omitempty"`
+	Path    []string            `yaml:"path,omitempty"`
+	Headers map[string][]string `yaml:"headers,omitempty"`
+}
+
+type SubClashService struct {
+	rules []string
+
+	SubService *SubService
+}
+
+func NewSubClashService(rules string, subService *SubService) *SubClashService {
+	clashRules, err := entity.ParseClashRules(rules)
+	if err != nil {
+		logger.Warning("SubClashService - rules are not valid, sending everything to the proxies:", err)
+		clashRules = nil
+	}
+	if len(clashRules) == 0 {
+		clashRules = []string{"MATCH," + clashGroupName}
+	}
+	return &SubClashService{
+		rules:      clashRules,
+		SubService: subService,
+	}
+}
+
+// GetClash returns the Clash.Meta configuration of the subscription subId and
+// the header of its clients. Clients whose transport Clash cannot use are
+// left out with a comment.
+func (s *SubClashService) GetClash(subId string, host string) (string, *subHeader, error) {
+	endpoints, header, err := s.SubService.getEndpoints(subId, host)
+	if err != nil || len(endpoints) == 0 {
+		return "", nil, err
+	}
+
+	proxies := make([]*clashProxy, 0)
+	var skipped []string
+	for _, endpoint := range endpoints {
+		proxy, err := newClashProxy(endpoint.inbound, endpoint.client, endpoint.stream, endpoint.security)
+		if err != nil {
+			skipped = append(skipped, fmt.Sprintf("skipped %s: %s", strings.ReplaceAll(endpoint.name, "\n", " "), strings.TrimSpace(err.Error())))
+			continue
+		}
+		proxy.Name = endpoint.name
+		proxy.Server = endpoint.server
+		proxy.Port = endpoint.port
+		proxies = append(proxies, proxy)
+	}
+
+	group := clashGroup{Name: clashGroupName, Type: "select"}
+	for _, proxy := range proxies {
+		group.Proxies = append(group.Proxies, proxy.Name)
+	}
+	if len(group.Proxies) == 0 {
+		group.Proxies = []string{"DIRECT"}
+	}
+	config := clashConfig{
+		MixedPort:   7890,
+		Mode:        "rule",
+		LogLevel:    "info",
+		Proxies:     proxies,
+		ProxyGroups: []clashGroup{group},
+		Rules:       s.rules,
+	}
+
+	var document yaml.Node
+	if err := document.Encode(config); err != nil {
+		return "", nil, err
+	}
+	// The skipped clients are listed after the proxies
+	for i := 0; i+1 < len(document.Content); i += 2 {
+		if document.Content[i].Value == "proxy-groups" {
+			document.Content[i].HeadComment = strings.Join(skipped, "\n")
+		}
+	}
+	var result bytes.Buffer
+	encoder := yaml.NewEncoder(&result)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&document); err != nil {
+		return "", nil, err
+	}
+	encoder.Close()
+
+	return result.String(), header, nil
+}
+
+// newClashProxy maps client of inbound to a mihomo proxy, without its name and
+// address. security overrides the one of stream unless it is "same". It fails
+// for the protocols, transports and securities Clash has no equivalent of; the
+// link options it has none of, mux.cool and the gRPC multi mode, are left out.
+func newClashProxy(inbound *model.Inbound, client model.Client, stream map[string]any, security string) (*clashProxy, error) {
+	if security == "" || security == "same" {
+		security, _ = stream["security"].(string)
+	}
+	if security == "" {
+		security = "none"
+	}
+	network, _ := stream["network"].(string)
+
+	proxy := &clashProxy{UDP: true}
+	switch inbound.Protocol {
+	case model.VMESS:
+		alterId := 0
+		proxy.Type = "vmess"
+		proxy.UUID = client.ID
+		proxy.AlterId = &alterId
+		proxy.Cipher = client.Security
+		if proxy.Cipher == "" {
+			proxy.Cipher = "auto"
+		}
+	case model.VLESS:
+		proxy.Type = "vless"
+		proxy.UUID = client.ID
+	case model.Trojan:
+		proxy.Type = "trojan"
+		proxy.Password = client.Password
+	case model.Shadowsocks:
+		var settings map[string]any
+		json.Unmarshal([]byte(inbound.Settings), &settings)
+		method, _ := settings["method"].(string)
+		proxy.Type = "ss"
+		proxy.Cipher = method
+		proxy.Password = client.Password
+		if strings.HasPrefix(method, "2022") {
+			inboundPassword, _ := settings["password"].(string)
+			proxy.Password = inboundPassword + ":" + client.Password
+		}
+	default:
+		return nil, common.NewErrorf("Clash has no %s proxies", inbound.Protocol)
+	}
+
+	switch network {
+	case "tcp":
+		tcp, _ := stream["tcpSettings"].(map[string]any)
+		header, _ := tcp["header"].(map[string]any)
+		if headerType, _ := header["type"].(string); headerType == "http" {
+			if inbound.Protocol != model.VMESS && inbound.Protocol != model.VLESS {
+				return nil, common.NewErrorf("Clash has no HTTP header obfuscation for %s", inbound.Protocol)
+			}
+			request, _ := header["request"].(map[string]any)
+			opts := &clashHTTPOpts{Headers: map[string][]string{}}
+			opts.Method, _ = request["method"].(string)
+			paths, _ := request["path"].([]any)
+			for _, path := range paths {
+				if path, ok := path.(string); ok {
+					opts.Path = append(opts.Path, path)
+				}
+			}
+			headers, _ := request["headers"].(map[string]any)
+			for key, values := range headers {
+				switch values := values.(type) {
+				case []any:
+					for _, value := range values {
+						if value, ok := value.(string); ok {
+							opts.Headers[key] = append(opts.Headers[key], value)
+						}
+					}
+				case string:
+					opts.Headers[key] = []string{values}
+				}
+			}
+			proxy.Network = "http"
+			proxy.HTTPOpts = opts
+		}
+	case "ws", "httpupgrade":
+		settings, _ := stream[network+"Settings"].(map[string]any)
+		opts := &clashWSOpts{V2rayHTTPUpgrade: network == "httpupgrade"}
+		opts.Path, _ = settings["path"].(string)
+		host, _ := settings["host"].(string)
+		if host == "" {
+			host = searchHost(settings["headers"])
+		}
+		if host != "" {
+			opts.Headers = map[string]string{"Host": host}
+		}
+		if network == "ws" {
+			opts.Path, opts.MaxEarlyData, opts.EarlyDataHeaderName = wsEarlyData(opts.Path, linkOptions(inbound, client))
+			if opts.MaxEarlyData == 0 {
+				opts.EarlyDataHeaderName = ""
+			}
+		}
+		proxy.Network = "ws"
+		proxy.WSOpts = opts
+	case "grpc":
+		grpc, _ := stream["grpcSettings"].(map[string]any)
+		serviceName, _ := grpc["serviceName"].(string)
+		proxy.Network = "grpc"
+		proxy.GrpcOpts = &clashGrpcOpts{ServiceName: serviceName}
+	case "xhttp":
+		// Clash.Meta only has XHTTP for VLESS
+		if inbound.Protocol != model.VLESS {
+			return nil, common.NewErrorf("Clash has no xhttp transport for %s", inbound.Protocol)
+		}
+		xhttp, _ := stream["xhttpSettings"].(map[string]any)
+		opts := &clashXHTTPOpts{}
+		opts.Path, _ = xhttp["path"].(string)
+		opts.Host, _ = xhttp["host"].(string)
+		if opts.Host == "" {
+			opts.Host = searchHost(xhttp["headers"])
+		}
+		opts.Mode, _ = xhttp["mode"].(string)
+		proxy.Network = "xhttp"
+		proxy.XHTTPOpts = opts
+	default:
+		return nil, common.NewErrorf("Clash has no %s transport", network)
+	}
+
+	switch security {
+	case "tls":
+		tlsSettings, _ := stream["tlsSettings"].(map[string]any)
+		clientSettings, _ := tlsSettings["settings"].(map[string]any)
+		serverName, _ := tlsSettings["serverName"].(string)
+		// Trojan is always over TLS, and names the server differently
+		if inbound.Protocol == model.Trojan {
+			proxy.SNI = serverName
+		} else {
+			proxy.TLS = true
+			proxy.ServerName = serverName
+		}
+		alpns, _ := tlsSettings["alpn"].([]any)
+		for _, alpn := range alpns {
+			if alpn, ok := alpn.(string); ok {
+				proxy.ALPN = append(proxy.ALPN, alpn)
+			}
+		}
+		proxy.SkipCertVerify, _ = clientSettings["allowInsecure"].(bool)
+		proxy.ClientFingerprint, _ = clientSettings["fingerprint"].(string)
+	case "reality":
+		if inbound.Protocol != model.VLESS {
+			return nil, common.NewErrorf("Clash has no REALITY for %s", inbound.Protocol)
+		}
+		realitySettings, _ := stream["realitySettings"].(map[string]any)
+		clientSettings, _ := realitySettings["settings"].(map[string]any)
+		opts := &clashRealityOpts{}
+		opts.PublicKey, _ = clientSettings["publicKey"].(string)
+		// The first ones, for configurations that do not change between updates
+		if serverNames, _ := realitySettings["serverNames"].([]any); len(serverNames) > 0 {
+			proxy.ServerName, _ = serverNames[0].(string)
+		}
+		if shortIds, _ := realitySettings["shortIds"].([]any); len(shortIds) > 0 {
+			opts.ShortId, _ = shortIds[0].(string)
+		}
+		proxy.TLS = true
+		proxy.ClientFingerprint, _ = clientSettings["fingerprint"].(string)
+		if proxy.ClientFingerprint == "" {
+			proxy.ClientFingerprint = "chrome"
+		}
+		proxy.RealityOpts = opts
+	case "none":
+		if inbound.Protocol == model.Trojan {
+			return nil, common.NewError("Clash has no trojan without TLS")
+		}
+	default:
+		return nil, common.NewErrorf("Clash has no %s security", security)
+	}
+
+	if inbound.Protocol == model.Shadowsocks && (proxy.Network != "" || security != "none") {
+		return nil, common.NewError("Clash has no shadowsocks over a transport or TLS")
+	}
+	if inbound.Protocol == model.VLESS && network == "tcp" && security != "none" {
+		proxy.Flow = client.Flow
+	}
+	return proxy, nil
+}
@@ -0,0 +1,203 @@
+package sub
+
+import (
+	"flag"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"x-ui/database"
+	"x-ui/database/model"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files of testdata")
+
+// clashTestInbound saves an inbound of protocol named remark, with the client
+// remark of the subscription subId. The client is given as the JSON of its
+// settings.
+func clashTestInbound(t *testing.T, remark string, subId string, protocol model.Protocol, port int, settings string, stream string) {
+	t.Helper()
+	settings = strings.ReplaceAll(settings, `"email":"{subId}"`, `"email":"`+remark+`"`)
+	inbound := &model.Inbound{
+		Remark: remark, Enable: true, Port: port, Protocol: protocol, Tag: "inbound-" + strconv.Itoa(port),
+		Settings: strings.ReplaceAll(settings, "{subId}", subId), StreamSettings: stream,
+	}
+	if err := database.GetDB().Create(inbound).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+const (
+	clashVmessClient  = `{"clients":[{"id":"0f0c2d7b-6f2e-4b8e-8f4a-2a6e5f1c9d33","security":"aes-128-gcm","email":"{subId}","subId":"{subId}","enable":true}]}`
+	clashVlessClient  = `{"clients":[{"id":"5d2b3f8c-1a9e-4c6d-b7f0-8e4a2c1d6b55","flow":"xtls-rprx-vision","email":"{subId}","subId":"{subId}","enable":true}],"decryption":"none"}`
+	clashTrojanClient = `{"clients":[{"password":"Zq8vN2xL5cR1","email":"{subId}","subId":"{subId}","enable":true}]}`
+	clashSSClient     = `{"method":"chacha20-ietf-poly1305","password":"","clients":[{"method":"chacha20-ietf-poly1305","password":"c2VjcmV0","email":"{subId}","subId":"{subId}","enable":true}]}`
+	clashSS2022Client = `{"method":"2022-blake3-aes-128-gcm","password":"aW5ib3VuZC1zZWNyZXQ=","clients":[{"method":"","password":"Y2xpZW50LXNlY3JldA==","email":"{subId}","subId":"{subId}","enable":true}]}`
+
+	clashTLS     = `"security":"tls","tlsSettings":{"serverName":"cdn.example.com","alpn":["h2","http/1.1"],"settings":{"allowInsecure":true,"fingerprint":"firefox"}}`
+	clashReality = `"security":"reality","realitySettings":{"serverNames":["www.microsoft.com","microsoft.com"],"shortIds":["6ba85179e30d4fc2","ab"],"settings":{"publicKey":"jNXHt1yRo0vDuchQlIP6Z0ZvjT3KtzVI-T4E7RoLJS0","fingerprint":"safari"}}`
+)
+
+// clashCombinations are the protocols and transports Clash.Meta has, each
+// with its golden file testdata/clash/<subId>.yaml.
+var clashCombinations = []struct {
+	subId    string
+	protocol model.Protocol
+	settings string
+	stream   string
+}{
+	{"vmess-tcp", model.VMESS, clashVmessClient, `{"network":"tcp","security":"none","tcpSettings":{"header":{"type":"none"}}}`},
+	{"vmess-tcp-http", model.VMESS, clashVmessClient, `{"network":"tcp","security":"none","tcpSettings":{"header":{"type":"http","request":{"method":"GET","path":["/a","/b"],"headers":{"Host":["a.example.com","b.example.com"],"Connection":"keep-alive"}}}}}`},
+	{"vmess-ws-tls", model.VMESS, clashVmessClient, `{"network":"ws",` + clashTLS + `,"wsSettings":{"path":"/ws?ed=2048","host":"ws.example.com"}}`},
+	{"vmess-grpc", model.VMESS, clashVmessClient, `{"network":"grpc","security":"none","grpcSettings":{"serviceName":"tunnel","multiMode":true}}`},
+	{"vless-tcp-reality", model.VLESS, clashVlessClient, `{"network":"tcp",` + clashReality + `,"tcpSettings":{"header":{"type":"none"}}}`},
+	{"vless-tcp-tls", model.VLESS, clashVlessClient, `{"network":"tcp",` + clashTLS + `,"tcpSettings":{"header":{"type":"none"}}}`},
+	{"vless-ws", model.VLESS, clashVlessClient, `{"network":"ws","security":"none","wsSettings":{"path":"/ws","headers":{"Host":"ws.example.com"}}}`},
+	{"vless-httpupgrade-tls", model.VLESS, clashVlessClient, `{"network":"httpupgrade",` + clashTLS + `,"httpupgradeSettings":{"path":"/upgrade","host":"up.example.com"}}`},
+	{"vless-grpc-reality", model.VLESS, clashVlessClient, `{"network":"grpc",` + clashReality + `,"grpcSettings":{"serviceName":"tunnel"}}`},
+	{"vless-xhttp-tls", model.VLESS, clashVlessClient, `{"network":"xhttp",` + clashTLS + `,"xhttpSettings":{"path":"/xhttp","host":"x.example.com","mode":"stream-one"}}`},
+	{"trojan-tcp-tls", model.Trojan, clashTrojanClient, `{"network":"tcp",` + clashTLS + `,"tcpSettings":{"header":{"type":"none"}}}`},
+	{"trojan-ws-tls", model.Trojan, clashTrojanClient, `{"network":"ws",` + clashTLS + `,"wsSettings":{"path":"/trojan","host":"ws.example.com"}}`},
+	{"trojan-grpc-tls", model.Trojan, clashTrojanClient, `{"network":"grpc",` + clashTLS + `,"grpcSettings":{"serviceName":"trojan"}}`},
+	{"ss-tcp", model.Shadowsocks, clashSSClient, `{"network":"tcp","security":"none","tcpSettings":{"header":{"type":"none"}}}`},
+	{"ss2022-tcp", model.Shadowsocks, clashSS2022Client, `{"network":"tcp","security":"none","tcpSettings":{"header":{"type":"none"}}}`},
+}
+
+// clashUnsupported are combinations Clash.Meta has no equivalent of, with the
+// reason they are skipped for.
+var clashUnsupported = []struct {
+	subId    string
+	protocol model.Protocol
+	settings string
+	stream   string
+	reason   string
+}{
+	{"trojan-tcp", model.Trojan, clashTrojanClient, `{"network":"tcp","security":"none"}`, "Clash has no trojan without TLS"},
+	{"trojan-tcp-http", model.Trojan, clashTrojanClient, `{"network":"tcp",` + clashTLS + `,"tcpSettings":{"header":{"type":"http"}}}`, "Clash has no HTTP header obfuscation for trojan"},
+	{"vmess-tcp-reality", model.VMESS, clashVmessClient, `{"network":"tcp",` + clashReality + `}`, "Clash has no REALITY for vmess"},
+	{"vmess-xhttp", model.VMESS, clashVmessClient, `{"network":"xhttp","security":"none","xhttpSettings":{"path":"/"}}`, "Clash has no xhttp transport for vmess"},
+	{"vless-kcp", model.VLESS, clashVlessClient, `{"network":"kcp","security":"none"}`, "Clash has no kcp transport"},
+	{"ss-ws", model.Shadowsocks, clashSSClient, `{"network":"ws","security":"none","wsSettings":{"path":"/"}}`, "Clash has no shadowsocks over a transport or TLS"},
+}
+
+func TestClashGolden(t *testing.T) {
+	if err := database.InitDB(t.TempDir() + "/x-ui.db"); err != nil {
+		t.Fatal(err)
+	}
+	for i, combination := range clashCombinations {
+		clashTestInbound(t, combination.subId, combination.subId, combination.protocol, 30101+i, combination.settings, combination.stream)
+	}
+	s := NewSubClashService("- DOMAIN-SUFFIX,lan,DIRECT\n- MATCH,PROXY\n", NewSubService(false, "-ieo"))
+
+	for _, combination := range clashCombinations {
+		t.Run(combination.subId, func(t *testing.T) {
+			config, _, err := s.GetClash(combination.subId, "example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			golden := filepath.Join("testdata", "clash", combination.subId+".yaml")
+			if *updateGolden {
+				if err := os.WriteFile(golden, []byte(config), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config != string(want) {
+				t.Errorf("the configuration differs from %s:\n%s", golden, config)
+			}
+		})
+	}
+}
+
+func TestClashUnsupported(t *testing.T) {
+	if err := database.InitDB(t.TempDir() + "/x-ui.db"); err != nil {
+		t.Fatal(err)
+	}
+	// All of them in one subscription, with one proxy Clash has
+	const subId = "mixed"
+	clashTestInbound(t, subId, subId, model.VLESS, 30201, clashVlessClient, clashCombinations[4].stream)
+	for i, unsupported := range clashUnsupported {
+		clashTestInbound(t, unsupported.subId, subId, unsupported.protocol, 30202+i, unsupported.settings, unsupported.stream)
+	}
+
+	s := NewSubClashService("", NewSubService(false, "-ieo"))
+	config, _, err := s.GetClash(subId, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, unsupported := range clashUnsupported {
+		comment := "# skipped " + unsupported.subId + "-" + unsupported.subId + ": " + unsupported.reason + "\n"
+		if !strings.Contains(config, comment) {
+			t.Errorf("the configuration doesn't tell %q:\n%s", comment, config)
+		}
+	}
+
+	var parsed clashConfig
+	if err := yaml.Unmarshal([]byte(config), &parsed); err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed.Proxies) != 1 || parsed.Proxies[0].Type != "vless" || parsed.Proxies[0].RealityOpts == nil {
+		t.Errorf("the proxies are %+v", parsed.Proxies)
+	}
+	if len(parsed.ProxyGroups) != 1 || len(parsed.ProxyGroups[0].Proxies) != 1 || parsed.ProxyGroups[0].Proxies[0] != parsed.Proxies[0].Name {
+		t.Errorf("the groups are %+v", parsed.ProxyGroups)
+	}
+	// Without rules everything goes through the proxies
+	if len(parsed.Rules) != 1 || parsed.Rules[0] != "MATCH,PROXY" {
+		t.Errorf("the rules are %v", parsed.Rules)
+	}
+}
+
+func TestClashRules(t *testing.T) {
+	tests := []struct {
+		rules string
+		want  []string
+	}{
+		{"", []string{"MATCH,PROXY"}},
+		{"[]", []string{"MATCH,PROXY"}},
+		{"- GEOIP,CN,DIRECT\n- MATCH,PROXY\n", []string{"GEOIP,CN,DIRECT", "MATCH,PROXY"}},
+		{"- MATCH\n", []string{"MATCH,PROXY"}},
+		{"rules: {}", []string{"MATCH,PROXY"}},
+	}
+	for _, test := range tests {
+		s := NewSubClashService(test.rules, nil)
+		if strings.Join(s.rules, "|") != strings.Join(test.want, "|") {
+			t.Errorf("the rules %q are %v, want %v", test.rules, s.rules, test.want)
+		}
+	}
+}
+
+func TestSubFormat(t *testing.T) {
+	tests := []struct {
+		query     string
+		userAgent string
+		want      string
+	}{
+		{"", "v2rayNG/1.8.5", ""},
+		{"", "", ""},
+		{"?format=clash", "v2rayNG/1.8.5", "clash"},
+		{"?format=singbox", "", "singbox"},
+		{"", "clash-verge/v1.7.7", "clash"},
+		{"", "ClashX Pro/1.118.0", "clash"},
+		{"", "mihomo/1.18.10", "clash"},
+		{"?format=base64", "clash-verge/v1.7.7", ""},
+		{"?format=yaml", "", ""},
+	}
+	for _, test := range tests {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("GET", "/sub/abc"+test.query, nil)
+		c.Request.Header.Set("User-Agent", test.userAgent)
+		if format := subFormat(c); format != test.want {
+			t.Errorf("%q from %q is the format %q, want %q", test.query, test.userAgent, format, test.want)
+		}
+	}
+}
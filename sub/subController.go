@@ -3,8 +3,17 @@ package sub
 import (
 	"encoding/base64"
 	"net"
+	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 
+	"x-ui/database"
+	"x-ui/logger"
+	"x-ui/web/metrics"
+	"x-ui/web/middleware"
+	"x-ui/web/service"
+
 	"github.com/gin-gonic/gin"
 )
 
@@ -14,9 +23,19 @@ type SUBController struct {
 	subJsonPath    string
 	subEncrypt     bool
 	updateInterval string
+	// cache is nil when subscriptions are built for every request
+	cache *subCache
+	// page is nil when browsers get the links as apps do
+	page *subPage
+	// aggregator is nil when there are no remote subscriptions to merge
+	aggregator *subAggregator
+
+	subAccessService service.SubAccessService
 
-	subService     *SubService
-	subJsonService *SubJsonService
+	subService        *SubService
+	subJsonService    *SubJsonService
+	subClashService   *SubClashService
+	subSingboxService *SubSingboxService
 }
 
 func NewSUBController(
@@ -32,6 +51,14 @@ func NewSUBController(
 	jsonMux string,
 	jsonRules string,
 	subTitle string,
+	clashRules string,
+	singboxVersion string,
+	singboxDns string,
+	singboxRoute string,
+	cache bool,
+	cacheGranularity int,
+	page *subPage,
+	aggregator *subAggregator,
 ) *SUBController {
 	sub := NewSubService(showInfo, rModel)
 	a := &SUBController{
@@ -40,9 +67,16 @@ func NewSUBController(
 		subJsonPath:    jsonPath,
 		subEncrypt:     encrypt,
 		updateInterval: update,
+		page:           page,
+		aggregator:     aggregator,
 
-		subService:     sub,
-		subJsonService: NewSubJsonService(jsonFragment, jsonNoise, jsonMux, jsonRules, sub),
+		subService:        sub,
+		subJsonService:    NewSubJsonService(jsonFragment, jsonNoise, jsonMux, jsonRules, sub),
+		subClashService:   NewSubClashService(clashRules, sub),
+		subSingboxService: NewSubSingboxService(singboxVersion, singboxDns, singboxRoute, sub),
+	}
+	if cache {
+		a.cache = newSubCache(cacheGranularity)
 	}
 	a.initRouter(g)
 	return a
@@ -53,50 +87,231 @@ func (a *SUBController) initRouter(g *gin.RouterGroup) {
 	gJson := g.Group(a.subJsonPath)
 
 	gLink.GET(":subid", a.subs)
+	gLink.GET(":subid/:device", a.subs)
 
 	gJson.GET(":subid", a.subJsons)
+	gJson.GET(":subid/:device", a.subJsons)
 }
 
 func (a *SUBController) subs(c *gin.Context) {
 	subId := c.Param("subid")
-	var host string
-	if h, err := getHostFromXFH(c.GetHeader("X-Forwarded-Host")); err == nil {
-		host = h
+	if _, ok := subDevice(c); !ok {
+		c.String(400, "Error!")
+		return
 	}
-	if host == "" {
-		host = c.GetHeader("X-Real-IP")
+	host := subHost(c)
+	if a.page != nil && wantsPage(c) {
+		a.subPage(c, subId, host)
+		return
 	}
-	if host == "" {
-		var err error
-		host, _, err = net.SplitHostPort(c.Request.Host)
-		if err != nil {
-			host = c.Request.Host
-		}
+	format := subFormat(c)
+	key := subCacheKey{subId, format, host}
+	if format == "" && c.Query("aggregate") == "1" && !fromAggregator(c) {
+		key.format = "aggregate"
 	}
-	subs, header, err := a.subService.GetSubs(subId, host)
-	if err != nil || len(subs) == 0 {
-		c.String(400, "Error!")
-	} else {
+	a.serve(c, key, func() (*subReply, *subHeader, error) {
+		switch format {
+		case "clash":
+			return a.subClash(subId, host)
+		case "singbox":
+			return a.subSingbox(subId, host)
+		}
+		subs, header, err := a.subService.GetSubs(subId, host)
+		if err != nil || len(subs) == 0 {
+			return nil, nil, err
+		}
+		// The remotes have their own cache, the merged links are not cached
+		aggregated := a.aggregator != nil && (key.format == "aggregate" || header.aggregate) && !fromAggregator(c)
+		if aggregated {
+			subs, header = a.aggregator.aggregate(a.subService, subId, subs, header)
+		}
 		result := ""
 		for _, sub := range subs {
 			result += sub + "\n"
 		}
-
-		// Add headers
-		c.Writer.Header().Set("Subscription-Userinfo", header)
-		c.Writer.Header().Set("Profile-Update-Interval", a.updateInterval)
-		c.Writer.Header().Set("Profile-Title", "base64:" + base64.StdEncoding.EncodeToString([]byte(a.subTitle)))
-
 		if a.subEncrypt {
-			c.String(200, base64.StdEncoding.EncodeToString([]byte(result)))
-		} else {
-			c.String(200, result)
+			result = base64.StdEncoding.EncodeToString([]byte(result))
 		}
-	}
+		reply := newSubReply("text/plain; charset=utf-8", a.headers(header), []byte(result))
+		reply.uncached = aggregated
+		return reply, header, nil
+	})
 }
 
 func (a *SUBController) subJsons(c *gin.Context) {
 	subId := c.Param("subid")
+	if _, ok := subDevice(c); !ok {
+		c.String(400, "Error!")
+		return
+	}
+	host := subHost(c)
+	a.serve(c, subCacheKey{subId, "json", host}, func() (*subReply, *subHeader, error) {
+		jsonSub, header, err := a.subJsonService.GetJson(subId, host)
+		if err != nil || len(jsonSub) == 0 {
+			return nil, nil, err
+		}
+		return newSubReply("text/plain; charset=utf-8", a.headers(header), []byte(jsonSub)), header, nil
+	})
+}
+
+// subPage replies with the HTML page of the subscription, for browsers.
+func (a *SUBController) subPage(c *gin.Context, subId string, host string) {
+	subs, header, err := a.subService.GetSubs(subId, host)
+	if err != nil {
+		c.String(400, "Error!")
+		return
+	}
+	if len(subs) == 0 {
+		c.String(404, "Not Found")
+		return
+	}
+	page, err := a.page.render(c, header, a.page.subURL(c, subId), a.subTitle)
+	if err != nil {
+		logger.Warning("Unable to render the subscription page:", err)
+		c.String(500, "Error!")
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.Header("Vary", "Accept, User-Agent")
+	c.Header("Content-Security-Policy", "default-src 'none'; img-src data: https: http:; style-src 'unsafe-inline'; base-uri 'none'; form-action 'none'; frame-ancestors 'none'")
+	c.Data(200, "text/html; charset=utf-8", page)
+}
+
+// subClash builds the Clash.Meta configuration of the subscription.
+func (a *SUBController) subClash(subId string, host string) (*subReply, *subHeader, error) {
+	clashSub, header, err := a.subClashService.GetClash(subId, host)
+	if err != nil || len(clashSub) == 0 {
+		return nil, nil, err
+	}
+	headers := a.headers(header)
+	// Clash names the profile after the file
+	if a.subTitle != "" {
+		headers.Set("Content-Disposition", "attachment; filename*=UTF-8''"+url.PathEscape(a.subTitle)+".yaml")
+	}
+	return newSubReply("text/yaml; charset=utf-8", headers, []byte(clashSub)), header, nil
+}
+
+// subSingbox builds the sing-box configuration of the subscription.
+func (a *SUBController) subSingbox(subId string, host string) (*subReply, *subHeader, error) {
+	singboxSub, header, err := a.subSingboxService.GetSingbox(subId, host)
+	if err != nil || len(singboxSub) == 0 {
+		return nil, nil, err
+	}
+	return newSubReply("application/json; charset=utf-8", a.headers(header), []byte(singboxSub)), header, nil
+}
+
+// serve replies with the subscription of key, from the cache if it is up to
+// date there and built otherwise, and records the fetch. A nil reply of build
+// is for an unknown or rotated subscription ID. Clients sending back the ETag
+// of the reply get a 304 without the body.
+func (a *SUBController) serve(c *gin.Context, key subCacheKey, build func() (*subReply, *subHeader, error)) {
+	var reply *subReply
+	if a.cache != nil {
+		reply = a.cache.get(key)
+		metrics.ObserveSubCache(reply != nil)
+	}
+	if reply == nil {
+		writes := database.Writes(subCacheTables...)
+		built, header, err := build()
+		if err != nil {
+			c.String(400, "Error!")
+			return
+		}
+		if built == nil {
+			c.String(404, "Not Found")
+			return
+		}
+		reply = built
+		reply.emails = header.emails
+		if a.cache != nil && !reply.uncached {
+			a.cache.put(key, reply, writes)
+		}
+	}
+	device, _ := subDevice(c)
+	a.subAccessService.Record(key.subId, reply.emails, middleware.ClientIP(c), c.Request.UserAgent(), device)
+
+	for name, values := range reply.header {
+		c.Writer.Header()[name] = values
+	}
+	c.Writer.Header().Set("ETag", reply.etag)
+	c.Writer.Header().Set("Cache-Control", "no-cache")
+	if reply.matches(c.GetHeader("If-None-Match")) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.Data(200, reply.contentType, reply.body)
+}
+
+// headers returns the headers apps take the quota, expiry and title of a
+// subscription from, and how often to update it.
+func (a *SUBController) headers(header *subHeader) http.Header {
+	headers := http.Header{}
+	headers.Set("Subscription-Userinfo", header.userinfo())
+	updateInterval := a.updateInterval
+	if header.updateInterval > 0 {
+		updateInterval = strconv.Itoa(header.updateInterval)
+	}
+	headers.Set("Profile-Update-Interval", updateInterval)
+	if a.subTitle != "" {
+		headers.Set("Profile-Title", profileTitle(a.subTitle))
+	}
+	return headers
+}
+
+// profileTitle returns the Profile-Title header of title, base64 encoded if
+// it is not plain ASCII since header values can not carry it.
+func profileTitle(title string) string {
+	for i := 0; i < len(title); i++ {
+		if title[i] < ' ' || title[i] > '~' {
+			return "base64:" + base64.StdEncoding.EncodeToString([]byte(title))
+		}
+	}
+	return title
+}
+
+// subFormat returns the format a subscription request is for: "clash" or
+// "singbox" when asked for with ?format=, "clash" as well for requests of Clash
+// clients unless they ask for ?format=base64, and "" for the links.
+func subFormat(c *gin.Context) string {
+	switch format := c.Query("format"); format {
+	case "clash", "singbox":
+		return format
+	case "base64":
+		return ""
+	}
+	userAgent := strings.ToLower(c.GetHeader("User-Agent"))
+	if strings.Contains(userAgent, "clash") || strings.Contains(userAgent, "mihomo") {
+		return "clash"
+	}
+	return ""
+}
+
+// subDevice returns the label of the device a subscription request is of, from
+// the path like /sub/<subId>/phone or from ?device=phone, "" if it has none.
+// It returns false for a label that is not valid.
+func subDevice(c *gin.Context) (string, bool) {
+	device := c.Param("device")
+	if device == "" {
+		device = c.Query("device")
+	}
+	if device == "" {
+		return "", true
+	}
+	if !service.IsValidSubDevice(device) {
+		return "", false
+	}
+	return device, true
+}
+
+// fromAggregator tells whether a subscription request is of another panel
+// merging the subscription into its own, which gets the local links only so
+// that panels merging each other's don't loop.
+func fromAggregator(c *gin.Context) bool {
+	return strings.HasPrefix(c.GetHeader("User-Agent"), "x-ui/")
+}
+
+// subHost returns the host the links of a subscription request point to.
+func subHost(c *gin.Context) string {
 	var host string
 	if h, err := getHostFromXFH(c.GetHeader("X-Forwarded-Host")); err == nil {
 		host = h
@@ -111,18 +326,7 @@ func (a *SUBController) subJsons(c *gin.Context) {
 			host = c.Request.Host
 		}
 	}
-	jsonSub, header, err := a.subJsonService.GetJson(subId, host)
-	if err != nil || len(jsonSub) == 0 {
-		c.String(400, "Error!")
-	} else {
-
-		// Add headers
-		c.Writer.Header().Set("Subscription-Userinfo", header)
-		c.Writer.Header().Set("Profile-Update-Interval", a.updateInterval)
-		c.Writer.Header().Set("Profile-Title", "base64:" + base64.StdEncoding.EncodeToString([]byte(a.subTitle)))
-
-		c.String(200, jsonSub)
-	}
+	return host
 }
 
 func getHostFromXFH(s string) (string, error) {
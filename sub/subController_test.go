@@ -0,0 +1,178 @@
+package sub
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/xray"
+
+	"github.com/gin-gonic/gin"
+)
+
+// headerTestClient is a client of the subscription subId and its traffic.
+type headerTestClient struct {
+	inbound  int
+	email    string
+	subId    string
+	enable   bool
+	updates  int
+	up, down int64
+	total    int64
+	expiry   int64
+}
+
+// headerTestEngine saves two inbounds with clients and returns the engine
+// serving their subscriptions with the title and the default update interval
+// of 12 hours.
+func headerTestEngine(t *testing.T, title string, clients []headerTestClient) *gin.Engine {
+	t.Helper()
+	if err := database.InitDB(t.TempDir() + "/x-ui.db"); err != nil {
+		t.Fatal(err)
+	}
+	db := database.GetDB()
+	inbounds := []*model.Inbound{
+		{Remark: "vmess", Enable: true, Port: 30401, Protocol: model.VMESS, Tag: "inbound-30401",
+			StreamSettings: `{"network":"tcp","security":"none"}`},
+		{Remark: "trojan", Enable: true, Port: 30402, Protocol: model.Trojan, Tag: "inbound-30402",
+			StreamSettings: `{"network":"tcp","security":"tls","tlsSettings":{"serverName":"example.com"}}`},
+	}
+	settings := []string{"", ""}
+	for i, client := range clients {
+		if settings[client.inbound] != "" {
+			settings[client.inbound] += ","
+		}
+		settings[client.inbound] += fmt.Sprintf(
+			`{"id":"0f0c2d7b-6f2e-4b8e-8f4a-2a6e5f1c9d%02d","password":"secret-%d","email":%q,"subId":%q,"enable":%t,"subUpdates":%d}`,
+			i, i, client.email, client.subId, client.enable, client.updates)
+	}
+	for i, inbound := range inbounds {
+		inbound.Settings = `{"clients":[` + settings[i] + `]}`
+		if err := db.Create(inbound).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, client := range clients {
+		traffic := &xray.ClientTraffic{
+			InboundId: inbounds[client.inbound].Id, Enable: client.enable, Email: client.email,
+			Up: client.up, Down: client.down, Total: client.total, ExpiryTime: client.expiry,
+		}
+		if err := db.Create(traffic).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	NewSUBController(engine.Group("/"), "/sub/", "/json/", false, false, "-ieo", "12",
+		"", "", "", "", title, "", "1.11", "", "", false, 0, nil, nil)
+	return engine
+}
+
+func TestSubHeaders(t *testing.T) {
+	nearest := time.Date(2030, 1, 2, 0, 0, 0, 0, time.UTC).UnixMilli()
+	clients := []headerTestClient{
+		{inbound: 0, email: "phone", subId: "family", enable: true, up: 100, down: 200, total: 1000, expiry: nearest + 86400000},
+		{inbound: 0, email: "laptop", subId: "family", enable: true, updates: 6, up: 10, down: 20, total: 2000, expiry: nearest},
+		// Across inbounds, with an expiry counted from the first use
+		{inbound: 1, email: "tablet", subId: "family", enable: true, updates: 3, up: 1, down: 2, total: 3000, expiry: -86400000},
+		// Neither disabled clients nor those of other subscriptions count
+		{inbound: 1, email: "old", subId: "family", enable: false, up: 1 << 20, down: 1 << 20, total: 1 << 30},
+		{inbound: 0, email: "friend", subId: "friend", enable: true, up: 5, down: 5},
+	}
+	engine := headerTestEngine(t, "Семья 🏠", clients)
+	title := "base64:" + base64.StdEncoding.EncodeToString([]byte("Семья 🏠"))
+
+	// Every format has the headers
+	for _, path := range []string{"/sub/family", "/sub/family?format=clash", "/sub/family?format=singbox", "/json/family"} {
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s replied %d: %s", path, w.Code, w.Body)
+		}
+		want := fmt.Sprintf("upload=111; download=222; total=6000; expire=%d", nearest/1000)
+		if userinfo := w.Header().Get("Subscription-Userinfo"); userinfo != want {
+			t.Errorf("%s has the userinfo %q, want %q", path, userinfo, want)
+		}
+		// The smallest interval of the clients
+		if interval := w.Header().Get("Profile-Update-Interval"); interval != "3" {
+			t.Errorf("%s has the update interval %q", path, interval)
+		}
+		if profileTitle := w.Header().Get("Profile-Title"); profileTitle != title {
+			t.Errorf("%s has the title %q, want %q", path, profileTitle, title)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/sub/friend", nil))
+	// Unlimited and without expiry, with the default update interval
+	if userinfo := w.Header().Get("Subscription-Userinfo"); userinfo != "upload=5; download=5" {
+		t.Errorf("the unlimited client has the userinfo %q", userinfo)
+	}
+	if interval := w.Header().Get("Profile-Update-Interval"); interval != "12" {
+		t.Errorf("the update interval is %q, want the default", interval)
+	}
+	// The links stay the default format
+	if !strings.HasPrefix(w.Body.String(), "vmess://") {
+		t.Errorf("the subscription is %q, want its links", w.Body)
+	}
+}
+
+func TestSubHeaderUnlimited(t *testing.T) {
+	// One unlimited client makes the whole subscription unlimited
+	clients := []headerTestClient{
+		{inbound: 0, email: "phone", subId: "family", enable: true, up: 100, down: 200, total: 1000},
+		{inbound: 1, email: "laptop", subId: "family", enable: true, up: 10, down: 20},
+	}
+	engine := headerTestEngine(t, "Home", clients)
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/sub/family", nil))
+	if userinfo := w.Header().Get("Subscription-Userinfo"); userinfo != "upload=110; download=220" {
+		t.Errorf("the userinfo is %q", userinfo)
+	}
+	if title := w.Header().Get("Profile-Title"); title != "Home" {
+		t.Errorf("the ASCII title is %q", title)
+	}
+}
+
+func TestProfileTitle(t *testing.T) {
+	tests := map[string]string{
+		"My VPN":    "My VPN",
+		"a~b!":      "a~b!",
+		"Мой VPN":   "base64:0JzQvtC5IFZQTg==",
+		"tab\there": "base64:dGFiCWhlcmU=",
+	}
+	for title, want := range tests {
+		if header := profileTitle(title); header != want {
+			t.Errorf("the title %q is sent as %q, want %q", title, header, want)
+		}
+	}
+}
+
+func TestSubServerRoutes(t *testing.T) {
+	if err := database.InitDB(t.TempDir() + "/x-ui.db"); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := NewServer().initRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The public listener has nothing of the panel API, the QR codes of the
+	// clients included
+	for _, route := range engine.Routes() {
+		if strings.Contains(route.Path, "panel") || strings.HasSuffix(route.Path, "/qr") {
+			t.Errorf("the subscription server serves %s %s", route.Method, route.Path)
+		}
+	}
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/panel/api/clients/phone/qr", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("the QR code of a client replied %d on the subscription server", w.Code)
+	}
+}
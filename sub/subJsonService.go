@@ -11,7 +11,6 @@ import (
 	"x-ui/util/json_util"
 	"x-ui/util/random"
 	"x-ui/web/service"
-	"x-ui/xray"
 )
 
 //go:embed default.json
@@ -67,17 +66,23 @@ func NewSubJsonService(fragment string, noises string, mux string, rules string,
 	}
 }
 
-func (s *SubJsonService) GetJson(subId string, host string) (string, string, error) {
+func (s *SubJsonService) GetJson(subId string, host string) (string, *subHeader, error) {
 	inbounds, err := s.SubService.getInboundsBySubId(subId)
 	if err != nil || len(inbounds) == 0 {
-		return "", "", err
+		return "", nil, err
 	}
+	s.SubService.remarkTemplate, _ = s.SubService.settingService.GetRemarkTemplate()
+	s.SubService.clientPorts, _ = s.SubService.settingService.GetPortRangeClientPort()
 
-	var header string
-	var traffic xray.ClientTraffic
-	var clientTraffics []xray.ClientTraffic
+	header := &subHeader{}
+	depletedClients := 0
 	var configArray []json_util.RawMessage
 
+	includeDisabled, err := s.SubService.settingService.GetSubIncludeDisabled()
+	if err != nil {
+		includeDisabled = true
+	}
+
 	// Prepare Inbounds
 	for _, inbound := range inbounds {
 		clients, err := s.inboundService.GetClients(inbound)
@@ -97,39 +102,29 @@ func (s *SubJsonService) GetJson(subId string, host string) (string, string, err
 		}
 
 		for _, client := range clients {
-			if client.Enable && client.SubID == subId {
-				clientTraffics = append(clientTraffics, s.SubService.getClientTraffics(inbound.ClientStats, client.Email))
-				newConfigs := s.getConfig(inbound, client, host)
+			show, depleted := s.SubService.showClient(inbound, client, subId, includeDisabled)
+			if depleted {
+				depletedClients++
+			}
+			if show || depleted {
+				header.add(client, s.SubService.getClientTraffics(inbound.ClientStats, client.Email))
+			}
+			if show {
+				clientInbound := tunedInbound(s.SubService.linkInbound(inbound, client.Email), linkOptions(inbound, client))
+				newConfigs := s.getConfig(clientInbound, client, host)
 				configArray = append(configArray, newConfigs...)
 			}
 		}
 	}
 
-	if len(configArray) == 0 {
-		return "", "", nil
+	if len(configArray) == 0 && depletedClients > 0 {
+		if inbound, client, ok := s.SubService.noticeClient(); ok {
+			configArray = append(configArray, s.getConfig(inbound, client, host)...)
+		}
 	}
 
-	// Prepare statistics
-	for index, clientTraffic := range clientTraffics {
-		if index == 0 {
-			traffic.Up = clientTraffic.Up
-			traffic.Down = clientTraffic.Down
-			traffic.Total = clientTraffic.Total
-			if clientTraffic.ExpiryTime > 0 {
-				traffic.ExpiryTime = clientTraffic.ExpiryTime
-			}
-		} else {
-			traffic.Up += clientTraffic.Up
-			traffic.Down += clientTraffic.Down
-			if traffic.Total == 0 || clientTraffic.Total == 0 {
-				traffic.Total = 0
-			} else {
-				traffic.Total += clientTraffic.Total
-			}
-			if clientTraffic.ExpiryTime != traffic.ExpiryTime {
-				traffic.ExpiryTime = 0
-			}
-		}
+	if len(configArray) == 0 {
+		return "", nil, nil
 	}
 
 	// Combile outbounds
@@ -140,7 +135,6 @@ func (s *SubJsonService) GetJson(subId string, host string) (string, string, err
 		finalJson, _ = json.MarshalIndent(configArray, "", "  ")
 	}
 
-	header = fmt.Sprintf("upload=%d; download=%d; total=%d; expire=%d", traffic.Up, traffic.Down, traffic.Total, traffic.ExpiryTime/1000)
 	return string(finalJson), header, nil
 }
 
@@ -166,7 +160,7 @@ func (s *SubJsonService) getConfig(inbound *model.Inbound, client model.Client,
 		extPrxy := ep.(map[string]any)
 		inbound.Listen = extPrxy["dest"].(string)
 		inbound.Port = int(extPrxy["port"].(float64))
-		newStream := stream
+		newStream := proxyStream(stream, extPrxy)
 		switch extPrxy["forceTls"].(string) {
 		case "tls":
 			if newStream["security"] != "tls" {
@@ -307,9 +301,7 @@ func (s *SubJsonService) genVnext(inbound *model.Inbound, streamSettings json_ut
 
 	outbound.Protocol = string(inbound.Protocol)
 	outbound.Tag = "proxy"
-	if s.mux != "" {
-		outbound.Mux = json_util.RawMessage(s.mux)
-	}
+	outbound.Mux = s.muxData(linkOptions(inbound, client))
 	outbound.StreamSettings = streamSettings
 	outbound.Settings = OutboundSettings{
 		Vnext: vnextData,
@@ -346,9 +338,7 @@ func (s *SubJsonService) genServer(inbound *model.Inbound, streamSettings json_u
 
 	outbound.Protocol = string(inbound.Protocol)
 	outbound.Tag = "proxy"
-	if s.mux != "" {
-		outbound.Mux = json_util.RawMessage(s.mux)
-	}
+	outbound.Mux = s.muxData(linkOptions(inbound, client))
 	outbound.StreamSettings = streamSettings
 	outbound.Settings = OutboundSettings{
 		Servers: serverData,
@@ -358,6 +348,23 @@ func (s *SubJsonService) genServer(inbound *model.Inbound, streamSettings json_u
 	return result
 }
 
+// muxData returns the mux of the outbound of a client with options: the one of
+// the settings, unless the options enable or disable mux.cool.
+func (s *SubJsonService) muxData(options model.LinkOptions) json_util.RawMessage {
+	if options.Mux == nil && options.MuxConcurrency == 0 {
+		if s.mux == "" {
+			return nil
+		}
+		return json_util.RawMessage(s.mux)
+	}
+	mux := map[string]any{"enabled": options.Mux == nil || *options.Mux}
+	if mux["enabled"] == true && options.MuxConcurrency > 0 {
+		mux["concurrency"] = options.MuxConcurrency
+	}
+	result, _ := json.Marshal(mux)
+	return result
+}
+
 type Outbound struct {
 	Protocol       string               `json:"protocol"`
 	Tag            string               `json:"tag"`
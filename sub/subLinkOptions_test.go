@@ -0,0 +1,108 @@
+package sub
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"x-ui/database"
+	"x-ui/database/model"
+)
+
+// linkOptionsCases are inbounds with link options for their clients, each with
+// its golden file testdata/linkoptions/<subId>.txt of the links and the Xray
+// JSON, Clash and sing-box subscriptions.
+var linkOptionsCases = []struct {
+	subId    string
+	protocol model.Protocol
+	settings string
+	stream   string
+	defaults *model.LinkOptions
+}{
+	// All the options the formats can have, mux.cool only in the Xray JSON
+	{"vless-ws-tls", model.VLESS, clashVlessClient, `{"network":"ws",` + clashTLS + `,"wsSettings":{"path":"/ws","host":"ws.example.com"}}`,
+		&model.LinkOptions{Mux: linkOptionsBool(true), MuxConcurrency: 8, ALPN: []string{"h2"}, Fingerprint: "chrome",
+			AllowInsecure: linkOptionsBool(false), WSEarlyData: 2048}},
+	{"vmess-grpc-tls", model.VMESS, clashVmessClient, `{"network":"grpc",` + clashTLS + `,"grpcSettings":{"serviceName":"tunnel","authority":"","multiMode":false}}`,
+		&model.LinkOptions{GRPCMultiMode: linkOptionsBool(true), ALPN: []string{"h3", "h2"}, Fingerprint: "ios"}},
+	// The early data in another header is left out of the links
+	{"trojan-ws-header", model.Trojan, clashTrojanClient, `{"network":"ws",` + clashTLS + `,"wsSettings":{"path":"/trojan?ed=512","host":"ws.example.com"}}`,
+		&model.LinkOptions{WSEarlyData: 4096, WSEarlyDataHeader: "X-Early-Data"}},
+	// The options of the client override those of the inbound
+	{"vless-reality-client", model.VLESS,
+		`{"clients":[{"id":"5d2b3f8c-1a9e-4c6d-b7f0-8e4a2c1d6b55","flow":"xtls-rprx-vision","email":"{subId}","subId":"{subId}","enable":true,"linkOptions":{"fingerprint":"edge","mux":false}}],"decryption":"none"}`,
+		`{"network":"tcp","security":"reality","realitySettings":{"serverNames":["www.microsoft.com"],"shortIds":["6ba85179e30d4fc2"],"settings":{"publicKey":"jNXHt1yRo0vDuchQlIP6Z0ZvjT3KtzVI-T4E7RoLJS0","fingerprint":"safari"}},"tcpSettings":{"header":{"type":"none"}}}`,
+		&model.LinkOptions{Mux: linkOptionsBool(true), Fingerprint: "firefox"}},
+}
+
+func linkOptionsBool(value bool) *bool {
+	return &value
+}
+
+// randomSpiderX is the random path of the REALITY links and configurations.
+var randomSpiderX = regexp.MustCompile(`(spx=%2F|"spiderX": ?"/|spider-x: /)[0-9A-Za-z]{15}`)
+
+func TestLinkOptionsGolden(t *testing.T) {
+	if err := database.InitDB(t.TempDir() + "/x-ui.db"); err != nil {
+		t.Fatal(err)
+	}
+	db := database.GetDB()
+	for i, test := range linkOptionsCases {
+		inbound := &model.Inbound{
+			Remark: test.subId, Enable: true, Port: 30501 + i, Protocol: test.protocol, Tag: "inbound-" + strconv.Itoa(30501+i),
+			StreamSettings: test.stream, ClientDefaults: test.defaults,
+			Settings: strings.ReplaceAll(test.settings, "{subId}", test.subId),
+		}
+		if err := db.Create(inbound).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	subService := NewSubService(false, "-ieo")
+	jsonService := NewSubJsonService("", "", "", "", subService)
+	clashService := NewSubClashService("", subService)
+	singboxService := NewSubSingboxService("1.11", "", "", subService)
+
+	for _, test := range linkOptionsCases {
+		t.Run(test.subId, func(t *testing.T) {
+			links, _, err := subService.GetSubs(test.subId, "example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			jsonConfig, _, err := jsonService.GetJson(test.subId, "example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			clash, _, err := clashService.GetClash(test.subId, "example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			singbox, _, err := singboxService.GetSingbox(test.subId, "example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := "# links\n" + strings.Join(links, "\n") + "\n# xray json\n" + jsonConfig +
+				"\n# clash\n" + clash + "# sing-box\n" + singbox + "\n"
+			got = randomSpiderX.ReplaceAllString(got, "${1}{random}")
+
+			golden := filepath.Join("testdata", "linkoptions", test.subId+".txt")
+			if *updateGolden {
+				if err := os.MkdirAll(filepath.Dir(golden), 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(golden, []byte(got), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != string(want) {
+				t.Errorf("the configurations differ from %s:\n%s", golden, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,226 @@
+package sub
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/base64"
+	"html/template"
+	"net/url"
+	"strings"
+	"time"
+
+	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/web/locale"
+
+	"github.com/gin-gonic/gin"
+	"github.com/skip2/go-qrcode"
+)
+
+//go:embed subPage.html
+var subPageHTML string
+
+var subPageTemplate = template.Must(template.New("subPage").Parse(subPageHTML))
+
+// subPageQRSize is the size in pixels of the QR code of the subscription URL.
+const subPageQRSize = 256
+
+// subPageKeys are the messages of the page, under pages.subscription.
+var subPageKeys = []string{
+	"title", "status", "active", "inactive", "used", "remaining", "total",
+	"unlimited", "expiry", "never", "daysLeft", "import", "url", "scan",
+	"support", "upload", "download",
+}
+
+// subPage is the HTML page browsers get for a subscription URL instead of its
+// links, set up by the subPage settings.
+type subPage struct {
+	title   string
+	logo    string
+	support string
+	// subURI is the public URL of the subscriptions, empty to take the one
+	// the page was requested on
+	subURI string
+}
+
+func newSubPage(title string, logo string, support string, subURI string) *subPage {
+	return &subPage{
+		title:   title,
+		logo:    logo,
+		support: support,
+		subURI:  subURI,
+	}
+}
+
+// subURL returns the URL apps fetch the subscription subId from.
+func (p *subPage) subURL(c *gin.Context, subId string) string {
+	if p.subURI != "" {
+		return p.subURI + subId
+	}
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	if proto := c.GetHeader("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+		scheme = proto
+	}
+	host := c.Request.Host
+	if forwarded := c.GetHeader("X-Forwarded-Host"); forwarded != "" {
+		host = forwarded
+	}
+	return (&url.URL{Scheme: scheme, Host: host, Path: c.Request.URL.Path}).String()
+}
+
+type subPageButton struct {
+	Name string
+	URL  template.URL
+}
+
+type subPageData struct {
+	Lang    string
+	T       map[string]string
+	Title   string
+	Logo    string
+	Support string
+	// SupportURL is the link of the support contact, empty if it is plain text
+	SupportURL template.URL
+	Active     bool
+	Upload     string
+	Download   string
+	Used       string
+	Remaining  string
+	Total      string
+	// Percent is how much of the quota is used, 0 when unlimited
+	Percent  int
+	Expiry   string
+	DaysLeft int
+	URL      string
+	QRCode   template.URL
+	Buttons  []subPageButton
+}
+
+// wantsPage tells whether a subscription request is of a browser, asking for
+// an HTML document without a format, or asks for the page with ?page=1. Apps
+// get the links, also when their User-Agent looks like a browser's.
+func wantsPage(c *gin.Context) bool {
+	if page := c.Query("page"); page != "" {
+		return page == "1"
+	}
+	if c.Query("format") != "" {
+		return false
+	}
+	return strings.HasPrefix(c.GetHeader("User-Agent"), "Mozilla/") &&
+		strings.Contains(c.GetHeader("Accept"), "text/html")
+}
+
+// render writes the page of the clients of header, subURL being the URL apps
+// fetch the subscription from. It shows nothing but what the Subscription-Userinfo
+// header tells, and works without JavaScript.
+func (p *subPage) render(c *gin.Context, header *subHeader, subURL string, subTitle string) ([]byte, error) {
+	langs := locale.RequestLanguages(c)
+	data := &subPageData{
+		Lang:    "en",
+		T:       map[string]string{},
+		Title:   p.title,
+		Logo:    p.logo,
+		Support: p.support,
+		Active:  true,
+		URL:     subURL,
+	}
+	if len(langs) > 0 {
+		data.Lang = strings.SplitN(strings.SplitN(langs[0], ",", 2)[0], ";", 2)[0]
+	}
+	for _, key := range subPageKeys {
+		data.T[key] = locale.Localize(langs, "pages.subscription."+key)
+	}
+	if data.Title == "" {
+		data.Title = subTitle
+	}
+	if data.Title == "" {
+		data.Title = data.T["title"]
+	}
+	data.SupportURL = supportURL(p.support)
+
+	used := header.up + header.down
+	data.Upload = common.FormatTraffic(header.up)
+	data.Download = common.FormatTraffic(header.down)
+	data.Used = common.FormatTraffic(used)
+	if header.unlimited {
+		data.Total = data.T["unlimited"]
+		data.Remaining = data.T["unlimited"]
+	} else {
+		data.Total = common.FormatTraffic(header.total)
+		data.Remaining = common.FormatTraffic(max(header.total-used, 0))
+		if header.total > 0 {
+			data.Percent = int(min(used*100/header.total, 100))
+		}
+		data.Active = used < header.total
+	}
+	if header.expiry > 0 {
+		expiry := time.UnixMilli(header.expiry)
+		data.Expiry = expiry.Format("2006-01-02 15:04")
+		data.DaysLeft = max(int(time.Until(expiry).Hours()/24), 0)
+		data.Active = data.Active && time.Now().Before(expiry)
+	} else {
+		data.Expiry = data.T["never"]
+		data.DaysLeft = -1
+	}
+
+	png, err := qrcode.Encode(subURL, qrcode.Medium, subPageQRSize)
+	if err != nil {
+		logger.Warning("Unable to make the QR code of a subscription:", err)
+	} else {
+		data.QRCode = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png))
+	}
+	data.Buttons = importButtons(subURL, data.Title)
+
+	var page bytes.Buffer
+	if err := subPageTemplate.Execute(&page, data); err != nil {
+		return nil, err
+	}
+	return page.Bytes(), nil
+}
+
+// importButtons returns the links handing the subscription to the apps, the
+// Clash and sing-box ones to the formats of these apps.
+func importButtons(subURL string, title string) []subPageButton {
+	withFormat := func(format string) string {
+		u, err := url.Parse(subURL)
+		if err != nil {
+			return subURL
+		}
+		query := u.Query()
+		query.Set("format", format)
+		u.RawQuery = query.Encode()
+		return u.String()
+	}
+	name := url.QueryEscape(title)
+	return []subPageButton{
+		{"v2rayNG", template.URL("v2rayng://install-sub?url=" + url.QueryEscape(subURL) + "&name=" + name)},
+		{"Clash", template.URL("clash://install-config?url=" + url.QueryEscape(withFormat("clash")) + "&name=" + name)},
+		{"sing-box", template.URL("sing-box://import-remote-profile?url=" + url.QueryEscape(withFormat("singbox")) + "#" + url.PathEscape(title))},
+		{"Hiddify", template.URL("hiddify://import/" + subURL + "#" + url.PathEscape(title))},
+	}
+}
+
+// supportURL returns the link of a support contact: itself if it is an
+// http(s) or mailto URL, the Telegram link of a @handle, or "" for plain text.
+func supportURL(support string) template.URL {
+	support = strings.TrimSpace(support)
+	if handle, ok := strings.CutPrefix(support, "@"); ok && handle != "" && !strings.ContainsAny(handle, " /") {
+		return template.URL("https://t.me/" + url.PathEscape(handle))
+	}
+	u, err := url.Parse(support)
+	if err != nil || strings.ContainsAny(support, " \n") {
+		return ""
+	}
+	switch u.Scheme {
+	case "http", "https":
+		if u.Host != "" {
+			return template.URL(u.String())
+		}
+	case "mailto":
+		return template.URL(u.String())
+	}
+	return ""
+}
@@ -3,7 +3,11 @@ package sub
 import (
 	"encoding/base64"
 	"fmt"
+	"maps"
 	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -22,6 +26,8 @@ type SubService struct {
 	address        string
 	showInfo       bool
 	remarkModel    string
+	remarkTemplate string
+	clientPorts    bool
 	datepicker     string
 	inboundService service.InboundService
 	settingService service.SettingService
@@ -34,25 +40,30 @@ func NewSubService(showInfo bool, remarkModel string) *SubService {
 	}
 }
 
-func (s *SubService) GetSubs(subId string, host string) ([]string, string, error) {
+func (s *SubService) GetSubs(subId string, host string) ([]string, *subHeader, error) {
 	s.address = host
 	var result []string
-	var header string
-	var traffic xray.ClientTraffic
-	var clientTraffics []xray.ClientTraffic
+	header := &subHeader{}
 	inbounds, err := s.getInboundsBySubId(subId)
 	if err != nil {
-		return nil, "", err
+		return nil, nil, err
 	}
 
 	if len(inbounds) == 0 {
-		return nil, "", common.NewError("No inbounds found with ", subId)
+		return nil, nil, nil
 	}
 
 	s.datepicker, err = s.settingService.GetDatepicker()
 	if err != nil {
 		s.datepicker = "gregorian"
 	}
+	s.remarkTemplate, _ = s.settingService.GetRemarkTemplate()
+	s.clientPorts, _ = s.settingService.GetPortRangeClientPort()
+	includeDisabled, err := s.settingService.GetSubIncludeDisabled()
+	if err != nil {
+		includeDisabled = true
+	}
+	depletedClients := 0
 	for _, inbound := range inbounds {
 		clients, err := s.inboundService.GetClients(inbound)
 		if err != nil {
@@ -70,50 +81,90 @@ func (s *SubService) GetSubs(subId string, host string) ([]string, string, error
 			}
 		}
 		for _, client := range clients {
-			if client.Enable && client.SubID == subId {
+			show, depleted := s.showClient(inbound, client, subId, includeDisabled)
+			if show {
 				link := s.getLink(inbound, client.Email)
 				result = append(result, link)
-				clientTraffics = append(clientTraffics, s.getClientTraffics(inbound.ClientStats, client.Email))
+			}
+			if depleted {
+				depletedClients++
+			}
+			if show || depleted {
+				header.add(client, s.getClientTraffics(inbound.ClientStats, client.Email))
 			}
 		}
 	}
 
-	// Prepare statistics
-	for index, clientTraffic := range clientTraffics {
-		if index == 0 {
-			traffic.Up = clientTraffic.Up
-			traffic.Down = clientTraffic.Down
-			traffic.Total = clientTraffic.Total
-			if clientTraffic.ExpiryTime > 0 {
-				traffic.ExpiryTime = clientTraffic.ExpiryTime
-			}
-		} else {
-			traffic.Up += clientTraffic.Up
-			traffic.Down += clientTraffic.Down
-			if traffic.Total == 0 || clientTraffic.Total == 0 {
-				traffic.Total = 0
-			} else {
-				traffic.Total += clientTraffic.Total
-			}
-			if clientTraffic.ExpiryTime != traffic.ExpiryTime {
-				traffic.ExpiryTime = 0
-			}
+	if len(result) == 0 && depletedClients > 0 {
+		if inbound, client, ok := s.noticeClient(); ok {
+			result = append(result, s.getLink(inbound, client.Email))
 		}
 	}
-	header = fmt.Sprintf("upload=%d; download=%d; total=%d; expire=%d", traffic.Up, traffic.Down, traffic.Total, traffic.ExpiryTime/1000)
 	return result, header, nil
 }
 
+// subHeader sums up the clients of a subscription for the headers of its
+// responses, which apps show as a quota bar and an expiry.
+type subHeader struct {
+	up        int64
+	down      int64
+	total     int64
+	unlimited bool
+	expiry    int64
+	// updateInterval is the smallest of the update intervals of the clients,
+	// in hours, 0 if none of them sets one
+	updateInterval int
+	// emails are the clients counted, whose traffic the header changes with
+	emails []string
+	// aggregate is set when one of the clients has the remote subscriptions
+	// merged into it
+	aggregate bool
+}
+
+// add counts the traffic, quota and expiry of client.
+func (h *subHeader) add(client model.Client, traffic xray.ClientTraffic) {
+	h.emails = append(h.emails, client.Email)
+	h.up += traffic.Up
+	h.down += traffic.Down
+	if traffic.Total <= 0 {
+		h.unlimited = true
+	} else {
+		h.total += traffic.Total
+	}
+	// Expiries counted from the first use are not dates yet
+	if traffic.ExpiryTime > 0 && (h.expiry == 0 || traffic.ExpiryTime < h.expiry) {
+		h.expiry = traffic.ExpiryTime
+	}
+	if client.SubUpdates > 0 && (h.updateInterval == 0 || client.SubUpdates < h.updateInterval) {
+		h.updateInterval = client.SubUpdates
+	}
+	h.aggregate = h.aggregate || client.SubAggregate
+}
+
+// userinfo returns the Subscription-Userinfo header: the traffic of the clients,
+// their quota unless one of them is unlimited, and the nearest of their
+// expiries if they have one.
+func (h *subHeader) userinfo() string {
+	userinfo := fmt.Sprintf("upload=%d; download=%d", h.up, h.down)
+	if !h.unlimited {
+		userinfo += fmt.Sprintf("; total=%d", h.total)
+	}
+	if h.expiry > 0 {
+		userinfo += fmt.Sprintf("; expire=%d", h.expiry/1000)
+	}
+	return userinfo
+}
+
 func (s *SubService) getInboundsBySubId(subId string) ([]*model.Inbound, error) {
 	db := database.GetDB()
 	var inbounds []*model.Inbound
 	err := db.Model(model.Inbound{}).Preload("ClientStats").Where(`id in (
 		SELECT DISTINCT inbounds.id
 		FROM inbounds,
-			JSON_EACH(JSON_EXTRACT(inbounds.settings, '$.clients')) AS client 
+			`+database.JSONEach("inbounds.settings", "$.clients", "client")+`
 		WHERE
 			protocol in ('vmess','vless','trojan','shadowsocks')
-			AND JSON_EXTRACT(client.value, '$.subId') = ? AND enable = ?
+			AND `+database.JSONText("client.value", "$.subId")+` = ? AND enable = ?
 	)`, subId, true).Find(&inbounds).Error
 	if err != nil {
 		return nil, err
@@ -121,6 +172,67 @@ func (s *SubService) getInboundsBySubId(subId string) ([]*model.Inbound, error)
 	return inbounds, nil
 }
 
+// showClient tells whether a client of an inbound is listed in the subscription
+// subId, and if not whether it is left out for having expired or used up its
+// quota. Clients excluded from it are left out, and so are expired and
+// depleted clients unless includeDisabled is set or the inbound overrides it.
+func (s *SubService) showClient(inbound *model.Inbound, client model.Client, subId string, includeDisabled bool) (show bool, depleted bool) {
+	if !client.Enable || client.SubID != subId || client.ExcludeFromSub {
+		return false, false
+	}
+	switch inbound.SubIncludeDisabled {
+	case model.SubIncludeDisabledOn:
+		includeDisabled = true
+	case model.SubIncludeDisabledOff:
+		includeDisabled = false
+	}
+	traffic := s.getClientTraffics(inbound.ClientStats, client.Email)
+	if includeDisabled || !clientDepleted(traffic, time.Now().UnixMilli()) {
+		return true, false
+	}
+	return false, true
+}
+
+// clientDepleted tells whether the client of traffic has expired or used up its
+// quota, whether or not it was disabled for it yet.
+func clientDepleted(traffic xray.ClientTraffic, now int64) bool {
+	if traffic.Email == "" {
+		return false
+	}
+	return !traffic.Enable ||
+		(traffic.ExpiryTime > 0 && traffic.ExpiryTime <= now) ||
+		(traffic.Total > 0 && traffic.Up+traffic.Down >= traffic.Total)
+}
+
+// noticeClient returns the inbound and client of the entry subscriptions list
+// when all their clients are left out for having expired or used up their
+// quota, so that apps tell why instead of showing nothing. The entry is named
+// after the notice of the settings and connects nowhere. ok is false when there
+// is no notice.
+func (s *SubService) noticeClient() (inbound *model.Inbound, client model.Client, ok bool) {
+	notice, err := s.settingService.GetSubExpiredNotice()
+	if err != nil || strings.TrimSpace(notice) == "" {
+		return nil, client, false
+	}
+	inbound, client = remarkClient(notice)
+	return inbound, client, true
+}
+
+// remarkClient returns an inbound and client connecting nowhere, whose entry in
+// subscriptions is named remark, to tell something in the list of the apps.
+func remarkClient(remark string) (*model.Inbound, model.Client) {
+	client := model.Client{ID: "00000000-0000-0000-0000-000000000000", Email: "notice", Enable: true}
+	settings, _ := json.Marshal(map[string]any{"clients": []model.Client{client}, "decryption": "none"})
+	inbound := &model.Inbound{
+		Protocol:       model.VLESS,
+		Port:           1,
+		RemarkTemplate: remark,
+		Settings:       string(settings),
+		StreamSettings: `{"network":"tcp","security":"none","tcpSettings":{"header":{"type":"none"}}}`,
+	}
+	return inbound, client
+}
+
 func (s *SubService) getClientTraffics(traffics []xray.ClientTraffic, email string) xray.ClientTraffic {
 	for _, traffic := range traffics {
 		if traffic.Email == email {
@@ -134,8 +246,13 @@ func (s *SubService) getFallbackMaster(dest string, streamSettings string) (stri
 	db := database.GetDB()
 	var inbound *model.Inbound
 	err := db.Model(model.Inbound{}).
-		Where("JSON_TYPE(settings, '$.fallbacks') = 'array'").
-		Where("EXISTS (SELECT * FROM json_each(settings, '$.fallbacks') WHERE json_extract(value, '$.dest') = ?)", dest).
+		Where(`id IN (
+			SELECT inbounds.id
+			FROM inbounds,
+				`+database.JSONEach("inbounds.settings", "$.fallbacks", "fallback")+`
+			WHERE `+database.JSONIsArray("inbounds.settings", "$.fallbacks")+`
+				AND `+database.JSONText("fallback.value", "$.dest")+` = ?
+		)`, dest).
 		Find(&inbound).Error
 	if err != nil {
 		return "", 0, "", err
@@ -153,7 +270,395 @@ func (s *SubService) getFallbackMaster(dest string, streamSettings string) (stri
 	return inbound.Listen, inbound.Port, string(modifiedStream), nil
 }
 
+// GetLink returns the share link of the client with email, for clients that
+// connect to host.
+func (s *SubService) GetLink(inbound *model.Inbound, email string, host string) string {
+	s.address = host
+	s.remarkTemplate, _ = s.settingService.GetRemarkTemplate()
+	s.clientPorts, _ = s.settingService.GetPortRangeClientPort()
+	return s.getLink(inbound, email)
+}
+
+// ShareLink is a share link of a client, with the remark it is named after and
+// the address it connects to: that of its external proxy if it has one.
+type ShareLink struct {
+	Link          string         `json:"link"`
+	Remark        string         `json:"remark"`
+	Address       string         `json:"address"`
+	Port          int            `json:"port"`
+	ExternalProxy map[string]any `json:"externalProxy,omitempty"`
+}
+
+// GetShareLinks returns the share links of the client with email one by one,
+// the links of GetLink in the same order.
+func (s *SubService) GetShareLinks(inbound *model.Inbound, email string, host string) []ShareLink {
+	links := strings.Split(s.GetLink(inbound, email, host), "\n")
+	clientInbound := s.linkInbound(inbound, email)
+	var stream map[string]any
+	json.Unmarshal([]byte(clientInbound.StreamSettings), &stream)
+	externalProxies, _ := stream["externalProxy"].([]any)
+
+	shareLinks := []ShareLink{}
+	for index, link := range links {
+		if link == "" {
+			continue
+		}
+		shareLink := ShareLink{Link: link, Address: host, Port: clientInbound.Port}
+		remark := ""
+		if index < len(externalProxies) {
+			shareLink.ExternalProxy, _ = externalProxies[index].(map[string]any)
+			remark, _ = shareLink.ExternalProxy["remark"].(string)
+			shareLink.Address, _ = shareLink.ExternalProxy["dest"].(string)
+			port, _ := shareLink.ExternalProxy["port"].(float64)
+			shareLink.Port = int(port)
+		}
+		shareLink.Remark = s.genRemark(clientInbound, email, remark)
+		shareLinks = append(shareLinks, shareLink)
+	}
+	return shareLinks
+}
+
+// RemarkTemplate returns the remark template the links of inbound are named
+// with, "" for the remark model.
+func (s *SubService) RemarkTemplate(inbound *model.Inbound) string {
+	if inbound.RemarkTemplate != "" {
+		return inbound.RemarkTemplate
+	}
+	template, _ := s.settingService.GetRemarkTemplate()
+	return template
+}
+
+// proxyOverrides returns the SNI and the host the external proxy ep makes its
+// clients use, "" for those of the inbound.
+func proxyOverrides(ep map[string]any) (sni string, host string) {
+	sni, _ = ep["sni"].(string)
+	host, _ = ep["host"].(string)
+	return strings.TrimSpace(sni), strings.TrimSpace(host)
+}
+
+// overrideProxyParams sets the SNI and the host of the external proxy ep in
+// the query of a link through it.
+func overrideProxyParams(q url.Values, ep map[string]any) {
+	sni, host := proxyOverrides(ep)
+	if security := q.Get("security"); sni != "" && (security == "tls" || security == "reality") {
+		q.Set("sni", sni)
+	}
+	if host == "" {
+		return
+	}
+	switch q.Get("type") {
+	case "grpc":
+		q.Set("authority", host)
+	case "ws", "httpupgrade", "xhttp":
+		q.Set("host", host)
+	default:
+		if q.Has("host") {
+			q.Set("host", host)
+		}
+	}
+}
+
+// proxyStream returns a copy of stream with the SNI and the host the external
+// proxy ep overrides, for the configurations of the clients connecting through
+// it. The Reality settings may be those of an inbound, with serverNames, or of
+// an outbound, with serverName.
+func proxyStream(stream map[string]any, ep map[string]any) map[string]any {
+	newStream := maps.Clone(stream)
+	if newStream == nil {
+		newStream = map[string]any{}
+	}
+	sni, host := proxyOverrides(ep)
+	if sni != "" {
+		forceTls, _ := ep["forceTls"].(string)
+		tlsSettings, ok := newStream["tlsSettings"].(map[string]any)
+		if ok || forceTls == "tls" {
+			tlsSettings = maps.Clone(tlsSettings)
+			if tlsSettings == nil {
+				tlsSettings = map[string]any{}
+			}
+			tlsSettings["serverName"] = sni
+			newStream["tlsSettings"] = tlsSettings
+		}
+		if realitySettings, ok := newStream["realitySettings"].(map[string]any); ok {
+			realitySettings = maps.Clone(realitySettings)
+			if _, ok := realitySettings["serverName"]; ok {
+				realitySettings["serverName"] = sni
+			} else {
+				realitySettings["serverNames"] = []any{sni}
+			}
+			newStream["realitySettings"] = realitySettings
+		}
+	}
+	if host != "" {
+		network, _ := newStream["network"].(string)
+		key := network + "Settings"
+		if settings, ok := newStream[key].(map[string]any); ok {
+			settings = maps.Clone(settings)
+			switch network {
+			case "grpc":
+				settings["authority"] = host
+			case "ws", "httpupgrade", "xhttp":
+				settings["host"] = host
+			}
+			newStream[key] = settings
+		}
+	}
+	return newStream
+}
+
+// linkOptions returns the link options of client: its own over the client
+// defaults of inbound.
+func linkOptions(inbound *model.Inbound, client model.Client) model.LinkOptions {
+	var options model.LinkOptions
+	if inbound.ClientDefaults != nil {
+		options = *inbound.ClientDefaults
+	}
+	return options.Merge(client.LinkOptions)
+}
+
+// tunedInbound returns inbound with the link options in its stream settings,
+// for the links and configurations of a client.
+func tunedInbound(inbound *model.Inbound, options model.LinkOptions) *model.Inbound {
+	var stream map[string]any
+	if reflect.ValueOf(options).IsZero() || json.Unmarshal([]byte(inbound.StreamSettings), &stream) != nil {
+		return inbound
+	}
+	data, err := json.Marshal(linkStream(stream, options))
+	if err != nil {
+		return inbound
+	}
+	tuned := *inbound
+	tuned.StreamSettings = string(data)
+	return &tuned
+}
+
+// linkStream returns a copy of stream with the link options that are part of
+// the stream settings of clients. The early data of WebSocket goes in its path,
+// where the links and Xray take it, unless it is sent in another header than
+// Sec-WebSocket-Protocol.
+func linkStream(stream map[string]any, options model.LinkOptions) map[string]any {
+	newStream := maps.Clone(stream)
+	if newStream == nil {
+		newStream = map[string]any{}
+	}
+	if tlsSettings, ok := newStream["tlsSettings"].(map[string]any); ok {
+		tlsSettings = maps.Clone(tlsSettings)
+		if len(options.ALPN) > 0 {
+			alpn := make([]any, 0, len(options.ALPN))
+			for _, value := range options.ALPN {
+				alpn = append(alpn, value)
+			}
+			tlsSettings["alpn"] = alpn
+		}
+		clientSettings, _ := tlsSettings["settings"].(map[string]any)
+		clientSettings = maps.Clone(clientSettings)
+		if clientSettings == nil {
+			clientSettings = map[string]any{}
+		}
+		if options.Fingerprint != "" {
+			clientSettings["fingerprint"] = options.Fingerprint
+		}
+		if options.AllowInsecure != nil {
+			clientSettings["allowInsecure"] = *options.AllowInsecure
+		}
+		tlsSettings["settings"] = clientSettings
+		newStream["tlsSettings"] = tlsSettings
+	}
+	if realitySettings, ok := newStream["realitySettings"].(map[string]any); ok && options.Fingerprint != "" {
+		realitySettings = maps.Clone(realitySettings)
+		clientSettings, _ := realitySettings["settings"].(map[string]any)
+		clientSettings = maps.Clone(clientSettings)
+		if clientSettings == nil {
+			clientSettings = map[string]any{}
+		}
+		clientSettings["fingerprint"] = options.Fingerprint
+		realitySettings["settings"] = clientSettings
+		newStream["realitySettings"] = realitySettings
+	}
+	network, _ := newStream["network"].(string)
+	switch network {
+	case "grpc":
+		if grpc, ok := newStream["grpcSettings"].(map[string]any); ok && options.GRPCMultiMode != nil {
+			grpc = maps.Clone(grpc)
+			grpc["multiMode"] = *options.GRPCMultiMode
+			newStream["grpcSettings"] = grpc
+		}
+	case "ws":
+		header := options.WSEarlyDataHeader
+		if ws, ok := newStream["wsSettings"].(map[string]any); ok && options.WSEarlyData > 0 && (header == "" || header == earlyDataHeader) {
+			ws = maps.Clone(ws)
+			path, _ := ws["path"].(string)
+			path, rawQuery, _ := strings.Cut(path, "?")
+			query, _ := url.ParseQuery(rawQuery)
+			query.Set("ed", strconv.Itoa(options.WSEarlyData))
+			ws["path"] = path + "?" + query.Encode()
+			newStream["wsSettings"] = ws
+		}
+	}
+	return newStream
+}
+
+// earlyDataHeader is the header Xray sends the early data of WebSocket in.
+const earlyDataHeader = "Sec-WebSocket-Protocol"
+
+// wsEarlyData returns the path of a WebSocket transport without its early data,
+// and the size and the header of that early data: those of the path, or of
+// options if they set one. The size is 0 without early data.
+func wsEarlyData(path string, options model.LinkOptions) (string, int, string) {
+	size, header := 0, earlyDataHeader
+	if base, rawQuery, ok := strings.Cut(path, "?"); ok {
+		query, _ := url.ParseQuery(rawQuery)
+		if query.Has("ed") {
+			size, _ = strconv.Atoi(query.Get("ed"))
+			query.Del("ed")
+			path = base
+			if len(query) > 0 {
+				path += "?" + query.Encode()
+			}
+		}
+	}
+	if options.WSEarlyData > 0 {
+		size = options.WSEarlyData
+		if options.WSEarlyDataHeader != "" {
+			header = options.WSEarlyDataHeader
+		}
+	}
+	return path, size, header
+}
+
+// linkInbound returns inbound with the port the links of the client with email
+// connect to: the first one of a port range, or the one of the client if the
+// settings ask for a port per client.
+func (s *SubService) linkInbound(inbound *model.Inbound, email string) *model.Inbound {
+	if inbound.PortEnd <= inbound.Port || !s.clientPorts {
+		return inbound
+	}
+	clientInbound := *inbound
+	clientInbound.Port = inbound.ClientPort(email)
+	clientInbound.PortEnd = 0
+	return &clientInbound
+}
+
+// subEndpoint is a client of a subscription at one of the addresses it connects
+// to, those of the external proxies of its inbound if it has some.
+type subEndpoint struct {
+	inbound  *model.Inbound
+	client   model.Client
+	stream   map[string]any
+	server   string
+	port     int
+	security string
+	name     string
+}
+
+// getEndpoints returns the endpoints of the clients of the subscription subId,
+// named uniquely after their remarks, and the header of the clients.
+func (s *SubService) getEndpoints(subId string, host string) ([]subEndpoint, *subHeader, error) {
+	inbounds, err := s.getInboundsBySubId(subId)
+	if err != nil || len(inbounds) == 0 {
+		return nil, nil, err
+	}
+	s.remarkTemplate, _ = s.settingService.GetRemarkTemplate()
+	s.clientPorts, _ = s.settingService.GetPortRangeClientPort()
+	includeDisabled, err := s.settingService.GetSubIncludeDisabled()
+	if err != nil {
+		includeDisabled = true
+	}
+
+	var endpoints []subEndpoint
+	header := &subHeader{}
+	depletedClients := 0
+	names := map[string]bool{}
+	for _, inbound := range inbounds {
+		clients, err := s.inboundService.GetClients(inbound)
+		if err != nil {
+			logger.Error("SubService - GetClients: Unable to get clients from inbound")
+		}
+		if clients == nil {
+			continue
+		}
+		if len(inbound.Listen) > 0 && inbound.Listen[0] == '@' {
+			listen, port, streamSettings, err := s.getFallbackMaster(inbound.Listen, inbound.StreamSettings)
+			if err == nil {
+				inbound.Listen = listen
+				inbound.Port = port
+				inbound.StreamSettings = streamSettings
+			}
+		}
+
+		for _, client := range clients {
+			show, depleted := s.showClient(inbound, client, subId, includeDisabled)
+			if depleted {
+				depletedClients++
+			}
+			if show || depleted {
+				header.add(client, s.getClientTraffics(inbound.ClientStats, client.Email))
+			}
+			if !show {
+				continue
+			}
+			clientInbound := tunedInbound(s.linkInbound(inbound, client.Email), linkOptions(inbound, client))
+
+			var stream map[string]any
+			json.Unmarshal([]byte(clientInbound.StreamSettings), &stream)
+			externalProxies, _ := stream["externalProxy"].([]any)
+			if len(externalProxies) == 0 {
+				externalProxies = []any{map[string]any{
+					"forceTls": "same",
+					"dest":     host,
+					"port":     float64(clientInbound.Port),
+					"remark":   "",
+				}}
+			}
+			for _, externalProxy := range externalProxies {
+				ep, _ := externalProxy.(map[string]any)
+				endpoint := subEndpoint{inbound: clientInbound, client: client, stream: proxyStream(stream, ep)}
+				endpoint.server, _ = ep["dest"].(string)
+				port, _ := ep["port"].(float64)
+				endpoint.port = int(port)
+				endpoint.security, _ = ep["forceTls"].(string)
+				remark, _ := ep["remark"].(string)
+
+				endpoint.name = s.genRemark(clientInbound, client.Email, remark)
+				if endpoint.name == "" {
+					endpoint.name = client.Email
+				}
+				// Clients refer to the proxies of configurations by their names
+				for i, base := 2, endpoint.name; names[endpoint.name]; i++ {
+					endpoint.name = fmt.Sprintf("%s %d", base, i)
+				}
+				names[endpoint.name] = true
+				endpoints = append(endpoints, endpoint)
+			}
+		}
+	}
+	if len(endpoints) == 0 && depletedClients > 0 {
+		if inbound, client, ok := s.noticeClient(); ok {
+			var stream map[string]any
+			json.Unmarshal([]byte(inbound.StreamSettings), &stream)
+			endpoints = append(endpoints, subEndpoint{
+				inbound:  inbound,
+				client:   client,
+				stream:   stream,
+				server:   host,
+				port:     inbound.Port,
+				security: "same",
+				name:     s.genRemark(inbound, client.Email, ""),
+			})
+		}
+	}
+	return endpoints, header, nil
+}
+
 func (s *SubService) getLink(inbound *model.Inbound, email string) string {
+	inbound = s.linkInbound(inbound, email)
+	clients, _ := s.inboundService.GetClients(inbound)
+	for _, client := range clients {
+		if client.Email == email {
+			inbound = tunedInbound(inbound, linkOptions(inbound, client))
+			break
+		}
+	}
 	switch inbound.Protocol {
 	case "vmess":
 		return s.genVmessLink(inbound, email)
@@ -233,7 +738,8 @@ func (s *SubService) genVmessLink(inbound *model.Inbound, email string) string {
 			headers, _ := xhttp["headers"].(map[string]any)
 			obj["host"] = searchHost(headers)
 		}
-		obj["mode"] = xhttp["mode"].(string)
+		// The VMess links of v2rayN give the mode of XHTTP as the header type
+		obj["type"] = xhttp["mode"].(string)
 	}
 	security, _ := stream["security"].(string)
 	obj["tls"] = security
@@ -293,6 +799,15 @@ func (s *SubService) genVmessLink(inbound *model.Inbound, email string) string {
 			if newSecurity != "same" {
 				newObj["tls"] = newSecurity
 			}
+			sni, host := proxyOverrides(ep)
+			if sni != "" && newObj["tls"] == "tls" {
+				newObj["sni"] = sni
+			}
+			if _, ok := newObj["host"]; host != "" && ok {
+				newObj["host"] = host
+			} else if host != "" && network == "grpc" {
+				newObj["authority"] = host
+			}
 			if index > 0 {
 				links += "\n"
 			}
@@ -382,6 +897,9 @@ func (s *SubService) genVlessLink(inbound *model.Inbound, email string) string {
 			params["host"] = searchHost(headers)
 		}
 		params["mode"] = xhttp["mode"].(string)
+		if extra := xhttpExtra(xhttp); extra != "" {
+			params["extra"] = extra
+		}
 	}
 	security, _ := stream["security"].(string)
 	if security == "tls" {
@@ -479,6 +997,8 @@ func (s *SubService) genVlessLink(inbound *model.Inbound, email string) string {
 				}
 			}
 
+			overrideProxyParams(q, ep)
+
 			// Set the new query values on the URL
 			url.RawQuery = q.Encode()
 
@@ -581,6 +1101,9 @@ func (s *SubService) genTrojanLink(inbound *model.Inbound, email string) string
 			params["host"] = searchHost(headers)
 		}
 		params["mode"] = xhttp["mode"].(string)
+		if extra := xhttpExtra(xhttp); extra != "" {
+			params["extra"] = extra
+		}
 	}
 	security, _ := stream["security"].(string)
 	if security == "tls" {
@@ -674,6 +1197,8 @@ func (s *SubService) genTrojanLink(inbound *model.Inbound, email string) string
 				}
 			}
 
+			overrideProxyParams(q, ep)
+
 			// Set the new query values on the URL
 			url.RawQuery = q.Encode()
 
@@ -780,6 +1305,9 @@ func (s *SubService) genShadowsocksLink(inbound *model.Inbound, email string) st
 			params["host"] = searchHost(headers)
 		}
 		params["mode"] = xhttp["mode"].(string)
+		if extra := xhttpExtra(xhttp); extra != "" {
+			params["extra"] = extra
+		}
 	}
 
 	security, _ := stream["security"].(string)
@@ -811,9 +1339,12 @@ func (s *SubService) genShadowsocksLink(inbound *model.Inbound, email string) st
 		}
 	}
 
-	encPart := fmt.Sprintf("%s:%s", method, clients[clientIndex].Password)
-	if method[0] == '2' {
-		encPart = fmt.Sprintf("%s:%s:%s", method, inboundPassword, clients[clientIndex].Password)
+	// SIP002 puts the 2022 methods and their keys in the userinfo as they are,
+	// percent-encoded, and the others in base64; it is left out of the URLs,
+	// which would encode it their own way
+	userInfo := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", method, clients[clientIndex].Password)))
+	if strings.HasPrefix(method, "2022") {
+		userInfo = url.QueryEscape(method) + ":" + url.QueryEscape(inboundPassword+":"+clients[clientIndex].Password)
 	}
 
 	externalProxies, _ := stream["externalProxy"].([]any)
@@ -825,7 +1356,7 @@ func (s *SubService) genShadowsocksLink(inbound *model.Inbound, email string) st
 			newSecurity, _ := ep["forceTls"].(string)
 			dest, _ := ep["dest"].(string)
 			port := int(ep["port"].(float64))
-			link := fmt.Sprintf("ss://%s@%s:%d", base64.StdEncoding.EncodeToString([]byte(encPart)), dest, port)
+			link := fmt.Sprintf("ss://%s:%d", dest, port)
 
 			if newSecurity != "same" {
 				params["security"] = newSecurity
@@ -841,6 +1372,8 @@ func (s *SubService) genShadowsocksLink(inbound *model.Inbound, email string) st
 				}
 			}
 
+			overrideProxyParams(q, ep)
+
 			// Set the new query values on the URL
 			url.RawQuery = q.Encode()
 
@@ -849,12 +1382,12 @@ func (s *SubService) genShadowsocksLink(inbound *model.Inbound, email string) st
 			if index > 0 {
 				links += "\n"
 			}
-			links += url.String()
+			links += withUserInfo(url, userInfo)
 		}
 		return links
 	}
 
-	link := fmt.Sprintf("ss://%s@%s:%d", base64.StdEncoding.EncodeToString([]byte(encPart)), address, inbound.Port)
+	link := fmt.Sprintf("ss://%s:%d", address, inbound.Port)
 	url, _ := url.Parse(link)
 	q := url.Query()
 
@@ -866,10 +1399,24 @@ func (s *SubService) genShadowsocksLink(inbound *model.Inbound, email string) st
 	url.RawQuery = q.Encode()
 
 	url.Fragment = s.genRemark(inbound, email, "")
-	return url.String()
+	return withUserInfo(url, userInfo)
+}
+
+// withUserInfo returns link with the encoded userInfo.
+func withUserInfo(link *url.URL, userInfo string) string {
+	scheme := link.Scheme + "://"
+	return scheme + userInfo + "@" + strings.TrimPrefix(link.String(), scheme)
 }
 
 func (s *SubService) genRemark(inbound *model.Inbound, email string, extra string) string {
+	template := inbound.RemarkTemplate
+	if template == "" {
+		template = s.remarkTemplate
+	}
+	if template != "" {
+		return s.renderRemark(template, inbound, email, extra)
+	}
+
 	separationChar := string(s.remarkModel[0])
 	orderChars := s.remarkModel[1:]
 	orders := map[byte]string{
@@ -954,6 +1501,54 @@ func (s *SubService) genRemark(inbound *model.Inbound, email string, extra strin
 	return strings.Join(remark, separationChar)
 }
 
+var remarkPlaceholder = regexp.MustCompile(`\{(\w+)\}`)
+
+// renderRemark fills in the placeholders of a remark template for the client
+// with email, and extra as the remark of the external proxy. Unknown
+// placeholders are left empty.
+func (s *SubService) renderRemark(template string, inbound *model.Inbound, email string, extra string) string {
+	stats := s.getClientTraffics(inbound.ClientStats, email)
+	if stats.Email == "" {
+		// Links not generated for a subscription come without the traffic
+		clients, _ := s.inboundService.GetClients(inbound)
+		for _, client := range clients {
+			if client.Email == email {
+				stats.ExpiryTime = client.ExpiryTime
+				stats.Total = client.TotalGB
+				break
+			}
+		}
+	}
+
+	expiryDate := "∞"
+	if stats.ExpiryTime > 0 {
+		expiryDate = time.UnixMilli(stats.ExpiryTime).Format("2006-01-02")
+	} else if stats.ExpiryTime < 0 {
+		// Counted from the first connection
+		expiryDate = fmt.Sprintf("%dD", stats.ExpiryTime/-86400000)
+	}
+	trafficLeft := "∞"
+	if stats.Total > 0 {
+		left := max(stats.Total-stats.Up-stats.Down, 0)
+		trafficLeft = strconv.FormatFloat(float64(left)/(1<<30), 'f', 2, 64)
+	}
+
+	values := map[string]string{
+		"serverName":    s.address,
+		"inboundRemark": inbound.Remark,
+		"email":         email,
+		"protocol":      string(inbound.Protocol),
+		"port":          strconv.Itoa(inbound.Port),
+		"proxyRemark":   extra,
+		"expiryDate":    expiryDate,
+		"trafficLeftGB": trafficLeft,
+	}
+	remark := remarkPlaceholder.ReplaceAllStringFunc(template, func(placeholder string) string {
+		return values[placeholder[1:len(placeholder)-1]]
+	})
+	return strings.TrimSpace(remark)
+}
+
 func searchKey(data any, key string) (any, bool) {
 	switch val := data.(type) {
 	case map[string]any:
@@ -975,6 +1570,20 @@ func searchKey(data any, key string) (any, bool) {
 	return nil, false
 }
 
+// xhttpExtra returns the XHTTP settings of a link the server needs the clients
+// to share, as the JSON of its extra parameter, empty if there are none.
+func xhttpExtra(xhttp map[string]any) string {
+	padding, _ := xhttp["xPaddingBytes"].(string)
+	if padding == "" {
+		return ""
+	}
+	extra, err := json.Marshal(map[string]any{"xPaddingBytes": padding})
+	if err != nil {
+		return ""
+	}
+	return string(extra)
+}
+
 func searchHost(headers any) string {
 	data, _ := headers.(map[string]any)
 	for k, v := range data {
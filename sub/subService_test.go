@@ -0,0 +1,277 @@
+package sub
+
+import (
+	"encoding/base64"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/web/service"
+	"x-ui/xray"
+
+	"github.com/gin-gonic/gin"
+	"github.com/goccy/go-json"
+	"gopkg.in/yaml.v3"
+)
+
+const remarkTestTemplate = "🚀 {inboundRemark} · {email} | {protocol}:{port} {trafficLeftGB}GB → {expiryDate} {noSuchPlaceholder}#%?&"
+
+var remarkTestExpiry = time.Date(2030, 1, 2, 12, 0, 0, 0, time.Local).UnixMilli()
+
+// remarkTestInbound saves an inbound of protocol with a client "тест-🙂-<protocol>",
+// named by remarkTestTemplate, and returns it with the traffic of the client.
+func remarkTestInbound(t *testing.T, protocol model.Protocol, port int, settings string, stream string) *model.Inbound {
+	t.Helper()
+	email := "тест-🙂-" + string(protocol)
+	inbound := &model.Inbound{
+		Remark: "Сервер 🇩🇪", Enable: true, Port: port, Protocol: protocol, Tag: "inbound-" + string(protocol),
+		Settings: strings.ReplaceAll(settings, "{email}", email), StreamSettings: stream, RemarkTemplate: remarkTestTemplate,
+	}
+	db := database.GetDB()
+	if err := db.Create(inbound).Error; err != nil {
+		t.Fatal(err)
+	}
+	traffic := &xray.ClientTraffic{
+		InboundId: inbound.Id, Enable: true, Email: email, Up: 1 << 29, Down: 1 << 29,
+		Total: 3 << 30, ExpiryTime: remarkTestExpiry,
+	}
+	if err := db.Create(traffic).Error; err != nil {
+		t.Fatal(err)
+	}
+	inbound.ClientStats = []xray.ClientTraffic{*traffic}
+	return inbound
+}
+
+func TestRemarkTemplateLinks(t *testing.T) {
+	if err := database.InitDB(t.TempDir() + "/x-ui.db"); err != nil {
+		t.Fatal(err)
+	}
+	tcp := `{"network":"tcp","security":"none","tcpSettings":{"header":{"type":"none"}}}`
+	inbounds := []*model.Inbound{
+		remarkTestInbound(t, model.VMESS, 30001,
+			`{"clients":[{"id":"0f0c2d7b-6f2e-4b8e-8f4a-2a6e5f1c9d33","email":"{email}","enable":true}]}`, tcp),
+		remarkTestInbound(t, model.VLESS, 30002,
+			`{"clients":[{"id":"5d2b3f8c-1a9e-4c6d-b7f0-8e4a2c1d6b55","email":"{email}","enable":true}],"decryption":"none"}`, tcp),
+		remarkTestInbound(t, model.Trojan, 30003,
+			`{"clients":[{"password":"Zq8vN2xL5cR1","email":"{email}","enable":true}]}`, tcp),
+		remarkTestInbound(t, model.Shadowsocks, 30004,
+			`{"method":"chacha20-ietf-poly1305","password":"","clients":[{"method":"chacha20-ietf-poly1305","password":"c2VjcmV0","email":"{email}","enable":true}]}`, tcp),
+	}
+
+	for _, inbound := range inbounds {
+		t.Run(string(inbound.Protocol), func(t *testing.T) {
+			s := NewSubService(false, "-ieo")
+			email := inbound.ClientStats[0].Email
+			link := s.GetLink(inbound, email, "example.com")
+			if link == "" {
+				t.Fatal("no link")
+			}
+			want := "🚀 Сервер 🇩🇪 · " + email + " | " + string(inbound.Protocol) + ":" + inbound.PortString() +
+				" 2.00GB → 2030-01-02 #%?&"
+
+			var remark string
+			if inbound.Protocol == model.VMESS {
+				data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(link, "vmess://"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				var obj map[string]any
+				if err := json.Unmarshal(data, &obj); err != nil {
+					t.Fatal(err)
+				}
+				remark, _ = obj["ps"].(string)
+			} else {
+				// The remark is the one fragment of the link, encoded
+				_, fragment, found := strings.Cut(link, "#")
+				if !found || strings.ContainsAny(fragment, " #") {
+					t.Fatalf("the fragment of %s is not encoded", link)
+				}
+				u, err := url.Parse(link)
+				if err != nil {
+					t.Fatal(err)
+				}
+				remark = u.Fragment
+			}
+			if remark != want {
+				t.Errorf("remark = %q, want %q", remark, want)
+			}
+		})
+	}
+}
+
+func TestRemarkTemplateSetting(t *testing.T) {
+	if err := database.InitDB(t.TempDir() + "/x-ui.db"); err != nil {
+		t.Fatal(err)
+	}
+	inbound := remarkTestInbound(t, model.Trojan, 30005,
+		`{"clients":[{"password":"Zq8vN2xL5cR1","email":"{email}","enable":true}]}`,
+		`{"network":"tcp","security":"none","tcpSettings":{"header":{"type":"none"}}}`)
+	email := inbound.ClientStats[0].Email
+	remark := func() string {
+		t.Helper()
+		u, err := url.Parse(NewSubService(false, "-ieo").GetLink(inbound, email, "example.com"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u.Fragment
+	}
+
+	// With no template the links are named by the remark model
+	inbound.RemarkTemplate = ""
+	if got, want := remark(), "Сервер 🇩🇪-"+email; got != want {
+		t.Errorf("remark = %q, want %q", got, want)
+	}
+
+	err := database.GetDB().Create(&model.Setting{Key: "remarkTemplate", Value: "{email} ✈ {protocol}"}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	service.InvalidateSettings()
+	if got, want := remark(), email+" ✈ trojan"; got != want {
+		t.Errorf("remark of the setting = %q, want %q", got, want)
+	}
+	// The template of the inbound comes before the setting
+	inbound.RemarkTemplate = "{inboundRemark}"
+	if got, want := remark(), "Сервер 🇩🇪"; got != want {
+		t.Errorf("remark of the inbound = %q, want %q", got, want)
+	}
+}
+
+// expiredTestEngine serves the subscription "gone", whose client "phone" has
+// expired and whose client "laptop" used up its quota, and the settings.
+func expiredTestEngine(t *testing.T, settings map[string]string) *gin.Engine {
+	t.Helper()
+	clients := []headerTestClient{
+		{inbound: 0, email: "phone", subId: "gone", enable: true, up: 100, down: 200, total: 1000, expiry: time.Now().Add(-time.Hour).UnixMilli()},
+		{inbound: 1, email: "laptop", subId: "gone", enable: true, up: 600, down: 500, total: 1000},
+	}
+	engine := headerTestEngine(t, "", clients)
+	for key, value := range settings {
+		if err := database.GetDB().Create(&model.Setting{Key: key, Value: value}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	service.InvalidateSettings()
+	return engine
+}
+
+// expiredTestNames returns the names of the entries of the subscription at
+// path, in any of its formats.
+func expiredTestNames(t *testing.T, engine *gin.Engine, path string) (int, string, []string) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	if w.Code != 200 {
+		return w.Code, w.Header().Get("Subscription-Userinfo"), nil
+	}
+	var names []string
+	switch {
+	case strings.Contains(path, "format=clash"):
+		var config clashConfig
+		if err := yaml.Unmarshal(w.Body.Bytes(), &config); err != nil {
+			t.Fatal(err)
+		}
+		for _, proxy := range config.Proxies {
+			names = append(names, proxy.Name)
+		}
+	case strings.Contains(path, "format=singbox"):
+		var config singboxConfig
+		if err := json.Unmarshal(w.Body.Bytes(), &config); err != nil {
+			t.Fatal(err)
+		}
+		for _, outbound := range config.Outbounds {
+			if outbound.Server != "" {
+				names = append(names, outbound.Tag)
+			}
+		}
+	case strings.HasPrefix(path, "/json/"):
+		var configs []map[string]any
+		if err := json.Unmarshal(w.Body.Bytes(), &configs); err != nil {
+			var config map[string]any
+			if err := json.Unmarshal(w.Body.Bytes(), &config); err != nil {
+				t.Fatalf("%s replied %s", path, w.Body)
+			}
+			configs = []map[string]any{config}
+		}
+		for _, config := range configs {
+			remarks, _ := config["remarks"].(string)
+			names = append(names, remarks)
+		}
+	default:
+		for _, link := range strings.Fields(w.Body.String()) {
+			u, err := url.Parse(link)
+			if err != nil {
+				t.Fatal(err)
+			}
+			names = append(names, u.Fragment)
+		}
+	}
+	return w.Code, w.Header().Get("Subscription-Userinfo"), names
+}
+
+var expiredTestPaths = []string{"/sub/gone", "/sub/gone?format=clash", "/sub/gone?format=singbox", "/json/gone"}
+
+func TestSubExpiredClients(t *testing.T) {
+	const notice = "⛔ Expired — contact support"
+	// The header has the real totals in every case
+	const userinfo = "upload=700; download=700; total=2000"
+
+	t.Run("notice", func(t *testing.T) {
+		engine := expiredTestEngine(t, map[string]string{"subIncludeDisabled": "false", "subExpiredNotice": notice})
+		for _, path := range expiredTestPaths {
+			code, header, names := expiredTestNames(t, engine, path)
+			if code != 200 || len(names) != 1 || names[0] != notice {
+				t.Errorf("%s replied %d with %q, want only the notice", path, code, names)
+			}
+			if !strings.HasPrefix(header, userinfo) {
+				t.Errorf("%s has the userinfo %q, want %q", path, header, userinfo)
+			}
+		}
+	})
+
+	t.Run("no notice", func(t *testing.T) {
+		engine := expiredTestEngine(t, map[string]string{"subIncludeDisabled": "false"})
+		for _, path := range expiredTestPaths {
+			if code, _, names := expiredTestNames(t, engine, path); code != 404 {
+				t.Errorf("%s replied %d with %q, want nothing", path, code, names)
+			}
+		}
+	})
+
+	t.Run("included", func(t *testing.T) {
+		engine := expiredTestEngine(t, map[string]string{"subExpiredNotice": notice})
+		for _, path := range expiredTestPaths {
+			code, header, names := expiredTestNames(t, engine, path)
+			if code != 200 || len(names) != 2 || slices.Contains(names, notice) {
+				t.Errorf("%s replied %d with %q, want both clients", path, code, names)
+			}
+			if !strings.HasPrefix(header, userinfo) {
+				t.Errorf("%s has the userinfo %q, want %q", path, header, userinfo)
+			}
+		}
+	})
+
+	t.Run("inbound override", func(t *testing.T) {
+		engine := expiredTestEngine(t, map[string]string{"subIncludeDisabled": "false", "subExpiredNotice": notice})
+		err := database.GetDB().Model(&model.Inbound{}).Where("port = ?", 30402).
+			Update("sub_include_disabled", model.SubIncludeDisabledOn).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The laptop of the inbound listing them, with no notice
+		for _, path := range expiredTestPaths {
+			code, header, names := expiredTestNames(t, engine, path)
+			if code != 200 || len(names) != 1 || !strings.Contains(names[0], "laptop") {
+				t.Errorf("%s replied %d with %q, want the laptop", path, code, names)
+			}
+			if !strings.HasPrefix(header, userinfo) {
+				t.Errorf("%s has the userinfo %q, want %q", path, header, userinfo)
+			}
+		}
+	})
+}
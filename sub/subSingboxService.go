@@ -0,0 +1,292 @@
+package sub
+
+import (
+	"encoding/json"
+	"strings"
+
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/web/entity"
+)
+
+// The groups of the proxies of a sing-box subscription: the one picked by hand,
+// and the one picking the fastest proxy.
+const (
+	singboxSelectorTag = "proxy"
+	singboxURLTestTag  = "auto"
+)
+
+type singboxConfig struct {
+	DNS       json.RawMessage    `json:"dns,omitempty"`
+	Outbounds []*singboxOutbound `json:"outbounds"`
+	Route     json.RawMessage    `json:"route,omitempty"`
+}
+
+type singboxOutbound struct {
+	Type       string            `json:"type"`
+	Tag        string            `json:"tag"`
+	Outbounds  []string          `json:"outbounds,omitempty"`
+	Default    string            `json:"default,omitempty"`
+	Server     string            `json:"server,omitempty"`
+	ServerPort int               `json:"server_port,omitempty"`
+	UUID       string            `json:"uuid,omitempty"`
+	Security   string            `json:"security,omitempty"`
+	Method     string            `json:"method,omitempty"`
+	Password   string            `json:"password,omitempty"`
+	Flow       string            `json:"flow,omitempty"`
+	TLS        *singboxTLS       `json:"tls,omitempty"`
+	Transport  *singboxTransport `json:"transport,omitempty"`
+}
+
+type singboxTLS struct {
+	Enabled    bool            `json:"enabled"`
+	ServerName string          `json:"server_name,omitempty"`
+	Insecure   bool            `json:"insecure,omitempty"`
+	ALPN       []string        `json:"alpn,omitempty"`
+	UTLS       *singboxUTLS    `json:"utls,omitempty"`
+	Reality    *singboxReality `json:"reality,omitempty"`
+}
+
+type singboxUTLS struct {
+	Enabled     bool   `json:"enabled"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+type singboxReality struct {
+	Enabled   bool   `json:"enabled"`
+	PublicKey string `json:"public_key"`
+	ShortId   string `json:"short_id,omitempty"`
+}
+
+type singboxTransport struct {
+	Type                string            `json:"type"`
+	Path                string            `json:"path,omitempty"`
+	Host                string            `json:"host,omitempty"`
+	Headers             map[string]string `json:"headers,omitempty"`
+	ServiceName         string            `json:"service_name,omitempty"`
+	MaxEarlyData        int               `json:"max_early_data,omitempty"`
+	EarlyDataHeaderName string            `json:"early_data_header_name,omitempty"`
+}
+
+type SubSingboxService struct {
+	// minor is the minor version of sing-box the configurations are written
+	// for, its schema changes between releases.
+	minor int
+	dns   json.RawMessage
+	route json.RawMessage
+
+	SubService *SubService
+}
+
+func NewSubSingboxService(version string, dns string, route string, subService *SubService) *SubSingboxService {
+	minor, err := entity.ParseSingboxVersion(version)
+	if err != nil {
+		logger.Warning("SubSingboxService - version is not valid, writing for 1.11:", err)
+		minor = 11
+	}
+	return &SubSingboxService{
+		minor:      minor,
+		dns:        singboxSection("dns", dns),
+		route:      singboxSection("route", route),
+		SubService: subService,
+	}
+}
+
+// singboxSection returns the template of a section of the configurations, nil
+// if there is none or it is not a JSON object.
+func singboxSection(name string, template string) json.RawMessage {
+	var object map[string]any
+	if template == "" {
+		return nil
+	}
+	if err := json.Unmarshal([]byte(template), &object); err != nil || object == nil {
+		logger.Warning("SubSingboxService - the", name, "template is not a JSON object, leaving it out")
+		return nil
+	}
+	return json.RawMessage(template)
+}
+
+// GetSingbox returns the sing-box configuration of the subscription subId and
+// the header of its clients. Clients whose transport sing-box cannot use
+// are left out.
+func (s *SubSingboxService) GetSingbox(subId string, host string) (string, *subHeader, error) {
+	endpoints, header, err := s.SubService.getEndpoints(subId, host)
+	if err != nil || len(endpoints) == 0 {
+		return "", nil, err
+	}
+
+	var proxies []*singboxOutbound
+	var tags []string
+	for _, endpoint := range endpoints {
+		outbound, err := newSingboxOutbound(endpoint.inbound, endpoint.client, endpoint.stream, endpoint.security)
+		if err != nil {
+			logger.Debug("SubSingboxService - skipped", endpoint.name+":", strings.TrimSpace(err.Error()))
+			continue
+		}
+		outbound.Tag = endpoint.name
+		outbound.Server = endpoint.server
+		outbound.ServerPort = endpoint.port
+		proxies = append(proxies, outbound)
+		tags = append(tags, endpoint.name)
+	}
+
+	selector := &singboxOutbound{Type: "selector", Tag: singboxSelectorTag, Outbounds: []string{"direct"}}
+	outbounds := []*singboxOutbound{selector}
+	if len(proxies) > 0 {
+		selector.Outbounds = append([]string{singboxURLTestTag}, tags...)
+		selector.Default = singboxURLTestTag
+		outbounds = append(outbounds, &singboxOutbound{Type: "urltest", Tag: singboxURLTestTag, Outbounds: tags})
+		outbounds = append(outbounds, proxies...)
+	}
+	outbounds = append(outbounds, &singboxOutbound{Type: "direct", Tag: "direct"})
+	// Rule actions replace the special outbounds from 1.11 on
+	if s.minor < 11 {
+		outbounds = append(outbounds,
+			&singboxOutbound{Type: "block", Tag: "block"},
+			&singboxOutbound{Type: "dns", Tag: "dns-out"})
+	}
+
+	config := singboxConfig{
+		DNS:       s.dns,
+		Outbounds: outbounds,
+		Route:     s.route,
+	}
+	result, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return "", nil, err
+	}
+	return string(result), header, nil
+}
+
+// newSingboxOutbound maps client of inbound to a sing-box outbound, without its
+// tag and address. security overrides the one of stream unless it is "same". It
+// fails for the protocols, transports and securities sing-box has no
+// equivalent of; the link options it has none of, mux.cool and the gRPC multi
+// mode, are left out.
+func newSingboxOutbound(inbound *model.Inbound, client model.Client, stream map[string]any, security string) (*singboxOutbound, error) {
+	if security == "" || security == "same" {
+		security, _ = stream["security"].(string)
+	}
+	if security == "" {
+		security = "none"
+	}
+	network, _ := stream["network"].(string)
+
+	outbound := &singboxOutbound{}
+	switch inbound.Protocol {
+	case model.VMESS:
+		outbound.Type = "vmess"
+		outbound.UUID = client.ID
+		outbound.Security = client.Security
+		if outbound.Security == "" {
+			outbound.Security = "auto"
+		}
+	case model.VLESS:
+		outbound.Type = "vless"
+		outbound.UUID = client.ID
+	case model.Trojan:
+		outbound.Type = "trojan"
+		outbound.Password = client.Password
+	case model.Shadowsocks:
+		var settings map[string]any
+		json.Unmarshal([]byte(inbound.Settings), &settings)
+		method, _ := settings["method"].(string)
+		outbound.Type = "shadowsocks"
+		outbound.Method = method
+		outbound.Password = client.Password
+		if strings.HasPrefix(method, "2022") {
+			inboundPassword, _ := settings["password"].(string)
+			outbound.Password = inboundPassword + ":" + client.Password
+		}
+	default:
+		return nil, common.NewErrorf("sing-box has no %s outbounds", inbound.Protocol)
+	}
+
+	switch network {
+	case "tcp":
+		tcp, _ := stream["tcpSettings"].(map[string]any)
+		header, _ := tcp["header"].(map[string]any)
+		if headerType, _ := header["type"].(string); headerType == "http" {
+			return nil, common.NewError("sing-box has no HTTP header obfuscation")
+		}
+	case "ws", "httpupgrade":
+		settings, _ := stream[network+"Settings"].(map[string]any)
+		transport := &singboxTransport{Type: network}
+		transport.Path, _ = settings["path"].(string)
+		host, _ := settings["host"].(string)
+		if host == "" {
+			host = searchHost(settings["headers"])
+		}
+		if host != "" {
+			// The WebSocket transport sends it as a header
+			if network == "ws" {
+				transport.Headers = map[string]string{"Host": host}
+			} else {
+				transport.Host = host
+			}
+		}
+		if network == "ws" {
+			transport.Path, transport.MaxEarlyData, transport.EarlyDataHeaderName = wsEarlyData(transport.Path, linkOptions(inbound, client))
+			if transport.MaxEarlyData == 0 {
+				transport.EarlyDataHeaderName = ""
+			}
+		}
+		outbound.Transport = transport
+	case "grpc":
+		grpc, _ := stream["grpcSettings"].(map[string]any)
+		serviceName, _ := grpc["serviceName"].(string)
+		outbound.Transport = &singboxTransport{Type: "grpc", ServiceName: serviceName}
+	default:
+		return nil, common.NewErrorf("sing-box has no %s transport", network)
+	}
+
+	switch security {
+	case "tls":
+		tlsSettings, _ := stream["tlsSettings"].(map[string]any)
+		clientSettings, _ := tlsSettings["settings"].(map[string]any)
+		tls := &singboxTLS{Enabled: true}
+		tls.ServerName, _ = tlsSettings["serverName"].(string)
+		tls.Insecure, _ = clientSettings["allowInsecure"].(bool)
+		alpns, _ := tlsSettings["alpn"].([]any)
+		for _, alpn := range alpns {
+			if alpn, ok := alpn.(string); ok {
+				tls.ALPN = append(tls.ALPN, alpn)
+			}
+		}
+		if fingerprint, _ := clientSettings["fingerprint"].(string); fingerprint != "" {
+			tls.UTLS = &singboxUTLS{Enabled: true, Fingerprint: fingerprint}
+		}
+		outbound.TLS = tls
+	case "reality":
+		realitySettings, _ := stream["realitySettings"].(map[string]any)
+		clientSettings, _ := realitySettings["settings"].(map[string]any)
+		tls := &singboxTLS{Enabled: true, Reality: &singboxReality{Enabled: true}}
+		tls.Reality.PublicKey, _ = clientSettings["publicKey"].(string)
+		// The first ones, for configurations that do not change between updates
+		if serverNames, _ := realitySettings["serverNames"].([]any); len(serverNames) > 0 {
+			tls.ServerName, _ = serverNames[0].(string)
+		}
+		if shortIds, _ := realitySettings["shortIds"].([]any); len(shortIds) > 0 {
+			tls.Reality.ShortId, _ = shortIds[0].(string)
+		}
+		// sing-box requires uTLS for REALITY
+		fingerprint, _ := clientSettings["fingerprint"].(string)
+		if fingerprint == "" {
+			fingerprint = "chrome"
+		}
+		tls.UTLS = &singboxUTLS{Enabled: true, Fingerprint: fingerprint}
+		outbound.TLS = tls
+	case "none":
+	default:
+		return nil, common.NewErrorf("sing-box has no %s security", security)
+	}
+
+	if inbound.Protocol == model.Shadowsocks && (outbound.Transport != nil || outbound.TLS != nil) {
+		return nil, common.NewError("sing-box has no shadowsocks over a transport or TLS")
+	}
+	if inbound.Protocol == model.VLESS && network == "tcp" && outbound.TLS != nil {
+		outbound.Flow = client.Flow
+	}
+	return outbound, nil
+}
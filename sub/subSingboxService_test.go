@@ -0,0 +1,325 @@
+package sub
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"x-ui/database"
+)
+
+// singboxKeys are the fields of the sing-box schema the configurations of
+// subscriptions may have, by the object they are of.
+var singboxKeys = map[string][]string{
+	"config":    {"dns", "outbounds", "route"},
+	"outbound":  {"type", "tag", "outbounds", "default", "server", "server_port", "uuid", "security", "method", "password", "flow", "tls", "transport"},
+	"tls":       {"enabled", "server_name", "insecure", "alpn", "utls", "reality"},
+	"utls":      {"enabled", "fingerprint"},
+	"reality":   {"enabled", "public_key", "short_id"},
+	"transport": {"type", "path", "host", "headers", "service_name", "max_early_data", "early_data_header_name"},
+}
+
+// singboxMethods are the shadowsocks methods of sing-box.
+var singboxMethods = []string{
+	"2022-blake3-aes-128-gcm", "2022-blake3-aes-256-gcm", "2022-blake3-chacha20-poly1305",
+	"aes-128-gcm", "aes-192-gcm", "aes-256-gcm", "chacha20-ietf-poly1305", "xchacha20-ietf-poly1305", "none",
+}
+
+// checkSingbox checks config with "sing-box check" when sing-box is installed,
+// and against the schema of the version minor otherwise.
+func checkSingbox(t *testing.T, config string, minor int) {
+	t.Helper()
+	if binary, err := exec.LookPath("sing-box"); err == nil {
+		file := filepath.Join(t.TempDir(), "config.json")
+		if err := os.WriteFile(file, []byte(config), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if output, err := exec.Command(binary, "check", "-c", file).CombinedOutput(); err != nil {
+			t.Errorf("sing-box check failed: %v\n%s\n%s", err, output, config)
+		}
+		return
+	}
+
+	var object map[string]any
+	if err := json.Unmarshal([]byte(config), &object); err != nil {
+		t.Fatal(err)
+	}
+	fail := func(format string, args ...any) {
+		t.Helper()
+		t.Errorf(format+"\n%s", append(args, config)...)
+	}
+	var keys func(kind string, object map[string]any)
+	keys = func(kind string, object map[string]any) {
+		for key, value := range object {
+			if !slices.Contains(singboxKeys[kind], key) {
+				fail("the %s has the field %q", kind, key)
+			}
+			if child, ok := value.(map[string]any); ok && singboxKeys[key] != nil {
+				keys(key, child)
+			}
+		}
+	}
+	keys("config", object)
+
+	outbounds, _ := object["outbounds"].([]any)
+	tags := map[string]bool{}
+	for _, value := range outbounds {
+		outbound, _ := value.(map[string]any)
+		keys("outbound", outbound)
+		tag, _ := outbound["tag"].(string)
+		if tag == "" || tags[tag] {
+			fail("the tag %q is empty or not unique", tag)
+		}
+		tags[tag] = true
+	}
+	for _, value := range outbounds {
+		outbound, _ := value.(map[string]any)
+		tag, kind := outbound["tag"], outbound["type"]
+		required := []string{"server", "server_port"}
+		switch kind {
+		case "selector", "urltest":
+			members, _ := outbound["outbounds"].([]any)
+			if len(members) == 0 {
+				fail("the group %s is empty", tag)
+			}
+			for _, member := range members {
+				if !tags[member.(string)] {
+					fail("the group %s has the unknown outbound %v", tag, member)
+				}
+			}
+			if def, ok := outbound["default"]; ok && !slices.Contains(members, def) {
+				fail("the default %v of %s is not one of its outbounds", def, tag)
+			}
+			continue
+		case "direct":
+			continue
+		case "block", "dns":
+			if minor >= 11 {
+				fail("sing-box 1.%d has no %s outbound", minor, kind)
+			}
+			continue
+		case "vmess", "vless":
+			required = append(required, "uuid")
+		case "trojan":
+			required = append(required, "password", "tls")
+		case "shadowsocks":
+			required = append(required, "method", "password")
+			if method, _ := outbound["method"].(string); !slices.Contains(singboxMethods, method) {
+				fail("sing-box has no shadowsocks method %v", outbound["method"])
+			}
+		default:
+			fail("sing-box has no %v outbound", kind)
+		}
+		for _, key := range required {
+			if outbound[key] == nil || outbound[key] == "" {
+				fail("the %v outbound %s has no %s", kind, tag, key)
+			}
+		}
+		if tls, ok := outbound["tls"].(map[string]any); ok {
+			if reality, ok := tls["reality"].(map[string]any); ok {
+				if reality["public_key"] == "" || tls["utls"] == nil || tls["server_name"] == nil {
+					fail("the REALITY of %s has no public key, uTLS or server name", tag)
+				}
+			}
+		}
+		if transport, ok := outbound["transport"].(map[string]any); ok && !slices.Contains([]any{"ws", "grpc", "httpupgrade", "http", "quic"}, transport["type"]) {
+			fail("sing-box has no %v transport", transport["type"])
+		}
+	}
+}
+
+func singboxOutbounds(t *testing.T, config string) map[string]*singboxOutbound {
+	t.Helper()
+	var parsed singboxConfig
+	if err := json.Unmarshal([]byte(config), &parsed); err != nil {
+		t.Fatal(err)
+	}
+	outbounds := map[string]*singboxOutbound{}
+	for _, outbound := range parsed.Outbounds {
+		outbounds[outbound.Tag] = outbound
+	}
+	return outbounds
+}
+
+func TestSingboxOutbounds(t *testing.T) {
+	if err := database.InitDB(t.TempDir() + "/x-ui.db"); err != nil {
+		t.Fatal(err)
+	}
+	for i, combination := range clashCombinations {
+		clashTestInbound(t, combination.subId, combination.subId, combination.protocol, 30101+i, combination.settings, combination.stream)
+	}
+	s := NewSubSingboxService("1.11", "", "", NewSubService(false, "-ieo"))
+
+	// sing-box has neither XHTTP nor the HTTP header obfuscation
+	skipped := []string{"vmess-tcp-http", "vless-xhttp-tls"}
+	for _, combination := range clashCombinations {
+		t.Run(combination.subId, func(t *testing.T) {
+			config, _, err := s.GetSingbox(combination.subId, "example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkSingbox(t, config, 11)
+			tag := combination.subId + "-" + combination.subId
+			outbound := singboxOutbounds(t, config)[tag]
+			if slices.Contains(skipped, combination.subId) {
+				if outbound != nil {
+					t.Errorf("sing-box has no %s, but the outbound is %+v", combination.subId, outbound)
+				}
+				return
+			}
+			if outbound == nil || outbound.Server != "example.com" || outbound.ServerPort == 0 {
+				t.Fatalf("the outbound %s is %+v in\n%s", tag, outbound, config)
+			}
+		})
+	}
+
+	tests := []struct {
+		subId string
+		check func(outbound *singboxOutbound) bool
+	}{
+		{"vmess-tcp", func(o *singboxOutbound) bool {
+			return o.Type == "vmess" && o.Security == "aes-128-gcm" && o.TLS == nil && o.Transport == nil
+		}},
+		{"vmess-ws-tls", func(o *singboxOutbound) bool {
+			return o.Transport.Type == "ws" && o.Transport.Path == "/ws" && o.Transport.Headers["Host"] == "ws.example.com" &&
+				o.Transport.MaxEarlyData == 2048 && o.Transport.EarlyDataHeaderName == "Sec-WebSocket-Protocol" &&
+				o.TLS.ServerName == "cdn.example.com" && o.TLS.Insecure && slices.Equal(o.TLS.ALPN, []string{"h2", "http/1.1"}) &&
+				o.TLS.UTLS.Fingerprint == "firefox"
+		}},
+		{"vmess-grpc", func(o *singboxOutbound) bool {
+			return o.Transport.Type == "grpc" && o.Transport.ServiceName == "tunnel"
+		}},
+		{"vless-tcp-reality", func(o *singboxOutbound) bool {
+			return o.Type == "vless" && o.Flow == "xtls-rprx-vision" && o.TLS.ServerName == "www.microsoft.com" &&
+				o.TLS.Reality.PublicKey == "jNXHt1yRo0vDuchQlIP6Z0ZvjT3KtzVI-T4E7RoLJS0" && o.TLS.Reality.ShortId == "6ba85179e30d4fc2" &&
+				o.TLS.UTLS.Enabled && o.TLS.UTLS.Fingerprint == "safari"
+		}},
+		{"vless-grpc-reality", func(o *singboxOutbound) bool {
+			return o.Flow == "" && o.TLS.Reality.Enabled && o.Transport.ServiceName == "tunnel"
+		}},
+		{"vless-ws", func(o *singboxOutbound) bool {
+			return o.Flow == "" && o.TLS == nil && o.Transport.Headers["Host"] == "ws.example.com" && o.Transport.MaxEarlyData == 0
+		}},
+		{"vless-httpupgrade-tls", func(o *singboxOutbound) bool {
+			return o.Transport.Type == "httpupgrade" && o.Transport.Host == "up.example.com" && o.Transport.Headers == nil
+		}},
+		{"trojan-tcp-tls", func(o *singboxOutbound) bool {
+			return o.Type == "trojan" && o.Password == "Zq8vN2xL5cR1" && o.TLS.Enabled
+		}},
+		{"ss-tcp", func(o *singboxOutbound) bool {
+			return o.Type == "shadowsocks" && o.Method == "chacha20-ietf-poly1305" && o.Password == "c2VjcmV0"
+		}},
+		{"ss2022-tcp", func(o *singboxOutbound) bool {
+			return o.Method == "2022-blake3-aes-128-gcm" && o.Password == "aW5ib3VuZC1zZWNyZXQ=:Y2xpZW50LXNlY3JldA=="
+		}},
+	}
+	for _, test := range tests {
+		config, _, err := s.GetSingbox(test.subId, "example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if outbound := singboxOutbounds(t, config)[test.subId+"-"+test.subId]; outbound == nil || !test.check(outbound) {
+			t.Errorf("the outbound of %s is not mapped right:\n%s", test.subId, config)
+		}
+	}
+}
+
+func TestSingboxGroupsAndVersions(t *testing.T) {
+	if err := database.InitDB(t.TempDir() + "/x-ui.db"); err != nil {
+		t.Fatal(err)
+	}
+	const subId = "mixed"
+	for i, combination := range clashCombinations[:3] {
+		clashTestInbound(t, combination.subId, subId, combination.protocol, 30201+i, combination.settings, combination.stream)
+	}
+	sub := NewSubService(false, "-ieo")
+
+	tests := []struct {
+		version string
+		minor   int
+		special bool
+	}{
+		{"1.10", 10, true},
+		{"1.11", 11, false},
+		{"1.12", 12, false},
+		{"2.0", 11, false},
+		{"1.7", 11, false},
+	}
+	for _, test := range tests {
+		s := NewSubSingboxService(test.version, "", "", sub)
+		if s.minor != test.minor {
+			t.Errorf("the version %s is written for 1.%d, want 1.%d", test.version, s.minor, test.minor)
+		}
+		config, _, err := s.GetSingbox(subId, "example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkSingbox(t, config, s.minor)
+		outbounds := singboxOutbounds(t, config)
+		if (outbounds["block"] != nil) != test.special || (outbounds["dns-out"] != nil) != test.special {
+			t.Errorf("for %s the block and dns outbounds are %v, want %v", test.version, outbounds["block"] != nil, test.special)
+		}
+		// The vmess over HTTP obfuscation is left out of the groups
+		tags := []string{"vmess-tcp-vmess-tcp", "vmess-ws-tls-vmess-ws-tls"}
+		selector, urltest := outbounds[singboxSelectorTag], outbounds[singboxURLTestTag]
+		if selector == nil || selector.Type != "selector" || selector.Default != singboxURLTestTag ||
+			!slices.Equal(selector.Outbounds, append([]string{singboxURLTestTag}, tags...)) {
+			t.Errorf("the selector is %+v", selector)
+		}
+		if urltest == nil || urltest.Type != "urltest" || !slices.Equal(urltest.Outbounds, tags) {
+			t.Errorf("the urltest is %+v", urltest)
+		}
+	}
+}
+
+func TestSingboxTemplates(t *testing.T) {
+	if err := database.InitDB(t.TempDir() + "/x-ui.db"); err != nil {
+		t.Fatal(err)
+	}
+	combination := clashCombinations[0]
+	clashTestInbound(t, combination.subId, combination.subId, combination.protocol, 30301, combination.settings, combination.stream)
+	sub := NewSubService(false, "-ieo")
+
+	dns := `{"servers":[{"tag":"cloudflare","address":"https://1.1.1.1/dns-query"}]}`
+	route := `{"rules":[{"ip_is_private":true,"outbound":"direct"}],"final":"proxy"}`
+	config, _, err := NewSubSingboxService("1.11", dns, route, sub).GetSingbox(combination.subId, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSingbox(t, config, 11)
+	var parsed map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(config), &parsed); err != nil {
+		t.Fatal(err)
+	}
+	if !jsonEqual(parsed["dns"], dns) || !jsonEqual(parsed["route"], route) {
+		t.Errorf("the templates are not in the configuration:\n%s", config)
+	}
+
+	// Templates that are not JSON objects are left out
+	for _, template := range []string{"", "[]", "null", "{not json"} {
+		config, _, err := NewSubSingboxService("1.11", template, template, sub).GetSingbox(combination.subId, "example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkSingbox(t, config, 11)
+		parsed := map[string]json.RawMessage{}
+		json.Unmarshal([]byte(config), &parsed)
+		if parsed["dns"] != nil || parsed["route"] != nil {
+			t.Errorf("the template %q is in the configuration:\n%s", template, config)
+		}
+	}
+}
+
+func jsonEqual(data json.RawMessage, want string) bool {
+	var a, b any
+	return json.Unmarshal(data, &a) == nil && json.Unmarshal([]byte(want), &b) == nil && bytes.Equal(marshalJSON(a), marshalJSON(b))
+}
+
+func marshalJSON(value any) []byte {
+	data, _ := json.Marshal(value)
+	return data
+}
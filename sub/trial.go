@@ -0,0 +1,114 @@
+package sub
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"x-ui/logger"
+	"x-ui/web/middleware"
+	"x-ui/web/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// trialRequestsPerMinute and trialRequestBurst limit the requests to the
+	// trial endpoint of an IP, the answers to the challenges included
+	trialRequestsPerMinute = 6
+	trialRequestBurst      = 3
+	// trialLimiterKeys bounds the memory used by the rate limiter
+	trialLimiterKeys = 10000
+)
+
+// trialStatuses are the HTTP statuses of the states of the trial requests.
+var trialStatuses = map[string]int{
+	service.TrialCreated:     http.StatusCreated,
+	service.TrialExisting:    http.StatusOK,
+	service.TrialCaptcha:     http.StatusForbidden,
+	service.TrialTelegram:    http.StatusAccepted,
+	service.TrialUsed:        http.StatusTooManyRequests,
+	service.TrialLimited:     http.StatusTooManyRequests,
+	service.TrialUnavailable: http.StatusServiceUnavailable,
+}
+
+// trialReply is a trial request as replied, with the subscription URL and the
+// links of a handed out client.
+type trialReply struct {
+	*service.TrialResult
+	SubUrl string   `json:"subUrl,omitempty"`
+	Links  []string `json:"links,omitempty"`
+}
+
+// trialEndpoint is the public trial endpoint: GET tells what a trial gives and
+// issues the challenge, POST hands out a trial client.
+type trialEndpoint struct {
+	remarkModel  string
+	trialService service.TrialService
+
+	settingService service.SettingService
+	limiter        *middleware.RateLimiter
+}
+
+func newTrialEndpoint(remarkModel string) *trialEndpoint {
+	return &trialEndpoint{
+		remarkModel: remarkModel,
+		limiter:     middleware.NewRateLimiter(trialRequestsPerMinute, trialRequestBurst, trialLimiterKeys),
+	}
+}
+
+// allow tells whether the IP of c may ask for a trial now, and replies 429 if
+// it may not.
+func (e *trialEndpoint) allow(c *gin.Context) bool {
+	c.Header("Cache-Control", "no-store")
+	c.Header("X-Robots-Tag", "noindex, nofollow")
+	allowed, wait := e.limiter.Allow(middleware.RateLimitKey(middleware.ClientIP(c)))
+	if !allowed {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		c.JSON(http.StatusTooManyRequests, gin.H{"status": service.TrialLimited})
+	}
+	return allowed
+}
+
+func (e *trialEndpoint) offer(c *gin.Context) {
+	if !e.allow(c) {
+		return
+	}
+	offer, err := e.trialService.Offer(middleware.ClientIP(c))
+	if err != nil {
+		logger.Warning("Unable to offer a trial:", err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	c.JSON(http.StatusOK, offer)
+}
+
+func (e *trialEndpoint) request(c *gin.Context) {
+	if !e.allow(c) {
+		return
+	}
+	req := &service.TrialRequest{}
+	if err := c.ShouldBind(req); err != nil {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	result, err := e.trialService.Request(req, middleware.ClientIP(c))
+	if err != nil {
+		logger.Warning("Unable to hand out a trial:", err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	reply := &trialReply{TrialResult: result}
+	if result.Inbound != nil {
+		host := subHost(c)
+		if link := NewSubService(false, e.remarkModel).GetLink(result.Inbound, result.Email, host); link != "" {
+			reply.Links = strings.Split(link, "\n")
+		}
+		reply.SubUrl, _ = e.settingService.GetSubLink(host, result.SubId)
+	}
+	if result.RetryAfter > 0 {
+		c.Header("Retry-After", strconv.FormatInt(result.RetryAfter, 10))
+	}
+	c.JSON(trialStatuses[result.Status], reply)
+}
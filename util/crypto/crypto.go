@@ -1,15 +1,128 @@
 package crypto
 
 import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/bcrypt"
 )
 
-func HashPasswordAsBcrypt(password string) (string, error) {
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	return string(hash), err
+const argon2idPrefix = "$argon2id$"
+
+// Argon2Params are the cost parameters of an argon2id hash. They are stored in the
+// hash itself, so raising them later doesn't break the existing hashes.
+type Argon2Params struct {
+	Memory      uint32 // KiB
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// DefaultArgon2Params follow the OWASP recommendation for argon2id.
+var DefaultArgon2Params = Argon2Params{
+	Memory:      64 * 1024,
+	Iterations:  3,
+	Parallelism: 2,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+// HashPassword hashes password with argon2id and the default parameters.
+func HashPassword(password string) (string, error) {
+	return HashPasswordWithParams(password, DefaultArgon2Params)
+}
+
+// HashPasswordWithParams returns a hash in the PHC string format
+// "$argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>".
+func HashPasswordWithParams(password string, params Argon2Params) (string, error) {
+	if params.Memory < 8*uint32(params.Parallelism) || params.Iterations == 0 || params.Parallelism == 0 {
+		return "", errors.New("invalid argon2id parameters")
+	}
+	salt := make([]byte, params.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2idPrefix, argon2.Version,
+		params.Memory, params.Iterations, params.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
 }
 
+// CheckPasswordHash verifies password against an argon2id hash, or a bcrypt hash
+// stored by older versions.
 func CheckPasswordHash(hash, password string) bool {
-	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
-	return err == nil
+	if !IsArgon2idHash(hash) {
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		return err == nil
+	}
+	params, salt, key, err := decodeArgon2idHash(hash)
+	if err != nil {
+		return false
+	}
+	other := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+	return subtle.ConstantTimeCompare(key, other) == 1
+}
+
+func IsArgon2idHash(hash string) bool {
+	return strings.HasPrefix(hash, argon2idPrefix)
+}
+
+// NeedsRehash reports whether hash uses an older scheme or weaker parameters than
+// params, and should be replaced the next time the password is known.
+func NeedsRehash(hash string, params Argon2Params) bool {
+	if !IsArgon2idHash(hash) {
+		return true
+	}
+	current, salt, key, err := decodeArgon2idHash(hash)
+	if err != nil {
+		return true
+	}
+	return current.Memory < params.Memory ||
+		current.Iterations < params.Iterations ||
+		current.Parallelism < params.Parallelism ||
+		uint32(len(salt)) < params.SaltLength ||
+		uint32(len(key)) < params.KeyLength
+}
+
+func decodeArgon2idHash(hash string) (Argon2Params, []byte, []byte, error) {
+	var params Argon2Params
+	// "", "argon2id", "v=19", "m=...,t=...,p=...", salt, key
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return params, nil, nil, errors.New("invalid argon2id hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return params, nil, nil, err
+	}
+	if version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("unsupported argon2 version %d", version)
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return params, nil, nil, err
+	}
+	if params.Iterations == 0 || params.Parallelism == 0 {
+		return params, nil, nil, errors.New("invalid argon2id parameters")
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, err
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, err
+	}
+	if len(key) == 0 {
+		return params, nil, nil, errors.New("invalid argon2id hash")
+	}
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+	return params, salt, key, nil
 }
@@ -0,0 +1,111 @@
+package crypto
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testParams are cheap parameters, the defaults would make the tests slow.
+var testParams = Argon2Params{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+
+func TestHashPasswordRoundTrip(t *testing.T) {
+	hash, err := HashPasswordWithParams("correct horse", testParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=1024,t=1,p=1$") {
+		t.Errorf("unexpected hash format: %s", hash)
+	}
+	if !CheckPasswordHash(hash, "correct horse") {
+		t.Error("the password doesn't verify against its hash")
+	}
+	if CheckPasswordHash(hash, "correct horse ") || CheckPasswordHash(hash, "") {
+		t.Error("a wrong password verifies")
+	}
+	other, _ := HashPasswordWithParams("correct horse", testParams)
+	if other == hash {
+		t.Error("two hashes of a password share their salt")
+	}
+}
+
+func TestCheckPasswordHashBcrypt(t *testing.T) {
+	// Hashes stored by older versions still verify
+	old, err := bcrypt.GenerateFromPassword([]byte("admin"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !CheckPasswordHash(string(old), "admin") {
+		t.Error("a bcrypt hash doesn't verify")
+	}
+	if CheckPasswordHash(string(old), "admin2") {
+		t.Error("a wrong password verifies against a bcrypt hash")
+	}
+	if !NeedsRehash(string(old), testParams) {
+		t.Error("a bcrypt hash doesn't need a rehash")
+	}
+}
+
+func TestRaisedParamsKeepOldHashes(t *testing.T) {
+	hash, err := HashPasswordWithParams("secret", testParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raised := testParams
+	raised.Memory *= 2
+	raised.Iterations++
+	if !CheckPasswordHash(hash, "secret") {
+		t.Error("an older hash stopped verifying")
+	}
+	if !NeedsRehash(hash, raised) {
+		t.Error("a hash of weaker parameters doesn't need a rehash")
+	}
+	if NeedsRehash(hash, testParams) {
+		t.Error("a hash of the current parameters needs a rehash")
+	}
+
+	// Lowering the parameters doesn't downgrade stronger hashes
+	strong, _ := HashPasswordWithParams("secret", raised)
+	if NeedsRehash(strong, testParams) {
+		t.Error("a hash of stronger parameters needs a rehash")
+	}
+	if !CheckPasswordHash(strong, "secret") {
+		t.Error("a hash of raised parameters doesn't verify")
+	}
+}
+
+func TestMalformedHashes(t *testing.T) {
+	hash, _ := HashPasswordWithParams("secret", testParams)
+	parts := strings.Split(hash, "$")
+	for name, bad := range map[string]string{
+		"empty":       "",
+		"truncated":   strings.Join(parts[:5], "$"),
+		"bad version": strings.Replace(hash, "v=19", "v=16", 1),
+		"zero time":   strings.Replace(hash, "t=1", "t=0", 1),
+		"bad salt":    strings.Join([]string{"", parts[1], parts[2], parts[3], "!!", parts[5]}, "$"),
+		"empty key":   strings.Join([]string{"", parts[1], parts[2], parts[3], parts[4], ""}, "$"),
+		"bad params":  strings.Replace(hash, "m=1024,t=1,p=1", "m=x", 1),
+	} {
+		t.Run(name, func(t *testing.T) {
+			if CheckPasswordHash(bad, "secret") {
+				t.Error("a malformed hash verifies")
+			}
+			if !NeedsRehash(bad, testParams) {
+				t.Error("a malformed hash doesn't need a rehash")
+			}
+		})
+	}
+}
+
+func TestInvalidParams(t *testing.T) {
+	for _, params := range []Argon2Params{
+		{Memory: 1024, Iterations: 0, Parallelism: 1, SaltLength: 16, KeyLength: 32},
+		{Memory: 1024, Iterations: 1, Parallelism: 0, SaltLength: 16, KeyLength: 32},
+		{Memory: 4, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32},
+	} {
+		if _, err := HashPasswordWithParams("secret", params); err == nil {
+			t.Errorf("hashing with %+v succeeded", params)
+		}
+	}
+}
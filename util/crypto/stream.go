@@ -0,0 +1,252 @@
+package crypto
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// The files NewEncryptWriter writes start with a header of encryptedMagic, the
+// version of the format, the argon2id parameters the key is derived with, the
+// random salt and the nonce prefix. The data follows in chunks, each sealed
+// with AES-256-GCM under a nonce of the prefix, the number of the chunk and a
+// flag for the last one, with the header as additional data so that none of
+// it can be changed, reordered or cut off unnoticed.
+const (
+	encryptedMagic   = "x-ui-enc"
+	encryptedVersion = 1
+	chunkSize        = 64 * 1024
+	saltSize         = 16
+	noncePrefixSize  = 7
+	// headerSize is the magic, the version, memory, iterations, parallelism,
+	// the salt and the nonce prefix
+	headerSize = len(encryptedMagic) + 1 + 4 + 4 + 1 + saltSize + noncePrefixSize
+)
+
+// ErrWrongPassphrase is returned when the passphrase doesn't open a file, or
+// the file was changed.
+var ErrWrongPassphrase = errors.New("wrong passphrase, or the file is corrupt")
+
+// IsEncrypted tells if data starts like a file NewEncryptWriter writes.
+func IsEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(encryptedMagic))
+}
+
+func streamKey(passphrase string, salt []byte, params Argon2Params) []byte {
+	return argon2.IDKey([]byte(passphrase), salt, params.Iterations, params.Memory, params.Parallelism, 32)
+}
+
+func chunkNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+type encryptWriter struct {
+	w       io.Writer
+	gcm     cipher.AEAD
+	header  []byte
+	prefix  []byte
+	buf     []byte
+	counter uint32
+	closed  bool
+}
+
+// NewEncryptWriter returns a writer encrypting what is written to it into w
+// with a key derived from passphrase. Close must be called to write the last
+// chunk; it doesn't close w.
+func NewEncryptWriter(w io.Writer, passphrase string) (io.WriteCloser, error) {
+	params := DefaultArgon2Params
+	header := make([]byte, 0, headerSize)
+	header = append(header, encryptedMagic...)
+	header = append(header, encryptedVersion)
+	header = binary.BigEndian.AppendUint32(header, params.Memory)
+	header = binary.BigEndian.AppendUint32(header, params.Iterations)
+	header = append(header, params.Parallelism)
+	random := make([]byte, saltSize+noncePrefixSize)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	header = append(header, random...)
+
+	block, err := aes.NewCipher(streamKey(passphrase, random[:saltSize], params))
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{
+		w:      w,
+		gcm:    gcm,
+		header: header,
+		prefix: random[saltSize:],
+		buf:    make([]byte, 0, chunkSize),
+	}, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	if e.closed {
+		return 0, errors.New("write to a closed encrypt writer")
+	}
+	written := 0
+	for len(p) > 0 {
+		// A full chunk is sealed once more data comes, the last one on Close
+		if len(e.buf) == chunkSize {
+			if err := e.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(e.buf[len(e.buf):chunkSize], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (e *encryptWriter) seal(last bool) error {
+	if e.counter == ^uint32(0) {
+		return errors.New("too much data to encrypt")
+	}
+	sealed := e.gcm.Seal(nil, chunkNonce(e.prefix, e.counter, last), e.buf, e.header)
+	e.counter++
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+func (e *encryptWriter) Close() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	return e.seal(true)
+}
+
+type decryptReader struct {
+	r       *bufio.Reader
+	gcm     cipher.AEAD
+	header  []byte
+	prefix  []byte
+	chunk   []byte
+	counter uint32
+	done    bool
+}
+
+// NewDecryptReader returns a reader of the data NewEncryptWriter encrypted into
+// r. It returns ErrWrongPassphrase at once if passphrase doesn't open the first
+// chunk, and from Read if a later chunk was changed or the file cut off.
+func NewDecryptReader(r io.Reader, passphrase string) (io.Reader, error) {
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, errors.New("not an encrypted file")
+	}
+	if !IsEncrypted(header) {
+		return nil, errors.New("not an encrypted file")
+	}
+	offset := len(encryptedMagic)
+	if header[offset] != encryptedVersion {
+		return nil, errors.New("unsupported version of encrypted file")
+	}
+	params := Argon2Params{
+		Memory:      binary.BigEndian.Uint32(header[offset+1:]),
+		Iterations:  binary.BigEndian.Uint32(header[offset+5:]),
+		Parallelism: header[offset+9],
+	}
+	// Bound the parameters, for a crafted header not to take all the memory
+	if params.Memory == 0 || params.Memory > 1024*1024 || params.Iterations == 0 || params.Iterations > 64 || params.Parallelism == 0 {
+		return nil, errors.New("invalid encrypted file")
+	}
+	salt := header[offset+10 : offset+10+saltSize]
+	block, err := aes.NewCipher(streamKey(passphrase, salt, params))
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	d := &decryptReader{
+		r:      bufio.NewReaderSize(r, chunkSize+gcm.Overhead()+1),
+		gcm:    gcm,
+		header: header,
+		prefix: header[offset+10+saltSize:],
+	}
+	if err := d.open(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// open reads and opens the next chunk, the last one if nothing follows it.
+func (d *decryptReader) open() error {
+	sealed := make([]byte, chunkSize+d.gcm.Overhead())
+	n, err := io.ReadFull(d.r, sealed)
+	last := false
+	switch err {
+	case nil:
+		if _, err := d.r.Peek(1); err == io.EOF {
+			last = true
+		}
+	case io.ErrUnexpectedEOF:
+		last = true
+	case io.EOF:
+		return ErrWrongPassphrase
+	default:
+		return err
+	}
+	chunk, err := d.gcm.Open(nil, chunkNonce(d.prefix, d.counter, last), sealed[:n], d.header)
+	if err != nil {
+		return ErrWrongPassphrase
+	}
+	d.counter++
+	d.chunk = chunk
+	d.done = last
+	return nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.chunk) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.chunk)
+	d.chunk = d.chunk[n:]
+	return n, nil
+}
+
+// EncryptBytes returns data encrypted with passphrase, see NewEncryptWriter.
+func EncryptBytes(data []byte, passphrase string) ([]byte, error) {
+	var out bytes.Buffer
+	w, err := NewEncryptWriter(&out, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,116 @@
+package sdnotify
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSystemd listens on a notify socket at name, abstract if it starts with
+// @, and returns the datagrams it gets.
+func fakeSystemd(t *testing.T, name string) <-chan string {
+	t.Helper()
+	addr := name
+	if strings.HasPrefix(name, "@") {
+		addr = "\x00" + name[1:]
+	}
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", name)
+
+	datagrams := make(chan string, 16)
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			datagrams <- string(buf[:n])
+		}
+	}()
+	return datagrams
+}
+
+func received(t *testing.T, datagrams <-chan string) string {
+	t.Helper()
+	select {
+	case datagram := <-datagrams:
+		return datagram
+	case <-time.After(2 * time.Second):
+		t.Fatal("systemd got nothing")
+		return ""
+	}
+}
+
+func TestNotify(t *testing.T) {
+	for _, name := range []string{
+		filepath.Join(t.TempDir(), "notify"),
+		"@x-ui-sdnotify-test-" + strconv.Itoa(os.Getpid()),
+	} {
+		datagrams := fakeSystemd(t, name)
+		if !Enabled() {
+			t.Errorf("%s is not enabled", name)
+		}
+		if sent, err := Notify(Ready); !sent || err != nil {
+			t.Fatalf("%s: sent %v: %v", name, sent, err)
+		}
+		if datagram := received(t, datagrams); datagram != "READY=1" {
+			t.Errorf("%s got %q", name, datagram)
+		}
+		// The states of one call are sent together, one a line
+		if sent, err := Notify(Reloading, Status("restarting\nxray")); !sent || err != nil {
+			t.Fatalf("%s: sent %v: %v", name, sent, err)
+		}
+		if datagram := received(t, datagrams); datagram != "RELOADING=1\nSTATUS=restarting xray" {
+			t.Errorf("%s got %q", name, datagram)
+		}
+	}
+}
+
+func TestNotifyWithoutSystemd(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if Enabled() {
+		t.Error("enabled without a notify socket")
+	}
+	if sent, err := Notify(Ready, Watchdog); sent || err != nil {
+		t.Errorf("without a notify socket sent %v: %v", sent, err)
+	}
+
+	// A socket nobody listens on is an error
+	t.Setenv("NOTIFY_SOCKET", filepath.Join(t.TempDir(), "gone"))
+	if sent, err := Notify(Stopping); sent || err == nil {
+		t.Errorf("to a missing socket sent %v: %v", sent, err)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	tests := []struct {
+		usec string
+		pid  string
+		want time.Duration
+	}{
+		{"60000000", "", time.Minute},
+		{"60000000", strconv.Itoa(os.Getpid()), time.Minute},
+		// The watchdog of another process
+		{"60000000", strconv.Itoa(os.Getpid() + 1), 0},
+		{"", "", 0},
+		{"0", "", 0},
+		{"-5", "", 0},
+		{"1m", "", 0},
+	}
+	for _, test := range tests {
+		t.Setenv("WATCHDOG_USEC", test.usec)
+		t.Setenv("WATCHDOG_PID", test.pid)
+		if interval := WatchdogInterval(); interval != test.want {
+			t.Errorf("WATCHDOG_USEC=%q WATCHDOG_PID=%q is %v, want %v", test.usec, test.pid, interval, test.want)
+		}
+	}
+}
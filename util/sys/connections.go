@@ -0,0 +1,99 @@
+package sys
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Connection is a connection to a port of the host, from RemoteIP.
+type Connection struct {
+	Proto      string // "tcp" or "udp"
+	LocalIP    string
+	LocalPort  int
+	RemoteIP   string
+	RemotePort int
+}
+
+// localAddresses returns the addresses of the interfaces of the host.
+func localAddresses() map[string]bool {
+	addresses := map[string]bool{}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return addresses
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			addresses[ipNet.IP.String()] = true
+		}
+	}
+	return addresses
+}
+
+// GetConntrackConnections returns the connections to the host the connection
+// tracking of netfilter follows: the established TCP ones and the UDP flows.
+// It needs Linux with nf_conntrack loaded; the connections the host opens
+// itself are left out.
+func GetConntrackConnections() ([]Connection, error) {
+	var file *os.File
+	var err error
+	for _, name := range []string{"net/nf_conntrack", "net/ip_conntrack"} {
+		if file, err = os.Open(HostProc(name)); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, errors.New("connection tracking is not available: " + err.Error())
+	}
+	defer file.Close()
+
+	local := localAddresses()
+	var connections []Connection
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// ipv4 2 tcp 6 431999 ESTABLISHED src=203.0.113.7 dst=198.51.100.1 sport=51234 dport=443 src=... [ASSURED] mark=0 use=1
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 {
+			continue
+		}
+		proto := fields[2]
+		if proto != "tcp" && proto != "udp" {
+			continue
+		}
+		if proto == "tcp" && fields[5] != "ESTABLISHED" {
+			continue
+		}
+		// The first tuple is the direction the connection was opened in
+		tuple := map[string]string{}
+		for _, field := range fields[3:] {
+			key, value, ok := strings.Cut(field, "=")
+			if !ok {
+				continue
+			}
+			if _, seen := tuple[key]; seen {
+				break
+			}
+			tuple[key] = value
+		}
+		dst, src := net.ParseIP(tuple["dst"]), net.ParseIP(tuple["src"])
+		if dst == nil || src == nil || !local[dst.String()] {
+			continue
+		}
+		port, err := strconv.Atoi(tuple["dport"])
+		if err != nil {
+			continue
+		}
+		remotePort, _ := strconv.Atoi(tuple["sport"])
+		connections = append(connections, Connection{
+			Proto:      proto,
+			LocalIP:    dst.String(),
+			LocalPort:  port,
+			RemoteIP:   src.String(),
+			RemotePort: remotePort,
+		})
+	}
+	return connections, scanner.Err()
+}
@@ -0,0 +1,90 @@
+//go:build linux
+// +build linux
+
+package sys
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// socketEstablished is the state of a connected socket in /proc/net/tcp and
+// /proc/net/udp
+const socketEstablished = "01"
+
+// parseProcAddress parses an address of /proc/net/tcp, like "0100007F:01BB":
+// the IP as 32-bit words in the order of the host, then the port.
+func parseProcAddress(address string) (net.IP, int, error) {
+	host, port, ok := strings.Cut(address, ":")
+	if !ok {
+		return nil, 0, fmt.Errorf("invalid address %q", address)
+	}
+	ip, err := hex.DecodeString(host)
+	if err != nil || (len(ip) != net.IPv4len && len(ip) != net.IPv6len) {
+		return nil, 0, fmt.Errorf("invalid address %q", address)
+	}
+	for i := 0; i < len(ip); i += 4 {
+		ip[i], ip[i+1], ip[i+2], ip[i+3] = ip[i+3], ip[i+2], ip[i+1], ip[i]
+	}
+	portNum, err := strconv.ParseUint(port, 16, 16)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid address %q", address)
+	}
+	return net.IP(ip), int(portNum), nil
+}
+
+func readSockets(proto string, name string, connections []Connection) ([]Connection, error) {
+	file, err := os.Open(HostProc("net", name))
+	if os.IsNotExist(err) {
+		return connections, nil
+	} else if err != nil {
+		return connections, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	// The first line names the columns
+	scanner.Scan()
+	for scanner.Scan() {
+		// 0: 0100007F:01BB 0200007F:C822 01 ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[3] != socketEstablished {
+			continue
+		}
+		localIP, localPort, err := parseProcAddress(fields[1])
+		if err != nil {
+			continue
+		}
+		remoteIP, remotePort, err := parseProcAddress(fields[2])
+		if err != nil {
+			continue
+		}
+		connections = append(connections, Connection{
+			Proto:      proto,
+			LocalIP:    localIP.String(),
+			LocalPort:  localPort,
+			RemoteIP:   remoteIP.String(),
+			RemotePort: remotePort,
+		})
+	}
+	return connections, scanner.Err()
+}
+
+// GetSocketConnections returns the connected TCP and UDP sockets of the host,
+// from its socket tables. UDP is only seen on connected sockets, a server
+// answering its clients on a single socket shows none.
+func GetSocketConnections() ([]Connection, error) {
+	var connections []Connection
+	var err error
+	for _, table := range [][2]string{{"tcp", "tcp"}, {"tcp", "tcp6"}, {"udp", "udp"}, {"udp", "udp6"}} {
+		if connections, err = readSockets(table[0], table[1], connections); err != nil {
+			return nil, err
+		}
+	}
+	return connections, nil
+}
@@ -0,0 +1,42 @@
+//go:build !linux
+// +build !linux
+
+package sys
+
+import (
+	"github.com/shirou/gopsutil/v4/net"
+)
+
+// GetSocketConnections returns the established TCP and the connected UDP
+// sockets of the host.
+func GetSocketConnections() ([]Connection, error) {
+	stats, err := net.Connections("inet")
+	if err != nil {
+		return nil, err
+	}
+	var connections []Connection
+	for _, stat := range stats {
+		if stat.Raddr.IP == "" || stat.Raddr.Port == 0 {
+			continue
+		}
+		proto := "tcp"
+		switch stat.Type {
+		case 1: // SOCK_STREAM
+			if stat.Status != "ESTABLISHED" {
+				continue
+			}
+		case 2: // SOCK_DGRAM
+			proto = "udp"
+		default:
+			continue
+		}
+		connections = append(connections, Connection{
+			Proto:      proto,
+			LocalIP:    stat.Laddr.IP,
+			LocalPort:  int(stat.Laddr.Port),
+			RemoteIP:   stat.Raddr.IP,
+			RemotePort: int(stat.Raddr.Port),
+		})
+	}
+	return connections, nil
+}
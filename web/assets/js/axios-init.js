@@ -22,6 +22,13 @@ axios.interceptors.response.use(
             const statusCode = error.response.status;
             // Check the status code
             if (statusCode === 401) { // Unauthorized
+                // A session ended for a session limit goes to the login page,
+                // which tells why
+                const code = error.response.data && error.response.data.code;
+                if (code === 'session_idle_timeout' || code === 'session_lifetime_exceeded') {
+                    sessionStorage.setItem('sessionEnded', error.response.data.msg);
+                    return window.location.replace(basePath);
+                }
                 return window.location.reload();
             }
         }
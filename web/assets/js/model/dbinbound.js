@@ -7,11 +7,30 @@ class DBInbound {
         this.down = 0;
         this.total = 0;
         this.remark = "";
+        this.remarkTemplate = "";
+        this.subIncludeDisabled = "";
+        this.clientDefaults = null;
+        // The link options of the clients, edited as JSON
+        this.clientDefaultsText = "";
         this.enable = true;
         this.expiryTime = 0;
+        // The schedule that switches the inbound, and where it stands
+        this.schedule = null;
+        this.scheduleState = null;
+        // The dests a Reality inbound falls back to, and how their checks went
+        this.realityDests = null;
+        this.realityHealth = null;
+        // The limits of the clients, set by admins, and what the clients take of them
+        this.limits = null;
+        this.limitUsage = null;
+        // The limits of the connections of each source IP, set by admins
+        this.connLimits = null;
+        // Why Xray goes without the inbound, if it failed to bind its port
+        this.bindState = null;
 
         this.listen = "";
         this.port = 0;
+        this.portEnd = 0;
         this.protocol = "";
         this.settings = "";
         this.streamSettings = "";
@@ -22,6 +41,24 @@ class DBInbound {
             return;
         }
         ObjectUtil.cloneProps(this, data);
+        if (this.clientDefaults && !this.clientDefaultsText) {
+            this.clientDefaultsText = JSON.stringify(this.clientDefaults, null, 2);
+        }
+    }
+
+    // limitsReached tells whether the clients take all of a limit on their
+    // number or traffic, so no more can be added
+    get limitsReached() {
+        if (!this.limits || !this.limitUsage) {
+            return false;
+        }
+        const { maxClients, maxTotalAssignedGB } = this.limits;
+        return (maxClients > 0 && this.limitUsage.clients >= maxClients)
+            || (maxTotalAssignedGB > 0 && this.limitUsage.assignedGB >= maxTotalAssignedGB);
+    }
+
+    get portText() {
+        return this.portEnd > this.port ? `${this.port}-${this.portEnd}` : String(this.port);
     }
 
     get totalGB() {
@@ -105,6 +142,7 @@ class DBInbound {
 
         const config = {
             port: this.port,
+            portEnd: this.portEnd,
             listen: this.listen,
             protocol: this.protocol,
             settings: settings,
@@ -121,6 +159,7 @@ class DBInbound {
             case Protocols.VMESS:
             case Protocols.VLESS:
             case Protocols.TROJAN:
+            case Protocols.WIREGUARD:
                 return true;
             case Protocols.SHADOWSOCKS:
                 return this.toInbound().isSSMultiUser;
@@ -135,14 +174,15 @@ class DBInbound {
             case Protocols.VLESS:
             case Protocols.TROJAN:
             case Protocols.SHADOWSOCKS:
+            case Protocols.WIREGUARD:
                 return true;
             default:
                 return false;
         }
     }
 
-    genInboundLinks(remarkModel) {
+    genInboundLinks(remarkModel, remarkTemplate = '', clientPorts = false) {
         const inbound = this.toInbound();
-        return inbound.genInboundLinks(this.remark, remarkModel);
+        return inbound.genInboundLinks(this.remark, remarkModel, this.remarkTemplate || remarkTemplate, clientPorts);
     }
 }
\ No newline at end of file
@@ -74,7 +74,8 @@ const SNIFFING_OPTION = {
     HTTP: "http",
     TLS: "tls",
     QUIC: "quic",
-    FAKEDNS: "fakedns"
+    FAKEDNS: "fakedns",
+    "FAKEDNS+OTHERS": "fakedns+others",
 };
 
 const USAGE_OPTION = {
@@ -644,6 +645,7 @@ TlsStreamSettings.Cert = class extends XrayCommonClass {
         oneTimeLoading = false,
         usage = USAGE_OPTION.ENCIPHERMENT,
         buildChain = false,
+        acme = '',
     ) {
         super();
         this.useFile = useFile;
@@ -654,17 +656,19 @@ TlsStreamSettings.Cert = class extends XrayCommonClass {
         this.oneTimeLoading = oneTimeLoading;
         this.usage = usage;
         this.buildChain = buildChain
+        this.acme = acme;
     }
 
     static fromJson(json = {}) {
-        if ('certificateFile' in json && 'keyFile' in json) {
+        if (('certificateFile' in json && 'keyFile' in json) || 'acme' in json) {
             return new TlsStreamSettings.Cert(
                 true,
-                json.certificateFile,
-                json.keyFile, '', '',
+                json.certificateFile || '',
+                json.keyFile || '', '', '',
                 json.oneTimeLoading,
                 json.usage,
                 json.buildChain,
+                json.acme,
             );
         } else {
             return new TlsStreamSettings.Cert(
@@ -680,13 +684,19 @@ TlsStreamSettings.Cert = class extends XrayCommonClass {
 
     toJson() {
         if (this.useFile) {
-            return {
+            const json = {
                 certificateFile: this.certFile,
                 keyFile: this.keyFile,
                 oneTimeLoading: this.oneTimeLoading,
                 usage: this.usage,
                 buildChain: this.buildChain,
             };
+            // The panel puts the files of its ACME certificate in place of the
+            // reference when it writes the config of Xray
+            if (this.acme) {
+                json.acme = this.acme;
+            }
+            return json;
         } else {
             return {
                 certificate: this.cert.split('\n'),
@@ -1018,12 +1028,14 @@ class Sniffing extends XrayCommonClass {
         enabled = false,
         destOverride = ['http', 'tls', 'quic', 'fakedns'],
         metadataOnly = false,
-        routeOnly = false) {
+        routeOnly = false,
+        domainsExcluded = []) {
         super();
         this.enabled = enabled;
         this.destOverride = destOverride;
         this.metadataOnly = metadataOnly;
         this.routeOnly = routeOnly;
+        this.domainsExcluded = domainsExcluded;
     }
 
     static fromJson(json = {}) {
@@ -1038,6 +1050,7 @@ class Sniffing extends XrayCommonClass {
             destOverride,
             json.metadataOnly,
             json.routeOnly,
+            json.domainsExcluded,
         );
     }
 }
@@ -1074,9 +1087,11 @@ class Inbound extends XrayCommonClass {
         sniffing = new Sniffing(),
         allocate = new Allocate(),
         clientStats = '',
+        portEnd = 0,
     ) {
         super();
         this.port = port;
+        this.portEnd = portEnd;
         this.listen = listen;
         this._protocol = protocol;
         this.settings = ObjectUtil.isEmpty(settings) ? Inbound.Settings.getSettings(protocol) : settings;
@@ -1096,6 +1111,7 @@ class Inbound extends XrayCommonClass {
             case Protocols.VLESS: return this.settings.vlesses;
             case Protocols.TROJAN: return this.settings.trojans;
             case Protocols.SHADOWSOCKS: return this.isSSMultiUser ? this.settings.shadowsockses : null;
+            case Protocols.WIREGUARD: return this.settings.peers;
             default: return null;
         }
     }
@@ -1231,6 +1247,12 @@ class Inbound extends XrayCommonClass {
         return false;
     }
 
+    // clients whose flow doesn't work with the transport and security of the inbound
+    invalidFlowClients() {
+        if (this.protocol !== Protocols.VLESS || this.canEnableTlsFlow()) return [];
+        return this.settings.vlesses.filter(client => !ObjectUtil.isEmpty(client.flow));
+    }
+
     canEnableReality() {
         if (![Protocols.VLESS, Protocols.TROJAN].includes(this.protocol)) return false;
         return ["tcp", "http", "grpc", "xhttp"].includes(this.network);
@@ -1367,6 +1389,9 @@ class Inbound extends XrayCommonClass {
                 params.set("path", xhttp.path);
                 params.set("host", xhttp.host?.length > 0 ? xhttp.host : this.getHeader(xhttp, 'host'));
                 params.set("mode", xhttp.mode);
+                if (xhttp.xPaddingBytes) {
+                    params.set("extra", JSON.stringify({ xPaddingBytes: xhttp.xPaddingBytes }));
+                }
                 break;
         }
 
@@ -1472,6 +1497,9 @@ class Inbound extends XrayCommonClass {
                 params.set("path", xhttp.path);
                 params.set("host", xhttp.host?.length > 0 ? xhttp.host : this.getHeader(xhttp, 'host'));
                 params.set("mode", xhttp.mode);
+                if (xhttp.xPaddingBytes) {
+                    params.set("extra", JSON.stringify({ xPaddingBytes: xhttp.xPaddingBytes }));
+                }
                 break;
         }
 
@@ -1497,7 +1525,10 @@ class Inbound extends XrayCommonClass {
         if (this.isSS2022) password.push(settings.password);
         if (this.isSSMultiUser) password.push(clientPassword);
 
-        let link = `ss://${Base64.encode(`${settings.method}:${password.join(':')}`, true)}@${address}:${port}`;
+        // SIP002 puts the 2022 methods and their keys in the userinfo as they are, percent-encoded
+        let userInfo = Base64.encode(`${settings.method}:${password.join(':')}`, true);
+        if (this.isSS2022) userInfo = `${encodeURIComponent(settings.method)}:${encodeURIComponent(password.join(':'))}`;
+        let link = `ss://${userInfo}@${address}:${port}`;
         const url = new URL(link);
         for (const [key, value] of params) {
             url.searchParams.set(key, value)
@@ -1553,6 +1584,9 @@ class Inbound extends XrayCommonClass {
                 params.set("path", xhttp.path);
                 params.set("host", xhttp.host?.length > 0 ? xhttp.host : this.getHeader(xhttp, 'host'));
                 params.set("mode", xhttp.mode);
+                if (xhttp.xPaddingBytes) {
+                    params.set("extra", JSON.stringify({ xPaddingBytes: xhttp.xPaddingBytes }));
+                }
                 break;
         }
 
@@ -1604,10 +1638,11 @@ class Inbound extends XrayCommonClass {
         return url.toString();
     }
 
-    getWireguardLink(address, port, remark, peerId) {
+    getWireguardLink(address, port, remark, peer) {
+        if (!peer.privateKey || ObjectUtil.isArrEmpty(peer.allowedIPs)) return '';
         let txt = `[Interface]\n`
-        txt += `PrivateKey = ${this.settings.peers[peerId].privateKey}\n`
-        txt += `Address = ${this.settings.peers[peerId].allowedIPs[0]}\n`
+        txt += `PrivateKey = ${peer.privateKey}\n`
+        txt += `Address = ${peer.allowedIPs.join(', ')}\n`
         txt += `DNS = 1.1.1.1, 1.0.0.1\n`
         if (this.settings.mtu) {
             txt += `MTU = ${this.settings.mtu}\n`
@@ -1615,13 +1650,13 @@ class Inbound extends XrayCommonClass {
         txt += `\n# ${remark}\n`
         txt += `[Peer]\n`
         txt += `PublicKey = ${this.settings.pubKey}\n`
-        txt += `AllowedIPs = 0.0.0.0/0, ::/0\n`
-        txt += `Endpoint = ${address}:${port}`
-        if (this.settings.peers[peerId].psk) {
-            txt += `\nPresharedKey = ${this.settings.peers[peerId].psk}`
+        if (peer.psk) {
+            txt += `PresharedKey = ${peer.psk}\n`
         }
-        if (this.settings.peers[peerId].keepAlive) {
-            txt += `\nPersistentKeepalive = ${this.settings.peers[peerId].keepAlive}\n`
+        txt += `AllowedIPs = 0.0.0.0/0, ::/0\n`
+        txt += `Endpoint = ${address.includes(':') ? `[${address}]` : address}:${port}\n`
+        if (peer.keepAlive) {
+            txt += `PersistentKeepalive = ${peer.keepAlive}\n`
         }
         return txt;
     }
@@ -1636,15 +1671,82 @@ class Inbound extends XrayCommonClass {
                 return this.genSSLink(address, port, forceTls, remark, this.isSSMultiUser ? client.password : '');
             case Protocols.TROJAN:
                 return this.genTrojanLink(address, port, forceTls, remark, client.password);
+            case Protocols.WIREGUARD:
+                return this.getWireguardLink(address, port, remark, client);
             default: return '';
         }
     }
 
-    genAllLinks(remark = '', remarkModel = '-ieo', client) {
+    clientPort(email = '') {
+        if (!(this.portEnd > this.port)) return this.port;
+        // FNV-1a of the email, like the subscription server picks it
+        let hash = 0x811c9dc5;
+        for (const byte of new TextEncoder().encode(email)) {
+            hash = Math.imul(hash ^ byte, 0x01000193) >>> 0;
+        }
+        return this.port + hash % (this.portEnd - this.port + 1);
+    }
+
+    genTemplateRemark(remarkTemplate, remark = '', client, extra = '', port = this.port) {
+        const email = client ? client.email : '';
+        const stats = Array.isArray(this.clientStats) ? this.clientStats.find(s => s.email === email) : null;
+        // Links of clients without traffic yet take the limits of the client
+        const expiryTime = stats ? stats.expiryTime : (client?.expiryTime ?? 0);
+        const total = stats ? stats.total : (client?.totalGB ?? 0);
+        const used = stats ? stats.up + stats.down : 0;
+        let expiryDate = '∞';
+        if (expiryTime > 0) {
+            const date = new Date(expiryTime);
+            expiryDate = [date.getFullYear(), date.getMonth() + 1, date.getDate()]
+                .map(n => String(n).padStart(2, '0')).join('-');
+        } else if (expiryTime < 0) {
+            expiryDate = Math.floor(expiryTime / -86400000) + 'D';
+        }
+        const values = {
+            serverName: location.hostname,
+            inboundRemark: remark,
+            email: email,
+            protocol: this.protocol,
+            port: String(port),
+            proxyRemark: extra,
+            expiryDate: expiryDate,
+            trafficLeftGB: total > 0 ? (Math.max(total - used, 0) / SizeFormatter.ONE_GB).toFixed(2) : '∞',
+        };
+        return remarkTemplate.replace(/\{(\w+)\}/g, (_, name) => Object.hasOwn(values, name) ? values[name] : '').trim();
+    }
+
+    // Sets the SNI and the host the external proxy overrides in a link through it.
+    overrideProxyLink(link, ep) {
+        const sni = (ep.sni || '').trim();
+        const host = (ep.host || '').trim();
+        if (ObjectUtil.isEmpty(link) || (sni === '' && host === '')) {
+            return link;
+        }
+        if (link.startsWith('vmess://')) {
+            const obj = JSON.parse(Base64.decode(link.slice('vmess://'.length)));
+            if (sni !== '' && obj.tls === 'tls') obj.sni = sni;
+            if (host !== '' && 'host' in obj) obj.host = host;
+            else if (host !== '' && obj.net === 'grpc') obj.authority = host;
+            return 'vmess://' + Base64.encode(JSON.stringify(obj, null, 2));
+        }
+        const url = new URL(link);
+        const params = url.searchParams;
+        if (sni !== '' && ['tls', 'reality'].includes(params.get('security'))) {
+            params.set('sni', sni);
+        }
+        if (host !== '') {
+            const type = params.get('type');
+            if (type === 'grpc') params.set('authority', host);
+            else if (['ws', 'httpupgrade', 'xhttp'].includes(type) || params.has('host')) params.set('host', host);
+        }
+        return url.toString();
+    }
+
+    genAllLinks(remark = '', remarkModel = '-ieo', client, remarkTemplate = '', clientPorts = false) {
         let result = [];
         let email = client ? client.email : '';
         let addr = !ObjectUtil.isEmpty(this.listen) && this.listen !== "0.0.0.0" ? this.listen : location.hostname;
-        let port = this.port;
+        let port = clientPorts ? this.clientPort(email) : this.port;
         const separationChar = remarkModel.charAt(0);
         const orderChars = remarkModel.slice(1);
         let orders = {
@@ -1653,7 +1755,8 @@ class Inbound extends XrayCommonClass {
             'o': '',
         };
         if (ObjectUtil.isArrEmpty(this.stream.externalProxy)) {
-            let r = orderChars.split('').map(char => orders[char]).filter(x => x.length > 0).join(separationChar);
+            let r = remarkTemplate ? this.genTemplateRemark(remarkTemplate, remark, client, '', port) :
+                orderChars.split('').map(char => orders[char]).filter(x => x.length > 0).join(separationChar);
             result.push({
                 remark: r,
                 link: this.genLink(addr, port, 'same', r, client)
@@ -1661,35 +1764,29 @@ class Inbound extends XrayCommonClass {
         } else {
             this.stream.externalProxy.forEach((ep) => {
                 orders['o'] = ep.remark;
-                let r = orderChars.split('').map(char => orders[char]).filter(x => x.length > 0).join(separationChar);
+                let r = remarkTemplate ? this.genTemplateRemark(remarkTemplate, remark, client, ep.remark) :
+                    orderChars.split('').map(char => orders[char]).filter(x => x.length > 0).join(separationChar);
                 result.push({
                     remark: r,
-                    link: this.genLink(ep.dest, ep.port, ep.forceTls, r, client)
+                    link: this.overrideProxyLink(this.genLink(ep.dest, ep.port, ep.forceTls, r, client), ep)
                 });
             });
         }
         return result;
     }
 
-    genInboundLinks(remark = '', remarkModel = '-ieo') {
+    genInboundLinks(remark = '', remarkModel = '-ieo', remarkTemplate = '', clientPorts = false) {
         let addr = !ObjectUtil.isEmpty(this.listen) && this.listen !== "0.0.0.0" ? this.listen : location.hostname;
         if (this.clients) {
             let links = [];
             this.clients.forEach((client) => {
-                this.genAllLinks(remark, remarkModel, client).forEach(l => {
+                this.genAllLinks(remark, remarkModel, client, remarkTemplate, clientPorts).forEach(l => {
                     links.push(l.link);
                 })
             });
             return links.join('\r\n');
         } else {
             if (this.protocol == Protocols.SHADOWSOCKS && !this.isSSMultiUser) return this.genSSLink(addr, this.port, 'same', remark);
-            if (this.protocol == Protocols.WIREGUARD) {
-                let links = [];
-                this.settings.peers.forEach((p, index) => {
-                    links.push(this.getWireguardLink(addr, this.port, remark + remarkModel.charAt(0) + (index + 1), index));
-                });
-                return links.join('\r\n');
-            }
             return '';
         }
     }
@@ -1704,7 +1801,8 @@ class Inbound extends XrayCommonClass {
             json.tag,
             Sniffing.fromJson(json.sniffing),
             Allocate.fromJson(json.allocate),
-            json.clientStats
+            json.clientStats,
+            json.portEnd,
         )
     }
 
@@ -1722,7 +1820,8 @@ class Inbound extends XrayCommonClass {
             tag: this.tag,
             sniffing: this.sniffing.toJson(),
             allocate: this.allocate.toJson(),
-            clientStats: this.clientStats
+            clientStats: this.clientStats,
+            portEnd: this.portEnd,
         };
     }
 }
@@ -1817,7 +1916,17 @@ Inbound.VmessSettings.VMESS = class extends XrayCommonClass {
         tgId = '',
         subId = RandomUtil.randomLowerAndNum(16),
         comment = '',
-        reset = 0
+        reset = 0,
+        tags = [],
+        resetPolicy = 'none',
+        resetDay = 0,
+        carryOver = false,
+        carryCapGB = 0,
+        excludeFromSub = false,
+        subUpdates = 0,
+        subAggregate = false,
+        outboundTag = '',
+        linkOptions = null
     ) {
         super();
         this.id = id;
@@ -1831,6 +1940,16 @@ Inbound.VmessSettings.VMESS = class extends XrayCommonClass {
         this.subId = subId;
         this.comment = comment;
         this.reset = reset;
+        this.tags = Array.isArray(tags) ? tags : [];
+        this.resetPolicy = resetPolicy;
+        this.resetDay = resetDay;
+        this.carryOver = carryOver;
+        this.carryCapGB = carryCapGB;
+        this.excludeFromSub = excludeFromSub;
+        this.subUpdates = subUpdates;
+        this.subAggregate = subAggregate;
+        this.outboundTag = outboundTag;
+        this.linkOptions = linkOptions;
     }
 
     static fromJson(json = {}) {
@@ -1846,6 +1965,16 @@ Inbound.VmessSettings.VMESS = class extends XrayCommonClass {
             json.subId,
             json.comment,
             json.reset,
+            json.tags,
+            json.resetPolicy,
+            json.resetDay,
+            json.carryOver,
+            json.carryCapGB,
+            json.excludeFromSub,
+            json.subUpdates,
+            json.subAggregate,
+            json.outboundTag,
+            json.linkOptions,
         );
     }
     get _expiryTime() {
@@ -1873,6 +2002,14 @@ Inbound.VmessSettings.VMESS = class extends XrayCommonClass {
         this.totalGB = NumberFormatter.toFixed(gb * SizeFormatter.ONE_GB, 0);
     }
 
+    get _carryCapGB() {
+        return NumberFormatter.toFixed(this.carryCapGB / SizeFormatter.ONE_GB, 2);
+    }
+
+    set _carryCapGB(gb) {
+        this.carryCapGB = NumberFormatter.toFixed(gb * SizeFormatter.ONE_GB, 0);
+    }
+
 };
 
 Inbound.VLESSSettings = class extends Inbound.Settings {
@@ -1926,7 +2063,17 @@ Inbound.VLESSSettings.VLESS = class extends XrayCommonClass {
         tgId = '',
         subId = RandomUtil.randomLowerAndNum(16),
         comment = '',
-        reset = 0
+        reset = 0,
+        tags = [],
+        resetPolicy = 'none',
+        resetDay = 0,
+        carryOver = false,
+        carryCapGB = 0,
+        excludeFromSub = false,
+        subUpdates = 0,
+        subAggregate = false,
+        outboundTag = '',
+        linkOptions = null
     ) {
         super();
         this.id = id;
@@ -1940,6 +2087,16 @@ Inbound.VLESSSettings.VLESS = class extends XrayCommonClass {
         this.subId = subId;
         this.comment = comment;
         this.reset = reset;
+        this.tags = Array.isArray(tags) ? tags : [];
+        this.resetPolicy = resetPolicy;
+        this.resetDay = resetDay;
+        this.carryOver = carryOver;
+        this.carryCapGB = carryCapGB;
+        this.excludeFromSub = excludeFromSub;
+        this.subUpdates = subUpdates;
+        this.subAggregate = subAggregate;
+        this.outboundTag = outboundTag;
+        this.linkOptions = linkOptions;
     }
 
     static fromJson(json = {}) {
@@ -1955,6 +2112,16 @@ Inbound.VLESSSettings.VLESS = class extends XrayCommonClass {
             json.subId,
             json.comment,
             json.reset,
+            json.tags,
+            json.resetPolicy,
+            json.resetDay,
+            json.carryOver,
+            json.carryCapGB,
+            json.excludeFromSub,
+            json.subUpdates,
+            json.subAggregate,
+            json.outboundTag,
+            json.linkOptions,
         );
     }
 
@@ -1982,6 +2149,14 @@ Inbound.VLESSSettings.VLESS = class extends XrayCommonClass {
     set _totalGB(gb) {
         this.totalGB = NumberFormatter.toFixed(gb * SizeFormatter.ONE_GB, 0);
     }
+
+    get _carryCapGB() {
+        return NumberFormatter.toFixed(this.carryCapGB / SizeFormatter.ONE_GB, 2);
+    }
+
+    set _carryCapGB(gb) {
+        this.carryCapGB = NumberFormatter.toFixed(gb * SizeFormatter.ONE_GB, 0);
+    }
 };
 Inbound.VLESSSettings.Fallback = class extends XrayCommonClass {
     constructor(name = "", alpn = '', path = '', dest = '', xver = 0) {
@@ -2065,7 +2240,17 @@ Inbound.TrojanSettings.Trojan = class extends XrayCommonClass {
         tgId = '',
         subId = RandomUtil.randomLowerAndNum(16),
         comment = '',
-        reset = 0
+        reset = 0,
+        tags = [],
+        resetPolicy = 'none',
+        resetDay = 0,
+        carryOver = false,
+        carryCapGB = 0,
+        excludeFromSub = false,
+        subUpdates = 0,
+        subAggregate = false,
+        outboundTag = '',
+        linkOptions = null
     ) {
         super();
         this.password = password;
@@ -2078,6 +2263,16 @@ Inbound.TrojanSettings.Trojan = class extends XrayCommonClass {
         this.subId = subId;
         this.comment = comment;
         this.reset = reset;
+        this.tags = Array.isArray(tags) ? tags : [];
+        this.resetPolicy = resetPolicy;
+        this.resetDay = resetDay;
+        this.carryOver = carryOver;
+        this.carryCapGB = carryCapGB;
+        this.excludeFromSub = excludeFromSub;
+        this.subUpdates = subUpdates;
+        this.subAggregate = subAggregate;
+        this.outboundTag = outboundTag;
+        this.linkOptions = linkOptions;
     }
 
     toJson() {
@@ -2092,6 +2287,14 @@ Inbound.TrojanSettings.Trojan = class extends XrayCommonClass {
             subId: this.subId,
             comment: this.comment,
             reset: this.reset,
+            tags: this.tags,
+            resetPolicy: this.resetPolicy,
+            resetDay: this.resetDay,
+            excludeFromSub: this.excludeFromSub,
+            subUpdates: this.subUpdates,
+            subAggregate: this.subAggregate,
+            outboundTag: this.outboundTag,
+            linkOptions: this.linkOptions,
         };
     }
 
@@ -2107,6 +2310,16 @@ Inbound.TrojanSettings.Trojan = class extends XrayCommonClass {
             json.subId,
             json.comment,
             json.reset,
+            json.tags,
+            json.resetPolicy,
+            json.resetDay,
+            json.carryOver,
+            json.carryCapGB,
+            json.excludeFromSub,
+            json.subUpdates,
+            json.subAggregate,
+            json.outboundTag,
+            json.linkOptions,
         );
     }
 
@@ -2135,6 +2348,14 @@ Inbound.TrojanSettings.Trojan = class extends XrayCommonClass {
         this.totalGB = NumberFormatter.toFixed(gb * SizeFormatter.ONE_GB, 0);
     }
 
+    get _carryCapGB() {
+        return NumberFormatter.toFixed(this.carryCapGB / SizeFormatter.ONE_GB, 2);
+    }
+
+    set _carryCapGB(gb) {
+        this.carryCapGB = NumberFormatter.toFixed(gb * SizeFormatter.ONE_GB, 0);
+    }
+
 };
 
 Inbound.TrojanSettings.Fallback = class extends XrayCommonClass {
@@ -2226,7 +2447,17 @@ Inbound.ShadowsocksSettings.Shadowsocks = class extends XrayCommonClass {
         tgId = '',
         subId = RandomUtil.randomLowerAndNum(16),
         comment = '',
-        reset = 0
+        reset = 0,
+        tags = [],
+        resetPolicy = 'none',
+        resetDay = 0,
+        carryOver = false,
+        carryCapGB = 0,
+        excludeFromSub = false,
+        subUpdates = 0,
+        subAggregate = false,
+        outboundTag = '',
+        linkOptions = null
     ) {
         super();
         this.method = method;
@@ -2240,6 +2471,16 @@ Inbound.ShadowsocksSettings.Shadowsocks = class extends XrayCommonClass {
         this.subId = subId;
         this.comment = comment;
         this.reset = reset;
+        this.tags = Array.isArray(tags) ? tags : [];
+        this.resetPolicy = resetPolicy;
+        this.resetDay = resetDay;
+        this.carryOver = carryOver;
+        this.carryCapGB = carryCapGB;
+        this.excludeFromSub = excludeFromSub;
+        this.subUpdates = subUpdates;
+        this.subAggregate = subAggregate;
+        this.outboundTag = outboundTag;
+        this.linkOptions = linkOptions;
     }
 
     toJson() {
@@ -2255,6 +2496,14 @@ Inbound.ShadowsocksSettings.Shadowsocks = class extends XrayCommonClass {
             subId: this.subId,
             comment: this.comment,
             reset: this.reset,
+            tags: this.tags,
+            resetPolicy: this.resetPolicy,
+            resetDay: this.resetDay,
+            excludeFromSub: this.excludeFromSub,
+            subUpdates: this.subUpdates,
+            subAggregate: this.subAggregate,
+            outboundTag: this.outboundTag,
+            linkOptions: this.linkOptions,
         };
     }
 
@@ -2271,6 +2520,16 @@ Inbound.ShadowsocksSettings.Shadowsocks = class extends XrayCommonClass {
             json.subId,
             json.comment,
             json.reset,
+            json.tags,
+            json.resetPolicy,
+            json.resetDay,
+            json.carryOver,
+            json.carryCapGB,
+            json.excludeFromSub,
+            json.subUpdates,
+            json.subAggregate,
+            json.outboundTag,
+            json.linkOptions,
         );
     }
 
@@ -2299,6 +2558,14 @@ Inbound.ShadowsocksSettings.Shadowsocks = class extends XrayCommonClass {
         this.totalGB = NumberFormatter.toFixed(gb * SizeFormatter.ONE_GB, 0);
     }
 
+    get _carryCapGB() {
+        return NumberFormatter.toFixed(this.carryCapGB / SizeFormatter.ONE_GB, 2);
+    }
+
+    set _carryCapGB(gb) {
+        this.carryCapGB = NumberFormatter.toFixed(gb * SizeFormatter.ONE_GB, 0);
+    }
+
 };
 
 Inbound.DokodemoSettings = class extends Inbound.Settings {
@@ -2447,7 +2714,8 @@ Inbound.WireguardSettings = class extends XrayCommonClass {
         mtu = 1420,
         secretKey = Wireguard.generateKeypair().privateKey,
         peers = [new Inbound.WireguardSettings.Peer()],
-        noKernelTun = false
+        noKernelTun = false,
+        subnet = '10.0.0.0/24',
     ) {
         super(protocol);
         this.mtu = mtu;
@@ -2455,10 +2723,11 @@ Inbound.WireguardSettings = class extends XrayCommonClass {
         this.pubKey = secretKey.length > 0 ? Wireguard.generateKeypair(secretKey).publicKey : '';
         this.peers = peers;
         this.noKernelTun = noKernelTun;
+        this.subnet = subnet;
     }
 
     addPeer() {
-        this.peers.push(new Inbound.WireguardSettings.Peer(null, null, '', ['10.0.0.' + (this.peers.length + 2)]));
+        this.peers.push(new Inbound.WireguardSettings.Peer());
     }
 
     delPeer(index) {
@@ -2466,12 +2735,15 @@ Inbound.WireguardSettings = class extends XrayCommonClass {
     }
 
     static fromJson(json = {}) {
+        // The peers are clients of the panel, older settings only have peers
+        const peers = json.clients ?? json.peers ?? [];
         return new Inbound.WireguardSettings(
             Protocols.WIREGUARD,
             json.mtu,
             json.secretKey,
-            json.peers.map(peer => Inbound.WireguardSettings.Peer.fromJson(peer)),
+            peers.map(peer => Inbound.WireguardSettings.Peer.fromJson(peer)),
             json.noKernelTun,
+            json.subnet,
         );
     }
 
@@ -2479,26 +2751,70 @@ Inbound.WireguardSettings = class extends XrayCommonClass {
         return {
             mtu: this.mtu ?? undefined,
             secretKey: this.secretKey,
-            peers: Inbound.WireguardSettings.Peer.toJsonArray(this.peers),
+            subnet: this.subnet,
+            clients: Inbound.WireguardSettings.Peer.toJsonArray(this.peers),
             noKernelTun: this.noKernelTun,
         };
     }
 };
 
 Inbound.WireguardSettings.Peer = class extends XrayCommonClass {
-    constructor(privateKey, publicKey, psk = '', allowedIPs = ['10.0.0.2/32'], keepAlive = 0) {
+    constructor(
+        privateKey,
+        publicKey,
+        psk = '',
+        allowedIPs = [],
+        keepAlive = 0,
+        email = RandomUtil.randomLowerAndNum(8),
+        limitIp = 0,
+        totalGB = 0,
+        expiryTime = 0,
+        enable = true,
+        tgId = '',
+        subId = RandomUtil.randomLowerAndNum(16),
+        comment = '',
+        reset = 0,
+        tags = [],
+        resetPolicy = 'none',
+        resetDay = 0,
+        carryOver = false,
+        carryCapGB = 0,
+        excludeFromSub = false,
+        subUpdates = 0,
+        subAggregate = false,
+        linkOptions = null
+    ) {
         super();
         this.privateKey = privateKey
         this.publicKey = publicKey;
-        if (!this.publicKey) {
+        if (!this.publicKey && !this.privateKey) {
             [this.publicKey, this.privateKey] = Object.values(Wireguard.generateKeypair())
         }
-        this.psk = psk;
+        this.psk = psk ?? '';
+        allowedIPs = Array.isArray(allowedIPs) ? allowedIPs : [];
         allowedIPs.forEach((a, index) => {
-            if (a.length > 0 && !a.includes('/')) allowedIPs[index] += '/32';
+            if (a.length > 0 && !a.includes('/')) allowedIPs[index] += a.includes(':') ? '/128' : '/32';
         })
         this.allowedIPs = allowedIPs;
         this.keepAlive = keepAlive;
+        this.email = email;
+        this.limitIp = limitIp;
+        this.totalGB = totalGB;
+        this.expiryTime = expiryTime;
+        this.enable = enable;
+        this.tgId = tgId;
+        this.subId = subId;
+        this.comment = comment;
+        this.reset = reset;
+        this.tags = Array.isArray(tags) ? tags : [];
+        this.resetPolicy = resetPolicy;
+        this.resetDay = resetDay;
+        this.carryOver = carryOver;
+        this.carryCapGB = carryCapGB;
+        this.excludeFromSub = excludeFromSub;
+        this.subUpdates = subUpdates;
+        this.subAggregate = subAggregate;
+        this.linkOptions = linkOptions;
     }
 
     static fromJson(json = {}) {
@@ -2507,20 +2823,86 @@ Inbound.WireguardSettings.Peer = class extends XrayCommonClass {
             json.publicKey,
             json.preSharedKey,
             json.allowedIPs,
-            json.keepAlive
+            json.keepAlive,
+            json.email,
+            json.limitIp,
+            json.totalGB,
+            json.expiryTime,
+            json.enable,
+            json.tgId,
+            json.subId,
+            json.comment,
+            json.reset,
+            json.tags,
+            json.resetPolicy,
+            json.resetDay,
+            json.carryOver,
+            json.carryCapGB,
+            json.excludeFromSub,
+            json.subUpdates,
+            json.subAggregate,
+            json.linkOptions,
         );
     }
 
     toJson() {
-        this.allowedIPs.forEach((a, index) => {
-            if (a.length > 0 && !a.includes('/')) this.allowedIPs[index] += '/32';
-        });
+        // The server gives the peers without an address the next free one
+        const allowedIPs = this.allowedIPs.filter(a => a.length > 0).map(a => a.includes('/') ? a : a + (a.includes(':') ? '/128' : '/32'));
         return {
             privateKey: this.privateKey,
             publicKey: this.publicKey,
             preSharedKey: this.psk.length > 0 ? this.psk : undefined,
-            allowedIPs: this.allowedIPs,
-            keepAlive: this.keepAlive ?? undefined,
+            allowedIPs: allowedIPs.length > 0 ? allowedIPs : undefined,
+            keepAlive: this.keepAlive || undefined,
+            email: this.email,
+            limitIp: this.limitIp,
+            totalGB: this.totalGB,
+            expiryTime: this.expiryTime,
+            enable: this.enable,
+            tgId: this.tgId,
+            subId: this.subId,
+            comment: this.comment,
+            reset: this.reset,
+            tags: this.tags,
+            resetPolicy: this.resetPolicy,
+            resetDay: this.resetDay,
+            excludeFromSub: this.excludeFromSub,
+            subUpdates: this.subUpdates,
+            subAggregate: this.subAggregate,
+            linkOptions: this.linkOptions,
         };
     }
+
+    get _expiryTime() {
+        if (this.expiryTime === 0 || this.expiryTime === "") {
+            return null;
+        }
+        if (this.expiryTime < 0) {
+            return this.expiryTime / -86400000;
+        }
+        return moment(this.expiryTime);
+    }
+
+    set _expiryTime(t) {
+        if (t == null || t === "") {
+            this.expiryTime = 0;
+        } else {
+            this.expiryTime = t.valueOf();
+        }
+    }
+    get _totalGB() {
+        return NumberFormatter.toFixed(this.totalGB / SizeFormatter.ONE_GB, 2);
+    }
+
+    set _totalGB(gb) {
+        this.totalGB = NumberFormatter.toFixed(gb * SizeFormatter.ONE_GB, 0);
+    }
+
+    get _carryCapGB() {
+        return NumberFormatter.toFixed(this.carryCapGB / SizeFormatter.ONE_GB, 2);
+    }
+
+    set _carryCapGB(gb) {
+        this.carryCapGB = NumberFormatter.toFixed(gb * SizeFormatter.ONE_GB, 0);
+    }
 };
@@ -6,8 +6,15 @@ class AllSetting {
         this.webPort = 2053;
         this.webCertFile = "";
         this.webKeyFile = "";
+        this.webCertAcme = "";
         this.webBasePath = "/";
         this.sessionMaxAge = 360;
+        this.rememberSessionMaxAge = 15;
+        this.rememberMaxAge = 30;
+        this.sessionIdleTimeout = 0;
+        this.sessionLifetime = 0;
+        this.sessionMaxConcurrent = 0;
+        this.sessionLimitPolicy = "evict";
         this.pageSize = 50;
         this.expireDiff = 0;
         this.trafficDiff = 0;
@@ -21,10 +28,9 @@ class AllSetting {
         this.tgRunTime = "@daily";
         this.tgBotBackup = false;
         this.tgBotLoginNotify = true;
+        this.tgBotPanicNotify = true;
         this.tgCpu = 80;
         this.tgLang = "en-US";
-        this.twoFactorEnable = false;
-        this.twoFactorToken = "";
         this.xrayTemplateConfig = "";
         this.subEnable = false;
         this.subTitle = "";
@@ -36,6 +42,7 @@ class AllSetting {
         this.externalTrafficInformEnable = false;
         this.externalTrafficInformURI = "";
         this.subCertFile = "";
+        this.subCertAcme = "";
         this.subKeyFile = "";
         this.subUpdates = 12;
         this.subEncrypt = true;
@@ -46,6 +53,202 @@ class AllSetting {
         this.subJsonNoises = "";
         this.subJsonMux = "";
         this.subJsonRules = "";
+        this.logFormat = "text";
+        this.accessLogEnable = false;
+        this.accessLogMaxSize = 10;
+        this.accessLogMaxBackups = 5;
+        this.accessLogMaxAge = 30;
+        this.accessLogExclude = "assets/";
+        this.accessLogPath = "";
+        this.authLogPath = "";
+        this.appLogLevel = "info";
+        this.slowRequestThreshold = 1000;
+        this.slowRequestRoutes = "";
+        this.panicBodyCaptureKB = 0;
+        this.metricsEnable = false;
+        this.metricsToken = "";
+        this.metricsAllowIPs = "";
+        this.metricsClientLabels = false;
+        this.loginRateLimit = 10;
+        this.loginRateBurst = 5;
+        this.lockoutThreshold = 5;
+        this.lockoutWindow = 15;
+        this.lockoutDuration = 30;
+        this.loginCaptcha = "off";
+        this.loginCaptchaFailures = 3;
+        this.loginCaptchaGlobalRate = 0;
+        this.turnstileSiteKey = "";
+        this.turnstileSecret = "";
+        this.webAuthnMode = "passwordless";
+        this.auditRetentionDays = 90;
+        this.passwordHashMemory = 65536;
+        this.passwordHashIterations = 3;
+        this.trustedProxies = "";
+        this.trustedProxyHeader = "X-Forwarded-For";
+        this.corsAllowedOrigins = "";
+        this.corsAllowedMethods = "GET, POST, PUT, DELETE";
+        this.corsAllowedHeaders = "Authorization, Content-Type";
+        this.corsAllowCredentials = false;
+        this.corsMaxAge = 600;
+        this.securityHsts = true;
+        this.securityNoSniff = true;
+        this.securityReferrerPolicy = "strict-origin-when-cross-origin";
+        this.securityFrameOptions = "SAMEORIGIN";
+        this.securityCsp = "default-src 'self'; script-src 'self' 'unsafe-inline' 'unsafe-eval'; style-src 'self' 'unsafe-inline'; img-src 'self' data: blob:; font-src 'self' data:; connect-src 'self'; object-src 'none'; base-uri 'self'; form-action 'self'";
+        this.securityCspScriptSrc = "";
+        this.securityCspStyleSrc = "";
+        this.subSecurityHeaders = true;
+        this.compressionEnable = true;
+        this.compressionMinSize = 1024;
+        this.compressionTypes = "application/json, application/javascript, application/yaml, application/x-yaml, text/";
+        this.shutdownTimeout = 10;
+        this.xrayKeepOnRestart = false;
+        this.healthzEnable = true;
+        this.socketMode = "0660";
+        this.socketOwner = "";
+        this.maxBodySize = 2;
+        this.maxBodySizeRestore = 128;
+        this.maxBodySizeImport = 16;
+        this.bulkClientsMax = 500;
+        this.trafficResetHistory = true;
+        this.subIncludeDisabled = true;
+        this.clientCleanupDays = 0;
+        this.notifyTrafficPercents = "";
+        this.notifyExpiryDays = "";
+        this.ipLimitWindow = 5;
+        this.ipLimitCooldown = 30;
+        this.ipLimitIpv6Prefix = 64;
+        this.ipLimitDevices = 0;
+        this.remarkTemplate = "";
+        this.randomPortMin = 10000;
+        this.randomPortMax = 60000;
+        this.portRangeClientPort = false;
+        this.observatoryMode = "observatory";
+        this.observatoryProbeUrl = "https://www.google.com/generate_204";
+        this.observatoryProbeInterval = 60;
+        this.xrayDownloadProxy = "";
+        this.xrayKeptVersions = 3;
+        this.geodataAutoUpdate = false;
+        this.geodataUpdateCron = "@daily";
+        this.geoipURL = "https://github.com/Loyalsoldier/v2ray-rules-dat/releases/latest/download/geoip.dat";
+        this.geositeURL = "https://github.com/Loyalsoldier/v2ray-rules-dat/releases/latest/download/geosite.dat";
+        this.tgBotGeodataNotify = true;
+        this.xrayHealthCheckWindow = 10;
+        this.xrayMaxRestartAttempts = 5;
+        this.xrayStableMinutes = 5;
+        this.xrayCrashOutputKB = 16;
+        this.tgBotXrayRestartNotify = true;
+        this.xrayApiUpdates = true;
+        this.xrayBinaryPath = "";
+        this.xrayAssetDir = "";
+        this.xrayWorkDir = "";
+        this.xrayArgs = "";
+        this.realityCheckInterval = 10;
+        this.realityCheckFailures = 3;
+        this.inboundCheckInterval = 0;
+        this.inboundCheckTimeout = 5;
+        this.inboundCheckProberUrl = "";
+        this.inboundCheckProberToken = "";
+        this.inboundCheckHost = "";
+        this.onlineWindow = 60;
+        this.clientInactiveDays = 0;
+        this.clientCleanupInactive = false;
+        this.clientInactiveReport = false;
+        this.connectionSampleInterval = 30;
+        this.connectionMethod = "sockets";
+        this.connBlockCommand = "";
+        this.connUnblockCommand = "";
+        this.connBlockMinutes = 10;
+        this.trafficHistoryDays = 90;
+        this.trafficFlushInterval = 30;
+        this.dbJournalMode = "WAL";
+        this.dbSynchronous = "NORMAL";
+        this.dbBusyTimeout = 5000;
+        this.dbMaxConnections = 8;
+        this.dbAutoOptimize = true;
+        this.dbOptimizeCron = "0 0 4 * * 0";
+        this.tgBotDbOptimizeNotify = true;
+        this.trashRetentionDays = 30;
+        this.backupEnable = false;
+        this.backupCron = "0 0 3 * * *";
+        this.backupDir = "";
+        this.backupKeep = 7;
+        this.backupIncludeFiles = false;
+        this.backupPassphrase = "";
+        this.backupWebhookUrl = "";
+        this.tgBotBackupUploadNotify = true;
+        this.tgBotBackupCron = "";
+        this.tgBotBackupLarge = "split";
+        this.tgBotLoginNotifyFailed = true;
+        this.tgBotLoginNotifyApi = true;
+        this.tgBotLoginNotifyInterval = 10;
+        this.tgBotSelfService = true;
+        this.notifyExpiryCron = "0 0 10 * * *";
+        this.notifyRenewalContact = "";
+        this.tgBotParseMode = "HTML";
+        this.tgTemplateLogin = "";
+        this.tgTemplateTraffic = "";
+        this.tgTemplateExpiry = "";
+        this.tgTemplateBackup = "";
+        this.tgTemplateClient = "";
+        this.alertChannels = "{}";
+        this.smtpHost = "";
+        this.smtpPort = 587;
+        this.smtpSecurity = "starttls";
+        this.smtpUsername = "";
+        this.smtpPassword = "";
+        this.smtpFrom = "";
+        this.smtpTo = "";
+        this.alertEmailSubject = "[{{.ServerName}}] {{.Title}}";
+        this.alertEmailBody = "";
+        this.alertWebhookUrl = "";
+        this.alertWebhookSecret = "";
+        this.subClashRules = "- IP-CIDR,127.0.0.0/8,DIRECT,no-resolve\n- IP-CIDR,10.0.0.0/8,DIRECT,no-resolve\n- IP-CIDR,172.16.0.0/12,DIRECT,no-resolve\n- IP-CIDR,192.168.0.0/16,DIRECT,no-resolve\n- MATCH,PROXY\n";
+        this.subSingboxVersion = "1.11";
+        this.subSingboxDns = "";
+        this.subSingboxRoute = "";
+        this.subExpiredNotice = "";
+        this.subCache = true;
+        this.subCacheGranularity = 10;
+        this.subAccessDays = 30;
+        this.subAccessMaxIps = 0;
+        this.webEnable = true;
+        this.subBasePath = "/";
+        this.subUseWebCert = false;
+        this.subPage = true;
+        this.subPageTitle = "";
+        this.subPageLogo = "";
+        this.subPageSupport = "";
+        this.subRemotes = "";
+        this.subRemoteTimeout = 5;
+        this.subRemoteTTL = 300;
+        this.statusPage = false;
+        this.statusPagePath = "/status/";
+        this.statusPageTitle = "";
+        this.statusPageInbounds = "";
+        this.statusPageFields = "state,latency";
+        this.statusPageTTL = 60;
+        this.statusPageCapacity = 100;
+        this.trialInbound = 0;
+        this.trialPath = "";
+        this.trialTotalGB = 1;
+        this.trialHours = 24;
+        this.trialIpDaily = 1;
+        this.trialDaily = 20;
+        this.trialCaptcha = "off";
+        this.trialTelegram = false;
+        this.trialCooldown = 24;
+        this.trialCleanupHours = 24;
+        this.statusSampleInterval = 2;
+        this.statusHistoryDays = 7;
+        this.bandwidthSource = "interface";
+        this.bandwidthMonthlyLimit = 0;
+        this.bandwidthDailyLimit = 0;
+        this.bandwidthResetDay = 1;
+        this.bandwidthAlertPercents = "80,90";
+        this.bandwidthAction = "alert";
+        this.geoStatsDatabase = "";
+        this.geoStatsDays = 90;
 
         this.timeLocation = "Local";
 
@@ -37,7 +37,7 @@ class HttpUtil {
             return msg;
         } catch (error) {
             console.error('GET request failed:', error);
-            const errorMsg = new Msg(false, error.response?.data?.message || error.message || 'Request failed');
+            const errorMsg = new Msg(false, error.response?.data?.msg || error.response?.data?.message || error.message || 'Request failed');
             this._handleMsg(errorMsg);
             return errorMsg;
         }
@@ -51,7 +51,21 @@ class HttpUtil {
             return msg;
         } catch (error) {
             console.error('POST request failed:', error);
-            const errorMsg = new Msg(false, error.response?.data?.message || error.message || 'Request failed');
+            const errorMsg = new Msg(false, error.response?.data?.msg || error.response?.data?.message || error.message || 'Request failed');
+            this._handleMsg(errorMsg);
+            return errorMsg;
+        }
+    }
+
+    static async delete(url, options = {}) {
+        try {
+            const resp = await axios.delete(url, options);
+            const msg = this._respToMsg(resp);
+            this._handleMsg(msg);
+            return msg;
+        } catch (error) {
+            console.error('DELETE request failed:', error);
+            const errorMsg = new Msg(false, error.response?.data?.msg || error.response?.data?.message || error.message || 'Request failed');
             this._handleMsg(errorMsg);
             return errorMsg;
         }
@@ -884,4 +898,65 @@ class FileManager {
 
         link.remove();
     }
-}
\ No newline at end of file
+}
+class WebAuthnUtil {
+    static isSupported() {
+        return window.isSecureContext && !!window.PublicKeyCredential && !!navigator.credentials;
+    }
+
+    static toBuffer(value) {
+        const base64 = value.replace(/-/g, '+').replace(/_/g, '/');
+        const padded = base64 + '='.repeat((4 - base64.length % 4) % 4);
+        return Uint8Array.from(window.atob(padded), c => c.charCodeAt(0)).buffer;
+    }
+
+    static fromBuffer(buffer) {
+        const bytes = new Uint8Array(buffer);
+        let binary = '';
+        bytes.forEach(b => binary += String.fromCharCode(b));
+        return window.btoa(binary).replace(/\+/g, '-').replace(/\//g, '_').replace(/=/g, '');
+    }
+
+    // create runs navigator.credentials.create with the options returned by the
+    // server and returns the credential in the JSON form the server expects
+    static async create(options) {
+        const publicKey = { ...options.publicKey };
+        publicKey.challenge = this.toBuffer(publicKey.challenge);
+        publicKey.user = { ...publicKey.user, id: this.toBuffer(publicKey.user.id) };
+        publicKey.excludeCredentials = (publicKey.excludeCredentials || [])
+            .map(c => ({ ...c, id: this.toBuffer(c.id) }));
+
+        const credential = await navigator.credentials.create({ publicKey });
+        return {
+            id: credential.id,
+            rawId: this.fromBuffer(credential.rawId),
+            type: credential.type,
+            response: {
+                clientDataJSON: this.fromBuffer(credential.response.clientDataJSON),
+                attestationObject: this.fromBuffer(credential.response.attestationObject),
+                transports: credential.response.getTransports ? credential.response.getTransports() : [],
+            },
+        };
+    }
+
+    // get runs navigator.credentials.get with the options returned by the server
+    static async get(options) {
+        const publicKey = { ...options.publicKey };
+        publicKey.challenge = this.toBuffer(publicKey.challenge);
+        publicKey.allowCredentials = (publicKey.allowCredentials || [])
+            .map(c => ({ ...c, id: this.toBuffer(c.id) }));
+
+        const credential = await navigator.credentials.get({ publicKey });
+        return {
+            id: credential.id,
+            rawId: this.fromBuffer(credential.rawId),
+            type: credential.type,
+            response: {
+                clientDataJSON: this.fromBuffer(credential.response.clientDataJSON),
+                authenticatorData: this.fromBuffer(credential.response.authenticatorData),
+                signature: this.fromBuffer(credential.response.signature),
+                userHandle: credential.response.userHandle ? this.fromBuffer(credential.response.userHandle) : null,
+            },
+        };
+    }
+}
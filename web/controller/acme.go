@@ -0,0 +1,77 @@
+package controller
+
+import (
+	"x-ui/web/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AcmeController sets how the certificates are issued over ACME, lists them
+// and issues one now.
+type AcmeController struct {
+	acmeService service.AcmeService
+}
+
+func NewAcmeController(g *gin.RouterGroup) *AcmeController {
+	a := &AcmeController{}
+	a.initRouter(g)
+	return a
+}
+
+func (a *AcmeController) initRouter(g *gin.RouterGroup) {
+	g.GET("", a.getSettings)
+	g.POST("", a.saveSettings)
+	g.GET("/certificates", a.getCertificates)
+	g.POST("/certificates/:domain/issue", a.issue)
+}
+
+func (a *AcmeController) getSettings(c *gin.Context) {
+	settings, err := a.acmeService.GetSettings()
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	jsonObj(c, settings, nil)
+}
+
+// saveSettings replaces the ACME settings with those of the JSON body. The
+// Cloudflare token comes back masked, and the mask keeps the saved one.
+func (a *AcmeController) saveSettings(c *gin.Context) {
+	settings := &service.AcmeSettings{}
+	if err := c.ShouldBindJSON(settings); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.acmeSaved"), err)
+		return
+	}
+	old, _ := a.acmeService.GetSettings()
+	if err := a.acmeService.SaveSettings(settings); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.acmeSaved"), err)
+		return
+	}
+	saved, err := a.acmeService.GetSettings()
+	if err == nil {
+		setAuditDiff(c, old, saved)
+	}
+	jsonMsgObj(c, I18nWeb(c, "pages.settings.acmeSaved"), saved, err)
+}
+
+func (a *AcmeController) getCertificates(c *gin.Context) {
+	certificates, err := a.acmeService.GetCertificates()
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	jsonObj(c, certificates, nil)
+}
+
+// issue issues or renews the certificate of a domain of the settings now,
+// and replies once the CA is done, with the error of the CA if it failed.
+func (a *AcmeController) issue(c *gin.Context) {
+	err := a.acmeService.Issue(c.Param("domain"))
+	jsonMsg(c, I18nWeb(c, "pages.settings.acmeIssued"), err)
+}
+
+// AcmeChallenge answers the HTTP-01 challenges of the certificates being
+// issued, on the root of the panel whatever its base path.
+func AcmeChallenge(c *gin.Context) {
+	service.ServeAcmeChallenge(c.Writer, c.Request)
+}
@@ -1,15 +1,105 @@
 package controller
 
 import (
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"x-ui/logger"
+	"x-ui/web/middleware"
 	"x-ui/web/service"
+	"x-ui/web/session"
 
 	"github.com/gin-gonic/gin"
 )
 
+const maxAccessLogTail = 10000
+
+// readOnlyPostRoutes are POST endpoints that only read data, relative to the base
+// path; read-only API tokens may call them besides GET requests, and they are left
+// out of the audit log
+var readOnlyPostRoutes = map[string]bool{
+	"panel/api/cleanup/preview":           true,
+	"panel/api/inbounds/clientIps/:email": true,
+	"panel/api/inbounds/:id/check":        true,
+	"panel/api/inbounds/onlines":          true,
+	"panel/api/settings/preview":          true,
+	"panel/api/webauthn/register/begin":   true,
+	"panel/api/xray/config/preview":       true,
+	"panel/inbound/list":                  true,
+	"panel/inbound/clientIps/:email":      true,
+	"panel/inbound/onlines":               true,
+	"panel/setting/all":                   true,
+	"panel/setting/defaultSettings":       true,
+	"panel/setting/preview":               true,
+	"panel/xray/":                         true,
+	"server/status":                       true,
+	"server/getXrayVersion":               true,
+	"server/logs/:count":                  true,
+	"server/xraylogs/:count":              true,
+	"server/getConfigJson":                true,
+	"server/getNewX25519Cert":             true,
+	"server/getNewmldsa65":                true,
+	"server/getNewEchCert":                true,
+}
+
+// actingGetRoutes are GET endpoints that act rather than read, relative to the
+// base path; read-only API tokens may not call them, and they are audited
+var actingGetRoutes = map[string]bool{
+	// Sends the whole database to the Telegram admins
+	"panel/api/inbounds/createbackup": true,
+}
+
+func isReadOnlyRequest(c *gin.Context) bool {
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead:
+		return !actingGetRoutes[strings.TrimPrefix(c.FullPath(), c.GetString("base_path"))]
+	case http.MethodPost:
+		return readOnlyPostRoutes[strings.TrimPrefix(c.FullPath(), c.GetString("base_path"))]
+	}
+	return false
+}
+
 type APIController struct {
 	BaseController
-	inboundController *InboundController
-	Tgbot             service.Tgbot
+	inboundController   *InboundController
+	twoFactorController *TwoFactorController
+	apiTokenController  *ApiTokenController
+	userController      *UserController
+	sessionController   *LoginSessionController
+	maintenance         *MaintenanceController
+	inboundTemplates    *InboundTemplateController
+	outboundController  *OutboundController
+	routingController   *RoutingController
+	balancerController  *BalancerController
+	warpController      *WarpController
+	dnsController       *DnsController
+	xrayVersions        *XrayVersionController
+	geodataController   *GeodataController
+	databaseController  *DatabaseController
+	trashController     *TrashController
+	backupController    *BackupController
+	xrayConfig          *XrayConfigController
+	settings            *SettingController
+	connBlocks          *ConnBlockController
+	xrayHealth          *XrayHealthController
+	xrayCrashes         *XrayCrashController
+	xrayLogs            *XrayLogsController
+	stats               *StatsController
+	tgbotController     *TgbotController
+	webhookController   *WebhookController
+	acmeController      *AcmeController
+	certController      *CertController
+	nodeController      *NodeController
+	securityController  *SecurityController
+	changesets          *ChangesetController
+	panelExport         *PanelExportController
+	v2                  *ApiV2Controller
+	lockoutService      service.LockoutService
+	panelService        service.PanelService
+	settingService      service.SettingService
+	Tgbot               service.Tgbot
 }
 
 func NewAPIController(g *gin.RouterGroup) *APIController {
@@ -19,8 +109,61 @@ func NewAPIController(g *gin.RouterGroup) *APIController {
 }
 
 func (a *APIController) initRouter(g *gin.RouterGroup) {
-	g = g.Group("/panel/api/inbounds")
-	g.Use(a.checkLogin)
+	api := g.Group("/panel/api")
+	if cors := a.cors(); cors != nil {
+		api.Use(cors)
+		// Registered before the authentication, browsers send preflights without
+		// credentials; the CORS middleware answers them
+		api.OPTIONS("/*path", func(c *gin.Context) {})
+	}
+	api.Use(a.checkApiAuth, a.audit, a.checkRole, a.checkChangeset)
+
+	api.POST("/restart", a.restartPanel)
+	api.GET("/panics", a.getPanics)
+	api.DELETE("/panics", a.clearPanics)
+	api.GET("/logs/access", a.getAccessLog)
+	api.GET("/logs/app", a.getAppLog)
+	api.GET("/logs/app/download", a.downloadAppLog)
+	api.GET("/fail2ban/filter", a.getFail2banFilter)
+	api.GET("/audit", a.getAuditLog)
+	api.GET("/lockouts", a.getLockouts)
+	api.DELETE("/lockouts", a.delAllLockouts)
+	api.DELETE("/lockouts/:id", a.delLockout)
+
+	a.twoFactorController = NewTwoFactorController(api.Group("/2fa", a.sessionOnly))
+	a.apiTokenController = NewApiTokenController(api.Group("/tokens", a.sessionOnly))
+	a.userController = NewUserController(api.Group("/users", a.sessionOnly))
+	a.sessionController = NewLoginSessionController(api.Group("/sessions", a.sessionOnly))
+	a.maintenance = NewMaintenanceController(api.Group("/maintenance"))
+	a.inboundTemplates = NewInboundTemplateController(api.Group("/inbound-templates"))
+	a.outboundController = NewOutboundController(api.Group("/outbounds"))
+	a.routingController = NewRoutingController(api.Group("/routing"))
+	a.balancerController = NewBalancerController(api.Group("/balancers"))
+	a.warpController = NewWarpController(api.Group("/warp"))
+	a.dnsController = NewDnsController(api.Group("/dns"))
+	a.xrayVersions = NewXrayVersionController(api.Group("/xray"))
+	a.geodataController = NewGeodataController(api.Group("/xray/geodata"))
+	a.databaseController = NewDatabaseController(api.Group("/database"))
+	a.trashController = NewTrashController(api.Group("/trash"))
+	a.backupController = NewBackupController(api.Group("/backups"))
+	a.xrayConfig = NewXrayConfigController(api.Group("/xray/config"))
+	a.connBlocks = NewConnBlockController(api.Group("/blocks"))
+	a.settings = NewSettingsAPIController(api.Group("/settings"))
+	a.xrayHealth = NewXrayHealthController(api.Group("/xray/health"))
+	a.xrayCrashes = NewXrayCrashController(api.Group("/xray/crashes"))
+	a.xrayLogs = NewXrayLogsController(api.Group("/xray/logs"))
+	a.stats = NewStatsController(api.Group("/stats"))
+	a.tgbotController = NewTgbotController(api.Group("/tgbot"))
+	a.webhookController = NewWebhookController(api.Group("/webhooks"))
+	a.acmeController = NewAcmeController(api.Group("/acme"))
+	a.certController = NewCertController(api.Group("/certs"))
+	a.nodeController = NewNodeController(api.Group("/nodes"))
+	a.securityController = NewSecurityController(api.Group("/security"))
+	a.changesets = NewChangesetController(api.Group("/changes"))
+	a.panelExport = NewPanelExportController(api.Group("", a.sessionOnly))
+	a.v2 = NewApiV2Controller(api.Group("/v2"))
+
+	g = api.Group("/inbounds")
 
 	a.inboundController = NewInboundController(g)
 
@@ -30,16 +173,33 @@ func (a *APIController) initRouter(g *gin.RouterGroup) {
 		Handler gin.HandlerFunc
 	}{
 		{"GET", "/createbackup", a.createBackup},
+		{"GET", "", a.inboundController.pageInbounds},
 		{"GET", "/list", a.inboundController.getInbounds},
+		{"GET", "/:id/clients", a.inboundController.pageInboundClients},
 		{"GET", "/get/:id", a.inboundController.getInbound},
+		{"GET", "/:id/export", a.inboundController.exportInbound},
+		{"GET", "/:id/connections", a.inboundController.getInboundConnections},
 		{"GET", "/getClientTraffics/:email", a.inboundController.getClientTraffics},
 		{"GET", "/getClientTrafficsById/:id", a.inboundController.getClientTrafficsById},
 		{"POST", "/add", a.inboundController.addInbound},
+		{"POST", "/:id/clone", a.inboundController.cloneInbound},
+		{"POST", "/import", a.inboundController.importInboundExport},
 		{"POST", "/del/:id", a.inboundController.delInbound},
 		{"POST", "/update/:id", a.inboundController.updateInbound},
+		{"POST", "/:id/schedule", a.inboundController.setInboundSchedule},
+		{"DELETE", "/:id/schedule", a.inboundController.delInboundSchedule},
+		{"POST", "/:id/limits", a.inboundController.setInboundLimits},
+		{"DELETE", "/:id/limits", a.inboundController.delInboundLimits},
+		{"POST", "/:id/connLimits", a.inboundController.setInboundConnLimits},
+		{"DELETE", "/:id/connLimits", a.inboundController.delInboundConnLimits},
+		{"POST", "/:id/realityDests", a.inboundController.setRealityDests},
+		{"POST", "/:id/realityDest", a.inboundController.setRealityDest},
+		{"POST", "/:id/check", a.inboundController.checkInbound},
+		{"POST", "/:id/retry-bind", a.inboundController.retryBind},
 		{"POST", "/clientIps/:email", a.inboundController.getClientIps},
 		{"POST", "/clearClientIps/:email", a.inboundController.clearClientIps},
 		{"POST", "/addClient", a.inboundController.addInboundClient},
+		{"POST", "/:id/clients/bulk", a.inboundController.addBulkClients},
 		{"POST", "/:id/delClient/:clientId", a.inboundController.delInboundClient},
 		{"POST", "/updateClient/:clientId", a.inboundController.updateInboundClient},
 		{"POST", "/:id/resetClientTraffic/:email", a.inboundController.resetClientTraffic},
@@ -53,8 +213,161 @@ func (a *APIController) initRouter(g *gin.RouterGroup) {
 	for _, route := range inboundRoutes {
 		g.Handle(route.Method, route.Path, route.Handler)
 	}
+
+	// Clients of any inbound
+	api.GET("/clients", a.inboundController.listClients)
+	api.GET("/clients/search", a.inboundController.searchClients)
+	api.GET("/clients/export", a.inboundController.exportClients)
+	api.GET("/clients/duplicates", a.inboundController.getDuplicateEmails)
+	api.GET("/clients/online", a.inboundController.getOnlineClients)
+	api.GET("/clients/inactive", a.inboundController.getInactiveClients)
+	api.POST("/clients/duplicates/repair", a.inboundController.repairDuplicateEmails)
+	api.POST("/clients/bulk-update", a.inboundController.bulkUpdateClients)
+	api.POST("/clients/bulk-delete", a.inboundController.bulkDelClients)
+	api.POST("/clients/bulk-notify", a.inboundController.bulkNotifyClients)
+	api.GET("/clients/:email/ips", a.inboundController.getClientIpRecord)
+	api.GET("/clients/:email/sub-access", a.inboundController.getSubAccess)
+	api.GET("/clients/:email/devices", a.inboundController.getSubDevices)
+	api.POST("/clients/:email/devices/:device/revoke", a.inboundController.revokeSubDevice)
+	api.GET("/clients/:email/share-access", a.inboundController.getShareAccess)
+	api.POST("/clients/:email/share-access", a.inboundController.createShareAccess)
+	api.POST("/clients/:email/share-access/:id/revoke", a.inboundController.revokeShareAccess)
+	api.GET("/clients/:email/qr", a.inboundController.getClientQR)
+	api.GET("/clients/:email/links", a.inboundController.getClientLinks)
+	api.POST("/clients/:email/renew", a.inboundController.renewClient)
+	api.POST("/clients/:email/move", a.inboundController.moveClient)
+	api.POST("/clients/:email/rotate", a.inboundController.rotateClient)
+	api.POST("/cleanup/preview", a.inboundController.previewCleanup)
+
+	api.GET("/ports/free", a.inboundController.getFreePorts)
+	api.GET("/xray/reality-keys", a.inboundController.getRealityKeys)
+	api.GET("/xray/reality-check", a.inboundController.checkRealityDest)
+	api.POST("/probe", a.inboundController.probe)
+	api.GET("/xray/observatory", a.balancerController.getObservatory)
+	api.GET("/server/status/history", a.stats.getStatusHistory)
+	api.GET(metricsSnapshotPath, a.stats.getMetricsSnapshot)
+}
+
+// cors returns the CORS middleware of the API, or nil if the API is same-origin
+// only.
+func (a *APIController) cors() gin.HandlerFunc {
+	allSetting, err := a.settingService.GetAllSetting()
+	if err != nil {
+		logger.Warning("Unable to get the CORS settings:", err)
+		return nil
+	}
+	config := allSetting.CORSConfig()
+	if !config.Enabled() {
+		return nil
+	}
+	if err := config.Validate(); err != nil {
+		logger.Warning("CORS is disabled:", err)
+		return nil
+	}
+	return middleware.CORS(config)
+}
+
+// restartPanel restarts the panel on its saved settings, and replies with the
+// URL it is at afterwards. Settings it can't start on fail the reply, and the
+// panel keeps running as it is.
+func (a *APIController) restartPanel(c *gin.Context) {
+	origin := c.GetHeader("X-Forwarded-Host")
+	if origin == "" {
+		origin = c.Request.Host
+	}
+	url, err := a.panelService.ApplySettings(session.IsSecureRequest(c), origin)
+	if err == nil {
+		setAuditTarget(c, "panel", url)
+	}
+	jsonMsgObj(c, I18nWeb(c, "pages.settings.restartPanelSuccess"), gin.H{"url": url}, err)
 }
 
 func (a *APIController) createBackup(c *gin.Context) {
 	a.Tgbot.SendBackupToAdmins()
 }
+
+func (a *APIController) getAccessLog(c *gin.Context) {
+	tail, err := strconv.Atoi(c.DefaultQuery("tail", "500"))
+	if err != nil || tail <= 0 {
+		tail = 500
+	}
+	if tail > maxAccessLogTail {
+		tail = maxAccessLogTail
+	}
+	path, err := a.settingService.GetAccessLogPath()
+	if err != nil {
+		jsonObj(c, nil, err)
+		return
+	}
+	lines, err := logger.TailFile(path, tail)
+	if os.IsNotExist(err) {
+		lines, err = []string{}, nil
+	}
+	jsonObj(c, lines, err)
+}
+
+// getAppLog returns the persisted log lines of the panel, newest first, at level
+// or more severe, of component and with q in them.
+func (a *APIController) getAppLog(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "200"))
+	entries, err := logger.QueryAppLog(logger.AppLogFilter{
+		Level:     c.Query("level"),
+		Component: c.Query("component"),
+		Query:     c.Query("q"),
+		Limit:     limit,
+	})
+	jsonObj(c, entries, err)
+}
+
+// downloadAppLog sends all of the persisted log lines of the panel, oldest
+// first, one JSON object per line.
+func (a *APIController) downloadAppLog(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Header("Content-Disposition", `attachment; filename="3xui-app.log"`)
+	if err := logger.WriteAppLog(c.Writer); err != nil {
+		logger.Warning("download of the app log failed:", err)
+	}
+}
+
+func (a *APIController) getFail2banFilter(c *gin.Context) {
+	path, err := a.settingService.GetAuthLogPath()
+	jsonObj(c, gin.H{
+		"failregex":   logger.AuthFailRegex,
+		"datepattern": logger.AuthDatePattern,
+		"logpath":     path,
+	}, err)
+}
+
+func (a *APIController) getLockouts(c *gin.Context) {
+	lockouts, err := a.lockoutService.GetLockouts()
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.security.lockoutsError"), err)
+		return
+	}
+	jsonObj(c, lockouts, nil)
+}
+
+func (a *APIController) delLockout(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.security.lockoutsError"), err)
+		return
+	}
+	err = a.lockoutService.DelLockout(id)
+	jsonMsg(c, I18nWeb(c, "pages.settings.security.lockoutRemoved"), err)
+}
+
+func (a *APIController) delAllLockouts(c *gin.Context) {
+	err := a.lockoutService.DelAllLockouts()
+	jsonMsg(c, I18nWeb(c, "pages.settings.security.lockoutRemoved"), err)
+}
+
+func (a *APIController) getPanics(c *gin.Context) {
+	jsonObj(c, middleware.RecentPanics(), nil)
+}
+
+func (a *APIController) clearPanics(c *gin.Context) {
+	middleware.ClearPanics()
+	jsonMsg(c, I18nWeb(c, "pages.index.panicsCleared"), nil)
+}
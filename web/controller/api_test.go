@@ -0,0 +1,143 @@
+package controller
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/web/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestIsReadOnlyRequest(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	for _, basePath := range []string{"/", "/secret/"} {
+		engine := gin.New()
+		engine.Use(func(c *gin.Context) { c.Set("base_path", basePath) })
+		readOnly := func(c *gin.Context) {
+			if isReadOnlyRequest(c) {
+				c.Status(http.StatusOK)
+			} else {
+				c.Status(http.StatusForbidden)
+			}
+		}
+		g := engine.Group(basePath)
+		g.GET("/panel/api/inbounds/list", readOnly)
+		g.HEAD("/panel/api/inbounds/list", readOnly)
+		g.GET("/panel/api/inbounds/createbackup", readOnly)
+		g.POST("/panel/api/inbounds/onlines", readOnly)
+		g.POST("/panel/api/inbounds/add", readOnly)
+		g.DELETE("/panel/api/inbounds/:id/limits", readOnly)
+
+		tests := []struct {
+			method string
+			path   string
+			want   bool
+		}{
+			{http.MethodGet, "panel/api/inbounds/list", true},
+			{http.MethodHead, "panel/api/inbounds/list", true},
+			{http.MethodGet, "panel/api/inbounds/createbackup", false},
+			{http.MethodPost, "panel/api/inbounds/onlines", true},
+			{http.MethodPost, "panel/api/inbounds/add", false},
+			{http.MethodDelete, "panel/api/inbounds/3/limits", false},
+		}
+		for _, test := range tests {
+			w := httptest.NewRecorder()
+			engine.ServeHTTP(w, httptest.NewRequest(test.method, basePath+test.path, nil))
+			if got := w.Code == http.StatusOK; got != test.want {
+				t.Errorf("%s %s%s read-only = %v, want %v (status %d)", test.method, basePath, test.path, got, test.want, w.Code)
+			}
+		}
+	}
+}
+
+func TestActingGetRoutesAreRegistered(t *testing.T) {
+	if err := database.InitDB(t.TempDir() + "/x-ui.db"); err != nil {
+		t.Fatal(err)
+	}
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	NewAPIController(engine.Group("/"))
+	registered := map[string]bool{}
+	for _, route := range engine.Routes() {
+		registered[route.Method+" "+route.Path] = true
+	}
+	for path := range actingGetRoutes {
+		if !registered["GET /"+path] {
+			t.Errorf("acting GET route %q is not a route of the API", path)
+		}
+	}
+}
+
+func TestXrayCrashesAPI(t *testing.T) {
+	engine, secret := apiTestEngine(t)
+	for i := 1; i <= 3; i++ {
+		report := &model.CrashReport{Time: int64(i), ExitCode: -1, Signal: "segmentation fault", Stderr: "panic", Attempt: i}
+		if err := database.GetDB().Create(report).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	w := getWithToken(engine, "/panel/api/xray/crashes?limit=2", secret)
+	var reply struct {
+		Success bool                `json:"success"`
+		Obj     service.XrayCrashes `json:"obj"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil || !reply.Success {
+		t.Fatalf("the crashes replied %d: %s", w.Code, w.Body)
+	}
+	reports := reply.Obj.Reports
+	if len(reports) != 2 || reports[0].Attempt != 3 || reports[1].Attempt != 2 || reports[0].Signal != "segmentation fault" {
+		t.Errorf("the crash reports are %s", w.Body)
+	}
+	if backoff := reply.Obj.Backoff; backoff == nil || backoff.Restarts != 0 || backoff.MaxAttempts != 5 || backoff.GaveUp {
+		t.Errorf("the backoff is %+v", backoff)
+	}
+}
+
+// metricsSnapshotFields are the field names of the snapshot of the metrics,
+// which the monitors reading it rely on
+var metricsSnapshotFields = []string{
+	"time", "panelUptimeSeconds", "xrayRunning", "xrayUptimeSeconds", "clientsTotal", "clientsOnline",
+	"dbSizeBytes", "lastBackupAgeSeconds", "failedLoginsLastHour", "pendingAlerts", "inbounds",
+}
+
+func TestMetricsSnapshotAPI(t *testing.T) {
+	engine, secret := apiTestEngine(t)
+	addTestInbound(t, &model.Inbound{Remark: "metrics", Enable: true, Port: 24452, Protocol: model.Trojan, Tag: "inbound-24452",
+		Up: 10, Down: 20, Settings: `{"clients":[{"password":"m1","email":"m1","enable":true}]}`}, "m1")
+
+	w := getWithToken(engine, "/panel/api/metrics/snapshot", secret)
+	var snapshot map[string]json.RawMessage
+	if err := json.Unmarshal(w.Body.Bytes(), &snapshot); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("the snapshot replied %d: %s", w.Code, w.Body)
+	}
+	// A flat document, not in an envelope, of the fields as they are
+	if len(snapshot) != len(metricsSnapshotFields) {
+		t.Errorf("the snapshot has the fields %s", w.Body)
+	}
+	for _, field := range metricsSnapshotFields {
+		if _, ok := snapshot[field]; !ok {
+			t.Errorf("the snapshot has no %s: %s", field, w.Body)
+		}
+	}
+	var inbounds []map[string]any
+	if err := json.Unmarshal(snapshot["inbounds"], &inbounds); err != nil || len(inbounds) != 1 ||
+		inbounds[0]["tag"] != "inbound-24452" || inbounds[0]["upBytes"] != float64(10) || inbounds[0]["downTodayBytes"] != float64(0) {
+		t.Errorf("the inbounds of the snapshot are %s", snapshot["inbounds"])
+	}
+	if string(snapshot["clientsTotal"]) != "1" {
+		t.Errorf("the snapshot has %s clients", snapshot["clientsTotal"])
+	}
+
+	// Without a token, the monitor is refused
+	r := httptest.NewRequest(http.MethodGet, "/panel/api/metrics/snapshot", nil)
+	w = httptest.NewRecorder()
+	engine.ServeHTTP(w, r)
+	if w.Code == http.StatusOK {
+		t.Errorf("the snapshot without a token replied %d: %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,73 @@
+package controller
+
+import (
+	"strconv"
+
+	"x-ui/logger"
+	"x-ui/web/service"
+	"x-ui/web/session"
+
+	"github.com/gin-gonic/gin"
+)
+
+type apiTokenForm struct {
+	Name      string `json:"name" form:"name"`
+	Scope     string `json:"scope" form:"scope"`
+	ExpiresAt int64  `json:"expiresAt" form:"expiresAt"`
+}
+
+// ApiTokenController lets the logged in user manage their personal access tokens.
+type ApiTokenController struct {
+	apiTokenService service.ApiTokenService
+}
+
+func NewApiTokenController(g *gin.RouterGroup) *ApiTokenController {
+	a := &ApiTokenController{}
+	a.initRouter(g)
+	return a
+}
+
+func (a *ApiTokenController) initRouter(g *gin.RouterGroup) {
+	g.GET("", a.getTokens)
+	g.POST("", a.createToken)
+	g.DELETE("/:id", a.delToken)
+}
+
+func (a *ApiTokenController) getTokens(c *gin.Context) {
+	tokens, err := a.apiTokenService.GetTokens(session.GetLoginUser(c).Id)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.security.apiTokensError"), err)
+		return
+	}
+	jsonObj(c, tokens, nil)
+}
+
+func (a *ApiTokenController) createToken(c *gin.Context) {
+	form := &apiTokenForm{}
+	if err := c.ShouldBind(form); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.security.apiTokenCreate"), err)
+		return
+	}
+	user := session.GetLoginUser(c)
+	secret, token, err := a.apiTokenService.CreateToken(user.Id, form.Name, form.Scope, form.ExpiresAt)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.security.apiTokenCreate"), err)
+		return
+	}
+	logger.Infof("%s created API token %q (%s)", user.Username, token.Name, token.Scope)
+	jsonMsgObj(c, I18nWeb(c, "pages.settings.security.apiTokenCreated"), gin.H{"token": secret, "info": token}, nil)
+}
+
+func (a *ApiTokenController) delToken(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.security.apiTokenRevoked"), err)
+		return
+	}
+	user := session.GetLoginUser(c)
+	err = a.apiTokenService.DelToken(user.Id, id)
+	if err == nil {
+		logger.Infof("%s revoked API token %d", user.Username, id)
+	}
+	jsonMsg(c, I18nWeb(c, "pages.settings.security.apiTokenRevoked"), err)
+}
@@ -0,0 +1,670 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/web/entity"
+	"x-ui/web/locale"
+	"x-ui/web/service"
+	"x-ui/web/session"
+	"x-ui/xray"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	// apiV2Prefix is the route of the v2 API relative to the base path
+	apiV2Prefix = "panel/api/v2"
+
+	apiV2DefaultPageSize = 50
+	apiV2MaxPageSize     = 500
+
+	// apiV2StatusMaxAge is how old the last server status may be for its CPU
+	// load and throughput to be replied, an older one is sampled again
+	apiV2StatusMaxAge = 10 * time.Second
+)
+
+// apiV2Statuses are the HTTP statuses of the coded errors, others are 422.
+var apiV2Statuses = map[locale.ErrorCode]int{
+	locale.ErrInternal:             http.StatusInternalServerError,
+	locale.ErrInvalidRequest:       http.StatusBadRequest,
+	locale.ErrNotFound:             http.StatusNotFound,
+	locale.ErrForbidden:            http.StatusForbidden,
+	locale.ErrInboundPortInUse:     http.StatusConflict,
+	locale.ErrClientEmailInUse:     http.StatusConflict,
+	locale.ErrClientEmailInInbound: http.StatusConflict,
+	locale.ErrInboundMaxClients:    http.StatusConflict,
+	locale.ErrInboundMaxTotalGB:    http.StatusConflict,
+	locale.ErrInboundMaxExpiry:     http.StatusConflict,
+	locale.ErrInboundUnlimited:     http.StatusConflict,
+	locale.ErrClientNotFound:       http.StatusNotFound,
+	locale.ErrClientRenewInvalid:   http.StatusBadRequest,
+	locale.ErrClientInInbounds:     http.StatusConflict,
+	locale.ErrIdempotencyKeyUsed:   http.StatusConflict,
+}
+
+// apiV2Route is a route of the v2 API. The routes are registered and the
+// OpenAPI document is written from the same list, so they can't drift apart.
+type apiV2Route struct {
+	Method string
+	// Path is relative to the v2 API, with gin's parameters
+	Path string
+	// Id is the operationId of the OpenAPI document
+	Id      string
+	Tag     string
+	Summary string
+	// Role is the least privileged role that may call the route
+	Role string
+	// Query, Body and Data are values of the types of the query, the JSON body
+	// and the data of a success, nil for none
+	Query any
+	Body  any
+	Data  any
+	// Paged replies with a page of Data items
+	Paged bool
+	// Status is the HTTP status of a success, 200 if 0
+	Status  int
+	Handler func(c *gin.Context) (any, error)
+}
+
+func (r apiV2Route) status() int {
+	if r.Status == 0 {
+		return http.StatusOK
+	}
+	return r.Status
+}
+
+// apiV2Error is an error with the code and the HTTP status of its reply.
+type apiV2Error struct {
+	status int
+	code   locale.ErrorCode
+	err    error
+}
+
+func (e *apiV2Error) Error() string { return e.err.Error() }
+func (e *apiV2Error) Unwrap() error { return e.err }
+
+func invalidRequest(err error) error {
+	return &apiV2Error{status: http.StatusBadRequest, code: locale.ErrInvalidRequest, err: err}
+}
+
+func notFound(what string) error {
+	return &apiV2Error{status: http.StatusNotFound, code: locale.ErrNotFound, err: errors.New(what)}
+}
+
+// apiV2PageQuery is the page of a list, pages count from 1.
+type apiV2PageQuery struct {
+	Page     int `form:"page"`
+	PageSize int `form:"pageSize"`
+}
+
+// bounds returns the page and the page size with their defaults, and the
+// offset of the page. The offset of a page too far to count is the last one
+// there can be, past all the items.
+func (q apiV2PageQuery) bounds() (page int, size int, offset int) {
+	page, size = max(q.Page, 1), q.PageSize
+	if size <= 0 {
+		size = apiV2DefaultPageSize
+	}
+	size = min(size, apiV2MaxPageSize)
+	return page, size, min(page-1, math.MaxInt/size-1) * size
+}
+
+// paginate returns the page of items.
+func paginate[T any](items []T, query apiV2PageQuery) entity.Page {
+	page, size, offset := query.bounds()
+	offset = min(offset, len(items))
+	end := min(offset+size, len(items))
+	return entity.Page{Items: items[offset:end], Total: int64(len(items)), Page: page, PageSize: size}
+}
+
+type apiV2ClientQuery struct {
+	apiV2PageQuery
+	Tag string `form:"tag"`
+}
+
+type apiV2DeleteQuery struct {
+	Permanent bool `form:"permanent"`
+}
+
+type apiV2ResetQuery struct {
+	CarryOver bool `form:"carryOver"`
+}
+
+type apiV2RestoreBody struct {
+	Passphrase string `json:"passphrase"`
+}
+
+// apiV2ClientInfo is a client with its inbound and its traffic, and the devices
+// its subscription is fetched on when it is read alone.
+type apiV2ClientInfo struct {
+	InboundId int                 `json:"inboundId"`
+	Client    model.Client        `json:"client"`
+	Traffic   *xray.ClientTraffic `json:"traffic"`
+	Devices   []service.SubDevice `json:"devices,omitempty"`
+}
+
+// ApiV2Controller serves the v2 API: REST routes with the same envelope for
+// every reply and HTTP statuses to match, described by an OpenAPI document.
+type ApiV2Controller struct {
+	inboundService         service.InboundService
+	inboundTemplateService service.InboundTemplateService
+	xrayService            service.XrayService
+	settingService         service.SettingService
+	serverService          service.ServerService
+	backupService          service.BackupService
+	panelService           service.PanelService
+	tgbotService           service.Tgbot
+	subAccessService       service.SubAccessService
+
+	statusLock sync.Mutex
+	lastStatus *service.Status
+}
+
+func NewApiV2Controller(g *gin.RouterGroup) *ApiV2Controller {
+	a := &ApiV2Controller{}
+	a.initRouter(g)
+	return a
+}
+
+func (a *ApiV2Controller) initRouter(g *gin.RouterGroup) {
+	for _, route := range a.routes() {
+		routeRoles[route.Method+" "+apiV2Prefix+route.Path] = route.Role
+		g.Handle(route.Method, route.Path, apiV2Handler(route))
+	}
+	routeRoles["GET "+apiV2Prefix+openAPISpecPath] = model.RoleViewer
+	g.GET(openAPISpecPath, a.getOpenAPI)
+}
+
+// routes lists the routes of the v2 API.
+func (a *ApiV2Controller) routes() []apiV2Route {
+	return []apiV2Route{
+		{Method: "GET", Path: "/inbounds", Id: "listInbounds", Tag: "inbounds", Summary: "List the inbounds",
+			Role: model.RoleViewer, Query: apiV2PageQuery{}, Data: model.Inbound{}, Paged: true, Handler: a.listInbounds},
+		{Method: "POST", Path: "/inbounds", Id: "createInbound", Tag: "inbounds", Summary: "Add an inbound",
+			Role: model.RoleAdmin, Body: model.Inbound{}, Data: model.Inbound{}, Status: http.StatusCreated, Handler: a.createInbound},
+		{Method: "GET", Path: "/inbounds/:id", Id: "getInbound", Tag: "inbounds", Summary: "Get an inbound",
+			Role: model.RoleViewer, Data: model.Inbound{}, Handler: a.getInbound},
+		{Method: "PATCH", Path: "/inbounds/:id", Id: "updateInbound", Tag: "inbounds", Summary: "Change an inbound, the fields left out are kept",
+			Role: model.RoleAdmin, Body: model.Inbound{}, Data: model.Inbound{}, Handler: a.updateInbound},
+		{Method: "DELETE", Path: "/inbounds/:id", Id: "deleteInbound", Tag: "inbounds", Summary: "Move an inbound to the trash, or delete it with permanent",
+			Role: model.RoleAdmin, Query: apiV2DeleteQuery{}, Handler: a.deleteInbound},
+		{Method: "POST", Path: "/inbounds/:id/clients", Id: "createClient", Tag: "clients", Summary: "Add a client to an inbound",
+			Role: model.RoleOperator, Body: model.Client{}, Data: apiV2ClientInfo{}, Status: http.StatusCreated, Handler: a.createClient},
+
+		{Method: "GET", Path: "/clients", Id: "listClients", Tag: "clients", Summary: "List the clients of all inbounds, those with a tag if given",
+			Role: model.RoleViewer, Query: apiV2ClientQuery{}, Data: service.ClientListItem{}, Paged: true, Handler: a.listClients},
+		{Method: "GET", Path: "/clients/:email", Id: "getClient", Tag: "clients", Summary: "Get a client",
+			Role: model.RoleViewer, Data: apiV2ClientInfo{}, Handler: a.getClient},
+		{Method: "PATCH", Path: "/clients/:email", Id: "updateClient", Tag: "clients", Summary: "Change a client, the fields left out are kept",
+			Role: model.RoleOperator, Body: model.Client{}, Data: apiV2ClientInfo{}, Handler: a.updateClient},
+		{Method: "DELETE", Path: "/clients/:email", Id: "deleteClient", Tag: "clients", Summary: "Move a client to the trash, or delete it with permanent",
+			Role: model.RoleOperator, Query: apiV2DeleteQuery{}, Handler: a.deleteClient},
+		{Method: "POST", Path: "/clients/:email/reset-traffic", Id: "resetClientTraffic", Tag: "clients", Summary: "Zero the traffic of a client, with carryOver carrying its unused traffic over if it carries over",
+			Role: model.RoleOperator, Query: apiV2ResetQuery{}, Data: xray.ClientTraffic{}, Handler: a.resetClientTraffic},
+
+		{Method: "GET", Path: "/clients/:email/traffic", Id: "getClientTraffic", Tag: "traffic", Summary: "Get the traffic of a client",
+			Role: model.RoleViewer, Data: xray.ClientTraffic{}, Handler: a.getClientTraffic},
+		{Method: "GET", Path: "/traffic/history", Id: "getTrafficHistory", Tag: "traffic", Summary: "Get the traffic of an inbound, a client or the panel by hours or days, times in milliseconds",
+			Role: model.RoleViewer, Query: service.TrafficHistoryQuery{}, Data: service.TrafficSeries{}, Handler: a.getTrafficHistory},
+
+		{Method: "GET", Path: "/settings", Id: "getSettings", Tag: "settings", Summary: "Get the settings of the panel",
+			Role: model.RoleAdmin, Data: entity.AllSetting{}, Handler: a.getSettings},
+		{Method: "PATCH", Path: "/settings", Id: "updateSettings", Tag: "settings", Summary: "Change settings of the panel, the ones left out are kept",
+			Role: model.RoleAdmin, Body: entity.AllSetting{}, Data: entity.AllSetting{}, Handler: a.updateSettings},
+
+		{Method: "GET", Path: "/backups", Id: "listBackups", Tag: "backups", Summary: "List the backups, newest first",
+			Role: model.RoleAdmin, Query: apiV2PageQuery{}, Data: service.BackupFile{}, Paged: true, Handler: a.listBackups},
+		{Method: "POST", Path: "/backups", Id: "createBackup", Tag: "backups", Summary: "Make a backup now",
+			Role: model.RoleAdmin, Data: service.BackupFile{}, Status: http.StatusCreated, Handler: a.createBackup},
+		{Method: "POST", Path: "/backups/:name/restore", Id: "restoreBackup", Tag: "backups", Summary: "Restore a backup and restart the panel on it",
+			Role: model.RoleAdmin, Body: apiV2RestoreBody{}, Handler: a.restoreBackup},
+
+		{Method: "GET", Path: "/server/status", Id: "getServerStatus", Tag: "server", Summary: "Get the status of the server and Xray",
+			Role: model.RoleViewer, Data: service.Status{}, Handler: a.getServerStatus},
+	}
+}
+
+// apiV2Handler replies to a route with the data of its handler, or its error.
+func apiV2Handler(route apiV2Route) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		data, err := route.Handler(c)
+		if err != nil {
+			apiV2Fail(c, err)
+			return
+		}
+		c.JSON(route.status(), entity.Response{Success: true, Data: localTimes(c, data)})
+	}
+}
+
+// apiV2Fail replies with err. Coded errors get their status and localized
+// message, the others the message of the request with the error.
+func apiV2Fail(c *gin.Context, err error) {
+	status, code, detail := http.StatusUnprocessableEntity, locale.ErrRequestFailed, err
+	var v2Err *apiV2Error
+	if errors.As(err, &v2Err) {
+		status, code, detail = v2Err.status, v2Err.code, v2Err.err
+	}
+	var params []string
+	var details any
+	if limitErr := (*service.InboundLimitError)(nil); errors.As(detail, &limitErr) {
+		details = limitErr
+	}
+	if coded, ok := locale.CodeOf(detail); ok {
+		code, params, detail = coded.Code, coded.Params, nil
+		if codeStatus, ok := apiV2Statuses[code]; ok {
+			status = codeStatus
+		}
+	} else if errors.Is(detail, gorm.ErrRecordNotFound) {
+		status, code = http.StatusNotFound, locale.ErrNotFound
+	}
+
+	message := code.Message(c, params...)
+	if detail != nil {
+		message += " (" + strings.TrimSpace(detail.Error()) + ")"
+	}
+	logger.Warningf("%s %s failed: %v", c.Request.Method, c.Request.URL.Path, err)
+	apiV2ErrorJSON(c, status, code, message, details)
+}
+
+// apiV2ErrorJSON replies with an error in the envelope of the v2 API.
+func apiV2ErrorJSON(c *gin.Context, status int, code locale.ErrorCode, message string, details any) {
+	c.Set(requestFailedKey, true)
+	c.JSON(status, entity.Response{Error: &entity.ResponseError{
+		Code:      code,
+		Message:   message,
+		Details:   details,
+		RequestId: c.Writer.Header().Get("X-Request-Id"),
+	}})
+}
+
+// isApiV2 tells if the request is one of the v2 API.
+func isApiV2(c *gin.Context) bool {
+	route := strings.TrimPrefix(c.FullPath(), c.GetString("base_path"))
+	return strings.HasPrefix(route, apiV2Prefix+"/")
+}
+
+func (a *ApiV2Controller) getOpenAPI(c *gin.Context) {
+	c.JSON(http.StatusOK, openAPIDocument(a.routes(), c.GetString("base_path")))
+}
+
+// idParam returns the id of the route.
+func idParam(c *gin.Context) (int, error) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return 0, invalidRequest(err)
+	}
+	return id, nil
+}
+
+func (a *ApiV2Controller) listInbounds(c *gin.Context) (any, error) {
+	query := apiV2PageQuery{}
+	if err := c.ShouldBindQuery(&query); err != nil {
+		return nil, invalidRequest(err)
+	}
+	page, size, offset := query.bounds()
+	inbounds, total, err := a.inboundService.ListInbounds(size, offset)
+	if err != nil {
+		return nil, err
+	}
+	return entity.Page{Items: inbounds, Total: total, Page: page, PageSize: size}, nil
+}
+
+func (a *ApiV2Controller) getInbound(c *gin.Context) (any, error) {
+	id, err := idParam(c)
+	if err != nil {
+		return nil, err
+	}
+	return a.inboundService.GetInbound(id)
+}
+
+func (a *ApiV2Controller) createInbound(c *gin.Context) (any, error) {
+	inbound := &model.Inbound{}
+	if err := c.ShouldBindJSON(inbound); err != nil {
+		return nil, invalidRequest(err)
+	}
+	if inbound.TemplateId != 0 {
+		if err := a.inboundTemplateService.ApplyTemplate(inbound); err != nil {
+			return nil, err
+		}
+	}
+	inbound.Id = 0
+	inbound.UserId = session.GetLoginUser(c).Id
+	setInboundTag(inbound)
+	inbound, needRestart, err := a.inboundService.AddInbound(inbound)
+	if err != nil {
+		return nil, err
+	}
+	if needRestart {
+		a.xrayService.SetToNeedRestart()
+	}
+	return a.inboundService.GetInbound(inbound.Id)
+}
+
+func (a *ApiV2Controller) updateInbound(c *gin.Context) (any, error) {
+	id, err := idParam(c)
+	if err != nil {
+		return nil, err
+	}
+	before, err := a.inboundService.GetInbound(id)
+	if err != nil {
+		return nil, err
+	}
+	inbound := *before
+	if err := c.ShouldBindJSON(&inbound); err != nil {
+		return nil, invalidRequest(err)
+	}
+	inbound.Id = id
+	_, needRestart, err := a.inboundService.UpdateInbound(&inbound)
+	if err != nil {
+		return nil, err
+	}
+	if needRestart {
+		a.xrayService.SetToNeedRestart()
+	}
+	after, err := a.inboundService.GetInbound(id)
+	if err != nil {
+		return nil, err
+	}
+	// Without the traffic counters that change on their own
+	audited := *after
+	before.Up, before.Down, audited.Up, audited.Down = 0, 0, 0, 0
+	setAuditDiff(c, before, &audited)
+	return after, nil
+}
+
+func (a *ApiV2Controller) deleteInbound(c *gin.Context) (any, error) {
+	id, err := idParam(c)
+	if err != nil {
+		return nil, err
+	}
+	query := apiV2DeleteQuery{}
+	if err := c.ShouldBindQuery(&query); err != nil {
+		return nil, invalidRequest(err)
+	}
+	if _, err := a.inboundService.GetInbound(id); err != nil {
+		return nil, err
+	}
+	needRestart := true
+	if query.Permanent {
+		needRestart, err = a.inboundService.DelInbound(id)
+	} else {
+		needRestart, err = a.inboundService.TrashInbound(id, auditActor(c))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if needRestart {
+		a.xrayService.SetToNeedRestart()
+	}
+	return nil, nil
+}
+
+// findClient returns the client of an email with its inbound and traffic.
+func (a *ApiV2Controller) findClient(email string) (*apiV2ClientInfo, *model.Inbound, error) {
+	traffic, inbound, err := a.inboundService.GetClientInboundByEmail(email)
+	if err != nil {
+		return nil, nil, err
+	}
+	if inbound == nil {
+		return nil, nil, notFound("client " + email)
+	}
+	clients, err := a.inboundService.GetClients(inbound)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, client := range clients {
+		if client.Email == email {
+			if err := a.inboundService.SetNextResets(traffic); err != nil {
+				return nil, nil, err
+			}
+			return &apiV2ClientInfo{InboundId: inbound.Id, Client: client, Traffic: traffic}, inbound, nil
+		}
+	}
+	return nil, nil, notFound("client " + email)
+}
+
+// clientKey returns what identifies a client of protocol in its inbound.
+func clientKey(protocol model.Protocol, client model.Client) string {
+	switch protocol {
+	case model.Trojan:
+		return client.Password
+	case model.Shadowsocks, model.WireGuard:
+		return client.Email
+	}
+	return client.ID
+}
+
+// clientSettings returns the settings of an inbound with only client, the way
+// the services take the clients to add or update.
+func clientSettings(client model.Client) (string, error) {
+	settings, err := json.Marshal(map[string][]model.Client{"clients": {client}})
+	return string(settings), err
+}
+
+func (a *ApiV2Controller) listClients(c *gin.Context) (any, error) {
+	query := apiV2ClientQuery{}
+	if err := c.ShouldBindQuery(&query); err != nil {
+		return nil, invalidRequest(err)
+	}
+	page, size, offset := query.bounds()
+	clients, total, err := a.inboundService.ListClients(query.Tag, size, offset)
+	if err != nil {
+		return nil, err
+	}
+	return entity.Page{Items: clients, Total: total, Page: page, PageSize: size}, nil
+}
+
+func (a *ApiV2Controller) getClient(c *gin.Context) (any, error) {
+	client, _, err := a.findClient(c.Param("email"))
+	if err != nil {
+		return nil, err
+	}
+	client.Devices, err = a.subAccessService.GetSubDevices(client.Client.SubID)
+	return client, err
+}
+
+func (a *ApiV2Controller) createClient(c *gin.Context) (any, error) {
+	id, err := idParam(c)
+	if err != nil {
+		return nil, err
+	}
+	client := model.Client{Enable: true}
+	if err := c.ShouldBindJSON(&client); err != nil {
+		return nil, invalidRequest(err)
+	}
+	if client.Email == "" {
+		return nil, invalidRequest(errors.New("email is required"))
+	}
+	if _, err := a.inboundService.GetInbound(id); err != nil {
+		return nil, err
+	}
+	settings, err := clientSettings(client)
+	if err != nil {
+		return nil, invalidRequest(err)
+	}
+	needRestart, err := a.inboundService.AddInboundClient(&model.Inbound{Id: id, Settings: settings})
+	if err != nil {
+		return nil, err
+	}
+	if needRestart {
+		a.xrayService.SetToNeedRestart()
+	}
+	created, _, err := a.findClient(client.Email)
+	return created, err
+}
+
+func (a *ApiV2Controller) updateClient(c *gin.Context) (any, error) {
+	before, inbound, err := a.findClient(c.Param("email"))
+	if err != nil {
+		return nil, err
+	}
+	client := before.Client
+	if err := c.ShouldBindJSON(&client); err != nil {
+		return nil, invalidRequest(err)
+	}
+	settings, err := clientSettings(client)
+	if err != nil {
+		return nil, invalidRequest(err)
+	}
+	data := &model.Inbound{Id: inbound.Id, Settings: settings}
+	needRestart, err := a.inboundService.UpdateInboundClient(data, clientKey(inbound.Protocol, before.Client))
+	if err != nil {
+		return nil, err
+	}
+	if needRestart {
+		a.xrayService.SetToNeedRestart()
+	}
+	after, _, err := a.findClient(client.Email)
+	if err != nil {
+		return nil, err
+	}
+	setAuditDiff(c, before.Client, after.Client)
+	return after, nil
+}
+
+func (a *ApiV2Controller) deleteClient(c *gin.Context) (any, error) {
+	query := apiV2DeleteQuery{}
+	if err := c.ShouldBindQuery(&query); err != nil {
+		return nil, invalidRequest(err)
+	}
+	client, inbound, err := a.findClient(c.Param("email"))
+	if err != nil {
+		return nil, err
+	}
+	key := clientKey(inbound.Protocol, client.Client)
+	needRestart := true
+	if query.Permanent {
+		needRestart, err = a.inboundService.DelInboundClient(inbound.Id, key)
+	} else {
+		needRestart, err = a.inboundService.TrashInboundClient(inbound.Id, key, auditActor(c))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if needRestart {
+		a.xrayService.SetToNeedRestart()
+	}
+	return nil, nil
+}
+
+func (a *ApiV2Controller) resetClientTraffic(c *gin.Context) (any, error) {
+	email := c.Param("email")
+	_, inbound, err := a.findClient(email)
+	if err != nil {
+		return nil, err
+	}
+	query := apiV2ResetQuery{}
+	if err := c.ShouldBindQuery(&query); err != nil {
+		return nil, err
+	}
+	needRestart, err := a.inboundService.ResetClientTraffic(inbound.Id, email, query.CarryOver)
+	if err != nil {
+		return nil, err
+	}
+	if needRestart {
+		a.xrayService.SetToNeedRestart()
+	}
+	return a.getClientTraffic(c)
+}
+
+func (a *ApiV2Controller) getClientTraffic(c *gin.Context) (any, error) {
+	email := c.Param("email")
+	traffic, err := a.inboundService.GetClientTrafficByEmail(email)
+	if err != nil {
+		return nil, err
+	}
+	if traffic == nil {
+		return nil, notFound("client " + email)
+	}
+	return traffic, a.inboundService.SetNextResets(traffic)
+}
+
+func (a *ApiV2Controller) getTrafficHistory(c *gin.Context) (any, error) {
+	query := service.TrafficHistoryQuery{}
+	if err := c.ShouldBindQuery(&query); err != nil {
+		return nil, invalidRequest(err)
+	}
+	return a.inboundService.GetTrafficHistory(query)
+}
+
+func (a *ApiV2Controller) getSettings(c *gin.Context) (any, error) {
+	return a.settingService.GetAllSetting()
+}
+
+func (a *ApiV2Controller) updateSettings(c *gin.Context) (any, error) {
+	before, err := a.settingService.GetAllSetting()
+	if err != nil {
+		return nil, err
+	}
+	allSetting := *before
+	if err := c.ShouldBindJSON(&allSetting); err != nil {
+		return nil, invalidRequest(err)
+	}
+	if err := a.settingService.UpdateAllSetting(&allSetting); err != nil {
+		return nil, err
+	}
+	after, err := a.settingService.GetAllSetting()
+	if err != nil {
+		return nil, err
+	}
+	setAuditDiff(c, before, after)
+	return after, nil
+}
+
+func (a *ApiV2Controller) listBackups(c *gin.Context) (any, error) {
+	query := apiV2PageQuery{}
+	if err := c.ShouldBindQuery(&query); err != nil {
+		return nil, invalidRequest(err)
+	}
+	backups, err := a.backupService.List()
+	if err != nil {
+		return nil, err
+	}
+	return paginate(backups, query), nil
+}
+
+func (a *ApiV2Controller) createBackup(c *gin.Context) (any, error) {
+	return a.backupService.Create()
+}
+
+func (a *ApiV2Controller) restoreBackup(c *gin.Context) (any, error) {
+	body := apiV2RestoreBody{}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		return nil, invalidRequest(err)
+	}
+	// Xray is stopped while the database is replaced
+	defer a.serverService.RestartXrayService()
+	if err := a.backupService.Restore(c.Param("name"), body.Passphrase); err != nil {
+		return nil, err
+	}
+	return nil, a.panelService.RestartPanel(time.Second * 3)
+}
+
+// getServerStatus replies with the status of the server, the last one the
+// status job took. The CPU load and the throughput are measured since the
+// status before, so if that one is old it is sampled again a moment later for
+// them to be the current ones.
+func (a *ApiV2Controller) getServerStatus(c *gin.Context) (any, error) {
+	if status := a.serverService.GetLastStatus(); status != nil && time.Since(status.T) <= apiV2StatusMaxAge {
+		return status, nil
+	}
+	a.statusLock.Lock()
+	defer a.statusLock.Unlock()
+	if a.lastStatus == nil || time.Since(a.lastStatus.T) > apiV2StatusMaxAge {
+		a.lastStatus = a.serverService.GetStatus(a.lastStatus)
+		time.Sleep(time.Second)
+	}
+	a.lastStatus = a.serverService.GetStatus(a.lastStatus)
+	return a.lastStatus, nil
+}
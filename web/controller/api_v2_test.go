@@ -0,0 +1,336 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/web/entity"
+	"x-ui/web/locale"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+func TestOpenAPIMatchesRoutes(t *testing.T) {
+	if err := database.InitDB(t.TempDir() + "/x-ui.db"); err != nil {
+		t.Fatal(err)
+	}
+	gin.SetMode(gin.TestMode)
+	for _, basePath := range []string{"/", "/secret/"} {
+		engine := gin.New()
+		NewAPIController(engine.Group(basePath))
+		if mismatches := UndocumentedApiV2Routes(engine.Routes(), basePath); len(mismatches) != 0 {
+			t.Errorf("under %s the routes and the OpenAPI document differ on %v", basePath, mismatches)
+		}
+
+		// A route that isn't in the document is told, and so is an operation
+		// of the document that isn't a route
+		routes := slices.DeleteFunc(engine.Routes(), func(route gin.RouteInfo) bool {
+			return route.Method == http.MethodGet && route.Path == basePath+apiV2Prefix+"/inbounds/:id"
+		})
+		routes = append(routes, gin.RouteInfo{Method: http.MethodPut, Path: basePath + apiV2Prefix + "/inbounds/:id/clients"})
+		want := []string{"GET /inbounds/{id}", "PUT /inbounds/{id}/clients"}
+		if mismatches := UndocumentedApiV2Routes(routes, basePath); !slices.Equal(mismatches, want) {
+			t.Errorf("the mismatches are %v, want %v", mismatches, want)
+		}
+
+		// The v1 routes are still served
+		registered := map[string]bool{}
+		for _, route := range engine.Routes() {
+			registered[route.Method+" "+route.Path] = true
+		}
+		for _, route := range []string{"GET panel/api/inbounds/list", "POST panel/api/inbounds/add", "GET panel/api/panics"} {
+			method, path, _ := strings.Cut(route, " ")
+			if !registered[method+" "+basePath+path] {
+				t.Errorf("the v1 route %s is not served under %s", route, basePath)
+			}
+		}
+	}
+}
+
+func TestOpenAPIDocument(t *testing.T) {
+	routes := (&ApiV2Controller{}).routes()
+	ids := map[string]bool{}
+	for _, route := range routes {
+		if ids[route.Id] {
+			t.Errorf("two routes are %s", route.Id)
+		}
+		ids[route.Id] = true
+		if route.Role != model.RoleViewer && route.Role != model.RoleOperator && route.Role != model.RoleAdmin {
+			t.Errorf("%s has the role %q", route.Id, route.Role)
+		}
+	}
+
+	data, err := json.Marshal(openAPIDocument(routes, "/secret/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var document struct {
+		OpenAPI string `json:"openapi"`
+		Servers []struct {
+			URL string `json:"url"`
+		} `json:"servers"`
+		Paths      map[string]map[string]json.RawMessage `json:"paths"`
+		Components struct {
+			Schemas map[string]json.RawMessage `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(data, &document); err != nil {
+		t.Fatal(err)
+	}
+	if document.OpenAPI != "3.0.3" || len(document.Servers) != 1 || document.Servers[0].URL != "/secret/panel/api/v2" {
+		t.Errorf("the document is %s %+v", document.OpenAPI, document.Servers)
+	}
+	operation := func(path string, method string) (operation openAPITestOperation) {
+		if err := json.Unmarshal(document.Paths[path][method], &operation); err != nil {
+			t.Errorf("%s %s: %v", method, path, err)
+		}
+		return operation
+	}
+	inbound := map[string]openAPITestOperation{}
+	for _, method := range []string{"get", "patch", "delete"} {
+		inbound[method] = operation("/inbounds/{id}", method)
+	}
+	if inbound["get"].OperationId != "getInbound" || inbound["patch"].OperationId != "updateInbound" || inbound["delete"].OperationId != "deleteInbound" {
+		t.Errorf("the operations of /inbounds/{id} are %+v", inbound)
+	}
+	if parameters := inbound["get"].Parameters; len(parameters) != 1 || parameters[0].Name != "id" || parameters[0].In != "path" || !parameters[0].Required {
+		t.Errorf("the parameters of getInbound are %+v", parameters)
+	}
+	list := operation("/inbounds", "get")
+	if len(list.Parameters) != 2 || list.Parameters[0].Name != "page" || list.Parameters[1].In != "query" {
+		t.Errorf("the parameters of listInbounds are %+v", list.Parameters)
+	}
+	if create := operation("/inbounds", "post"); create.Responses["201"] == nil {
+		t.Errorf("createInbound doesn't reply 201: %v", create.Responses)
+	}
+	for _, schema := range []string{"Inbound", "Client", "ResponseError"} {
+		if _, ok := document.Components.Schemas[schema]; !ok {
+			t.Errorf("the schema %s is missing", schema)
+		}
+	}
+}
+
+type openAPITestOperation struct {
+	OperationId string `json:"operationId"`
+	Parameters  []struct {
+		Name     string `json:"name"`
+		In       string `json:"in"`
+		Required bool   `json:"required"`
+	} `json:"parameters"`
+	Responses map[string]json.RawMessage `json:"responses"`
+}
+
+type apiV2Reply struct {
+	Success bool                  `json:"success"`
+	Data    json.RawMessage       `json:"data"`
+	Error   *entity.ResponseError `json:"error"`
+}
+
+func serveApiV2(t *testing.T, engine *gin.Engine, method string, path string) (int, apiV2Reply) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+	var reply apiV2Reply
+	if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+		t.Fatalf("%s %s replied %s", method, path, w.Body)
+	}
+	return w.Code, reply
+}
+
+func TestApiV2Envelope(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	handlers := map[string]func(c *gin.Context) (any, error){
+		"/ok":      func(c *gin.Context) (any, error) { return gin.H{"a": 1}, nil },
+		"/invalid": func(c *gin.Context) (any, error) { return nil, invalidRequest(errors.New("bad id")) },
+		"/missing": func(c *gin.Context) (any, error) { return nil, notFound("no such inbound") },
+		"/record":  func(c *gin.Context) (any, error) { return nil, gorm.ErrRecordNotFound },
+		"/coded": func(c *gin.Context) (any, error) {
+			return nil, locale.NewError(locale.ErrInboundPortInUse, "Port==443")
+		},
+		"/forbidden": func(c *gin.Context) (any, error) { return nil, locale.NewError(locale.ErrForbidden) },
+		"/failed":    func(c *gin.Context) (any, error) { return nil, errors.New("disk full") },
+	}
+	for path, handler := range handlers {
+		engine.GET(path, apiV2Handler(apiV2Route{Handler: handler}))
+	}
+	engine.POST("/created", apiV2Handler(apiV2Route{Status: http.StatusCreated, Handler: handlers["/ok"]}))
+
+	tests := []struct {
+		method string
+		path   string
+		status int
+		code   locale.ErrorCode
+	}{
+		{http.MethodGet, "/ok", http.StatusOK, ""},
+		{http.MethodPost, "/created", http.StatusCreated, ""},
+		{http.MethodGet, "/invalid", http.StatusBadRequest, locale.ErrInvalidRequest},
+		{http.MethodGet, "/missing", http.StatusNotFound, locale.ErrNotFound},
+		{http.MethodGet, "/record", http.StatusNotFound, locale.ErrNotFound},
+		{http.MethodGet, "/coded", http.StatusConflict, locale.ErrInboundPortInUse},
+		{http.MethodGet, "/forbidden", http.StatusForbidden, locale.ErrForbidden},
+		{http.MethodGet, "/failed", http.StatusUnprocessableEntity, locale.ErrRequestFailed},
+	}
+	for _, test := range tests {
+		status, reply := serveApiV2(t, engine, test.method, test.path)
+		if status != test.status {
+			t.Errorf("%s replied %d, want %d", test.path, status, test.status)
+		}
+		if test.code == "" {
+			if !reply.Success || string(reply.Data) != `{"a":1}` || reply.Error != nil {
+				t.Errorf("%s replied %+v", test.path, reply)
+			}
+			continue
+		}
+		if reply.Success || reply.Error == nil || reply.Error.Code != test.code || reply.Error.Message == "" {
+			t.Errorf("%s replied %+v, want the code %s", test.path, reply, test.code)
+		}
+	}
+	if _, reply := serveApiV2(t, engine, http.MethodGet, "/coded"); reply.Error.Message != "Port 443 is already used by another inbound" {
+		t.Errorf("the coded error is %q", reply.Error.Message)
+	}
+	if _, reply := serveApiV2(t, engine, http.MethodGet, "/invalid"); reply.Error.Message != "The Input data format is invalid. (bad id)" {
+		t.Errorf("the invalid request error is %q", reply.Error.Message)
+	}
+}
+
+func TestApiV2Inbounds(t *testing.T) {
+	if err := database.InitDB(t.TempDir() + "/x-ui.db"); err != nil {
+		t.Fatal(err)
+	}
+	for _, port := range []int{24439, 24440, 24441} {
+		inbound := &model.Inbound{Enable: true, Port: port, Protocol: model.VMESS, Tag: "inbound-" + strconv.Itoa(port), Settings: `{"clients":[]}`}
+		if err := database.GetDB().Create(inbound).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	for _, route := range (&ApiV2Controller{}).routes() {
+		if route.Tag == "inbounds" && route.Method == http.MethodGet {
+			engine.Handle(route.Method, "/"+apiV2Prefix+route.Path, apiV2Handler(route))
+		}
+	}
+
+	status, reply := serveApiV2(t, engine, http.MethodGet, "/"+apiV2Prefix+"/inbounds?page=2&pageSize=2")
+	var page struct {
+		Items    []model.Inbound `json:"items"`
+		Total    int64           `json:"total"`
+		Page     int             `json:"page"`
+		PageSize int             `json:"pageSize"`
+	}
+	if err := json.Unmarshal(reply.Data, &page); err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK || page.Total != 3 || page.Page != 2 || page.PageSize != 2 || len(page.Items) != 1 {
+		t.Errorf("the second page is %d %+v", status, page)
+	}
+
+	if status, reply := serveApiV2(t, engine, http.MethodGet, "/"+apiV2Prefix+"/inbounds/99"); status != http.StatusNotFound || reply.Error.Code != locale.ErrNotFound {
+		t.Errorf("a missing inbound replied %d %+v", status, reply)
+	}
+	if status, reply := serveApiV2(t, engine, http.MethodGet, "/"+apiV2Prefix+"/inbounds/first"); status != http.StatusBadRequest || reply.Error.Code != locale.ErrInvalidRequest {
+		t.Errorf("an invalid id replied %d %+v", status, reply)
+	}
+	if status, _ := serveApiV2(t, engine, http.MethodGet, "/"+apiV2Prefix+"/inbounds?pageSize=many"); status != http.StatusBadRequest {
+		t.Errorf("an invalid page size replied %d", status)
+	}
+	// A page too far to count is empty
+	status, reply = serveApiV2(t, engine, http.MethodGet, "/"+apiV2Prefix+"/inbounds?page=18446744073709553&pageSize=500")
+	if err := json.Unmarshal(reply.Data, &page); status != http.StatusOK || err != nil || len(page.Items) != 0 || page.Total != 3 {
+		t.Errorf("a huge page replied %d with %d of %d inbounds", status, len(page.Items), page.Total)
+	}
+}
+
+func TestApiV2Paginate(t *testing.T) {
+	items := make([]int, 120)
+	tests := []struct {
+		query  apiV2PageQuery
+		page   int
+		size   int
+		length int
+	}{
+		{apiV2PageQuery{}, 1, apiV2DefaultPageSize, apiV2DefaultPageSize},
+		{apiV2PageQuery{Page: 3}, 3, apiV2DefaultPageSize, 20},
+		{apiV2PageQuery{Page: 4}, 4, apiV2DefaultPageSize, 0},
+		{apiV2PageQuery{Page: -1, PageSize: 1000}, 1, apiV2MaxPageSize, 120},
+		{apiV2PageQuery{Page: 2, PageSize: 100}, 2, 100, 20},
+		{apiV2PageQuery{Page: 18446744073709553, PageSize: 500}, 18446744073709553, 500, 0},
+		{apiV2PageQuery{Page: math.MaxInt, PageSize: math.MaxInt}, math.MaxInt, apiV2MaxPageSize, 0},
+		{apiV2PageQuery{Page: math.MaxInt}, math.MaxInt, apiV2DefaultPageSize, 0},
+		{apiV2PageQuery{Page: math.MinInt, PageSize: math.MinInt}, 1, apiV2DefaultPageSize, apiV2DefaultPageSize},
+		{apiV2PageQuery{Page: math.MaxInt / 500, PageSize: 500}, math.MaxInt / 500, 500, 0},
+	}
+	for _, test := range tests {
+		_, size, offset := test.query.bounds()
+		if offset < 0 || offset > math.MaxInt-size {
+			t.Errorf("%+v gave the offset %d", test.query, offset)
+		}
+		page := paginate(items, test.query)
+		if page.Page != test.page || page.PageSize != test.size || len(page.Items.([]int)) != test.length || page.Total != 120 {
+			t.Errorf("%+v gave the page %d of %d with %d items", test.query, page.Page, page.PageSize, len(page.Items.([]int)))
+		}
+	}
+}
+
+func TestOpenAPIMetricsSnapshot(t *testing.T) {
+	data, err := json.Marshal(openAPIDocument((&ApiV2Controller{}).routes(), "/secret/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var document struct {
+		Paths map[string]struct {
+			Servers []struct {
+				URL string `json:"url"`
+			} `json:"servers"`
+			Get struct {
+				OperationId string `json:"operationId"`
+				Responses   map[string]struct {
+					Content map[string]struct {
+						Schema openAPITestSchema `json:"schema"`
+					} `json:"content"`
+				} `json:"responses"`
+			} `json:"get"`
+		} `json:"paths"`
+		Components struct {
+			Schemas map[string]openAPITestSchema `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(data, &document); err != nil {
+		t.Fatal(err)
+	}
+	path, ok := document.Paths["/metrics/snapshot"]
+	if !ok || len(path.Servers) != 1 || path.Servers[0].URL != "/secret/panel/api" || path.Get.OperationId != "getMetricsSnapshot" {
+		t.Fatalf("the path of the snapshot is %+v", path)
+	}
+	schema := path.Get.Responses["200"].Content["application/json"].Schema
+	if schema.Ref != "" {
+		schema = document.Components.Schemas[schema.Ref[len("#/components/schemas/"):]]
+	}
+	// Each field of the snapshot, named as it is served, is described
+	if len(schema.Properties) != len(metricsSnapshotFields) {
+		t.Errorf("the schema of the snapshot has %d fields, the snapshot %d", len(schema.Properties), len(metricsSnapshotFields))
+	}
+	for _, field := range metricsSnapshotFields {
+		if schema.Properties[field].Description == "" {
+			t.Errorf("the field %s of the snapshot isn't described", field)
+		}
+	}
+}
+
+type openAPITestSchema struct {
+	Ref        string `json:"$ref"`
+	Properties map[string]struct {
+		Description string `json:"description"`
+	} `json:"properties"`
+}
@@ -0,0 +1,163 @@
+package controller
+
+import (
+	"strconv"
+	"strings"
+
+	"x-ui/database/model"
+	"x-ui/web/middleware"
+	"x-ui/web/service"
+	"x-ui/web/session"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	auditDiffKey     = "audit_diff"
+	auditEntityKey   = "audit_entity"
+	auditEntityIdKey = "audit_entity_id"
+)
+
+// auditEntities maps the first segment of a route to the entity type recorded in
+// the audit log
+var auditEntities = map[string]string{
+	"inbound":           "inbound",
+	"inbounds":          "inbound",
+	"inbound-templates": "inbound_template",
+	"outbounds":         "outbound",
+	"routing":           "routing_rule",
+	"balancers":         "balancer",
+	"warp":              "warp",
+	"dns":               "dns",
+	"clients":           "client",
+	"setting":           "setting",
+	"settings":          "setting",
+	"backups":           "backup",
+	"xray":              "xray",
+	"server":            "server",
+	"users":             "user",
+	"tokens":            "api_token",
+	"sessions":          "session",
+	"2fa":               "two_factor",
+	"webauthn":          "passkey",
+	"lockouts":          "lockout",
+	"panics":            "panic",
+	"nodes":             "node",
+	"blocks":            "conn_block",
+}
+
+// setAuditDiff attaches the changed fields of an entity to the audit log entry of
+// the request.
+func setAuditDiff(c *gin.Context, before any, after any) {
+	c.Set(auditDiffKey, service.AuditDiff(before, after))
+}
+
+// setAuditTarget overrides the entity derived from the route, for requests that
+// carry it in the body.
+func setAuditTarget(c *gin.Context, entityType string, entityId string) {
+	c.Set(auditEntityKey, entityType)
+	c.Set(auditEntityIdKey, entityId)
+}
+
+// audit records every request that may change something, after it was handled.
+// It runs after checkLogin or checkApiAuth, so the actor is always known, and
+// before checkRole, so denied attempts are recorded as well.
+func (a *BaseController) audit(c *gin.Context) {
+	if isReadOnlyRequest(c) {
+		c.Next()
+		return
+	}
+	c.Next()
+
+	route := strings.TrimPrefix(c.FullPath(), c.GetString("base_path"))
+	if route == "" {
+		return
+	}
+	entityType, action, entityId := auditTarget(c, route)
+	if value, ok := c.Get(auditEntityKey); ok {
+		entityType, entityId = value.(string), c.GetString(auditEntityIdKey)
+	}
+	a.auditLog.Record(&model.AuditLog{
+		Actor:      auditActor(c),
+		Action:     action,
+		EntityType: entityType,
+		EntityId:   entityId,
+		Ip:         middleware.ClientIP(c),
+		Success:    c.Writer.Status() < 400 && !c.GetBool(requestFailedKey),
+		Diff:       c.GetString(auditDiffKey),
+	})
+}
+
+// auditActor returns who makes the request: the API token or the logged in user.
+func auditActor(c *gin.Context) string {
+	actor := middleware.GetActor(c)
+	if user := session.GetLoginUser(c); actor == "" && user != nil {
+		actor = user.Username
+	}
+	return actor
+}
+
+// auditTarget derives the entity and the action from a route like
+// "panel/api/inbounds/:id/resetClientTraffic/:email". Client secrets may be part
+// of a route, so only the inbound id and the client email are used as ids.
+func auditTarget(c *gin.Context, route string) (entityType string, action string, entityId string) {
+	if rest, ok := strings.CutPrefix(route, apiV2Prefix+"/"); ok {
+		route = rest
+	} else if rest, ok := strings.CutPrefix(route, "panel/api/"); ok {
+		route = rest
+	} else {
+		route = strings.TrimPrefix(route, "panel/")
+	}
+	var names []string
+	for _, segment := range strings.Split(route, "/") {
+		if segment != "" && !strings.HasPrefix(segment, ":") {
+			names = append(names, segment)
+		}
+	}
+	if len(names) == 0 {
+		return "", strings.ToLower(c.Request.Method), ""
+	}
+
+	entityType = names[0]
+	if name, ok := auditEntities[entityType]; ok {
+		entityType = name
+	}
+	entityId = c.Param("id")
+	if email := c.Param("email"); email != "" {
+		entityType, entityId = "client", email
+	}
+
+	if len(names) > 1 {
+		action = entityType + "." + strings.Join(names[1:], ".")
+	} else {
+		switch {
+		case c.Request.Method == "DELETE":
+			action = entityType + ".delete"
+		case entityId != "" || c.Request.Method == "PATCH":
+			action = entityType + ".update"
+		default:
+			action = entityType + ".create"
+		}
+	}
+	return entityType, action, entityId
+}
+
+func (a *APIController) getAuditLog(c *gin.Context) {
+	filter := service.AuditFilter{
+		EntityType: c.Query("entity"),
+		EntityId:   c.Query("id"),
+		Actor:      c.Query("actor"),
+		Action:     c.Query("action"),
+	}
+	filter.Limit, _ = strconv.Atoi(c.Query("limit"))
+	filter.Offset, _ = strconv.Atoi(c.Query("offset"))
+	filter.Since, _ = strconv.ParseInt(c.Query("since"), 10, 64)
+	filter.Until, _ = strconv.ParseInt(c.Query("until"), 10, 64)
+
+	entries, total, err := a.auditLog.GetEntries(filter)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.auditLogError"), err)
+		return
+	}
+	jsonObj(c, gin.H{"total": total, "entries": entries}, nil)
+}
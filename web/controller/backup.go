@@ -0,0 +1,102 @@
+package controller
+
+import (
+	"time"
+
+	"x-ui/web/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// BackupController lists the backups of the backup folder, makes one now and
+// restores them, and sets the remotes they are uploaded to.
+type BackupController struct {
+	backupService service.BackupService
+	serverService service.ServerService
+	panelService  service.PanelService
+}
+
+func NewBackupController(g *gin.RouterGroup) *BackupController {
+	a := &BackupController{}
+	a.initRouter(g)
+	return a
+}
+
+func (a *BackupController) initRouter(g *gin.RouterGroup) {
+	g.GET("", a.list)
+	g.POST("", a.create)
+	g.POST("/:name/restore", a.restore)
+	g.GET("/remotes", a.getRemotes)
+	g.POST("/remotes", a.saveRemotes)
+	g.POST("/test-remote", a.testRemote)
+}
+
+func (a *BackupController) list(c *gin.Context) {
+	backups, err := a.backupService.List()
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	jsonObj(c, backups, nil)
+}
+
+func (a *BackupController) create(c *gin.Context) {
+	backup, err := a.backupService.Create()
+	jsonMsgObj(c, I18nWeb(c, "pages.settings.backupCreated"), backup, err)
+}
+
+// restore replaces the database with a backup, decrypted with the passphrase
+// of the form if it is encrypted, then restarts the panel on it.
+func (a *BackupController) restore(c *gin.Context) {
+	// Xray is stopped while the database is replaced
+	defer a.serverService.RestartXrayService()
+	err := a.backupService.Restore(c.Param("name"), c.PostForm("passphrase"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.index.importDatabaseError"), err)
+		return
+	}
+	err = a.panelService.RestartPanel(time.Second * 3)
+	jsonMsg(c, I18nWeb(c, "pages.index.importDatabaseSuccess"), err)
+}
+
+func (a *BackupController) getRemotes(c *gin.Context) {
+	remotes, err := a.backupService.GetRemotes()
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	jsonObj(c, remotes, nil)
+}
+
+// saveRemotes replaces the remotes with those of the JSON array of the body.
+// Each secret comes back masked, and a masked one keeps the saved secret.
+func (a *BackupController) saveRemotes(c *gin.Context) {
+	remotes := []service.BackupRemote{}
+	if err := c.ShouldBindJSON(&remotes); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.backupRemotesSaved"), err)
+		return
+	}
+	old, _ := a.backupService.GetRemotes()
+	err := a.backupService.SaveRemotes(remotes)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.backupRemotesSaved"), err)
+		return
+	}
+	saved, err := a.backupService.GetRemotes()
+	if err == nil {
+		setAuditDiff(c, old, saved)
+	}
+	jsonMsgObj(c, I18nWeb(c, "pages.settings.backupRemotesSaved"), saved, err)
+}
+
+// testRemote writes and deletes a probe file on the remote of the body, which
+// doesn't have to be saved.
+func (a *BackupController) testRemote(c *gin.Context) {
+	remote := &service.BackupRemote{}
+	if err := c.ShouldBindJSON(remote); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.backupRemoteTested"), err)
+		return
+	}
+	err := a.backupService.TestRemote(remote)
+	jsonMsg(c, I18nWeb(c, "pages.settings.backupRemoteTested"), err)
+}
@@ -0,0 +1,38 @@
+package controller
+
+import (
+	"net/http"
+
+	"x-ui/logger"
+	"x-ui/web/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// BackupDownloadController serves the backups too large for Telegram on the
+// signed, expiring links the bot sends, without logging in.
+type BackupDownloadController struct {
+	backupService service.BackupService
+}
+
+func NewBackupDownloadController(g *gin.RouterGroup) *BackupDownloadController {
+	a := &BackupDownloadController{}
+	a.initRouter(g)
+	return a
+}
+
+func (a *BackupDownloadController) initRouter(g *gin.RouterGroup) {
+	g.GET("/backups/download/:name", a.download)
+}
+
+func (a *BackupDownloadController) download(c *gin.Context) {
+	name := c.Param("name")
+	path, err := a.backupService.CheckDownload(name, c.Query("expires"), c.Query("signature"))
+	if err != nil {
+		logger.Warning("backup download of", name, "refused:", err)
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.FileAttachment(path, name)
+}
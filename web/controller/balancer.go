@@ -0,0 +1,120 @@
+package controller
+
+import (
+	"strconv"
+	"time"
+
+	"x-ui/database/model"
+	"x-ui/web/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// BalancerController manages the balancers the panel adds to the Xray config,
+// besides those of the config template.
+type BalancerController struct {
+	balancerService service.BalancerService
+	xrayService     service.XrayService
+}
+
+func NewBalancerController(g *gin.RouterGroup) *BalancerController {
+	a := &BalancerController{}
+	a.initRouter(g)
+	return a
+}
+
+func (a *BalancerController) initRouter(g *gin.RouterGroup) {
+	g.GET("", a.getBalancers)
+	g.GET("/:id", a.getBalancer)
+	g.POST("", a.addBalancer)
+	g.PUT("/:id", a.updateBalancer)
+	g.DELETE("/:id", a.delBalancer)
+}
+
+func (a *BalancerController) getBalancers(c *gin.Context) {
+	balancers, err := a.balancerService.GetBalancers()
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	jsonObj(c, balancers, nil)
+}
+
+func (a *BalancerController) getBalancer(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	balancer, err := a.balancerService.GetBalancer(id)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	jsonObj(c, balancer, nil)
+}
+
+func (a *BalancerController) addBalancer(c *gin.Context) {
+	balancer := &model.Balancer{}
+	if err := c.ShouldBind(balancer); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.xray.balancer.saved"), err)
+		return
+	}
+	balancer, err := a.balancerService.AddBalancer(balancer)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.xray.balancer.saved"), err)
+		return
+	}
+	setAuditTarget(c, "balancer", strconv.Itoa(balancer.Id))
+	setAuditDiff(c, gin.H{}, balancer)
+	jsonMsgObj(c, I18nWeb(c, "pages.xray.balancer.saved"), balancer, nil)
+	a.xrayService.SetToNeedRestart()
+}
+
+func (a *BalancerController) updateBalancer(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.xray.balancer.saved"), err)
+		return
+	}
+	balancer := &model.Balancer{}
+	if err := c.ShouldBind(balancer); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.xray.balancer.saved"), err)
+		return
+	}
+	balancer.Id = id
+	before, _ := a.balancerService.GetBalancer(id)
+	balancer, err = a.balancerService.UpdateBalancer(balancer)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.xray.balancer.saved"), err)
+		return
+	}
+	setAuditDiff(c, before, balancer)
+	jsonMsgObj(c, I18nWeb(c, "pages.xray.balancer.saved"), balancer, nil)
+	a.xrayService.SetToNeedRestart()
+}
+
+func (a *BalancerController) delBalancer(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.xray.balancer.deleted"), err)
+		return
+	}
+	err = a.balancerService.DelBalancer(id)
+	jsonMsg(c, I18nWeb(c, "pages.xray.balancer.deleted"), err)
+	if err == nil {
+		a.xrayService.SetToNeedRestart()
+	}
+}
+
+// observatoryTimeout bounds how long the running Xray may take to answer
+const observatoryTimeout = 5 * time.Second
+
+func (a *BalancerController) getObservatory(c *gin.Context) {
+	observatory, err := a.balancerService.GetObservatory(observatoryTimeout)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	jsonObj(c, observatory, nil)
+}
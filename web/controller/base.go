@@ -2,20 +2,124 @@ package controller
 
 import (
 	"net/http"
+	"time"
 
+	"x-ui/database/model"
 	"x-ui/logger"
 	"x-ui/web/locale"
+	"x-ui/web/middleware"
+	"x-ui/web/service"
 	"x-ui/web/session"
 
+	"github.com/gin-contrib/sessions"
 	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
 )
 
-type BaseController struct{}
+const (
+	// apiTokenKey holds the *model.ApiToken of a token authenticated request
+	apiTokenKey = "api_token"
+	// loginSessionKey holds the *model.LoginSession of a session request
+	loginSessionKey = "login_session"
+	// sessionEndedKey holds the *locale.Error of the session limit the session
+	// of a request went over
+	sessionEndedKey = "session_ended"
+)
+
+type BaseController struct {
+	sessionUsers service.UserService
+	apiTokens    service.ApiTokenService
+	auditLog     service.AuditService
+	sessionStore service.LoginSessionService
+	tgbot        service.Tgbot
+}
+
+// checkApiAuth accepts an "Authorization: Bearer" API token in place of the
+// session cookie. Token requests act as the token's owner and never touch the
+// session; read-only tokens are limited to requests that don't change anything.
+func (a *BaseController) checkApiAuth(c *gin.Context) {
+	secret, ok := bearerToken(c)
+	if !ok {
+		a.checkLogin(c)
+		return
+	}
+	token, err := a.apiTokens.Authenticate(secret)
+	if err != nil {
+		logger.Warningf("API token rejected, IP: \"%s\": %v", middleware.ClientIP(c), err)
+		jsonError(c, http.StatusUnauthorized, locale.ErrInvalidApiToken)
+		c.Abort()
+		return
+	}
+	if token.Scope != service.ApiTokenScopeReadWrite && !isReadOnlyRequest(c) {
+		jsonError(c, http.StatusForbidden, locale.ErrReadOnlyApiToken)
+		c.Abort()
+		return
+	}
+	user, err := a.sessionUsers.GetUserById(token.UserId)
+	if err != nil {
+		jsonError(c, http.StatusUnauthorized, locale.ErrInvalidApiToken)
+		c.Abort()
+		return
+	}
+	session.SetRequestUser(c, user)
+	c.Set(apiTokenKey, token)
+	middleware.SetActor(c, "token:"+token.Name)
+	a.tgbot.UserLoginNotify(service.LoginNotice{
+		Status:    service.LoginSuccess,
+		Username:  user.Username,
+		Ip:        middleware.ClientIP(c),
+		PeerIp:    c.RemoteIP(),
+		UserAgent: c.Request.UserAgent(),
+		ApiToken:  token.Name,
+		Time:      time.Now(),
+	})
+	logger.Debugf("API token %q: %s %s", token.Name, c.Request.Method, c.Request.URL.Path)
+	c.Next()
+}
+
+// sessionOnly rejects token authenticated requests, for endpoints that manage
+// credentials and must not be reachable with a leaked token.
+func (a *BaseController) sessionOnly(c *gin.Context) {
+	if _, ok := c.Get(apiTokenKey); ok {
+		jsonError(c, http.StatusForbidden, locale.ErrSessionRequired)
+		c.Abort()
+		return
+	}
+	c.Next()
+}
 
 func (a *BaseController) checkLogin(c *gin.Context) {
-	if !session.IsLogin(c) {
-		if isAjax(c) {
-			pureJsonMsg(c, http.StatusUnauthorized, false, I18nWeb(c, "pages.login.loginAgain"))
+	if user := session.GetLoginUser(c); user != nil {
+		current := a.sessionUsers.GetSessionUser(user.Id, session.GetLoginTime(c))
+		var loginSession *model.LoginSession
+		var err error
+		if current != nil {
+			loginSession, err = a.sessionStore.Validate(session.GetSessionId(c), current, middleware.ClientIP(c), c.Request.UserAgent())
+		}
+		if current != nil && err == nil {
+			// Act as the stored user, so role changes apply to existing sessions
+			session.SetRequestUser(c, current)
+			c.Set(loginSessionKey, loginSession)
+		} else {
+			if err != nil {
+				logger.Debug("login session rejected:", err)
+			}
+			sessionEnded(c, err)
+			logger.Infof("%s session was revoked", user.Username)
+			session.ClearSession(c)
+			if err := sessions.Default(c).Save(); err != nil {
+				logger.Warning("Unable to save session after clearing:", err)
+			}
+		}
+	}
+	if !session.IsLogin(c) && !a.refreshLogin(c) {
+		if isAjax(c) || isApiV2(c) {
+			ended, _ := c.Get(sessionEndedKey)
+			if coded, ok := ended.(*locale.Error); ok {
+				jsonError(c, http.StatusUnauthorized, coded.Code, coded.Params...)
+			} else {
+				jsonError(c, http.StatusUnauthorized, locale.ErrSessionExpired)
+			}
 		} else {
 			c.Redirect(http.StatusTemporaryRedirect, c.GetString("base_path"))
 		}
@@ -25,6 +129,69 @@ func (a *BaseController) checkLogin(c *gin.Context) {
 	}
 }
 
+// refreshLogin logs the request in again with the refresh token of a
+// remember-me login, rotating its tokens. WebSocket upgrades can't set cookies,
+// they wait for another request to refresh.
+func (a *BaseController) refreshLogin(c *gin.Context) bool {
+	refresh := session.GetRefreshToken(c)
+	if refresh == "" || websocket.IsWebSocketUpgrade(c.Request) {
+		return false
+	}
+	remoteIp := middleware.ClientIP(c)
+	login, err := a.sessionStore.Refresh(refresh, session.GetDeviceId(c), remoteIp, c.Request.UserAgent())
+	if login != nil && login.Reused {
+		username := ""
+		if user, err := a.sessionUsers.GetUserById(login.Session.UserId); err == nil {
+			username = user.Username
+		}
+		logger.Warningf("reused refresh token of %q, IP: \"%s\", the login was ended", username, remoteIp)
+		logger.Auth(false, remoteIp, username, service.LoginReasonRefreshReused)
+		a.tgbot.RefreshReused(username, remoteIp)
+	}
+	if err != nil {
+		logger.Debug("refresh token rejected:", err)
+		sessionEnded(c, err)
+		// The cookie of a token another request of the device rotated a moment
+		// ago is the rotated one, it must not be removed
+		if login == nil || !login.Rotated {
+			session.ClearRefreshToken(c)
+		}
+		return false
+	}
+	// The login is as old as the session, not as its last refresh
+	user := a.sessionUsers.GetSessionUser(login.Session.UserId, login.Session.CreatedAt)
+	if user == nil {
+		session.ClearRefreshToken(c)
+		return false
+	}
+	if err := setRememberedLogin(c, user, login); err != nil {
+		logger.Warning("Unable to save session: ", err)
+		return false
+	}
+	session.SetRequestUser(c, user)
+	c.Set(loginSessionKey, login.Session)
+	return true
+}
+
+// sessionEnded keeps err for the reply to the request, if the session of the
+// request was ended for going over a session limit.
+func sessionEnded(c *gin.Context, err error) {
+	if coded, ok := locale.CodeOf(err); ok {
+		c.Set(sessionEndedKey, coded)
+	}
+}
+
+// setRememberedLogin issues the cookies of a remember-me login: the session
+// until the session token expires, and the refresh token for the rest.
+func setRememberedLogin(c *gin.Context, user *model.User, login *service.RememberedLogin) error {
+	now := time.Now().UnixMilli()
+	session.SetMaxAge(c, int((login.Session.ExpiresAt-now)/1000))
+	session.SetLoginUser(c, user)
+	session.SetSessionId(c, login.Token)
+	session.SetRefreshToken(c, login.RefreshToken, int((login.Session.RefreshExpiresAt-now)/1000))
+	return sessions.Default(c).Save()
+}
+
 func I18nWeb(c *gin.Context, name string, params ...string) string {
 	anyfunc, funcExists := c.Get("I18n")
 	if !funcExists {
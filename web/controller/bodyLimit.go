@@ -0,0 +1,27 @@
+package controller
+
+import (
+	"x-ui/web/entity"
+	"x-ui/web/middleware"
+
+	"github.com/gin-gonic/gin"
+)
+
+// BodyLimit limits the request bodies to the configured sizes; the database
+// restore, the panel import and the inbound import take larger uploads than the other routes.
+func BodyLimit(allSetting *entity.AllSetting) gin.HandlerFunc {
+	const mb = 1 << 20
+	restore := int64(allSetting.MaxBodySizeRestore) * mb
+	inboundImport := int64(allSetting.MaxBodySizeImport) * mb
+	return middleware.BodyLimit(middleware.BodyLimitConfig{
+		Default: int64(allSetting.MaxBodySize) * mb,
+		Routes: map[string]int64{
+			"POST server/importDB":                   restore,
+			"POST panel/api/import":                  restore,
+			"POST panel/api/import/foreign":          restore,
+			"POST panel/inbound/import":              inboundImport,
+			"POST panel/api/inbounds/inbound/import": inboundImport,
+			"POST panel/api/inbounds/import":         inboundImport,
+		},
+	})
+}
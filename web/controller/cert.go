@@ -0,0 +1,30 @@
+package controller
+
+import (
+	"x-ui/web/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CertController reloads the certificates of the panel, of the subscriptions
+// and of the inbounds without a restart.
+type CertController struct {
+	certReloadService service.CertReloadService
+}
+
+func NewCertController(g *gin.RouterGroup) *CertController {
+	a := &CertController{}
+	a.initRouter(g)
+	return a
+}
+
+func (a *CertController) initRouter(g *gin.RouterGroup) {
+	g.POST("/reload", a.reload)
+}
+
+// reload loads every certificate from its files again, changed or not, and
+// replies how it went for each; those that failed keep being served as they
+// were.
+func (a *CertController) reload(c *gin.Context) {
+	jsonMsgObj(c, I18nWeb(c, "pages.settings.certsReloaded"), a.certReloadService.Reload(true), nil)
+}
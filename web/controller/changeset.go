@@ -0,0 +1,150 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"x-ui/web/locale"
+	"x-ui/web/service"
+	"x-ui/web/session"
+
+	"github.com/gin-gonic/gin"
+)
+
+// changesetHeader carries the ID of the changeset a change is staged for; the
+// changeset query parameter does too.
+const changesetHeader = "X-Changeset-Id"
+
+// changesetRoutes are the prefixes, relative to the base path, of the routes
+// that change the inbounds and their clients.
+var changesetRoutes = []string{
+	"panel/api/inbounds",
+	"panel/api/clients",
+	"panel/api/trash",
+	"panel/api/v2/inbounds",
+	"panel/api/v2/clients",
+	"panel/inbound/",
+}
+
+// ChangesetController stages changes of the inbounds and their clients, and
+// applies them to Xray at once.
+type ChangesetController struct {
+	changesetService service.ChangesetService
+}
+
+func NewChangesetController(g *gin.RouterGroup) *ChangesetController {
+	a := &ChangesetController{}
+	a.initRouter(g)
+	return a
+}
+
+func (a *ChangesetController) initRouter(g *gin.RouterGroup) {
+	g.GET("", a.getOpen)
+	g.POST("/begin", a.begin)
+	g.GET("/:id/diff", a.diff)
+	g.POST("/:id/commit", a.commit)
+	g.DELETE("/:id", a.discard)
+}
+
+// getOpen replies with the open changeset, null if there is none.
+func (a *ChangesetController) getOpen(c *gin.Context) {
+	jsonObj(c, service.OpenChangeset(), nil)
+}
+
+// begin opens the changeset named in the JSON body. The changes made with its
+// ID are written to the database but not applied to Xray until it is committed.
+func (a *ChangesetController) begin(c *gin.Context) {
+	body := struct {
+		Name string `json:"name"`
+	}{}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&body); err != nil {
+			jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.changesetBegun"), err)
+			return
+		}
+	}
+	createdBy := ""
+	if user := session.GetLoginUser(c); user != nil {
+		createdBy = user.Username
+	}
+	changeset, err := a.changesetService.Begin(strings.TrimSpace(body.Name), createdBy)
+	if err == nil {
+		setAuditTarget(c, "changeset", changeset.Id)
+	}
+	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.toasts.changesetBegun"), changeset, err)
+}
+
+func (a *ChangesetController) diff(c *gin.Context) {
+	preview, err := a.changesetService.Diff(c.Param("id"))
+	if errors.Is(err, service.ErrNoChangeset) {
+		jsonError(c, http.StatusNotFound, locale.ErrChangesetNotOpen, "Id=="+c.Param("id"))
+		return
+	}
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	jsonObj(c, preview, nil)
+}
+
+// commit applies the changeset by one restart of Xray, and replies with what it
+// applied. A config Xray rejects, or a restart it isn't healthy after, rolls
+// the changes back and fails the reply.
+func (a *ChangesetController) commit(c *gin.Context) {
+	setAuditTarget(c, "changeset", c.Param("id"))
+	result, err := a.changesetService.Commit(c.Param("id"))
+	if errors.Is(err, service.ErrNoChangeset) {
+		jsonError(c, http.StatusNotFound, locale.ErrChangesetNotOpen, "Id=="+c.Param("id"))
+		return
+	}
+	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.toasts.changesetCommitted"), result, err)
+}
+
+// discard rolls back the changes of the changeset and closes it.
+func (a *ChangesetController) discard(c *gin.Context) {
+	setAuditTarget(c, "changeset", c.Param("id"))
+	err := a.changesetService.Discard(c.Param("id"))
+	if errors.Is(err, service.ErrNoChangeset) {
+		jsonError(c, http.StatusNotFound, locale.ErrChangesetNotOpen, "Id=="+c.Param("id"))
+		return
+	}
+	jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.changesetDiscarded"), err)
+}
+
+// checkChangeset rejects, while a changeset is open, the changes of the
+// inbounds and their clients that don't carry its ID: they would be rolled
+// back with it, or applied by its commit without being part of it. Changes
+// carrying the ID of a changeset that isn't open are rejected too.
+func (a *BaseController) checkChangeset(c *gin.Context) {
+	id := c.GetHeader(changesetHeader)
+	if id == "" {
+		id = c.Query("changeset")
+	}
+	open := service.OpenChangeset()
+	if (open == nil && id == "") || isReadOnlyRequest(c) || !isChangesetRoute(c) {
+		c.Next()
+		return
+	}
+	if open == nil {
+		jsonError(c, http.StatusNotFound, locale.ErrChangesetNotOpen, "Id=="+id)
+		c.Abort()
+		return
+	}
+	if id != open.Id {
+		jsonError(c, http.StatusConflict, locale.ErrChangesetOpen, "Name=="+open.Name, "Id=="+open.Id)
+		c.Abort()
+		return
+	}
+	c.Next()
+}
+
+func isChangesetRoute(c *gin.Context) bool {
+	route := strings.TrimPrefix(c.FullPath(), c.GetString("base_path"))
+	for _, prefix := range changesetRoutes {
+		if strings.HasPrefix(route, prefix) {
+			return true
+		}
+	}
+	return false
+}
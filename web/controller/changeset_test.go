@@ -0,0 +1,116 @@
+package controller
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/web/locale"
+	"x-ui/web/service"
+)
+
+// changesetReply is the JSON reply of the panel API.
+type changesetReply struct {
+	Success bool             `json:"success"`
+	Msg     string           `json:"msg"`
+	Code    locale.ErrorCode `json:"code"`
+	Obj     json.RawMessage  `json:"obj"`
+}
+
+// sendWithChangeset sends the request with the token of secret and, if
+// changeset isn't empty, the ID of the changeset in its header.
+func sendWithChangeset(t *testing.T, engine http.Handler, method string, path string, secret string, changeset string) (int, changesetReply) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(method, path, nil)
+	r.Header.Set("Authorization", "Bearer "+secret)
+	if changeset != "" {
+		r.Header.Set(changesetHeader, changeset)
+	}
+	engine.ServeHTTP(w, r)
+	var reply changesetReply
+	if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+		t.Fatalf("%s %s replied %d: %s", method, path, w.Code, w.Body)
+	}
+	return w.Code, reply
+}
+
+func TestChangesetAPI(t *testing.T) {
+	engine, _ := apiTestEngine(t)
+	var admin model.User
+	if err := database.GetDB().Where("username = ?", "admin").First(&admin).Error; err != nil {
+		t.Fatal(err)
+	}
+	secret, _, err := (&service.ApiTokenService{}).CreateToken(admin.Id, "changes", service.ApiTokenScopeReadWrite, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inbound := &model.Inbound{
+		Remark: "reseller", Enable: true, Port: 24451, Protocol: model.Trojan, Tag: "inbound-24451",
+		Settings: `{"clients":[{"password":"p1","email":"reseller-1","enable":true}]}`,
+	}
+	addTestInbound(t, inbound, "reseller-1")
+	t.Cleanup(func() {
+		if open := service.OpenChangeset(); open != nil {
+			(&service.ChangesetService{}).Discard(open.Id)
+		}
+	})
+	deletePath := "/panel/api/inbounds/del/" + strconv.Itoa(inbound.Id)
+
+	code, reply := sendWithChangeset(t, engine, http.MethodPost, "/panel/api/changes/begin", secret, "")
+	var changeset service.Changeset
+	if code != http.StatusOK || !reply.Success || json.Unmarshal(reply.Obj, &changeset) != nil {
+		t.Fatalf("beginning the changeset replied %d: %+v", code, reply)
+	}
+	if _, reply := sendWithChangeset(t, engine, http.MethodPost, "/panel/api/changes/begin", secret, ""); reply.Success {
+		t.Error("a second changeset was begun")
+	}
+	if _, reply := sendWithChangeset(t, engine, http.MethodGet, "/panel/api/changes", secret, ""); !strings.Contains(string(reply.Obj), changeset.Id) {
+		t.Errorf("the open changeset is %s, want %s", reply.Obj, changeset.Id)
+	}
+
+	// The changes without its ID are rejected, telling how to join it
+	for _, id := range []string{"", "other"} {
+		code, reply := sendWithChangeset(t, engine, http.MethodPost, deletePath, secret, id)
+		if code != http.StatusConflict || reply.Code != locale.ErrChangesetOpen || !strings.Contains(reply.Msg, changeset.Id) || !strings.Contains(reply.Msg, changesetHeader) {
+			t.Errorf("a change with the changeset %q replied %d: %+v", id, code, reply)
+		}
+	}
+	// Reads are not
+	if code, reply := sendWithChangeset(t, engine, http.MethodGet, "/panel/api/inbounds/list", secret, ""); code != http.StatusOK || !reply.Success {
+		t.Errorf("listing the inbounds replied %d: %+v", code, reply)
+	}
+	if code, reply := sendWithChangeset(t, engine, http.MethodGet, "/panel/api/changes/other/diff", secret, ""); code != http.StatusNotFound || reply.Code != locale.ErrChangesetNotOpen {
+		t.Errorf("the diff of another changeset replied %d: %+v", code, reply)
+	}
+
+	// The query parameter carries the ID too
+	if code, reply := sendWithChangeset(t, engine, http.MethodPost, deletePath+"?changeset="+changeset.Id, secret, ""); code != http.StatusOK || !reply.Success {
+		t.Fatalf("the staged change replied %d: %+v", code, reply)
+	}
+	var count int64
+	database.GetDB().Model(&model.Inbound{}).Count(&count)
+	if count != 0 {
+		t.Error("the staged deletion isn't written to the database")
+	}
+
+	if code, reply := sendWithChangeset(t, engine, http.MethodDelete, "/panel/api/changes/"+changeset.Id, secret, ""); code != http.StatusOK || !reply.Success {
+		t.Fatalf("discarding the changeset replied %d: %+v", code, reply)
+	}
+	database.GetDB().Model(&model.Inbound{}).Count(&count)
+	if count != 1 {
+		t.Error("the discarded deletion isn't rolled back")
+	}
+	// Once it is closed, its ID is rejected
+	if code, reply := sendWithChangeset(t, engine, http.MethodPost, deletePath, secret, changeset.Id); code != http.StatusNotFound || reply.Code != locale.ErrChangesetNotOpen {
+		t.Errorf("a change with the closed changeset replied %d: %+v", code, reply)
+	}
+	if code, reply := sendWithChangeset(t, engine, http.MethodPost, "/panel/api/changes/"+changeset.Id+"/commit", secret, ""); code != http.StatusNotFound {
+		t.Errorf("committing the closed changeset replied %d: %+v", code, reply)
+	}
+}
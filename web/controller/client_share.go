@@ -0,0 +1,149 @@
+package controller
+
+import (
+	"net/http"
+	"strconv"
+
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/web/locale"
+	"x-ui/web/middleware"
+	"x-ui/web/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+const clientShareKey = "client_share"
+
+// ClientShareController serves the management page of a single client to the
+// holders of its share links, without logging in. The link carries its secret in
+// the fragment of the page URL, which the page sends as a bearer token.
+type ClientShareController struct {
+	clientShareService service.ClientShareService
+	xrayService        service.XrayService
+	auditService       service.AuditService
+}
+
+func NewClientShareController(g *gin.RouterGroup) *ClientShareController {
+	a := &ClientShareController{}
+	a.initRouter(g)
+	return a
+}
+
+func (a *ClientShareController) initRouter(g *gin.RouterGroup) {
+	g.GET("/share", a.sharePage)
+
+	api := g.Group("/share/api")
+	api.Use(a.checkShare)
+	api.GET("/client", a.getClient)
+	api.POST("/reset", a.resetTraffic)
+	api.POST("/extend", a.extend)
+}
+
+func (a *ClientShareController) sharePage(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	c.Header("Referrer-Policy", "no-referrer")
+	html(c, "share.html", "pages.share.title", nil)
+}
+
+// checkShare resolves the share link of the bearer token, replying 410 for one
+// that expired or was revoked.
+func (a *ClientShareController) checkShare(c *gin.Context) {
+	secret, ok := bearerToken(c)
+	if !ok {
+		jsonError(c, http.StatusUnauthorized, locale.ErrNotFound)
+		c.Abort()
+		return
+	}
+	share, err := a.clientShareService.Resolve(secret)
+	if err != nil {
+		logger.Warningf("client share link rejected, IP: \"%s\": %v", middleware.ClientIP(c), err)
+		if coded, ok := locale.CodeOf(err); ok && coded.Code == locale.ErrShareGone {
+			jsonError(c, http.StatusGone, locale.ErrShareGone)
+		} else if ok && coded.Code == locale.ErrNotFound {
+			jsonError(c, http.StatusNotFound, locale.ErrNotFound)
+		} else {
+			jsonError(c, http.StatusInternalServerError, locale.ErrInternal)
+		}
+		c.Abort()
+		return
+	}
+	c.Set(clientShareKey, share)
+	c.Next()
+}
+
+func (a *ClientShareController) getShare(c *gin.Context) *model.ClientShare {
+	return c.MustGet(clientShareKey).(*model.ClientShare)
+}
+
+// record writes an action taken over share to the audit log, with the link and
+// who created it.
+func (a *ClientShareController) record(c *gin.Context, share *model.ClientShare, action string, before map[string]any, after map[string]any, err error) {
+	if after == nil {
+		after = map[string]any{}
+	}
+	after["shareId"] = share.Id
+	after["createdBy"] = share.CreatedBy
+	a.auditService.Record(&model.AuditLog{
+		Actor:      "share:" + strconv.Itoa(share.Id),
+		Action:     action,
+		EntityType: "client",
+		EntityId:   share.Email,
+		Ip:         middleware.ClientIP(c),
+		Success:    err == nil,
+		Diff:       service.AuditDiff(before, after),
+	})
+}
+
+func (a *ClientShareController) getClient(c *gin.Context) {
+	share := a.getShare(c)
+	usage, err := a.clientShareService.Usage(share)
+	a.record(c, share, "client.share.view", nil, nil, err)
+	jsonObj(c, usage, err)
+}
+
+func (a *ClientShareController) resetTraffic(c *gin.Context) {
+	share := a.getShare(c)
+	before, _ := a.clientShareService.Usage(share)
+	needRestart, err := a.clientShareService.ResetTraffic(share)
+	if needRestart {
+		a.xrayService.SetToNeedRestart()
+	}
+	after, _ := a.clientShareService.Usage(share)
+	a.record(c, share, "client.share.reset", shareAuditUsage(before), shareAuditUsage(after), err)
+	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.toasts.resetInboundClientTrafficSuccess"), after, err)
+}
+
+func (a *ClientShareController) extend(c *gin.Context) {
+	share := a.getShare(c)
+	form := &struct {
+		Days int `json:"days" form:"days"`
+	}{}
+	if err := c.ShouldBind(form); err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	before, _ := a.clientShareService.Usage(share)
+	_, needRestart, err := a.clientShareService.Extend(share, form.Days)
+	if needRestart {
+		a.xrayService.SetToNeedRestart()
+	}
+	after, _ := a.clientShareService.Usage(share)
+	auditAfter := shareAuditUsage(after)
+	auditAfter["days"] = form.Days
+	a.record(c, share, "client.share.extend", shareAuditUsage(before), auditAfter, err)
+	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.toasts.inboundClientUpdateSuccess"), after, err)
+}
+
+// shareAuditUsage returns the fields of usage the audit log compares.
+func shareAuditUsage(usage *service.ClientShareUsage) map[string]any {
+	if usage == nil {
+		return map[string]any{}
+	}
+	return map[string]any{
+		"enable":     usage.Enable,
+		"up":         usage.Up,
+		"down":       usage.Down,
+		"expiryTime": usage.ExpiryTime,
+	}
+}
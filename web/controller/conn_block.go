@@ -0,0 +1,55 @@
+package controller
+
+import (
+	"strconv"
+
+	"x-ui/web/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ConnBlockController lists the source IPs blocked for going over the
+// connection limits of inbounds, and lifts their blocks.
+type ConnBlockController struct {
+	connBlockService service.ConnBlockService
+}
+
+func NewConnBlockController(g *gin.RouterGroup) *ConnBlockController {
+	a := &ConnBlockController{}
+	a.initRouter(g)
+	return a
+}
+
+func (a *ConnBlockController) initRouter(g *gin.RouterGroup) {
+	g.GET("", a.getBlocks)
+	g.DELETE("", a.delBlocks)
+	g.DELETE("/:id", a.delBlock)
+}
+
+// getBlocks returns the blocks in effect, and whether the connection limits
+// are enforced at all, which they aren't without a block command.
+func (a *ConnBlockController) getBlocks(c *gin.Context) {
+	blocks, err := a.connBlockService.GetBlocks()
+	jsonObj(c, gin.H{"enabled": a.connBlockService.Enabled(), "blocks": blocks}, err)
+}
+
+// delBlock lifts a block before it expires.
+func (a *ConnBlockController) delBlock(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	block, err := a.connBlockService.DeleteBlock(id)
+	if block != nil {
+		setAuditDiff(c, block, nil)
+	}
+	jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.connBlockLifted"), err)
+}
+
+// delBlocks lifts all blocks.
+func (a *ConnBlockController) delBlocks(c *gin.Context) {
+	count, err := a.connBlockService.DeleteBlocks()
+	setAuditDiff(c, map[string]any{"blocks": count}, map[string]any{"blocks": 0})
+	jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.connBlockLifted"), err)
+}
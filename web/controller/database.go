@@ -0,0 +1,40 @@
+package controller
+
+import (
+	"x-ui/web/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DatabaseController shows the size of the database and triggers its
+// optimization.
+type DatabaseController struct {
+	databaseService service.DatabaseService
+}
+
+func NewDatabaseController(g *gin.RouterGroup) *DatabaseController {
+	a := &DatabaseController{}
+	a.initRouter(g)
+	return a
+}
+
+func (a *DatabaseController) initRouter(g *gin.RouterGroup) {
+	g.GET("", a.getStatus)
+	g.POST("/optimize", a.optimize)
+}
+
+func (a *DatabaseController) getStatus(c *gin.Context) {
+	status, err := a.databaseService.GetStatus()
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	jsonObj(c, status, nil)
+}
+
+// optimize vacuums and analyzes the database now, and returns the run with the
+// sizes before and after it. It fails at once while a backup or a restore runs.
+func (a *DatabaseController) optimize(c *gin.Context) {
+	run, err := a.databaseService.Optimize()
+	jsonMsgObj(c, I18nWeb(c, "pages.settings.dbOptimized"), run, err)
+}
@@ -0,0 +1,74 @@
+package controller
+
+import (
+	"strconv"
+	"time"
+
+	"x-ui/web/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DnsController edits the dns section of the Xray config template.
+type DnsController struct {
+	dnsService  service.DnsService
+	xrayService service.XrayService
+}
+
+func NewDnsController(g *gin.RouterGroup) *DnsController {
+	a := &DnsController{}
+	a.initRouter(g)
+	return a
+}
+
+func (a *DnsController) initRouter(g *gin.RouterGroup) {
+	g.GET("", a.getDns)
+	g.POST("/update", a.updateDns)
+	g.GET("/test", a.testResolution)
+}
+
+func (a *DnsController) getDns(c *gin.Context) {
+	config, err := a.dnsService.GetDns()
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	jsonObj(c, config, nil)
+}
+
+func (a *DnsController) updateDns(c *gin.Context) {
+	config := &service.DnsConfig{}
+	if err := c.ShouldBindJSON(config); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.xray.dns.saved"), err)
+		return
+	}
+	old, _ := a.dnsService.GetDns()
+	err := a.dnsService.SaveDns(config)
+	if err == nil {
+		setAuditDiff(c, old, config)
+	}
+	jsonMsgObj(c, I18nWeb(c, "pages.xray.dns.saved"), config, err)
+	if err == nil {
+		a.xrayService.SetToNeedRestart()
+	}
+}
+
+// testResolution resolves a name with every DNS server of the template. It
+// waits timeout seconds for each, 5 by default.
+func (a *DnsController) testResolution(c *gin.Context) {
+	timeout := 5
+	if value := c.Query("timeout"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+			return
+		}
+		timeout = n
+	}
+	answers, err := a.dnsService.TestResolution(c.Query("name"), time.Duration(timeout)*time.Second)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	jsonObj(c, answers, nil)
+}
@@ -0,0 +1,40 @@
+package controller
+
+import (
+	"x-ui/web/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GeodataController shows and triggers the updates of the geoip and geosite
+// files.
+type GeodataController struct {
+	geodataService service.GeodataService
+}
+
+func NewGeodataController(g *gin.RouterGroup) *GeodataController {
+	a := &GeodataController{}
+	a.initRouter(g)
+	return a
+}
+
+func (a *GeodataController) initRouter(g *gin.RouterGroup) {
+	g.GET("", a.getStatus)
+	g.POST("/update", a.update)
+}
+
+func (a *GeodataController) getStatus(c *gin.Context) {
+	status, err := a.geodataService.GetStatus()
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	jsonObj(c, status, nil)
+}
+
+// update downloads the geodata files now. Files that failed are listed with
+// their error in the status, next to those that were updated.
+func (a *GeodataController) update(c *gin.Context) {
+	status, err := a.geodataService.Update()
+	jsonMsgObj(c, I18nWeb(c, "pages.index.geofileUpdatePopover"), status, err)
+}
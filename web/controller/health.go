@@ -0,0 +1,57 @@
+package controller
+
+import (
+	"net/http"
+
+	"x-ui/web/middleware"
+	"x-ui/web/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HealthController serves the probe of load balancers and uptime monitors. It
+// is not behind the login check and can be turned off in the settings.
+type HealthController struct {
+	settingService service.SettingService
+	healthService  service.HealthService
+}
+
+func NewHealthController(g *gin.RouterGroup) *HealthController {
+	a := &HealthController{}
+	a.initRouter(g)
+	return a
+}
+
+func (a *HealthController) initRouter(g *gin.RouterGroup) {
+	g.GET("/healthz", a.healthz)
+}
+
+// healthz answers 200 when the database, Xray and the subscription server are
+// up, and 503 naming the failed components otherwise. With ?verbose=1 the
+// result and latency of every check are included.
+func (a *HealthController) healthz(c *gin.Context) {
+	enabled, err := a.settingService.GetHealthzEnable()
+	if err != nil || !enabled {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	report := a.healthService.Check()
+	status, code := "ok", http.StatusOK
+	if !report.Healthy() {
+		status, code = "fail", http.StatusServiceUnavailable
+	} else {
+		// Only failed probes are worth a line in the access log
+		middleware.SkipAccessLog(c)
+	}
+
+	body := gin.H{"status": status}
+	if !report.Healthy() {
+		body["failed"] = report.Failed
+	}
+	if verbose := c.Query("verbose"); verbose == "1" || verbose == "true" {
+		body["checks"] = report.Checks
+	}
+	c.Header("Cache-Control", "no-store")
+	c.JSON(code, body)
+}
@@ -2,19 +2,42 @@ package controller
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/sub"
+	"x-ui/util/common"
+	"x-ui/web/entity"
+	"x-ui/web/locale"
+	"x-ui/web/middleware"
 	"x-ui/web/service"
 	"x-ui/web/session"
+	"x-ui/xray"
 
 	"github.com/gin-gonic/gin"
 )
 
 type InboundController struct {
-	inboundService service.InboundService
-	xrayService    service.XrayService
+	inboundService         service.InboundService
+	xrayService            service.XrayService
+	settingService         service.SettingService
+	inboundTemplateService service.InboundTemplateService
+	subAccessService       service.SubAccessService
+	clientShareService     service.ClientShareService
+	tgbot                  service.Tgbot
+}
+
+// bulkClient is a client created in a batch, with what its user needs to connect.
+type bulkClient struct {
+	model.Client
+	Link   string `json:"link"`
+	SubURL string `json:"subUrl,omitempty"`
 }
 
 func NewInboundController(g *gin.RouterGroup) *InboundController {
@@ -43,163 +66,1254 @@ func (a *InboundController) initRouter(g *gin.RouterGroup) {
 	g.POST("/onlines", a.onlines)
 }
 
-func (a *InboundController) getInbounds(c *gin.Context) {
-	user := session.GetLoginUser(c)
-	inbounds, err := a.inboundService.GetInbounds(user.Id)
+// getInbounds lists all inbounds with all their clients. It is deprecated for
+// the pages of pageInbounds, which a panel with many clients can reply.
+func (a *InboundController) getInbounds(c *gin.Context) {
+	c.Header("Deprecation", "true")
+	c.Header("Link", "<"+c.GetString("base_path")+"panel/api/inbounds>; rel=\"successor-version\"")
+	// Inbounds are shared by all panel users, whoever created them
+	inbounds, err := a.inboundService.GetAllInbounds()
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.obtain"), err)
+		return
+	}
+	jsonObj(c, inbounds, nil)
+}
+
+// inboundPageQuery is a page of the inbounds, with fields "summary", the
+// default, or "full".
+type inboundPageQuery struct {
+	apiV2PageQuery
+	Fields string `form:"fields"`
+}
+
+// pageInbounds lists a page of the inbounds by id. Their summaries leave out
+// the settings and the clients for the counts and the traffic of the clients;
+// the full inbounds are those of getInbounds.
+func (a *InboundController) pageInbounds(c *gin.Context) {
+	query := inboundPageQuery{}
+	if err := c.ShouldBindQuery(&query); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.obtain"), err)
+		return
+	}
+	page, size, offset := query.bounds()
+	var items any
+	var total int64
+	var err error
+	switch query.Fields {
+	case "", "summary":
+		items, total, err = a.inboundService.ListInboundSummaries(size, offset)
+	case "full":
+		items, total, err = a.inboundService.ListInbounds(size, offset)
+	default:
+		err = common.NewErrorf("unknown fields %q", query.Fields)
+	}
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.obtain"), err)
+		return
+	}
+	jsonObj(c, entity.Page{Items: items, Total: total, Page: page, PageSize: size}, nil)
+}
+
+// inboundClientsQuery is a page of the clients of an inbound.
+type inboundClientsQuery struct {
+	apiV2PageQuery
+	service.InboundClientQuery
+}
+
+// pageInboundClients lists a page of the clients of an inbound, filtered,
+// searched by email and sorted as the query asks.
+func (a *InboundController) pageInboundClients(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "get"), err)
+		return
+	}
+	query := inboundClientsQuery{}
+	if err := c.ShouldBindQuery(&query); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.obtain"), err)
+		return
+	}
+	page, size, offset := query.bounds()
+	clients, total, err := a.inboundService.ListInboundClients(id, query.InboundClientQuery, size, offset)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.obtain"), err)
+		return
+	}
+	jsonObj(c, entity.Page{Items: clients, Total: total, Page: page, PageSize: size}, nil)
+}
+
+func (a *InboundController) getInbound(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "get"), err)
+		return
+	}
+	inbound, err := a.inboundService.GetInbound(id)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.obtain"), err)
+		return
+	}
+	jsonObj(c, inbound, nil)
+}
+
+func (a *InboundController) getClientTraffics(c *gin.Context) {
+	email := c.Param("email")
+	clientTraffics, err := a.inboundService.GetClientTrafficByEmail(email)
+	if err == nil {
+		err = a.inboundService.SetNextResets(clientTraffics)
+	}
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.trafficGetError"), err)
+		return
+	}
+	jsonObj(c, clientTraffics, nil)
+}
+
+func (a *InboundController) getClientTrafficsById(c *gin.Context) {
+	id := c.Param("id")
+	clientTraffics, err := a.inboundService.GetClientTrafficByID(id)
+	if err == nil {
+		traffics := make([]*xray.ClientTraffic, len(clientTraffics))
+		for i := range clientTraffics {
+			traffics[i] = &clientTraffics[i]
+		}
+		err = a.inboundService.SetNextResets(traffics...)
+	}
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.trafficGetError"), err)
+		return
+	}
+	jsonObj(c, clientTraffics, nil)
+}
+
+// setInboundTag names an inbound after the address and the port it listens on.
+func setInboundTag(inbound *model.Inbound) {
+	if inbound.Listen == "" || inbound.Listen == "0.0.0.0" || inbound.Listen == "::" || inbound.Listen == "::0" {
+		inbound.Tag = fmt.Sprintf("inbound-%v", inbound.Port)
+	} else {
+		inbound.Tag = fmt.Sprintf("inbound-%v:%v", inbound.Listen, inbound.Port)
+	}
+}
+
+func (a *InboundController) addInbound(c *gin.Context) {
+	inbound := &model.Inbound{}
+	err := c.ShouldBind(inbound)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.inboundCreateSuccess"), err)
+		return
+	}
+	if inbound.TemplateId != 0 {
+		if err := a.inboundTemplateService.ApplyTemplate(inbound); err != nil {
+			jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+			return
+		}
+	}
+	user := session.GetLoginUser(c)
+	inbound.UserId = user.Id
+	setInboundTag(inbound)
+
+	needRestart := false
+	inbound, needRestart, err = a.inboundService.AddInbound(inbound)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	jsonMsgObj(c, a.proxyWarning(c, inbound, I18nWeb(c, "pages.inbounds.toasts.inboundCreateSuccess")), inbound, nil)
+	if needRestart {
+		a.xrayService.SetToNeedRestart()
+	}
+}
+
+// cloneInbound adds a copy of an inbound on another port and replies with it.
+func (a *InboundController) cloneInbound(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	opts := &service.InboundClone{}
+	if err := c.ShouldBind(opts); err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	user := session.GetLoginUser(c)
+	inbound, needRestart, err := a.inboundService.CloneInbound(id, opts, user.Id)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	if needRestart {
+		a.xrayService.SetToNeedRestart()
+	}
+	inbound, err = a.inboundService.GetInbound(inbound.Id)
+	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.toasts.inboundCreateSuccess"), inbound, err)
+}
+
+func (a *InboundController) delInbound(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.inboundDeleteSuccess"), err)
+		return
+	}
+	needRestart := true
+	if isPermanent(c) {
+		needRestart, err = a.inboundService.DelInbound(id)
+	} else {
+		needRestart, err = a.inboundService.TrashInbound(id, auditActor(c))
+	}
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.toasts.inboundDeleteSuccess"), id, nil)
+	if needRestart {
+		a.xrayService.SetToNeedRestart()
+	}
+}
+
+func (a *InboundController) updateInbound(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.inboundUpdateSuccess"), err)
+		return
+	}
+	inbound := &model.Inbound{
+		Id: id,
+	}
+	err = c.ShouldBind(inbound)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.inboundUpdateSuccess"), err)
+		return
+	}
+	before := a.auditInbound(id)
+	needRestart := true
+	inbound, needRestart, err = a.inboundService.UpdateInbound(inbound)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	setAuditDiff(c, before, a.auditInbound(id))
+	jsonMsgObj(c, a.proxyWarning(c, inbound, I18nWeb(c, "pages.inbounds.toasts.inboundUpdateSuccess")), inbound, nil)
+	if needRestart {
+		a.xrayService.SetToNeedRestart()
+	}
+}
+
+// inboundScheduleForm carries the schedule of an inbound, in JSON in forms.
+type inboundScheduleForm struct {
+	Schedule *model.InboundSchedule `json:"schedule" form:"schedule"`
+}
+
+// setInboundSchedule sets the schedule of an inbound, which switches it to the
+// state the schedule has it in now.
+func (a *InboundController) setInboundSchedule(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	form := &inboundScheduleForm{}
+	if err = c.ShouldBind(form); err == nil && form.Schedule == nil {
+		err = common.NewError("no schedule given")
+	}
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	a.saveInboundSchedule(c, id, form.Schedule)
+}
+
+// delInboundSchedule deletes the schedule of an inbound, which is then always
+// on again.
+func (a *InboundController) delInboundSchedule(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	a.saveInboundSchedule(c, id, nil)
+}
+
+func (a *InboundController) saveInboundSchedule(c *gin.Context, id int, schedule *model.InboundSchedule) {
+	before := a.auditInbound(id)
+	inbound, needRestart, err := a.inboundService.SetInboundSchedule(id, schedule)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	setAuditDiff(c, before, a.auditInbound(id))
+	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.toasts.scheduleSaved"), inbound, nil)
+	if needRestart {
+		a.xrayService.SetToNeedRestart()
+	}
+}
+
+// inboundLimitsForm carries the limits of the clients of an inbound, in JSON in
+// forms.
+type inboundLimitsForm struct {
+	Limits *model.InboundLimits `json:"limits" form:"limits"`
+}
+
+// setInboundLimits sets the limits of the clients of an inbound. Only admins
+// reach it, the operators managing the clients are bound by the limits.
+func (a *InboundController) setInboundLimits(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	form := &inboundLimitsForm{}
+	if err = c.ShouldBind(form); err == nil && form.Limits == nil {
+		err = common.NewError("no limits given")
+	}
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	a.saveInboundLimits(c, id, form.Limits)
+}
+
+// delInboundLimits removes the limits of the clients of an inbound.
+func (a *InboundController) delInboundLimits(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	a.saveInboundLimits(c, id, nil)
+}
+
+func (a *InboundController) saveInboundLimits(c *gin.Context, id int, limits *model.InboundLimits) {
+	before := a.auditInbound(id)
+	inbound, err := a.inboundService.SetInboundLimits(id, limits)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	setAuditDiff(c, before, a.auditInbound(id))
+	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.toasts.limitsSaved"), inbound, nil)
+}
+
+// inboundConnLimitsForm carries the connection limits of an inbound, in JSON in
+// forms.
+type inboundConnLimitsForm struct {
+	ConnLimits *model.InboundConnLimits `json:"connLimits" form:"connLimits"`
+}
+
+// setInboundConnLimits sets the limits of the connections of each source IP to
+// an inbound.
+func (a *InboundController) setInboundConnLimits(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	form := &inboundConnLimitsForm{}
+	if err = c.ShouldBind(form); err == nil && form.ConnLimits == nil {
+		err = common.NewError("no connection limits given")
+	}
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	a.saveInboundConnLimits(c, id, form.ConnLimits)
+}
+
+// delInboundConnLimits removes the connection limits of an inbound.
+func (a *InboundController) delInboundConnLimits(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	a.saveInboundConnLimits(c, id, nil)
+}
+
+func (a *InboundController) saveInboundConnLimits(c *gin.Context, id int, limits *model.InboundConnLimits) {
+	before := a.auditInbound(id)
+	inbound, err := a.inboundService.SetInboundConnLimits(id, limits)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	setAuditDiff(c, before, a.auditInbound(id))
+	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.toasts.connLimitsSaved"), inbound, nil)
+}
+
+// realityDestsForm carries the fallback dests of a Reality inbound, one per
+// line, or the dest to switch it to.
+type realityDestsForm struct {
+	Dests string `json:"dests" form:"dests"`
+	Dest  string `json:"dest" form:"dest"`
+}
+
+// setRealityDests sets the dests a Reality inbound falls back to, in order,
+// when its dest keeps failing the health checks.
+func (a *InboundController) setRealityDests(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	form := &realityDestsForm{}
+	if err := c.ShouldBind(form); err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	before := a.auditInbound(id)
+	inbound, err := a.inboundService.SetRealityDests(id, strings.Fields(form.Dests))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	setAuditDiff(c, before, a.auditInbound(id))
+	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.toasts.realityDestsSaved"), inbound, nil)
+}
+
+// setRealityDest switches a Reality inbound to another dest, such as back to
+// the one it fell back from.
+func (a *InboundController) setRealityDest(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	form := &realityDestsForm{}
+	if err := c.ShouldBind(form); err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	before := a.auditInbound(id)
+	inbound, needRestart, err := a.inboundService.SetRealityDest(id, form.Dest)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	setAuditDiff(c, before, a.auditInbound(id))
+	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.toasts.realityDestSwitched"), inbound, nil)
+	if needRestart {
+		a.xrayService.SetToNeedRestart()
+	}
+}
+
+// proxyWarning returns msg with a warning about the external proxies of
+// inbound whose hosts do not resolve, if there are some.
+func (a *InboundController) proxyWarning(c *gin.Context, inbound *model.Inbound, msg string) string {
+	hosts := a.inboundService.UnresolvedProxyHosts(inbound)
+	if len(hosts) == 0 {
+		return msg
+	}
+	return msg + " " + I18nWeb(c, "pages.inbounds.toasts.externalProxyUnresolved", "Hosts=="+strings.Join(hosts, ", "))
+}
+
+func (a *InboundController) getClientIps(c *gin.Context) {
+	email := c.Param("email")
+
+	ips, err := a.inboundService.GetInboundClientIps(email)
+	if err != nil || ips == "" {
+		jsonObj(c, "No IP Record", nil)
+		return
+	}
+
+	jsonObj(c, ips, nil)
+}
+
+// getClientIpRecord replies with the IPs a client was seen from and the ones it
+// was last disabled for.
+func (a *InboundController) getClientIpRecord(c *gin.Context) {
+	ips, err := a.inboundService.GetClientIps(c.Param("email"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	jsonObj(c, ips, nil)
+}
+
+// getSubAccess replies with the last fetches of the subscription of a client,
+// at most limit of them.
+func (a *InboundController) getSubAccess(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	accesses, err := a.subAccessService.GetSubAccess(c.Param("email"), limit)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.obtain"), err)
+		return
+	}
+	jsonObj(c, accesses, nil)
+}
+
+// getSubDevices replies with the devices the subscription of a client is
+// fetched on, by the labels of their URLs.
+func (a *InboundController) getSubDevices(c *gin.Context) {
+	devices, err := a.subAccessService.GetClientSubDevices(c.Param("email"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.obtain"), err)
+		return
+	}
+	jsonObj(c, devices, nil)
+}
+
+// revokeSubDevice takes the subscription away from a device of a client by
+// rotating its subscription ID, and sends the new link to the Telegram user of
+// the client.
+func (a *InboundController) revokeSubDevice(c *gin.Context) {
+	email, device := c.Param("email"), c.Param("device")
+	result, needRestart, err := a.subAccessService.RevokeSubDevice(email, device)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	if needRestart {
+		a.xrayService.SetToNeedRestart()
+	}
+	setAuditDiff(c, gin.H{}, gin.H{"device": device, "rotated": result.Rotated})
+
+	subURL, _ := a.settingService.GetSubLink(requestHost(c), result.SubId)
+	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.toasts.inboundClientUpdateSuccess"), gin.H{
+		"email":    result.Email,
+		"device":   device,
+		"rotated":  result.Rotated,
+		"subUrl":   subURL,
+		"notified": a.tgbot.SubDeviceRevoked(result, device),
+	}, nil)
+}
+
+// createShareAccess creates a link for managing the client without logging in,
+// replying with its secret and the path of its page, with the secret in the
+// fragment. Neither is available again afterwards.
+func (a *InboundController) createShareAccess(c *gin.Context) {
+	form := &struct {
+		ExpiresAt     int64 `json:"expiresAt" form:"expiresAt"`
+		MaxExtendDays int   `json:"maxExtendDays" form:"maxExtendDays"`
+	}{}
+	if err := c.ShouldBind(form); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.shareAccessCreate"), err)
+		return
+	}
+	createdBy := auditActor(c)
+	secret, share, err := a.clientShareService.CreateShare(c.Param("email"), createdBy, form.ExpiresAt, form.MaxExtendDays)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.shareAccessCreate"), err)
+		return
+	}
+	logger.Infof("%s created share link %d of client %s, until %d", createdBy, share.Id, share.Email, share.ExpiresAt)
+	setAuditDiff(c, nil, share)
+	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.toasts.shareAccessCreated"), gin.H{
+		"token": secret,
+		"path":  c.GetString("base_path") + "share#" + secret,
+		"info":  share,
+	}, nil)
+}
+
+// getShareAccess lists the share links of the client, the expired and revoked
+// ones too.
+func (a *InboundController) getShareAccess(c *gin.Context) {
+	shares, err := a.clientShareService.GetShares(c.Param("email"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.obtain"), err)
+		return
+	}
+	jsonObj(c, shares, nil)
+}
+
+// revokeShareAccess ends a share link of the client at once.
+func (a *InboundController) revokeShareAccess(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	share, err := a.clientShareService.RevokeShare(c.Param("email"), id)
+	if err == nil {
+		setAuditDiff(c, map[string]any{"shareId": share.Id, "revokedAt": 0}, map[string]any{"shareId": share.Id, "revokedAt": share.RevokedAt})
+	}
+	jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.shareAccessRevoked"), err)
+}
+
+// getClientQR replies with the QR code image of a share link of a client, the
+// one of inbound if given and the first one unless index says otherwise, or of
+// its subscription URL with type=sub.
+func (a *InboundController) getClientQR(c *gin.Context) {
+	email := c.Param("email")
+	size := service.QRCodeDefaultSize
+	if value := c.Query("size"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+			return
+		}
+		size = n
+	}
+	index, _ := strconv.Atoi(c.Query("index"))
+
+	traffic, inbound, err := a.inboundService.GetClientInboundByEmail(email)
+	if err == nil && inbound == nil {
+		err = common.NewError("Inbound Not Found For Email:", email)
+	}
+	if err == nil && c.Query("inbound") != "" {
+		var id int
+		if id, err = strconv.Atoi(c.Query("inbound")); err == nil && id != traffic.InboundId {
+			err = common.NewErrorf("client %s is not of inbound %d", email, id)
+		}
+	}
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.obtain"), err)
+		return
+	}
+
+	host := requestHost(c)
+	content := ""
+	switch c.DefaultQuery("type", "link") {
+	case "link":
+		if inbound.Protocol == model.WireGuard {
+			// The peer is set up by its wg-quick config
+			if content, err = a.inboundService.WireguardConf(inbound, email, host); err != nil {
+				jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.obtain"), err)
+				return
+			}
+			break
+		}
+		remarkModel, err := a.settingService.GetRemarkModel()
+		if err != nil || remarkModel == "" {
+			remarkModel = "-ieo"
+		}
+		links := strings.Split(sub.NewSubService(false, remarkModel).GetLink(inbound, email, host), "\n")
+		if index >= 0 && index < len(links) {
+			content = links[index]
+		}
+	case "sub":
+		clients, err := a.inboundService.GetClients(inbound)
+		if err != nil {
+			jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.obtain"), err)
+			return
+		}
+		for _, client := range clients {
+			if client.Email == email {
+				content, _ = a.settingService.GetSubLink(host, client.SubID)
+			}
+		}
+	default:
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), common.NewError("type must be link or sub:", c.Query("type")))
+		return
+	}
+	if content == "" {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.obtain"), common.NewError("no link to encode for", email))
+		return
+	}
+
+	image, contentType, err := service.EncodeQRCode(content, size, c.Query("level"), c.Query("format"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	// The link carries the credential of the client
+	c.Header("Cache-Control", "no-store")
+	c.Data(http.StatusOK, contentType, image)
+}
+
+// getClientLinks replies with the share links of a client, made as the panel
+// and the subscriptions make them, and the URLs of its subscription. The links
+// are what the QR codes encode. A peer of a WireGuard inbound has its wg-quick
+// config instead, as a file with format=conf.
+func (a *InboundController) getClientLinks(c *gin.Context) {
+	email := c.Param("email")
+	_, inbound, err := a.inboundService.GetClientInboundByEmail(email)
+	if err == nil && inbound == nil {
+		err = common.NewError("Inbound Not Found For Email:", email)
+	}
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.obtain"), err)
+		return
+	}
+	clients, err := a.inboundService.GetClients(inbound)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.obtain"), err)
+		return
+	}
+	subId := ""
+	for _, client := range clients {
+		if client.Email == email {
+			subId = client.SubID
+		}
+	}
+
+	host := requestHost(c)
+	config := ""
+	if inbound.Protocol == model.WireGuard {
+		if config, err = a.inboundService.WireguardConf(inbound, email, host); err != nil {
+			jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.obtain"), err)
+			return
+		}
+		if c.Query("format") == "conf" {
+			c.Header("Cache-Control", "no-store")
+			c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", email+".conf"))
+			c.Data(http.StatusOK, "text/plain; charset=utf-8", []byte(config))
+			return
+		}
+	}
+	remarkModel, err := a.settingService.GetRemarkModel()
+	if err != nil || remarkModel == "" {
+		remarkModel = "-ieo"
+	}
+	subService := sub.NewSubService(false, remarkModel)
+	subLinks, err := a.settingService.GetSubLinks(host, subId)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.obtain"), err)
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	jsonObj(c, gin.H{
+		"email":        email,
+		"subId":        subId,
+		"remarkModel":  remarkModel,
+		"subscription": subLinks,
+		"inbounds": []gin.H{{
+			"id":             inbound.Id,
+			"tag":            inbound.Tag,
+			"remark":         inbound.Remark,
+			"protocol":       inbound.Protocol,
+			"remarkTemplate": subService.RemarkTemplate(inbound),
+			"links":          subService.GetShareLinks(inbound, email, host),
+			"config":         config,
+		}},
+	}, nil)
+}
+
+func (a *InboundController) clearClientIps(c *gin.Context) {
+	email := c.Param("email")
+
+	err := a.inboundService.ClearClientIps(email)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.updateSuccess"), err)
+		return
+	}
+	jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.logCleanSuccess"), nil)
+}
+
+func (a *InboundController) addInboundClient(c *gin.Context) {
+	data := &model.Inbound{}
+	err := c.ShouldBind(data)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.inboundUpdateSuccess"), err)
+		return
+	}
+
+	setAuditTarget(c, "inbound", strconv.Itoa(data.Id))
+	before := a.auditInbound(data.Id)
+	needRestart := true
+
+	needRestart, err = a.inboundService.AddInboundClient(data)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	setAuditDiff(c, before, a.auditInbound(data.Id))
+	jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.inboundClientAddSuccess"), nil)
+	if needRestart {
+		a.xrayService.SetToNeedRestart()
+	}
+}
+
+// addBulkClients creates a batch of clients with generated credentials. Either
+// all of them are added or none; on failure the reply names the client at fault.
+func (a *InboundController) addBulkClients(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	bulk := &service.BulkClients{}
+	if err := c.ShouldBind(bulk); err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	maxCount, err := a.settingService.GetBulkClientsMax()
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+
+	clients, err := a.inboundService.AddBulkClients(id, bulk, maxCount)
+	var bulkErr *service.BulkClientError
+	if errors.As(err, &bulkErr) {
+		jsonMsgObj(c, I18nWeb(c, "somethingWentWrong"), gin.H{"index": bulkErr.Index, "email": bulkErr.Email}, err)
+		return
+	}
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	// One restart for the whole batch
+	a.xrayService.SetToNeedRestart()
+
+	inbound, err := a.inboundService.GetInbound(id)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	host := requestHost(c)
+	remarkModel, err := a.settingService.GetRemarkModel()
+	if err != nil || remarkModel == "" {
+		remarkModel = "-ieo"
+	}
+	subService := sub.NewSubService(false, remarkModel)
+	subURI := ""
+	if defaults, err := a.settingService.GetDefaultSettings(host); err == nil {
+		if settings, ok := defaults.(map[string]any); ok && settings["subEnable"] == true {
+			subURI, _ = settings["subURI"].(string)
+		}
+	}
+
+	result := make([]bulkClient, len(clients))
+	for i, client := range clients {
+		result[i] = bulkClient{
+			Client: client,
+			Link:   subService.GetLink(inbound, client.Email, host),
+		}
+		if subURI != "" {
+			result[i].SubURL = subURI + client.SubID
+		}
+	}
+	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.toasts.inboundClientAddSuccess"), result, nil)
+}
+
+// listClients lists the clients of all inbounds, those with a tag if "tag" is
+// given.
+func (a *InboundController) listClients(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	offset, _ := strconv.Atoi(c.Query("offset"))
+	clients, total, err := a.inboundService.ListClients(c.Query("tag"), limit, offset)
 	if err != nil {
 		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.obtain"), err)
 		return
 	}
-	jsonObj(c, inbounds, nil)
+	jsonObj(c, gin.H{"total": total, "clients": clients}, nil)
 }
 
-func (a *InboundController) getInbound(c *gin.Context) {
-	id, err := strconv.Atoi(c.Param("id"))
+// getInactiveClients lists the enabled and unexpired clients with no traffic
+// and no subscription fetch for "days", 30 if not given, and tells whether
+// their traffic was checked in the history or in the counters.
+func (a *InboundController) getInactiveClients(c *gin.Context) {
+	days := 30
+	if value := c.Query("days"); value != "" {
+		var err error
+		if days, err = strconv.Atoi(value); err != nil {
+			jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+			return
+		}
+	}
+	clients, source, err := a.inboundService.InactiveClients(days)
 	if err != nil {
-		jsonMsg(c, I18nWeb(c, "get"), err)
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.obtain"), err)
 		return
 	}
-	inbound, err := a.inboundService.GetInbound(id)
+	jsonObj(c, gin.H{"days": days, "source": source, "clients": clients}, nil)
+}
+
+// searchClients finds clients of all inbounds by email, UUID, subscription or
+// Telegram ID.
+func (a *InboundController) searchClients(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	offset, _ := strconv.Atoi(c.Query("offset"))
+	hits, total, err := a.inboundService.SearchClients(c.Query("q"), limit, offset)
 	if err != nil {
 		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.obtain"), err)
 		return
 	}
-	jsonObj(c, inbound, nil)
+	jsonObj(c, gin.H{"total": total, "hits": hits}, nil)
 }
 
-func (a *InboundController) getClientTraffics(c *gin.Context) {
-	email := c.Param("email")
-	clientTraffics, err := a.inboundService.GetClientTrafficByEmail(email)
+// exportClients downloads the clients of all inbounds, or of the "inbound"
+// given, as CSV or XLSX, filtered by "tag" and "q" as the listing and search
+// are, with their traffic of the month of "period".
+func (a *InboundController) exportClients(c *gin.Context) {
+	query := service.ClientExportQuery{}
+	if err := c.ShouldBindQuery(&query); err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	export, err := a.inboundService.ExportClients(query)
 	if err != nil {
-		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.trafficGetError"), err)
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.obtain"), err)
 		return
 	}
-	jsonObj(c, clientTraffics, nil)
+	defer export.Close()
+	c.Header("Content-Disposition", "attachment; filename="+export.Filename())
+	c.Header("Content-Type", export.ContentType())
+	c.Header("Cache-Control", "no-store")
+	c.Status(http.StatusOK)
+	if err := export.Write(c.Writer); err != nil {
+		logger.Warning("client export failed:", err)
+	}
 }
 
-func (a *InboundController) getClientTrafficsById(c *gin.Context) {
-	id := c.Param("id")
-	clientTraffics, err := a.inboundService.GetClientTrafficByID(id)
+// bulkUpdateClients applies one change to a selection of clients across
+// inbounds and replies with the result for every client.
+func (a *InboundController) bulkUpdateClients(c *gin.Context) {
+	update := &service.BulkClientUpdate{}
+	if err := c.ShouldBindJSON(update); err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	maxCount, err := a.settingService.GetBulkClientsMax()
 	if err != nil {
-		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.trafficGetError"), err)
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
 		return
 	}
-	jsonObj(c, clientTraffics, nil)
-}
 
-func (a *InboundController) addInbound(c *gin.Context) {
-	inbound := &model.Inbound{}
-	err := c.ShouldBind(inbound)
+	results, needRestart, err := a.inboundService.UpdateBulkClients(update, maxCount)
+	var bulkErr *service.BulkClientError
+	if errors.As(err, &bulkErr) {
+		jsonMsgObj(c, I18nWeb(c, "somethingWentWrong"), gin.H{"index": bulkErr.Index, "email": bulkErr.Email}, err)
+		return
+	}
 	if err != nil {
-		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.inboundCreateSuccess"), err)
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
 		return
 	}
-	user := session.GetLoginUser(c)
-	inbound.UserId = user.Id
-	if inbound.Listen == "" || inbound.Listen == "0.0.0.0" || inbound.Listen == "::" || inbound.Listen == "::0" {
-		inbound.Tag = fmt.Sprintf("inbound-%v", inbound.Port)
-	} else {
-		inbound.Tag = fmt.Sprintf("inbound-%v:%v", inbound.Listen, inbound.Port)
+	if needRestart {
+		// One restart for the whole batch
+		a.xrayService.SetToNeedRestart()
 	}
+	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.toasts.inboundClientUpdateSuccess"), results, nil)
+}
 
-	needRestart := false
-	inbound, needRestart, err = a.inboundService.AddInbound(inbound)
-	if err != nil {
+// renewClient extends a client by a paid period. A retried request with the
+// same Idempotency-Key header doesn't renew again.
+func (a *InboundController) renewClient(c *gin.Context) {
+	email := c.Param("email")
+	renew := &service.ClientRenew{}
+	if err := c.ShouldBind(renew); err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	before := a.auditClient(email)
+	result, needRestart, err := a.inboundService.RenewClient(email, renew, c.GetHeader("Idempotency-Key"))
+	if coded, ok := locale.CodeOf(err); ok {
+		jsonError(c, http.StatusOK, coded.Code, coded.Params...)
+		return
+	} else if err != nil {
 		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
 		return
 	}
-	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.toasts.inboundCreateSuccess"), inbound, nil)
 	if needRestart {
 		a.xrayService.SetToNeedRestart()
 	}
+	if !result.Replayed {
+		after := a.auditClient(email)
+		after["renew"] = renew
+		setAuditDiff(c, before, after)
+	}
+	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.toasts.inboundClientUpdateSuccess"), result, nil)
 }
 
-func (a *InboundController) delInbound(c *gin.Context) {
-	id, err := strconv.Atoi(c.Param("id"))
+// previewCleanup lists the clients the next cleanup run deletes, by the grace
+// and inactivity periods in the request or else the ones set, without deleting
+// any.
+func (a *InboundController) previewCleanup(c *gin.Context) {
+	form := &struct {
+		GraceDays    int `json:"graceDays" form:"graceDays"`
+		InactiveDays int `json:"inactiveDays" form:"inactiveDays"`
+	}{}
+	if err := c.ShouldBind(form); err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	if form.GraceDays == 0 {
+		days, err := a.settingService.GetClientCleanupDays()
+		if err != nil {
+			jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+			return
+		}
+		form.GraceDays = days
+	}
+	if form.InactiveDays == 0 {
+		form.InactiveDays = a.settingService.GetClientCleanupInactiveDays()
+	}
+	trialGrace, err := a.settingService.GetTrialCleanup()
 	if err != nil {
-		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.inboundDeleteSuccess"), err)
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
 		return
 	}
-	needRestart := true
-	needRestart, err = a.inboundService.DelInbound(id)
+	candidates, total, err := a.inboundService.CleanupCandidates(form.GraceDays, form.InactiveDays, trialGrace, service.ClientCleanupMaxPerRun)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	jsonObj(c, gin.H{
+		"graceDays":    form.GraceDays,
+		"inactiveDays": form.InactiveDays,
+		"trialHours":   int(trialGrace.Hours()),
+		"total":        total,
+		"maxPerRun":    service.ClientCleanupMaxPerRun,
+		"candidates":   candidates,
+	}, nil)
+}
+
+// rotateClient replaces the subscription ID or the credential of a client and
+// returns its new links. The audit log records what was replaced, not the new
+// values.
+func (a *InboundController) rotateClient(c *gin.Context) {
+	email := c.Param("email")
+	rotate := &service.ClientRotate{}
+	if err := c.ShouldBind(rotate); err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	result, needRestart, err := a.inboundService.RotateClient(email, rotate)
 	if err != nil {
 		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
 		return
 	}
-	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.toasts.inboundDeleteSuccess"), id, nil)
 	if needRestart {
 		a.xrayService.SetToNeedRestart()
 	}
+	setAuditDiff(c, gin.H{}, gin.H{"rotated": result.Rotated})
+
+	host := requestHost(c)
+	remarkModel, err := a.settingService.GetRemarkModel()
+	if err != nil || remarkModel == "" {
+		remarkModel = "-ieo"
+	}
+	links := make([]string, 0)
+	if link := sub.NewSubService(false, remarkModel).GetLink(result.Inbound, result.Email, host); link != "" {
+		links = strings.Split(link, "\n")
+	}
+	subURL, _ := a.settingService.GetSubLink(host, result.SubId)
+	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.toasts.inboundClientUpdateSuccess"), gin.H{
+		"email":     result.Email,
+		"inboundId": result.InboundId,
+		"rotated":   result.Rotated,
+		"links":     links,
+		"subUrl":    subURL,
+	}, nil)
 }
 
-func (a *InboundController) updateInbound(c *gin.Context) {
-	id, err := strconv.Atoi(c.Param("id"))
+// getFreePorts hands out random free ports for new inbounds, reserved for a
+// short while.
+func (a *InboundController) getFreePorts(c *gin.Context) {
+	count := 1
+	if value := c.Query("count"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+			return
+		}
+		count = n
+	}
+	ports, err := a.inboundService.GetFreePorts(c.Query("listen"), count)
 	if err != nil {
-		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.inboundUpdateSuccess"), err)
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
 		return
 	}
-	inbound := &model.Inbound{
-		Id: id,
+	jsonObj(c, ports, nil)
+}
+
+// getRealityKeys generates a Reality key pair and short IDs, count of them of
+// length hex digits, 8 of all lengths by default.
+func (a *InboundController) getRealityKeys(c *gin.Context) {
+	count, length := 8, 0
+	var err error
+	if value := c.Query("count"); value != "" {
+		if count, err = strconv.Atoi(value); err != nil {
+			jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+			return
+		}
 	}
-	err = c.ShouldBind(inbound)
+	if value := c.Query("length"); value != "" {
+		if length, err = strconv.Atoi(value); err != nil {
+			jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+			return
+		}
+	}
+	keys, err := service.NewRealityKeys(count, length)
 	if err != nil {
-		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.inboundUpdateSuccess"), err)
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
 		return
 	}
-	needRestart := true
-	inbound, needRestart, err = a.inboundService.UpdateInbound(inbound)
+	jsonObj(c, keys, nil)
+}
+
+// checkRealityDest tells whether the dest of a Reality inbound answers with TLS
+// 1.3 for its server names, given comma separated. It waits timeout seconds, 5
+// by default.
+func (a *InboundController) checkRealityDest(c *gin.Context) {
+	timeout := 5
+	if value := c.Query("timeout"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+			return
+		}
+		timeout = n
+	}
+	var serverNames []string
+	if value := c.Query("serverNames"); value != "" {
+		serverNames = strings.Split(value, ",")
+	}
+	checks, err := service.CheckRealityDest(c.Query("dest"), serverNames, time.Duration(timeout)*time.Second)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	jsonObj(c, checks, nil)
+}
+
+// checkInbound checks whether an inbound listens and, with a prober in the
+// settings, whether it is reachable from outside: at the "host" of the form, or
+// the host of the settings.
+func (a *InboundController) checkInbound(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	check, err := a.inboundService.CheckInbound(id, c.PostForm("host"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	jsonObj(c, check, nil)
+}
+
+// retryBind puts an inbound that failed to bind its port back in the config of
+// Xray, once its port is free; the inbound comes with its bind state.
+func (a *InboundController) retryBind(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
 		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
 		return
 	}
-	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.toasts.inboundUpdateSuccess"), inbound, nil)
+	inbound, needRestart, err := a.inboundService.RetryBind(id)
+	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.toasts.bindRetried"), inbound, err)
 	if needRestart {
 		a.xrayService.SetToNeedRestart()
 	}
 }
 
-func (a *InboundController) getClientIps(c *gin.Context) {
-	email := c.Param("email")
+// probe connects to the host and port of a service.ProbeRequest, for another
+// panel that has this one as its prober; without a host, to the address the
+// request came from.
+func (a *InboundController) probe(c *gin.Context) {
+	req := &service.ProbeRequest{}
+	if err := c.ShouldBind(req); err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	if req.Host == "" {
+		req.Host = middleware.ClientIP(c)
+	}
+	result, err := service.Probe(req)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	jsonObj(c, result, nil)
+}
 
-	ips, err := a.inboundService.GetInboundClientIps(email)
-	if err != nil || ips == "" {
-		jsonObj(c, "No IP Record", nil)
+// getDuplicateEmails lists the emails used by more than one client.
+func (a *InboundController) getDuplicateEmails(c *gin.Context) {
+	duplicates, err := a.inboundService.GetDuplicateEmails()
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
 		return
 	}
+	jsonObj(c, duplicates, nil)
+}
 
-	jsonObj(c, ips, nil)
+// repairDuplicateEmails renames the clients that share their email with
+// another one.
+func (a *InboundController) repairDuplicateEmails(c *gin.Context) {
+	renames, needRestart, err := a.inboundService.RepairDuplicateEmails()
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	if needRestart {
+		a.xrayService.SetToNeedRestart()
+	}
+	setAuditDiff(c, gin.H{}, gin.H{"renamed": renames})
+	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.toasts.inboundClientUpdateSuccess"), renames, nil)
 }
 
-func (a *InboundController) clearClientIps(c *gin.Context) {
+// moveClient moves a client to another inbound, or copies it there.
+func (a *InboundController) moveClient(c *gin.Context) {
 	email := c.Param("email")
-
-	err := a.inboundService.ClearClientIps(email)
+	move := &service.ClientMove{}
+	if err := c.ShouldBind(move); err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	before := a.auditClient(email)
+	before["inboundId"] = a.auditClientInbound(email)
+	result, needRestart, err := a.inboundService.MoveClient(email, move)
 	if err != nil {
-		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.updateSuccess"), err)
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
 		return
 	}
-	jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.logCleanSuccess"), nil)
+	if needRestart {
+		a.xrayService.SetToNeedRestart()
+	}
+	after := a.auditClient(result.Email)
+	after["inboundId"] = result.InboundId
+	if move.Copy {
+		after["copiedFrom"] = email
+	}
+	setAuditDiff(c, before, after)
+	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.toasts.inboundClientUpdateSuccess"), result, nil)
 }
 
-func (a *InboundController) addInboundClient(c *gin.Context) {
-	data := &model.Inbound{}
-	err := c.ShouldBind(data)
+// bulkDelClients deletes a selection of clients across inbounds and replies with
+// the result for every client.
+func (a *InboundController) bulkDelClients(c *gin.Context) {
+	selection := &service.BulkClientSelection{}
+	if err := c.ShouldBindJSON(selection); err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	maxCount, err := a.settingService.GetBulkClientsMax()
 	if err != nil {
-		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.inboundUpdateSuccess"), err)
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
 		return
 	}
 
-	needRestart := true
-
-	needRestart, err = a.inboundService.AddInboundClient(data)
+	results, needRestart, err := a.inboundService.DelBulkClients(selection, maxCount, auditActor(c), isPermanent(c))
+	var bulkErr *service.BulkClientError
+	if errors.As(err, &bulkErr) {
+		jsonMsgObj(c, I18nWeb(c, "somethingWentWrong"), gin.H{"index": bulkErr.Index, "email": bulkErr.Email}, err)
+		return
+	}
 	if err != nil {
 		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
 		return
 	}
-	jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.inboundClientAddSuccess"), nil)
 	if needRestart {
+		// One restart for the whole batch
 		a.xrayService.SetToNeedRestart()
 	}
+	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.toasts.inboundClientDeleteSuccess"), results, nil)
+}
+
+// bulkNotifyClients sends a Telegram message to a selection of clients and
+// replies with the result for every client.
+func (a *InboundController) bulkNotifyClients(c *gin.Context) {
+	notify := &service.BulkClientNotify{}
+	if err := c.ShouldBindJSON(notify); err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	maxCount, err := a.settingService.GetBulkClientsMax()
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+
+	results, err := a.inboundService.NotifyBulkClients(notify, maxCount)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	jsonObj(c, results, nil)
 }
 
 func (a *InboundController) delInboundClient(c *gin.Context) {
@@ -210,13 +1324,19 @@ func (a *InboundController) delInboundClient(c *gin.Context) {
 	}
 	clientId := c.Param("clientId")
 
+	before := a.auditInbound(id)
 	needRestart := true
 
-	needRestart, err = a.inboundService.DelInboundClient(id, clientId)
+	if isPermanent(c) {
+		needRestart, err = a.inboundService.DelInboundClient(id, clientId)
+	} else {
+		needRestart, err = a.inboundService.TrashInboundClient(id, clientId, auditActor(c))
+	}
 	if err != nil {
 		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
 		return
 	}
+	setAuditDiff(c, before, a.auditInbound(id))
 	jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.inboundClientDeleteSuccess"), nil)
 	if needRestart {
 		a.xrayService.SetToNeedRestart()
@@ -233,6 +1353,8 @@ func (a *InboundController) updateInboundClient(c *gin.Context) {
 		return
 	}
 
+	setAuditTarget(c, "inbound", strconv.Itoa(inbound.Id))
+	before := a.auditInbound(inbound.Id)
 	needRestart := true
 
 	needRestart, err = a.inboundService.UpdateInboundClient(inbound, clientId)
@@ -240,6 +1362,7 @@ func (a *InboundController) updateInboundClient(c *gin.Context) {
 		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
 		return
 	}
+	setAuditDiff(c, before, a.auditInbound(inbound.Id))
 	jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.inboundClientUpdateSuccess"), nil)
 	if needRestart {
 		a.xrayService.SetToNeedRestart()
@@ -254,7 +1377,8 @@ func (a *InboundController) resetClientTraffic(c *gin.Context) {
 	}
 	email := c.Param("email")
 
-	needRestart, err := a.inboundService.ResetClientTraffic(id, email)
+	carryOver, _ := strconv.ParseBool(c.PostForm("carryOver"))
+	needRestart, err := a.inboundService.ResetClientTraffic(id, email, carryOver)
 	if err != nil {
 		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
 		return
@@ -303,11 +1427,7 @@ func (a *InboundController) importInbound(c *gin.Context) {
 	user := session.GetLoginUser(c)
 	inbound.Id = 0
 	inbound.UserId = user.Id
-	if inbound.Listen == "" || inbound.Listen == "0.0.0.0" || inbound.Listen == "::" || inbound.Listen == "::0" {
-		inbound.Tag = fmt.Sprintf("inbound-%v", inbound.Port)
-	} else {
-		inbound.Tag = fmt.Sprintf("inbound-%v:%v", inbound.Listen, inbound.Port)
-	}
+	setInboundTag(inbound)
 
 	for index := range inbound.ClientStats {
 		inbound.ClientStats[index].Id = 0
@@ -322,6 +1442,62 @@ func (a *InboundController) importInbound(c *gin.Context) {
 	}
 }
 
+// exportInbound replies with an inbound as a portable document, without the
+// traffic counters with "stripTraffic".
+func (a *InboundController) exportInbound(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "get"), err)
+		return
+	}
+	stripTraffic, _ := strconv.ParseBool(c.Query("stripTraffic"))
+	doc, err := a.inboundService.ExportInbound(id, stripTraffic)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.obtain"), err)
+		return
+	}
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=inbound-%d.json", doc.Inbound.Port))
+	c.JSON(http.StatusOK, doc)
+}
+
+// getInboundConnections returns the TCP connections and UDP flows to an
+// inbound of the last sample, with the ones of its clients where Xray tells
+// their IPs.
+func (a *InboundController) getInboundConnections(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "get"), err)
+		return
+	}
+	connections, err := a.xrayService.GetInboundConnections(id)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	jsonObj(c, connections, nil)
+}
+
+// importInboundExport creates an inbound from a document of exportInbound. The
+// "conflict" query parameter tells what to do about ports and emails in use,
+// newKeys=true gives a WireGuard inbound and its peers new keys.
+func (a *InboundController) importInboundExport(c *gin.Context) {
+	data, err := c.GetRawData()
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	user := session.GetLoginUser(c)
+	result, needRestart, err := a.inboundService.ImportInbound(data, c.Query("conflict"), c.Query("newKeys") == "true", user.Id)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	if needRestart {
+		a.xrayService.SetToNeedRestart()
+	}
+	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.toasts.inboundCreateSuccess"), result, nil)
+}
+
 func (a *InboundController) delDepletedClients(c *gin.Context) {
 	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
@@ -340,6 +1516,17 @@ func (a *InboundController) onlines(c *gin.Context) {
 	jsonObj(c, a.inboundService.GetOnlineClients(), nil)
 }
 
+// getOnlineClients lists the clients seen within the online window, with their
+// inbound, when they were last seen and the IPs they connect from.
+func (a *InboundController) getOnlineClients(c *gin.Context) {
+	clients, err := a.inboundService.ListOnlineClients()
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.obtain"), err)
+		return
+	}
+	jsonObj(c, clients, nil)
+}
+
 func (a *InboundController) updateClientTraffic(c *gin.Context) {
 	email := c.Param("email")
 
@@ -364,3 +1551,38 @@ func (a *InboundController) updateClientTraffic(c *gin.Context) {
 
 	jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.inboundClientUpdateSuccess"), nil)
 }
+
+// auditClient returns the limits and the state of a client for the audit log.
+// auditClientInbound returns the inbound of a client for the audit log, or 0.
+func (a *InboundController) auditClientInbound(email string) int {
+	traffic, err := a.inboundService.GetClientTrafficByEmail(email)
+	if err != nil || traffic == nil {
+		return 0
+	}
+	return traffic.InboundId
+}
+
+func (a *InboundController) auditClient(email string) gin.H {
+	traffic, err := a.inboundService.GetClientTrafficByEmail(email)
+	if err != nil || traffic == nil {
+		return gin.H{}
+	}
+	return gin.H{
+		"enable":     traffic.Enable,
+		"total":      traffic.Total,
+		"expiryTime": traffic.ExpiryTime,
+		"up":         traffic.Up,
+		"down":       traffic.Down,
+	}
+}
+
+// auditInbound loads an inbound for the audit diff, without the traffic counters
+// that change on their own.
+func (a *InboundController) auditInbound(id int) *model.Inbound {
+	inbound, err := a.inboundService.GetInbound(id)
+	if err != nil {
+		return nil
+	}
+	inbound.Up, inbound.Down = 0, 0
+	return inbound
+}
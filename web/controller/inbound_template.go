@@ -0,0 +1,86 @@
+package controller
+
+import (
+	"strconv"
+
+	"x-ui/database/model"
+	"x-ui/web/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+type inboundTemplateForm struct {
+	model.InboundTemplate
+	// InboundId saves the inbound with this id as the template, instead of the
+	// fields of the form
+	InboundId int `json:"inboundId" form:"inboundId"`
+}
+
+// InboundTemplateController manages the templates inbounds are created from.
+type InboundTemplateController struct {
+	inboundTemplateService service.InboundTemplateService
+}
+
+func NewInboundTemplateController(g *gin.RouterGroup) *InboundTemplateController {
+	a := &InboundTemplateController{}
+	a.initRouter(g)
+	return a
+}
+
+func (a *InboundTemplateController) initRouter(g *gin.RouterGroup) {
+	g.GET("", a.getTemplates)
+	g.POST("", a.saveTemplate)
+	g.POST("/:id/clone", a.cloneTemplate)
+	g.DELETE("/:id", a.delTemplate)
+}
+
+func (a *InboundTemplateController) getTemplates(c *gin.Context) {
+	templates, err := a.inboundTemplateService.GetTemplates()
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	jsonObj(c, templates, nil)
+}
+
+func (a *InboundTemplateController) saveTemplate(c *gin.Context) {
+	form := &inboundTemplateForm{}
+	if err := c.ShouldBind(form); err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	template, err := a.inboundTemplateService.SaveTemplate(&form.InboundTemplate, form.InboundId)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	setAuditTarget(c, "inbound_template", strconv.Itoa(template.Id))
+	setAuditDiff(c, gin.H{}, template)
+	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.toasts.templateSaved"), template, nil)
+}
+
+func (a *InboundTemplateController) cloneTemplate(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	template, err := a.inboundTemplateService.CloneTemplate(id, c.PostForm("name"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	setAuditTarget(c, "inbound_template", strconv.Itoa(template.Id))
+	setAuditDiff(c, gin.H{}, template)
+	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.toasts.templateSaved"), template, nil)
+}
+
+func (a *InboundTemplateController) delTemplate(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.templateDeleted"), err)
+		return
+	}
+	err = a.inboundTemplateService.DelTemplate(id)
+	jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.templateDeleted"), err)
+}
@@ -0,0 +1,315 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/sub"
+	"x-ui/web/service"
+	"x-ui/xray"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-contrib/sessions/cookie"
+	"github.com/gin-gonic/gin"
+	"github.com/makiuchi-d/gozxing"
+	"github.com/makiuchi-d/gozxing/qrcode"
+)
+
+// apiTestEngine returns the panel API with subscriptions on, and a token of
+// the admin for it.
+func apiTestEngine(t *testing.T) (*gin.Engine, string) {
+	t.Helper()
+	if err := database.InitDB(t.TempDir() + "/x-ui.db"); err != nil {
+		t.Fatal(err)
+	}
+	db := database.GetDB()
+	if err := db.Create(&model.Setting{Key: "subEnable", Value: "true"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	service.InvalidateSettings()
+	var admin model.User
+	if err := db.Where("username = ?", "admin").First(&admin).Error; err != nil {
+		t.Fatal(err)
+	}
+	secret, _, err := (&service.ApiTokenService{}).CreateToken(admin.Id, "test", service.ApiTokenScopeReadOnly, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.Use(sessions.Sessions("3x-ui", cookie.NewStore([]byte("api-test-secret"))))
+	engine.Use(func(c *gin.Context) { c.Set("base_path", "/") })
+	NewAPIController(engine.Group("/"))
+	return engine, secret
+}
+
+// addTestInbound saves inbound with the traffic of its client email.
+func addTestInbound(t *testing.T, inbound *model.Inbound, email string) {
+	t.Helper()
+	db := database.GetDB()
+	if err := db.Create(inbound).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create(&xray.ClientTraffic{InboundId: inbound.Id, Enable: true, Email: email}).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// qrTestEngine saves a TLS inbound with the client "qr-user" of the
+// subscription "qr-sub", and returns the panel API and a token of the admin.
+func qrTestEngine(t *testing.T) (*gin.Engine, *model.Inbound, string) {
+	t.Helper()
+	engine, secret := apiTestEngine(t)
+	inbound := &model.Inbound{
+		Remark: "Сервер 🇩🇪", Enable: true, Port: 24442, Protocol: model.VLESS, Tag: "inbound-24442",
+		Settings:       `{"clients":[{"id":"5d2b3f8c-1a9e-4c6d-b7f0-8e4a2c1d6b55","flow":"xtls-rprx-vision","email":"qr-user","subId":"qr-sub","enable":true}],"decryption":"none"}`,
+		StreamSettings: `{"network":"tcp","security":"tls","tlsSettings":{"serverName":"cdn.example.com","alpn":["h2"],"settings":{"fingerprint":"chrome"}}}`,
+	}
+	addTestInbound(t, inbound, "qr-user")
+	return engine, inbound, secret
+}
+
+func getWithToken(engine *gin.Engine, path string, secret string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	r.Host = "panel.example.com:2053"
+	if secret != "" {
+		r.Header.Set("Authorization", "Bearer "+secret)
+	}
+	engine.ServeHTTP(w, r)
+	return w
+}
+
+func decodeQRCode(t *testing.T, img image.Image) string {
+	t.Helper()
+	bitmap, err := gozxing.NewBinaryBitmapFromImage(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := qrcode.NewQRCodeReader().Decode(bitmap, map[gozxing.DecodeHintType]any{gozxing.DecodeHintType_TRY_HARDER: true})
+	if err != nil {
+		t.Fatal("the QR code can't be decoded:", err)
+	}
+	return result.GetText()
+}
+
+func TestClientQRCode(t *testing.T) {
+	engine, inbound, secret := qrTestEngine(t)
+	link := sub.NewSubService(false, "-ieo").GetLink(inbound, "qr-user", "panel.example.com")
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"", link},
+		{"?type=link&inbound=1&size=512&level=H", link},
+		{"?type=sub&size=300", "http://panel.example.com:2096/sub/qr-sub"},
+	}
+	for _, test := range tests {
+		w := getWithToken(engine, "/panel/api/clients/qr-user/qr"+test.query, secret)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/png" {
+			t.Fatalf("%s replied %d %s: %s", test.query, w.Code, w.Header().Get("Content-Type"), w.Body)
+		}
+		if cache := w.Header().Get("Cache-Control"); cache != "no-store" {
+			t.Errorf("%s is cached with %q", test.query, cache)
+		}
+		img, err := png.Decode(bytes.NewReader(w.Body.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if content := decodeQRCode(t, img); content != test.want {
+			t.Errorf("the QR code of %s is %q, want %q", test.query, content, test.want)
+		}
+	}
+
+	w := getWithToken(engine, "/panel/api/clients/qr-user/qr?format=svg", secret)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/svg+xml" || !strings.HasPrefix(w.Body.String(), "<?xml") {
+		t.Errorf("the SVG replied %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+}
+
+func TestClientQRCodeRejected(t *testing.T) {
+	engine, _, secret := qrTestEngine(t)
+	for _, query := range []string{
+		"?size=4096", "?size=big", "?level=Z", "?type=wireguard", "?format=gif", "?inbound=2", "?index=3",
+	} {
+		w := getWithToken(engine, "/panel/api/clients/qr-user/qr"+query, secret)
+		var msg struct {
+			Success bool `json:"success"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &msg); err != nil || msg.Success {
+			t.Errorf("%s replied %d %s", query, w.Code, w.Header().Get("Content-Type"))
+		}
+	}
+	if w := getWithToken(engine, "/panel/api/clients/nobody/qr", secret); strings.HasPrefix(w.Header().Get("Content-Type"), "image/") {
+		t.Error("an unknown client has a QR code")
+	}
+
+	// Neither without credentials nor with a wrong token
+	for _, secret := range []string{"", "xui_not-a-token"} {
+		if w := getWithToken(engine, "/panel/api/clients/qr-user/qr", secret); w.Code == http.StatusOK || w.Body.Len() > 0 && strings.HasPrefix(w.Header().Get("Content-Type"), "image/") {
+			t.Errorf("the token %q got the QR code: %d %s", secret, w.Code, w.Header().Get("Content-Type"))
+		}
+	}
+}
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files of testdata")
+
+// randomSpiderX matches the spider path REALITY links get at random.
+var randomSpiderX = regexp.MustCompile(`spx=%2F[0-9A-Za-z]{15}`)
+
+func TestClientLinksGolden(t *testing.T) {
+	engine, secret := apiTestEngine(t)
+	if err := database.GetDB().Create(&model.Setting{Key: "remarkTemplate", Value: "{email} ✈ {protocol}"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	service.InvalidateSettings()
+	// Saved in this order, for the ids of the golden files
+	inbounds := []*model.Inbound{
+		{
+			Remark: "Reality 🇩🇪", Enable: true, Port: 24445, Protocol: model.VLESS, Tag: "inbound-24445",
+			RemarkTemplate: "{inboundRemark} · {email}",
+			Settings:       `{"clients":[{"id":"5d2b3f8c-1a9e-4c6d-b7f0-8e4a2c1d6b55","flow":"xtls-rprx-vision","email":"vless-reality-vision","subId":"shop-1","enable":true}],"decryption":"none"}`,
+			StreamSettings: `{"network":"tcp","security":"reality","realitySettings":{"serverNames":["www.microsoft.com"],"shortIds":["6ba85179e30d4fc2"],"settings":{"publicKey":"jNXHt1yRo0vDuchQlIP6Z0ZvjT3KtzVI-T4E7RoLJS0","fingerprint":"chrome"}},"tcpSettings":{"header":{"type":"none"}}}`,
+		},
+		{
+			Remark: "CDN", Enable: true, Port: 24446, Protocol: model.VMESS, Tag: "inbound-24446",
+			RemarkTemplate: "{inboundRemark} {proxyRemark} {email}",
+			Settings:       `{"clients":[{"id":"0f0c2d7b-6f2e-4b8e-8f4a-2a6e5f1c9d33","security":"auto","email":"vmess-ws-tls","subId":"shop-2","enable":true}]}`,
+			StreamSettings: `{"network":"ws","security":"tls","tlsSettings":{"serverName":"ws.example.com","alpn":["http/1.1"],"settings":{"fingerprint":"firefox"}},"wsSettings":{"path":"/ws","host":"ws.example.com"},"externalProxy":[{"forceTls":"tls","dest":"cdn.example.com","port":443,"remark":"Cloudflare"},{"forceTls":"none","dest":"203.0.113.7","port":8080,"remark":""}]}`,
+		},
+		{
+			Remark: "Trojan", Enable: true, Port: 24447, Protocol: model.Trojan, Tag: "inbound-24447",
+			Settings:       `{"clients":[{"password":"Zq8vN2xL5cR1","email":"trojan-tls","subId":"shop-3","enable":true}]}`,
+			StreamSettings: `{"network":"tcp","security":"tls","tlsSettings":{"serverName":"trojan.example.com","settings":{"allowInsecure":false}},"tcpSettings":{"header":{"type":"none"}}}`,
+		},
+		{
+			Remark: "SS", Enable: true, Port: 24448, Protocol: model.Shadowsocks, Tag: "inbound-24448",
+			Settings:       `{"method":"2022-blake3-aes-128-gcm","password":"aW5ib3VuZC1zZWNyZXQ=","network":"tcp,udp","clients":[{"method":"","password":"Y2xpZW50LXNlY3JldA==","email":"shadowsocks-2022","subId":"shop-4","enable":true}]}`,
+			StreamSettings: `{"network":"tcp","security":"none","tcpSettings":{"header":{"type":"none"}}}`,
+		},
+	}
+	emails := []string{"vless-reality-vision", "vmess-ws-tls", "trojan-tls", "shadowsocks-2022"}
+	for i, inbound := range inbounds {
+		addTestInbound(t, inbound, emails[i])
+	}
+
+	for i, inbound := range inbounds {
+		email := emails[i]
+		t.Run(email, func(t *testing.T) {
+			w := getWithToken(engine, "/panel/api/clients/"+email+"/links", secret)
+			var msg struct {
+				Success bool            `json:"success"`
+				Obj     json.RawMessage `json:"obj"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &msg); err != nil || !msg.Success {
+				t.Fatalf("the links replied %d: %s", w.Code, w.Body)
+			}
+			var indented bytes.Buffer
+			if err := json.Indent(&indented, msg.Obj, "", "  "); err != nil {
+				t.Fatal(err)
+			}
+			linksJSON := randomSpiderX.ReplaceAllString(indented.String(), "spx=%2F{random}") + "\n"
+
+			golden := filepath.Join("testdata", "links", email+".json")
+			if *updateGolden {
+				if err := os.WriteFile(golden, []byte(linksJSON), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if linksJSON != string(want) {
+				t.Errorf("the links differ from %s:\n%s", golden, linksJSON)
+			}
+
+			// The links are those of the panel and the QR codes
+			var links struct {
+				Inbounds []struct {
+					Links []sub.ShareLink `json:"links"`
+				} `json:"inbounds"`
+			}
+			if err := json.Unmarshal(msg.Obj, &links); err != nil {
+				t.Fatal(err)
+			}
+			panelLinks := strings.Split(sub.NewSubService(false, "-ieo").GetLink(inbound, email, "panel.example.com"), "\n")
+			if len(links.Inbounds) != 1 || len(links.Inbounds[0].Links) != len(panelLinks) {
+				t.Fatalf("the links are %+v, the panel has %q", links, panelLinks)
+			}
+			for i, link := range links.Inbounds[0].Links {
+				if randomSpiderX.ReplaceAllString(link.Link, "") != randomSpiderX.ReplaceAllString(panelLinks[i], "") {
+					t.Errorf("the link %q is not the one of the panel %q", link.Link, panelLinks[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRenewClientErrorCodes(t *testing.T) {
+	engine, _ := apiTestEngine(t)
+	var admin model.User
+	if err := database.GetDB().Where("username = ?", "admin").First(&admin).Error; err != nil {
+		t.Fatal(err)
+	}
+	secret, _, err := (&service.ApiTokenService{}).CreateToken(admin.Id, "renew", service.ApiTokenScopeReadWrite, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addTestInbound(t, &model.Inbound{
+		Remark: "trojan", Enable: true, Port: 24443, Protocol: model.Trojan, Tag: "inbound-24443",
+		Settings: `{"clients":[{"password":"p1","email":"renew-user","enable":true},{"password":"p2","email":"renew-twice","enable":true}]}`,
+	}, "renew-user")
+	// renew-twice is in a second inbound too
+	addTestInbound(t, &model.Inbound{
+		Remark: "trojan", Enable: true, Port: 24444, Protocol: model.Trojan, Tag: "inbound-24444",
+		Settings: `{"clients":[{"password":"p3","email":"renew-twice","enable":true}]}`,
+	}, "renew-twice")
+
+	tests := []struct {
+		email string
+		body  string
+		key   string
+		want  string
+	}{
+		{"missing", `{"days":30}`, "", "client_not_found"},
+		{"renew-user", `{"days":0}`, "", "client_renew_invalid"},
+		{"renew-user", `{"days":30,"addGB":-1}`, "", "client_renew_invalid"},
+		{"renew-twice", `{"days":30}`, "", "client_in_inbounds"},
+		{"renew-user", `{"days":30}`, "key", ""},
+		{"renew-twice", `{"days":30,"allInbounds":true}`, "key", "idempotency_key_used"},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/panel/api/clients/"+test.email+"/renew", strings.NewReader(test.body))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("Authorization", "Bearer "+secret)
+		if test.key != "" {
+			r.Header.Set("Idempotency-Key", test.key)
+		}
+		engine.ServeHTTP(w, r)
+		var reply struct {
+			Success bool   `json:"success"`
+			Code    string `json:"code"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+			t.Fatalf("renewing %s with %s replied %d: %s", test.email, test.body, w.Code, w.Body)
+		}
+		if reply.Success != (test.want == "") || reply.Code != test.want {
+			t.Errorf("renewing %s with %s replied %s, want the code %q", test.email, test.body, w.Body, test.want)
+		}
+	}
+}
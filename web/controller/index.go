@@ -1,11 +1,16 @@
 package controller
 
 import (
+	"math"
 	"net/http"
+	"strconv"
 	"text/template"
 	"time"
 
+	"x-ui/database/model"
 	"x-ui/logger"
+	"x-ui/web/locale"
+	"x-ui/web/middleware"
 	"x-ui/web/service"
 	"x-ui/web/session"
 
@@ -14,17 +19,27 @@ import (
 )
 
 type LoginForm struct {
-	Username    	string `json:"username" form:"username"`
-	Password    	string `json:"password" form:"password"`
-	TwoFactorCode	string `json:"twoFactorCode" form:"twoFactorCode"`
+	Username      string `json:"username" form:"username"`
+	Password      string `json:"password" form:"password"`
+	TwoFactorCode string `json:"twoFactorCode" form:"twoFactorCode"`
+	RememberMe    bool   `json:"rememberMe" form:"rememberMe"`
+	// The answer to the login challenge, and the token of a math one
+	CaptchaToken  string `json:"captchaToken" form:"captchaToken"`
+	CaptchaAnswer string `json:"captchaAnswer" form:"captchaAnswer"`
 }
 
+// loginRateLimitKeys bounds the memory used by the login rate limiter
+const loginRateLimitKeys = 10000
+
 type IndexController struct {
 	BaseController
 
-	settingService service.SettingService
-	userService    service.UserService
-	tgbot          service.Tgbot
+	settingService  service.SettingService
+	userService     service.UserService
+	lockoutService  service.LockoutService
+	captchaService  service.CaptchaService
+	webAuthnService service.WebAuthnService
+	webhookService  service.WebhookService
 }
 
 func NewIndexController(g *gin.RouterGroup) *IndexController {
@@ -35,24 +50,44 @@ func NewIndexController(g *gin.RouterGroup) *IndexController {
 
 func (a *IndexController) initRouter(g *gin.RouterGroup) {
 	g.GET("/", a.index)
-	g.POST("/login", a.login)
+	g.POST("/login", a.loginRateLimit(), a.login)
 	g.GET("/logout", a.logout)
 	g.POST("/getTwoFactorEnable", a.getTwoFactorEnable)
 }
 
+// loginRateLimit limits login attempts per client IP. A rate of 0 disables it.
+func (a *IndexController) loginRateLimit() gin.HandlerFunc {
+	perMinute, err := a.settingService.GetLoginRateLimit()
+	if err != nil || perMinute <= 0 {
+		return func(c *gin.Context) { c.Next() }
+	}
+	burst, err := a.settingService.GetLoginRateBurst()
+	if err != nil {
+		burst = perMinute
+	}
+	limiter := middleware.NewRateLimiter(perMinute, burst, loginRateLimitKeys)
+	return middleware.RateLimit(limiter, middleware.ClientIP, func(c *gin.Context, retryAfter time.Duration) {
+		logger.Warningf("too many login attempts, IP: \"%s\"", middleware.ClientIP(c))
+		logger.Auth(false, middleware.ClientIP(c), c.PostForm("username"), service.LoginReasonRateLimited)
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		jsonError(c, http.StatusTooManyRequests, locale.ErrTooManyRequests)
+	})
+}
+
 func (a *IndexController) index(c *gin.Context) {
-	if session.IsLogin(c) {
+	if session.IsLogin(c) || a.refreshLogin(c) {
 		c.Redirect(http.StatusTemporaryRedirect, "panel/")
 		return
 	}
-	html(c, "login.html", "pages.login.title", nil)
+	rememberMe, _, _ := a.sessionStore.RememberMeEnabled()
+	html(c, "login.html", "pages.login.title", gin.H{"rememberMe": rememberMe})
 }
 
 func (a *IndexController) login(c *gin.Context) {
 	var form LoginForm
 
 	if err := c.ShouldBind(&form); err != nil {
-		pureJsonMsg(c, http.StatusOK, false, I18nWeb(c, "pages.login.toasts.invalidFormData"))
+		jsonError(c, http.StatusOK, locale.ErrInvalidRequest)
 		return
 	}
 	if form.Username == "" {
@@ -64,35 +99,197 @@ func (a *IndexController) login(c *gin.Context) {
 		return
 	}
 
-	user := a.userService.CheckUser(form.Username, form.Password, form.TwoFactorCode)
-	timeStr := time.Now().Format("2006-01-02 15:04:05")
+	remoteIp := middleware.ClientIP(c)
 	safeUser := template.HTMLEscapeString(form.Username)
+
+	// The lockout check runs before the password hash is computed so a locked
+	// IP can't be used to burn CPU on password hashing
+	if locked, until := a.lockoutService.IsLocked(remoteIp); locked {
+		logger.Warningf("login locked out: \"%s\", IP: \"%s\"", safeUser, remoteIp)
+		logger.Auth(false, remoteIp, form.Username, service.LoginReasonLockedOut)
+		a.lockedOut(c, until)
+		return
+	}
+
+	// So is the challenge of suspicious sources
+	if kind := a.captchaService.Required(remoteIp); kind != service.CaptchaOff {
+		if !a.captchaService.Verify(kind, remoteIp, form.CaptchaToken, form.CaptchaAnswer) {
+			code := locale.ErrCaptchaRequired
+			if form.CaptchaAnswer != "" {
+				code = locale.ErrCaptchaFailed
+				logger.Warningf("login challenge failed: \"%s\", IP: \"%s\"", safeUser, remoteIp)
+				logger.Auth(false, remoteIp, form.Username, service.LoginReasonCaptcha)
+				a.captchaService.RecordFailure(remoteIp)
+			}
+			a.captchaChallenge(c, code, kind, remoteIp)
+			return
+		}
+	}
+
+	user, reason := a.userService.CheckUser(form.Username, form.Password, form.TwoFactorCode)
 	safePass := template.HTMLEscapeString(form.Password)
 
+	if reason == service.LoginReasonPasswordReset {
+		logger.Warningf("login refused until the password is reset: \"%s\", IP: \"%s\"", safeUser, remoteIp)
+		logger.Auth(false, remoteIp, form.Username, reason)
+		pureJsonMsg(c, http.StatusOK, false, I18nWeb(c, "pages.login.toasts.passwordResetRequired"))
+		return
+	}
 	if user == nil {
-		logger.Warningf("wrong username: \"%s\", password: \"%s\", IP: \"%s\"", safeUser, safePass, getRemoteIp(c))
-		a.tgbot.UserLoginNotify(safeUser, safePass, getRemoteIp(c), timeStr, 0)
-		pureJsonMsg(c, http.StatusOK, false, I18nWeb(c, "pages.login.toasts.wrongUsernameOrPassword"))
+		logger.Warningf("wrong username: \"%s\", password: \"%s\", IP: \"%s\"", safeUser, safePass, remoteIp)
+		a.tgbot.UserLoginNotify(service.LoginNotice{
+			Status:    service.LoginFail,
+			Username:  form.Username,
+			Password:  form.Password,
+			Ip:        remoteIp,
+			PeerIp:    c.RemoteIP(),
+			UserAgent: c.Request.UserAgent(),
+			Time:      time.Now(),
+		})
+		a.webhookService.Emit(service.WebhookLoginFailed, map[string]any{
+			"username":  form.Username,
+			"ip":        remoteIp,
+			"userAgent": c.Request.UserAgent(),
+			"reason":    reason,
+		})
+		logger.Auth(false, remoteIp, form.Username, reason)
+		locked, err := a.lockoutService.RecordFailure(remoteIp, form.Username)
+		if err != nil {
+			logger.Warning("Unable to record failed login:", err)
+		}
+		if locked {
+			logger.Warningf("login locked out after repeated failures: \"%s\", IP: \"%s\"", safeUser, remoteIp)
+		}
+		// The next attempt may have to pass a challenge, it comes with the reply
+		a.captchaService.RecordFailure(remoteIp)
+		if kind := a.captchaService.Required(remoteIp); kind != service.CaptchaOff {
+			a.captchaChallenge(c, locale.ErrInvalidCreds, kind, remoteIp)
+			return
+		}
+		jsonError(c, http.StatusOK, locale.ErrInvalidCreds)
+		return
+	}
+
+	// In second factor mode users with passkeys have to present one before the
+	// session is issued
+	if a.webAuthnService.RequiresPasskey(user.Id) {
+		session.SetPendingLogin(c, user.Id)
+		if err := sessions.Default(c).Save(); err != nil {
+			logger.Warning("Unable to save session: ", err)
+			return
+		}
+		jsonObj(c, gin.H{"webauthn": true}, nil)
 		return
 	}
 
-	logger.Infof("%s logged in successfully, Ip Address: %s\n", safeUser, getRemoteIp(c))
-	a.tgbot.UserLoginNotify(safeUser, ``, getRemoteIp(c), timeStr, 1)
+	if err := a.completeLogin(c, user, remoteIp, form.RememberMe); err != nil {
+		if _, ok := locale.CodeOf(err); !ok {
+			logger.Warning("Unable to save session: ", err)
+		}
+		return
+	}
+	jsonMsg(c, I18nWeb(c, "pages.login.toasts.successLogin"), nil)
+}
+
+// completeLogin issues the session of a user that passed every login check, a
+// remember-me one if remember is set and remember-me is enabled. A login beyond
+// the sessions the user may have is refused with a coded error, which has been
+// replied.
+func (a *IndexController) completeLogin(c *gin.Context, user *model.User, remoteIp string, remember bool) error {
+	safeUser := template.HTMLEscapeString(user.Username)
+
+	remembered, err := a.issueSession(c, user, remoteIp, remember)
+	if coded, ok := locale.CodeOf(err); ok {
+		logger.Warningf("%s has the most sessions allowed, login refused, IP: \"%s\"", safeUser, remoteIp)
+		logger.Auth(false, remoteIp, user.Username, service.LoginReasonSessionLimit)
+		jsonError(c, http.StatusOK, coded.Code, coded.Params...)
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	logger.Auth(true, remoteIp, user.Username, "")
+	if err := a.lockoutService.Reset(remoteIp, user.Username); err != nil {
+		logger.Warning("Unable to reset login failures:", err)
+	}
+	a.captchaService.Reset(remoteIp)
+
+	logger.Infof("%s logged in successfully, Ip Address: %s\n", safeUser, remoteIp)
+	a.tgbot.UserLoginNotify(service.LoginNotice{
+		Status:    service.LoginSuccess,
+		Username:  user.Username,
+		Ip:        remoteIp,
+		PeerIp:    c.RemoteIP(),
+		UserAgent: c.Request.UserAgent(),
+		Time:      time.Now(),
+	})
+	if remembered {
+		logger.Infof("%s logged in successfully, remembered", safeUser)
+	} else {
+		logger.Infof("%s logged in successfully", safeUser)
+	}
+	return nil
+}
 
+// issueSession starts the session of a login and sets its cookies, and tells
+// whether it is a remember-me one.
+func (a *IndexController) issueSession(c *gin.Context, user *model.User, remoteIp string, remember bool) (bool, error) {
 	sessionMaxAge, err := a.settingService.GetSessionMaxAge()
 	if err != nil {
 		logger.Warning("Unable to get session's max age from DB")
 	}
 
+	// A new login never reuses the session of the cookie it arrived with
+	if err := a.sessionStore.DelByToken(session.GetSessionId(c)); err != nil {
+		logger.Warning("Unable to end the previous session:", err)
+	}
+	if err := a.sessionStore.DelByRefreshToken(session.GetRefreshToken(c)); err != nil {
+		logger.Warning("Unable to end the previous session:", err)
+	}
+	session.ClearPendingLogin(c)
+	if enabled, _, _ := a.sessionStore.RememberMeEnabled(); remember && enabled {
+		device, err := session.EnsureDeviceId(c)
+		if err != nil {
+			return true, err
+		}
+		login, err := a.sessionStore.CreateRemembered(user.Id, remoteIp, c.Request.UserAgent(), device)
+		if err != nil {
+			return true, err
+		}
+		return true, setRememberedLogin(c, user, login)
+	}
+	session.ClearRefreshToken(c)
+	sessionId, err := a.sessionStore.Create(user.Id, remoteIp, c.Request.UserAgent(), time.Duration(sessionMaxAge)*time.Minute)
+	if err != nil {
+		return false, err
+	}
+
 	session.SetMaxAge(c, sessionMaxAge*60)
 	session.SetLoginUser(c, user)
-	if err := sessions.Default(c).Save(); err != nil {
-		logger.Warning("Unable to save session: ", err)
-		return
+	session.SetSessionId(c, sessionId)
+	return false, sessions.Default(c).Save()
+}
+
+func (a *IndexController) lockedOut(c *gin.Context, until time.Time) {
+	retryAfter := int(math.Ceil(time.Until(until).Seconds()))
+	if retryAfter < 1 {
+		retryAfter = 1
 	}
+	c.Header("Retry-After", strconv.Itoa(retryAfter))
+	jsonError(c, http.StatusTooManyRequests, locale.ErrAccountLocked)
+}
 
-	logger.Infof("%s logged in successfully", safeUser)
-	jsonMsg(c, I18nWeb(c, "pages.login.toasts.successLogin"), nil)
+// captchaChallenge refuses a login with code and a new challenge of kind for
+// remoteIp to pass.
+func (a *IndexController) captchaChallenge(c *gin.Context, code locale.ErrorCode, kind string, remoteIp string) {
+	challenge, err := a.captchaService.NewChallenge(kind, remoteIp)
+	if err != nil {
+		logger.Warning("Unable to issue a login challenge:", err)
+		jsonError(c, http.StatusOK, locale.ErrInternal)
+		return
+	}
+	c.Set(requestFailedKey, true)
+	locale.ErrorJSON(c, http.StatusOK, code, gin.H{"captcha": challenge})
 }
 
 func (a *IndexController) logout(c *gin.Context) {
@@ -100,6 +297,14 @@ func (a *IndexController) logout(c *gin.Context) {
 	if user != nil {
 		logger.Infof("%s logged out successfully", user.Username)
 	}
+	// The session holds the refresh token of a remember-me login, it ends with it
+	if err := a.sessionStore.DelByToken(session.GetSessionId(c)); err != nil {
+		logger.Warning("Unable to end the session:", err)
+	}
+	if err := a.sessionStore.DelByRefreshToken(session.GetRefreshToken(c)); err != nil {
+		logger.Warning("Unable to end the session:", err)
+	}
+	session.ClearRefreshToken(c)
 	session.ClearSession(c)
 	if err := sessions.Default(c).Save(); err != nil {
 		logger.Warning("Unable to save session after clearing:", err)
@@ -108,7 +313,7 @@ func (a *IndexController) logout(c *gin.Context) {
 }
 
 func (a *IndexController) getTwoFactorEnable(c *gin.Context) {
-	status, err := a.settingService.GetTwoFactorEnable()
+	status, err := a.userService.HasTwoFactor()
 	if err == nil {
 		jsonObj(c, status, nil)
 	}
@@ -0,0 +1,244 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"x-ui/logger"
+	"x-ui/web/middleware"
+	"x-ui/web/service"
+	"x-ui/web/session"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// liveStatsPingInterval is how often the streams are pinged, and the
+	// session they were opened with checked
+	liveStatsPingInterval = 30 * time.Second
+	// liveStatsIdleTimeout is how long a stream may go without a pong or a
+	// message before it is closed
+	liveStatsIdleTimeout = 75 * time.Second
+	// liveStatsPollTimeout is how long a long poll waits at most
+	liveStatsPollTimeout = 25 * time.Second
+	// liveStatsMaxMessage bounds the subscription messages
+	liveStatsMaxMessage = 4096
+)
+
+// liveStatsSubscription is what a stream asks for: the topics it renders, all
+// of them if it sent none, and at most one frame an interval in seconds.
+type liveStatsSubscription struct {
+	Topics   []string `json:"topics"`
+	Interval int      `json:"interval"`
+
+	// invalid is why the message was not a subscription
+	invalid error
+}
+
+// validate checks the topics and fills in all of them for none.
+func (s *liveStatsSubscription) validate() error {
+	if s.invalid != nil {
+		return s.invalid
+	}
+	if len(s.Topics) == 0 {
+		s.Topics = service.LiveStatsTopics
+	}
+	for _, topic := range s.Topics {
+		if !slices.Contains(service.LiveStatsTopics, topic) {
+			return fmt.Errorf("unknown topic %q", topic)
+		}
+	}
+	s.Interval = max(s.Interval, 0)
+	return nil
+}
+
+// LiveStatsController streams the status of the server, the throughput of the
+// inbounds and the online clients to the dashboards, from the frames the
+// status job makes for all of them.
+type LiveStatsController struct {
+	BaseController
+
+	serverService service.ServerService
+}
+
+func NewLiveStatsController(g *gin.RouterGroup) *LiveStatsController {
+	a := &LiveStatsController{}
+	a.initRouter(g)
+	return a
+}
+
+func (a *LiveStatsController) initRouter(g *gin.RouterGroup) {
+	g.GET("/ws/stats", a.stream)
+	g.GET("/stats/poll", a.poll)
+}
+
+// stream sends the frames of the live stats with the topics the socket
+// subscribed to, the status as the fields that changed since the last frame.
+// The socket subscribes again by sending a liveStatsSubscription. A socket
+// that is slow to read skips frames, an idle one is closed, and so is one
+// whose session was revoked.
+func (a *LiveStatsController) stream(c *gin.Context) {
+	conn, err := statusUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// The upgrader replied already
+		return
+	}
+	defer conn.Close()
+	release := a.serverService.WatchLiveStats()
+	defer release()
+
+	subscriptions := make(chan liveStatsSubscription, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn.SetReadLimit(liveStatsMaxMessage)
+		conn.SetReadDeadline(time.Now().Add(liveStatsIdleTimeout))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(liveStatsIdleTimeout))
+		})
+		for {
+			_, message, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.SetReadDeadline(time.Now().Add(liveStatsIdleTimeout))
+			subscription := liveStatsSubscription{}
+			if err := json.Unmarshal(message, &subscription); err != nil {
+				subscription.invalid = err
+			}
+			// Only the last subscription counts
+			select {
+			case <-subscriptions:
+			default:
+			}
+			subscriptions <- subscription
+		}
+	}()
+
+	// The first subscription may come with the URL, as for the long polls
+	subscription := liveStatsSubscription{}
+	if topics := c.Query("topics"); topics != "" {
+		subscription.Topics = strings.Split(topics, ",")
+	}
+	subscription.Interval, _ = strconv.Atoi(c.Query("interval"))
+	if subscription.validate() != nil {
+		subscription = liveStatsSubscription{}
+		subscription.validate()
+	}
+	ping := time.NewTicker(liveStatsPingInterval)
+	defer ping.Stop()
+	var since int64
+	var sent time.Time
+	var last map[string]json.RawMessage
+	var throttle <-chan time.Time
+	for {
+		frame, changed := a.serverService.NextLiveStats(since)
+		if frame != nil && throttle == nil {
+			if wait := time.Duration(subscription.Interval)*time.Second - time.Since(sent); wait > 0 {
+				throttle = time.After(wait)
+			} else {
+				if last, err = a.write(conn, frame, subscription.Topics, last); err != nil {
+					return
+				}
+				since, sent = frame.Seq, time.Now()
+				continue
+			}
+		}
+		select {
+		case <-changed:
+		case <-throttle:
+			throttle = nil
+		case subscription = <-subscriptions:
+			if err := subscription.validate(); err != nil {
+				conn.SetWriteDeadline(time.Now().Add(statusWriteTimeout))
+				if conn.WriteJSON(gin.H{"error": err.Error()}) != nil {
+					return
+				}
+				subscription = liveStatsSubscription{}
+				subscription.validate()
+			}
+			// The new topics start over from a full frame
+			since, last, throttle = 0, nil, nil
+		case <-ping.C:
+			if !a.sessionValid(c) {
+				conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "session revoked"),
+					time.Now().Add(statusWriteTimeout))
+				return
+			}
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(statusWriteTimeout)); err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// write sends frame with topics, the status as its delta from last, and
+// returns the status sent.
+func (a *LiveStatsController) write(conn *websocket.Conn, frame *service.LiveStats, topics []string, last map[string]json.RawMessage) (map[string]json.RawMessage, error) {
+	message := map[string]any{"seq": frame.Seq, "time": frame.Time}
+	frame = frame.Only(topics)
+	if frame.Status != nil {
+		delta, status, err := service.StatusDelta(last, frame.Status)
+		if err != nil {
+			logger.Warning("encode status failed:", err)
+			return last, err
+		}
+		message["status"], last = delta, status
+	}
+	if slices.Contains(topics, service.LiveStatsInbounds) {
+		message["inbounds"] = frame.Inbounds
+	}
+	if frame.Online != nil {
+		message["online"] = frame.Online
+	}
+	conn.SetWriteDeadline(time.Now().Add(statusWriteTimeout))
+	return last, conn.WriteJSON(message)
+}
+
+// sessionValid tells whether the session the stream was opened with was not
+// revoked since, nor its user removed.
+func (a *LiveStatsController) sessionValid(c *gin.Context) bool {
+	user := session.GetLoginUser(c)
+	if user == nil {
+		return false
+	}
+	current := a.sessionUsers.GetSessionUser(user.Id, session.GetLoginTime(c))
+	if current == nil {
+		return false
+	}
+	_, err := a.sessionStore.Validate(session.GetSessionId(c), current, middleware.ClientIP(c), c.Request.UserAgent())
+	if err != nil {
+		logger.Debug("live stats session rejected:", err)
+		return false
+	}
+	return true
+}
+
+// poll replies with the frame of the live stats after the frame "since", once
+// there is one or after a while, for where streams can't be opened. "topics"
+// picks the topics, comma separated.
+func (a *LiveStatsController) poll(c *gin.Context) {
+	since, _ := strconv.ParseInt(c.Query("since"), 10, 64)
+	subscription := liveStatsSubscription{}
+	if topics := c.Query("topics"); topics != "" {
+		subscription.Topics = strings.Split(topics, ",")
+	}
+	if err := subscription.validate(); err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	frame := a.serverService.PollLiveStats(since, liveStatsPollTimeout)
+	if frame == nil {
+		jsonObj(c, nil, nil)
+		return
+	}
+	jsonObj(c, frame.Only(subscription.Topics), nil)
+}
@@ -0,0 +1,87 @@
+package controller
+
+import (
+	"strconv"
+	"time"
+
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/web/service"
+	"x-ui/web/session"
+
+	"github.com/gin-gonic/gin"
+)
+
+type loginSessionInfo struct {
+	*model.LoginSession
+	Current bool `json:"current"`
+	// IdleSeconds is how long ago the session was last used
+	IdleSeconds int64 `json:"idleSeconds"`
+}
+
+// LoginSessionController lets the logged in user see where they are logged in
+// and end those sessions.
+type LoginSessionController struct {
+	sessionStore service.LoginSessionService
+}
+
+func NewLoginSessionController(g *gin.RouterGroup) *LoginSessionController {
+	a := &LoginSessionController{}
+	a.initRouter(g)
+	return a
+}
+
+func (a *LoginSessionController) initRouter(g *gin.RouterGroup) {
+	g.GET("", a.getSessions)
+	// Deleting the collection logs out everywhere except the current session
+	g.DELETE("", a.delOtherSessions)
+	g.DELETE("/:id", a.delSession)
+}
+
+// currentSessionId returns the id of the session the request was made with.
+func currentSessionId(c *gin.Context) int {
+	if value, ok := c.Get(loginSessionKey); ok {
+		return value.(*model.LoginSession).Id
+	}
+	return 0
+}
+
+func (a *LoginSessionController) getSessions(c *gin.Context) {
+	loginSessions, err := a.sessionStore.GetSessions(session.GetLoginUser(c).Id)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.security.sessionsError"), err)
+		return
+	}
+	currentId := currentSessionId(c)
+	now := time.Now().UnixMilli()
+	infos := make([]*loginSessionInfo, 0, len(loginSessions))
+	for _, loginSession := range loginSessions {
+		infos = append(infos, &loginSessionInfo{
+			LoginSession: loginSession,
+			Current:      loginSession.Id == currentId,
+			IdleSeconds:  max(now-loginSession.LastActiveAt, 0) / 1000,
+		})
+	}
+	jsonObj(c, infos, nil)
+}
+
+func (a *LoginSessionController) delSession(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.security.sessionRevoked"), err)
+		return
+	}
+	err = a.sessionStore.DelSession(session.GetLoginUser(c).Id, id)
+	jsonMsg(c, I18nWeb(c, "pages.settings.security.sessionRevoked"), err)
+}
+
+func (a *LoginSessionController) delOtherSessions(c *gin.Context) {
+	user := session.GetLoginUser(c)
+	count, err := a.sessionStore.DelOtherSessions(user.Id, currentSessionId(c))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.security.sessionsRevoked"), err)
+		return
+	}
+	logger.Infof("%s logged out %d other sessions", user.Username, count)
+	jsonMsgObj(c, I18nWeb(c, "pages.settings.security.sessionsRevoked"), count, nil)
+}
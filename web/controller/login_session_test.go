@@ -0,0 +1,128 @@
+package controller
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/web/locale"
+	"x-ui/web/service"
+	"x-ui/web/session"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+// sessionTestLogin logs the admin in through engine, as the login page does,
+// and returns the cookie and the id of the login session.
+func sessionTestLogin(t *testing.T, engine *gin.Engine) (string, int) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/test/login", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("the login replied %d: %s", w.Code, w.Body)
+	}
+	loginSession := &model.LoginSession{}
+	if err := database.GetDB().Order("id DESC").First(loginSession).Error; err != nil {
+		t.Fatal(err)
+	}
+	return w.Header().Get("Set-Cookie"), loginSession.Id
+}
+
+func sessionTestRequest(engine *gin.Engine, path string, cookie string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	r.Header.Set("Cookie", cookie)
+	r.Header.Set("X-Requested-With", "XMLHttpRequest")
+	engine.ServeHTTP(w, r)
+	return w
+}
+
+// ageTestSession moves the last activity of the session with id back by age.
+func ageTestSession(t *testing.T, id int, age time.Duration) {
+	t.Helper()
+	if err := database.GetDB().Model(model.LoginSession{}).Where("id = ?", id).
+		Update("last_active_at", time.Now().Add(-age).UnixMilli()).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoginSessionLimits(t *testing.T) {
+	engine, _ := apiTestEngine(t)
+	db := database.GetDB()
+	var admin model.User
+	if err := db.Where("username = ?", "admin").First(&admin).Error; err != nil {
+		t.Fatal(err)
+	}
+	engine.POST("/test/login", func(c *gin.Context) {
+		token, err := (&service.LoginSessionService{}).Create(admin.Id, "192.0.2.1", "Firefox", 0)
+		if err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+		session.SetLoginUser(c, &admin)
+		session.SetSessionId(c, token)
+		if err := sessions.Default(c).Save(); err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+		}
+	})
+
+	// The list tells how long each session has been idle
+	cookie, current := sessionTestLogin(t, engine)
+	_, other := sessionTestLogin(t, engine)
+	ageTestSession(t, other, 5*time.Minute)
+	w := sessionTestRequest(engine, "/panel/api/sessions", cookie)
+	var reply struct {
+		Success bool `json:"success"`
+		Obj     []struct {
+			Id          int   `json:"id"`
+			Current     bool  `json:"current"`
+			IdleSeconds int64 `json:"idleSeconds"`
+		} `json:"obj"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil || !reply.Success || len(reply.Obj) != 2 {
+		t.Fatalf("the sessions replied %d: %s", w.Code, w.Body)
+	}
+	for _, info := range reply.Obj {
+		switch info.Id {
+		case current:
+			if !info.Current || info.IdleSeconds != 0 {
+				t.Errorf("the current session is %+v", info)
+			}
+		case other:
+			if info.Current || info.IdleSeconds < 299 || info.IdleSeconds > 301 {
+				t.Errorf("the session idle for 5 minutes is %+v", info)
+			}
+		}
+	}
+
+	// Past the idle timeout, the reply carries its code for the frontend to
+	// go to the login page
+	if err := db.Create(&model.Setting{Key: "sessionIdleTimeout", Value: "15"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	service.InvalidateSettings()
+	cookie, idle := sessionTestLogin(t, engine)
+	ageTestSession(t, idle, 16*time.Minute)
+	w = sessionTestRequest(engine, "/panel/api/sessions", cookie)
+	var ended changesetReply
+	if err := json.Unmarshal(w.Body.Bytes(), &ended); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusUnauthorized || ended.Success || ended.Code != locale.ErrSessionIdle {
+		t.Errorf("the idle session replied %d: %s", w.Code, w.Body)
+	}
+	// The session is ended, its next request is refused as any expired one
+	w = sessionTestRequest(engine, "/panel/api/sessions", cookie)
+	if err := json.Unmarshal(w.Body.Bytes(), &ended); err != nil || w.Code != http.StatusUnauthorized || ended.Code != locale.ErrSessionExpired {
+		t.Errorf("the ended session replied %d: %s", w.Code, w.Body)
+	}
+	var count int64
+	if err := db.Model(model.LoginSession{}).Where("id = ?", idle).Count(&count).Error; err != nil || count != 0 {
+		t.Errorf("the idle session is kept: %d, %v", count, err)
+	}
+}
@@ -0,0 +1,121 @@
+package controller
+
+import (
+	"strings"
+	"time"
+
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/web/middleware"
+	"x-ui/web/service"
+	"x-ui/web/session"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maintenanceExempt are the routes that stay reachable in maintenance mode,
+// relative to the base path, so that admins can log in and monitoring goes on.
+var maintenanceExempt = map[string]bool{
+	"GET ":                                 true,
+	"POST login":                           true,
+	"GET logout":                           true,
+	"POST getTwoFactorEnable":              true,
+	"POST panel/api/webauthn/login/status": true,
+	"POST panel/api/webauthn/login/begin":  true,
+	"POST panel/api/webauthn/login/finish": true,
+	"GET assets/*filepath":                 true,
+	"HEAD assets/*filepath":                true,
+	"GET healthz":                          true,
+	"GET metrics":                          true,
+}
+
+// MaintenanceGuard answers 503 to everyone but admins while the maintenance mode
+// is on. It has to run before the routes are registered.
+func MaintenanceGuard() gin.HandlerFunc {
+	a := &MaintenanceController{}
+	return middleware.Maintenance(a.state, a.bypass)
+}
+
+// MaintenanceController switches the maintenance mode of the panel and the
+// subscription server.
+type MaintenanceController struct {
+	BaseController
+	settingService service.SettingService
+}
+
+func NewMaintenanceController(g *gin.RouterGroup) *MaintenanceController {
+	a := &MaintenanceController{}
+	a.initRouter(g)
+	return a
+}
+
+func (a *MaintenanceController) initRouter(g *gin.RouterGroup) {
+	g.GET("", a.getMaintenance)
+	g.POST("", a.setMaintenance)
+}
+
+func (a *MaintenanceController) state() middleware.MaintenanceState {
+	state, err := a.settingService.GetMaintenance()
+	if err != nil {
+		logger.Warning("Unable to get the maintenance mode:", err)
+	}
+	return state
+}
+
+// bypass lets through the exempt routes and the requests of admins, whether
+// they come with a session or an API token.
+func (a *MaintenanceController) bypass(c *gin.Context) bool {
+	route := strings.TrimPrefix(c.FullPath(), c.GetString("base_path"))
+	if maintenanceExempt[c.Request.Method+" "+route] {
+		return true
+	}
+	var user *model.User
+	if secret, ok := bearerToken(c); ok {
+		token, err := a.apiTokens.Authenticate(secret)
+		if err != nil {
+			return false
+		}
+		if user, err = a.sessionUsers.GetUserById(token.UserId); err != nil {
+			return false
+		}
+	} else if loginUser := session.GetLoginUser(c); loginUser != nil {
+		user = a.sessionUsers.GetSessionUser(loginUser.Id, session.GetLoginTime(c))
+		if user == nil {
+			return false
+		}
+		if _, err := a.sessionStore.Validate(session.GetSessionId(c), user, middleware.ClientIP(c), c.Request.UserAgent()); err != nil {
+			return false
+		}
+	}
+	return user != nil && user.Role == model.RoleAdmin
+}
+
+func (a *MaintenanceController) getMaintenance(c *gin.Context) {
+	state, err := a.settingService.GetMaintenance()
+	jsonObj(c, state, err)
+}
+
+func (a *MaintenanceController) setMaintenance(c *gin.Context) {
+	state := middleware.MaintenanceState{}
+	if err := c.ShouldBind(&state); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.maintenanceError"), err)
+		return
+	}
+	if state.Eta > 0 && state.Eta < time.Now().UnixMilli() {
+		jsonMsg(c, I18nWeb(c, "pages.settings.maintenanceError"), common.NewError("the ETA is in the past"))
+		return
+	}
+	if err := a.settingService.SetMaintenance(state); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.maintenanceError"), err)
+		return
+	}
+	user := session.GetLoginUser(c)
+	if state.Enable {
+		logger.Infof("%s turned the maintenance mode on", user.Username)
+		jsonMsg(c, I18nWeb(c, "pages.settings.maintenanceEnabled"), nil)
+	} else {
+		logger.Infof("%s turned the maintenance mode off", user.Username)
+		jsonMsg(c, I18nWeb(c, "pages.settings.maintenanceDisabled"), nil)
+	}
+}
@@ -0,0 +1,171 @@
+package controller
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"x-ui/logger"
+	"x-ui/web/metrics"
+	"x-ui/web/middleware"
+	"x-ui/web/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// MetricsController serves the Prometheus endpoint. It is not behind the login
+// check; access is granted by a bearer token or a client IP allowlist instead.
+type MetricsController struct {
+	settingService service.SettingService
+	inboundService service.InboundService
+	xrayService    service.XrayService
+}
+
+func NewMetricsController(g *gin.RouterGroup) *MetricsController {
+	a := &MetricsController{}
+	a.initRouter(g)
+	return a
+}
+
+func (a *MetricsController) initRouter(g *gin.RouterGroup) {
+	g.GET("/metrics", a.checkAccess, a.metrics)
+}
+
+func (a *MetricsController) checkAccess(c *gin.Context) {
+	enabled, err := a.settingService.GetMetricsEnable()
+	if err != nil || !enabled {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	token, _ := a.settingService.GetMetricsToken()
+	allowIPs, _ := a.settingService.GetMetricsAllowIPs()
+	ip := net.ParseIP(middleware.ClientIP(c))
+
+	if token != "" && metricsTokenMatches(c, token) {
+		c.Next()
+		return
+	}
+	if allowIPs != "" && ipAllowed(ip, allowIPs) {
+		c.Next()
+		return
+	}
+	// With nothing configured only local scrapers are allowed
+	if token == "" && allowIPs == "" && ip != nil && ip.IsLoopback() {
+		c.Next()
+		return
+	}
+
+	logger.Warning("metrics: access denied for", middleware.ClientIP(c))
+	c.AbortWithStatus(http.StatusForbidden)
+}
+
+func metricsTokenMatches(c *gin.Context, token string) bool {
+	got, ok := bearerToken(c)
+	if !ok {
+		got = c.Query("token")
+	}
+	return got != "" && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+// ipAllowed reports whether ip matches one of the comma-separated IPs or CIDRs.
+func ipAllowed(ip net.IP, list string) bool {
+	if ip == nil {
+		return false
+	}
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if strings.Contains(entry, "/") {
+			if _, cidr, err := net.ParseCIDR(entry); err == nil && cidr.Contains(ip) {
+				return true
+			}
+		} else if allowed := net.ParseIP(entry); allowed != nil && allowed.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *MetricsController) metrics(c *gin.Context) {
+	var buf bytes.Buffer
+	metrics.WriteHTTP(&buf)
+	metrics.WriteLatency(&buf)
+	metrics.WriteSubCache(&buf)
+
+	up := 0.0
+	if a.xrayService.IsXrayRunning() {
+		up = 1
+	}
+	metrics.WriteHeader(&buf, "xui_xray_up", "Whether the xray process is running.", "gauge")
+	metrics.WriteSample(&buf, "xui_xray_up", nil, up)
+	metrics.WriteHeader(&buf, "xui_xray_uptime_seconds", "Seconds since the xray process was started.", "gauge")
+	metrics.WriteSample(&buf, "xui_xray_uptime_seconds", nil, float64(a.xrayService.GetXrayUptime()))
+
+	onlines := a.inboundService.GetOnlineClients()
+	metrics.WriteHeader(&buf, "xui_online_clients", "Number of clients currently online.", "gauge")
+	metrics.WriteSample(&buf, "xui_online_clients", nil, float64(len(onlines)))
+
+	inbounds, err := a.inboundService.GetAllInbounds()
+	if err != nil {
+		logger.Warning("metrics: get inbounds failed:", err)
+	}
+
+	metrics.WriteHeader(&buf, "xui_inbound_up_bytes_total", "Uploaded bytes per inbound.", "counter")
+	for _, inbound := range inbounds {
+		metrics.WriteSample(&buf, "xui_inbound_up_bytes_total", inboundLabels(inbound.Id, inbound.Tag, string(inbound.Protocol)), float64(inbound.Up))
+	}
+	metrics.WriteHeader(&buf, "xui_inbound_down_bytes_total", "Downloaded bytes per inbound.", "counter")
+	for _, inbound := range inbounds {
+		metrics.WriteSample(&buf, "xui_inbound_down_bytes_total", inboundLabels(inbound.Id, inbound.Tag, string(inbound.Protocol)), float64(inbound.Down))
+	}
+	metrics.WriteHeader(&buf, "xui_inbound_clients", "Number of clients per inbound.", "gauge")
+	for _, inbound := range inbounds {
+		metrics.WriteSample(&buf, "xui_inbound_clients", inboundLabels(inbound.Id, inbound.Tag, string(inbound.Protocol)), float64(len(inbound.ClientStats)))
+	}
+
+	// Per-client series grow with the number of clients, so they are opt-in
+	if perClient, _ := a.settingService.GetMetricsClientLabels(); perClient {
+		online := make(map[string]bool, len(onlines))
+		for _, email := range onlines {
+			online[email] = true
+		}
+		metrics.WriteHeader(&buf, "xui_client_up_bytes_total", "Uploaded bytes per client.", "counter")
+		for _, inbound := range inbounds {
+			for _, stat := range inbound.ClientStats {
+				metrics.WriteSample(&buf, "xui_client_up_bytes_total", clientLabels(inbound.Id, stat.Email), float64(stat.Up))
+			}
+		}
+		metrics.WriteHeader(&buf, "xui_client_down_bytes_total", "Downloaded bytes per client.", "counter")
+		for _, inbound := range inbounds {
+			for _, stat := range inbound.ClientStats {
+				metrics.WriteSample(&buf, "xui_client_down_bytes_total", clientLabels(inbound.Id, stat.Email), float64(stat.Down))
+			}
+		}
+		metrics.WriteHeader(&buf, "xui_client_online", "Whether the client is currently online.", "gauge")
+		for _, inbound := range inbounds {
+			for _, stat := range inbound.ClientStats {
+				value := 0.0
+				if online[stat.Email] {
+					value = 1
+				}
+				metrics.WriteSample(&buf, "xui_client_online", clientLabels(inbound.Id, stat.Email), value)
+			}
+		}
+	}
+
+	c.Data(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", buf.Bytes())
+}
+
+func inboundLabels(id int, tag string, protocol string) metrics.Labels {
+	return metrics.Labels{"id", strconv.Itoa(id), "tag", tag, "protocol", protocol}
+}
+
+func clientLabels(inboundId int, email string) metrics.Labels {
+	return metrics.Labels{"inbound_id", strconv.Itoa(inboundId), "email", email}
+}
@@ -0,0 +1,153 @@
+package controller
+
+import (
+	"strconv"
+
+	"x-ui/database/model"
+	"x-ui/web/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// NodeController manages the nodes the inbounds and the clients are pushed
+// to, tells what a sync would change on them and resolves their conflicts.
+type NodeController struct {
+	nodeService service.NodeService
+}
+
+func NewNodeController(g *gin.RouterGroup) *NodeController {
+	a := &NodeController{}
+	a.initRouter(g)
+	return a
+}
+
+func (a *NodeController) initRouter(g *gin.RouterGroup) {
+	g.GET("", a.getNodes)
+	g.POST("", a.addNode)
+	g.PUT("/:id", a.updateNode)
+	g.DELETE("/:id", a.delNode)
+	g.GET("/:id/diff", a.diff)
+	g.POST("/:id/sync", a.sync)
+	g.GET("/:id/conflicts", a.getConflicts)
+	g.POST("/:id/conflicts/:tag/resolve", a.resolveConflict)
+}
+
+func (a *NodeController) getNodes(c *gin.Context) {
+	nodes, err := a.nodeService.GetNodes()
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	jsonObj(c, nodes, nil)
+}
+
+// addNode adds the node of the JSON body. Its token comes back masked.
+func (a *NodeController) addNode(c *gin.Context) {
+	node := &model.Node{}
+	if err := c.ShouldBindJSON(node); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.nodeSaved"), err)
+		return
+	}
+	node, err := a.nodeService.AddNode(node)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.nodeSaved"), err)
+		return
+	}
+	setAuditTarget(c, "node", strconv.Itoa(node.Id))
+	setAuditDiff(c, gin.H{}, node)
+	jsonMsgObj(c, I18nWeb(c, "pages.settings.nodeSaved"), node, nil)
+}
+
+// updateNode replaces a node with the JSON body, the mask as the token keeps
+// the saved one.
+func (a *NodeController) updateNode(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.nodeSaved"), err)
+		return
+	}
+	node := &model.Node{}
+	if err := c.ShouldBindJSON(node); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.nodeSaved"), err)
+		return
+	}
+	node.Id = id
+	before, _ := a.nodeService.GetNode(id)
+	node, err = a.nodeService.UpdateNode(node)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.nodeSaved"), err)
+		return
+	}
+	setAuditDiff(c, before, node)
+	jsonMsgObj(c, I18nWeb(c, "pages.settings.nodeSaved"), node, nil)
+}
+
+func (a *NodeController) delNode(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.nodeDeleted"), err)
+		return
+	}
+	jsonMsg(c, I18nWeb(c, "pages.settings.nodeDeleted"), a.nodeService.DelNode(id))
+}
+
+// diff replies with what a sync of the node would change, without changing
+// anything.
+func (a *NodeController) diff(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	result, err := a.nodeService.Sync(id, true)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	jsonObj(c, result, nil)
+}
+
+// sync syncs the node now and replies with what changed. The changes that
+// failed carry their error and fail the reply.
+func (a *NodeController) sync(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.nodeSynced"), err)
+		return
+	}
+	result, err := a.nodeService.Sync(id, false)
+	jsonMsgObj(c, I18nWeb(c, "pages.settings.nodeSynced"), result, err)
+}
+
+func (a *NodeController) getConflicts(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	conflicts, err := a.nodeService.GetConflicts(id)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	jsonObj(c, conflicts, nil)
+}
+
+// resolveConflict ends the conflict of an inbound of the node, keeping the
+// one of the panel or of the node as the JSON body says.
+func (a *NodeController) resolveConflict(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.nodeConflictResolved"), err)
+		return
+	}
+	body := struct {
+		Keep string `json:"keep"`
+	}{}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.nodeConflictResolved"), err)
+		return
+	}
+	change, err := a.nodeService.ResolveConflict(id, c.Param("tag"), body.Keep)
+	jsonMsgObj(c, I18nWeb(c, "pages.settings.nodeConflictResolved"), change, err)
+}
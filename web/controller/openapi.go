@@ -0,0 +1,329 @@
+package controller
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"x-ui/config"
+	"x-ui/web/entity"
+	"x-ui/web/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	timeType        = reflect.TypeOf(time.Time{})
+	rawMessageType  = reflect.TypeOf(json.RawMessage{})
+	openAPISpecPath = "/openapi.json"
+	// metricsSnapshotPath is served beside the v2 API, relative to panel/api
+	metricsSnapshotPath = "/metrics/snapshot"
+)
+
+// openAPISchemas collects the schemas of the Go types of a document, each
+// struct once under components, named after its type.
+type openAPISchemas struct {
+	names   map[reflect.Type]string
+	schemas gin.H
+}
+
+func newOpenAPISchemas() *openAPISchemas {
+	return &openAPISchemas{names: map[reflect.Type]string{}, schemas: gin.H{}}
+}
+
+// schemaOf returns the schema of the JSON encoding of t.
+func (s *openAPISchemas) schemaOf(t reflect.Type) gin.H {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t {
+	case timeType:
+		return gin.H{"type": "string", "format": "date-time"}
+	case rawMessageType:
+		return gin.H{}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return gin.H{"type": "boolean"}
+	case reflect.Int64, reflect.Uint64:
+		return gin.H{"type": "integer", "format": "int64"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return gin.H{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return gin.H{"type": "number"}
+	case reflect.String:
+		return gin.H{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return gin.H{"type": "string", "format": "byte"}
+		}
+		return gin.H{"type": "array", "items": s.schemaOf(t.Elem())}
+	case reflect.Map:
+		return gin.H{"type": "object", "additionalProperties": s.schemaOf(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return s.object(t)
+		}
+		return s.ref(t)
+	}
+	// Interfaces hold any JSON
+	return gin.H{}
+}
+
+// ref returns a reference to the schema of the struct t, adding it to the
+// components the first time.
+func (s *openAPISchemas) ref(t reflect.Type) gin.H {
+	name, ok := s.names[t]
+	if !ok {
+		// The types of the controllers are named without their prefix
+		name = strings.TrimPrefix(t.Name(), "apiV2")
+		name = strings.ToUpper(name[:1]) + name[1:]
+		if _, taken := s.schemas[name]; taken {
+			pkg := t.PkgPath()[strings.LastIndex(t.PkgPath(), "/")+1:]
+			name = strings.ToUpper(pkg[:1]) + pkg[1:] + name
+		}
+		s.names[t] = name
+		// Taken before the fields, for types that refer to themselves
+		s.schemas[name] = gin.H{}
+		s.schemas[name] = s.object(t)
+	}
+	return gin.H{"$ref": "#/components/schemas/" + name}
+}
+
+// object returns the schema of the JSON object of the struct t.
+func (s *openAPISchemas) object(t reflect.Type) gin.H {
+	properties := gin.H{}
+	s.properties(t, properties)
+	return gin.H{"type": "object", "properties": properties}
+}
+
+// properties adds the fields of t to properties the way encoding/json writes
+// them, those of embedded structs included.
+func (s *openAPISchemas) properties(t reflect.Type, properties gin.H) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" && options == "" {
+			continue
+		}
+		fieldType := field.Type
+		for fieldType.Kind() == reflect.Pointer {
+			fieldType = fieldType.Elem()
+		}
+		if field.Anonymous && name == "" && fieldType.Kind() == reflect.Struct {
+			s.properties(fieldType, properties)
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		schema := s.schemaOf(field.Type)
+		if strings.Contains(","+options+",", ",string,") {
+			schema = gin.H{"type": "string"}
+		}
+		if description := field.Tag.Get("description"); description != "" {
+			schema["description"] = description
+		}
+		properties[name] = schema
+	}
+}
+
+// queryParameters returns the query parameters of the form fields of t.
+func (s *openAPISchemas) queryParameters(t reflect.Type) []gin.H {
+	var parameters []gin.H
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			parameters = append(parameters, s.queryParameters(field.Type)...)
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("form"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		parameters = append(parameters, gin.H{"name": name, "in": "query", "schema": s.schemaOf(field.Type)})
+	}
+	return parameters
+}
+
+// openAPIPath turns a route like "/inbounds/:id" into "/inbounds/{id}", with
+// the parameters of its path.
+func openAPIPath(route string) (string, []gin.H) {
+	var parameters []gin.H
+	segments := strings.Split(route, "/")
+	for i, segment := range segments {
+		name, ok := strings.CutPrefix(segment, ":")
+		if !ok {
+			continue
+		}
+		segments[i] = "{" + name + "}"
+		// The ids are those of the database, the other parameters are names
+		schema := gin.H{"type": "string"}
+		if name == "id" {
+			schema = gin.H{"type": "integer"}
+		}
+		parameters = append(parameters, gin.H{"name": name, "in": "path", "required": true, "schema": schema})
+	}
+	return strings.Join(segments, "/"), parameters
+}
+
+// jsonContent is the content of a JSON body of schema.
+func jsonContent(schema gin.H) gin.H {
+	return gin.H{"application/json": gin.H{"schema": schema}}
+}
+
+// operation returns the OpenAPI operation of a route.
+func (s *openAPISchemas) operation(route apiV2Route) gin.H {
+	_, parameters := openAPIPath(route.Path)
+	if route.Query != nil {
+		parameters = append(parameters, s.queryParameters(reflect.TypeOf(route.Query))...)
+	}
+
+	data := gin.H{}
+	if route.Data != nil {
+		data = s.schemaOf(reflect.TypeOf(route.Data))
+	}
+	if route.Paged {
+		data = gin.H{"type": "object", "properties": gin.H{
+			"items":    gin.H{"type": "array", "items": data},
+			"total":    gin.H{"type": "integer", "format": "int64"},
+			"page":     gin.H{"type": "integer"},
+			"pageSize": gin.H{"type": "integer"},
+		}}
+	}
+	reply := gin.H{"type": "object", "required": []string{"success", "data"}, "properties": gin.H{
+		"success": gin.H{"type": "boolean"},
+		"data":    data,
+	}}
+
+	operation := gin.H{
+		"operationId": route.Id,
+		"tags":        []string{route.Tag},
+		"summary":     route.Summary,
+		"description": "Requires the " + route.Role + " role.",
+		"responses": gin.H{
+			strconv.Itoa(route.status()): gin.H{"description": http.StatusText(route.status()), "content": jsonContent(reply)},
+			"default":                    gin.H{"$ref": "#/components/responses/Error"},
+		},
+	}
+	if len(parameters) > 0 {
+		operation["parameters"] = parameters
+	}
+	if route.Body != nil {
+		operation["requestBody"] = gin.H{"required": true, "content": jsonContent(s.schemaOf(reflect.TypeOf(route.Body)))}
+	}
+	return operation
+}
+
+// openAPIDocument writes the OpenAPI document of routes, served under basePath.
+func openAPIDocument(routes []apiV2Route, basePath string) gin.H {
+	schemas := newOpenAPISchemas()
+	paths := gin.H{}
+	for _, route := range routes {
+		path, _ := openAPIPath(route.Path)
+		operations, ok := paths[path].(gin.H)
+		if !ok {
+			operations = gin.H{}
+			paths[path] = operations
+		}
+		operations[strings.ToLower(route.Method)] = schemas.operation(route)
+	}
+	paths[openAPISpecPath] = gin.H{"get": gin.H{
+		"operationId": "getOpenAPI",
+		"tags":        []string{"meta"},
+		"summary":     "This document",
+		"responses": gin.H{
+			"200": gin.H{"description": "The OpenAPI document of the API", "content": jsonContent(gin.H{"type": "object"})},
+		},
+	}}
+	paths[metricsSnapshotPath] = gin.H{
+		"servers": []gin.H{{"url": basePath + "panel/api"}},
+		"get": gin.H{
+			"operationId": "getMetricsSnapshot",
+			"tags":        []string{"metrics"},
+			"summary":     "A snapshot of the metrics, for the monitors that don't scrape Prometheus",
+			"description": "Requires the viewer role. The reply is the snapshot itself, not in the envelope of the v2 API.",
+			"responses": gin.H{
+				"200": gin.H{
+					"description": "The snapshot of the metrics",
+					"content":     jsonContent(schemas.schemaOf(reflect.TypeOf(service.MetricsSnapshot{}))),
+				},
+			},
+		},
+	}
+
+	errorSchema := schemas.schemaOf(reflect.TypeOf(entity.ResponseError{}))
+	return gin.H{
+		"openapi": "3.0.3",
+		"info": gin.H{
+			"title":       "3x-ui panel API",
+			"version":     config.GetVersion(),
+			"description": "Replies are {\"success\", \"data\"}, failures {\"success\": false, \"error\": {\"code\", \"message\"}} with an HTTP status to match. Lists are paged with page, from 1, and pageSize.",
+		},
+		"servers":  []gin.H{{"url": basePath + apiV2Prefix}},
+		"security": []gin.H{{"bearerAuth": []string{}}, {"cookieAuth": []string{}}},
+		"paths":    paths,
+		"components": gin.H{
+			"schemas": schemas.schemas,
+			"responses": gin.H{"Error": gin.H{
+				"description": "The request failed",
+				"content": jsonContent(gin.H{"type": "object", "properties": gin.H{
+					"success": gin.H{"type": "boolean"},
+					"data":    gin.H{"nullable": true},
+					"error":   errorSchema,
+				}}),
+			}},
+			"securitySchemes": gin.H{
+				"bearerAuth": gin.H{"type": "http", "scheme": "bearer", "description": "An API token of the panel"},
+				"cookieAuth": gin.H{"type": "apiKey", "in": "cookie", "name": "3x-ui"},
+			},
+		},
+	}
+}
+
+// UndocumentedApiV2Routes compares the routes of the engine under the v2 API
+// with its OpenAPI document. It returns the routes the document leaves out and
+// the operations of the document that are not routes, as "METHOD /path".
+func UndocumentedApiV2Routes(routes gin.RoutesInfo, basePath string) []string {
+	prefix := basePath + apiV2Prefix + "/"
+	served := map[string]bool{}
+	for _, route := range routes {
+		if path, ok := strings.CutPrefix(route.Path, prefix); ok {
+			path, _ = openAPIPath("/" + path)
+			served[route.Method+" "+path] = true
+		}
+	}
+	documented := map[string]bool{}
+	document := openAPIDocument((&ApiV2Controller{}).routes(), basePath)
+	for path, operations := range document["paths"].(gin.H) {
+		// Paths of their own servers are not of the v2 API
+		if _, ok := operations.(gin.H)["servers"]; ok {
+			continue
+		}
+		for method := range operations.(gin.H) {
+			documented[strings.ToUpper(method)+" "+path] = true
+		}
+	}
+
+	var mismatches []string
+	for route := range served {
+		if !documented[route] {
+			mismatches = append(mismatches, route)
+		}
+	}
+	for route := range documented {
+		if !served[route] {
+			mismatches = append(mismatches, route)
+		}
+	}
+	sort.Strings(mismatches)
+	return mismatches
+}
@@ -0,0 +1,119 @@
+package controller
+
+import (
+	"strconv"
+
+	"x-ui/database/model"
+	"x-ui/web/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// OutboundController manages the outbounds the panel adds to the Xray config,
+// besides those of the config template.
+type OutboundController struct {
+	outboundService service.OutboundService
+	xrayService     service.XrayService
+}
+
+func NewOutboundController(g *gin.RouterGroup) *OutboundController {
+	a := &OutboundController{}
+	a.initRouter(g)
+	return a
+}
+
+func (a *OutboundController) initRouter(g *gin.RouterGroup) {
+	g.GET("", a.getOutbounds)
+	g.GET("/tags", a.getOutboundTags)
+	g.GET("/:id", a.getOutbound)
+	g.POST("", a.addOutbound)
+	g.PUT("/:id", a.updateOutbound)
+	g.DELETE("/:id", a.delOutbound)
+}
+
+// getOutboundTags replies with the tags of the outbounds of the config template
+// and of the panel, those clients can be sent to.
+func (a *OutboundController) getOutboundTags(c *gin.Context) {
+	tags, err := a.outboundService.OutboundTags()
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	jsonObj(c, tags, nil)
+}
+
+func (a *OutboundController) getOutbounds(c *gin.Context) {
+	outbounds, err := a.outboundService.GetOutbounds()
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	jsonObj(c, outbounds, nil)
+}
+
+func (a *OutboundController) getOutbound(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	outbound, err := a.outboundService.GetOutbound(id)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	jsonObj(c, outbound, nil)
+}
+
+func (a *OutboundController) addOutbound(c *gin.Context) {
+	outbound := &model.Outbound{}
+	if err := c.ShouldBind(outbound); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.xray.outbound.saved"), err)
+		return
+	}
+	outbound, err := a.outboundService.AddOutbound(outbound)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.xray.outbound.saved"), err)
+		return
+	}
+	setAuditTarget(c, "outbound", strconv.Itoa(outbound.Id))
+	setAuditDiff(c, gin.H{}, outbound)
+	jsonMsgObj(c, I18nWeb(c, "pages.xray.outbound.saved"), outbound, nil)
+	a.xrayService.SetToNeedRestart()
+}
+
+func (a *OutboundController) updateOutbound(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.xray.outbound.saved"), err)
+		return
+	}
+	outbound := &model.Outbound{}
+	if err := c.ShouldBind(outbound); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.xray.outbound.saved"), err)
+		return
+	}
+	outbound.Id = id
+	before, _ := a.outboundService.GetOutbound(id)
+	outbound, err = a.outboundService.UpdateOutbound(outbound)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.xray.outbound.saved"), err)
+		return
+	}
+	setAuditDiff(c, before, outbound)
+	jsonMsgObj(c, I18nWeb(c, "pages.xray.outbound.saved"), outbound, nil)
+	a.xrayService.SetToNeedRestart()
+}
+
+func (a *OutboundController) delOutbound(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.xray.outbound.deleted"), err)
+		return
+	}
+	err = a.outboundService.DelOutbound(id)
+	jsonMsg(c, I18nWeb(c, "pages.xray.outbound.deleted"), err)
+	if err == nil {
+		a.xrayService.SetToNeedRestart()
+	}
+}
@@ -0,0 +1,72 @@
+package controller
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"x-ui/web/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PanelExportController exports the whole panel as a bundle and imports one
+// of another host.
+type PanelExportController struct {
+	panelExportService service.PanelExportService
+}
+
+func NewPanelExportController(g *gin.RouterGroup) *PanelExportController {
+	a := &PanelExportController{}
+	a.initRouter(g)
+	return a
+}
+
+func (a *PanelExportController) initRouter(g *gin.RouterGroup) {
+	g.GET("/export", a.export)
+	g.POST("/import", a.importPanel)
+	g.POST("/import/foreign", a.importForeign)
+}
+
+// export replies with the panel as a bundle, without the secrets with
+// "stripSecrets" and without the traffic counters with "stripTraffic".
+func (a *PanelExportController) export(c *gin.Context) {
+	stripSecrets, _ := strconv.ParseBool(c.Query("stripSecrets"))
+	stripTraffic, _ := strconv.ParseBool(c.Query("stripTraffic"))
+	doc, err := a.panelExportService.Export(stripSecrets, stripTraffic)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	filename := "x-ui-export-" + time.Now().Format("20060102-150405") + ".json"
+	c.Header("Content-Disposition", "attachment; filename="+filename)
+	c.JSON(http.StatusOK, doc)
+}
+
+// importPanel applies the bundle of the body with the "policy" query
+// parameter: replace-all, merge-keep-existing or merge-overwrite.
+func (a *PanelExportController) importPanel(c *gin.Context) {
+	data, err := c.GetRawData()
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	result, err := a.panelExportService.Import(data, c.Query("policy"))
+	jsonMsgObj(c, I18nWeb(c, "pages.settings.panelImported"), result, err)
+}
+
+// importForeign imports the inbounds and clients of another panel from the
+// body: the database of a legacy x-ui panel, an export of Marzban or the config
+// of an Xray server, as the "source" query parameter tells or told apart by
+// their content. "policy" is merge-keep-existing or merge-overwrite, and
+// "dryRun" only replies with what the import would do.
+func (a *PanelExportController) importForeign(c *gin.Context) {
+	data, err := c.GetRawData()
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	dryRun, _ := strconv.ParseBool(c.Query("dryRun"))
+	result, err := a.panelExportService.ImportForeign(data, c.Query("source"), c.Query("policy"), dryRun)
+	jsonMsgObj(c, I18nWeb(c, "pages.settings.foreignImported"), result, err)
+}
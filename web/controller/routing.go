@@ -0,0 +1,138 @@
+package controller
+
+import (
+	"strconv"
+
+	"x-ui/database/model"
+	"x-ui/web/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RoutingController manages the routing rules the panel adds to the Xray config,
+// after those of the config template.
+type RoutingController struct {
+	routingService service.RoutingService
+	xrayService    service.XrayService
+}
+
+type routingOrderForm struct {
+	Ids []int `json:"ids" form:"ids"`
+}
+
+func NewRoutingController(g *gin.RouterGroup) *RoutingController {
+	a := &RoutingController{}
+	a.initRouter(g)
+	return a
+}
+
+func (a *RoutingController) initRouter(g *gin.RouterGroup) {
+	g.GET("", a.getRules)
+	g.GET("/:id", a.getRule)
+	g.POST("", a.addRule)
+	g.PUT("/:id", a.updateRule)
+	g.DELETE("/:id", a.delRule)
+	g.POST("/reorder", a.reorderRules)
+	g.POST("/import", a.importRules)
+}
+
+func (a *RoutingController) getRules(c *gin.Context) {
+	rules, err := a.routingService.GetRules()
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	jsonObj(c, rules, nil)
+}
+
+func (a *RoutingController) getRule(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	rule, err := a.routingService.GetRule(id)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	jsonObj(c, rule, nil)
+}
+
+func (a *RoutingController) addRule(c *gin.Context) {
+	rule := &model.RoutingRule{}
+	if err := c.ShouldBind(rule); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.xray.rules.saved"), err)
+		return
+	}
+	rule, err := a.routingService.AddRule(rule)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.xray.rules.saved"), err)
+		return
+	}
+	setAuditTarget(c, "routing_rule", strconv.Itoa(rule.Id))
+	setAuditDiff(c, gin.H{}, rule)
+	jsonMsgObj(c, I18nWeb(c, "pages.xray.rules.saved"), rule, nil)
+	a.xrayService.SetToNeedRestart()
+}
+
+func (a *RoutingController) updateRule(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.xray.rules.saved"), err)
+		return
+	}
+	rule := &model.RoutingRule{}
+	if err := c.ShouldBind(rule); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.xray.rules.saved"), err)
+		return
+	}
+	rule.Id = id
+	before, _ := a.routingService.GetRule(id)
+	rule, err = a.routingService.UpdateRule(rule)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.xray.rules.saved"), err)
+		return
+	}
+	setAuditDiff(c, before, rule)
+	jsonMsgObj(c, I18nWeb(c, "pages.xray.rules.saved"), rule, nil)
+	a.xrayService.SetToNeedRestart()
+}
+
+func (a *RoutingController) delRule(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.xray.rules.deleted"), err)
+		return
+	}
+	err = a.routingService.DelRule(id)
+	jsonMsg(c, I18nWeb(c, "pages.xray.rules.deleted"), err)
+	if err == nil {
+		a.xrayService.SetToNeedRestart()
+	}
+}
+
+func (a *RoutingController) reorderRules(c *gin.Context) {
+	form := &routingOrderForm{}
+	if err := c.ShouldBind(form); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.xray.rules.reordered"), err)
+		return
+	}
+	err := a.routingService.ReorderRules(form.Ids)
+	jsonMsg(c, I18nWeb(c, "pages.xray.rules.reordered"), err)
+	if err == nil {
+		a.xrayService.SetToNeedRestart()
+	}
+}
+
+func (a *RoutingController) importRules(c *gin.Context) {
+	imported, kept, err := a.routingService.ImportTemplateRules()
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.xray.rules.imported"), err)
+		return
+	}
+	jsonMsgObj(c, I18nWeb(c, "pages.xray.rules.imported"), gin.H{"imported": imported, "kept": kept}, nil)
+	if imported > 0 {
+		a.xrayService.SetToNeedRestart()
+	}
+}
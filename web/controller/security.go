@@ -0,0 +1,41 @@
+package controller
+
+import (
+	"x-ui/web/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SecurityController reports the default credentials and the weak settings of
+// the panel.
+type SecurityController struct {
+	securityService service.SecurityService
+}
+
+func NewSecurityController(g *gin.RouterGroup) *SecurityController {
+	a := &SecurityController{}
+	a.initRouter(g)
+	return a
+}
+
+func (a *SecurityController) initRouter(g *gin.RouterGroup) {
+	g.GET("/report", a.getReport)
+}
+
+// getReport replies with the findings of the security report, their titles
+// and how to fix them in the language of the request.
+func (a *SecurityController) getReport(c *gin.Context) {
+	report := *a.securityService.Report()
+	findings := make([]service.SecurityFinding, len(report.Findings))
+	for i, finding := range report.Findings {
+		params := make([]string, 0, len(finding.Params))
+		for name, value := range finding.Params {
+			params = append(params, name+"=="+value)
+		}
+		finding.Title = I18nWeb(c, finding.TitleKey, params...)
+		finding.Hint = I18nWeb(c, finding.HintKey, params...)
+		findings[i] = finding
+	}
+	report.Findings = findings
+	jsonObj(c, report, nil)
+}
@@ -1,46 +1,49 @@
 package controller
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"regexp"
 	"time"
 
-	"x-ui/web/global"
+	"x-ui/logger"
 	"x-ui/web/service"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
 )
 
 var filenameRegex = regexp.MustCompile(`^[a-zA-Z0-9_\-.]+$`)
 
+// statusWriteTimeout is how long the dashboard is given to take a status
+const statusWriteTimeout = 10 * time.Second
+
+// statusUpgrader opens the status streams, to the origin of the panel only
+var statusUpgrader = websocket.Upgrader{}
+
 type ServerController struct {
 	BaseController
 
 	serverService  service.ServerService
 	settingService service.SettingService
 
-	lastStatus        *service.Status
-	lastGetStatusTime time.Time
-
 	lastVersions        []string
 	lastGetVersionsTime time.Time
 }
 
 func NewServerController(g *gin.RouterGroup) *ServerController {
-	a := &ServerController{
-		lastGetStatusTime: time.Now(),
-	}
+	a := &ServerController{}
 	a.initRouter(g)
-	a.startTask()
 	return a
 }
 
 func (a *ServerController) initRouter(g *gin.RouterGroup) {
 	g = g.Group("/server")
 
-	g.Use(a.checkLogin)
+	g.Use(a.checkLogin, a.audit, a.checkRole)
 	g.POST("/status", a.status)
+	g.GET("/status/ws", a.statusWs)
 	g.POST("/getXrayVersion", a.getXrayVersion)
 	g.POST("/stopXrayService", a.stopXrayService)
 	g.POST("/restartXrayService", a.restartXrayService)
@@ -57,26 +60,57 @@ func (a *ServerController) initRouter(g *gin.RouterGroup) {
 	g.POST("/getNewEchCert", a.getNewEchCert)
 }
 
-func (a *ServerController) refreshStatus() {
-	a.lastStatus = a.serverService.GetStatus(a.lastStatus)
+// status replies with the last status the status job took, or a status
+// sampled now if it took none yet.
+func (a *ServerController) status(c *gin.Context) {
+	status := a.serverService.GetLastStatus()
+	if status == nil {
+		status = a.serverService.GetStatus(nil)
+	}
+	jsonObj(c, status, nil)
 }
 
-func (a *ServerController) startTask() {
-	webServer := global.GetWebServer()
-	c := webServer.GetCron()
-	c.AddFunc("@every 2s", func() {
-		now := time.Now()
-		if now.Sub(a.lastGetStatusTime) > time.Minute*3 {
-			return
+// statusWs streams the status to the dashboard as the status job takes it:
+// all of its fields first, then the ones that changed.
+func (a *ServerController) statusWs(c *gin.Context) {
+	conn, err := statusUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// The upgrader replied already
+		return
+	}
+	defer conn.Close()
+	updates, cancel := a.serverService.SubscribeStatus()
+	defer cancel()
+	// The dashboard sends nothing, reading only finds that it went away
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				cancel()
+				return
+			}
 		}
-		a.refreshStatus()
-	})
-}
-
-func (a *ServerController) status(c *gin.Context) {
-	a.lastGetStatusTime = time.Now()
+	}()
 
-	jsonObj(c, a.lastStatus, nil)
+	var last map[string]json.RawMessage
+	status := a.serverService.GetLastStatus()
+	for {
+		if status != nil {
+			var delta map[string]json.RawMessage
+			delta, last, err = service.StatusDelta(last, status)
+			if err != nil {
+				logger.Warning("encode status failed:", err)
+				return
+			}
+			conn.SetWriteDeadline(time.Now().Add(statusWriteTimeout))
+			if err := conn.WriteJSON(delta); err != nil {
+				return
+			}
+		}
+		var ok bool
+		if status, ok = <-updates; !ok {
+			return
+		}
+	}
 }
 
 func (a *ServerController) getXrayVersion(c *gin.Context) {
@@ -111,7 +145,6 @@ func (a *ServerController) updateGeofile(c *gin.Context) {
 }
 
 func (a *ServerController) stopXrayService(c *gin.Context) {
-	a.lastGetStatusTime = time.Now()
 	err := a.serverService.StopXrayService()
 	if err != nil {
 		jsonMsg(c, I18nWeb(c, "pages.xray.stopError"), err)
@@ -191,14 +224,12 @@ func (a *ServerController) getConfigJson(c *gin.Context) {
 }
 
 func (a *ServerController) getDb(c *gin.Context) {
-	db, err := a.serverService.GetDb()
+	db, filename, err := a.serverService.GetDb()
 	if err != nil {
 		jsonMsg(c, I18nWeb(c, "pages.index.getDatabaseError"), err)
 		return
 	}
 
-	filename := "x-ui.db"
-
 	if !isValidFilename(filename) {
 		c.AbortWithError(http.StatusBadRequest, fmt.Errorf("invalid filename"))
 		return
@@ -227,11 +258,8 @@ func (a *ServerController) importDB(c *gin.Context) {
 	defer file.Close()
 	// Always restart Xray before return
 	defer a.serverService.RestartXrayService()
-	defer func() {
-		a.lastGetStatusTime = time.Now()
-	}()
 	// Import it
-	err = a.serverService.ImportDB(file)
+	err = a.serverService.ImportDB(file, c.PostForm("passphrase"))
 	if err != nil {
 		jsonMsg(c, I18nWeb(c, "pages.index.importDatabaseError"), err)
 		return
@@ -2,8 +2,10 @@ package controller
 
 import (
 	"errors"
+	"strconv"
 	"time"
 
+	"x-ui/logger"
 	"x-ui/util/crypto"
 	"x-ui/web/entity"
 	"x-ui/web/service"
@@ -13,16 +15,35 @@ import (
 )
 
 type updateUserForm struct {
-	OldUsername string `json:"oldUsername" form:"oldUsername"`
-	OldPassword string `json:"oldPassword" form:"oldPassword"`
-	NewUsername string `json:"newUsername" form:"newUsername"`
-	NewPassword string `json:"newPassword" form:"newPassword"`
+	OldUsername   string `json:"oldUsername" form:"oldUsername"`
+	OldPassword   string `json:"oldPassword" form:"oldPassword"`
+	NewUsername   string `json:"newUsername" form:"newUsername"`
+	NewPassword   string `json:"newPassword" form:"newPassword"`
+	TwoFactorCode string `json:"twoFactorCode" form:"twoFactorCode"`
+}
+
+// tgBotTestForm is the connection of the bot to test, as it is on the settings
+// page, which may not be saved yet.
+type tgBotTestForm struct {
+	TgBotToken     string `json:"tgBotToken" form:"tgBotToken"`
+	TgBotProxy     string `json:"tgBotProxy" form:"tgBotProxy"`
+	TgBotAPIServer string `json:"tgBotAPIServer" form:"tgBotAPIServer"`
+}
+
+// alertTestForm is the channel to send a test alert to, with the email and the
+// webhook as they are on the settings page, which may not be saved yet.
+type alertTestForm struct {
+	Channel string `json:"channel" form:"channel"`
+	entity.AllSetting
 }
 
 type SettingController struct {
 	settingService service.SettingService
 	userService    service.UserService
 	panelService   service.PanelService
+	sessionStore   service.LoginSessionService
+	tgbotService   service.Tgbot
+	xrayService    service.XrayService
 }
 
 func NewSettingController(g *gin.RouterGroup) *SettingController {
@@ -31,14 +52,26 @@ func NewSettingController(g *gin.RouterGroup) *SettingController {
 	return a
 }
 
+// NewSettingsAPIController registers the routes of the API to preview and to
+// save the settings, under g.
+func NewSettingsAPIController(g *gin.RouterGroup) *SettingController {
+	a := &SettingController{}
+	g.POST("/preview", a.previewSetting)
+	g.POST("/update", a.updateSetting)
+	return a
+}
+
 func (a *SettingController) initRouter(g *gin.RouterGroup) {
 	g = g.Group("/setting")
 
 	g.POST("/all", a.getAllSetting)
 	g.POST("/defaultSettings", a.getDefaultSettings)
 	g.POST("/update", a.updateSetting)
+	g.POST("/preview", a.previewSetting)
 	g.POST("/updateUser", a.updateUser)
 	g.POST("/restartPanel", a.restartPanel)
+	g.POST("/testTgBot", a.testTgBot)
+	g.POST("/testAlert", a.testAlert)
 	g.GET("/getDefaultJsonConfig", a.getDefaultXrayConfig)
 }
 
@@ -67,8 +100,78 @@ func (a *SettingController) updateSetting(c *gin.Context) {
 		jsonMsg(c, I18nWeb(c, "pages.settings.toasts.modifySettings"), err)
 		return
 	}
+	before, _ := a.settingService.GetAllSetting()
 	err = a.settingService.UpdateAllSetting(allSetting)
-	jsonMsg(c, I18nWeb(c, "pages.settings.toasts.modifySettings"), err)
+	var change *service.SettingsChange
+	if err == nil {
+		after, _ := a.settingService.GetAllSetting()
+		setAuditDiff(c, before, after)
+		if before != nil && after != nil {
+			change, err = a.xrayService.SettingsChange(before, after)
+			if change != nil && change.XrayRestart {
+				a.xrayService.SetToNeedRestart()
+			}
+		}
+	}
+	jsonMsgObj(c, I18nWeb(c, "pages.settings.toasts.modifySettings"), change, err)
+}
+
+// previewSetting replies with what saving the settings of the request would
+// change, without saving them.
+func (a *SettingController) previewSetting(c *gin.Context) {
+	allSetting := &entity.AllSetting{}
+	if err := c.ShouldBind(allSetting); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.toasts.previewSettings"), err)
+		return
+	}
+	if err := a.settingService.CheckAllSetting(allSetting); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.toasts.previewSettings"), err)
+		return
+	}
+	before, err := a.settingService.GetAllSetting()
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.toasts.previewSettings"), err)
+		return
+	}
+	change, err := a.xrayService.SettingsChange(before, allSetting)
+	jsonObj(c, change, err)
+}
+
+// testTgBot calls getMe with the bot of the form and reports its latency, or
+// why it failed.
+func (a *SettingController) testTgBot(c *gin.Context) {
+	form := &tgBotTestForm{}
+	if err := c.ShouldBind(form); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.toasts.tgBotTestFail"), err)
+		return
+	}
+	if err := (&entity.AllSetting{TgBotProxy: form.TgBotProxy, TgBotAPIServer: form.TgBotAPIServer}).CheckTgBotConnection(); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.toasts.tgBotTestFail"), err)
+		return
+	}
+	result, err := a.tgbotService.TestConnection(form.TgBotToken, form.TgBotProxy, form.TgBotAPIServer)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.toasts.tgBotTestFail"), err)
+		return
+	}
+	jsonMsgObj(c, I18nWeb(c, "pages.settings.toasts.tgBotTestSuccess",
+		"Bot==@"+result.Username, "Latency=="+strconv.FormatInt(result.Latency, 10)), result, nil)
+}
+
+// testAlert sends a test alert to the channel of the form at once, and reports
+// why it failed.
+func (a *SettingController) testAlert(c *gin.Context) {
+	form := &alertTestForm{}
+	if err := c.ShouldBind(form); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.toasts.alertTestFail"), err)
+		return
+	}
+	config := form.AlertConfig()
+	if err := a.tgbotService.TestAlert(form.Channel, &config); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.toasts.alertTestFail"), err)
+		return
+	}
+	jsonMsg(c, I18nWeb(c, "pages.settings.toasts.alertTestSuccess"), nil)
 }
 
 func (a *SettingController) updateUser(c *gin.Context) {
@@ -87,11 +190,25 @@ func (a *SettingController) updateUser(c *gin.Context) {
 		jsonMsg(c, I18nWeb(c, "pages.settings.toasts.modifyUserError"), errors.New(I18nWeb(c, "pages.settings.toasts.userPassMustBeNotEmpty")))
 		return
 	}
+	current, err := a.userService.GetUserById(user.Id)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.toasts.modifyUserError"), err)
+		return
+	}
+	if current.TotpEnabled {
+		if ok, err := a.userService.CheckTwoFactor(current, form.TwoFactorCode); err != nil || !ok {
+			jsonMsg(c, I18nWeb(c, "pages.settings.toasts.modifyUserError"), errors.New(I18nWeb(c, "pages.settings.security.twoFactorModalError")))
+			return
+		}
+	}
 	err = a.userService.UpdateUser(user.Id, form.NewUsername, form.NewPassword)
 	if err == nil {
 		user.Username = form.NewUsername
-		user.Password, _ = crypto.HashPasswordAsBcrypt(form.NewPassword)
 		session.SetLoginUser(c, user)
+		// Whoever knew the old password may still be logged in elsewhere
+		if _, err := a.sessionStore.DelOtherSessions(user.Id, currentSessionId(c)); err != nil {
+			logger.Warning("Unable to revoke the other sessions:", err)
+		}
 	}
 	jsonMsg(c, I18nWeb(c, "pages.settings.toasts.modifyUser"), err)
 }
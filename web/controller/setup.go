@@ -0,0 +1,121 @@
+package controller
+
+import (
+	"net/http"
+	"strings"
+
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/web/middleware"
+	"x-ui/web/service"
+	"x-ui/web/session"
+
+	"github.com/gin-gonic/gin"
+)
+
+// setupExempt are the routes that stay reachable before the panel is set up,
+// relative to the base path.
+var setupExempt = map[string]bool{
+	"GET setup":             true,
+	"POST setup":            true,
+	"POST setup/twoFactor":  true,
+	"GET assets/*filepath":  true,
+	"HEAD assets/*filepath": true,
+	"GET healthz":           true,
+}
+
+// SetupGuard sends everyone to the setup until the panel is set up. It has to
+// run before the routes are registered.
+func SetupGuard() gin.HandlerFunc {
+	a := &SetupController{}
+	return middleware.FirstRun(a.setupService.Pending, a.exempt, func(c *gin.Context) string {
+		return c.GetString("base_path") + "setup"
+	})
+}
+
+// SetupController serves the first-run setup of the panel.
+type SetupController struct {
+	BaseController
+	setupService service.SetupService
+	panelService service.PanelService
+}
+
+func NewSetupController(g *gin.RouterGroup) *SetupController {
+	a := &SetupController{}
+	a.initRouter(g)
+	return a
+}
+
+func (a *SetupController) initRouter(g *gin.RouterGroup) {
+	g.GET("/setup", a.setupPage)
+	g.POST("/setup", a.setup)
+	g.POST("/setup/twoFactor", a.newTwoFactor)
+}
+
+// exempt lets through the setup itself, its assets and the ACME challenges of
+// the certificate it issues.
+func (a *SetupController) exempt(c *gin.Context) bool {
+	if c.FullPath() == "/.well-known/acme-challenge/:token" {
+		return true
+	}
+	route := strings.TrimPrefix(c.FullPath(), c.GetString("base_path"))
+	return setupExempt[c.Request.Method+" "+route]
+}
+
+func (a *SetupController) setupPage(c *gin.Context) {
+	if !a.setupService.Pending() {
+		c.Redirect(http.StatusTemporaryRedirect, c.GetString("base_path"))
+		return
+	}
+	html(c, "setup.html", "pages.setup.title", nil)
+}
+
+func (a *SetupController) newTwoFactor(c *gin.Context) {
+	setup, err := a.setupService.NewSetupTwoFactor(c.PostForm("username"))
+	jsonObj(c, setup, err)
+}
+
+// setup sets the panel up and restarts it on its new settings, replying with
+// the URL it is at afterwards. A certificate over ACME is issued after that,
+// and the panel restarted once more to use it.
+func (a *SetupController) setup(c *gin.Context) {
+	form := &service.SetupForm{}
+	if err := c.ShouldBind(form); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.setup.failed"), err)
+		return
+	}
+	result, err := a.setupService.Setup(form)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.setup.failed"), err)
+		return
+	}
+	a.auditLog.Record(&model.AuditLog{
+		Actor:      result.Username,
+		Action:     "panel.setup",
+		EntityType: "panel",
+		Ip:         middleware.ClientIP(c),
+		Success:    true,
+	})
+
+	origin := c.GetHeader("X-Forwarded-Host")
+	if origin == "" {
+		origin = c.Request.Host
+	}
+	if result.Url, err = a.panelService.ApplySettings(session.IsSecureRequest(c), origin); err != nil {
+		// The setup is saved either way, the panel starts on it next time
+		logger.Warning("Unable to restart the panel after its setup:", err)
+	}
+	if domain := result.AcmeDomain; domain != "" {
+		go func() {
+			if err := a.setupService.IssueSetupCertificate(domain); err != nil {
+				return
+			}
+			if url, err := a.panelService.ApplySettings(true, origin); err != nil {
+				logger.Warning("Unable to restart the panel on the certificate of", domain+":", err)
+			} else {
+				logger.Info("The panel uses the certificate of", domain, "at", url)
+			}
+		}()
+	}
+	jsonMsgObj(c, I18nWeb(c, "pages.setup.done"), result, nil)
+}
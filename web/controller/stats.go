@@ -0,0 +1,92 @@
+package controller
+
+import (
+	"net/http"
+
+	"x-ui/web/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// StatsController serves the traffic history of the inbounds, the clients and
+// the panel, the status history of the server, for charts, the geo stats and
+// the snapshot of the metrics.
+type StatsController struct {
+	inboundService         service.InboundService
+	serverService          service.ServerService
+	geoStatsService        service.GeoStatsService
+	metricsSnapshotService service.MetricsSnapshotService
+}
+
+func NewStatsController(g *gin.RouterGroup) *StatsController {
+	a := &StatsController{}
+	a.initRouter(g)
+	return a
+}
+
+func (a *StatsController) initRouter(g *gin.RouterGroup) {
+	g.GET("/history", a.getHistory)
+	g.GET("/geo", a.getGeo)
+}
+
+// getHistory returns the traffic of an entity by hours or days, like
+// ?entity=client&id=alice&from=...&to=...&resolution=day with the times in
+// milliseconds. Without an entity it is the traffic of the whole panel.
+func (a *StatsController) getHistory(c *gin.Context) {
+	query := service.TrafficHistoryQuery{}
+	if err := c.ShouldBindQuery(&query); err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	series, err := a.inboundService.GetTrafficHistory(query)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	jsonObj(c, series, nil)
+}
+
+// getMetricsSnapshot replies with the snapshot of the metrics itself, a flat
+// document for the monitors to read without an envelope.
+func (a *StatsController) getMetricsSnapshot(c *gin.Context) {
+	snapshot, err := a.metricsSnapshotService.GetSnapshot()
+	if err != nil {
+		pureJsonMsg(c, http.StatusInternalServerError, false, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, snapshot)
+}
+
+// getStatusHistory returns the status of the server over a range, like
+// ?from=...&to=...&resolution=hour with the times in milliseconds, the
+// resolution being raw, minute or hour.
+func (a *StatsController) getStatusHistory(c *gin.Context) {
+	query := service.StatusHistoryQuery{}
+	if err := c.ShouldBindQuery(&query); err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	history, err := a.serverService.GetStatusHistory(query)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	jsonObj(c, history, nil)
+}
+
+// getGeo returns the connections and the traffic by country over a range
+// of days, like ?from=...&to=...&groupBy=client with the times in
+// milliseconds, grouped by country or by client and country.
+func (a *StatsController) getGeo(c *gin.Context) {
+	query := service.GeoStatsQuery{}
+	if err := c.ShouldBindQuery(&query); err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	stats, err := a.geoStatsService.GetGeoStats(query)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	jsonObj(c, stats, nil)
+}
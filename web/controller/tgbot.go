@@ -0,0 +1,44 @@
+package controller
+
+import (
+	"x-ui/web/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+type tgTemplatePreviewForm struct {
+	Kind     string `json:"kind" form:"kind"`
+	Template string `json:"template" form:"template"`
+	// ParseMode is the one of the settings if it is empty
+	ParseMode string `json:"parseMode" form:"parseMode"`
+}
+
+// TgbotController serves the Telegram bot settings that aren't plain values.
+type TgbotController struct {
+	tgbotService service.Tgbot
+}
+
+func NewTgbotController(g *gin.RouterGroup) *TgbotController {
+	a := &TgbotController{}
+	a.initRouter(g)
+	return a
+}
+
+func (a *TgbotController) initRouter(g *gin.RouterGroup) {
+	g.POST("/templates/preview", a.previewTemplate)
+}
+
+// previewTemplate renders a message template, saved or not, with sample data.
+func (a *TgbotController) previewTemplate(c *gin.Context) {
+	form := &tgTemplatePreviewForm{}
+	if err := c.ShouldBind(form); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.toasts.tgTemplatePreviewFail"), err)
+		return
+	}
+	preview, err := a.tgbotService.PreviewTemplate(form.Kind, form.Template, form.ParseMode)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.toasts.tgTemplatePreviewFail"), err)
+		return
+	}
+	jsonObj(c, preview, nil)
+}
@@ -0,0 +1,58 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	"x-ui/logger"
+	"x-ui/web/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// localTimes renders the times in obj in the time zone of the panel, for the
+// requests with "tz=local". Times in unix milliseconds have no zone to render
+// and stay as they are; the zone is in the X-Time-Zone header for them.
+func localTimes(c *gin.Context, obj any) any {
+	if obj == nil || c.Query("tz") != "local" {
+		return obj
+	}
+	loc, err := (&service.SettingService{}).GetTimeLocation()
+	if err != nil {
+		logger.Warning("Unable to get the time zone of the panel:", err)
+		return obj
+	}
+	c.Header("X-Time-Zone", loc.String())
+
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return obj
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return obj
+	}
+	return inLocation(value, loc)
+}
+
+// inLocation moves the RFC 3339 times in value, as decoded from JSON, to loc.
+func inLocation(value any, loc *time.Location) any {
+	switch value := value.(type) {
+	case map[string]any:
+		for key, item := range value {
+			value[key] = inLocation(item, loc)
+		}
+	case []any:
+		for i, item := range value {
+			value[i] = inLocation(item, loc)
+		}
+	case string:
+		if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+			return t.In(loc).Format(time.RFC3339Nano)
+		}
+	}
+	return value
+}
@@ -0,0 +1,63 @@
+package controller
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+	_ "time/tzdata"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/web/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestLocalTimes(t *testing.T) {
+	if err := database.InitDB(t.TempDir() + "/x-ui.db"); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.GetDB().Create(&model.Setting{Key: "timeLocation", Value: "Asia/Tehran"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	service.InvalidateSettings()
+	type report struct {
+		At       time.Time   `json:"at"`
+		AtMillis int64       `json:"atMillis"`
+		Name     string      `json:"name"`
+		Runs     []time.Time `json:"runs"`
+	}
+	at := time.Date(2025, 2, 28, 20, 30, 0, 0, time.UTC)
+	obj := report{At: at, AtMillis: at.UnixMilli(), Name: "2025", Runs: []time.Time{at.Add(time.Hour)}}
+
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("GET", "/panel/api/server/status", nil)
+	if got, ok := localTimes(c, obj).(report); !ok || !got.At.Equal(at) || w.Header().Get("X-Time-Zone") != "" {
+		t.Errorf("without tz=local the times became %v", got)
+	}
+
+	w = httptest.NewRecorder()
+	c, _ = gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("GET", "/panel/api/server/status?tz=local", nil)
+	got, ok := localTimes(c, obj).(map[string]any)
+	if !ok {
+		t.Fatalf("the times with tz=local are %v", got)
+	}
+	if zone := w.Header().Get("X-Time-Zone"); zone != "Asia/Tehran" {
+		t.Errorf("the zone header is %q", zone)
+	}
+	// Half an hour off the hours of UTC, on the next day there
+	if got["at"] != "2025-03-01T00:00:00+03:30" {
+		t.Errorf("the time is %v", got["at"])
+	}
+	if runs, _ := got["runs"].([]any); len(runs) != 1 || runs[0] != "2025-03-01T01:00:00+03:30" {
+		t.Errorf("the times in a list are %v", got["runs"])
+	}
+	if millis, _ := got["atMillis"].(json.Number); millis.String() != strconv.FormatInt(at.UnixMilli(), 10) || got["name"] != "2025" {
+		t.Errorf("the values that aren't times changed: %v, %v", got["atMillis"], got["name"])
+	}
+}
@@ -0,0 +1,56 @@
+package controller
+
+import (
+	"strconv"
+
+	"x-ui/web/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TrashController lists the deleted inbounds and clients and restores them.
+type TrashController struct {
+	inboundService service.InboundService
+	xrayService    service.XrayService
+}
+
+func NewTrashController(g *gin.RouterGroup) *TrashController {
+	a := &TrashController{}
+	a.initRouter(g)
+	return a
+}
+
+func (a *TrashController) initRouter(g *gin.RouterGroup) {
+	g.GET("", a.getTrash)
+	g.POST("/:id/restore", a.restore)
+}
+
+// isPermanent tells if a delete request skips the trash, with ?permanent=true.
+func isPermanent(c *gin.Context) bool {
+	permanent, _ := strconv.ParseBool(c.Query("permanent"))
+	return permanent
+}
+
+func (a *TrashController) getTrash(c *gin.Context) {
+	entries, err := a.inboundService.GetTrash()
+	jsonObj(c, entries, err)
+}
+
+// restore puts an entry of the trash back. It fails, keeping the entry, if its
+// port, tag or emails were taken meanwhile.
+func (a *TrashController) restore(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.trashRestored"), err)
+		return
+	}
+	needRestart, err := a.inboundService.RestoreTrash(id)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.trashRestored"), nil)
+	if needRestart {
+		a.xrayService.SetToNeedRestart()
+	}
+}
@@ -0,0 +1,104 @@
+package controller
+
+import (
+	"x-ui/logger"
+	"x-ui/web/service"
+	"x-ui/web/session"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+type twoFactorCodeForm struct {
+	Code string `json:"code" form:"code"`
+}
+
+// TwoFactorController lets the logged in user manage their own TOTP enrollment.
+type TwoFactorController struct {
+	userService service.UserService
+}
+
+func NewTwoFactorController(g *gin.RouterGroup) *TwoFactorController {
+	a := &TwoFactorController{}
+	a.initRouter(g)
+	return a
+}
+
+func (a *TwoFactorController) initRouter(g *gin.RouterGroup) {
+	g.GET("/status", a.status)
+	g.POST("/setup", a.setup)
+	g.POST("/enable", a.enable)
+	g.POST("/disable", a.disable)
+	g.POST("/recovery-codes", a.regenerateRecoveryCodes)
+}
+
+func (a *TwoFactorController) status(c *gin.Context) {
+	user, err := a.userService.GetUserById(session.GetLoginUser(c).Id)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.security.twoFactorStatusError"), err)
+		return
+	}
+	jsonObj(c, gin.H{"enabled": user.TotpEnabled}, nil)
+}
+
+func (a *TwoFactorController) setup(c *gin.Context) {
+	setup, err := a.userService.SetupTwoFactor(session.GetLoginUser(c).Id)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.security.twoFactorModalSetTitle"), err)
+		return
+	}
+	jsonObj(c, setup, nil)
+}
+
+func (a *TwoFactorController) enable(c *gin.Context) {
+	form := &twoFactorCodeForm{}
+	if err := c.ShouldBind(form); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.security.twoFactorModalSetTitle"), err)
+		return
+	}
+	user := session.GetLoginUser(c)
+	codes, err := a.userService.EnableTwoFactor(user.Id, form.Code)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.security.twoFactorModalSetTitle"), err)
+		return
+	}
+
+	// Every session issued before now is revoked; reissue the current one since it
+	// has just proven the new factor
+	user.TotpEnabled = true
+	session.SetLoginUser(c, user)
+	if err := sessions.Default(c).Save(); err != nil {
+		logger.Warning("Unable to save session: ", err)
+	}
+	logger.Infof("%s enabled two-factor authentication", user.Username)
+	jsonMsgObj(c, I18nWeb(c, "pages.settings.security.twoFactorModalSetSuccess"), gin.H{"recoveryCodes": codes}, nil)
+}
+
+func (a *TwoFactorController) disable(c *gin.Context) {
+	form := &twoFactorCodeForm{}
+	if err := c.ShouldBind(form); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.security.twoFactorModalDeleteTitle"), err)
+		return
+	}
+	user := session.GetLoginUser(c)
+	if err := a.userService.DisableTwoFactor(user.Id, form.Code); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.security.twoFactorModalDeleteTitle"), err)
+		return
+	}
+	logger.Infof("%s disabled two-factor authentication", user.Username)
+	jsonMsg(c, I18nWeb(c, "pages.settings.security.twoFactorModalDeleteSuccess"), nil)
+}
+
+func (a *TwoFactorController) regenerateRecoveryCodes(c *gin.Context) {
+	form := &twoFactorCodeForm{}
+	if err := c.ShouldBind(form); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.security.recoveryCodesRegenerate"), err)
+		return
+	}
+	codes, err := a.userService.RegenerateRecoveryCodes(session.GetLoginUser(c).Id, form.Code)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.security.recoveryCodesRegenerate"), err)
+		return
+	}
+	jsonMsgObj(c, I18nWeb(c, "pages.settings.security.recoveryCodesRegenerated"), gin.H{"recoveryCodes": codes}, nil)
+}
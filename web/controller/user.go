@@ -0,0 +1,232 @@
+package controller
+
+import (
+	"strconv"
+
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/util/crypto"
+	"x-ui/web/service"
+	"x-ui/web/session"
+
+	"github.com/gin-gonic/gin"
+)
+
+type userForm struct {
+	Username string `json:"username" form:"username"`
+	Password string `json:"password" form:"password"`
+	Role     string `json:"role" form:"role"`
+	TgChatId int64  `json:"tgChatId" form:"tgChatId"`
+}
+
+// userInfo is a panel user as listed to admins, without any credentials.
+type userInfo struct {
+	Id          int    `json:"id"`
+	Username    string `json:"username"`
+	Role        string `json:"role"`
+	TgChatId    int64  `json:"tgChatId"`
+	TotpEnabled bool   `json:"totpEnabled"`
+	// PasswordStale is set while the password is stored with a hash from before
+	// argon2id
+	PasswordStale bool                 `json:"passwordStale"`
+	SessionLimits *model.SessionLimits `json:"sessionLimits"`
+}
+
+func newUserInfo(user *model.User) *userInfo {
+	return &userInfo{
+		Id:            user.Id,
+		Username:      user.Username,
+		Role:          user.Role,
+		TgChatId:      user.TgChatId,
+		TotpEnabled:   user.TotpEnabled,
+		PasswordStale: !crypto.IsArgon2idHash(user.Password),
+		SessionLimits: user.SessionLimits,
+	}
+}
+
+// UserController lets admins manage the panel users and their roles.
+type UserController struct {
+	userService    service.UserService
+	settingService service.SettingService
+}
+
+func NewUserController(g *gin.RouterGroup) *UserController {
+	a := &UserController{}
+	a.initRouter(g)
+	return a
+}
+
+func (a *UserController) initRouter(g *gin.RouterGroup) {
+	g.GET("", a.getUsers)
+	g.POST("", a.addUser)
+	g.GET("/passwords", a.getPasswordStatus)
+	g.POST("/passwords", a.setPasswordResetDeadline)
+	g.POST("/:id/password", a.resetPassword)
+	g.POST("/:id/sessionLimits", a.setSessionLimits)
+	g.DELETE("/:id/sessionLimits", a.delSessionLimits)
+	g.POST("/:id", a.updateUser)
+	g.DELETE("/:id", a.delUser)
+}
+
+func (a *UserController) getUsers(c *gin.Context) {
+	users, err := a.userService.GetUsers()
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.users.error"), err)
+		return
+	}
+	infos := make([]*userInfo, 0, len(users))
+	for _, user := range users {
+		infos = append(infos, newUserInfo(user))
+	}
+	jsonObj(c, infos, nil)
+}
+
+func (a *UserController) addUser(c *gin.Context) {
+	form := &userForm{}
+	if err := c.ShouldBind(form); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.users.added"), err)
+		return
+	}
+	user, err := a.userService.AddUser(form.Username, form.Password, form.Role, form.TgChatId)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.users.added"), err)
+		return
+	}
+	logger.Infof("%s added %s user %s", session.GetLoginUser(c).Username, user.Role, user.Username)
+	jsonMsgObj(c, I18nWeb(c, "pages.settings.users.added"), newUserInfo(user), nil)
+}
+
+// updateUser changes the role and Telegram chat of a user; the username and
+// password are changed by the user themselves.
+func (a *UserController) updateUser(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.users.updated"), err)
+		return
+	}
+	form := &userForm{}
+	if err := c.ShouldBind(form); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.users.updated"), err)
+		return
+	}
+	err = a.userService.UpdateUserRole(id, form.Role, form.TgChatId)
+	if err == nil {
+		logger.Infof("%s set the role of user %d to %s", session.GetLoginUser(c).Username, id, form.Role)
+	}
+	jsonMsg(c, I18nWeb(c, "pages.settings.users.updated"), err)
+}
+
+func (a *UserController) delUser(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.users.removed"), err)
+		return
+	}
+	err = a.userService.DelUser(id)
+	if err == nil {
+		logger.Infof("%s removed user %d", session.GetLoginUser(c).Username, id)
+	}
+	jsonMsg(c, I18nWeb(c, "pages.settings.users.removed"), err)
+}
+
+// sessionLimitsForm carries the session limits of a user, in JSON in forms.
+type sessionLimitsForm struct {
+	SessionLimits *model.SessionLimits `json:"sessionLimits" form:"sessionLimits"`
+}
+
+// setSessionLimits sets the session limits of a user that override those of
+// the settings; the limits left out are those of the settings.
+func (a *UserController) setSessionLimits(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.users.updated"), err)
+		return
+	}
+	form := &sessionLimitsForm{}
+	if err = c.ShouldBind(form); err == nil && form.SessionLimits == nil {
+		err = common.NewError("no session limits given")
+	}
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.users.updated"), err)
+		return
+	}
+	a.saveSessionLimits(c, id, form.SessionLimits)
+}
+
+// delSessionLimits gives a user the session limits of the settings again.
+func (a *UserController) delSessionLimits(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.users.updated"), err)
+		return
+	}
+	a.saveSessionLimits(c, id, nil)
+}
+
+func (a *UserController) saveSessionLimits(c *gin.Context, id int, limits *model.SessionLimits) {
+	err := a.userService.SetSessionLimits(id, limits)
+	if err == nil {
+		logger.Infof("%s set the session limits of user %d", session.GetLoginUser(c).Username, id)
+	}
+	jsonMsg(c, I18nWeb(c, "pages.settings.users.updated"), err)
+}
+
+// getPasswordStatus returns the deadline for the password reset and the users who
+// still have to log in before it to upgrade their password hash.
+func (a *UserController) getPasswordStatus(c *gin.Context) {
+	deadline, err := a.settingService.GetPasswordResetDeadline()
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.users.error"), err)
+		return
+	}
+	users, err := a.userService.GetStaleUsers()
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.users.error"), err)
+		return
+	}
+	infos := make([]*userInfo, 0, len(users))
+	for _, user := range users {
+		infos = append(infos, newUserInfo(user))
+	}
+	jsonObj(c, gin.H{"deadline": deadline, "stale": infos}, nil)
+}
+
+// setPasswordResetDeadline sets the unix milliseconds after which the users listed
+// by getPasswordStatus can only log in once an admin reset their password. A
+// deadline of 0 turns it off.
+func (a *UserController) setPasswordResetDeadline(c *gin.Context) {
+	form := &struct {
+		Deadline int64 `json:"deadline" form:"deadline"`
+	}{}
+	if err := c.ShouldBind(form); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.users.passwordResetDeadlineSet"), err)
+		return
+	}
+	if form.Deadline < 0 {
+		form.Deadline = 0
+	}
+	err := a.settingService.SetPasswordResetDeadline(form.Deadline)
+	if err == nil {
+		logger.Infof("%s set the password reset deadline to %d", session.GetLoginUser(c).Username, form.Deadline)
+	}
+	jsonMsg(c, I18nWeb(c, "pages.settings.users.passwordResetDeadlineSet"), err)
+}
+
+func (a *UserController) resetPassword(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.users.passwordReset"), err)
+		return
+	}
+	form := &userForm{}
+	if err := c.ShouldBind(form); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.users.passwordReset"), err)
+		return
+	}
+	err = a.userService.ResetUserPassword(id, form.Password)
+	if err == nil {
+		logger.Infof("%s reset the password of user %d", session.GetLoginUser(c).Username, id)
+	}
+	jsonMsg(c, I18nWeb(c, "pages.settings.users.passwordReset"), err)
+}
@@ -1,6 +1,7 @@
 package controller
 
 import (
+	"errors"
 	"net"
 	"net/http"
 	"strings"
@@ -8,24 +9,16 @@ import (
 	"x-ui/config"
 	"x-ui/logger"
 	"x-ui/web/entity"
+	"x-ui/web/locale"
+	"x-ui/web/service"
+	"x-ui/web/session"
 
 	"github.com/gin-gonic/gin"
 )
 
-func getRemoteIp(c *gin.Context) string {
-	value := c.GetHeader("X-Real-IP")
-	if value != "" {
-		return value
-	}
-	value = c.GetHeader("X-Forwarded-For")
-	if value != "" {
-		ips := strings.Split(value, ",")
-		return ips[0]
-	}
-	addr := c.Request.RemoteAddr
-	ip, _, _ := net.SplitHostPort(addr)
-	return ip
-}
+// requestFailedKey marks a request whose handler replied with success false, for
+// the audit log
+const requestFailedKey = "request_failed"
 
 func jsonMsg(c *gin.Context, msg string, err error) {
 	jsonMsgObj(c, msg, nil, err)
@@ -37,7 +30,7 @@ func jsonObj(c *gin.Context, obj any, err error) {
 
 func jsonMsgObj(c *gin.Context, msg string, obj any, err error) {
 	m := entity.Msg{
-		Obj: obj,
+		Obj: localTimes(c, obj),
 	}
 	if err == nil {
 		m.Success = true
@@ -46,24 +39,59 @@ func jsonMsgObj(c *gin.Context, msg string, obj any, err error) {
 		}
 	} else {
 		m.Success = false
-		m.Msg = msg + " (" + err.Error() + ")"
+		if coded, ok := locale.CodeOf(err); ok {
+			m.Code = coded.Code
+			m.Msg = msg + " (" + coded.Code.Message(c, coded.Params...) + ")"
+			if limitErr := (*service.InboundLimitError)(nil); obj == nil && errors.As(err, &limitErr) {
+				// The limit and the usage, for scripts
+				m.Obj = limitErr
+			}
+		} else {
+			m.Msg = msg + " (" + err.Error() + ")"
+		}
+		c.Set(requestFailedKey, true)
 		logger.Warning(msg+" "+I18nWeb(c, "fail")+": ", err)
 	}
 	c.JSON(http.StatusOK, m)
 }
 
 func pureJsonMsg(c *gin.Context, statusCode int, success bool, msg string) {
+	if !success {
+		c.Set(requestFailedKey, true)
+	}
 	c.JSON(statusCode, entity.Msg{
 		Success: success,
 		Msg:     msg,
 	})
 }
 
+// jsonError replies with the localized message of code. Unlike the other
+// replies it always carries the code, for scripts to match on.
+func jsonError(c *gin.Context, statusCode int, code locale.ErrorCode, params ...string) {
+	if isApiV2(c) {
+		apiV2ErrorJSON(c, statusCode, code, code.Message(c, params...), nil)
+		return
+	}
+	c.Set(requestFailedKey, true)
+	locale.ErrorJSON(c, statusCode, code, nil, params...)
+}
+
 func html(c *gin.Context, name string, title string, data gin.H) {
 	if data == nil {
 		data = gin.H{}
 	}
 	data["title"] = title
+	data["host"] = requestHost(c)
+	data["request_uri"] = c.Request.RequestURI
+	data["base_path"] = c.GetString("base_path")
+	if user := session.GetLoginUser(c); user != nil {
+		data["role"] = user.Role
+	}
+	c.HTML(http.StatusOK, name, getContext(data))
+}
+
+// requestHost returns the host the client used to reach the panel, without port.
+func requestHost(c *gin.Context) string {
 	host := c.GetHeader("X-Forwarded-Host")
 	if host == "" {
 		host = c.GetHeader("X-Real-IP")
@@ -75,10 +103,7 @@ func html(c *gin.Context, name string, title string, data gin.H) {
 			host = c.Request.Host
 		}
 	}
-	data["host"] = host
-	data["request_uri"] = c.Request.RequestURI
-	data["base_path"] = c.GetString("base_path")
-	c.HTML(http.StatusOK, name, getContext(data))
+	return host
 }
 
 func getContext(h gin.H) gin.H {
@@ -94,3 +119,13 @@ func getContext(h gin.H) gin.H {
 func isAjax(c *gin.Context) bool {
 	return c.GetHeader("X-Requested-With") == "XMLHttpRequest"
 }
+
+// bearerToken returns the token of an "Authorization: Bearer" header.
+func bearerToken(c *gin.Context) (string, bool) {
+	auth := c.GetHeader("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return "", false
+	}
+	token := strings.TrimSpace(auth[7:])
+	return token, token != ""
+}
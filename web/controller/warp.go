@@ -0,0 +1,69 @@
+package controller
+
+import (
+	"x-ui/web/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// WarpController manages the outbound to Cloudflare WARP, with the account of
+// the panel.
+type WarpController struct {
+	warpService service.WarpService
+	xrayService service.XrayService
+}
+
+func NewWarpController(g *gin.RouterGroup) *WarpController {
+	a := &WarpController{}
+	a.initRouter(g)
+	return a
+}
+
+func (a *WarpController) initRouter(g *gin.RouterGroup) {
+	g.GET("", a.getStatus)
+	g.POST("/enable", a.enable)
+	g.POST("/disable", a.disable)
+	g.POST("/rotate", a.rotateKeys)
+}
+
+func (a *WarpController) getStatus(c *gin.Context) {
+	status, err := a.warpService.GetWarpStatus()
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	jsonObj(c, status, nil)
+}
+
+func (a *WarpController) enable(c *gin.Context) {
+	form := &service.WarpForm{}
+	if err := c.ShouldBind(form); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.xray.wireguard.warpEnabled"), err)
+		return
+	}
+	status, err := a.warpService.EnableWarp(form)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.xray.wireguard.warpEnabled"), err)
+		return
+	}
+	jsonMsgObj(c, I18nWeb(c, "pages.xray.wireguard.warpEnabled"), status, nil)
+	a.xrayService.SetToNeedRestart()
+}
+
+func (a *WarpController) disable(c *gin.Context) {
+	err := a.warpService.DisableWarp()
+	jsonMsg(c, I18nWeb(c, "pages.xray.wireguard.warpDisabled"), err)
+	if err == nil {
+		a.xrayService.SetToNeedRestart()
+	}
+}
+
+func (a *WarpController) rotateKeys(c *gin.Context) {
+	status, err := a.warpService.RotateWarpKeys()
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.xray.wireguard.warpRotated"), err)
+		return
+	}
+	jsonMsgObj(c, I18nWeb(c, "pages.xray.wireguard.warpRotated"), status, nil)
+	a.xrayService.SetToNeedRestart()
+}
@@ -0,0 +1,205 @@
+package controller
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+
+	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/web/locale"
+	"x-ui/web/middleware"
+	"x-ui/web/service"
+	"x-ui/web/session"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+type webAuthnNicknameForm struct {
+	Nickname string `json:"nickname" form:"nickname"`
+}
+
+// WebAuthnController serves passkey registration, passkey login and the
+// management of the logged in user's passkeys.
+type WebAuthnController struct {
+	BaseController
+
+	index           *IndexController
+	settingService  service.SettingService
+	webAuthnService service.WebAuthnService
+}
+
+func NewWebAuthnController(g *gin.RouterGroup, index *IndexController) *WebAuthnController {
+	a := &WebAuthnController{index: index}
+	a.initRouter(g)
+	return a
+}
+
+func (a *WebAuthnController) initRouter(g *gin.RouterGroup) {
+	g = g.Group("/panel/api/webauthn")
+
+	// The login ceremony runs before there is a session
+	g.POST("/login/status", a.loginStatus)
+	g.POST("/login/begin", a.beginLogin)
+	g.POST("/login/finish", a.finishLogin)
+
+	auth := g.Group("")
+	auth.Use(a.checkLogin, a.audit, a.checkRole)
+	auth.POST("/register/begin", a.beginRegistration)
+	auth.POST("/register/finish", a.finishRegistration)
+	auth.GET("/credentials", a.getCredentials)
+	auth.POST("/credentials/:id/rename", a.renameCredential)
+	auth.DELETE("/credentials/:id", a.delCredential)
+}
+
+// relyingParty derives the RP ID from the panel domain, or from the request host
+// if no domain is configured. The origin never contains the base path, so passkeys
+// keep working when the panel is served under a custom one.
+func (a *WebAuthnController) relyingParty(c *gin.Context) (string, string) {
+	scheme := "http"
+	if session.IsSecureRequest(c) {
+		scheme = "https"
+	}
+	host := c.Request.Host
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	rpID, err := a.settingService.GetWebDomain()
+	if err != nil || rpID == "" {
+		rpID = hostname
+	}
+	return rpID, scheme + "://" + host
+}
+
+func (a *WebAuthnController) loginStatus(c *gin.Context) {
+	pending := session.GetPendingLogin(c) != 0
+	jsonObj(c, gin.H{
+		"mode":      a.webAuthnService.GetMode(),
+		"available": a.webAuthnService.AnyCredentials(),
+		"pending":   pending,
+	}, nil)
+}
+
+func (a *WebAuthnController) beginLogin(c *gin.Context) {
+	// A pending second factor login is bound to the user that passed the password
+	// check; otherwise passkeys replace the password only in passwordless mode
+	userId := session.GetPendingLogin(c)
+	if userId == 0 && a.webAuthnService.GetMode() != service.WebAuthnModePasswordless {
+		pureJsonMsg(c, http.StatusOK, false, I18nWeb(c, "pages.login.toasts.passkeyUnavailable"))
+		return
+	}
+	rpID, origin := a.relyingParty(c)
+	options, state, ok, err := a.webAuthnService.BeginLogin(userId, rpID, origin)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.login.toasts.passkeyFailed"), err)
+		return
+	}
+	if !ok {
+		pureJsonMsg(c, http.StatusOK, false, I18nWeb(c, "pages.login.toasts.passkeyUnavailable"))
+		return
+	}
+	session.SetWebAuthnSession(c, state)
+	if err := sessions.Default(c).Save(); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.login.toasts.passkeyFailed"), err)
+		return
+	}
+	jsonObj(c, options, nil)
+}
+
+func (a *WebAuthnController) finishLogin(c *gin.Context) {
+	remoteIp := middleware.ClientIP(c)
+	pendingId := session.GetPendingLogin(c)
+	state := session.PopWebAuthnSession(c)
+	rpID, origin := a.relyingParty(c)
+
+	user, err := a.webAuthnService.FinishLogin(rpID, origin, state, c.Request)
+	if err == nil && pendingId != 0 && user.Id != pendingId {
+		err = common.NewError("passkey belongs to another user")
+	}
+	if err != nil {
+		logger.Warningf("passkey login failed, IP: \"%s\": %v", remoteIp, err)
+		logger.Auth(false, remoteIp, "", service.LoginReasonBadPasskey)
+		if err := sessions.Default(c).Save(); err != nil {
+			logger.Warning("Unable to save session: ", err)
+		}
+		pureJsonMsg(c, http.StatusOK, false, I18nWeb(c, "pages.login.toasts.passkeyFailed"))
+		return
+	}
+
+	if err := a.index.completeLogin(c, user, remoteIp, c.Query("rememberMe") == "true"); err != nil {
+		if _, ok := locale.CodeOf(err); !ok {
+			logger.Warning("Unable to save session: ", err)
+		}
+		return
+	}
+	jsonMsg(c, I18nWeb(c, "pages.login.toasts.successLogin"), nil)
+}
+
+func (a *WebAuthnController) beginRegistration(c *gin.Context) {
+	rpID, origin := a.relyingParty(c)
+	options, state, err := a.webAuthnService.BeginRegistration(session.GetLoginUser(c).Id, rpID, origin)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.security.passkeyAdd"), err)
+		return
+	}
+	session.SetWebAuthnSession(c, state)
+	if err := sessions.Default(c).Save(); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.security.passkeyAdd"), err)
+		return
+	}
+	jsonObj(c, options, nil)
+}
+
+// finishRegistration takes the nickname from the query string because the body is
+// the credential returned by the browser.
+func (a *WebAuthnController) finishRegistration(c *gin.Context) {
+	user := session.GetLoginUser(c)
+	state := session.PopWebAuthnSession(c)
+	if err := sessions.Default(c).Save(); err != nil {
+		logger.Warning("Unable to save session: ", err)
+	}
+	rpID, origin := a.relyingParty(c)
+	credential, err := a.webAuthnService.FinishRegistration(user.Id, rpID, origin, state, c.Query("nickname"), c.Request)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.security.passkeyAdd"), err)
+		return
+	}
+	logger.Infof("%s registered passkey %q", user.Username, credential.Nickname)
+	jsonMsgObj(c, I18nWeb(c, "pages.settings.security.passkeyAdded"), credential, nil)
+}
+
+func (a *WebAuthnController) getCredentials(c *gin.Context) {
+	credentials, err := a.webAuthnService.GetCredentials(session.GetLoginUser(c).Id)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.security.passkeysError"), err)
+		return
+	}
+	jsonObj(c, credentials, nil)
+}
+
+func (a *WebAuthnController) renameCredential(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.security.passkeyRenamed"), err)
+		return
+	}
+	form := &webAuthnNicknameForm{}
+	if err := c.ShouldBind(form); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.security.passkeyRenamed"), err)
+		return
+	}
+	err = a.webAuthnService.RenameCredential(session.GetLoginUser(c).Id, id, form.Nickname)
+	jsonMsg(c, I18nWeb(c, "pages.settings.security.passkeyRenamed"), err)
+}
+
+func (a *WebAuthnController) delCredential(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.security.passkeyRemoved"), err)
+		return
+	}
+	err = a.webAuthnService.DelCredential(session.GetLoginUser(c).Id, id)
+	jsonMsg(c, I18nWeb(c, "pages.settings.security.passkeyRemoved"), err)
+}
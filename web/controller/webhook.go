@@ -0,0 +1,81 @@
+package controller
+
+import (
+	"errors"
+	"strconv"
+
+	"x-ui/database/model"
+	"x-ui/web/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// WebhookController sets the webhooks the events of the panel are posted to,
+// and shows how their deliveries went.
+type WebhookController struct {
+	webhookService service.WebhookService
+}
+
+func NewWebhookController(g *gin.RouterGroup) *WebhookController {
+	a := &WebhookController{}
+	a.initRouter(g)
+	return a
+}
+
+func (a *WebhookController) initRouter(g *gin.RouterGroup) {
+	g.GET("", a.getSettings)
+	g.POST("", a.saveSettings)
+	g.GET("/deliveries", a.getDeliveries)
+	g.POST("/:name/test", a.test)
+}
+
+func (a *WebhookController) getSettings(c *gin.Context) {
+	settings, err := a.webhookService.GetSettings()
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	jsonObj(c, settings, nil)
+}
+
+// saveSettings replaces the webhooks and their secret with those of the JSON
+// body. The secret comes back masked, and the mask keeps the saved one.
+func (a *WebhookController) saveSettings(c *gin.Context) {
+	settings := &service.WebhookSettings{}
+	if err := c.ShouldBindJSON(settings); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.webhooksSaved"), err)
+		return
+	}
+	old, _ := a.webhookService.GetSettings()
+	if err := a.webhookService.SaveSettings(settings); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.webhooksSaved"), err)
+		return
+	}
+	saved, err := a.webhookService.GetSettings()
+	if err == nil {
+		setAuditDiff(c, old, saved)
+	}
+	jsonMsgObj(c, I18nWeb(c, "pages.settings.webhooksSaved"), saved, err)
+}
+
+// getDeliveries lists the latest deliveries, of the webhook of the webhook
+// query if it is given, as many as the limit query.
+func (a *WebhookController) getDeliveries(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	deliveries, err := a.webhookService.GetDeliveries(c.Query("webhook"), limit)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	jsonObj(c, deliveries, nil)
+}
+
+// test posts a test event to a saved webhook and answers with the delivery,
+// failed if the webhook didn't answer with 2xx.
+func (a *WebhookController) test(c *gin.Context) {
+	delivery, err := a.webhookService.Test(c.Param("name"))
+	if err == nil && delivery.Status == model.WebhookFailed {
+		err = errors.New(delivery.Error)
+	}
+	jsonMsgObj(c, I18nWeb(c, "pages.settings.webhookTested"), delivery, err)
+}
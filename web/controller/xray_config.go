@@ -0,0 +1,34 @@
+package controller
+
+import (
+	"x-ui/web/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// XrayConfigController shows the config the panel would run Xray with before it
+// is applied.
+type XrayConfigController struct {
+	xrayService service.XrayService
+}
+
+func NewXrayConfigController(g *gin.RouterGroup) *XrayConfigController {
+	a := &XrayConfigController{}
+	a.initRouter(g)
+	return a
+}
+
+func (a *XrayConfigController) initRouter(g *gin.RouterGroup) {
+	g.POST("/preview", a.preview)
+}
+
+// preview returns the generated config, what it changes in the running one, and
+// whether Xray takes it.
+func (a *XrayConfigController) preview(c *gin.Context) {
+	preview, err := a.xrayService.PreviewXrayConfig()
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	jsonObj(c, preview, nil)
+}
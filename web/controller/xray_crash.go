@@ -0,0 +1,33 @@
+package controller
+
+import (
+	"strconv"
+
+	"x-ui/web/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// XrayCrashController lists the crash reports of Xray.
+type XrayCrashController struct {
+	xrayService service.XrayService
+}
+
+func NewXrayCrashController(g *gin.RouterGroup) *XrayCrashController {
+	a := &XrayCrashController{}
+	a.initRouter(g)
+	return a
+}
+
+func (a *XrayCrashController) initRouter(g *gin.RouterGroup) {
+	g.GET("", a.getCrashes)
+}
+
+// getCrashes returns the last crash reports of Xray, ?limit of them, with the
+// exit and the end of the stderr of each, and the backoff of the restarts
+// after them.
+func (a *XrayCrashController) getCrashes(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	crashes, err := a.xrayService.GetXrayCrashes(limit)
+	jsonObj(c, crashes, err)
+}
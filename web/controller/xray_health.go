@@ -0,0 +1,29 @@
+package controller
+
+import (
+	"x-ui/web/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// XrayHealthController reports on the health checks of the restarts of Xray.
+type XrayHealthController struct {
+	xrayService service.XrayService
+}
+
+func NewXrayHealthController(g *gin.RouterGroup) *XrayHealthController {
+	a := &XrayHealthController{}
+	a.initRouter(g)
+	return a
+}
+
+func (a *XrayHealthController) initRouter(g *gin.RouterGroup) {
+	g.GET("", a.getHealth)
+}
+
+// getHealth returns the report of the last restart of Xray, with the inbounds
+// it didn't listen on and its last output if it failed, and the restarts of a
+// crashed Xray.
+func (a *XrayHealthController) getHealth(c *gin.Context) {
+	jsonObj(c, a.xrayService.GetXrayHealth(), nil)
+}
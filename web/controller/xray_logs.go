@@ -0,0 +1,106 @@
+package controller
+
+import (
+	"strconv"
+	"time"
+
+	"x-ui/web/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// xrayLogPollInterval is how often a followed log is read for new lines
+	xrayLogPollInterval = 500 * time.Millisecond
+	// xrayLogKeepAlive is how long a followed log may stay quiet before a ping
+	// is sent, so that proxies keep the stream open
+	xrayLogKeepAlive = 15 * time.Second
+)
+
+// XrayLogsController reads the error and access logs of Xray, only from the
+// files its config names.
+type XrayLogsController struct {
+	xrayService service.XrayService
+}
+
+func NewXrayLogsController(g *gin.RouterGroup) *XrayLogsController {
+	a := &XrayLogsController{}
+	a.initRouter(g)
+	return a
+}
+
+func (a *XrayLogsController) initRouter(g *gin.RouterGroup) {
+	g.GET("", a.getLogs)
+	g.GET("/follow", a.follow)
+}
+
+func xrayLogQuery(c *gin.Context) service.XrayLogQuery {
+	query := service.XrayLogQuery{
+		Type:  c.Query("type"),
+		Level: c.Query("level"),
+		Grep:  c.Query("grep"),
+	}
+	query.Tail, _ = strconv.Atoi(c.Query("tail"))
+	return query
+}
+
+// getLogs returns the last lines of a log of Xray, filtered by severity and by
+// text, with their time and severity when the log has them.
+func (a *XrayLogsController) getLogs(c *gin.Context) {
+	log, err := a.xrayService.GetXrayLog(xrayLogQuery(c))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	jsonObj(c, log, nil)
+}
+
+// follow streams a log of Xray as server-sent events: a "tail" event with the
+// last lines, then a "line" event for each new line that passes the filters,
+// following the file across rotations.
+func (a *XrayLogsController) follow(c *gin.Context) {
+	query := xrayLogQuery(c)
+	follower, tail, err := a.xrayService.FollowXrayLog(&query)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	defer follower.Close()
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.SSEvent("tail", tail)
+	c.Writer.Flush()
+
+	ticker := time.NewTicker(xrayLogPollInterval)
+	defer ticker.Stop()
+	lastSent := time.Now()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-ticker.C:
+		}
+		lines, err := follower.Next()
+		sent := false
+		for _, line := range lines {
+			if query.Match(line) {
+				c.SSEvent("line", line)
+				sent = true
+			}
+		}
+		if err != nil {
+			c.SSEvent("error", err.Error())
+			c.Writer.Flush()
+			return
+		}
+		if !sent && time.Since(lastSent) >= xrayLogKeepAlive {
+			c.SSEvent("ping", "")
+			sent = true
+		}
+		if sent {
+			c.Writer.Flush()
+			lastSent = time.Now()
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package controller
+
+import (
+	"x-ui/web/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// XrayVersionController lists the versions of Xray and switches between them.
+type XrayVersionController struct {
+	serverService service.ServerService
+}
+
+func NewXrayVersionController(g *gin.RouterGroup) *XrayVersionController {
+	a := &XrayVersionController{}
+	a.initRouter(g)
+	return a
+}
+
+func (a *XrayVersionController) initRouter(g *gin.RouterGroup) {
+	g.GET("/versions", a.getVersions)
+	g.POST("/version", a.switchVersion)
+}
+
+func (a *XrayVersionController) getVersions(c *gin.Context) {
+	versions, err := a.serverService.GetXrayVersionList(c.Query("refresh") == "true")
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "getVersion"), err)
+		return
+	}
+	jsonObj(c, versions, nil)
+}
+
+// switchVersion installs the version of Xray given in the form, and restarts
+// Xray with it. A kept version is switched to without downloading it. A custom
+// binary of the settings is only replaced with force.
+func (a *XrayVersionController) switchVersion(c *gin.Context) {
+	form := &struct {
+		Version string `json:"version" form:"version"`
+		Force   bool   `json:"force" form:"force"`
+	}{}
+	if err := c.ShouldBind(form); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.index.xraySwitchVersionPopover"), err)
+		return
+	}
+	setAuditTarget(c, "xray", form.Version)
+	err := a.serverService.SwitchXrayVersion(form.Version, form.Force)
+	jsonMsg(c, I18nWeb(c, "pages.index.xraySwitchVersionPopover"), err)
+}
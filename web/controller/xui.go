@@ -10,6 +10,7 @@ type XUIController struct {
 	inboundController     *InboundController
 	settingController     *SettingController
 	xraySettingController *XraySettingController
+	liveStatsController   *LiveStatsController
 }
 
 func NewXUIController(g *gin.RouterGroup) *XUIController {
@@ -20,7 +21,7 @@ func NewXUIController(g *gin.RouterGroup) *XUIController {
 
 func (a *XUIController) initRouter(g *gin.RouterGroup) {
 	g = g.Group("/panel")
-	g.Use(a.checkLogin)
+	g.Use(a.checkLogin, a.audit, a.checkRole, a.checkChangeset)
 
 	g.GET("/", a.index)
 	g.GET("/inbounds", a.inbounds)
@@ -30,6 +31,7 @@ func (a *XUIController) initRouter(g *gin.RouterGroup) {
 	a.inboundController = NewInboundController(g)
 	a.settingController = NewSettingController(g)
 	a.xraySettingController = NewXraySettingController(g)
+	a.liveStatsController = NewLiveStatsController(g)
 }
 
 func (a *XUIController) index(c *gin.Context) {
@@ -2,18 +2,62 @@ package entity
 
 import (
 	"crypto/tls"
+	"encoding/json"
 	"math"
 	"net"
+	"net/mail"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
 	"x-ui/util/common"
+	"x-ui/web/locale"
+	"x-ui/web/middleware"
+	"x-ui/web/network"
+
+	"github.com/robfig/cron/v3"
+	"gopkg.in/yaml.v3"
 )
 
+// CronParser parses the cron expressions of the settings like the cron of the
+// panel, with seconds.
+var CronParser = cron.NewParser(cron.Second | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
 type Msg struct {
 	Success bool   `json:"success"`
 	Msg     string `json:"msg"`
 	Obj     any    `json:"obj"`
+	// Code is set for the errors of the catalog in the locale package
+	Code locale.ErrorCode `json:"code,omitempty"`
+}
+
+// Response is the reply of the v2 API: the data of a success, or the error of
+// a failure.
+type Response struct {
+	Success bool           `json:"success"`
+	Data    any            `json:"data"`
+	Error   *ResponseError `json:"error,omitempty"`
+}
+
+// ResponseError is the error of a failed v2 API request.
+type ResponseError struct {
+	Code    locale.ErrorCode `json:"code"`
+	Message string           `json:"message"`
+	// Details are the particulars of some errors, like the limit of an inbound
+	// a change of clients goes over
+	Details   any    `json:"details,omitempty"`
+	RequestId string `json:"requestId,omitempty"`
+}
+
+// Page is a page of a list of the v2 API, pages count from 1.
+type Page struct {
+	Items    any   `json:"items"`
+	Total    int64 `json:"total"`
+	Page     int   `json:"page"`
+	PageSize int   `json:"pageSize"`
 }
 
 type AllSetting struct {
@@ -22,8 +66,15 @@ type AllSetting struct {
 	WebPort                     int    `json:"webPort" form:"webPort"`
 	WebCertFile                 string `json:"webCertFile" form:"webCertFile"`
 	WebKeyFile                  string `json:"webKeyFile" form:"webKeyFile"`
+	WebCertAcme                 string `json:"webCertAcme" form:"webCertAcme"`
 	WebBasePath                 string `json:"webBasePath" form:"webBasePath"`
 	SessionMaxAge               int    `json:"sessionMaxAge" form:"sessionMaxAge"`
+	RememberSessionMaxAge       int    `json:"rememberSessionMaxAge" form:"rememberSessionMaxAge"`
+	RememberMaxAge              int    `json:"rememberMaxAge" form:"rememberMaxAge"`
+	SessionIdleTimeout          int    `json:"sessionIdleTimeout" form:"sessionIdleTimeout"`
+	SessionLifetime             int    `json:"sessionLifetime" form:"sessionLifetime"`
+	SessionMaxConcurrent        int    `json:"sessionMaxConcurrent" form:"sessionMaxConcurrent"`
+	SessionLimitPolicy          string `json:"sessionLimitPolicy" form:"sessionLimitPolicy"`
 	PageSize                    int    `json:"pageSize" form:"pageSize"`
 	ExpireDiff                  int    `json:"expireDiff" form:"expireDiff"`
 	TrafficDiff                 int    `json:"trafficDiff" form:"trafficDiff"`
@@ -36,11 +87,10 @@ type AllSetting struct {
 	TgRunTime                   string `json:"tgRunTime" form:"tgRunTime"`
 	TgBotBackup                 bool   `json:"tgBotBackup" form:"tgBotBackup"`
 	TgBotLoginNotify            bool   `json:"tgBotLoginNotify" form:"tgBotLoginNotify"`
+	TgBotPanicNotify            bool   `json:"tgBotPanicNotify" form:"tgBotPanicNotify"`
 	TgCpu                       int    `json:"tgCpu" form:"tgCpu"`
 	TgLang                      string `json:"tgLang" form:"tgLang"`
 	TimeLocation                string `json:"timeLocation" form:"timeLocation"`
-	TwoFactorEnable             bool   `json:"twoFactorEnable" form:"twoFactorEnable"`
-	TwoFactorToken              string `json:"twoFactorToken" form:"twoFactorToken"`
 	SubEnable                   bool   `json:"subEnable" form:"subEnable"`
 	SubTitle                    string `json:"subTitle" form:"subTitle"`
 	SubListen                   string `json:"subListen" form:"subListen"`
@@ -49,6 +99,7 @@ type AllSetting struct {
 	SubDomain                   string `json:"subDomain" form:"subDomain"`
 	SubCertFile                 string `json:"subCertFile" form:"subCertFile"`
 	SubKeyFile                  string `json:"subKeyFile" form:"subKeyFile"`
+	SubCertAcme                 string `json:"subCertAcme" form:"subCertAcme"`
 	SubUpdates                  int    `json:"subUpdates" form:"subUpdates"`
 	ExternalTrafficInformEnable bool   `json:"externalTrafficInformEnable" form:"externalTrafficInformEnable"`
 	ExternalTrafficInformURI    string `json:"externalTrafficInformURI" form:"externalTrafficInformURI"`
@@ -62,22 +113,609 @@ type AllSetting struct {
 	SubJsonMux                  string `json:"subJsonMux" form:"subJsonMux"`
 	SubJsonRules                string `json:"subJsonRules" form:"subJsonRules"`
 	Datepicker                  string `json:"datepicker" form:"datepicker"`
+	LogFormat                   string `json:"logFormat" form:"logFormat"`
+	AccessLogEnable             bool   `json:"accessLogEnable" form:"accessLogEnable"`
+	AccessLogMaxSize            int    `json:"accessLogMaxSize" form:"accessLogMaxSize"`
+	AccessLogMaxBackups         int    `json:"accessLogMaxBackups" form:"accessLogMaxBackups"`
+	AccessLogMaxAge             int    `json:"accessLogMaxAge" form:"accessLogMaxAge"`
+	AccessLogExclude            string `json:"accessLogExclude" form:"accessLogExclude"`
+	AccessLogPath               string `json:"accessLogPath" form:"accessLogPath"`
+	AuthLogPath                 string `json:"authLogPath" form:"authLogPath"`
+	AppLogLevel                 string `json:"appLogLevel" form:"appLogLevel"`
+	SlowRequestThreshold        int    `json:"slowRequestThreshold" form:"slowRequestThreshold"`
+	SlowRequestRoutes           string `json:"slowRequestRoutes" form:"slowRequestRoutes"`
+	PanicBodyCaptureKB          int    `json:"panicBodyCaptureKB" form:"panicBodyCaptureKB"`
+	MetricsEnable               bool   `json:"metricsEnable" form:"metricsEnable"`
+	MetricsToken                string `json:"metricsToken" form:"metricsToken"`
+	MetricsAllowIPs             string `json:"metricsAllowIPs" form:"metricsAllowIPs"`
+	MetricsClientLabels         bool   `json:"metricsClientLabels" form:"metricsClientLabels"`
+	LoginRateLimit              int    `json:"loginRateLimit" form:"loginRateLimit"`
+	LoginRateBurst              int    `json:"loginRateBurst" form:"loginRateBurst"`
+	LockoutThreshold            int    `json:"lockoutThreshold" form:"lockoutThreshold"`
+	LockoutWindow               int    `json:"lockoutWindow" form:"lockoutWindow"`
+	LockoutDuration             int    `json:"lockoutDuration" form:"lockoutDuration"`
+	LoginCaptcha                string `json:"loginCaptcha" form:"loginCaptcha"`
+	LoginCaptchaFailures        int    `json:"loginCaptchaFailures" form:"loginCaptchaFailures"`
+	LoginCaptchaGlobalRate      int    `json:"loginCaptchaGlobalRate" form:"loginCaptchaGlobalRate"`
+	TurnstileSiteKey            string `json:"turnstileSiteKey" form:"turnstileSiteKey"`
+	TurnstileSecret             string `json:"turnstileSecret" form:"turnstileSecret"`
+	WebAuthnMode                string `json:"webAuthnMode" form:"webAuthnMode"`
+	AuditRetentionDays          int    `json:"auditRetentionDays" form:"auditRetentionDays"`
+	PasswordHashMemory          int    `json:"passwordHashMemory" form:"passwordHashMemory"`
+	PasswordHashIterations      int    `json:"passwordHashIterations" form:"passwordHashIterations"`
+	TrustedProxies              string `json:"trustedProxies" form:"trustedProxies"`
+	TrustedProxyHeader          string `json:"trustedProxyHeader" form:"trustedProxyHeader"`
+	CorsAllowedOrigins          string `json:"corsAllowedOrigins" form:"corsAllowedOrigins"`
+	CorsAllowedMethods          string `json:"corsAllowedMethods" form:"corsAllowedMethods"`
+	CorsAllowedHeaders          string `json:"corsAllowedHeaders" form:"corsAllowedHeaders"`
+	CorsAllowCredentials        bool   `json:"corsAllowCredentials" form:"corsAllowCredentials"`
+	CorsMaxAge                  int    `json:"corsMaxAge" form:"corsMaxAge"`
+	SecurityHsts                bool   `json:"securityHsts" form:"securityHsts"`
+	SecurityNoSniff             bool   `json:"securityNoSniff" form:"securityNoSniff"`
+	SecurityReferrerPolicy      string `json:"securityReferrerPolicy" form:"securityReferrerPolicy"`
+	SecurityFrameOptions        string `json:"securityFrameOptions" form:"securityFrameOptions"`
+	SecurityCsp                 string `json:"securityCsp" form:"securityCsp"`
+	SecurityCspScriptSrc        string `json:"securityCspScriptSrc" form:"securityCspScriptSrc"`
+	SecurityCspStyleSrc         string `json:"securityCspStyleSrc" form:"securityCspStyleSrc"`
+	SubSecurityHeaders          bool   `json:"subSecurityHeaders" form:"subSecurityHeaders"`
+	CompressionEnable           bool   `json:"compressionEnable" form:"compressionEnable"`
+	CompressionMinSize          int    `json:"compressionMinSize" form:"compressionMinSize"`
+	CompressionTypes            string `json:"compressionTypes" form:"compressionTypes"`
+	ShutdownTimeout             int    `json:"shutdownTimeout" form:"shutdownTimeout"`
+	XrayKeepOnRestart           bool   `json:"xrayKeepOnRestart" form:"xrayKeepOnRestart"`
+	HealthzEnable               bool   `json:"healthzEnable" form:"healthzEnable"`
+	SocketMode                  string `json:"socketMode" form:"socketMode"`
+	SocketOwner                 string `json:"socketOwner" form:"socketOwner"`
+	MaxBodySize                 int    `json:"maxBodySize" form:"maxBodySize"`
+	MaxBodySizeRestore          int    `json:"maxBodySizeRestore" form:"maxBodySizeRestore"`
+	MaxBodySizeImport           int    `json:"maxBodySizeImport" form:"maxBodySizeImport"`
+	BulkClientsMax              int    `json:"bulkClientsMax" form:"bulkClientsMax"`
+	TrafficResetHistory         bool   `json:"trafficResetHistory" form:"trafficResetHistory"`
+	SubIncludeDisabled          bool   `json:"subIncludeDisabled" form:"subIncludeDisabled"`
+	ClientCleanupDays           int    `json:"clientCleanupDays" form:"clientCleanupDays"`
+	NotifyTrafficPercents       string `json:"notifyTrafficPercents" form:"notifyTrafficPercents"`
+	NotifyExpiryDays            string `json:"notifyExpiryDays" form:"notifyExpiryDays"`
+	IpLimitWindow               int    `json:"ipLimitWindow" form:"ipLimitWindow"`
+	IpLimitCooldown             int    `json:"ipLimitCooldown" form:"ipLimitCooldown"`
+	IpLimitIpv6Prefix           int    `json:"ipLimitIpv6Prefix" form:"ipLimitIpv6Prefix"`
+	IpLimitDevices              int    `json:"ipLimitDevices" form:"ipLimitDevices"`
+	RemarkTemplate              string `json:"remarkTemplate" form:"remarkTemplate"`
+	RandomPortMin               int    `json:"randomPortMin" form:"randomPortMin"`
+	RandomPortMax               int    `json:"randomPortMax" form:"randomPortMax"`
+	PortRangeClientPort         bool   `json:"portRangeClientPort" form:"portRangeClientPort"`
+	ObservatoryMode             string `json:"observatoryMode" form:"observatoryMode"`
+	ObservatoryProbeURL         string `json:"observatoryProbeUrl" form:"observatoryProbeUrl"`
+	ObservatoryProbeInterval    int    `json:"observatoryProbeInterval" form:"observatoryProbeInterval"`
+	XrayDownloadProxy           string `json:"xrayDownloadProxy" form:"xrayDownloadProxy"`
+	XrayKeptVersions            int    `json:"xrayKeptVersions" form:"xrayKeptVersions"`
+	GeodataAutoUpdate           bool   `json:"geodataAutoUpdate" form:"geodataAutoUpdate"`
+	GeodataUpdateCron           string `json:"geodataUpdateCron" form:"geodataUpdateCron"`
+	GeoipURL                    string `json:"geoipURL" form:"geoipURL"`
+	GeositeURL                  string `json:"geositeURL" form:"geositeURL"`
+	TgBotGeodataNotify          bool   `json:"tgBotGeodataNotify" form:"tgBotGeodataNotify"`
+	XrayHealthCheckWindow       int    `json:"xrayHealthCheckWindow" form:"xrayHealthCheckWindow"`
+	XrayMaxRestartAttempts      int    `json:"xrayMaxRestartAttempts" form:"xrayMaxRestartAttempts"`
+	XrayStableMinutes           int    `json:"xrayStableMinutes" form:"xrayStableMinutes"`
+	XrayCrashOutputKB           int    `json:"xrayCrashOutputKB" form:"xrayCrashOutputKB"`
+	TgBotXrayRestartNotify      bool   `json:"tgBotXrayRestartNotify" form:"tgBotXrayRestartNotify"`
+	XrayApiUpdates              bool   `json:"xrayApiUpdates" form:"xrayApiUpdates"`
+	XrayBinaryPath              string `json:"xrayBinaryPath" form:"xrayBinaryPath"`
+	XrayAssetDir                string `json:"xrayAssetDir" form:"xrayAssetDir"`
+	XrayWorkDir                 string `json:"xrayWorkDir" form:"xrayWorkDir"`
+	XrayArgs                    string `json:"xrayArgs" form:"xrayArgs"`
+	RealityCheckInterval        int    `json:"realityCheckInterval" form:"realityCheckInterval"`
+	RealityCheckFailures        int    `json:"realityCheckFailures" form:"realityCheckFailures"`
+	InboundCheckInterval        int    `json:"inboundCheckInterval" form:"inboundCheckInterval"`
+	InboundCheckTimeout         int    `json:"inboundCheckTimeout" form:"inboundCheckTimeout"`
+	InboundCheckProberUrl       string `json:"inboundCheckProberUrl" form:"inboundCheckProberUrl"`
+	InboundCheckProberToken     string `json:"inboundCheckProberToken" form:"inboundCheckProberToken"`
+	InboundCheckHost            string `json:"inboundCheckHost" form:"inboundCheckHost"`
+	OnlineWindow                int    `json:"onlineWindow" form:"onlineWindow"`
+	ClientInactiveDays          int    `json:"clientInactiveDays" form:"clientInactiveDays"`
+	ClientCleanupInactive       bool   `json:"clientCleanupInactive" form:"clientCleanupInactive"`
+	ClientInactiveReport        bool   `json:"clientInactiveReport" form:"clientInactiveReport"`
+	ConnectionSampleInterval    int    `json:"connectionSampleInterval" form:"connectionSampleInterval"`
+	ConnectionMethod            string `json:"connectionMethod" form:"connectionMethod"`
+	ConnBlockCommand            string `json:"connBlockCommand" form:"connBlockCommand"`
+	ConnUnblockCommand          string `json:"connUnblockCommand" form:"connUnblockCommand"`
+	ConnBlockMinutes            int    `json:"connBlockMinutes" form:"connBlockMinutes"`
+	TrafficHistoryDays          int    `json:"trafficHistoryDays" form:"trafficHistoryDays"`
+	TrafficFlushInterval        int    `json:"trafficFlushInterval" form:"trafficFlushInterval"`
+	DbJournalMode               string `json:"dbJournalMode" form:"dbJournalMode"`
+	DbSynchronous               string `json:"dbSynchronous" form:"dbSynchronous"`
+	DbBusyTimeout               int    `json:"dbBusyTimeout" form:"dbBusyTimeout"`
+	DbMaxConnections            int    `json:"dbMaxConnections" form:"dbMaxConnections"`
+	DbAutoOptimize              bool   `json:"dbAutoOptimize" form:"dbAutoOptimize"`
+	DbOptimizeCron              string `json:"dbOptimizeCron" form:"dbOptimizeCron"`
+	TgBotDbOptimizeNotify       bool   `json:"tgBotDbOptimizeNotify" form:"tgBotDbOptimizeNotify"`
+	TrashRetentionDays          int    `json:"trashRetentionDays" form:"trashRetentionDays"`
+	BackupEnable                bool   `json:"backupEnable" form:"backupEnable"`
+	BackupCron                  string `json:"backupCron" form:"backupCron"`
+	BackupDir                   string `json:"backupDir" form:"backupDir"`
+	BackupKeep                  int    `json:"backupKeep" form:"backupKeep"`
+	BackupIncludeFiles          bool   `json:"backupIncludeFiles" form:"backupIncludeFiles"`
+	BackupPassphrase            string `json:"backupPassphrase" form:"backupPassphrase"`
+	BackupWebhookUrl            string `json:"backupWebhookUrl" form:"backupWebhookUrl"`
+	TgBotBackupUploadNotify     bool   `json:"tgBotBackupUploadNotify" form:"tgBotBackupUploadNotify"`
+	TgBotBackupCron             string `json:"tgBotBackupCron" form:"tgBotBackupCron"`
+	TgBotBackupLarge            string `json:"tgBotBackupLarge" form:"tgBotBackupLarge"`
+	TgBotLoginNotifyFailed      bool   `json:"tgBotLoginNotifyFailed" form:"tgBotLoginNotifyFailed"`
+	TgBotLoginNotifyApi         bool   `json:"tgBotLoginNotifyApi" form:"tgBotLoginNotifyApi"`
+	TgBotLoginNotifyInterval    int    `json:"tgBotLoginNotifyInterval" form:"tgBotLoginNotifyInterval"`
+	TgBotSelfService            bool   `json:"tgBotSelfService" form:"tgBotSelfService"`
+	NotifyExpiryCron            string `json:"notifyExpiryCron" form:"notifyExpiryCron"`
+	NotifyRenewalContact        string `json:"notifyRenewalContact" form:"notifyRenewalContact"`
+	TgBotParseMode              string `json:"tgBotParseMode" form:"tgBotParseMode"`
+	TgTemplateLogin             string `json:"tgTemplateLogin" form:"tgTemplateLogin"`
+	TgTemplateTraffic           string `json:"tgTemplateTraffic" form:"tgTemplateTraffic"`
+	TgTemplateExpiry            string `json:"tgTemplateExpiry" form:"tgTemplateExpiry"`
+	TgTemplateBackup            string `json:"tgTemplateBackup" form:"tgTemplateBackup"`
+	TgTemplateClient            string `json:"tgTemplateClient" form:"tgTemplateClient"`
+	AlertChannels               string `json:"alertChannels" form:"alertChannels"`
+	SmtpHost                    string `json:"smtpHost" form:"smtpHost"`
+	SmtpPort                    int    `json:"smtpPort" form:"smtpPort"`
+	SmtpSecurity                string `json:"smtpSecurity" form:"smtpSecurity"`
+	SmtpUsername                string `json:"smtpUsername" form:"smtpUsername"`
+	SmtpPassword                string `json:"smtpPassword" form:"smtpPassword"`
+	SmtpFrom                    string `json:"smtpFrom" form:"smtpFrom"`
+	SmtpTo                      string `json:"smtpTo" form:"smtpTo"`
+	AlertEmailSubject           string `json:"alertEmailSubject" form:"alertEmailSubject"`
+	AlertEmailBody              string `json:"alertEmailBody" form:"alertEmailBody"`
+	AlertWebhookUrl             string `json:"alertWebhookUrl" form:"alertWebhookUrl"`
+	AlertWebhookSecret          string `json:"alertWebhookSecret" form:"alertWebhookSecret"`
+	SubClashRules               string `json:"subClashRules" form:"subClashRules"`
+	SubSingboxVersion           string `json:"subSingboxVersion" form:"subSingboxVersion"`
+	SubSingboxDns               string `json:"subSingboxDns" form:"subSingboxDns"`
+	SubSingboxRoute             string `json:"subSingboxRoute" form:"subSingboxRoute"`
+	SubExpiredNotice            string `json:"subExpiredNotice" form:"subExpiredNotice"`
+	SubCache                    bool   `json:"subCache" form:"subCache"`
+	SubCacheGranularity         int    `json:"subCacheGranularity" form:"subCacheGranularity"`
+	SubAccessDays               int    `json:"subAccessDays" form:"subAccessDays"`
+	SubAccessMaxIps             int    `json:"subAccessMaxIps" form:"subAccessMaxIps"`
+	WebEnable                   bool   `json:"webEnable" form:"webEnable"`
+	SubBasePath                 string `json:"subBasePath" form:"subBasePath"`
+	SubUseWebCert               bool   `json:"subUseWebCert" form:"subUseWebCert"`
+	SubPage                     bool   `json:"subPage" form:"subPage"`
+	SubPageTitle                string `json:"subPageTitle" form:"subPageTitle"`
+	SubPageLogo                 string `json:"subPageLogo" form:"subPageLogo"`
+	SubPageSupport              string `json:"subPageSupport" form:"subPageSupport"`
+	SubRemotes                  string `json:"subRemotes" form:"subRemotes"`
+	SubRemoteTimeout            int    `json:"subRemoteTimeout" form:"subRemoteTimeout"`
+	SubRemoteTTL                int    `json:"subRemoteTTL" form:"subRemoteTTL"`
+	StatusPage                  bool   `json:"statusPage" form:"statusPage"`
+	StatusPagePath              string `json:"statusPagePath" form:"statusPagePath"`
+	StatusPageTitle             string `json:"statusPageTitle" form:"statusPageTitle"`
+	StatusPageInbounds          string `json:"statusPageInbounds" form:"statusPageInbounds"`
+	StatusPageFields            string `json:"statusPageFields" form:"statusPageFields"`
+	StatusPageTTL               int    `json:"statusPageTTL" form:"statusPageTTL"`
+	StatusPageCapacity          int    `json:"statusPageCapacity" form:"statusPageCapacity"`
+	TrialInbound                int    `json:"trialInbound" form:"trialInbound"`
+	TrialPath                   string `json:"trialPath" form:"trialPath"`
+	TrialTotalGB                int    `json:"trialTotalGB" form:"trialTotalGB"`
+	TrialHours                  int    `json:"trialHours" form:"trialHours"`
+	TrialIpDaily                int    `json:"trialIpDaily" form:"trialIpDaily"`
+	TrialDaily                  int    `json:"trialDaily" form:"trialDaily"`
+	TrialCaptcha                string `json:"trialCaptcha" form:"trialCaptcha"`
+	TrialTelegram               bool   `json:"trialTelegram" form:"trialTelegram"`
+	TrialCooldown               int    `json:"trialCooldown" form:"trialCooldown"`
+	TrialCleanupHours           int    `json:"trialCleanupHours" form:"trialCleanupHours"`
+	StatusSampleInterval        int    `json:"statusSampleInterval" form:"statusSampleInterval"`
+	StatusHistoryDays           int    `json:"statusHistoryDays" form:"statusHistoryDays"`
+	BandwidthSource             string `json:"bandwidthSource" form:"bandwidthSource"`
+	BandwidthMonthlyLimit       int    `json:"bandwidthMonthlyLimit" form:"bandwidthMonthlyLimit"`
+	BandwidthDailyLimit         int    `json:"bandwidthDailyLimit" form:"bandwidthDailyLimit"`
+	BandwidthResetDay           int    `json:"bandwidthResetDay" form:"bandwidthResetDay"`
+	BandwidthAlertPercents      string `json:"bandwidthAlertPercents" form:"bandwidthAlertPercents"`
+	BandwidthAction             string `json:"bandwidthAction" form:"bandwidthAction"`
+	GeoStatsDatabase            string `json:"geoStatsDatabase" form:"geoStatsDatabase"`
+	GeoStatsDays                int    `json:"geoStatsDays" form:"geoStatsDays"`
 }
 
-func (s *AllSetting) CheckValid() error {
-	if s.WebListen != "" {
-		ip := net.ParseIP(s.WebListen)
-		if ip == nil {
-			return common.NewError("web listen is not valid ip:", s.WebListen)
+// CORSConfig returns the CORS settings of the API.
+func (s *AllSetting) CORSConfig() middleware.CORSConfig {
+	return middleware.CORSConfig{
+		AllowedOrigins:   middleware.ParseCORSList(s.CorsAllowedOrigins),
+		AllowedMethods:   middleware.ParseCORSList(s.CorsAllowedMethods),
+		AllowedHeaders:   middleware.ParseCORSList(s.CorsAllowedHeaders),
+		AllowCredentials: s.CorsAllowCredentials,
+		MaxAge:           s.CorsMaxAge,
+	}
+}
+
+// SecurityHeadersConfig returns the security headers of the panel responses.
+func (s *AllSetting) SecurityHeadersConfig() middleware.SecurityHeadersConfig {
+	return middleware.SecurityHeadersConfig{
+		HSTS:           s.SecurityHsts,
+		NoSniff:        s.SecurityNoSniff,
+		ReferrerPolicy: strings.TrimSpace(s.SecurityReferrerPolicy),
+		FrameOptions:   strings.ToUpper(strings.TrimSpace(s.SecurityFrameOptions)),
+		CSP:            s.SecurityCsp,
+		CSPScriptSrc:   s.SecurityCspScriptSrc,
+		CSPStyleSrc:    s.SecurityCspStyleSrc,
+		Turnstile:      s.LoginCaptcha == "turnstile",
+	}
+}
+
+// The security of the connections to the SMTP server of the alert emails.
+const (
+	SmtpSecurityNone     = "none"
+	SmtpSecurityStartTLS = "starttls"
+	SmtpSecuritySSL      = "ssl"
+)
+
+// AlertConfig is where the alerts go besides Telegram: the SMTP server and the
+// addresses of the emails, and the JSON webhook. The forms of the test sends
+// carry it too.
+type AlertConfig struct {
+	SmtpHost      string `json:"smtpHost" form:"smtpHost"`
+	SmtpPort      int    `json:"smtpPort" form:"smtpPort"`
+	SmtpSecurity  string `json:"smtpSecurity" form:"smtpSecurity"`
+	SmtpUsername  string `json:"smtpUsername" form:"smtpUsername"`
+	SmtpPassword  string `json:"smtpPassword" form:"smtpPassword"`
+	SmtpFrom      string `json:"smtpFrom" form:"smtpFrom"`
+	SmtpTo        string `json:"smtpTo" form:"smtpTo"`
+	EmailSubject  string `json:"alertEmailSubject" form:"alertEmailSubject"`
+	EmailBody     string `json:"alertEmailBody" form:"alertEmailBody"`
+	WebhookUrl    string `json:"alertWebhookUrl" form:"alertWebhookUrl"`
+	WebhookSecret string `json:"alertWebhookSecret" form:"alertWebhookSecret"`
+}
+
+// AlertConfig returns where the alerts go besides Telegram.
+func (s *AllSetting) AlertConfig() AlertConfig {
+	return AlertConfig{
+		SmtpHost:      strings.TrimSpace(s.SmtpHost),
+		SmtpPort:      s.SmtpPort,
+		SmtpSecurity:  s.SmtpSecurity,
+		SmtpUsername:  s.SmtpUsername,
+		SmtpPassword:  s.SmtpPassword,
+		SmtpFrom:      strings.TrimSpace(s.SmtpFrom),
+		SmtpTo:        strings.TrimSpace(s.SmtpTo),
+		EmailSubject:  s.AlertEmailSubject,
+		EmailBody:     s.AlertEmailBody,
+		WebhookUrl:    strings.TrimSpace(s.AlertWebhookUrl),
+		WebhookSecret: s.AlertWebhookSecret,
+	}
+}
+
+// EmailEnabled tells whether the alerts can be sent by email.
+func (c *AlertConfig) EmailEnabled() bool {
+	return c.SmtpHost != "" && c.SmtpTo != ""
+}
+
+// Validate checks the SMTP server and the addresses if the emails are set up,
+// and the URL of the webhook if there is one.
+func (c *AlertConfig) Validate() error {
+	if c.SmtpHost != "" {
+		if c.SmtpPort < 1 || c.SmtpPort > 65535 {
+			return common.NewError("the SMTP port must be between 1 and 65535:", c.SmtpPort)
+		}
+		if !slices.Contains([]string{SmtpSecurityNone, SmtpSecurityStartTLS, SmtpSecuritySSL}, c.SmtpSecurity) {
+			return common.NewError("the SMTP security must be none, starttls or ssl:", c.SmtpSecurity)
+		}
+		if _, err := mail.ParseAddress(c.SmtpFrom); err != nil {
+			return common.NewError("the sender of the alert emails is not an address:", err)
+		}
+		if _, err := mail.ParseAddressList(c.SmtpTo); err != nil {
+			return common.NewError("the recipients of the alert emails are not a list of addresses:", err)
+		}
+	}
+	if c.WebhookUrl != "" {
+		parsed, err := url.Parse(c.WebhookUrl)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return common.NewError("the alert webhook must be an http or https URL:", c.WebhookUrl)
+		}
+	}
+	return nil
+}
+
+// CompressConfig returns the response compression settings.
+func (s *AllSetting) CompressConfig() middleware.CompressConfig {
+	return middleware.CompressConfig{
+		MinSize: s.CompressionMinSize,
+		Types:   middleware.ParseCORSList(s.CompressionTypes),
+	}
+}
+
+// SlowRequestConfig returns when the requests of the server on basePath are
+// logged as slow.
+func (s *AllSetting) SlowRequestConfig(basePath string) middleware.SlowRequestConfig {
+	routes, _ := middleware.ParseSlowRoutes(s.SlowRequestRoutes)
+	return middleware.SlowRequestConfig{
+		BasePath:  basePath,
+		Threshold: time.Duration(s.SlowRequestThreshold) * time.Millisecond,
+		Routes:    routes,
+	}
+}
+
+// BodyCaptureConfig returns what of the bodies of the API requests of the
+// server on basePath is kept for the panic records.
+func (s *AllSetting) BodyCaptureConfig(basePath string) middleware.BodyCaptureConfig {
+	return middleware.BodyCaptureConfig{
+		BasePath: basePath,
+		Prefix:   "panel/api/",
+		Limit:    s.PanicBodyCaptureKB << 10,
+	}
+}
+
+// ParseThresholds parses a comma separated list of notification thresholds, each
+// between minValue and maxValue, into ascending order without duplicates.
+func ParseThresholds(value string, minValue, maxValue int) ([]int, error) {
+	thresholds := make([]int, 0)
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		threshold, err := strconv.Atoi(item)
+		if err != nil || threshold < minValue || threshold > maxValue {
+			return nil, common.NewErrorf("threshold %q must be a number between %d and %d", item, minValue, maxValue)
+		}
+		if !slices.Contains(thresholds, threshold) {
+			thresholds = append(thresholds, threshold)
+		}
+	}
+	slices.Sort(thresholds)
+	return thresholds, nil
+}
+
+// ParseClashRules parses the rules of Clash subscriptions, a YAML list like
+// "- MATCH,PROXY".
+func ParseClashRules(value string) ([]string, error) {
+	rules := make([]string, 0)
+	if err := yaml.Unmarshal([]byte(value), &rules); err != nil {
+		return nil, common.NewError("rules must be a YAML list of strings:", err)
+	}
+	for _, rule := range rules {
+		if len(strings.Split(rule, ",")) < 2 {
+			return nil, common.NewErrorf("rule %q must be like TYPE,ARGUMENT,POLICY", rule)
+		}
+	}
+	return rules, nil
+}
+
+// SubRemote is a subscription of another panel merged into the subscriptions
+// fetched for it.
+type SubRemote struct {
+	// Name tells the remote in the entry listed when it can't be fetched, the
+	// host of its URL if empty
+	Name string `json:"name"`
+	// URL is the subscription URL, the subscription ID appended to it unless
+	// it has a {subId} placeholder
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// ParseSubRemotes parses the remote subscriptions, a JSON list like
+// [{"name": "node2", "url": "https://node2.example.com/sub/"}].
+func ParseSubRemotes(value string) ([]SubRemote, error) {
+	remotes := make([]SubRemote, 0)
+	if strings.TrimSpace(value) == "" {
+		return remotes, nil
+	}
+	if err := json.Unmarshal([]byte(value), &remotes); err != nil {
+		return nil, common.NewError("remote subscriptions must be a JSON list:", err)
+	}
+	for i, remote := range remotes {
+		u, err := url.Parse(remote.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, common.NewErrorf("remote subscription %q is not an http(s) URL", remote.URL)
+		}
+		for name, value := range remote.Headers {
+			if name == "" || strings.ContainsAny(name+value, "\r\n") {
+				return nil, common.NewErrorf("header %q of remote subscription %q is not valid", name, remote.URL)
+			}
+		}
+		if remote.Name == "" {
+			remotes[i].Name = u.Host
+		}
+	}
+	return remotes, nil
+}
+
+// The fields of the inbounds the public status page can show.
+const (
+	StatusPageState   = "state"
+	StatusPageLatency = "latency"
+	StatusPageLoad    = "load"
+)
+
+// Bounds of the time the public status page is cached, in seconds.
+const (
+	MinStatusPageTTL = 5
+	MaxStatusPageTTL = 3600
+)
+
+// ParseStatusPageInbounds parses the ids of the inbounds on the public status
+// page, like "1, 3", keeping their order.
+func ParseStatusPageInbounds(value string) ([]int, error) {
+	ids := make([]int, 0)
+	for _, field := range strings.Split(value, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		id, err := strconv.Atoi(field)
+		if err != nil || id <= 0 {
+			return nil, common.NewErrorf("status page inbound %q is not an inbound id", field)
+		}
+		if !slices.Contains(ids, id) {
+			ids = append(ids, id)
 		}
 	}
+	return ids, nil
+}
 
-	if s.SubListen != "" {
-		ip := net.ParseIP(s.SubListen)
-		if ip == nil {
-			return common.NewError("Sub listen is not valid ip:", s.SubListen)
+// ParseStatusPageFields parses the fields the public status page shows of its
+// inbounds, like "state, latency".
+func ParseStatusPageFields(value string) ([]string, error) {
+	fields := make([]string, 0)
+	for _, field := range strings.Split(value, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		switch field {
+		case StatusPageState, StatusPageLatency, StatusPageLoad:
+		default:
+			return nil, common.NewErrorf("status page field %q is not one of state, latency and load", field)
+		}
+		if !slices.Contains(fields, field) {
+			fields = append(fields, field)
 		}
 	}
+	return fields, nil
+}
+
+// checkStatusPage checks the settings of the public status page. Its path is
+// one of the subscription server, apart from the subscription paths.
+func (s *AllSetting) checkStatusPage() error {
+	if !strings.HasPrefix(s.StatusPagePath, "/") {
+		s.StatusPagePath = "/" + s.StatusPagePath
+	}
+	if !strings.HasSuffix(s.StatusPagePath, "/") {
+		s.StatusPagePath += "/"
+	}
+	if s.StatusPagePath == "/" || strings.ContainsAny(s.StatusPagePath, ":*?# ") {
+		return common.NewError("status page path is not valid:", s.StatusPagePath)
+	}
+	for _, path := range []string{s.SubPath, s.SubJsonPath} {
+		if strings.HasPrefix(s.StatusPagePath, path) || strings.HasPrefix(path, s.StatusPagePath) {
+			return common.NewErrorf("status page path %s overlaps the subscription path %s", s.StatusPagePath, path)
+		}
+	}
+	if _, err := ParseStatusPageInbounds(s.StatusPageInbounds); err != nil {
+		return err
+	}
+	if _, err := ParseStatusPageFields(s.StatusPageFields); err != nil {
+		return err
+	}
+	if s.StatusPageTTL < MinStatusPageTTL || s.StatusPageTTL > MaxStatusPageTTL {
+		return common.NewErrorf("status page cache time must be between %d and %d seconds: %d", MinStatusPageTTL, MaxStatusPageTTL, s.StatusPageTTL)
+	}
+	if s.StatusPageCapacity <= 0 {
+		return common.NewError("status page capacity must be positive:", s.StatusPageCapacity)
+	}
+	return nil
+}
+
+// checkTrial checks the settings of the public trial endpoint. Its path is one
+// of the subscription server, apart from the subscription paths and the status
+// page; without one there are no trials.
+func (s *AllSetting) checkTrial() error {
+	if s.TrialPath = strings.TrimSpace(s.TrialPath); s.TrialPath != "" {
+		if !strings.HasPrefix(s.TrialPath, "/") {
+			s.TrialPath = "/" + s.TrialPath
+		}
+		if !strings.HasSuffix(s.TrialPath, "/") {
+			s.TrialPath += "/"
+		}
+		if s.TrialPath == "/" || strings.ContainsAny(s.TrialPath, ":*?# ") {
+			return common.NewError("trial path is not valid:", s.TrialPath)
+		}
+		paths := []string{s.SubPath, s.SubJsonPath}
+		if s.StatusPage {
+			paths = append(paths, s.StatusPagePath)
+		}
+		for _, path := range paths {
+			if strings.HasPrefix(s.TrialPath, path) || strings.HasPrefix(path, s.TrialPath) {
+				return common.NewErrorf("trial path %s overlaps the path %s", s.TrialPath, path)
+			}
+		}
+	}
+	if s.TrialInbound < 0 {
+		return common.NewError("trial inbound is not an inbound id:", s.TrialInbound)
+	}
+	if s.TrialTotalGB < 0 {
+		return common.NewError("trial traffic must not be negative:", s.TrialTotalGB)
+	}
+	if s.TrialHours <= 0 {
+		return common.NewError("trial duration must be positive:", s.TrialHours)
+	}
+	if s.TrialIpDaily < 0 || s.TrialDaily < 0 {
+		return common.NewError("daily trial caps must not be negative")
+	}
+	if s.TrialCooldown < 0 || s.TrialCleanupHours < 0 {
+		return common.NewError("trial cooldown and cleanup must not be negative")
+	}
+	switch s.TrialCaptcha {
+	case "":
+		s.TrialCaptcha = "off"
+	case "off", "math":
+	case "turnstile":
+		if strings.TrimSpace(s.TurnstileSiteKey) == "" || strings.TrimSpace(s.TurnstileSecret) == "" {
+			return common.NewError("the Turnstile trial challenge needs a site key and a secret")
+		}
+	default:
+		return common.NewError("trial challenge must be off, math or turnstile:", s.TrialCaptcha)
+	}
+	return nil
+}
+
+// ParseBandwidthPercents parses the percents of the bandwidth limits alerts are
+// sent at, like "80, 90", into their ascending list.
+func ParseBandwidthPercents(value string) ([]int, error) {
+	percents := make([]int, 0)
+	for _, field := range strings.Split(value, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		percent, err := strconv.Atoi(field)
+		if err != nil || percent < 1 || percent > 99 {
+			return nil, common.NewErrorf("bandwidth alert %q must be a percent from 1 to 99", field)
+		}
+		if !slices.Contains(percents, percent) {
+			percents = append(percents, percent)
+		}
+	}
+	slices.Sort(percents)
+	return percents, nil
+}
+
+// ParseSingboxVersion parses the sing-box version subscriptions are written
+// for, like "1.11", into its minor version.
+func ParseSingboxVersion(value string) (int, error) {
+	minor, err := strconv.Atoi(strings.TrimPrefix(value, "1."))
+	if !strings.HasPrefix(value, "1.") || err != nil || minor < 8 {
+		return 0, common.NewErrorf("version %q must be like 1.11, from 1.8 on", value)
+	}
+	return minor, nil
+}
+
+// isJSONObject tells whether value is empty or a JSON object.
+func isJSONObject(value string) bool {
+	var object map[string]any
+	if value == "" {
+		return true
+	}
+	return json.Unmarshal([]byte(value), &object) == nil && object != nil
+}
+
+// CheckTgBotConnection checks the proxy and the Bot API server of the bot.
+func (s *AllSetting) CheckTgBotConnection() error {
+	if s.TgBotProxy != "" {
+		// Not shown, it may have the credentials of the proxy
+		if u, err := url.Parse(s.TgBotProxy); err != nil || !slices.Contains([]string{"socks5", "socks5h", "http"}, u.Scheme) || u.Host == "" {
+			return common.NewError("Telegram bot proxy must be a socks5 or http URL")
+		}
+	}
+	if s.TgBotAPIServer != "" {
+		if u, err := url.Parse(s.TgBotAPIServer); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return common.NewError("Telegram Bot API server is not an http(s) URL:", s.TgBotAPIServer)
+		}
+	}
+	return nil
+}
+
+func (s *AllSetting) CheckValid() error {
+	if err := network.ValidateListen(s.WebListen); err != nil {
+		return common.NewError("web listen is not valid:", err)
+	}
+
+	if err := network.ValidateListen(s.SubListen); err != nil {
+		return common.NewError("Sub listen is not valid:", err)
+	}
+
+	if _, err := network.ParseSocketMode(s.SocketMode); err != nil {
+		return err
+	}
 
 	if s.WebPort <= 0 || s.WebPort > math.MaxUint16 {
 		return common.NewError("web port is not a valid port:", s.WebPort)
@@ -87,7 +725,14 @@ func (s *AllSetting) CheckValid() error {
 		return common.NewError("Sub port is not a valid port:", s.SubPort)
 	}
 
-	if (s.SubPort == s.WebPort) && (s.WebListen == s.SubListen) {
+	if s.RandomPortMin <= 0 || s.RandomPortMax > math.MaxUint16 || s.RandomPortMin > s.RandomPortMax {
+		return common.NewErrorf("random port range %d-%d is not valid", s.RandomPortMin, s.RandomPortMax)
+	}
+
+	if s.WebEnable && s.SubEnable && network.Overlaps(s.WebListen, s.WebPort, s.SubListen, s.SubPort) {
+		if webSocket, ok := network.UnixSocketPath(s.WebListen); ok {
+			return common.NewError("Sub and Web could not use the same unix socket:", webSocket)
+		}
 		return common.NewError("Sub and Web could not use same ip:port, ", s.SubListen, ":", s.SubPort, " & ", s.WebListen, ":", s.WebPort)
 	}
 
@@ -118,6 +763,13 @@ func (s *AllSetting) CheckValid() error {
 		s.SubPath += "/"
 	}
 
+	if !strings.HasPrefix(s.SubBasePath, "/") {
+		s.SubBasePath = "/" + s.SubBasePath
+	}
+	if !strings.HasSuffix(s.SubBasePath, "/") {
+		s.SubBasePath += "/"
+	}
+
 	if !strings.HasPrefix(s.SubJsonPath, "/") {
 		s.SubJsonPath = "/" + s.SubJsonPath
 	}
@@ -125,10 +777,381 @@ func (s *AllSetting) CheckValid() error {
 		s.SubJsonPath += "/"
 	}
 
+	if s.SubCacheGranularity < 0 {
+		return common.NewError("subscription cache granularity must not be negative:", s.SubCacheGranularity)
+	}
+	if s.SubAccessDays < 0 {
+		return common.NewError("subscription fetch retention must not be negative:", s.SubAccessDays)
+	}
+	if s.SubAccessMaxIps < 0 {
+		return common.NewError("subscription fetch IP limit must not be negative:", s.SubAccessMaxIps)
+	}
+	if s.SubPageLogo != "" {
+		if u, err := url.Parse(s.SubPageLogo); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return common.NewError("subscription page logo is not an http(s) URL:", s.SubPageLogo)
+		}
+	}
+	if _, err := ParseSubRemotes(s.SubRemotes); err != nil {
+		return err
+	}
+	if s.SubRemoteTimeout <= 0 {
+		return common.NewError("remote subscription timeout must be positive:", s.SubRemoteTimeout)
+	}
+	if s.SubRemoteTTL < 0 {
+		return common.NewError("remote subscription cache time must not be negative:", s.SubRemoteTTL)
+	}
+	if err := s.checkStatusPage(); err != nil {
+		return err
+	}
+	if err := s.checkTrial(); err != nil {
+		return err
+	}
+	if _, err := ParseClashRules(s.SubClashRules); err != nil {
+		return common.NewError("Clash subscription rules are not valid:", err)
+	}
+	if _, err := ParseSingboxVersion(s.SubSingboxVersion); err != nil {
+		return common.NewError("sing-box subscription version is not valid:", err)
+	}
+	if !isJSONObject(s.SubSingboxDns) || !isJSONObject(s.SubSingboxRoute) {
+		return common.NewError("sing-box subscription dns and route must be JSON objects")
+	}
+
 	_, err := time.LoadLocation(s.TimeLocation)
 	if err != nil {
 		return common.NewError("time location not exist:", s.TimeLocation)
 	}
 
+	if s.AccessLogMaxSize < 0 || s.AccessLogMaxBackups < 0 || s.AccessLogMaxAge < 0 {
+		return common.NewError("access log rotation limits must not be negative")
+	}
+	s.AccessLogPath = strings.TrimSpace(s.AccessLogPath)
+	s.AuthLogPath = strings.TrimSpace(s.AuthLogPath)
+	if !filepath.IsAbs(s.AccessLogPath) || !filepath.IsAbs(s.AuthLogPath) {
+		return common.NewError("the access and auth log paths must be absolute file paths")
+	}
+	if filepath.Clean(s.AccessLogPath) == filepath.Clean(s.AuthLogPath) {
+		return common.NewError("the access and auth logs must be different files:", s.AccessLogPath)
+	}
+	if s.SlowRequestThreshold < 0 {
+		return common.NewError("slow request threshold must not be negative:", s.SlowRequestThreshold)
+	}
+	if _, err := middleware.ParseSlowRoutes(s.SlowRequestRoutes); err != nil {
+		return common.NewError("slow request route thresholds are not valid:", err)
+	}
+	if s.PanicBodyCaptureKB < 0 || s.PanicBodyCaptureKB > 1024 {
+		return common.NewError("the body kept of requests that panic must be 0 to 1024 KB:", s.PanicBodyCaptureKB)
+	}
+	if s.AuditRetentionDays < 0 {
+		return common.NewError("audit log retention must not be negative:", s.AuditRetentionDays)
+	}
+	if s.TrafficHistoryDays < 0 {
+		return common.NewError("traffic history retention must not be negative:", s.TrafficHistoryDays)
+	}
+	if s.StatusHistoryDays < 0 {
+		return common.NewError("status history retention must not be negative:", s.StatusHistoryDays)
+	}
+	if s.GeoStatsDays < 0 {
+		return common.NewError("geo stats retention must not be negative:", s.GeoStatsDays)
+	}
+	if s.TrashRetentionDays < 0 {
+		return common.NewError("trash retention must not be negative:", s.TrashRetentionDays)
+	}
+	if _, err := ParseThresholds(s.NotifyTrafficPercents, 1, 100); err != nil {
+		return common.NewError("traffic notification thresholds are not valid:", err)
+	}
+	if _, err := ParseThresholds(s.NotifyExpiryDays, 0, 3650); err != nil {
+		return common.NewError("expiry notification thresholds are not valid:", err)
+	}
+	if s.NotifyExpiryCron != "" {
+		if _, err := CronParser.Parse(s.NotifyExpiryCron); err != nil {
+			return common.NewError("expiry notification schedule is not a cron expression:", err)
+		}
+	}
+	if s.IpLimitWindow < 1 {
+		return common.NewError("IP limit window must be at least one minute:", s.IpLimitWindow)
+	}
+	if s.IpLimitCooldown < 0 {
+		return common.NewError("IP limit cooldown must not be negative:", s.IpLimitCooldown)
+	}
+	if s.IpLimitIpv6Prefix < 0 || s.IpLimitIpv6Prefix > 128 {
+		return common.NewError("IPv6 prefix of IP limits must be between 0 and 128:", s.IpLimitIpv6Prefix)
+	}
+	if s.IpLimitDevices < 0 {
+		return common.NewError("device window of IP limits must not be negative:", s.IpLimitDevices)
+	}
+	if s.ClientCleanupDays < 0 {
+		return common.NewError("client cleanup grace period must not be negative:", s.ClientCleanupDays)
+	}
+	if s.ClientInactiveDays < 0 {
+		return common.NewError("client inactivity period must not be negative:", s.ClientInactiveDays)
+	}
+	if s.RealityCheckInterval < 0 || s.RealityCheckInterval > 1440 {
+		return common.NewError("the interval of the Reality dest checks must be between 0 and 1440 minutes:", s.RealityCheckInterval)
+	}
+	if s.RealityCheckFailures < 1 || s.RealityCheckFailures > 100 {
+		return common.NewError("the failed Reality dest checks before a fallback must be between 1 and 100:", s.RealityCheckFailures)
+	}
+	if s.InboundCheckInterval < 0 || s.InboundCheckInterval > 1440 {
+		return common.NewError("the interval of the inbound checks must be between 0 and 1440 minutes:", s.InboundCheckInterval)
+	}
+	if s.InboundCheckTimeout < 1 || s.InboundCheckTimeout > 30 {
+		return common.NewError("the timeout of the inbound checks must be between 1 and 30 seconds:", s.InboundCheckTimeout)
+	}
+	if s.InboundCheckProberUrl != "" {
+		if u, err := url.Parse(s.InboundCheckProberUrl); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return common.NewError("the prober of the inbound checks is not an http(s) URL:", s.InboundCheckProberUrl)
+		}
+	}
+	s.InboundCheckHost = strings.TrimSpace(s.InboundCheckHost)
+	if strings.ContainsAny(s.InboundCheckHost, "/: ") && net.ParseIP(s.InboundCheckHost) == nil {
+		return common.NewError("the host of the inbound checks must be a domain or an IP address:", s.InboundCheckHost)
+	}
+	if s.OnlineWindow < 10 || s.OnlineWindow > 86400 {
+		return common.NewError("online window must be between 10 and 86400 seconds:", s.OnlineWindow)
+	}
+	if s.ConnectionSampleInterval != 0 && (s.ConnectionSampleInterval < 5 || s.ConnectionSampleInterval > 3600) {
+		return common.NewError("connection sample interval must be between 5 and 3600 seconds, or 0:", s.ConnectionSampleInterval)
+	}
+	if s.ConnBlockMinutes < 1 || s.ConnBlockMinutes > 10080 {
+		return common.NewError("connection blocks must last between 1 and 10080 minutes:", s.ConnBlockMinutes)
+	}
+	if s.StatusSampleInterval < 1 || s.StatusSampleInterval > 60 {
+		return common.NewError("status sample interval must be between 1 and 60 seconds:", s.StatusSampleInterval)
+	}
+	if s.BandwidthSource != "interface" && s.BandwidthSource != "inbounds" {
+		return common.NewError("bandwidth source must be interface or inbounds:", s.BandwidthSource)
+	}
+	if s.BandwidthMonthlyLimit < 0 || s.BandwidthDailyLimit < 0 {
+		return common.NewError("bandwidth limits must not be negative")
+	}
+	if s.BandwidthResetDay < 1 || s.BandwidthResetDay > 28 {
+		return common.NewError("bandwidth reset day must be between 1 and 28:", s.BandwidthResetDay)
+	}
+	if _, err := ParseBandwidthPercents(s.BandwidthAlertPercents); err != nil {
+		return err
+	}
+	if !slices.Contains([]string{"alert", "disableInbounds", "stopXray"}, s.BandwidthAction) {
+		return common.NewError("bandwidth action must be alert, disableInbounds or stopXray:", s.BandwidthAction)
+	}
+	if s.ConnectionMethod != "sockets" && s.ConnectionMethod != "conntrack" {
+		return common.NewError("connection method must be sockets or conntrack:", s.ConnectionMethod)
+	}
+	if s.TrafficFlushInterval < 0 || s.TrafficFlushInterval > 3600 {
+		return common.NewError("traffic flush interval must be between 0 and 3600 seconds:", s.TrafficFlushInterval)
+	}
+	if !slices.Contains([]string{"WAL", "DELETE", "TRUNCATE"}, s.DbJournalMode) {
+		return common.NewError("database journal mode must be WAL, DELETE or TRUNCATE:", s.DbJournalMode)
+	}
+	if !slices.Contains([]string{"OFF", "NORMAL", "FULL"}, s.DbSynchronous) {
+		return common.NewError("database synchronous mode must be OFF, NORMAL or FULL:", s.DbSynchronous)
+	}
+	if s.DbBusyTimeout < 0 || s.DbBusyTimeout > 60000 {
+		return common.NewError("database busy timeout must be between 0 and 60000 milliseconds:", s.DbBusyTimeout)
+	}
+	if s.DbMaxConnections < 1 || s.DbMaxConnections > 64 {
+		return common.NewError("database connections must be between 1 and 64:", s.DbMaxConnections)
+	}
+	if _, err := CronParser.Parse(s.DbOptimizeCron); err != nil {
+		return common.NewError("database optimization schedule is not a cron expression:", err)
+	}
+	if _, err := CronParser.Parse(s.BackupCron); err != nil {
+		return common.NewError("backup schedule is not a cron expression:", err)
+	}
+	if s.BackupDir != "" && !filepath.IsAbs(s.BackupDir) {
+		return common.NewError("backup folder must be an absolute path:", s.BackupDir)
+	}
+	if s.BackupKeep < 0 {
+		return common.NewError("backups to keep must not be negative:", s.BackupKeep)
+	}
+	if s.TgBotBackupCron != "" {
+		if _, err := CronParser.Parse(s.TgBotBackupCron); err != nil {
+			return common.NewError("Telegram backup schedule is not a cron expression:", err)
+		}
+	}
+	if s.TgBotBackupLarge != "split" && s.TgBotBackupLarge != "link" {
+		return common.NewError("large Telegram backups must be split or sent as a link:", s.TgBotBackupLarge)
+	}
+	if s.TgBotLoginNotifyInterval < 0 {
+		return common.NewError("login notification interval must not be negative:", s.TgBotLoginNotifyInterval)
+	}
+	if err := s.CheckTgBotConnection(); err != nil {
+		return err
+	}
+	if s.TgBotParseMode != "HTML" && s.TgBotParseMode != "MarkdownV2" {
+		return common.NewError("Telegram parse mode must be HTML or MarkdownV2:", s.TgBotParseMode)
+	}
+	if s.BackupWebhookUrl != "" {
+		if u, err := url.Parse(s.BackupWebhookUrl); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return common.NewError("backup webhook is not an http(s) URL:", s.BackupWebhookUrl)
+		}
+	}
+
+	if s.RememberSessionMaxAge < 1 {
+		return common.NewError("remember-me session duration must be at least a minute:", s.RememberSessionMaxAge)
+	}
+	if s.RememberMaxAge < 0 {
+		return common.NewError("remember-me duration must not be negative:", s.RememberMaxAge)
+	}
+	if s.SessionIdleTimeout < 0 || s.SessionLifetime < 0 || s.SessionMaxConcurrent < 0 {
+		return common.NewError("session limits must not be negative")
+	}
+	if s.SessionLimitPolicy != "evict" && s.SessionLimitPolicy != "reject" {
+		return common.NewError("sessions beyond the limit must evict the oldest or be rejected:", s.SessionLimitPolicy)
+	}
+	if s.LoginRateLimit < 0 {
+		return common.NewError("login rate limit must not be negative:", s.LoginRateLimit)
+	}
+	if s.LoginRateBurst < 1 {
+		s.LoginRateBurst = 1
+	}
+	if s.LockoutThreshold < 0 || s.LockoutWindow < 0 || s.LockoutDuration < 0 {
+		return common.NewError("lockout settings must not be negative")
+	}
+	switch s.LoginCaptcha {
+	case "":
+		s.LoginCaptcha = "off"
+	case "off", "math":
+	case "turnstile":
+		s.TurnstileSiteKey = strings.TrimSpace(s.TurnstileSiteKey)
+		s.TurnstileSecret = strings.TrimSpace(s.TurnstileSecret)
+		if s.TurnstileSiteKey == "" || s.TurnstileSecret == "" {
+			return common.NewError("the Turnstile login challenge needs a site key and a secret")
+		}
+	default:
+		return common.NewError("login challenge must be off, math or turnstile:", s.LoginCaptcha)
+	}
+	if s.LoginCaptchaFailures < 1 {
+		return common.NewError("the failures before the login challenge must be at least 1:", s.LoginCaptchaFailures)
+	}
+	if s.LoginCaptchaGlobalRate < 0 {
+		return common.NewError("the failed logins per minute before the login challenge must not be negative:", s.LoginCaptchaGlobalRate)
+	}
+	if s.SmtpSecurity == "" {
+		s.SmtpSecurity = SmtpSecurityStartTLS
+	}
+	alertConfig := s.AlertConfig()
+	if err := alertConfig.Validate(); err != nil {
+		return err
+	}
+	if _, err := middleware.ParseTrustedProxies(s.TrustedProxies); err != nil {
+		return err
+	}
+	if s.TrustedProxyHeader == "" {
+		s.TrustedProxyHeader = middleware.TrustedProxyHeaders[0]
+	} else if !middleware.IsTrustedProxyHeader(s.TrustedProxyHeader) {
+		return common.NewError("unsupported client IP header:", s.TrustedProxyHeader)
+	}
+
+	if s.CorsMaxAge < 0 {
+		return common.NewError("CORS max age must not be negative:", s.CorsMaxAge)
+	}
+	cors := s.CORSConfig()
+	if err := cors.Validate(); err != nil {
+		return err
+	}
+
+	securityHeaders := s.SecurityHeadersConfig()
+	if err := securityHeaders.Validate(); err != nil {
+		return err
+	}
+
+	if s.ShutdownTimeout < 1 || s.ShutdownTimeout > 300 {
+		return common.NewError("shutdown timeout must be between 1 and 300 seconds:", s.ShutdownTimeout)
+	}
+
+	if s.CompressionMinSize < 0 {
+		return common.NewError("compression minimum size must not be negative:", s.CompressionMinSize)
+	}
+
+	if s.MaxBodySize < 1 || s.MaxBodySizeRestore < 1 || s.MaxBodySizeImport < 1 {
+		return common.NewError("request body limits must be at least 1 MB")
+	}
+
+	if s.BulkClientsMax < 1 {
+		return common.NewError("bulk client limit must be at least 1:", s.BulkClientsMax)
+	}
+
+	// Every login has to compute a hash, keep it between 8 MiB and 1 GiB
+	if s.PasswordHashMemory < 8*1024 || s.PasswordHashMemory > 1024*1024 {
+		return common.NewError("password hash memory must be between 8192 and 1048576 KiB:", s.PasswordHashMemory)
+	}
+	if s.PasswordHashIterations < 1 || s.PasswordHashIterations > 20 {
+		return common.NewError("password hash iterations must be between 1 and 20:", s.PasswordHashIterations)
+	}
+
+	switch s.LogFormat {
+	case "":
+		s.LogFormat = "text"
+	case "text", "json":
+	default:
+		return common.NewError("log format must be text or json:", s.LogFormat)
+	}
+	switch s.AppLogLevel {
+	case "":
+		s.AppLogLevel = "info"
+	case "off", "debug", "info", "notice", "warning", "error":
+	default:
+		return common.NewError("app log level must be off, debug, info, notice, warning or error:", s.AppLogLevel)
+	}
+
+	switch s.WebAuthnMode {
+	case "":
+		s.WebAuthnMode = "passwordless"
+	case "passwordless", "secondFactor":
+	default:
+		return common.NewError("passkey mode must be passwordless or secondFactor:", s.WebAuthnMode)
+	}
+
+	switch s.ObservatoryMode {
+	case "":
+		s.ObservatoryMode = "observatory"
+	case "observatory", "burstObservatory":
+	default:
+		return common.NewError("observatory mode must be observatory or burstObservatory:", s.ObservatoryMode)
+	}
+	if probeURL, err := url.Parse(s.ObservatoryProbeURL); err != nil || (probeURL.Scheme != "http" && probeURL.Scheme != "https") || probeURL.Host == "" {
+		return common.NewError("observatory probe URL must be an http or https URL:", s.ObservatoryProbeURL)
+	}
+	if s.ObservatoryProbeInterval < 10 {
+		return common.NewError("observatory probe interval must be at least 10 seconds:", s.ObservatoryProbeInterval)
+	}
+
+	if s.XrayDownloadProxy != "" {
+		proxyURL, err := url.Parse(s.XrayDownloadProxy)
+		if err != nil || proxyURL.Host == "" {
+			return common.NewError("xray download proxy must be a URL:", s.XrayDownloadProxy)
+		}
+		switch proxyURL.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return common.NewError("xray download proxy must be an http, https or socks5 URL:", s.XrayDownloadProxy)
+		}
+	}
+	if s.XrayKeptVersions < 1 || s.XrayKeptVersions > 10 {
+		return common.NewError("xray kept versions must be between 1 and 10:", s.XrayKeptVersions)
+	}
+
+	if _, err := CronParser.Parse(s.GeodataUpdateCron); err != nil {
+		return common.NewError("geodata update schedule is not a cron expression:", err)
+	}
+	for _, geoURL := range []string{s.GeoipURL, s.GeositeURL} {
+		if parsed, err := url.Parse(geoURL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return common.NewError("geodata URL must be an http or https URL:", geoURL)
+		}
+	}
+
+	if s.XrayHealthCheckWindow < 1 || s.XrayHealthCheckWindow > 120 {
+		return common.NewError("xray health check window must be between 1 and 120 seconds:", s.XrayHealthCheckWindow)
+	}
+	if s.XrayMaxRestartAttempts < 1 || s.XrayMaxRestartAttempts > 100 {
+		return common.NewError("xray restart attempts must be between 1 and 100:", s.XrayMaxRestartAttempts)
+	}
+	if s.XrayStableMinutes < 1 || s.XrayStableMinutes > 1440 {
+		return common.NewError("xray stable uptime must be between 1 and 1440 minutes:", s.XrayStableMinutes)
+	}
+	if s.XrayCrashOutputKB < 1 || s.XrayCrashOutputKB > 1024 {
+		return common.NewError("xray crash output must be between 1 and 1024 KB:", s.XrayCrashOutputKB)
+	}
+
 	return nil
 }
@@ -2,6 +2,7 @@ package global
 
 import (
 	"context"
+	"net"
 	_ "unsafe"
 
 	"github.com/robfig/cron/v3"
@@ -15,10 +16,13 @@ var (
 type WebServer interface {
 	GetCron() *cron.Cron
 	GetCtx() context.Context
+	GetListenAddr() net.Addr
+	PrepareRestart() error
 }
 
 type SubServer interface {
 	GetCtx() context.Context
+	GetListenAddr() net.Addr
 }
 
 func SetWebServer(s WebServer) {
@@ -0,0 +1,26 @@
+package job
+
+import (
+	"x-ui/logger"
+	"x-ui/web/service"
+)
+
+type BackupJob struct {
+	backupService service.BackupService
+	tgbotService  service.Tgbot
+}
+
+func NewBackupJob() *BackupJob {
+	return new(BackupJob)
+}
+
+// Here Run is an interface method of the Job interface
+func (j *BackupJob) Run() {
+	backup, err := j.backupService.Create()
+	if err != nil {
+		logger.Warning("scheduled backup failed:", err)
+		j.tgbotService.BackupFailed(err)
+		return
+	}
+	j.backupService.UploadRemotes(backup)
+}
@@ -0,0 +1,29 @@
+package job
+
+import (
+	"x-ui/logger"
+	"x-ui/web/service"
+)
+
+// CheckBandwidthJob counts the traffic of the server against its bandwidth
+// limits. A failure is only logged when it differs from the last one.
+type CheckBandwidthJob struct {
+	bandwidthService service.BandwidthService
+	lastErr          string
+}
+
+func NewCheckBandwidthJob() *CheckBandwidthJob {
+	return new(CheckBandwidthJob)
+}
+
+func (j *CheckBandwidthJob) Run() {
+	err := j.bandwidthService.Check()
+	if err == nil {
+		j.lastErr = ""
+		return
+	}
+	if err.Error() != j.lastErr {
+		j.lastErr = err.Error()
+		logger.Warning("check bandwidth failed:", err)
+	}
+}
@@ -8,18 +8,36 @@ import (
 	"os"
 	"os/exec"
 	"regexp"
+	"slices"
 	"sort"
+	"strings"
 	"time"
 
 	"x-ui/database"
 	"x-ui/database/model"
 	"x-ui/logger"
+	"x-ui/web/middleware"
+	"x-ui/web/network"
+	"x-ui/web/service"
 	"x-ui/xray"
 )
 
+var (
+	accessLogIpRegex    = regexp.MustCompile(`from (?:tcp:|udp:)?\[?([0-9a-fA-F\.:]+)\]?:\d+ accepted`)
+	accessLogEmailRegex = regexp.MustCompile(`email: (.+)$`)
+)
+
 type CheckClientIpJob struct {
-	lastClear     int64
-	disAllowedIps []string
+	lastClear      int64
+	disAllowedIps  []string
+	settingService service.SettingService
+	inboundService service.InboundService
+	xrayService    service.XrayService
+	// logFile and logOffset are the access log as far as it was read
+	logFile   os.FileInfo
+	logOffset int64
+	// seen is when each client was last seen from each IP within the window
+	seen map[string]map[string]time.Time
 }
 
 var job *CheckClientIpJob
@@ -36,18 +54,14 @@ func (j *CheckClientIpJob) Run() {
 
 	shouldClearAccessLog := false
 	iplimitActive := j.hasLimitIp()
-	f2bInstalled := j.checkFail2BanInstalled()
 	isAccessLogAvailable := j.checkAccessLogAvailable(iplimitActive)
 
-	if iplimitActive {
-		if f2bInstalled && isAccessLogAvailable {
-			shouldClearAccessLog = j.processLogFile()
-		} else {
-			if !f2bInstalled {
-				logger.Warning("[LimitIP] Fail2Ban is not installed, Please install Fail2Ban from the x-ui bash menu.")
-			}
-		}
+	if iplimitActive && isAccessLogAvailable {
+		shouldClearAccessLog = j.processLogFile(j.checkFail2BanInstalled())
+	} else if isAccessLogAvailable {
+		j.seeOnlineClients()
 	}
+	j.enableCooledDownClients()
 
 	if shouldClearAccessLog || (isAccessLogAvailable && time.Now().Unix()-j.lastClear > 3600) {
 		j.clearAccessLog()
@@ -71,6 +85,7 @@ func (j *CheckClientIpJob) clearAccessLog() {
 
 	err = os.Truncate(accessLogPath, 0)
 	j.checkError(err)
+	j.logOffset = 0
 
 	j.lastClear = time.Now().Unix()
 }
@@ -104,52 +119,79 @@ func (j *CheckClientIpJob) hasLimitIp() bool {
 	return false
 }
 
-func (j *CheckClientIpJob) processLogFile() bool {
-
-	ipRegex := regexp.MustCompile(`from (?:tcp:|udp:)?\[?([0-9a-fA-F\.:]+)\]?:\d+ accepted`)
-	emailRegex := regexp.MustCompile(`email: (.+)$`)
+// processLogFile reads what was written to the access log since the last run
+// and records the IPs every client was seen from within the IP limit window.
+// Clients seen from more IPs than their limit are reported to Fail2Ban, which
+// bans the IPs beyond the limit, or disabled if it is not installed.
+func (j *CheckClientIpJob) processLogFile(f2bInstalled bool) bool {
+	windowMinutes, err := j.settingService.GetIpLimitWindow()
+	if err != nil || windowMinutes < 1 {
+		windowMinutes = 5
+	}
+	now := time.Now()
+	cutoff := now.Add(-time.Duration(windowMinutes) * time.Minute)
+	if j.seen == nil {
+		j.seen = make(map[string]map[string]time.Time, 100)
+	}
 
 	accessLogPath, _ := xray.GetAccessLogPath()
-	file, _ := os.Open(accessLogPath)
-	defer file.Close()
-
-	inboundClientIps := make(map[string]map[string]struct{}, 100)
-
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-
-		ipMatches := ipRegex.FindStringSubmatch(line)
-		if len(ipMatches) < 2 {
+	for _, line := range j.readAccessLog(accessLogPath) {
+		email, ip, at, ok := parseAccessLogLine(line, now)
+		if !ok {
 			continue
 		}
-
-		ip := ipMatches[1]
-
-		if ip == "127.0.0.1" || ip == "::1" {
+		j.inboundService.SeeClientIp(email, ip, at)
+		if at.Before(cutoff) {
 			continue
 		}
 
-		emailMatches := emailRegex.FindStringSubmatch(line)
-		if len(emailMatches) < 2 {
+		// A trusted proxy in front of xray stands for many clients, counting it
+		// would ban every client behind it
+		if source, _ := network.IpSource(ip, 128); source == "127.0.0.1" || source == "::1" || middleware.IsTrustedProxy(ip) {
 			continue
 		}
-		email := emailMatches[1]
 
-		if _, exists := inboundClientIps[email]; !exists {
-			inboundClientIps[email] = make(map[string]struct{})
+		if _, exists := j.seen[email]; !exists {
+			j.seen[email] = make(map[string]time.Time)
+		}
+		if at.After(j.seen[email][ip]) {
+			j.seen[email][ip] = at
 		}
-		inboundClientIps[email][ip] = struct{}{}
 	}
 
+	// Forget the IPs that fell out of the window
+	for email, ips := range j.seen {
+		for ip, at := range ips {
+			if at.Before(cutoff) {
+				delete(ips, ip)
+			}
+		}
+		if len(ips) == 0 {
+			delete(j.seen, email)
+		}
+	}
+
+	v6Prefix, err := j.settingService.GetIpLimitIpv6Prefix()
+	if err != nil {
+		v6Prefix = 64
+	}
 	shouldCleanLog := false
-	for email, uniqueIps := range inboundClientIps {
+	blocked := map[string][]string{}
+	for email, seenIps := range j.seen {
 
-		ips := make([]string, 0, len(uniqueIps))
-		for ip := range uniqueIps {
+		// The IPs in the order they were last seen, the ones beyond the limit
+		// are the latest
+		ips := make([]string, 0, len(seenIps))
+		for ip := range seenIps {
 			ips = append(ips, ip)
 		}
-		sort.Strings(ips)
+		sort.Slice(ips, func(a, b int) bool {
+			if !seenIps[ips[a]].Equal(seenIps[ips[b]]) {
+				return seenIps[ips[a]].Before(seenIps[ips[b]])
+			}
+			return ips[a] < ips[b]
+		})
+		sources := groupIpSources(ips, v6Prefix)
 
 		clientIpsRecord, err := j.getInboundClientIps(email)
 		if err != nil {
@@ -157,12 +199,147 @@ func (j *CheckClientIpJob) processLogFile() bool {
 			continue
 		}
 
-		shouldCleanLog = j.updateInboundClientIps(clientIpsRecord, email, ips) || shouldCleanLog
+		shouldCleanLog = j.updateInboundClientIps(clientIpsRecord, email, sources) || shouldCleanLog
+		if !f2bInstalled && len(j.disAllowedIps) > 0 {
+			blocked[email] = slices.Clone(j.disAllowedIps)
+		}
+	}
+
+	if len(blocked) > 0 {
+		count, needRestart, err := j.inboundService.DisableIpLimitedClients(blocked)
+		if err != nil {
+			logger.Warning("[LimitIP] disable clients failed:", err)
+		} else if count > 0 {
+			logger.Infof("[LimitIP] disabled %d clients for connecting from more IPs than they may", count)
+		}
+		for email := range blocked {
+			delete(j.seen, email)
+		}
+		if needRestart {
+			j.xrayService.SetToNeedRestart()
+		}
 	}
 
 	return shouldCleanLog
 }
 
+// seeOnlineClients reads what was written to the access log since the last run
+// for the IPs the clients connect from, when no IP limit needs it read.
+func (j *CheckClientIpJob) seeOnlineClients() {
+	accessLogPath, _ := xray.GetAccessLogPath()
+	now := time.Now()
+	for _, line := range j.readAccessLog(accessLogPath) {
+		if email, ip, at, ok := parseAccessLogLine(line, now); ok {
+			j.inboundService.SeeClientIp(email, ip, at)
+		}
+	}
+}
+
+// groupIpSources groups ips by the sources they count as toward an IP limit, in
+// the order of the last IP of each source; an IPv4 address and the same one
+// mapped into IPv6 are one source, and so are the IPv6 addresses of a network
+// of v6Prefix bits.
+func groupIpSources(ips []string, v6Prefix int) [][]string {
+	bySource := map[string][]string{}
+	order := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		source, ok := network.IpSource(ip, v6Prefix)
+		if !ok {
+			source = ip
+		}
+		if _, exists := bySource[source]; exists {
+			// Moves the source after the ones seen before its latest IP
+			order = slices.DeleteFunc(order, func(s string) bool { return s == source })
+		}
+		bySource[source] = append(bySource[source], ip)
+		order = append(order, source)
+	}
+	sources := make([][]string, 0, len(order))
+	for _, source := range order {
+		sources = append(sources, bySource[source])
+	}
+	return sources
+}
+
+// readAccessLog returns the lines written to the access log since it was last
+// read. A log that was rotated or truncated since is read from its start, and a
+// last line that is not complete yet is left for the next read.
+func (j *CheckClientIpJob) readAccessLog(accessLogPath string) []string {
+	file, err := os.Open(accessLogPath)
+	if err != nil {
+		j.checkError(err)
+		return nil
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		j.checkError(err)
+		return nil
+	}
+	if j.logFile == nil || !os.SameFile(j.logFile, info) || info.Size() < j.logOffset {
+		j.logOffset = 0
+	}
+	j.logFile = info
+	if _, err := file.Seek(j.logOffset, io.SeekStart); err != nil {
+		j.checkError(err)
+		return nil
+	}
+
+	var lines []string
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			break
+		}
+		j.logOffset += int64(len(line))
+		lines = append(lines, strings.TrimRight(line, "\r\n"))
+	}
+	return lines
+}
+
+// parseAccessLogLine returns the client and the source IP of an accepted
+// connection in the access log, and when it was accepted; lines without a time
+// are taken as written at now.
+func parseAccessLogLine(line string, now time.Time) (email string, ip string, at time.Time, ok bool) {
+	ipMatches := accessLogIpRegex.FindStringSubmatch(line)
+	if len(ipMatches) < 2 {
+		return "", "", time.Time{}, false
+	}
+	emailMatches := accessLogEmailRegex.FindStringSubmatch(line)
+	if len(emailMatches) < 2 {
+		return "", "", time.Time{}, false
+	}
+	at = now
+	if len(line) >= 19 {
+		if parsed, err := time.ParseInLocation("2006/01/02 15:04:05", line[:19], time.Local); err == nil {
+			at = parsed
+		}
+	}
+	return strings.TrimSpace(emailMatches[1]), ipMatches[1], at, true
+}
+
+// enableCooledDownClients enables the clients disabled for their IP limit again
+// once the cooldown passed; a cooldown of 0 leaves them to the admin.
+func (j *CheckClientIpJob) enableCooledDownClients() {
+	cooldown, err := j.settingService.GetIpLimitCooldown()
+	if err != nil || cooldown <= 0 {
+		return
+	}
+	count, needRestart, err := j.inboundService.EnableIpLimitedClients(time.Duration(cooldown) * time.Minute)
+	if err != nil {
+		logger.Warning("[LimitIP] enable clients failed:", err)
+		return
+	}
+	if count > 0 {
+		logger.Infof("[LimitIP] enabled %d clients after their cooldown", count)
+	}
+	if needRestart {
+		j.xrayService.SetToNeedRestart()
+	}
+}
+
 func (j *CheckClientIpJob) checkFail2BanInstalled() bool {
 	cmd := "fail2ban-client"
 	args := []string{"-h"}
@@ -210,8 +387,7 @@ func (j *CheckClientIpJob) addInboundClientIps(clientEmail string, ips []string)
 	inboundClientIps.ClientEmail = clientEmail
 	inboundClientIps.Ips = string(jsonIps)
 
-	db := database.GetDB()
-	tx := db.Begin()
+	tx := database.Begin()
 
 	defer func() {
 		if err == nil {
@@ -228,7 +404,11 @@ func (j *CheckClientIpJob) addInboundClientIps(clientEmail string, ips []string)
 	return nil
 }
 
-func (j *CheckClientIpJob) updateInboundClientIps(inboundClientIps *model.InboundClientIps, clientEmail string, ips []string) bool {
+// updateInboundClientIps records the IPs of a client, grouped by the sources
+// they count as toward its IP limit, and takes the IPs of the sources beyond its
+// limit as disallowed.
+func (j *CheckClientIpJob) updateInboundClientIps(inboundClientIps *model.InboundClientIps, clientEmail string, sources [][]string) bool {
+	ips := slices.Concat(sources...)
 	jsonIps, err := json.Marshal(ips)
 	if err != nil {
 		logger.Error("failed to marshal IPs to JSON:", err)
@@ -271,10 +451,10 @@ func (j *CheckClientIpJob) updateInboundClientIps(inboundClientIps *model.Inboun
 			if limitIp > 0 && inbound.Enable {
 				shouldCleanLog = true
 
-				if limitIp < len(ips) {
-					j.disAllowedIps = append(j.disAllowedIps, ips[limitIp:]...)
-					for i := limitIp; i < len(ips); i++ {
-						log.Printf("[LIMIT_IP] Email = %s || SRC = %s", clientEmail, ips[i])
+				if limitIp < len(sources) {
+					j.disAllowedIps = append(j.disAllowedIps, slices.Concat(sources[limitIp:]...)...)
+					for _, ip := range slices.Concat(sources[limitIp:]...) {
+						log.Printf("[LIMIT_IP] Email = %s || SRC = %s", clientEmail, ip)
 					}
 				}
 			}
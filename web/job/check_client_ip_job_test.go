@@ -0,0 +1,168 @@
+package job
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+)
+
+func TestParseAccessLogLine(t *testing.T) {
+	now := time.Date(2024, 5, 20, 12, 0, 0, 0, time.Local)
+	tests := []struct {
+		name  string
+		line  string
+		email string
+		ip    string
+		at    time.Time
+	}{
+		{
+			"vless", "2024/05/20 10:11:12.345678 from 203.0.113.7:51234 accepted tcp:www.google.com:443 [inbound-443 >> direct] email: reality-1",
+			"reality-1", "203.0.113.7", time.Date(2024, 5, 20, 10, 11, 12, 0, time.Local),
+		},
+		{
+			"vmess ws over ipv6", "2024/05/20 10:11:13 from [2001:db8::1]:40000 accepted tcp:example.com:80 [inbound-8080 -> direct] email: ws-1@example.com",
+			"ws-1@example.com", "2001:db8::1", time.Date(2024, 5, 20, 10, 11, 13, 0, time.Local),
+		},
+		{
+			"trojan with network", "2024/05/20 10:11:14.000001 from tcp:198.51.100.3:6000 accepted udp:8.8.8.8:53 [inbound-2053 >> direct] email: trojan-1",
+			"trojan-1", "198.51.100.3", time.Date(2024, 5, 20, 10, 11, 14, 0, time.Local),
+		},
+		{
+			"v4 mapped", "2024/05/20 10:11:15.5 from tcp:[::ffff:192.0.2.1]:443 accepted tcp:1.1.1.1:443 [inbound-443 >> direct] email: mapped",
+			"mapped", "::ffff:192.0.2.1", time.Date(2024, 5, 20, 10, 11, 15, 0, time.Local),
+		},
+		{
+			"no time", "from 192.0.2.9:1000 accepted tcp:a.example:443 [inbound-443 >> direct] email: bare",
+			"bare", "192.0.2.9", now,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			email, ip, at, ok := parseAccessLogLine(test.line, now)
+			if !ok || email != test.email || ip != test.ip || !at.Equal(test.at) {
+				t.Errorf("parsed %q %q %v %v, want %q %q %v", email, ip, at, ok, test.email, test.ip, test.at)
+			}
+		})
+	}
+
+	for name, line := range map[string]string{
+		"rejected": "2024/05/20 10:11:16 from 203.0.113.7:51234 rejected  proxy/vless/encoding: invalid request user id",
+		"api":      "2024/05/20 10:11:17 from 127.0.0.1:40012 accepted tcp:127.0.0.1:62789 [api -> api]",
+		"dns":      "2024/05/20 10:11:18 [Info] app/dns: UDP:1.1.1.1:53 got answer: www.google.com. TypeA -> [142.250.74.36]",
+		"empty":    "",
+	} {
+		if _, _, _, ok := parseAccessLogLine(line, now); ok {
+			t.Errorf("%s line was parsed", name)
+		}
+	}
+}
+
+func TestReadAccessLogFollowsRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	write := func(content string, flag int) {
+		t.Helper()
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|flag, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := f.WriteString(content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	j := &CheckClientIpJob{}
+	check := func(step string, want ...string) {
+		t.Helper()
+		if got := j.readAccessLog(path); !reflect.DeepEqual(got, want) && !(len(got) == 0 && len(want) == 0) {
+			t.Errorf("%s: read %q, want %q", step, got, want)
+		}
+	}
+
+	write("one\r\ntwo\npart", os.O_TRUNC)
+	check("first read", "one", "two")
+	// A line being written is read once it is complete
+	write("ial\nthree\n", os.O_APPEND)
+	check("appended", "partial", "three")
+	check("unchanged")
+
+	// A rotated log is a new file, read from its start
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	write("four\n", os.O_TRUNC)
+	check("rotated", "four")
+
+	// So is a log truncated in place
+	write("", os.O_TRUNC)
+	check("truncated")
+	write("five\n", os.O_APPEND)
+	check("after truncation", "five")
+
+	os.Remove(path)
+	check("removed")
+}
+
+func TestGroupIpSources(t *testing.T) {
+	ips := []string{"203.0.113.7", "2001:db8:1:2::1", "::ffff:203.0.113.7", "2001:db8:1:2::2", "2001:db8:1:3::1", "bogus"}
+	want := [][]string{
+		{"203.0.113.7", "::ffff:203.0.113.7"},
+		{"2001:db8:1:2::1", "2001:db8:1:2::2"},
+		{"2001:db8:1:3::1"},
+		{"bogus"},
+	}
+	if got := groupIpSources(ips, 64); !reflect.DeepEqual(got, want) {
+		t.Errorf("groupIpSources(/64) = %q, want %q", got, want)
+	}
+	if got := groupIpSources(ips, 128); len(got) != 5 {
+		t.Errorf("groupIpSources(/128) has %d sources, want 5: %q", len(got), got)
+	}
+}
+
+func TestUpdateInboundClientIpsLogsRawAddresses(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XUI_LOG_FOLDER", dir)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	if err := database.InitDB(filepath.Join(dir, "x-ui.db")); err != nil {
+		t.Fatal(err)
+	}
+	inbound := &model.Inbound{
+		Enable: true, Port: 20004, Protocol: model.Trojan, Tag: "inbound-20004",
+		Settings: `{"clients":[{"password":"p","email":"dual-stack","limitIp":1,"enable":true}]}`,
+	}
+	if err := database.GetDB().Create(inbound).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// The addresses of a /64 and a v4 address mapped into IPv6 are one source
+	// each, the v4 one counting beyond the limit
+	ips := []string{"2001:db8:1:2::1", "2001:db8:1:2::2", "::ffff:203.0.113.7", "203.0.113.7"}
+	j := &CheckClientIpJob{}
+	record := &model.InboundClientIps{}
+	if !j.updateInboundClientIps(record, "dual-stack", groupIpSources(ips, 64)) {
+		t.Error("the IP limit of the client is not active")
+	}
+	if want := []string{"203.0.113.7", "::ffff:203.0.113.7"}; !reflect.DeepEqual(j.disAllowedIps, want) {
+		t.Errorf("disallowed %q, want %q", j.disAllowedIps, want)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "3xipl.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Fail2Ban bans the addresses as they connected, not their sources
+	for _, ip := range []string{"::ffff:203.0.113.7", "203.0.113.7"} {
+		if !strings.Contains(string(data), "[LIMIT_IP] Email = dual-stack || SRC = "+ip+"\n") {
+			t.Errorf("the IP limit log misses %s:\n%s", ip, data)
+		}
+	}
+	if strings.Contains(string(data), "2001:db8") {
+		t.Errorf("the IP limit log has the addresses within the limit:\n%s", data)
+	}
+}
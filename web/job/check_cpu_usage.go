@@ -21,6 +21,9 @@ func NewCheckCpuJob() *CheckCpuJob {
 // Here run is a interface method of Job interface
 func (j *CheckCpuJob) Run() {
 	threshold, _ := j.settingService.GetTgCpu()
+	if threshold <= 0 || !j.tgbotService.AlertsOn(service.AlertCpu) {
+		return
+	}
 
 	// get latest status of server
 	percent, err := cpu.Percent(1*time.Minute, false)
@@ -29,6 +32,6 @@ func (j *CheckCpuJob) Run() {
 			"Percent=="+strconv.FormatFloat(percent[0], 'f', 2, 64),
 			"Threshold=="+strconv.Itoa(threshold))
 
-		j.tgbotService.SendMsgToTgbotAdmins(msg)
+		j.tgbotService.SendAlert(service.AlertCpu, msg)
 	}
 }
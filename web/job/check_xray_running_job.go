@@ -1,7 +1,6 @@
 package job
 
 import (
-	"x-ui/logger"
 	"x-ui/web/service"
 )
 
@@ -18,15 +17,13 @@ func NewCheckXrayRunningJob() *CheckXrayRunningJob {
 func (j *CheckXrayRunningJob) Run() {
 	if !j.xrayService.DidXrayCrash() {
 		j.checkTime = 0
+		j.xrayService.NoteXrayRunning()
 	} else {
 		j.checkTime++
 		// only restart if it's down 2 times in a row
 		if j.checkTime > 1 {
-			err := j.xrayService.RestartXray(false)
 			j.checkTime = 0
-			if err != nil {
-				logger.Error("Restart xray failed:", err)
-			}
+			j.xrayService.RestartCrashedXray()
 		}
 	}
 }
@@ -0,0 +1,44 @@
+package job
+
+import (
+	"strings"
+
+	"x-ui/logger"
+	"x-ui/web/service"
+)
+
+// CheckXrayUsersJob restarts Xray when the users it has after the changes made
+// through its API drift from the users of the panel. A drift is only acted on
+// if it is still there on the next run, not to restart Xray in the middle of a
+// change.
+type CheckXrayUsersJob struct {
+	xrayService service.XrayService
+	lastDrift   string
+}
+
+func NewCheckXrayUsersJob() *CheckXrayUsersJob {
+	return new(CheckXrayUsersJob)
+}
+
+func (j *CheckXrayUsersJob) Run() {
+	drift, err := j.xrayService.CheckXrayUsers()
+	if err != nil {
+		logger.Warning("check xray users failed:", err)
+		return
+	}
+	if len(drift) == 0 {
+		j.lastDrift = ""
+		return
+	}
+	current := strings.Join(drift, "; ")
+	if current != j.lastDrift {
+		j.lastDrift = current
+		logger.Debug("The users of Xray differ from the panel:", current)
+		return
+	}
+	j.lastDrift = ""
+	logger.Warning("The users of Xray drifted from the panel, restarting it:", current)
+	if err := j.xrayService.RestartXray(true); err != nil {
+		logger.Error("restart xray failed:", err)
+	}
+}
@@ -0,0 +1,64 @@
+package job
+
+import (
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/web/service"
+)
+
+type CleanupClientsJob struct {
+	settingService service.SettingService
+	inboundService service.InboundService
+	auditService   service.AuditService
+	xrayService    service.XrayService
+}
+
+func NewCleanupClientsJob() *CleanupClientsJob {
+	return new(CleanupClientsJob)
+}
+
+// Here Run is an interface method of the Job interface
+func (j *CleanupClientsJob) Run() {
+	days, err := j.settingService.GetClientCleanupDays()
+	if err != nil {
+		logger.Warning("get client cleanup setting failed:", err)
+		return
+	}
+	inactiveDays := j.settingService.GetClientCleanupInactiveDays()
+	trialGrace, err := j.settingService.GetTrialCleanup()
+	if err != nil {
+		logger.Warning("get trial cleanup setting failed:", err)
+	}
+	if days <= 0 && inactiveDays <= 0 && trialGrace <= 0 {
+		return
+	}
+	deleted, needRestart, err := j.inboundService.CleanupClients(days, inactiveDays, trialGrace)
+	if err != nil {
+		logger.Warning("clean up clients failed:", err)
+		return
+	}
+	if len(deleted) == 0 {
+		return
+	}
+	logger.Infof("deleted %d clients disabled for more than %d days (trials %v) or not seen for more than %d days", len(deleted), days, trialGrace, inactiveDays)
+	emails := make([]string, 0, len(deleted))
+	for _, client := range deleted {
+		emails = append(emails, client.Email)
+	}
+	j.auditService.Record(&model.AuditLog{
+		Actor:      "system",
+		Action:     "client.cleanup",
+		EntityType: "client",
+		Success:    true,
+		Diff: service.AuditDiff(map[string]any{}, map[string]any{
+			"graceDays":    days,
+			"inactiveDays": inactiveDays,
+			"trialHours":   int(trialGrace.Hours()),
+			"count":        len(deleted),
+			"emails":       emails,
+		}),
+	})
+	if needRestart {
+		j.xrayService.SetToNeedRestart()
+	}
+}
@@ -0,0 +1,22 @@
+package job
+
+import (
+	"x-ui/logger"
+	"x-ui/web/service"
+)
+
+// ExpireConnBlocksJob lifts the blocks of the source IPs that went over the
+// connection limits of inbounds once they expire.
+type ExpireConnBlocksJob struct {
+	connBlockService service.ConnBlockService
+}
+
+func NewExpireConnBlocksJob() *ExpireConnBlocksJob {
+	return new(ExpireConnBlocksJob)
+}
+
+func (j *ExpireConnBlocksJob) Run() {
+	if err := j.connBlockService.ExpireBlocks(); err != nil {
+		logger.Warning("expire connection blocks failed:", err)
+	}
+}
@@ -0,0 +1,25 @@
+package job
+
+import (
+	"x-ui/logger"
+	"x-ui/web/service"
+)
+
+type ExpiryReminderJob struct {
+	inboundService service.InboundService
+	tgbotService   service.Tgbot
+}
+
+func NewExpiryReminderJob() *ExpiryReminderJob {
+	return new(ExpiryReminderJob)
+}
+
+// Here Run is an interface method of the Job interface
+func (j *ExpiryReminderJob) Run() {
+	reminders, err := j.inboundService.CheckExpiryReminders()
+	if err != nil {
+		logger.Warning("check expiry reminders failed:", err)
+		return
+	}
+	j.tgbotService.NotifyExpiryReminders(reminders)
+}
@@ -0,0 +1,23 @@
+package job
+
+import (
+	"x-ui/logger"
+	"x-ui/web/service"
+)
+
+// FlushGeoStatsJob writes the connections and the traffic counted by country
+// to the database.
+type FlushGeoStatsJob struct {
+	geoStatsService service.GeoStatsService
+}
+
+func NewFlushGeoStatsJob() *FlushGeoStatsJob {
+	return new(FlushGeoStatsJob)
+}
+
+// Here Run is an interface method of the Job interface
+func (j *FlushGeoStatsJob) Run() {
+	if err := j.geoStatsService.Flush(); err != nil {
+		logger.Warning("flush geo stats failed:", err)
+	}
+}
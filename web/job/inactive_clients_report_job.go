@@ -0,0 +1,31 @@
+package job
+
+import (
+	"x-ui/logger"
+	"x-ui/web/service"
+)
+
+type InactiveClientsReportJob struct {
+	settingService service.SettingService
+	inboundService service.InboundService
+}
+
+func NewInactiveClientsReportJob() *InactiveClientsReportJob {
+	return new(InactiveClientsReportJob)
+}
+
+// Here Run is an interface method of the Job interface
+func (j *InactiveClientsReportJob) Run() {
+	days := j.settingService.GetClientInactiveReportDays()
+	if days <= 0 {
+		return
+	}
+	count, err := j.inboundService.ReportInactiveClients(days)
+	if err != nil {
+		logger.Warning("report inactive clients failed:", err)
+		return
+	}
+	if count > 0 {
+		logger.Infof("reported %d clients that became inactive for %d days", count, days)
+	}
+}
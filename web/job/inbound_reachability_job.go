@@ -0,0 +1,27 @@
+package job
+
+import (
+	"x-ui/logger"
+	"x-ui/web/service"
+)
+
+type InboundReachabilityJob struct {
+	inboundService service.InboundService
+	tgbotService   service.Tgbot
+}
+
+func NewInboundReachabilityJob() *InboundReachabilityJob {
+	return new(InboundReachabilityJob)
+}
+
+// Here Run is an interface method of the Job interface
+func (j *InboundReachabilityJob) Run() {
+	unreachable, err := j.inboundService.CheckInbounds()
+	if err != nil {
+		logger.Warning("check inbound reachability failed:", err)
+	}
+	for _, failed := range unreachable {
+		logger.Warningf("inbound %s on port %d went unreachable, its %s check failed: %s", failed.Check.Tag, failed.Check.Port, failed.Step.Step, failed.Step.Error)
+		j.tgbotService.InboundUnreachable(failed)
+	}
+}
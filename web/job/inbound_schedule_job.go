@@ -0,0 +1,48 @@
+package job
+
+import (
+	"strconv"
+
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/web/service"
+)
+
+type InboundScheduleJob struct {
+	inboundService service.InboundService
+	auditService   service.AuditService
+	xrayService    service.XrayService
+}
+
+func NewInboundScheduleJob() *InboundScheduleJob {
+	return new(InboundScheduleJob)
+}
+
+// Here Run is an interface method of the Job interface
+func (j *InboundScheduleJob) Run() {
+	transitions, needRestart, err := j.inboundService.RunSchedules()
+	if err != nil {
+		logger.Warning("run inbound schedules failed:", err)
+	}
+	for _, transition := range transitions {
+		action := "inbound.disable"
+		if transition.Enable {
+			action = "inbound.enable"
+		}
+		logger.Infof("inbound %s switched to enable=%v by its schedule", transition.Tag, transition.Enable)
+		j.auditService.Record(&model.AuditLog{
+			Actor:      "system",
+			Action:     action,
+			EntityType: "inbound",
+			EntityId:   strconv.Itoa(transition.InboundId),
+			Success:    true,
+			Diff: service.AuditDiff(map[string]any{"enable": !transition.Enable}, map[string]any{
+				"enable": transition.Enable,
+				"reason": "schedule",
+			}),
+		})
+	}
+	if needRestart {
+		j.xrayService.SetToNeedRestart()
+	}
+}
@@ -0,0 +1,19 @@
+package job
+
+import (
+	"x-ui/web/service"
+)
+
+// NodeSyncJob syncs the nodes the inbounds or the clients changed for, and
+// the others once in a while for their drift and their traffic.
+type NodeSyncJob struct {
+	nodeService service.NodeService
+}
+
+func NewNodeSyncJob() *NodeSyncJob {
+	return new(NodeSyncJob)
+}
+
+func (j *NodeSyncJob) Run() {
+	j.nodeService.SyncNodes()
+}
@@ -0,0 +1,29 @@
+package job
+
+import (
+	"x-ui/database"
+	"x-ui/logger"
+	"x-ui/web/service"
+)
+
+type OptimizeDbJob struct {
+	databaseService service.DatabaseService
+	tgbotService    service.Tgbot
+}
+
+func NewOptimizeDbJob() *OptimizeDbJob {
+	return new(OptimizeDbJob)
+}
+
+// Here Run is an interface method of the Job interface
+func (j *OptimizeDbJob) Run() {
+	_, err := j.databaseService.Optimize()
+	if err == database.ErrFileBusy {
+		logger.Info("database optimization skipped:", err)
+		return
+	}
+	if err != nil {
+		logger.Warning(err)
+		j.tgbotService.DatabaseOptimizeFailed(err)
+	}
+}
@@ -0,0 +1,32 @@
+package job
+
+import (
+	"x-ui/logger"
+	"x-ui/web/service"
+)
+
+type PruneAuditLogJob struct {
+	settingService service.SettingService
+	auditService   service.AuditService
+}
+
+func NewPruneAuditLogJob() *PruneAuditLogJob {
+	return new(PruneAuditLogJob)
+}
+
+// Here Run is an interface method of the Job interface
+func (j *PruneAuditLogJob) Run() {
+	days, err := j.settingService.GetAuditRetentionDays()
+	if err != nil {
+		logger.Warning("get audit log retention failed:", err)
+		return
+	}
+	count, err := j.auditService.Prune(days)
+	if err != nil {
+		logger.Warning("prune audit log failed:", err)
+		return
+	}
+	if count > 0 {
+		logger.Infof("pruned %d audit log entries older than %d days", count, days)
+	}
+}
@@ -0,0 +1,32 @@
+package job
+
+import (
+	"x-ui/logger"
+	"x-ui/web/service"
+)
+
+type PruneGeoStatsJob struct {
+	settingService  service.SettingService
+	geoStatsService service.GeoStatsService
+}
+
+func NewPruneGeoStatsJob() *PruneGeoStatsJob {
+	return new(PruneGeoStatsJob)
+}
+
+// Here Run is an interface method of the Job interface
+func (j *PruneGeoStatsJob) Run() {
+	days, err := j.settingService.GetGeoStatsDays()
+	if err != nil {
+		logger.Warning("get geo stats retention failed:", err)
+		return
+	}
+	count, err := j.geoStatsService.Prune(days)
+	if err != nil {
+		logger.Warning("prune geo stats failed:", err)
+		return
+	}
+	if count > 0 {
+		logger.Infof("pruned %d rows of geo stats older than %d days", count, days)
+	}
+}
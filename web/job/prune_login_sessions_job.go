@@ -0,0 +1,26 @@
+package job
+
+import (
+	"x-ui/logger"
+	"x-ui/web/service"
+)
+
+type PruneLoginSessionsJob struct {
+	sessionStore service.LoginSessionService
+}
+
+func NewPruneLoginSessionsJob() *PruneLoginSessionsJob {
+	return new(PruneLoginSessionsJob)
+}
+
+// Here Run is an interface method of the Job interface
+func (j *PruneLoginSessionsJob) Run() {
+	count, err := j.sessionStore.Prune()
+	if err != nil {
+		logger.Warning("prune login sessions failed:", err)
+		return
+	}
+	if count > 0 {
+		logger.Infof("pruned %d expired login sessions", count)
+	}
+}
@@ -0,0 +1,32 @@
+package job
+
+import (
+	"x-ui/logger"
+	"x-ui/web/service"
+)
+
+type PruneStatusHistoryJob struct {
+	settingService service.SettingService
+	serverService  service.ServerService
+}
+
+func NewPruneStatusHistoryJob() *PruneStatusHistoryJob {
+	return new(PruneStatusHistoryJob)
+}
+
+// Here Run is an interface method of the Job interface
+func (j *PruneStatusHistoryJob) Run() {
+	days, err := j.settingService.GetStatusHistoryDays()
+	if err != nil {
+		logger.Warning("get status history retention failed:", err)
+		return
+	}
+	count, err := j.serverService.PruneStatusHistory(days)
+	if err != nil {
+		logger.Warning("prune status history failed:", err)
+		return
+	}
+	if count > 0 {
+		logger.Infof("pruned %d minutes of status history older than %d days", count, days)
+	}
+}
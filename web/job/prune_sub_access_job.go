@@ -0,0 +1,32 @@
+package job
+
+import (
+	"x-ui/logger"
+	"x-ui/web/service"
+)
+
+type PruneSubAccessJob struct {
+	settingService   service.SettingService
+	subAccessService service.SubAccessService
+}
+
+func NewPruneSubAccessJob() *PruneSubAccessJob {
+	return new(PruneSubAccessJob)
+}
+
+// Here Run is an interface method of the Job interface
+func (j *PruneSubAccessJob) Run() {
+	days, err := j.settingService.GetSubAccessDays()
+	if err != nil {
+		logger.Warning("get subscription fetch retention failed:", err)
+		return
+	}
+	count, err := j.subAccessService.Prune(days)
+	if err != nil {
+		logger.Warning("prune subscription fetches failed:", err)
+		return
+	}
+	if count > 0 {
+		logger.Infof("pruned %d subscription fetches older than %d days", count, days)
+	}
+}
@@ -0,0 +1,32 @@
+package job
+
+import (
+	"x-ui/logger"
+	"x-ui/web/service"
+)
+
+type PruneTrafficHistoryJob struct {
+	settingService service.SettingService
+	inboundService service.InboundService
+}
+
+func NewPruneTrafficHistoryJob() *PruneTrafficHistoryJob {
+	return new(PruneTrafficHistoryJob)
+}
+
+// Here Run is an interface method of the Job interface
+func (j *PruneTrafficHistoryJob) Run() {
+	days, err := j.settingService.GetTrafficHistoryDays()
+	if err != nil {
+		logger.Warning("get traffic history retention failed:", err)
+		return
+	}
+	count, err := j.inboundService.PruneTrafficHistory(days)
+	if err != nil {
+		logger.Warning("prune traffic history failed:", err)
+		return
+	}
+	if count > 0 {
+		logger.Infof("pruned %d hours of traffic history older than %d days", count, days)
+	}
+}
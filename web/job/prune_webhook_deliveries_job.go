@@ -0,0 +1,26 @@
+package job
+
+import (
+	"x-ui/logger"
+	"x-ui/web/service"
+)
+
+type PruneWebhookDeliveriesJob struct {
+	webhookService service.WebhookService
+}
+
+func NewPruneWebhookDeliveriesJob() *PruneWebhookDeliveriesJob {
+	return new(PruneWebhookDeliveriesJob)
+}
+
+// Here Run is an interface method of the Job interface
+func (j *PruneWebhookDeliveriesJob) Run() {
+	count, err := j.webhookService.Prune()
+	if err != nil {
+		logger.Warning("prune webhook deliveries failed:", err)
+		return
+	}
+	if count > 0 {
+		logger.Infof("pruned %d finished webhook deliveries", count)
+	}
+}
@@ -0,0 +1,32 @@
+package job
+
+import (
+	"x-ui/logger"
+	"x-ui/web/service"
+)
+
+type PurgeTrashJob struct {
+	settingService service.SettingService
+	inboundService service.InboundService
+}
+
+func NewPurgeTrashJob() *PurgeTrashJob {
+	return new(PurgeTrashJob)
+}
+
+// Here Run is an interface method of the Job interface
+func (j *PurgeTrashJob) Run() {
+	days, err := j.settingService.GetTrashRetentionDays()
+	if err != nil {
+		logger.Warning("get trash retention failed:", err)
+		return
+	}
+	count, err := j.inboundService.PurgeTrash(days)
+	if err != nil {
+		logger.Warning("purge trash failed:", err)
+		return
+	}
+	if count > 0 {
+		logger.Infof("purged %d trash entries older than %d days", count, days)
+	}
+}
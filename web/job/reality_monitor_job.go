@@ -0,0 +1,54 @@
+package job
+
+import (
+	"strconv"
+
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/web/service"
+)
+
+type RealityMonitorJob struct {
+	inboundService service.InboundService
+	settingService service.SettingService
+	auditService   service.AuditService
+	xrayService    service.XrayService
+	tgbotService   service.Tgbot
+}
+
+func NewRealityMonitorJob() *RealityMonitorJob {
+	return new(RealityMonitorJob)
+}
+
+// Here Run is an interface method of the Job interface
+func (j *RealityMonitorJob) Run() {
+	failures, err := j.settingService.GetRealityCheckFailures()
+	if err != nil || failures < 1 {
+		failures = 3
+	}
+	failed, needRestart, err := j.inboundService.CheckRealityDests(failures)
+	if err != nil {
+		logger.Warning("check reality dests failed:", err)
+	}
+	for _, failure := range failed {
+		logger.Warningf("reality dest %s of inbound %s failed %d checks in a row: %s", failure.Dest, failure.Tag, failure.Failures, failure.Error)
+		if failure.Fallback != "" {
+			logger.Infof("inbound %s switched from reality dest %s to %s", failure.Tag, failure.Dest, failure.Fallback)
+			j.auditService.Record(&model.AuditLog{
+				Actor:      "system",
+				Action:     "inbound.realityDest",
+				EntityType: "inbound",
+				EntityId:   strconv.Itoa(failure.InboundId),
+				Success:    true,
+				Diff: service.AuditDiff(map[string]any{"dest": failure.Dest}, map[string]any{
+					"dest":   failure.Fallback,
+					"reason": "health check",
+				}),
+			})
+		}
+		j.tgbotService.RealityDestFailed(failure)
+	}
+	if needRestart {
+		j.xrayService.SetToNeedRestart()
+	}
+}
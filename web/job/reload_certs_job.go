@@ -0,0 +1,19 @@
+package job
+
+import (
+	"x-ui/web/service"
+)
+
+// ReloadCertsJob reloads the certificates of the panel, of the subscriptions
+// and of the inbounds whose files changed, a renewal by certbot say.
+type ReloadCertsJob struct {
+	certReloadService service.CertReloadService
+}
+
+func NewReloadCertsJob() *ReloadCertsJob {
+	return new(ReloadCertsJob)
+}
+
+func (j *ReloadCertsJob) Run() {
+	j.certReloadService.Reload(false)
+}
@@ -0,0 +1,22 @@
+package job
+
+import (
+	"x-ui/logger"
+	"x-ui/web/service"
+)
+
+// RenewAcmeJob issues the ACME certificates of the settings that are missing
+// and renews those close to their expiry.
+type RenewAcmeJob struct {
+	acmeService service.AcmeService
+}
+
+func NewRenewAcmeJob() *RenewAcmeJob {
+	return new(RenewAcmeJob)
+}
+
+func (j *RenewAcmeJob) Run() {
+	if err := j.acmeService.RenewDue(); err != nil {
+		logger.Warning("renew ACME certificates failed:", err)
+	}
+}
@@ -0,0 +1,36 @@
+package job
+
+import (
+	"x-ui/logger"
+	"x-ui/web/service"
+)
+
+type ResetClientTrafficJob struct {
+	settingService service.SettingService
+	inboundService service.InboundService
+	xrayService    service.XrayService
+}
+
+func NewResetClientTrafficJob() *ResetClientTrafficJob {
+	return new(ResetClientTrafficJob)
+}
+
+// Here Run is an interface method of the Job interface
+func (j *ResetClientTrafficJob) Run() {
+	archive, err := j.settingService.GetTrafficResetHistory()
+	if err != nil {
+		logger.Warning("get traffic reset history setting failed:", err)
+		return
+	}
+	count, needRestart, err := j.inboundService.ResetScheduledTraffics(archive)
+	if err != nil {
+		logger.Warning("reset scheduled client traffics failed:", err)
+		return
+	}
+	if count > 0 {
+		logger.Infof("reset the traffic of %d clients by their reset policy", count)
+	}
+	if needRestart {
+		j.xrayService.SetToNeedRestart()
+	}
+}
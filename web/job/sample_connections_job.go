@@ -0,0 +1,30 @@
+package job
+
+import (
+	"x-ui/logger"
+	"x-ui/web/service"
+)
+
+// SampleConnectionsJob counts the connections to the inbounds for the API. A
+// failure is only logged when it differs from the last one, a missing
+// connection tracking would be logged on every run otherwise.
+type SampleConnectionsJob struct {
+	xrayService service.XrayService
+	lastErr     string
+}
+
+func NewSampleConnectionsJob() *SampleConnectionsJob {
+	return new(SampleConnectionsJob)
+}
+
+func (j *SampleConnectionsJob) Run() {
+	err := j.xrayService.SampleConnections()
+	if err == nil {
+		j.lastErr = ""
+		return
+	}
+	if err.Error() != j.lastErr {
+		j.lastErr = err.Error()
+		logger.Warning("sample connections failed:", err)
+	}
+}
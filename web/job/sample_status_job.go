@@ -0,0 +1,22 @@
+package job
+
+import (
+	"time"
+
+	"x-ui/web/service"
+)
+
+// SampleStatusJob takes the status of the server for the dashboard and the
+// status history.
+type SampleStatusJob struct {
+	serverService service.ServerService
+	interval      time.Duration
+}
+
+func NewSampleStatusJob(interval time.Duration) *SampleStatusJob {
+	return &SampleStatusJob{interval: interval}
+}
+
+func (j *SampleStatusJob) Run() {
+	j.serverService.SampleStatus(j.interval)
+}
@@ -0,0 +1,19 @@
+package job
+
+import (
+	"x-ui/web/service"
+)
+
+// SecurityAlertJob tells the Telegram admins about the critical findings of
+// the security report, the ones they were not told about yet.
+type SecurityAlertJob struct {
+	securityService service.SecurityService
+}
+
+func NewSecurityAlertJob() *SecurityAlertJob {
+	return new(SecurityAlertJob)
+}
+
+func (j *SecurityAlertJob) Run() {
+	j.securityService.AlertCritical()
+}
@@ -0,0 +1,21 @@
+package job
+
+import (
+	"x-ui/logger"
+	"x-ui/web/service"
+)
+
+type SubAccessJob struct {
+	subAccessService service.SubAccessService
+}
+
+func NewSubAccessJob() *SubAccessJob {
+	return new(SubAccessJob)
+}
+
+// Here Run is an interface method of the Job interface
+func (j *SubAccessJob) Run() {
+	if err := j.subAccessService.Flush(); err != nil {
+		logger.Warning("save subscription fetches failed:", err)
+	}
+}
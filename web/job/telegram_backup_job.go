@@ -0,0 +1,18 @@
+package job
+
+import (
+	"x-ui/web/service"
+)
+
+type TelegramBackupJob struct {
+	tgbotService service.Tgbot
+}
+
+func NewTelegramBackupJob() *TelegramBackupJob {
+	return new(TelegramBackupJob)
+}
+
+// Here Run is an interface method of the Job interface
+func (j *TelegramBackupJob) Run() {
+	j.tgbotService.SendScheduledBackup()
+}
@@ -0,0 +1,28 @@
+package job
+
+import (
+	"x-ui/logger"
+	"x-ui/web/service"
+)
+
+type UpdateGeodataJob struct {
+	geodataService service.GeodataService
+	tgbotService   service.Tgbot
+}
+
+func NewUpdateGeodataJob() *UpdateGeodataJob {
+	return new(UpdateGeodataJob)
+}
+
+// Here Run is an interface method of the Job interface
+func (j *UpdateGeodataJob) Run() {
+	status, err := j.geodataService.Update()
+	if err != nil {
+		logger.Warning("update geodata failed:", err)
+		j.tgbotService.GeodataUpdateFailed(err)
+		return
+	}
+	if status.Restarted {
+		logger.Info("geodata updated, xray restarted")
+	}
+}
@@ -0,0 +1,18 @@
+package job
+
+import (
+	"x-ui/web/service"
+)
+
+type WebhookJob struct {
+	webhookService service.WebhookService
+}
+
+func NewWebhookJob() *WebhookJob {
+	return new(WebhookJob)
+}
+
+// Here Run is an interface method of the Job interface
+func (j *WebhookJob) Run() {
+	j.webhookService.Deliver()
+}
@@ -10,10 +10,10 @@ import (
 )
 
 type XrayTrafficJob struct {
-	settingService  service.SettingService
-	xrayService     service.XrayService
-	inboundService  service.InboundService
-	outboundService service.OutboundService
+	settingService service.SettingService
+	xrayService    service.XrayService
+	inboundService service.InboundService
+	tgbotService   service.Tgbot
 }
 
 func NewXrayTrafficJob() *XrayTrafficJob {
@@ -24,28 +24,39 @@ func (j *XrayTrafficJob) Run() {
 	if !j.xrayService.IsXrayRunning() {
 		return
 	}
-	traffics, clientTraffics, err := j.xrayService.GetXrayTraffic()
+	traffics, clientTraffics, counters, err := j.xrayService.GetXrayTraffic()
 	if err != nil {
 		return
 	}
-	err, needRestart0 := j.inboundService.AddTraffic(traffics, clientTraffics)
+	err, needRestart := j.inboundService.AddTraffic(traffics, clientTraffics, counters)
 	if err != nil {
-		logger.Warning("add inbound traffic failed:", err)
-	}
-	err, needRestart1 := j.outboundService.AddTraffic(traffics, clientTraffics)
-	if err != nil {
-		logger.Warning("add outbound traffic failed:", err)
+		// The traffic stays pending, it is written with the next run
+		logger.Warning("add traffic failed:", err)
 	}
+	j.notifyThresholds()
 	if ExternalTrafficInformEnable, err := j.settingService.GetExternalTrafficInformEnable(); ExternalTrafficInformEnable {
 		j.informTrafficToExternalAPI(traffics, clientTraffics)
 	} else if err != nil {
 		logger.Warning("get ExternalTrafficInformEnable failed:", err)
 	}
-	if needRestart0 || needRestart1 {
+	if needRestart {
 		j.xrayService.SetToNeedRestart()
 	}
 }
 
+// notifyThresholds notifies the clients that crossed a traffic or expiry
+// notification threshold.
+func (j *XrayTrafficJob) notifyThresholds() {
+	crossings, err := j.inboundService.CheckNotifyThresholds()
+	if err != nil {
+		logger.Warning("check notification thresholds failed:", err)
+		return
+	}
+	for i := range crossings {
+		j.tgbotService.NotifyThreshold(&crossings[i])
+	}
+}
+
 func (j *XrayTrafficJob) informTrafficToExternalAPI(inboundTraffics []*xray.Traffic, clientTraffics []*xray.ClientTraffic) {
 	informURL, err := j.settingService.GetExternalTrafficInformURI()
 	if err != nil {
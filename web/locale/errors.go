@@ -0,0 +1,185 @@
+package locale
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nicksnyder/go-i18n/v2/i18n"
+)
+
+// ErrorCode identifies an API error. Codes are part of the API and never
+// translated, so scripts can match on them; the messages are in the [errors]
+// section of the translation files.
+type ErrorCode string
+
+const (
+	ErrInternal             ErrorCode = "internal_error"
+	ErrInvalidRequest       ErrorCode = "invalid_request"
+	ErrInvalidCreds         ErrorCode = "invalid_credentials"
+	ErrSessionExpired       ErrorCode = "session_expired"
+	ErrSessionIdle          ErrorCode = "session_idle_timeout"
+	ErrSessionLifetime      ErrorCode = "session_lifetime_exceeded"
+	ErrSessionLimit         ErrorCode = "session_limit_reached"
+	ErrInvalidApiToken      ErrorCode = "invalid_api_token"
+	ErrReadOnlyApiToken     ErrorCode = "read_only_api_token"
+	ErrSessionRequired      ErrorCode = "session_required"
+	ErrForbidden            ErrorCode = "forbidden"
+	ErrTooManyRequests      ErrorCode = "too_many_requests"
+	ErrAccountLocked        ErrorCode = "account_locked"
+	ErrCaptchaRequired      ErrorCode = "captcha_required"
+	ErrCaptchaFailed        ErrorCode = "captcha_failed"
+	ErrRequestTooLarge      ErrorCode = "request_too_large"
+	ErrMaintenance          ErrorCode = "maintenance"
+	ErrInboundPortInUse     ErrorCode = "inbound_port_in_use"
+	ErrClientEmailInUse     ErrorCode = "client_email_in_use"
+	ErrClientEmailInInbound ErrorCode = "client_email_in_inbound"
+	ErrNotFound             ErrorCode = "not_found"
+	ErrRequestFailed        ErrorCode = "request_failed"
+	ErrChangesetOpen        ErrorCode = "changeset_open"
+	ErrChangesetNotOpen     ErrorCode = "changeset_not_open"
+	ErrSetupRequired        ErrorCode = "setup_required"
+	ErrSetupDone            ErrorCode = "setup_done"
+	ErrInboundMaxClients    ErrorCode = "inbound_max_clients"
+	ErrInboundMaxTotalGB    ErrorCode = "inbound_max_total_gb"
+	ErrInboundMaxExpiry     ErrorCode = "inbound_max_expiry_days"
+	ErrInboundUnlimited     ErrorCode = "inbound_unlimited_client"
+	ErrShareGone            ErrorCode = "share_link_gone"
+	ErrClientNotFound       ErrorCode = "client_not_found"
+	ErrClientRenewInvalid   ErrorCode = "client_renew_invalid"
+	ErrClientInInbounds     ErrorCode = "client_in_inbounds"
+	ErrIdempotencyKeyUsed   ErrorCode = "idempotency_key_used"
+)
+
+// fallbackBundle renders the English messages before InitLocalizer
+var fallbackBundle = i18n.NewBundle(defaultLanguage)
+
+// errorMessages are the English messages, used when the translations are not
+// loaded, e.g. on the subscription server.
+var errorMessages = map[ErrorCode]string{
+	ErrInternal:             "Something went wrong",
+	ErrInvalidRequest:       "The Input data format is invalid.",
+	ErrInvalidCreds:         "Invalid username or password or two-factor code.",
+	ErrSessionExpired:       "Your session has expired, please log in again",
+	ErrSessionIdle:          "You were logged out after {{ .Minutes }} minutes of inactivity, please log in again",
+	ErrSessionLifetime:      "Your session reached its maximum duration of {{ .Minutes }} minutes, please log in again",
+	ErrSessionLimit:         "You already have {{ .Max }} sessions, the most allowed; log out of one of them first",
+	ErrInvalidApiToken:      "Invalid or expired API token",
+	ErrReadOnlyApiToken:     "This API token is read-only",
+	ErrSessionRequired:      "This action requires logging in to the panel",
+	ErrForbidden:            "Your role does not allow this action",
+	ErrTooManyRequests:      "Too many login attempts. Please try again later.",
+	ErrAccountLocked:        "This account is temporarily locked for your IP address after too many failed logins. Please try again later.",
+	ErrCaptchaRequired:      "Please solve the challenge to log in.",
+	ErrCaptchaFailed:        "The challenge was not solved, please try again.",
+	ErrRequestTooLarge:      "Request body exceeds the limit of {{ .Limit }}",
+	ErrMaintenance:          "The service is under maintenance, please try again later.",
+	ErrInboundPortInUse:     "Port {{ .Port }} is already used by another inbound",
+	ErrClientEmailInUse:     "Email {{ .Email }} is already used by another client",
+	ErrClientEmailInInbound: "Email {{ .Email }} is already used by a client of inbound {{ .Inbound }} (ID {{ .Id }})",
+	ErrNotFound:             "The requested item does not exist",
+	ErrRequestFailed:        "The request could not be completed",
+	ErrChangesetOpen:        "Changeset {{ .Name }} ({{ .Id }}) is open: changes to the inbounds and clients are rejected unless they carry its ID in the X-Changeset-Id header or the changeset query parameter, until it is committed or discarded",
+	ErrChangesetNotOpen:     "Changeset {{ .Id }} is not open",
+	ErrSetupRequired:        "The panel is not set up yet, finish its setup at {{ .Path }} first",
+	ErrSetupDone:            "The panel is already set up, it can only be set up again after \"x-ui setup -reset\"",
+	ErrInboundMaxClients:    "Inbound {{ .Inbound }} takes at most {{ .Max }} clients, it has {{ .Usage }} and would have {{ .Requested }}",
+	ErrInboundMaxTotalGB:    "The clients of inbound {{ .Inbound }} may be assigned at most {{ .Max }} GB in total, they have {{ .Usage }} GB and would have {{ .Requested }} GB",
+	ErrInboundMaxExpiry:     "The clients of inbound {{ .Inbound }} may expire at most {{ .Max }} days ahead, {{ .Email }} would expire in {{ .Requested }} days",
+	ErrInboundUnlimited:     "Inbound {{ .Inbound }} does not allow clients without a traffic limit or an expiry, like {{ .Email }}",
+	ErrShareGone:            "This link has expired or was revoked, ask for a new one",
+	ErrClientNotFound:       "Client {{ .Email }} does not exist",
+	ErrClientRenewInvalid:   "A renewal takes 1 to 3650 days and can't take traffic away",
+	ErrClientInInbounds:     "Client {{ .Email }} is in {{ .Count }} inbounds, renew them all with allInbounds",
+	ErrIdempotencyKeyUsed:   "The idempotency key was already used for another client",
+}
+
+// Error is an error with a code, for errors that reach the API. Params fill in
+// the message, as "Name==value" like the other translations.
+type Error struct {
+	Code   ErrorCode
+	Params []string
+}
+
+func NewError(code ErrorCode, params ...string) *Error {
+	return &Error{Code: code, Params: params}
+}
+
+// Error returns the English message, for the logs.
+func (e *Error) Error() string {
+	return e.Code.localize(nil, e.Params...)
+}
+
+// CodeOf returns the code of err, if it is or wraps an *Error.
+func CodeOf(err error) (*Error, bool) {
+	var coded *Error
+	if errors.As(err, &coded) {
+		return coded, true
+	}
+	return nil, false
+}
+
+// RequestLanguages returns the languages a request asks for, in order: the
+// "lang" query parameter, the cookie set by the panel and Accept-Language.
+func RequestLanguages(c *gin.Context) []string {
+	var langs []string
+	if lang := c.Query("lang"); lang != "" {
+		langs = append(langs, strings.ReplaceAll(lang, "_", "-"))
+	}
+	if cookie, err := c.Request.Cookie("lang"); err == nil && cookie.Value != "" {
+		langs = append(langs, cookie.Value)
+	}
+	if accept := c.GetHeader("Accept-Language"); accept != "" {
+		langs = append(langs, accept)
+	}
+	return langs
+}
+
+// Message returns the message of code in the language of the request, English
+// if there is no translation for it.
+func (code ErrorCode) Message(c *gin.Context, params ...string) string {
+	return code.localize(RequestLanguages(c), params...)
+}
+
+func (code ErrorCode) localize(langs []string, params ...string) string {
+	defaultMessage, ok := errorMessages[code]
+	if !ok {
+		defaultMessage = errorMessages[ErrInternal]
+	}
+	message := &i18n.Message{ID: "errors." + string(code), Other: defaultMessage}
+	templateData := createTemplateData(params)
+	bundle := i18nBundle
+	if bundle == nil {
+		bundle = fallbackBundle
+	}
+	msg, err := i18n.NewLocalizer(bundle, langs...).Localize(&i18n.LocalizeConfig{
+		DefaultMessage: message,
+		TemplateData:   templateData,
+	})
+	if err != nil && msg == "" {
+		return defaultMessage
+	}
+	return msg
+}
+
+// ErrorResponse is the body of an API error. It extends the usual
+// success/msg/obj reply with the error code and the request ID.
+type ErrorResponse struct {
+	Success   bool      `json:"success"`
+	Msg       string    `json:"msg"`
+	Code      ErrorCode `json:"code"`
+	Obj       any       `json:"obj"`
+	RequestId string    `json:"requestId,omitempty"`
+}
+
+// ErrorJSON replies with the error code and its message, localized for the
+// request. It doesn't abort the request.
+func ErrorJSON(c *gin.Context, status int, code ErrorCode, obj any, params ...string) {
+	c.JSON(status, ErrorResponse{
+		Success:   false,
+		Msg:       code.Message(c, params...),
+		Code:      code,
+		Obj:       obj,
+		RequestId: c.Writer.Header().Get("X-Request-Id"),
+	})
+}
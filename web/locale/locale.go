@@ -13,6 +13,8 @@ import (
 	"golang.org/x/text/language"
 )
 
+var defaultLanguage = language.MustParse("en-US")
+
 var (
 	i18nBundle   *i18n.Bundle
 	LocalizerWeb *i18n.Localizer
@@ -32,7 +34,7 @@ type SettingService interface {
 
 func InitLocalizer(i18nFS embed.FS, settingService SettingService) error {
 	// set default bundle to english
-	i18nBundle = i18n.NewBundle(language.MustParse("en-US"))
+	i18nBundle = i18n.NewBundle(defaultLanguage)
 	i18nBundle.RegisterUnmarshalFunc("toml", toml.Unmarshal)
 
 	// parse files
@@ -102,15 +104,7 @@ func initTGBotLocalizer(settingService SettingService) error {
 
 func LocalizerMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		var lang string
-
-		if cookie, err := c.Request.Cookie("lang"); err == nil {
-			lang = cookie.Value
-		} else {
-			lang = c.GetHeader("Accept-Language")
-		}
-
-		LocalizerWeb = i18n.NewLocalizer(i18nBundle, lang)
+		LocalizerWeb = i18n.NewLocalizer(i18nBundle, RequestLanguages(c)...)
 
 		c.Set("localizer", LocalizerWeb)
 		c.Set("I18n", I18n)
@@ -143,3 +137,19 @@ func parseTranslationFiles(i18nFS embed.FS, i18nBundle *i18n.Bundle) error {
 
 	return nil
 }
+
+// Localize returns the message of key in the first of langs it is translated
+// to, English if none, or "" if the translations are not loaded.
+func Localize(langs []string, key string, params ...string) string {
+	if i18nBundle == nil {
+		return ""
+	}
+	msg, err := i18n.NewLocalizer(i18nBundle, langs...).Localize(&i18n.LocalizeConfig{
+		MessageID:    key,
+		TemplateData: createTemplateData(params),
+	})
+	if err != nil && msg == "" {
+		logger.Warningf("Failed to localize message %s: %v", key, err)
+	}
+	return msg
+}
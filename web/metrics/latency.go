@@ -0,0 +1,97 @@
+package metrics
+
+import (
+	"io"
+	"math"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencySamples is how many of the last durations of a route its quantiles
+// are computed from.
+const latencySamples = 512
+
+// latencyQuantiles are the quantiles of the last durations of each route.
+var latencyQuantiles = []float64{0.5, 0.95, 0.99}
+
+// latencyRing keeps the last durations of a route, written over in turn.
+type latencyRing struct {
+	next    atomic.Uint64
+	samples [latencySamples]atomic.Int64
+}
+
+var (
+	// latencies has a latencyRing by durationKey. The routes are known after
+	// the first requests, so a request only reads it.
+	latencies sync.Map
+
+	flushContentions atomic.Uint64
+)
+
+// ObserveLatency keeps d among the last durations of the route, for its
+// rolling quantiles. It takes no lock.
+func ObserveLatency(method, route string, d time.Duration) {
+	key := durationKey{method, route}
+	ring, ok := latencies.Load(key)
+	if !ok {
+		ring, _ = latencies.LoadOrStore(key, &latencyRing{})
+	}
+	r := ring.(*latencyRing)
+	i := r.next.Add(1) - 1
+	r.samples[i%latencySamples].Store(int64(d))
+}
+
+// IncFlushContention counts a traffic flush that had to wait for another one.
+func IncFlushContention() {
+	flushContentions.Add(1)
+}
+
+// FlushContentions returns how many traffic flushes had to wait for another
+// one since the panel started.
+func FlushContentions() uint64 {
+	return flushContentions.Load()
+}
+
+// WriteLatency renders the rolling quantiles of the durations of each route
+// and the contentions of the traffic flushes.
+func WriteLatency(w io.Writer) {
+	var keys []durationKey
+	latencies.Range(func(key, _ any) bool {
+		keys = append(keys, key.(durationKey))
+		return true
+	})
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].route != keys[j].route {
+			return keys[i].route < keys[j].route
+		}
+		return keys[i].method < keys[j].method
+	})
+
+	WriteHeader(w, "xui_http_request_duration_recent_seconds", "Quantiles of the last "+formatFloat(latencySamples)+" request durations of each route.", "gauge")
+	samples := make([]int64, 0, latencySamples)
+	for _, key := range keys {
+		ring, _ := latencies.Load(key)
+		r := ring.(*latencyRing)
+		n := min(r.next.Load(), latencySamples)
+		samples = samples[:0]
+		for i := range n {
+			samples = append(samples, r.samples[i].Load())
+		}
+		if len(samples) == 0 {
+			continue
+		}
+		slices.Sort(samples)
+		for _, q := range latencyQuantiles {
+			rank := max(int(math.Ceil(float64(len(samples))*q))-1, 0)
+			WriteSample(w, "xui_http_request_duration_recent_seconds",
+				Labels{"method", key.method, "route", key.route, "quantile", formatFloat(q)},
+				time.Duration(samples[rank]).Seconds())
+		}
+	}
+
+	WriteHeader(w, "xui_traffic_flush_contentions_total", "Traffic flushes that had to wait for another one.", "counter")
+	WriteSample(w, "xui_traffic_flush_contentions_total", nil, float64(FlushContentions()))
+}
@@ -0,0 +1,74 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// latencyQuantile returns the value of the quantile q of the durations of the
+// route in the output of WriteLatency, or "" if it has none.
+func latencyQuantile(output string, method string, route string, q string) string {
+	prefix := `xui_http_request_duration_recent_seconds{method="` + method + `",route="` + route + `",quantile="` + q + `"} `
+	for _, line := range strings.Split(output, "\n") {
+		if value, ok := strings.CutPrefix(line, prefix); ok {
+			return value
+		}
+	}
+	return ""
+}
+
+func TestLatencyQuantiles(t *testing.T) {
+	tests := []struct {
+		name      string
+		durations func(i int) time.Duration
+		count     int
+		want      map[string]string
+	}{
+		{"one sample", func(int) time.Duration { return 3 * time.Millisecond }, 1,
+			map[string]string{"0.5": "0.003", "0.95": "0.003", "0.99": "0.003"}},
+		{"a hundred samples", func(i int) time.Duration { return time.Duration(i+1) * time.Millisecond }, 100,
+			map[string]string{"0.5": "0.05", "0.95": "0.095", "0.99": "0.099"}},
+		{"full ring", func(i int) time.Duration { return time.Duration(i+1) * time.Millisecond }, latencySamples,
+			map[string]string{"0.5": "0.256", "0.95": "0.487", "0.99": "0.507"}},
+		// Only the last samples count, the slow ones before them rolled out
+		{"rolled over", func(i int) time.Duration {
+			if i < latencySamples {
+				return time.Second
+			}
+			return time.Millisecond
+		}, 2 * latencySamples, map[string]string{"0.5": "0.001", "0.95": "0.001", "0.99": "0.001"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			route := "/test/" + test.name
+			for i := range test.count {
+				ObserveLatency("GET", route, test.durations(i))
+			}
+			var output strings.Builder
+			WriteLatency(&output)
+			for q, want := range test.want {
+				if got := latencyQuantile(output.String(), "GET", route, q); got != want {
+					t.Errorf("the quantile %s is %q, want %q", q, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLatencyByRoute(t *testing.T) {
+	ObserveLatency("GET", "/test/fast", time.Millisecond)
+	ObserveLatency("POST", "/test/fast", time.Second)
+	ObserveLatency("GET", "/test/slow", 2*time.Second)
+	var output strings.Builder
+	WriteLatency(&output)
+	for _, test := range []struct{ method, route, want string }{
+		{"GET", "/test/fast", "0.001"},
+		{"POST", "/test/fast", "1"},
+		{"GET", "/test/slow", "2"},
+	} {
+		if got := latencyQuantile(output.String(), test.method, test.route, "0.5"); got != test.want {
+			t.Errorf("%s %s has the median %q, want %q", test.method, test.route, got, test.want)
+		}
+	}
+}
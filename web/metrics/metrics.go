@@ -0,0 +1,198 @@
+// Package metrics keeps the panel's own counters and renders them, together with
+// values collected at scrape time, in the Prometheus text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// durationBuckets are the upper bounds (seconds) of the request duration histogram.
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type requestKey struct {
+	method string
+	route  string
+	status string
+}
+
+type durationKey struct {
+	method string
+	route  string
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+var (
+	mu        sync.Mutex
+	requests  = map[requestKey]uint64{}
+	durations = map[durationKey]*histogram{}
+	panics    uint64
+
+	subCacheHits   uint64
+	subCacheMisses uint64
+)
+
+// ObserveRequest records a finished HTTP request. route should be the matched
+// route template rather than the raw path to keep cardinality bounded.
+func ObserveRequest(method, route string, status int, d time.Duration) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	requests[requestKey{method, route, strconv.Itoa(status)}]++
+
+	dk := durationKey{method, route}
+	h, ok := durations[dk]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(durationBuckets))}
+		durations[dk] = h
+	}
+	sec := d.Seconds()
+	for i, bound := range durationBuckets {
+		if sec <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += sec
+	h.count++
+}
+
+// IncPanics increments the recovered panic counter.
+func IncPanics() {
+	mu.Lock()
+	panics++
+	mu.Unlock()
+}
+
+// ObserveSubCache records a subscription request answered from the cache when
+// hit, or built.
+func ObserveSubCache(hit bool) {
+	mu.Lock()
+	if hit {
+		subCacheHits++
+	} else {
+		subCacheMisses++
+	}
+	mu.Unlock()
+}
+
+// WriteSubCache renders the hits and misses of the subscription cache.
+func WriteSubCache(w io.Writer) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	WriteHeader(w, "xui_sub_cache_hits_total", "Subscription requests answered from the cache.", "counter")
+	WriteSample(w, "xui_sub_cache_hits_total", nil, float64(subCacheHits))
+	WriteHeader(w, "xui_sub_cache_misses_total", "Subscription requests the subscription was built for.", "counter")
+	WriteSample(w, "xui_sub_cache_misses_total", nil, float64(subCacheMisses))
+}
+
+// WriteHTTP renders the request, duration and panic metrics.
+func WriteHTTP(w io.Writer) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	WriteHeader(w, "xui_http_requests_total", "Total number of HTTP requests handled by the panel.", "counter")
+	rkeys := make([]requestKey, 0, len(requests))
+	for k := range requests {
+		rkeys = append(rkeys, k)
+	}
+	sort.Slice(rkeys, func(i, j int) bool {
+		a, b := rkeys[i], rkeys[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.status < b.status
+	})
+	for _, k := range rkeys {
+		WriteSample(w, "xui_http_requests_total", Labels{"method", k.method, "route", k.route, "status", k.status}, float64(requests[k]))
+	}
+
+	WriteHeader(w, "xui_http_request_duration_seconds", "HTTP request latency of the panel.", "histogram")
+	dkeys := make([]durationKey, 0, len(durations))
+	for k := range durations {
+		dkeys = append(dkeys, k)
+	}
+	sort.Slice(dkeys, func(i, j int) bool {
+		if dkeys[i].route != dkeys[j].route {
+			return dkeys[i].route < dkeys[j].route
+		}
+		return dkeys[i].method < dkeys[j].method
+	})
+	for _, k := range dkeys {
+		h := durations[k]
+		for i, bound := range durationBuckets {
+			WriteSample(w, "xui_http_request_duration_seconds_bucket",
+				Labels{"method", k.method, "route", k.route, "le", formatFloat(bound)}, float64(h.counts[i]))
+		}
+		WriteSample(w, "xui_http_request_duration_seconds_bucket",
+			Labels{"method", k.method, "route", k.route, "le", "+Inf"}, float64(h.count))
+		WriteSample(w, "xui_http_request_duration_seconds_sum", Labels{"method", k.method, "route", k.route}, h.sum)
+		WriteSample(w, "xui_http_request_duration_seconds_count", Labels{"method", k.method, "route", k.route}, float64(h.count))
+	}
+
+	WriteHeader(w, "xui_panics_total", "Total number of recovered panics in panel handlers.", "counter")
+	WriteSample(w, "xui_panics_total", nil, float64(panics))
+}
+
+// Labels is a flat list of label name/value pairs.
+type Labels []string
+
+// WriteHeader writes the HELP and TYPE lines of a metric family.
+func WriteHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// WriteSample writes a single sample line.
+func WriteSample(w io.Writer, name string, labels Labels, value float64) {
+	var b strings.Builder
+	b.WriteString(name)
+	if len(labels) > 1 {
+		b.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(labels[i])
+			b.WriteString(`="`)
+			b.WriteString(escapeLabel(labels[i+1]))
+			b.WriteByte('"')
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte(' ')
+	b.WriteString(formatFloat(value))
+	b.WriteByte('\n')
+	io.WriteString(w, b.String())
+}
+
+func escapeLabel(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, "\n", `\n`)
+	return strings.ReplaceAll(v, `"`, `\"`)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,127 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
+	"x-ui/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+const skipAccessLogKey = "skip_access_log"
+
+// SkipAccessLog keeps the request out of the access log, for frequent probes
+// that would drown out everything else.
+func SkipAccessLog(c *gin.Context) {
+	c.Set(skipAccessLogKey, true)
+}
+
+// AccessLog writes one line per request to w. Requests whose path (relative to
+// basePath) starts with one of the excluded prefixes are not logged. The line is
+// a JSON object written by log/slog when the panel log format is json, with the
+// level of the status, plain text otherwise.
+func AccessLog(w io.Writer, basePath string, excluded []string) gin.HandlerFunc {
+	jsonHandler := logger.NewJSONHandler(w)
+	return func(c *gin.Context) {
+		start := time.Now()
+		path := c.Request.URL.Path
+
+		c.Next()
+
+		if c.GetBool(skipAccessLogKey) {
+			return
+		}
+		rel := strings.TrimPrefix(path, strings.TrimSuffix(basePath, "/"))
+		rel = strings.TrimPrefix(rel, "/")
+		for _, prefix := range excluded {
+			if prefix != "" && strings.HasPrefix(rel, strings.TrimPrefix(prefix, "/")) {
+				return
+			}
+		}
+
+		entry := accessLogEntry{
+			Time:       start,
+			RequestID:  GetRequestID(c),
+			Method:     c.Request.Method,
+			Path:       RedactURL(c.Request.URL),
+			Status:     c.Writer.Status(),
+			Size:       max(c.Writer.Size(), 0),
+			DurationMs: float64(time.Since(start).Microseconds()) / 1000,
+			ClientIP:   ClientIP(c),
+			UserAgent:  c.Request.UserAgent(),
+			Actor:      GetActor(c),
+			Error:      c.Errors.ByType(gin.ErrorTypePrivate).String(),
+		}
+
+		if logger.IsJSON() {
+			if err := jsonHandler.Handle(context.Background(), entry.record()); err != nil {
+				logger.Debug("write access log failed:", err)
+			}
+			return
+		}
+		line := fmt.Sprintf("%s %s %s %s %d %d %.3fms %s %q %s\n",
+			entry.Time.UTC().Format(time.RFC3339), entry.ClientIP, entry.Method, entry.Path, entry.Status,
+			entry.Size, entry.DurationMs, orDash(entry.RequestID), entry.UserAgent, orDash(entry.Actor))
+		if _, err := io.WriteString(w, line); err != nil {
+			logger.Debug("write access log failed:", err)
+		}
+	}
+}
+
+type accessLogEntry struct {
+	Time       time.Time
+	RequestID  string
+	Method     string
+	Path       string
+	Status     int
+	Size       int
+	DurationMs float64
+	ClientIP   string
+	UserAgent  string
+	Actor      string
+	Error      string
+}
+
+// record returns the entry as a slog record of the time the request started,
+// leaving out the fields it doesn't have. Server errors are logged as errors,
+// client errors as warnings.
+func (e *accessLogEntry) record() slog.Record {
+	level := slog.LevelInfo
+	switch {
+	case e.Status >= 500:
+		level = slog.LevelError
+	case e.Status >= 400:
+		level = slog.LevelWarn
+	}
+	record := slog.NewRecord(e.Time, level, "request", 0)
+	optional := func(key string, value string) {
+		if value != "" {
+			record.AddAttrs(slog.String(key, value))
+		}
+	}
+	optional("requestId", e.RequestID)
+	record.AddAttrs(
+		slog.String("method", e.Method),
+		slog.String("path", e.Path),
+		slog.Int("status", e.Status),
+		slog.Int("size", e.Size),
+		slog.Float64("duration_ms", e.DurationMs),
+		slog.String("client_ip", e.ClientIP),
+	)
+	optional("user_agent", e.UserAgent)
+	optional("actor", e.Actor)
+	optional("error", e.Error)
+	return record
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
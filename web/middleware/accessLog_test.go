@@ -0,0 +1,178 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"x-ui/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// withJSONLogs switches the panel log to json for the test.
+func withJSONLogs(t *testing.T) {
+	logger.SetFormat("json")
+	t.Cleanup(func() { logger.SetFormat("text") })
+}
+
+func accessLogEngine(w *bytes.Buffer, excluded []string) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.Use(RequestID())
+	engine.Use(AccessLog(w, "/base/", excluded))
+	engine.GET("/base/ok", func(c *gin.Context) { c.String(http.StatusOK, "ok") })
+	engine.GET("/base/missing", func(c *gin.Context) { c.Status(http.StatusNotFound) })
+	engine.GET("/base/fail", func(c *gin.Context) {
+		SetActor(c, "admin")
+		_ = c.Error(http.ErrNotSupported)
+		c.Status(http.StatusInternalServerError)
+	})
+	engine.GET("/base/assets/app.js", func(c *gin.Context) { c.Status(http.StatusOK) })
+	return engine
+}
+
+func serve(engine *gin.Engine, target string) {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	req.Header.Set("User-Agent", "test-agent")
+	engine.ServeHTTP(httptest.NewRecorder(), req)
+}
+
+func TestAccessLogJSON(t *testing.T) {
+	withJSONLogs(t)
+	var buf bytes.Buffer
+	engine := accessLogEngine(&buf, nil)
+	serve(engine, "/base/ok?token=s3cr3t&page=1")
+	serve(engine, "/base/missing")
+	serve(engine, "/base/fail")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("got %d lines, want 3:\n%s", len(lines), buf.String())
+	}
+	wantLevels := []string{"INFO", "WARNING", "ERROR"}
+	for i, line := range lines {
+		var record map[string]any
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("line %d is not JSON: %v\n%s", i, err, line)
+		}
+		for _, key := range []string{"ts", "level", "requestId", "method", "path", "status", "duration_ms", "client_ip"} {
+			if _, ok := record[key]; !ok {
+				t.Errorf("line %d misses %q: %s", i, key, line)
+			}
+		}
+		if record["level"] != wantLevels[i] {
+			t.Errorf("line %d level = %v, want %s", i, record["level"], wantLevels[i])
+		}
+	}
+	if strings.Contains(buf.String(), "s3cr3t") {
+		t.Errorf("the token leaked into the access log: %s", lines[0])
+	}
+	var fail map[string]any
+	json.Unmarshal([]byte(lines[2]), &fail)
+	if fail["actor"] != "admin" || fail["error"] == nil || fail["status"] != float64(500) {
+		t.Errorf("the failed request is logged as %v", fail)
+	}
+}
+
+func TestAccessLogText(t *testing.T) {
+	var buf bytes.Buffer
+	engine := accessLogEngine(&buf, []string{"assets/"})
+	serve(engine, "/base/ok?password=s3cr3t")
+	serve(engine, "/base/assets/app.js")
+
+	line := strings.TrimSpace(buf.String())
+	if strings.Contains(line, "\n") {
+		t.Fatalf("an excluded path was logged:\n%s", buf.String())
+	}
+	if strings.HasPrefix(line, "{") {
+		t.Errorf("text mode wrote JSON: %s", line)
+	}
+	if !strings.Contains(line, " GET /base/ok?password="+redactedValue+" 200 ") || !strings.Contains(line, `"test-agent"`) {
+		t.Errorf("unexpected line: %s", line)
+	}
+}
+
+func TestAccessLogSkip(t *testing.T) {
+	var buf bytes.Buffer
+	engine := accessLogEngine(&buf, nil)
+	engine.GET("/base/probe", func(c *gin.Context) { SkipAccessLog(c) })
+	serve(engine, "/base/probe")
+	if buf.Len() != 0 {
+		t.Errorf("a skipped request was logged: %s", buf.String())
+	}
+}
+
+// scanJSONLines parses every line of data as a JSON object.
+func scanJSONLines(t *testing.T, data []byte) []map[string]any {
+	var records []map[string]any
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var record map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("not a JSON line: %v\n%s", err, scanner.Text())
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestAccessLogConcurrentRotation(t *testing.T) {
+	dir := t.TempDir()
+	file := &logger.RotatingFile{Path: filepath.Join(dir, "access.log"), MaxSize: 4096}
+	defer file.Close()
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.Use(RequestID())
+	engine.Use(AccessLog(file, "/", nil))
+	engine.GET("/ok", func(c *gin.Context) { c.String(http.StatusOK, "ok") })
+
+	const workers, requests = 16, 200
+	var wg sync.WaitGroup
+	for w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range requests {
+				serve(engine, fmt.Sprintf("/ok?worker=%d&i=%d", w, i))
+			}
+		}()
+	}
+	wg.Wait()
+	file.Close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "access*.log"))
+	if len(files) < 2 {
+		t.Fatalf("the log was not rotated: %v", files)
+	}
+	line := regexp.MustCompile(`^\S+ \S+ GET /ok\?worker=\d+&i=\d+ 200 2 \S+ms \S+ "test-agent" -$`)
+	seen := map[string]bool{}
+	for _, name := range files {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) > 0 && data[len(data)-1] != '\n' {
+			t.Errorf("%s ends with a partial line", name)
+		}
+		for _, l := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+			if !line.MatchString(l) {
+				t.Fatalf("partial or mixed line in %s: %q", name, l)
+			}
+			seen[strings.Fields(l)[3]] = true
+		}
+	}
+	if len(seen) != workers*requests {
+		t.Errorf("logged %d requests, want %d", len(seen), workers*requests)
+	}
+}
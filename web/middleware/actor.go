@@ -0,0 +1,16 @@
+package middleware
+
+import "github.com/gin-gonic/gin"
+
+const actorKey = "actor"
+
+// SetActor records who made the request when it isn't a session user, for
+// example "token:<name>" for API tokens, so the logs can attribute it.
+func SetActor(c *gin.Context, actor string) {
+	c.Set(actorKey, actor)
+}
+
+// GetActor returns the actor recorded with SetActor, or "".
+func GetActor(c *gin.Context) string {
+	return c.GetString(actorKey)
+}
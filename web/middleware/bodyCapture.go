@@ -0,0 +1,153 @@
+package middleware
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const bodyCaptureKey = "capturedBody"
+
+// BodyCaptureConfig is what of the request bodies is kept for the panic
+// records: the first Limit bytes of those of the routes under Prefix, a path
+// relative to BasePath. A limit of 0 keeps none.
+type BodyCaptureConfig struct {
+	BasePath string
+	Prefix   string
+	Limit    int
+}
+
+// capturedBody keeps a copy of the first bytes a handler reads of a body,
+// which it reads on as from the body itself.
+type capturedBody struct {
+	io.ReadCloser
+	data      []byte
+	truncated bool
+}
+
+func (b *capturedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		room := cap(b.data) - len(b.data)
+		if n > room {
+			b.truncated = true
+		}
+		b.data = append(b.data, p[:min(n, room)]...)
+	}
+	return n, err
+}
+
+// capturedTypes tells whether a body of contentType is text worth keeping;
+// multipart and binary bodies are not.
+func capturedTypes(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(mediaType, "text/"),
+		mediaType == "application/json",
+		strings.HasSuffix(mediaType, "+json"),
+		mediaType == "application/x-www-form-urlencoded":
+		return true
+	}
+	return false
+}
+
+// BodyCapture keeps the first bytes the handlers read of the bodies of the
+// routes of config, for RecoveryJSON to tell what a request that panicked
+// sent. The body reads on unchanged; the copy is made as it is read, into a
+// buffer of at most the limit.
+func BodyCapture(config BodyCaptureConfig) gin.HandlerFunc {
+	prefix := config.BasePath + strings.TrimPrefix(config.Prefix, "/")
+	return func(c *gin.Context) {
+		r := c.Request
+		if config.Limit <= 0 || r.Body == nil || r.Body == http.NoBody ||
+			!strings.HasPrefix(r.URL.Path, prefix) || !capturedTypes(r.Header.Get("Content-Type")) {
+			c.Next()
+			return
+		}
+		size := config.Limit
+		if r.ContentLength >= 0 && r.ContentLength < int64(size) {
+			size = int(r.ContentLength)
+		}
+		body := &capturedBody{ReadCloser: r.Body, data: make([]byte, 0, size), truncated: r.ContentLength > int64(size)}
+		r.Body = body
+		c.Set(bodyCaptureKey, body)
+		c.Next()
+	}
+}
+
+// sensitiveJSONValue matches the string or number values of the sensitive keys
+// of JSON, also inside a JSON string, where the quotes are escaped, and up to
+// the end of a body cut short.
+var sensitiveJSONValue = regexp.MustCompile(`(?i)((\\?)"(?:` + sensitiveKeyPattern() + `)\\?"\s*:\s*)(?:\\?"(?:[^"\\]|\\[^"])*(?:\\?")?|-?[0-9.eE+-]+)`)
+
+func sensitiveKeyPattern() string {
+	keys := make([]string, 0, len(sensitiveKeys))
+	for key := range sensitiveKeys {
+		keys = append(keys, regexp.QuoteMeta(key))
+	}
+	return strings.Join(keys, "|")
+}
+
+// redactJSONText redacts the values of the sensitive keys of JSON text at any
+// depth, without it having to be whole.
+func redactJSONText(text string) string {
+	return sensitiveJSONValue.ReplaceAllString(text, `$1$2"`+redactedValue+`$2"`)
+}
+
+// redactCapturedBody redacts a captured body of contentType. The fields of a
+// form are decoded, with the JSON in their values redacted as well.
+func redactCapturedBody(contentType string, body []byte) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType != "application/x-www-form-urlencoded" {
+		return redactJSONText(string(body))
+	}
+	fields := strings.Split(string(body), "&")
+	for i, field := range fields {
+		key, value, _ := strings.Cut(field, "=")
+		key, value = unescapeField(key), unescapeField(value)
+		if isSensitiveKey(key) {
+			value = redactedValue
+		}
+		fields[i] = key + "=" + redactJSONText(value)
+	}
+	return strings.Join(fields, "&")
+}
+
+// unescapeField decodes a field of a form, up to an escape cut short at the
+// end of a captured body.
+func unescapeField(field string) string {
+	if decoded, err := url.QueryUnescape(field); err == nil {
+		return decoded
+	}
+	if i := strings.LastIndex(field, "%"); i >= len(field)-2 {
+		if decoded, err := url.QueryUnescape(field[:i]); err == nil {
+			return decoded
+		}
+	}
+	return field
+}
+
+// capturedRequestBody returns what BodyCapture kept of the body of the
+// request, redacted, and whether the body went on past it.
+func capturedRequestBody(c *gin.Context) (string, bool) {
+	value, ok := c.Get(bodyCaptureKey)
+	if !ok {
+		return "", false
+	}
+	body := value.(*capturedBody)
+	if len(body.data) == 0 {
+		return "", false
+	}
+	return redactCapturedBody(c.Request.Header.Get("Content-Type"), body.data), body.truncated
+}
@@ -0,0 +1,159 @@
+package middleware
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// bodyCaptureEngine serves a handler on /panel/api/ and /other/ that reads
+// the whole body into read and panics, keeping limit bytes of the bodies of
+// the API.
+func bodyCaptureEngine(limit int, read *[]byte) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.Use(RecoveryJSON())
+	engine.Use(BodyCapture(BodyCaptureConfig{BasePath: "/", Prefix: "panel/api/", Limit: limit}))
+	handler := func(c *gin.Context) {
+		data, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			panic(err)
+		}
+		*read = data
+		panic("boom")
+	}
+	engine.POST("/panel/api/save", handler)
+	engine.POST("/other/save", handler)
+	return engine
+}
+
+// capturedPanic posts body of contentType to path and returns the panic it
+// recorded.
+func capturedPanic(t *testing.T, engine *gin.Engine, path string, contentType string, body string) PanicEvent {
+	t.Helper()
+	ClearPanics()
+	t.Cleanup(ClearPanics)
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	engine.ServeHTTP(httptest.NewRecorder(), req)
+	panics := RecentPanics()
+	if len(panics) != 1 {
+		t.Fatalf("%d panics were recorded, want 1", len(panics))
+	}
+	return panics[0]
+}
+
+func TestBodyCaptureTruncates(t *testing.T) {
+	var read []byte
+	engine := bodyCaptureEngine(16, &read)
+	body := `{"remark":"` + strings.Repeat("a", 100) + `"}`
+	event := capturedPanic(t, engine, "/panel/api/save", "application/json", body)
+	if string(read) != body {
+		t.Errorf("the handler read %d bytes, want the %d of the body", len(read), len(body))
+	}
+	if event.Body != body[:16] || !event.BodyTruncated {
+		t.Errorf("the record keeps %q, truncated %v, want %q cut short", event.Body, event.BodyTruncated, body[:16])
+	}
+
+	// A body within the limit is kept whole
+	event = capturedPanic(t, engine, "/panel/api/save", "application/json", `{"id":1}`)
+	if event.Body != `{"id":1}` || event.BodyTruncated {
+		t.Errorf("the record keeps %q, truncated %v", event.Body, event.BodyTruncated)
+	}
+}
+
+func TestBodyCaptureRedacts(t *testing.T) {
+	var read []byte
+	engine := bodyCaptureEngine(1024, &read)
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        string
+	}{
+		{"json", "application/json", `{"username":"admin","password":"s3cr3t"}`, `{"username":"admin","password":"` + redactedValue + `"}`},
+		{"nested json", "application/json; charset=utf-8", `{"settings":"{\"clients\":[{\"secret\":\"s3cr3t\"}]}"}`,
+			`{"settings":"{\"clients\":[{\"secret\":\"` + redactedValue + `\"}]}"}`},
+		{"form", "application/x-www-form-urlencoded", "username=admin&password=s3cr3t", "username=admin&password=" + redactedValue},
+		{"json in a form", "application/x-www-form-urlencoded", "settings=%7B%22token%22%3A%22s3cr3t%22%7D",
+			`settings={"token":"` + redactedValue + `"}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			event := capturedPanic(t, engine, "/panel/api/save", test.contentType, test.body)
+			if string(read) != test.body {
+				t.Errorf("the handler read %q, want %q", read, test.body)
+			}
+			if event.Body != test.want {
+				t.Errorf("the record keeps %q, want %q", event.Body, test.want)
+			}
+		})
+	}
+
+	// A secret cut short by the limit is redacted as well
+	engine = bodyCaptureEngine(24, &read)
+	event := capturedPanic(t, engine, "/panel/api/save", "application/json", `{"password":"s3cr3t-and-more"}`)
+	if strings.Contains(event.Body, "s3cr3t") || !event.BodyTruncated {
+		t.Errorf("the record keeps %q, truncated %v", event.Body, event.BodyTruncated)
+	}
+}
+
+func TestBodyCaptureSkips(t *testing.T) {
+	var read []byte
+	tests := []struct {
+		name        string
+		limit       int
+		path        string
+		contentType string
+	}{
+		{"disabled", 0, "/panel/api/save", "application/json"},
+		{"other route", 1024, "/other/save", "application/json"},
+		{"multipart", 1024, "/panel/api/save", "multipart/form-data; boundary=x"},
+		{"binary", 1024, "/panel/api/save", "application/octet-stream"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			engine := bodyCaptureEngine(test.limit, &read)
+			event := capturedPanic(t, engine, test.path, test.contentType, `{"id":1}`)
+			if string(read) != `{"id":1}` {
+				t.Errorf("the handler read %q", read)
+			}
+			if event.Body != "" || event.BodyTruncated {
+				t.Errorf("the record keeps %q, truncated %v", event.Body, event.BodyTruncated)
+			}
+		})
+	}
+}
+
+func BenchmarkBodyCapture(b *testing.B) {
+	body := []byte(`{"settings":"` + strings.Repeat("x", 16<<10) + `","password":"s3cr3t"}`)
+	for _, bench := range []struct {
+		name  string
+		limit int
+	}{
+		{"off", 0},
+		{"on", 64 << 10},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			gin.SetMode(gin.TestMode)
+			engine := gin.New()
+			engine.Use(BodyCapture(BodyCaptureConfig{BasePath: "/", Prefix: "panel/api/", Limit: bench.limit}))
+			engine.POST("/panel/api/save", func(c *gin.Context) {
+				io.Copy(io.Discard, c.Request.Body)
+				c.Status(http.StatusOK)
+			})
+			b.ReportAllocs()
+			b.SetBytes(int64(len(body)))
+			for b.Loop() {
+				req := httptest.NewRequest(http.MethodPost, "/panel/api/save", bytes.NewReader(body))
+				req.Header.Set("Content-Type", "application/json")
+				engine.ServeHTTP(httptest.NewRecorder(), req)
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"x-ui/logger"
+	"x-ui/web/locale"
+
+	"github.com/gin-gonic/gin"
+)
+
+// BodyLimitConfig holds the request body limits in bytes. Routes are keyed by
+// method and route relative to the base path, e.g. "POST server/importDB".
+type BodyLimitConfig struct {
+	Default int64
+	Routes  map[string]int64
+}
+
+func (c *BodyLimitConfig) limit(ctx *gin.Context) int64 {
+	route := strings.TrimPrefix(ctx.FullPath(), ctx.GetString("base_path"))
+	if limit, ok := c.Routes[ctx.Request.Method+" "+route]; ok {
+		return limit
+	}
+	return c.Default
+}
+
+// BodyLimit rejects request bodies over the limit with a 413. The body is
+// limited while it is read, so a multipart upload is cut off at the part that
+// crosses the limit instead of being buffered first. Whatever the handler
+// writes after that is dropped.
+func BodyLimit(config BodyLimitConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit := config.limit(c)
+		if limit <= 0 || c.Request.Body == nil || c.Request.Body == http.NoBody {
+			c.Next()
+			return
+		}
+		if c.Request.ContentLength > limit {
+			rejectBody(c, limit)
+			c.Abort()
+			return
+		}
+
+		body := &limitedBody{
+			ReadCloser: http.MaxBytesReader(nil, c.Request.Body, limit),
+			c:          c,
+			limit:      limit,
+		}
+		c.Request.Body = body
+		c.Writer = &limitedBodyWriter{ResponseWriter: c.Writer, body: body}
+		c.Next()
+	}
+}
+
+func rejectBody(c *gin.Context, limit int64) {
+	logger.Warningf("request body of %s %s from %s exceeds the limit of %d bytes",
+		c.Request.Method, c.Request.URL.Path, ClientIP(c), limit)
+	locale.ErrorJSON(c, http.StatusRequestEntityTooLarge, locale.ErrRequestTooLarge,
+		gin.H{"limit": limit}, "Limit=="+formatBodyLimit(limit))
+	c.Abort()
+}
+
+func formatBodyLimit(limit int64) string {
+	const mb = 1 << 20
+	if limit >= mb && limit%mb == 0 {
+		return fmt.Sprintf("%d MB", limit/mb)
+	}
+	return fmt.Sprintf("%d bytes", limit)
+}
+
+type limitedBody struct {
+	io.ReadCloser
+	c        *gin.Context
+	limit    int64
+	rejected bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	var tooLarge *http.MaxBytesError
+	if err != nil && !b.rejected && errors.As(err, &tooLarge) {
+		rejectBody(b.c, b.limit)
+		b.rejected = true
+	}
+	return n, err
+}
+
+// limitedBodyWriter drops the response of a handler that read past the limit,
+// the 413 has been sent already.
+type limitedBodyWriter struct {
+	gin.ResponseWriter
+	body *limitedBody
+}
+
+func (w *limitedBodyWriter) WriteHeader(code int) {
+	if !w.body.rejected {
+		w.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (w *limitedBodyWriter) WriteHeaderNow() {
+	if !w.body.rejected {
+		w.ResponseWriter.WriteHeaderNow()
+	}
+}
+
+func (w *limitedBodyWriter) Write(data []byte) (int, error) {
+	if w.body.rejected {
+		return len(data), nil
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *limitedBodyWriter) WriteString(s string) (int, error) {
+	if w.body.rejected {
+		return len(s), nil
+	}
+	return w.ResponseWriter.WriteString(s)
+}
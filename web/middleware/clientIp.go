@@ -0,0 +1,143 @@
+package middleware
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TrustedProxyHeaders are the headers a trusted proxy may pass the client IP in.
+var TrustedProxyHeaders = []string{"X-Forwarded-For", "X-Real-IP", "CF-Connecting-IP"}
+
+var (
+	trustedProxyNets   atomic.Pointer[[]*net.IPNet]
+	trustedProxyHeader atomic.Pointer[string]
+)
+
+// ParseTrustedProxies splits a comma or newline separated list of IPs and CIDRs
+// into CIDRs, a single IP becomes a /32 or /128 network.
+func ParseTrustedProxies(value string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0)
+	for _, item := range strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == '\n' || r == '\r' || r == ' '
+	}) {
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", item)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", item)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// IsTrustedProxyHeader reports whether header is one of TrustedProxyHeaders.
+func IsTrustedProxyHeader(header string) bool {
+	for _, h := range TrustedProxyHeaders {
+		if strings.EqualFold(h, header) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetTrustedProxies makes engine take the client IP from header, but only for
+// requests whose direct peer is in one of the trusted networks. Without trusted
+// networks the headers are ignored and the peer address is the client IP.
+func SetTrustedProxies(engine *gin.Engine, trusted string, header string) error {
+	nets, err := ParseTrustedProxies(trusted)
+	if err != nil {
+		return err
+	}
+	if header == "" {
+		header = TrustedProxyHeaders[0]
+	}
+	if !IsTrustedProxyHeader(header) {
+		return fmt.Errorf("unsupported client IP header %q", header)
+	}
+	cidrs := make([]string, 0, len(nets))
+	for _, ipNet := range nets {
+		cidrs = append(cidrs, ipNet.String())
+	}
+	// The platform header would be trusted from any peer
+	engine.TrustedPlatform = ""
+	engine.ForwardedByClientIP = len(cidrs) > 0
+	engine.RemoteIPHeaders = []string{http.CanonicalHeaderKey(header)}
+	if err := engine.SetTrustedProxies(cidrs); err != nil {
+		return err
+	}
+	trustedProxyNets.Store(&nets)
+	trustedProxyHeader.Store(&header)
+	return nil
+}
+
+// ClientIP returns the IP of the client of a request, as determined by the
+// trusted proxies of the engine. Every per-IP feature should use it, so that
+// rate limits, lockouts and logs agree on the address.
+func ClientIP(c *gin.Context) string {
+	if ip := c.ClientIP(); ip != "" {
+		return ip
+	}
+	// gin can't parse the peer address of a link-local IPv6 peer with a zone
+	host, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+	if err == nil {
+		return host
+	}
+	// A unix socket peer has no address, only the reverse proxy knows the client
+	return forwardedClientIP(c)
+}
+
+// forwardedClientIP takes the client IP from the client IP header, skipping the
+// trusted proxies appended to X-Forwarded-For. It returns "" without the header.
+func forwardedClientIP(c *gin.Context) string {
+	header := TrustedProxyHeaders[0]
+	if h := trustedProxyHeader.Load(); h != nil {
+		header = *h
+	}
+	items := strings.Split(c.GetHeader(header), ",")
+	for i := len(items) - 1; i >= 0; i-- {
+		ip := strings.TrimSpace(items[i])
+		if net.ParseIP(ip) == nil {
+			continue
+		}
+		if i > 0 && IsTrustedProxy(ip) {
+			continue
+		}
+		return ip
+	}
+	return ""
+}
+
+// IsTrustedProxy reports whether ip belongs to a trusted proxy, such as a CDN edge
+// that shows up in place of the client.
+func IsTrustedProxy(ip string) bool {
+	nets := trustedProxyNets.Load()
+	if nets == nil {
+		return false
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, ipNet := range *nets {
+		if ipNet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,129 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// clientIPEngine returns an engine answering with the client IP of requests,
+// trusting the proxies of trusted.
+func clientIPEngine(t *testing.T, trusted string, header string) *gin.Engine {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	if err := SetTrustedProxies(engine, trusted, header); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { SetTrustedProxies(gin.New(), "", "") })
+	engine.GET("/", func(c *gin.Context) { c.String(http.StatusOK, ClientIP(c)) })
+	return engine
+}
+
+func clientIPOf(engine *gin.Engine, peer string, headers map[string]string) string {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = peer
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	rec := httptest.NewRecorder()
+	engine.ServeHTTP(rec, req)
+	return rec.Body.String()
+}
+
+func TestClientIPForwardedFor(t *testing.T) {
+	engine := clientIPEngine(t, "10.0.0.0/8, 192.168.1.1", "X-Forwarded-For")
+	tests := []struct {
+		name string
+		peer string
+		xff  string
+		want string
+	}{
+		{"no header", "10.0.0.1:1234", "", "10.0.0.1"},
+		{"single", "10.0.0.1:1234", "203.0.113.7", "203.0.113.7"},
+		{"chain of trusted proxies", "10.0.0.1:1234", "203.0.113.7, 10.1.1.1, 192.168.1.1", "203.0.113.7"},
+		// The first untrusted hop from the right is the client, what it was
+		// sent from further left may be spoofed
+		{"spoofed start of chain", "10.0.0.1:1234", "1.1.1.1, 203.0.113.7, 10.1.1.1", "203.0.113.7"},
+		{"untrusted peer", "198.51.100.9:1234", "203.0.113.7", "198.51.100.9"},
+		{"garbage", "10.0.0.1:1234", "not an ip", "10.0.0.1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			headers := map[string]string{}
+			if test.xff != "" {
+				headers["X-Forwarded-For"] = test.xff
+			}
+			if got := clientIPOf(engine, test.peer, headers); got != test.want {
+				t.Errorf("client IP = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestClientIPv6Peers(t *testing.T) {
+	engine := clientIPEngine(t, "2001:db8::/32, ::1", "X-Forwarded-For")
+	tests := []struct {
+		name string
+		peer string
+		xff  string
+		want string
+	}{
+		{"trusted peer", "[2001:db8::10]:443", "2001:db8:ffff::1, 2001:db8::20", "2001:db8:ffff::1"},
+		{"v4 client behind v6 proxy", "[::1]:443", "203.0.113.7", "203.0.113.7"},
+		{"untrusted peer", "[2001:dbf::1]:443", "203.0.113.7", "2001:dbf::1"},
+		{"v6 client", "[2001:db8::10]:443", "2a00:1450:4001::1", "2a00:1450:4001::1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := clientIPOf(engine, test.peer, map[string]string{"X-Forwarded-For": test.xff}); got != test.want {
+				t.Errorf("client IP = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestClientIPOtherHeaders(t *testing.T) {
+	engine := clientIPEngine(t, "10.0.0.1", "CF-Connecting-IP")
+	headers := map[string]string{"CF-Connecting-IP": "203.0.113.7", "X-Forwarded-For": "198.51.100.1"}
+	if got := clientIPOf(engine, "10.0.0.1:1234", headers); got != "203.0.113.7" {
+		t.Errorf("client IP = %q, want the CF-Connecting-IP", got)
+	}
+	if got := clientIPOf(engine, "10.0.0.2:1234", headers); got != "10.0.0.2" {
+		t.Errorf("client IP = %q, want the untrusted peer", got)
+	}
+}
+
+func TestClientIPWithoutTrustedProxies(t *testing.T) {
+	engine := clientIPEngine(t, "", "")
+	headers := map[string]string{"X-Forwarded-For": "203.0.113.7", "X-Real-IP": "203.0.113.8"}
+	if got := clientIPOf(engine, "10.0.0.1:1234", headers); got != "10.0.0.1" {
+		t.Errorf("client IP = %q, want the peer", got)
+	}
+}
+
+func TestClientIPUnixSocket(t *testing.T) {
+	engine := clientIPEngine(t, "10.0.0.0/8", "X-Forwarded-For")
+	// Only the reverse proxy in front of a unix socket knows the client
+	if got := clientIPOf(engine, "@", map[string]string{"X-Forwarded-For": "203.0.113.7, 10.0.0.1"}); got != "203.0.113.7" {
+		t.Errorf("client IP = %q, want the forwarded one", got)
+	}
+	if got := clientIPOf(engine, "@", nil); got != "" {
+		t.Errorf("client IP = %q without a header", got)
+	}
+}
+
+func TestSetTrustedProxiesInvalid(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	for _, test := range []struct{ trusted, header string }{
+		{"10.0.0.0/33", ""},
+		{"not an ip", ""},
+		{"10.0.0.1", "X-Client-IP"},
+	} {
+		if err := SetTrustedProxies(gin.New(), test.trusted, test.header); err == nil {
+			t.Errorf("SetTrustedProxies(%q, %q) succeeded", test.trusted, test.header)
+		}
+	}
+}
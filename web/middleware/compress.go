@@ -0,0 +1,271 @@
+package middleware
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"x-ui/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DefaultCompressTypes are the content types compressed unless configured
+// otherwise; a type ending with / matches all of its subtypes.
+const DefaultCompressTypes = "application/json, application/javascript, application/yaml, application/x-yaml, text/"
+
+// CompressConfig controls the response compression.
+type CompressConfig struct {
+	// MinSize is the smallest body in bytes worth compressing
+	MinSize int
+	// Types are content types like "application/json", or prefixes like "text/"
+	Types []string
+}
+
+// Compress encodes responses with gzip or deflate, whichever the client prefers.
+// Only bodies of at least MinSize bytes with one of the allowed types are
+// compressed; responses that are already encoded, partial content and websocket
+// upgrades pass through untouched, as do all the other headers.
+func Compress(config CompressConfig) gin.HandlerFunc {
+	types := make([]string, 0, len(config.Types))
+	for _, t := range config.Types {
+		types = append(types, strings.ToLower(strings.TrimSpace(t)))
+	}
+	return func(c *gin.Context) {
+		if c.Request.Method == http.MethodHead || c.GetHeader("Range") != "" || isWebSocketUpgrade(c) {
+			c.Next()
+			return
+		}
+		encoding := acceptedEncoding(c.GetHeader("Accept-Encoding"))
+		if encoding == "" {
+			c.Next()
+			return
+		}
+
+		w := &compressWriter{
+			ResponseWriter: c.Writer,
+			encoding:       encoding,
+			minSize:        config.MinSize,
+			types:          types,
+		}
+		c.Writer = w
+		defer func() {
+			c.Writer = w.ResponseWriter
+			// Leave the response to the recovery middleware, without the held back body
+			if r := recover(); r != nil {
+				panic(r)
+			}
+			if err := w.finish(); err != nil {
+				logger.Debug("compress response failed:", err)
+			}
+		}()
+		c.Next()
+	}
+}
+
+// acceptedEncoding picks gzip or deflate from an Accept-Encoding header, or ""
+// if the client accepts neither.
+func acceptedEncoding(header string) string {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != "gzip" && name != "deflate" {
+			continue
+		}
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		// gzip wins a tie, it is what every client supports best
+		if q > bestQ || q == bestQ && name == "gzip" && q > 0 {
+			best, bestQ = name, q
+		}
+	}
+	return best
+}
+
+// compressWriter holds back the body until it is known whether it should be
+// compressed: when MinSize bytes have been written, on a flush, or at the end.
+type compressWriter struct {
+	gin.ResponseWriter
+	encoding string
+	minSize  int
+	types    []string
+
+	status  int
+	size    int
+	buf     []byte
+	decided bool
+	encoder io.WriteCloser
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	if code > 0 && !w.decided {
+		w.status = code
+	}
+}
+
+func (w *compressWriter) WriteHeaderNow() {}
+
+func (w *compressWriter) Status() int {
+	if w.decided {
+		return w.ResponseWriter.Status()
+	}
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+func (w *compressWriter) Size() int {
+	if !w.Written() {
+		return -1
+	}
+	return w.size
+}
+
+func (w *compressWriter) Written() bool {
+	return w.decided || w.status != 0 || w.size > 0
+}
+
+func (w *compressWriter) Write(data []byte) (int, error) {
+	w.size += len(data)
+	if !w.decided {
+		w.buf = append(w.buf, data...)
+		if len(w.buf) < w.minSize {
+			return len(data), nil
+		}
+		if err := w.decide(true); err != nil {
+			return 0, err
+		}
+		return len(data), nil
+	}
+	if w.encoder != nil {
+		return w.encoder.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *compressWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Flush sends what was written so far; a streamed response is compressed
+// regardless of its size.
+func (w *compressWriter) Flush() {
+	if !w.decided {
+		if err := w.decide(true); err != nil {
+			return
+		}
+	}
+	if flusher, ok := w.encoder.(interface{ Flush() error }); ok {
+		if err := flusher.Flush(); err != nil {
+			return
+		}
+	}
+	w.ResponseWriter.Flush()
+}
+
+func (w *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.decided = true
+	return w.ResponseWriter.Hijack()
+}
+
+// decide chooses between compressing and passing the body through, then writes
+// the header and the held back body. large is false at the end of a response
+// shorter than MinSize.
+func (w *compressWriter) decide(large bool) error {
+	compress := large && w.shouldCompress()
+	w.decided = true
+	if compress {
+		h := w.Header()
+		h.Set("Content-Encoding", w.encoding)
+		h.Add("Vary", "Accept-Encoding")
+		h.Del("Content-Length")
+		if w.encoding == "gzip" {
+			w.encoder = gzip.NewWriter(w.ResponseWriter)
+		} else {
+			encoder, err := flate.NewWriter(w.ResponseWriter, flate.DefaultCompression)
+			if err != nil {
+				return err
+			}
+			w.encoder = encoder
+		}
+	}
+	w.forwardHeader()
+	if len(w.buf) == 0 {
+		return nil
+	}
+	buf := w.buf
+	w.buf = nil
+	var err error
+	if w.encoder != nil {
+		_, err = w.encoder.Write(buf)
+	} else {
+		_, err = w.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+func (w *compressWriter) forwardHeader() {
+	if w.status != 0 {
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+}
+
+func (w *compressWriter) shouldCompress() bool {
+	status := w.Status()
+	if status < http.StatusOK || status == http.StatusNoContent || status == http.StatusNotModified ||
+		status == http.StatusPartialContent {
+		return false
+	}
+	h := w.Header()
+	if h.Get("Content-Encoding") != "" {
+		return false
+	}
+	contentType := strings.ToLower(h.Get("Content-Type"))
+	if contentType == "" {
+		// net/http would sniff the compressed bytes otherwise
+		h.Set("Content-Type", http.DetectContentType(w.buf))
+		contentType = strings.ToLower(h.Get("Content-Type"))
+	}
+	contentType, _, _ = strings.Cut(contentType, ";")
+	contentType = strings.TrimSpace(contentType)
+	for _, t := range w.types {
+		if t == "" {
+			continue
+		}
+		if strings.HasSuffix(t, "/") && strings.HasPrefix(contentType, t) || contentType == t {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *compressWriter) finish() error {
+	if !w.decided {
+		if !w.Written() {
+			return nil
+		}
+		if err := w.decide(len(w.buf) >= w.minSize); err != nil {
+			return err
+		}
+		if w.encoder == nil {
+			w.ResponseWriter.WriteHeaderNow()
+		}
+	}
+	if w.encoder != nil {
+		return w.encoder.Close()
+	}
+	return nil
+}
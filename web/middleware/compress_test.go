@@ -0,0 +1,193 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAcceptedEncoding(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"br", ""},
+		{"*", ""},
+		{"gzip", "gzip"},
+		{"deflate", "deflate"},
+		{"GZIP", "gzip"},
+		{"deflate, gzip", "gzip"},
+		{"gzip, deflate, br", "gzip"},
+		{"gzip;q=0.5, deflate", "deflate"},
+		{"gzip;q=0, deflate;q=0", ""},
+		{"gzip;q=0", ""},
+		{"gzip;q=oops, deflate;q=0.1", "deflate"},
+		{"identity;q=1, gzip;q=0.2", "gzip"},
+	}
+	for _, test := range tests {
+		if got := acceptedEncoding(test.header); got != test.want {
+			t.Errorf("acceptedEncoding(%q) = %q, want %q", test.header, got, test.want)
+		}
+	}
+}
+
+// compressEngine serves body with contentType on /, compressing the responses
+// of at least minSize bytes.
+func compressEngine(minSize int, contentType string, body []byte) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.Use(Compress(CompressConfig{MinSize: minSize, Types: strings.Split(DefaultCompressTypes, ",")}))
+	handler := func(c *gin.Context) {
+		if c.Query("encoded") != "" {
+			c.Header("Content-Encoding", "br")
+		}
+		c.Data(http.StatusOK, contentType, body)
+	}
+	engine.GET("/", handler)
+	engine.HEAD("/", handler)
+	return engine
+}
+
+// decode returns the body of a response in the encoding it was sent with.
+func decode(t *testing.T, encoding string, body []byte) []byte {
+	t.Helper()
+	var reader io.Reader
+	switch encoding {
+	case "gzip":
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = gz
+	case "deflate":
+		reader = flate.NewReader(bytes.NewReader(body))
+	default:
+		return body
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestCompress(t *testing.T) {
+	large := []byte(`{"success":true,"obj":"` + strings.Repeat("inbound ", 256) + `"}`)
+	small := []byte(`{"success":true}`)
+	tests := []struct {
+		name        string
+		method      string
+		target      string
+		header      map[string]string
+		contentType string
+		body        []byte
+		want        string
+	}{
+		{"no accept-encoding", http.MethodGet, "/", nil, "application/json", large, ""},
+		{"identity", http.MethodGet, "/", map[string]string{"Accept-Encoding": "identity"}, "application/json", large, ""},
+		{"gzip", http.MethodGet, "/", map[string]string{"Accept-Encoding": "gzip"}, "application/json", large, "gzip"},
+		{"deflate", http.MethodGet, "/", map[string]string{"Accept-Encoding": "deflate"}, "application/json", large, "deflate"},
+		{"preferred", http.MethodGet, "/", map[string]string{"Accept-Encoding": "gzip;q=0.4, deflate;q=0.8"}, "application/json", large, "deflate"},
+		{"subtype", http.MethodGet, "/", map[string]string{"Accept-Encoding": "gzip"}, "text/plain; charset=utf-8", large, "gzip"},
+		{"small body", http.MethodGet, "/", map[string]string{"Accept-Encoding": "gzip"}, "application/json", small, ""},
+		{"other type", http.MethodGet, "/", map[string]string{"Accept-Encoding": "gzip"}, "image/png", large, ""},
+		{"already encoded", http.MethodGet, "/?encoded=1", map[string]string{"Accept-Encoding": "gzip"}, "application/json", large, "br"},
+		{"range", http.MethodGet, "/", map[string]string{"Accept-Encoding": "gzip", "Range": "bytes=0-9"}, "application/json", large, ""},
+		{"head", http.MethodHead, "/", map[string]string{"Accept-Encoding": "gzip"}, "application/json", large, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(test.method, test.target, nil)
+			for name, value := range test.header {
+				req.Header.Set(name, value)
+			}
+			w := httptest.NewRecorder()
+			compressEngine(1024, test.contentType, test.body).ServeHTTP(w, req)
+			encoding := w.Header().Get("Content-Encoding")
+			if encoding != test.want {
+				t.Fatalf("Content-Encoding = %q, want %q", encoding, test.want)
+			}
+			if vary := w.Header().Get("Vary"); (vary == "Accept-Encoding") != (test.want == "gzip" || test.want == "deflate") {
+				t.Errorf("Vary = %q", vary)
+			}
+			if test.method == http.MethodHead {
+				return
+			}
+			if body := decode(t, encoding, w.Body.Bytes()); !bytes.Equal(body, test.body) {
+				t.Errorf("the body is %d bytes, want the %d sent", len(body), len(test.body))
+			}
+		})
+	}
+}
+
+// compressPayloads are typical responses of the panel and the subscription
+// server: a page of inbounds of the API, and subscriptions as links and as a
+// Clash profile, of 100 clients with random ids.
+func compressPayloads() map[string]struct {
+	contentType string
+	body        []byte
+} {
+	random := rand.New(rand.NewPCG(1, 2))
+	id := func() string {
+		return fmt.Sprintf("%08x-%04x-4%03x-%04x-%012x", random.Uint32(), random.Uint32()&0xffff,
+			random.Uint32()&0xfff, 0x8000|random.Uint32()&0x3fff, random.Uint64()&0xffffffffffff)
+	}
+	var clients, links, clash strings.Builder
+	for i := range 100 {
+		uuid := id()
+		if i > 0 {
+			clients.WriteString(`,`)
+		}
+		fmt.Fprintf(&clients, `{\"id\":\"%s\",\"email\":\"client-%d\",\"limitIp\":0,\"totalGB\":0,\"expiryTime\":0,\"enable\":true,\"tgId\":0,\"subId\":\"%x\",\"reset\":0}`,
+			uuid, i, random.Uint64())
+		fmt.Fprintf(&links, "vless://%s@example.com:443?type=tcp&security=reality&pbk=%x&fp=chrome&sni=www.example.com&sid=%x&spx=%%2F#client-%d\n",
+			uuid, random.Uint64(), random.Uint32(), i)
+		fmt.Fprintf(&clash, "  - name: client-%d\n    type: vless\n    server: example.com\n    port: 443\n    uuid: %s\n    network: tcp\n    tls: true\n    servername: www.example.com\n    client-fingerprint: chrome\n",
+			i, uuid)
+	}
+	api := `{"success":true,"msg":"","obj":[{"id":1,"up":123456789,"down":987654321,"total":0,"remark":"reality","enable":true,"expiryTime":0,` +
+		`"listen":"","port":443,"protocol":"vless","settings":"{\"clients\":[` + clients.String() + `],\"decryption\":\"none\",\"fallbacks\":[]}",` +
+		`"streamSettings":"{\"network\":\"tcp\",\"security\":\"reality\"}","tag":"inbound-443","sniffing":"{\"enabled\":true}"}]}`
+	return map[string]struct {
+		contentType string
+		body        []byte
+	}{
+		"api":   {"application/json; charset=utf-8", []byte(api)},
+		"sub":   {"text/plain; charset=utf-8", []byte(base64.StdEncoding.EncodeToString([]byte(links.String())))},
+		"clash": {"application/yaml; charset=utf-8", []byte("proxies:\n" + clash.String())},
+	}
+}
+
+func BenchmarkCompress(b *testing.B) {
+	for name, payload := range compressPayloads() {
+		for _, encoding := range []string{"gzip", "deflate"} {
+			b.Run(name+"/"+encoding, func(b *testing.B) {
+				engine := compressEngine(1024, payload.contentType, payload.body)
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				req.Header.Set("Accept-Encoding", encoding)
+				var compressed int
+				b.SetBytes(int64(len(payload.body)))
+				for b.Loop() {
+					w := httptest.NewRecorder()
+					engine.ServeHTTP(w, req)
+					compressed = w.Body.Len()
+				}
+				b.ReportMetric(float64(len(payload.body)), "bytes")
+				b.ReportMetric(float64(compressed), "compressed-bytes")
+				b.ReportMetric(100*(1-float64(compressed)/float64(len(payload.body))), "%saved")
+			})
+		}
+	}
+}
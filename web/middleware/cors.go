@@ -0,0 +1,141 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CORSConfig controls which other origins may call the API from a browser. An
+// empty AllowedOrigins keeps the API same-origin only.
+type CORSConfig struct {
+	// AllowedOrigins are exact origins like "https://app.example.com", wildcard
+	// subdomains like "https://*.example.com", or "*" for any origin
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	AllowCredentials bool
+	MaxAge           int // seconds
+}
+
+// ParseCORSList splits a comma separated setting into its non-empty items.
+func ParseCORSList(value string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func (c *CORSConfig) Enabled() bool {
+	return len(c.AllowedOrigins) > 0
+}
+
+func (c *CORSConfig) Validate() error {
+	for _, origin := range c.AllowedOrigins {
+		if origin == "*" {
+			if c.AllowCredentials {
+				return errors.New("CORS origin * can not be combined with credentials, list the allowed origins instead")
+			}
+			continue
+		}
+		scheme, host, ok := strings.Cut(origin, "://")
+		if !ok || scheme == "" || host == "" || strings.Contains(host, "/") {
+			return fmt.Errorf("invalid CORS origin %q, expected scheme://host[:port]", origin)
+		}
+		if strings.Contains(strings.TrimPrefix(host, "*."), "*") {
+			return fmt.Errorf("invalid CORS origin %q, only a leading *. is allowed", origin)
+		}
+	}
+	for _, method := range c.AllowedMethods {
+		if method != strings.ToUpper(method) || strings.ContainsAny(method, " \t") {
+			return fmt.Errorf("invalid CORS method %q", method)
+		}
+	}
+	if c.MaxAge < 0 {
+		return errors.New("CORS max age must not be negative")
+	}
+	return nil
+}
+
+// allowOrigin reports whether a request from origin may read the response.
+func (c *CORSConfig) allowOrigin(origin string) bool {
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+		prefix, suffix, ok := strings.Cut(allowed, "*.")
+		if !ok || len(origin) <= len(prefix)+len(suffix)+1 {
+			continue
+		}
+		lower := strings.ToLower(origin)
+		sub := lower[len(prefix) : len(lower)-len(suffix)]
+		if strings.HasPrefix(lower, strings.ToLower(prefix)) &&
+			strings.HasSuffix(lower, "."+strings.ToLower(suffix)) &&
+			!strings.ContainsAny(sub, "/:") {
+			return true
+		}
+	}
+	return false
+}
+
+// CORS answers preflight requests itself and adds the CORS headers to the
+// responses of allowed origins. It has to run before authentication, browsers
+// never send credentials with a preflight.
+func CORS(config CORSConfig) gin.HandlerFunc {
+	methods := strings.Join(config.AllowedMethods, ", ")
+	headers := strings.Join(config.AllowedHeaders, ", ")
+	anyOrigin := false
+	for _, origin := range config.AllowedOrigins {
+		anyOrigin = anyOrigin || origin == "*"
+	}
+
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		preflight := c.Request.Method == http.MethodOptions && c.GetHeader("Access-Control-Request-Method") != ""
+		if origin == "" {
+			c.Next()
+			return
+		}
+		c.Writer.Header().Add("Vary", "Origin")
+		if !config.allowOrigin(origin) {
+			if preflight {
+				c.AbortWithStatus(http.StatusForbidden)
+				return
+			}
+			// The browser keeps the response from the page without the headers
+			c.Next()
+			return
+		}
+
+		if anyOrigin && !config.AllowCredentials {
+			c.Header("Access-Control-Allow-Origin", "*")
+		} else {
+			c.Header("Access-Control-Allow-Origin", origin)
+		}
+		if config.AllowCredentials {
+			c.Header("Access-Control-Allow-Credentials", "true")
+		}
+		if !preflight {
+			c.Next()
+			return
+		}
+
+		c.Writer.Header().Add("Vary", "Access-Control-Request-Method")
+		c.Writer.Header().Add("Vary", "Access-Control-Request-Headers")
+		c.Header("Access-Control-Allow-Methods", methods)
+		if headers != "" {
+			c.Header("Access-Control-Allow-Headers", headers)
+		}
+		if config.MaxAge > 0 {
+			c.Header("Access-Control-Max-Age", strconv.Itoa(config.MaxAge))
+		}
+		c.AbortWithStatus(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,93 @@
+package middleware
+
+import (
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"x-ui/web/locale"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Retry-After when no ETA was given
+const defaultMaintenanceRetry = 5 * time.Minute
+
+// MaintenanceState is the maintenance mode as stored in the settings.
+type MaintenanceState struct {
+	Enable  bool   `json:"enable" form:"enable"`
+	Message string `json:"message" form:"message"`
+	// Eta is when the maintenance should be over, in unix milliseconds, or 0
+	Eta int64 `json:"eta" form:"eta"`
+}
+
+// RetryAfter returns the seconds until the ETA, for the Retry-After header.
+func (m *MaintenanceState) RetryAfter() int {
+	if m.Eta <= 0 {
+		return int(defaultMaintenanceRetry.Seconds())
+	}
+	seconds := int(time.Until(time.UnixMilli(m.Eta)).Seconds())
+	if seconds < 1 {
+		// Past the ETA but not finished yet
+		seconds = 60
+	}
+	return seconds
+}
+
+var maintenancePage = template.Must(template.New("maintenance").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Maintenance</title>
+<style>body{font-family:sans-serif;display:flex;align-items:center;justify-content:center;min-height:90vh;margin:0;color:#333}main{max-width:32rem;padding:1rem;text-align:center}</style>
+</head>
+<body>
+<main>
+<h1>Maintenance</h1>
+<p>{{.Message}}</p>
+{{if .Eta}}<p>Expected back at <time datetime="{{.Eta}}">{{.Eta}}</time>.</p>{{end}}
+</main>
+</body>
+</html>
+`))
+
+// Maintenance answers 503 while state reports the maintenance mode as enabled,
+// except for requests bypass lets through. Browsers get a page, everything else,
+// subscription clients included, a JSON message.
+func Maintenance(state func() MaintenanceState, bypass func(c *gin.Context) bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		m := state()
+		if !m.Enable || bypass != nil && bypass(c) {
+			c.Next()
+			return
+		}
+
+		message := m.Message
+		if message == "" {
+			message = locale.ErrMaintenance.Message(c)
+		}
+		eta := ""
+		if m.Eta > 0 {
+			eta = time.UnixMilli(m.Eta).UTC().Format(time.RFC3339)
+		}
+		c.Header("Retry-After", strconv.Itoa(m.RetryAfter()))
+		c.Header("Cache-Control", "no-store")
+
+		if strings.Contains(c.GetHeader("Accept"), "text/html") && c.GetHeader("X-Requested-With") == "" {
+			c.Status(http.StatusServiceUnavailable)
+			c.Header("Content-Type", "text/html; charset=utf-8")
+			maintenancePage.Execute(c.Writer, gin.H{"Message": message, "Eta": eta})
+			c.Abort()
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, locale.ErrorResponse{
+			Msg:       message,
+			Code:      locale.ErrMaintenance,
+			Obj:       gin.H{"maintenance": true, "eta": m.Eta},
+			RequestId: GetRequestID(c),
+		})
+	}
+}
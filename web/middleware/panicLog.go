@@ -0,0 +1,47 @@
+package middleware
+
+import "sync"
+
+const panicLogSize = 50
+
+// panicRing keeps the last panicLogSize panics in memory so they can be inspected
+// from the panel without digging through the logs.
+type panicRing struct {
+	mu      sync.Mutex
+	entries [panicLogSize]PanicEvent
+	next    int
+	count   int
+}
+
+var recentPanics panicRing
+
+func (r *panicRing) push(event PanicEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries[r.next] = event
+	r.next = (r.next + 1) % panicLogSize
+	if r.count < panicLogSize {
+		r.count++
+	}
+}
+
+// RecentPanics returns a copy of the recorded panics, newest first.
+func RecentPanics() []PanicEvent {
+	recentPanics.mu.Lock()
+	defer recentPanics.mu.Unlock()
+	events := make([]PanicEvent, 0, recentPanics.count)
+	for i := 1; i <= recentPanics.count; i++ {
+		idx := (recentPanics.next - i + panicLogSize) % panicLogSize
+		events = append(events, recentPanics.entries[idx])
+	}
+	return events
+}
+
+// ClearPanics drops all recorded panics.
+func ClearPanics() {
+	recentPanics.mu.Lock()
+	defer recentPanics.mu.Unlock()
+	recentPanics.entries = [panicLogSize]PanicEvent{}
+	recentPanics.next = 0
+	recentPanics.count = 0
+}
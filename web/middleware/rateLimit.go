@@ -0,0 +1,108 @@
+package middleware
+
+import (
+	"container/list"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RateLimiter is a token bucket limiter keyed by an arbitrary string. The number
+// of tracked keys is bounded; the least recently used buckets are evicted first.
+type RateLimiter struct {
+	rate     float64 // tokens per second
+	burst    float64
+	capacity int
+
+	mu      sync.Mutex
+	buckets map[string]*list.Element
+	lru     *list.List
+}
+
+type bucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter allows perMinute requests per key with bursts of up to burst
+// requests, tracking at most capacity keys.
+func NewRateLimiter(perMinute int, burst int, capacity int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &RateLimiter{
+		rate:     float64(perMinute) / 60,
+		burst:    float64(burst),
+		capacity: capacity,
+		buckets:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// Allow takes a token from the bucket of key. If none is left it returns false
+// and how long the caller has to wait for the next token.
+func (l *RateLimiter) Allow(key string) (bool, time.Duration) {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var b *bucket
+	if el, ok := l.buckets[key]; ok {
+		l.lru.MoveToFront(el)
+		b = el.Value.(*bucket)
+		b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+		b.last = now
+	} else {
+		for l.lru.Len() >= l.capacity {
+			oldest := l.lru.Back()
+			l.lru.Remove(oldest)
+			delete(l.buckets, oldest.Value.(*bucket).key)
+		}
+		b = &bucket{key: key, tokens: l.burst, last: now}
+		l.buckets[key] = l.lru.PushFront(b)
+	}
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	if l.rate <= 0 {
+		return false, time.Minute
+	}
+	wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+// RateLimitKey normalizes a client IP for rate limiting: IPv6 addresses are
+// grouped by their /64 prefix since a single host usually owns the whole block.
+func RateLimitKey(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return v4.String()
+	}
+	return parsed.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+// RateLimit rejects requests over the limit by calling onLimited instead of the
+// rest of the chain. keyFunc returns the client identity, usually its IP.
+func RateLimit(limiter *RateLimiter, keyFunc func(c *gin.Context) string, onLimited func(c *gin.Context, retryAfter time.Duration)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if ok, retryAfter := limiter.Allow(RateLimitKey(keyFunc(c))); !ok {
+			onLimited(c, retryAfter)
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,137 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRateLimiterBurst(t *testing.T) {
+	limiter := NewRateLimiter(6, 3, 10)
+	for i := range 3 {
+		if ok, _ := limiter.Allow("1.2.3.4"); !ok {
+			t.Fatalf("request %d of the burst was limited", i+1)
+		}
+	}
+	ok, wait := limiter.Allow("1.2.3.4")
+	if ok {
+		t.Fatal("a request over the burst was allowed")
+	}
+	// 6 a minute is a token every 10 seconds
+	if wait <= 9*time.Second || wait > 10*time.Second {
+		t.Errorf("retry after %v, want about 10s", wait)
+	}
+	if ok, _ := limiter.Allow("5.6.7.8"); !ok {
+		t.Error("another key shares the bucket")
+	}
+}
+
+func TestRateLimiterRefill(t *testing.T) {
+	limiter := NewRateLimiter(60, 2, 10)
+	limiter.Allow("a")
+	limiter.Allow("a")
+	if ok, _ := limiter.Allow("a"); ok {
+		t.Fatal("an empty bucket allowed a request")
+	}
+
+	// Five seconds at a token a second refill the bucket up to its burst only
+	b := limiter.buckets["a"].Value.(*bucket)
+	b.last = b.last.Add(-5 * time.Second)
+	for i := range 2 {
+		if ok, _ := limiter.Allow("a"); !ok {
+			t.Fatalf("refilled request %d was limited", i+1)
+		}
+	}
+	if ok, _ := limiter.Allow("a"); ok {
+		t.Error("the bucket refilled over its burst")
+	}
+}
+
+func TestRateLimiterZeroRate(t *testing.T) {
+	limiter := NewRateLimiter(0, 1, 10)
+	limiter.Allow("a")
+	if ok, wait := limiter.Allow("a"); ok || wait != time.Minute {
+		t.Errorf("Allow = %v, %v, want limited for a minute", ok, wait)
+	}
+}
+
+func TestRateLimiterEviction(t *testing.T) {
+	limiter := NewRateLimiter(1, 1, 3)
+	for _, key := range []string{"a", "b", "c"} {
+		limiter.Allow(key)
+	}
+	// Using a makes b the least recently used, evicted for d
+	limiter.Allow("a")
+	limiter.Allow("d")
+
+	if len(limiter.buckets) != 3 || limiter.lru.Len() != 3 {
+		t.Fatalf("%d buckets are kept, want 3", len(limiter.buckets))
+	}
+	if _, ok := limiter.buckets["b"]; ok {
+		t.Error("the least recently used bucket was kept")
+	}
+	// An evicted key starts over with a full bucket
+	if ok, _ := limiter.Allow("b"); !ok {
+		t.Error("an evicted key is still limited")
+	}
+	if ok, _ := limiter.Allow("a"); ok {
+		t.Error("a recently used bucket was evicted")
+	}
+
+	for i := range 10000 {
+		limiter.Allow(fmt.Sprintf("10.0.%d.%d", i/256, i%256))
+	}
+	if len(limiter.buckets) != 3 || limiter.lru.Len() != 3 {
+		t.Errorf("a scan grew the buckets to %d", len(limiter.buckets))
+	}
+}
+
+func TestRateLimitKey(t *testing.T) {
+	tests := map[string]string{
+		"1.2.3.4":                   "1.2.3.4",
+		"::ffff:1.2.3.4":            "1.2.3.4",
+		"2001:db8:1:2:3:4:5:6":      "2001:db8:1:2::/64",
+		"2001:db8:1:2:ffff::1":      "2001:db8:1:2::/64",
+		"2001:db8:1:3::1":           "2001:db8:1:3::/64",
+		"not an ip":                 "not an ip",
+		"fe80::1234:5678:9abc:def0": "fe80::/64",
+	}
+	for ip, want := range tests {
+		if got := RateLimitKey(ip); got != want {
+			t.Errorf("RateLimitKey(%q) = %q, want %q", ip, got, want)
+		}
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	limiter := NewRateLimiter(1, 1, 10)
+	keyFunc := func(c *gin.Context) string { return c.GetHeader("X-Test-IP") }
+	engine.Use(RateLimit(limiter, keyFunc, func(c *gin.Context, retryAfter time.Duration) {
+		c.JSON(http.StatusTooManyRequests, gin.H{"retryAfter": retryAfter.Seconds()})
+	}))
+	engine.POST("/login", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	status := func(ip string) int {
+		req := httptest.NewRequest(http.MethodPost, "/login", nil)
+		req.Header.Set("X-Test-IP", ip)
+		rec := httptest.NewRecorder()
+		engine.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if got := status("2001:db8::1"); got != http.StatusOK {
+		t.Fatalf("the first request got %d", got)
+	}
+	// Another address of the same /64 shares the bucket
+	if got := status("2001:db8::2"); got != http.StatusTooManyRequests {
+		t.Errorf("rotating within the /64 got %d, want 429", got)
+	}
+	if got := status("2001:db8:0:1::1"); got != http.StatusOK {
+		t.Errorf("another /64 got %d", got)
+	}
+}
@@ -1,19 +1,79 @@
 package middleware
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"net"
+	"log/slog"
 	"net/http"
-	"net/http/httputil"
 	"runtime/debug"
-	"strings"
+	"sync"
+	"syscall"
 	"time"
 	"x-ui/logger"
+	"x-ui/web/locale"
+	"x-ui/web/metrics"
 
 	"github.com/gin-gonic/gin"
+	"github.com/op/go-logging"
 )
 
+// PanicEvent описывает перехваченную панику для подписчиков (алерты, счётчики и т.п.).
+type PanicEvent struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"requestId"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	// URL — полный адрес запроса, с секретами запроса (query) под redacted
+	URL        string `json:"url"`
+	Route      string `json:"route"`
+	Error      string `json:"error"`
+	Stack      string `json:"stack"`
+	BrokenPipe bool   `json:"brokenPipe"`
+	// Request — строка запроса и заголовки, Headers — те же заголовки картой;
+	// секреты в обоих заменены
+	Request string            `json:"request"`
+	Headers map[string]string `json:"headers"`
+	// Body — начало тела запроса без секретов, если его сохранил BodyCapture;
+	// BodyTruncated — тело было длиннее
+	Body          string `json:"body,omitempty"`
+	BodyTruncated bool   `json:"bodyTruncated,omitempty"`
+}
+
+var (
+	panicHooksMu sync.RWMutex
+	panicHooks   = map[string]func(PanicEvent){}
+)
+
+// OnPanic регистрирует подписчика под именем name; повторная регистрация с тем же
+// именем заменяет предыдущего (важно при перезапуске веб-сервера).
+// Подписчик вызывается синхронно в горутине запроса, поэтому должен быть быстрым.
+func OnPanic(name string, fn func(PanicEvent)) {
+	panicHooksMu.Lock()
+	defer panicHooksMu.Unlock()
+	if fn == nil {
+		delete(panicHooks, name)
+		return
+	}
+	panicHooks[name] = fn
+}
+
+func notifyPanic(event PanicEvent) {
+	panicHooksMu.RLock()
+	defer panicHooksMu.RUnlock()
+	for name, fn := range panicHooks {
+		func() {
+			// Подписчик не должен уронить сам обработчик паник
+			defer func() {
+				if r := recover(); r != nil {
+					logger.Warningf("panic hook %s failed: %v", name, r)
+				}
+			}()
+			fn(event)
+		}()
+	}
+}
+
 // RecoveryJSON перехватывает панику, логирует всё нужное и отдаёт JSON 500.
 // Ничего лишнего клиенту не раскрывает.
 func RecoveryJSON() gin.HandlerFunc {
@@ -31,19 +91,88 @@ func RecoveryJSON() gin.HandlerFunc {
 					err = fmt.Errorf("%v", v)
 				}
 
+				// Клиент ушёл сам: это не ошибка панели, стек и алерты не нужны
+				if kind := classifyAbort(err); kind != "" {
+					logAbort(c, kind, err, start)
+					if errors.Is(err, http.ErrAbortHandler) {
+						// Пусть net/http оборвёт соединение, как и просил обработчик,
+						// чтобы клиент не принял обрезанный ответ за полный
+						panic(http.ErrAbortHandler)
+					}
+					_ = c.Error(err)
+					c.Abort()
+					return
+				}
+
 				// Определим "сломанное соединение": писать ответ уже нельзя
 				brokenPipe := isBrokenPipe(err)
 
-				// Безопасный дамп запроса (без body, с редактированием секретов)
-				reqDump := dumpRequestSafe(c.Request)
-
 				// Стек для логов
 				stack := debug.Stack()
 
-				logger.Debugf("[PANIC] %s | %s %s | brokenPipe=%t | err=%v\nRequest:\n%s\nStack:\n%s",
-					time.Since(start), c.Request.Method, c.Request.URL.String(),
-					brokenPipe, err, reqDump, stack,
-				)
+				// Коррелируем по X-Request-ID, который выставляет RequestID()
+				reqID := GetRequestID(c)
+				if reqID == "" {
+					reqID = "-"
+				}
+
+				// Начало тела, прочитанное обработчиком до паники
+				body, bodyTruncated := capturedRequestBody(c)
+
+				// Безопасный дамп запроса (без body, с редактированием секретов)
+				reqDump := dumpRequestSafe(c.Request)
+				headers := redactedHeaders(c.Request)
+
+				if logger.IsJSON() {
+					// В JSON-режиме пишем структурированные поля, заголовки — отдельной картой
+					logger.LogAttrs(logging.DEBUG, "panic recovered",
+						slog.String("requestId", reqID),
+						slog.String("method", c.Request.Method),
+						slog.String("path", c.Request.URL.Path),
+						slog.Int("status", http.StatusInternalServerError),
+						slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+						slog.String("client_ip", ClientIP(c)),
+						slog.String("error", err.Error()),
+						slog.Bool("brokenPipe", brokenPipe),
+						slog.Any("headers", headers),
+						slog.String("body", body),
+						slog.Bool("bodyTruncated", bodyTruncated),
+						slog.String("stack", string(stack)),
+					)
+				} else {
+					logDump := reqDump
+					if body != "" {
+						logDump += "\n\n" + body
+						if bodyTruncated {
+							logDump += "…"
+						}
+					}
+
+					logger.Debugf("[PANIC] requestId=%s | %s | %s %s | brokenPipe=%t | err=%v\nRequest:\n%s\nStack:\n%s",
+						reqID, time.Since(start), c.Request.Method, RedactURL(c.Request.URL),
+						brokenPipe, err, logDump, stack,
+					)
+				}
+
+				event := PanicEvent{
+					Time:       time.Now(),
+					RequestID:  GetRequestID(c),
+					Method:     c.Request.Method,
+					Path:       c.Request.URL.Path,
+					URL:        RedactURL(c.Request.URL),
+					Route:      c.FullPath(),
+					Error:      err.Error(),
+					Stack:      string(stack),
+					BrokenPipe: brokenPipe,
+					Request:    reqDump,
+					Headers:    headers,
+
+					Body:          body,
+					BodyTruncated: bodyTruncated,
+				}
+				recentPanics.push(event)
+				metrics.IncPanics()
+				notifyPanic(event)
 
 				if brokenPipe {
 					// Ничего не пишем в ответ — соединение уже мёртвое
@@ -52,14 +181,8 @@ func RecoveryJSON() gin.HandlerFunc {
 					return
 				}
 
-				// Коррелируем по X-Request-ID, если есть
-				reqID := c.GetHeader("X-Request-ID")
-
-				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
-					"error":     "internal_error",
-					"message":   "Something went wrong",
-					"requestId": reqID,
-				})
+				locale.ErrorJSON(c, http.StatusInternalServerError, locale.ErrInternal, nil)
+				c.Abort()
 			}
 		}()
 
@@ -67,45 +190,43 @@ func RecoveryJSON() gin.HandlerFunc {
 	}
 }
 
-func dumpRequestSafe(r *http.Request) string {
-	// Клонируем заголовки и редактируем чувствительные
-	redacted := r.Header.Clone()
-	for _, h := range []string{
-		"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie",
-		"X-Api-Key", "X-Auth-Token",
-	} {
-		if redacted.Get(h) != "" {
-			redacted.Set(h, "***REDACTED***")
-		}
+// classifyAbort возвращает, почему запрос оборван клиентом или сервером без
+// ошибки в коде: "aborted" для http.ErrAbortHandler, "canceled" для отменённого
+// контекста (браузер ушёл со страницы) или истёкшего срока, и "" для настоящей
+// паники. Обёрнутые ошибки тоже узнаются.
+func classifyAbort(err error) string {
+	switch {
+	case errors.Is(err, http.ErrAbortHandler):
+		return "aborted"
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return "canceled"
 	}
+	return ""
+}
 
-	// Поверхностная копия запроса с отредактированными заголовками
-	r2 := new(http.Request)
-	*r2 = *r
-	r2.Header = redacted
-
-	// Body намеренно не читаем — это может сломать хендлеры ниже по цепочке
-	dump, err := httputil.DumpRequest(r2, false)
-	if err != nil {
-		return fmt.Sprintf("could not dump request: %v", err)
+// logAbort пишет одну строку INFO об оборванном запросе, без стека и дампа.
+func logAbort(c *gin.Context, kind string, err error, start time.Time) {
+	reqID := GetRequestID(c)
+	if reqID == "" {
+		reqID = "-"
+	}
+	if logger.IsJSON() {
+		logger.LogAttrs(logging.INFO, "request "+kind,
+			slog.String("requestId", reqID),
+			slog.String("method", c.Request.Method),
+			slog.String("path", c.Request.URL.Path),
+			slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.String("client_ip", ClientIP(c)),
+			slog.String("error", err.Error()),
+		)
+		return
 	}
-	return strings.TrimSpace(string(dump))
+	logger.Infof("request %s: requestId=%s | %s | %s %s | %v",
+		kind, reqID, time.Since(start), c.Request.Method, RedactURL(c.Request.URL), err)
 }
 
+// isBrokenPipe узнаёт закрытое клиентом соединение по ошибке ОС, а не по тексту,
+// который бывает обёрнут или переведён.
 func isBrokenPipe(err error) bool {
-	if err == nil {
-		return false
-	}
-	// Чаще всего прячется внутри *net.OpError; универсальная проверка по сообщению
-	var ne *net.OpError
-	if errors.As(err, &ne) {
-		if ne.Err != nil {
-			s := strings.ToLower(ne.Err.Error())
-			return strings.Contains(s, "broken pipe") ||
-				strings.Contains(s, "connection reset by peer")
-		}
-	}
-	s := strings.ToLower(err.Error())
-	return strings.Contains(s, "broken pipe") ||
-		strings.Contains(s, "connection reset by peer")
+	return errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET)
 }
@@ -0,0 +1,229 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"x-ui/logger"
+
+	"github.com/gin-gonic/gin"
+	"github.com/op/go-logging"
+)
+
+func TestClassifyAbort(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"abort handler", http.ErrAbortHandler, "aborted"},
+		{"wrapped abort handler", fmt.Errorf("copy: %w", http.ErrAbortHandler), "aborted"},
+		{"canceled", context.Canceled, "canceled"},
+		{"wrapped canceled", fmt.Errorf("query: %w", context.Canceled), "canceled"},
+		{"deadline", context.DeadlineExceeded, "canceled"},
+		{"panic", errors.New("index out of range"), ""},
+		{"broken pipe", syscall.EPIPE, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := classifyAbort(test.err); got != test.want {
+				t.Errorf("classifyAbort(%v) = %q, want %q", test.err, got, test.want)
+			}
+		})
+	}
+}
+
+func TestIsBrokenPipe(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"epipe", syscall.EPIPE, true},
+		{"reset", syscall.ECONNRESET, true},
+		{"op error", &net.OpError{Op: "write", Err: os.NewSyscallError("write", syscall.EPIPE)}, true},
+		{"text only", errors.New("write: broken pipe"), false},
+		{"other", errors.New("boom"), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isBrokenPipe(test.err); got != test.want {
+				t.Errorf("isBrokenPipe(%v) = %v, want %v", test.err, got, test.want)
+			}
+		})
+	}
+}
+
+func recoveryServer(t *testing.T, handler gin.HandlerFunc) *httptest.Server {
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.Use(RequestID())
+	engine.Use(RecoveryJSON())
+	engine.GET("/", handler)
+	server := httptest.NewServer(engine)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestRecoveryJSONPanic(t *testing.T) {
+	server := recoveryServer(t, func(c *gin.Context) {
+		panic("boom")
+	})
+	before := len(RecentPanics())
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("status = %d, want 500", resp.StatusCode)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if len(body) == 0 || body[0] != '{' {
+		t.Errorf("body = %q, want JSON", body)
+	}
+	if len(RecentPanics()) != before+1 {
+		t.Error("the panic was not recorded")
+	}
+}
+
+func TestRecoveryJSONAbortHandler(t *testing.T) {
+	server := recoveryServer(t, func(c *gin.Context) {
+		c.Writer.WriteHeader(http.StatusOK)
+		c.Writer.WriteString("partial")
+		c.Writer.Flush()
+		panic(http.ErrAbortHandler)
+	})
+	before := len(RecentPanics())
+	resp, err := http.Get(server.URL)
+	if err == nil {
+		// The headers went out, the body must end in an error, not look whole
+		_, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	if err == nil {
+		t.Error("the aborted response was read as complete")
+	}
+	if len(RecentPanics()) != before {
+		t.Error("an aborted request was recorded as a panic")
+	}
+}
+
+func TestRecoveryJSONCanceled(t *testing.T) {
+	server := recoveryServer(t, func(c *gin.Context) {
+		panic(fmt.Errorf("query: %w", context.Canceled))
+	})
+	before := len(RecentPanics())
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusInternalServerError {
+		t.Error("a canceled request was answered as a panic")
+	}
+	if len(RecentPanics()) != before {
+		t.Error("a canceled request was recorded as a panic")
+	}
+}
+
+func TestRecoveryJSONRecordsRedactedRequest(t *testing.T) {
+	server := recoveryServer(t, func(c *gin.Context) {
+		panic("boom")
+	})
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/?token=s3cr3t&page=2", nil)
+	req.Header.Set("Authorization", "Bearer s3cr3t")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	event := RecentPanics()[0]
+	for name, value := range map[string]string{"url": event.URL, "request": event.Request, "authorization": event.Headers["Authorization"]} {
+		if strings.Contains(value, "s3cr3t") {
+			t.Errorf("%s leaks the secret: %q", name, value)
+		}
+	}
+	if want := "/?token=" + redactedValue + "&page=2"; event.URL != want {
+		t.Errorf("URL = %q, want %q", event.URL, want)
+	}
+	if !strings.HasPrefix(event.Request, "GET /?token=") || !strings.Contains(event.Request, "Authorization: "+redactedValue) {
+		t.Errorf("Request = %q, want the request line and redacted headers", event.Request)
+	}
+	if event.Headers["Host"] == "" {
+		t.Error("Headers miss the host")
+	}
+}
+
+func TestRecoveryJSONStructuredLog(t *testing.T) {
+	// The JSON logger writes to the stderr it was created with
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stderr := os.Stderr
+	os.Stderr = w
+	logger.InitLogger(logging.DEBUG)
+	logger.SetFormat("json")
+	os.Stderr = stderr
+	output := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(r)
+		output <- data
+	}()
+
+	server := recoveryServer(t, func(c *gin.Context) {
+		panic("boom")
+	})
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/?token=s3cr3t", nil)
+	req.Header.Set("Authorization", "Bearer s3cr3t")
+	req.Header.Set("Cookie", "3x-ui=s3cr3t")
+	resp, err := http.DefaultClient.Do(req)
+	if err == nil {
+		resp.Body.Close()
+	}
+
+	logger.SetFormat("text")
+	logger.InitLogger(logging.INFO)
+	w.Close()
+	data := <-output
+	server.Close()
+
+	var panicRecord map[string]any
+	for _, record := range scanJSONLines(t, data) {
+		if record["msg"] == "panic recovered" {
+			panicRecord = record
+		}
+	}
+	if panicRecord == nil {
+		t.Fatalf("no panic record in:\n%s", data)
+	}
+	for _, key := range []string{"ts", "level", "requestId", "method", "path", "status", "duration_ms", "client_ip", "error", "stack"} {
+		if _, ok := panicRecord[key]; !ok {
+			t.Errorf("the panic record misses %q", key)
+		}
+	}
+	if stack, _ := panicRecord["stack"].(string); !strings.Contains(stack, "\n") {
+		t.Error("the stack is not kept as one string")
+	}
+	headers, ok := panicRecord["headers"].(map[string]any)
+	if !ok {
+		t.Fatalf("headers are not a map: %v", panicRecord["headers"])
+	}
+	if headers["Authorization"] != redactedValue {
+		t.Errorf("Authorization = %v, want it redacted", headers["Authorization"])
+	}
+	if strings.Contains(string(data), "s3cr3t") {
+		t.Errorf("a secret leaked into the structured log:\n%s", data)
+	}
+}
@@ -0,0 +1,200 @@
+package middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"x-ui/logger"
+)
+
+const redactedValue = "***REDACTED***"
+
+var sensitiveHeaders = []string{
+	"Authorization", "Proxy-Authorization", "X-Api-Key", "X-Auth-Token",
+}
+
+// sensitiveKeys are query parameters and JSON body keys whose values are never logged.
+// Matching is case-insensitive.
+var sensitiveKeys = map[string]struct{}{
+	"token":    {},
+	"password": {},
+	"secret":   {},
+	"subid":    {},
+	"otp":      {},
+	// The Reality key of the inbounds, in the stream settings they are saved with
+	"privatekey": {},
+}
+
+// sensitiveText matches the values of the sensitive keys in free text, like
+// "password=x", "token: x" or "\"secret\":\"x\"", and bearer credentials.
+var sensitiveText = func() *regexp.Regexp {
+	keys := make([]string, 0, len(sensitiveKeys))
+	for key := range sensitiveKeys {
+		keys = append(keys, regexp.QuoteMeta(key))
+	}
+	sort.Strings(keys)
+	return regexp.MustCompile(`(?i)(\b(?:` + strings.Join(keys, "|") + `)["']?\s*[:=]\s*["']?|\bbearer\s+)([^\s"'&,;]+)`)
+}()
+
+func init() {
+	logger.SetRedactor(RedactText)
+}
+
+// RedactText replaces the values of sensitive keys and bearer credentials in a
+// log message, keeping the keys.
+func RedactText(text string) string {
+	return sensitiveText.ReplaceAllString(text, "${1}"+redactedValue)
+}
+
+func isSensitiveKey(key string) bool {
+	_, ok := sensitiveKeys[strings.ToLower(key)]
+	return ok
+}
+
+// redactHeader clones the headers, hides credentials and redacts cookie values
+// one by one so the cookie names stay visible.
+func redactHeader(h http.Header) http.Header {
+	redacted := h.Clone()
+	for _, name := range sensitiveHeaders {
+		if redacted.Get(name) != "" {
+			redacted.Set(name, redactedValue)
+		}
+	}
+	if values := redacted.Values("Cookie"); len(values) > 0 {
+		redacted.Del("Cookie")
+		for _, v := range values {
+			redacted.Add("Cookie", redactCookies(v))
+		}
+	}
+	if values := redacted.Values("Set-Cookie"); len(values) > 0 {
+		redacted.Del("Set-Cookie")
+		for _, v := range values {
+			redacted.Add("Set-Cookie", redactSetCookie(v))
+		}
+	}
+	return redacted
+}
+
+// redactCookies turns "a=1; b=2" into "a=***REDACTED***; b=***REDACTED***".
+func redactCookies(header string) string {
+	parts := strings.Split(header, ";")
+	for i, part := range parts {
+		name, _, _ := strings.Cut(strings.TrimSpace(part), "=")
+		parts[i] = name + "=" + redactedValue
+	}
+	return strings.Join(parts, "; ")
+}
+
+// redactSetCookie hides only the cookie value and keeps the attributes.
+func redactSetCookie(header string) string {
+	cookie, attrs, _ := strings.Cut(header, ";")
+	name, _, _ := strings.Cut(strings.TrimSpace(cookie), "=")
+	if attrs != "" {
+		return name + "=" + redactedValue + ";" + attrs
+	}
+	return name + "=" + redactedValue
+}
+
+// RedactQuery replaces the values of sensitive query parameters, keeping their names.
+func RedactQuery(rawQuery string) string {
+	if rawQuery == "" {
+		return ""
+	}
+	parts := strings.Split(rawQuery, "&")
+	for i, part := range parts {
+		key, _, hasValue := strings.Cut(part, "=")
+		name, err := url.QueryUnescape(key)
+		if err != nil {
+			name = key
+		}
+		if hasValue && isSensitiveKey(name) {
+			parts[i] = key + "=" + redactedValue
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// RedactURL returns the request URI with sensitive query values redacted.
+func RedactURL(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	u2 := *u
+	u2.RawQuery = RedactQuery(u.RawQuery)
+	u2.User = nil
+	return u2.String()
+}
+
+// RedactJSONBody redacts the values of sensitive top-level keys of a JSON object.
+// Anything that isn't a JSON object is returned unchanged.
+func RedactJSONBody(body []byte) (out []byte) {
+	defer func() {
+		if recover() != nil {
+			out = []byte(redactedValue)
+		}
+	}()
+
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(body, &obj); err != nil {
+		return body
+	}
+	changed := false
+	redacted, _ := json.Marshal(redactedValue)
+	for key := range obj {
+		if isSensitiveKey(key) {
+			obj[key] = redacted
+			changed = true
+		}
+	}
+	if !changed {
+		return body
+	}
+	out, err := json.Marshal(obj)
+	if err != nil {
+		return body
+	}
+	return out
+}
+
+// redactedHeaders returns the request headers as a map for structured logs.
+func redactedHeaders(r *http.Request) map[string]string {
+	redacted := redactHeader(r.Header)
+	headers := make(map[string]string, len(redacted)+1)
+	headers["Host"] = r.Host
+	for name, values := range redacted {
+		headers[name] = strings.Join(values, ", ")
+	}
+	return headers
+}
+
+// dumpRequestSafe dumps the request line and headers with secrets redacted.
+// The body is never read since that could break the handlers down the chain.
+func dumpRequestSafe(r *http.Request) (dump string) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			dump = fmt.Sprintf("could not dump request: %v", rec)
+		}
+	}()
+
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.Header = redactHeader(r.Header)
+	r2.RequestURI = ""
+	if r.URL != nil {
+		u := *r.URL
+		u.RawQuery = RedactQuery(r.URL.RawQuery)
+		r2.URL = &u
+	}
+
+	b, err := httputil.DumpRequest(r2, false)
+	if err != nil {
+		return fmt.Sprintf("could not dump request: %v", err)
+	}
+	return strings.TrimSpace(string(b))
+}
@@ -0,0 +1,55 @@
+package middleware
+
+import (
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	RequestIDHeader = "X-Request-ID"
+	requestIDKey    = "request_id"
+	maxRequestIDLen = 128
+)
+
+// RequestID takes the X-Request-ID header from the incoming request or generates
+// a new UUIDv4 when it is absent, stores it in the gin context and echoes it back
+// on the response so logs and clients can be correlated.
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		reqID := sanitizeRequestID(c.GetHeader(RequestIDHeader))
+		if reqID == "" {
+			reqID = uuid.NewString()
+		}
+		c.Set(requestIDKey, reqID)
+		c.Header(RequestIDHeader, reqID)
+		c.Next()
+	}
+}
+
+// GetRequestID returns the request id assigned by RequestID, or an empty string
+// if the middleware was not applied.
+func GetRequestID(c *gin.Context) string {
+	if v, ok := c.Get(requestIDKey); ok {
+		if reqID, ok := v.(string); ok {
+			return reqID
+		}
+	}
+	return ""
+}
+
+// sanitizeRequestID drops ids that are too long or contain characters that would
+// break log lines or response headers.
+func sanitizeRequestID(id string) string {
+	id = strings.TrimSpace(id)
+	if id == "" || len(id) > maxRequestIDLen {
+		return ""
+	}
+	for _, r := range id {
+		if r < 0x21 || r > 0x7e {
+			return ""
+		}
+	}
+	return id
+}
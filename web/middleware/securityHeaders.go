@@ -0,0 +1,146 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DefaultCSP is the Content-Security-Policy of the panel pages. The pages use
+// inline scripts and compile Vue templates at runtime, hence the unsafe sources.
+const DefaultCSP = "default-src 'self'; script-src 'self' 'unsafe-inline' 'unsafe-eval'; " +
+	"style-src 'self' 'unsafe-inline'; img-src 'self' data: blob:; font-src 'self' data:; " +
+	"connect-src 'self'; object-src 'none'; base-uri 'self'; form-action 'self'"
+
+const hstsValue = "max-age=15552000"
+
+// turnstileOrigin serves the script and the frame of the Turnstile login
+// challenge
+const turnstileOrigin = "https://challenges.cloudflare.com"
+
+// SecurityHeadersConfig selects the security headers of the responses; an empty
+// or false field leaves its header out.
+type SecurityHeadersConfig struct {
+	HSTS           bool   // only sent over TLS
+	NoSniff        bool   // X-Content-Type-Options
+	ReferrerPolicy string // e.g. "strict-origin-when-cross-origin"
+	FrameOptions   string // "DENY" or "SAMEORIGIN", also sets frame-ancestors
+	CSP            string // policy template, see DefaultCSP
+	CSPScriptSrc   string // sources appended to script-src
+	CSPStyleSrc    string // sources appended to style-src
+	Turnstile      bool   // allows the script and the frame of Turnstile
+}
+
+// ForSubscription returns the relaxed profile of the subscription server. Some
+// clients fail on a policy meant for browsers, so only transport headers are kept.
+func (c SecurityHeadersConfig) ForSubscription() SecurityHeadersConfig {
+	return SecurityHeadersConfig{
+		HSTS:    c.HSTS,
+		NoSniff: c.NoSniff,
+	}
+}
+
+func (c *SecurityHeadersConfig) Validate() error {
+	switch c.FrameOptions {
+	case "", "DENY", "SAMEORIGIN":
+	default:
+		return fmt.Errorf("frame options must be DENY or SAMEORIGIN: %s", c.FrameOptions)
+	}
+	for _, value := range []string{c.ReferrerPolicy, c.CSP, c.CSPScriptSrc, c.CSPStyleSrc} {
+		if strings.ContainsAny(value, "\r\n") {
+			return errors.New("security headers must not contain line breaks")
+		}
+	}
+	if strings.Contains(c.CSPScriptSrc, ";") || strings.Contains(c.CSPStyleSrc, ";") {
+		return errors.New("extra CSP sources must not contain ;")
+	}
+	return nil
+}
+
+// Policy assembles the Content-Security-Policy from the template, the extra
+// sources and the frame options.
+func (c *SecurityHeadersConfig) Policy() string {
+	if strings.TrimSpace(c.CSP) == "" {
+		return ""
+	}
+	scriptSrc := c.CSPScriptSrc
+	if c.Turnstile {
+		scriptSrc = strings.TrimSpace(scriptSrc + " " + turnstileOrigin)
+	}
+	var directives []string
+	found := map[string]bool{}
+	for _, directive := range strings.Split(c.CSP, ";") {
+		directive = strings.TrimSpace(directive)
+		if directive == "" {
+			continue
+		}
+		name, _, _ := strings.Cut(directive, " ")
+		name = strings.ToLower(name)
+		found[name] = true
+		switch name {
+		case "script-src":
+			directive = strings.TrimSpace(directive + " " + scriptSrc)
+		case "frame-src":
+			if c.Turnstile {
+				directive += " " + turnstileOrigin
+			}
+		case "style-src":
+			directive = strings.TrimSpace(directive + " " + c.CSPStyleSrc)
+		}
+		directives = append(directives, directive)
+	}
+	if !found["script-src"] && scriptSrc != "" {
+		directives = append(directives, "script-src 'self' "+strings.TrimSpace(scriptSrc))
+	}
+	if !found["frame-src"] && c.Turnstile {
+		directives = append(directives, "frame-src 'self' "+turnstileOrigin)
+	}
+	if !found["style-src"] && strings.TrimSpace(c.CSPStyleSrc) != "" {
+		directives = append(directives, "style-src 'self' "+strings.TrimSpace(c.CSPStyleSrc))
+	}
+	if !found["frame-ancestors"] {
+		switch c.FrameOptions {
+		case "DENY":
+			directives = append(directives, "frame-ancestors 'none'")
+		case "SAMEORIGIN":
+			directives = append(directives, "frame-ancestors 'self'")
+		}
+	}
+	return strings.Join(directives, "; ")
+}
+
+func isWebSocketUpgrade(c *gin.Context) bool {
+	return strings.EqualFold(c.GetHeader("Upgrade"), "websocket") &&
+		strings.Contains(strings.ToLower(c.GetHeader("Connection")), "upgrade")
+}
+
+// SecurityHeaders sets the configured security headers before the handler runs,
+// on every response except websocket upgrades.
+func SecurityHeaders(config SecurityHeadersConfig) gin.HandlerFunc {
+	policy := config.Policy()
+	return func(c *gin.Context) {
+		if isWebSocketUpgrade(c) {
+			c.Next()
+			return
+		}
+		h := c.Writer.Header()
+		if config.HSTS && c.Request.TLS != nil {
+			h.Set("Strict-Transport-Security", hstsValue)
+		}
+		if config.NoSniff {
+			h.Set("X-Content-Type-Options", "nosniff")
+		}
+		if config.ReferrerPolicy != "" {
+			h.Set("Referrer-Policy", config.ReferrerPolicy)
+		}
+		if config.FrameOptions != "" {
+			h.Set("X-Frame-Options", config.FrameOptions)
+		}
+		if policy != "" {
+			h.Set("Content-Security-Policy", policy)
+		}
+		c.Next()
+	}
+}
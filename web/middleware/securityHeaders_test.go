@@ -0,0 +1,142 @@
+package middleware
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+var fullSecurityHeaders = SecurityHeadersConfig{
+	HSTS:           true,
+	NoSniff:        true,
+	ReferrerPolicy: "strict-origin-when-cross-origin",
+	FrameOptions:   "DENY",
+	CSP:            DefaultCSP,
+}
+
+func securityHeadersEngine(config SecurityHeadersConfig) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.Use(SecurityHeaders(config))
+	engine.GET("/panel", func(c *gin.Context) { c.Data(http.StatusOK, "text/html", []byte("<html></html>")) })
+	engine.GET("/panel/api/status", func(c *gin.Context) { c.JSON(http.StatusOK, gin.H{"success": true}) })
+	engine.GET("/ws", func(c *gin.Context) { c.Status(http.StatusSwitchingProtocols) })
+	return engine
+}
+
+func securityHeadersOf(engine *gin.Engine, req *http.Request) http.Header {
+	rec := httptest.NewRecorder()
+	engine.ServeHTTP(rec, req)
+	return rec.Header()
+}
+
+func TestSecurityHeadersOnPagesAndAPI(t *testing.T) {
+	engine := securityHeadersEngine(fullSecurityHeaders)
+	for _, path := range []string{"/panel", "/panel/api/status"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.TLS = &tls.ConnectionState{}
+		h := securityHeadersOf(engine, req)
+		for name, want := range map[string]string{
+			"Strict-Transport-Security": hstsValue,
+			"X-Content-Type-Options":    "nosniff",
+			"Referrer-Policy":           "strict-origin-when-cross-origin",
+			"X-Frame-Options":           "DENY",
+		} {
+			if got := h.Get(name); got != want {
+				t.Errorf("%s: %s = %q, want %q", path, name, got, want)
+			}
+		}
+		if csp := h.Get("Content-Security-Policy"); !strings.Contains(csp, "frame-ancestors 'none'") {
+			t.Errorf("%s: CSP %q misses frame-ancestors", path, csp)
+		}
+	}
+}
+
+func TestSecurityHeadersHSTSOnlyOverTLS(t *testing.T) {
+	engine := securityHeadersEngine(fullSecurityHeaders)
+	h := securityHeadersOf(engine, httptest.NewRequest(http.MethodGet, "/panel", nil))
+	if h.Get("Strict-Transport-Security") != "" {
+		t.Error("HSTS was sent over plain HTTP")
+	}
+	if h.Get("X-Content-Type-Options") == "" {
+		t.Error("the other headers are missing over plain HTTP")
+	}
+}
+
+func TestSecurityHeadersSkipWebSocket(t *testing.T) {
+	engine := securityHeadersEngine(fullSecurityHeaders)
+	req := httptest.NewRequest(http.MethodGet, "/ws", nil)
+	req.TLS = &tls.ConnectionState{}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "keep-alive, Upgrade")
+	h := securityHeadersOf(engine, req)
+	for _, name := range []string{"Strict-Transport-Security", "X-Content-Type-Options", "Referrer-Policy", "X-Frame-Options", "Content-Security-Policy"} {
+		if h.Get(name) != "" {
+			t.Errorf("%s was sent on a websocket upgrade", name)
+		}
+	}
+}
+
+func TestSecurityHeadersOffSwitches(t *testing.T) {
+	engine := securityHeadersEngine(SecurityHeadersConfig{NoSniff: true})
+	req := httptest.NewRequest(http.MethodGet, "/panel", nil)
+	req.TLS = &tls.ConnectionState{}
+	h := securityHeadersOf(engine, req)
+	if h.Get("X-Content-Type-Options") != "nosniff" {
+		t.Error("the enabled header is missing")
+	}
+	for _, name := range []string{"Strict-Transport-Security", "Referrer-Policy", "X-Frame-Options", "Content-Security-Policy"} {
+		if h.Get(name) != "" {
+			t.Errorf("%s was sent though it is off", name)
+		}
+	}
+}
+
+func TestSecurityHeadersForSubscription(t *testing.T) {
+	sub := fullSecurityHeaders.ForSubscription()
+	if !sub.HSTS || !sub.NoSniff || sub.CSP != "" || sub.FrameOptions != "" || sub.ReferrerPolicy != "" {
+		t.Errorf("the subscription profile is %+v", sub)
+	}
+}
+
+func TestSecurityHeadersPolicy(t *testing.T) {
+	config := SecurityHeadersConfig{
+		CSP:          "default-src 'self'; script-src 'self'",
+		CSPScriptSrc: "https://cdn.example.com",
+		CSPStyleSrc:  "https://fonts.example.com",
+		FrameOptions: "SAMEORIGIN",
+		Turnstile:    true,
+	}
+	want := "default-src 'self'; script-src 'self' https://cdn.example.com " + turnstileOrigin +
+		"; frame-src 'self' " + turnstileOrigin + "; style-src 'self' https://fonts.example.com; frame-ancestors 'self'"
+	if got := config.Policy(); got != want {
+		t.Errorf("Policy() =\n%s\nwant\n%s", got, want)
+	}
+
+	config = SecurityHeadersConfig{CSP: "default-src 'none'; frame-ancestors https://embed.example.com", FrameOptions: "DENY"}
+	if got := config.Policy(); strings.Contains(got, "'none'; frame-ancestors 'none'") || !strings.Contains(got, "frame-ancestors https://embed.example.com") {
+		t.Errorf("the frame-ancestors of the template were overridden: %s", got)
+	}
+	if got := (&SecurityHeadersConfig{CSP: "  ", CSPScriptSrc: "https://cdn.example.com"}).Policy(); got != "" {
+		t.Errorf("an empty template gave the policy %q", got)
+	}
+}
+
+func TestSecurityHeadersValidate(t *testing.T) {
+	for _, config := range []SecurityHeadersConfig{
+		{FrameOptions: "ALLOW-FROM https://example.com"},
+		{ReferrerPolicy: "no-referrer\r\nX-Injected: 1"},
+		{CSPScriptSrc: "https://a.example.com; object-src *"},
+	} {
+		if err := config.Validate(); err == nil {
+			t.Errorf("%+v is valid", config)
+		}
+	}
+	if err := fullSecurityHeaders.Validate(); err != nil {
+		t.Errorf("the full profile is invalid: %v", err)
+	}
+}
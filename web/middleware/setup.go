@@ -0,0 +1,35 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+
+	"x-ui/web/locale"
+
+	"github.com/gin-gonic/gin"
+)
+
+// FirstRun sends everyone to the setup while pending reports that the panel
+// is not set up yet, except for requests exempt lets through. Browsers are
+// redirected to setupPath, everything else gets 403.
+func FirstRun(pending func() bool, exempt func(c *gin.Context) bool, setupPath func(c *gin.Context) string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if exempt(c) || !pending() {
+			c.Next()
+			return
+		}
+		path := setupPath(c)
+		c.Header("Cache-Control", "no-store")
+		if c.Request.Method == http.MethodGet && strings.Contains(c.GetHeader("Accept"), "text/html") && c.GetHeader("X-Requested-With") == "" {
+			c.Redirect(http.StatusTemporaryRedirect, path)
+			c.Abort()
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusForbidden, locale.ErrorResponse{
+			Msg:       locale.ErrSetupRequired.Message(c, "Path=="+path),
+			Code:      locale.ErrSetupRequired,
+			Obj:       gin.H{"setup": path},
+			RequestId: GetRequestID(c),
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package middleware
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"x-ui/database"
+	"x-ui/logger"
+	"x-ui/web/metrics"
+
+	"github.com/gin-gonic/gin"
+	"github.com/op/go-logging"
+)
+
+// SlowRoute is the threshold of the requests whose path, relative to the base
+// path, starts with Prefix.
+type SlowRoute struct {
+	Prefix    string
+	Threshold time.Duration
+}
+
+// SlowRequestConfig is when a request is slow enough to be logged: after the
+// threshold of the longest prefix of Routes its path starts with, or after
+// Threshold. A threshold of 0 logs none.
+type SlowRequestConfig struct {
+	BasePath  string
+	Threshold time.Duration
+	Routes    []SlowRoute
+}
+
+// ParseSlowRoutes parses comma separated "prefix=milliseconds" thresholds,
+// the longest prefix first.
+func ParseSlowRoutes(value string) ([]SlowRoute, error) {
+	routes := []SlowRoute{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		prefix, ms, ok := strings.Cut(item, "=")
+		prefix = strings.TrimPrefix(strings.TrimSpace(prefix), "/")
+		threshold, err := strconv.Atoi(strings.TrimSpace(ms))
+		if !ok || prefix == "" || err != nil || threshold < 0 {
+			return nil, fmt.Errorf("%q must be a path prefix=milliseconds", item)
+		}
+		routes = append(routes, SlowRoute{Prefix: prefix, Threshold: time.Duration(threshold) * time.Millisecond})
+	}
+	slices.SortStableFunc(routes, func(a, b SlowRoute) int { return len(b.Prefix) - len(a.Prefix) })
+	return routes, nil
+}
+
+// threshold returns the threshold of the requests to path.
+func (c *SlowRequestConfig) threshold(path string) time.Duration {
+	if len(c.Routes) == 0 {
+		return c.Threshold
+	}
+	rel := strings.TrimPrefix(path, strings.TrimSuffix(c.BasePath, "/"))
+	rel = strings.TrimPrefix(rel, "/")
+	for _, route := range c.Routes {
+		if strings.HasPrefix(rel, route.Prefix) {
+			return route.Threshold
+		}
+	}
+	return c.Threshold
+}
+
+// SlowRequests times every request for the rolling quantiles of the durations
+// of its route, and logs a warning about the ones slower than their threshold:
+// with the time their queries took if the context of the request carries a
+// database.QueryTimer, and whether a traffic flush had to wait meanwhile. The
+// requests that are not slow cost a few atomic operations.
+func SlowRequests(config SlowRequestConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		contentions := metrics.FlushContentions()
+
+		c.Next()
+
+		elapsed := time.Since(start)
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		metrics.ObserveLatency(c.Request.Method, route, elapsed)
+
+		threshold := config.threshold(c.Request.URL.Path)
+		if threshold <= 0 || elapsed < threshold {
+			return
+		}
+		contended := metrics.FlushContentions() != contentions
+		reqID := GetRequestID(c)
+		if reqID == "" {
+			reqID = "-"
+		}
+		durationMs := float64(elapsed.Microseconds()) / 1000
+		dbMs := -1.0
+		if timer := database.QueryTimerOf(c.Request.Context()); timer != nil {
+			dbMs = float64(timer.Duration().Microseconds()) / 1000
+		}
+
+		if logger.IsJSON() {
+			attrs := []slog.Attr{
+				slog.String("requestId", reqID),
+				slog.String("method", c.Request.Method),
+				slog.String("route", route),
+				slog.Int("status", c.Writer.Status()),
+				slog.Float64("duration_ms", durationMs),
+				slog.Float64("threshold_ms", float64(threshold.Milliseconds())),
+				slog.Bool("flush_contended", contended),
+			}
+			if dbMs >= 0 {
+				attrs = append(attrs, slog.Float64("db_ms", dbMs))
+			}
+			logger.LogAttrs(logging.WARNING, "slow request", attrs...)
+			return
+		}
+		db := "-"
+		if dbMs >= 0 {
+			db = strconv.FormatFloat(dbMs, 'f', 3, 64) + "ms"
+		}
+		logger.Warningf("slow request requestId=%s method=%s route=%s status=%d duration=%.3fms threshold=%dms db=%s flushContended=%t",
+			reqID, c.Request.Method, route, c.Writer.Status(), durationMs, threshold.Milliseconds(), db, contended)
+	}
+}
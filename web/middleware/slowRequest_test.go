@@ -0,0 +1,151 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"x-ui/logger"
+	"x-ui/web/metrics"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestParseSlowRoutes(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []SlowRoute
+		err   bool
+	}{
+		{"", []SlowRoute{}, false},
+		{" /panel/api/=500 , sub/=2000,panel/api/inbounds/list=100 ", []SlowRoute{
+			{"panel/api/inbounds/list", 100 * time.Millisecond},
+			{"panel/api/", 500 * time.Millisecond},
+			{"sub/", 2 * time.Second},
+		}, false},
+		{"panel/=0", []SlowRoute{{"panel/", 0}}, false},
+		{"panel/", nil, true},
+		{"=100", nil, true},
+		{"panel/=fast", nil, true},
+		{"panel/=-1", nil, true},
+	}
+	for _, test := range tests {
+		routes, err := ParseSlowRoutes(test.value)
+		if (err != nil) != test.err {
+			t.Errorf("ParseSlowRoutes(%q) error = %v, want error %v", test.value, err, test.err)
+			continue
+		}
+		if !test.err && !slices.Equal(routes, test.want) {
+			t.Errorf("ParseSlowRoutes(%q) = %v, want %v", test.value, routes, test.want)
+		}
+	}
+}
+
+func TestSlowRequestThreshold(t *testing.T) {
+	routes, _ := ParseSlowRoutes("panel/api/=500,panel/api/inbounds/list=100,sub/=0")
+	config := SlowRequestConfig{BasePath: "/base/", Threshold: time.Second, Routes: routes}
+	tests := []struct {
+		path string
+		want time.Duration
+	}{
+		{"/base/panel/api/inbounds/list", 100 * time.Millisecond},
+		{"/base/panel/api/inbounds/get/1", 500 * time.Millisecond},
+		{"/base/sub/abc", 0},
+		{"/base/panel/settings", time.Second},
+		{"/base", time.Second},
+	}
+	for _, test := range tests {
+		if got := config.threshold(test.path); got != test.want {
+			t.Errorf("threshold(%q) = %v, want %v", test.path, got, test.want)
+		}
+	}
+	if got := (&SlowRequestConfig{Threshold: time.Second}).threshold("/panel/api/inbounds/list"); got != time.Second {
+		t.Errorf("without routes the threshold is %v, want 1s", got)
+	}
+}
+
+// slowRequestLogged tells whether a slow request to route was logged.
+func slowRequestLogged(route string) bool {
+	for _, line := range logger.GetLogs(100, "WARNING") {
+		if strings.Contains(line, "slow request") && strings.Contains(line, "route="+route+" ") {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSlowRequests(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.Use(SlowRequests(SlowRequestConfig{
+		BasePath:  "/",
+		Threshold: 50 * time.Millisecond,
+		Routes:    []SlowRoute{{Prefix: "fast/", Threshold: 5 * time.Millisecond}, {Prefix: "never/", Threshold: 0}},
+	}))
+	for _, route := range []string{"/quick/:id", "/slow/:id", "/fast/:id", "/never/:id"} {
+		engine.GET(route, func(c *gin.Context) {
+			if wait, err := time.ParseDuration(c.Query("wait")); err == nil {
+				time.Sleep(wait)
+			}
+			c.Status(http.StatusOK)
+		})
+	}
+
+	tests := []struct {
+		target string
+		route  string
+		logged bool
+	}{
+		{"/quick/1", "/quick/:id", false},
+		{"/slow/1?wait=60ms", "/slow/:id", true},
+		{"/fast/1?wait=10ms", "/fast/:id", true},
+		{"/never/1?wait=60ms", "/never/:id", false},
+	}
+	for _, test := range tests {
+		engine.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, test.target, nil))
+		if logged := slowRequestLogged(test.route); logged != test.logged {
+			t.Errorf("%s logged %v, want %v", test.target, logged, test.logged)
+		}
+	}
+
+	// Every request is timed under its route, not its path
+	var output strings.Builder
+	metrics.WriteLatency(&output)
+	for _, test := range tests {
+		if !strings.Contains(output.String(), `route="`+test.route+`"`) {
+			t.Errorf("the durations of %s are not kept", test.route)
+		}
+	}
+	if strings.Contains(output.String(), `route="/quick/1"`) {
+		t.Error("the durations are kept by path")
+	}
+}
+
+func BenchmarkSlowRequests(b *testing.B) {
+	for _, bench := range []struct {
+		name   string
+		timing bool
+	}{
+		{"without", false},
+		{"with", true},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			gin.SetMode(gin.TestMode)
+			engine := gin.New()
+			if bench.timing {
+				engine.Use(SlowRequests(SlowRequestConfig{BasePath: "/", Threshold: time.Second}))
+			}
+			engine.GET("/panel/api/inbounds/list", func(c *gin.Context) {
+				c.Status(http.StatusOK)
+			})
+			req := httptest.NewRequest(http.MethodGet, "/panel/api/inbounds/list", nil)
+			b.ReportAllocs()
+			for b.Loop() {
+				engine.ServeHTTP(httptest.NewRecorder(), req)
+			}
+		})
+	}
+}
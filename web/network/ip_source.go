@@ -0,0 +1,30 @@
+package network
+
+import (
+	"net/netip"
+	"strings"
+)
+
+// IpSource returns what an IP address counts as toward an IP limit: an IPv4
+// address, also one mapped into IPv6, as itself, and an IPv6 address as its
+// network of v6Prefix bits in CIDR notation, or as itself with a prefix of 128.
+// ok is false if ip is not an IP address.
+func IpSource(ip string, v6Prefix int) (source string, ok bool) {
+	addr, err := netip.ParseAddr(strings.Trim(ip, "[]"))
+	if err != nil {
+		return "", false
+	}
+	addr = addr.Unmap().WithZone("")
+	if addr.Is4() {
+		return addr.String(), true
+	}
+	v6Prefix = min(max(v6Prefix, 0), 128)
+	if v6Prefix == 128 {
+		return addr.String(), true
+	}
+	prefix, err := addr.Prefix(v6Prefix)
+	if err != nil {
+		return "", false
+	}
+	return prefix.String(), true
+}
@@ -0,0 +1,43 @@
+package network
+
+import "testing"
+
+func TestIpSource(t *testing.T) {
+	tests := []struct {
+		ip       string
+		v6Prefix int
+		want     string
+		ok       bool
+	}{
+		{"203.0.113.7", 64, "203.0.113.7", true},
+		{"::ffff:203.0.113.7", 64, "203.0.113.7", true},
+		{"[::ffff:203.0.113.7]", 128, "203.0.113.7", true},
+		{"2001:db8:1:2:3:4:5:6", 64, "2001:db8:1:2::/64", true},
+		{"[2001:db8:1:2:3:4:5:6]", 48, "2001:db8:1::/48", true},
+		{"2001:db8:1:2:3:4:5:6", 56, "2001:db8:1::/56", true},
+		{"2001:db8:1:2ff:3:4:5:6", 56, "2001:db8:1:200::/56", true},
+		{"2001:db8:1:2:3:4:5:6", 128, "2001:db8:1:2:3:4:5:6", true},
+		{"2001:db8:1:2:3:4:5:6", 127, "2001:db8:1:2:3:4:5:6/127", true},
+		{"2001:db8::1", 0, "::/0", true},
+		// Prefixes out of range are clamped
+		{"2001:db8::1", -8, "::/0", true},
+		{"2001:db8::1", 200, "2001:db8::1", true},
+		{"fe80::1%eth0", 64, "fe80::/64", true},
+		{"fe80::1%eth0", 128, "fe80::1", true},
+		// The prefix only applies to IPv6
+		{"::ffff:203.0.113.7", 0, "203.0.113.7", true},
+		{"::1", 64, "::/64", true},
+		{"", 64, "", false},
+		{"203.0.113", 64, "", false},
+		{"203.0.113.7:443", 64, "", false},
+		{"2001:db8::1/64", 64, "", false},
+		{"2001:db8:::1", 64, "", false},
+		{"example.com", 64, "", false},
+	}
+	for _, test := range tests {
+		source, ok := IpSource(test.ip, test.v6Prefix)
+		if source != test.want || ok != test.ok {
+			t.Errorf("IpSource(%q, %d) = %q, %v, want %q, %v", test.ip, test.v6Prefix, source, ok, test.want, test.ok)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const unixScheme = "unix://"
+
+// UnixSocketPath returns the socket path of a listen setting like
+// "unix:///run/x-ui/panel.sock", or false if it is an IP address.
+func UnixSocketPath(listen string) (string, bool) {
+	path, ok := strings.CutPrefix(listen, unixScheme)
+	return path, ok
+}
+
+// ValidateListen checks a listen setting: empty, an IP address or a unix socket
+// with an absolute path.
+func ValidateListen(listen string) error {
+	if path, ok := UnixSocketPath(listen); ok {
+		if !filepath.IsAbs(path) {
+			return fmt.Errorf("unix socket path must be absolute: %s", listen)
+		}
+		return nil
+	}
+	if listen != "" && net.ParseIP(listen) == nil {
+		return fmt.Errorf("not a valid ip or unix socket: %s", listen)
+	}
+	return nil
+}
+
+// Overlaps tells whether two listeners, each a listen setting and a port, would
+// take the same address: the same unix socket, or the same port on addresses
+// that overlap, an empty or unspecified address taking all of them.
+func Overlaps(listenA string, portA int, listenB string, portB int) bool {
+	pathA, socketA := UnixSocketPath(listenA)
+	pathB, socketB := UnixSocketPath(listenB)
+	if socketA || socketB {
+		return socketA && socketB && filepath.Clean(pathA) == filepath.Clean(pathB)
+	}
+	if portA != portB {
+		return false
+	}
+	ipA, ipB := net.ParseIP(listenA), net.ParseIP(listenB)
+	if ipA == nil || ipB == nil || ipA.IsUnspecified() || ipB.IsUnspecified() {
+		return true
+	}
+	return ipA.Equal(ipB)
+}
+
+// ParseSocketMode parses the octal permissions of a socket file, e.g. "0660".
+func ParseSocketMode(mode string) (os.FileMode, error) {
+	value, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || value > 0o777 {
+		return 0, fmt.Errorf("invalid socket permissions: %s", mode)
+	}
+	return os.FileMode(value), nil
+}
+
+// Listen opens a TCP listener on listen:port, or the unix socket of listen. A
+// stale socket file left by a crashed process is removed first; the socket gets
+// the given permissions and, if set, the owner "user" or "user:group".
+func Listen(listen string, port int, mode string, owner string) (net.Listener, error) {
+	path, ok := UnixSocketPath(listen)
+	if !ok {
+		return net.Listen("tcp", net.JoinHostPort(listen, strconv.Itoa(port)))
+	}
+
+	perm, err := ParseSocketMode(mode)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, perm); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	if owner != "" {
+		if err := chownSocket(path, owner); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	return listener, nil
+}
+
+func chownSocket(path string, owner string) error {
+	userName, groupName, _ := strings.Cut(owner, ":")
+	uid, gid := -1, -1
+	if userName != "" {
+		u, err := user.Lookup(userName)
+		if err != nil {
+			return err
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return errors.New("socket owner has no numeric uid")
+		}
+	}
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			return err
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return errors.New("socket group has no numeric gid")
+		}
+	}
+	return os.Chown(path, uid, gid)
+}
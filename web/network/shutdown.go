@@ -0,0 +1,30 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"x-ui/logger"
+)
+
+// Shutdown stops server from accepting connections and waits up to timeout for
+// the in-flight requests to finish; the connections still open after that are
+// closed. The listeners are closed by the server itself.
+func Shutdown(name string, server *http.Server, timeout time.Duration) error {
+	logger.Infof("%s: draining connections for up to %v", name, timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	start := time.Now()
+	err := server.Shutdown(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		logger.Warningf("%s: requests still running after %v, closing their connections", name, timeout)
+		return server.Close()
+	}
+	if err != nil {
+		return err
+	}
+	logger.Infof("%s: all requests finished in %v", name, time.Since(start).Round(time.Millisecond))
+	return nil
+}
@@ -0,0 +1,92 @@
+package network
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// slowServer serves a handler that takes delay, signalling started as each
+// request comes in.
+func slowServer(t *testing.T, delay time.Duration) (*http.Server, string, chan struct{}) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{}, 1)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		select {
+		case <-time.After(delay):
+			io.WriteString(w, "done")
+		case <-r.Context().Done():
+		}
+	})}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+	return server, "http://" + listener.Addr().String(), started
+}
+
+type result struct {
+	body string
+	err  error
+}
+
+func get(url string) chan result {
+	done := make(chan result, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		done <- result{string(body), err}
+	}()
+	return done
+}
+
+func TestShutdownDrainsRequests(t *testing.T) {
+	server, url, started := slowServer(t, 300*time.Millisecond)
+	done := get(url)
+	<-started
+
+	start := time.Now()
+	if err := Shutdown("Test server", server, 5*time.Second); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("Shutdown returned after %v, before the request finished", elapsed)
+	}
+	if r := <-done; r.err != nil || r.body != "done" {
+		t.Errorf("the in-flight request got %q, %v", r.body, r.err)
+	}
+	// No new connections are accepted once draining starts
+	if r := <-get(url); r.err == nil {
+		t.Error("a request after the shutdown was served")
+	}
+}
+
+func TestShutdownClosesAfterTimeout(t *testing.T) {
+	server, url, started := slowServer(t, time.Minute)
+	done := get(url)
+	<-started
+
+	start := time.Now()
+	Shutdown("Test server", server, 200*time.Millisecond)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Shutdown waited %v, past its timeout", elapsed)
+	}
+	select {
+	case r := <-done:
+		if r.err == nil && r.body == "done" {
+			t.Error("the stuck request finished")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("the connection of the stuck request was not closed")
+	}
+}
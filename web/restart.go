@@ -0,0 +1,108 @@
+package web
+
+import (
+	"crypto/tls"
+	"net"
+	"strconv"
+	"sync"
+
+	"x-ui/logger"
+	"x-ui/web/network"
+)
+
+// handoff is the listener PrepareRestart bound for the next start of the
+// panel, with the address it was bound for.
+var handoff struct {
+	lock     sync.Mutex
+	listener net.Listener
+	address  string
+}
+
+// listenAddress returns the address the panel listens on with listen and port;
+// the ones that listen on all the addresses are the same.
+func listenAddress(listen string, port int) string {
+	if path, ok := network.UnixSocketPath(listen); ok {
+		return "unix:" + path
+	}
+	if ip := net.ParseIP(listen); ip != nil && ip.IsUnspecified() {
+		listen = ""
+	}
+	return net.JoinHostPort(listen, strconv.Itoa(port))
+}
+
+// takeHandoff returns the listener bound for address by PrepareRestart, or nil.
+func takeHandoff(address string) net.Listener {
+	handoff.lock.Lock()
+	defer handoff.lock.Unlock()
+	listener := handoff.listener
+	if listener == nil {
+		return nil
+	}
+	handoff.listener = nil
+	if handoff.address != address {
+		listener.Close()
+		return nil
+	}
+	return listener
+}
+
+// PrepareRestart checks that the panel can start again with the saved
+// settings: that the certificate loads and that the new address can be bound.
+// The new address is bound now and handed over to the next start, so that
+// nothing takes it meanwhile; the one the panel listens on stays its own.
+func (s *Server) PrepareRestart() error {
+	webEnable, err := s.settingService.GetWebEnable()
+	if err != nil || !webEnable {
+		return err
+	}
+	certFile, err := s.settingService.GetCertFile()
+	if err != nil {
+		return err
+	}
+	keyFile, err := s.settingService.GetKeyFile()
+	if err != nil {
+		return err
+	}
+	listen, err := s.settingService.GetListen()
+	if err != nil {
+		return err
+	}
+	port, err := s.settingService.GetPort()
+	if err != nil {
+		return err
+	}
+	socketMode, err := s.settingService.GetSocketMode()
+	if err != nil {
+		return err
+	}
+	socketOwner, err := s.settingService.GetSocketOwner()
+	if err != nil {
+		return err
+	}
+	if _, isSocket := network.UnixSocketPath(listen); !isSocket && (certFile != "" || keyFile != "") {
+		if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+			return err
+		}
+	}
+
+	address := listenAddress(listen, port)
+	if s.listener != nil && address == s.listenAddress {
+		return nil
+	}
+	handoff.lock.Lock()
+	defer handoff.lock.Unlock()
+	if handoff.listener != nil && handoff.address == address {
+		return nil
+	}
+	listener, err := network.Listen(listen, port, socketMode, socketOwner)
+	if err != nil {
+		return err
+	}
+	if handoff.listener != nil {
+		handoff.listener.Close()
+	}
+	handoff.listener = listener
+	handoff.address = address
+	logger.Info("Web server bound", listener.Addr(), "for the restart")
+	return nil
+}
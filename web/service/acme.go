@@ -0,0 +1,635 @@
+package service
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"html"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"x-ui/config"
+	"x-ui/logger"
+	"x-ui/util/common"
+	xuicrypto "x-ui/util/crypto"
+
+	"golang.org/x/crypto/acme"
+)
+
+// The challenges a certificate is issued with.
+const (
+	AcmeChallengeHTTP = "http"
+	AcmeChallengeDNS  = "dns"
+)
+
+const (
+	// acmeCertFolder is the folder of the issued certificates, in the folder
+	// of the database
+	acmeCertFolder = "certs"
+	// acmeRenewBefore is how long before its expiry a certificate is renewed
+	acmeRenewBefore = 30 * 24 * time.Hour
+	// acmeTimeout bounds the issuance of a certificate, DNS propagation
+	// included
+	acmeTimeout = 10 * time.Minute
+	// acmePropagationTimeout is how long a TXT record of DNS-01 may take to
+	// be seen, checked every acmePropagationWait
+	acmePropagationTimeout = 3 * time.Minute
+	acmePropagationWait    = 5 * time.Second
+)
+
+var acmeDomainPattern = regexp.MustCompile(`^(\*\.)?([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z]{2,63}$`)
+
+// AcmeSettings are how the certificates of the panel are issued over ACME:
+// one certificate for each of Domains, on the account of Email.
+type AcmeSettings struct {
+	Email   string   `json:"email"`
+	Domains []string `json:"domains"`
+	// Challenge is http for HTTP-01 or dns for DNS-01
+	Challenge string `json:"challenge"`
+	// HttpPort is the port a listener is opened on for HTTP-01 while a
+	// certificate is issued, 0 to answer on the port of the panel
+	HttpPort int `json:"httpPort,omitempty"`
+	// CloudflareToken is the API token DNS-01 sets the TXT records with, it
+	// needs the DNS edit permission of the zones
+	CloudflareToken string `json:"cloudflareToken,omitempty"`
+	// Directory is the directory URL of the CA, Let's Encrypt if empty
+	Directory string `json:"directory,omitempty"`
+}
+
+// AcmeCertificate is a certificate issued over ACME, with the files the panel,
+// the subscriptions and the inbounds use it by.
+type AcmeCertificate struct {
+	Domain    string `json:"domain"`
+	CertFile  string `json:"certFile"`
+	KeyFile   string `json:"keyFile"`
+	Issuer    string `json:"issuer,omitempty"`
+	NotBefore int64  `json:"notBefore,omitempty"`
+	NotAfter  int64  `json:"notAfter,omitempty"`
+	// LastError is why the last issuance failed, at LastErrorAt, if it did
+	LastError   string `json:"lastError,omitempty"`
+	LastErrorAt int64  `json:"lastErrorAt,omitempty"`
+}
+
+var (
+	// acmeLock lets one certificate be issued at a time
+	acmeLock sync.Mutex
+	// acmeTokens are the answers to the HTTP-01 challenges being validated,
+	// by token
+	acmeTokens     = map[string]string{}
+	acmeTokensLock sync.Mutex
+	// acmeFailures are the last failed issuances, by domain
+	acmeFailures     = map[string]AcmeCertificate{}
+	acmeFailuresLock sync.Mutex
+	// acmeReloaders are told of the domain of a certificate that was issued
+	// or renewed, to load its new files
+	acmeReloaders     []func(domain string)
+	acmeReloadersLock sync.Mutex
+)
+
+// AcmeService issues the certificates of the settings over ACME and renews
+// them before they expire.
+type AcmeService struct {
+	settingService SettingService
+	webhookService WebhookService
+
+	certReloadService CertReloadService
+}
+
+// OnAcmeCertificate calls reload with the domain of every certificate issued
+// or renewed from now on.
+func OnAcmeCertificate(reload func(domain string)) {
+	acmeReloadersLock.Lock()
+	defer acmeReloadersLock.Unlock()
+	acmeReloaders = append(acmeReloaders, reload)
+}
+
+// acmeCertFiles returns the certificate chain and key files of the certificate
+// of domain.
+func acmeCertFiles(domain string) (string, string) {
+	dir := filepath.Join(config.GetDBFolderPath(), acmeCertFolder, strings.ReplaceAll(domain, "*", "_"))
+	return filepath.Join(dir, "fullchain.pem"), filepath.Join(dir, "privkey.pem")
+}
+
+// acmeCertificateFiles returns the files of all the issued certificates.
+func acmeCertificateFiles() []string {
+	matches, _ := filepath.Glob(filepath.Join(config.GetDBFolderPath(), acmeCertFolder, "*", "*.pem"))
+	return matches
+}
+
+func (s *AcmeSettings) validate() error {
+	s.Email = strings.TrimSpace(s.Email)
+	if s.Email == "" || !strings.Contains(s.Email, "@") {
+		return common.NewError("ACME needs the email of the account")
+	}
+	domains := []string{}
+	for _, domain := range s.Domains {
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		if domain == "" || slices.Contains(domains, domain) {
+			continue
+		}
+		if !acmeDomainPattern.MatchString(domain) {
+			return common.NewErrorf("%s is not a domain a certificate can be issued for", domain)
+		}
+		if strings.HasPrefix(domain, "*.") && s.Challenge != AcmeChallengeDNS {
+			return common.NewErrorf("the wildcard %s can only be issued with DNS-01", domain)
+		}
+		domains = append(domains, domain)
+	}
+	s.Domains = domains
+	switch s.Challenge {
+	case AcmeChallengeHTTP:
+		if s.HttpPort < 0 || s.HttpPort > 65535 {
+			return common.NewErrorf("invalid HTTP-01 port: %d", s.HttpPort)
+		}
+	case AcmeChallengeDNS:
+		if s.CloudflareToken == "" {
+			return common.NewError("DNS-01 needs a Cloudflare API token")
+		}
+	default:
+		return common.NewErrorf("unknown ACME challenge %q, use http or dns", s.Challenge)
+	}
+	return nil
+}
+
+// getSettings returns the ACME settings with the Cloudflare token decrypted.
+func (s *AcmeService) getSettings() (*AcmeSettings, error) {
+	value, err := s.settingService.GetAcmeSettings()
+	if err != nil {
+		return nil, err
+	}
+	settings := &AcmeSettings{}
+	if err := json.Unmarshal([]byte(value), settings); err != nil {
+		return nil, common.NewErrorf("the ACME settings are not valid: %v", err)
+	}
+	if settings.CloudflareToken != "" {
+		key, err := s.settingService.GetSecret()
+		if err != nil {
+			return nil, err
+		}
+		if settings.CloudflareToken, err = xuicrypto.Decrypt(key, settings.CloudflareToken); err != nil {
+			return nil, common.NewErrorf("unable to decrypt the Cloudflare token: %v", err)
+		}
+	}
+	return settings, nil
+}
+
+// GetSettings returns the ACME settings, the Cloudflare token masked.
+func (s *AcmeService) GetSettings() (*AcmeSettings, error) {
+	settings, err := s.getSettings()
+	if err != nil {
+		return nil, err
+	}
+	if settings.CloudflareToken != "" {
+		settings.CloudflareToken = remoteSecretMask
+	}
+	return settings, nil
+}
+
+// SaveSettings replaces the ACME settings. A Cloudflare token given as the
+// mask keeps the saved one; it is stored encrypted.
+func (s *AcmeService) SaveSettings(settings *AcmeSettings) error {
+	if settings.CloudflareToken == remoteSecretMask {
+		stored, err := s.getSettings()
+		if err != nil {
+			return err
+		}
+		settings.CloudflareToken = stored.CloudflareToken
+	}
+	if err := settings.validate(); err != nil {
+		return err
+	}
+	if settings.CloudflareToken != "" {
+		key, err := s.settingService.GetSecret()
+		if err != nil {
+			return err
+		}
+		if settings.CloudflareToken, err = xuicrypto.Encrypt(key, settings.CloudflareToken); err != nil {
+			return err
+		}
+	}
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	return s.settingService.SetAcmeSettings(string(data))
+}
+
+// GetCertificates returns the certificates of the domains of the settings,
+// and of those issued before that are no longer in them.
+func (s *AcmeService) GetCertificates() ([]AcmeCertificate, error) {
+	settings, err := s.getSettings()
+	if err != nil {
+		return nil, err
+	}
+	domains := slices.Clone(settings.Domains)
+	entries, _ := os.ReadDir(filepath.Join(config.GetDBFolderPath(), acmeCertFolder))
+	for _, entry := range entries {
+		domain := strings.Replace(entry.Name(), "_", "*", 1)
+		if entry.IsDir() && !slices.Contains(domains, domain) {
+			domains = append(domains, domain)
+		}
+	}
+
+	certificates := make([]AcmeCertificate, 0, len(domains))
+	for _, domain := range domains {
+		certificate := AcmeCertificate{Domain: domain}
+		certificate.CertFile, certificate.KeyFile = acmeCertFiles(domain)
+		if cert, err := readCertificate(certificate.CertFile); err == nil {
+			certificate.Issuer = cert.Issuer.CommonName
+			certificate.NotBefore = cert.NotBefore.UnixMilli()
+			certificate.NotAfter = cert.NotAfter.UnixMilli()
+		}
+		acmeFailuresLock.Lock()
+		if failure, ok := acmeFailures[domain]; ok {
+			certificate.LastError, certificate.LastErrorAt = failure.LastError, failure.LastErrorAt
+		}
+		acmeFailuresLock.Unlock()
+		certificates = append(certificates, certificate)
+	}
+	return certificates, nil
+}
+
+// readCertificate returns the first certificate of a PEM file.
+func readCertificate(path string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, common.NewErrorf("%s holds no certificate", path)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// RenewDue issues the certificates of the domains of the settings that have
+// none yet, and renews those that expire within 30 days. A failure is reported
+// to the Telegram admins and the webhooks, and the other domains go on.
+func (s *AcmeService) RenewDue() error {
+	settings, err := s.getSettings()
+	if err != nil {
+		return err
+	}
+	for _, domain := range settings.Domains {
+		certFile, _ := acmeCertFiles(domain)
+		if cert, err := readCertificate(certFile); err == nil && time.Until(cert.NotAfter) > acmeRenewBefore {
+			continue
+		}
+		s.Issue(domain)
+	}
+	return nil
+}
+
+// Issue issues the certificate of domain, one of the domains of the settings,
+// and reports a failure to the Telegram admins and the webhooks.
+func (s *AcmeService) Issue(domain string) error {
+	settings, err := s.getSettings()
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(settings.Domains, domain) {
+		return common.NewErrorf("%s is not a domain of the ACME settings", domain)
+	}
+
+	acmeLock.Lock()
+	err = s.issue(settings, domain)
+	acmeLock.Unlock()
+
+	acmeFailuresLock.Lock()
+	if err == nil {
+		delete(acmeFailures, domain)
+	} else {
+		acmeFailures[domain] = AcmeCertificate{Domain: domain, LastError: err.Error(), LastErrorAt: time.Now().UnixMilli()}
+	}
+	acmeFailuresLock.Unlock()
+
+	if err != nil {
+		logger.Warningf("Unable to issue the certificate of %s: %v", domain, err)
+		go new(Tgbot).AcmeFailed(domain, err.Error())
+		s.webhookService.Emit(WebhookAcmeFailed, map[string]any{
+			"domain": domain,
+			"error":  err.Error(),
+		})
+		return err
+	}
+	logger.Info("Certificate of", domain, "issued")
+	s.reload(domain)
+	return nil
+}
+
+// reload tells the users of the certificate of domain that it changed: the
+// servers and the inbounds that use it load it again.
+func (s *AcmeService) reload(domain string) {
+	s.certReloadService.Reload(false)
+	acmeReloadersLock.Lock()
+	reloaders := slices.Clone(acmeReloaders)
+	acmeReloadersLock.Unlock()
+	for _, reload := range reloaders {
+		reload(domain)
+	}
+}
+
+func (s *AcmeService) issue(settings *AcmeSettings, domain string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), acmeTimeout)
+	defer cancel()
+
+	accountKey, err := s.accountKey()
+	if err != nil {
+		return err
+	}
+	client := &acme.Client{Key: accountKey, DirectoryURL: settings.Directory, UserAgent: "x-ui"}
+	if client.DirectoryURL == "" {
+		client.DirectoryURL = acme.LetsEncryptURL
+	}
+	account := &acme.Account{Contact: []string{"mailto:" + settings.Email}}
+	if _, err := client.Register(ctx, account, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return common.NewErrorf("registering the ACME account failed: %v", err)
+	}
+
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(domain))
+	if err != nil {
+		return common.NewErrorf("ordering the certificate failed: %v", err)
+	}
+	for _, url := range order.AuthzURLs {
+		if err := s.authorize(ctx, client, settings, url); err != nil {
+			return err
+		}
+	}
+	if order, err = client.WaitOrder(ctx, order.URI); err != nil {
+		return common.NewErrorf("the order of the certificate failed: %v", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: []string{domain}}, key)
+	if err != nil {
+		return err
+	}
+	chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return common.NewErrorf("finalizing the certificate failed: %v", err)
+	}
+	return writeAcmeCertificate(domain, chain, key)
+}
+
+// authorize proves the control of the identifier of an authorization with the
+// challenge of the settings.
+func (s *AcmeService) authorize(ctx context.Context, client *acme.Client, settings *AcmeSettings, url string) error {
+	authz, err := client.GetAuthorization(ctx, url)
+	if err != nil {
+		return err
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+	challengeType := "http-01"
+	if settings.Challenge == AcmeChallengeDNS {
+		challengeType = "dns-01"
+	}
+	var challenge *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == challengeType {
+			challenge = c
+			break
+		}
+	}
+	if challenge == nil {
+		return common.NewErrorf("the CA offers no %s challenge for %s", challengeType, authz.Identifier.Value)
+	}
+
+	var cleanup func()
+	if settings.Challenge == AcmeChallengeDNS {
+		cleanup, err = s.prepareDNSChallenge(ctx, client, settings, authz.Identifier.Value, challenge)
+	} else {
+		cleanup, err = prepareHTTPChallenge(client, settings, challenge)
+	}
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	if _, err := client.Accept(ctx, challenge); err != nil {
+		return common.NewErrorf("the %s challenge of %s was refused: %v", challengeType, authz.Identifier.Value, err)
+	}
+	if _, err := client.WaitAuthorization(ctx, authz.URI); err != nil {
+		return common.NewErrorf("the %s challenge of %s failed: %v", challengeType, authz.Identifier.Value, err)
+	}
+	return nil
+}
+
+// prepareHTTPChallenge answers an HTTP-01 challenge on the panel, and on a
+// listener of its own if the settings have a port for it.
+func prepareHTTPChallenge(client *acme.Client, settings *AcmeSettings, challenge *acme.Challenge) (func(), error) {
+	response, err := client.HTTP01ChallengeResponse(challenge.Token)
+	if err != nil {
+		return nil, err
+	}
+	acmeTokensLock.Lock()
+	acmeTokens[challenge.Token] = response
+	acmeTokensLock.Unlock()
+	cleanup := func() {
+		acmeTokensLock.Lock()
+		delete(acmeTokens, challenge.Token)
+		acmeTokensLock.Unlock()
+	}
+	if settings.HttpPort == 0 {
+		return cleanup, nil
+	}
+
+	listener, err := net.Listen("tcp", ":"+strconv.Itoa(settings.HttpPort))
+	if err != nil {
+		cleanup()
+		return nil, common.NewErrorf("unable to listen for HTTP-01 on port %d: %v", settings.HttpPort, err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(ServeAcmeChallenge), ReadHeaderTimeout: 10 * time.Second}
+	go server.Serve(listener)
+	return func() {
+		server.Close()
+		cleanup()
+	}, nil
+}
+
+// ServeAcmeChallenge answers the HTTP-01 challenges of the certificates being
+// issued, at /.well-known/acme-challenge/{token}.
+func ServeAcmeChallenge(w http.ResponseWriter, r *http.Request) {
+	token, ok := strings.CutPrefix(r.URL.Path, "/.well-known/acme-challenge/")
+	acmeTokensLock.Lock()
+	response, found := acmeTokens[token]
+	acmeTokensLock.Unlock()
+	if !ok || !found {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(response))
+}
+
+// prepareDNSChallenge sets the TXT record of a DNS-01 challenge on Cloudflare
+// and waits for it to be seen.
+func (s *AcmeService) prepareDNSChallenge(ctx context.Context, client *acme.Client, settings *AcmeSettings, domain string, challenge *acme.Challenge) (func(), error) {
+	value, err := client.DNS01ChallengeRecord(challenge.Token)
+	if err != nil {
+		return nil, err
+	}
+	name := "_acme-challenge." + domain
+	cloudflare := newCloudflareDNS(settings.CloudflareToken)
+	zoneId, recordId, err := cloudflare.addTXT(ctx, name, value)
+	if err != nil {
+		return nil, common.NewErrorf("setting the TXT record of %s on Cloudflare failed: %v", name, err)
+	}
+	cleanup := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if err := cloudflare.deleteRecord(ctx, zoneId, recordId); err != nil {
+			logger.Warning("Unable to delete the TXT record of", name, "from Cloudflare:", err)
+		}
+	}
+	if err := waitTXT(ctx, name, value); err != nil {
+		cleanup()
+		return nil, err
+	}
+	return cleanup, nil
+}
+
+// waitTXT waits for a public resolver to see value in the TXT records of name.
+func waitTXT(ctx context.Context, name string, value string) error {
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return new(net.Dialer).DialContext(ctx, network, "1.1.1.1:53")
+		},
+	}
+	deadline := time.Now().Add(acmePropagationTimeout)
+	for {
+		records, _ := resolver.LookupTXT(ctx, name)
+		if slices.Contains(records, value) {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return common.NewErrorf("the TXT record of %s did not propagate within %v", name, acmePropagationTimeout)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(acmePropagationWait):
+		}
+	}
+}
+
+// accountKey returns the key of the ACME account, made and stored encrypted
+// the first time.
+func (s *AcmeService) accountKey() (crypto.Signer, error) {
+	secret, err := s.settingService.GetSecret()
+	if err != nil {
+		return nil, err
+	}
+	stored, err := s.settingService.GetAcmeAccountKey()
+	if err != nil {
+		return nil, err
+	}
+	if stored != "" {
+		data, err := xuicrypto.Decrypt(secret, stored)
+		if err != nil {
+			return nil, common.NewErrorf("unable to decrypt the ACME account key: %v", err)
+		}
+		block, _ := pem.Decode([]byte(data))
+		if block == nil {
+			return nil, common.NewError("the ACME account key is not valid")
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := xuicrypto.Encrypt(secret, string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})))
+	if err != nil {
+		return nil, err
+	}
+	if err := s.settingService.SetAcmeAccountKey(encrypted); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// writeAcmeCertificate writes the chain and the key of the certificate of
+// domain to its files, each replaced at once so that no reader sees half.
+func writeAcmeCertificate(domain string, chain [][]byte, key *ecdsa.PrivateKey) error {
+	certFile, keyFile := acmeCertFiles(domain)
+	if err := os.MkdirAll(filepath.Dir(certFile), 0o700); err != nil {
+		return err
+	}
+	var certPEM []byte
+	for _, der := range chain {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	if err := writeFileAtomic(keyFile, keyPEM, 0o600); err != nil {
+		return err
+	}
+	return writeFileAtomic(certFile, certPEM, 0o644)
+}
+
+func writeFileAtomic(path string, data []byte, mode os.FileMode) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// resolveAcmeCertificates replaces the references to ACME certificates of the
+// TLS settings of a stream, "acme": domain, with the files of the certificate.
+func resolveAcmeCertificates(tlsSettings map[string]any) {
+	certificates, _ := tlsSettings["certificates"].([]any)
+	for _, c := range certificates {
+		certificate, ok := c.(map[string]any)
+		if !ok {
+			continue
+		}
+		domain, _ := certificate["acme"].(string)
+		delete(certificate, "acme")
+		if domain == "" {
+			continue
+		}
+		certificate["certificateFile"], certificate["keyFile"] = acmeCertFiles(domain)
+		delete(certificate, "certificate")
+		delete(certificate, "key")
+	}
+}
+
+// AcmeFailed tells the admins that the certificate of domain could
+// not be issued or renewed, with the error of the CA.
+func (t *Tgbot) AcmeFailed(domain string, detail string) {
+	if !t.AlertsOn(AlertCertificate) {
+		return
+	}
+	msg := t.I18nBot("tgbot.messages.acmeFailed", "Domain=="+html.EscapeString(domain), "Error=="+html.EscapeString(detail))
+	msg += t.I18nBot("tgbot.messages.hostname", "Hostname=="+hostname)
+	t.SendAlert(AlertCertificate, msg)
+}
@@ -0,0 +1,115 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"x-ui/util/common"
+)
+
+const cloudflareAPI = "https://api.cloudflare.com/client/v4"
+
+// cloudflareDNS sets the TXT records of DNS-01 challenges with the API of
+// Cloudflare.
+type cloudflareDNS struct {
+	token  string
+	client *http.Client
+}
+
+func newCloudflareDNS(token string) *cloudflareDNS {
+	return &cloudflareDNS{token: token, client: &http.Client{Timeout: 30 * time.Second}}
+}
+
+// do calls the API and decodes the result of its reply into result, or
+// returns the errors the API replied with.
+func (c *cloudflareDNS) do(ctx context.Context, method string, path string, body any, result any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, cloudflareAPI+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var reply struct {
+		Success bool `json:"success"`
+		Errors  []struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&reply); err != nil {
+		return common.NewErrorf("the Cloudflare API replied %s", resp.Status)
+	}
+	if !reply.Success {
+		messages := []string{}
+		for _, e := range reply.Errors {
+			messages = append(messages, e.Message)
+		}
+		return common.NewErrorf("the Cloudflare API replied %s: %s", resp.Status, strings.Join(messages, "; "))
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(reply.Result, result)
+}
+
+// zoneId returns the id of the zone of name: the longest of its parent
+// domains the token can see a zone of.
+func (c *cloudflareDNS) zoneId(ctx context.Context, name string) (string, error) {
+	labels := strings.Split(strings.TrimSuffix(name, "."), ".")
+	for i := 0; i < len(labels)-1; i++ {
+		var zones []struct {
+			Id string `json:"id"`
+		}
+		zone := strings.Join(labels[i:], ".")
+		if err := c.do(ctx, http.MethodGet, "/zones?name="+url.QueryEscape(zone), nil, &zones); err != nil {
+			return "", err
+		}
+		if len(zones) > 0 {
+			return zones[0].Id, nil
+		}
+	}
+	return "", common.NewErrorf("the token has access to no zone of %s", name)
+}
+
+// addTXT adds a TXT record and returns the ids of its zone and of the record.
+func (c *cloudflareDNS) addTXT(ctx context.Context, name string, value string) (string, string, error) {
+	zoneId, err := c.zoneId(ctx, name)
+	if err != nil {
+		return "", "", err
+	}
+	var record struct {
+		Id string `json:"id"`
+	}
+	err = c.do(ctx, http.MethodPost, "/zones/"+zoneId+"/dns_records", map[string]any{
+		"type":    "TXT",
+		"name":    name,
+		"content": value,
+		"ttl":     120,
+	}, &record)
+	return zoneId, record.Id, err
+}
+
+func (c *cloudflareDNS) deleteRecord(ctx context.Context, zoneId string, recordId string) error {
+	return c.do(ctx, http.MethodDelete, "/zones/"+zoneId+"/dns_records/"+recordId, nil, nil)
+}
@@ -0,0 +1,548 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"html"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"x-ui/config"
+	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/web/entity"
+
+	"github.com/goccy/go-json"
+	"github.com/google/uuid"
+	"github.com/mymmrac/telego"
+	xhtml "golang.org/x/net/html"
+)
+
+// The kinds of the alerts to the admins; the settings route each kind to its
+// own channels.
+const (
+	AlertLogin       = "login"
+	AlertSecurity    = "security"
+	AlertPanic       = "panic"
+	AlertTraffic     = "traffic"
+	AlertExpiry      = "expiry"
+	AlertInactive    = "inactive"
+	AlertBackup      = "backup"
+	AlertDatabase    = "database"
+	AlertXray        = "xray"
+	AlertCpu         = "cpu"
+	AlertBandwidth   = "bandwidth"
+	AlertCertificate = "certificate"
+	AlertGeodata     = "geodata"
+	AlertSubShared   = "subShared"
+	AlertReality     = "reality"
+	AlertInbound     = "inbound"
+)
+
+var alertKinds = []string{
+	AlertLogin, AlertSecurity, AlertPanic, AlertTraffic, AlertExpiry, AlertInactive, AlertBackup,
+	AlertDatabase, AlertXray, AlertCpu, AlertBandwidth, AlertCertificate, AlertGeodata, AlertSubShared, AlertReality,
+	AlertInbound,
+}
+
+// The channels the alerts go to. An alert the settings give no channels goes
+// to Telegram, as all of them did before there were others.
+const (
+	AlertChannelTelegram = "telegram"
+	AlertChannelEmail    = "email"
+	AlertChannelWebhook  = "webhook"
+)
+
+var alertChannels = []string{AlertChannelTelegram, AlertChannelEmail, AlertChannelWebhook}
+
+const (
+	// alertQueueSize is how many alerts wait for the email and the webhook
+	// before new ones are dropped
+	alertQueueSize = 64
+	// alertMaxAttempts is how many times an alert is sent to a channel before
+	// it is given up, alertRetryWait apart after the first attempt and twice as
+	// long after each next one
+	alertMaxAttempts = 4
+	alertRetryWait   = 30 * time.Second
+	// alertTimeout bounds a delivery
+	alertTimeout = 20 * time.Second
+)
+
+// alertSample is the data the templates of the alert emails are checked with,
+// its keys are all their variables.
+var alertSample = map[string]string{
+	"ServerName": "vpn-1",
+	"Alert":      AlertBackup,
+	"Title":      "The backup x-ui-20250131-060000.db.gz couldn't be uploaded to s3.",
+	"Text":       "The backup x-ui-20250131-060000.db.gz couldn't be uploaded to s3.\nError: timeout",
+	"Message":    "The backup <b>x-ui-20250131-060000.db.gz</b> couldn't be uploaded to <b>s3</b>.\nError: timeout",
+	"Time":       "2025-01-31 06:00:00",
+}
+
+// alertDelivery is an alert on its way to the email or the webhook.
+type alertDelivery struct {
+	channel string
+	kind    string
+	// msg is the alert in the HTML of the bot
+	msg     string
+	time    time.Time
+	attempt int
+}
+
+var (
+	alertQueueOnce sync.Once
+	alertQueue     chan alertDelivery
+	// alertsPending counts the alerts queued, being sent or waiting to be sent
+	// again
+	alertsPending atomic.Int64
+)
+
+// AlertService sends the alerts to the email and to the webhook of the
+// settings; Tgbot sends them to Telegram.
+type AlertService struct {
+	settingService SettingService
+}
+
+// parseAlertChannels parses the channels of the alerts in the settings, a JSON
+// object of the channels by alert.
+func parseAlertChannels(value string) (map[string][]string, error) {
+	channels := map[string][]string{}
+	if strings.TrimSpace(value) == "" {
+		return channels, nil
+	}
+	if err := json.Unmarshal([]byte(value), &channels); err != nil {
+		return nil, common.NewError("the channels of the alerts are not a JSON object of lists:", err)
+	}
+	for kind, list := range channels {
+		if !slices.Contains(alertKinds, kind) {
+			return nil, common.NewError("unknown alert:", kind)
+		}
+		for _, channel := range list {
+			if !slices.Contains(alertChannels, channel) {
+				return nil, common.NewErrorf("unknown channel %q of the %s alerts", channel, kind)
+			}
+		}
+	}
+	return channels, nil
+}
+
+// checkAlertTemplates checks that the templates of the alert emails render.
+func checkAlertTemplates(config entity.AlertConfig) error {
+	if _, err := renderAlertTemplate("subject", config.EmailSubject, alertSample); err != nil {
+		return common.NewError("the subject of the alert emails:", err)
+	}
+	if _, err := renderAlertTemplate("body", config.EmailBody, alertSample); err != nil {
+		return common.NewError("the body of the alert emails:", err)
+	}
+	return nil
+}
+
+// Channels returns the channels the alerts of kind go to in the settings.
+func (s *AlertService) Channels(kind string) []string {
+	value, err := s.settingService.GetAlertChannels()
+	if err != nil {
+		return []string{AlertChannelTelegram}
+	}
+	channels, err := parseAlertChannels(value)
+	if err != nil {
+		logger.Warning("Invalid channels of the alerts:", err)
+		return []string{AlertChannelTelegram}
+	}
+	if list, ok := channels[kind]; ok {
+		return list
+	}
+	return []string{AlertChannelTelegram}
+}
+
+// Routes returns the channels the alerts of kind go to that can take them:
+// Telegram while the bot runs, the email and the webhook once they are set up.
+func (s *AlertService) Routes(kind string) []string {
+	channels := s.Channels(kind)
+	if len(channels) == 0 {
+		return nil
+	}
+	config, err := s.settingService.GetAlertConfig()
+	if err != nil {
+		logger.Warning("Unable to get the settings of the alerts:", err)
+		return nil
+	}
+	routes := make([]string, 0, len(channels))
+	for _, channel := range channels {
+		switch {
+		case channel == AlertChannelTelegram && isRunning,
+			channel == AlertChannelEmail && config.EmailEnabled(),
+			channel == AlertChannelWebhook && config.WebhookUrl != "":
+			routes = append(routes, channel)
+		}
+	}
+	return routes
+}
+
+// queue queues a delivery for the worker. It never blocks: the delivery is
+// dropped if the queue is full.
+func (s *AlertService) queue(delivery alertDelivery) {
+	alertQueueOnce.Do(func() {
+		alertQueue = make(chan alertDelivery, alertQueueSize)
+		go s.worker()
+	})
+	alertsPending.Add(1)
+	select {
+	case alertQueue <- delivery:
+	default:
+		alertsPending.Add(-1)
+		logger.Warningf("The alert queue is full, dropping the %s alert to %s", delivery.kind, delivery.channel)
+	}
+}
+
+// worker delivers the queued alerts, and queues them again for later when they
+// fail.
+func (s *AlertService) worker() {
+	for delivery := range alertQueue {
+		config, err := s.settingService.GetAlertConfig()
+		if err == nil {
+			err = deliverAlert(config, delivery)
+		}
+		alertsPending.Add(-1)
+		if err == nil {
+			continue
+		}
+		delivery.attempt++
+		if delivery.attempt >= alertMaxAttempts {
+			logger.Warningf("Giving up the %s alert to %s after %d attempts: %v", delivery.kind, delivery.channel, delivery.attempt, err)
+			continue
+		}
+		wait := alertRetryWait << (delivery.attempt - 1)
+		logger.Warningf("Unable to send the %s alert to %s, retrying in %v: %v", delivery.kind, delivery.channel, wait, err)
+		alertsPending.Add(1)
+		time.AfterFunc(wait, func() {
+			alertsPending.Add(-1)
+			s.queue(delivery)
+		})
+	}
+}
+
+// PendingAlerts returns how many alerts to the email and the webhook are not
+// sent yet, those to be sent again after a failure included.
+func (s *AlertService) PendingAlerts() int {
+	return int(alertsPending.Load())
+}
+
+// SendAlert sends the alert msg of kind, in the HTML of the bot, to the
+// channels of the settings: to the Telegram admins with replyMarkup, and to the
+// email and the webhook in the background.
+func (t *Tgbot) SendAlert(kind string, msg string, replyMarkup ...telego.ReplyMarkup) {
+	var alertService AlertService
+	for _, channel := range alertService.Routes(kind) {
+		if channel == AlertChannelTelegram {
+			t.SendMsgToTgbotAdmins(msg, replyMarkup...)
+			continue
+		}
+		alertService.queue(alertDelivery{channel: channel, kind: kind, msg: msg, time: time.Now()})
+	}
+}
+
+// AlertsOn tells whether the alerts of kind go anywhere, for them not to be
+// made up otherwise.
+func (t *Tgbot) AlertsOn(kind string) bool {
+	var alertService AlertService
+	return len(alertService.Routes(kind)) > 0
+}
+
+// TestAlert sends a test alert to channel at once, to the email and the
+// webhook of config rather than those of the settings.
+func (t *Tgbot) TestAlert(channel string, config *entity.AlertConfig) error {
+	msg := t.I18nBot("tgbot.messages.alertTest")
+	msg += t.I18nBot("tgbot.messages.hostname", "Hostname=="+hostname)
+	switch channel {
+	case AlertChannelTelegram:
+		if !t.IsRunning() {
+			return common.NewError("the Telegram bot is not running")
+		}
+		t.SendMsgToTgbotAdmins(msg)
+		return nil
+	case AlertChannelEmail, AlertChannelWebhook:
+		if err := config.Validate(); err != nil {
+			return err
+		}
+		if err := checkAlertTemplates(*config); err != nil {
+			return err
+		}
+		return deliverAlert(config, alertDelivery{channel: channel, kind: "test", msg: msg, time: time.Now()})
+	default:
+		return common.NewError("unknown alert channel:", channel)
+	}
+}
+
+// deliverAlert sends an alert to its channel once.
+func deliverAlert(config *entity.AlertConfig, delivery alertDelivery) error {
+	text := alertText(delivery.msg)
+	title, _, _ := strings.Cut(strings.TrimSpace(text), "\n")
+	server := hostname
+	if server == "" {
+		server, _ = os.Hostname()
+	}
+	vars := map[string]string{
+		"ServerName": server,
+		"Alert":      delivery.kind,
+		"Title":      strings.TrimSpace(title),
+		"Text":       text,
+		"Message":    delivery.msg,
+		"Time":       delivery.time.Format("2006-01-02 15:04:05"),
+	}
+	switch delivery.channel {
+	case AlertChannelEmail:
+		if !config.EmailEnabled() {
+			return common.NewError("the alert emails have no SMTP server or recipients")
+		}
+		return sendAlertEmail(config, vars)
+	case AlertChannelWebhook:
+		if config.WebhookUrl == "" {
+			return common.NewError("there is no alert webhook")
+		}
+		return postAlertWebhook(config, vars)
+	}
+	return common.NewError("unknown alert channel:", delivery.channel)
+}
+
+// renderAlertTemplate executes text with vars, for the subject and the body of
+// the alert emails; the variables that aren't known are an error.
+func renderAlertTemplate(name string, text string, vars map[string]string) (string, error) {
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var out strings.Builder
+	if err := tmpl.Execute(&out, vars); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// alertText returns the text of an alert in the HTML of the bot, or of an email,
+// with the URLs of its links after them and the blocks on lines of their own.
+func alertText(msg string) string {
+	var out strings.Builder
+	var href string
+	tokenizer := xhtml.NewTokenizer(strings.NewReader(msg))
+	for {
+		switch tokenizer.Next() {
+		case xhtml.ErrorToken:
+			return strings.TrimSpace(strings.ReplaceAll(out.String(), "\r\n", "\n"))
+		case xhtml.TextToken:
+			out.Write(tokenizer.Text())
+		case xhtml.StartTagToken, xhtml.SelfClosingTagToken:
+			token := tokenizer.Token()
+			switch token.Data {
+			case "a":
+				for _, attr := range token.Attr {
+					if attr.Key == "href" {
+						href = attr.Val
+					}
+				}
+			case "br":
+				out.WriteString("\n")
+			}
+		case xhtml.EndTagToken:
+			name, _ := tokenizer.TagName()
+			switch string(name) {
+			case "a":
+				if href != "" {
+					out.WriteString(" (" + href + ")")
+					href = ""
+				}
+			case "p", "div", "h1", "h2", "h3", "h4", "h5", "h6", "li", "tr", "pre", "blockquote":
+				out.WriteString("\n")
+			}
+		}
+	}
+}
+
+// alertEmailHTML returns the HTML part of an alert email: the body template of
+// the settings with the text variables escaped, or the alert as the bot sends
+// it if there is none.
+func alertEmailHTML(config *entity.AlertConfig, vars map[string]string) (string, error) {
+	if strings.TrimSpace(config.EmailBody) == "" {
+		return `<div style="font-family: sans-serif; white-space: pre-wrap">` + vars["Message"] + `</div>`, nil
+	}
+	escaped := make(map[string]string, len(vars))
+	for name, value := range vars {
+		escaped[name] = html.EscapeString(value)
+	}
+	escaped["Message"] = vars["Message"]
+	return renderAlertTemplate("body", config.EmailBody, escaped)
+}
+
+// sendAlertEmail sends an alert to the recipients of config, with a plain text
+// and an HTML alternative.
+func sendAlertEmail(config *entity.AlertConfig, vars map[string]string) error {
+	subject, err := renderAlertTemplate("subject", config.EmailSubject, vars)
+	if err != nil {
+		return err
+	}
+	if subject = strings.Join(strings.Fields(subject), " "); subject == "" {
+		subject = vars["Title"]
+	}
+	body, err := alertEmailHTML(config, vars)
+	if err != nil {
+		return err
+	}
+	from, err := mail.ParseAddress(config.SmtpFrom)
+	if err != nil {
+		return err
+	}
+	to, err := mail.ParseAddressList(config.SmtpTo)
+	if err != nil {
+		return err
+	}
+
+	var message bytes.Buffer
+	parts := multipart.NewWriter(&message)
+	recipients := make([]string, 0, len(to))
+	for _, address := range to {
+		recipients = append(recipients, address.String())
+	}
+	domain := from.Address[strings.LastIndex(from.Address, "@")+1:]
+	headers := [][2]string{
+		{"From", from.String()},
+		{"To", strings.Join(recipients, ", ")},
+		{"Subject", mime.QEncoding.Encode("utf-8", subject)},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"Message-ID", "<" + uuid.NewString() + "@" + domain + ">"},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "multipart/alternative; boundary=" + parts.Boundary()},
+	}
+	for _, header := range headers {
+		message.WriteString(header[0] + ": " + header[1] + "\r\n")
+	}
+	message.WriteString("\r\n")
+	for _, part := range [][2]string{{"text/plain", alertText(body)}, {"text/html", body}} {
+		writer, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part[0] + "; charset=utf-8"},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return err
+		}
+		encoder := quotedprintable.NewWriter(writer)
+		if _, err := io.WriteString(encoder, part[1]); err != nil {
+			return err
+		}
+		encoder.Close()
+	}
+	parts.Close()
+
+	client, err := dialSmtp(config)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if config.SmtpUsername != "" {
+		if err := client.Auth(smtp.PlainAuth("", config.SmtpUsername, config.SmtpPassword, config.SmtpHost)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(from.Address); err != nil {
+		return err
+	}
+	for _, address := range to {
+		if err := client.Rcpt(address.Address); err != nil {
+			return err
+		}
+	}
+	data, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := data.Write(message.Bytes()); err != nil {
+		return err
+	}
+	if err := data.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// dialSmtp connects to the SMTP server of config, over TLS from the start or
+// after STARTTLS as its security says.
+func dialSmtp(config *entity.AlertConfig) (*smtp.Client, error) {
+	address := net.JoinHostPort(config.SmtpHost, strconv.Itoa(config.SmtpPort))
+	dialer := &net.Dialer{Timeout: alertTimeout}
+	tlsConfig := &tls.Config{ServerName: config.SmtpHost}
+	var conn net.Conn
+	var err error
+	if config.SmtpSecurity == entity.SmtpSecuritySSL {
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(alertTimeout))
+	client, err := smtp.NewClient(conn, config.SmtpHost)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if config.SmtpSecurity == entity.SmtpSecurityStartTLS {
+		if err := client.StartTLS(tlsConfig); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+	return client, nil
+}
+
+// postAlertWebhook posts an alert to the webhook of alertConfig as JSON, signed like
+// the event webhooks if it has a secret.
+func postAlertWebhook(alertConfig *entity.AlertConfig, vars map[string]string) error {
+	body, err := json.Marshal(map[string]any{
+		"alert":  vars["Alert"],
+		"server": vars["ServerName"],
+		"title":  vars["Title"],
+		"text":   vars["Text"],
+		"html":   vars["Message"],
+		"time":   vars["Time"],
+	})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), alertTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, alertConfig.WebhookUrl, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "3x-ui/"+config.GetVersion())
+	req.Header.Set("X-XUI-Alert", vars["Alert"])
+	if alertConfig.WebhookSecret != "" {
+		req.Header.Set("X-XUI-Signature", signWebhook(alertConfig.WebhookSecret, body))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, webhookBodyLimit))
+	if resp.StatusCode >= 300 {
+		return common.NewError("the alert webhook answered", resp.Status)
+	}
+	return nil
+}
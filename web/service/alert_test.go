@@ -0,0 +1,324 @@
+package service
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/textproto"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"x-ui/web/entity"
+)
+
+const alertTestMsg = "🆘 The backup <b>x-ui.db.gz</b> couldn't be uploaded to <a href=\"https://s3.example.com\">s3</a>.\r\nError: <code>timeout &amp; retry</code>"
+
+// smtpRecorder is an SMTP server taking one message without authentication,
+// and keeping its envelope and its data.
+type smtpRecorder struct {
+	listener net.Listener
+	from     string
+	to       []string
+	data     string
+	done     chan struct{}
+}
+
+func newSmtpRecorder(t *testing.T) *smtpRecorder {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &smtpRecorder{listener: listener, done: make(chan struct{})}
+	t.Cleanup(func() { listener.Close() })
+	go r.serve()
+	return r
+}
+
+func (r *smtpRecorder) port() int {
+	return r.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (r *smtpRecorder) serve() {
+	defer close(r.done)
+	conn, err := r.listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 mail.example.com ESMTP")
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		command, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(command) {
+		case "EHLO", "HELO":
+			text.PrintfLine("250 mail.example.com")
+		case "MAIL":
+			r.from = strings.Trim(strings.TrimPrefix(arg, "FROM:"), "<>")
+			text.PrintfLine("250 OK")
+		case "RCPT":
+			r.to = append(r.to, strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>"))
+			text.PrintfLine("250 OK")
+		case "DATA":
+			text.PrintfLine("354 Go ahead")
+			data, err := text.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			r.data = string(data)
+			text.PrintfLine("250 Queued")
+		case "QUIT":
+			text.PrintfLine("221 Bye")
+			return
+		default:
+			text.PrintfLine("502 Not implemented")
+		}
+	}
+}
+
+func TestParseAlertChannels(t *testing.T) {
+	channels, err := parseAlertChannels(`{"backup":["email","webhook"],"login":[]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(channels[AlertBackup], []string{"email", "webhook"}) || channels[AlertLogin] == nil || len(channels[AlertLogin]) != 0 {
+		t.Errorf("the channels are %v", channels)
+	}
+	if channels, err := parseAlertChannels(" "); err != nil || len(channels) != 0 {
+		t.Errorf("no channels were parsed to %v, %v", channels, err)
+	}
+	for _, invalid := range []string{`{"backup":["sms"]}`, `{"weather":["email"]}`, `["email"]`, `{"backup":"email"}`} {
+		if _, err := parseAlertChannels(invalid); err == nil {
+			t.Errorf("the channels %s were parsed", invalid)
+		}
+	}
+}
+
+func TestAlertText(t *testing.T) {
+	want := "🆘 The backup x-ui.db.gz couldn't be uploaded to s3 (https://s3.example.com).\nError: timeout & retry"
+	if text := alertText(alertTestMsg); text != want {
+		t.Errorf("the text of the alert is %q, want %q", text, want)
+	}
+	if text := alertText("<p>Line 1</p><p>Line 2<br>Line 3</p>"); text != "Line 1\nLine 2\nLine 3" {
+		t.Errorf("the blocks are %q", text)
+	}
+}
+
+func TestAlertRoutes(t *testing.T) {
+	newTestDB(t)
+	var s AlertService
+	// Telegram is the default, and only while the bot runs
+	if channels := s.Channels(AlertBackup); !slices.Equal(channels, []string{AlertChannelTelegram}) {
+		t.Errorf("the default channels are %v", channels)
+	}
+	if routes := s.Routes(AlertBackup); len(routes) != 0 {
+		t.Errorf("the alerts go to %v without the bot", routes)
+	}
+
+	if err := s.settingService.setString("alertChannels", `{"backup":["telegram","email","webhook"],"login":[]}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.settingService.setString("alertWebhookUrl", "https://hooks.example.com/alerts"); err != nil {
+		t.Fatal(err)
+	}
+	// The email isn't set up
+	if routes := s.Routes(AlertBackup); !slices.Equal(routes, []string{AlertChannelWebhook}) {
+		t.Errorf("the backup alerts go to %v", routes)
+	}
+	if routes := s.Routes(AlertLogin); len(routes) != 0 {
+		t.Errorf("the login alerts without channels go to %v", routes)
+	}
+	if channels := s.Channels(AlertPanic); !slices.Equal(channels, []string{AlertChannelTelegram}) {
+		t.Errorf("the alerts missing from the settings go to %v", channels)
+	}
+}
+
+func TestAlertWebhook(t *testing.T) {
+	var body []byte
+	var header http.Header
+	status := http.StatusNoContent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = io.ReadAll(r.Body)
+		header = r.Header
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	config := &entity.AlertConfig{WebhookUrl: server.URL, WebhookSecret: "alert-secret"}
+	sent := time.Date(2025, 1, 31, 6, 0, 0, 0, time.Local)
+	delivery := alertDelivery{channel: AlertChannelWebhook, kind: AlertBackup, msg: alertTestMsg, time: sent}
+	if err := deliverAlert(config, delivery); err != nil {
+		t.Fatal(err)
+	}
+	if header.Get("X-XUI-Alert") != AlertBackup || header.Get("X-XUI-Signature") != signWebhook("alert-secret", body) {
+		t.Errorf("the webhook got the headers %v", header)
+	}
+	var payload map[string]string
+	if err := json.Unmarshal(body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload["alert"] != AlertBackup || payload["html"] != alertTestMsg || payload["time"] != "2025-01-31 06:00:00" ||
+		payload["title"] != "🆘 The backup x-ui.db.gz couldn't be uploaded to s3 (https://s3.example.com)." ||
+		!strings.HasSuffix(payload["text"], "Error: timeout & retry") {
+		t.Errorf("the webhook got %s", body)
+	}
+
+	status = http.StatusBadGateway
+	if err := deliverAlert(config, delivery); err == nil || !strings.Contains(err.Error(), "502") {
+		t.Errorf("a failed delivery returned %v", err)
+	}
+	if err := deliverAlert(&entity.AlertConfig{}, delivery); err == nil {
+		t.Error("an alert was delivered without a webhook")
+	}
+}
+
+// alertEmailParts returns the subject of the email data and the decoded text
+// of its parts by content type.
+func alertEmailParts(t *testing.T, data string) (string, map[string]string) {
+	t.Helper()
+	message, err := mail.ReadMessage(strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(message.Header.Get("Subject"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, err := mime.ParseMediaType(message.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("the email is %s: %v", mediaType, err)
+	}
+	parts := map[string]string{}
+	reader := multipart.NewReader(message.Body, params["boundary"])
+	for {
+		part, err := reader.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if part.Header.Get("Content-Transfer-Encoding") != "quoted-printable" {
+			t.Errorf("the part %s is not quoted-printable", part.Header.Get("Content-Type"))
+		}
+		decoded, err := io.ReadAll(quotedprintable.NewReader(part))
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts[part.Header.Get("Content-Type")] = string(decoded)
+	}
+	return subject, parts
+}
+
+func TestAlertEmail(t *testing.T) {
+	server := newSmtpRecorder(t)
+	config := &entity.AlertConfig{
+		SmtpHost: "127.0.0.1", SmtpPort: server.port(), SmtpSecurity: entity.SmtpSecurityNone,
+		SmtpFrom: "3x-ui <panel@example.com>", SmtpTo: "admin@example.com, Ops <ops@example.com>",
+		EmailSubject: "[{{.ServerName}}] {{.Alert}}:\n{{.Title}}",
+		EmailBody:    "<h1>{{.Title}}</h1><p>{{.Message}}</p><small>{{.Time}}</small>",
+	}
+	sent := time.Date(2025, 1, 31, 6, 0, 0, 0, time.Local)
+	delivery := alertDelivery{channel: AlertChannelEmail, kind: AlertBackup, msg: alertTestMsg, time: sent}
+	if err := deliverAlert(config, delivery); err != nil {
+		t.Fatal(err)
+	}
+	<-server.done
+	if server.from != "panel@example.com" || !slices.Equal(server.to, []string{"admin@example.com", "ops@example.com"}) {
+		t.Errorf("the envelope is from %q to %q", server.from, server.to)
+	}
+
+	subject, parts := alertEmailParts(t, server.data)
+	title := "🆘 The backup x-ui.db.gz couldn't be uploaded to s3 (https://s3.example.com)."
+	if !strings.HasSuffix(subject, "] backup: "+title) {
+		t.Errorf("the subject is %q", subject)
+	}
+	// The variables are escaped in the HTML, but the message of the bot; the
+	// server reads the lines without their CR
+	html := parts["text/html; charset=utf-8"]
+	if !strings.Contains(html, "<h1>🆘 The backup x-ui.db.gz couldn&#39;t be uploaded") || !strings.Contains(html, "<p>"+strings.ReplaceAll(alertTestMsg, "\r\n", "\n")+"</p>") ||
+		!strings.Contains(html, "<small>2025-01-31 06:00:00</small>") {
+		t.Errorf("the HTML part is %q", html)
+	}
+	text := parts["text/plain; charset=utf-8"]
+	if !strings.HasPrefix(text, title+"\n") || !strings.Contains(text, "Error: timeout & retry") || strings.Contains(text, "<") {
+		t.Errorf("the text part is %q", text)
+	}
+}
+
+func TestAlertEmailDefaultBody(t *testing.T) {
+	server := newSmtpRecorder(t)
+	config := &entity.AlertConfig{
+		SmtpHost: "127.0.0.1", SmtpPort: server.port(), SmtpSecurity: entity.SmtpSecurityNone,
+		SmtpFrom: "panel@example.com", SmtpTo: "admin@example.com",
+	}
+	delivery := alertDelivery{channel: AlertChannelEmail, kind: AlertXray, msg: "Xray <b>crashed</b>", time: time.Now()}
+	if err := deliverAlert(config, delivery); err != nil {
+		t.Fatal(err)
+	}
+	<-server.done
+	// Without templates the title is the subject, the alert the body
+	subject, parts := alertEmailParts(t, server.data)
+	if subject != "Xray crashed" || !strings.Contains(parts["text/html; charset=utf-8"], "Xray <b>crashed</b>") ||
+		parts["text/plain; charset=utf-8"] != "Xray crashed" {
+		t.Errorf("the email is %q with %q", subject, parts)
+	}
+}
+
+func TestAlertTemplates(t *testing.T) {
+	if err := checkAlertTemplates(entity.AlertConfig{EmailSubject: "{{.ServerName}}: {{.Title}}", EmailBody: "{{.Message}}"}); err != nil {
+		t.Error(err)
+	}
+	for _, invalid := range []entity.AlertConfig{{EmailSubject: "{{.Hostname}}"}, {EmailBody: "{{.Message"}} {
+		if err := checkAlertTemplates(invalid); err == nil {
+			t.Errorf("the templates %+v were taken", invalid)
+		}
+	}
+}
+
+func TestAlertQueue(t *testing.T) {
+	newTestDB(t)
+	received := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Get("X-XUI-Alert")
+	}))
+	defer server.Close()
+	var s AlertService
+	if err := s.settingService.setString("alertWebhookUrl", server.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	// The alert is sent in the background, the producer doesn't wait
+	start := time.Now()
+	s.queue(alertDelivery{channel: AlertChannelWebhook, kind: AlertCpu, msg: "CPU at 99%", time: time.Now()})
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("queueing the alert took %v", elapsed)
+	}
+	select {
+	case kind := <-received:
+		if kind != AlertCpu {
+			t.Errorf("the webhook got the %s alert", kind)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the queued alert wasn't sent")
+	}
+	deadline := time.Now().Add(time.Second)
+	for s.PendingAlerts() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if pending := s.PendingAlerts(); pending != 0 {
+		t.Errorf("%d alerts are still pending", pending)
+	}
+}
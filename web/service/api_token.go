@@ -0,0 +1,131 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/util/common"
+)
+
+const (
+	ApiTokenScopeReadOnly  = "ro"
+	ApiTokenScopeReadWrite = "rw"
+
+	apiTokenPrefix       = "xui_"
+	apiTokenBytes        = 32
+	apiTokenDisplayChars = 8
+	apiTokenMaxName      = 64
+
+	// apiTokenTouchInterval limits how often the last used time is written, so a
+	// busy script doesn't cause a database write on every request
+	apiTokenTouchInterval = time.Minute
+)
+
+// ApiTokenService manages personal access tokens for the panel API.
+type ApiTokenService struct{}
+
+func (s *ApiTokenService) GetTokens(userId int) ([]*model.ApiToken, error) {
+	tokens := make([]*model.ApiToken, 0)
+	err := database.GetDB().Model(model.ApiToken{}).
+		Where("user_id = ?", userId).
+		Order("id").
+		Find(&tokens).Error
+	return tokens, err
+}
+
+// CreateToken stores a new token and returns its secret, which is never available
+// again afterwards. expiresAt is in unix milliseconds, zero means no expiry.
+func (s *ApiTokenService) CreateToken(userId int, name string, scope string, expiresAt int64) (string, *model.ApiToken, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", nil, common.NewError("token name can not be empty")
+	}
+	if len([]rune(name)) > apiTokenMaxName {
+		return "", nil, common.NewErrorf("token name is longer than %d characters", apiTokenMaxName)
+	}
+	switch scope {
+	case "":
+		scope = ApiTokenScopeReadOnly
+	case ApiTokenScopeReadOnly, ApiTokenScopeReadWrite:
+	default:
+		return "", nil, common.NewError("token scope must be ro or rw:", scope)
+	}
+	now := time.Now().UnixMilli()
+	if expiresAt != 0 && expiresAt <= now {
+		return "", nil, common.NewError("token expiry must be in the future")
+	}
+
+	buf := make([]byte, apiTokenBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return "", nil, err
+	}
+	secret := apiTokenPrefix + base64.RawURLEncoding.EncodeToString(buf)
+
+	token := &model.ApiToken{
+		UserId:    userId,
+		Name:      name,
+		Prefix:    secret[:len(apiTokenPrefix)+apiTokenDisplayChars],
+		TokenHash: hashToken(secret),
+		Scope:     scope,
+		ExpiresAt: expiresAt,
+		CreatedAt: now,
+	}
+	if err := database.GetDB().Create(token).Error; err != nil {
+		return "", nil, err
+	}
+	return secret, token, nil
+}
+
+func (s *ApiTokenService) DelToken(userId int, id int) error {
+	result := database.GetDB().
+		Where("id = ? AND user_id = ?", id, userId).
+		Delete(model.ApiToken{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return common.NewError("token not found")
+	}
+	return nil
+}
+
+// Authenticate looks the secret up on every request, so a revoked token stops
+// working immediately.
+func (s *ApiTokenService) Authenticate(secret string) (*model.ApiToken, error) {
+	if !strings.HasPrefix(secret, apiTokenPrefix) {
+		return nil, common.NewError("invalid token")
+	}
+	db := database.GetDB()
+	token := &model.ApiToken{}
+	err := db.Model(model.ApiToken{}).Where("token_hash = ?", hashToken(secret)).First(token).Error
+	if database.IsNotFound(err) {
+		return nil, common.NewError("invalid token")
+	} else if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if token.ExpiresAt != 0 && now.UnixMilli() >= token.ExpiresAt {
+		return nil, common.NewError("token expired")
+	}
+	if now.UnixMilli()-token.LastUsedAt >= apiTokenTouchInterval.Milliseconds() {
+		token.LastUsedAt = now.UnixMilli()
+		if err := db.Model(model.ApiToken{}).Where("id = ?", token.Id).Update("last_used_at", token.LastUsedAt).Error; err != nil {
+			return nil, err
+		}
+	}
+	return token, nil
+}
+
+// hashToken returns the digest under which bearer secrets, like API tokens and
+// session ids, are stored.
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,282 @@
+package service
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+)
+
+const (
+	auditDefaultLimit = 100
+	auditMaxLimit     = 1000
+	auditRedacted     = "***"
+)
+
+// auditSecretWords mark keys whose values never go into an audit diff; a change
+// is still recorded, with both values redacted
+var auditSecretWords = []string{"password", "secret", "privatekey", "token", "presharedkey"}
+
+// auditSecretKeys are key names that hold credentials in xray configs and settings
+var auditSecretKeys = map[string]bool{
+	"pass": true,
+	"psk":  true,
+	"key":  true,
+	"seed": true,
+	"auth": true,
+	// Proxy URLs of the panel settings may carry user:pass
+	"tgbotproxy":        true,
+	"xraydownloadproxy": true,
+}
+
+// AuditFilter selects audit log entries; empty fields match everything. Since and
+// Until are unix milliseconds.
+type AuditFilter struct {
+	EntityType string
+	EntityId   string
+	Actor      string
+	Action     string
+	Since      int64
+	Until      int64
+	Limit      int
+	Offset     int
+}
+
+type AuditService struct{}
+
+// Record stores an entry. Failing to write the audit log doesn't fail the request,
+// the change has already been made.
+func (s *AuditService) Record(entry *model.AuditLog) {
+	if entry.CreatedAt == 0 {
+		entry.CreatedAt = time.Now().UnixMilli()
+	}
+	if err := database.GetDB().Create(entry).Error; err != nil {
+		logger.Warning("write audit log err:", err)
+	}
+}
+
+// GetEntries returns a page of matching entries, newest first, and the number of
+// all matching entries.
+func (s *AuditService) GetEntries(filter AuditFilter) ([]*model.AuditLog, int64, error) {
+	db := database.GetDB().Model(model.AuditLog{})
+	if filter.EntityType != "" {
+		db = db.Where("entity_type = ?", filter.EntityType)
+	}
+	if filter.EntityId != "" {
+		db = db.Where("entity_id = ?", filter.EntityId)
+	}
+	if filter.Actor != "" {
+		db = db.Where("actor = ?", filter.Actor)
+	}
+	if filter.Action != "" {
+		db = db.Where("action = ?", filter.Action)
+	}
+	if filter.Since > 0 {
+		db = db.Where("created_at >= ?", filter.Since)
+	}
+	if filter.Until > 0 {
+		db = db.Where("created_at < ?", filter.Until)
+	}
+
+	var total int64
+	if err := db.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = auditDefaultLimit
+	} else if limit > auditMaxLimit {
+		limit = auditMaxLimit
+	}
+	offset := max(filter.Offset, 0)
+
+	entries := make([]*model.AuditLog, 0)
+	err := db.Order("id DESC").Limit(limit).Offset(offset).Find(&entries).Error
+	return entries, total, err
+}
+
+// Prune deletes the entries older than days; zero days keeps everything.
+func (s *AuditService) Prune(days int) (int64, error) {
+	if days <= 0 {
+		return 0, nil
+	}
+	cutoff := time.Now().AddDate(0, 0, -days).UnixMilli()
+	result := database.GetDB().Where("created_at < ?", cutoff).Delete(model.AuditLog{})
+	return result.RowsAffected, result.Error
+}
+
+// AuditDiff compares the JSON forms of before and after and returns the changed
+// fields as a JSON object of [old, new] pairs, or "" if nothing changed. String
+// fields holding JSON, like the settings of an inbound, are compared field by
+// field, and lists of clients are matched by email.
+func AuditDiff(before any, after any) string {
+	changes := map[string][2]any{}
+	diffAuditValues("", toAuditValue(before), toAuditValue(after), changes)
+	if len(changes) == 0 {
+		return ""
+	}
+	data, err := json.Marshal(changes)
+	if err != nil {
+		logger.Warning("marshal audit diff err:", err)
+		return ""
+	}
+	return string(data)
+}
+
+func toAuditValue(v any) any {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	var value any
+	if err := json.Unmarshal(data, &value); err != nil {
+		return nil
+	}
+	return value
+}
+
+func diffAuditValues(path string, before any, after any, changes map[string][2]any) {
+	if reflect.DeepEqual(before, after) {
+		return
+	}
+	if isAuditSecret(path) {
+		changes[path] = [2]any{auditRedacted, auditRedacted}
+		return
+	}
+	if parsed, ok := parseAuditJSON(before, after); ok {
+		before, after = parsed[0], parsed[1]
+	}
+
+	switch b := before.(type) {
+	case map[string]any:
+		if a, ok := after.(map[string]any); ok {
+			for key, value := range b {
+				diffAuditValues(joinAuditPath(path, key), value, a[key], changes)
+			}
+			for key, value := range a {
+				if _, ok := b[key]; !ok {
+					diffAuditValues(joinAuditPath(path, key), nil, value, changes)
+				}
+			}
+			return
+		}
+	case []any:
+		if a, ok := after.([]any); ok {
+			bByEmail, okBefore := auditByEmail(b)
+			aByEmail, okAfter := auditByEmail(a)
+			if okBefore && okAfter {
+				for email, value := range bByEmail {
+					diffAuditValues(path+"["+email+"]", value, aByEmail[email], changes)
+				}
+				for email, value := range aByEmail {
+					if _, ok := bByEmail[email]; !ok {
+						diffAuditValues(path+"["+email+"]", nil, value, changes)
+					}
+				}
+				return
+			}
+		}
+	}
+	changes[path] = [2]any{redactAuditValue(before), redactAuditValue(after)}
+}
+
+// parseAuditJSON decodes two strings that both hold a JSON object or array.
+func parseAuditJSON(before any, after any) ([2]any, bool) {
+	var parsed [2]any
+	for i, v := range []any{before, after} {
+		s, ok := v.(string)
+		s = strings.TrimSpace(s)
+		if !ok || s == "" || (s[0] != '{' && s[0] != '[') {
+			return parsed, false
+		}
+		if err := json.Unmarshal([]byte(s), &parsed[i]); err != nil {
+			return parsed, false
+		}
+	}
+	return parsed, true
+}
+
+// auditByEmail indexes a list of objects by their email field, if all of them
+// have a distinct one.
+func auditByEmail(list []any) (map[string]any, bool) {
+	byEmail := make(map[string]any, len(list))
+	for _, item := range list {
+		obj, ok := item.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		email, ok := obj["email"].(string)
+		if !ok || email == "" {
+			return nil, false
+		}
+		if _, dup := byEmail[email]; dup {
+			return nil, false
+		}
+		byEmail[email] = obj
+	}
+	return byEmail, len(byEmail) > 0
+}
+
+// redactAuditValue replaces the secrets inside a value that is recorded whole,
+// such as an added client.
+func redactAuditValue(v any) any {
+	if s, ok := v.(string); ok {
+		var parsed any
+		if trimmed := strings.TrimSpace(s); trimmed != "" && (trimmed[0] == '{' || trimmed[0] == '[') &&
+			json.Unmarshal([]byte(trimmed), &parsed) == nil {
+			return redactAuditValue(parsed)
+		}
+		return s
+	}
+	switch value := v.(type) {
+	case map[string]any:
+		redacted := make(map[string]any, len(value))
+		for key, item := range value {
+			if isAuditSecret(key) {
+				redacted[key] = auditRedacted
+			} else {
+				redacted[key] = redactAuditValue(item)
+			}
+		}
+		return redacted
+	case []any:
+		redacted := make([]any, len(value))
+		for i, item := range value {
+			redacted[i] = redactAuditValue(item)
+		}
+		return redacted
+	}
+	return v
+}
+
+func joinAuditPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// isAuditSecret checks the last key of a path like "settings.clients[a@b].password".
+func isAuditSecret(path string) bool {
+	key := path
+	if i := strings.LastIndex(key, "."); i >= 0 {
+		key = key[i+1:]
+	}
+	if strings.HasSuffix(key, "]") {
+		return false
+	}
+	key = strings.ToLower(key)
+	if auditSecretKeys[key] {
+		return true
+	}
+	for _, word := range auditSecretWords {
+		if strings.Contains(key, word) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,535 @@
+package service
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"x-ui/config"
+	"x-ui/database"
+	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/util/crypto"
+	"x-ui/xray"
+)
+
+const (
+	// backupTimeLayout is the time in the name of a backup
+	backupTimeLayout = "20060102-150405"
+	// backupArchiveDB is the database in a backup archive, next to the files
+	// under backupArchiveFiles by their absolute paths
+	backupArchiveDB    = "x-ui.db"
+	backupArchiveFiles = "files"
+	// encryptedExt ends the name of a backup encrypted with the passphrase
+	encryptedExt = ".enc"
+)
+
+// backupName matches the backups the panel made, x-ui-<time>-v<version>.db or
+// .tar.gz with the xray config and the certificates, and .enc once encrypted.
+var backupName = regexp.MustCompile(`^x-ui-(\d{8}-\d{6})-v([0-9A-Za-z._+-]+?)\.(db|tar\.gz)(\.enc)?$`)
+
+var errBackupNotFound = errors.New("backup not found")
+
+// BackupFile is a backup of the backup folder.
+type BackupFile struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	Time    time.Time `json:"time"`
+	Version string    `json:"version"`
+	// Archive tells that it is a tar.gz with the files of Xray and the panel
+	Archive bool `json:"archive"`
+	// Encrypted tells that it takes the passphrase to restore
+	Encrypted bool `json:"encrypted"`
+}
+
+// BackupService backs the database up to the backup folder on a schedule, and
+// restores those backups.
+type BackupService struct {
+	settingService SettingService
+	inboundService InboundService
+	serverService  ServerService
+	webhookService WebhookService
+}
+
+// GetDir returns the backup folder, a backups folder next to the database if
+// it isn't set.
+func (s *BackupService) GetDir() (string, error) {
+	dir, err := s.settingService.GetBackupDir()
+	if err != nil {
+		return "", err
+	}
+	if dir == "" {
+		dir = filepath.Join(config.GetDBFolderPath(), "backups")
+	}
+	return dir, nil
+}
+
+// List returns the backups of the backup folder, the last one first.
+func (s *BackupService) List() ([]*BackupFile, error) {
+	dir, err := s.GetDir()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return []*BackupFile{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	backups := []*BackupFile{}
+	for _, entry := range entries {
+		match := backupName.FindStringSubmatch(entry.Name())
+		if match == nil || !entry.Type().IsRegular() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		t, err := time.ParseInLocation(backupTimeLayout, match[1], time.Local)
+		if err != nil {
+			continue
+		}
+		backups = append(backups, &BackupFile{
+			Name:      entry.Name(),
+			Size:      info.Size(),
+			Time:      t,
+			Version:   match[2],
+			Archive:   match[3] == "tar.gz",
+			Encrypted: match[4] != "",
+		})
+	}
+	slices.SortFunc(backups, func(a, b *BackupFile) int {
+		return b.Time.Compare(a.Time)
+	})
+	return backups, nil
+}
+
+// Create backs the database up to the backup folder, with the xray config and
+// the certificates in a tar.gz if the settings include them. The copy is
+// checked before it is kept, and only then are the backups beyond those to
+// keep removed.
+func (s *BackupService) Create() (*BackupFile, error) {
+	if !database.IsSQLite() {
+		return nil, common.NewErrorf("Backing up to a folder is %v", database.ErrNotSQLite)
+	}
+	dir, err := s.GetDir()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	includeFiles, err := s.settingService.GetBackupIncludeFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	// The backup has the traffic counted so far
+	if err := s.inboundService.FlushTraffic(); err != nil {
+		logger.Warning("flush traffic before backup failed:", err)
+	}
+	start := time.Now()
+	base := fmt.Sprintf("x-ui-%s-v%s", start.Format(backupTimeLayout), config.GetVersion())
+	dbTemp := filepath.Join(dir, "."+base+".db.tmp")
+	defer os.Remove(dbTemp)
+	if err := database.BackupTo(dbTemp); err != nil {
+		return nil, common.NewErrorf("backing up the database failed: %v", err)
+	}
+	if err := database.CheckIntegrity(dbTemp); err != nil {
+		return nil, common.NewErrorf("the backup of the database is not valid: %v", err)
+	}
+
+	name := base + ".db"
+	if includeFiles {
+		name = base + ".tar.gz"
+		archiveTemp := filepath.Join(dir, "."+name+".tmp")
+		defer os.Remove(archiveTemp)
+		if err := writeBackupArchive(archiveTemp, dbTemp, s.backupFiles()); err != nil {
+			return nil, common.NewErrorf("archiving the backup failed: %v", err)
+		}
+		dbTemp = archiveTemp
+	}
+	passphrase, err := s.settingService.GetBackupPassphrase()
+	if err != nil {
+		return nil, err
+	}
+	if passphrase != "" {
+		name += encryptedExt
+		encryptedTemp := filepath.Join(dir, "."+name+".tmp")
+		defer os.Remove(encryptedTemp)
+		if err := encryptFile(dbTemp, encryptedTemp, passphrase); err != nil {
+			return nil, common.NewErrorf("encrypting the backup failed: %v", err)
+		}
+		dbTemp = encryptedTemp
+	}
+	path := filepath.Join(dir, name)
+	if err := os.Rename(dbTemp, path); err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	logger.Infof("database backed up to %s in %v", path, time.Since(start).Round(time.Millisecond))
+
+	if err := s.prune(); err != nil {
+		logger.Warning("Unable to remove the old backups:", err)
+	}
+	backup := &BackupFile{
+		Name:      name,
+		Size:      info.Size(),
+		Time:      start.Truncate(time.Second),
+		Version:   config.GetVersion(),
+		Archive:   includeFiles,
+		Encrypted: passphrase != "",
+	}
+	s.webhookService.Emit(WebhookBackupCompleted, backup)
+	return backup, nil
+}
+
+// prune removes the oldest backups beyond those to keep, none if it is 0.
+func (s *BackupService) prune() error {
+	keep, err := s.settingService.GetBackupKeep()
+	if err != nil || keep <= 0 {
+		return err
+	}
+	backups, err := s.List()
+	if err != nil || len(backups) <= keep {
+		return err
+	}
+	dir, err := s.GetDir()
+	if err != nil {
+		return err
+	}
+	for _, backup := range backups[keep:] {
+		if err := os.Remove(filepath.Join(dir, backup.Name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backupFiles returns the files a backup archive takes with the database: the
+// xray config, the certificates of the panel and of the subscriptions, and
+// those the inbounds use for TLS.
+func (s *BackupService) backupFiles() []string {
+	files := []string{xray.GetConfigPath()}
+	for _, get := range []func() (string, error){
+		s.settingService.GetCertFile, s.settingService.GetKeyFile,
+		s.settingService.GetSubCertFile, s.settingService.GetSubKeyFile,
+	} {
+		if file, err := get(); err == nil && file != "" {
+			files = append(files, file)
+		}
+	}
+	inbounds, err := s.inboundService.GetAllInbounds()
+	if err != nil {
+		logger.Warning("Unable to read the certificates of the inbounds for the backup:", err)
+	}
+	for _, inbound := range inbounds {
+		files = append(files, streamCertificateFiles(inbound.StreamSettings)...)
+	}
+	files = append(files, acmeCertificateFiles()...)
+
+	paths := []string{}
+	for _, file := range files {
+		if file == "" {
+			continue
+		}
+		path, err := filepath.Abs(file)
+		if err == nil && !slices.Contains(paths, path) {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// streamCertificateFiles returns the certificate and key files the TLS
+// settings of the stream settings of an inbound refer to.
+func streamCertificateFiles(streamSettings string) []string {
+	var stream struct {
+		TLSSettings struct {
+			Certificates []struct {
+				CertificateFile string `json:"certificateFile"`
+				KeyFile         string `json:"keyFile"`
+			} `json:"certificates"`
+		} `json:"tlsSettings"`
+	}
+	if json.Unmarshal([]byte(streamSettings), &stream) != nil {
+		return nil
+	}
+	files := []string{}
+	for _, certificate := range stream.TLSSettings.Certificates {
+		for _, file := range []string{certificate.CertificateFile, certificate.KeyFile} {
+			if file != "" {
+				files = append(files, file)
+			}
+		}
+	}
+	return files
+}
+
+// writeBackupArchive writes a tar.gz to path with the database at dbPath and
+// the files, those missing skipped.
+func writeBackupArchive(path string, dbPath string, files []string) error {
+	out, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	gz := gzip.NewWriter(out)
+	tw := tar.NewWriter(gz)
+	if err := addToArchive(tw, dbPath, backupArchiveDB); err != nil {
+		return err
+	}
+	for _, file := range files {
+		name := backupArchiveFiles + "/" + strings.TrimPrefix(filepath.ToSlash(file), "/")
+		if err := addToArchive(tw, file, name); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return out.Sync()
+}
+
+func addToArchive(tw *tar.Writer, path string, name string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, file)
+	return err
+}
+
+// Restore replaces the database with the backup of name, decrypted with
+// passphrase, or the backup passphrase if it is empty. The database is staged
+// out of the backup and checked first, and the current one is put back if Xray
+// doesn't start on it. The files of an archive are not restored, they are in it
+// to be copied back by hand. The panel should be restarted after.
+func (s *BackupService) Restore(name string, passphrase string) error {
+	if !database.IsSQLite() {
+		return common.NewErrorf("Restoring a backup is %v", database.ErrNotSQLite)
+	}
+	path, cleanup, err := s.stageBackup(name, passphrase)
+	defer cleanup()
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := s.serverService.importDB(file, "", true); err != nil {
+		return err
+	}
+	logger.Info("database restored from the backup", name)
+	return nil
+}
+
+// Verify checks the database of a backup of the backup folder, decrypted with
+// the backup passphrase if it is encrypted.
+func (s *BackupService) Verify(name string) error {
+	_, cleanup, err := s.stageBackup(name, "")
+	cleanup()
+	return err
+}
+
+// stageBackup returns the path of the database of a backup, decrypted and out
+// of its archive into the backup folder if it must be, once it is checked.
+// cleanup removes what was staged.
+func (s *BackupService) stageBackup(name string, passphrase string) (path string, cleanup func(), err error) {
+	staged := []string{}
+	cleanup = func() {
+		for _, file := range staged {
+			os.Remove(file)
+		}
+	}
+	match := backupName.FindStringSubmatch(name)
+	if match == nil {
+		return "", cleanup, errBackupNotFound
+	}
+	dir, err := s.GetDir()
+	if err != nil {
+		return "", cleanup, err
+	}
+	path = filepath.Join(dir, name)
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return "", cleanup, errBackupNotFound
+		}
+		return "", cleanup, err
+	}
+
+	if match[4] != "" {
+		if passphrase == "" {
+			if passphrase, err = s.settingService.GetBackupPassphrase(); err != nil {
+				return "", cleanup, err
+			}
+		}
+		decrypted := filepath.Join(dir, "."+strings.TrimSuffix(name, encryptedExt)+".restore")
+		staged = append(staged, decrypted)
+		if err := decryptFile(path, decrypted, passphrase); err != nil {
+			return "", cleanup, common.NewErrorf("decrypting the backup failed: %v", err)
+		}
+		path = decrypted
+	}
+	if match[3] == "tar.gz" {
+		db := filepath.Join(dir, "."+name+".restore.db")
+		staged = append(staged, db)
+		if err := extractBackupDB(path, db); err != nil {
+			return "", cleanup, common.NewErrorf("reading the backup failed: %v", err)
+		}
+		path = db
+	}
+	if err := database.CheckIntegrity(path); err != nil {
+		return "", cleanup, common.NewErrorf("the backup is not valid: %v", err)
+	}
+	return path, cleanup, nil
+}
+
+// extractBackupDB writes the database of the backup archive at path to dest.
+func extractBackupDB(path string, dest string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	gz, err := gzip.NewReader(in)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return errors.New("the archive has no database")
+		}
+		if err != nil {
+			return err
+		}
+		if header.Name != backupArchiveDB {
+			continue
+		}
+		out, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, tr)
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	}
+}
+
+// encryptBackup returns data encrypted with the backup passphrase and name with
+// the .enc extension, both as they are if there is no passphrase.
+func (s *SettingService) encryptBackup(data []byte, name string) ([]byte, string, error) {
+	passphrase, err := s.GetBackupPassphrase()
+	if err != nil || passphrase == "" {
+		return data, name, err
+	}
+	encrypted, err := crypto.EncryptBytes(data, passphrase)
+	if err != nil {
+		return nil, "", err
+	}
+	return encrypted, name + encryptedExt, nil
+}
+
+// isEncryptedFile tells if file starts like an encrypted backup.
+func isEncryptedFile(file io.ReaderAt) (bool, error) {
+	header := make([]byte, 16)
+	n, err := file.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	return crypto.IsEncrypted(header[:n]), nil
+}
+
+// encryptFile writes the file at path encrypted with passphrase to dest.
+func encryptFile(path string, dest string, passphrase string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	w, err := crypto.NewEncryptWriter(out, passphrase)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, in); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return out.Sync()
+}
+
+// decryptFile writes the encrypted file at path decrypted with passphrase to
+// dest, removed again if it doesn't decrypt to the end.
+func decryptFile(path string, dest string, passphrase string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	r, err := crypto.NewDecryptReader(in, passphrase)
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, r)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dest)
+	}
+	return err
+}
@@ -0,0 +1,483 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/util/crypto"
+	"x-ui/util/random"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The kinds of remote a backup is uploaded to.
+const (
+	RemoteS3     = "s3"
+	RemoteWebDAV = "webdav"
+	RemoteSFTP   = "sftp"
+)
+
+const (
+	// remoteTimeout bounds an upload to a remote, and the removal of its old
+	// backups
+	remoteTimeout = 10 * time.Minute
+	// remoteTries is how many times an upload is tried, remoteRetryWait more
+	// apart each time
+	remoteTries     = 3
+	remoteRetryWait = 10 * time.Second
+	// remoteSecretMask stands for a secret of a remote that is set: the API
+	// never returns the secrets, and a remote saved with the mask keeps its own
+	remoteSecretMask = "********"
+)
+
+// BackupRemote is where the backups are uploaded to after they are made, and
+// how many of them are kept there.
+type BackupRemote struct {
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Enable bool   `json:"enable"`
+	// Keep is how many backups the remote keeps, all of them for 0
+	Keep int `json:"keep"`
+
+	// Endpoint, Region, Bucket, Prefix, PathStyle and the keys are for S3
+	Endpoint  string `json:"endpoint,omitempty"`
+	Region    string `json:"region,omitempty"`
+	Bucket    string `json:"bucket,omitempty"`
+	Prefix    string `json:"prefix,omitempty"`
+	PathStyle bool   `json:"pathStyle,omitempty"`
+	AccessKey string `json:"accessKey,omitempty"`
+	SecretKey string `json:"secretKey,omitempty"`
+
+	// URL is the folder of the backups on WebDAV
+	URL string `json:"url,omitempty"`
+
+	// Host, HostKey, PrivateKey and Path are for SFTP. HostKey is the SHA256
+	// fingerprint of the key the server must have
+	Host       string `json:"host,omitempty"`
+	HostKey    string `json:"hostKey,omitempty"`
+	PrivateKey string `json:"privateKey,omitempty"`
+	Path       string `json:"path,omitempty"`
+
+	// Username and Password are for WebDAV and SFTP
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// secrets returns the secrets of the remote, to encrypt, decrypt or mask them.
+func (r *BackupRemote) secrets() []*string {
+	return []*string{&r.SecretKey, &r.Password, &r.PrivateKey}
+}
+
+// Masked returns the remote with the mask for each secret that is set.
+func (r BackupRemote) Masked() BackupRemote {
+	for _, secret := range r.secrets() {
+		if *secret != "" {
+			*secret = remoteSecretMask
+		}
+	}
+	return r
+}
+
+func (r *BackupRemote) validate() error {
+	if r.Name == "" {
+		return common.NewError("a remote has no name")
+	}
+	if r.Keep < 0 {
+		return common.NewErrorf("the backups to keep on %s must not be negative", r.Name)
+	}
+	for _, secret := range r.secrets() {
+		// unmask left it, so no saved remote has the name
+		if *secret == remoteSecretMask {
+			return common.NewErrorf("a secret of %s is masked but the remote is new", r.Name)
+		}
+	}
+	switch r.Type {
+	case RemoteS3:
+		if u, err := url.Parse(r.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil {
+			return common.NewErrorf("the endpoint of %s is not an http(s) URL without credentials", r.Name)
+		}
+		if r.Bucket == "" || r.AccessKey == "" || r.SecretKey == "" {
+			return common.NewErrorf("%s needs a bucket, an access key and a secret key", r.Name)
+		}
+	case RemoteWebDAV:
+		if u, err := url.Parse(r.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil {
+			return common.NewErrorf("the URL of %s is not an http(s) URL without credentials", r.Name)
+		}
+	case RemoteSFTP:
+		if r.Host == "" || r.Username == "" || r.Path == "" {
+			return common.NewErrorf("%s needs a host, a username and a path", r.Name)
+		}
+		if r.Password == "" && r.PrivateKey == "" {
+			return common.NewErrorf("%s needs a password or a private key", r.Name)
+		}
+		if r.PrivateKey != "" {
+			if _, err := ssh.ParsePrivateKey([]byte(r.PrivateKey)); err != nil {
+				return common.NewErrorf("the private key of %s is not valid: %v", r.Name, err)
+			}
+		}
+		if r.HostKey != "" && !strings.HasPrefix(r.HostKey, "SHA256:") {
+			return common.NewErrorf("the host key of %s is not a SHA256 fingerprint", r.Name)
+		}
+	default:
+		return common.NewErrorf("unknown remote type %q, use s3, webdav or sftp", r.Type)
+	}
+	return nil
+}
+
+// remoteStore is a remote the backups are uploaded to.
+type remoteStore interface {
+	// Put uploads file from its start as name
+	Put(ctx context.Context, name string, file *os.File) error
+	// List returns the names of the files in the folder of the backups
+	List(ctx context.Context) ([]string, error)
+	Delete(ctx context.Context, name string) error
+	Close() error
+}
+
+func openRemote(ctx context.Context, remote *BackupRemote) (remoteStore, error) {
+	switch remote.Type {
+	case RemoteS3:
+		return newS3Store(remote)
+	case RemoteWebDAV:
+		return newWebDAVStore(remote)
+	case RemoteSFTP:
+		return newSFTPStore(ctx, remote)
+	}
+	return nil, common.NewErrorf("unknown remote type %q", remote.Type)
+}
+
+// getRemotes returns the remotes of the settings with their secrets decrypted.
+func (s *BackupService) getRemotes() ([]*BackupRemote, error) {
+	value, err := s.settingService.GetBackupRemotes()
+	if err != nil {
+		return nil, err
+	}
+	remotes := []*BackupRemote{}
+	if value != "" {
+		if err := json.Unmarshal([]byte(value), &remotes); err != nil {
+			return nil, common.NewErrorf("the backup remotes are not valid: %v", err)
+		}
+	}
+	key, err := s.settingService.GetSecret()
+	if err != nil {
+		return nil, err
+	}
+	for _, remote := range remotes {
+		for _, secret := range remote.secrets() {
+			if *secret == "" {
+				continue
+			}
+			if *secret, err = crypto.Decrypt(key, *secret); err != nil {
+				return nil, common.NewErrorf("unable to decrypt a secret of %s: %v", remote.Name, err)
+			}
+		}
+	}
+	return remotes, nil
+}
+
+// GetRemotes returns the remotes the backups are uploaded to, masked.
+func (s *BackupService) GetRemotes() ([]BackupRemote, error) {
+	remotes, err := s.getRemotes()
+	if err != nil {
+		return nil, err
+	}
+	masked := make([]BackupRemote, len(remotes))
+	for i, remote := range remotes {
+		masked[i] = remote.Masked()
+	}
+	return masked, nil
+}
+
+// unmask puts the stored secrets back into those of remote that are masked,
+// from the stored remote of the same name.
+func unmask(remote *BackupRemote, stored []*BackupRemote) {
+	for _, old := range stored {
+		if old.Name != remote.Name {
+			continue
+		}
+		secrets, oldSecrets := remote.secrets(), old.secrets()
+		for i := range secrets {
+			if *secrets[i] == remoteSecretMask {
+				*secrets[i] = *oldSecrets[i]
+			}
+		}
+		return
+	}
+}
+
+// SaveRemotes replaces the remotes the backups are uploaded to. A secret given
+// as the mask keeps the one of the remote of the same name; the secrets are
+// stored encrypted.
+func (s *BackupService) SaveRemotes(remotes []BackupRemote) error {
+	stored, err := s.getRemotes()
+	if err != nil {
+		return err
+	}
+	// The secrets are sealed in place, not in the remotes of the caller
+	remotes = slices.Clone(remotes)
+	for i := range remotes {
+		remotes[i].Name = strings.TrimSpace(remotes[i].Name)
+		unmask(&remotes[i], stored)
+	}
+	value, err := s.sealRemotes(remotes)
+	if err != nil {
+		return err
+	}
+	return s.settingService.SetBackupRemotes(value)
+}
+
+// sealRemotes validates the remotes and returns the value of their setting,
+// with the secrets encrypted.
+func (s *BackupService) sealRemotes(remotes []BackupRemote) (string, error) {
+	key, err := s.settingService.GetSecret()
+	if err != nil {
+		return "", err
+	}
+	names := []string{}
+	for i := range remotes {
+		remote := &remotes[i]
+		if slices.Contains(names, remote.Name) {
+			return "", common.NewErrorf("two remotes are named %s", remote.Name)
+		}
+		names = append(names, remote.Name)
+		if err := remote.validate(); err != nil {
+			return "", err
+		}
+		for _, secret := range remote.secrets() {
+			if *secret == "" {
+				continue
+			}
+			if *secret, err = crypto.Encrypt(key, *secret); err != nil {
+				return "", err
+			}
+		}
+	}
+	data, err := json.Marshal(remotes)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// TestRemote writes a small probe file to remote, finds it in the list of its
+// files and deletes it, to check its settings before a backup needs them. The
+// masked secrets are those of the saved remote of the same name.
+func (s *BackupService) TestRemote(remote *BackupRemote) error {
+	stored, err := s.getRemotes()
+	if err != nil {
+		return err
+	}
+	unmask(remote, stored)
+	if err := remote.validate(); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	probe, err := os.CreateTemp("", "x-ui-probe-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(probe.Name())
+	defer probe.Close()
+	if _, err := probe.WriteString("x-ui backup probe\n"); err != nil {
+		return err
+	}
+
+	store, err := openRemote(ctx, remote)
+	if err != nil {
+		return common.NewErrorf("connecting failed: %v", err)
+	}
+	defer store.Close()
+	name := ".x-ui-probe-" + random.Seq(8)
+	if err := store.Put(ctx, name, probe); err != nil {
+		return common.NewErrorf("writing failed: %v", err)
+	}
+	names, err := store.List(ctx)
+	if err != nil {
+		store.Delete(ctx, name)
+		return common.NewErrorf("listing failed: %v", err)
+	}
+	if !slices.Contains(names, name) {
+		store.Delete(ctx, name)
+		return common.NewError("the probe written is not in the list of the files")
+	}
+	if err := store.Delete(ctx, name); err != nil {
+		return common.NewErrorf("deleting failed: %v", err)
+	}
+	return nil
+}
+
+// UploadRemotes uploads the backup to each enabled remote, then removes the
+// oldest ones there beyond those it keeps. A failed upload is reported to the
+// Telegram admins and the webhook; the backup stays in the backup folder.
+func (s *BackupService) UploadRemotes(backup *BackupFile) {
+	remotes, err := s.getRemotes()
+	if err != nil {
+		logger.Warning("Unable to read the backup remotes:", err)
+		return
+	}
+	dir, err := s.GetDir()
+	if err != nil {
+		logger.Warning("Unable to read the backup folder:", err)
+		return
+	}
+	// The file is kept open meanwhile, for the pruning of a later backup not to
+	// take it away
+	file, err := os.Open(filepath.Join(dir, backup.Name))
+	if err != nil {
+		logger.Warning("Unable to open the backup:", err)
+		return
+	}
+	defer file.Close()
+	for _, remote := range remotes {
+		if !remote.Enable {
+			continue
+		}
+		if err := s.uploadRemote(remote, backup.Name, file); err != nil {
+			logger.Warningf("Uploading the backup %s to %s failed: %v", backup.Name, remote.Name, err)
+			s.reportUploadFailed(remote.Name, backup.Name, err)
+			continue
+		}
+		logger.Infof("backup %s uploaded to %s", backup.Name, remote.Name)
+		if err := s.pruneRemote(remote); err != nil {
+			logger.Warningf("Unable to remove the old backups of %s: %v", remote.Name, err)
+		}
+	}
+}
+
+// uploadRemote uploads file to remote as name, tried again on failure.
+func (s *BackupService) uploadRemote(remote *BackupRemote, name string, file *os.File) error {
+	var err error
+	for try := 1; try <= remoteTries; try++ {
+		if try > 1 {
+			time.Sleep(remoteRetryWait * time.Duration(try-1))
+		}
+		err = func() error {
+			ctx, cancel := context.WithTimeout(context.Background(), remoteTimeout)
+			defer cancel()
+			store, err := openRemote(ctx, remote)
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+			if _, err := file.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			return store.Put(ctx, name, file)
+		}()
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// pruneRemote removes the oldest backups of remote beyond those it keeps.
+func (s *BackupService) pruneRemote(remote *BackupRemote) error {
+	if remote.Keep <= 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), remoteTimeout)
+	defer cancel()
+	store, err := openRemote(ctx, remote)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	names, err := store.List(ctx)
+	if err != nil {
+		return err
+	}
+	// The names start with the time of the backup
+	backups := slices.DeleteFunc(names, func(name string) bool { return !backupName.MatchString(name) })
+	slices.Sort(backups)
+	slices.Reverse(backups)
+	if len(backups) <= remote.Keep {
+		return nil
+	}
+	for _, name := range backups[remote.Keep:] {
+		if err := store.Delete(ctx, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reportUploadFailed tells the Telegram admins and the backup webhook that the
+// backup couldn't be uploaded to a remote.
+func (s *BackupService) reportUploadFailed(remote string, backup string, err error) {
+	tgbot := Tgbot{}
+	tgbot.BackupUploadFailed(remote, backup, err)
+
+	webhook, settingErr := s.settingService.GetBackupWebhookUrl()
+	if settingErr != nil || webhook == "" {
+		return
+	}
+	host, _ := os.Hostname()
+	body, _ := json.Marshal(map[string]any{
+		"event":    "backup.upload_failed",
+		"hostname": host,
+		"remote":   remote,
+		"backup":   backup,
+		"error":    err.Error(),
+		"time":     time.Now().Unix(),
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, reqErr := http.NewRequestWithContext(ctx, http.MethodPost, webhook, bytes.NewReader(body))
+	if reqErr != nil {
+		logger.Warning("Unable to call the backup webhook:", reqErr)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, reqErr := http.DefaultClient.Do(req)
+	if reqErr != nil {
+		logger.Warning("Unable to call the backup webhook:", reqErr)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		logger.Warning("The backup webhook answered", resp.Status)
+	}
+}
+
+// BackupFailed tells the admins that the scheduled backup couldn't be made.
+func (t *Tgbot) BackupFailed(err error) {
+	if !t.AlertsOn(AlertBackup) {
+		return
+	}
+	msg := t.I18nBot("tgbot.messages.backupFailed")
+	msg += t.I18nBot("tgbot.messages.hostname", "Hostname=="+hostname)
+	msg += t.I18nBot("tgbot.messages.error", "Error=="+html.EscapeString(err.Error()))
+	t.SendAlert(AlertBackup, msg)
+}
+
+// BackupUploadFailed tells the admins that a backup couldn't be
+// uploaded to a remote.
+func (t *Tgbot) BackupUploadFailed(remote string, backup string, err error) {
+	if !t.AlertsOn(AlertBackup) {
+		return
+	}
+	enabled, settingErr := t.settingService.GetTgBotBackupUploadNotify()
+	if settingErr != nil || !enabled {
+		return
+	}
+	msg := t.I18nBot("tgbot.messages.backupUploadFailed", "Backup=="+html.EscapeString(backup), "Remote=="+html.EscapeString(remote))
+	msg += t.I18nBot("tgbot.messages.hostname", "Hostname=="+hostname)
+	msg += t.I18nBot("tgbot.messages.error", "Error=="+html.EscapeString(fmt.Sprint(err)))
+	t.SendAlert(AlertBackup, msg)
+}
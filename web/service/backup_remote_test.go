@@ -0,0 +1,386 @@
+package service
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/webdav"
+)
+
+// s3Server is an S3 bucket in memory, taking the requests signed with the keys
+// AKID and the secret key "secret".
+type s3Server struct {
+	sync.Mutex
+	objects map[string][]byte
+}
+
+func (s *s3Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/") || !strings.Contains(auth, "/us-east-1/s3/aws4_request") ||
+		!strings.Contains(auth, "Signature=") || r.Header.Get("x-amz-date") == "" {
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, `<Error><Code>InvalidAccessKeyId</Code><Message>The key is not known</Message></Error>`)
+		return
+	}
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != "backups" {
+		w.WriteHeader(http.StatusNotFound)
+		io.WriteString(w, `<Error><Code>NoSuchBucket</Code><Message>The bucket does not exist</Message></Error>`)
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		body, _ := io.ReadAll(r.Body)
+		if hash := sha256.Sum256(body); r.Header.Get("x-amz-content-sha256") != hex.EncodeToString(hash[:]) {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `<Error><Code>XAmzContentSHA256Mismatch</Code><Message>The hash is not of the body</Message></Error>`)
+			return
+		}
+		s.objects[key] = body
+	case http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet:
+		prefix := r.URL.Query().Get("prefix")
+		var result struct {
+			XMLName  xml.Name `xml:"ListBucketResult"`
+			Contents []struct {
+				Key string `xml:"Key"`
+			} `xml:"Contents"`
+		}
+		keys := []string{}
+		for key := range s.objects {
+			if strings.HasPrefix(key, prefix) {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			result.Contents = append(result.Contents, struct {
+				Key string `xml:"Key"`
+			}{key})
+		}
+		xml.NewEncoder(w).Encode(result)
+	}
+}
+
+func s3TestRemote(t *testing.T) (BackupRemote, *s3Server) {
+	server := &s3Server{objects: map[string][]byte{}}
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+	return BackupRemote{
+		Name: "s3", Type: RemoteS3, Enable: true, Endpoint: httpServer.URL, Bucket: "backups", Prefix: "/panel/",
+		PathStyle: true, AccessKey: "AKID", SecretKey: "secret",
+	}, server
+}
+
+// webdavTestRemote serves a WebDAV folder in memory to the user "user" with the
+// password "secret".
+func webdavTestRemote(t *testing.T) BackupRemote {
+	fs := webdav.NewMemFS()
+	if err := fs.Mkdir(context.Background(), "/backups", 0755); err != nil {
+		t.Fatal(err)
+	}
+	handler := &webdav.Handler{FileSystem: fs, LockSystem: webdav.NewMemLS()}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "user" || password != "secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return BackupRemote{Name: "webdav", Type: RemoteWebDAV, Enable: true, URL: server.URL + "/backups", Username: "user", Password: "secret"}
+}
+
+// sftpTestRemote serves SFTP over SSH to the user "user" with the password
+// "secret", from a new folder.
+func sftpTestRemote(t *testing.T) BackupRemote {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+		if conn.User() == "user" && string(password) == "secret" {
+			return nil, nil
+		}
+		return nil, os.ErrPermission
+	}}
+	config.AddHostKey(signer)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSFTP(conn, config)
+		}
+	}()
+	return BackupRemote{
+		Name: "sftp", Type: RemoteSFTP, Enable: true, Host: listener.Addr().String(), HostKey: ssh.FingerprintSHA256(signer.PublicKey()),
+		Username: "user", Password: "secret", Path: filepath.Join(t.TempDir(), "backups"),
+	}
+}
+
+func serveSFTP(conn net.Conn, config *ssh.ServerConfig) {
+	defer conn.Close()
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range requests {
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					if server, err := sftp.NewServer(channel); err == nil {
+						server.Serve()
+						server.Close()
+					}
+					return
+				}
+			}
+		}()
+	}
+}
+
+func TestBackupRemoteValidate(t *testing.T) {
+	s3, _ := s3TestRemote(t)
+	for _, remote := range []BackupRemote{s3, webdavTestRemote(t), sftpTestRemote(t)} {
+		if err := remote.validate(); err != nil {
+			t.Errorf("%s: %v", remote.Name, err)
+		}
+	}
+	tests := []struct {
+		remote BackupRemote
+		err    string
+	}{
+		{BackupRemote{Type: RemoteS3}, "no name"},
+		{BackupRemote{Name: "a", Type: RemoteS3, Keep: -1}, "must not be negative"},
+		{BackupRemote{Name: "a", Type: "ftp"}, "unknown remote type"},
+		{BackupRemote{Name: "a", Type: RemoteS3, Endpoint: "ftp://s3.example", Bucket: "b", AccessKey: "k", SecretKey: "s"}, "not an http(s) URL"},
+		{BackupRemote{Name: "a", Type: RemoteS3, Endpoint: "https://k:s@s3.example", Bucket: "b", AccessKey: "k", SecretKey: "s"}, "without credentials"},
+		{BackupRemote{Name: "a", Type: RemoteS3, Endpoint: "https://s3.example", AccessKey: "k", SecretKey: "s"}, "needs a bucket"},
+		{BackupRemote{Name: "a", Type: RemoteWebDAV, URL: "dav.example/backups"}, "not an http(s) URL"},
+		{BackupRemote{Name: "a", Type: RemoteSFTP, Host: "sftp.example", Username: "u", Path: "/b"}, "needs a password or a private key"},
+		{BackupRemote{Name: "a", Type: RemoteSFTP, Host: "sftp.example", Username: "u", Path: "/b", PrivateKey: "key"}, "private key of a is not valid"},
+		{BackupRemote{Name: "a", Type: RemoteSFTP, Host: "sftp.example", Username: "u", Path: "/b", Password: "p", HostKey: "MD5:aa"}, "not a SHA256 fingerprint"},
+		{BackupRemote{Name: "a", Type: RemoteWebDAV, URL: "https://dav.example", Password: remoteSecretMask}, "masked but the remote is new"},
+	}
+	for _, test := range tests {
+		err := test.remote.validate()
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("remote %+v: error %v, want %q", test.remote, err, test.err)
+		}
+	}
+}
+
+func TestBackupRemoteSecrets(t *testing.T) {
+	newTestDB(t)
+	var s BackupService
+	s3, _ := s3TestRemote(t)
+	webdav := webdavTestRemote(t)
+	saved := []BackupRemote{s3, webdav}
+	if err := s.SaveRemotes(saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved[0].SecretKey != "secret" || saved[1].Password != "secret" {
+		t.Errorf("the remotes of the caller were sealed: %+v", saved)
+	}
+	stored, err := s.settingService.GetBackupRemotes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(stored, `"secret"`) {
+		t.Errorf("the secrets are stored in the clear: %s", stored)
+	}
+
+	remotes, err := s.GetRemotes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remotes) != 2 || remotes[0].SecretKey != remoteSecretMask || remotes[1].Password != remoteSecretMask ||
+		remotes[0].AccessKey != "AKID" || remotes[1].Username != "user" {
+		t.Errorf("the remotes are %+v", remotes)
+	}
+	data, _ := json.Marshal(remotes)
+	if strings.Contains(string(data), `"secret"`) {
+		t.Errorf("the API gives the secrets: %s", data)
+	}
+
+	// Saved back masked, the remotes keep their secrets
+	remotes[1].Keep = 3
+	if err := s.SaveRemotes(remotes); err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err := s.getRemotes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decrypted[0].SecretKey != "secret" || decrypted[1].Password != "secret" || decrypted[1].Keep != 3 {
+		t.Errorf("the saved remotes are %+v %+v", *decrypted[0], *decrypted[1])
+	}
+	// A masked secret needs a saved remote of the name
+	renamed := remotes[1]
+	renamed.Name = "other"
+	if err := s.SaveRemotes([]BackupRemote{renamed}); err == nil {
+		t.Error("a new remote was saved with a masked secret")
+	}
+	if err := s.SaveRemotes([]BackupRemote{webdav, webdav}); err == nil {
+		t.Error("two remotes of the same name were saved")
+	}
+}
+
+func TestTestRemote(t *testing.T) {
+	newTestDB(t)
+	var s BackupService
+	s3, server := s3TestRemote(t)
+	remotes := []BackupRemote{s3, webdavTestRemote(t), sftpTestRemote(t)}
+	for _, remote := range remotes {
+		t.Run(remote.Type, func(t *testing.T) {
+			if err := s.TestRemote(&remote); err != nil {
+				t.Fatal(err)
+			}
+			remote.Password, remote.SecretKey = "wrong", "wrong"
+			if remote.Type == RemoteS3 {
+				remote.AccessKey = "other"
+			}
+			err := s.TestRemote(&remote)
+			if err == nil {
+				t.Fatal("the remote took the wrong credentials")
+			}
+			// The secrets don't make it into the error, nor the logs
+			if strings.Contains(err.Error(), "wrong") {
+				t.Errorf("the error has the secret: %v", err)
+			}
+		})
+	}
+	if len(server.objects) != 0 {
+		t.Errorf("the probes were left in the bucket: %v", server.objects)
+	}
+
+	// A remote tested with masked secrets uses the saved ones
+	if err := s.SaveRemotes(remotes); err != nil {
+		t.Fatal(err)
+	}
+	masked, _ := s.GetRemotes()
+	if err := s.TestRemote(&masked[1]); err != nil {
+		t.Errorf("the masked remote failed: %v", err)
+	}
+}
+
+func TestRemoteUploadAndPrune(t *testing.T) {
+	newTestDB(t)
+	var s BackupService
+	dir := t.TempDir()
+	if err := s.settingService.setString("backupDir", dir); err != nil {
+		t.Fatal(err)
+	}
+	s3, server := s3TestRemote(t)
+	remotes := []BackupRemote{s3, webdavTestRemote(t), sftpTestRemote(t)}
+	for i := range remotes {
+		remotes[i].Keep = 2
+	}
+	disabled := webdavTestRemote(t)
+	disabled.Name, disabled.Enable = "disabled", false
+	if err := s.SaveRemotes(append(remotes, disabled)); err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{"x-ui-20240101-000000-v2.5.0.db", "x-ui-20240102-000000-v2.5.0.db", "x-ui-20240103-000000-v2.5.0.db"}
+	for _, name := range names {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("backup "+name), 0600); err != nil {
+			t.Fatal(err)
+		}
+		s.UploadRemotes(&BackupFile{Name: name})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	for _, remote := range append(remotes, disabled) {
+		store, err := openRemote(ctx, &remote)
+		if err != nil {
+			t.Fatal(err)
+		}
+		listed, err := store.List(ctx)
+		store.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		slices.Sort(listed)
+		want := names[1:]
+		if !remote.Enable {
+			want = nil
+		}
+		if !slices.Equal(listed, want) && len(listed)+len(want) > 0 {
+			t.Errorf("%s has %v, want %v", remote.Name, listed, want)
+		}
+	}
+	if string(server.objects["panel/"+names[2]]) != "backup "+names[2] {
+		t.Errorf("the bucket has %v", server.objects)
+	}
+}
+
+func TestReportUploadFailed(t *testing.T) {
+	newTestDB(t)
+	events := make(chan map[string]any, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event map[string]any
+		json.NewDecoder(r.Body).Decode(&event)
+		events <- event
+	}))
+	defer webhook.Close()
+	var s BackupService
+	if err := s.settingService.setString("backupWebhookUrl", webhook.URL); err != nil {
+		t.Fatal(err)
+	}
+	s.reportUploadFailed("s3", "x-ui-20240101-000000-v2.5.0.db", io.ErrUnexpectedEOF)
+	select {
+	case event := <-events:
+		if event["event"] != "backup.upload_failed" || event["remote"] != "s3" || event["error"] != io.ErrUnexpectedEOF.Error() {
+			t.Errorf("the webhook got %v", event)
+		}
+	default:
+		t.Error("the webhook was not called")
+	}
+}
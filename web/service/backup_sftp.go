@@ -0,0 +1,138 @@
+package service
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"path"
+	"time"
+
+	"x-ui/util/common"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// sftpStore uploads the backups to a folder of an SFTP server, trusting only
+// the server of the host key of the remote.
+type sftpStore struct {
+	remote *BackupRemote
+	conn   *ssh.Client
+	client *sftp.Client
+	stop   func() bool
+}
+
+func newSFTPStore(ctx context.Context, remote *BackupRemote) (remoteStore, error) {
+	address := remote.Host
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "22")
+	}
+	auth := []ssh.AuthMethod{}
+	if remote.PrivateKey != "" {
+		signer, err := ssh.ParsePrivateKey([]byte(remote.PrivateKey))
+		if err != nil {
+			return nil, err
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if remote.Password != "" {
+		auth = append(auth, ssh.Password(remote.Password))
+	}
+	config := &ssh.ClientConfig{
+		User: remote.Username,
+		Auth: auth,
+		HostKeyCallback: func(hostname string, _ net.Addr, key ssh.PublicKey) error {
+			fingerprint := ssh.FingerprintSHA256(key)
+			if remote.HostKey == "" {
+				return common.NewErrorf("the host key of %s is %s, set it to trust the server", hostname, fingerprint)
+			}
+			if fingerprint != remote.HostKey {
+				return common.NewErrorf("the host key of %s is %s, not %s", hostname, fingerprint, remote.HostKey)
+			}
+			return nil
+		},
+		Timeout: 30 * time.Second,
+	}
+
+	dialer := net.Dialer{Timeout: config.Timeout}
+	netConn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	// The handshake and the transfers end with ctx
+	stop := context.AfterFunc(ctx, func() { netConn.Close() })
+	sshConn, chans, reqs, err := ssh.NewClientConn(netConn, address, config)
+	if err != nil {
+		stop()
+		netConn.Close()
+		return nil, err
+	}
+	conn := ssh.NewClient(sshConn, chans, reqs)
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		stop()
+		conn.Close()
+		return nil, err
+	}
+	return &sftpStore{remote: remote, conn: conn, client: client, stop: stop}, nil
+}
+
+// Put writes a partial file next to the backup first, and renames it once it
+// is complete.
+func (s *sftpStore) Put(ctx context.Context, name string, file *os.File) error {
+	if err := s.client.MkdirAll(s.remote.Path); err != nil {
+		return err
+	}
+	target := path.Join(s.remote.Path, name)
+	part := path.Join(s.remote.Path, "."+name+".part")
+	remoteFile, err := s.client.Create(part)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(remoteFile, file)
+	if closeErr := remoteFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		s.client.Remove(part)
+		return err
+	}
+	if err := s.client.PosixRename(part, target); err != nil {
+		// Without the extension of OpenSSH, the target must not exist
+		s.client.Remove(target)
+		if err := s.client.Rename(part, target); err != nil {
+			s.client.Remove(part)
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sftpStore) List(ctx context.Context) ([]string, error) {
+	entries, err := s.client.ReadDir(s.remote.Path)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, entry := range entries {
+		if entry.Mode().IsRegular() {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+func (s *sftpStore) Delete(ctx context.Context, name string) error {
+	err := s.client.Remove(path.Join(s.remote.Path, name))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *sftpStore) Close() error {
+	s.stop()
+	s.client.Close()
+	return s.conn.Close()
+}
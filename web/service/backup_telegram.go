@@ -0,0 +1,414 @@
+package service
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"x-ui/logger"
+	"x-ui/util/common"
+
+	"github.com/goccy/go-json"
+	"github.com/mymmrac/telego"
+	tu "github.com/mymmrac/telego/telegoutil"
+)
+
+const (
+	// tgBotUploadLimit is the largest file a bot can send, 50 MB, less room for
+	// the rest of the request
+	tgBotUploadLimit = 50<<20 - 1<<20
+	// tgBackupTries are the attempts to deliver a backup to a chat, a minute
+	// then two apart
+	tgBackupTries = 3
+	// tgBackupLinkTTL is how long the download link of a backup works
+	tgBackupLinkTTL = 24 * time.Hour
+	// tgBackupFailuresKept are the failed deliveries kept per chat to report
+	tgBackupFailuresKept = 5
+	// tgCaptionLimit is the longest caption of a document, in characters
+	tgCaptionLimit = 1024
+)
+
+// tgBackupMutex keeps the scheduled deliveries from overlapping, and guards
+// the failures saved in the settings.
+var tgBackupMutex sync.Mutex
+
+// tgBackupFailure is a scheduled delivery of a backup to a chat that failed,
+// reported with the next one that works.
+type tgBackupFailure struct {
+	Time   int64  `json:"time"`
+	Backup string `json:"backup"`
+	Error  string `json:"error"`
+}
+
+// Path returns the path of a backup of the backup folder.
+func (s *BackupService) Path(name string) (string, error) {
+	if !backupName.MatchString(name) {
+		return "", errBackupNotFound
+	}
+	dir, err := s.GetDir()
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, name)
+	if info, err := os.Stat(path); err != nil || !info.Mode().IsRegular() {
+		return "", errBackupNotFound
+	}
+	return path, nil
+}
+
+// downloadSignature signs the download of a backup until expires with the
+// secret of the panel.
+func (s *BackupService) downloadSignature(name string, expires int64) (string, error) {
+	secret, err := s.settingService.GetSecret()
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "backup-download\n%s\n%d", name, expires)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// DownloadLink returns a link of the panel that downloads a backup without
+// logging in until expires. The panel is reached on its domain, which must be
+// set.
+func (s *BackupService) DownloadLink(name string, expires time.Time) (string, error) {
+	domain, err := s.settingService.GetWebDomain()
+	if err != nil {
+		return "", err
+	}
+	if domain == "" {
+		return "", common.NewError("the panel has no domain to link the backup on")
+	}
+	port, err := s.settingService.GetPort()
+	if err != nil {
+		return "", err
+	}
+	certFile, _ := s.settingService.GetCertFile()
+	keyFile, _ := s.settingService.GetKeyFile()
+	basePath, err := s.settingService.GetBasePath()
+	if err != nil {
+		return "", err
+	}
+	signature, err := s.downloadSignature(name, expires.Unix())
+	if err != nil {
+		return "", err
+	}
+
+	link := url.URL{Scheme: "http", Host: domain, Path: basePath + "backups/download/" + name}
+	tls := certFile != "" && keyFile != ""
+	if tls {
+		link.Scheme = "https"
+	}
+	if (tls && port != 443) || (!tls && port != 80) {
+		link.Host = net.JoinHostPort(domain, strconv.Itoa(port))
+	}
+	link.RawQuery = url.Values{
+		"expires":   {strconv.FormatInt(expires.Unix(), 10)},
+		"signature": {signature},
+	}.Encode()
+	return link.String(), nil
+}
+
+// CheckDownload returns the path of a backup for a link of DownloadLink that
+// hasn't expired.
+func (s *BackupService) CheckDownload(name string, expires string, signature string) (string, error) {
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > unix {
+		return "", common.NewError("the download link has expired")
+	}
+	expected, err := s.downloadSignature(name, unix)
+	if err != nil {
+		return "", err
+	}
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return "", common.NewError("the download link is not valid")
+	}
+	return s.Path(name)
+}
+
+// tgBackup is the backup a scheduled delivery sends, with the result of its
+// integrity check.
+type tgBackup struct {
+	*BackupFile
+	// file stays open for the retries, for the backup to outlive the backups
+	// removed beyond those to keep
+	file  *os.File
+	check string
+	// linked tells that the backup is the one of the backup folder, which a
+	// link can download, rather than a copy encrypted for the delivery
+	linked bool
+}
+
+// scheduledBackup returns the last backup of the backup folder that passes
+// its integrity check, or a new one if none does. A backup that isn't
+// encrypted is encrypted for the delivery when there is a backup passphrase.
+func (t *Tgbot) scheduledBackup() (*tgBackup, error) {
+	var backupService BackupService
+	backups, err := backupService.List()
+	if err != nil {
+		return nil, err
+	}
+	check := ""
+	var chosen *BackupFile
+	for _, backup := range backups {
+		if err := backupService.Verify(backup.Name); err != nil {
+			logger.Warning("The backup", backup.Name, "failed its integrity check:", err)
+			check += t.I18nBot("tgbot.messages.backupCheckFailed",
+				"Backup=="+html.EscapeString(backup.Name), "Error=="+html.EscapeString(err.Error()))
+			continue
+		}
+		chosen = backup
+		break
+	}
+	if chosen == nil {
+		// A new backup is checked before it is kept
+		if chosen, err = backupService.Create(); err != nil {
+			return nil, err
+		}
+	}
+	check += t.I18nBot("tgbot.messages.backupCheckOk")
+
+	path, err := backupService.Path(chosen.Name)
+	if err != nil {
+		return nil, err
+	}
+	passphrase, err := t.settingService.GetBackupPassphrase()
+	if err != nil {
+		return nil, err
+	}
+	backup := &tgBackup{BackupFile: chosen, check: check, linked: true}
+	if passphrase != "" && !chosen.Encrypted {
+		encrypted := filepath.Join(filepath.Dir(path), "."+chosen.Name+encryptedExt+".tmp")
+		if err := encryptFile(path, encrypted, passphrase); err != nil {
+			os.Remove(encrypted)
+			return nil, common.NewErrorf("encrypting the backup failed: %v", err)
+		}
+		info, err := os.Stat(encrypted)
+		if err != nil {
+			os.Remove(encrypted)
+			return nil, err
+		}
+		copied := *chosen
+		copied.Name += encryptedExt
+		copied.Size = info.Size()
+		copied.Encrypted = true
+		backup.BackupFile = &copied
+		backup.linked = false
+		path = encrypted
+	}
+	file, err := os.Open(path)
+	if !backup.linked {
+		// Open, the file is read until it is closed
+		os.Remove(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	backup.file = file
+	return backup, nil
+}
+
+// SendScheduledBackup sends the last backup that passes its integrity check to
+// the admins. A backup too large for a bot is split in parts, or sent as a
+// download link of the panel if the settings say so. A delivery that fails is
+// retried, and reported with the next one to the chat that works.
+func (t *Tgbot) SendScheduledBackup() {
+	if !t.IsRunning() {
+		return
+	}
+	if !tgBackupMutex.TryLock() {
+		logger.Warning("The scheduled Telegram backup is still being sent")
+		return
+	}
+	defer tgBackupMutex.Unlock()
+
+	backup, err := t.scheduledBackup()
+	if err != nil {
+		logger.Warning("Unable to prepare the scheduled Telegram backup:", err)
+		for _, chatId := range t.chatsWithRole(tgRoleFull) {
+			t.addBackupFailure(chatId, "", err)
+		}
+		return
+	}
+	defer backup.file.Close()
+
+	for _, chatId := range t.chatsWithRole(tgRoleFull) {
+		var err error
+		for try := 1; try <= tgBackupTries; try++ {
+			if try > 1 {
+				time.Sleep(time.Minute << (try - 2))
+			}
+			if err = t.deliverBackup(chatId, backup); err == nil {
+				break
+			}
+			logger.Warningf("Sending the backup %s to the chat %d failed (%d/%d): %v", backup.Name, chatId, try, tgBackupTries, err)
+		}
+		if err != nil {
+			t.addBackupFailure(chatId, backup.Name, err)
+		}
+	}
+}
+
+// deliverBackup sends a backup to a chat, with the failures of the deliveries
+// before, which are forgotten once it is sent.
+func (t *Tgbot) deliverBackup(chatId int64, backup *tgBackup) error {
+	failures := t.backupFailures()[strconv.FormatInt(chatId, 10)]
+	// The template is the head of the caption, what comes of the delivery follows
+	caption := t.renderTemplate("backup", map[string]string{
+		"ServerName": hostname,
+		"Backup":     backup.Name,
+		"Size":       common.FormatTraffic(backup.Size),
+		"Time":       backup.Time.Format("2006-01-02 15:04:05"),
+	})
+	if caption == "" {
+		caption = t.I18nBot("tgbot.messages.backupScheduled", "Backup=="+html.EscapeString(backup.Name),
+			"Size=="+common.FormatTraffic(backup.Size), "Time=="+backup.Time.Format("2006-01-02 15:04:05"))
+		caption += t.I18nBot("tgbot.messages.hostname", "Hostname=="+hostname)
+	}
+	caption += backup.check
+	if len(failures) > 0 {
+		caption += t.I18nBot("tgbot.messages.backupEarlierFailures")
+		for _, failure := range failures {
+			caption += t.I18nBot("tgbot.messages.backupEarlierFailure",
+				"Time=="+time.Unix(failure.Time, 0).Format("2006-01-02 15:04:05"),
+				"Error=="+html.EscapeString(failure.Error))
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+	var err error
+	switch large, _ := t.settingService.GetTgBotBackupLarge(); {
+	case backup.Size <= tgBotUploadLimit:
+		err = t.sendBackupParts(ctx, chatId, backup, caption, 1)
+	case large == "link":
+		err = t.sendBackupLink(ctx, chatId, backup, caption)
+		if err == nil {
+			break
+		}
+		logger.Warning("Unable to link the backup, it is split instead:", err)
+		fallthrough
+	default:
+		parts := int((backup.Size + tgBotUploadLimit - 1) / tgBotUploadLimit)
+		caption += t.I18nBot("tgbot.messages.backupParts", "Count=="+strconv.Itoa(parts), "Backup=="+html.EscapeString(backup.Name))
+		err = t.sendBackupParts(ctx, chatId, backup, caption, parts)
+	}
+	if err != nil {
+		return err
+	}
+	if len(failures) > 0 {
+		t.clearBackupFailures(chatId)
+	}
+	return nil
+}
+
+// sendBackupParts sends a backup as a document, or as parts of up to the
+// upload limit named with their number, to join back in order.
+func (t *Tgbot) sendBackupParts(ctx context.Context, chatId int64, backup *tgBackup, caption string, parts int) error {
+	if len([]rune(caption)) > tgCaptionLimit {
+		_, err := bot.SendMessage(ctx, &telego.SendMessageParams{
+			ChatID:    tu.ID(chatId),
+			Text:      caption,
+			ParseMode: telego.ModeHTML,
+		})
+		if err != nil {
+			return err
+		}
+		caption = ""
+	}
+	for part := 1; part <= parts; part++ {
+		name, text := backup.Name, caption
+		if parts > 1 {
+			name = fmt.Sprintf("%s.%03d", backup.Name, part)
+			if part > 1 {
+				text = t.I18nBot("tgbot.messages.backupPart", "Part=="+strconv.Itoa(part), "Count=="+strconv.Itoa(parts))
+			}
+		}
+		reader := io.NewSectionReader(backup.file, int64(part-1)*tgBotUploadLimit, tgBotUploadLimit)
+		_, err := bot.SendDocument(ctx, &telego.SendDocumentParams{
+			ChatID:    tu.ID(chatId),
+			Document:  tu.FileFromReader(reader, name),
+			Caption:   text,
+			ParseMode: telego.ModeHTML,
+		})
+		if err != nil {
+			return common.NewErrorf("part %d of %d: %v", part, parts, err)
+		}
+	}
+	return nil
+}
+
+// sendBackupLink sends a download link of a backup instead of the file.
+func (t *Tgbot) sendBackupLink(ctx context.Context, chatId int64, backup *tgBackup, caption string) error {
+	if !backup.linked {
+		return common.NewError("the backup is encrypted for the delivery only")
+	}
+	var backupService BackupService
+	expires := time.Now().Add(tgBackupLinkTTL)
+	link, err := backupService.DownloadLink(backup.Name, expires)
+	if err != nil {
+		return err
+	}
+	caption += t.I18nBot("tgbot.messages.backupLink", "Time=="+expires.Format("2006-01-02 15:04:05"), "Link=="+html.EscapeString(link))
+	_, err = bot.SendMessage(ctx, &telego.SendMessageParams{
+		ChatID:    tu.ID(chatId),
+		Text:      caption,
+		ParseMode: telego.ModeHTML,
+	})
+	return err
+}
+
+// backupFailures returns the failed deliveries by chat.
+func (t *Tgbot) backupFailures() map[string][]tgBackupFailure {
+	failures := map[string][]tgBackupFailure{}
+	value, err := t.settingService.GetTgBotBackupFailures()
+	if err == nil {
+		json.Unmarshal([]byte(value), &failures)
+	}
+	return failures
+}
+
+func (t *Tgbot) saveBackupFailures(failures map[string][]tgBackupFailure) {
+	data, err := json.Marshal(failures)
+	if err == nil {
+		err = t.settingService.SetTgBotBackupFailures(string(data))
+	}
+	if err != nil {
+		logger.Warning("Unable to save the failed Telegram backups:", err)
+	}
+}
+
+func (t *Tgbot) addBackupFailure(chatId int64, backup string, err error) {
+	failures := t.backupFailures()
+	key := strconv.FormatInt(chatId, 10)
+	message := err.Error()
+	if backup != "" {
+		message = backup + ": " + message
+	}
+	if runes := []rune(message); len(runes) > 200 {
+		message = string(runes[:200]) + "…"
+	}
+	failures[key] = append(failures[key], tgBackupFailure{Time: time.Now().Unix(), Backup: backup, Error: strings.TrimSpace(message)})
+	if len(failures[key]) > tgBackupFailuresKept {
+		failures[key] = failures[key][len(failures[key])-tgBackupFailuresKept:]
+	}
+	t.saveBackupFailures(failures)
+}
+
+func (t *Tgbot) clearBackupFailures(chatId int64) {
+	failures := t.backupFailures()
+	delete(failures, strconv.FormatInt(chatId, 10))
+	t.saveBackupFailures(failures)
+}
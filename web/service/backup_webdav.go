@@ -0,0 +1,132 @@
+package service
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+const webdavPropfind = `<?xml version="1.0" encoding="utf-8"?><d:propfind xmlns:d="DAV:"><d:prop><d:resourcetype/></d:prop></d:propfind>`
+
+// webdavStore uploads the backups to a folder of a WebDAV server, which must
+// exist.
+type webdavStore struct {
+	remote *BackupRemote
+	folder *url.URL
+	client *http.Client
+}
+
+func newWebDAVStore(remote *BackupRemote) (remoteStore, error) {
+	folder, err := url.Parse(remote.URL)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(folder.Path, "/") {
+		folder.Path += "/"
+		folder.RawPath = ""
+	}
+	return &webdavStore{remote: remote, folder: folder, client: &http.Client{}}, nil
+}
+
+func (s *webdavStore) fileURL(name string) string {
+	return s.folder.JoinPath(name).String()
+}
+
+func (s *webdavStore) do(req *http.Request, ok ...int) (*http.Response, error) {
+	if s.remote.Username != "" || s.remote.Password != "" {
+		req.SetBasicAuth(s.remote.Username, s.remote.Password)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, status := range ok {
+		if resp.StatusCode == status {
+			return resp, nil
+		}
+	}
+	resp.Body.Close()
+	return nil, fmt.Errorf("%s %s: %s", req.Method, req.URL.Redacted(), resp.Status)
+}
+
+func (s *webdavStore) Put(ctx context.Context, name string, file *os.File) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	offset, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.fileURL(name), io.NopCloser(file))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = info.Size() - offset
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := s.do(req, http.StatusOK, http.StatusCreated, http.StatusNoContent)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+type webdavMultistatus struct {
+	Responses []struct {
+		Href string `xml:"DAV: href"`
+	} `xml:"DAV: response"`
+}
+
+func (s *webdavStore) List(ctx context.Context) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, "PROPFIND", s.folder.String(), strings.NewReader(webdavPropfind))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Depth", "1")
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+	resp, err := s.do(req, http.StatusMultiStatus)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var status webdavMultistatus
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, 16<<20)).Decode(&status); err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, response := range status.Responses {
+		href, err := url.Parse(response.Href)
+		if err != nil || strings.HasSuffix(href.Path, "/") {
+			// The folder itself and the folders in it
+			continue
+		}
+		if name := path.Base(href.Path); name != "." && name != "/" {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func (s *webdavStore) Delete(ctx context.Context, name string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, s.fileURL(name), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req, http.StatusOK, http.StatusNoContent, http.StatusNotFound)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *webdavStore) Close() error {
+	return nil
+}
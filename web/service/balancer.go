@@ -0,0 +1,342 @@
+package service
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/util/common"
+	"x-ui/xray"
+
+	"github.com/goccy/go-json"
+)
+
+// balancerStrategies are the balancing strategies of Xray, by their lower case
+// names, which Xray takes as well.
+var balancerStrategies = map[string]string{
+	"random":     "random",
+	"roundrobin": "roundRobin",
+	"leastping":  "leastPing",
+	"leastload":  "leastLoad",
+}
+
+// BalancerInfo is a balancer of the panel with the outbounds it balances, and
+// the one leastPing picks from the latest probes of the observatory.
+type BalancerInfo struct {
+	Tag      string   `json:"tag"`
+	Strategy string   `json:"strategy"`
+	Members  []string `json:"members"`
+	Picked   string   `json:"picked,omitempty"`
+}
+
+// Observatory is what the observatory of Xray knows about the outbounds.
+type Observatory struct {
+	Outbounds []*xray.OutboundStatus `json:"outbounds"`
+	Balancers []BalancerInfo         `json:"balancers"`
+}
+
+// BalancerService manages the balancers the panel adds to the routing of the
+// Xray config, with the observatory the leastPing and leastLoad strategies need.
+type BalancerService struct {
+	settingService SettingService
+}
+
+// balancerMembers returns the tags matched by a selector, as Xray matches them:
+// by prefix.
+func balancerMembers(selector []string, tags []string) []string {
+	var members []string
+	for _, tag := range tags {
+		for _, prefix := range selector {
+			if prefix != "" && strings.HasPrefix(tag, prefix) {
+				members = append(members, tag)
+				break
+			}
+		}
+	}
+	return members
+}
+
+// observes tells if the strategy of a balancer needs the observatory.
+func observes(strategy string) bool {
+	return strategy == "leastPing" || strategy == "leastLoad"
+}
+
+func (s *BalancerService) checkBalancer(balancer *model.Balancer, refs *templateRefs) error {
+	balancer.Tag = strings.TrimSpace(balancer.Tag)
+	balancer.Selector = normalizeRuleList(balancer.Selector)
+	balancer.FallbackTag = strings.TrimSpace(balancer.FallbackTag)
+	if balancer.Tag == "" {
+		return common.NewError("tag can not be empty")
+	}
+	if len(balancer.Tag) > outboundTagMaxLength {
+		return common.NewErrorf("tag is longer than %d characters", outboundTagMaxLength)
+	}
+	for _, balancerRef := range refs.balancers {
+		if balancerRef.Tag == balancer.Tag {
+			return common.NewErrorf("tag %s is used by a balancer of the xray config template", balancer.Tag)
+		}
+	}
+	for _, other := range refs.panelBalancers {
+		if other.Tag == balancer.Tag && other.Id != balancer.Id {
+			return common.NewErrorf("tag %s is used by another balancer", balancer.Tag)
+		}
+	}
+	tags := append(slices.Clone(refs.outbounds), refs.panelOutbounds...)
+	if slices.Contains(tags, balancer.Tag) {
+		return common.NewErrorf("tag %s is used by an outbound", balancer.Tag)
+	}
+
+	if len(balancer.Selector) == 0 {
+		return common.NewError("selector can not be empty")
+	}
+	if len(balancerMembers(balancer.Selector, tags)) == 0 {
+		return common.NewErrorf("selector %s matches no outbound", strings.Join(balancer.Selector, ", "))
+	}
+	if balancer.Strategy == "" {
+		balancer.Strategy = "random"
+	}
+	strategy, ok := balancerStrategies[strings.ToLower(balancer.Strategy)]
+	if !ok {
+		return common.NewErrorf("strategy must be random, roundRobin, leastPing or leastLoad, not %q", balancer.Strategy)
+	}
+	balancer.Strategy = strategy
+	if balancer.FallbackTag != "" && !slices.Contains(tags, balancer.FallbackTag) {
+		return common.NewErrorf("fallbackTag: there is no outbound %s", balancer.FallbackTag)
+	}
+	return nil
+}
+
+func (s *BalancerService) GetBalancers() ([]model.Balancer, error) {
+	var balancers []model.Balancer
+	err := database.GetDB().Order("id").Find(&balancers).Error
+	return balancers, err
+}
+
+func (s *BalancerService) GetBalancer(id int) (*model.Balancer, error) {
+	balancer := &model.Balancer{}
+	if err := database.GetDB().First(balancer, id).Error; err != nil {
+		return nil, err
+	}
+	return balancer, nil
+}
+
+func (s *BalancerService) AddBalancer(balancer *model.Balancer) (*model.Balancer, error) {
+	refs, err := loadTemplateRefs()
+	if err != nil {
+		return nil, err
+	}
+	balancer.Id = 0
+	if err := s.checkBalancer(balancer, refs); err != nil {
+		return nil, err
+	}
+	if err := database.GetDB().Create(balancer).Error; err != nil {
+		return nil, err
+	}
+	return balancer, nil
+}
+
+// UpdateBalancer replaces a balancer. Its tag can't change while routing rules
+// send to it.
+func (s *BalancerService) UpdateBalancer(balancer *model.Balancer) (*model.Balancer, error) {
+	old, err := s.GetBalancer(balancer.Id)
+	if err != nil {
+		return nil, err
+	}
+	refs, err := loadTemplateRefs()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkBalancer(balancer, refs); err != nil {
+		return nil, err
+	}
+	if balancer.Tag != old.Tag {
+		if user := refs.balancerUsedBy(old.Tag); user != "" {
+			return nil, common.NewErrorf("balancer %s can not be renamed, %s sends to it", old.Tag, user)
+		}
+	}
+	if err := database.GetDB().Save(balancer).Error; err != nil {
+		return nil, err
+	}
+	return balancer, nil
+}
+
+func (s *BalancerService) DelBalancer(id int) error {
+	balancer, err := s.GetBalancer(id)
+	if err != nil {
+		return err
+	}
+	refs, err := loadTemplateRefs()
+	if err != nil {
+		return err
+	}
+	if user := refs.balancerUsedBy(balancer.Tag); user != "" {
+		return common.NewErrorf("balancer %s can not be deleted, %s sends to it", balancer.Tag, user)
+	}
+	return database.GetDB().Delete(model.Balancer{}, id).Error
+}
+
+// genObservatory returns the observatory or burst observatory of the config,
+// probing the outbounds of the balancers that need it.
+func (s *BalancerService) genObservatory(balancers []model.Balancer) (string, map[string]any, error) {
+	var selector []string
+	for _, balancer := range balancers {
+		if !observes(balancer.Strategy) {
+			continue
+		}
+		for _, prefix := range balancer.Selector {
+			if !slices.Contains(selector, prefix) {
+				selector = append(selector, prefix)
+			}
+		}
+	}
+	if len(selector) == 0 {
+		return "", nil, nil
+	}
+	mode, err := s.settingService.GetObservatoryMode()
+	if err != nil {
+		return "", nil, err
+	}
+	probeURL, err := s.settingService.GetObservatoryProbeURL()
+	if err != nil {
+		return "", nil, err
+	}
+	interval, err := s.settingService.GetObservatoryProbeInterval()
+	if err != nil {
+		return "", nil, err
+	}
+	probeInterval := fmt.Sprintf("%ds", interval)
+	if mode == "burstObservatory" {
+		return mode, map[string]any{
+			"subjectSelector": selector,
+			"pingConfig": map[string]any{
+				"destination": probeURL,
+				"interval":    probeInterval,
+				"sampling":    3,
+				"timeout":     "5s",
+			},
+		}, nil
+	}
+	return "observatory", map[string]any{
+		"subjectSelector":   selector,
+		"probeURL":          probeURL,
+		"probeInterval":     probeInterval,
+		"enableConcurrency": true,
+	}, nil
+}
+
+// addBalancers adds the balancers of the panel to the routing of a config
+// generated from the template, with an observatory if they need one and the
+// template has none. The observatory is then added to the services of the API,
+// for the panel to read its probes.
+func (s *BalancerService) addBalancers(config *xray.Config) error {
+	balancers, err := s.GetBalancers()
+	if err != nil {
+		return err
+	}
+	if len(balancers) > 0 {
+		routing := map[string]any{}
+		if len(config.RouterConfig) > 0 {
+			if err := json.Unmarshal(config.RouterConfig, &routing); err != nil || routing == nil {
+				return common.NewError("xray template config invalid: routing must be an object")
+			}
+		}
+		items, _ := routing["balancers"].([]any)
+		for i := range balancers {
+			items = append(items, balancers[i].GenXrayBalancerConfig())
+		}
+		routing["balancers"] = items
+		data, err := json.MarshalIndent(routing, "", "  ")
+		if err != nil {
+			return err
+		}
+		config.RouterConfig = data
+	}
+
+	if len(config.Observatory) == 0 && len(config.BurstObservatory) == 0 {
+		mode, observatory, err := s.genObservatory(balancers)
+		if err != nil {
+			return err
+		}
+		if observatory != nil {
+			data, err := json.MarshalIndent(observatory, "", "  ")
+			if err != nil {
+				return err
+			}
+			if mode == "burstObservatory" {
+				config.BurstObservatory = data
+			} else {
+				config.Observatory = data
+			}
+		}
+	}
+	if len(config.Observatory) == 0 && len(config.BurstObservatory) == 0 {
+		return nil
+	}
+	return addAPIService(config, "ObservatoryService")
+}
+
+// addAPIService adds a service to the API of the config, if it has an API.
+func addAPIService(config *xray.Config, service string) error {
+	if len(config.API) == 0 {
+		return nil
+	}
+	api := map[string]any{}
+	if err := json.Unmarshal(config.API, &api); err != nil || api == nil {
+		return common.NewError("xray template config invalid: api must be an object")
+	}
+	services, _ := api["services"].([]any)
+	for _, item := range services {
+		if name, _ := item.(string); strings.EqualFold(name, service) {
+			return nil
+		}
+	}
+	api["services"] = append(services, service)
+	data, err := json.MarshalIndent(api, "", "  ")
+	if err != nil {
+		return err
+	}
+	config.API = data
+	return nil
+}
+
+// GetObservatory returns the latest probes of the observatory of the running
+// Xray, with the outbounds of the balancers of the panel.
+func (s *BalancerService) GetObservatory(timeout time.Duration) (*Observatory, error) {
+	var xrayService XrayService
+	statuses, err := xrayService.GetOutboundStatus(timeout)
+	if err != nil {
+		return nil, err
+	}
+	refs, err := loadTemplateRefs()
+	if err != nil {
+		return nil, err
+	}
+	tags := append(slices.Clone(refs.outbounds), refs.panelOutbounds...)
+	observatory := &Observatory{Outbounds: statuses, Balancers: []BalancerInfo{}}
+	for _, balancer := range refs.panelBalancers {
+		info := BalancerInfo{
+			Tag:      balancer.Tag,
+			Strategy: balancer.Strategy,
+			Members:  balancerMembers(balancer.Selector, tags),
+		}
+		if balancer.Strategy == "leastPing" {
+			var picked *xray.OutboundStatus
+			for _, status := range statuses {
+				if status.Alive && slices.Contains(info.Members, status.Tag) &&
+					(picked == nil || status.Delay < picked.Delay) {
+					picked = status
+				}
+			}
+			if picked != nil {
+				info.Picked = picked.Tag
+			} else {
+				info.Picked = balancer.FallbackTag
+			}
+		}
+		observatory.Balancers = append(observatory.Balancers, info)
+	}
+	return observatory, nil
+}
@@ -0,0 +1,404 @@
+package service
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"x-ui/config"
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/web/entity"
+
+	"github.com/shirou/gopsutil/v4/net"
+)
+
+// bandwidthStateFile keeps the bandwidth counted in the periods, in the bin
+// folder, for the counters of the server and not of the database.
+const bandwidthStateFile = "bandwidth.json"
+
+// The actions taken when a bandwidth limit is reached.
+const (
+	BandwidthActionAlert           = "alert"
+	BandwidthActionDisableInbounds = "disableInbounds"
+	BandwidthActionStopXray        = "stopXray"
+)
+
+// BandwidthUsage is the traffic of the server in the current month and day of
+// the bandwidth limits, in bytes, times in milliseconds. A limit of 0 is none.
+type BandwidthUsage struct {
+	Source       string `json:"source"`
+	PeriodStart  int64  `json:"periodStart"`
+	PeriodEnd    int64  `json:"periodEnd"`
+	Month        uint64 `json:"month"`
+	MonthlyLimit uint64 `json:"monthlyLimit"`
+	Today        uint64 `json:"today"`
+	DailyLimit   uint64 `json:"dailyLimit"`
+	// Capped tells that a limit was reached and its action taken
+	Capped bool `json:"capped"`
+}
+
+// bandwidthState is what is counted in the periods. Counters are the last
+// readings of the interfaces, so that the traffic made while the panel was
+// down is counted on the next start.
+type bandwidthState struct {
+	PeriodStart int64             `json:"periodStart"`
+	DayStart    int64             `json:"dayStart"`
+	Month       uint64            `json:"month"`
+	Today       uint64            `json:"today"`
+	Counters    map[string]uint64 `json:"counters"`
+	// MonthAlerts and DayAlerts are the percents of the limits alerted
+	MonthAlerts []int `json:"monthAlerts"`
+	DayAlerts   []int `json:"dayAlerts"`
+	MonthCapped bool  `json:"monthCapped"`
+	DayCapped   bool  `json:"dayCapped"`
+	// DisabledInbounds and StoppedXray are what the action of a limit did, to
+	// be undone when the limit no longer holds
+	DisabledInbounds []int `json:"disabledInbounds,omitempty"`
+	StoppedXray      bool  `json:"stoppedXray,omitempty"`
+}
+
+var (
+	bandwidthLock   sync.Mutex
+	bandwidth       *bandwidthState
+	bandwidthLoaded bool
+	bandwidthUsage  *BandwidthUsage
+)
+
+// BandwidthService counts the traffic of the server against the monthly and
+// daily limits of the settings, alerts as it goes over the alert percents and
+// takes the action of the settings when a limit is reached.
+type BandwidthService struct {
+	settingService SettingService
+	xrayService    XrayService
+	webhookService WebhookService
+}
+
+// bandwidthLimit is a limit of a period and how far it is used.
+type bandwidthLimit struct {
+	period string
+	used   uint64
+	limit  uint64
+	alerts *[]int
+	capped *bool
+}
+
+// GetUsage returns the bandwidth the last check counted, nil before the first
+// one.
+func (s *BandwidthService) GetUsage() *BandwidthUsage {
+	bandwidthLock.Lock()
+	defer bandwidthLock.Unlock()
+	return bandwidthUsage
+}
+
+// Check counts the traffic since the last check, starts the periods that are
+// due, and alerts or acts on the limits.
+func (s *BandwidthService) Check() error {
+	allSetting, err := s.settingService.GetAllSetting()
+	if err != nil {
+		return err
+	}
+	percents, err := entity.ParseBandwidthPercents(allSetting.BandwidthAlertPercents)
+	if err != nil {
+		return err
+	}
+
+	bandwidthLock.Lock()
+	defer bandwidthLock.Unlock()
+	state := loadBandwidthState()
+	now := time.Now()
+	periodStart := bandwidthPeriodStart(now, allSetting.BandwidthResetDay)
+	dayStart := dayStart(now)
+	restore := false
+	if state.PeriodStart != periodStart.UnixMilli() {
+		restore = restore || state.MonthCapped
+		state.PeriodStart, state.Month, state.MonthAlerts, state.MonthCapped = periodStart.UnixMilli(), 0, nil, false
+	}
+	if state.DayStart != dayStart.UnixMilli() {
+		restore = restore || state.DayCapped
+		state.DayStart, state.Today, state.DayAlerts, state.DayCapped = dayStart.UnixMilli(), 0, nil, false
+	}
+
+	switch allSetting.BandwidthSource {
+	case "inbounds":
+		if state.Month, err = panelTrafficSince(state.PeriodStart); err != nil {
+			return err
+		}
+		if state.Today, err = panelTrafficSince(state.DayStart); err != nil {
+			return err
+		}
+	default:
+		delta, err := readInterfaceCounters(state.Counters)
+		if err != nil {
+			return err
+		}
+		state.Month += delta
+		state.Today += delta
+	}
+
+	gigabyte := uint64(1 << 30)
+	limits := []bandwidthLimit{
+		{"month", state.Month, uint64(allSetting.BandwidthMonthlyLimit) * gigabyte, &state.MonthAlerts, &state.MonthCapped},
+		{"day", state.Today, uint64(allSetting.BandwidthDailyLimit) * gigabyte, &state.DayAlerts, &state.DayCapped},
+	}
+	// A limit lifted or raised over the usage no longer holds its action
+	for _, limit := range limits {
+		if *limit.capped && (limit.limit == 0 || limit.used < limit.limit) {
+			*limit.capped = false
+			restore = true
+		}
+	}
+	if restore && !state.MonthCapped && !state.DayCapped {
+		s.restore(state)
+	}
+	for _, limit := range limits {
+		if limit.limit > 0 {
+			s.checkLimit(state, limit, percents, allSetting.BandwidthAction)
+		}
+	}
+
+	bandwidthUsage = &BandwidthUsage{
+		Source:       allSetting.BandwidthSource,
+		PeriodStart:  state.PeriodStart,
+		PeriodEnd:    bandwidthPeriodStart(periodStart.AddDate(0, 1, 0), allSetting.BandwidthResetDay).UnixMilli(),
+		Month:        state.Month,
+		MonthlyLimit: limits[0].limit,
+		Today:        state.Today,
+		DailyLimit:   limits[1].limit,
+		Capped:       state.MonthCapped || state.DayCapped,
+	}
+	return saveBandwidthState(state)
+}
+
+// checkLimit alerts on the highest alert percent of a limit newly gone over,
+// and takes action when the limit is reached.
+func (s *BandwidthService) checkLimit(state *bandwidthState, limit bandwidthLimit, percents []int, action string) {
+	if limit.used >= limit.limit {
+		if *limit.capped {
+			return
+		}
+		*limit.capped = true
+		// An action taken for the other limit is not taken again
+		if len(state.DisabledInbounds) == 0 && !state.StoppedXray {
+			s.act(state, action)
+		} else {
+			action = BandwidthActionAlert
+		}
+		s.alert(limit, 100, true, action)
+		return
+	}
+	crossed := 0
+	for _, percent := range percents {
+		if limit.used*100 >= limit.limit*uint64(percent) && !slices.Contains(*limit.alerts, percent) {
+			*limit.alerts = append(*limit.alerts, percent)
+			crossed = percent
+		}
+	}
+	if crossed > 0 {
+		s.alert(limit, crossed, false, "")
+	}
+}
+
+// act takes the action of a reached limit.
+func (s *BandwidthService) act(state *bandwidthState, action string) {
+	switch action {
+	case BandwidthActionDisableInbounds:
+		db := database.GetDB()
+		var ids []int
+		err := db.Model(model.Inbound{}).Where("enable = ?", true).Pluck("id", &ids).Error
+		if err == nil && len(ids) > 0 {
+			err = db.Model(model.Inbound{}).Where("id IN ?", ids).Update("enable", false).Error
+		}
+		if err != nil {
+			logger.Warning("Unable to disable the inbounds for the bandwidth limit:", err)
+			return
+		}
+		logger.Warningf("Bandwidth limit reached, %d inbounds disabled", len(ids))
+		state.DisabledInbounds = ids
+		s.xrayService.SetToNeedRestart()
+	case BandwidthActionStopXray:
+		if err := s.xrayService.StopXray(); err != nil {
+			logger.Warning("Unable to stop Xray for the bandwidth limit:", err)
+			return
+		}
+		logger.Warning("Bandwidth limit reached, Xray stopped")
+		state.StoppedXray = true
+	}
+}
+
+// restore undoes the action of a limit whose period is over or that was lifted.
+func (s *BandwidthService) restore(state *bandwidthState) {
+	if len(state.DisabledInbounds) > 0 {
+		err := database.GetDB().Model(model.Inbound{}).Where("id IN ?", state.DisabledInbounds).Update("enable", true).Error
+		if err != nil {
+			logger.Warning("Unable to enable the inbounds disabled for the bandwidth limit:", err)
+			return
+		}
+		logger.Infof("Bandwidth limit over, %d inbounds enabled again", len(state.DisabledInbounds))
+		s.xrayService.SetToNeedRestart()
+	}
+	if state.StoppedXray {
+		if err := s.xrayService.RestartXray(true); err != nil {
+			logger.Warning("Unable to start Xray stopped for the bandwidth limit:", err)
+			return
+		}
+		logger.Info("Bandwidth limit over, Xray started again")
+	}
+	state.DisabledInbounds, state.StoppedXray = nil, false
+	go new(Tgbot).BandwidthRestored()
+}
+
+func (s *BandwidthService) alert(limit bandwidthLimit, percent int, capped bool, action string) {
+	logger.Warningf("Bandwidth of the %s at %d%%: %s of %s", limit.period, percent,
+		common.FormatTraffic(int64(limit.used)), common.FormatTraffic(int64(limit.limit)))
+	go new(Tgbot).BandwidthAlert(limit.period, limit.used, limit.limit, percent, capped, action)
+	s.webhookService.Emit(WebhookBandwidthThreshold, map[string]any{
+		"period":  limit.period,
+		"used":    limit.used,
+		"limit":   limit.limit,
+		"percent": percent,
+		"capped":  capped,
+		"action":  action,
+	})
+}
+
+// bandwidthPeriodStart returns the start of the month of the limits t is in,
+// the last reset day at midnight.
+func bandwidthPeriodStart(t time.Time, resetDay int) time.Time {
+	start := time.Date(t.Year(), t.Month(), resetDay, 0, 0, 0, 0, t.Location())
+	if start.After(t) {
+		start = start.AddDate(0, -1, 0)
+	}
+	return start
+}
+
+// panelTrafficSince returns the traffic of all the inbounds from since on, as
+// the traffic history has it.
+func panelTrafficSince(since int64) (uint64, error) {
+	var total int64
+	err := database.GetDB().Model(model.HourlyTraffic{}).
+		Select("COALESCE(SUM(up + down), 0)").
+		Where("entity = ? AND entity_id = ? AND hour >= ?", model.TrafficEntityPanel, "", since).
+		Scan(&total).Error
+	return uint64(max(total, 0)), err
+}
+
+// readInterfaceCounters returns the bytes the interfaces but the loopback ones
+// sent and received since counters were read, and updates them. An interface
+// seen for the first time counts from now on.
+func readInterfaceCounters(counters map[string]uint64) (uint64, error) {
+	stats, err := net.IOCounters(true)
+	if err != nil {
+		return 0, err
+	}
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return 0, err
+	}
+	loopback := map[string]bool{}
+	for _, i := range interfaces {
+		if slices.Contains(i.Flags, "loopback") {
+			loopback[i.Name] = true
+		}
+	}
+	var total uint64
+	for _, stat := range stats {
+		if loopback[stat.Name] {
+			continue
+		}
+		for name, value := range map[string]uint64{stat.Name + ">>>sent": stat.BytesSent, stat.Name + ">>>recv": stat.BytesRecv} {
+			if last, ok := counters[name]; ok {
+				total += counterDelta(last, value)
+			}
+			counters[name] = value
+		}
+	}
+	return total, nil
+}
+
+// counterDelta returns how much a counter grew from last to current. A counter
+// that went back either wrapped, if it has 32 bits, or started over from zero
+// with the server.
+func counterDelta(last uint64, current uint64) uint64 {
+	if current >= last {
+		return current - last
+	}
+	if last <= math.MaxUint32 {
+		if wrapped := math.MaxUint32 - last + current + 1; wrapped < 1<<31 {
+			return wrapped
+		}
+	}
+	return current
+}
+
+func loadBandwidthState() *bandwidthState {
+	if bandwidthLoaded {
+		return bandwidth
+	}
+	bandwidthLoaded = true
+	bandwidth = &bandwidthState{}
+	data, err := os.ReadFile(filepath.Join(config.GetBinFolderPath(), bandwidthStateFile))
+	if err == nil {
+		err = json.Unmarshal(data, bandwidth)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		logger.Warning("Unable to read the bandwidth counted:", err)
+	}
+	if bandwidth.Counters == nil {
+		bandwidth.Counters = map[string]uint64{}
+	}
+	return bandwidth
+}
+
+func saveBandwidthState(state *bandwidthState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(config.GetBinFolderPath(), bandwidthStateFile), data, 0o644)
+}
+
+// BandwidthAlert tells the admins how much of a bandwidth limit the
+// server used, and the action taken if it reached it.
+func (t *Tgbot) BandwidthAlert(period string, used uint64, limit uint64, percent int, capped bool, action string) {
+	if !t.AlertsOn(AlertBandwidth) {
+		return
+	}
+	periodName := t.I18nBot("tgbot.messages.bandwidthMonthly")
+	if period == "day" {
+		periodName = t.I18nBot("tgbot.messages.bandwidthDaily")
+	}
+	var msg string
+	if capped {
+		msg = t.I18nBot("tgbot.messages.bandwidthCapped", "Period=="+periodName, "Limit=="+common.FormatTraffic(int64(limit)))
+	} else {
+		msg = t.I18nBot("tgbot.messages.bandwidthThreshold", "Period=="+periodName,
+			"Used=="+common.FormatTraffic(int64(used)), "Limit=="+common.FormatTraffic(int64(limit)), "Percent=="+strconv.Itoa(percent))
+	}
+	msg += t.I18nBot("tgbot.messages.hostname", "Hostname=="+hostname)
+	switch action {
+	case BandwidthActionDisableInbounds:
+		msg += t.I18nBot("tgbot.messages.bandwidthInboundsDisabled")
+	case BandwidthActionStopXray:
+		msg += t.I18nBot("tgbot.messages.bandwidthXrayStopped")
+	}
+	t.SendAlert(AlertBandwidth, msg)
+}
+
+// BandwidthRestored tells the admins that the action of a bandwidth
+// limit was undone with the start of a new period.
+func (t *Tgbot) BandwidthRestored() {
+	if !t.AlertsOn(AlertBandwidth) {
+		return
+	}
+	msg := t.I18nBot("tgbot.messages.bandwidthRestored")
+	msg += t.I18nBot("tgbot.messages.hostname", "Hostname=="+hostname)
+	t.SendAlert(AlertBandwidth, msg)
+}
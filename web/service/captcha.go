@@ -0,0 +1,383 @@
+package service
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math/big"
+	mathrand "math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"x-ui/logger"
+
+	"github.com/goccy/go-json"
+)
+
+// The kinds of the login challenge. Math is a sum drawn on an image by the
+// panel, Turnstile the widget of Cloudflare with the keys in the settings.
+const (
+	CaptchaOff       = "off"
+	CaptchaMath      = "math"
+	CaptchaTurnstile = "turnstile"
+)
+
+const (
+	// captchaTTL is how long an issued challenge can be answered
+	captchaTTL = 5 * time.Minute
+	// maxCaptchaChallenges bounds the challenges waiting for an answer, the
+	// oldest are dropped first
+	maxCaptchaChallenges = 10000
+	// maxCaptchaSources bounds the IPs whose failures are counted, those that
+	// failed least recently are forgotten first
+	maxCaptchaSources = 10000
+	// captchaFailureWindow is how long a failed login counts, when the lockout
+	// has no window
+	captchaFailureWindow = 15 * time.Minute
+	turnstileVerifyURL   = "https://challenges.cloudflare.com/turnstile/v0/siteverify"
+	turnstileTimeout     = 10 * time.Second
+)
+
+// CaptchaChallenge is the challenge a login has to pass, as sent to the login
+// page. Token names a math challenge and Image draws it; a Turnstile challenge
+// has the site key of the widget instead.
+type CaptchaChallenge struct {
+	Type    string `json:"type"`
+	Token   string `json:"token,omitempty"`
+	Image   string `json:"image,omitempty"`
+	SiteKey string `json:"siteKey,omitempty"`
+}
+
+// captchaEntry is a key of a bounded captcha store and what is kept of it.
+type captchaEntry struct {
+	key     string
+	value   string
+	ip      string
+	count   int
+	first   time.Time
+	expires time.Time
+}
+
+// captchaStore keeps at most capacity entries by key, dropping the least
+// recently touched ones first.
+type captchaStore struct {
+	capacity int
+	entries  map[string]*list.Element
+	lru      *list.List
+}
+
+func newCaptchaStore(capacity int) *captchaStore {
+	return &captchaStore{capacity: capacity, entries: map[string]*list.Element{}, lru: list.New()}
+}
+
+func (s *captchaStore) get(key string) *captchaEntry {
+	element, ok := s.entries[key]
+	if !ok {
+		return nil
+	}
+	s.lru.MoveToFront(element)
+	return element.Value.(*captchaEntry)
+}
+
+func (s *captchaStore) put(entry *captchaEntry) {
+	if element, ok := s.entries[entry.key]; ok {
+		element.Value = entry
+		s.lru.MoveToFront(element)
+		return
+	}
+	for s.lru.Len() >= s.capacity {
+		s.remove(s.lru.Back().Value.(*captchaEntry).key)
+	}
+	s.entries[entry.key] = s.lru.PushFront(entry)
+}
+
+func (s *captchaStore) remove(key string) {
+	if element, ok := s.entries[key]; ok {
+		s.lru.Remove(element)
+		delete(s.entries, key)
+	}
+}
+
+var (
+	captchaLock       sync.Mutex
+	captchaChallenges = newCaptchaStore(maxCaptchaChallenges)
+	captchaFailures   = newCaptchaStore(maxCaptchaSources)
+	// captchaRecent are the times of the failed logins of the last minute, from
+	// any IP, at most as many as the limit needs
+	captchaRecent []time.Time
+)
+
+// CaptchaService decides when a login has to pass a challenge, issues the math
+// challenges and checks the answers. The challenges and the failures are kept
+// in memory only.
+type CaptchaService struct {
+	settingService SettingService
+}
+
+// kind returns the kind of challenge the settings ask the logins for, as
+// Resolve does, with the keys of Turnstile.
+func (s *CaptchaService) kind() (string, string, string) {
+	kind, err := s.settingService.GetLoginCaptcha()
+	if err != nil {
+		return CaptchaOff, "", ""
+	}
+	return s.resolve(kind)
+}
+
+// resolve returns the kind of challenge kind is given as: off for an unknown
+// kind, math when Turnstile lacks its keys. The keys of Turnstile come along.
+func (s *CaptchaService) resolve(kind string) (string, string, string) {
+	if kind != CaptchaMath && kind != CaptchaTurnstile {
+		return CaptchaOff, "", ""
+	}
+	if kind == CaptchaTurnstile {
+		siteKey, _ := s.settingService.GetTurnstileSiteKey()
+		secret, _ := s.settingService.GetTurnstileSecret()
+		if siteKey == "" || secret == "" {
+			logger.Warning("Turnstile has no site key or secret, the challenge is a math one")
+			return CaptchaMath, "", ""
+		}
+		return kind, siteKey, secret
+	}
+	return kind, "", ""
+}
+
+// Resolve returns the kind of challenge kind is given as, for the challenges
+// other than the one of the logins.
+func (s *CaptchaService) Resolve(kind string) string {
+	kind, _, _ = s.resolve(kind)
+	return kind
+}
+
+// failureWindow returns how long a failed login counts towards a challenge.
+func (s *CaptchaService) failureWindow() time.Duration {
+	window, err := s.settingService.GetLockoutWindow()
+	if err != nil || window <= 0 {
+		return captchaFailureWindow
+	}
+	return time.Duration(window) * time.Minute
+}
+
+// Required returns the kind of challenge a login from ip has to pass, off if
+// none: it is past the failures allowed from an IP, or the failed logins of
+// the last minute from anywhere are past the global limit.
+func (s *CaptchaService) Required(ip string) string {
+	kind, _, _ := s.kind()
+	if kind == CaptchaOff {
+		return CaptchaOff
+	}
+	threshold, _ := s.settingService.GetLoginCaptchaFailures()
+	globalRate, _ := s.settingService.GetLoginCaptchaGlobalRate()
+	now := time.Now()
+
+	captchaLock.Lock()
+	defer captchaLock.Unlock()
+	if globalRate > 0 && pruneCaptchaRecent(now) >= globalRate {
+		return kind
+	}
+	if failure := captchaFailures.get(ip); failure != nil {
+		if now.Sub(failure.first) > s.failureWindow() {
+			captchaFailures.remove(ip)
+		} else if failure.count >= max(threshold, 1) {
+			return kind
+		}
+	}
+	return CaptchaOff
+}
+
+// pruneCaptchaRecent drops the failed logins older than a minute and returns
+// how many are left.
+func pruneCaptchaRecent(now time.Time) int {
+	start := 0
+	for start < len(captchaRecent) && now.Sub(captchaRecent[start]) > time.Minute {
+		start++
+	}
+	captchaRecent = captchaRecent[start:]
+	return len(captchaRecent)
+}
+
+// RecordFailure counts a failed login from ip, with a wrong password or a
+// wrong answer to the challenge.
+func (s *CaptchaService) RecordFailure(ip string) {
+	if kind, _, _ := s.kind(); kind == CaptchaOff {
+		return
+	}
+	globalRate, _ := s.settingService.GetLoginCaptchaGlobalRate()
+	now := time.Now()
+
+	captchaLock.Lock()
+	defer captchaLock.Unlock()
+	failure := captchaFailures.get(ip)
+	if failure == nil || now.Sub(failure.first) > s.failureWindow() {
+		failure = &captchaEntry{key: ip, first: now}
+	}
+	failure.count++
+	captchaFailures.put(failure)
+	if globalRate > 0 {
+		// More than the limit are not needed to know it is reached
+		if pruneCaptchaRecent(now) >= globalRate {
+			captchaRecent = captchaRecent[1:]
+		}
+		captchaRecent = append(captchaRecent, now)
+	}
+}
+
+// Reset forgets the failures of ip, after it logged in.
+func (s *CaptchaService) Reset(ip string) {
+	captchaLock.Lock()
+	defer captchaLock.Unlock()
+	captchaFailures.remove(ip)
+}
+
+// NewChallenge issues a challenge of kind for a login from ip.
+func (s *CaptchaService) NewChallenge(kind string, ip string) (*CaptchaChallenge, error) {
+	if kind == CaptchaTurnstile {
+		_, siteKey, _ := s.resolve(kind)
+		return &CaptchaChallenge{Type: CaptchaTurnstile, SiteKey: siteKey}, nil
+	}
+	a, err := rand.Int(rand.Reader, big.NewInt(40))
+	if err != nil {
+		return nil, err
+	}
+	b, err := rand.Int(rand.Reader, big.NewInt(40))
+	if err != nil {
+		return nil, err
+	}
+	question := fmt.Sprintf("%d+%d=?", a.Int64()+10, b.Int64()+1)
+	answer := strconv.FormatInt(a.Int64()+10+b.Int64()+1, 10)
+	image, err := captchaImage(question)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	token := hex.EncodeToString(buf)
+
+	captchaLock.Lock()
+	defer captchaLock.Unlock()
+	captchaChallenges.put(&captchaEntry{key: token, value: answer, ip: ip, expires: time.Now().Add(captchaTTL)})
+	return &CaptchaChallenge{Type: CaptchaMath, Token: token, Image: image}, nil
+}
+
+// Verify checks the answer to a challenge of kind from ip. A math challenge
+// can only be answered once, from the IP it was issued to, before it expires.
+func (s *CaptchaService) Verify(kind string, ip string, token string, answer string) bool {
+	answer = strings.TrimSpace(answer)
+	if answer == "" {
+		return false
+	}
+	if kind == CaptchaTurnstile {
+		_, _, secret := s.resolve(kind)
+		return verifyTurnstile(secret, answer, ip)
+	}
+	captchaLock.Lock()
+	defer captchaLock.Unlock()
+	challenge := captchaChallenges.get(token)
+	if challenge == nil {
+		return false
+	}
+	captchaChallenges.remove(token)
+	return challenge.ip == ip && time.Now().Before(challenge.expires) && challenge.value == answer
+}
+
+// verifyTurnstile asks Cloudflare whether response is a solved Turnstile
+// challenge of ip.
+func verifyTurnstile(secret string, response string, ip string) bool {
+	client := &http.Client{Timeout: turnstileTimeout}
+	resp, err := client.PostForm(turnstileVerifyURL, url.Values{
+		"secret":   {secret},
+		"response": {response},
+		"remoteip": {ip},
+	})
+	if err != nil {
+		logger.Warning("Unable to verify the Turnstile challenge:", err)
+		return false
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Success    bool     `json:"success"`
+		ErrorCodes []string `json:"error-codes"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		logger.Warning("Unable to verify the Turnstile challenge:", err)
+		return false
+	}
+	if !result.Success && len(result.ErrorCodes) > 0 {
+		logger.Debug("Turnstile challenge failed:", strings.Join(result.ErrorCodes, ", "))
+	}
+	return result.Success
+}
+
+// captchaGlyphs are the characters of the math challenges, 3 by 5 pixels with
+// a row of 3 bits each.
+var captchaGlyphs = map[rune][5]uint8{
+	'0': {7, 5, 5, 5, 7},
+	'1': {2, 6, 2, 2, 7},
+	'2': {7, 1, 7, 4, 7},
+	'3': {7, 1, 7, 1, 7},
+	'4': {5, 5, 7, 1, 1},
+	'5': {7, 4, 7, 1, 7},
+	'6': {7, 4, 7, 5, 7},
+	'7': {7, 1, 2, 2, 2},
+	'8': {7, 5, 7, 5, 7},
+	'9': {7, 5, 7, 1, 7},
+	'+': {0, 2, 7, 2, 0},
+	'=': {0, 7, 0, 7, 0},
+	'?': {7, 1, 3, 0, 2},
+}
+
+// captchaImage draws text with jitter and noise on a PNG, as a data URL.
+func captchaImage(text string) (string, error) {
+	const scale, width, height = 5, 200, 60
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for i := range img.Pix {
+		img.Pix[i] = 0xf4
+	}
+	for range 300 {
+		shade := uint8(mathrand.IntN(120) + 100)
+		img.Set(mathrand.IntN(width), mathrand.IntN(height), color.RGBA{shade, shade, shade, 0xff})
+	}
+	x := 10
+	for _, char := range text {
+		glyph := captchaGlyphs[char]
+		top := 12 + mathrand.IntN(14)
+		ink := color.RGBA{uint8(mathrand.IntN(90)), uint8(mathrand.IntN(90)), uint8(mathrand.IntN(90)), 0xff}
+		for row, bits := range glyph {
+			for col := range 3 {
+				if bits&(4>>col) == 0 {
+					continue
+				}
+				for dy := range scale {
+					for dx := range scale {
+						img.Set(x+col*scale+dx, top+row*scale+dy, ink)
+					}
+				}
+			}
+		}
+		x += 4*scale + mathrand.IntN(5)
+	}
+	for range 4 {
+		y, slope := float64(mathrand.IntN(height)), float64(mathrand.IntN(41)-20)/100
+		shade := uint8(mathrand.IntN(100) + 60)
+		for px := range width {
+			img.Set(px, int(y+slope*float64(px)), color.RGBA{shade, shade, shade, 0xff})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return "", err
+	}
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
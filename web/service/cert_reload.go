@@ -0,0 +1,340 @@
+package service
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/xray"
+)
+
+var (
+	// certReloaders are the certificates the HTTPS servers of the panel serve,
+	// by their name
+	certReloaders     = map[string]*CertReloader{}
+	certReloadersLock sync.Mutex
+	// inboundCertStamps are the stamps of the certificate files of the
+	// inbounds as last seen, by pair of files
+	inboundCertStamps = map[certPair]certStamp{}
+	// certReloadLock keeps the job and the API from reloading at once
+	certReloadLock sync.Mutex
+)
+
+// certPair is a certificate file and the file of its key.
+type certPair struct {
+	CertFile string
+	KeyFile  string
+}
+
+// certStamp tells whether the files of a certificate changed, by their
+// modification times and sizes.
+type certStamp struct {
+	CertTime time.Time
+	CertSize int64
+	KeyTime  time.Time
+	KeySize  int64
+}
+
+func statCertPair(pair certPair) certStamp {
+	stamp := certStamp{}
+	if info, err := os.Stat(pair.CertFile); err == nil {
+		stamp.CertTime, stamp.CertSize = info.ModTime(), info.Size()
+	}
+	if info, err := os.Stat(pair.KeyFile); err == nil {
+		stamp.KeyTime, stamp.KeySize = info.ModTime(), info.Size()
+	}
+	return stamp
+}
+
+// loadCertPair loads a certificate and its key, and fails if the key is not
+// the key of the certificate or the certificate is not valid now.
+func loadCertPair(pair certPair) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(pair.CertFile, pair.KeyFile)
+	if err != nil {
+		return nil, common.NewErrorf("%s with %s: %v", pair.CertFile, pair.KeyFile, err)
+	}
+	leaf := cert.Leaf
+	if leaf == nil {
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, common.NewErrorf("%s: %v", pair.CertFile, err)
+		}
+	}
+	now := time.Now()
+	if now.After(leaf.NotAfter) {
+		return nil, common.NewErrorf("%s expired on %s", pair.CertFile, leaf.NotAfter.Format(time.RFC3339))
+	}
+	if now.Before(leaf.NotBefore) {
+		return nil, common.NewErrorf("%s is not valid before %s", pair.CertFile, leaf.NotBefore.Format(time.RFC3339))
+	}
+	return &cert, nil
+}
+
+func certNotAfter(cert *tls.Certificate) int64 {
+	if cert == nil || cert.Leaf == nil {
+		return 0
+	}
+	return cert.Leaf.NotAfter.UnixMilli()
+}
+
+// CertReloadResult is how the reload of a certificate went. A certificate that
+// failed to load keeps being served as it was.
+type CertReloadResult struct {
+	Name     string   `json:"name"`
+	CertFile string   `json:"certFile"`
+	KeyFile  string   `json:"keyFile"`
+	Tags     []string `json:"tags,omitempty"`
+	Reloaded bool     `json:"reloaded"`
+	NotAfter int64    `json:"notAfter,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// CertReloader serves a certificate to a TLS server through GetCertificate,
+// and swaps it for the one of its files when they change.
+type CertReloader struct {
+	name string
+	pair certPair
+
+	lock  sync.RWMutex
+	cert  *tls.Certificate
+	stamp certStamp
+}
+
+// NewCertReloader loads the certificate of certFile and keyFile for the
+// server of name, or fails if it is not valid.
+func NewCertReloader(name string, certFile string, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{name: name, pair: certPair{CertFile: certFile, KeyFile: keyFile}}
+	r.stamp = statCertPair(r.pair)
+	cert, err := loadCertPair(r.pair)
+	if err != nil {
+		return nil, err
+	}
+	r.cert = cert
+	return r, nil
+}
+
+// GetCertificate returns the certificate loaded last, for tls.Config.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.cert, nil
+}
+
+// Reload loads the files of the certificate again if they changed, or anyway
+// if force is set. A certificate that is not valid is not swapped in.
+func (r *CertReloader) Reload(force bool) CertReloadResult {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	result := CertReloadResult{Name: r.name, CertFile: r.pair.CertFile, KeyFile: r.pair.KeyFile}
+	stamp := statCertPair(r.pair)
+	if !force && stamp == r.stamp {
+		result.NotAfter = certNotAfter(r.cert)
+		return result
+	}
+	// A change is tried once, not until the files are fixed
+	r.stamp = stamp
+	cert, err := loadCertPair(r.pair)
+	if err != nil {
+		logger.Warning("Keeping the certificate of the", r.name, "server, the new one failed to load:", err)
+		result.Error = err.Error()
+		result.NotAfter = certNotAfter(r.cert)
+		return result
+	}
+	r.cert = cert
+	result.Reloaded = true
+	result.NotAfter = certNotAfter(cert)
+	logger.Info("Reloaded the certificate of the", r.name, "server from", r.pair.CertFile)
+	return result
+}
+
+// RegisterCertReloader has the certificate of a server reloaded along with
+// the others, in place of the one of the same name.
+func RegisterCertReloader(r *CertReloader) {
+	certReloadersLock.Lock()
+	defer certReloadersLock.Unlock()
+	certReloaders[r.name] = r
+}
+
+// UnregisterCertReloader stops reloading the certificate of a server that
+// stopped.
+func UnregisterCertReloader(r *CertReloader) {
+	certReloadersLock.Lock()
+	defer certReloadersLock.Unlock()
+	if certReloaders[r.name] == r {
+		delete(certReloaders, r.name)
+	}
+}
+
+// CertReloadService reloads the certificates of the panel, of the
+// subscriptions and of the inbounds whose files changed, without a restart.
+type CertReloadService struct {
+	inboundService InboundService
+	xrayService    XrayService
+}
+
+// Reload reloads the certificates whose files changed since they were last
+// seen, or all of them if force is set, and returns how it went for each.
+func (s *CertReloadService) Reload(force bool) []CertReloadResult {
+	certReloadLock.Lock()
+	defer certReloadLock.Unlock()
+
+	certReloadersLock.Lock()
+	reloaders := make([]*CertReloader, 0, len(certReloaders))
+	for _, r := range certReloaders {
+		reloaders = append(reloaders, r)
+	}
+	certReloadersLock.Unlock()
+	sort.Slice(reloaders, func(i, j int) bool { return reloaders[i].name < reloaders[j].name })
+
+	results := []CertReloadResult{}
+	for _, r := range reloaders {
+		results = append(results, r.Reload(force))
+	}
+	return append(results, s.reloadInbounds(force)...)
+}
+
+// reloadInbounds adds again through the API of Xray the enabled inbounds with
+// a certificate whose files changed, for Xray to load them, and only them.
+func (s *CertReloadService) reloadInbounds(force bool) []CertReloadResult {
+	inbounds, err := s.inboundService.GetAllInbounds()
+	if err != nil {
+		logger.Warning("Unable to read the inbounds for their certificates:", err)
+		return nil
+	}
+	pairs := []certPair{}
+	tags := map[certPair][]string{}
+	for _, inbound := range inbounds {
+		if !inbound.Enable {
+			continue
+		}
+		for _, pair := range streamCertPairs(inbound.StreamSettings) {
+			if _, ok := tags[pair]; !ok {
+				pairs = append(pairs, pair)
+			}
+			if !slices.Contains(tags[pair], inbound.Tag) {
+				tags[pair] = append(tags[pair], inbound.Tag)
+			}
+		}
+	}
+
+	results := []CertReloadResult{}
+	reload := []string{}
+	for _, pair := range pairs {
+		stamp := statCertPair(pair)
+		old, seen := inboundCertStamps[pair]
+		inboundCertStamps[pair] = stamp
+		if !force && (!seen || old == stamp) {
+			continue
+		}
+		result := CertReloadResult{Name: "inbound", CertFile: pair.CertFile, KeyFile: pair.KeyFile, Tags: tags[pair]}
+		cert, err := loadCertPair(pair)
+		if err != nil {
+			logger.Warning("Keeping the certificate of the inbounds", tags[pair], "the new one failed to load:", err)
+			result.Error = err.Error()
+		} else {
+			result.NotAfter = certNotAfter(cert)
+			for _, tag := range tags[pair] {
+				if !slices.Contains(reload, tag) {
+					reload = append(reload, tag)
+				}
+			}
+		}
+		results = append(results, result)
+	}
+	// Forget the files no inbound refers to anymore
+	for pair := range inboundCertStamps {
+		if _, ok := tags[pair]; !ok {
+			delete(inboundCertStamps, pair)
+		}
+	}
+	if len(reload) == 0 {
+		return results
+	}
+
+	err = s.readdInbounds(reload)
+	if err != nil {
+		logger.Warning("Unable to reload the inbounds", reload, "by api, restarting xray:", err)
+		if s.xrayService.IsXrayRunning() {
+			// The paths of the certificates are the same, the config too
+			s.xrayService.SetToRequireRestart()
+		}
+	} else {
+		logger.Info("Reloaded the certificates of the inbounds", reload)
+	}
+	for i := range results {
+		if results[i].Error == "" {
+			results[i].Reloaded = err == nil
+		}
+	}
+	return results
+}
+
+// readdInbounds removes the running inbounds of tags and adds them again with
+// the config Xray would be started with.
+func (s *CertReloadService) readdInbounds(tags []string) error {
+	config, err := s.xrayService.GetXrayConfig()
+	if err != nil {
+		return err
+	}
+	configs := []xray.InboundConfig{}
+	for _, inbound := range config.InboundConfigs {
+		if slices.Contains(tags, inbound.Tag) {
+			configs = append(configs, inbound)
+		}
+	}
+
+	s.inboundService.muXray.Lock()
+	defer s.inboundService.muXray.Unlock()
+	if err := s.inboundService.initXrayAPI(); err != nil {
+		return err
+	}
+	defer s.inboundService.xrayApi.Close()
+	for _, inbound := range configs {
+		inboundJson, err := json.Marshal(inbound)
+		if err != nil {
+			return err
+		}
+		if err := s.inboundService.xrayApi.DelInbound(inbound.Tag); err != nil {
+			return err
+		}
+		if err := s.inboundService.xrayApi.AddInbound(inboundJson); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// streamCertPairs returns the certificate files, and their keys, the TLS
+// settings of a stream use, those of ACME certificates included.
+func streamCertPairs(streamSettings string) []certPair {
+	var stream struct {
+		Security    string `json:"security"`
+		TLSSettings struct {
+			Certificates []struct {
+				Acme            string `json:"acme"`
+				CertificateFile string `json:"certificateFile"`
+				KeyFile         string `json:"keyFile"`
+			} `json:"certificates"`
+		} `json:"tlsSettings"`
+	}
+	if json.Unmarshal([]byte(streamSettings), &stream) != nil || stream.Security != "tls" {
+		return nil
+	}
+	pairs := []certPair{}
+	for _, certificate := range stream.TLSSettings.Certificates {
+		pair := certPair{CertFile: certificate.CertificateFile, KeyFile: certificate.KeyFile}
+		if certificate.Acme != "" {
+			pair.CertFile, pair.KeyFile = acmeCertFiles(certificate.Acme)
+		}
+		if pair.CertFile != "" && pair.KeyFile != "" {
+			pairs = append(pairs, pair)
+		}
+	}
+	return pairs
+}
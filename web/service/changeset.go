@@ -0,0 +1,302 @@
+package service
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/util/random"
+	"x-ui/xray"
+
+	"gorm.io/gorm"
+)
+
+// changesetHealthTimeout is how long a committed changeset waits for the API of
+// the restarted Xray to answer.
+const changesetHealthTimeout = 5 * time.Second
+
+// inboundConfigColumns are the columns of an inbound a rolled back changeset
+// restores; the traffic it counted meanwhile is kept.
+var inboundConfigColumns = []string{
+	"remark", "enable", "expiry_time", "total", "remark_template", "sub_include_disabled", "client_defaults",
+	"listen", "port", "port_end", "protocol", "settings", "stream_settings", "tag", "sniffing", "allocate",
+}
+
+// clientConfigColumns are the columns of the traffic of a client a rolled back
+// changeset restores.
+var clientConfigColumns = []string{"inbound_id", "enable", "expiry_time", "total", "carried_over", "reset", "tags"}
+
+// Changeset is a batch of changes to the inbounds and their clients. They are
+// written to the database as they are made, and applied to Xray together by one
+// restart when the changeset is committed.
+type Changeset struct {
+	Id        string `json:"id"`
+	Name      string `json:"name"`
+	CreatedBy string `json:"createdBy"`
+	CreatedAt int64  `json:"createdAt"`
+	// snapshot is the inbounds with the traffic of their clients when the
+	// changeset began, what a rollback restores
+	snapshot []*model.Inbound
+}
+
+// ChangesetResult is what committing a changeset did. Preview is the config it
+// applied, compared to the one Xray ran with before.
+type ChangesetResult struct {
+	Changeset  *Changeset         `json:"changeset"`
+	Preview    *XrayConfigPreview `json:"preview,omitempty"`
+	Applied    bool               `json:"applied"`
+	RolledBack bool               `json:"rolledBack"`
+	Error      string             `json:"error,omitempty"`
+}
+
+var (
+	// changesetLock serializes the beginning, committing and discarding of
+	// the changesets
+	changesetLock sync.Mutex
+	// openChangeset is the changeset being staged, nil when there is none
+	openChangeset atomic.Pointer[Changeset]
+)
+
+// ErrNoChangeset is returned for the ID of a changeset that is not open.
+var ErrNoChangeset = errors.New("the changeset is not open")
+
+// OpenChangeset returns the changeset being staged, or nil.
+func OpenChangeset() *Changeset {
+	return openChangeset.Load()
+}
+
+// isStaging tells whether the changes are held back from Xray for a changeset.
+func isStaging() bool {
+	return openChangeset.Load() != nil
+}
+
+// ChangesetService stages changes of the inbounds and their clients and
+// applies them to Xray at once. One changeset is open at a time; while it is,
+// the changes that don't belong to it are rejected by the API.
+type ChangesetService struct {
+	xrayService XrayService
+}
+
+// Begin opens a changeset. It fails while another one is open.
+func (s *ChangesetService) Begin(name string, createdBy string) (*Changeset, error) {
+	changesetLock.Lock()
+	defer changesetLock.Unlock()
+	if open := openChangeset.Load(); open != nil {
+		return nil, common.NewErrorf("changeset %q (%s) is already open", open.Name, open.Id)
+	}
+	snapshot := []*model.Inbound{}
+	if err := database.GetDB().Preload("ClientStats").Find(&snapshot).Error; err != nil {
+		return nil, err
+	}
+	if name == "" {
+		name = time.Now().Format("2006-01-02 15:04:05")
+	}
+	changeset := &Changeset{
+		Id:        random.Seq(12),
+		Name:      name,
+		CreatedBy: createdBy,
+		CreatedAt: time.Now().UnixMilli(),
+		snapshot:  snapshot,
+	}
+	openChangeset.Store(changeset)
+	logger.Infof("Changeset %q (%s) begun by %s", changeset.Name, changeset.Id, createdBy)
+	return changeset, nil
+}
+
+// get returns the open changeset if it has the ID id.
+func (s *ChangesetService) get(id string) (*Changeset, error) {
+	changeset := openChangeset.Load()
+	if changeset == nil || changeset.Id != id {
+		return nil, ErrNoChangeset
+	}
+	return changeset, nil
+}
+
+// Diff returns the config the changeset would apply, compared to the one Xray
+// runs with, and whether Xray takes it.
+func (s *ChangesetService) Diff(id string) (*XrayConfigPreview, error) {
+	if _, err := s.get(id); err != nil {
+		return nil, err
+	}
+	return s.xrayService.PreviewXrayConfig()
+}
+
+// Commit applies the changeset by restarting Xray once. If Xray rejects the
+// config, or isn't healthy after the restart, the changes of the changeset are
+// rolled back in the database and Xray keeps the config it had.
+func (s *ChangesetService) Commit(id string) (*ChangesetResult, error) {
+	changesetLock.Lock()
+	defer changesetLock.Unlock()
+	changeset, err := s.get(id)
+	if err != nil {
+		return nil, err
+	}
+	result := &ChangesetResult{Changeset: changeset}
+
+	preview, err := s.xrayService.PreviewXrayConfig()
+	if err != nil {
+		return nil, err
+	}
+	result.Preview = preview
+	if !preview.Test.Ok && !preview.Test.Skipped {
+		err = common.NewErrorf("xray rejected the config: %s", preview.Test.Error)
+		return s.rollBack(changeset, result, err, false)
+	}
+
+	openChangeset.Store(nil)
+	if !s.xrayService.IsXrayRunning() {
+		// Applied the next time Xray starts
+		logger.Infof("Changeset %q (%s) committed, xray is not running", changeset.Name, changeset.Id)
+		return result, nil
+	}
+	s.xrayService.IsNeedRestartAndSetFalse()
+	// A commit that leaves the config as Xray runs it keeps Xray running
+	if err := s.xrayService.RestartXray(false); err != nil {
+		return s.rollBack(changeset, result, err, true)
+	}
+	if err := s.checkHealth(); err != nil {
+		return s.rollBack(changeset, result, err, true)
+	}
+	result.Applied = true
+	logger.Infof("Changeset %q (%s) committed", changeset.Name, changeset.Id)
+	return result, nil
+}
+
+// checkHealth waits for the API of the restarted Xray to answer.
+func (s *ChangesetService) checkHealth() error {
+	deadline := time.Now().Add(changesetHealthTimeout)
+	for {
+		err := errors.New("xray is not running")
+		if s.xrayService.IsXrayRunning() {
+			if err = s.xrayService.PingXrayAPI(time.Second); err == nil {
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// rollBack undoes the changes of a changeset that failed to apply with cause,
+// and if restart, brings Xray back to the config of the database.
+func (s *ChangesetService) rollBack(changeset *Changeset, result *ChangesetResult, cause error, restart bool) (*ChangesetResult, error) {
+	logger.Warningf("Changeset %q (%s) failed, rolling it back: %v", changeset.Name, changeset.Id, cause)
+	result.Error = cause.Error()
+	if err := changeset.restore(); err != nil {
+		openChangeset.CompareAndSwap(changeset, nil)
+		return result, common.NewErrorf("%v; rolling back the changeset failed: %v", cause, err)
+	}
+	openChangeset.CompareAndSwap(changeset, nil)
+	result.RolledBack = true
+	if restart {
+		if err := s.xrayService.RestartXray(false); err != nil {
+			logger.Warning("Restart xray after the rollback of the changeset failed:", err)
+		}
+	}
+	return result, cause
+}
+
+// Discard rolls back the changes of the changeset and closes it. Xray never
+// had them.
+func (s *ChangesetService) Discard(id string) error {
+	changesetLock.Lock()
+	defer changesetLock.Unlock()
+	changeset, err := s.get(id)
+	if err != nil {
+		return err
+	}
+	if err := changeset.restore(); err != nil {
+		return err
+	}
+	openChangeset.Store(nil)
+	logger.Infof("Changeset %q (%s) discarded", changeset.Name, changeset.Id)
+	// The changes made meanwhile outside of the inbounds, like settings, still
+	// need a restart; the discarded ones don't
+	s.xrayService.IsNeedRestartAndSetFalse()
+	if s.xrayService.IsXrayRunning() {
+		if err := s.xrayService.RestartXray(false); err != nil {
+			logger.Warning("Restart xray after discarding the changeset failed:", err)
+		}
+	}
+	return nil
+}
+
+// restore puts the inbounds and the traffic of their clients back as they were
+// when the changeset began: the inbounds it added are deleted, the ones it
+// deleted are added back, and the trash entries of its deletions are removed.
+// The traffic counted meanwhile is kept.
+func (c *Changeset) restore() error {
+	return database.GetDB().Transaction(func(tx *gorm.DB) error {
+		ids := make([]int, 0, len(c.snapshot))
+		emails := make([]string, 0)
+		for _, inbound := range c.snapshot {
+			ids = append(ids, inbound.Id)
+			for _, traffic := range inbound.ClientStats {
+				emails = append(emails, traffic.Email)
+			}
+		}
+
+		added := tx.Model(&model.Inbound{})
+		if len(ids) > 0 {
+			added = added.Where("id NOT IN ?", ids)
+		}
+		var addedIds []int
+		if err := added.Pluck("id", &addedIds).Error; err != nil {
+			return err
+		}
+		if len(addedIds) > 0 {
+			if err := tx.Where("inbound_id IN ?", addedIds).Delete(&xray.ClientTraffic{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("id IN ?", addedIds).Delete(&model.Inbound{}).Error; err != nil {
+				return err
+			}
+		}
+		addedClients := tx.Where("id > 0")
+		if len(emails) > 0 {
+			addedClients = tx.Where("email NOT IN ?", emails)
+		}
+		if err := addedClients.Delete(&xray.ClientTraffic{}).Error; err != nil {
+			return err
+		}
+
+		for _, inbound := range c.snapshot {
+			var count int64
+			if err := tx.Model(&model.Inbound{}).Where("id = ?", inbound.Id).Count(&count).Error; err != nil {
+				return err
+			}
+			if count > 0 {
+				err := tx.Model(&model.Inbound{}).Where("id = ?", inbound.Id).Select(inboundConfigColumns).Updates(inbound).Error
+				if err != nil {
+					return err
+				}
+			} else if err := tx.Omit("ClientStats").Create(inbound).Error; err != nil {
+				return err
+			}
+			for _, traffic := range inbound.ClientStats {
+				if err := tx.Model(&xray.ClientTraffic{}).Where("email = ?", traffic.Email).Count(&count).Error; err != nil {
+					return err
+				}
+				if count > 0 {
+					err := tx.Model(&xray.ClientTraffic{}).Where("email = ?", traffic.Email).Select(clientConfigColumns).Updates(&traffic).Error
+					if err != nil {
+						return err
+					}
+					continue
+				}
+				traffic.Id = 0
+				if err := tx.Create(&traffic).Error; err != nil {
+					return err
+				}
+			}
+		}
+		return tx.Where("deleted_at >= ?", c.CreatedAt).Delete(&model.TrashEntry{}).Error
+	})
+}
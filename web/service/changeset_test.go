@@ -0,0 +1,223 @@
+package service
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/xray"
+
+	"gorm.io/gorm"
+)
+
+// changesetTestDB opens a database with two inbounds of a client each, the
+// first one having counted traffic, and returns them.
+func changesetTestDB(t *testing.T) []*model.Inbound {
+	t.Helper()
+	inbounds := []*model.Inbound{
+		{Remark: "kept", Enable: true, Port: 20011, Protocol: model.Trojan, Tag: "inbound-20011",
+			Settings: `{"clients":[{"password":"p1","email":"kept-1","enable":true}]}`},
+		{Remark: "deleted", Enable: true, Port: 20012, Protocol: model.Trojan, Tag: "inbound-20012",
+			Settings: `{"clients":[{"password":"p2","email":"deleted-1","enable":true}]}`},
+	}
+	newTestDB(t, seedInbounds(inbounds...), func(db *gorm.DB) error {
+		traffics := []xray.ClientTraffic{
+			{InboundId: inbounds[0].Id, Enable: true, Email: "kept-1", Total: 1000, Up: 10, Down: 20},
+			{InboundId: inbounds[1].Id, Enable: true, Email: "deleted-1", Total: 1000},
+		}
+		return db.Create(&traffics).Error
+	})
+	t.Cleanup(func() { openChangeset.Store(nil) })
+	return inbounds
+}
+
+// stageChanges makes in the database the changes of a changeset: it edits the
+// first inbound and its client, deletes the second one to the trash and adds a
+// third one.
+func stageChanges(t *testing.T, inbounds []*model.Inbound) {
+	t.Helper()
+	var s InboundService
+	db := database.GetDB()
+	edited := *inbounds[0]
+	edited.Remark = "edited"
+	edited.Port = 20021
+	if _, _, err := s.UpdateInbound(&edited); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Model(&xray.ClientTraffic{}).Where("email = ?", "kept-1").Updates(map[string]any{"total": 5000, "enable": false}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.DelInbound(inbounds[1].Id); err != nil {
+		t.Fatal(err)
+	}
+	trash := &model.TrashEntry{Kind: "inbound", InboundId: inbounds[1].Id, Remark: "deleted", Port: 20012, DeletedAt: time.Now().UnixMilli()}
+	if err := db.Create(trash).Error; err != nil {
+		t.Fatal(err)
+	}
+	added := &model.Inbound{
+		Remark: "added", Enable: true, Port: 20013, Protocol: model.Trojan, Tag: "inbound-20013",
+		Settings: `{"clients":[{"password":"p3","email":"added-1","enable":true}]}`,
+	}
+	if _, _, err := s.AddInbound(added); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChangesetDiscard(t *testing.T) {
+	inbounds := changesetTestDB(t)
+	// An older trash entry isn't part of the changeset
+	db := database.GetDB()
+	if err := db.Create(&model.TrashEntry{Kind: "client", Email: "old", DeletedAt: time.Now().Add(-time.Hour).UnixMilli()}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	var s ChangesetService
+	changeset, err := s.Begin("reseller", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if OpenChangeset() != changeset || changeset.Name != "reseller" || changeset.CreatedBy != "admin" {
+		t.Fatalf("the changeset begun is %+v", changeset)
+	}
+	if _, err := s.Begin("second", "admin"); err == nil {
+		t.Error("a second changeset was begun while one is open")
+	}
+	stageChanges(t, inbounds)
+	// The traffic counted meanwhile is kept by the rollback
+	if err := db.Model(&xray.ClientTraffic{}).Where("email = ?", "kept-1").Updates(map[string]any{"up": 110, "down": 220}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Discard("other"); !errors.Is(err, ErrNoChangeset) {
+		t.Errorf("discarding another changeset returned %v", err)
+	}
+	if err := s.Discard(changeset.Id); err != nil {
+		t.Fatal(err)
+	}
+	if OpenChangeset() != nil {
+		t.Error("the discarded changeset is still open")
+	}
+
+	var restored []*model.Inbound
+	if err := db.Preload("ClientStats").Order("id").Find(&restored).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(restored) != 2 {
+		t.Fatalf("%d inbounds after the rollback, want 2", len(restored))
+	}
+	for i, inbound := range restored {
+		want := inbounds[i]
+		if inbound.Id != want.Id || inbound.Remark != want.Remark || inbound.Port != want.Port || inbound.Tag != want.Tag || inbound.Settings != want.Settings {
+			t.Errorf("the inbound %d is restored as %+v", want.Id, inbound)
+		}
+		if len(inbound.ClientStats) != 1 {
+			t.Errorf("the inbound %q has the clients %+v", inbound.Remark, inbound.ClientStats)
+		}
+	}
+	kept := clientTraffic(t, "kept-1")
+	if kept.Total != 1000 || !kept.Enable || kept.Up != 110 || kept.Down != 220 {
+		t.Errorf("the client is restored as %+v", kept)
+	}
+	if deleted := clientTraffic(t, "deleted-1"); deleted.InboundId != inbounds[1].Id || deleted.Total != 1000 {
+		t.Errorf("the client of the deleted inbound is restored as %+v", deleted)
+	}
+	var count int64
+	db.Model(&xray.ClientTraffic{}).Where("email = ?", "added-1").Count(&count)
+	if count != 0 {
+		t.Error("the client of the added inbound is left")
+	}
+	var trash []model.TrashEntry
+	db.Find(&trash)
+	if len(trash) != 1 || trash[0].Email != "old" {
+		t.Errorf("the trash is %+v, want the older entry only", trash)
+	}
+}
+
+func TestChangesetCommit(t *testing.T) {
+	inbounds := changesetTestDB(t)
+	var s ChangesetService
+	changeset, err := s.Begin("reseller", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stageChanges(t, inbounds)
+
+	for _, id := range []string{"", "other"} {
+		if _, err := s.Diff(id); !errors.Is(err, ErrNoChangeset) {
+			t.Errorf("the diff of %q returned %v", id, err)
+		}
+		if _, err := s.Commit(id); !errors.Is(err, ErrNoChangeset) {
+			t.Errorf("committing %q returned %v", id, err)
+		}
+	}
+	if OpenChangeset() != changeset {
+		t.Fatal("the changeset was closed by a wrong ID")
+	}
+
+	// The preview has the staged inbounds, all of the config is new without a
+	// running Xray
+	preview, err := s.Diff(changeset.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := []string{}
+	for _, inbound := range preview.Config.InboundConfigs {
+		tags = append(tags, inbound.Tag)
+	}
+	if !slices.Contains(tags, "inbound-20021") || !slices.Contains(tags, "inbound-20013") || slices.Contains(tags, "inbound-20012") {
+		t.Errorf("the staged config has the inbounds %v", tags)
+	}
+	if preview.Running || !slices.Contains(preview.Diff.Added, "inbounds") {
+		t.Errorf("the diff with Xray stopped is %+v", preview.Diff)
+	}
+
+	result, err := s.Commit(changeset.Id)
+	if preview.Test.Ok || preview.Test.Skipped {
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Xray isn't running, the changes are applied when it starts
+		if result.Applied || result.RolledBack || OpenChangeset() != nil {
+			t.Errorf("the commit is %+v", result)
+		}
+		var count int64
+		database.GetDB().Model(&model.Inbound{}).Count(&count)
+		if count != 2 {
+			t.Errorf("%d inbounds after the commit, want 2", count)
+		}
+	} else if err == nil || !result.RolledBack {
+		t.Errorf("the config Xray rejects was committed: %+v", result)
+	}
+	if _, err := s.Commit(changeset.Id); !errors.Is(err, ErrNoChangeset) {
+		t.Errorf("committing twice returned %v", err)
+	}
+}
+
+func TestChangesetStaging(t *testing.T) {
+	changesetTestDB(t)
+	var inboundService InboundService
+	var s ChangesetService
+	changeset, err := s.Begin("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := time.ParseInLocation("2006-01-02 15:04:05", changeset.Name, time.Local); err != nil {
+		t.Errorf("the changeset without a name is named %q", changeset.Name)
+	}
+	// The staged changes are not pushed through the API of Xray
+	if err := inboundService.initXrayAPI(); err == nil {
+		t.Error("the API of Xray is used while a changeset is open")
+	}
+	if users, err := (&XrayService{}).CheckXrayUsers(); users != nil || err != nil {
+		t.Errorf("the users of Xray are checked while a changeset is open: %v, %v", users, err)
+	}
+	if err := s.Discard(changeset.Id); err != nil {
+		t.Fatal(err)
+	}
+	if isStaging() {
+		t.Error("staging after the changeset was discarded")
+	}
+}
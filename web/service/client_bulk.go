@@ -0,0 +1,889 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"math/big"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/util/common"
+	"x-ui/xray"
+
+	"github.com/goccy/go-json"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	BulkSubIdShared = "shared"
+	BulkSubIdClient = "client"
+)
+
+// bulkEmailNumber is the placeholder for the number in a bulk email pattern,
+// "{n}" or zero padded to a width like "{n:3}"
+var bulkEmailNumber = regexp.MustCompile(`\{n(?::(\d+))?\}`)
+
+// BulkClients describes a batch of clients with the same limits.
+type BulkClients struct {
+	Count int `json:"count" form:"count"`
+	// Email is the email pattern, e.g. "trial-{n:3}"; without a placeholder the
+	// number is appended
+	Email string `json:"email" form:"email"`
+	// Start is the number of the first client, 1 if not set
+	Start int `json:"start" form:"start"`
+	// TotalGB is the traffic limit in gigabytes, 0 for unlimited
+	TotalGB float64 `json:"totalGB" form:"totalGB"`
+	// ExpiryTime is in unix milliseconds, negative for the validity after the
+	// first use, like for a single client
+	ExpiryTime int64  `json:"expiryTime" form:"expiryTime"`
+	Flow       string `json:"flow" form:"flow"`
+	LimitIP    int    `json:"limitIp" form:"limitIp"`
+	TgID       int64  `json:"tgId" form:"tgId"`
+	Comment    string `json:"comment" form:"comment"`
+	Reset      int    `json:"reset" form:"reset"`
+	// SubIdMode is BulkSubIdShared for one subscription for the whole batch, or
+	// BulkSubIdClient for a subscription per client
+	SubIdMode string `json:"subIdMode" form:"subIdMode"`
+	// SubId is the shared subscription ID, generated if empty
+	SubId string   `json:"subId" form:"subId"`
+	Tags  []string `json:"tags" form:"tags"`
+}
+
+// BulkClientError tells which client of a batch failed; nothing of the batch
+// was saved.
+type BulkClientError struct {
+	Index int
+	Email string
+	Err   error
+}
+
+func (e *BulkClientError) Error() string {
+	return fmt.Sprintf("client %d (%s): %v", e.Index, e.Email, e.Err)
+}
+
+func (e *BulkClientError) Unwrap() error {
+	return e.Err
+}
+
+func randomLowerAndNum(length int) string {
+	const charset = "abcdefghijklmnopqrstuvwxyz0123456789"
+	bytes := make([]byte, length)
+	for i := range bytes {
+		index, _ := rand.Int(rand.Reader, big.NewInt(int64(len(charset))))
+		bytes[i] = charset[index.Int64()]
+	}
+	return string(bytes)
+}
+
+// randomShadowsocksPassword returns a key of the length the method needs.
+func randomShadowsocksPassword(method string) string {
+	length := 32
+	if method == "2022-blake3-aes-128-gcm" {
+		length = 16
+	}
+	key := make([]byte, length)
+	if _, err := rand.Read(key); err != nil {
+		return randomLowerAndNum(32)
+	}
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func (b *BulkClients) email(number int) string {
+	pattern := b.Email
+	if !bulkEmailNumber.MatchString(pattern) {
+		pattern += "{n}"
+	}
+	return bulkEmailNumber.ReplaceAllStringFunc(pattern, func(placeholder string) string {
+		width, _ := strconv.Atoi(bulkEmailNumber.FindStringSubmatch(placeholder)[1])
+		return fmt.Sprintf("%0*d", width, number)
+	})
+}
+
+// clients generates the clients of the batch with fresh credentials.
+func (b *BulkClients) clients(inbound *model.Inbound) ([]model.Client, error) {
+	switch b.SubIdMode {
+	case "", BulkSubIdShared, BulkSubIdClient:
+	default:
+		return nil, common.NewError("unknown subId mode:", b.SubIdMode)
+	}
+	if b.TotalGB < 0 || b.LimitIP < 0 || b.Reset < 0 {
+		return nil, common.NewError("limits must not be negative")
+	}
+	tags, err := NormalizeTags(b.Tags)
+	if err != nil {
+		return nil, err
+	}
+	start := b.Start
+	if start == 0 {
+		start = 1
+	}
+	subId := b.SubId
+	if subId == "" {
+		subId = randomLowerAndNum(16)
+	}
+	method := ""
+	if inbound.Protocol == model.Shadowsocks {
+		settings := map[string]any{}
+		json.Unmarshal([]byte(inbound.Settings), &settings)
+		method, _ = settings["method"].(string)
+	}
+
+	clients := make([]model.Client, b.Count)
+	for i := range clients {
+		client := &clients[i]
+		client.Email = b.email(start + i)
+		client.TotalGB = int64(b.TotalGB * (1 << 30))
+		client.ExpiryTime = b.ExpiryTime
+		client.LimitIP = b.LimitIP
+		client.Enable = true
+		client.TgID = b.TgID
+		client.Comment = b.Comment
+		client.Reset = b.Reset
+		client.Tags = tags
+		client.SubID = subId
+		if b.SubIdMode == BulkSubIdClient {
+			client.SubID = randomLowerAndNum(16)
+		}
+		switch inbound.Protocol {
+		case model.VMESS:
+			client.ID = uuid.New().String()
+			client.Security = "auto"
+		case model.VLESS:
+			client.ID = uuid.New().String()
+			client.Flow = b.Flow
+		case model.Trojan:
+			client.Password = randomLowerAndNum(10)
+		case model.Shadowsocks:
+			client.Password = randomShadowsocksPassword(method)
+		case model.WireGuard:
+			// The addresses are given out as the clients are added
+			var err error
+			if client.PrivateKey, client.PublicKey, err = newWireguardKeyPair(); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, common.NewError("inbound protocol has no clients:", inbound.Protocol)
+		}
+	}
+	return clients, nil
+}
+
+// bulkClientJSON returns the fields the panel stores for a client of protocol.
+func bulkClientJSON(protocol model.Protocol, client *model.Client) map[string]any {
+	data := map[string]any{
+		"email":      client.Email,
+		"limitIp":    client.LimitIP,
+		"totalGB":    client.TotalGB,
+		"expiryTime": client.ExpiryTime,
+		"enable":     client.Enable,
+		"tgId":       client.TgID,
+		"subId":      client.SubID,
+		"comment":    client.Comment,
+		"reset":      client.Reset,
+	}
+	if len(client.Tags) > 0 {
+		data["tags"] = client.Tags
+	}
+	switch protocol {
+	case model.VMESS:
+		data["id"] = client.ID
+		data["security"] = client.Security
+	case model.VLESS:
+		data["id"] = client.ID
+		data["flow"] = client.Flow
+	case model.Trojan:
+		data["password"] = client.Password
+	case model.Shadowsocks:
+		data["method"] = ""
+		data["password"] = client.Password
+	case model.WireGuard:
+		data["privateKey"] = client.PrivateKey
+		data["publicKey"] = client.PublicKey
+		if len(client.AllowedIPs) > 0 {
+			data["allowedIPs"] = client.AllowedIPs
+		}
+	}
+	return data
+}
+
+// NewClient returns an enabled client of inbound with email, fresh credentials,
+// a quota of totalGB and the expiry expiryTime, and the settings that add it
+// with AddInboundClient.
+func NewClient(inbound *model.Inbound, email string, totalGB float64, expiryTime int64) (*model.Client, string, error) {
+	batch := &BulkClients{Count: 1, TotalGB: totalGB, ExpiryTime: expiryTime}
+	clients, err := batch.clients(inbound)
+	if err != nil {
+		return nil, "", err
+	}
+	client := &clients[0]
+	client.Email = email
+	settings, err := json.Marshal(map[string][]any{"clients": {bulkClientJSON(inbound.Protocol, client)}})
+	return client, string(settings), err
+}
+
+// CheckNewClients returns why clients can't be added to inbound, the way
+// AddInboundClient checks them, or nil.
+func (s *InboundService) CheckNewClients(inbound *model.Inbound, clients []model.Client) error {
+	if _, err := s.checkClientEmails(clients, nil); err != nil {
+		return err
+	}
+	if err := checkClientIds(inbound.Protocol, clients); err != nil {
+		return err
+	}
+	if _, err := checkClientFlows(inbound, clients); err != nil {
+		return err
+	}
+	_, err := checkShadowsocksKeys(inbound, clients)
+	return err
+}
+
+// AddBulkClients creates the clients of bulk on an inbound in one transaction,
+// at most maxCount of them. If one of them can't be added, the whole batch is
+// rolled back and a *BulkClientError names it. Xray has to be restarted after.
+func (s *InboundService) AddBulkClients(inboundId int, bulk *BulkClients, maxCount int) ([]model.Client, error) {
+	if bulk.Count < 1 || bulk.Count > maxCount {
+		return nil, common.NewErrorf("the number of clients must be between 1 and %d", maxCount)
+	}
+
+	unlock := s.lockInbound(inboundId)
+	defer unlock()
+
+	inbound, err := s.GetInbound(inboundId)
+	if err != nil {
+		return nil, err
+	}
+	clients, err := bulk.clients(inbound)
+	if err != nil {
+		return nil, err
+	}
+
+	if i, err := s.checkClientEmails(clients, nil); err != nil {
+		if i < 0 {
+			return nil, err
+		}
+		return nil, &BulkClientError{Index: i, Email: clients[i].Email, Err: err}
+	}
+	if i, err := checkClientFlows(inbound, clients); err != nil {
+		return nil, &BulkClientError{Index: i, Email: clients[i].Email, Err: err}
+	}
+	if i, err := checkShadowsocksKeys(inbound, clients); err != nil {
+		if i < 0 {
+			return nil, err
+		}
+		return nil, &BulkClientError{Index: i, Email: clients[i].Email, Err: err}
+	}
+
+	var settings map[string]any
+	if err := json.Unmarshal([]byte(inbound.Settings), &settings); err != nil {
+		return nil, err
+	}
+	inboundClients, _ := settings["clients"].([]any)
+	added := make([]any, 0, len(clients))
+	for i := range clients {
+		added = append(added, bulkClientJSON(inbound.Protocol, &clients[i]))
+	}
+	if inbound.Protocol == model.WireGuard {
+		subnet, err := wireguardSubnet(settings)
+		if err != nil {
+			return nil, err
+		}
+		if err := fillWireguardPeers(added, subnet, inboundClients); err != nil {
+			return nil, err
+		}
+		for i := range clients {
+			clients[i].AllowedIPs, _ = added[i].(map[string]any)["allowedIPs"].([]string)
+		}
+	}
+	before := limitedClients(inboundClients)
+	settings["clients"] = append(inboundClients, added...)
+	if err := checkInboundLimits(inbound, before, append(before, limitedClients(added)...), time.Now().UnixMilli()); err != nil {
+		s.limitRejected(err)
+		return nil, err
+	}
+	newSettings, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	inbound.Settings = string(newSettings)
+
+	err = database.Transaction(func(tx *gorm.DB) error {
+		for i := range clients {
+			if err := s.AddClientStat(tx, inbound.Id, &clients[i]); err != nil {
+				return &BulkClientError{Index: i, Email: clients[i].Email, Err: err}
+			}
+		}
+		return tx.Omit("ClientStats").Save(inbound).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return clients, nil
+}
+
+// ClientRef identifies a client by its inbound and email, by its email alone or
+// by its UUID.
+type ClientRef struct {
+	InboundId int    `json:"inboundId"`
+	Email     string `json:"email"`
+	Id        string `json:"id"`
+}
+
+// ClientPatch holds the changes of a bulk update; unset fields are kept.
+type ClientPatch struct {
+	// ExpiryTime replaces the expiry, in unix milliseconds
+	ExpiryTime *int64 `json:"expiryTime"`
+	// ExpiryDate replaces the expiry with the end of a date, "2006-01-02", in
+	// the panel time zone
+	ExpiryDate string `json:"expiryDate"`
+	// ExtendDays moves the expiry by whole days, counted from now for clients
+	// that expired already; clients without expiry keep none
+	ExtendDays int `json:"extendDays"`
+	// TotalGB replaces the traffic limit, in gigabytes
+	TotalGB *float64 `json:"totalGB"`
+	// AddGB raises the traffic limit of clients that have one
+	AddGB        float64  `json:"addGB"`
+	ResetTraffic bool     `json:"resetTraffic"`
+	Enable       *bool    `json:"enable"`
+	LimitIP      *int     `json:"limitIp"`
+	AddTags      []string `json:"addTags"`
+	RemoveTags   []string `json:"removeTags"`
+	// ExcludeFromSub leaves the clients out of their subscriptions, or puts
+	// them back
+	ExcludeFromSub *bool `json:"excludeFromSub"`
+	// OutboundTag sends the clients to the outbound with the tag, or back to
+	// the routing rules if empty
+	OutboundTag *string `json:"outboundTag"`
+}
+
+func (p *ClientPatch) validate() error {
+	if p.ExpiryDate != "" {
+		if p.ExpiryTime != nil {
+			return common.NewError("expiryTime and expiryDate can't be used together")
+		}
+		expiryTime, err := EndOfDay(p.ExpiryDate, panelLocation())
+		if err != nil {
+			return err
+		}
+		p.ExpiryTime = &expiryTime
+		p.ExpiryDate = ""
+	}
+	if p.ExpiryTime != nil && p.ExtendDays != 0 {
+		return common.NewError("expiryTime and extendDays can't be used together")
+	}
+	if p.TotalGB != nil && p.AddGB != 0 {
+		return common.NewError("totalGB and addGB can't be used together")
+	}
+	if p.TotalGB != nil && *p.TotalGB < 0 || p.AddGB < 0 || p.LimitIP != nil && *p.LimitIP < 0 {
+		return common.NewError("limits must not be negative")
+	}
+	var err error
+	if p.AddTags, err = NormalizeTags(p.AddTags); err != nil {
+		return err
+	}
+	if p.RemoveTags, err = NormalizeTags(p.RemoveTags); err != nil {
+		return err
+	}
+	if p.ExpiryTime == nil && p.ExtendDays == 0 && p.TotalGB == nil && p.AddGB == 0 &&
+		!p.ResetTraffic && p.Enable == nil && p.LimitIP == nil && len(p.AddTags) == 0 && len(p.RemoveTags) == 0 &&
+		p.ExcludeFromSub == nil && p.OutboundTag == nil {
+		return common.NewError("nothing to update")
+	}
+	if p.OutboundTag != nil {
+		tag := strings.TrimSpace(*p.OutboundTag)
+		p.OutboundTag = &tag
+	}
+	return nil
+}
+
+// apply changes the client as stored in the inbound settings.
+func (p *ClientPatch) apply(client map[string]any, now int64) error {
+	const day = int64(24 * time.Hour / time.Millisecond)
+	if p.ExpiryTime != nil {
+		client["expiryTime"] = *p.ExpiryTime
+	}
+	if p.ExtendDays != 0 {
+		expiry := jsonInt64(client["expiryTime"])
+		switch {
+		case expiry > 0:
+			client["expiryTime"] = max(expiry, now) + int64(p.ExtendDays)*day
+		case expiry < 0:
+			// Validity after the first use
+			client["expiryTime"] = expiry - int64(p.ExtendDays)*day
+		}
+	}
+	if p.TotalGB != nil {
+		client["totalGB"] = int64(*p.TotalGB * (1 << 30))
+	}
+	if total := jsonInt64(client["totalGB"]); p.AddGB != 0 && total > 0 {
+		client["totalGB"] = total + int64(p.AddGB*(1<<30))
+	}
+	if p.Enable != nil {
+		client["enable"] = *p.Enable
+	}
+	if p.LimitIP != nil {
+		client["limitIp"] = *p.LimitIP
+	}
+	if p.ExcludeFromSub != nil {
+		client["excludeFromSub"] = *p.ExcludeFromSub
+	}
+	if p.OutboundTag != nil && *p.OutboundTag == "" {
+		delete(client, "outboundTag")
+	} else if p.OutboundTag != nil {
+		client["outboundTag"] = *p.OutboundTag
+	}
+	if len(p.AddTags) > 0 || len(p.RemoveTags) > 0 {
+		tags := slices.DeleteFunc(append(tagsOf(client), p.AddTags...), func(tag string) bool {
+			return slices.Contains(p.RemoveTags, tag)
+		})
+		tags, err := NormalizeTags(tags)
+		if err != nil {
+			return err
+		}
+		if len(tags) == 0 {
+			delete(client, "tags")
+		} else {
+			client["tags"] = tags
+		}
+	}
+	return nil
+}
+
+// Preview returns client as the patch would leave it at now, without saving it.
+func (p *ClientPatch) Preview(client model.Client, now int64) (model.Client, error) {
+	if err := p.validate(); err != nil {
+		return client, err
+	}
+	data, err := json.Marshal(client)
+	if err != nil {
+		return client, err
+	}
+	fields := map[string]any{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return client, err
+	}
+	if err := p.apply(fields, now); err != nil {
+		return client, err
+	}
+	if data, err = json.Marshal(fields); err != nil {
+		return client, err
+	}
+	patched := model.Client{}
+	err = json.Unmarshal(data, &patched)
+	return patched, err
+}
+
+func jsonInt64(value any) int64 {
+	switch v := value.(type) {
+	case float64:
+		return int64(v)
+	case int64:
+		return v
+	case json.Number:
+		n, _ := v.Int64()
+		return n
+	}
+	return 0
+}
+
+// BulkClientSelection selects the clients of a bulk action.
+type BulkClientSelection struct {
+	Clients []ClientRef `json:"clients"`
+	// Tag selects all clients with the tag, besides Clients
+	Tag string `json:"tag"`
+	// InactiveDays selects all clients inactive for that many days, besides
+	// Clients, as listed by InactiveClients
+	InactiveDays int `json:"inactiveDays"`
+	// Strict fails the whole batch if a client is not found
+	Strict bool `json:"strict"`
+}
+
+// BulkClientUpdate applies one patch to a selection of clients.
+type BulkClientUpdate struct {
+	BulkClientSelection
+	Patch ClientPatch `json:"patch"`
+
+	// commit, if set, runs last in the transaction of the update with its
+	// results, to write what has to be committed along with it
+	commit func(tx *gorm.DB, results []BulkClientResult) error
+}
+
+// BulkClientResult is the outcome for one client of a bulk action, with the
+// values of the client after an update.
+type BulkClientResult struct {
+	InboundId int                `json:"inboundId,omitempty"`
+	Email     string             `json:"email"`
+	Ok        bool               `json:"ok"`
+	Error     string             `json:"error,omitempty"`
+	Client    *BulkClientUpdated `json:"client,omitempty"`
+}
+
+type BulkClientUpdated struct {
+	ExpiryTime     int64    `json:"expiryTime"`
+	TotalGB        int64    `json:"totalGB"`
+	Enable         bool     `json:"enable"`
+	LimitIP        int      `json:"limitIp"`
+	Tags           []string `json:"tags"`
+	ExcludeFromSub bool     `json:"excludeFromSub"`
+	OutboundTag    string   `json:"outboundTag,omitempty"`
+}
+
+// findClient returns the inbound and the email of the client ref points to.
+func findClient(inbounds []*model.Inbound, ref ClientRef) (int, string, bool) {
+	for _, inbound := range inbounds {
+		if ref.InboundId != 0 && inbound.Id != ref.InboundId {
+			continue
+		}
+		settings := map[string][]model.Client{}
+		json.Unmarshal([]byte(inbound.Settings), &settings)
+		for _, client := range settings["clients"] {
+			if ref.Id != "" && client.ID == ref.Id ||
+				ref.Id == "" && ref.Email != "" && strings.EqualFold(client.Email, ref.Email) {
+				return inbound.Id, client.Email, true
+			}
+		}
+	}
+	return 0, "", false
+}
+
+// bulkTargets resolves the clients of a selection, at most maxCount of them. It
+// returns a result for every client, failed if it is not found, and the emails
+// of the found ones per inbound. In strict mode a client that is not found
+// fails with a *BulkClientError.
+func (s *InboundService) bulkTargets(sel *BulkClientSelection, maxCount int) ([]BulkClientResult, map[int]map[string]bool, error) {
+	refs := sel.Clients
+	if sel.Tag != "" {
+		tagged, err := s.clientsByTag(sel.Tag)
+		if err != nil {
+			return nil, nil, err
+		}
+		refs = append(slices.Clone(refs), tagged...)
+	}
+	if sel.InactiveDays != 0 {
+		inactive, err := s.clientsInactive(sel.InactiveDays)
+		if err != nil {
+			return nil, nil, err
+		}
+		refs = append(slices.Clone(refs), inactive...)
+	}
+	if len(refs) == 0 && sel.Tag == "" && sel.InactiveDays == 0 {
+		return nil, nil, common.NewError("no clients selected")
+	}
+	if len(refs) > maxCount {
+		return nil, nil, common.NewErrorf("the number of clients must be between 1 and %d", maxCount)
+	}
+
+	inbounds, err := s.GetAllInbounds()
+	if err != nil {
+		return nil, nil, err
+	}
+	results := make([]BulkClientResult, len(refs))
+	targets := map[int]map[string]bool{}
+	for i, ref := range refs {
+		inboundId, email, found := findClient(inbounds, ref)
+		if !found {
+			if sel.Strict {
+				return nil, nil, &BulkClientError{Index: i, Email: ref.Email, Err: common.NewError("client not found")}
+			}
+			results[i] = BulkClientResult{InboundId: ref.InboundId, Email: ref.Email, Error: "client not found"}
+			continue
+		}
+		results[i] = BulkClientResult{InboundId: inboundId, Email: email}
+		if targets[inboundId] == nil {
+			targets[inboundId] = map[string]bool{}
+		}
+		targets[inboundId][email] = true
+	}
+	return results, targets, nil
+}
+
+// lockInbounds locks the inbounds of targets in the order of their IDs, so that
+// bulk actions don't deadlock each other. It returns the IDs in that order and
+// the function to unlock them.
+func (s *InboundService) lockInbounds(targets map[int]map[string]bool) ([]int, func()) {
+	ids := make([]int, 0, len(targets))
+	for id := range targets {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	unlocks := make([]func(), len(ids))
+	for i, id := range ids {
+		unlocks[i] = s.lockInbound(id)
+	}
+	return ids, func() {
+		for _, unlock := range unlocks {
+			unlock()
+		}
+	}
+}
+
+// UpdateBulkClients applies the patch of update to its clients, at most
+// maxCount of them, in one transaction. A client that is not found is reported
+// in its result, or fails the whole batch with a *BulkClientError in strict
+// mode. It returns whether something changed and Xray has to be restarted.
+func (s *InboundService) UpdateBulkClients(update *BulkClientUpdate, maxCount int) ([]BulkClientResult, bool, error) {
+	if err := update.Patch.validate(); err != nil {
+		return nil, false, err
+	}
+	if tag := update.Patch.OutboundTag; tag != nil && *tag != "" {
+		if err := checkClientOutbounds([]string{*tag}); err != nil {
+			return nil, false, err
+		}
+	}
+	results, targets, err := s.bulkTargets(&update.BulkClientSelection, maxCount)
+	if err != nil || len(targets) == 0 {
+		return results, false, err
+	}
+	if update.Patch.ResetTraffic {
+		// The traffic counted before the reset is written first, not added after it
+		if err := s.FlushTraffic(); err != nil {
+			return nil, false, err
+		}
+	}
+	ids, unlock := s.lockInbounds(targets)
+	defer unlock()
+
+	now := time.Now().UnixMilli()
+	updated := map[string]map[string]any{}
+	err = database.Transaction(func(tx *gorm.DB) error {
+		for _, id := range ids {
+			inbound := &model.Inbound{}
+			if err := tx.Model(model.Inbound{}).First(inbound, id).Error; err != nil {
+				return err
+			}
+			var settings map[string]any
+			if err := json.Unmarshal([]byte(inbound.Settings), &settings); err != nil {
+				return err
+			}
+			clients, _ := settings["clients"].([]any)
+			before := limitedClients(clients)
+			for _, item := range clients {
+				client, _ := item.(map[string]any)
+				email, _ := client["email"].(string)
+				if !targets[id][email] {
+					continue
+				}
+				if err := update.Patch.apply(client, now); err != nil {
+					return common.NewErrorf("%s: %v", email, err)
+				}
+				updated[email] = client
+
+				enable, ok := client["enable"].(bool)
+				traffic := savedColumns(quotaColumns(map[string]any{
+					"expiry_time": jsonInt64(client["expiryTime"]),
+					"tags":        tagColumn(tagsOf(client)),
+				}, jsonInt64(client["totalGB"])), &model.Client{Enable: enable || !ok})
+				if update.Patch.ResetTraffic {
+					traffic["up"], traffic["down"] = 0, 0
+				}
+				if err := tx.Model(xray.ClientTraffic{}).Where("email = ?", email).Updates(traffic).Error; err != nil {
+					return err
+				}
+			}
+			if err := checkInboundLimits(inbound, before, limitedClients(clients), now); err != nil {
+				return err
+			}
+			newSettings, err := json.MarshalIndent(settings, "", "  ")
+			if err != nil {
+				return err
+			}
+			if err := tx.Model(model.Inbound{}).Where("id = ?", id).Update("settings", string(newSettings)).Error; err != nil {
+				return err
+			}
+		}
+		bulkUpdated(results, updated)
+		if update.commit != nil {
+			return update.commit(tx, results)
+		}
+		return nil
+	})
+	if err != nil {
+		s.limitRejected(err)
+		return nil, false, err
+	}
+	return results, true, nil
+}
+
+// bulkUpdated fills results with the values of the updated clients, by email.
+func bulkUpdated(results []BulkClientResult, updated map[string]map[string]any) {
+	for i := range results {
+		client, ok := updated[results[i].Email]
+		if !ok {
+			if results[i].Error == "" {
+				results[i].Error = "client not found"
+			}
+			continue
+		}
+		enable, _ := client["enable"].(bool)
+		excludeFromSub, _ := client["excludeFromSub"].(bool)
+		outboundTag, _ := client["outboundTag"].(string)
+		results[i].Ok = true
+		results[i].Client = &BulkClientUpdated{
+			ExpiryTime:     jsonInt64(client["expiryTime"]),
+			TotalGB:        jsonInt64(client["totalGB"]),
+			Enable:         enable,
+			LimitIP:        int(jsonInt64(client["limitIp"])),
+			Tags:           tagsOf(client),
+			ExcludeFromSub: excludeFromSub,
+			OutboundTag:    outboundTag,
+		}
+	}
+}
+
+// DelBulkClients deletes a selection of clients, at most maxCount of them, in
+// one transaction. Clients that are not found, or that are the last ones of
+// their inbound, are reported in their results and kept; in strict mode they
+// fail the whole batch with a *BulkClientError. Unless permanent, the deleted
+// clients go to the trash as deleted by actor. It returns whether something
+// changed and Xray has to be restarted.
+func (s *InboundService) DelBulkClients(sel *BulkClientSelection, maxCount int, actor string, permanent bool) ([]BulkClientResult, bool, error) {
+	results, targets, err := s.bulkTargets(sel, maxCount)
+	if err != nil || len(targets) == 0 {
+		return results, false, err
+	}
+	ids, unlock := s.lockInbounds(targets)
+	defer unlock()
+
+	deleted := map[string]bool{}
+	// Inbounds that would be left without clients
+	kept := map[int]bool{}
+	err = database.Transaction(func(tx *gorm.DB) error {
+		for _, id := range ids {
+			inbound := &model.Inbound{}
+			if err := tx.Model(model.Inbound{}).First(inbound, id).Error; err != nil {
+				return err
+			}
+			var settings map[string]any
+			if err := json.Unmarshal([]byte(inbound.Settings), &settings); err != nil {
+				return err
+			}
+			clients, _ := settings["clients"].([]any)
+			remaining := make([]any, 0, len(clients))
+			var emails []string
+			var removed []map[string]any
+			for _, item := range clients {
+				client, _ := item.(map[string]any)
+				email, _ := client["email"].(string)
+				if targets[id][email] {
+					emails = append(emails, email)
+					removed = append(removed, client)
+				} else {
+					remaining = append(remaining, item)
+				}
+			}
+			if len(remaining) == 0 {
+				if sel.Strict {
+					index := slices.IndexFunc(results, func(r BulkClientResult) bool { return r.InboundId == id })
+					return &BulkClientError{Index: index, Email: results[index].Email, Err: common.NewError("no client remained in Inbound")}
+				}
+				kept[id] = true
+				continue
+			}
+
+			settings["clients"] = remaining
+			newSettings, err := json.MarshalIndent(settings, "", "  ")
+			if err != nil {
+				return err
+			}
+			if err := tx.Model(model.Inbound{}).Where("id = ?", id).Update("settings", string(newSettings)).Error; err != nil {
+				return err
+			}
+			for i, email := range emails {
+				if !permanent {
+					if _, err := s.trashClient(tx, inbound, removed[i], email, actor); err != nil {
+						return err
+					}
+				}
+				if err := s.DelClientStat(tx, email); err != nil {
+					return err
+				}
+				if err := s.DelClientIPs(tx, email); err != nil {
+					return err
+				}
+				deleted[email] = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	for i := range results {
+		switch {
+		case deleted[results[i].Email]:
+			results[i].Ok = true
+		case kept[results[i].InboundId]:
+			results[i].Error = "no client remained in Inbound"
+		case results[i].Error == "":
+			results[i].Error = "client not found"
+		}
+	}
+	return results, len(deleted) > 0, nil
+}
+
+// BulkClientNotify sends one Telegram message to a selection of clients.
+type BulkClientNotify struct {
+	BulkClientSelection
+	Message string `json:"message"`
+}
+
+// NotifyBulkClients sends the message of notify over Telegram to its clients,
+// at most maxCount of them. The clients without a Telegram ID are reported in
+// their results, like the ones that are not found.
+func (s *InboundService) NotifyBulkClients(notify *BulkClientNotify, maxCount int) ([]BulkClientResult, error) {
+	message := strings.TrimSpace(notify.Message)
+	if message == "" {
+		return nil, common.NewError("the message is empty")
+	}
+	tgbot := Tgbot{}
+	if !tgbot.IsRunning() {
+		return nil, common.NewError("the Telegram bot is not running")
+	}
+	results, targets, err := s.bulkTargets(&notify.BulkClientSelection, maxCount)
+	if err != nil || len(targets) == 0 {
+		return results, err
+	}
+
+	tgIds := map[string]int64{}
+	for id, emails := range targets {
+		inbound, err := s.GetInbound(id)
+		if err != nil {
+			return nil, err
+		}
+		settings := map[string][]model.Client{}
+		json.Unmarshal([]byte(inbound.Settings), &settings)
+		for _, client := range settings["clients"] {
+			if emails[client.Email] {
+				tgIds[client.Email] = client.TgID
+			}
+		}
+	}
+	sent := map[string]bool{}
+	for i := range results {
+		if results[i].Error != "" {
+			continue
+		}
+		email := results[i].Email
+		tgId := tgIds[email]
+		if tgId == 0 {
+			results[i].Error = "client has no Telegram ID"
+			continue
+		}
+		// A client selected twice gets the message once
+		if !sent[email] {
+			tgbot.SendMsgToTgbot(tgId, html.EscapeString(message))
+			sent[email] = true
+		}
+		results[i].Ok = true
+	}
+	return results, nil
+}
@@ -0,0 +1,34 @@
+package service
+
+import (
+	"testing"
+
+	"x-ui/xray"
+)
+
+func TestBulkResetFlushesPendingTraffic(t *testing.T) {
+	inbound := lifecycleTestDB(t, []xray.ClientTraffic{
+		{Email: "reset", Enable: true, Up: 60, Down: 40, Total: 1000},
+		{Email: "kept", Enable: true, Up: 60, Down: 40, Total: 1000},
+	})
+	// Traffic of the period that ends, still waiting for a flush
+	bufferTraffic(nil, []*xray.ClientTraffic{{Email: "reset", Up: 300, Down: 200}, {Email: "kept", Up: 3, Down: 2}}, nil)
+
+	var s InboundService
+	update := &BulkClientUpdate{
+		BulkClientSelection: BulkClientSelection{Clients: []ClientRef{{InboundId: inbound.Id, Email: "reset"}}, Strict: true},
+		Patch:               ClientPatch{ResetTraffic: true},
+	}
+	if _, _, err := s.UpdateBulkClients(update, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.FlushTraffic(); err != nil {
+		t.Fatal(err)
+	}
+	if stored := clientTraffic(t, "reset"); stored.Up != 0 || stored.Down != 0 {
+		t.Errorf("after the reset the client used %d up, %d down, want the traffic before it left out", stored.Up, stored.Down)
+	}
+	if stored := clientTraffic(t, "kept"); stored.Up != 63 || stored.Down != 42 {
+		t.Errorf("the client left alone used %d up, %d down, want 63 and 42", stored.Up, stored.Down)
+	}
+}
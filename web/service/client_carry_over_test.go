@@ -0,0 +1,191 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/xray"
+
+	"gorm.io/gorm"
+)
+
+func TestCarriedOver(t *testing.T) {
+	for _, c := range []struct {
+		name                        string
+		base, total, used, carryCap int64
+		want                        int64
+	}{
+		{"unused", 100, 100, 30, 0, 70},
+		{"under the cap", 100, 100, 30, 80, 70},
+		{"over the cap", 100, 100, 30, 50, 50},
+		{"with what was carried in", 100, 150, 30, 0, 120},
+		{"depleted", 100, 100, 100, 0, 0},
+		{"over its quota", 100, 100, 130, 50, 0},
+		{"unlimited", 0, 0, 30, 50, 0},
+		{"unlimited with a stale total", 0, 100, 30, 0, 0},
+	} {
+		if got := carriedOver(c.base, c.total, c.used, c.carryCap); got != c.want {
+			t.Errorf("%s: %d carried over, want %d", c.name, got, c.want)
+		}
+	}
+}
+
+// carryTestClient is a client with a daily reset and its traffic before it.
+type carryTestClient struct {
+	email      string
+	totalGB    int64
+	carryOver  bool
+	carryCapGB int64
+	traffic    xray.ClientTraffic
+}
+
+// carryTestDB opens an empty database with an inbound of clients whose last
+// reset was two days ago, so a scheduled reset is due for each.
+func carryTestDB(t *testing.T, clients []carryTestClient) *model.Inbound {
+	t.Helper()
+	settings := make([]string, 0, len(clients))
+	for _, client := range clients {
+		settings = append(settings, fmt.Sprintf(
+			`{"password":"p%s","email":"%s","enable":true,"totalGB":%d,"resetPolicy":"daily","carryOver":%t,"carryCapGB":%d}`,
+			client.email, client.email, client.totalGB, client.carryOver, client.carryCapGB))
+	}
+	inbound := &model.Inbound{
+		Remark: "trojan", Enable: true, Port: 20003, Protocol: model.Trojan, Tag: "inbound-20003",
+		Settings: `{"clients":[` + strings.Join(settings, ",") + `]}`,
+	}
+	newTestDB(t, seedInbounds(inbound), func(db *gorm.DB) error {
+		lastReset := time.Now().AddDate(0, 0, -2).UnixMilli()
+		for _, client := range clients {
+			traffic := client.traffic
+			traffic.InboundId, traffic.Email, traffic.Enable, traffic.LastReset = inbound.Id, client.email, true, lastReset
+			if err := db.Create(&traffic).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return inbound
+}
+
+func TestScheduledResetCarriesOver(t *testing.T) {
+	carryTestDB(t, []carryTestClient{
+		{email: "carry", totalGB: 100, carryOver: true, traffic: xray.ClientTraffic{Up: 20, Down: 10, Total: 100}},
+		{email: "capped", totalGB: 100, carryOver: true, carryCapGB: 50, traffic: xray.ClientTraffic{Up: 10, Total: 100}},
+		{email: "again", totalGB: 100, carryOver: true, traffic: xray.ClientTraffic{Up: 50, Total: 140, CarriedOver: 40}},
+		{email: "depleted", totalGB: 100, carryOver: true, traffic: xray.ClientTraffic{Up: 80, Down: 40, Total: 100}},
+		{email: "unlimited", carryOver: true, traffic: xray.ClientTraffic{Up: 20}},
+		{email: "plain", totalGB: 100, traffic: xray.ClientTraffic{Up: 20, Total: 140, CarriedOver: 40}},
+	})
+	var s InboundService
+	count, _, err := s.ResetScheduledTraffics(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 6 {
+		t.Errorf("%d clients were reset, want 6", count)
+	}
+
+	want := map[string]struct{ total, carried, carriedIn int64 }{
+		"carry":     {170, 70, 0},
+		"capped":    {150, 50, 0},
+		"again":     {190, 90, 40},
+		"depleted":  {100, 0, 0},
+		"unlimited": {0, 0, 0},
+		"plain":     {100, 0, 40},
+	}
+	for email, w := range want {
+		traffic := clientTraffic(t, email)
+		if traffic.Up+traffic.Down != 0 || traffic.Total != w.total || traffic.CarriedOver != w.carried {
+			t.Errorf("%s after the reset has %d used of %d, %d carried over; want %d, %d carried over",
+				email, traffic.Up+traffic.Down, traffic.Total, traffic.CarriedOver, w.total, w.carried)
+		}
+		var history model.TrafficHistory
+		if err := database.GetDB().Where("email = ?", email).First(&history).Error; err != nil {
+			t.Fatal(err)
+		}
+		if history.CarriedIn != w.carriedIn || history.CarriedOver != w.carried {
+			t.Errorf("the history of %s has %d carried in, %d carried over; want %d, %d",
+				email, history.CarriedIn, history.CarriedOver, w.carriedIn, w.carried)
+		}
+	}
+
+	// Repeated, the reset of the period is not carried over twice
+	if count, _, err := s.ResetScheduledTraffics(true); err != nil || count != 0 {
+		t.Errorf("the repeated reset reset %d clients, %v", count, err)
+	}
+	if traffic := clientTraffic(t, "carry"); traffic.Total != 170 {
+		t.Errorf("the repeated reset left a quota of %d", traffic.Total)
+	}
+}
+
+func TestManualResetCarriesOver(t *testing.T) {
+	inbound := carryTestDB(t, []carryTestClient{
+		{email: "carry", totalGB: 100, carryOver: true, carryCapGB: 50, traffic: xray.ClientTraffic{Up: 20, Total: 100}},
+		{email: "kept", totalGB: 100, carryOver: true, traffic: xray.ClientTraffic{Up: 20, Total: 130, CarriedOver: 30}},
+		{email: "plain", totalGB: 100, traffic: xray.ClientTraffic{Up: 20, Total: 100}},
+		{email: "unlimited", carryOver: true, traffic: xray.ClientTraffic{Up: 20}},
+	})
+	var s InboundService
+	for email, carryOver := range map[string]bool{"carry": true, "kept": false, "plain": true, "unlimited": true} {
+		if _, err := s.ResetClientTraffic(inbound.Id, email, carryOver); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for email, w := range map[string]struct{ total, carried int64 }{
+		"carry":     {150, 50},
+		"kept":      {130, 30},
+		"plain":     {100, 0},
+		"unlimited": {0, 0},
+	} {
+		traffic := clientTraffic(t, email)
+		if traffic.Up+traffic.Down != 0 || traffic.Total != w.total || traffic.CarriedOver != w.carried {
+			t.Errorf("%s after the reset has %d used of %d, %d carried over; want %d, %d carried over",
+				email, traffic.Up+traffic.Down, traffic.Total, traffic.CarriedOver, w.total, w.carried)
+		}
+	}
+}
+
+func TestClientEditKeepsCarriedOver(t *testing.T) {
+	carryTestDB(t, []carryTestClient{
+		{email: "carry", totalGB: 100, carryOver: true, traffic: xray.ClientTraffic{Up: 20, Total: 130, CarriedOver: 30}},
+		{email: "unlimited", totalGB: 100, carryOver: true, traffic: xray.ClientTraffic{Up: 20, Total: 130, CarriedOver: 30}},
+	})
+	var s InboundService
+	db := database.GetDB()
+	if err := s.UpdateClientStat(db, "carry", &model.Client{Email: "carry", Enable: true, TotalGB: 200}); err != nil {
+		t.Fatal(err)
+	}
+	if traffic := clientTraffic(t, "carry"); traffic.Total != 230 || traffic.CarriedOver != 30 {
+		t.Errorf("the edited client has a quota of %d, %d carried over", traffic.Total, traffic.CarriedOver)
+	}
+	// Made unlimited, it has nothing carried over left
+	if err := s.UpdateClientStat(db, "unlimited", &model.Client{Email: "unlimited", Enable: true}); err != nil {
+		t.Fatal(err)
+	}
+	if traffic := clientTraffic(t, "unlimited"); traffic.Total != 0 || traffic.CarriedOver != 0 {
+		t.Errorf("the unlimited client has a quota of %d, %d carried over", traffic.Total, traffic.CarriedOver)
+	}
+}
+
+func TestClientTrafficQuotas(t *testing.T) {
+	data, err := json.Marshal(xray.ClientTraffic{Email: "carry", Total: 130, CarriedOver: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var quotas struct {
+		BaseQuota      int64 `json:"baseQuota"`
+		CarriedOver    int64 `json:"carriedOver"`
+		EffectiveQuota int64 `json:"effectiveQuota"`
+	}
+	if err := json.Unmarshal(data, &quotas); err != nil {
+		t.Fatal(err)
+	}
+	if quotas.BaseQuota != 100 || quotas.CarriedOver != 30 || quotas.EffectiveQuota != 130 {
+		t.Errorf("the quotas are %+v in %s", quotas, data)
+	}
+}
@@ -0,0 +1,107 @@
+package service
+
+import (
+	"time"
+
+	"x-ui/database"
+	"x-ui/util/common"
+	"x-ui/xray"
+)
+
+const (
+	// clientCleanupKeepTag protects a client from the cleanup
+	clientCleanupKeepTag = "keep"
+	// ClientCleanupMaxPerRun caps the deletions of one cleanup, so a backlog of
+	// dead clients is worked off over several runs
+	ClientCleanupMaxPerRun = 200
+	// ClientInactive is the reason of a client deleted for not being seen
+	ClientInactive = "inactive"
+)
+
+// ClientCleanupCandidate is a client the cleanup deletes. DisabledReason is
+// "inactive" for a client deleted for not being seen since LastSeen.
+type ClientCleanupCandidate struct {
+	InboundId      int    `json:"inboundId"`
+	Email          string `json:"email"`
+	DisabledReason string `json:"disabledReason"`
+	DisabledAt     int64  `json:"disabledAt"`
+	LastSeen       int64  `json:"lastSeen,omitempty"`
+}
+
+// CleanupCandidates returns the clients that have been disabled for depletion or
+// expiry for more than graceDays, or the trials for more than trialGrace if it
+// isn't 0, and, if inactiveDays isn't 0, those not seen for more than
+// inactiveDays; clients never seen are left to the first rule. The longest
+// disabled or unseen come first, at most limit of them unless it is 0, with the
+// number of all of them. Clients tagged "keep" are left out.
+func (s *InboundService) CleanupCandidates(graceDays int, inactiveDays int, trialGrace time.Duration, limit int) ([]ClientCleanupCandidate, int64, error) {
+	if graceDays <= 0 && inactiveDays <= 0 && trialGrace <= 0 {
+		return nil, 0, common.NewError("the grace or the inactivity period must be at least one day")
+	}
+	graceCutoff := time.Now().AddDate(0, 0, -graceDays).UnixMilli()
+	trialCutoff := time.Now().Add(-trialGrace).UnixMilli()
+	trialTag := "%" + tagColumn([]string{TrialTag}) + "%"
+	disabled := database.GetDB().
+		Where("enable = ? AND disabled_reason IN ?", false, []string{ClientDisabledQuota, ClientDisabledExpiry})
+	depleted := database.GetDB().Where("1 = 0")
+	if graceDays > 0 {
+		depleted = depleted.Or("disabled_at > 0 AND disabled_at <= ?", graceCutoff)
+	}
+	if trialGrace > 0 {
+		depleted = depleted.Or("disabled_at > 0 AND disabled_at <= ? AND COALESCE(tags, '') LIKE ?", trialCutoff, trialTag)
+	}
+	depleted = disabled.Where(depleted)
+	inactive := database.GetDB().Where("1 = 0")
+	if inactiveDays > 0 {
+		inactive = database.GetDB().
+			Where("last_seen > 0 AND last_seen <= ?", time.Now().AddDate(0, 0, -inactiveDays).UnixMilli())
+	}
+	db := database.GetDB().Model(xray.ClientTraffic{}).
+		Where(depleted.Or(inactive)).
+		Where("COALESCE(tags, '') NOT LIKE ?", "%"+tagColumn([]string{clientCleanupKeepTag})+"%")
+
+	var total int64
+	if err := db.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	// A client both depleted and unseen is deleted for the depletion
+	reason := "CASE WHEN NOT enable AND disabled_reason IN ('" + ClientDisabledQuota + "', '" + ClientDisabledExpiry + "')" +
+		" AND disabled_at > 0 AND (? > 0 AND disabled_at <= ? OR ? > 0 AND disabled_at <= ? AND COALESCE(tags, '') LIKE ?)" +
+		" THEN disabled_reason ELSE '" + ClientInactive + "' END"
+	candidates := make([]ClientCleanupCandidate, 0)
+	query := db.Select("inbound_id, email, "+reason+" AS disabled_reason, disabled_at, last_seen",
+		graceDays, graceCutoff, int64(trialGrace), trialCutoff, trialTag).
+		Order("CASE WHEN last_seen > 0 AND (disabled_at = 0 OR last_seen < disabled_at) THEN last_seen ELSE disabled_at END, id")
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	err := query.Scan(&candidates).Error
+	return candidates, total, err
+}
+
+// CleanupClients deletes up to ClientCleanupMaxPerRun of the CleanupCandidates
+// for good, in one batch per inbound. Like DelBulkClients, it leaves inbounds that would
+// have no client left as they are. It returns the deleted clients and whether
+// Xray has to be restarted.
+func (s *InboundService) CleanupClients(graceDays int, inactiveDays int, trialGrace time.Duration) ([]ClientCleanupCandidate, bool, error) {
+	candidates, _, err := s.CleanupCandidates(graceDays, inactiveDays, trialGrace, ClientCleanupMaxPerRun)
+	if err != nil || len(candidates) == 0 {
+		return nil, false, err
+	}
+	sel := &BulkClientSelection{}
+	for _, candidate := range candidates {
+		sel.Clients = append(sel.Clients, ClientRef{InboundId: candidate.InboundId, Email: candidate.Email})
+	}
+	results, needRestart, err := s.DelBulkClients(sel, len(sel.Clients), "", true)
+	if err != nil {
+		return nil, false, err
+	}
+
+	deleted := make([]ClientCleanupCandidate, 0, len(results))
+	for i, result := range results {
+		if result.Ok {
+			deleted = append(deleted, candidates[i])
+		}
+	}
+	return deleted, needRestart, nil
+}
@@ -0,0 +1,242 @@
+package service
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/web/locale"
+	"x-ui/xray"
+
+	"github.com/goccy/go-json"
+	"gorm.io/gorm"
+)
+
+// ClientEmailUse is an email as it is used by a client of an inbound.
+type ClientEmailUse struct {
+	InboundId int    `json:"inboundId"`
+	Remark    string `json:"remark"`
+	Email     string `json:"email"`
+}
+
+// ClientEmailDuplicate is an email used by more than one client, which Xray
+// counts as one: their traffic adds up and they are disabled together.
+type ClientEmailDuplicate struct {
+	Email string           `json:"email"`
+	Uses  []ClientEmailUse `json:"uses"`
+}
+
+// ClientEmailRename is a client that was renamed to repair a duplicate email.
+type ClientEmailRename struct {
+	InboundId int    `json:"inboundId"`
+	Email     string `json:"email"`
+	NewEmail  string `json:"newEmail"`
+}
+
+// getClientEmails returns the emails of the clients of all inbounds, in the
+// order of the inbounds and their clients.
+func (s *InboundService) getClientEmails() ([]ClientEmailUse, error) {
+	uses := make([]ClientEmailUse, 0)
+	err := database.GetDB().Raw(`
+		SELECT inbounds.id AS inbound_id, inbounds.remark, ` + database.JSONText("client.value", "$.email") + ` AS email
+		FROM inbounds,
+			` + database.JSONEach("inbounds.settings", "$.clients", "client") + `
+		WHERE COALESCE(` + database.JSONText("client.value", "$.email") + `, '') != ''
+		ORDER BY inbounds.id, ` + database.JSONIndex("client") + `
+		`).Scan(&uses).Error
+	if err != nil {
+		return nil, err
+	}
+	return uses, nil
+}
+
+// emailInUse is the error for an email that is used by a client of use.
+func emailInUse(email string, use *ClientEmailUse) error {
+	if use == nil {
+		return locale.NewError(locale.ErrClientEmailInUse, "Email=="+email)
+	}
+	remark := use.Remark
+	if remark == "" {
+		remark = "#" + strconv.Itoa(use.InboundId)
+	}
+	return locale.NewError(locale.ErrClientEmailInInbound, "Email=="+email, "Inbound=="+remark, "Id=="+strconv.Itoa(use.InboundId))
+}
+
+// checkClientEmails checks that the emails of clients are used neither by
+// another of them nor by a client of any inbound, but the uses skip returns
+// true for, e.g. the clients of an inbound that is replaced. On a conflict it
+// returns the index of the client and an error naming the inbound of the other
+// one, otherwise -1.
+func (s *InboundService) checkClientEmails(clients []model.Client, skip func(*ClientEmailUse) bool) (int, error) {
+	uses, err := s.getClientEmails()
+	if err != nil {
+		return -1, err
+	}
+	used := make(map[string]*ClientEmailUse, len(uses))
+	for i := range uses {
+		if skip == nil || !skip(&uses[i]) {
+			used[strings.ToLower(uses[i].Email)] = &uses[i]
+		}
+	}
+	emails := make(map[string]bool, len(clients))
+	for i, client := range clients {
+		if client.Email == "" {
+			continue
+		}
+		email := strings.ToLower(client.Email)
+		if emails[email] {
+			return i, emailInUse(client.Email, nil)
+		}
+		if use, ok := used[email]; ok {
+			return i, emailInUse(client.Email, use)
+		}
+		emails[email] = true
+	}
+	return -1, nil
+}
+
+// GetDuplicateEmails returns the emails that are used by more than one client,
+// which an older panel let through.
+func (s *InboundService) GetDuplicateEmails() ([]ClientEmailDuplicate, error) {
+	uses, err := s.getClientEmails()
+	if err != nil {
+		return nil, err
+	}
+	byEmail := map[string][]ClientEmailUse{}
+	for _, use := range uses {
+		email := strings.ToLower(use.Email)
+		byEmail[email] = append(byEmail[email], use)
+	}
+	duplicates := make([]ClientEmailDuplicate, 0)
+	for email, uses := range byEmail {
+		if len(uses) > 1 {
+			duplicates = append(duplicates, ClientEmailDuplicate{Email: email, Uses: uses})
+		}
+	}
+	sort.Slice(duplicates, func(i, j int) bool { return duplicates[i].Email < duplicates[j].Email })
+	return duplicates, nil
+}
+
+// RepairDuplicateEmails gives every client that shares its email with another
+// one an email of its own, by appending a number to it. The client the traffic
+// of the email is recorded for keeps it; the others start from zero traffic.
+// Their links and subscriptions follow the new emails. Xray has to be restarted
+// after.
+func (s *InboundService) RepairDuplicateEmails() ([]ClientEmailRename, bool, error) {
+	duplicates, err := s.GetDuplicateEmails()
+	if err != nil || len(duplicates) == 0 {
+		return []ClientEmailRename{}, false, err
+	}
+	targets := map[int]map[string]bool{}
+	for _, duplicate := range duplicates {
+		for _, use := range duplicate.Uses {
+			targets[use.InboundId] = nil
+		}
+	}
+	ids, unlock := s.lockInbounds(targets)
+	defer unlock()
+
+	uses, err := s.getClientEmails()
+	if err != nil {
+		return nil, false, err
+	}
+	used := make(map[string]bool, len(uses))
+	count := map[string]int{}
+	for _, use := range uses {
+		used[strings.ToLower(use.Email)] = true
+		count[strings.ToLower(use.Email)]++
+	}
+
+	// The client in the inbound the traffic is recorded for keeps the email
+	keeper := map[string]int{}
+	for _, use := range uses {
+		email := strings.ToLower(use.Email)
+		if count[email] < 2 {
+			continue
+		}
+		if _, ok := keeper[email]; !ok {
+			keeper[email] = use.InboundId
+		}
+	}
+	var traffics []xray.ClientTraffic
+	emails := make([]string, 0, len(keeper))
+	for email := range keeper {
+		emails = append(emails, email)
+	}
+	err = database.GetDB().Where("LOWER(email) IN ?", emails).Find(&traffics).Error
+	if err != nil {
+		return nil, false, err
+	}
+	for _, traffic := range traffics {
+		email := strings.ToLower(traffic.Email)
+		for _, use := range uses {
+			if use.InboundId == traffic.InboundId && strings.ToLower(use.Email) == email {
+				keeper[email] = traffic.InboundId
+				break
+			}
+		}
+	}
+
+	renames := make([]ClientEmailRename, 0)
+	kept := map[string]bool{}
+	err = database.Transaction(func(tx *gorm.DB) error {
+		for _, id := range ids {
+			inbound, err := s.GetInbound(id)
+			if err != nil {
+				return err
+			}
+			var settings map[string]any
+			if err := json.Unmarshal([]byte(inbound.Settings), &settings); err != nil {
+				return err
+			}
+			clients, _ := settings["clients"].([]any)
+			changed := false
+			for _, item := range clients {
+				client, _ := item.(map[string]any)
+				oldEmail, _ := client["email"].(string)
+				email := strings.ToLower(oldEmail)
+				if _, ok := keeper[email]; !ok {
+					continue
+				}
+				if keeper[email] == id && !kept[email] {
+					kept[email] = true
+					continue
+				}
+				newEmail := oldEmail
+				for n := 2; used[strings.ToLower(newEmail)]; n++ {
+					newEmail = fmt.Sprintf("%s-%d", oldEmail, n)
+				}
+				used[strings.ToLower(newEmail)] = true
+				client["email"] = newEmail
+				changed = true
+
+				var stat model.Client
+				data, _ := json.Marshal(client)
+				json.Unmarshal(data, &stat)
+				if err := s.AddClientStat(tx, id, &stat); err != nil {
+					return err
+				}
+				renames = append(renames, ClientEmailRename{InboundId: id, Email: oldEmail, NewEmail: newEmail})
+			}
+			if !changed {
+				continue
+			}
+			newSettings, err := json.MarshalIndent(settings, "", "  ")
+			if err != nil {
+				return err
+			}
+			err = tx.Model(model.Inbound{}).Where("id = ?", id).Update("settings", string(newSettings)).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return renames, len(renames) > 0, nil
+}
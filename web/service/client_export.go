@@ -0,0 +1,413 @@
+package service
+
+import (
+	"archive/zip"
+	"bufio"
+	"database/sql"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/common"
+)
+
+const (
+	ClientExportCSV  = "csv"
+	ClientExportXLSX = "xlsx"
+)
+
+// clientExportTime is how the times of the export are written, in the time
+// location of the panel.
+const clientExportTime = "2006-01-02 15:04:05"
+
+// clientExportColumns are the headers of the columns of the export.
+var clientExportColumns = []string{
+	"Inbound", "Email", "Tags", "Protocol", "Created", "Expiry", "Total quota (bytes)",
+	"Up (bytes)", "Down (bytes)", "State", "Last seen", "Last subscription fetch",
+}
+
+// ClientExportQuery picks the clients of an export and its format. Inbound is
+// the id of an inbound or "all", Period a month as 2006-01 the traffic is
+// counted for; Tag and Query filter the clients as the client listing and
+// search do.
+type ClientExportQuery struct {
+	Format  string `form:"format"`
+	Inbound string `form:"inbound"`
+	Period  string `form:"period"`
+	Tag     string `form:"tag"`
+	Query   string `form:"q"`
+}
+
+// clientExportRow is a client as read for the export.
+type clientExportRow struct {
+	InboundId      int
+	Remark         string
+	Protocol       string
+	Email          string
+	TagColumn      string `gorm:"column:tags"`
+	CreatedAt      int64
+	ExpiryTime     int64
+	Total          int64
+	Up             int64
+	Down           int64
+	ClientEnable   bool
+	TrafficEnable  bool
+	DisabledReason string
+	LastSeen       int64
+	LastSubFetch   int64
+}
+
+// ClientExport is an export of the clients, read row by row as it is written.
+type ClientExport struct {
+	format   string
+	filename string
+	location *time.Location
+	rows     *sql.Rows
+}
+
+// ExportClients starts an export of the clients of query. The traffic is the
+// traffic of the month of the period if the traffic history is kept, the
+// lifetime traffic otherwise. The export must be closed once written.
+func (s *InboundService) ExportClients(query ClientExportQuery) (*ClientExport, error) {
+	switch query.Format {
+	case "":
+		query.Format = ClientExportCSV
+	case ClientExportCSV, ClientExportXLSX:
+	default:
+		return nil, common.NewErrorf("unknown export format: %s", query.Format)
+	}
+	inboundId := 0
+	if query.Inbound != "" && query.Inbound != "all" {
+		var err error
+		if inboundId, err = strconv.Atoi(query.Inbound); err != nil || inboundId <= 0 {
+			return nil, common.NewErrorf("invalid inbound: %s", query.Inbound)
+		}
+	}
+	pattern := "%"
+	if query.Tag != "" {
+		var err error
+		if pattern, err = tagPattern(query.Tag); err != nil {
+			return nil, err
+		}
+	}
+	location, err := s.settingService.GetTimeLocation()
+	if err != nil {
+		return nil, err
+	}
+
+	var from, to int64
+	suffix := time.Now().In(location).Format("20060102-150405")
+	if query.Period != "" {
+		month, err := time.ParseInLocation("2006-01", query.Period, location)
+		if err != nil {
+			return nil, common.NewErrorf("invalid period, expected a month as 2006-01: %s", query.Period)
+		}
+		suffix = query.Period
+		if days, err := s.settingService.GetTrafficHistoryDays(); err == nil && days > 0 {
+			from, to = month.UnixMilli(), month.AddDate(0, 1, 0).UnixMilli()
+		}
+	}
+
+	lower := strings.ToLower(strings.TrimSpace(query.Query))
+	tgId, _ := strconv.ParseInt(lower, 10, 64)
+	traffic := "traffic.up, traffic.down"
+	period := ""
+	if to > 0 {
+		traffic = "COALESCE(period.up, 0) AS up, COALESCE(period.down, 0) AS down"
+		period = `
+	LEFT JOIN (
+		SELECT entity_id, SUM(up) AS up, SUM(down) AS down FROM traffic_history
+		WHERE entity = @entity AND hour >= @from AND hour < @to
+		GROUP BY entity_id
+	) AS period ON period.entity_id = traffic.email`
+	}
+	rows, err := database.GetDB().Raw(`
+SELECT * FROM (
+	SELECT traffic.inbound_id, inbounds.remark, inbounds.protocol, traffic.email,
+		COALESCE(traffic.tags, '') AS tags, COALESCE(traffic.created_at, 0) AS created_at,
+		traffic.expiry_time, traffic.total, `+traffic+`,
+		COALESCE(`+database.JSONBool("client.value", "$.enable")+`, 1) AS client_enable,
+		traffic.enable AS traffic_enable, COALESCE(traffic.disabled_reason, '') AS disabled_reason,
+		COALESCE(traffic.last_seen, 0) AS last_seen, COALESCE(traffic.last_sub_fetch, 0) AS last_sub_fetch,
+		COALESCE(`+database.JSONText("client.value", "$.id")+`, '') AS client_id,
+		COALESCE(`+database.JSONText("client.value", "$.subId")+`, '') AS sub_id,
+		COALESCE(`+database.JSONInt("client.value", "$.tgId")+`, 0) AS tg_id
+	FROM client_traffics AS traffic
+		JOIN inbounds ON inbounds.id = traffic.inbound_id
+		LEFT JOIN `+database.JSONEach("inbounds.settings", "$.clients", "client")+`
+			ON `+database.JSONText("client.value", "$.email")+` = traffic.email`+period+`
+	WHERE COALESCE(traffic.tags, '') LIKE @pattern ESCAPE '!'
+		AND (@inbound = 0 OR traffic.inbound_id = @inbound)
+) AS clients
+WHERE @query = ''
+	OR LOWER(email) LIKE @substring ESCAPE '!'
+	OR LOWER(client_id) = @query OR sub_id = @raw
+	OR (@tg <> 0 AND tg_id = @tg)
+ORDER BY inbound_id, LOWER(email)`,
+		sql.Named("pattern", pattern),
+		sql.Named("inbound", inboundId),
+		sql.Named("entity", model.TrafficEntityClient),
+		sql.Named("from", from),
+		sql.Named("to", to),
+		sql.Named("query", lower),
+		sql.Named("raw", strings.TrimSpace(query.Query)),
+		sql.Named("substring", "%"+escapeLike(lower)+"%"),
+		sql.Named("tg", tgId),
+	).Rows()
+	if err != nil {
+		return nil, err
+	}
+	return &ClientExport{
+		format:   query.Format,
+		filename: "x-ui-clients-" + suffix + "." + query.Format,
+		location: location,
+		rows:     rows,
+	}, nil
+}
+
+// Filename returns the name the export is downloaded as.
+func (e *ClientExport) Filename() string {
+	return e.filename
+}
+
+// ContentType returns the MIME type of the export.
+func (e *ClientExport) ContentType() string {
+	if e.format == ClientExportXLSX {
+		return "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+	}
+	return "text/csv; charset=utf-8"
+}
+
+func (e *ClientExport) Close() error {
+	return e.rows.Close()
+}
+
+// Write writes the export to w, a row at a time.
+func (e *ClientExport) Write(w io.Writer) error {
+	var table tableWriter
+	if e.format == ClientExportXLSX {
+		table = newXLSXWriter(w)
+	} else {
+		table = newCSVWriter(w)
+	}
+	header := make([]tableCell, len(clientExportColumns))
+	for i, column := range clientExportColumns {
+		header[i] = textCell(column)
+	}
+	if err := table.WriteRow(header); err != nil {
+		return err
+	}
+
+	db := database.GetDB()
+	count := 0
+	for e.rows.Next() {
+		var row clientExportRow
+		if err := db.ScanRows(e.rows, &row); err != nil {
+			return err
+		}
+		if err := table.WriteRow(e.cells(&row)); err != nil {
+			return err
+		}
+		count++
+	}
+	if err := e.rows.Err(); err != nil {
+		return err
+	}
+	logger.Info("exported", count, "clients as", e.format)
+	return table.Close()
+}
+
+// cells returns the columns of the export of a client.
+func (e *ClientExport) cells(row *clientExportRow) []tableCell {
+	state := "enabled"
+	if !row.ClientEnable || !row.TrafficEnable {
+		state = "disabled"
+		if row.DisabledReason != "" {
+			state += " (" + row.DisabledReason + ")"
+		}
+	}
+	expiry := textCell(e.time(row.ExpiryTime))
+	if row.ExpiryTime < 0 {
+		expiry = textCell(fmt.Sprintf("%d days after first use", -row.ExpiryTime/int64(24*time.Hour/time.Millisecond)))
+	}
+	total := textCell("")
+	if row.Total > 0 {
+		total = numberCell(row.Total)
+	}
+	lastSubFetch := row.LastSubFetch
+	if at, _ := subAccessLastFetch(row.Email); at > lastSubFetch {
+		lastSubFetch = at
+	}
+	return []tableCell{
+		textCell(row.Remark),
+		textCell(row.Email),
+		textCell(strings.Join(parseTagColumn(row.TagColumn), ", ")),
+		textCell(row.Protocol),
+		textCell(e.time(row.CreatedAt)),
+		expiry,
+		total,
+		numberCell(row.Up),
+		numberCell(row.Down),
+		textCell(state),
+		textCell(e.time(max(row.LastSeen, clientLastSeen(row.Email)))),
+		textCell(e.time(lastSubFetch)),
+	}
+}
+
+// time formats a time in milliseconds, empty if it is not set.
+func (e *ClientExport) time(ms int64) string {
+	if ms <= 0 {
+		return ""
+	}
+	return time.UnixMilli(ms).In(e.location).Format(clientExportTime)
+}
+
+// tableCell is a cell of a table written by a tableWriter, a number if
+// numeric is set.
+type tableCell struct {
+	value   string
+	numeric bool
+}
+
+func textCell(value string) tableCell {
+	return tableCell{value: value}
+}
+
+func numberCell(value int64) tableCell {
+	return tableCell{value: strconv.FormatInt(value, 10), numeric: true}
+}
+
+// tableWriter writes a table a row at a time; Close ends it.
+type tableWriter interface {
+	WriteRow(cells []tableCell) error
+	Close() error
+}
+
+// csvWriter writes a table as RFC 4180 CSV, behind a UTF-8 byte order mark for
+// Excel to read the text as UTF-8.
+type csvWriter struct {
+	w       *csv.Writer
+	started bool
+	out     io.Writer
+	record  []string
+}
+
+func newCSVWriter(w io.Writer) *csvWriter {
+	writer := csv.NewWriter(w)
+	writer.UseCRLF = true
+	return &csvWriter{w: writer, out: w}
+}
+
+func (t *csvWriter) WriteRow(cells []tableCell) error {
+	if !t.started {
+		t.started = true
+		if _, err := io.WriteString(t.out, "\ufeff"); err != nil {
+			return err
+		}
+	}
+	t.record = t.record[:0]
+	for _, cell := range cells {
+		value := cell.value
+		// Text starting like a formula is quoted for spreadsheets to show
+		// it as text
+		if !cell.numeric && value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+			value = "'" + value
+		}
+		t.record = append(t.record, value)
+	}
+	return t.w.Write(t.record)
+}
+
+func (t *csvWriter) Close() error {
+	t.w.Flush()
+	return t.w.Error()
+}
+
+// xlsxWriter writes a table as the only sheet of an XLSX workbook. The sheet
+// is streamed into the archive with inline strings, so the rows are not held
+// in memory.
+type xlsxWriter struct {
+	zip   *zip.Writer
+	sheet *bufio.Writer
+	rows  int
+	err   error
+}
+
+// xlsxParts are the parts of the workbook other than the sheet.
+var xlsxParts = []struct{ name, content string }{
+	{"[Content_Types].xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/><Default Extension="xml" ContentType="application/xml"/><Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/><Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/><Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/></Types>`},
+	{"_rels/.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`},
+	{"xl/workbook.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="Clients" sheetId="1" r:id="rId1"/></sheets></workbook>`},
+	{"xl/_rels/workbook.xml.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/><Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/></Relationships>`},
+	{"xl/styles.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><fonts count="1"><font><sz val="11"/><name val="Calibri"/></font></fonts><fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills><borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders><cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs><cellXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/></cellXfs></styleSheet>`},
+}
+
+func newXLSXWriter(w io.Writer) *xlsxWriter {
+	t := &xlsxWriter{zip: zip.NewWriter(w)}
+	for _, part := range xlsxParts {
+		var f io.Writer
+		if f, t.err = t.zip.Create(part.name); t.err != nil {
+			return t
+		}
+		if _, t.err = io.WriteString(f, part.content); t.err != nil {
+			return t
+		}
+	}
+	// The sheet is the last part, for it to be written until the end
+	f, err := t.zip.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		t.err = err
+		return t
+	}
+	t.sheet = bufio.NewWriter(f)
+	_, t.err = t.sheet.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	return t
+}
+
+func (t *xlsxWriter) WriteRow(cells []tableCell) error {
+	if t.err != nil {
+		return t.err
+	}
+	t.rows++
+	fmt.Fprintf(t.sheet, `<row r="%d">`, t.rows)
+	for _, cell := range cells {
+		if cell.numeric {
+			fmt.Fprintf(t.sheet, `<c><v>%s</v></c>`, cell.value)
+			continue
+		}
+		t.sheet.WriteString(`<c t="inlineStr"><is><t xml:space="preserve">`)
+		if err := xml.EscapeText(t.sheet, []byte(cell.value)); err != nil {
+			t.err = err
+			return err
+		}
+		t.sheet.WriteString(`</t></is></c>`)
+	}
+	_, t.err = t.sheet.WriteString(`</row>`)
+	return t.err
+}
+
+func (t *xlsxWriter) Close() error {
+	if t.err != nil {
+		return t.err
+	}
+	if _, err := t.sheet.WriteString(`</sheetData></worksheet>`); err != nil {
+		return err
+	}
+	if err := t.sheet.Flush(); err != nil {
+		return err
+	}
+	return t.zip.Close()
+}
@@ -0,0 +1,31 @@
+package service
+
+import (
+	"x-ui/database/model"
+	"x-ui/util/common"
+)
+
+// clientFlows are the XTLS flows a VLESS client may have, besides none.
+var clientFlows = map[string]bool{
+	"xtls-rprx-vision":        true,
+	"xtls-rprx-vision-udp443": true,
+}
+
+// checkClientFlows checks the flow of every client of an inbound: it has to be a
+// known one, on an inbound canFlow allows it on. It returns the index of the
+// first client that fails, -1 if the error isn't about a client.
+func checkClientFlows(inbound *model.Inbound, clients []model.Client) (int, error) {
+	flowAllowed := canFlow(inbound)
+	for i, client := range clients {
+		if client.Flow == "" {
+			continue
+		}
+		if !clientFlows[client.Flow] {
+			return i, common.NewErrorf("unknown flow %q of client %s", client.Flow, client.Email)
+		}
+		if !flowAllowed {
+			return i, common.NewErrorf("flow %s of client %s needs VLESS over TCP with TLS or Reality", client.Flow, client.Email)
+		}
+	}
+	return -1, nil
+}
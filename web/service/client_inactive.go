@@ -0,0 +1,217 @@
+package service
+
+import (
+	"cmp"
+	"database/sql"
+	"html"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/common"
+)
+
+const (
+	// maxInactiveDays is the longest window clients are looked at inactive for
+	maxInactiveDays = 3650
+	// inactiveReportPeriod is how often the digest of the clients that became
+	// inactive is sent, and so how far back it looks
+	inactiveReportPeriod = 7 * 24 * time.Hour
+)
+
+// The sources the traffic of the inactive clients is checked in besides when
+// they were last seen: the hourly traffic history if it goes back to the start
+// of the window, only the last time the counters of the clients grew otherwise.
+const (
+	InactiveSourceHistory  = "history"
+	InactiveSourceCounters = "counters"
+)
+
+// InactiveClient is an enabled and unexpired client that passed no traffic and
+// didn't fetch its subscription within a window. LastActive is the last of its
+// traffic, its fetches and its creation that is known, 0 if none is.
+type InactiveClient struct {
+	ClientListItem
+	CreatedAt  int64 `json:"createdAt,omitempty"`
+	LastActive int64 `json:"lastActive,omitempty"`
+}
+
+// InactiveClients returns the enabled and unexpired clients with no traffic and
+// no subscription fetch for days, the longest inactive first, and the source
+// their traffic was checked in. The clients created within the days are left
+// out, they are new rather than inactive.
+func (s *InboundService) InactiveClients(days int) ([]InactiveClient, string, error) {
+	if days < 1 || days > maxInactiveDays {
+		return nil, "", common.NewErrorf("the inactivity period must be between 1 and %d days", maxInactiveDays)
+	}
+	now := time.Now()
+	cutoff := now.AddDate(0, 0, -days).UnixMilli()
+	source, err := inactiveSource(cutoff)
+	if err != nil {
+		return nil, "", err
+	}
+	// Without the history, the clients never seen since the tracking began and
+	// created before it are not known inactive
+	traffic := `(COALESCE(traffic.last_seen, 0) > 0 OR COALESCE(traffic.created_at, 0) > 0)`
+	if source == InactiveSourceHistory {
+		traffic = `NOT EXISTS (
+			SELECT 1 FROM traffic_history
+			WHERE entity = @entity AND entity_id = traffic.email AND hour >= @hour
+		)`
+	}
+
+	rows := make([]InactiveClient, 0)
+	err = database.GetDB().Raw(`
+SELECT traffic.inbound_id, inbounds.remark, inbounds.port, inbounds.protocol, traffic.email,
+	COALESCE(`+database.JSONText("client.value", "$.id")+`, '') AS client_id,
+	COALESCE(`+database.JSONText("client.value", "$.subId")+`, '') AS sub_id,
+	COALESCE(`+database.JSONInt("client.value", "$.tgId")+`, 0) AS tg_id,
+	COALESCE(`+database.JSONBool("client.value", "$.enable")+`, 1) AS enable,
+	traffic.up, traffic.down, traffic.total, traffic.expiry_time,
+	COALESCE(traffic.last_seen, 0) AS last_seen, COALESCE(traffic.tags, '') AS tags,
+	COALESCE(traffic.last_sub_fetch, 0) AS last_sub_fetch, COALESCE(traffic.last_user_agent, '') AS last_user_agent,
+	COALESCE(traffic.created_at, 0) AS created_at
+FROM client_traffics AS traffic
+	JOIN inbounds ON inbounds.id = traffic.inbound_id
+	LEFT JOIN `+database.JSONEach("inbounds.settings", "$.clients", "client")+`
+		ON `+database.JSONText("client.value", "$.email")+` = traffic.email
+WHERE traffic.enable = @enabled
+	AND (traffic.expiry_time <= 0 OR traffic.expiry_time > @now)
+	AND COALESCE(traffic.created_at, 0) < @cutoff
+	AND COALESCE(traffic.last_sub_fetch, 0) < @cutoff
+	AND COALESCE(traffic.last_seen, 0) < @cutoff
+	AND `+traffic,
+		sql.Named("enabled", true), sql.Named("now", now.UnixMilli()), sql.Named("cutoff", cutoff),
+		sql.Named("entity", model.TrafficEntityClient), sql.Named("hour", hourStart(time.UnixMilli(cutoff)).UnixMilli())).
+		Scan(&rows).Error
+	if err != nil {
+		return nil, "", err
+	}
+
+	clients := make([]InactiveClient, 0, len(rows))
+	for _, client := range rows {
+		client.Tags = parseTagColumn(client.TagColumn)
+		client.LastSeen = max(client.LastSeen, clientLastSeen(client.Email))
+		client.addLastSubFetch()
+		// The sightings and fetches not written yet count too
+		if !client.Enable || client.LastSubFetch >= cutoff || client.LastSeen >= cutoff {
+			continue
+		}
+		client.LastActive = max(client.LastSeen, client.LastSubFetch, client.CreatedAt)
+		clients = append(clients, client)
+	}
+	slices.SortFunc(clients, func(a, b InactiveClient) int {
+		return cmp.Or(cmp.Compare(a.LastActive, b.LastActive), strings.Compare(a.Email, b.Email))
+	})
+	return clients, source, nil
+}
+
+// inactiveSource returns where the traffic of the clients since cutoff is
+// known: in the traffic history if it was kept from before cutoff on.
+func inactiveSource(cutoff int64) (string, error) {
+	var oldest sql.NullInt64
+	err := database.GetDB().Model(model.HourlyTraffic{}).Select("MIN(hour)").Scan(&oldest).Error
+	if err != nil {
+		return "", err
+	}
+	if oldest.Valid && oldest.Int64 <= cutoff {
+		return InactiveSourceHistory, nil
+	}
+	return InactiveSourceCounters, nil
+}
+
+// clientsInactive returns the clients inactive for days, for bulk selections.
+func (s *InboundService) clientsInactive(days int) ([]ClientRef, error) {
+	clients, _, err := s.InactiveClients(days)
+	if err != nil {
+		return nil, err
+	}
+	refs := make([]ClientRef, 0, len(clients))
+	for _, client := range clients {
+		refs = append(refs, ClientRef{InboundId: client.InboundId, Email: client.Email})
+	}
+	return refs, nil
+}
+
+// InactiveEntrants returns the clients inactive for days that became so within
+// the last period: those last active in the period before the window.
+func (s *InboundService) InactiveEntrants(days int, period time.Duration) ([]InactiveClient, error) {
+	clients, _, err := s.InactiveClients(days)
+	if err != nil {
+		return nil, err
+	}
+	since := time.Now().AddDate(0, 0, -days).Add(-period).UnixMilli()
+	entrants := make([]InactiveClient, 0)
+	for _, client := range clients {
+		if client.LastActive >= since {
+			entrants = append(entrants, client)
+		}
+	}
+	return entrants, nil
+}
+
+// ReportInactiveClients sends the digest of the clients that became inactive
+// for days within the last week to the Telegram admins and the webhooks.
+func (s *InboundService) ReportInactiveClients(days int) (int, error) {
+	entrants, err := s.InactiveEntrants(days, inactiveReportPeriod)
+	if err != nil || len(entrants) == 0 {
+		return 0, err
+	}
+	items := make([]map[string]any, 0, len(entrants))
+	for _, client := range entrants {
+		items = append(items, map[string]any{
+			"inboundId":  client.InboundId,
+			"email":      client.Email,
+			"tgId":       client.TgId,
+			"tags":       client.Tags,
+			"lastActive": client.LastActive,
+		})
+	}
+	s.webhookService.Emit(WebhookClientsInactive, map[string]any{
+		"days":    days,
+		"count":   len(entrants),
+		"clients": items,
+	})
+	tgbot := Tgbot{}
+	tgbot.NotifyInactiveClients(days, entrants)
+	return len(entrants), nil
+}
+
+// inactiveDigestPage is how many clients of the inactive digest go in a message.
+const inactiveDigestPage = 30
+
+// NotifyInactiveClients tells the admins about the clients that became
+// inactive for days.
+func (t *Tgbot) NotifyInactiveClients(days int, clients []InactiveClient) {
+	if !t.AlertsOn(AlertInactive) || len(clients) == 0 {
+		return
+	}
+	loc, err := t.settingService.GetTimeLocation()
+	if err != nil {
+		logger.Warning("Unable to get the time zone of the inactive clients:", err)
+		loc = time.Local
+	}
+	lines := make([]string, 0, len(clients))
+	for _, client := range clients {
+		date := "-"
+		if client.LastActive > 0 {
+			date = time.UnixMilli(client.LastActive).In(loc).Format("2006-01-02")
+		}
+		tags := ""
+		if len(client.Tags) > 0 {
+			tags = " 🏷 " + html.EscapeString(strings.Join(client.Tags, ", "))
+		}
+		lines = append(lines, t.I18nBot("tgbot.messages.inactiveDigestLine",
+			"Email=="+html.EscapeString(client.Email), "Date=="+date, "Tags=="+tags))
+	}
+	msg := t.I18nBot("tgbot.messages.inactiveDigest", "Days=="+strconv.Itoa(days), "Count=="+strconv.Itoa(len(clients)))
+	// Pages of clients are apart, so that a long digest is split between them
+	for start := 0; start < len(lines); start += inactiveDigestPage {
+		msg += "\r\n" + strings.Join(lines[start:min(start+inactiveDigestPage, len(lines))], "")
+	}
+	t.SendAlert(AlertInactive, msg)
+}
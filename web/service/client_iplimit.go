@@ -0,0 +1,258 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/web/network"
+	"x-ui/xray"
+
+	"github.com/goccy/go-json"
+	"gorm.io/gorm"
+)
+
+// ClientIps are the IPs a client was seen from within the IP limit window and
+// the ones it was last disabled for.
+type ClientIps struct {
+	Email          string     `json:"email"`
+	LimitIp        int        `json:"limitIp"`
+	Ips            []ClientIp `json:"ips"`
+	BlockedIps     []ClientIp `json:"blockedIps"`
+	BlockedAt      int64      `json:"blockedAt,omitempty"`
+	DisabledReason string     `json:"disabledReason,omitempty"`
+	DisabledAt     int64      `json:"disabledAt,omitempty"`
+}
+
+// ClientIp is an IP as it was seen and the source it counts as toward the IP
+// limit.
+type ClientIp struct {
+	Ip     string `json:"ip"`
+	Source string `json:"source"`
+	// Device is the label of the device the IP is of, by the subscription
+	// fetches, if the IP limit attributes the IPs to devices
+	Device string `json:"device,omitempty"`
+}
+
+// clientIpsOf parses a list of IPs as it is stored in inbound_client_ips.
+func clientIpsOf(column string, v6Prefix int) []ClientIp {
+	var ips []string
+	json.Unmarshal([]byte(column), &ips)
+	result := make([]ClientIp, 0, len(ips))
+	for _, ip := range ips {
+		source, ok := network.IpSource(ip, v6Prefix)
+		if !ok {
+			source = ip
+		}
+		result = append(result, ClientIp{Ip: ip, Source: source})
+	}
+	return result
+}
+
+// GetClientIps returns the IP record of a client.
+func (s *InboundService) GetClientIps(email string) (*ClientIps, error) {
+	traffic, client, err := s.GetClientByEmail(email)
+	if err != nil {
+		return nil, err
+	}
+	result := &ClientIps{
+		Email:          traffic.Email,
+		LimitIp:        client.LimitIP,
+		Ips:            []ClientIp{},
+		BlockedIps:     []ClientIp{},
+		DisabledReason: traffic.DisabledReason,
+		DisabledAt:     traffic.DisabledAt,
+	}
+	var records []model.InboundClientIps
+	err = database.GetDB().Where("client_email = ?", traffic.Email).Limit(1).Find(&records).Error
+	if err != nil || len(records) == 0 {
+		return result, err
+	}
+	v6Prefix, err := s.settingService.GetIpLimitIpv6Prefix()
+	if err != nil {
+		return nil, err
+	}
+	result.Ips = clientIpsOf(records[0].Ips, v6Prefix)
+	result.BlockedIps = clientIpsOf(records[0].BlockedIps, v6Prefix)
+	result.BlockedAt = records[0].BlockedAt
+
+	window, err := s.settingService.GetIpLimitDevices()
+	if err != nil || window <= 0 {
+		return result, err
+	}
+	if err := s.attributeDevices(traffic.Email, client.SubID, window, v6Prefix, time.Now().UnixMilli(), result.Ips); err != nil {
+		return nil, err
+	}
+	if err := s.attributeDevices(traffic.Email, client.SubID, window, v6Prefix, result.BlockedAt, result.BlockedIps); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// DisableIpLimitedClients disables the traffic of the clients in blocked, by
+// their emails, for connecting from more IPs than they may, records the IPs
+// beyond their limit and removes them from Xray. It returns the number of clients
+// disabled and whether Xray has to be restarted.
+func (s *InboundService) DisableIpLimitedClients(blocked map[string][]string) (int64, bool, error) {
+	if len(blocked) == 0 {
+		return 0, false, nil
+	}
+	emails := make([]string, 0, len(blocked))
+	for email := range blocked {
+		emails = append(emails, email)
+	}
+
+	db := database.GetDB()
+	var results []struct {
+		Tag   string
+		Email string
+	}
+	err := db.Table("inbounds").
+		Select("inbounds.tag, client_traffics.email").
+		Joins("JOIN client_traffics ON inbounds.id = client_traffics.inbound_id").
+		Where("client_traffics.email IN ? AND client_traffics.enable = ? AND inbounds.enable = ?", emails, true, true).
+		Scan(&results).Error
+	if err != nil || len(results) == 0 {
+		return 0, false, err
+	}
+
+	now := time.Now().UnixMilli()
+	count := int64(0)
+	err = database.Transaction(func(tx *gorm.DB) error {
+		for _, result := range results {
+			update := tx.Model(xray.ClientTraffic{}).
+				Where("email = ? AND enable = ?", result.Email, true).
+				Updates(map[string]any{
+					"enable":          false,
+					"disabled_reason": ClientDisabledIpLimit,
+					"disabled_at":     now,
+				})
+			if update.Error != nil {
+				return update.Error
+			}
+			count += update.RowsAffected
+
+			ips, _ := json.Marshal(blocked[result.Email])
+			update = tx.Model(model.InboundClientIps{}).Where("client_email = ?", result.Email).
+				Updates(map[string]any{"blocked_ips": string(ips), "blocked_at": now})
+			if update.Error != nil {
+				return update.Error
+			}
+			if update.RowsAffected == 0 {
+				err := tx.Create(&model.InboundClientIps{
+					ClientEmail: result.Email,
+					Ips:         string(ips),
+					BlockedIps:  string(ips),
+					BlockedAt:   now,
+				}).Error
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, false, err
+	}
+
+	needRestart := false
+	if p != nil {
+		s.muXray.Lock()
+		defer s.muXray.Unlock()
+		if s.initXrayAPI() != nil {
+			needRestart = len(results) > 0
+		} else {
+			for _, result := range results {
+				err1 := s.xrayApi.RemoveUser(result.Tag, result.Email)
+				if err1 == nil {
+					logger.Debug("Client disabled for its IP limit by api:", result.Email)
+				} else if strings.Contains(err1.Error(), fmt.Sprintf("User %s not found.", result.Email)) {
+					logger.Debug("User is already disabled. Nothing to do more...")
+				} else {
+					logger.Debug("Error in disabling client by api:", err1)
+					needRestart = true
+				}
+			}
+			s.xrayApi.Close()
+		}
+	}
+	return count, needRestart, nil
+}
+
+// EnableIpLimitedClients enables the clients again that were disabled for
+// their IP limit before cooldown, and adds them back to Xray. It returns the
+// number of clients enabled and whether Xray has to be restarted.
+func (s *InboundService) EnableIpLimitedClients(cooldown time.Duration) (int64, bool, error) {
+	db := database.GetDB()
+	cutoff := time.Now().Add(-cooldown).UnixMilli()
+	var traffics []*xray.ClientTraffic
+	err := db.Where("enable = ? AND disabled_reason = ? AND disabled_at <= ?", false, ClientDisabledIpLimit, cutoff).
+		Find(&traffics).Error
+	if err != nil || len(traffics) == 0 {
+		return 0, false, err
+	}
+
+	emails := make([]string, 0, len(traffics))
+	for _, traffic := range traffics {
+		emails = append(emails, traffic.Email)
+	}
+	result := db.Model(xray.ClientTraffic{}).
+		Where("email IN ? AND enable = ? AND disabled_reason = ?", emails, false, ClientDisabledIpLimit).
+		Updates(enabledColumns(map[string]any{}))
+	if result.Error != nil {
+		return 0, false, result.Error
+	}
+
+	needRestart := false
+	if p != nil {
+		s.muXray.Lock()
+		defer s.muXray.Unlock()
+		if s.initXrayAPI() != nil {
+			needRestart = true
+		} else {
+			for _, traffic := range traffics {
+				inbound, err := s.GetInbound(traffic.InboundId)
+				if err != nil || !inbound.Enable {
+					continue
+				}
+				clients, err := s.GetClients(inbound)
+				if err != nil {
+					needRestart = true
+					continue
+				}
+				for _, client := range clients {
+					if client.Email != traffic.Email || !client.Enable {
+						continue
+					}
+					cipher := ""
+					if inbound.Protocol == model.Shadowsocks {
+						var settings map[string]any
+						json.Unmarshal([]byte(inbound.Settings), &settings)
+						cipher, _ = settings["method"].(string)
+					}
+					err1 := s.xrayApi.AddUser(string(inbound.Protocol), inbound.Tag, map[string]any{
+						"email":    client.Email,
+						"id":       client.ID,
+						"security": client.Security,
+						"flow":     client.Flow,
+						"password": client.Password,
+						"cipher":   cipher,
+					})
+					if err1 == nil {
+						logger.Debug("Client enabled after its IP limit cooldown:", client.Email)
+					} else {
+						logger.Debug("Error in enabling client by api:", err1)
+						needRestart = true
+					}
+					break
+				}
+			}
+			s.xrayApi.Close()
+		}
+	}
+	return result.RowsAffected, needRestart, nil
+}
@@ -0,0 +1,93 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/xray"
+)
+
+func TestIpLimitedClientsLifecycle(t *testing.T) {
+	inbound := lifecycleTestDB(t, []xray.ClientTraffic{
+		{Email: "shared", Enable: true},
+		{Email: "fine", Enable: true},
+		{Email: "quota", Enable: false, Up: 200, Total: 100, DisabledReason: ClientDisabledQuota, DisabledAt: 1},
+	})
+	var s InboundService
+
+	blocked := map[string][]string{"shared": {"203.0.113.7", "2001:db8::/64"}, "quota": {"198.51.100.1"}}
+	count, _, err := s.DisableIpLimitedClients(blocked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A client disabled already keeps its reason
+	if count != 1 {
+		t.Errorf("disabled %d clients, want 1", count)
+	}
+	if stored := clientTraffic(t, "shared"); stored.Enable || stored.DisabledReason != ClientDisabledIpLimit {
+		t.Errorf("the shared client is %v %q", stored.Enable, stored.DisabledReason)
+	}
+	if stored := clientTraffic(t, "quota"); stored.DisabledReason != ClientDisabledQuota {
+		t.Errorf("the depleted client got the reason %q", stored.DisabledReason)
+	}
+	var record model.InboundClientIps
+	if err := database.GetDB().Where("client_email = ?", "shared").First(&record).Error; err != nil {
+		t.Fatal(err)
+	}
+	if record.BlockedIps != `["203.0.113.7","2001:db8::/64"]` || record.BlockedAt == 0 {
+		t.Errorf("the blocked IPs are recorded as %s at %d", record.BlockedIps, record.BlockedAt)
+	}
+
+	// The inbound lists count the client apart from the depleted ones
+	inbounds, _, err := s.ListInbounds(10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := model.InboundClientCounts{Active: 1, Quota: 1, IpLimit: 1}
+	if len(inbounds) != 1 || inbounds[0].Id != inbound.Id || *inbounds[0].ClientCounts != want {
+		t.Errorf("counts are %+v, want %+v", inbounds[0].ClientCounts, want)
+	}
+	summaries, _, err := s.ListInboundSummaries(10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(summaries) != 1 || *summaries[0].ClientCounts != want {
+		t.Errorf("summary counts are %+v, want %+v", summaries[0].ClientCounts, want)
+	}
+
+	// Within the cooldown the client stays disabled, after it it is enabled
+	if count, _, err := s.EnableIpLimitedClients(time.Hour); err != nil || count != 0 {
+		t.Errorf("enabled %d clients within the cooldown, %v", count, err)
+	}
+	if count, _, err := s.EnableIpLimitedClients(0); err != nil || count != 1 {
+		t.Errorf("enabled %d clients after the cooldown, %v", count, err)
+	}
+	if stored := clientTraffic(t, "shared"); !stored.Enable || stored.DisabledReason != "" {
+		t.Errorf("the cooled down client is %v %q", stored.Enable, stored.DisabledReason)
+	}
+	if clientTraffic(t, "quota").Enable {
+		t.Error("the cooldown enabled a depleted client")
+	}
+}
+
+func TestClientIpsOfKeepsRawAddresses(t *testing.T) {
+	got := clientIpsOf(`["::ffff:203.0.113.7","2001:db8:1:2::1","bogus"]`, 64)
+	want := []ClientIp{
+		{Ip: "::ffff:203.0.113.7", Source: "203.0.113.7"},
+		{Ip: "2001:db8:1:2::1", Source: "2001:db8:1:2::/64"},
+		{Ip: "bogus", Source: "bogus"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("ip %d is %+v, want %+v", i, got[i], want[i])
+		}
+	}
+	if got := clientIpsOf("", 64); len(got) != 0 {
+		t.Errorf("an empty column gave %+v", got)
+	}
+}
@@ -0,0 +1,113 @@
+package service
+
+import (
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/xray"
+
+	"gorm.io/gorm"
+)
+
+const (
+	ClientDisabledQuota  = "quota"
+	ClientDisabledExpiry = "expiry"
+	ClientDisabledAdmin  = "admin"
+	// ClientDisabledIpLimit is a client that connected from more IPs than its
+	// limit allows; it is enabled again after the IP limit cooldown
+	ClientDisabledIpLimit = "iplimit"
+)
+
+// disabledReason is the reason a depleted client is disabled for; a client
+// disabled by an admin keeps that reason, and expiry goes before quota since a
+// top-up alone doesn't bring an expired client back.
+func disabledReason(now int64) any {
+	return gorm.Expr(`CASE
+		WHEN disabled_reason = ? THEN disabled_reason
+		WHEN expiry_time > 0 AND expiry_time <= ? THEN ?
+		ELSE ? END`, ClientDisabledAdmin, now, ClientDisabledExpiry, ClientDisabledQuota)
+}
+
+// enabledColumns adds to the columns of an update that enables the traffic of
+// clients again the ones that clear their depletion. If they are still over
+// quota or expired, the next traffic run disables them again, with the reason
+// left.
+func enabledColumns(columns map[string]any) map[string]any {
+	columns["enable"] = true
+	columns["disabled_reason"] = gorm.Expr("CASE WHEN disabled_reason = ? THEN disabled_reason ELSE '' END", ClientDisabledAdmin)
+	columns["disabled_at"] = gorm.Expr("CASE WHEN disabled_reason = ? THEN disabled_at ELSE 0 END", ClientDisabledAdmin)
+	return columns
+}
+
+// enableTraffic is enabledColumns for a traffic that is saved whole.
+func enableTraffic(traffic *xray.ClientTraffic) {
+	traffic.Enable = true
+	if traffic.DisabledReason != ClientDisabledAdmin {
+		traffic.DisabledReason = ""
+		traffic.DisabledAt = 0
+	}
+}
+
+// savedColumns adds to the columns of an update that saves the settings of a
+// client its disabled state: the depletion is cleared as by enabledColumns, and
+// a client disabled in its settings is disabled by an admin, since when it
+// first was.
+func savedColumns(columns map[string]any, client *model.Client) map[string]any {
+	columns["enable"] = true
+	if client.Enable {
+		columns["disabled_reason"] = ""
+		columns["disabled_at"] = 0
+		return columns
+	}
+	columns["disabled_reason"] = ClientDisabledAdmin
+	columns["disabled_at"] = gorm.Expr("CASE WHEN disabled_reason = ? THEN disabled_at ELSE ? END", ClientDisabledAdmin, time.Now().UnixMilli())
+	return columns
+}
+
+// SetClientCounts fills in the ClientCounts of inbounds from their ClientStats.
+func SetClientCounts(inbounds ...*model.Inbound) {
+	for _, inbound := range inbounds {
+		counts := &model.InboundClientCounts{}
+		for _, traffic := range inbound.ClientStats {
+			switch {
+			case traffic.DisabledReason == ClientDisabledAdmin:
+				counts.Admin++
+			case !traffic.Enable && traffic.DisabledReason == ClientDisabledExpiry:
+				counts.Expiry++
+			case !traffic.Enable && traffic.DisabledReason == ClientDisabledIpLimit:
+				counts.IpLimit++
+			case !traffic.Enable:
+				counts.Quota++
+			default:
+				counts.Active++
+			}
+		}
+		inbound.ClientCounts = counts
+	}
+}
+
+// MigrationDisabledReasons gives the disabled clients of older panels the
+// reason they are disabled for.
+func (s *InboundService) MigrationDisabledReasons() {
+	db := database.GetDB()
+	now := time.Now().UnixMilli()
+	err := db.Exec(`
+		UPDATE client_traffics SET disabled_reason = ?, disabled_at = ?
+		WHERE COALESCE(disabled_reason, '') = '' AND email IN (
+			SELECT `+database.JSONText("client.value", "$.email")+`
+			FROM inbounds,
+				`+database.JSONEach("inbounds.settings", "$.clients", "client")+`
+			WHERE `+database.JSONBool("client.value", "$.enable")+` = 0
+		)`, ClientDisabledAdmin, now).Error
+	if err == nil {
+		err = db.Model(xray.ClientTraffic{}).
+			Where("enable = ? AND COALESCE(disabled_reason, '') = ''", false).
+			Where("(total > 0 AND up + down >= total) OR (expiry_time > 0 AND expiry_time <= ?)", now).
+			Updates(map[string]any{"disabled_reason": disabledReason(now), "disabled_at": now}).Error
+	}
+	if err != nil {
+		logger.Warning("Error in migrating disabled reasons:", err)
+	}
+}
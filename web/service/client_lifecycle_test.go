@@ -0,0 +1,191 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/xray"
+
+	"gorm.io/gorm"
+)
+
+// lifecycleTestDB opens an empty database with an inbound of the clients of
+// traffics, saving their traffics.
+func lifecycleTestDB(t *testing.T, traffics []xray.ClientTraffic) *model.Inbound {
+	t.Helper()
+	db := newTestDB(t)
+	settings := `{"clients":[`
+	for i, traffic := range traffics {
+		if i > 0 {
+			settings += ","
+		}
+		enable := "true"
+		if traffic.DisabledReason == ClientDisabledAdmin {
+			enable = "false"
+		}
+		settings += `{"password":"p` + traffic.Email + `","email":"` + traffic.Email + `","enable":` + enable + `}`
+	}
+	inbound := &model.Inbound{
+		Remark: "trojan", Enable: true, Port: 20003, Protocol: model.Trojan, Tag: "inbound-20003",
+		Settings: settings + `]}`,
+	}
+	if err := db.Create(inbound).Error; err != nil {
+		t.Fatal(err)
+	}
+	for i := range traffics {
+		traffics[i].InboundId = inbound.Id
+		if err := db.Create(&traffics[i]).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	return inbound
+}
+
+func clientTraffic(t *testing.T, email string) *xray.ClientTraffic {
+	t.Helper()
+	var traffic xray.ClientTraffic
+	if err := database.GetDB().Where("email = ?", email).First(&traffic).Error; err != nil {
+		t.Fatal(err)
+	}
+	return &traffic
+}
+
+func disableClients(t *testing.T) []xray.ClientTraffic {
+	t.Helper()
+	var s InboundService
+	var disabled []xray.ClientTraffic
+	err := database.GetDB().Transaction(func(tx *gorm.DB) error {
+		var err error
+		_, disabled, err = s.disableInvalidClients(tx)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return disabled
+}
+
+func TestClientDisableTransitions(t *testing.T) {
+	past := time.Now().Add(-time.Hour).UnixMilli()
+	future := time.Now().Add(time.Hour).UnixMilli()
+	lifecycleTestDB(t, []xray.ClientTraffic{
+		{Email: "active", Enable: true, Up: 10, Total: 100, ExpiryTime: future},
+		{Email: "quota", Enable: true, Up: 60, Down: 40, Total: 100},
+		{Email: "expiry", Enable: true, Up: 10, Total: 100, ExpiryTime: past},
+		{Email: "both", Enable: true, Up: 200, Total: 100, ExpiryTime: past},
+		{Email: "admin", Enable: true, Up: 200, Total: 100, DisabledReason: ClientDisabledAdmin, DisabledAt: 1},
+		{Email: "unlimited", Enable: true, Up: 1 << 40},
+		{Email: "already", Enable: false, Up: 200, Total: 100, DisabledReason: ClientDisabledQuota, DisabledAt: 1},
+	})
+
+	disabled := disableClients(t)
+	reasons := map[string]string{}
+	for _, traffic := range disabled {
+		reasons[traffic.Email] = traffic.DisabledReason
+	}
+	want := map[string]string{
+		"quota":  ClientDisabledQuota,
+		"expiry": ClientDisabledExpiry,
+		// An expired client is not brought back by a top-up alone
+		"both":  ClientDisabledExpiry,
+		"admin": ClientDisabledAdmin,
+	}
+	if len(reasons) != len(want) {
+		t.Errorf("disabled %v, want %v", reasons, want)
+	}
+	for email, reason := range want {
+		if reasons[email] != reason {
+			t.Errorf("%s was disabled for %q, want %q", email, reasons[email], reason)
+		}
+		stored := clientTraffic(t, email)
+		if stored.Enable || stored.DisabledReason != reason || stored.DisabledAt == 0 {
+			t.Errorf("%s is stored as %v %q %d", email, stored.Enable, stored.DisabledReason, stored.DisabledAt)
+		}
+	}
+	for _, email := range []string{"active", "unlimited"} {
+		if !clientTraffic(t, email).Enable {
+			t.Errorf("%s was disabled", email)
+		}
+	}
+	if stored := clientTraffic(t, "already"); stored.DisabledAt != 1 {
+		t.Error("a disabled client was disabled again")
+	}
+
+	// A second run has nothing left to disable
+	if again := disableClients(t); len(again) != 0 {
+		t.Errorf("the second run disabled %v", again)
+	}
+}
+
+func TestClientReenableTransitions(t *testing.T) {
+	past := time.Now().Add(-time.Hour).UnixMilli()
+	lifecycleTestDB(t, []xray.ClientTraffic{
+		{Email: "quota", Enable: false, Up: 200, Total: 100, DisabledReason: ClientDisabledQuota, DisabledAt: 1},
+		{Email: "both", Enable: false, Up: 200, Total: 100, ExpiryTime: past, DisabledReason: ClientDisabledExpiry, DisabledAt: 1},
+		{Email: "admin", Enable: false, Up: 200, Total: 100, DisabledReason: ClientDisabledAdmin, DisabledAt: 1},
+	})
+	db := database.GetDB()
+
+	// A top-up enables the clients, the admin keeps its reason
+	err := db.Model(xray.ClientTraffic{}).Where("1 = 1").
+		Updates(enabledColumns(map[string]any{"total": 1000})).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	for email, reason := range map[string]string{"quota": "", "both": "", "admin": ClientDisabledAdmin} {
+		stored := clientTraffic(t, email)
+		if !stored.Enable || stored.DisabledReason != reason {
+			t.Errorf("after the top-up %s is %v %q, want enabled with %q", email, stored.Enable, stored.DisabledReason, reason)
+		}
+	}
+	// The expired client is disabled again, for its expiry
+	disabled := disableClients(t)
+	reasons := map[string]string{}
+	for _, traffic := range disabled {
+		reasons[traffic.Email] = traffic.DisabledReason
+	}
+	if len(reasons) != 1 || reasons["both"] != ClientDisabledExpiry {
+		t.Errorf("after the top-up disabled %v, want both for expiry", reasons)
+	}
+}
+
+func TestResetClientTrafficReenables(t *testing.T) {
+	inbound := lifecycleTestDB(t, []xray.ClientTraffic{
+		{Email: "quota", Enable: false, Up: 60, Down: 40, Total: 100, DisabledReason: ClientDisabledQuota, DisabledAt: 1},
+		{Email: "admin", Enable: false, Up: 60, Down: 40, Total: 100, DisabledReason: ClientDisabledAdmin, DisabledAt: 1},
+	})
+	var s InboundService
+	for _, email := range []string{"quota", "admin"} {
+		if _, err := s.ResetClientTraffic(inbound.Id, email, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stored := clientTraffic(t, "quota"); !stored.Enable || stored.Up+stored.Down != 0 || stored.DisabledReason != "" || stored.DisabledAt != 0 {
+		t.Errorf("the reset client is %+v", stored)
+	}
+	if stored := clientTraffic(t, "admin"); stored.DisabledReason != ClientDisabledAdmin {
+		t.Errorf("the reset admin disabled client lost its reason: %+v", stored)
+	}
+	if len(disableClients(t)) != 0 {
+		t.Error("a reset client was disabled again")
+	}
+}
+
+func TestSetClientCounts(t *testing.T) {
+	inbound := &model.Inbound{ClientStats: []xray.ClientTraffic{
+		{Enable: true},
+		{Enable: true},
+		{Enable: false, DisabledReason: ClientDisabledQuota},
+		{Enable: false, DisabledReason: ClientDisabledExpiry},
+		{Enable: true, DisabledReason: ClientDisabledAdmin},
+		{Enable: false, DisabledReason: ClientDisabledAdmin},
+		{Enable: false},
+	}}
+	SetClientCounts(inbound)
+	want := model.InboundClientCounts{Active: 2, Quota: 2, Expiry: 1, Admin: 2}
+	if *inbound.ClientCounts != want {
+		t.Errorf("counts are %+v, want %+v", *inbound.ClientCounts, want)
+	}
+}
@@ -0,0 +1,292 @@
+package service
+
+import (
+	"fmt"
+	"maps"
+	"strings"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/xray"
+
+	"github.com/goccy/go-json"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// ClientMove moves a client to another inbound, or copies it there.
+type ClientMove struct {
+	InboundId int  `json:"inboundId" form:"inboundId"`
+	Copy      bool `json:"copy" form:"copy"`
+	// Email is the email of the copy, emails are unique across inbounds; a
+	// moved client keeps its own
+	Email string `json:"email" form:"email"`
+}
+
+// ClientMoveResult is a client after it was moved or copied.
+type ClientMoveResult struct {
+	Email     string `json:"email"`
+	InboundId int    `json:"inboundId"`
+	// FromInboundId is the inbound the client was moved or copied from
+	FromInboundId int  `json:"fromInboundId"`
+	Copy          bool `json:"copy"`
+}
+
+// canFlow tells whether the clients of an inbound may have an XTLS flow: VLESS
+// over TCP with TLS or Reality.
+func canFlow(inbound *model.Inbound) bool {
+	if inbound.Protocol != model.VLESS {
+		return false
+	}
+	var stream map[string]any
+	json.Unmarshal([]byte(inbound.StreamSettings), &stream)
+	network, _ := stream["network"].(string)
+	security, _ := stream["security"].(string)
+	return network == "tcp" && (security == "tls" || security == "reality")
+}
+
+// transplantClient adjusts a client from the settings of source to the protocol
+// of target, keeping its credentials where the protocol uses them.
+func transplantClient(client map[string]any, source *model.Inbound, target *model.Inbound) (map[string]any, error) {
+	moved := maps.Clone(client)
+	id, _ := moved["id"].(string)
+	password, _ := moved["password"].(string)
+	delete(moved, "id")
+	delete(moved, "password")
+	delete(moved, "security")
+	delete(moved, "method")
+	flow, _ := moved["flow"].(string)
+	delete(moved, "flow")
+	// The address of a peer is given out by the subnet of its inbound
+	delete(moved, "allowedIPs")
+	if target.Protocol != model.WireGuard || source.Protocol != model.WireGuard {
+		for _, key := range []string{"privateKey", "publicKey", "preSharedKey", "keepAlive"} {
+			delete(moved, key)
+		}
+	}
+
+	switch target.Protocol {
+	case model.VMESS, model.VLESS:
+		if id == "" {
+			// A client moved back from Trojan gets its UUID again
+			if _, err := uuid.Parse(password); err == nil {
+				id = password
+			} else {
+				id = uuid.New().String()
+			}
+		}
+		moved["id"] = id
+		if target.Protocol == model.VMESS {
+			moved["security"] = "auto"
+		} else if flow != "" && canFlow(target) {
+			moved["flow"] = flow
+		} else {
+			moved["flow"] = ""
+		}
+	case model.Trojan:
+		if password == "" {
+			// The UUID of the client keeps working as its Trojan password
+			if id != "" {
+				password = id
+			} else {
+				password = randomLowerAndNum(10)
+			}
+		}
+		moved["password"] = password
+	case model.Shadowsocks:
+		// A Shadowsocks key must fit the method of the inbound
+		method := shadowsocksMethod(target)
+		if source.Protocol != model.Shadowsocks || password == "" || shadowsocksMethod(source) != method {
+			password = randomShadowsocksPassword(method)
+		}
+		moved["password"] = password
+		moved["method"] = ""
+	case model.WireGuard:
+		// A peer of another WireGuard inbound keeps its keys, the others get
+		// new ones as they are added
+	default:
+		return nil, common.NewError("inbound protocol has no clients:", target.Protocol)
+	}
+	return moved, nil
+}
+
+// MoveClient moves a client to another inbound with its credentials, where the
+// protocol there uses them, its subscription, tags, counters and expiry, or
+// copies it there under another email with counters of its own. The client is
+// updated in both inbounds of the running Xray. It returns whether Xray has to
+// be restarted.
+func (s *InboundService) MoveClient(email string, move *ClientMove) (*ClientMoveResult, bool, error) {
+	traffic, source, err := s.GetClientInboundByEmail(email)
+	if err != nil {
+		return nil, false, err
+	}
+	if traffic == nil || source == nil {
+		return nil, false, common.NewError("client not found:", email)
+	}
+	if move.InboundId == source.Id {
+		return nil, false, common.NewError("the client is in this inbound already")
+	}
+	newEmail := traffic.Email
+	if move.Copy {
+		newEmail = strings.TrimSpace(move.Email)
+		if newEmail == "" {
+			return nil, false, common.NewError("a copy needs an email of its own")
+		}
+	}
+
+	_, unlock := s.lockInbounds(map[int]map[string]bool{source.Id: nil, move.InboundId: nil})
+	defer unlock()
+
+	source, err = s.GetInbound(source.Id)
+	if err != nil {
+		return nil, false, err
+	}
+	target, err := s.GetInbound(move.InboundId)
+	if err != nil {
+		return nil, false, err
+	}
+	// A moved client only takes its own email along
+	_, err = s.checkClientEmails([]model.Client{{Email: newEmail}}, func(use *ClientEmailUse) bool {
+		return !move.Copy && use.InboundId == source.Id && strings.EqualFold(use.Email, traffic.Email)
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	var sourceSettings, targetSettings map[string]any
+	if err := json.Unmarshal([]byte(source.Settings), &sourceSettings); err != nil {
+		return nil, false, err
+	}
+	if err := json.Unmarshal([]byte(target.Settings), &targetSettings); err != nil {
+		return nil, false, err
+	}
+	sourceClients, _ := sourceSettings["clients"].([]any)
+	var client map[string]any
+	remaining := make([]any, 0, len(sourceClients))
+	for _, item := range sourceClients {
+		c, _ := item.(map[string]any)
+		if e, _ := c["email"].(string); c != nil && client == nil && strings.EqualFold(e, traffic.Email) {
+			client = c
+			if move.Copy {
+				remaining = append(remaining, item)
+			}
+			continue
+		}
+		remaining = append(remaining, item)
+	}
+	if client == nil {
+		return nil, false, common.NewError("client not found:", email)
+	}
+	if !move.Copy && len(remaining) == 0 {
+		return nil, false, common.NewError("no client remained in Inbound")
+	}
+	moved, err := transplantClient(client, source, target)
+	if err != nil {
+		return nil, false, err
+	}
+	moved["email"] = newEmail
+	sourceSettings["clients"] = remaining
+	targetClients, _ := targetSettings["clients"].([]any)
+	before := limitedClients(targetClients)
+	if err := checkInboundLimits(target, before, append(before, limitedClients([]any{moved})...), time.Now().UnixMilli()); err != nil {
+		s.limitRejected(err)
+		return nil, false, err
+	}
+	if target.Protocol == model.WireGuard {
+		subnet, err := wireguardSubnet(targetSettings)
+		if err != nil {
+			return nil, false, err
+		}
+		if err := fillWireguardPeers([]any{moved}, subnet, targetClients); err != nil {
+			return nil, false, err
+		}
+	}
+	targetSettings["clients"] = append(targetClients, moved)
+
+	err = database.Transaction(func(tx *gorm.DB) error {
+		for _, update := range []struct {
+			inbound  *model.Inbound
+			settings map[string]any
+		}{{source, sourceSettings}, {target, targetSettings}} {
+			if update.inbound == source && move.Copy {
+				continue
+			}
+			settings, err := json.MarshalIndent(update.settings, "", "  ")
+			if err != nil {
+				return err
+			}
+			err = tx.Model(model.Inbound{}).Where("id = ?", update.inbound.Id).Update("settings", string(settings)).Error
+			if err != nil {
+				return err
+			}
+		}
+		if !move.Copy {
+			return tx.Model(xray.ClientTraffic{}).Where("id = ?", traffic.Id).Update("inbound_id", target.Id).Error
+		}
+		return tx.Create(&xray.ClientTraffic{
+			InboundId:      target.Id,
+			Enable:         traffic.Enable,
+			Email:          newEmail,
+			ExpiryTime:     traffic.ExpiryTime,
+			Total:          traffic.Total,
+			CarriedOver:    traffic.CarriedOver,
+			Reset:          traffic.Reset,
+			Tags:           traffic.Tags,
+			DisabledReason: traffic.DisabledReason,
+			DisabledAt:     traffic.DisabledAt,
+		}).Error
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	result := &ClientMoveResult{Email: newEmail, InboundId: target.Id, FromInboundId: source.Id, Copy: move.Copy}
+	enabled, _ := client["enable"].(bool)
+	if p == nil || !enabled || !traffic.Enable {
+		return result, false, nil
+	}
+
+	needRestart := false
+	s.muXray.Lock()
+	defer s.muXray.Unlock()
+	if err := s.initXrayAPI(); err != nil {
+		return result, true, nil
+	}
+	defer s.xrayApi.Close()
+	if !move.Copy && source.Enable {
+		err1 := s.xrayApi.RemoveUser(source.Tag, traffic.Email)
+		if err1 == nil {
+			logger.Debug("Client moved out by api:", traffic.Email)
+		} else if !strings.Contains(err1.Error(), fmt.Sprintf("User %s not found.", traffic.Email)) {
+			logger.Debug("Error in moving client by api:", err1)
+			needRestart = true
+		}
+	}
+	if target.Enable {
+		var user model.Client
+		data, _ := json.Marshal(moved)
+		json.Unmarshal(data, &user)
+		cipher := ""
+		if target.Protocol == model.Shadowsocks {
+			cipher = shadowsocksMethod(target)
+		}
+		err1 := s.xrayApi.AddUser(string(target.Protocol), target.Tag, map[string]any{
+			"email":    user.Email,
+			"id":       user.ID,
+			"security": user.Security,
+			"flow":     user.Flow,
+			"password": user.Password,
+			"cipher":   cipher,
+		})
+		if err1 == nil {
+			logger.Debug("Client moved in by api:", user.Email)
+		} else {
+			logger.Debug("Error in moving client by api:", err1)
+			needRestart = true
+		}
+	}
+	return result, needRestart, nil
+}
@@ -0,0 +1,224 @@
+package service
+
+import (
+	"math"
+	"time"
+
+	"x-ui/database"
+	"x-ui/web/entity"
+	"x-ui/xray"
+
+	"gorm.io/gorm"
+)
+
+// ClientThresholdCrossing is a client that crossed Percent of its traffic, a
+// traffic notification threshold.
+type ClientThresholdCrossing struct {
+	InboundId  int    `json:"inboundId"`
+	Email      string `json:"email"`
+	TgId       int64  `json:"tgId,omitempty"`
+	Percent    int    `json:"percent,omitempty"`
+	Up         int64  `json:"up"`
+	Down       int64  `json:"down"`
+	Total      int64  `json:"total"`
+	ExpiryTime int64  `json:"expiryTime"`
+}
+
+// ClientExpiryReminder is a client that is Days from its expiry, 0 on the day
+// it expires, and is due a reminder.
+type ClientExpiryReminder struct {
+	InboundId  int    `json:"inboundId"`
+	Email      string `json:"email"`
+	TgId       int64  `json:"tgId,omitempty"`
+	Days       int    `json:"days"`
+	Up         int64  `json:"up"`
+	Down       int64  `json:"down"`
+	Total      int64  `json:"total"`
+	ExpiryTime int64  `json:"expiryTime"`
+}
+
+// notifiedTraffic is the traffic of an active client with its Telegram ID.
+type notifiedTraffic struct {
+	xray.ClientTraffic
+	TgId int64
+}
+
+// trafficThreshold returns the highest of thresholds, in percent, the usage of
+// a client is past, or 0.
+func trafficThreshold(traffic *xray.ClientTraffic, thresholds []int) int {
+	if traffic.Total <= 0 {
+		return 0
+	}
+	percent := (traffic.Up + traffic.Down) * 100 / traffic.Total
+	level := 0
+	for _, threshold := range thresholds {
+		if percent >= int64(threshold) {
+			level = threshold
+		}
+	}
+	return level
+}
+
+// daysUntil returns the number of days from the day of now to the day of
+// expiryTime, both in loc.
+func daysUntil(expiryTime int64, now time.Time, loc *time.Location) int {
+	year, month, day := now.In(loc).Date()
+	today := time.Date(year, month, day, 0, 0, 0, 0, loc)
+	year, month, day = time.UnixMilli(expiryTime).In(loc).Date()
+	expiryDay := time.Date(year, month, day, 0, 0, 0, 0, loc)
+	// Days across a daylight saving change are an hour off 24 hours
+	return int(math.Round(expiryDay.Sub(today).Hours() / 24))
+}
+
+// expiryReminderThreshold returns the lowest of thresholds, in days, that days
+// is within, or -1.
+func expiryReminderThreshold(days int, thresholds []int) int {
+	for _, threshold := range thresholds {
+		if days <= threshold {
+			return threshold
+		}
+	}
+	return -1
+}
+
+// notifiedClients returns the traffic of the active clients matching where,
+// with their Telegram ID.
+func notifiedClients(where string, args ...any) ([]notifiedTraffic, error) {
+	traffics := make([]notifiedTraffic, 0)
+	err := database.GetDB().Raw(`
+		SELECT traffic.*, COALESCE(`+database.JSONInt("client.value", "$.tgId")+`, 0) AS tg_id
+		FROM client_traffics AS traffic
+			JOIN inbounds ON inbounds.id = traffic.inbound_id
+			LEFT JOIN `+database.JSONEach("inbounds.settings", "$.clients", "client")+`
+				ON `+database.JSONText("client.value", "$.email")+` = traffic.email
+		WHERE traffic.enable = ? AND inbounds.enable = ? AND (`+where+`)`,
+		append([]any{true, true}, args...)...).Scan(&traffics).Error
+	return traffics, err
+}
+
+// CheckNotifyThresholds returns the active clients that crossed one of the
+// traffic notification thresholds set since the last check. Every client
+// records the threshold it is past, so it is notified of each once; a traffic
+// reset or a higher quota lowers the record, and the thresholds are notified
+// again when they are crossed again.
+func (s *InboundService) CheckNotifyThresholds() ([]ClientThresholdCrossing, error) {
+	percentsSetting, err := s.settingService.GetNotifyTrafficPercents()
+	if err != nil {
+		return nil, err
+	}
+	percents, err := entity.ParseThresholds(percentsSetting, 1, 100)
+	if err != nil {
+		return nil, err
+	}
+	if len(percents) == 0 {
+		return nil, nil
+	}
+
+	traffics, err := notifiedClients("traffic.total > 0 OR traffic.last_notified_threshold > 0")
+	if err != nil {
+		return nil, err
+	}
+
+	crossings := make([]ClientThresholdCrossing, 0)
+	err = database.Transaction(func(tx *gorm.DB) error {
+		for i := range traffics {
+			traffic := &traffics[i]
+			crossing := ClientThresholdCrossing{
+				InboundId:  traffic.InboundId,
+				Email:      traffic.Email,
+				TgId:       traffic.TgId,
+				Up:         traffic.Up,
+				Down:       traffic.Down,
+				Total:      traffic.Total,
+				ExpiryTime: traffic.ExpiryTime,
+			}
+
+			percent := trafficThreshold(&traffic.ClientTraffic, percents)
+			if percent == traffic.LastNotifiedThreshold {
+				continue
+			}
+			if percent > traffic.LastNotifiedThreshold {
+				crossing.Percent = percent
+				crossings = append(crossings, crossing)
+			}
+			err := tx.Model(xray.ClientTraffic{}).Where("id = ?", traffic.Id).
+				Update("last_notified_threshold", percent).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return crossings, nil
+}
+
+// CheckExpiryReminders returns the active clients due a reminder of their
+// expiry: the ones that reached one of the expiry days thresholds, counted in
+// days of the panel time zone, since their last reminder. Every threshold is
+// reminded of once for an expiry time, a renewal starts them over.
+func (s *InboundService) CheckExpiryReminders() ([]ClientExpiryReminder, error) {
+	daysSetting, err := s.settingService.GetNotifyExpiryDays()
+	if err != nil {
+		return nil, err
+	}
+	thresholds, err := entity.ParseThresholds(daysSetting, 0, 3650)
+	if err != nil {
+		return nil, err
+	}
+	if len(thresholds) == 0 {
+		return nil, nil
+	}
+	loc, err := s.settingService.GetTimeLocation()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	// The trials run out soon by design, reminders would be noise
+	traffics, err := notifiedClients("traffic.expiry_time > ? AND COALESCE(traffic.tags, '') NOT LIKE ?",
+		now.UnixMilli(), "%"+tagColumn([]string{TrialTag})+"%")
+	if err != nil {
+		return nil, err
+	}
+
+	reminders := make([]ClientExpiryReminder, 0)
+	err = database.Transaction(func(tx *gorm.DB) error {
+		for i := range traffics {
+			traffic := &traffics[i]
+			days := daysUntil(traffic.ExpiryTime, now, loc)
+			threshold := expiryReminderThreshold(days, thresholds)
+			if threshold < 0 {
+				continue
+			}
+			reminded := traffic.LastExpiryNotice == traffic.ExpiryTime
+			if reminded && threshold >= traffic.LastNotifiedExpiry {
+				continue
+			}
+			reminders = append(reminders, ClientExpiryReminder{
+				InboundId:  traffic.InboundId,
+				Email:      traffic.Email,
+				TgId:       traffic.TgId,
+				Days:       days,
+				Up:         traffic.Up,
+				Down:       traffic.Down,
+				Total:      traffic.Total,
+				ExpiryTime: traffic.ExpiryTime,
+			})
+			err := tx.Model(xray.ClientTraffic{}).Where("id = ?", traffic.Id).Updates(map[string]any{
+				"last_notified_expiry": threshold,
+				"last_expiry_notice":   traffic.ExpiryTime,
+			}).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reminders, nil
+}
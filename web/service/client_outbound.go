@@ -0,0 +1,164 @@
+package service
+
+import (
+	"slices"
+	"strings"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/xray"
+
+	"github.com/goccy/go-json"
+)
+
+// clientOutbound is an inbound and the outbound the traffic of some of its
+// clients is sent to, the routing rule of those clients.
+type clientOutbound struct {
+	inboundTag  string
+	outboundTag string
+}
+
+// OutboundTags returns the tags of the outbounds clients can be sent to: those
+// of the config template, then those of the panel.
+func (s *OutboundService) OutboundTags() ([]string, error) {
+	var settingService SettingService
+	template, err := settingService.GetXrayConfigTemplate()
+	if err != nil {
+		return nil, err
+	}
+	refs, err := parseTemplateRefs(template)
+	if err != nil {
+		return nil, err
+	}
+	var panelTags []string
+	if err := database.GetDB().Model(model.Outbound{}).Order("id").Pluck("tag", &panelTags).Error; err != nil {
+		return nil, err
+	}
+	tags := []string{}
+	for _, tag := range append(refs.outbounds, panelTags...) {
+		if tag != "" && !slices.Contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags, nil
+}
+
+// normalizeClientOutbound trims the outbound tag of a client as stored in the
+// inbound settings, and drops an empty one. It returns the tag.
+func normalizeClientOutbound(client map[string]any) (string, error) {
+	value, ok := client["outboundTag"]
+	if !ok {
+		return "", nil
+	}
+	tag, ok := value.(string)
+	if !ok && value != nil {
+		return "", common.NewError("the outbound tag of a client must be a string")
+	}
+	tag = strings.TrimSpace(tag)
+	if tag == "" {
+		delete(client, "outboundTag")
+		return "", nil
+	}
+	client["outboundTag"] = tag
+	return tag, nil
+}
+
+// checkClientOutbounds checks that the outbounds clients are sent to exist.
+func checkClientOutbounds(tags []string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+	var outboundService OutboundService
+	known, err := outboundService.OutboundTags()
+	if err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		if !slices.Contains(known, tag) {
+			return common.NewErrorf("outbound %s does not exist", tag)
+		}
+	}
+	return nil
+}
+
+// clientsByOutbound returns the emails of the clients sent to each outbound,
+// of the inbounds whose settings have text.
+func clientsByOutbound(text string) (map[string][]string, error) {
+	var inbounds []*model.Inbound
+	err := database.GetDB().Model(model.Inbound{}).Where("settings LIKE ?", "%"+text+"%").Find(&inbounds).Error
+	if err != nil {
+		return nil, err
+	}
+	emails := map[string][]string{}
+	for _, inbound := range inbounds {
+		settings := map[string][]model.Client{}
+		json.Unmarshal([]byte(inbound.Settings), &settings)
+		for _, client := range settings["clients"] {
+			if client.OutboundTag != "" {
+				emails[client.OutboundTag] = append(emails[client.OutboundTag], client.Email)
+			}
+		}
+	}
+	return emails, nil
+}
+
+// checkOutboundUnused fails if clients are sent to the outbound tag, listing
+// them; what is done to the outbound is in action, like "deleted".
+func checkOutboundUnused(tag string, action string) error {
+	clients, err := clientsByOutbound(tag)
+	if err != nil {
+		return err
+	}
+	if emails := clients[tag]; len(emails) > 0 {
+		return common.NewErrorf("outbound %s can not be %s, clients %s are sent to it", tag, action, strings.Join(emails, ", "))
+	}
+	return nil
+}
+
+// addClientOutboundRules puts a routing rule for each inbound and outbound the
+// traffic of clients is sent to before the other rules of config, with the
+// emails of those clients. Outbounds missing from config are left out.
+func addClientOutboundRules(config *xray.Config, routes []clientOutbound, emails map[clientOutbound][]string) error {
+	if len(routes) == 0 {
+		return nil
+	}
+	var outbounds []struct {
+		Tag string `json:"tag"`
+	}
+	json.Unmarshal(config.OutboundConfigs, &outbounds)
+	known := make([]string, 0, len(outbounds))
+	for _, outbound := range outbounds {
+		known = append(known, outbound.Tag)
+	}
+
+	routing := map[string]any{}
+	if len(config.RouterConfig) > 0 {
+		if err := json.Unmarshal(config.RouterConfig, &routing); err != nil || routing == nil {
+			return common.NewError("xray template config invalid: routing must be an object")
+		}
+	}
+	rules := []any{}
+	for _, route := range routes {
+		if !slices.Contains(known, route.outboundTag) {
+			logger.Warningf("The clients %s are not sent to outbound %s, it does not exist",
+				strings.Join(emails[route], ", "), route.outboundTag)
+			continue
+		}
+		rules = append(rules, map[string]any{
+			"type":        "field",
+			"inboundTag":  []string{route.inboundTag},
+			"user":        emails[route],
+			"outboundTag": route.outboundTag,
+		})
+	}
+	items, _ := routing["rules"].([]any)
+	routing["rules"] = append(rules, items...)
+	data, err := json.MarshalIndent(routing, "", "  ")
+	if err != nil {
+		return err
+	}
+	config.RouterConfig = data
+	return nil
+}
@@ -0,0 +1,173 @@
+package service
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"x-ui/database"
+	"x-ui/database/model"
+
+	"github.com/goccy/go-json"
+)
+
+// clientOutboundTestDB opens a database with the outbound residential of the
+// panel and two inbounds whose clients are sent to it and to direct.
+func clientOutboundTestDB(t *testing.T) *model.Outbound {
+	t.Helper()
+	newTestDB(t)
+	var outboundService OutboundService
+	residential, err := outboundService.AddOutbound(&model.Outbound{Tag: "residential", Protocol: "freedom", Settings: `{}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s InboundService
+	inbounds := []*model.Inbound{
+		{Remark: "vless", Enable: true, Port: 20031, Protocol: model.VLESS, Tag: "inbound-20031",
+			Settings: `{"clients":[` +
+				`{"id":"0b6f1e0a-3c1d-4a5e-9f7b-2d8c6e4a1b01","email":"a1","enable":true,"outboundTag":"residential"},` +
+				`{"id":"0b6f1e0a-3c1d-4a5e-9f7b-2d8c6e4a1b02","email":"a2","enable":true,"outboundTag":" direct "},` +
+				`{"id":"0b6f1e0a-3c1d-4a5e-9f7b-2d8c6e4a1b03","email":"a3","enable":true,"outboundTag":"residential"},` +
+				`{"id":"0b6f1e0a-3c1d-4a5e-9f7b-2d8c6e4a1b04","email":"a4","enable":true,"outboundTag":""}` +
+				`],"decryption":"none"}`},
+		{Remark: "trojan", Enable: true, Port: 20032, Protocol: model.Trojan, Tag: "inbound-20032",
+			Settings: `{"clients":[` +
+				`{"password":"b1","email":"b1","enable":true,"outboundTag":"residential"},` +
+				`{"password":"b2","email":"b2","enable":true,"outboundTag":"residential"}` +
+				`]}`},
+	}
+	for _, inbound := range inbounds {
+		if _, _, err := s.AddInbound(inbound); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return residential
+}
+
+func TestClientOutboundRules(t *testing.T) {
+	clientOutboundTestDB(t)
+	config, err := (&XrayService{}).GetXrayConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var routing struct {
+		Rules []struct {
+			InboundTag  []string `json:"inboundTag"`
+			User        []string `json:"user"`
+			OutboundTag string   `json:"outboundTag"`
+		} `json:"rules"`
+	}
+	if err := json.Unmarshal(config.RouterConfig, &routing); err != nil {
+		t.Fatal(err)
+	}
+	// One rule for each inbound and outbound, before those of the template
+	want := []string{
+		"inbound-20031 a1,a3 residential",
+		"inbound-20031 a2 direct",
+		"inbound-20032 b1,b2 residential",
+	}
+	var rules []string
+	for _, rule := range routing.Rules {
+		if len(rule.User) > 0 {
+			rules = append(rules, strings.Join(rule.InboundTag, ",")+" "+strings.Join(rule.User, ",")+" "+rule.OutboundTag)
+		}
+	}
+	if !slices.Equal(rules, want) {
+		t.Errorf("the rules of the clients are %q, want %q", rules, want)
+	}
+	if len(routing.Rules) <= len(want) || len(routing.Rules[len(want)].User) > 0 {
+		t.Errorf("the template rules don't follow those of the clients: %+v", routing.Rules)
+	}
+
+	// Xray doesn't get the outbound tag of a client
+	for _, inbound := range config.InboundConfigs {
+		if strings.Contains(string(inbound.Settings), "outboundTag") {
+			t.Errorf("the inbound %s has the settings %s", inbound.Tag, inbound.Settings)
+		}
+	}
+	// The saved settings have the tags trimmed, and empty tags dropped
+	var inbound model.Inbound
+	database.GetDB().Where("port = ?", 20031).First(&inbound)
+	var settings struct {
+		Clients []map[string]any `json:"clients"`
+	}
+	if err := json.Unmarshal([]byte(inbound.Settings), &settings); err != nil {
+		t.Fatal(err)
+	}
+	saved := []any{}
+	for _, client := range settings.Clients {
+		tag, ok := client["outboundTag"]
+		saved = append(saved, tag, ok)
+	}
+	if !slices.Equal(saved, []any{"residential", true, "direct", true, "residential", true, nil, false}) {
+		t.Errorf("the outbound tags are saved as %v", saved)
+	}
+}
+
+func TestClientOutboundChecks(t *testing.T) {
+	residential := clientOutboundTestDB(t)
+	var s InboundService
+	unknown := &model.Inbound{
+		Remark: "unknown", Enable: true, Port: 20033, Protocol: model.Trojan, Tag: "inbound-20033",
+		Settings: `{"clients":[{"password":"c1","email":"c1","enable":true,"outboundTag":"warp"}]}`,
+	}
+	if _, _, err := s.AddInbound(unknown); err == nil || !strings.Contains(err.Error(), "outbound warp does not exist") {
+		t.Errorf("a client sent to an unknown outbound was saved: %v", err)
+	}
+	unknown.Settings = `{"clients":[{"password":"c1","email":"c1","enable":true,"outboundTag":1}]}`
+	if _, _, err := s.AddInbound(unknown); err == nil {
+		t.Error("a client with a numeric outbound tag was saved")
+	}
+
+	// The outbound clients are sent to stays, with its tag
+	var outboundService OutboundService
+	err := outboundService.DelOutbound(residential.Id)
+	if err == nil || !strings.Contains(err.Error(), "clients a1, a3, b1, b2 are sent to it") {
+		t.Errorf("deleting the outbound clients are sent to returned %v", err)
+	}
+	renamed := *residential
+	renamed.Tag = "home"
+	if _, err := outboundService.UpdateOutbound(&renamed); err == nil || !strings.Contains(err.Error(), "can not be renamed") {
+		t.Errorf("renaming the outbound clients are sent to returned %v", err)
+	}
+	// So does an outbound of the template
+	template := `{"outbounds":[{"tag":"blocked","protocol":"blackhole"}],"routing":{"rules":[]}}`
+	if err := outboundService.checkTemplateOutbounds(template); err == nil || !strings.Contains(err.Error(), "outbound direct can not be removed, clients a2") {
+		t.Errorf("a template without the outbound clients are sent to returned %v", err)
+	}
+
+	tags, err := outboundService.OutboundTags()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(tags, "direct") || tags[len(tags)-1] != "residential" {
+		t.Errorf("the outbound tags are %v", tags)
+	}
+}
+
+func TestClientPatchOutbound(t *testing.T) {
+	tag := " residential "
+	patch := &ClientPatch{OutboundTag: &tag}
+	if err := patch.validate(); err != nil {
+		t.Fatal(err)
+	}
+	client := map[string]any{"email": "a1"}
+	if err := patch.apply(client, 0); err != nil {
+		t.Fatal(err)
+	}
+	if client["outboundTag"] != "residential" {
+		t.Errorf("the patched client is %v", client)
+	}
+	// An empty tag sends the client back to the routing rules
+	empty := ""
+	patch = &ClientPatch{OutboundTag: &empty}
+	if err := patch.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := patch.apply(client, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := client["outboundTag"]; ok {
+		t.Errorf("the outbound tag is left in %v", client)
+	}
+}
@@ -0,0 +1,171 @@
+package service
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/web/locale"
+
+	"github.com/goccy/go-json"
+	"gorm.io/gorm"
+)
+
+// clientRenewalKeep is how long an idempotency key of a renewal is remembered
+const clientRenewalKeep = 7 * 24 * time.Hour
+
+// muRenew makes looking up an idempotency key and renewing one step
+var muRenew sync.Mutex
+
+// ClientRenew describes a paid period of a client.
+type ClientRenew struct {
+	// Days extends the expiry from now or from the current expiry, whichever is
+	// later; clients without expiry keep none
+	Days         int     `json:"days" form:"days"`
+	ResetTraffic bool    `json:"resetTraffic" form:"resetTraffic"`
+	AddGB        float64 `json:"addGB" form:"addGB"`
+	// AllInbounds renews the client in every inbound it is in; without it a
+	// client in more than one inbound is an error
+	AllInbounds bool `json:"allInbounds" form:"allInbounds"`
+}
+
+// ClientRenewResult is the state of a client after a renewal.
+type ClientRenewResult struct {
+	Email      string `json:"email"`
+	ExpiryTime int64  `json:"expiryTime"`
+	TotalGB    int64  `json:"totalGB"`
+	Inbounds   []int  `json:"inbounds"`
+	// Replayed is set if the idempotency key was used before and nothing was
+	// renewed this time
+	Replayed bool `json:"replayed,omitempty"`
+}
+
+// inboundsOfClient returns the inbounds that have a client with email.
+func (s *InboundService) inboundsOfClient(email string) ([]int, error) {
+	ids := make([]int, 0)
+	err := database.GetDB().Raw(`
+		SELECT DISTINCT inbounds.id
+		FROM inbounds,
+			`+database.JSONEach("inbounds.settings", "$.clients", "client")+`
+		WHERE LOWER(`+database.JSONText("client.value", "$.email")+`) = LOWER(?)
+		ORDER BY inbounds.id`, email).Scan(&ids).Error
+	return ids, err
+}
+
+// renewal returns the update that renews the client with email, and the
+// inbounds it is in.
+func (s *InboundService) renewal(email string, renew *ClientRenew) (*BulkClientUpdate, []int, error) {
+	if renew.Days < 1 || renew.Days > 3650 || renew.AddGB < 0 {
+		return nil, nil, locale.NewError(locale.ErrClientRenewInvalid)
+	}
+
+	ids, err := s.inboundsOfClient(email)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(ids) == 0 {
+		return nil, nil, locale.NewError(locale.ErrClientNotFound, "Email=="+email)
+	}
+	if len(ids) > 1 && !renew.AllInbounds {
+		return nil, nil, locale.NewError(locale.ErrClientInInbounds, "Email=="+email, "Count=="+strconv.Itoa(len(ids)))
+	}
+
+	update := &BulkClientUpdate{
+		BulkClientSelection: BulkClientSelection{Strict: true},
+		Patch: ClientPatch{
+			ExtendDays:   renew.Days,
+			AddGB:        renew.AddGB,
+			ResetTraffic: renew.ResetTraffic,
+		},
+	}
+	for _, id := range ids {
+		update.Clients = append(update.Clients, ClientRef{InboundId: id, Email: email})
+	}
+	return update, ids, nil
+}
+
+// PreviewRenewClient returns what RenewClient would make of the client with
+// email, without renewing it.
+func (s *InboundService) PreviewRenewClient(email string, renew *ClientRenew) (*ClientRenewResult, error) {
+	update, ids, err := s.renewal(email, renew)
+	if err != nil {
+		return nil, err
+	}
+	_, client, err := s.GetClientByEmail(email)
+	if err != nil {
+		return nil, err
+	}
+	renewed, err := update.Patch.Preview(*client, time.Now().UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	return &ClientRenewResult{Email: renewed.Email, ExpiryTime: renewed.ExpiryTime, TotalGB: renewed.TotalGB, Inbounds: ids}, nil
+}
+
+// RenewClient extends the expiry of a client, adds to its quota and resets its
+// traffic if asked, and enables it again if it was disabled for depletion or
+// expiry. A renewal with an idempotencyKey that was used before returns the
+// result of then. It returns whether Xray has to be restarted.
+func (s *InboundService) RenewClient(email string, renew *ClientRenew, idempotencyKey string) (*ClientRenewResult, bool, error) {
+	muRenew.Lock()
+	defer muRenew.Unlock()
+
+	db := database.GetDB()
+	if idempotencyKey != "" {
+		var renewals []model.ClientRenewal
+		if err := db.Where(map[string]any{"key": idempotencyKey}).Limit(1).Find(&renewals).Error; err != nil {
+			return nil, false, err
+		}
+		if len(renewals) > 0 {
+			if !strings.EqualFold(renewals[0].Email, email) {
+				return nil, false, locale.NewError(locale.ErrIdempotencyKeyUsed)
+			}
+			result := &ClientRenewResult{}
+			if err := json.Unmarshal([]byte(renewals[0].Result), result); err != nil {
+				return nil, false, err
+			}
+			result.Replayed = true
+			return result, false, nil
+		}
+	}
+
+	update, ids, err := s.renewal(email, renew)
+	if err != nil {
+		return nil, false, err
+	}
+	var result *ClientRenewResult
+	// The idempotency key is saved with the renewal, so that a retry after a
+	// failure of either renews the client once
+	update.commit = func(tx *gorm.DB, results []BulkClientResult) error {
+		result = &ClientRenewResult{Email: results[0].Email, Inbounds: ids}
+		if client := results[0].Client; client != nil {
+			result.ExpiryTime = client.ExpiryTime
+			result.TotalGB = client.TotalGB
+		}
+		if idempotencyKey == "" {
+			return nil
+		}
+		data, err := json.Marshal(result)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		if err := tx.Where("created_at < ?", now.Add(-clientRenewalKeep).UnixMilli()).Delete(model.ClientRenewal{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&model.ClientRenewal{
+			Key:       idempotencyKey,
+			Email:     result.Email,
+			Result:    string(data),
+			CreatedAt: now.UnixMilli(),
+		}).Error
+	}
+	_, needRestart, err := s.UpdateBulkClients(update, len(ids))
+	if err != nil {
+		return nil, false, err
+	}
+	return result, needRestart, nil
+}
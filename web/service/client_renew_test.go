@@ -0,0 +1,53 @@
+package service
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"x-ui/database/model"
+	"x-ui/xray"
+)
+
+func TestRenewClientOnceForKey(t *testing.T) {
+	expiry := time.Now().Add(24 * time.Hour).UnixMilli()
+	inbound := &model.Inbound{
+		Remark: "trojan", Enable: true, Port: 20004, Protocol: model.Trojan, Tag: "inbound-20004",
+		Settings: `{"clients":[{"password":"p","email":"renew","enable":true,"expiryTime":` + strconv.FormatInt(expiry, 10) + `}]}`,
+	}
+	db := newTestDB(t, seedInbounds(inbound))
+	if err := db.Create(&xray.ClientTraffic{InboundId: inbound.Id, Email: "renew", Enable: true, ExpiryTime: expiry}).Error; err != nil {
+		t.Fatal(err)
+	}
+	var s InboundService
+	renew := &ClientRenew{Days: 30}
+
+	// The renewal isn't kept when its idempotency key can't be
+	if err := db.Exec("CREATE TRIGGER renewals_full BEFORE INSERT ON client_renewals BEGIN SELECT RAISE(ABORT, 'full'); END").Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.RenewClient("renew", renew, "key"); err == nil {
+		t.Fatal("the renewal succeeded without its idempotency key saved")
+	}
+	if _, client, err := s.GetClientByEmail("renew"); err != nil || client.ExpiryTime != expiry {
+		t.Fatalf("the failed renewal left the client expiring at %d, %v, want %d", client.ExpiryTime, err, expiry)
+	}
+	if err := db.Exec("DROP TRIGGER renewals_full").Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// Retrying with the key renews the client once
+	want := expiry + 30*24*time.Hour.Milliseconds()
+	for range 2 {
+		result, _, err := s.RenewClient("renew", renew, "key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.ExpiryTime != want {
+			t.Errorf("the renewal replied the expiry %d, want %d", result.ExpiryTime, want)
+		}
+	}
+	if _, client, err := s.GetClientByEmail("renew"); err != nil || client.ExpiryTime != want {
+		t.Errorf("the client expires at %d, %v, want %d", client.ExpiryTime, err, want)
+	}
+}
@@ -0,0 +1,302 @@
+package service
+
+import (
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/xray"
+
+	"gorm.io/gorm"
+)
+
+const (
+	ResetPolicyNone    = "none"
+	ResetPolicyDaily   = "daily"
+	ResetPolicyWeekly  = "weekly"
+	ResetPolicyMonthly = "monthly"
+)
+
+// resetPeriod returns the last reset of a policy at or before now and the next
+// one after it, at midnight in loc. Weekly resets fall on day as an ISO
+// weekday, Monday if it is not one; monthly resets on day of the month, the 1st
+// if it is not one, or the last day of months that are shorter. ok is false if
+// the policy doesn't reset.
+func resetPeriod(policy string, day int, now time.Time, loc *time.Location) (last time.Time, next time.Time, ok bool) {
+	now = now.In(loc)
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	switch policy {
+	case ResetPolicyDaily:
+		return midnight, midnight.AddDate(0, 0, 1), true
+	case ResetPolicyWeekly:
+		if day < 1 || day > 7 {
+			day = 1
+		}
+		back := (int(midnight.Weekday()) - day%7 + 7) % 7
+		last = midnight.AddDate(0, 0, -back)
+		return last, last.AddDate(0, 0, 7), true
+	case ResetPolicyMonthly:
+		if day < 1 || day > 31 {
+			day = 1
+		}
+		inMonth := func(year int, month time.Month) time.Time {
+			// Day 0 of the next month is the last day of this one
+			lastDay := time.Date(year, month+1, 0, 0, 0, 0, 0, loc).Day()
+			return time.Date(year, month, min(day, lastDay), 0, 0, 0, 0, loc)
+		}
+		this := inMonth(now.Year(), now.Month())
+		if this.After(now) {
+			return inMonth(now.Year(), now.Month()-1), this, true
+		}
+		return this, inMonth(now.Year(), now.Month()+1), true
+	}
+	return time.Time{}, time.Time{}, false
+}
+
+// checkResetPolicy checks the reset policy of a client as stored in the inbound
+// settings.
+func checkResetPolicy(client map[string]any) error {
+	policy, _ := client["resetPolicy"].(string)
+	day := jsonInt64(client["resetDay"])
+	switch policy {
+	case "", ResetPolicyNone, ResetPolicyDaily:
+	case ResetPolicyWeekly:
+		if day < 0 || day > 7 {
+			return common.NewError("the reset day of a weekly reset must be a weekday from 1 to 7")
+		}
+	case ResetPolicyMonthly:
+		if day < 0 || day > 31 {
+			return common.NewError("the reset day of a monthly reset must be a day of the month from 1 to 31")
+		}
+	default:
+		return common.NewError("unknown reset policy:", policy)
+	}
+	if jsonInt64(client["carryCapGB"]) < 0 {
+		return common.NewError("the carry over cap must be >= 0")
+	}
+	return nil
+}
+
+// carriedOver returns what a reset with carry over adds to the next period of
+// a client with the quota base in its settings, of the quota total of the
+// period that ends, of which it used used: the unused traffic, up to carryCap
+// if it is above 0. Unlimited and depleted clients carry nothing over.
+func carriedOver(base int64, total int64, used int64, carryCap int64) int64 {
+	if base <= 0 {
+		return 0
+	}
+	unused := max(total-used, 0)
+	if carryCap > 0 {
+		unused = min(unused, carryCap)
+	}
+	return unused
+}
+
+// quotaColumns sets the quota of the client in the columns of an update of its
+// traffic to totalGB of its settings, with what was carried over to its period.
+// An unlimited client has nothing carried over.
+func quotaColumns(columns map[string]any, totalGB int64) map[string]any {
+	if totalGB <= 0 {
+		columns["total"], columns["carried_over"] = totalGB, 0
+		return columns
+	}
+	columns["total"] = gorm.Expr("? + carried_over", totalGB)
+	return columns
+}
+
+// carryOverTraffic sets the quota of traffic, a client of the inbound id, to
+// carry over its unused traffic in a reset, if the client carries over.
+func (s *InboundService) carryOverTraffic(id int, traffic *xray.ClientTraffic) error {
+	inbound, err := s.GetInbound(id)
+	if err != nil {
+		return err
+	}
+	clients, err := s.GetClients(inbound)
+	if err != nil {
+		return err
+	}
+	for _, client := range clients {
+		if client.Email == traffic.Email && client.CarryOver {
+			carried := carriedOver(client.TotalGB, traffic.Total, traffic.Up+traffic.Down, client.CarryCapGB)
+			traffic.Total, traffic.CarriedOver = max(client.TotalGB, 0)+carried, carried
+			break
+		}
+	}
+	return nil
+}
+
+// scheduledReset is a client with a reset policy and its traffic.
+type scheduledReset struct {
+	xray.ClientTraffic
+	InboundEnable bool
+	ResetPolicy   string
+	ResetDay      int
+	// BaseQuota is the totalGB of the client, which CarryOver, up to CarryCap,
+	// adds the unused traffic of a period to
+	BaseQuota int64
+	CarryOver bool
+	CarryCap  int64
+}
+
+// scheduledResets lists the clients with a reset policy, only those with
+// emails if any are given.
+func scheduledResets(db *gorm.DB, emails ...string) ([]scheduledReset, error) {
+	query := `
+		SELECT traffic.*, inbounds.enable AS inbound_enable,
+			` + database.JSONText("client.value", "$.resetPolicy") + ` AS reset_policy,
+			COALESCE(` + database.JSONInt("client.value", "$.resetDay") + `, 0) AS reset_day,
+			COALESCE(` + database.JSONInt("client.value", "$.totalGB") + `, 0) AS base_quota,
+			COALESCE(` + database.JSONBool("client.value", "$.carryOver") + `, 0) AS carry_over,
+			COALESCE(` + database.JSONInt("client.value", "$.carryCapGB") + `, 0) AS carry_cap
+		FROM inbounds
+			CROSS JOIN ` + database.JSONEach("inbounds.settings", "$.clients", "client") + `
+			JOIN client_traffics AS traffic
+				ON traffic.inbound_id = inbounds.id AND traffic.email = ` + database.JSONText("client.value", "$.email") + `
+		WHERE ` + database.JSONText("client.value", "$.resetPolicy") + ` IN (?)`
+	args := []any{[]string{ResetPolicyDaily, ResetPolicyWeekly, ResetPolicyMonthly}}
+	if len(emails) > 0 {
+		query += ` AND traffic.email IN (?)`
+		args = append(args, emails)
+	}
+	resets := make([]scheduledReset, 0)
+	err := db.Raw(query, args...).Scan(&resets).Error
+	return resets, err
+}
+
+// SetNextResets fills in NextReset of the traffics of clients with a reset
+// policy.
+func (s *InboundService) SetNextResets(traffics ...*xray.ClientTraffic) error {
+	emails := make([]string, 0, len(traffics))
+	for _, traffic := range traffics {
+		if traffic != nil {
+			emails = append(emails, traffic.Email)
+		}
+	}
+	if len(emails) == 0 {
+		return nil
+	}
+	resets, err := scheduledResets(database.GetDB(), emails...)
+	if err != nil {
+		return err
+	}
+	loc, err := s.settingService.GetTimeLocation()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, reset := range resets {
+		_, next, ok := resetPeriod(reset.ResetPolicy, reset.ResetDay, now, loc)
+		if !ok {
+			continue
+		}
+		for _, traffic := range traffics {
+			if traffic != nil && traffic.Email == reset.Email {
+				traffic.NextReset = next.UnixMilli()
+			}
+		}
+	}
+	return nil
+}
+
+// ResetScheduledTraffics zeroes the traffic of the clients whose reset policy
+// is due, enables those disabled for depletion again and, if archive is set,
+// keeps their usage of the period that ended in traffic_history. The clients
+// with carry over start the next period with what they left unused; the others
+// go back to the quota of their settings. Expired
+// clients are left alone. Each client records the reset it got, so a run that
+// is repeated, or one after a missed midnight, resets every client once. It
+// returns the number of clients reset and whether Xray has to be restarted.
+func (s *InboundService) ResetScheduledTraffics(archive bool) (int, bool, error) {
+	// The traffic counted before the reset is written first, not added after it
+	if err := s.FlushTraffic(); err != nil {
+		return 0, false, err
+	}
+	loc, err := s.settingService.GetTimeLocation()
+	if err != nil {
+		return 0, false, err
+	}
+	db := database.GetDB()
+	resets, err := scheduledResets(db)
+	if err != nil {
+		return 0, false, err
+	}
+
+	now := time.Now()
+	count := 0
+	needRestart := false
+	err = database.Transaction(func(tx *gorm.DB) error {
+		for _, reset := range resets {
+			last, _, ok := resetPeriod(reset.ResetPolicy, reset.ResetDay, now, loc)
+			if !ok || reset.LastReset >= last.UnixMilli() {
+				continue
+			}
+			if reset.LastReset == 0 {
+				// A new policy starts with the current period
+				err := tx.Model(xray.ClientTraffic{}).Where("id = ? AND last_reset = 0", reset.Id).
+					Update("last_reset", last.UnixMilli()).Error
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			if reset.ExpiryTime > 0 && reset.ExpiryTime <= now.UnixMilli() {
+				continue
+			}
+
+			// Archive the counters as they are now, not as they were listed
+			traffic := &xray.ClientTraffic{}
+			if err := tx.Where("id = ?", reset.Id).First(traffic).Error; err == gorm.ErrRecordNotFound {
+				continue
+			} else if err != nil {
+				return err
+			}
+			carried := int64(0)
+			if reset.CarryOver {
+				carried = carriedOver(reset.BaseQuota, traffic.Total, traffic.Up+traffic.Down, reset.CarryCap)
+			}
+			result := tx.Model(xray.ClientTraffic{}).
+				Where("id = ? AND last_reset = ?", reset.Id, reset.LastReset).
+				Updates(enabledColumns(map[string]any{
+					"up":           0,
+					"down":         0,
+					"last_reset":   last.UnixMilli(),
+					"total":        reset.BaseQuota + carried,
+					"carried_over": carried,
+				}))
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				continue
+			}
+			if archive {
+				err := tx.Create(&model.TrafficHistory{
+					InboundId:   traffic.InboundId,
+					Email:       traffic.Email,
+					Up:          traffic.Up,
+					Down:        traffic.Down,
+					Total:       traffic.Total,
+					PeriodStart: reset.LastReset,
+					PeriodEnd:   last.UnixMilli(),
+					CarriedIn:   traffic.CarriedOver,
+					CarriedOver: carried,
+				}).Error
+				if err != nil {
+					return err
+				}
+			}
+			if !reset.Enable && reset.InboundEnable {
+				needRestart = true
+			}
+			count++
+			logger.Debugf("Client traffic reset by %s policy: %s", reset.ResetPolicy, reset.Email)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, false, err
+	}
+	return count, needRestart, nil
+}
@@ -0,0 +1,158 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/common"
+
+	"github.com/goccy/go-json"
+	"github.com/google/uuid"
+)
+
+// ClientRotate tells which secrets of a client to replace, e.g. after its
+// subscription link leaked.
+type ClientRotate struct {
+	RotateSubId bool `json:"rotateSubId" form:"rotateSubId"`
+	// RotateUuid replaces the credential of the client: its UUID, or its
+	// password on Trojan and Shadowsocks
+	RotateUuid bool `json:"rotateUuid" form:"rotateUuid"`
+}
+
+// ClientRotateResult is a client after its secrets were replaced.
+type ClientRotateResult struct {
+	Email     string `json:"email"`
+	InboundId int    `json:"inboundId"`
+	SubId     string `json:"subId"`
+	// Rotated names the secrets that were replaced, "subId" and "uuid"
+	Rotated []string `json:"rotated"`
+	// Inbound and Client are as saved, to generate the new links from
+	Inbound *model.Inbound `json:"-"`
+	Client  model.Client   `json:"-"`
+}
+
+// RotateClient replaces the subscription ID and the credential of a client, as
+// rotate asks, with new random ones. The old subscription ID stops working at
+// once. A new credential is updated in the running Xray. It returns whether
+// Xray has to be restarted.
+func (s *InboundService) RotateClient(email string, rotate *ClientRotate) (*ClientRotateResult, bool, error) {
+	if !rotate.RotateSubId && !rotate.RotateUuid {
+		return nil, false, common.NewError("nothing to rotate")
+	}
+	traffic, inbound, err := s.GetClientInboundByEmail(email)
+	if err != nil {
+		return nil, false, err
+	}
+	if traffic == nil || inbound == nil {
+		return nil, false, common.NewError("client not found:", email)
+	}
+
+	unlock := s.lockInbound(inbound.Id)
+	defer unlock()
+
+	inbound, err = s.GetInbound(inbound.Id)
+	if err != nil {
+		return nil, false, err
+	}
+	var settings map[string]any
+	if err := json.Unmarshal([]byte(inbound.Settings), &settings); err != nil {
+		return nil, false, err
+	}
+	clients, _ := settings["clients"].([]any)
+	var client map[string]any
+	for _, item := range clients {
+		c, _ := item.(map[string]any)
+		if e, _ := c["email"].(string); c != nil && strings.EqualFold(e, traffic.Email) {
+			client = c
+			break
+		}
+	}
+	if client == nil {
+		return nil, false, common.NewError("client not found:", email)
+	}
+
+	rotated := make([]string, 0, 2)
+	if rotate.RotateSubId {
+		client["subId"] = randomLowerAndNum(16)
+		rotated = append(rotated, "subId")
+	}
+	if rotate.RotateUuid {
+		switch inbound.Protocol {
+		case model.VMESS, model.VLESS:
+			client["id"] = uuid.New().String()
+		case model.Trojan:
+			client["password"] = randomLowerAndNum(10)
+		case model.Shadowsocks:
+			client["password"] = randomShadowsocksPassword(shadowsocksMethod(inbound))
+		case model.WireGuard:
+			var err error
+			if client["privateKey"], client["publicKey"], err = newWireguardKeyPair(); err != nil {
+				return nil, false, err
+			}
+		default:
+			return nil, false, common.NewError("inbound protocol has no clients:", inbound.Protocol)
+		}
+		rotated = append(rotated, "uuid")
+	}
+
+	newSettings, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return nil, false, err
+	}
+	inbound.Settings = string(newSettings)
+	err = database.GetDB().Model(model.Inbound{}).Where("id = ?", inbound.Id).Update("settings", inbound.Settings).Error
+	if err != nil {
+		return nil, false, err
+	}
+
+	var user model.Client
+	data, _ := json.Marshal(client)
+	json.Unmarshal(data, &user)
+	result := &ClientRotateResult{
+		Email:     user.Email,
+		InboundId: inbound.Id,
+		SubId:     user.SubID,
+		Rotated:   rotated,
+		Inbound:   inbound,
+		Client:    user,
+	}
+	// Xray doesn't know the subscription ID, only the credential
+	if !rotate.RotateUuid || p == nil || !inbound.Enable || !user.Enable || !traffic.Enable {
+		return result, false, nil
+	}
+
+	needRestart := false
+	s.muXray.Lock()
+	defer s.muXray.Unlock()
+	if err := s.initXrayAPI(); err != nil {
+		return result, true, nil
+	}
+	defer s.xrayApi.Close()
+	err1 := s.xrayApi.RemoveUser(inbound.Tag, user.Email)
+	if err1 != nil && !strings.Contains(err1.Error(), fmt.Sprintf("User %s not found.", user.Email)) {
+		logger.Debug("Error in rotating client by api:", err1)
+		needRestart = true
+	}
+	cipher := ""
+	if inbound.Protocol == model.Shadowsocks {
+		cipher = shadowsocksMethod(inbound)
+	}
+	err1 = s.xrayApi.AddUser(string(inbound.Protocol), inbound.Tag, map[string]any{
+		"email":    user.Email,
+		"id":       user.ID,
+		"security": user.Security,
+		"flow":     user.Flow,
+		"password": user.Password,
+		"cipher":   cipher,
+	})
+	if err1 == nil {
+		logger.Debug("Client rotated by api:", user.Email)
+	} else {
+		logger.Debug("Error in rotating client by api:", err1)
+		needRestart = true
+	}
+	return result, needRestart, nil
+}
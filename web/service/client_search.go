@@ -0,0 +1,147 @@
+package service
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+
+	"x-ui/database"
+	"x-ui/util/common"
+)
+
+const (
+	clientSearchDefaultLimit = 50
+	clientSearchMaxLimit     = 500
+)
+
+// ClientListItem is a client of any inbound, with its inbound and traffic.
+type ClientListItem struct {
+	InboundId  int      `json:"inboundId"`
+	Remark     string   `json:"remark"`
+	Port       int      `json:"port"`
+	Protocol   string   `json:"protocol"`
+	Email      string   `json:"email"`
+	ClientId   string   `json:"id,omitempty"`
+	SubId      string   `json:"subId,omitempty"`
+	TgId       int64    `json:"tgId,omitempty"`
+	Enable     bool     `json:"enable"`
+	Up         int64    `json:"up"`
+	Down       int64    `json:"down"`
+	Total      int64    `json:"total"`
+	ExpiryTime int64    `json:"expiryTime"`
+	LastSeen   int64    `json:"lastSeen,omitempty"`
+	Tags       []string `json:"tags,omitempty" gorm:"-"`
+	TagColumn  string   `json:"-" gorm:"column:tags"`
+	// LastSubFetch is when the subscription of the client was last fetched,
+	// and LastUserAgent the app it was fetched by
+	LastSubFetch  int64  `json:"lastSubFetch,omitempty"`
+	LastUserAgent string `json:"lastUserAgent,omitempty"`
+}
+
+// addLastSubFetch counts the fetches of the subscription of the client not
+// written yet in its last fetch.
+func (c *ClientListItem) addLastSubFetch() {
+	if at, userAgent := subAccessLastFetch(c.Email); at > c.LastSubFetch {
+		c.LastSubFetch, c.LastUserAgent = at, userAgent
+	}
+}
+
+// ClientSearchHit is a client found by SearchClients.
+type ClientSearchHit struct {
+	ClientListItem
+	// Relevance is 0 for exact matches, 1 for email prefixes and 2 for other
+	// email substrings
+	Relevance int `json:"relevance"`
+}
+
+// clientSearchHits lists the clients of all inbounds from their settings, with
+// the relevance of the match, so only the page asked for is read in full.
+func clientSearchHits() string {
+	return `
+WITH clients AS (
+	SELECT inbounds.id AS inbound_id, inbounds.remark, inbounds.port, inbounds.protocol,
+		COALESCE(` + database.JSONText("client.value", "$.email") + `, '') AS email,
+		COALESCE(` + database.JSONText("client.value", "$.id") + `, '') AS client_id,
+		COALESCE(` + database.JSONText("client.value", "$.subId") + `, '') AS sub_id,
+		COALESCE(` + database.JSONInt("client.value", "$.tgId") + `, 0) AS tg_id,
+		COALESCE(` + database.JSONBool("client.value", "$.enable") + `, 1) AS enable
+	FROM inbounds,
+		` + database.JSONEach("inbounds.settings", "$.clients", "client") + `
+), hits AS (
+	SELECT *,
+		CASE
+			WHEN LOWER(email) = @query OR LOWER(client_id) = @query OR sub_id = @raw
+				OR (@tg <> 0 AND tg_id = @tg) THEN 0
+			WHEN LOWER(email) LIKE @prefix ESCAPE '!' THEN 1
+			ELSE 2
+		END AS relevance
+	FROM clients
+	WHERE LOWER(email) LIKE @substring ESCAPE '!'
+		OR LOWER(client_id) = @query OR sub_id = @raw
+		OR (@tg <> 0 AND tg_id = @tg)
+)
+`
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern, with ! as the escape: a
+// backslash would have to be escaped again in the strings of MySQL.
+func escapeLike(value string) string {
+	return strings.NewReplacer(`!`, `!!`, `%`, `!%`, `_`, `!_`).Replace(value)
+}
+
+// SearchClients finds the clients of all inbounds whose email contains query,
+// case-insensitively, or whose UUID, subscription or Telegram ID is query. The
+// hits are sorted with exact matches first; it returns the hits from offset on,
+// at most limit of them, and the number of all hits.
+func (s *InboundService) SearchClients(query string, limit int, offset int) ([]ClientSearchHit, int64, error) {
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return nil, 0, common.NewError("empty search query")
+	}
+	if limit <= 0 {
+		limit = clientSearchDefaultLimit
+	} else if limit > clientSearchMaxLimit {
+		limit = clientSearchMaxLimit
+	}
+	offset = max(offset, 0)
+
+	lower := strings.ToLower(query)
+	tgId, _ := strconv.ParseInt(query, 10, 64)
+	params := []any{
+		sql.Named("query", lower),
+		sql.Named("raw", query),
+		sql.Named("tg", tgId),
+		sql.Named("prefix", escapeLike(lower)+"%"),
+		sql.Named("substring", "%"+escapeLike(lower)+"%"),
+	}
+
+	db := database.GetDB()
+	var total int64
+	if err := db.Raw(clientSearchHits()+`SELECT COUNT(*) FROM hits`, params...).Scan(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	hits := make([]ClientSearchHit, 0)
+	err := db.Raw(clientSearchHits()+`
+SELECT hits.inbound_id, hits.remark, hits.port, hits.protocol, hits.email,
+	hits.client_id, hits.sub_id, hits.tg_id, hits.enable, hits.relevance,
+	COALESCE(traffic.up, 0) AS up, COALESCE(traffic.down, 0) AS down,
+	COALESCE(traffic.total, 0) AS total, COALESCE(traffic.expiry_time, 0) AS expiry_time,
+	COALESCE(traffic.last_seen, 0) AS last_seen, COALESCE(traffic.tags, '') AS tags,
+	COALESCE(traffic.last_sub_fetch, 0) AS last_sub_fetch, COALESCE(traffic.last_user_agent, '') AS last_user_agent
+FROM hits
+	LEFT JOIN client_traffics AS traffic ON traffic.email = hits.email
+ORDER BY hits.relevance, LOWER(hits.email), hits.inbound_id
+LIMIT @limit OFFSET @offset`,
+		append(params, sql.Named("limit", limit), sql.Named("offset", offset))...).
+		Scan(&hits).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	for i := range hits {
+		hits[i].Tags = parseTagColumn(hits[i].TagColumn)
+		hits[i].LastSeen = max(hits[i].LastSeen, clientLastSeen(hits[i].Email))
+		hits[i].addLastSubFetch()
+	}
+	return hits, total, nil
+}
@@ -0,0 +1,227 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/util/common"
+	"x-ui/web/locale"
+
+	"gorm.io/gorm"
+)
+
+const (
+	clientSharePrefix = "xuis_"
+	clientShareBytes  = 32
+	// clientShareMaxLifetime is the longest a share link may be valid for
+	clientShareMaxLifetime = 90 * 24 * time.Hour
+	// clientShareMaxExtendDays is the most a share link may extend a client by,
+	// as much as a single renewal
+	clientShareMaxExtendDays = 3650
+)
+
+// ClientShareService manages the links that let someone without a login manage
+// a single client. What the holder of a link may do is fixed here, the link only
+// names the client and the limits set when it was created.
+type ClientShareService struct {
+	inboundService InboundService
+}
+
+// ClientShareUsage is what the holder of a share link sees of its client.
+type ClientShareUsage struct {
+	Email      string `json:"email"`
+	Enable     bool   `json:"enable"`
+	Up         int64  `json:"up"`
+	Down       int64  `json:"down"`
+	Total      int64  `json:"total"`
+	ExpiryTime int64  `json:"expiryTime"`
+	// ExtendDays is how many days the link may still extend the expiry by
+	ExtendDays int   `json:"extendDays"`
+	ExpiresAt  int64 `json:"expiresAt"`
+}
+
+// CreateShare stores a new share link of the client with email and returns its
+// secret, which is never available again afterwards. expiresAt is in unix
+// milliseconds and maxExtendDays is the most the link may extend the expiry of
+// the client by, zero for not at all.
+func (s *ClientShareService) CreateShare(email string, createdBy string, expiresAt int64, maxExtendDays int) (string, *model.ClientShare, error) {
+	traffic, err := s.inboundService.GetClientTrafficByEmail(email)
+	if err != nil {
+		return "", nil, err
+	}
+	if traffic == nil {
+		return "", nil, locale.NewError(locale.ErrNotFound)
+	}
+	now := time.Now()
+	if expiresAt <= now.UnixMilli() {
+		return "", nil, common.NewError("share link expiry must be in the future")
+	}
+	if expiresAt > now.Add(clientShareMaxLifetime).UnixMilli() {
+		return "", nil, common.NewErrorf("share link expiry can be at most %d days ahead", int(clientShareMaxLifetime/(24*time.Hour)))
+	}
+	if maxExtendDays < 0 || maxExtendDays > clientShareMaxExtendDays {
+		return "", nil, common.NewErrorf("share link extension must be between 0 and %d days", clientShareMaxExtendDays)
+	}
+
+	buf := make([]byte, clientShareBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return "", nil, err
+	}
+	secret := clientSharePrefix + base64.RawURLEncoding.EncodeToString(buf)
+
+	share := &model.ClientShare{
+		Email:         traffic.Email,
+		Prefix:        secret[:len(clientSharePrefix)+apiTokenDisplayChars],
+		TokenHash:     hashToken(secret),
+		CreatedBy:     createdBy,
+		MaxExtendDays: maxExtendDays,
+		CreatedAt:     now.UnixMilli(),
+		ExpiresAt:     expiresAt,
+	}
+	if err := database.GetDB().Create(share).Error; err != nil {
+		return "", nil, err
+	}
+	return secret, share, nil
+}
+
+// GetShares returns the share links of the client with email, the newest first,
+// the expired and revoked ones too.
+func (s *ClientShareService) GetShares(email string) ([]*model.ClientShare, error) {
+	shares := make([]*model.ClientShare, 0)
+	err := database.GetDB().Model(model.ClientShare{}).
+		Where("LOWER(email) = LOWER(?)", email).
+		Order("id DESC").
+		Find(&shares).Error
+	return shares, err
+}
+
+// RevokeShare ends the share link id of the client with email. Revoking a link
+// again keeps when it was first revoked.
+func (s *ClientShareService) RevokeShare(email string, id int) (*model.ClientShare, error) {
+	db := database.GetDB()
+	share := &model.ClientShare{}
+	err := db.Model(model.ClientShare{}).Where("id = ? AND LOWER(email) = LOWER(?)", id, email).First(share).Error
+	if database.IsNotFound(err) {
+		return nil, locale.NewError(locale.ErrNotFound)
+	} else if err != nil {
+		return nil, err
+	}
+	if share.RevokedAt != 0 {
+		return share, nil
+	}
+	share.RevokedAt = time.Now().UnixMilli()
+	err = db.Model(model.ClientShare{}).Where("id = ?", share.Id).Update("revoked_at", share.RevokedAt).Error
+	return share, err
+}
+
+// Resolve looks the share link of secret up on every request, so a revoked link
+// stops working immediately. A link that expired or was revoked, or whose client
+// is gone, is an ErrShareGone.
+func (s *ClientShareService) Resolve(secret string) (*model.ClientShare, error) {
+	if !strings.HasPrefix(secret, clientSharePrefix) {
+		return nil, locale.NewError(locale.ErrNotFound)
+	}
+	db := database.GetDB()
+	share := &model.ClientShare{}
+	err := db.Model(model.ClientShare{}).Where("token_hash = ?", hashToken(secret)).First(share).Error
+	if database.IsNotFound(err) {
+		return nil, locale.NewError(locale.ErrNotFound)
+	} else if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UnixMilli()
+	if share.RevokedAt != 0 || now >= share.ExpiresAt {
+		return nil, locale.NewError(locale.ErrShareGone)
+	}
+	traffic, err := s.inboundService.GetClientTrafficByEmail(share.Email)
+	if err != nil {
+		return nil, err
+	}
+	if traffic == nil {
+		return nil, locale.NewError(locale.ErrShareGone)
+	}
+	if now-share.LastUsedAt >= apiTokenTouchInterval.Milliseconds() {
+		share.LastUsedAt = now
+		if err := db.Model(model.ClientShare{}).Where("id = ?", share.Id).Update("last_used_at", share.LastUsedAt).Error; err != nil {
+			return nil, err
+		}
+	}
+	return share, nil
+}
+
+// Usage returns the usage of the client of share.
+func (s *ClientShareService) Usage(share *model.ClientShare) (*ClientShareUsage, error) {
+	traffic, err := s.inboundService.GetClientTrafficByEmail(share.Email)
+	if err != nil {
+		return nil, err
+	}
+	if traffic == nil {
+		return nil, locale.NewError(locale.ErrShareGone)
+	}
+	return &ClientShareUsage{
+		Email:      traffic.Email,
+		Enable:     traffic.Enable,
+		Up:         traffic.Up,
+		Down:       traffic.Down,
+		Total:      traffic.Total,
+		ExpiryTime: traffic.ExpiryTime,
+		ExtendDays: max(share.MaxExtendDays-share.ExtendedDays, 0),
+		ExpiresAt:  share.ExpiresAt,
+	}, nil
+}
+
+// ResetTraffic zeroes the traffic of the client of share. It returns whether
+// Xray has to be restarted.
+func (s *ClientShareService) ResetTraffic(share *model.ClientShare) (bool, error) {
+	traffic, err := s.inboundService.GetClientTrafficByEmail(share.Email)
+	if err != nil {
+		return false, err
+	}
+	if traffic == nil {
+		return false, locale.NewError(locale.ErrShareGone)
+	}
+	return s.inboundService.ResetClientTraffic(traffic.InboundId, traffic.Email, false)
+}
+
+// Extend extends the expiry of the client of share by days, in every inbound it
+// is in, as long as the link has that many days left to extend by. It returns
+// whether Xray has to be restarted.
+func (s *ClientShareService) Extend(share *model.ClientShare, days int) (*ClientRenewResult, bool, error) {
+	if days < 1 {
+		return nil, false, common.NewError("extension must be at least a day")
+	}
+	traffic, err := s.inboundService.GetClientTrafficByEmail(share.Email)
+	if err != nil {
+		return nil, false, err
+	}
+	if traffic == nil {
+		return nil, false, locale.NewError(locale.ErrShareGone)
+	}
+	if traffic.ExpiryTime == 0 {
+		return nil, false, common.NewError("the client does not expire")
+	}
+
+	// The days are taken first, so links used at once can't extend past the limit
+	db := database.GetDB()
+	result := db.Model(model.ClientShare{}).
+		Where("id = ? AND extended_days + ? <= max_extend_days", share.Id, days).
+		Update("extended_days", gorm.Expr("extended_days + ?", days))
+	if result.Error != nil {
+		return nil, false, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, false, common.NewErrorf("the link can extend the client by %d more days at most", max(share.MaxExtendDays-share.ExtendedDays, 0))
+	}
+	renewed, needRestart, err := s.inboundService.RenewClient(share.Email, &ClientRenew{Days: days, AllInbounds: true}, "")
+	if err != nil {
+		db.Model(model.ClientShare{}).Where("id = ?", share.Id).Update("extended_days", gorm.Expr("extended_days - ?", days))
+		return nil, false, err
+	}
+	share.ExtendedDays += days
+	return renewed, needRestart, nil
+}
@@ -0,0 +1,243 @@
+package service
+
+import (
+	"database/sql"
+	"regexp"
+	"slices"
+	"strings"
+
+	"x-ui/database"
+	"x-ui/util/common"
+
+	"github.com/goccy/go-json"
+)
+
+const (
+	maxClientTags      = 16
+	maxClientTagLength = 32
+)
+
+// clientTagPattern is what a tag may contain after it was lowercased
+var clientTagPattern = regexp.MustCompile(`^[a-z0-9._-]+$`)
+
+// NormalizeTags lowercases and trims tags and drops the empty and duplicate
+// ones. It fails on tags with other characters than letters, digits, ".", "_"
+// and "-", on tags longer than maxClientTagLength and on more than
+// maxClientTags tags.
+func NormalizeTags(tags []string) ([]string, error) {
+	normalized := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || slices.Contains(normalized, tag) {
+			continue
+		}
+		if len(tag) > maxClientTagLength {
+			return nil, common.NewErrorf("tag %q is longer than %d characters", tag, maxClientTagLength)
+		}
+		if !clientTagPattern.MatchString(tag) {
+			return nil, common.NewErrorf("tag %q may only contain letters, digits, \".\", \"_\" and \"-\"", tag)
+		}
+		normalized = append(normalized, tag)
+	}
+	if len(normalized) > maxClientTags {
+		return nil, common.NewErrorf("a client can have at most %d tags", maxClientTags)
+	}
+	return normalized, nil
+}
+
+// tagColumn returns tags as they are mirrored into client_traffics, delimited
+// on both ends so a tag is found with LIKE '%,tag,%'.
+func tagColumn(tags []string) string {
+	if len(tags) == 0 {
+		return ""
+	}
+	return "," + strings.Join(tags, ",") + ","
+}
+
+func parseTagColumn(column string) []string {
+	column = strings.Trim(column, ",")
+	if column == "" {
+		return nil
+	}
+	return strings.Split(column, ",")
+}
+
+// tagsOf returns the tags of a client as stored in the inbound settings.
+func tagsOf(client map[string]any) []string {
+	switch items := client["tags"].(type) {
+	case []string:
+		return slices.Clone(items)
+	case []any:
+		tags := make([]string, 0, len(items))
+		for _, item := range items {
+			if tag, ok := item.(string); ok {
+				tags = append(tags, tag)
+			}
+		}
+		return tags
+	}
+	return []string{}
+}
+
+// normalizeClients normalizes the tags, the Telegram ids, the outbound tags and
+// the link options of the clients in the settings of an inbound, and checks
+// their reset policies and that their outbounds exist. The settings are only
+// rewritten if a client has tags, an outbound tag, link options or a tgId
+// given as a string.
+func normalizeClients(settings string) (string, error) {
+	var parsed map[string]any
+	if err := json.Unmarshal([]byte(settings), &parsed); err != nil {
+		return settings, nil
+	}
+	clients, _ := parsed["clients"].([]any)
+	changed := false
+	outbounds := []string{}
+	for _, item := range clients {
+		client, ok := item.(map[string]any)
+		if !ok {
+			continue
+		}
+		if err := checkResetPolicy(client); err != nil {
+			return "", err
+		}
+		tgIdChanged, err := normalizeTgId(client)
+		if err != nil {
+			return "", err
+		}
+		changed = changed || tgIdChanged
+		dateChanged, err := normalizeExpiryDate(client)
+		if err != nil {
+			return "", err
+		}
+		changed = changed || dateChanged
+		if _, ok := client["outboundTag"]; ok {
+			outbound, err := normalizeClientOutbound(client)
+			if err != nil {
+				return "", err
+			}
+			if outbound != "" && !slices.Contains(outbounds, outbound) {
+				outbounds = append(outbounds, outbound)
+			}
+			changed = true
+		}
+		if _, ok := client["linkOptions"]; ok {
+			if err := normalizeClientLinkOptions(client); err != nil {
+				return "", err
+			}
+			changed = true
+		}
+		if _, ok := client["tags"]; !ok {
+			continue
+		}
+		if _, ok := client["tags"].([]any); !ok && client["tags"] != nil {
+			return "", common.NewError("the tags of a client must be a list")
+		}
+		tags, err := NormalizeTags(tagsOf(client))
+		if err != nil {
+			return "", err
+		}
+		if len(tags) == 0 {
+			delete(client, "tags")
+		} else {
+			client["tags"] = tags
+		}
+		changed = true
+	}
+	if err := checkClientOutbounds(outbounds); err != nil {
+		return "", err
+	}
+	if !changed {
+		return settings, nil
+	}
+	normalized, err := json.MarshalIndent(parsed, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(normalized), nil
+}
+
+// tagPattern returns the LIKE pattern for the client_traffics rows of a tag.
+func tagPattern(tag string) (string, error) {
+	tags, err := NormalizeTags([]string{tag})
+	if err != nil {
+		return "", err
+	}
+	if len(tags) == 0 {
+		return "", common.NewError("empty tag")
+	}
+	return "%" + escapeLike(tagColumn(tags)) + "%", nil
+}
+
+// clientsByTag returns the clients with a tag.
+func (s *InboundService) clientsByTag(tag string) ([]ClientRef, error) {
+	pattern, err := tagPattern(tag)
+	if err != nil {
+		return nil, err
+	}
+	refs := make([]ClientRef, 0)
+	err = database.GetDB().Raw(`
+		SELECT inbound_id, email FROM client_traffics
+		WHERE tags LIKE ? ESCAPE '!'
+		ORDER BY id`, pattern).Scan(&refs).Error
+	return refs, err
+}
+
+// ListClients lists the clients of all inbounds, only those with tag if it is
+// not empty, sorted by email. It returns the clients from offset on, at most
+// limit of them, and the number of all of them. The tags mirrored into
+// client_traffics select the clients; the inbound settings are only read for
+// the rows returned.
+func (s *InboundService) ListClients(tag string, limit int, offset int) ([]ClientListItem, int64, error) {
+	pattern := "%"
+	if tag != "" {
+		var err error
+		if pattern, err = tagPattern(tag); err != nil {
+			return nil, 0, err
+		}
+	}
+	if limit <= 0 {
+		limit = clientSearchDefaultLimit
+	} else if limit > clientSearchMaxLimit {
+		limit = clientSearchMaxLimit
+	}
+	offset = max(offset, 0)
+
+	db := database.GetDB()
+	var total int64
+	err := db.Raw(`SELECT COUNT(*) FROM client_traffics WHERE COALESCE(tags, '') LIKE @pattern ESCAPE '!'`,
+		sql.Named("pattern", pattern)).Scan(&total).Error
+	if err != nil {
+		return nil, 0, err
+	}
+
+	items := make([]ClientListItem, 0)
+	err = db.Raw(`
+SELECT page.inbound_id, inbounds.remark, inbounds.port, inbounds.protocol, page.email,
+	COALESCE(`+database.JSONText("client.value", "$.id")+`, '') AS client_id,
+	COALESCE(`+database.JSONText("client.value", "$.subId")+`, '') AS sub_id,
+	COALESCE(`+database.JSONInt("client.value", "$.tgId")+`, 0) AS tg_id,
+	COALESCE(`+database.JSONBool("client.value", "$.enable")+`, 1) AS enable,
+	page.up, page.down, page.total, page.expiry_time, page.last_seen, page.tags,
+	COALESCE(page.last_sub_fetch, 0) AS last_sub_fetch, COALESCE(page.last_user_agent, '') AS last_user_agent
+FROM (
+	SELECT * FROM client_traffics
+	WHERE COALESCE(tags, '') LIKE @pattern ESCAPE '!'
+	ORDER BY LOWER(email), id
+	LIMIT @limit OFFSET @offset
+) AS page
+	JOIN inbounds ON inbounds.id = page.inbound_id
+	LEFT JOIN `+database.JSONEach("inbounds.settings", "$.clients", "client")+`
+		ON `+database.JSONText("client.value", "$.email")+` = page.email
+ORDER BY LOWER(page.email), page.id`,
+		sql.Named("pattern", pattern), sql.Named("limit", limit), sql.Named("offset", offset)).
+		Scan(&items).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	for i := range items {
+		items[i].Tags = parseTagColumn(items[i].TagColumn)
+		items[i].LastSeen = max(items[i].LastSeen, clientLastSeen(items[i].Email))
+		items[i].addLastSubFetch()
+	}
+	return items, total, nil
+}
@@ -0,0 +1,407 @@
+package service
+
+import (
+	"context"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/util/sys"
+)
+
+// The connection limits of inbounds, as blocks name them.
+const (
+	ConnLimitConcurrent = "maxConnsPerIP"
+	ConnLimitNewPerMin  = "maxNewConnsPerMinute"
+
+	// connBlockCommandTimeout is how long a block or unblock command may run
+	connBlockCommandTimeout = 10 * time.Second
+)
+
+// connSource is a source IP of the connections to an inbound.
+type connSource struct {
+	inboundId int
+	ip        string
+}
+
+// connOpening is a number of connections a source opened by a sample.
+type connOpening struct {
+	at    int64
+	count int
+}
+
+// connTracker tells the connections a sample sees that the one before did not,
+// which are the ones opened in between, and keeps how many each source opened
+// in the last minute. Connections opened and closed between two samples are
+// not seen. Only the inbounds with connection limits are tracked; on the first
+// sample of one, none of its connections is counted as new.
+var connTracker = struct {
+	sync.Mutex
+	last     map[sys.Connection]bool
+	inbounds map[int]bool
+	opened   map[connSource][]connOpening
+}{}
+
+// ConnBlockService keeps the blocks of the source IPs that went over the
+// connection limits of inbounds, and runs the commands of the settings that
+// block them in the firewall and unblock them.
+type ConnBlockService struct {
+	settingService SettingService
+	auditService   AuditService
+}
+
+// normalizeConnLimits checks the connection limits of an inbound, no limits
+// are nil.
+func normalizeConnLimits(limits *model.InboundConnLimits) (*model.InboundConnLimits, error) {
+	if limits == nil {
+		return nil, nil
+	}
+	if limits.MaxConnsPerIP < 0 || limits.MaxNewConnsPerMinute < 0 {
+		return nil, common.NewError("the connection limits of an inbound can't be negative")
+	}
+	if limits.MaxConnsPerIP == 0 && limits.MaxNewConnsPerMinute == 0 {
+		return nil, nil
+	}
+	return limits, nil
+}
+
+// SetInboundConnLimits sets the limits of the connections of each source IP to
+// an inbound, or removes them if nil. The blocks made for the old limits are
+// kept until they expire.
+func (s *InboundService) SetInboundConnLimits(id int, limits *model.InboundConnLimits) (*model.Inbound, error) {
+	limits, err := normalizeConnLimits(limits)
+	if err != nil {
+		return nil, err
+	}
+	unlock := s.lockInbound(id)
+	defer unlock()
+
+	inbound, err := s.GetInbound(id)
+	if err != nil {
+		return nil, err
+	}
+	inbound.ConnLimits = limits
+	if err := database.GetDB().Model(inbound).Select("conn_limits").Updates(inbound).Error; err != nil {
+		return nil, err
+	}
+	return inbound, nil
+}
+
+// connBlockData is what the commands of the settings are given of a block:
+// {{.IP}}, {{.Family}} as nftables names it, "ip" or "ip6", {{.Port}}, a port
+// or a range like "443-450", and how long the block lasts in {{.Minutes}} and
+// {{.Seconds}}.
+type connBlockData struct {
+	IP      string
+	Family  string
+	Port    string
+	Minutes int64
+	Seconds int64
+}
+
+// connBlockArgs returns the program and the arguments of command for data. The
+// command is run as is, without a shell.
+func connBlockArgs(command string, data connBlockData) ([]string, error) {
+	tmpl, err := template.New("command").Option("missingkey=error").Parse(command)
+	if err != nil {
+		return nil, err
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return nil, err
+	}
+	return strings.Fields(b.String()), nil
+}
+
+// checkConnBlockCommands checks that the block and unblock commands of the
+// settings are valid templates.
+func checkConnBlockCommands(commands ...string) error {
+	sample := connBlockData{IP: "192.0.2.1", Family: "ip", Port: "443", Minutes: 10, Seconds: 600}
+	for _, command := range commands {
+		if _, err := connBlockArgs(command, sample); err != nil {
+			return common.NewError("invalid connection block command:", err)
+		}
+	}
+	return nil
+}
+
+// runConnBlockCommand runs command for block; an empty command does nothing.
+func runConnBlockCommand(command string, block *model.ConnBlock) error {
+	family := "ip"
+	if ip := net.ParseIP(block.Ip); ip != nil && ip.To4() == nil {
+		family = "ip6"
+	}
+	seconds := max((block.ExpiresAt-block.CreatedAt)/1000, 1)
+	args, err := connBlockArgs(command, connBlockData{
+		IP:      block.Ip,
+		Family:  family,
+		Port:    block.Port,
+		Minutes: (seconds + 59) / 60,
+		Seconds: seconds,
+	})
+	if err != nil || len(args) == 0 {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), connBlockCommandTimeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		return common.NewErrorf("%s: %v: %s", args[0], err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// Enabled tells whether the settings have a block command, the connection
+// limits are not enforced without one.
+func (s *ConnBlockService) Enabled() bool {
+	command, err := s.settingService.GetConnBlockCommand()
+	return err == nil && strings.TrimSpace(command) != ""
+}
+
+// GetBlocks returns the blocks in effect, the newest first.
+func (s *ConnBlockService) GetBlocks() ([]*model.ConnBlock, error) {
+	blocks := make([]*model.ConnBlock, 0)
+	err := database.GetDB().Model(model.ConnBlock{}).
+		Where("expires_at > ?", time.Now().UnixMilli()).
+		Order("id DESC").
+		Find(&blocks).Error
+	return blocks, err
+}
+
+// record writes what happened to a block in the audit log.
+func (s *ConnBlockService) record(action string, block *model.ConnBlock, err error) {
+	after := map[string]any{
+		"ip":        block.Ip,
+		"inboundId": block.InboundId,
+		"port":      block.Port,
+		"limit":     block.Limit,
+		"count":     block.Count,
+		"expiresAt": block.ExpiresAt,
+	}
+	if err != nil {
+		after["error"] = err.Error()
+	}
+	s.auditService.Record(&model.AuditLog{
+		Actor:      "system",
+		Action:     action,
+		EntityType: "conn_block",
+		EntityId:   strconv.Itoa(block.Id),
+		Success:    err == nil,
+		Diff:       AuditDiff(map[string]any{}, after),
+	})
+}
+
+// block blocks the source of block for the minutes of the settings, unless
+// it's blocked from the inbound already. Nothing is stored if the block
+// command fails.
+func (s *ConnBlockService) block(block *model.ConnBlock) error {
+	command, err := s.settingService.GetConnBlockCommand()
+	if err != nil {
+		return err
+	}
+	minutes, err := s.settingService.GetConnBlockMinutes()
+	if err != nil {
+		return err
+	}
+	db := database.GetDB()
+	now := time.Now().UnixMilli()
+	var blocked int64
+	err = db.Model(model.ConnBlock{}).
+		Where("ip = ? AND inbound_id = ? AND expires_at > ?", block.Ip, block.InboundId, now).
+		Count(&blocked).Error
+	if err != nil || blocked > 0 {
+		return err
+	}
+	block.CreatedAt = now
+	block.ExpiresAt = now + int64(minutes)*time.Minute.Milliseconds()
+	if err := runConnBlockCommand(command, block); err != nil {
+		s.record("conn_block.add", block, err)
+		return err
+	}
+	if err := db.Create(block).Error; err != nil {
+		return err
+	}
+	logger.Infof("source %s was blocked from inbound %d on port %s for %d minutes, its %s was %d", block.Ip, block.InboundId, block.Port, minutes, block.Limit, block.Count)
+	s.record("conn_block.add", block, nil)
+	return nil
+}
+
+// lift runs the unblock command of the settings for block and deletes it. A
+// block whose command fails is deleted still, the firewall is left to lift it
+// on a timeout of its own then.
+func (s *ConnBlockService) lift(block *model.ConnBlock) error {
+	command, err := s.settingService.GetConnUnblockCommand()
+	if err != nil {
+		return err
+	}
+	err = runConnBlockCommand(command, block)
+	if err != nil {
+		logger.Warningf("unblock of source %s from inbound %d failed: %v", block.Ip, block.InboundId, err)
+	}
+	return common.Combine(err, database.GetDB().Delete(block).Error)
+}
+
+// DeleteBlock lifts a block before it expires.
+func (s *ConnBlockService) DeleteBlock(id int) (*model.ConnBlock, error) {
+	block := &model.ConnBlock{}
+	if err := database.GetDB().Model(model.ConnBlock{}).Where("id = ?", id).First(block).Error; err != nil {
+		return nil, err
+	}
+	return block, s.lift(block)
+}
+
+// DeleteBlocks lifts all blocks, and tells how many there were.
+func (s *ConnBlockService) DeleteBlocks() (int, error) {
+	blocks := make([]*model.ConnBlock, 0)
+	if err := database.GetDB().Model(model.ConnBlock{}).Find(&blocks).Error; err != nil {
+		return 0, err
+	}
+	errs := make([]error, 0)
+	for _, block := range blocks {
+		if err := s.lift(block); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return len(blocks), common.Combine(errs...)
+}
+
+// ExpireBlocks lifts the blocks that expired.
+func (s *ConnBlockService) ExpireBlocks() error {
+	blocks := make([]*model.ConnBlock, 0)
+	err := database.GetDB().Model(model.ConnBlock{}).
+		Where("expires_at <= ?", time.Now().UnixMilli()).
+		Find(&blocks).Error
+	if err != nil {
+		return err
+	}
+	errs := make([]error, 0)
+	for _, block := range blocks {
+		err := s.lift(block)
+		s.record("conn_block.expire", block, err)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return common.Combine(errs...)
+}
+
+// protectedPorts returns the ports of the panel and of the subscriptions,
+// inbounds on them are never blocked from.
+func (s *XrayService) protectedPorts() map[int]bool {
+	ports := map[int]bool{}
+	if port, err := s.settingService.GetPort(); err == nil {
+		ports[port] = true
+	}
+	if enable, err := s.settingService.GetSubEnable(); err == nil && enable {
+		if port, err := s.settingService.GetSubPort(); err == nil {
+			ports[port] = true
+		}
+	}
+	return ports
+}
+
+// limitConnections counts the connections of each source IP to the inbounds
+// with connection limits, connections[i] being those to inbounds[i], and
+// blocks the sources going over a limit. It does nothing unless the settings
+// have a block command.
+func (s *XrayService) limitConnections(inbounds []*model.Inbound, connections [][]sys.Connection, now time.Time) {
+	blocks := &ConnBlockService{settingService: s.settingService}
+	if !blocks.Enabled() {
+		connTracker.Lock()
+		connTracker.last, connTracker.inbounds, connTracker.opened = nil, nil, nil
+		connTracker.Unlock()
+		return
+	}
+	protected := s.protectedPorts()
+	cutoff := now.Add(-time.Minute).UnixMilli()
+	over := make([]*model.ConnBlock, 0)
+
+	connTracker.Lock()
+	last, tracked := connTracker.last, connTracker.inbounds
+	if connTracker.opened == nil {
+		connTracker.opened = map[connSource][]connOpening{}
+	}
+	connTracker.last, connTracker.inbounds = map[sys.Connection]bool{}, map[int]bool{}
+	for i, inbound := range inbounds {
+		limits := inbound.ConnLimits
+		if limits == nil {
+			continue
+		}
+		start, end := inbound.PortRange()
+		onProtected := false
+		for port := range protected {
+			onProtected = onProtected || (port >= start && port <= end)
+		}
+		if onProtected {
+			continue
+		}
+		connTracker.inbounds[inbound.Id] = true
+		concurrent, opened := map[string]int{}, map[string]int{}
+		for _, connection := range connections[i] {
+			connTracker.last[connection] = true
+			if ip := net.ParseIP(connection.RemoteIP); ip == nil || ip.IsLoopback() {
+				continue
+			}
+			concurrent[connection.RemoteIP]++
+			if tracked[inbound.Id] && !last[connection] {
+				opened[connection.RemoteIP]++
+			}
+		}
+		port := strconv.Itoa(start)
+		if end > start {
+			port += "-" + strconv.Itoa(end)
+		}
+		for ip, count := range concurrent {
+			source := connSource{inboundId: inbound.Id, ip: ip}
+			if opened[ip] > 0 {
+				connTracker.opened[source] = append(connTracker.opened[source], connOpening{at: now.UnixMilli(), count: opened[ip]})
+			}
+			perMinute := 0
+			for _, opening := range connTracker.opened[source] {
+				if opening.at > cutoff {
+					perMinute += opening.count
+				}
+			}
+			block := &model.ConnBlock{Ip: ip, InboundId: inbound.Id, Port: port}
+			switch {
+			case limits.MaxConnsPerIP > 0 && count > limits.MaxConnsPerIP:
+				block.Limit, block.Count = ConnLimitConcurrent, count
+			case limits.MaxNewConnsPerMinute > 0 && perMinute > limits.MaxNewConnsPerMinute:
+				block.Limit, block.Count = ConnLimitNewPerMin, perMinute
+			default:
+				continue
+			}
+			// A source blocked starts over once the block is lifted
+			delete(connTracker.opened, source)
+			over = append(over, block)
+		}
+	}
+	for source, openings := range connTracker.opened {
+		kept := openings[:0]
+		for _, opening := range openings {
+			if opening.at > cutoff {
+				kept = append(kept, opening)
+			}
+		}
+		if len(kept) == 0 || !connTracker.inbounds[source.inboundId] {
+			delete(connTracker.opened, source)
+		} else {
+			connTracker.opened[source] = kept
+		}
+	}
+	connTracker.Unlock()
+
+	for _, block := range over {
+		if err := blocks.block(block); err != nil {
+			logger.Warningf("block of source %s from inbound %d failed: %v", block.Ip, block.InboundId, err)
+		}
+	}
+}
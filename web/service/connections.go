@@ -0,0 +1,282 @@
+package service
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/util/sys"
+	"x-ui/xray"
+)
+
+const (
+	// ConnectionMethodSockets counts the connections in the socket tables of
+	// the host
+	ConnectionMethodSockets = "sockets"
+	// ConnectionMethodConntrack counts the connections the connection tracking
+	// of netfilter follows, UDP flows included
+	ConnectionMethodConntrack = "conntrack"
+
+	// onlineIPsTimeout is how long Xray is given to list the IPs of a client
+	onlineIPsTimeout = 2 * time.Second
+)
+
+// ConnectionCount is a number of TCP connections and UDP flows.
+type ConnectionCount struct {
+	TCP int `json:"tcp"`
+	UDP int `json:"udp"`
+}
+
+// ClientConnections are the connections of an inbound made from the IPs a
+// client was seen connecting from. Clients sharing an IP are each given its
+// connections.
+type ClientConnections struct {
+	Email string   `json:"email"`
+	IPs   []string `json:"ips"`
+	ConnectionCount
+}
+
+// InboundConnections are the connections to the port of an inbound.
+type InboundConnections struct {
+	InboundId int    `json:"inboundId"`
+	Tag       string `json:"tag"`
+	Port      int    `json:"port"`
+	SampledAt int64  `json:"sampledAt"`
+	ConnectionCount
+	Clients []ClientConnections `json:"clients"`
+}
+
+// ConnectionStats is the last sample of the connections to the inbounds.
+type ConnectionStats struct {
+	SampledAt int64  `json:"sampledAt"`
+	Method    string `json:"method"`
+	ConnectionCount
+	Inbounds []*InboundConnections `json:"inbounds"`
+}
+
+var (
+	connectionStatsLock sync.RWMutex
+	connectionStats     *ConnectionStats
+)
+
+// GetConnectionStats returns the last sample of the connections, or nil if
+// none was taken yet.
+func (s *XrayService) GetConnectionStats() *ConnectionStats {
+	connectionStatsLock.RLock()
+	defer connectionStatsLock.RUnlock()
+	return connectionStats
+}
+
+// GetInboundConnections returns the connections to an inbound of the last
+// sample.
+func (s *XrayService) GetInboundConnections(id int) (*InboundConnections, error) {
+	inbound, err := s.inboundService.GetInbound(id)
+	if err != nil {
+		return nil, err
+	}
+	stats := s.GetConnectionStats()
+	if stats == nil {
+		if interval, err := s.settingService.GetConnectionSampleInterval(); err == nil && interval == 0 {
+			return nil, common.NewError("connections are not sampled, the sample interval is 0")
+		}
+		return nil, common.NewError("connections have not been sampled yet")
+	}
+	for _, connections := range stats.Inbounds {
+		if connections.InboundId == id {
+			return connections, nil
+		}
+	}
+	// A disabled inbound has no connections
+	return &InboundConnections{
+		InboundId: inbound.Id,
+		Tag:       inbound.Tag,
+		Port:      inbound.Port,
+		SampledAt: stats.SampledAt,
+		Clients:   []ClientConnections{},
+	}, nil
+}
+
+// onlineClientIPs returns the IPs the clients seen within the online window
+// connected from, by email: the ones of the access log, and the ones Xray
+// keeps with statsUserOnline in its policy, which it forgets 20 seconds after
+// a connection opens.
+func (s *XrayService) onlineClientIPs() (map[string][]string, error) {
+	seen := map[string]map[string]bool{}
+	for email, sighting := range s.inboundService.onlineSightings() {
+		seen[email] = map[string]bool{}
+		for ip := range sighting.ips {
+			seen[email][ip] = true
+		}
+	}
+	var err error
+	if len(seen) > 0 && s.IsXrayRunning() {
+		err = s.xrayAPI.Init(p.GetAPIPort())
+		if err == nil {
+			for email := range seen {
+				var online map[string]int64
+				if online, err = s.xrayAPI.GetOnlineIPs(email, onlineIPsTimeout); err != nil {
+					break
+				}
+				for ip := range online {
+					seen[email][ip] = true
+				}
+			}
+			s.xrayAPI.Close()
+		}
+	}
+
+	ips := map[string][]string{}
+	for email, addresses := range seen {
+		for ip := range addresses {
+			if parsed := net.ParseIP(ip); parsed != nil {
+				ips[email] = append(ips[email], parsed.String())
+			}
+		}
+		sort.Strings(ips[email])
+	}
+	return ips, err
+}
+
+// listensOn tells if an inbound takes the connections made to ip.
+func listensOn(inbound *model.Inbound, ip string) bool {
+	listen := net.ParseIP(inbound.Listen)
+	return listen == nil || listen.IsUnspecified() || listen.String() == ip
+}
+
+// SampleConnections counts the connections to the port of each enabled
+// inbound, by the method of the settings, and attributes them to the clients
+// seen connecting from their remote IPs. The sample is kept for the API.
+func (s *XrayService) SampleConnections() error {
+	method, err := s.settingService.GetConnectionMethod()
+	if err != nil {
+		return err
+	}
+	var connections []sys.Connection
+	switch method {
+	case ConnectionMethodConntrack:
+		connections, err = sys.GetConntrackConnections()
+	default:
+		method = ConnectionMethodSockets
+		connections, err = sys.GetSocketConnections()
+	}
+	if err != nil {
+		return err
+	}
+
+	var inbounds []*model.Inbound
+	err = database.GetDB().Model(model.Inbound{}).
+		Select("id, tag, listen, port, port_end, conn_limits").
+		Where("enable = ?", true).
+		Find(&inbounds).Error
+	if err != nil {
+		return err
+	}
+	stats := &ConnectionStats{
+		SampledAt: time.Now().UnixMilli(),
+		Method:    method,
+		Inbounds:  make([]*InboundConnections, 0, len(inbounds)),
+	}
+	byPort := map[int][]int{}
+	for i, inbound := range inbounds {
+		stats.Inbounds = append(stats.Inbounds, &InboundConnections{
+			InboundId: inbound.Id,
+			Tag:       inbound.Tag,
+			Port:      inbound.Port,
+			SampledAt: stats.SampledAt,
+			Clients:   []ClientConnections{},
+		})
+		start, end := inbound.PortRange()
+		for port := max(start, 1); port <= end; port++ {
+			byPort[port] = append(byPort[port], i)
+		}
+	}
+
+	// The clients of each inbound by the IPs they connected from
+	onlineIPs, err := s.onlineClientIPs()
+	if err != nil {
+		// The IPs of the access log are still used
+		logger.Debug("get online IPs of clients from xray failed:", err)
+	}
+	var traffics []xray.ClientTraffic
+	if len(onlineIPs) > 0 {
+		emails := make([]string, 0, len(onlineIPs))
+		for email := range onlineIPs {
+			emails = append(emails, email)
+		}
+		err = database.GetDB().Model(xray.ClientTraffic{}).
+			Select("email, inbound_id").
+			Where("email IN ?", emails).
+			Find(&traffics).Error
+		if err != nil {
+			return err
+		}
+	}
+	inboundIndex := map[int]int{}
+	for i, inbound := range inbounds {
+		inboundIndex[inbound.Id] = i
+	}
+	clientsByIP := make([]map[string][]int, len(inbounds))
+	for _, traffic := range traffics {
+		i, ok := inboundIndex[traffic.InboundId]
+		ips := onlineIPs[traffic.Email]
+		if !ok || len(ips) == 0 {
+			continue
+		}
+		connections := stats.Inbounds[i]
+		connections.Clients = append(connections.Clients, ClientConnections{Email: traffic.Email, IPs: ips})
+		if clientsByIP[i] == nil {
+			clientsByIP[i] = map[string][]int{}
+		}
+		for _, ip := range ips {
+			clientsByIP[i][ip] = append(clientsByIP[i][ip], len(connections.Clients)-1)
+		}
+	}
+
+	// The connections to the inbounds with connection limits, for the limits
+	limited := make([][]sys.Connection, len(inbounds))
+	count := func(c *ConnectionCount, proto string) {
+		if proto == "udp" {
+			c.UDP++
+		} else {
+			c.TCP++
+		}
+	}
+	for _, connection := range connections {
+		for _, i := range byPort[connection.LocalPort] {
+			if !listensOn(inbounds[i], connection.LocalIP) {
+				continue
+			}
+			if inbounds[i].ConnLimits != nil {
+				limited[i] = append(limited[i], connection)
+			}
+			inbound := stats.Inbounds[i]
+			count(&inbound.ConnectionCount, connection.Proto)
+			count(&stats.ConnectionCount, connection.Proto)
+			for _, client := range clientsByIP[i][connection.RemoteIP] {
+				count(&inbound.Clients[client].ConnectionCount, connection.Proto)
+			}
+			break
+		}
+	}
+	for _, inbound := range stats.Inbounds {
+		sort.Slice(inbound.Clients, func(a, b int) bool {
+			ca, cb := inbound.Clients[a], inbound.Clients[b]
+			if ca.TCP+ca.UDP != cb.TCP+cb.UDP {
+				return ca.TCP+ca.UDP > cb.TCP+cb.UDP
+			}
+			return ca.Email < cb.Email
+		})
+	}
+
+	connectionStatsLock.Lock()
+	connectionStats = stats
+	connectionStatsLock.Unlock()
+
+	s.limitConnections(inbounds, limited, time.UnixMilli(stats.SampledAt))
+	return nil
+}
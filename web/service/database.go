@@ -0,0 +1,153 @@
+package service
+
+import (
+	"encoding/json"
+	"html"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"x-ui/config"
+	"x-ui/database"
+	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/web/entity"
+)
+
+// dbOptimizeStateFile of the bin folder keeps the last optimization of the
+// database
+const dbOptimizeStateFile = "db-optimize.json"
+
+var (
+	dbOptimizeLock       sync.Mutex
+	lastDbOptimize       *DatabaseOptimization
+	lastDbOptimizeLoaded bool
+)
+
+// DatabaseOptimization is a run of the optimization of the database, with the
+// sizes it had before and after it, or the error it failed with.
+type DatabaseOptimization struct {
+	Time time.Time `json:"time"`
+	// Duration is how long it ran, in milliseconds
+	Duration int64 `json:"duration"`
+	database.OptimizeReport
+	Error string `json:"error,omitempty"`
+}
+
+// DatabaseStatus is the size of the database and when it is optimized.
+type DatabaseStatus struct {
+	Dialect      string                `json:"dialect"`
+	Size         int64                 `json:"size"`
+	AutoOptimize bool                  `json:"autoOptimize"`
+	Cron         string                `json:"cron"`
+	NextRun      time.Time             `json:"nextRun,omitzero"`
+	LastOptimize *DatabaseOptimization `json:"lastOptimize,omitempty"`
+}
+
+// DatabaseService optimizes the database of the panel.
+type DatabaseService struct {
+	settingService SettingService
+}
+
+func loadLastDbOptimize() {
+	if lastDbOptimizeLoaded {
+		return
+	}
+	lastDbOptimizeLoaded = true
+	data, err := os.ReadFile(filepath.Join(config.GetBinFolderPath(), dbOptimizeStateFile))
+	if err == nil {
+		err = json.Unmarshal(data, &lastDbOptimize)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		logger.Warning("Unable to read the last optimization of the database:", err)
+	}
+}
+
+func saveLastDbOptimize() {
+	data, err := json.Marshal(lastDbOptimize)
+	if err == nil {
+		err = os.WriteFile(filepath.Join(config.GetBinFolderPath(), dbOptimizeStateFile), data, 0o644)
+	}
+	if err != nil {
+		logger.Warning("Unable to save the last optimization of the database:", err)
+	}
+}
+
+// GetLastOptimize returns the last optimization of the database, nil if it was
+// never optimized.
+func (s *DatabaseService) GetLastOptimize() *DatabaseOptimization {
+	dbOptimizeLock.Lock()
+	defer dbOptimizeLock.Unlock()
+	loadLastDbOptimize()
+	return lastDbOptimize
+}
+
+// GetStatus returns the size of the database and its optimizations.
+func (s *DatabaseService) GetStatus() (*DatabaseStatus, error) {
+	status := &DatabaseStatus{Dialect: database.Dialect()}
+	var err error
+	if status.Size, err = database.Size(); err != nil {
+		return nil, err
+	}
+	if status.AutoOptimize, err = s.settingService.GetDbAutoOptimize(); err != nil {
+		return nil, err
+	}
+	if status.Cron, err = s.settingService.GetDbOptimizeCron(); err != nil {
+		return nil, err
+	}
+	if status.AutoOptimize {
+		if schedule, err := entity.CronParser.Parse(status.Cron); err == nil {
+			// The jobs run in the panel time zone
+			status.NextRun = schedule.Next(time.Now().In(panelLocation()))
+		}
+	}
+	status.LastOptimize = s.GetLastOptimize()
+	return status, nil
+}
+
+// Optimize checkpoints, vacuums and analyzes the database, see
+// database.Optimize, and records the run. It returns database.ErrFileBusy
+// without running while the database is backed up or restored.
+func (s *DatabaseService) Optimize() (*DatabaseOptimization, error) {
+	start := time.Now()
+	report, err := database.Optimize()
+	if err == database.ErrFileBusy {
+		return nil, err
+	}
+	run := &DatabaseOptimization{Time: start, Duration: time.Since(start).Milliseconds()}
+	if err != nil {
+		run.Error = err.Error()
+	} else {
+		run.OptimizeReport = *report
+		logger.Infof("database optimized in %v, %d bytes before and %d after",
+			time.Since(start).Round(time.Millisecond), report.SizeBefore, report.SizeAfter)
+	}
+
+	dbOptimizeLock.Lock()
+	loadLastDbOptimize()
+	lastDbOptimize = run
+	saveLastDbOptimize()
+	dbOptimizeLock.Unlock()
+
+	if err != nil {
+		return run, common.NewErrorf("optimizing the database failed: %v", err)
+	}
+	return run, nil
+}
+
+// DatabaseOptimizeFailed tells the admins that the scheduled
+// optimization of the database failed, such as for a disk too full to vacuum.
+func (t *Tgbot) DatabaseOptimizeFailed(err error) {
+	if !t.AlertsOn(AlertDatabase) {
+		return
+	}
+	enabled, settingErr := t.settingService.GetTgBotDbOptimizeNotify()
+	if settingErr != nil || !enabled {
+		return
+	}
+	msg := t.I18nBot("tgbot.messages.dbOptimizeFailed")
+	msg += t.I18nBot("tgbot.messages.hostname", "Hostname=="+hostname)
+	msg += t.I18nBot("tgbot.messages.error", "Error=="+html.EscapeString(err.Error()))
+	t.SendAlert(AlertDatabase, msg)
+}
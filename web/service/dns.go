@@ -0,0 +1,548 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"x-ui/util/common"
+
+	"github.com/goccy/go-json"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// MaxDnsTestTimeout is the longest a test of the DNS servers may wait for one
+	MaxDnsTestTimeout = 10 * time.Second
+	maxDnsTestServers = 16
+)
+
+// hostnamePattern matches domain names, and names of hosts without a domain.
+var hostnamePattern = regexp.MustCompile(`^([A-Za-z0-9_]([A-Za-z0-9_-]{0,61}[A-Za-z0-9_])?\.)*[A-Za-z0-9_]([A-Za-z0-9_-]{0,61}[A-Za-z0-9_])?\.?$`)
+
+// dnsSchemes are the schemes of the DNS servers Xray queries by URL.
+var dnsSchemes = map[string]bool{
+	"https":       true,
+	"https+local": true,
+	"h2c":         true,
+	"h2c+local":   true,
+	"quic+local":  true,
+	"tcp":         true,
+	"tcp+local":   true,
+}
+
+// dnsQueryStrategies are the query strategies of Xray, of the whole DNS or of
+// one server.
+var dnsQueryStrategies = map[string]bool{
+	"UseIP":     true,
+	"UseIPv4":   true,
+	"UseIPv6":   true,
+	"UseSystem": true,
+}
+
+// DnsServer is a DNS server of Xray. Servers with only an address are written
+// as one, like Xray takes them.
+type DnsServer struct {
+	Address       string   `json:"address"`
+	Port          int      `json:"port,omitempty"`
+	Domains       []string `json:"domains,omitempty"`
+	ExpectIPs     []string `json:"expectIPs,omitempty"`
+	UnexpectIPs   []string `json:"unexpectIPs,omitempty"`
+	SkipFallback  bool     `json:"skipFallback,omitempty"`
+	ClientIP      string   `json:"clientIp,omitempty"`
+	QueryStrategy string   `json:"queryStrategy,omitempty"`
+	TimeoutMs     int      `json:"timeoutMs,omitempty"`
+	DisableCache  bool     `json:"disableCache,omitempty"`
+	FinalQuery    bool     `json:"finalQuery,omitempty"`
+	Tag           string   `json:"tag,omitempty"`
+}
+
+type dnsServerFields DnsServer
+
+func (s *DnsServer) UnmarshalJSON(data []byte) error {
+	var address string
+	if err := json.Unmarshal(data, &address); err == nil {
+		*s = DnsServer{Address: address}
+		return nil
+	}
+	return json.Unmarshal(data, (*dnsServerFields)(s))
+}
+
+func (s DnsServer) MarshalJSON() ([]byte, error) {
+	if s.Port == 0 && len(s.Domains) == 0 && len(s.ExpectIPs) == 0 && len(s.UnexpectIPs) == 0 &&
+		!s.SkipFallback && s.ClientIP == "" &&
+		s.QueryStrategy == "" && s.TimeoutMs == 0 && !s.DisableCache && !s.FinalQuery && s.Tag == "" {
+		return json.Marshal(s.Address)
+	}
+	return json.Marshal(dnsServerFields(s))
+}
+
+// DnsHost are the addresses, or the domain, a host of the DNS config resolves
+// to. One address is written as a string.
+type DnsHost []string
+
+func (h *DnsHost) UnmarshalJSON(data []byte) error {
+	var address string
+	if err := json.Unmarshal(data, &address); err == nil {
+		*h = DnsHost{address}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(h))
+}
+
+func (h DnsHost) MarshalJSON() ([]byte, error) {
+	if len(h) == 1 {
+		return json.Marshal(h[0])
+	}
+	return json.Marshal([]string(h))
+}
+
+// DnsConfig is the dns section of the Xray config template.
+type DnsConfig struct {
+	Servers                []DnsServer        `json:"servers"`
+	Hosts                  map[string]DnsHost `json:"hosts,omitempty"`
+	ClientIP               string             `json:"clientIp,omitempty"`
+	QueryStrategy          string             `json:"queryStrategy,omitempty"`
+	DisableCache           bool               `json:"disableCache,omitempty"`
+	DisableFallback        bool               `json:"disableFallback,omitempty"`
+	DisableFallbackIfMatch bool               `json:"disableFallbackIfMatch,omitempty"`
+	UseSystemHosts         bool               `json:"useSystemHosts,omitempty"`
+	Tag                    string             `json:"tag,omitempty"`
+}
+
+// DnsAnswer is how a DNS server resolved a name in a test.
+type DnsAnswer struct {
+	Server    string   `json:"server"`
+	Addresses []string `json:"addresses"`
+	LatencyMs int64    `json:"latencyMs"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// DnsService edits the dns section of the Xray config template.
+type DnsService struct {
+	settingService SettingService
+}
+
+// checkDnsAddress checks the address of a DNS server: an IP or a host name,
+// localhost, fakedns, or the URL of a server Xray queries over HTTPS, QUIC or
+// TCP.
+func checkDnsAddress(address string) error {
+	switch strings.ToLower(address) {
+	case "":
+		return common.NewErrorf("can not be empty")
+	case "localhost", "fakedns":
+		return nil
+	}
+	if !strings.Contains(address, "://") {
+		if net.ParseIP(address) == nil && !hostnamePattern.MatchString(address) {
+			return common.NewErrorf("%q is not an IP, a host name or a URL", address)
+		}
+		return nil
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return common.NewErrorf("%q is not a valid URL: %v", address, err)
+	}
+	scheme := strings.ToLower(u.Scheme)
+	if scheme == "tls" {
+		return common.NewErrorf("Xray doesn't query DNS over TLS, use https:// or tcp:// instead of %q", address)
+	}
+	if !dnsSchemes[scheme] {
+		return common.NewErrorf("%q has an unknown scheme %s", address, u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return common.NewErrorf("%q has no host", address)
+	}
+	if port := u.Port(); port != "" {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return common.NewErrorf("%q has an invalid port", address)
+		}
+	}
+	return nil
+}
+
+func checkQueryStrategy(strategy string) error {
+	if strategy != "" && !dnsQueryStrategies[strategy] {
+		return common.NewErrorf("queryStrategy must be UseIP, UseIPv4, UseIPv6 or UseSystem, not %q", strategy)
+	}
+	return nil
+}
+
+// checkDnsDomain checks a domain of the DNS config like one of a routing rule,
+// with its geosite list looked up.
+func checkDnsDomain(domain string) error {
+	if err := checkRuleDomain(domain); err != nil {
+		return err
+	}
+	if strings.HasPrefix(domain, "geosite:") || strings.HasPrefix(domain, "ext:") {
+		return checkGeosite(domain)
+	}
+	return nil
+}
+
+func checkDnsServer(server *DnsServer) error {
+	server.Address = strings.TrimSpace(server.Address)
+	server.Domains = normalizeRuleList(server.Domains)
+	server.ExpectIPs = normalizeRuleList(server.ExpectIPs)
+	server.UnexpectIPs = normalizeRuleList(server.UnexpectIPs)
+	server.ClientIP = strings.TrimSpace(server.ClientIP)
+	if err := checkDnsAddress(server.Address); err != nil {
+		return common.NewErrorf("address: %v", err)
+	}
+	if server.Port < 0 || server.Port > 65535 {
+		return common.NewErrorf("port: %d is not a valid port", server.Port)
+	}
+	for i, domain := range server.Domains {
+		if err := checkDnsDomain(domain); err != nil {
+			return common.NewErrorf("domains[%d]: %v", i, err)
+		}
+	}
+	for i, ip := range server.ExpectIPs {
+		if err := checkRuleIp(ip); err != nil {
+			return common.NewErrorf("expectIPs[%d]: %v", i, err)
+		}
+	}
+	for i, ip := range server.UnexpectIPs {
+		if err := checkRuleIp(ip); err != nil {
+			return common.NewErrorf("unexpectIPs[%d]: %v", i, err)
+		}
+	}
+	if server.ClientIP != "" && net.ParseIP(server.ClientIP) == nil {
+		return common.NewErrorf("clientIp: %q is not an IP", server.ClientIP)
+	}
+	if server.TimeoutMs < 0 {
+		return common.NewErrorf("timeoutMs: must not be negative")
+	}
+	return checkQueryStrategy(server.QueryStrategy)
+}
+
+func checkDnsConfig(config *DnsConfig) error {
+	for i := range config.Servers {
+		if err := checkDnsServer(&config.Servers[i]); err != nil {
+			return common.NewErrorf("servers[%d].%v", i, err)
+		}
+	}
+	for host, addresses := range config.Hosts {
+		if err := checkDnsDomain(host); err != nil {
+			return common.NewErrorf("hosts[%q]: %v", host, err)
+		}
+		if len(addresses) == 0 {
+			return common.NewErrorf("hosts[%q]: has no address", host)
+		}
+		for _, address := range addresses {
+			if net.ParseIP(address) == nil && !hostnamePattern.MatchString(address) {
+				return common.NewErrorf("hosts[%q]: %q is not an IP or a domain", host, address)
+			}
+		}
+	}
+	config.ClientIP = strings.TrimSpace(config.ClientIP)
+	if config.ClientIP != "" && net.ParseIP(config.ClientIP) == nil {
+		return common.NewErrorf("clientIp: %q is not an IP", config.ClientIP)
+	}
+	if err := checkQueryStrategy(config.QueryStrategy); err != nil {
+		return err
+	}
+	if strings.ContainsAny(config.Tag, " \t") {
+		return common.NewErrorf("tag: %q has spaces", config.Tag)
+	}
+	return nil
+}
+
+func (s *DnsService) parseTemplate() (map[string]any, error) {
+	template, err := s.settingService.GetXrayConfigTemplate()
+	if err != nil {
+		return nil, err
+	}
+	var config map[string]any
+	if err := json.Unmarshal([]byte(template), &config); err != nil || config == nil {
+		return nil, common.NewError("xray template config invalid:", err)
+	}
+	return config, nil
+}
+
+// GetDns returns the dns section of the config template.
+func (s *DnsService) GetDns() (*DnsConfig, error) {
+	template, err := s.parseTemplate()
+	if err != nil {
+		return nil, err
+	}
+	config := &DnsConfig{Servers: []DnsServer{}}
+	if section, ok := template["dns"]; ok && section != nil {
+		data, err := json.Marshal(section)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, config); err != nil {
+			return nil, common.NewError("the dns section of the xray template config is invalid:", err)
+		}
+	}
+	return config, nil
+}
+
+// SaveDns replaces the dns section of the config template, once Xray took the
+// config. The fields of the section the panel doesn't edit are kept.
+func (s *DnsService) SaveDns(config *DnsConfig) error {
+	if err := checkDnsConfig(config); err != nil {
+		return err
+	}
+	template, err := s.parseTemplate()
+	if err != nil {
+		return err
+	}
+	section, _ := template["dns"].(map[string]any)
+	if section == nil {
+		section = map[string]any{}
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	for _, key := range []string{"servers", "hosts", "clientIp", "queryStrategy", "disableCache", "disableFallback", "disableFallbackIfMatch", "useSystemHosts", "tag"} {
+		if value, ok := fields[key]; ok {
+			section[key] = value
+		} else {
+			delete(section, key)
+		}
+	}
+	if len(config.Servers) == 0 {
+		delete(section, "servers")
+	}
+	if len(section) == 0 {
+		delete(template, "dns")
+	} else {
+		template["dns"] = section
+	}
+
+	newTemplate, err := json.MarshalIndent(template, "", "  ")
+	if err != nil {
+		return err
+	}
+	var xrayService XrayService
+	if err := xrayService.testXrayTemplate(string(newTemplate)); err != nil {
+		return err
+	}
+	return s.settingService.saveSetting("xrayTemplateConfig", string(newTemplate))
+}
+
+// dnsExchange sends a DNS query to a server and returns its answer.
+type dnsExchange func(ctx context.Context, query []byte) ([]byte, error)
+
+// exchangeUDP queries a plain DNS server over UDP.
+func exchangeUDP(address string) dnsExchange {
+	return func(ctx context.Context, query []byte) ([]byte, error) {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "udp", address)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(deadline)
+		}
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		answer := make([]byte, 64*1024)
+		for {
+			n, err := conn.Read(answer)
+			if err != nil {
+				return nil, err
+			}
+			// The answer has the ID of the query
+			if n >= 2 && bytes.Equal(answer[:2], query[:2]) {
+				return answer[:n], nil
+			}
+		}
+	}
+}
+
+// exchangeTCP queries a plain DNS server over TCP, where messages are prefixed
+// with their length.
+func exchangeTCP(address string) dnsExchange {
+	return func(ctx context.Context, query []byte) ([]byte, error) {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", address)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(deadline)
+		}
+		if _, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(query))), query...)); err != nil {
+			return nil, err
+		}
+		length := make([]byte, 2)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return nil, err
+		}
+		answer := make([]byte, binary.BigEndian.Uint16(length))
+		if _, err := io.ReadFull(conn, answer); err != nil {
+			return nil, err
+		}
+		return answer, nil
+	}
+}
+
+// exchangeDoh queries a DNS over HTTPS server.
+func exchangeDoh(endpoint string) dnsExchange {
+	return func(ctx context.Context, query []byte) ([]byte, error) {
+		req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(query))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/dns-message")
+		req.Header.Set("Accept", "application/dns-message")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, common.NewErrorf("the server answered %s", resp.Status)
+		}
+		return io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	}
+}
+
+// queryDns resolves a name with a DNS server, asking for its IPv4 and IPv6
+// addresses. The hosts file of the system is not looked at.
+func queryDns(ctx context.Context, exchange dnsExchange, name string) ([]string, error) {
+	fqdn, err := dnsmessage.NewName(strings.TrimSuffix(name, ".") + ".")
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 2)
+	var addresses []string
+	for _, queryType := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		if _, err := rand.Read(id); err != nil {
+			return nil, err
+		}
+		query, err := (&dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: binary.BigEndian.Uint16(id), RecursionDesired: true},
+			Questions: []dnsmessage.Question{{Name: fqdn, Type: queryType, Class: dnsmessage.ClassINET}},
+		}).Pack()
+		if err != nil {
+			return nil, err
+		}
+		data, err := exchange(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		var answer dnsmessage.Message
+		if err := answer.Unpack(data); err != nil {
+			return nil, common.NewErrorf("the server didn't answer with a DNS message: %v", err)
+		}
+		if answer.RCode != dnsmessage.RCodeSuccess {
+			return nil, common.NewErrorf("the server answered %s", answer.RCode)
+		}
+		for _, resource := range answer.Answers {
+			switch body := resource.Body.(type) {
+			case *dnsmessage.AResource:
+				addresses = append(addresses, net.IP(body.A[:]).String())
+			case *dnsmessage.AAAAResource:
+				addresses = append(addresses, net.IP(body.AAAA[:]).String())
+			}
+		}
+	}
+	return addresses, nil
+}
+
+// resolveWith resolves a name with a DNS server, as Xray would query it.
+func resolveWith(ctx context.Context, server DnsServer, name string) ([]string, error) {
+	address := server.Address
+	switch strings.ToLower(address) {
+	case "localhost":
+		return net.DefaultResolver.LookupHost(ctx, name)
+	case "fakedns":
+		return nil, common.NewErrorf("fakedns answers with addresses of its pool, it can't be tested")
+	}
+	if !strings.Contains(address, "://") {
+		port := server.Port
+		if port == 0 {
+			port = 53
+		}
+		return queryDns(ctx, exchangeUDP(net.JoinHostPort(address, strconv.Itoa(port))), name)
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "tcp", "tcp+local":
+		port := u.Port()
+		if port == "" {
+			port = "53"
+		}
+		return queryDns(ctx, exchangeTCP(net.JoinHostPort(u.Hostname(), port)), name)
+	case "https", "https+local":
+		u.Scheme = "https"
+		return queryDns(ctx, exchangeDoh(u.String()), name)
+	}
+	return nil, common.NewErrorf("servers over %s can't be tested", u.Scheme)
+}
+
+// TestResolution resolves a name with every DNS server of the config template at
+// once. The panel queries the servers itself, not through Xray, so it sends the
+// queries of remote servers out directly as well.
+func (s *DnsService) TestResolution(name string, timeout time.Duration) ([]DnsAnswer, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || !hostnamePattern.MatchString(name) {
+		return nil, common.NewErrorf("%q is not a domain name", name)
+	}
+	if timeout <= 0 || timeout > MaxDnsTestTimeout {
+		return nil, common.NewErrorf("timeout must be at most %v", MaxDnsTestTimeout)
+	}
+	config, err := s.GetDns()
+	if err != nil {
+		return nil, err
+	}
+	servers := config.Servers
+	if len(servers) == 0 {
+		// Without servers Xray resolves with the system
+		servers = []DnsServer{{Address: "localhost"}}
+	}
+	if len(servers) > maxDnsTestServers {
+		servers = servers[:maxDnsTestServers]
+	}
+
+	answers := make([]DnsAnswer, len(servers))
+	var wg sync.WaitGroup
+	for i, server := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			start := time.Now()
+			addresses, err := resolveWith(ctx, server, name)
+			answers[i] = DnsAnswer{
+				Server:    server.Address,
+				Addresses: addresses,
+				LatencyMs: time.Since(start).Milliseconds(),
+			}
+			if answers[i].Addresses == nil {
+				answers[i].Addresses = []string{}
+			}
+			if err != nil {
+				answers[i].Error = strings.TrimSpace(err.Error())
+			}
+		}()
+	}
+	wg.Wait()
+	return answers, nil
+}
@@ -0,0 +1,361 @@
+package service
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"x-ui/xray"
+
+	"github.com/goccy/go-json"
+	"github.com/xtls/xray-core/app/router"
+	"golang.org/x/net/dns/dnsmessage"
+	"google.golang.org/protobuf/proto"
+)
+
+// fakeXray puts in a new bin folder an Xray that takes every config but those
+// with reject in them, failing like Xray does. Run with a config, it waits to
+// be stopped.
+func fakeXray(t *testing.T, reject string) string {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("XUI_BIN_FOLDER", dir)
+	script := `#!/bin/sh
+while [ $# -gt 0 ]; do
+	case "$1" in
+	-c) config="$2" ;;
+	-test) test=1 ;;
+	-version) echo "Xray 25.1.1 (Xray, Penetrates Everything.)"; exit 0 ;;
+	esac
+	shift
+done
+[ -z "$test" ] && exec sleep 60
+if grep -q '` + reject + `' "$config"; then
+	echo "Xray 25.1.1 (Xray, Penetrates Everything.)"
+	echo "Failed to start: main: failed to load config files: ` + reject + ` is not valid"
+	exit 23
+fi
+echo "Configuration OK."
+`
+	if err := os.WriteFile(filepath.Join(dir, xray.GetBinaryName()), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestDnsConfigJSON(t *testing.T) {
+	data := `{"servers":["1.1.1.1",{"address":"https://dns.google/dns-query","domains":["geosite:google"]}],` +
+		`"hosts":{"a.example":"192.0.2.1","b.example":["192.0.2.2","2001:db8::2"]},"queryStrategy":"UseIPv4"}`
+	var config DnsConfig
+	if err := json.Unmarshal([]byte(data), &config); err != nil {
+		t.Fatal(err)
+	}
+	if config.Servers[0].Address != "1.1.1.1" || config.Servers[1].Domains[0] != "geosite:google" ||
+		len(config.Hosts["a.example"]) != 1 || len(config.Hosts["b.example"]) != 2 {
+		t.Errorf("parsed %+v", config)
+	}
+	// Servers with only an address and hosts with one are written as strings
+	again, err := json.Marshal(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameJSON(t, data, string(again)) {
+		t.Errorf("written as %s, want %s", again, data)
+	}
+}
+
+func TestCheckDnsConfig(t *testing.T) {
+	valid := DnsConfig{
+		Servers: []DnsServer{
+			{Address: " 8.8.8.8 "}, {Address: "localhost"}, {Address: "fakedns"}, {Address: "dns.example"},
+			{Address: "https://1.1.1.1/dns-query"}, {Address: "tcp+local://9.9.9.9:53"},
+			{Address: "2001:4860:4860::8888", Port: 53, Domains: []string{"full:example.com", " "}, ExpectIPs: []string{"geoip:cn"}},
+		},
+		Hosts:    map[string]DnsHost{"domain:example.org": {"192.0.2.1"}, "dns.example": {"8.8.8.8", "8.8.4.4"}},
+		ClientIP: " 203.0.113.1 ",
+	}
+	if err := checkDnsConfig(&valid); err != nil {
+		t.Fatal(err)
+	}
+	if valid.Servers[0].Address != "8.8.8.8" || len(valid.Servers[6].Domains) != 1 || valid.ClientIP != "203.0.113.1" {
+		t.Errorf("the config was normalized to %+v", valid)
+	}
+
+	tests := []struct {
+		config DnsConfig
+		err    string
+	}{
+		{DnsConfig{Servers: []DnsServer{{Address: "1.1.1.1"}, {Address: ""}}}, "servers[1].address: can not be empty"},
+		{DnsConfig{Servers: []DnsServer{{Address: "not a host"}}}, "servers[0].address:"},
+		{DnsConfig{Servers: []DnsServer{{Address: "tls://1.1.1.1"}}}, "doesn't query DNS over TLS"},
+		{DnsConfig{Servers: []DnsServer{{Address: "udp://1.1.1.1"}}}, "unknown scheme udp"},
+		{DnsConfig{Servers: []DnsServer{{Address: "https:///dns-query"}}}, "has no host"},
+		{DnsConfig{Servers: []DnsServer{{Address: "tcp://1.1.1.1:0"}}}, "has an invalid port"},
+		{DnsConfig{Servers: []DnsServer{{Address: "1.1.1.1", Port: 70000}}}, "servers[0].port:"},
+		{DnsConfig{Servers: []DnsServer{{Address: "1.1.1.1", Domains: []string{"a.com", "geoip:cn"}}}}, "servers[0].domains[1]:"},
+		{DnsConfig{Servers: []DnsServer{{Address: "1.1.1.1", ExpectIPs: []string{"1.1.1.1/40"}}}}, "servers[0].expectIPs[0]:"},
+		{DnsConfig{Servers: []DnsServer{{Address: "1.1.1.1", UnexpectIPs: []string{"x"}}}}, "servers[0].unexpectIPs[0]:"},
+		{DnsConfig{Servers: []DnsServer{{Address: "1.1.1.1", ClientIP: "x"}}}, "servers[0].clientIp:"},
+		{DnsConfig{Servers: []DnsServer{{Address: "1.1.1.1", TimeoutMs: -1}}}, "servers[0].timeoutMs:"},
+		{DnsConfig{Servers: []DnsServer{{Address: "1.1.1.1", QueryStrategy: "UseIPv5"}}}, "servers[0].queryStrategy"},
+		{DnsConfig{Hosts: map[string]DnsHost{"a.example": {}}}, `hosts["a.example"]: has no address`},
+		{DnsConfig{Hosts: map[string]DnsHost{"a.example": {"no host"}}}, `hosts["a.example"]: "no host" is not an IP or a domain`},
+		{DnsConfig{Hosts: map[string]DnsHost{"bad:a.example": {"192.0.2.1"}}}, `hosts["bad:a.example"]:`},
+		{DnsConfig{ClientIP: "x"}, "clientIp:"},
+		{DnsConfig{QueryStrategy: "IPv4"}, "queryStrategy"},
+		{DnsConfig{Tag: "dns in"}, "tag:"},
+	}
+	for _, test := range tests {
+		err := checkDnsConfig(&test.config)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("config %+v: error %v, want %q", test.config, err, test.err)
+		}
+	}
+}
+
+func TestCheckGeosite(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XUI_BIN_FOLDER", dir)
+	// Without the file lists are not checked
+	if err := checkGeosite("geosite:nothing"); err != nil {
+		t.Errorf("a list was checked without its file: %v", err)
+	}
+
+	data, err := proto.Marshal(&router.GeoSiteList{Entry: []*router.GeoSite{
+		{CountryCode: "GOOGLE", Domain: []*router.Domain{
+			{Value: "google.com"},
+			{Value: "google.cn", Attribute: []*router.Domain_Attribute{{Key: "cn"}}},
+		}},
+		{CountryCode: "CATEGORY-ADS-ALL", Domain: []*router.Domain{{Value: "ads.example"}}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"geosite.dat", "geosite_IR.dat"} {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for domain, want := range map[string]string{
+		"geosite:google":               "",
+		"geosite:Google@cn":            "",
+		"geosite:google@!cn":           "",
+		"geosite:category-ads-all":     "",
+		"ext:geosite_IR.dat:google@cn": "",
+		"geosite:netflix":              "geosite.dat has no list netflix",
+		"geosite:google@ads":           "list google of geosite.dat has no attribute ads",
+		"ext:geosite_IR.dat:ir":        "geosite_IR.dat has no list ir",
+	} {
+		err := checkGeosite(domain)
+		if want == "" && err != nil || want != "" && (err == nil || !strings.Contains(err.Error(), want)) {
+			t.Errorf("%s: error %v, want %q", domain, err, want)
+		}
+	}
+	if err := checkDnsConfig(&DnsConfig{Servers: []DnsServer{{Address: "1.1.1.1", Domains: []string{"geosite:netflix"}}}}); err == nil ||
+		!strings.Contains(err.Error(), "servers[0].domains[0]: geosite.dat has no list netflix") {
+		t.Errorf("a missing list of a server was taken: %v", err)
+	}
+}
+
+func TestSaveDns(t *testing.T) {
+	newTestDB(t)
+	var s DnsService
+	template, err := s.parseTemplate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	template["dns"] = map[string]any{"servers": []any{"8.8.8.8"}, "fallbackStrategy": "disabled"}
+	data, _ := json.Marshal(template)
+	if err := s.settingService.saveSetting("xrayTemplateConfig", string(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	fakeXray(t, "rejected.example")
+	config := &DnsConfig{Servers: []DnsServer{{Address: "1.1.1.1"}, {Address: "https://dns.google/dns-query"}}, QueryStrategy: "UseIPv4"}
+	if err := s.SaveDns(config); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := s.GetDns()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.Servers) != 2 || saved.Servers[1].Address != "https://dns.google/dns-query" || saved.QueryStrategy != "UseIPv4" {
+		t.Errorf("saved %+v", saved)
+	}
+	template, _ = s.parseTemplate()
+	if section := template["dns"].(map[string]any); section["fallbackStrategy"] != "disabled" {
+		t.Errorf("the fields the panel doesn't edit were dropped: %v", section)
+	}
+
+	// A config Xray rejects is not saved, with the reason of Xray
+	err = s.SaveDns(&DnsConfig{Servers: []DnsServer{{Address: "rejected.example"}}})
+	if err == nil || !strings.Contains(err.Error(), "rejected.example is not valid") {
+		t.Errorf("the rejected config gave %v", err)
+	}
+	if again, _ := s.GetDns(); len(again.Servers) != 2 {
+		t.Errorf("the rejected config replaced the dns section: %+v", again)
+	}
+
+	// Without servers nor fields the section goes
+	if err := s.SaveDns(&DnsConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	template, _ = s.parseTemplate()
+	if section, ok := template["dns"].(map[string]any); !ok || len(section) != 1 {
+		t.Errorf("the dns section is %v", template["dns"])
+	}
+}
+
+// answerDns answers a DNS query for a.example with 192.0.2.1 and 2001:db8::1,
+// and any other name with NXDOMAIN.
+func answerDns(t *testing.T, query []byte) []byte {
+	var message dnsmessage.Message
+	if err := message.Unpack(query); err != nil {
+		t.Error(err)
+		return nil
+	}
+	message.Response = true
+	question := message.Questions[0]
+	header := dnsmessage.ResourceHeader{Name: question.Name, Type: question.Type, Class: question.Class, TTL: 60}
+	switch {
+	case question.Name.String() != "a.example.":
+		message.RCode = dnsmessage.RCodeNameError
+	case question.Type == dnsmessage.TypeA:
+		message.Answers = []dnsmessage.Resource{{Header: header, Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}}}}
+	case question.Type == dnsmessage.TypeAAAA:
+		ip := [16]byte(net.ParseIP("2001:db8::1"))
+		message.Answers = []dnsmessage.Resource{{Header: header, Body: &dnsmessage.AAAAResource{AAAA: ip}}}
+	}
+	answer, err := message.Pack()
+	if err != nil {
+		t.Error(err)
+	}
+	return answer
+}
+
+func udpDnsServer(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(answerDns(t, buf[:n]), addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func tcpDnsServer(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				length := make([]byte, 2)
+				if _, err := io.ReadFull(conn, length); err != nil {
+					return
+				}
+				query := make([]byte, binary.BigEndian.Uint16(length))
+				if _, err := io.ReadFull(conn, query); err != nil {
+					return
+				}
+				answer := answerDns(t, query)
+				conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(answer))), answer...))
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestQueryDns(t *testing.T) {
+	doh := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, _ := io.ReadAll(r.Body)
+		if r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "bad content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(answerDns(t, query))
+	}))
+	defer doh.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	want := []string{"192.0.2.1", "2001:db8::1"}
+	for name, exchange := range map[string]dnsExchange{
+		"udp": exchangeUDP(udpDnsServer(t)),
+		"tcp": exchangeTCP(tcpDnsServer(t)),
+		"doh": exchangeDoh(doh.URL),
+	} {
+		addresses, err := queryDns(ctx, exchange, "a.example")
+		if err != nil || !slices.Equal(addresses, want) {
+			t.Errorf("%s resolved %v, %v, want %v", name, addresses, err, want)
+		}
+		if _, err := queryDns(ctx, exchange, "b.example"); err == nil || !strings.Contains(err.Error(), "RCodeNameError") {
+			t.Errorf("%s resolved a missing name: %v", name, err)
+		}
+	}
+}
+
+func TestTestResolution(t *testing.T) {
+	newTestDB(t)
+	t.Setenv("XUI_BIN_FOLDER", t.TempDir())
+	udpHost, udpPort, _ := net.SplitHostPort(udpDnsServer(t))
+	port, _ := strconv.Atoi(udpPort)
+	tcp := "tcp://" + tcpDnsServer(t)
+
+	var s DnsService
+	config := &DnsConfig{Servers: []DnsServer{{Address: udpHost, Port: port}, {Address: tcp}, {Address: "fakedns"}}}
+	if err := s.SaveDns(config); err != nil {
+		t.Fatal(err)
+	}
+	answers, err := s.TestResolution("a.example", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(answers) != 3 {
+		t.Fatalf("answers %+v", answers)
+	}
+	for _, answer := range answers[:2] {
+		if answer.Error != "" || len(answer.Addresses) != 2 || answer.LatencyMs < 0 {
+			t.Errorf("%s answered %+v", answer.Server, answer)
+		}
+	}
+	if answers[1].Server != tcp || answers[2].Error == "" || answers[2].Addresses == nil {
+		t.Errorf("fakedns answered %+v", answers[2])
+	}
+
+	for _, name := range []string{"", "not a name"} {
+		if _, err := s.TestResolution(name, time.Second); err == nil {
+			t.Errorf("%q was resolved", name)
+		}
+	}
+	if _, err := s.TestResolution("a.example", time.Minute); err == nil {
+		t.Error("a timeout over the longest was taken")
+	}
+}
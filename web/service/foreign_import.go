@@ -0,0 +1,719 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/common"
+
+	"github.com/goccy/go-json"
+)
+
+// The sources ImportForeign reads.
+const (
+	// ForeignSourceAuto tells the source apart by its content
+	ForeignSourceAuto = "auto"
+	// ForeignSourceXUI is the SQLite database of a legacy x-ui panel
+	ForeignSourceXUI = "x-ui"
+	// ForeignSourceMarzban is the JSON of the users of Marzban, as its API lists
+	// them, with the Xray config of Marzban as "xray_config"
+	ForeignSourceMarzban = "marzban"
+	// ForeignSourceXray is the JSON config of an Xray server
+	ForeignSourceXray = "xray"
+)
+
+// ForeignImportResult is what an import from another panel does, or would do
+// when it is a dry run.
+type ForeignImportResult struct {
+	Source string `json:"source"`
+	DryRun bool   `json:"dryRun"`
+	// Inbounds are the inbounds created with their clients
+	Inbounds []ForeignImportInbound `json:"inbounds"`
+	// Replaced are the tags of the inbounds of the panel replaced by those of
+	// the source, with merge-overwrite
+	Replaced []string `json:"replaced,omitempty"`
+	// Renamed are the clients given another email than in the source, because
+	// they had none or it was taken in the source
+	Renamed []ForeignImportRename `json:"renamed,omitempty"`
+	// Skipped are what merge-keep-existing left out
+	Skipped []string `json:"skipped,omitempty"`
+	// Unmapped are what of the source the panel has nothing for, with why
+	Unmapped []ForeignImportItem `json:"unmapped,omitempty"`
+	// XrayError is why Xray didn't start after the import
+	XrayError string `json:"xrayError,omitempty"`
+}
+
+type ForeignImportInbound struct {
+	Tag      string         `json:"tag"`
+	Remark   string         `json:"remark"`
+	Protocol model.Protocol `json:"protocol"`
+	Port     int            `json:"port"`
+	PortEnd  int            `json:"portEnd,omitempty"`
+	// Clients are the emails of the clients of the inbound
+	Clients []string `json:"clients"`
+}
+
+type ForeignImportRename struct {
+	Inbound string `json:"inbound"`
+	// From is empty for a client without an email
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type ForeignImportItem struct {
+	Item   string `json:"item"`
+	Reason string `json:"reason"`
+}
+
+// foreignImport is a source being turned into a bundle of Export.
+type foreignImport struct {
+	doc    *PanelExport
+	result *ForeignImportResult
+	// emails are the emails given so far, in lowercase
+	emails map[string]bool
+	tags   map[string]bool
+}
+
+func (f *foreignImport) unmap(item string, format string, args ...any) {
+	f.result.Unmapped = append(f.result.Unmapped, ForeignImportItem{Item: item, Reason: fmt.Sprintf(format, args...)})
+}
+
+// email returns the email of a client of inbound tag, unique in the import:
+// that of the source while it is free, or one made of tag for a client without
+// one.
+func (f *foreignImport) email(tag string, email string) string {
+	email = strings.TrimSpace(email)
+	candidate, base, n := email, email, 1
+	if email == "" {
+		base = tag
+		candidate = fmt.Sprintf("%s-%d", base, n)
+	}
+	for f.emails[strings.ToLower(candidate)] {
+		n++
+		candidate = fmt.Sprintf("%s-%d", base, n)
+	}
+	f.emails[strings.ToLower(candidate)] = true
+	if candidate != email {
+		f.result.Renamed = append(f.result.Renamed, ForeignImportRename{Inbound: tag, From: email, To: candidate})
+	}
+	return candidate
+}
+
+// foreignClient fills in the fields of the panel a client of the source
+// doesn't have; its credentials are kept as they are.
+func foreignClient(client map[string]any) map[string]any {
+	defaults := map[string]any{
+		"enable":     true,
+		"limitIp":    0,
+		"totalGB":    0,
+		"expiryTime": 0,
+		"tgId":       0,
+		"comment":    "",
+		"reset":      0,
+	}
+	for key, value := range defaults {
+		if _, ok := client[key]; !ok {
+			client[key] = value
+		}
+	}
+	if subId, _ := client["subId"].(string); subId == "" {
+		client["subId"] = randomLowerAndNum(16)
+	}
+	// Xray takes no alterId since VMess AEAD, and the panel keeps no levels
+	delete(client, "alterId")
+	delete(client, "level")
+	return client
+}
+
+// foreignPort returns the port or range of ports of an inbound of an Xray
+// config, a number or "start-end".
+func foreignPort(value any) (int, int, bool) {
+	switch port := value.(type) {
+	case float64:
+		return int(port), 0, port == float64(int(port))
+	case string:
+		start, end, isRange := strings.Cut(strings.TrimSpace(port), "-")
+		first, err := strconv.Atoi(strings.TrimSpace(start))
+		if err != nil {
+			return 0, 0, false
+		}
+		if !isRange {
+			return first, 0, true
+		}
+		last, err := strconv.Atoi(strings.TrimSpace(end))
+		return first, last, err == nil
+	}
+	return 0, 0, false
+}
+
+// xrayInbound returns an inbound of the panel for one of an Xray config, with
+// its settings apart for the clients to be set in; false if the panel has
+// nothing for it.
+func (f *foreignImport) xrayInbound(raw map[string]any) (*PanelExportInbound, map[string]any, bool) {
+	tag, _ := raw["tag"].(string)
+	protocol, _ := raw["protocol"].(string)
+	item := "inbound " + tag
+	if tag == "" {
+		item = fmt.Sprintf("inbound %s on port %v", protocol, raw["port"])
+	}
+	if protocol == "tunnel" {
+		protocol = string(model.DOKODEMO)
+	}
+	if tag == "api" && protocol == string(model.DOKODEMO) {
+		f.unmap(item, "the inbound of the API of Xray, the panel has its own")
+		return nil, nil, false
+	}
+	switch model.Protocol(protocol) {
+	case model.VMESS, model.VLESS, model.Trojan, model.Shadowsocks, model.DOKODEMO,
+		model.Socks, model.HTTP, model.WireGuard:
+	default:
+		f.unmap(item, "the protocol %q is not one the panel has", protocol)
+		return nil, nil, false
+	}
+	port, portEnd, ok := foreignPort(raw["port"])
+	if !ok {
+		f.unmap(item, "the port %v is neither a number nor a range", raw["port"])
+		return nil, nil, false
+	}
+	listen, _ := raw["listen"].(string)
+	settings, _ := raw["settings"].(map[string]any)
+	if settings == nil {
+		settings = map[string]any{}
+	}
+	in := &PanelExportInbound{Tag: tag}
+	in.Remark = tag
+	in.Enable = true
+	in.Listen = listen
+	in.Port = port
+	in.PortEnd = portEnd
+	in.Protocol = model.Protocol(protocol)
+	for key, field := range map[string]*json.RawMessage{
+		"streamSettings": &in.StreamSettings,
+		"sniffing":       &in.Sniffing,
+		"allocate":       &in.Allocate,
+	} {
+		if value, ok := raw[key].(map[string]any); ok {
+			*field, _ = json.Marshal(value)
+		}
+	}
+	return in, settings, true
+}
+
+// sourceClients turns the clients of the settings of an inbound of the source
+// into clients of the panel, with the emails the import gives them. The peers of
+// a WireGuard inbound of an Xray config become its clients, and the user of a
+// Shadowsocks inbound with a single one its client where the method allows.
+func (f *foreignImport) sourceClients(in *PanelExportInbound, settings map[string]any) {
+	clients, _ := settings["clients"].([]any)
+	switch in.Protocol {
+	case model.WireGuard:
+		if peers, ok := settings["peers"].([]any); ok && len(clients) == 0 {
+			clients = peers
+			delete(settings, "peers")
+		}
+	case model.Shadowsocks:
+		method, _ := settings["method"].(string)
+		password, _ := settings["password"].(string)
+		if len(clients) == 0 && password != "" {
+			if isSS2022(method) {
+				f.unmap("inbound "+in.Tag, "its single user keeps the key of the inbound, the panel has no client for it")
+			} else {
+				clients = []any{map[string]any{"method": method, "password": password}}
+			}
+		}
+	case model.VMESS, model.VLESS, model.Trojan:
+	default:
+		return
+	}
+	kept := make([]any, 0, len(clients))
+	for _, item := range clients {
+		client, ok := item.(map[string]any)
+		if !ok {
+			continue
+		}
+		email, _ := client["email"].(string)
+		client["email"] = f.email(in.Tag, email)
+		kept = append(kept, foreignClient(client))
+	}
+	settings["clients"] = kept
+}
+
+// add adds an inbound of the source with settings to the bundle, if the panel
+// can take it as it is.
+func (f *foreignImport) add(in *PanelExportInbound, settings map[string]any) {
+	if in.Tag == "" {
+		in.Tag = InboundTag(in.Listen, in.Port)
+	}
+	if in.Remark == "" {
+		in.Remark = in.Tag
+	}
+	item := "inbound " + in.Tag
+	if f.tags[in.Tag] {
+		f.unmap(item, "another inbound of the source has its tag")
+		return
+	}
+	var err error
+	if in.Settings, err = json.Marshal(settings); err != nil {
+		f.unmap(item, "%v", err)
+		return
+	}
+	if err := (&InboundExport{Inbound: in.InboundExportInbound}).validate(); err != nil {
+		f.unmap(item, "%v", err)
+		return
+	}
+	inbound := &model.Inbound{Protocol: in.Protocol, Settings: string(in.Settings), StreamSettings: string(in.StreamSettings)}
+	clients, err := (&InboundService{}).GetClients(inbound)
+	if err == nil {
+		err = checkClientIds(inbound.Protocol, clients)
+	}
+	if err == nil {
+		_, err = checkClientFlows(inbound, clients)
+	}
+	if err == nil {
+		_, err = checkShadowsocksKeys(inbound, clients)
+	}
+	if err != nil {
+		f.unmap(item, "%v", err)
+		return
+	}
+	f.tags[in.Tag] = true
+	f.doc.Inbounds = append(f.doc.Inbounds, *in)
+}
+
+// readXray reads the inbounds of the JSON config of an Xray server.
+func (f *foreignImport) readXray(config map[string]any) error {
+	inbounds, ok := config["inbounds"].([]any)
+	if !ok {
+		return common.NewError("the Xray config has no inbounds")
+	}
+	for _, item := range inbounds {
+		raw, _ := item.(map[string]any)
+		in, settings, ok := f.xrayInbound(raw)
+		if !ok {
+			continue
+		}
+		f.sourceClients(in, settings)
+		f.add(in, settings)
+	}
+	for _, key := range []string{"outbounds", "routing", "dns"} {
+		if _, ok := config[key]; ok {
+			f.unmap(key, "only the inbounds and their clients are imported")
+		}
+	}
+	return nil
+}
+
+// marzbanUser is a user as the API of Marzban lists them.
+type marzbanUser struct {
+	Username string `json:"username"`
+	Status   string `json:"status"`
+	// Proxies are the credentials of the user by protocol
+	Proxies map[string]map[string]any `json:"proxies"`
+	// Inbounds are the tags of the inbounds of the user by protocol, all those
+	// of a protocol of its proxies it has none of
+	Inbounds map[string][]string `json:"inbounds"`
+	// Expire is in seconds, DataLimit and UsedTraffic in bytes
+	Expire    int64  `json:"expire"`
+	DataLimit int64  `json:"data_limit"`
+	Reset     string `json:"data_limit_reset_strategy"`
+	// OnHoldExpireDuration is how many seconds the user is valid for once first
+	// connected, while on hold
+	OnHoldExpireDuration int64  `json:"on_hold_expire_duration"`
+	UsedTraffic          int64  `json:"used_traffic"`
+	Note                 string `json:"note"`
+}
+
+// marzbanResets are the reset policies of the panel for the data limit reset
+// strategies of Marzban.
+var marzbanResets = map[string]string{
+	"":         "",
+	"no_reset": "",
+	"day":      ResetPolicyDaily,
+	"week":     ResetPolicyWeekly,
+	"month":    ResetPolicyMonthly,
+}
+
+// readMarzban reads the users of Marzban into the inbounds of its Xray config.
+// A user in several inbounds is a client of each, under one subscription.
+func (f *foreignImport) readMarzban(export map[string]any) error {
+	data, _ := json.Marshal(export["users"])
+	var users []marzbanUser
+	if err := json.Unmarshal(data, &users); err != nil {
+		return common.NewError("invalid users of Marzban:", err)
+	}
+	config, ok := export["xray_config"].(map[string]any)
+	if !ok {
+		config, ok = export["core_config"].(map[string]any)
+	}
+	if !ok {
+		return common.NewError("the Marzban export has no xray_config to take the inbounds from")
+	}
+	raws, _ := config["inbounds"].([]any)
+
+	type marzbanInbound struct {
+		in       *PanelExportInbound
+		settings map[string]any
+		clients  []any
+	}
+	var inbounds []*marzbanInbound
+	for _, item := range raws {
+		raw, _ := item.(map[string]any)
+		in, settings, ok := f.xrayInbound(raw)
+		if !ok {
+			continue
+		}
+		inbounds = append(inbounds, &marzbanInbound{in: in, settings: settings})
+	}
+
+	for _, user := range users {
+		item := "user " + user.Username
+		if user.Username == "" {
+			continue
+		}
+		if len(user.Proxies) == 0 {
+			f.unmap(item, "the user has no proxies")
+			continue
+		}
+		expiry := user.Expire * 1000
+		if user.Status == "on_hold" && user.OnHoldExpireDuration > 0 {
+			// Valid for the duration from the first use, as on hold
+			expiry = -user.OnHoldExpireDuration * 1000
+		}
+		reset, ok := marzbanResets[user.Reset]
+		if !ok {
+			f.unmap(item, "the data limit reset %q is not one the panel has, the client isn't reset", user.Reset)
+		}
+		subId := randomLowerAndNum(16)
+		first := true
+		// In a same order each time, for the first client to keep the username
+		for _, protocol := range slices.Sorted(maps.Keys(user.Proxies)) {
+			proxy := user.Proxies[protocol]
+			matched := false
+			for _, inbound := range inbounds {
+				if string(inbound.in.Protocol) != protocol {
+					continue
+				}
+				if tags, ok := user.Inbounds[protocol]; ok && !slices.Contains(tags, inbound.in.Tag) {
+					continue
+				}
+				matched = true
+				client := map[string]any{
+					"email":      f.email(inbound.in.Tag, user.Username),
+					"enable":     user.Status != "disabled",
+					"totalGB":    user.DataLimit,
+					"expiryTime": expiry,
+					"comment":    user.Note,
+					"subId":      subId,
+				}
+				if reset != "" {
+					client["resetPolicy"] = reset
+				}
+				switch inbound.in.Protocol {
+				case model.VMESS, model.VLESS:
+					client["id"], _ = proxy["id"].(string)
+				case model.Trojan, model.Shadowsocks:
+					client["password"], _ = proxy["password"].(string)
+				}
+				if method, _ := proxy["method"].(string); inbound.in.Protocol == model.Shadowsocks {
+					client["method"] = method
+				}
+				// Marzban gives the flow only on the inbounds that take it
+				stream := &model.Inbound{Protocol: inbound.in.Protocol, StreamSettings: string(inbound.in.StreamSettings)}
+				if flow, _ := proxy["flow"].(string); flow != "" && canFlow(stream) {
+					client["flow"] = flow
+				}
+				inbound.clients = append(inbound.clients, foreignClient(client))
+				traffic := InboundExportTraffic{
+					Email:      client["email"].(string),
+					Enable:     client["enable"].(bool),
+					Total:      user.DataLimit,
+					ExpiryTime: expiry,
+				}
+				// The traffic used goes to one of the clients of the user
+				if first {
+					traffic.Down = user.UsedTraffic
+					first = false
+				}
+				inbound.in.ClientStats = append(inbound.in.ClientStats, traffic)
+			}
+			if !matched {
+				f.unmap(item, "no %s inbound of the Xray config is one of the user", protocol)
+			}
+		}
+	}
+	for _, inbound := range inbounds {
+		inbound.settings["clients"] = inbound.clients
+		if inbound.clients == nil {
+			f.sourceClients(inbound.in, inbound.settings)
+		}
+		f.add(inbound.in, inbound.settings)
+	}
+	return nil
+}
+
+// sqlString returns a text column of a row of a legacy database.
+func sqlString(row map[string]any, column string) string {
+	switch value := row[column].(type) {
+	case string:
+		return value
+	case []byte:
+		return string(value)
+	}
+	return ""
+}
+
+// sqlInt returns an integer column of a row of a legacy database.
+func sqlInt(row map[string]any, column string) int64 {
+	switch value := row[column].(type) {
+	case int64:
+		return value
+	case float64:
+		return int64(value)
+	case bool:
+		if value {
+			return 1
+		}
+	case string, []byte:
+		n, _ := strconv.ParseInt(sqlString(row, column), 10, 64)
+		return n
+	}
+	return 0
+}
+
+// readXUI reads the inbounds of the database of a legacy x-ui panel, with the
+// traffic of their clients where it has it.
+func (f *foreignImport) readXUI(data []byte) error {
+	file, err := os.CreateTemp("", "x-ui-foreign-*.db")
+	if err != nil {
+		return err
+	}
+	path := file.Name()
+	defer os.Remove(path)
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := database.CheckIntegrity(path); err != nil {
+		return common.NewError("invalid x-ui database:", err)
+	}
+	rows, err := database.ReadTable(path, "inbounds")
+	if err != nil {
+		return common.NewError("invalid x-ui database:", err)
+	}
+	if rows == nil {
+		return common.NewError("the x-ui database has no inbounds table")
+	}
+	traffics, err := database.ReadTable(path, "client_traffics")
+	if err != nil {
+		return common.NewError("invalid x-ui database:", err)
+	}
+	stats := map[int64][]InboundExportTraffic{}
+	for _, row := range traffics {
+		id := sqlInt(row, "inbound_id")
+		stats[id] = append(stats[id], InboundExportTraffic{
+			Email:      sqlString(row, "email"),
+			Enable:     sqlInt(row, "enable") != 0,
+			Up:         sqlInt(row, "up"),
+			Down:       sqlInt(row, "down"),
+			Total:      sqlInt(row, "total"),
+			ExpiryTime: sqlInt(row, "expiry_time"),
+			Reset:      int(sqlInt(row, "reset")),
+		})
+	}
+
+	for _, row := range rows {
+		raw := map[string]any{
+			"tag":      sqlString(row, "tag"),
+			"protocol": sqlString(row, "protocol"),
+			"listen":   sqlString(row, "listen"),
+			"port":     float64(sqlInt(row, "port")),
+		}
+		for _, key := range []string{"settings", "stream_settings", "sniffing", "allocate"} {
+			var value map[string]any
+			if json.Unmarshal([]byte(sqlString(row, key)), &value) == nil && value != nil {
+				raw[strings.Replace(key, "_s", "S", 1)] = value
+			}
+		}
+		in, settings, ok := f.xrayInbound(raw)
+		if !ok {
+			continue
+		}
+		if in.Tag == "" {
+			in.Tag = InboundTag(in.Listen, in.Port)
+		}
+		in.Remark = sqlString(row, "remark")
+		in.Enable = sqlInt(row, "enable") != 0
+		in.Up = sqlInt(row, "up")
+		in.Down = sqlInt(row, "down")
+		in.Total = sqlInt(row, "total")
+		in.ExpiryTime = sqlInt(row, "expiry_time")
+
+		// The traffic goes with the clients by the emails they have in x-ui
+		traffic := map[string]InboundExportTraffic{}
+		for _, stat := range stats[sqlInt(row, "id")] {
+			traffic[stat.Email] = stat
+		}
+		var oldEmails []string
+		clients, _ := settings["clients"].([]any)
+		for _, item := range clients {
+			if client, ok := item.(map[string]any); ok {
+				email, _ := client["email"].(string)
+				oldEmails = append(oldEmails, email)
+			}
+		}
+		f.sourceClients(in, settings)
+		clients, _ = settings["clients"].([]any)
+		for i, item := range clients {
+			client, _ := item.(map[string]any)
+			if i >= len(oldEmails) {
+				break
+			}
+			stat, ok := traffic[oldEmails[i]]
+			if !ok {
+				continue
+			}
+			stat.Email, _ = client["email"].(string)
+			in.ClientStats = append(in.ClientStats, stat)
+		}
+		f.add(in, settings)
+	}
+	return nil
+}
+
+// ImportForeign imports the inbounds and clients of another panel: the
+// database of a legacy x-ui panel, an export of the users of Marzban or the
+// config of an Xray server, as source tells or, with ForeignSourceAuto, as
+// told apart by their content. The credentials of the clients are kept, for
+// their links to go on working. The import merges with policy like Import does,
+// PanelImportKeepExisting or PanelImportOverwrite; with dryRun it only returns
+// what it would do. What the panel has nothing for is left out and reported.
+func (s *PanelExportService) ImportForeign(data []byte, source string, policy string, dryRun bool) (*ForeignImportResult, error) {
+	if policy == "" {
+		policy = PanelImportKeepExisting
+	}
+	if policy != PanelImportKeepExisting && policy != PanelImportOverwrite {
+		return nil, common.NewErrorf("an import from another panel merges, use %s or %s", PanelImportKeepExisting, PanelImportOverwrite)
+	}
+	if source == "" || source == ForeignSourceAuto {
+		source = detectForeignSource(data)
+	}
+
+	f := &foreignImport{
+		doc:    &PanelExport{Version: PanelExportVersion},
+		result: &ForeignImportResult{Source: source, DryRun: dryRun, Inbounds: []ForeignImportInbound{}},
+		emails: map[string]bool{},
+		tags:   map[string]bool{},
+	}
+	var err error
+	switch source {
+	case ForeignSourceXUI:
+		err = f.readXUI(data)
+	case ForeignSourceMarzban, ForeignSourceXray:
+		var parsed map[string]any
+		if err := json.Unmarshal(data, &parsed); err != nil {
+			return nil, common.NewErrorf("invalid %s JSON: %v", source, err)
+		}
+		if source == ForeignSourceMarzban {
+			err = f.readMarzban(parsed)
+		} else {
+			err = f.readXray(parsed)
+		}
+	case "":
+		return nil, common.NewError("the source is neither an x-ui database, a Marzban export nor an Xray config")
+	default:
+		return nil, common.NewErrorf("unknown source %q, use %s, %s, %s or %s", source,
+			ForeignSourceAuto, ForeignSourceXUI, ForeignSourceMarzban, ForeignSourceXray)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := f.doc.validate(); err != nil {
+		return nil, err
+	}
+	if !dryRun {
+		// The buffered traffic goes to the clients before they may be replaced
+		if err := s.inboundService.FlushTraffic(); err != nil {
+			return nil, err
+		}
+	}
+
+	p := &panelImport{
+		s:           s,
+		doc:         f.doc,
+		policy:      policy,
+		result:      &PanelImportResult{},
+		updateUsers: map[int]PanelExportUser{},
+	}
+	err = p.plan()
+	if err == nil && !dryRun {
+		err = database.Transaction(p.apply)
+	}
+	for _, file := range p.created {
+		if err != nil || dryRun {
+			os.Remove(file)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result := f.result
+	result.Skipped = p.result.Skipped
+	for _, inbound := range p.delInbounds {
+		result.Replaced = append(result.Replaced, inbound.Tag)
+	}
+	for _, inbound := range p.addInbounds {
+		planned := ForeignImportInbound{
+			Tag:      inbound.Tag,
+			Remark:   inbound.Remark,
+			Protocol: inbound.Protocol,
+			Port:     inbound.Port,
+			PortEnd:  inbound.PortEnd,
+			Clients:  []string{},
+		}
+		for _, stat := range inbound.ClientStats {
+			planned.Clients = append(planned.Clients, stat.Email)
+		}
+		result.Inbounds = append(result.Inbounds, planned)
+	}
+	if dryRun {
+		return result, nil
+	}
+	logger.Infof("imported from %s with %s: %d inbounds, %d items unmapped", source, policy, len(result.Inbounds), len(result.Unmapped))
+
+	if err := s.xrayService.RestartXray(true); err != nil {
+		logger.Warning("Xray failed to start after the import from another panel:", err)
+		result.XrayError = err.Error()
+	}
+	return result, nil
+}
+
+// detectForeignSource tells the source of ImportForeign by its content, empty
+// if it is none.
+func detectForeignSource(data []byte) string {
+	if bytes.HasPrefix(data, []byte("SQLite format 3\x00")) {
+		return ForeignSourceXUI
+	}
+	var parsed map[string]any
+	if json.Unmarshal(data, &parsed) != nil {
+		return ""
+	}
+	if _, ok := parsed["users"]; ok {
+		return ForeignSourceMarzban
+	}
+	if _, ok := parsed["inbounds"]; ok {
+		return ForeignSourceXray
+	}
+	return ""
+}
@@ -0,0 +1,351 @@
+package service
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/xray"
+)
+
+// foreignFixture returns the source of testdata/foreign/name; the schema and
+// rows of x-ui.sql as the database of a legacy x-ui panel.
+func foreignFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", "foreign", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Ext(name) != ".sql" {
+		return data
+	}
+	path := filepath.Join(t.TempDir(), "x-ui.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(string(data)); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if data, err = os.ReadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// foreignImported returns the inbounds of the panel by tag, and their clients
+// by email.
+func foreignImported(t *testing.T) (map[string]*model.Inbound, map[string]model.Client) {
+	t.Helper()
+	var inboundService InboundService
+	all, err := inboundService.GetAllInbounds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	inbounds, clients := map[string]*model.Inbound{}, map[string]model.Client{}
+	for _, inbound := range all {
+		inbounds[inbound.Tag] = inbound
+		list, err := inboundService.GetClients(inbound)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, client := range list {
+			clients[client.Email] = client
+		}
+	}
+	return inbounds, clients
+}
+
+func foreignUnmapped(result *ForeignImportResult) string {
+	var items []string
+	for _, item := range result.Unmapped {
+		items = append(items, item.Item+": "+item.Reason)
+	}
+	return strings.Join(items, "\n")
+}
+
+func TestDetectForeignSource(t *testing.T) {
+	tests := []struct {
+		data string
+		want string
+	}{
+		{"SQLite format 3\x00rest of the database", ForeignSourceXUI},
+		{`{"users":[],"xray_config":{}}`, ForeignSourceMarzban},
+		{`{"log":{},"inbounds":[]}`, ForeignSourceXray},
+		{`{"outbounds":[]}`, ""},
+		{`[{"inbounds":[]}]`, ""},
+		{"not json", ""},
+	}
+	for _, test := range tests {
+		if source := detectForeignSource([]byte(test.data)); source != test.want {
+			t.Errorf("%q is told apart as %q, want %q", test.data, source, test.want)
+		}
+	}
+
+	newTestDB(t)
+	var s PanelExportService
+	for _, test := range []struct{ data, source, err string }{
+		{`{"outbounds":[]}`, "", "neither an x-ui database"},
+		{`{"inbounds":[]}`, "v2board", `unknown source "v2board"`},
+		{`{"inbounds":[]}`, ForeignSourceMarzban, "no xray_config"},
+		{`{"users":[]}`, ForeignSourceXray, "no inbounds"},
+		{`{"inbounds":[`, ForeignSourceXray, "invalid xray JSON"},
+		{"SQLite format 3\x00", ForeignSourceAuto, "invalid x-ui database"},
+	} {
+		if _, err := s.ImportForeign([]byte(test.data), test.source, "", true); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s as %q: error %v, want %q", test.data, test.source, err, test.err)
+		}
+	}
+	if _, err := s.ImportForeign([]byte(`{"inbounds":[]}`), "", PanelImportReplaceAll, true); err == nil {
+		t.Error("another panel replaced all of this one")
+	}
+}
+
+func TestImportForeignXray(t *testing.T) {
+	panelImportXray(t)
+	newTestDB(t)
+	data := foreignFixture(t, "xray.json")
+	var s PanelExportService
+
+	// A dry run returns the plan and writes nothing
+	plan, err := s.ImportForeign(data, "", "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inbounds, _ := foreignImported(t); len(inbounds) != 0 {
+		t.Fatalf("the dry run created %d inbounds", len(inbounds))
+	}
+	result, err := s.ImportForeign(data, ForeignSourceXray, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result.DryRun, result.XrayError = true, ""
+	if !reflect.DeepEqual(plan, result) {
+		t.Errorf("the import %+v isn't the plan %+v", result, plan)
+	}
+
+	var tags []string
+	for _, inbound := range result.Inbounds {
+		tags = append(tags, inbound.Tag)
+	}
+	if !slices.Equal(tags, []string{"vless-reality", "vmess-ws", "inbound-20053", "ss-legacy", "ss-2022", "socks-range"}) {
+		t.Errorf("the inbounds imported are %v", tags)
+	}
+	unmapped := foreignUnmapped(result)
+	for _, want := range []string{
+		"inbound api: the inbound of the API", "inbound ss-2022: its single user", `inbound hysteria: the protocol "hysteria"`,
+		"inbound bad-port: the port https", "outbounds: only the inbounds", "routing: only the inbounds",
+	} {
+		if !strings.Contains(unmapped, want) {
+			t.Errorf("%q is not reported in:\n%s", want, unmapped)
+		}
+	}
+
+	inbounds, clients := foreignImported(t)
+	// The credentials are those of the source, for the links to go on working
+	for email, want := range map[string]model.Client{
+		"carol@example.com":   {ID: "9f30cb25-56eb-4778-89e7-709224dba3b9", Flow: "xtls-rprx-vision"},
+		"vless-reality-1":     {ID: "2246688c-dc32-41a4-b382-22b5fe968327", Flow: "xtls-rprx-vision"},
+		"carol@example.com-2": {ID: "24c2c139-d63b-4faf-921b-a9db9a6f46a0"},
+		"dave":                {Password: "tr0jan-dave"},
+		"ss-legacy-1":         {Password: "ss-legacy-pass"},
+	} {
+		client, ok := clients[email]
+		if !ok || client.ID != want.ID || client.Password != want.Password || client.Flow != want.Flow || !client.Enable || client.SubID == "" {
+			t.Errorf("the client %s is %+v", email, client)
+		}
+	}
+	vless := inbounds["vless-reality"]
+	if vless == nil || vless.Port != 20051 || !sameJSON(t, vless.StreamSettings,
+		`{"network":"tcp","security":"reality","realitySettings":{"show":false,"dest":"www.example.com:443","xver":0,"serverNames":["www.example.com"],"privateKey":"wK4uM9rjR3b5X0lJ7xg3qXnB2a3qHkFsfw3mCbqk0mc","shortIds":["6ba85179e30d4fc2"]}}`) {
+		t.Errorf("the REALITY inbound is %+v", vless)
+	}
+	if vmess := inbounds["vmess-ws"]; vmess == nil || strings.Contains(vmess.Settings, "alterId") || strings.Contains(vmess.Settings, "level") {
+		t.Errorf("the VMess inbound keeps its alterId or level: %+v", vmess)
+	}
+	if ss := inbounds["ss-2022"]; ss == nil || shadowsocksKey(ss) != "Tm1iG5BqYF0uzh2pH4h3xQ==" {
+		t.Errorf("the Shadowsocks 2022 inbound lost its key: %+v", ss)
+	}
+	if socks := inbounds["socks-range"]; socks == nil || socks.Port != 20056 || socks.PortEnd != 20058 {
+		t.Errorf("the socks inbound is %+v", socks)
+	}
+}
+
+func TestImportForeignMarzban(t *testing.T) {
+	panelImportXray(t)
+	newTestDB(t)
+	result, err := (&PanelExportService{}).ImportForeign(foreignFixture(t, "marzban.json"), "", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Source != ForeignSourceMarzban || len(result.Inbounds) != 4 {
+		t.Errorf("the import is %+v", result)
+	}
+	unmapped := foreignUnmapped(result)
+	for _, want := range []string{`user grace: the data limit reset "year"`, "user heidi: no vless inbound", "user ivan: the user has no proxies"} {
+		if !strings.Contains(unmapped, want) {
+			t.Errorf("%q is not reported in:\n%s", want, unmapped)
+		}
+	}
+
+	_, clients := foreignImported(t)
+	// A user in two inbounds is a client of each, under one subscription
+	erin, erinVmess := clients["erin"], clients["erin-2"]
+	if erin.ID != "efc42f44-7453-460e-b07e-48b3b20494d6" || erin.Flow != "xtls-rprx-vision" || erinVmess.ID != "e83e08b6-20bd-415d-81f8-7bd4ea937808" {
+		t.Errorf("the credentials of erin are %+v and %+v", erin, erinVmess)
+	}
+	if erin.SubID == "" || erin.SubID != erinVmess.SubID || erin.TotalGB != 107374182400 || erin.ExpiryTime != 1893456000000 ||
+		erin.ResetPolicy != ResetPolicyMonthly || erin.Comment != "family" || !erin.Enable {
+		t.Errorf("erin is %+v", erin)
+	}
+	if frank := clients["frank"]; frank.Password != "frank-trojan" || frank.Enable || frank.ExpiryTime != 0 || frank.TotalGB != 0 {
+		t.Errorf("frank is %+v", frank)
+	}
+	// On hold, valid for 30 days from the first use
+	if grace := clients["grace"]; grace.Password != "grace-ss" || grace.ExpiryTime != -2592000000 || grace.ResetPolicy != "" {
+		t.Errorf("grace is %+v", grace)
+	}
+	// The traffic used goes to one of the clients of the user
+	var inboundService InboundService
+	traffic, err := inboundService.GetClientTrafficByEmail("erin")
+	if err != nil || traffic == nil || traffic.Down != 5368709120 || traffic.Total != 107374182400 {
+		t.Errorf("the traffic of erin is %+v, %v", traffic, err)
+	}
+	if traffic, err := inboundService.GetClientTrafficByEmail("erin-2"); err != nil || traffic == nil || traffic.Down != 0 {
+		t.Errorf("the traffic of erin-2 is %+v, %v", traffic, err)
+	}
+}
+
+func TestImportForeignXUI(t *testing.T) {
+	panelImportXray(t)
+	newTestDB(t)
+	result, err := (&PanelExportService{}).ImportForeign(foreignFixture(t, "x-ui.sql"), "", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Source != ForeignSourceXUI || len(result.Inbounds) != 4 || !strings.Contains(foreignUnmapped(result), `inbound inbound-20075: the protocol "mtproto"`) {
+		t.Errorf("the import is %+v", result)
+	}
+	renamed := []ForeignImportRename{
+		{Inbound: "inbound-20072", From: "alice", To: "alice-2"},
+		{Inbound: "inbound-20072", From: "", To: "inbound-20072-1"},
+		{Inbound: "inbound-20074", From: "", To: "inbound-20074-1"},
+	}
+	if !reflect.DeepEqual(result.Renamed, renamed) {
+		t.Errorf("the clients renamed are %+v", result.Renamed)
+	}
+
+	inbounds, clients := foreignImported(t)
+	vless := inbounds["inbound-20071"]
+	if vless == nil || vless.Remark != "Legacy VLESS" || !vless.Enable || vless.Up != 1000 || vless.Down != 2000 || !sameJSON(t, vless.StreamSettings,
+		`{"network":"tcp","security":"tls","tlsSettings":{"serverName":"legacy.example.com","certificates":[{"certificateFile":"/root/cert.crt","keyFile":"/root/private.key"}]},"tcpSettings":{"header":{"type":"none"}}}`) {
+		t.Errorf("the VLESS inbound is %+v", vless)
+	}
+	if trojan := inbounds["inbound-20073"]; trojan == nil || trojan.Enable {
+		t.Errorf("the disabled trojan inbound is %+v", trojan)
+	}
+	alice := clients["alice"]
+	if alice.ID != "a0713e89-2acb-4e8e-aae5-9e9aa0e76149" || alice.Flow != "xtls-rprx-vision" || alice.SubID != "alice-sub" ||
+		alice.LimitIP != 2 || alice.TotalGB != 10737418240 || alice.ExpiryTime != 1893456000000 {
+		t.Errorf("alice is %+v", alice)
+	}
+	for email, want := range map[string]model.Client{
+		"bob":             {ID: "807c13d4-5b53-4b0f-8aa6-29979342f436"},
+		"alice-2":         {ID: "54b0ec4d-8d2a-4bc9-9a63-1c8e5f0d2a7b"},
+		"inbound-20072-1": {ID: "c3a1f6e0-7b2d-4e89-a5c4-0d9e8f1b2a36"},
+		"carol":           {Password: "carol-trojan"},
+		"inbound-20074-1": {Password: "legacy-ss"},
+	} {
+		if client, ok := clients[email]; !ok || client.ID != want.ID || client.Password != want.Password {
+			t.Errorf("the client %s is %+v", email, client)
+		}
+	}
+
+	// The traffic goes with the clients by their emails in x-ui
+	db := database.GetDB()
+	var traffics []xray.ClientTraffic
+	if err := db.Order("email").Find(&traffics).Error; err != nil {
+		t.Fatal(err)
+	}
+	stats := map[string]xray.ClientTraffic{}
+	for _, traffic := range traffics {
+		stats[traffic.Email] = traffic
+	}
+	if alice := stats["alice"]; alice.Up != 123 || alice.Down != 456 || alice.Total != 10737418240 || alice.Reset != 30 || !alice.Enable {
+		t.Errorf("the traffic of alice is %+v", alice)
+	}
+	if bob := stats["bob"]; bob.Up != 7 || bob.Down != 8 || bob.Enable {
+		t.Errorf("the traffic of bob is %+v", bob)
+	}
+	if alice2 := stats["alice-2"]; alice2.Up != 0 || alice2.Down != 0 {
+		t.Errorf("the renamed alice took the traffic %+v", alice2)
+	}
+}
+
+func TestImportForeignConflicts(t *testing.T) {
+	panelImportXray(t)
+	newTestDB(t)
+	var inboundService InboundService
+	// An inbound with the tag of one of the source, and another with the email
+	// of a client of the source
+	for _, inbound := range []*model.Inbound{
+		{Remark: "own vmess", Enable: true, Port: 20052, Protocol: model.VMESS, Tag: "vmess-ws",
+			Settings: `{"clients":[{"id":"5d2b3f8c-1a9e-4c6d-b7f0-8e4a2c1d6b55","email":"own-vmess","enable":true}]}`},
+		{Remark: "own trojan", Enable: true, Port: 20050, Protocol: model.Trojan, Tag: "own-trojan",
+			Settings: `{"clients":[{"password":"own-password","email":"dave","enable":true}]}`},
+	} {
+		if _, _, err := inboundService.AddInbound(inbound); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data := foreignFixture(t, "xray.json")
+	var s PanelExportService
+
+	result, err := s.ImportForeign(data, "", PanelImportKeepExisting, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(result.Skipped, []string{"inbound vmess-ws", "client dave"}) || len(result.Replaced) != 0 {
+		t.Errorf("keeping the existing ones skips %v and replaces %v", result.Skipped, result.Replaced)
+	}
+
+	// Overwriting, the inbound with the tag is replaced, but the email is still
+	// taken by an inbound of the panel
+	if _, err := s.ImportForeign(data, "", PanelImportOverwrite, true); err == nil || !strings.Contains(err.Error(), "the email dave is used by inbound own-trojan") {
+		t.Errorf("overwriting with a taken email gave %v", err)
+	}
+	if _, err := inboundService.DelInbound(inboundByTag(t, "own-trojan").Id); err != nil {
+		t.Fatal(err)
+	}
+	result, err = s.ImportForeign(data, "", PanelImportOverwrite, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(result.Replaced, []string{"vmess-ws"}) {
+		t.Errorf("overwriting replaces %v", result.Replaced)
+	}
+	inbounds, clients := foreignImported(t)
+	if vmess := inbounds["vmess-ws"]; vmess == nil || vmess.Remark != "vmess-ws" || len(inbounds) != 6 {
+		t.Errorf("the inbounds after overwriting are %v", inbounds)
+	}
+	if _, ok := clients["own-vmess"]; ok {
+		t.Error("the client of the replaced inbound is left")
+	}
+}
+
+func inboundByTag(t *testing.T, tag string) *model.Inbound {
+	t.Helper()
+	inbound := &model.Inbound{}
+	if err := database.GetDB().Where("tag = ?", tag).First(inbound).Error; err != nil {
+		t.Fatal(err)
+	}
+	return inbound
+}
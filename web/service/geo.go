@@ -0,0 +1,94 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"x-ui/config"
+	"x-ui/logger"
+	"x-ui/util/common"
+
+	"github.com/xtls/xray-core/app/router"
+	"google.golang.org/protobuf/proto"
+)
+
+// geositeFile is a geosite file of the bin folder, with its lists and the
+// attributes of their domains.
+type geositeFile struct {
+	modTime time.Time
+	lists   map[string]map[string]bool
+}
+
+var (
+	geositeFiles     = map[string]*geositeFile{}
+	geositeFilesLock sync.Mutex
+)
+
+// loadGeositeLists returns the lists of a geosite file of the bin folder, read
+// again only when the file changed.
+func loadGeositeLists(name string) (map[string]map[string]bool, error) {
+	path := filepath.Join(config.GetBinFolderPath(), filepath.Base(name))
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	geositeFilesLock.Lock()
+	defer geositeFilesLock.Unlock()
+	if file, ok := geositeFiles[path]; ok && file.modTime.Equal(info.ModTime()) {
+		return file.lists, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var siteList router.GeoSiteList
+	if err := proto.Unmarshal(data, &siteList); err != nil {
+		return nil, common.NewErrorf("%s is not a geosite file: %v", name, err)
+	}
+	lists := make(map[string]map[string]bool, len(siteList.Entry))
+	for _, site := range siteList.Entry {
+		attributes := map[string]bool{}
+		for _, domain := range site.Domain {
+			for _, attribute := range domain.Attribute {
+				attributes[strings.ToLower(attribute.Key)] = true
+			}
+		}
+		lists[strings.ToLower(site.CountryCode)] = attributes
+	}
+	geositeFiles[path] = &geositeFile{modTime: info.ModTime(), lists: lists}
+	return lists, nil
+}
+
+// checkGeosite checks that a geosite list, like "geosite:google@cn" or
+// "ext:geosite_IR.dat:ir", is in its file. Lists aren't checked when the file is
+// missing: Xray fails to start on them anyway, with the name of the file.
+func checkGeosite(domain string) error {
+	file, list := "geosite.dat", strings.TrimPrefix(domain, "geosite:")
+	if rest, ok := strings.CutPrefix(domain, "ext:"); ok {
+		file, list, _ = strings.Cut(rest, ":")
+	}
+	lists, err := loadGeositeLists(file)
+	if os.IsNotExist(err) {
+		logger.Debug("geosite lists are not checked:", err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	name, attributes, _ := strings.Cut(strings.ToLower(list), "@")
+	listAttributes, ok := lists[name]
+	if !ok {
+		return common.NewErrorf("%s has no list %s", file, name)
+	}
+	for _, attribute := range strings.Split(attributes, "@") {
+		attribute = strings.TrimPrefix(attribute, "!")
+		if attribute != "" && !listAttributes[attribute] {
+			return common.NewErrorf("list %s of %s has no attribute %s", name, file, attribute)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,382 @@
+package service
+
+import (
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/common"
+
+	"github.com/oschwald/maxminddb-golang"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// geoStatsBatch is how many rows a flush of the geo stats writes at once
+	geoStatsBatch = 500
+	// geoReloadCheck is how often the database is checked for a new file
+	geoReloadCheck = 30 * time.Second
+	// geoTopCountries is how many countries the status of the server tells
+	geoTopCountries = 5
+	// geoTopTTL is how long the top countries of the status are kept
+	geoTopTTL = time.Minute
+)
+
+// GeoStat is the connections and the traffic of a country, or of a client from
+// a country, over a range of days. An empty country is the addresses the
+// database doesn't know.
+type GeoStat struct {
+	Country     string `json:"country"`
+	Email       string `json:"email,omitempty"`
+	Connections int64  `json:"connections"`
+	Up          int64  `json:"up"`
+	Down        int64  `json:"down"`
+}
+
+// GeoStats is the geo stats from From to To, by country or by client and
+// country, the most traffic first, with the totals of the range.
+type GeoStats struct {
+	From        int64     `json:"from"`
+	To          int64     `json:"to"`
+	GroupBy     string    `json:"groupBy"`
+	Connections int64     `json:"connections"`
+	Up          int64     `json:"up"`
+	Down        int64     `json:"down"`
+	Rows        []GeoStat `json:"rows"`
+}
+
+// GeoStatsQuery picks a range of the geo stats. From and To are in
+// milliseconds; the days holding them are included.
+type GeoStatsQuery struct {
+	From    int64  `form:"from"`
+	To      int64  `form:"to"`
+	GroupBy string `form:"groupBy"`
+}
+
+type geoKey struct {
+	day     int64
+	country string
+	email   string
+}
+
+type geoCounts struct {
+	connections int64
+	up          int64
+	down        int64
+}
+
+// geoStats looks the addresses the clients connect from up in the database of
+// the settings, and counts the connections and the traffic by day, country and
+// client until they are flushed.
+type geoStats struct {
+	lock sync.Mutex
+	// reader is the database as of the file of path with modTime and size, nil
+	// while there is none
+	reader  *maxminddb.Reader
+	path    string
+	modTime time.Time
+	size    int64
+	checked time.Time
+	// cache is the country of each address looked up within cacheDay
+	cache    map[string]string
+	cacheDay int64
+	// countries is where each client last connected from, its traffic is
+	// counted for that country
+	countries map[string]string
+	pending   map[geoKey]*geoCounts
+	top       []GeoStat
+	topAt     time.Time
+}
+
+var geo = &geoStats{
+	countries: map[string]string{},
+	pending:   map[geoKey]*geoCounts{},
+}
+
+// geoCountryRecord is the field of the country of the MaxMind Country and City
+// databases, and of the compatible ones.
+type geoCountryRecord struct {
+	Country struct {
+		IsoCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+// refreshReader opens the database again if its file changed, or closes it if
+// the file is gone. The file is read into memory, so that it may be replaced
+// in place while the panel runs.
+func (g *geoStats) refreshReader(now time.Time) {
+	if now.Sub(g.checked) < geoReloadCheck {
+		return
+	}
+	g.checked = now
+	path, err := new(SettingService).GetGeoStatsDatabase()
+	if err != nil {
+		return
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		if g.reader != nil {
+			logger.Info("Geo stats stopped, no database at", path)
+		}
+		g.reader, g.path = nil, ""
+		return
+	}
+	if path == g.path && info.ModTime().Equal(g.modTime) && info.Size() == g.size {
+		return
+	}
+	g.reader, g.path, g.modTime, g.size = nil, path, info.ModTime(), info.Size()
+	g.cache = map[string]string{}
+	data, err := os.ReadFile(path)
+	if err == nil {
+		g.reader, err = maxminddb.FromBytes(data)
+	}
+	if err != nil {
+		logger.Warning("Unable to load the geo stats database:", err)
+		return
+	}
+	logger.Info("Geo stats database loaded:", path)
+}
+
+// country returns the country of ip, from the cache if it was looked up within
+// day. Private addresses have none.
+func (g *geoStats) country(ip string, day int64) (string, bool) {
+	if g.cacheDay != day {
+		g.cache, g.cacheDay = map[string]string{}, day
+	}
+	if country, ok := g.cache[ip]; ok {
+		return country, true
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil || addr.IsPrivate() || addr.IsLoopback() || addr.IsLinkLocalUnicast() || addr.IsUnspecified() {
+		return "", false
+	}
+	var record geoCountryRecord
+	if err := g.reader.Lookup(addr, &record); err != nil {
+		logger.Debug("geo stats lookup of", ip, "failed:", err)
+	}
+	g.cache[ip] = record.Country.IsoCode
+	return record.Country.IsoCode, true
+}
+
+func (g *geoStats) add(key geoKey, connections int64, up int64, down int64) {
+	counts := g.pending[key]
+	if counts == nil {
+		counts = &geoCounts{}
+		g.pending[key] = counts
+	}
+	counts.connections += connections
+	counts.up += up
+	counts.down += down
+}
+
+// seeGeoConnection counts a connection of a client from ip at at, if there is
+// a database to look ip up in.
+func seeGeoConnection(email string, ip string, at time.Time) {
+	if email == "" || ip == "" {
+		return
+	}
+	geo.lock.Lock()
+	defer geo.lock.Unlock()
+	geo.refreshReader(time.Now())
+	if geo.reader == nil {
+		return
+	}
+	day := dayStart(at).UnixMilli()
+	country, ok := geo.country(ip, day)
+	if !ok {
+		return
+	}
+	geo.countries[email] = country
+	geo.add(geoKey{day, country, email}, 1, 0, 0)
+}
+
+// addGeoTraffic counts traffic of a client for the country it last connected
+// from. The traffic of a client not seen connecting since the panel started
+// is not counted.
+func addGeoTraffic(email string, up int64, down int64, at time.Time) {
+	if up <= 0 && down <= 0 {
+		return
+	}
+	geo.lock.Lock()
+	defer geo.lock.Unlock()
+	if geo.reader == nil {
+		return
+	}
+	country, ok := geo.countries[email]
+	if !ok {
+		return
+	}
+	geo.add(geoKey{dayStart(at).UnixMilli(), country, email}, 0, max(up, 0), max(down, 0))
+}
+
+// GeoStatsService keeps the connections and the traffic of the clients by the
+// country they connect from, per day.
+type GeoStatsService struct{}
+
+// Flush writes the pending geo stats to the database. On failure they stay
+// pending.
+func (s *GeoStatsService) Flush() error {
+	geo.lock.Lock()
+	pending := geo.pending
+	geo.pending = map[geoKey]*geoCounts{}
+	geo.lock.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	rows := make([]model.GeoDay, 0, len(pending))
+	for key, counts := range pending {
+		rows = append(rows, model.GeoDay{
+			Day:         key.day,
+			Country:     key.country,
+			Email:       key.email,
+			Connections: counts.connections,
+			Up:          counts.up,
+			Down:        counts.down,
+		})
+	}
+	err := database.GetDB().Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "day"}, {Name: "country"}, {Name: "email"}},
+		DoUpdates: clause.Assignments(map[string]any{
+			"connections": gorm.Expr("geo_stats.connections + " + database.Excluded("connections")),
+			"up":          gorm.Expr("geo_stats.up + " + database.Excluded("up")),
+			"down":        gorm.Expr("geo_stats.down + " + database.Excluded("down")),
+		}),
+	}).CreateInBatches(rows, geoStatsBatch).Error
+	if err != nil {
+		geo.lock.Lock()
+		for key, counts := range pending {
+			geo.add(key, counts.connections, counts.up, counts.down)
+		}
+		geo.lock.Unlock()
+	}
+	return err
+}
+
+// Prune deletes the days of the geo stats older than days, none if days is 0.
+func (s *GeoStatsService) Prune(days int) (int64, error) {
+	if days <= 0 {
+		return 0, nil
+	}
+	cutoff := dayStart(time.Now().AddDate(0, 0, -days)).UnixMilli()
+	result := database.GetDB().Where("day < ?", cutoff).Delete(model.GeoDay{})
+	return result.RowsAffected, result.Error
+}
+
+// GetGeoStats returns the geo stats of a range by country, or by client and
+// country. It covers the last 30 days unless told otherwise.
+func (s *GeoStatsService) GetGeoStats(query GeoStatsQuery) (*GeoStats, error) {
+	columns := "country"
+	switch query.GroupBy {
+	case "country", "":
+		query.GroupBy = "country"
+	case "client":
+		columns = "country, email"
+	default:
+		return nil, common.NewErrorf("unknown geo stats grouping: %s", query.GroupBy)
+	}
+	to := time.Now()
+	if query.To > 0 {
+		to = time.UnixMilli(query.To)
+	}
+	from := to.AddDate(0, 0, -30)
+	if query.From > 0 {
+		from = time.UnixMilli(query.From)
+	}
+	if from.After(to) {
+		return nil, common.NewError("the geo stats range starts after it ends")
+	}
+
+	stats := &GeoStats{
+		From:    dayStart(from).UnixMilli(),
+		To:      to.UnixMilli(),
+		GroupBy: query.GroupBy,
+		Rows:    []GeoStat{},
+	}
+	var rows []GeoStat
+	err := database.GetDB().Model(model.GeoDay{}).
+		Select(columns+", SUM(connections) AS connections, SUM(up) AS up, SUM(down) AS down").
+		Where("day >= ? AND day <= ?", stats.From, stats.To).
+		Group(columns).
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	index := map[geoKey]int{}
+	for _, row := range rows {
+		index[geoKey{country: row.Country, email: row.Email}] = len(stats.Rows)
+		stats.Rows = append(stats.Rows, row)
+	}
+	geo.lock.Lock()
+	for key, counts := range geo.pending {
+		if key.day < stats.From || key.day > stats.To {
+			continue
+		}
+		row := geoKey{country: key.country}
+		if query.GroupBy == "client" {
+			row.email = key.email
+		}
+		i, ok := index[row]
+		if !ok {
+			i = len(stats.Rows)
+			index[row] = i
+			stats.Rows = append(stats.Rows, GeoStat{Country: row.country, Email: row.email})
+		}
+		stats.Rows[i].Connections += counts.connections
+		stats.Rows[i].Up += counts.up
+		stats.Rows[i].Down += counts.down
+	}
+	geo.lock.Unlock()
+
+	for _, row := range stats.Rows {
+		stats.Connections += row.Connections
+		stats.Up += row.Up
+		stats.Down += row.Down
+	}
+	sort.Slice(stats.Rows, func(a, b int) bool {
+		x, y := stats.Rows[a], stats.Rows[b]
+		if x.Up+x.Down != y.Up+y.Down {
+			return x.Up+x.Down > y.Up+y.Down
+		}
+		if x.Connections != y.Connections {
+			return x.Connections > y.Connections
+		}
+		if x.Country != y.Country {
+			return x.Country < y.Country
+		}
+		return x.Email < y.Email
+	})
+	return stats, nil
+}
+
+// TopCountries returns the countries the most traffic came from today, nil if
+// there are none, as of at most a minute ago.
+func (s *GeoStatsService) TopCountries() []GeoStat {
+	geo.lock.Lock()
+	top, at := geo.top, geo.topAt
+	geo.lock.Unlock()
+	if time.Since(at) < geoTopTTL {
+		return top
+	}
+
+	stats, err := s.GetGeoStats(GeoStatsQuery{From: dayStart(time.Now()).UnixMilli()})
+	if err != nil {
+		logger.Debug("unable to get the top countries:", err)
+		return top
+	}
+	top = nil
+	if len(stats.Rows) > 0 {
+		top = stats.Rows[:min(len(stats.Rows), geoTopCountries)]
+	}
+	geo.lock.Lock()
+	geo.top, geo.topAt = top, time.Now()
+	geo.lock.Unlock()
+	return top
+}
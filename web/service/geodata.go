@@ -0,0 +1,370 @@
+package service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"html"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"x-ui/config"
+	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/web/entity"
+
+	"github.com/xtls/xray-core/app/router"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	geodataDownloadTimeout = 5 * time.Minute
+	maxGeodataSize         = 256 << 20
+	// geodataStateFile of the bin folder keeps the results of the updates
+	geodataStateFile = "geodata.json"
+)
+
+// geodataReleasePattern finds the tag of a GitHub release in a download URL, the
+// one "latest" redirects to.
+var geodataReleasePattern = regexp.MustCompile(`/releases/download/([^/]+)/`)
+
+var (
+	geodataLock  sync.Mutex
+	geodataState struct {
+		LastRun   time.Time                 `json:"lastRun"`
+		LastError string                    `json:"lastError,omitempty"`
+		Files     map[string]geodataVersion `json:"files"`
+	}
+	geodataStateLoaded bool
+	// geodataUpdating is held while the files are updated
+	geodataUpdating sync.Mutex
+)
+
+type geodataVersion struct {
+	Version   string    `json:"version"`
+	Sha256    string    `json:"sha256"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// GeodataFile is a geoip or geosite file of the bin folder.
+type GeodataFile struct {
+	Name      string    `json:"name"`
+	URL       string    `json:"url"`
+	Size      int64     `json:"size"`
+	ModTime   time.Time `json:"modTime,omitzero"`
+	Version   string    `json:"version,omitempty"`
+	Sha256    string    `json:"sha256,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt,omitzero"`
+	Changed   bool      `json:"changed,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// GeodataStatus tells when the geodata files were updated and when they are
+// updated next.
+type GeodataStatus struct {
+	AutoUpdate bool          `json:"autoUpdate"`
+	Cron       string        `json:"cron"`
+	NextRun    time.Time     `json:"nextRun,omitzero"`
+	LastRun    time.Time     `json:"lastRun,omitzero"`
+	LastError  string        `json:"lastError,omitempty"`
+	Restarted  bool          `json:"restarted,omitempty"`
+	Files      []GeodataFile `json:"files"`
+}
+
+// GeodataService updates the geoip.dat and geosite.dat files Xray routes with.
+type GeodataService struct {
+	settingService SettingService
+	serverService  ServerService
+	xrayService    XrayService
+}
+
+func loadGeodataState() {
+	if geodataStateLoaded {
+		return
+	}
+	geodataStateLoaded = true
+	data, err := os.ReadFile(filepath.Join(config.GetBinFolderPath(), geodataStateFile))
+	if err == nil {
+		err = json.Unmarshal(data, &geodataState)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		logger.Warning("Unable to read the state of the geodata updates:", err)
+	}
+}
+
+func saveGeodataState() {
+	data, err := json.Marshal(&geodataState)
+	if err == nil {
+		err = os.WriteFile(filepath.Join(config.GetBinFolderPath(), geodataStateFile), data, 0o644)
+	}
+	if err != nil {
+		logger.Warning("Unable to save the state of the geodata updates:", err)
+	}
+}
+
+func (s *GeodataService) sources() (map[string]string, error) {
+	geoipURL, err := s.settingService.GetGeoipURL()
+	if err != nil {
+		return nil, err
+	}
+	geositeURL, err := s.settingService.GetGeositeURL()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"geoip.dat": geoipURL, "geosite.dat": geositeURL}, nil
+}
+
+// GetStatus returns the geodata files and the results of the last update.
+func (s *GeodataService) GetStatus() (*GeodataStatus, error) {
+	sources, err := s.sources()
+	if err != nil {
+		return nil, err
+	}
+	status := &GeodataStatus{}
+	if status.AutoUpdate, err = s.settingService.GetGeodataAutoUpdate(); err != nil {
+		return nil, err
+	}
+	if status.Cron, err = s.settingService.GetGeodataUpdateCron(); err != nil {
+		return nil, err
+	}
+	if status.AutoUpdate {
+		if schedule, err := entity.CronParser.Parse(status.Cron); err == nil {
+			// The jobs run in the panel time zone
+			status.NextRun = schedule.Next(time.Now().In(panelLocation()))
+		}
+	}
+
+	geodataLock.Lock()
+	defer geodataLock.Unlock()
+	loadGeodataState()
+	status.LastRun, status.LastError = geodataState.LastRun, geodataState.LastError
+	for _, name := range []string{"geoip.dat", "geosite.dat"} {
+		file := GeodataFile{Name: name, URL: sources[name]}
+		if info, err := os.Stat(filepath.Join(config.GetBinFolderPath(), name)); err == nil {
+			file.Size, file.ModTime = info.Size(), info.ModTime()
+		}
+		version := geodataState.Files[name]
+		file.Version, file.Sha256, file.UpdatedAt = version.Version, version.Sha256, version.UpdatedAt
+		status.Files = append(status.Files, file)
+	}
+	return status, nil
+}
+
+// geodataSum returns the SHA-256 sum published alongside a geodata file, in the
+// format of sha256sum.
+func geodataSum(client *http.Client, fileURL string) (string, error) {
+	resp, err := client.Get(fileURL + ".sha256sum")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", common.NewErrorf("the checksum could not be downloaded: %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 || len(fields[0]) != sha256.Size*2 {
+		return "", common.NewErrorf("the checksum file has no SHA-256 sum")
+	}
+	return strings.ToLower(fields[0]), nil
+}
+
+func fileSum(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// checkGeodata checks that data is a geoip or a geosite file, with lists.
+func checkGeodata(name string, data []byte) error {
+	var count int
+	if strings.HasPrefix(name, "geoip") {
+		var list router.GeoIPList
+		if err := proto.Unmarshal(data, &list); err != nil {
+			return common.NewErrorf("the file is not a geoip file: %v", err)
+		}
+		count = len(list.Entry)
+	} else {
+		var list router.GeoSiteList
+		if err := proto.Unmarshal(data, &list); err != nil {
+			return common.NewErrorf("the file is not a geosite file: %v", err)
+		}
+		count = len(list.Entry)
+	}
+	if count == 0 {
+		return common.NewErrorf("the file has no lists")
+	}
+	return nil
+}
+
+// updateGeodataFile downloads a geodata file next to the one in the bin folder,
+// and renames it over that one if it matches its checksum and differs from it.
+// The file in place is never left half written.
+func updateGeodataFile(client *http.Client, file *GeodataFile) error {
+	sum, err := geodataSum(client, file.URL)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(config.GetBinFolderPath(), file.Name)
+	if current, err := fileSum(path); err == nil && current == sum {
+		file.Sha256 = sum
+		return nil
+	}
+
+	resp, err := client.Get(file.URL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return common.NewErrorf("the file could not be downloaded: %s", resp.Status)
+	}
+	if match := geodataReleasePattern.FindStringSubmatch(resp.Request.URL.Path); match != nil {
+		file.Version = match[1]
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxGeodataSize+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > maxGeodataSize {
+		return common.NewErrorf("the file is too large")
+	}
+	actual := sha256.Sum256(data)
+	if hex.EncodeToString(actual[:]) != sum {
+		return common.NewErrorf("the file doesn't match its checksum: got %x, want %s", actual, sum)
+	}
+	if err := checkGeodata(file.Name, data); err != nil {
+		return err
+	}
+
+	temp, err := os.CreateTemp(config.GetBinFolderPath(), "."+file.Name+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	if _, err := io.Copy(temp, bytes.NewReader(data)); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(temp.Name(), 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(temp.Name(), path); err != nil {
+		return err
+	}
+	file.Sha256, file.Changed = sum, true
+	return nil
+}
+
+// Update downloads the geodata files, and restarts Xray if one of them changed.
+// A file that fails to update keeps its previous content.
+func (s *GeodataService) Update() (*GeodataStatus, error) {
+	if !geodataUpdating.TryLock() {
+		return nil, common.NewErrorf("the geodata files are being updated")
+	}
+	defer geodataUpdating.Unlock()
+
+	sources, err := s.sources()
+	if err != nil {
+		return nil, err
+	}
+	// The files are downloaded like Xray is, through its download proxy
+	client, err := s.serverService.xrayHTTPClient(geodataDownloadTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []GeodataFile
+	var errorMessages []string
+	changed := false
+	for _, name := range []string{"geoip.dat", "geosite.dat"} {
+		file := GeodataFile{Name: name, URL: sources[name]}
+		if err := updateGeodataFile(client, &file); err != nil {
+			file.Error = strings.TrimSpace(err.Error())
+			errorMessages = append(errorMessages, name+": "+file.Error)
+			logger.Warning("Unable to update", name+":", file.Error)
+		} else if file.Changed {
+			changed = true
+			logger.Info("Updated", name, file.Version)
+		}
+		files = append(files, file)
+	}
+
+	restarted := false
+	if changed && s.xrayService.IsXrayRunning() {
+		if err := s.xrayService.RestartXray(true); err != nil {
+			errorMessages = append(errorMessages, "xray failed to restart: "+strings.TrimSpace(err.Error()))
+		} else {
+			restarted = true
+		}
+	}
+
+	geodataLock.Lock()
+	loadGeodataState()
+	if geodataState.Files == nil {
+		geodataState.Files = map[string]geodataVersion{}
+	}
+	geodataState.LastRun = time.Now()
+	geodataState.LastError = strings.Join(errorMessages, "; ")
+	for _, file := range files {
+		if file.Changed {
+			geodataState.Files[file.Name] = geodataVersion{Version: file.Version, Sha256: file.Sha256, UpdatedAt: geodataState.LastRun}
+		}
+	}
+	saveGeodataState()
+	geodataLock.Unlock()
+
+	status, err := s.GetStatus()
+	if err != nil {
+		return nil, err
+	}
+	status.Restarted = restarted
+	for i := range status.Files {
+		status.Files[i].Changed = files[i].Changed
+		status.Files[i].Error = files[i].Error
+	}
+	if len(errorMessages) > 0 {
+		return status, common.NewErrorf("%s", strings.Join(errorMessages, "\r\n"))
+	}
+	return status, nil
+}
+
+// GeodataUpdateFailed tells the admins that the scheduled update of the
+// geodata files failed.
+func (t *Tgbot) GeodataUpdateFailed(err error) {
+	if !t.AlertsOn(AlertGeodata) {
+		return
+	}
+	enabled, settingErr := t.settingService.GetTgBotGeodataNotify()
+	if settingErr != nil || !enabled {
+		return
+	}
+	msg := t.I18nBot("tgbot.messages.geodataFailed")
+	msg += t.I18nBot("tgbot.messages.hostname", "Hostname=="+hostname)
+	msg += t.I18nBot("tgbot.messages.error", "Error=="+html.EscapeString(err.Error()))
+	t.SendAlert(AlertGeodata, msg)
+}
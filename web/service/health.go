@@ -0,0 +1,188 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/web/global"
+)
+
+const (
+	healthCheckTimeout = 2 * time.Second
+	// Probes may come every second, the Xray API is asked at most this often
+	xrayHealthCacheTTL = 2 * time.Second
+)
+
+// HealthCheck is the result of checking one component.
+type HealthCheck struct {
+	Ok        bool    `json:"ok"`
+	LatencyMs float64 `json:"latencyMs"`
+	Cached    bool    `json:"cached,omitempty"`
+	Skipped   bool    `json:"skipped,omitempty"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// HealthReport holds the checks of the database, Xray and the subscription server.
+type HealthReport struct {
+	Checks map[string]HealthCheck
+	Failed []string
+}
+
+func (r *HealthReport) Healthy() bool {
+	return len(r.Failed) == 0
+}
+
+var (
+	xrayHealthLock  sync.Mutex
+	xrayHealth      HealthCheck
+	xrayHealthCheck time.Time
+)
+
+type HealthService struct {
+	settingService SettingService
+	xrayService    XrayService
+}
+
+func (s *HealthService) Check() *HealthReport {
+	report := &HealthReport{Checks: map[string]HealthCheck{}}
+	for _, check := range []struct {
+		name string
+		run  func() HealthCheck
+	}{
+		{"db", s.checkDB},
+		{"xray", s.checkXray},
+		{"sub", s.checkSub},
+	} {
+		result := check.run()
+		report.Checks[check.name] = result
+		if !result.Ok {
+			report.Failed = append(report.Failed, check.name)
+		}
+	}
+	return report
+}
+
+func timeCheck(check func() error) HealthCheck {
+	start := time.Now()
+	err := check()
+	result := HealthCheck{
+		Ok:        err == nil,
+		LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+func (s *HealthService) checkDB() HealthCheck {
+	return timeCheck(func() error {
+		db := database.GetDB()
+		if db == nil {
+			return errors.New("database is not initialized")
+		}
+		sqlDB, err := db.DB()
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+		defer cancel()
+		return sqlDB.PingContext(ctx)
+	})
+}
+
+func (s *HealthService) checkXray() HealthCheck {
+	xrayHealthLock.Lock()
+	defer xrayHealthLock.Unlock()
+	if time.Since(xrayHealthCheck) < xrayHealthCacheTTL {
+		cached := xrayHealth
+		cached.Cached = true
+		return cached
+	}
+	xrayHealth = timeCheck(func() error {
+		return s.xrayService.PingXrayAPI(healthCheckTimeout)
+	})
+	xrayHealthCheck = time.Now()
+	return xrayHealth
+}
+
+func (s *HealthService) checkSub() HealthCheck {
+	if enabled, err := s.settingService.GetSubEnable(); err == nil && !enabled {
+		return HealthCheck{Ok: true, Skipped: true}
+	}
+	return timeCheck(func() error {
+		subServer := global.GetSubServer()
+		if subServer == nil {
+			return errors.New("subscription server is not running")
+		}
+		addr := subServer.GetListenAddr()
+		if addr == nil {
+			return errors.New("subscription server is not listening")
+		}
+		conn, err := net.DialTimeout(addr.Network(), addr.String(), healthCheckTimeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	})
+}
+
+// checkWeb checks that the panel accepts connections, if it listens.
+func (s *HealthService) checkWeb() HealthCheck {
+	if enabled, err := s.settingService.GetWebEnable(); err == nil && !enabled {
+		return HealthCheck{Ok: true, Skipped: true}
+	}
+	return timeCheck(func() error {
+		webServer := global.GetWebServer()
+		if webServer == nil {
+			return errors.New("web server is not running")
+		}
+		addr := webServer.GetListenAddr()
+		if addr == nil {
+			return errors.New("web server is not listening")
+		}
+		conn, err := net.DialTimeout(addr.Network(), addr.String(), healthCheckTimeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	})
+}
+
+// CheckAlive tells whether the panel itself is alive, for the watchdog of
+// systemd: the database answers a query and the panel and the subscription
+// server accept connections. Xray is left out, the panel restarts it itself.
+func (s *HealthService) CheckAlive() error {
+	checks := map[string]HealthCheck{
+		"db":  s.checkDB(),
+		"web": s.checkWeb(),
+		"sub": s.checkSub(),
+	}
+	for _, name := range []string{"db", "web", "sub"} {
+		if check := checks[name]; !check.Ok {
+			return errors.New(name + ": " + check.Error)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+	var count int64
+	return database.GetDB().WithContext(ctx).Model(model.Setting{}).Count(&count).Error
+}
+
+// Summary returns the status line of the panel, for "systemctl status".
+func (s *HealthService) Summary() string {
+	version := s.xrayService.GetXrayVersion()
+	xrayState := "xray v" + version
+	if !s.xrayService.IsXrayRunning() {
+		xrayState = "xray stopped"
+	}
+	var inbounds int64
+	database.GetDB().Model(model.Inbound{}).Where("enable = ?", true).Count(&inbounds)
+	return fmt.Sprintf("serving, %s, %d inbounds", xrayState, inbounds)
+}
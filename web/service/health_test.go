@@ -0,0 +1,101 @@
+package service
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/web/global"
+
+	"github.com/robfig/cron/v3"
+)
+
+// fakeServer is a web or subscription server listening on a port of its own.
+type fakeServer struct {
+	listener net.Listener
+}
+
+func (s *fakeServer) GetCron() *cron.Cron     { return nil }
+func (s *fakeServer) GetCtx() context.Context { return context.Background() }
+func (s *fakeServer) GetListenAddr() net.Addr { return s.listener.Addr() }
+func (s *fakeServer) PrepareRestart() error   { return nil }
+
+func startFakeServer(t *testing.T) *fakeServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	return &fakeServer{listener: listener}
+}
+
+func TestCheckAlive(t *testing.T) {
+	newTestDB(t)
+	web, sub := startFakeServer(t), startFakeServer(t)
+	global.SetWebServer(web)
+	global.SetSubServer(sub)
+	t.Cleanup(func() {
+		global.SetWebServer(nil)
+		global.SetSubServer(nil)
+	})
+	settingService := SettingService{}
+	if err := settingService.setString("subEnable", "true"); err != nil {
+		t.Fatal(err)
+	}
+	s := HealthService{}
+	if err := s.CheckAlive(); err != nil {
+		t.Fatal("the panel is not alive:", err)
+	}
+
+	// A listener that stopped accepting connections
+	sub.listener.Close()
+	if err := s.CheckAlive(); err == nil || !strings.HasPrefix(err.Error(), "sub: ") {
+		t.Errorf("with the subscription server down the panel is alive: %v", err)
+	}
+	// unless it is off
+	if err := settingService.setString("subEnable", "false"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CheckAlive(); err != nil {
+		t.Errorf("with the subscription server off the panel is not alive: %v", err)
+	}
+
+	global.SetWebServer(nil)
+	if err := s.CheckAlive(); err == nil || !strings.HasPrefix(err.Error(), "web: ") {
+		t.Errorf("without the web server the panel is alive: %v", err)
+	}
+	if err := settingService.setString("webEnable", "false"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CheckAlive(); err != nil {
+		t.Errorf("with the web server off the panel is not alive: %v", err)
+	}
+
+	// A database that doesn't answer
+	sqlDB, err := database.GetDB().DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.Close()
+	if err := s.CheckAlive(); err == nil || !strings.HasPrefix(err.Error(), "db: ") {
+		t.Errorf("with the database closed the panel is alive: %v", err)
+	}
+}
+
+func TestHealthSummary(t *testing.T) {
+	db := newTestDB(t)
+	for i, enable := range []bool{true, true, false} {
+		inbound := &model.Inbound{Enable: enable, Port: 24443 + i, Protocol: model.VMESS, Tag: "inbound-summary-" + string(rune('a'+i)), Settings: `{"clients":[]}`}
+		if err := db.Create(inbound).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Xray isn't running in the tests
+	if summary := (&HealthService{}).Summary(); summary != "serving, xray stopped, 2 inbounds" {
+		t.Errorf("the status is %q", summary)
+	}
+}
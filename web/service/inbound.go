@@ -1,8 +1,11 @@
 package service
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"net"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -13,6 +16,7 @@ import (
 	"x-ui/database/model"
 	"x-ui/logger"
 	"x-ui/util/common"
+	"x-ui/web/locale"
 	"x-ui/xray"
 
 	"gorm.io/gorm"
@@ -22,6 +26,9 @@ type InboundService struct {
 	xrayApi xray.XrayAPI
 	muXray  sync.Mutex // только для последовательного доступа к xrayApi
 	muByID  sync.Map
+
+	settingService SettingService
+	webhookService WebhookService
 }
 
 func (s *InboundService) GetInbounds(userId int) ([]*model.Inbound, error) {
@@ -31,13 +38,18 @@ func (s *InboundService) GetInbounds(userId int) ([]*model.Inbound, error) {
 	if err != nil && err != gorm.ErrRecordNotFound {
 		return nil, err
 	}
+	SetClientCounts(inbounds...)
+	s.setScheduleStates(inbounds...)
+	s.setRealityHealth(inbounds...)
+	s.setBindStates(inbounds...)
+	SetLimitUsage(inbounds...)
 	return inbounds, nil
 }
 
 func (s *InboundService) GetAllInbounds() ([]*model.Inbound, error) {
 	db := database.GetDB()
 	var inbounds []*model.Inbound
-	err := db.Model(model.Inbound{}).Preload("ClientStats").Find(&inbounds).Error
+	err := db.Model(model.Inbound{}).Preload("ClientStats").Order("id").Find(&inbounds).Error
 	if err != nil && err != gorm.ErrRecordNotFound {
 		return nil, err
 	}
@@ -51,24 +63,28 @@ func (s *InboundService) lockInbound(id int) func() {
 	return func() { mu.Unlock() }
 }
 
-func (s *InboundService) checkPortExist(listen string, port int, ignoreId int) (bool, error) {
+// checkPortExist tells whether an inbound other than ignoreId listens on a port
+// from start to end.
+func (s *InboundService) checkPortExist(listen string, start int, end int, ignoreId int) (bool, error) {
 	db := database.GetDB()
+	// The ports of an inbound go from port to port_end, or just port
+	overlap := "port <= ? AND " + database.Greatest("port", "COALESCE(port_end, 0)") + " >= ?"
 	if listen == "" || listen == "0.0.0.0" || listen == "::" || listen == "::0" {
-		db = db.Model(model.Inbound{}).Where("port = ?", port)
+		db = db.Model(model.Inbound{}).Where(overlap, end, start)
 	} else {
 		db = db.Model(model.Inbound{}).
-			Where("port = ?", port).
+			Where(overlap, end, start).
 			Where(
 				db.Model(model.Inbound{}).Where(
 					"listen = ?", listen,
 				).Or(
-					"listen = \"\"",
+					"listen = ''",
 				).Or(
-					"listen = \"0.0.0.0\"",
+					"listen = '0.0.0.0'",
 				).Or(
-					"listen = \"::\"",
+					"listen = '::'",
 				).Or(
-					"listen = \"::0\""))
+					"listen = '::0'"))
 	}
 	if ignoreId > 0 {
 		db = db.Where("id != ?", ignoreId)
@@ -99,9 +115,9 @@ func (s *InboundService) getAllEmails() ([]string, error) {
 	db := database.GetDB()
 	var emails []string
 	err := db.Raw(`
-		SELECT JSON_EXTRACT(client.value, '$.email')
+		SELECT ` + database.JSONText("client.value", "$.email") + `
 		FROM inbounds,
-			JSON_EACH(JSON_EXTRACT(inbounds.settings, '$.clients')) AS client
+			` + database.JSONEach("inbounds.settings", "$.clients", "client") + `
 		`).Scan(&emails).Error
 	if err != nil {
 		return nil, err
@@ -109,102 +125,107 @@ func (s *InboundService) getAllEmails() ([]string, error) {
 	return emails, nil
 }
 
-func (s *InboundService) contains(slice []string, str string) bool {
-	lowerStr := strings.ToLower(str)
-	for _, s := range slice {
-		if strings.ToLower(s) == lowerStr {
-			return true
-		}
+// checkSubIncludeDisabled checks the override of an inbound for its expired and
+// depleted clients in subscriptions.
+func checkSubIncludeDisabled(value string) error {
+	if !slices.Contains([]string{"", model.SubIncludeDisabledOn, model.SubIncludeDisabledOff}, value) {
+		return common.NewErrorf("subscription override %q must be empty, %s or %s", value, model.SubIncludeDisabledOn, model.SubIncludeDisabledOff)
 	}
-	return false
+	return nil
 }
 
-func (s *InboundService) checkEmailsExistForClients(clients []model.Client) (string, error) {
-	allEmails, err := s.getAllEmails()
+func (s *InboundService) AddInbound(inbound *model.Inbound) (*model.Inbound, bool, error) {
+	settings, err := normalizeClients(inbound.Settings)
 	if err != nil {
-		return "", err
+		return inbound, false, err
 	}
-	var emails []string
-	for _, client := range clients {
-		if client.Email != "" {
-			if s.contains(emails, client.Email) {
-				return client.Email, nil
-			}
-			if s.contains(allEmails, client.Email) {
-				return client.Email, nil
-			}
-			emails = append(emails, client.Email)
+	if settings, err = normalizeFallbacks(inbound.Protocol, settings); err != nil {
+		return inbound, false, err
+	}
+	inbound.Settings = settings
+	if inbound.Sniffing, err = normalizeSniffing(inbound.Sniffing); err != nil {
+		return inbound, false, err
+	}
+	if inbound.StreamSettings, err = normalizeStreamSettings(inbound.StreamSettings); err != nil {
+		return inbound, false, err
+	}
+	if err = checkSubIncludeDisabled(inbound.SubIncludeDisabled); err != nil {
+		return inbound, false, err
+	}
+	if inbound.ClientDefaults, err = normalizeLinkOptions(inbound.ClientDefaults); err != nil {
+		return inbound, false, err
+	}
+	if inbound.Limits, err = normalizeInboundLimits(inbound.Limits); err != nil {
+		return inbound, false, err
+	}
+	if inbound.ConnLimits, err = normalizeConnLimits(inbound.ConnLimits); err != nil {
+		return inbound, false, err
+	}
+	if inbound.RegenerateRealityKeys {
+		if err := regenerateRealityKeys(inbound); err != nil {
+			return inbound, false, err
 		}
 	}
-	return "", nil
-}
-
-func (s *InboundService) checkEmailExistForInbound(inbound *model.Inbound) (string, error) {
-	clients, err := s.GetClients(inbound)
-	if err != nil {
-		return "", err
+	if inbound.Protocol == model.Shadowsocks {
+		method := shadowsocksMethod(inbound)
+		if inbound.Settings, err = fillShadowsocksClients(inbound.Settings, method); err != nil {
+			return inbound, false, err
+		}
 	}
-	allEmails, err := s.getAllEmails()
-	if err != nil {
-		return "", err
+	if inbound.Protocol == model.WireGuard {
+		if inbound.Settings, err = fillWireguardSettings(inbound.Settings); err != nil {
+			return inbound, false, err
+		}
 	}
-	var emails []string
-	for _, client := range clients {
-		if client.Email != "" {
-			if s.contains(emails, client.Email) {
-				return client.Email, nil
-			}
-			if s.contains(allEmails, client.Email) {
-				return client.Email, nil
-			}
-			emails = append(emails, client.Email)
+
+	if inbound.Port == 0 || inbound.RandomPort {
+		if inbound.PortEnd != 0 {
+			return inbound, false, common.NewError("a random port can't be a port range")
+		}
+		port, err := s.pickRandomPort(inbound.Listen)
+		if err != nil {
+			return inbound, false, err
 		}
+		inbound.Port = port
+		inbound.Tag = InboundTag(inbound.Listen, port)
 	}
-	return "", nil
-}
 
-func (s *InboundService) AddInbound(inbound *model.Inbound) (*model.Inbound, bool, error) {
-	exist, err := s.checkPortExist(inbound.Listen, inbound.Port, 0)
+	exist, err := s.checkInboundPorts(inbound, 0)
 	if err != nil {
 		return inbound, false, err
 	}
 	if exist {
-		return inbound, false, common.NewError("Port already exists:", inbound.Port)
+		return inbound, false, locale.NewError(locale.ErrInboundPortInUse, "Port=="+inbound.PortString())
 	}
 
-	existEmail, err := s.checkEmailExistForInbound(inbound)
+	clients, err := s.GetClients(inbound)
 	if err != nil {
 		return inbound, false, err
 	}
-	if existEmail != "" {
-		return inbound, false, common.NewError("Duplicate email:", existEmail)
+	if _, err = s.checkClientEmails(clients, nil); err != nil {
+		return inbound, false, err
+	}
+	if _, err = checkClientFlows(inbound, clients); err != nil {
+		return inbound, false, err
+	}
+	if _, err = checkShadowsocksKeys(inbound, clients); err != nil {
+		return inbound, false, err
 	}
 
-	clients, err := s.GetClients(inbound)
-	if err != nil {
+	if err = checkClientIds(inbound.Protocol, clients); err != nil {
 		return inbound, false, err
 	}
 
-	// Secure client ID
-	for _, client := range clients {
-		switch inbound.Protocol {
-		case "trojan":
-			if client.Password == "" {
-				return inbound, false, common.NewError("empty client ID")
-			}
-		case "shadowsocks":
-			if client.Email == "" {
-				return inbound, false, common.NewError("empty client ID")
-			}
-		default:
-			if client.ID == "" {
-				return inbound, false, common.NewError("empty client ID")
+	// The events are queued after the inbound is committed
+	defer func() {
+		if err == nil {
+			s.webhookService.Emit(WebhookInboundCreated, inboundWebhookData(inbound))
+			for i := range clients {
+				s.webhookService.Emit(WebhookClientCreated, clientWebhookData(inbound, &clients[i]))
 			}
 		}
-	}
-
-	db := database.GetDB()
-	tx := db.Begin()
+	}()
+	tx := database.Begin()
 	defer func() {
 		if err == nil {
 			tx.Commit()
@@ -213,6 +234,8 @@ func (s *InboundService) AddInbound(inbound *model.Inbound) (*model.Inbound, boo
 		}
 	}()
 
+	markClientStats(inbound, clients)
+
 	err = tx.Save(inbound).Error
 	if err == nil {
 		if len(inbound.ClientStats) == 0 {
@@ -228,26 +251,73 @@ func (s *InboundService) AddInbound(inbound *model.Inbound) (*model.Inbound, boo
 	if inbound.Enable {
 		s.muXray.Lock()
 		defer s.muXray.Unlock()
-		s.xrayApi.Init(p.GetAPIPort())
-		inboundJson, err1 := json.MarshalIndent(inbound.GenXrayInboundConfig(), "", "  ")
-		if err1 != nil {
-			logger.Debug("Unable to marshal inbound config:", err1)
-		}
-
-		err1 = s.xrayApi.AddInbound(inboundJson)
-		if err1 == nil {
-			logger.Debug("New inbound added by api:", inbound.Tag)
-		} else {
-			logger.Debug("Unable to add inbound by api:", err1)
+		if s.initXrayAPI() != nil {
 			needRestart = true
+		} else {
+			inboundJson, err1 := json.MarshalIndent(inbound.GenXrayInboundConfig(), "", "  ")
+			if err1 != nil {
+				logger.Debug("Unable to marshal inbound config:", err1)
+			}
+
+			err1 = s.xrayApi.AddInbound(inboundJson)
+			if err1 == nil {
+				logger.Debug("New inbound added by api:", inbound.Tag)
+			} else {
+				logger.Debug("Unable to add inbound by api:", err1)
+				needRestart = true
+			}
+			s.xrayApi.Close()
 		}
-		s.xrayApi.Close()
 
 	}
 
 	return inbound, needRestart, err
 }
 
+// checkClientIds checks that each client has the credential of the protocol.
+func checkClientIds(protocol model.Protocol, clients []model.Client) error {
+	// Secure client ID
+	for _, client := range clients {
+		switch protocol {
+		case "trojan":
+			if client.Password == "" {
+				return common.NewError("empty client ID")
+			}
+		case "shadowsocks":
+			if client.Email == "" {
+				return common.NewError("empty client ID")
+			}
+		case "wireguard":
+			if client.Email == "" || client.PublicKey == "" {
+				return common.NewError("empty client ID")
+			}
+		default:
+			if client.ID == "" {
+				return common.NewError("empty client ID")
+			}
+		}
+	}
+	return nil
+}
+
+// markClientStats gives the imported client stats of an inbound the tags and
+// the admin state of their clients.
+func markClientStats(inbound *model.Inbound, clients []model.Client) {
+	clientsByEmail := make(map[string]model.Client, len(clients))
+	for _, client := range clients {
+		clientsByEmail[client.Email] = client
+	}
+	for index := range inbound.ClientStats {
+		stat := &inbound.ClientStats[index]
+		client, ok := clientsByEmail[stat.Email]
+		stat.Tags = tagColumn(client.Tags)
+		if ok && !client.Enable {
+			stat.DisabledReason = ClientDisabledAdmin
+			stat.DisabledAt = time.Now().UnixMilli()
+		}
+	}
+}
+
 func (s *InboundService) DelInbound(id int) (bool, error) {
 	s.muXray.Lock()
 	defer s.muXray.Unlock()
@@ -257,15 +327,18 @@ func (s *InboundService) DelInbound(id int) (bool, error) {
 	needRestart := false
 	result := db.Model(model.Inbound{}).Select("tag").Where("id = ? and enable = ?", id, true).First(&tag)
 	if result.Error == nil {
-		s.xrayApi.Init(p.GetAPIPort())
-		err1 := s.xrayApi.DelInbound(tag)
-		if err1 == nil {
-			logger.Debug("Inbound deleted by api:", tag)
-		} else {
-			logger.Debug("Unable to delete inbound by api:", err1)
+		if s.initXrayAPI() != nil {
 			needRestart = true
+		} else {
+			err1 := s.xrayApi.DelInbound(tag)
+			if err1 == nil {
+				logger.Debug("Inbound deleted by api:", tag)
+			} else {
+				logger.Debug("Unable to delete inbound by api:", err1)
+				needRestart = true
+			}
+			s.xrayApi.Close()
 		}
-		s.xrayApi.Close()
 
 	} else {
 		logger.Debug("No enabled inbound founded to removing by api", tag)
@@ -305,23 +378,78 @@ func (s *InboundService) GetInbound(id int) (*model.Inbound, error) {
 }
 
 func (s *InboundService) UpdateInbound(inbound *model.Inbound) (*model.Inbound, bool, error) {
-	exist, err := s.checkPortExist(inbound.Listen, inbound.Port, inbound.Id)
+	settings, err := normalizeClients(inbound.Settings)
+	if err != nil {
+		return inbound, false, err
+	}
+	if settings, err = normalizeFallbacks(inbound.Protocol, settings); err != nil {
+		return inbound, false, err
+	}
+	inbound.Settings = settings
+	if inbound.Sniffing, err = normalizeSniffing(inbound.Sniffing); err != nil {
+		return inbound, false, err
+	}
+	if inbound.StreamSettings, err = normalizeStreamSettings(inbound.StreamSettings); err != nil {
+		return inbound, false, err
+	}
+	if err = checkSubIncludeDisabled(inbound.SubIncludeDisabled); err != nil {
+		return inbound, false, err
+	}
+	if inbound.ClientDefaults, err = normalizeLinkOptions(inbound.ClientDefaults); err != nil {
+		return inbound, false, err
+	}
+	if inbound.RegenerateRealityKeys {
+		if err := regenerateRealityKeys(inbound); err != nil {
+			return inbound, false, err
+		}
+	}
+
+	exist, err := s.checkInboundPorts(inbound, inbound.Id)
 	if err != nil {
 		return inbound, false, err
 	}
 	if exist {
-		return inbound, false, common.NewError("Port already exists:", inbound.Port)
+		return inbound, false, locale.NewError(locale.ErrInboundPortInUse, "Port=="+inbound.PortString())
 	}
 
 	oldInbound, err := s.GetInbound(inbound.Id)
 	if err != nil {
 		return inbound, false, err
 	}
+	if inbound.Protocol == model.Shadowsocks {
+		if err = s.migrateShadowsocksKeys(oldInbound, inbound); err != nil {
+			return inbound, false, err
+		}
+		method := shadowsocksMethod(inbound)
+		if inbound.Settings, err = fillShadowsocksClients(inbound.Settings, method); err != nil {
+			return inbound, false, err
+		}
+	}
+	if inbound.Protocol == model.WireGuard {
+		if inbound.Settings, err = fillWireguardSettings(inbound.Settings); err != nil {
+			return inbound, false, err
+		}
+	}
 
-	tag := oldInbound.Tag
+	// The clients of the inbound are replaced, the others keep their emails
+	clients, err := s.GetClients(inbound)
+	if err != nil {
+		return inbound, false, err
+	}
+	_, err = s.checkClientEmails(clients, func(use *ClientEmailUse) bool {
+		return use.InboundId == inbound.Id
+	})
+	if err != nil {
+		return inbound, false, err
+	}
+	if _, err = checkClientFlows(inbound, clients); err != nil {
+		return inbound, false, err
+	}
+	if _, err = checkShadowsocksKeys(inbound, clients); err != nil {
+		return inbound, false, err
+	}
 
-	db := database.GetDB()
-	tx := db.Begin()
+	tx := database.Begin()
 
 	defer func() {
 		if err != nil {
@@ -340,10 +468,18 @@ func (s *InboundService) UpdateInbound(inbound *model.Inbound) (*model.Inbound,
 	oldInbound.Down = inbound.Down
 	oldInbound.Total = inbound.Total
 	oldInbound.Remark = inbound.Remark
+	oldInbound.RemarkTemplate = inbound.RemarkTemplate
+	oldInbound.SubIncludeDisabled = inbound.SubIncludeDisabled
+	oldInbound.ClientDefaults = inbound.ClientDefaults
+	// Switching a scheduled inbound by hand holds until the schedule switches it
+	if oldInbound.Schedule != nil && oldInbound.Enable != inbound.Enable {
+		oldInbound.ScheduleOverride = s.scheduleOverride(oldInbound.Schedule, inbound.Enable)
+	}
 	oldInbound.Enable = inbound.Enable
 	oldInbound.ExpiryTime = inbound.ExpiryTime
 	oldInbound.Listen = inbound.Listen
 	oldInbound.Port = inbound.Port
+	oldInbound.PortEnd = inbound.PortEnd
 	oldInbound.Protocol = inbound.Protocol
 	oldInbound.Settings = inbound.Settings
 	oldInbound.StreamSettings = inbound.StreamSettings
@@ -355,29 +491,9 @@ func (s *InboundService) UpdateInbound(inbound *model.Inbound) (*model.Inbound,
 		oldInbound.Tag = fmt.Sprintf("inbound-%v:%v", inbound.Listen, inbound.Port)
 	}
 
-	needRestart := false
-	s.xrayApi.Init(p.GetAPIPort())
-	if s.xrayApi.DelInbound(tag) == nil {
-		logger.Debug("Old inbound deleted by api:", tag)
-	}
-	if inbound.Enable {
-		inboundJson, err2 := json.MarshalIndent(oldInbound.GenXrayInboundConfig(), "", "  ")
-		if err2 != nil {
-			logger.Debug("Unable to marshal updated inbound config:", err2)
-			needRestart = true
-		} else {
-			err2 = s.xrayApi.AddInbound(inboundJson)
-			if err2 == nil {
-				logger.Debug("Updated inbound added by api:", oldInbound.Tag)
-			} else {
-				logger.Debug("Unable to update inbound by api:", err2)
-				needRestart = true
-			}
-		}
-	}
-	s.xrayApi.Close()
-
-	return inbound, needRestart, tx.Save(oldInbound).Error
+	// An edited inbound goes through a rebuild of the config, through the API
+	// Xray would get it with its disabled clients too
+	return inbound, true, tx.Save(oldInbound).Error
 }
 
 func (s *InboundService) updateClientTraffics(tx *gorm.DB, oldInbound *model.Inbound, newInbound *model.Inbound) error {
@@ -414,6 +530,13 @@ func (s *InboundService) updateClientTraffics(tx *gorm.DB, oldInbound *model.Inb
 		for _, oldClient := range oldClients {
 			if newClient.Email == oldClient.Email {
 				emailExists = true
+				if !slices.Equal(newClient.Tags, oldClient.Tags) {
+					err = tx.Model(xray.ClientTraffic{}).Where("email = ?", newClient.Email).
+						Update("tags", tagColumn(newClient.Tags)).Error
+					if err != nil {
+						return err
+					}
+				}
 				break
 			}
 		}
@@ -428,6 +551,18 @@ func (s *InboundService) updateClientTraffics(tx *gorm.DB, oldInbound *model.Inb
 }
 
 func (s *InboundService) AddInboundClient(data *model.Inbound) (bool, error) {
+	return s.addInboundClient(data, WebhookClientCreated)
+}
+
+// addInboundClient adds the clients of data to its inbound, and emits event for
+// each of them.
+func (s *InboundService) addInboundClient(data *model.Inbound, event string) (bool, error) {
+	var err error
+	data.Settings, err = normalizeClients(data.Settings)
+	if err != nil {
+		return false, err
+	}
+
 	clients, err := s.GetClients(data)
 	if err != nil {
 		return false, err
@@ -440,14 +575,9 @@ func (s *InboundService) AddInboundClient(data *model.Inbound) (bool, error) {
 
 	interfaceClients, _ := settings["clients"].([]any)
 
-	if _, err = s.checkEmailsExistForClients(clients); err != nil {
+	if _, err = s.checkClientEmails(clients, nil); err != nil {
 		return false, err
 	}
-	for _, client := range clients {
-		if client.ID == "" {
-			return false, common.NewError("empty client ID")
-		}
-	}
 
 	// === ЛОК ТОЛЬКО ПО ЭТОМУ inbound.Id ===
 	unlock := s.lockInbound(data.Id)
@@ -458,6 +588,45 @@ func (s *InboundService) AddInboundClient(data *model.Inbound) (bool, error) {
 	if err != nil {
 		return false, err
 	}
+	if oldInbound.Protocol == model.Shadowsocks {
+		// The clients without a key get one of the method of the inbound
+		method := shadowsocksMethod(oldInbound)
+		if data.Settings, err = fillShadowsocksClients(data.Settings, method); err != nil {
+			return false, err
+		}
+		if clients, err = s.GetClients(data); err != nil {
+			return false, err
+		}
+		settings = nil
+		if err = json.Unmarshal([]byte(data.Settings), &settings); err != nil {
+			return false, err
+		}
+		interfaceClients, _ = settings["clients"].([]any)
+	}
+	if oldInbound.Protocol == model.WireGuard {
+		// The peers get keys and the next free addresses of the subnet
+		if data.Settings, err = fillWireguardClients(data.Settings, oldInbound); err != nil {
+			return false, err
+		}
+		if clients, err = s.GetClients(data); err != nil {
+			return false, err
+		}
+		settings = nil
+		if err = json.Unmarshal([]byte(data.Settings), &settings); err != nil {
+			return false, err
+		}
+		interfaceClients, _ = settings["clients"].([]any)
+	}
+	// Trojan and Shadowsocks clients have a password rather than an ID
+	if err = checkClientIds(oldInbound.Protocol, clients); err != nil {
+		return false, err
+	}
+	if _, err = checkClientFlows(oldInbound, clients); err != nil {
+		return false, err
+	}
+	if _, err = checkShadowsocksKeys(oldInbound, clients); err != nil {
+		return false, err
+	}
 
 	var oldSettings map[string]any
 	if err = json.Unmarshal([]byte(oldInbound.Settings), &oldSettings); err != nil {
@@ -465,6 +634,15 @@ func (s *InboundService) AddInboundClient(data *model.Inbound) (bool, error) {
 	}
 
 	oldClients, _ := oldSettings["clients"].([]any)
+	// Updates are checked against the client they replace, before it is deleted
+	if event == WebhookClientCreated {
+		before := limitedClients(oldClients)
+		err = checkInboundLimits(oldInbound, before, append(before, limitedClients(interfaceClients)...), time.Now().UnixMilli())
+		if err != nil {
+			s.limitRejected(err)
+			return false, err
+		}
+	}
 	oldClients = append(oldClients, interfaceClients...)
 	oldSettings["clients"] = oldClients
 
@@ -482,17 +660,20 @@ func (s *InboundService) AddInboundClient(data *model.Inbound) (bool, error) {
 	s.muXray.Lock() // xrayApi — под глобальным, как и раньше
 	defer s.muXray.Unlock()
 
-	if err := s.xrayApi.Init(p.GetAPIPort()); err != nil {
-		return true, nil // попросим рестарт, если API недоступен
+	// Without the API the clients are added by a restart
+	apiErr := s.initXrayAPI()
+	if apiErr == nil {
+		defer s.xrayApi.Close()
 	}
 
 	for _, client := range clients {
 		if len(client.Email) > 0 {
 			if err := s.AddClientStat(db, data.Id, &client); err != nil {
-				s.xrayApi.Close()
 				return needRestart, err
 			}
-			if client.Enable {
+			if client.Enable && apiErr != nil {
+				needRestart = true
+			} else if client.Enable {
 				cipher := ""
 				if oldInbound.Protocol == "shadowsocks" {
 					if m, ok := oldSettings["method"].(string); ok {
@@ -519,9 +700,13 @@ func (s *InboundService) AddInboundClient(data *model.Inbound) (bool, error) {
 		}
 	}
 
-	s.xrayApi.Close()
-
-	return needRestart, db.Save(oldInbound).Error
+	if err := db.Save(oldInbound).Error; err != nil {
+		return needRestart, err
+	}
+	for i := range clients {
+		s.webhookService.Emit(event, clientWebhookData(oldInbound, &clients[i]))
+	}
+	return needRestart, nil
 }
 
 func (s *InboundService) DelInboundClient(inboundId int, clientId string) (bool, error) {
@@ -543,7 +728,7 @@ func (s *InboundService) DelInboundClient(inboundId int, clientId string) (bool,
 	if oldInbound.Protocol == "trojan" {
 		client_key = "password"
 	}
-	if oldInbound.Protocol == "shadowsocks" {
+	if oldInbound.Protocol == "shadowsocks" || oldInbound.Protocol == "wireguard" {
 		client_key = "email"
 	}
 
@@ -593,20 +778,23 @@ func (s *InboundService) DelInboundClient(inboundId int, clientId string) (bool,
 			logger.Error("Delete stats Data Error")
 		}
 		if needApiDel && notDepleted {
-			s.xrayApi.Init(p.GetAPIPort())
-			err1 := s.xrayApi.RemoveUser(oldInbound.Tag, email)
-			if err1 == nil {
-				logger.Debug("Client deleted by api:", email)
-				needRestart = false
+			if s.initXrayAPI() != nil {
+				needRestart = true
 			} else {
-				if strings.Contains(err1.Error(), fmt.Sprintf("User %s not found.", email)) {
-					logger.Debug("User is already deleted. Nothing to do more...")
+				err1 := s.xrayApi.RemoveUser(oldInbound.Tag, email)
+				if err1 == nil {
+					logger.Debug("Client deleted by api:", email)
+					needRestart = false
 				} else {
-					logger.Debug("Error in deleting client by api:", err1)
-					needRestart = true
+					if strings.Contains(err1.Error(), fmt.Sprintf("User %s not found.", email)) {
+						logger.Debug("User is already deleted. Nothing to do more...")
+					} else {
+						logger.Debug("Error in deleting client by api:", err1)
+						needRestart = true
+					}
 				}
+				s.xrayApi.Close()
 			}
-			s.xrayApi.Close()
 
 		}
 	}
@@ -614,193 +802,269 @@ func (s *InboundService) DelInboundClient(inboundId int, clientId string) (bool,
 }
 
 func (s *InboundService) UpdateInboundClient(data *model.Inbound, clientId string) (bool, error) {
+	var err error
+	if data.Settings, err = normalizeClients(data.Settings); err != nil {
+		return false, err
+	}
+	// Check the emails before the client is deleted, it may keep its own
+	oldInbound, err := s.GetInbound(data.Id)
+	if err != nil {
+		return false, err
+	}
+	oldClients, err := s.GetClients(oldInbound)
+	if err != nil {
+		return false, err
+	}
+	oldEmail, oldFlow := "", ""
+	for _, client := range oldClients {
+		c_id := client.ID
+		if oldInbound.Protocol == "trojan" {
+			c_id = client.Password
+		}
+		if oldInbound.Protocol == "shadowsocks" || oldInbound.Protocol == "wireguard" {
+			c_id = client.Email
+		}
+		if c_id == clientId {
+			oldEmail, oldFlow = client.Email, client.Flow
+			break
+		}
+	}
+	clients, err := s.GetClients(data)
+	if err != nil {
+		return false, err
+	}
+	_, err = s.checkClientEmails(clients, func(use *ClientEmailUse) bool {
+		return use.InboundId == data.Id && use.Email == oldEmail
+	})
+	if err != nil {
+		return false, err
+	}
+	if err = checkUpdateLimits(oldInbound, oldEmail, data.Settings); err != nil {
+		s.limitRejected(err)
+		return false, err
+	}
+
 	g, err := s.DelInboundClient(data.Id, clientId)
 	if err != nil {
 		return false, err
 	}
-	g, err = s.AddInboundClient(data)
+	g, err = s.addInboundClient(data, WebhookClientUpdated)
 	if err != nil {
 		return false, err
 	}
+	// The connections of the client keep the flow they were opened with, only a
+	// restart of Xray changes it
+	for _, client := range clients {
+		if client.Flow != oldFlow {
+			usersNeedRestart.Store(true)
+			g = true
+		}
+	}
 	return g, nil
 
 }
 
-func (s *InboundService) AddTraffic(inboundTraffics []*xray.Traffic, clientTraffics []*xray.ClientTraffic) (error, bool) {
-	var err error
-	db := database.GetDB()
-	tx := db.Begin()
+// AddTraffic counts the traffic read from Xray up to counters. It is gathered
+// in memory and written to the database every trafficFlushInterval, or at once
+// when it makes a client or an inbound reach its limit; the clients and the
+// inbounds that are due are renewed or disabled on every call. Traffic that
+// fails to be written stays pending for the next flush.
+func (s *InboundService) AddTraffic(inboundTraffics []*xray.Traffic, clientTraffics []*xray.ClientTraffic, counters *xray.CounterSnapshot) (error, bool) {
+	bufferTraffic(inboundTraffics, clientTraffics, counters)
+	recordLiveTraffic(inboundTraffics)
 
-	defer func() {
-		if err != nil {
-			tx.Rollback()
-		} else {
-			tx.Commit()
-		}
-	}()
-	err = s.addInboundTraffic(tx, inboundTraffics)
+	lockTrafficFlush()
+	defer trafficFlushLock.Unlock()
+	flush, err := s.trafficFlushDue()
 	if err != nil {
-		return err, false
+		logger.Warning("Error in checking pending traffic:", err)
 	}
-	err = s.addClientTraffic(tx, clientTraffics)
-	if err != nil {
-		return err, false
+	var batches map[int64]*trafficBatch
+	if flush {
+		batches, counters = takePendingTraffic()
 	}
 
-	needRestart0, count, err := s.autoRenewClients(tx)
-	if err != nil {
-		logger.Warning("Error in renew clients:", err)
+	tx := database.Begin()
+	if flush {
+		if err = s.writeTraffic(tx, batches, counters); err != nil {
+			tx.Rollback()
+			restorePendingTraffic(batches, counters)
+			return err, false
+		}
+	}
+
+	// The traffic is committed even if the clients can't be renewed or disabled
+	needRestart0, count, err1 := s.autoRenewClients(tx)
+	if err1 != nil {
+		logger.Warning("Error in renew clients:", err1)
 	} else if count > 0 {
 		logger.Debugf("%v clients renewed", count)
 	}
 
-	needRestart1, count, err := s.disableInvalidClients(tx)
-	if err != nil {
-		logger.Warning("Error in disabling invalid clients:", err)
-	} else if count > 0 {
-		logger.Debugf("%v clients disabled", count)
+	needRestart1, disabled, err1 := s.disableInvalidClients(tx)
+	if err1 != nil {
+		logger.Warning("Error in disabling invalid clients:", err1)
+	} else if len(disabled) > 0 {
+		logger.Debugf("%v clients disabled", len(disabled))
 	}
 
-	needRestart2, count, err := s.disableInvalidInbounds(tx)
-	if err != nil {
-		logger.Warning("Error in disabling invalid inbounds:", err)
+	needRestart2, count, err1 := s.disableInvalidInbounds(tx)
+	if err1 != nil {
+		logger.Warning("Error in disabling invalid inbounds:", err1)
 	} else if count > 0 {
 		logger.Debugf("%v inbounds disabled", count)
 	}
-	return nil, (needRestart0 || needRestart1 || needRestart2)
-}
-
-func (s *InboundService) addInboundTraffic(tx *gorm.DB, traffics []*xray.Traffic) error {
-	if len(traffics) == 0 {
-		return nil
-	}
-
-	var err error
 
-	for _, traffic := range traffics {
-		if traffic.IsInbound {
-			err = tx.Model(&model.Inbound{}).Where("tag = ?", traffic.Tag).
-				Updates(map[string]any{
-					"up":   gorm.Expr("up + ?", traffic.Up),
-					"down": gorm.Expr("down + ?", traffic.Down),
-				}).Error
-			if err != nil {
-				return err
-			}
+	if err = tx.Commit().Error; err != nil {
+		if flush {
+			restorePendingTraffic(batches, counters)
 		}
+		return err, false
 	}
-	return nil
+	if flush {
+		trafficFlushed(batches, counters)
+		s.forgetOldSightings()
+	}
+	s.webhookService.emitClientsDisabled(disabled)
+	return nil, (needRestart0 || needRestart1 || needRestart2)
 }
 
-func (s *InboundService) addClientTraffic(tx *gorm.DB, traffics []*xray.ClientTraffic) (err error) {
-	if len(traffics) == 0 {
-		// Empty onlineUsers
-		if p != nil {
-			p.SetOnlineClients(nil)
-		}
-		return nil
+// addInboundTraffic adds the traffic of inbounds by tag.
+func (s *InboundService) addInboundTraffic(tx *gorm.DB, traffics map[string]*trafficDelta) error {
+	values := make([][]any, 0, len(traffics))
+	for tag, delta := range traffics {
+		values = append(values, []any{tag, delta.up, delta.down})
 	}
+	return updateByKey(tx, "inbounds", "tag", []string{"up = up + %s", "down = down + %s"}, values)
+}
 
-	var onlineClients []string
-
+// addClientTraffic adds the traffic of clients by email, starts the countdown
+// of the ones with a delayed start that passed traffic, and saves when the
+// clients seen since the panel started were last seen.
+func (s *InboundService) addClientTraffic(tx *gorm.DB, traffics map[string]*trafficDelta) error {
+	lastSeen := sightedClients()
+	values := make([][]any, 0, len(traffics)+len(lastSeen))
+	used := make([]*xray.ClientTraffic, 0, len(traffics))
 	emails := make([]string, 0, len(traffics))
-	for _, traffic := range traffics {
-		emails = append(emails, traffic.Email)
-	}
-	dbClientTraffics := make([]*xray.ClientTraffic, 0, len(traffics))
-	err = tx.Model(xray.ClientTraffic{}).Where("email IN (?)", emails).Find(&dbClientTraffics).Error
-	if err != nil {
-		return err
+	for email, delta := range traffics {
+		values = append(values, []any{email, delta.up, delta.down, lastSeen[email]})
+		used = append(used, &xray.ClientTraffic{Email: email, Up: delta.up, Down: delta.down})
+		emails = append(emails, email)
 	}
-
-	// Avoid empty slice error
-	if len(dbClientTraffics) == 0 {
-		return nil
+	for email, seen := range lastSeen {
+		if _, ok := traffics[email]; !ok {
+			values = append(values, []any{email, 0, 0, seen})
+		}
 	}
-
-	dbClientTraffics, err = s.adjustTraffics(tx, dbClientTraffics)
+	err := updateByKey(tx, "client_traffics", "email",
+		[]string{"up = up + %s", "down = down + %s", "last_seen = " + database.Greatest("last_seen", "%s")}, values)
 	if err != nil {
 		return err
 	}
 
-	for dbTraffic_index := range dbClientTraffics {
-		for traffic_index := range traffics {
-			if dbClientTraffics[dbTraffic_index].Email == traffics[traffic_index].Email {
-				dbClientTraffics[dbTraffic_index].Up += traffics[traffic_index].Up
-				dbClientTraffics[dbTraffic_index].Down += traffics[traffic_index].Down
-
-				// Add user in onlineUsers array on traffic
-				if traffics[traffic_index].Up+traffics[traffic_index].Down > 0 {
-					onlineClients = append(onlineClients, traffics[traffic_index].Email)
-				}
-				break
-			}
+	for start := 0; start < len(emails); start += trafficFlushBatch {
+		var delayed []*xray.ClientTraffic
+		err = tx.Model(xray.ClientTraffic{}).
+			Where("expiry_time < 0 AND email IN ?", emails[start:min(start+trafficFlushBatch, len(emails))]).
+			Find(&delayed).Error
+		if err != nil {
+			return err
+		}
+		if len(delayed) == 0 {
+			continue
+		}
+		if _, err = s.adjustTraffics(tx, delayed, used); err != nil {
+			return err
 		}
 	}
-
-	// Set onlineUsers
-	p.SetOnlineClients(onlineClients)
-
-	err = tx.Save(dbClientTraffics).Error
-	if err != nil {
-		logger.Warning("AddClientTraffic update data ", err)
-	}
-
 	return nil
 }
 
-func (s *InboundService) adjustTraffics(tx *gorm.DB, dbClientTraffics []*xray.ClientTraffic) ([]*xray.ClientTraffic, error) {
-	inboundIds := make([]int, 0, len(dbClientTraffics))
-	for _, dbClientTraffic := range dbClientTraffics {
-		if dbClientTraffic.ExpiryTime < 0 {
-			inboundIds = append(inboundIds, dbClientTraffic.InboundId)
+// adjustTraffics starts the countdown of clients with a delayed start, whose
+// negative expiryTime is the duration, once they passed traffic. The traffic row
+// is claimed with a conditional update, so a client is started exactly once
+// even if it is changed elsewhere at the same time.
+func (s *InboundService) adjustTraffics(tx *gorm.DB, dbClientTraffics []*xray.ClientTraffic, traffics []*xray.ClientTraffic) ([]*xray.ClientTraffic, error) {
+	used := make(map[string]bool, len(traffics))
+	for _, traffic := range traffics {
+		if traffic.Up+traffic.Down > 0 {
+			used[traffic.Email] = true
 		}
 	}
 
-	if len(inboundIds) > 0 {
-		var inbounds []*model.Inbound
-		err := tx.Model(model.Inbound{}).Where("id IN (?)", inboundIds).Find(&inbounds).Error
-		if err != nil {
-			return nil, err
+	now := time.Now().UnixMilli()
+	started := map[int]map[string]int64{}
+	for _, dbClientTraffic := range dbClientTraffics {
+		if dbClientTraffic.ExpiryTime >= 0 || !used[dbClientTraffic.Email] {
+			continue
 		}
-		for inbound_index := range inbounds {
-			settings := map[string]any{}
-			json.Unmarshal([]byte(inbounds[inbound_index].Settings), &settings)
-			clients, ok := settings["clients"].([]any)
-			if ok {
-				var newClients []any
-				for client_index := range clients {
-					c := clients[client_index].(map[string]any)
-					for traffic_index := range dbClientTraffics {
-						if dbClientTraffics[traffic_index].ExpiryTime < 0 && c["email"] == dbClientTraffics[traffic_index].Email {
-							oldExpiryTime := c["expiryTime"].(float64)
-							newExpiryTime := (time.Now().Unix() * 1000) - int64(oldExpiryTime)
-							c["expiryTime"] = newExpiryTime
-							dbClientTraffics[traffic_index].ExpiryTime = newExpiryTime
-							break
-						}
-					}
-					newClients = append(newClients, any(c))
-				}
-				settings["clients"] = newClients
-				modifiedSettings, err := json.MarshalIndent(settings, "", "  ")
-				if err != nil {
-					return nil, err
-				}
-
-				inbounds[inbound_index].Settings = string(modifiedSettings)
+		expiryTime := now - dbClientTraffic.ExpiryTime
+		result := tx.Model(xray.ClientTraffic{}).
+			Where("id = ? AND expiry_time < 0", dbClientTraffic.Id).
+			Update("expiry_time", expiryTime)
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		if result.RowsAffected == 0 {
+			// Started or edited meanwhile, keep what is stored
+			err := tx.Model(xray.ClientTraffic{}).Select("expiry_time").
+				Where("id = ?", dbClientTraffic.Id).Scan(&dbClientTraffic.ExpiryTime).Error
+			if err != nil {
+				return nil, err
 			}
+			continue
 		}
-		err = tx.Save(inbounds).Error
-		if err != nil {
-			logger.Warning("AddClientTraffic update inbounds ", err)
-			logger.Error(inbounds)
+		dbClientTraffic.ExpiryTime = expiryTime
+		if started[dbClientTraffic.InboundId] == nil {
+			started[dbClientTraffic.InboundId] = map[string]int64{}
 		}
+		started[dbClientTraffic.InboundId][dbClientTraffic.Email] = expiryTime
 	}
 
+	for inboundId, expiryTimes := range started {
+		if err := s.setDelayedExpiryTimes(tx, inboundId, expiryTimes); err != nil {
+			return nil, err
+		}
+	}
 	return dbClientTraffics, nil
 }
 
+// setDelayedExpiryTimes sets the expiryTime of the clients of an inbound that
+// still have a delayed start, by email.
+func (s *InboundService) setDelayedExpiryTimes(tx *gorm.DB, inboundId int, expiryTimes map[string]int64) error {
+	inbound := &model.Inbound{}
+	if err := tx.Model(model.Inbound{}).Where("id = ?", inboundId).First(inbound).Error; err != nil {
+		return err
+	}
+	settings := map[string]any{}
+	if err := json.Unmarshal([]byte(inbound.Settings), &settings); err != nil {
+		return err
+	}
+	clients, _ := settings["clients"].([]any)
+	changed := false
+	for _, item := range clients {
+		c, ok := item.(map[string]any)
+		if !ok {
+			continue
+		}
+		email, _ := c["email"].(string)
+		expiryTime, ok := expiryTimes[email]
+		if !ok || jsonInt64(c["expiryTime"]) >= 0 {
+			continue
+		}
+		c["expiryTime"] = expiryTime
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	modifiedSettings, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return err
+	}
+	return tx.Model(model.Inbound{}).Where("id = ?", inboundId).Update("settings", string(modifiedSettings)).Error
+}
+
 func (s *InboundService) autoRenewClients(tx *gorm.DB) (bool, int64, error) {
 	// check for time expired
 	var traffics []*xray.ClientTraffic
@@ -849,17 +1113,20 @@ func (s *InboundService) autoRenewClients(tx *gorm.DB) (bool, int64, error) {
 					traffics[traffic_index].Down = 0
 					traffics[traffic_index].Up = 0
 					if !traffic.Enable {
-						traffics[traffic_index].Enable = true
-						clientsToAdd = append(clientsToAdd,
-							struct {
-								protocol string
-								tag      string
-								client   map[string]any
-							}{
-								protocol: string(inbounds[inbound_index].Protocol),
-								tag:      inbounds[inbound_index].Tag,
-								client:   c,
-							})
+						enableTraffic(traffics[traffic_index])
+						// A client disabled by hand stays out of Xray
+						if enabled, _ := c["enable"].(bool); enabled && inbounds[inbound_index].Enable {
+							clientsToAdd = append(clientsToAdd,
+								struct {
+									protocol string
+									tag      string
+									client   map[string]any
+								}{
+									protocol: string(inbounds[inbound_index].Protocol),
+									tag:      inbounds[inbound_index].Tag,
+									client:   apiUser(inbounds[inbound_index], c),
+								})
+						}
 					}
 					clients[client_index] = any(c)
 					break
@@ -881,10 +1148,10 @@ func (s *InboundService) autoRenewClients(tx *gorm.DB) (bool, int64, error) {
 	if err != nil {
 		return false, 0, err
 	}
-	if p != nil {
+	if len(clientsToAdd) > 0 {
 		s.muXray.Lock()
 		defer s.muXray.Unlock()
-		err1 = s.xrayApi.Init(p.GetAPIPort())
+		err1 = s.initXrayAPI()
 		if err1 != nil {
 			return true, int64(len(traffics)), nil
 		}
@@ -915,17 +1182,20 @@ func (s *InboundService) disableInvalidInbounds(tx *gorm.DB) (bool, int64, error
 		}
 		s.muXray.Lock()
 		defer s.muXray.Unlock()
-		s.xrayApi.Init(p.GetAPIPort())
-		for _, tag := range tags {
-			err1 := s.xrayApi.DelInbound(tag)
-			if err1 == nil {
-				logger.Debug("Inbound disabled by api:", tag)
-			} else {
-				logger.Debug("Error in disabling inbound by api:", err1)
-				needRestart = true
+		if s.initXrayAPI() != nil {
+			needRestart = len(tags) > 0
+		} else {
+			for _, tag := range tags {
+				err1 := s.xrayApi.DelInbound(tag)
+				if err1 == nil {
+					logger.Debug("Inbound disabled by api:", tag)
+				} else {
+					logger.Debug("Error in disabling inbound by api:", err1)
+					needRestart = true
+				}
 			}
+			s.xrayApi.Close()
 		}
-		s.xrayApi.Close()
 
 	}
 
@@ -937,7 +1207,7 @@ func (s *InboundService) disableInvalidInbounds(tx *gorm.DB) (bool, int64, error
 	return needRestart, count, err
 }
 
-func (s *InboundService) disableInvalidClients(tx *gorm.DB) (bool, int64, error) {
+func (s *InboundService) disableInvalidClients(tx *gorm.DB) (bool, []xray.ClientTraffic, error) {
 	now := time.Now().Unix() * 1000
 	needRestart := false
 
@@ -953,37 +1223,66 @@ func (s *InboundService) disableInvalidClients(tx *gorm.DB) (bool, int64, error)
 			Where("((client_traffics.total > 0 AND client_traffics.up + client_traffics.down >= client_traffics.total) OR (client_traffics.expiry_time > 0 AND client_traffics.expiry_time <= ?)) AND client_traffics.enable = ?", now, true).
 			Scan(&results).Error
 		if err != nil {
-			return false, 0, err
+			return false, nil, err
 		}
 		s.muXray.Lock()
 		defer s.muXray.Unlock()
-		s.xrayApi.Init(p.GetAPIPort())
-		for _, result := range results {
-			err1 := s.xrayApi.RemoveUser(result.Tag, result.Email)
-			if err1 == nil {
-				logger.Debug("Client disabled by api:", result.Email)
-			} else {
-				if strings.Contains(err1.Error(), fmt.Sprintf("User %s not found.", result.Email)) {
-					logger.Debug("User is already disabled. Nothing to do more...")
+		if s.initXrayAPI() != nil {
+			needRestart = len(results) > 0
+		} else {
+			for _, result := range results {
+				err1 := s.xrayApi.RemoveUser(result.Tag, result.Email)
+				if err1 == nil {
+					logger.Debug("Client disabled by api:", result.Email)
 				} else {
 					if strings.Contains(err1.Error(), fmt.Sprintf("User %s not found.", result.Email)) {
 						logger.Debug("User is already disabled. Nothing to do more...")
 					} else {
-						logger.Debug("Error in disabling client by api:", err1)
-						needRestart = true
+						if strings.Contains(err1.Error(), fmt.Sprintf("User %s not found.", result.Email)) {
+							logger.Debug("User is already disabled. Nothing to do more...")
+						} else {
+							logger.Debug("Error in disabling client by api:", err1)
+							needRestart = true
+						}
 					}
 				}
 			}
+			s.xrayApi.Close()
 		}
-		s.xrayApi.Close()
 
 	}
-	result := tx.Model(xray.ClientTraffic{}).
-		Where("((total > 0 and up + down >= total) or (expiry_time > 0 and expiry_time <= ?)) and enable = ?", now, true).
-		Update("enable", false)
-	err := result.Error
-	count := result.RowsAffected
-	return needRestart, count, err
+	// The clients are read first for their events
+	var disabled []xray.ClientTraffic
+	where := "((total > 0 and up + down >= total) or (expiry_time > 0 and expiry_time <= ?)) and enable = ?"
+	if err := tx.Where(where, now, true).Find(&disabled).Error; err != nil {
+		return needRestart, nil, err
+	}
+	if len(disabled) == 0 {
+		return needRestart, nil, nil
+	}
+	err := tx.Model(xray.ClientTraffic{}).
+		Where(where, now, true).
+		Updates(map[string]any{
+			"enable":          false,
+			"disabled_reason": disabledReason(now),
+			"disabled_at":     now,
+		}).Error
+	if err != nil {
+		return needRestart, nil, err
+	}
+	for i := range disabled {
+		traffic := &disabled[i]
+		traffic.Enable = false
+		traffic.DisabledAt = now
+		switch {
+		case traffic.DisabledReason == ClientDisabledAdmin:
+		case traffic.ExpiryTime > 0 && traffic.ExpiryTime <= now:
+			traffic.DisabledReason = ClientDisabledExpiry
+		default:
+			traffic.DisabledReason = ClientDisabledQuota
+		}
+	}
+	return needRestart, disabled, nil
 }
 
 func (s *InboundService) GetInboundTags() (string, error) {
@@ -1002,13 +1301,68 @@ func (s *InboundService) MigrationRemoveOrphanedTraffics() {
 	db.Exec(`
 		DELETE FROM client_traffics
 		WHERE email NOT IN (
-			SELECT JSON_EXTRACT(client.value, '$.email')
+				SELECT ` + database.JSONText("client.value", "$.email") + `
 			FROM inbounds,
-				JSON_EACH(JSON_EXTRACT(inbounds.settings, '$.clients')) AS client
+				` + database.JSONEach("inbounds.settings", "$.clients", "client") + `
 		)
 	`)
 }
 
+// MigrationSyncDelayedStarts repairs clients whose delayed start was converted
+// in only one of the inbound settings and client_traffics, as in a backup taken
+// while it happened. The concrete expiry wins over the duration.
+func (s *InboundService) MigrationSyncDelayedStarts() {
+	var mismatches []struct {
+		InboundId      int
+		Email          string
+		SettingsExpiry int64
+		TrafficExpiry  int64
+	}
+	db := database.GetDB()
+	expiry := database.JSONInt("client.value", "$.expiryTime")
+	err := db.Raw(`
+		SELECT inbounds.id AS inbound_id, traffic.email,
+			` + expiry + ` AS settings_expiry,
+			traffic.expiry_time AS traffic_expiry
+		FROM inbounds
+			CROSS JOIN ` + database.JSONEach("inbounds.settings", "$.clients", "client") + `
+			JOIN client_traffics AS traffic
+				ON traffic.inbound_id = inbounds.id AND traffic.email = ` + database.JSONText("client.value", "$.email") + `
+		WHERE (` + expiry + ` < 0 AND traffic.expiry_time > 0)
+			OR (` + expiry + ` > 0 AND traffic.expiry_time < 0)`).
+		Scan(&mismatches).Error
+	if err != nil || len(mismatches) == 0 {
+		return
+	}
+
+	err = database.Transaction(func(tx *gorm.DB) error {
+		started := map[int]map[string]int64{}
+		for _, mismatch := range mismatches {
+			if mismatch.TrafficExpiry < 0 {
+				err := tx.Model(xray.ClientTraffic{}).Where("email = ?", mismatch.Email).
+					Update("expiry_time", mismatch.SettingsExpiry).Error
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			if started[mismatch.InboundId] == nil {
+				started[mismatch.InboundId] = map[string]int64{}
+			}
+			started[mismatch.InboundId][mismatch.Email] = mismatch.TrafficExpiry
+		}
+		for inboundId, expiryTimes := range started {
+			if err := s.setDelayedExpiryTimes(tx, inboundId, expiryTimes); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Warning("Error in syncing delayed starts:", err)
+	}
+}
+
 func (s *InboundService) AddClientStat(tx *gorm.DB, inboundId int, client *model.Client) error {
 	clientTraffic := xray.ClientTraffic{}
 	clientTraffic.InboundId = inboundId
@@ -1019,6 +1373,11 @@ func (s *InboundService) AddClientStat(tx *gorm.DB, inboundId int, client *model
 	clientTraffic.Up = 0
 	clientTraffic.Down = 0
 	clientTraffic.Reset = client.Reset
+	clientTraffic.Tags = tagColumn(client.Tags)
+	if !client.Enable {
+		clientTraffic.DisabledReason = ClientDisabledAdmin
+		clientTraffic.DisabledAt = time.Now().UnixMilli()
+	}
 	result := tx.Create(&clientTraffic)
 	err := result.Error
 	return err
@@ -1027,13 +1386,12 @@ func (s *InboundService) AddClientStat(tx *gorm.DB, inboundId int, client *model
 func (s *InboundService) UpdateClientStat(tx *gorm.DB, email string, client *model.Client) error {
 	result := tx.Model(xray.ClientTraffic{}).
 		Where("email = ?", email).
-		Updates(map[string]any{
-			"enable":      true,
+		Updates(savedColumns(quotaColumns(map[string]any{
 			"email":       client.Email,
-			"total":       client.TotalGB,
 			"expiry_time": client.ExpiryTime,
 			"reset":       client.Reset,
-		})
+			"tags":        tagColumn(client.Tags),
+		}, client.TotalGB), client))
 	err := result.Error
 	return err
 }
@@ -1126,7 +1484,7 @@ func (s *InboundService) SetClientTelegramUserID(trafficId int, tgId int64) (boo
 			switch inbound.Protocol {
 			case "trojan":
 				clientId = oldClient.Password
-			case "shadowsocks":
+			case "shadowsocks", "wireguard":
 				clientId = oldClient.Email
 			default:
 				clientId = oldClient.ID
@@ -1211,7 +1569,7 @@ func (s *InboundService) ToggleClientEnableByEmail(clientEmail string) (bool, bo
 			switch inbound.Protocol {
 			case "trojan":
 				clientId = oldClient.Password
-			case "shadowsocks":
+			case "shadowsocks", "wireguard":
 				clientId = oldClient.Email
 			default:
 				clientId = oldClient.ID
@@ -1275,7 +1633,7 @@ func (s *InboundService) ResetClientIpLimitByEmail(clientEmail string, count int
 			switch inbound.Protocol {
 			case "trojan":
 				clientId = oldClient.Password
-			case "shadowsocks":
+			case "shadowsocks", "wireguard":
 				clientId = oldClient.Email
 			default:
 				clientId = oldClient.ID
@@ -1333,7 +1691,7 @@ func (s *InboundService) ResetClientExpiryTimeByEmail(clientEmail string, expiry
 			switch inbound.Protocol {
 			case "trojan":
 				clientId = oldClient.Password
-			case "shadowsocks":
+			case "shadowsocks", "wireguard":
 				clientId = oldClient.Email
 			default:
 				clientId = oldClient.ID
@@ -1394,7 +1752,7 @@ func (s *InboundService) ResetClientTrafficLimitByEmail(clientEmail string, tota
 			switch inbound.Protocol {
 			case "trojan":
 				clientId = oldClient.Password
-			case "shadowsocks":
+			case "shadowsocks", "wireguard":
 				clientId = oldClient.Email
 			default:
 				clientId = oldClient.ID
@@ -1432,11 +1790,15 @@ func (s *InboundService) ResetClientTrafficLimitByEmail(clientEmail string, tota
 }
 
 func (s *InboundService) ResetClientTrafficByEmail(clientEmail string) error {
+	// The traffic counted before the reset is written first, not added after it
+	if err := s.FlushTraffic(); err != nil {
+		return err
+	}
 	db := database.GetDB()
 
 	result := db.Model(xray.ClientTraffic{}).
 		Where("email = ?", clientEmail).
-		Updates(map[string]any{"enable": true, "up": 0, "down": 0})
+		Updates(enabledColumns(map[string]any{"up": 0, "down": 0}))
 
 	err := result.Error
 	if err != nil {
@@ -1445,7 +1807,14 @@ func (s *InboundService) ResetClientTrafficByEmail(clientEmail string) error {
 	return nil
 }
 
-func (s *InboundService) ResetClientTraffic(id int, clientEmail string) (bool, error) {
+// ResetClientTraffic zeroes the traffic of a client of the inbound id. With
+// carryOver, a client with carry over starts anew with what it left unused, as
+// on a scheduled reset.
+func (s *InboundService) ResetClientTraffic(id int, clientEmail string, carryOver bool) (bool, error) {
+	// The traffic counted before the reset is written first, not added after it
+	if err := s.FlushTraffic(); err != nil {
+		return false, err
+	}
 	needRestart := false
 
 	traffic, err := s.GetClientTrafficByEmail(clientEmail)
@@ -1466,40 +1835,48 @@ func (s *InboundService) ResetClientTraffic(id int, clientEmail string) (bool, e
 			if client.Email == clientEmail && client.Enable {
 				s.muXray.Lock()
 				defer s.muXray.Unlock()
-				s.xrayApi.Init(p.GetAPIPort())
-				cipher := ""
-				if string(inbound.Protocol) == "shadowsocks" {
-					var oldSettings map[string]any
-					err = json.Unmarshal([]byte(inbound.Settings), &oldSettings)
-					if err != nil {
-						return false, err
-					}
-					cipher = oldSettings["method"].(string)
-				}
-				err1 := s.xrayApi.AddUser(string(inbound.Protocol), inbound.Tag, map[string]any{
-					"email":    client.Email,
-					"id":       client.ID,
-					"security": client.Security,
-					"flow":     client.Flow,
-					"password": client.Password,
-					"cipher":   cipher,
-				})
-				if err1 == nil {
-					logger.Debug("Client enabled due to reset traffic:", clientEmail)
-				} else {
-					logger.Debug("Error in enabling client by api:", err1)
+				if s.initXrayAPI() != nil {
 					needRestart = true
+				} else {
+					cipher := ""
+					if string(inbound.Protocol) == "shadowsocks" {
+						var oldSettings map[string]any
+						err = json.Unmarshal([]byte(inbound.Settings), &oldSettings)
+						if err != nil {
+							return false, err
+						}
+						cipher = oldSettings["method"].(string)
+					}
+					err1 := s.xrayApi.AddUser(string(inbound.Protocol), inbound.Tag, map[string]any{
+						"email":    client.Email,
+						"id":       client.ID,
+						"security": client.Security,
+						"flow":     client.Flow,
+						"password": client.Password,
+						"cipher":   cipher,
+					})
+					if err1 == nil {
+						logger.Debug("Client enabled due to reset traffic:", clientEmail)
+					} else {
+						logger.Debug("Error in enabling client by api:", err1)
+						needRestart = true
+					}
+					s.xrayApi.Close()
 				}
-				s.xrayApi.Close()
 
 				break
 			}
 		}
 	}
 
+	if carryOver {
+		if err := s.carryOverTraffic(id, traffic); err != nil {
+			return false, err
+		}
+	}
 	traffic.Up = 0
 	traffic.Down = 0
-	traffic.Enable = true
+	enableTraffic(traffic)
 
 	db := database.GetDB()
 	err = db.Save(traffic).Error
@@ -1511,6 +1888,10 @@ func (s *InboundService) ResetClientTraffic(id int, clientEmail string) (bool, e
 }
 
 func (s *InboundService) ResetAllClientTraffics(id int) error {
+	// The traffic counted before the reset is written first, not added after it
+	if err := s.FlushTraffic(); err != nil {
+		return err
+	}
 	db := database.GetDB()
 
 	whereText := "inbound_id "
@@ -1522,13 +1903,17 @@ func (s *InboundService) ResetAllClientTraffics(id int) error {
 
 	result := db.Model(xray.ClientTraffic{}).
 		Where(whereText, id).
-		Updates(map[string]any{"enable": true, "up": 0, "down": 0})
+		Updates(enabledColumns(map[string]any{"up": 0, "down": 0}))
 
 	err := result.Error
 	return err
 }
 
 func (s *InboundService) ResetAllTraffics() error {
+	// The traffic counted before the reset is written first, not added after it
+	if err := s.FlushTraffic(); err != nil {
+		return err
+	}
 	db := database.GetDB()
 
 	result := db.Model(model.Inbound{}).
@@ -1541,7 +1926,7 @@ func (s *InboundService) ResetAllTraffics() error {
 
 func (s *InboundService) DelDepletedClients(id int) (err error) {
 	db := database.GetDB()
-	tx := db.Begin()
+	tx := database.Begin()
 	defer func() {
 		if err == nil {
 			tx.Commit()
@@ -1558,7 +1943,7 @@ func (s *InboundService) DelDepletedClients(id int) (err error) {
 	}
 
 	depletedClients := []xray.ClientTraffic{}
-	err = db.Model(xray.ClientTraffic{}).Where(whereText+" and enable = ?", id, false).Select("inbound_id, GROUP_CONCAT(email) as email").Group("inbound_id").Find(&depletedClients).Error
+	err = db.Model(xray.ClientTraffic{}).Where(whereText+" and enable = ?", id, false).Select("inbound_id, " + database.GroupConcat("email") + " as email").Group("inbound_id").Find(&depletedClients).Error
 	if err != nil {
 		return err
 	}
@@ -1617,18 +2002,22 @@ func (s *InboundService) DelDepletedClients(id int) (err error) {
 	return nil
 }
 
-func (s *InboundService) GetClientTrafficTgBot(tgId int64) ([]*xray.ClientTraffic, error) {
+// GetClientsByTgId returns the clients of the Telegram user tgId in every
+// inbound.
+func (s *InboundService) GetClientsByTgId(tgId int64) ([]model.Client, error) {
 	db := database.GetDB()
 	var inbounds []*model.Inbound
 
-	// Retrieve inbounds where settings contain the given tgId
-	err := db.Model(model.Inbound{}).Where("settings LIKE ?", fmt.Sprintf(`%%"tgId": %d%%`, tgId)).Find(&inbounds).Error
+	// Retrieve inbounds with a client of the given tgId, however the settings
+	// are formatted
+	err := db.Model(model.Inbound{}).Where("EXISTS (SELECT 1 FROM "+database.JSONEach("inbounds.settings", "$.clients", "client")+
+		" WHERE "+database.JSONInt("client.value", "$.tgId")+" = ?)", tgId).Find(&inbounds).Error
 	if err != nil && err != gorm.ErrRecordNotFound {
 		logger.Errorf("Error retrieving inbounds with tgId %d: %v", tgId, err)
 		return nil, err
 	}
 
-	var emails []string
+	var result []model.Client
 	for _, inbound := range inbounds {
 		clients, err := s.GetClients(inbound)
 		if err != nil {
@@ -1637,10 +2026,23 @@ func (s *InboundService) GetClientTrafficTgBot(tgId int64) ([]*xray.ClientTraffi
 		}
 		for _, client := range clients {
 			if client.TgID == tgId {
-				emails = append(emails, client.Email)
+				result = append(result, client)
 			}
 		}
 	}
+	return result, nil
+}
+
+func (s *InboundService) GetClientTrafficTgBot(tgId int64) ([]*xray.ClientTraffic, error) {
+	db := database.GetDB()
+	clients, err := s.GetClientsByTgId(tgId)
+	if err != nil {
+		return nil, err
+	}
+	var emails []string
+	for _, client := range clients {
+		emails = append(emails, client.Email)
+	}
 
 	var traffics []*xray.ClientTraffic
 	err = db.Model(xray.ClientTraffic{}).Where("email IN ?", emails).Find(&traffics).Error
@@ -1692,11 +2094,11 @@ func (s *InboundService) GetClientTrafficByID(id string) ([]xray.ClientTraffic,
 	var traffics []xray.ClientTraffic
 
 	err := db.Model(xray.ClientTraffic{}).Where(`email IN(
-		SELECT JSON_EXTRACT(client.value, '$.email') as email
+		SELECT `+database.JSONText("client.value", "$.email")+` as email
 		FROM inbounds,
-	  	JSON_EACH(JSON_EXTRACT(inbounds.settings, '$.clients')) AS client
+	  	`+database.JSONEach("inbounds.settings", "$.clients", "client")+`
 		WHERE
-	  	JSON_EXTRACT(client.value, '$.id') in (?)
+	  	`+database.JSONText("client.value", "$.id")+` in (?)
 		)`, id).Find(&traffics).Error
 
 	if err != nil {
@@ -1792,8 +2194,7 @@ func (s *InboundService) SearchInbounds(query string) ([]*model.Inbound, error)
 }
 
 func (s *InboundService) MigrationRequirements() {
-	db := database.GetDB()
-	tx := db.Begin()
+	tx := database.Begin()
 	var err error
 	defer func() {
 		if err == nil {
@@ -1881,8 +2282,8 @@ func (s *InboundService) MigrationRequirements() {
 	err = tx.Raw(`select id, port, stream_settings
 	from inbounds
 	WHERE protocol in ('vmess','vless','trojan')
-	  AND json_extract(stream_settings, '$.security') = 'tls'
-	  AND json_extract(stream_settings, '$.tlsSettings.settings.domains') IS NOT NULL`).Scan(&externalProxy).Error
+	  AND ` + database.JSONText("stream_settings", "$.security") + ` = 'tls'
+	  AND ` + database.JSONText("stream_settings", "$.tlsSettings.settings.domains") + ` IS NOT NULL`).Scan(&externalProxy).Error
 	if err != nil || len(externalProxy) == 0 {
 		return
 	}
@@ -1909,12 +2310,12 @@ func (s *InboundService) MigrationRequirements() {
 		}
 		stream["externalProxy"] = reverses
 		newStream, _ := json.MarshalIndent(stream, " ", "  ")
-		tx.Model(model.Inbound{}).Where("id = ?", ep.Id).Update("stream_settings", newStream)
+		tx.Model(model.Inbound{}).Where("id = ?", ep.Id).Update("stream_settings", string(newStream))
 	}
 
 	err = tx.Raw(`UPDATE inbounds
 	SET tag = REPLACE(tag, '0.0.0.0:', '')
-	WHERE INSTR(tag, '0.0.0.0:') > 0;`).Error
+	WHERE tag LIKE '%0.0.0.0:%';`).Error
 	if err != nil {
 		return
 	}
@@ -1923,10 +2324,9 @@ func (s *InboundService) MigrationRequirements() {
 func (s *InboundService) MigrateDB() {
 	s.MigrationRequirements()
 	s.MigrationRemoveOrphanedTraffics()
-}
-
-func (s *InboundService) GetOnlineClients() []string {
-	return p.GetOnlineClients()
+	s.MigrationSyncDelayedStarts()
+	s.MigrationDisabledReasons()
+	s.MigrationSniffing()
 }
 
 func (s *InboundService) FilterAndSortClientEmails(emails []string) ([]string, []string, error) {
@@ -1962,3 +2362,31 @@ func (s *InboundService) FilterAndSortClientEmails(emails []string) ([]string, [
 
 	return validEmails, extraEmails, nil
 }
+
+// UnresolvedProxyHosts returns the hosts of the external proxies of inbound
+// that do not resolve, for a warning: the links through them would not
+// connect.
+func (s *InboundService) UnresolvedProxyHosts(inbound *model.Inbound) []string {
+	stream := struct {
+		ExternalProxy []struct {
+			Dest string `json:"dest"`
+		} `json:"externalProxy"`
+	}{}
+	if json.Unmarshal([]byte(inbound.StreamSettings), &stream) != nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var unresolved []string
+	for _, ep := range stream.ExternalProxy {
+		host := strings.Trim(strings.TrimSpace(ep.Dest), "[]")
+		if host == "" || net.ParseIP(host) != nil || slices.Contains(unresolved, host) {
+			continue
+		}
+		if _, err := net.DefaultResolver.LookupHost(ctx, host); err != nil {
+			logger.Warningf("external proxy %s of inbound %s does not resolve: %v", host, inbound.Tag, err)
+			unresolved = append(unresolved, host)
+		}
+	}
+	return unresolved
+}
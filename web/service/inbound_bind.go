@@ -0,0 +1,247 @@
+package service
+
+import (
+	"fmt"
+	"html"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/xray"
+)
+
+// inboundBindError is an inbound Xray goes without because it failed to bind
+// its port, kept for the listen address and the port it failed on.
+type inboundBindError struct {
+	state  model.InboundBindState
+	tag    string
+	listen string
+	port   int
+}
+
+var (
+	bindErrorsMu sync.RWMutex
+	// bindErrors are the inbounds that failed to bind, by id
+	bindErrors = map[int]*inboundBindError{}
+)
+
+// bindErrorOf returns why inbound failed to bind, or nil if it didn't or its
+// address changed since.
+func bindErrorOf(inbound *model.Inbound) *inboundBindError {
+	bindErrorsMu.RLock()
+	defer bindErrorsMu.RUnlock()
+	failed := bindErrors[inbound.Id]
+	if failed == nil || failed.listen != inbound.Listen || failed.port != inbound.Port {
+		return nil
+	}
+	return failed
+}
+
+// setBindError leaves inbound out of the config of Xray for reason. It returns
+// whether the inbound wasn't left out already.
+func setBindError(inbound *model.Inbound, reason string) bool {
+	bindErrorsMu.Lock()
+	failed := bindErrors[inbound.Id]
+	known := failed != nil && failed.listen == inbound.Listen && failed.port == inbound.Port
+	if !known {
+		failed = &inboundBindError{
+			state:  model.InboundBindState{State: model.BindStateError, Since: time.Now().UnixMilli()},
+			tag:    inbound.Tag,
+			listen: inbound.Listen,
+			port:   inbound.Port,
+		}
+		bindErrors[inbound.Id] = failed
+	}
+	failed.state.Reason = reason
+	bindErrorsMu.Unlock()
+	return !known
+}
+
+// reportBindError tells the admins that inbound is left out of the config of
+// Xray for reason.
+func reportBindError(inbound *model.Inbound, reason string) {
+	logger.Warningf("Inbound %s is left out of the config of Xray: %s", inbound.Tag, reason)
+	go new(Tgbot).InboundBindFailed(inbound.Tag, inbound.Port, reason)
+}
+
+func clearBindError(id int) {
+	bindErrorsMu.Lock()
+	delete(bindErrors, id)
+	bindErrorsMu.Unlock()
+}
+
+// setBindStates fills in the BindState of the inbounds that failed to bind.
+func (s *InboundService) setBindStates(inbounds ...*model.Inbound) {
+	for _, inbound := range inbounds {
+		if failed := bindErrorOf(inbound); failed != nil {
+			state := failed.state
+			inbound.BindState = &state
+		}
+	}
+}
+
+// GetBindErrors returns the inbounds Xray goes without because they failed to
+// bind, as "tag: reason".
+func (s *XrayService) GetBindErrors() []string {
+	bindErrorsMu.RLock()
+	defer bindErrorsMu.RUnlock()
+	var failures []string
+	for _, failed := range bindErrors {
+		failures = append(failures, failed.tag+": "+failed.state.Reason)
+	}
+	sort.Strings(failures)
+	return failures
+}
+
+// listenerBindable tells whether no other program listens on the port of
+// listener.
+func listenerBindable(listener xray.InboundListener) bool {
+	host := listener.Listen
+	if net.ParseIP(host) == nil {
+		host = ""
+	}
+	address := net.JoinHostPort(host, strconv.Itoa(listener.Port))
+	if listener.Network == "udp" {
+		pc, err := net.ListenPacket("udp", address)
+		if err != nil {
+			return false
+		}
+		pc.Close()
+		return true
+	}
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return false
+	}
+	l.Close()
+	return true
+}
+
+// runningListeners returns the ports the running Xray listens on by its
+// config, by network.
+func runningListeners() map[string]map[int]bool {
+	owned := map[string]map[int]bool{"tcp": {}, "udp": {}}
+	if p == nil || !p.IsRunning() {
+		return owned
+	}
+	for _, inbound := range p.GetConfig().InboundConfigs {
+		if listener, ok := inbound.Listener(); ok {
+			owned[listener.Network][listener.Port] = true
+		}
+	}
+	return owned
+}
+
+// portConflict returns why inbound can't bind its port, or "" if the port is
+// free or among the owned ones of the running Xray.
+func portConflict(inbound *model.Inbound, owned map[string]map[int]bool) string {
+	listener, ok := inbound.GenXrayInboundConfig().Listener()
+	if !ok || owned[listener.Network][listener.Port] || listenerBindable(listener) {
+		return ""
+	}
+	return fmt.Sprintf("%s port %d is taken by another program", listener.Network, listener.Port)
+}
+
+// leaveOutPortConflicts leaves the enabled inbounds whose port another program
+// listens on out of the config of Xray. It returns whether it left out some.
+func (s *XrayService) leaveOutPortConflicts() bool {
+	inbounds, err := s.inboundService.GetAllInbounds()
+	if err != nil {
+		logger.Warning("Unable to check the ports of the inbounds:", err)
+		return false
+	}
+	// Inbounds that are gone, disabled or moved to another port get checked
+	// afresh
+	current := make(map[int]bool, len(inbounds))
+	for _, inbound := range inbounds {
+		current[inbound.Id] = inbound.Enable && bindErrorOf(inbound) != nil
+	}
+	bindErrorsMu.Lock()
+	for id := range bindErrors {
+		if !current[id] {
+			delete(bindErrors, id)
+		}
+	}
+	bindErrorsMu.Unlock()
+
+	owned := runningListeners()
+	leftOut := false
+	for _, inbound := range inbounds {
+		if !inbound.Enable || current[inbound.Id] {
+			continue
+		}
+		if reason := portConflict(inbound, owned); reason != "" && setBindError(inbound, reason) {
+			reportBindError(inbound, reason)
+			leftOut = true
+		}
+	}
+	return leftOut
+}
+
+// leaveOutFailedInbounds leaves the inbounds of the panel that report names out
+// of the config of Xray and returns them, if Xray had no other problem so that
+// it may run without them.
+func (s *XrayService) leaveOutFailedInbounds(report *XrayRestartReport) []*model.Inbound {
+	if len(report.Inbounds) == 0 || report.APIError != "" {
+		return nil
+	}
+	inbounds, err := s.inboundService.GetAllInbounds()
+	if err != nil {
+		return nil
+	}
+	byTag := make(map[string]*model.Inbound, len(inbounds))
+	for _, inbound := range inbounds {
+		byTag[inbound.Tag] = inbound
+	}
+	for _, failed := range report.Inbounds {
+		if byTag[failed.Tag] == nil {
+			return nil
+		}
+	}
+	leftOut := make([]*model.Inbound, 0, len(report.Inbounds))
+	for _, failed := range report.Inbounds {
+		setBindError(byTag[failed.Tag], failed.Error)
+		leftOut = append(leftOut, byTag[failed.Tag])
+	}
+	return leftOut
+}
+
+// RetryBind checks the port of an inbound that failed to bind again. If it's
+// free, the inbound is back in the config of Xray and RetryBind returns that
+// Xray needs a restart; if not, it returns why.
+func (s *InboundService) RetryBind(id int) (*model.Inbound, bool, error) {
+	inbound, err := s.GetInbound(id)
+	if err != nil {
+		return nil, false, err
+	}
+	if bindErrorOf(inbound) == nil {
+		clearBindError(id)
+		return inbound, false, nil
+	}
+	if reason := portConflict(inbound, runningListeners()); reason != "" {
+		setBindError(inbound, reason)
+		s.setBindStates(inbound)
+		return inbound, false, common.NewErrorf("%s", reason)
+	}
+	clearBindError(id)
+	return inbound, true, nil
+}
+
+// InboundBindFailed tells the admins that an inbound is left out of the
+// config of Xray because it failed to bind its port.
+func (t *Tgbot) InboundBindFailed(tag string, port int, reason string) {
+	if !t.AlertsOn(AlertInbound) {
+		return
+	}
+	msg := t.I18nBot("tgbot.messages.inboundBindFailed",
+		"Inbound=="+html.EscapeString(tag),
+		"Port=="+strconv.Itoa(port))
+	msg += t.I18nBot("tgbot.messages.hostname", "Hostname=="+hostname)
+	msg += t.I18nBot("tgbot.messages.error", "Error=="+html.EscapeString(reason))
+	t.SendAlert(AlertInbound, msg)
+}
@@ -0,0 +1,180 @@
+package service
+
+import (
+	"net"
+	"testing"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/xray"
+)
+
+// bindTestDB opens an empty database with enabled inbounds on tcp ports 20081
+// and 20082 and udp port 20083, and one disabled on 20084. The inbounds that
+// failed to bind are forgotten after the test.
+func bindTestDB(t *testing.T) []*model.Inbound {
+	t.Helper()
+	inbounds := []*model.Inbound{
+		{Remark: "taken", Enable: true, Port: 20081, Protocol: model.Trojan, Tag: "inbound-20081",
+			Settings: `{"clients":[{"password":"a1","email":"a1","enable":true}]}`},
+		{Remark: "free", Enable: true, Port: 20082, Protocol: model.Trojan, Tag: "inbound-20082",
+			Settings: `{"clients":[{"password":"b1","email":"b1","enable":true}]}`},
+		{Remark: "udp", Enable: true, Port: 20083, Protocol: model.WireGuard, Tag: "inbound-20083",
+			Settings: `{"secretKey":"cGFuZWwtdGVzdC1rZXktMDAwMDAwMDAwMDAwMDAwMDA=","peers":[]}`},
+		{Remark: "disabled", Enable: false, Port: 20084, Protocol: model.Trojan, Tag: "inbound-20084",
+			Settings: `{"clients":[{"password":"c1","email":"c1","enable":true}]}`},
+	}
+	newTestDB(t, seedInbounds(inbounds...))
+	t.Cleanup(func() {
+		bindErrorsMu.Lock()
+		bindErrors = map[int]*inboundBindError{}
+		bindErrorsMu.Unlock()
+	})
+	return inbounds
+}
+
+// takePort listens on port of network, as another program would, until the
+// returned function is called or the test ends.
+func takePort(t *testing.T, network string, port string) func() {
+	t.Helper()
+	var conflict interface{ Close() error }
+	var err error
+	if network == "udp" {
+		conflict, err = net.ListenPacket("udp", ":"+port)
+	} else {
+		conflict, err = net.Listen("tcp", ":"+port)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conflict.Close() })
+	return func() { conflict.Close() }
+}
+
+// configTags returns the tags of the inbounds in the config of Xray.
+func configTags(t *testing.T) map[string]bool {
+	t.Helper()
+	config, err := (&XrayService{}).GetXrayConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := map[string]bool{}
+	for _, inbound := range config.InboundConfigs {
+		tags[inbound.Tag] = true
+	}
+	return tags
+}
+
+func TestPortConflictsLeftOut(t *testing.T) {
+	inbounds := bindTestDB(t)
+	takePort(t, "tcp", "20081")
+	takePort(t, "udp", "20083")
+	// Taken, a disabled inbound isn't in the config anyway
+	takePort(t, "tcp", "20084")
+	var s XrayService
+	if !s.leaveOutPortConflicts() {
+		t.Fatal("no inbound was left out")
+	}
+
+	// Only the conflicting inbounds are left out, the rest runs
+	tags := configTags(t)
+	if tags["inbound-20081"] || tags["inbound-20083"] || tags["inbound-20084"] || !tags["inbound-20082"] {
+		t.Errorf("the config has the inbounds %v", tags)
+	}
+	failures := s.GetBindErrors()
+	want := []string{"inbound-20081: tcp port 20081 is taken by another program", "inbound-20083: udp port 20083 is taken by another program"}
+	if len(failures) != len(want) || failures[0] != want[0] || failures[1] != want[1] {
+		t.Errorf("the bind errors are %q, want %q", failures, want)
+	}
+	listed, err := s.inboundService.GetInbounds(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, inbound := range listed {
+		failed := inbound.Port == 20081 || inbound.Port == 20083
+		if failed != (inbound.BindState != nil) {
+			t.Errorf("%s is listed with the bind state %+v", inbound.Tag, inbound.BindState)
+		} else if failed && (inbound.BindState.State != model.BindStateError || inbound.BindState.Since == 0 || inbound.BindState.Reason == "") {
+			t.Errorf("%s has the bind state %+v", inbound.Tag, inbound.BindState)
+		}
+	}
+
+	// Checked again, the inbounds already left out aren't reported twice
+	if s.leaveOutPortConflicts() {
+		t.Error("the inbounds were left out twice")
+	}
+
+	// Moved to another port, an inbound is checked afresh
+	inbounds[0].Port = 20085
+	if err := database.GetDB().Save(inbounds[0]).Error; err != nil {
+		t.Fatal(err)
+	}
+	if bindErrorOf(inbounds[0]) != nil {
+		t.Error("the moved inbound has the bind error of its old port")
+	}
+	s.leaveOutPortConflicts()
+	if tags := configTags(t); !tags["inbound-20081"] {
+		t.Errorf("the moved inbound isn't back in the config: %v", tags)
+	}
+}
+
+func TestRetryBind(t *testing.T) {
+	inbounds := bindTestDB(t)
+	free := takePort(t, "tcp", "20081")
+	var s XrayService
+	s.leaveOutPortConflicts()
+	id := inbounds[0].Id
+
+	// Still taken, the inbound stays out with the reason
+	inbound, needRestart, err := s.inboundService.RetryBind(id)
+	if err == nil || needRestart || inbound.BindState == nil || inbound.BindState.Reason != err.Error() {
+		t.Errorf("the retry of a taken port gave %+v, %v, %v", inbound.BindState, needRestart, err)
+	}
+	if configTags(t)["inbound-20081"] {
+		t.Error("the inbound whose port is still taken is in the config")
+	}
+
+	// Once the port is free, it is back
+	free()
+	inbound, needRestart, err = s.inboundService.RetryBind(id)
+	if err != nil || !needRestart || inbound.BindState != nil {
+		t.Errorf("the retry of a free port gave %+v, %v, %v", inbound.BindState, needRestart, err)
+	}
+	if !configTags(t)["inbound-20081"] || len(s.GetBindErrors()) != 0 {
+		t.Errorf("the inbound isn't back in the config, bind errors %q", s.GetBindErrors())
+	}
+	// An inbound that didn't fail needs no restart
+	if _, needRestart, err := s.inboundService.RetryBind(inbounds[1].Id); err != nil || needRestart {
+		t.Errorf("the retry of a bound inbound gave %v, %v", needRestart, err)
+	}
+}
+
+func TestLeaveOutFailedInbounds(t *testing.T) {
+	bindTestDB(t)
+	var s XrayService
+	failed := func(tag string, port int) InboundHealth {
+		return InboundHealth{InboundListener: xray.InboundListener{Tag: tag, Port: port, Network: "tcp"}, Error: "not listening"}
+	}
+
+	// Not if Xray had another problem, or with inbounds that aren't the panel's
+	if leftOut := s.leaveOutFailedInbounds(&XrayRestartReport{Inbounds: []InboundHealth{failed("inbound-20081", 20081)}, APIError: "timeout"}); leftOut != nil {
+		t.Errorf("left out %d inbounds of an Xray whose API fails", len(leftOut))
+	}
+	if leftOut := s.leaveOutFailedInbounds(&XrayRestartReport{Inbounds: []InboundHealth{failed("inbound-20081", 20081), failed("socks-in", 1080)}}); leftOut != nil {
+		t.Errorf("left out %d inbounds with one of the template", len(leftOut))
+	}
+	if len(s.GetBindErrors()) != 0 {
+		t.Errorf("the bind errors are %q", s.GetBindErrors())
+	}
+
+	leftOut := s.leaveOutFailedInbounds(&XrayRestartReport{Inbounds: []InboundHealth{failed("inbound-20081", 20081)}})
+	if len(leftOut) != 1 || leftOut[0].Tag != "inbound-20081" {
+		t.Fatalf("left out %v", leftOut)
+	}
+	if tags := configTags(t); tags["inbound-20081"] || !tags["inbound-20082"] || !tags["inbound-20083"] {
+		t.Errorf("the config has the inbounds %v", tags)
+	}
+	if failures := s.GetBindErrors(); len(failures) != 1 || failures[0] != "inbound-20081: not listening" {
+		t.Errorf("the bind errors are %q", failures)
+	}
+}
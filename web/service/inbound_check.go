@@ -0,0 +1,411 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"html"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"x-ui/config"
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/util/common"
+
+	"github.com/goccy/go-json"
+)
+
+// The steps of the reachability check of an inbound
+const (
+	InboundCheckListen = "listen"
+	InboundCheckTcp    = "tcp"
+	InboundCheckTls    = "tls"
+)
+
+const (
+	// inboundCheckWorkers is how many inbounds the scheduled checks check at once
+	inboundCheckWorkers = 8
+	// MaxInboundCheckTimeout bounds each step of a check
+	MaxInboundCheckTimeout = 30 * time.Second
+	// proberReplyLimit bounds the replies of the prober
+	proberReplyLimit = 64 << 10
+)
+
+// InboundCheckStep is the result of a step of the check of an inbound, with
+// its latency in milliseconds.
+type InboundCheckStep struct {
+	Step    string `json:"step"`
+	Ok      bool   `json:"ok"`
+	Latency int64  `json:"latency"`
+	Error   string `json:"error,omitempty"`
+}
+
+// InboundCheck is the reachability check of an inbound: whether Xray listens
+// on its port, and whether the prober could connect to it from outside and, for
+// TLS and Reality, finish a handshake. The external steps are left out when no
+// prober is set.
+type InboundCheck struct {
+	InboundId int                `json:"inboundId"`
+	Tag       string             `json:"tag"`
+	Port      int                `json:"port"`
+	Host      string             `json:"host,omitempty"`
+	Prober    string             `json:"prober,omitempty"`
+	Steps     []InboundCheckStep `json:"steps"`
+	Reachable bool               `json:"reachable"`
+	CheckedAt int64              `json:"checkedAt"`
+}
+
+// ProbeRequest is what is sent to the prober: where to connect to and the
+// server name of the handshake, never anything of the clients. An empty Host
+// is the address the request came from.
+type ProbeRequest struct {
+	Host       string `json:"host" form:"host"`
+	Port       int    `json:"port" form:"port"`
+	Tls        bool   `json:"tls" form:"tls"`
+	ServerName string `json:"serverName" form:"serverName"`
+	Timeout    int    `json:"timeout" form:"timeout"`
+}
+
+// ProbeResult is the reply of the prober, the TLS step only when asked for.
+type ProbeResult struct {
+	Host string            `json:"host"`
+	Tcp  InboundCheckStep  `json:"tcp"`
+	Tls  *InboundCheckStep `json:"tls,omitempty"`
+}
+
+// InboundCheckUnreachable is an inbound that passed its last scheduled check
+// and failed this one.
+type InboundCheckUnreachable struct {
+	Check *InboundCheck
+	Step  InboundCheckStep
+}
+
+var (
+	// inboundCheckMu keeps the scheduled checks from overlapping
+	inboundCheckMu sync.Mutex
+	// inboundReachable is whether the inbounds passed their last scheduled check
+	inboundReachable = map[int]bool{}
+)
+
+// Probe connects to the host and port of req, and makes a TLS handshake after if
+// it asks for one. It is what a panel does as the prober of another.
+func Probe(req *ProbeRequest) (*ProbeResult, error) {
+	if req.Host == "" || req.Port < 1 || req.Port > 65535 {
+		return nil, common.NewError("the probe needs a host and a port")
+	}
+	timeout := time.Duration(req.Timeout) * time.Second
+	if timeout <= 0 || timeout > MaxInboundCheckTimeout {
+		timeout = 5 * time.Second
+	}
+	result := &ProbeResult{Host: req.Host, Tcp: InboundCheckStep{Step: InboundCheckTcp}}
+	address := net.JoinHostPort(req.Host, strconv.Itoa(req.Port))
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		result.Tcp.Error = err.Error()
+		return result, nil
+	}
+	defer conn.Close()
+	result.Tcp.Ok, result.Tcp.Latency = true, time.Since(start).Milliseconds()
+	if !req.Tls {
+		return result, nil
+	}
+
+	result.Tls = &InboundCheckStep{Step: InboundCheckTls}
+	conn.SetDeadline(time.Now().Add(timeout))
+	// Only whether the handshake finishes is checked, not the certificate: a
+	// Reality inbound answers with the one of its dest
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: req.ServerName, InsecureSkipVerify: true})
+	start = time.Now()
+	if err := tlsConn.Handshake(); err != nil {
+		result.Tls.Error = err.Error()
+		return result, nil
+	}
+	result.Tls.Ok, result.Tls.Latency = true, time.Since(start).Milliseconds()
+	return result, nil
+}
+
+// inboundCheckConfig are the settings of the checks.
+type inboundCheckConfig struct {
+	prober  *url.URL
+	token   string
+	host    string
+	timeout time.Duration
+}
+
+func (s *InboundService) inboundCheckConfig() (*inboundCheckConfig, error) {
+	checkConfig := &inboundCheckConfig{timeout: 5 * time.Second}
+	if seconds, err := s.settingService.GetInboundCheckTimeout(); err == nil && seconds > 0 {
+		checkConfig.timeout = min(time.Duration(seconds)*time.Second, MaxInboundCheckTimeout)
+	}
+	// Without a host the prober connects to the domain of the panel, or without
+	// one to where it sees the probe come from
+	checkConfig.host, _ = s.settingService.GetInboundCheckHost()
+	if checkConfig.host == "" {
+		checkConfig.host, _ = s.settingService.GetWebDomain()
+	}
+	proberUrl, err := s.settingService.GetInboundCheckProberUrl()
+	if err != nil || proberUrl == "" {
+		return checkConfig, err
+	}
+	if checkConfig.prober, err = url.Parse(proberUrl); err != nil {
+		return nil, common.NewErrorf("the prober URL is not valid: %v", err)
+	}
+	checkConfig.token, _ = s.settingService.GetInboundCheckProberToken()
+	return checkConfig, nil
+}
+
+// CheckInbound checks whether the inbound listens and, with a prober set,
+// whether it is reachable from outside at host, the host of the settings if
+// empty.
+func (s *InboundService) CheckInbound(id int, host string) (*InboundCheck, error) {
+	inbound, err := s.GetInbound(id)
+	if err != nil {
+		return nil, err
+	}
+	checkConfig, err := s.inboundCheckConfig()
+	if err != nil {
+		return nil, err
+	}
+	if host = strings.TrimSpace(host); host != "" {
+		checkConfig.host = host
+	}
+	return checkConfig.check(inbound), nil
+}
+
+// check runs the steps of the check of inbound, the external ones only if it
+// listens.
+func (c *inboundCheckConfig) check(inbound *model.Inbound) *InboundCheck {
+	check := &InboundCheck{
+		InboundId: inbound.Id,
+		Tag:       inbound.Tag,
+		Port:      inbound.Port,
+		CheckedAt: time.Now().UnixMilli(),
+	}
+	listen := checkListen(inbound)
+	check.Steps = append(check.Steps, listen)
+	check.Reachable = listen.Ok
+	if c.prober == nil || !listen.Ok {
+		return check
+	}
+	check.Prober = c.prober.Host
+	if inboundOverUDP(inbound) {
+		check.Steps = append(check.Steps, InboundCheckStep{Step: InboundCheckTcp, Error: "the inbound listens on UDP only, it can't be probed"})
+		check.Reachable = false
+		return check
+	}
+	req := &ProbeRequest{Host: c.host, Port: inbound.Port, Timeout: int(c.timeout / time.Second)}
+	req.Tls, req.ServerName = inboundServerName(inbound)
+	result, err := c.probe(req)
+	if err != nil {
+		check.Steps = append(check.Steps, InboundCheckStep{Step: InboundCheckTcp, Error: err.Error()})
+		check.Reachable = false
+		return check
+	}
+	check.Host = result.Host
+	check.Steps = append(check.Steps, result.Tcp)
+	check.Reachable = result.Tcp.Ok
+	if result.Tls != nil {
+		check.Steps = append(check.Steps, *result.Tls)
+		check.Reachable = check.Reachable && result.Tls.Ok
+	}
+	return check
+}
+
+// checkListen tells whether Xray listens on the port of inbound: a TCP inbound
+// is dialed, the port of a UDP one must be taken.
+func checkListen(inbound *model.Inbound) InboundCheckStep {
+	step := InboundCheckStep{Step: InboundCheckListen}
+	if p == nil || !p.IsRunning() {
+		step.Error = "Xray is not running"
+		return step
+	}
+	if !inbound.Enable {
+		step.Error = "the inbound is disabled"
+		return step
+	}
+	if !inboundOverUDP(inbound) {
+		latency, ok := probeInbound(inbound)
+		if !ok {
+			step.Error = "nothing accepts connections on the port"
+			return step
+		}
+		step.Ok, step.Latency = true, *latency
+		return step
+	}
+	host := inbound.Listen
+	if net.ParseIP(host) == nil {
+		host = ""
+	}
+	conn, err := net.ListenPacket("udp", net.JoinHostPort(host, strconv.Itoa(inbound.Port)))
+	if err == nil {
+		conn.Close()
+		step.Error = "nothing is bound to the UDP port"
+		return step
+	}
+	if !errors.Is(err, syscall.EADDRINUSE) {
+		step.Error = err.Error()
+		return step
+	}
+	step.Ok = true
+	return step
+}
+
+// inboundServerName tells whether the inbound uses TLS or Reality, and the
+// server name for a handshake with it: the one of its TLS settings, or the first
+// of the server names of Reality. None of its keys or short ids go to the
+// prober.
+func inboundServerName(inbound *model.Inbound) (bool, string) {
+	if _, serverNames, ok := realityDestOf(inbound.StreamSettings); ok {
+		if len(serverNames) > 0 {
+			return true, serverNames[0]
+		}
+		return true, ""
+	}
+	var stream struct {
+		Security    string `json:"security"`
+		TlsSettings struct {
+			ServerName string `json:"serverName"`
+		} `json:"tlsSettings"`
+	}
+	if json.Unmarshal([]byte(inbound.StreamSettings), &stream) != nil || stream.Security != "tls" {
+		return false, ""
+	}
+	return true, stream.TlsSettings.ServerName
+}
+
+// probe sends req to the prober, with its token if there is one. The prober
+// replies with a ProbeResult, as the data of a reply of the panel or as it is.
+func (c *inboundCheckConfig) probe(req *ProbeRequest) (*ProbeResult, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	// The TCP and the TLS steps may each take the timeout
+	ctx, cancel := context.WithTimeout(context.Background(), 2*c.timeout+5*time.Second)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, c.prober.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Accept", "application/json")
+	request.Header.Set("User-Agent", "3x-ui/"+config.GetVersion())
+	if c.token != "" {
+		request.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, common.NewErrorf("the prober is unreachable: %v", err)
+	}
+	defer response.Body.Close()
+	reply, err := io.ReadAll(io.LimitReader(response.Body, proberReplyLimit))
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, common.NewErrorf("the prober replied with %s", response.Status)
+	}
+	var message struct {
+		Success *bool           `json:"success"`
+		Msg     string          `json:"msg"`
+		Obj     json.RawMessage `json:"obj"`
+	}
+	if err := json.Unmarshal(reply, &message); err != nil {
+		return nil, common.NewErrorf("the reply of the prober is not valid: %v", err)
+	}
+	if message.Success != nil {
+		if !*message.Success {
+			return nil, common.NewErrorf("the prober refused the probe: %s", message.Msg)
+		}
+		reply = message.Obj
+	}
+	result := &ProbeResult{}
+	if err := json.Unmarshal(reply, result); err != nil {
+		return nil, common.NewErrorf("the reply of the prober is not valid: %v", err)
+	}
+	result.Tcp.Step = InboundCheckTcp
+	if result.Tls != nil {
+		result.Tls.Step = InboundCheckTls
+	}
+	return result, nil
+}
+
+// CheckInbounds checks the enabled inbounds, and returns those that passed
+// their last check and fail this one. The first check of an inbound only
+// records whether it is reachable.
+func (s *InboundService) CheckInbounds() ([]InboundCheckUnreachable, error) {
+	if !inboundCheckMu.TryLock() {
+		return nil, nil
+	}
+	defer inboundCheckMu.Unlock()
+
+	checkConfig, err := s.inboundCheckConfig()
+	if err != nil {
+		return nil, err
+	}
+	var inbounds []*model.Inbound
+	err = database.GetDB().Model(model.Inbound{}).Where("enable = ?", true).Order("id").Find(&inbounds).Error
+	if err != nil {
+		return nil, err
+	}
+
+	checks := make([]*InboundCheck, len(inbounds))
+	workers := make(chan struct{}, inboundCheckWorkers)
+	var wg sync.WaitGroup
+	for i, inbound := range inbounds {
+		wg.Add(1)
+		workers <- struct{}{}
+		go func() {
+			defer func() {
+				<-workers
+				wg.Done()
+			}()
+			checks[i] = checkConfig.check(inbound)
+		}()
+	}
+	wg.Wait()
+
+	var unreachable []InboundCheckUnreachable
+	previous := inboundReachable
+	inboundReachable = make(map[int]bool, len(checks))
+	for _, check := range checks {
+		inboundReachable[check.InboundId] = check.Reachable
+		if check.Reachable || !previous[check.InboundId] {
+			continue
+		}
+		failed := InboundCheckUnreachable{Check: check}
+		for _, step := range check.Steps {
+			if !step.Ok {
+				failed.Step = step
+				break
+			}
+		}
+		unreachable = append(unreachable, failed)
+	}
+	return unreachable, nil
+}
+
+// InboundUnreachable tells the admins that an inbound that was reachable failed
+// a step of its check.
+func (t *Tgbot) InboundUnreachable(failed InboundCheckUnreachable) {
+	if !t.AlertsOn(AlertInbound) {
+		return
+	}
+	msg := t.I18nBot("tgbot.messages.inboundUnreachable",
+		"Inbound=="+html.EscapeString(failed.Check.Tag),
+		"Port=="+strconv.Itoa(failed.Check.Port),
+		"Step=="+failed.Step.Step)
+	msg += t.I18nBot("tgbot.messages.hostname", "Hostname=="+hostname)
+	msg += t.I18nBot("tgbot.messages.error", "Error=="+html.EscapeString(failed.Step.Error))
+	t.SendAlert(AlertInbound, msg)
+}
@@ -0,0 +1,269 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strconv"
+
+	"x-ui/database/model"
+	"x-ui/util/common"
+	"x-ui/web/locale"
+
+	"github.com/goccy/go-json"
+	"github.com/google/uuid"
+)
+
+// InboundClone holds the options for cloning an inbound.
+type InboundClone struct {
+	// Port of the clone, 0 to pick the first free port after the source
+	Port int `json:"port" form:"port"`
+	// Clients copies the clients, with the port appended to their emails
+	Clients bool `json:"clients" form:"clients"`
+	// KeepIds keeps the UUIDs and passwords of the copied clients, and the
+	// WireGuard keys of the inbound and its peers
+	KeepIds bool `json:"keepIds" form:"keepIds"`
+	// KeepSubIds keeps the subscriptions of the copied clients, so they get
+	// both inbounds
+	KeepSubIds bool `json:"keepSubIds" form:"keepSubIds"`
+	// NewReality generates a new Reality key pair and short IDs
+	NewReality bool `json:"newReality" form:"newReality"`
+	// RemarkSuffix is appended to the remark, " (copy)" if empty
+	RemarkSuffix string `json:"remarkSuffix" form:"remarkSuffix"`
+}
+
+// InboundTag returns the tag the panel gives an inbound on listen and port.
+func InboundTag(listen string, port int) string {
+	if listen == "" || listen == "0.0.0.0" || listen == "::" || listen == "::0" {
+		return fmt.Sprintf("inbound-%v", port)
+	}
+	return fmt.Sprintf("inbound-%v:%v", listen, port)
+}
+
+// randomShortIds returns Reality short IDs of all lengths, like the panel does.
+func randomShortIds() []string {
+	lengths := []int{2, 4, 6, 8, 10, 12, 14, 16}
+	for i := len(lengths) - 1; i > 0; i-- {
+		j, _ := rand.Int(rand.Reader, big.NewInt(int64(i+1)))
+		lengths[i], lengths[j.Int64()] = lengths[j.Int64()], lengths[i]
+	}
+	shortIds := make([]string, len(lengths))
+	for i, length := range lengths {
+		id := make([]byte, length/2)
+		rand.Read(id)
+		shortIds[i] = hex.EncodeToString(id)
+	}
+	return shortIds
+}
+
+// panelPortIn tells whether the panel or the subscription server listens on a
+// port from start to end.
+func (s *InboundService) panelPortIn(start int, end int) (bool, error) {
+	for _, get := range []func() (int, error){s.settingService.GetPort, s.settingService.GetSubPort} {
+		used, err := get()
+		if err != nil {
+			return false, err
+		}
+		if used >= start && used <= end {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// portTaken tells whether a port from start to end is used by an inbound or by
+// the panel or subscription server.
+func (s *InboundService) portTaken(listen string, start int, end int) (bool, error) {
+	if used, err := s.panelPortIn(start, end); err != nil || used {
+		return used, err
+	}
+	return s.checkPortExist(listen, start, end, 0)
+}
+
+// freePort returns the first port after start that, with the width ports after
+// it, is neither taken nor bound by another program.
+func (s *InboundService) freePort(listen string, start int, width int) (int, error) {
+	for port := start + 1; port+width <= 65535; port++ {
+		taken, err := s.portTaken(listen, port, port+width)
+		if err != nil {
+			return 0, err
+		}
+		if taken {
+			continue
+		}
+		bindable := true
+		for p := port; p <= port+width && bindable; p++ {
+			bindable = portBindable(listen, p)
+		}
+		if bindable {
+			return port, nil
+		}
+	}
+	return 0, common.NewError("no free port after", start)
+}
+
+// cloneClients gives the clients of settings new emails and, unless kept, new
+// credentials and subscriptions, or drops them.
+func (opts *InboundClone) cloneClients(protocol model.Protocol, settings map[string]any, port int) {
+	clients, ok := settings["clients"].([]any)
+	if !ok {
+		return
+	}
+	if !opts.Clients {
+		settings["clients"] = []any{}
+		return
+	}
+	method, _ := settings["method"].(string)
+	for _, item := range clients {
+		client, ok := item.(map[string]any)
+		if !ok {
+			continue
+		}
+		email, _ := client["email"].(string)
+		client["email"] = fmt.Sprintf("%s-%d", email, port)
+		if !opts.KeepIds {
+			switch protocol {
+			case model.VMESS, model.VLESS:
+				client["id"] = uuid.New().String()
+			case model.Trojan:
+				client["password"] = randomLowerAndNum(10)
+			case model.Shadowsocks:
+				client["password"] = randomShadowsocksPassword(method)
+			}
+		}
+		if !opts.KeepSubIds {
+			client["subId"] = randomLowerAndNum(16)
+		}
+	}
+}
+
+// newReality gives the Reality settings of stream a new key pair and short IDs.
+func newReality(stream map[string]any) error {
+	reality, ok := stream["realitySettings"].(map[string]any)
+	if !ok {
+		return nil
+	}
+	privateKey, publicKey, err := newRealityKeyPair()
+	if err != nil {
+		return err
+	}
+	reality["privateKey"] = privateKey
+	reality["shortIds"] = randomShortIds()
+	settings, _ := reality["settings"].(map[string]any)
+	if settings == nil {
+		settings = map[string]any{}
+		reality["settings"] = settings
+	}
+	settings["publicKey"] = publicKey
+
+	if seed, _ := reality["mldsa65Seed"].(string); seed != "" {
+		var server ServerService
+		cert, err := server.GetNewmldsa65()
+		if err != nil {
+			return err
+		}
+		keys := cert.(map[string]any)
+		reality["mldsa65Seed"] = keys["seed"]
+		settings["mldsa65Verify"] = keys["verify"]
+	}
+	return nil
+}
+
+// CloneInbound adds a copy of an inbound on another port, owned by userId, and
+// returns it. It returns whether Xray has to be restarted for the clone.
+func (s *InboundService) CloneInbound(id int, opts *InboundClone, userId int) (*model.Inbound, bool, error) {
+	source, err := s.GetInbound(id)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// A port range is cloned with as many ports
+	start, end := source.PortRange()
+	width := end - start
+	port := opts.Port
+	if port == 0 {
+		if port, err = s.freePort(source.Listen, source.Port, width); err != nil {
+			return nil, false, err
+		}
+	} else if port < 1 || port+width > 65535 {
+		return nil, false, common.NewError("invalid port:", port)
+	} else if taken, err := s.portTaken(source.Listen, port, port+width); err != nil {
+		return nil, false, err
+	} else if taken {
+		return nil, false, locale.NewError(locale.ErrInboundPortInUse, "Port=="+strconv.Itoa(port))
+	}
+	portEnd := 0
+	if width > 0 {
+		portEnd = port + width
+	}
+
+	var settings map[string]any
+	if err := json.Unmarshal([]byte(source.Settings), &settings); err != nil {
+		return nil, false, err
+	}
+	if source.Protocol == model.WireGuard {
+		legacyWireguardPeers(settings)
+		if !opts.KeepIds {
+			if err := regenerateWireguardKeys(settings); err != nil {
+				return nil, false, err
+			}
+		}
+	}
+	opts.cloneClients(source.Protocol, settings, port)
+	if source.Protocol == model.Shadowsocks && !opts.KeepIds {
+		if password, _ := settings["password"].(string); password != "" {
+			method, _ := settings["method"].(string)
+			settings["password"] = randomShadowsocksPassword(method)
+		}
+	}
+	newSettings, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return nil, false, err
+	}
+
+	streamSettings := source.StreamSettings
+	if opts.NewReality && streamSettings != "" {
+		var stream map[string]any
+		if err := json.Unmarshal([]byte(streamSettings), &stream); err != nil {
+			return nil, false, err
+		}
+		if err := newReality(stream); err != nil {
+			return nil, false, err
+		}
+		newStream, err := json.MarshalIndent(stream, "", "  ")
+		if err != nil {
+			return nil, false, err
+		}
+		streamSettings = string(newStream)
+	}
+
+	suffix := opts.RemarkSuffix
+	if suffix == "" {
+		suffix = " (copy)"
+	}
+	clone := &model.Inbound{
+		UserId:             userId,
+		Total:              source.Total,
+		Remark:             source.Remark + suffix,
+		RemarkTemplate:     source.RemarkTemplate,
+		SubIncludeDisabled: source.SubIncludeDisabled,
+		ClientDefaults:     source.ClientDefaults,
+		Enable:             source.Enable,
+		ExpiryTime:         source.ExpiryTime,
+		Listen:             source.Listen,
+		Port:               port,
+		PortEnd:            portEnd,
+		Protocol:           source.Protocol,
+		Settings:           string(newSettings),
+		StreamSettings:     streamSettings,
+		Tag:                InboundTag(source.Listen, port),
+		Sniffing:           source.Sniffing,
+		Allocate:           source.Allocate,
+	}
+	clone, needRestart, err := s.AddInbound(clone)
+	if err != nil {
+		return nil, false, err
+	}
+	return clone, needRestart, nil
+}
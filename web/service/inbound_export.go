@@ -0,0 +1,405 @@
+package service
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/util/common"
+	"x-ui/web/locale"
+	"x-ui/xray"
+
+	"github.com/goccy/go-json"
+)
+
+// InboundExportVersion is the version of the inbound export format. Raise it
+// on incompatible changes and add a step to inboundExportUpgrades, so that
+// older files can still be imported.
+const InboundExportVersion = 1
+
+// inboundExportUpgrades turn a document of the version they are keyed by into
+// one of the next version.
+var inboundExportUpgrades = map[int]func(doc map[string]any) error{}
+
+const (
+	InboundConflictFail        = "fail"
+	InboundConflictRename      = "rename"
+	InboundConflictSkipClients = "skip-clients"
+)
+
+// InboundExport is a single inbound as a portable document. The JSON columns are
+// embedded as objects so the file stays readable.
+type InboundExport struct {
+	Version    int                  `json:"version"`
+	ExportedAt int64                `json:"exportedAt"`
+	Inbound    InboundExportInbound `json:"inbound"`
+	// ClientStats are the traffic counters of the clients, left out if the
+	// traffic is stripped
+	ClientStats []InboundExportTraffic `json:"clientStats,omitempty"`
+}
+
+type InboundExportInbound struct {
+	Remark             string             `json:"remark"`
+	RemarkTemplate     string             `json:"remarkTemplate,omitempty"`
+	SubIncludeDisabled string             `json:"subIncludeDisabled,omitempty"`
+	ClientDefaults     *model.LinkOptions `json:"clientDefaults,omitempty"`
+	Enable             bool               `json:"enable"`
+	Up                 int64              `json:"up"`
+	Down               int64              `json:"down"`
+	Total              int64              `json:"total"`
+	ExpiryTime         int64              `json:"expiryTime"`
+	Listen             string             `json:"listen"`
+	Port               int                `json:"port"`
+	PortEnd            int                `json:"portEnd,omitempty"`
+	Protocol           model.Protocol     `json:"protocol"`
+	Settings           json.RawMessage    `json:"settings"`
+	StreamSettings     json.RawMessage    `json:"streamSettings,omitempty"`
+	Sniffing           json.RawMessage    `json:"sniffing,omitempty"`
+	Allocate           json.RawMessage    `json:"allocate,omitempty"`
+}
+
+type InboundExportTraffic struct {
+	Email      string `json:"email"`
+	Enable     bool   `json:"enable"`
+	Up         int64  `json:"up"`
+	Down       int64  `json:"down"`
+	Total      int64  `json:"total"`
+	ExpiryTime int64  `json:"expiryTime"`
+	Reset      int    `json:"reset"`
+	// CarriedOver is the part of Total carried over from the last period
+	CarriedOver int64 `json:"carriedOver,omitempty"`
+}
+
+// InboundImportResult tells how an imported inbound was changed to fit in.
+type InboundImportResult struct {
+	Inbound *model.Inbound `json:"inbound"`
+	// Port is the port the document asked for, if it had to be changed
+	Port int `json:"port,omitempty"`
+	// Renamed maps the emails of renamed clients to their new ones
+	Renamed map[string]string `json:"renamed,omitempty"`
+	// Skipped are the emails of clients left out
+	Skipped []string `json:"skipped,omitempty"`
+}
+
+func rawJSON(value string) json.RawMessage {
+	if strings.TrimSpace(value) == "" {
+		return nil
+	}
+	return json.RawMessage(value)
+}
+
+// ExportInbound returns an inbound as a portable document, without the traffic
+// counters if stripTraffic is set.
+func (s *InboundService) ExportInbound(id int, stripTraffic bool) (*InboundExport, error) {
+	inbound, err := s.GetInbound(id)
+	if err != nil {
+		return nil, err
+	}
+	doc := &InboundExport{
+		Version:    InboundExportVersion,
+		ExportedAt: time.Now().UnixMilli(),
+		Inbound: InboundExportInbound{
+			Remark:             inbound.Remark,
+			RemarkTemplate:     inbound.RemarkTemplate,
+			SubIncludeDisabled: inbound.SubIncludeDisabled,
+			ClientDefaults:     inbound.ClientDefaults,
+			Enable:             inbound.Enable,
+			Total:              inbound.Total,
+			ExpiryTime:         inbound.ExpiryTime,
+			Listen:             inbound.Listen,
+			Port:               inbound.Port,
+			PortEnd:            inbound.PortEnd,
+			Protocol:           inbound.Protocol,
+			Settings:           rawJSON(inbound.Settings),
+			StreamSettings:     rawJSON(inbound.StreamSettings),
+			Sniffing:           rawJSON(inbound.Sniffing),
+			Allocate:           rawJSON(inbound.Allocate),
+		},
+	}
+	if stripTraffic {
+		return doc, nil
+	}
+	doc.Inbound.Up, doc.Inbound.Down = inbound.Up, inbound.Down
+
+	var traffics []xray.ClientTraffic
+	if err := database.GetDB().Where("inbound_id = ?", id).Order("id").Find(&traffics).Error; err != nil {
+		return nil, err
+	}
+	for _, traffic := range traffics {
+		doc.ClientStats = append(doc.ClientStats, InboundExportTraffic{
+			Email:       traffic.Email,
+			Enable:      traffic.Enable,
+			Up:          traffic.Up,
+			Down:        traffic.Down,
+			Total:       traffic.Total,
+			ExpiryTime:  traffic.ExpiryTime,
+			Reset:       traffic.Reset,
+			CarriedOver: traffic.CarriedOver,
+		})
+	}
+	return doc, nil
+}
+
+// parseInboundExport reads a document of any version and upgrades it to the
+// current one.
+func parseInboundExport(data []byte) (*InboundExport, error) {
+	var raw map[string]any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, common.NewError("invalid inbound export:", err)
+	}
+	version := int(jsonInt64(raw["version"]))
+	if version < 1 {
+		return nil, common.NewError("the inbound export has no version")
+	}
+	if version > InboundExportVersion {
+		return nil, common.NewErrorf("the inbound export has version %d, this panel reads up to %d", version, InboundExportVersion)
+	}
+	for ; version < InboundExportVersion; version++ {
+		if err := inboundExportUpgrades[version](raw); err != nil {
+			return nil, err
+		}
+	}
+	raw["version"] = version
+	if upgraded, err := json.Marshal(raw); err == nil {
+		data = upgraded
+	}
+
+	doc := &InboundExport{}
+	if err := json.Unmarshal(data, doc); err != nil {
+		return nil, common.NewError("invalid inbound export:", err)
+	}
+	return doc, nil
+}
+
+func (doc *InboundExport) validate() error {
+	in := &doc.Inbound
+	switch in.Protocol {
+	case model.VMESS, model.VLESS, model.Trojan, model.Shadowsocks, model.DOKODEMO,
+		model.Socks, model.HTTP, model.WireGuard:
+	default:
+		return common.NewError("unknown protocol:", in.Protocol)
+	}
+	if in.Port < 1 || in.Port > 65535 {
+		return common.NewError("invalid port:", in.Port)
+	}
+	if in.PortEnd != 0 && (in.PortEnd <= in.Port || in.PortEnd > 65535) {
+		return common.NewErrorf("invalid port range %d-%d", in.Port, in.PortEnd)
+	}
+	for name, value := range map[string]json.RawMessage{
+		"settings":       in.Settings,
+		"streamSettings": in.StreamSettings,
+		"sniffing":       in.Sniffing,
+		"allocate":       in.Allocate,
+	} {
+		if value == nil && name != "settings" {
+			continue
+		}
+		var object map[string]any
+		if err := json.Unmarshal(value, &object); err != nil || object == nil {
+			return common.NewErrorf("%s must be an object", name)
+		}
+	}
+
+	settings := map[string][]model.Client{}
+	json.Unmarshal(in.Settings, &settings)
+	emails := map[string]bool{}
+	for _, client := range settings["clients"] {
+		email := strings.ToLower(client.Email)
+		if email == "" {
+			return common.NewError("a client has no email")
+		}
+		if emails[email] {
+			return common.NewError("duplicate client email:", client.Email)
+		}
+		emails[email] = true
+	}
+	return nil
+}
+
+// tagTaken tells whether an inbound uses tag already.
+func (s *InboundService) tagTaken(tag string) (bool, error) {
+	var count int64
+	err := database.GetDB().Model(model.Inbound{}).Where("tag = ?", tag).Count(&count).Error
+	return count > 0, err
+}
+
+// ImportInbound creates an inbound, owned by userId, from an exported document.
+// On conflicts with existing ports, tags or client emails it fails, or with
+// InboundConflictRename moves the inbound to a free port and renames the
+// clients; InboundConflictSkipClients moves the inbound too but leaves the
+// clients out. A WireGuard inbound gets new keys for itself and its peers with
+// newKeys, rather than sharing those of the exported one. It returns whether
+// Xray has to be restarted.
+func (s *InboundService) ImportInbound(data []byte, conflict string, newKeys bool, userId int) (*InboundImportResult, bool, error) {
+	if conflict == "" {
+		conflict = InboundConflictFail
+	}
+	switch conflict {
+	case InboundConflictFail, InboundConflictRename, InboundConflictSkipClients:
+	default:
+		return nil, false, common.NewError("unknown conflict policy:", conflict)
+	}
+	doc, err := parseInboundExport(data)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := doc.validate(); err != nil {
+		return nil, false, err
+	}
+	in := &doc.Inbound
+	result := &InboundImportResult{}
+
+	port := in.Port
+	width := 0
+	if in.PortEnd != 0 {
+		width = in.PortEnd - in.Port
+	}
+	taken, err := s.portTaken(in.Listen, port, port+width)
+	if err == nil && !taken {
+		taken, err = s.tagTaken(InboundTag(in.Listen, port))
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if taken {
+		if conflict == InboundConflictFail {
+			return nil, false, locale.NewError(locale.ErrInboundPortInUse, "Port=="+strconv.Itoa(port))
+		}
+		for taken {
+			if port, err = s.freePort(in.Listen, port, width); err != nil {
+				return nil, false, err
+			}
+			if taken, err = s.tagTaken(InboundTag(in.Listen, port)); err != nil {
+				return nil, false, err
+			}
+		}
+		result.Port = in.Port
+	}
+
+	portEnd := 0
+	if width > 0 {
+		portEnd = port + width
+	}
+
+	// Clients keep their fields as they are in the document
+	var settings map[string]any
+	if err := json.Unmarshal(in.Settings, &settings); err != nil {
+		return nil, false, err
+	}
+	existing, err := s.getClientEmails()
+	if err != nil {
+		return nil, false, err
+	}
+	// used has the inbounds of the emails taken, nil for the ones of the document
+	used := map[string]*ClientEmailUse{}
+	for i := range existing {
+		used[strings.ToLower(existing[i].Email)] = &existing[i]
+	}
+	emailTaken := func(email string) bool {
+		_, ok := used[strings.ToLower(email)]
+		return ok
+	}
+	stats := map[string]*InboundExportTraffic{}
+	for i := range doc.ClientStats {
+		stats[doc.ClientStats[i].Email] = &doc.ClientStats[i]
+	}
+
+	var clientStats []xray.ClientTraffic
+	if clients, ok := settings["clients"].([]any); ok {
+		kept := make([]any, 0, len(clients))
+		for _, item := range clients {
+			client, _ := item.(map[string]any)
+			email, _ := client["email"].(string)
+			newEmail := email
+			if use, ok := used[strings.ToLower(email)]; ok {
+				switch conflict {
+				case InboundConflictFail:
+					return nil, false, emailInUse(email, use)
+				case InboundConflictSkipClients:
+					result.Skipped = append(result.Skipped, email)
+					continue
+				}
+				for n := 2; emailTaken(newEmail); n++ {
+					newEmail = fmt.Sprintf("%s-%d", email, n)
+				}
+				client["email"] = newEmail
+				if result.Renamed == nil {
+					result.Renamed = map[string]string{}
+				}
+				result.Renamed[email] = newEmail
+			}
+			used[strings.ToLower(newEmail)] = nil
+			kept = append(kept, client)
+
+			clientStats = append(clientStats, importedClientStat(client, stats[email], newEmail))
+		}
+		settings["clients"] = kept
+	}
+	if in.Protocol == model.WireGuard && newKeys {
+		if err := regenerateWireguardKeys(settings); err != nil {
+			return nil, false, err
+		}
+	}
+	newSettings, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return nil, false, err
+	}
+
+	inbound := &model.Inbound{
+		UserId:             userId,
+		Up:                 in.Up,
+		Down:               in.Down,
+		Total:              in.Total,
+		Remark:             in.Remark,
+		RemarkTemplate:     in.RemarkTemplate,
+		SubIncludeDisabled: in.SubIncludeDisabled,
+		ClientDefaults:     in.ClientDefaults,
+		Enable:             in.Enable,
+		ExpiryTime:         in.ExpiryTime,
+		ClientStats:        clientStats,
+		Listen:             in.Listen,
+		Port:               port,
+		PortEnd:            portEnd,
+		Protocol:           in.Protocol,
+		Settings:           string(newSettings),
+		StreamSettings:     string(in.StreamSettings),
+		Tag:                InboundTag(in.Listen, port),
+		Sniffing:           string(in.Sniffing),
+		Allocate:           string(in.Allocate),
+	}
+	// Saves the inbound and its client stats in one transaction
+	inbound, needRestart, err := s.AddInbound(inbound)
+	if err != nil {
+		return nil, false, err
+	}
+	result.Inbound = inbound
+	return result, needRestart, nil
+}
+
+// importedClientStat returns the traffic counters of an imported client as
+// email, from traffic, or if the document has none from the fields of the
+// client.
+func importedClientStat(client map[string]any, traffic *InboundExportTraffic, email string) xray.ClientTraffic {
+	if traffic == nil {
+		enable, _ := client["enable"].(bool)
+		traffic = &InboundExportTraffic{
+			Enable:     enable,
+			Total:      jsonInt64(client["totalGB"]),
+			ExpiryTime: jsonInt64(client["expiryTime"]),
+			Reset:      int(jsonInt64(client["reset"])),
+		}
+	}
+	return xray.ClientTraffic{
+		Email:       email,
+		Enable:      traffic.Enable,
+		Up:          traffic.Up,
+		Down:        traffic.Down,
+		Total:       traffic.Total,
+		ExpiryTime:  traffic.ExpiryTime,
+		Reset:       traffic.Reset,
+		CarriedOver: traffic.CarriedOver,
+	}
+}
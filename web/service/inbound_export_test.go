@@ -0,0 +1,212 @@
+package service
+
+import (
+	"strings"
+	"testing"
+
+	"x-ui/database/model"
+
+	"github.com/goccy/go-json"
+)
+
+var exportTestInbounds = []model.Inbound{
+	{
+		Remark: "vless reality", Enable: true, Port: 24431, Protocol: model.VLESS,
+		Settings: `{"clients":[{"id":"9c1f4c1e-6a4b-4d47-9a20-3c2f1d7e8b10","email":"reality-1","flow":"xtls-rprx-vision","enable":true,"totalGB":1073741824}],"decryption":"none","fallbacks":[]}`,
+		StreamSettings: `{"network":"tcp","security":"reality","realitySettings":{"show":false,"dest":"www.example.com:443",` +
+			`"serverNames":["www.example.com"],"privateKey":"wK4uM9rjR3b5X0lJ7xg3qXnB2a3qHkFsfw3mCbqk0mc","shortIds":["6ba85179e30d4fc2"],` +
+			`"settings":{"publicKey":"Igm2dL3jTHVx0hB6dOgfeLM2Y4P8kK3aJ3lCkKzbmUM","fingerprint":"chrome"}},"tcpSettings":{"header":{"type":"none"}}}`,
+		Sniffing: `{"enabled":true,"destOverride":["http","tls","quic"]}`,
+	},
+	{
+		Remark: "vmess ws", Enable: true, Port: 24432, Protocol: model.VMESS,
+		Settings:       `{"clients":[{"id":"0f0c2d7b-6f2e-4b8e-8f4a-2a6e5f1c9d33","email":"ws-1","enable":true},{"id":"5d2b3f8c-1a9e-4c6d-b7f0-8e4a2c1d6b55","email":"ws-2","enable":false}]}`,
+		StreamSettings: `{"network":"ws","security":"none","wsSettings":{"path":"/ray","headers":{"Host":"cdn.example.com"}}}`,
+		Sniffing:       `{"enabled":false,"destOverride":["http","tls"]}`,
+	},
+	{
+		Remark: "trojan tcp", Enable: true, Port: 24433, Protocol: model.Trojan,
+		Settings:       `{"clients":[{"password":"Zq8vN2xL5cR1","email":"trojan-1","enable":true,"expiryTime":1893456000000}],"fallbacks":[]}`,
+		StreamSettings: `{"network":"tcp","security":"none","tcpSettings":{"header":{"type":"none"}}}`,
+		Sniffing:       `{"enabled":true,"destOverride":["http","tls"]}`,
+	},
+}
+
+// addExportTestInbound adds an inbound of exportTestInbounds to an empty
+// database, with traffic of its own and of its clients.
+func addExportTestInbound(t *testing.T, template model.Inbound) *model.Inbound {
+	t.Helper()
+	db := newTestDB(t)
+	var s InboundService
+	inbound := template
+	inbound.Tag = InboundTag(inbound.Listen, inbound.Port)
+	added, _, err := s.AddInbound(&inbound)
+	if err != nil {
+		t.Fatalf("add %s: %v", template.Remark, err)
+	}
+	if err := db.Model(added).Updates(map[string]any{"up": 1000, "down": 2000}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec("UPDATE client_traffics SET up = 10, down = 20 WHERE inbound_id = ?", added.Id).Error; err != nil {
+		t.Fatal(err)
+	}
+	return added
+}
+
+func exportJSON(t *testing.T, id int, stripTraffic bool) []byte {
+	t.Helper()
+	var s InboundService
+	doc, err := s.ExportInbound(id, stripTraffic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// sameJSON tells whether a and b are the same JSON values.
+func sameJSON(t *testing.T, a, b string) bool {
+	t.Helper()
+	var x, y any
+	if err := json.Unmarshal([]byte(a), &x); err != nil {
+		t.Fatalf("invalid JSON %s: %v", a, err)
+	}
+	if err := json.Unmarshal([]byte(b), &y); err != nil {
+		t.Fatalf("invalid JSON %s: %v", b, err)
+	}
+	ja, _ := json.Marshal(x)
+	jb, _ := json.Marshal(y)
+	return string(ja) == string(jb)
+}
+
+func TestInboundExportRoundTrip(t *testing.T) {
+	for _, template := range exportTestInbounds {
+		t.Run(template.Remark, func(t *testing.T) {
+			original := addExportTestInbound(t, template)
+			original, _ = (&InboundService{}).GetInbound(original.Id)
+			data := exportJSON(t, original.Id, false)
+
+			var s InboundService
+			// The inbound and its clients are still there, so all of it conflicts
+			if _, _, err := s.ImportInbound(data, InboundConflictFail, false, 1); err == nil {
+				t.Fatal("an import conflicting with its inbound was made")
+			}
+			if _, err := s.DelInbound(original.Id); err != nil {
+				t.Fatal(err)
+			}
+
+			result, _, err := s.ImportInbound(data, InboundConflictFail, false, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			imported, err := s.GetInbound(result.Inbound.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if imported.Port != original.Port || imported.Tag != original.Tag || imported.Protocol != original.Protocol ||
+				imported.Remark != original.Remark || imported.Up != 1000 || imported.Down != 2000 {
+				t.Errorf("imported %+v, want the fields of %+v", imported, original)
+			}
+			for name, pair := range map[string][2]string{
+				"settings":       {original.Settings, imported.Settings},
+				"streamSettings": {original.StreamSettings, imported.StreamSettings},
+				"sniffing":       {original.Sniffing, imported.Sniffing},
+			} {
+				if !sameJSON(t, pair[0], pair[1]) {
+					t.Errorf("%s changed:\n%s\n%s", name, pair[0], pair[1])
+				}
+			}
+			if len(imported.ClientStats) != len(original.ClientStats) {
+				t.Fatalf("%d client stats imported, want %d", len(imported.ClientStats), len(original.ClientStats))
+			}
+			for _, stat := range imported.ClientStats {
+				if stat.Up != 10 || stat.Down != 20 {
+					t.Errorf("client %s has traffic %d/%d, want 10/20", stat.Email, stat.Up, stat.Down)
+				}
+			}
+			// The document of the import is that of the export
+			if again := exportJSON(t, imported.Id, false); !sameJSON(t, withoutTime(t, data), withoutTime(t, again)) {
+				t.Errorf("the export changed on the round trip:\n%s\n%s", data, again)
+			}
+		})
+	}
+}
+
+// withoutTime returns the export document data without its time.
+func withoutTime(t *testing.T, data []byte) string {
+	var doc map[string]any
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatal(err)
+	}
+	delete(doc, "exportedAt")
+	out, _ := json.Marshal(doc)
+	return string(out)
+}
+
+func TestInboundExportStripTraffic(t *testing.T) {
+	original := addExportTestInbound(t, exportTestInbounds[1])
+	var doc InboundExport
+	if err := json.Unmarshal(exportJSON(t, original.Id, true), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.Inbound.Up != 0 || doc.Inbound.Down != 0 || len(doc.ClientStats) != 0 {
+		t.Errorf("the stripped export has traffic: %+v", doc)
+	}
+}
+
+func TestInboundImportConflicts(t *testing.T) {
+	original := addExportTestInbound(t, exportTestInbounds[1])
+	data := exportJSON(t, original.Id, false)
+	var s InboundService
+
+	result, _, err := s.ImportInbound(data, InboundConflictRename, false, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Port != original.Port || result.Inbound.Port == original.Port || result.Inbound.Tag == original.Tag {
+		t.Errorf("the renamed import took port %d, tag %s", result.Inbound.Port, result.Inbound.Tag)
+	}
+	if result.Renamed["ws-1"] != "ws-1-2" || result.Renamed["ws-2"] != "ws-2-2" {
+		t.Errorf("renamed %v", result.Renamed)
+	}
+	clients, _ := s.GetClients(result.Inbound)
+	for _, client := range clients {
+		if !strings.HasSuffix(client.Email, "-2") {
+			t.Errorf("client %s of the import was not renamed", client.Email)
+		}
+	}
+
+	result, _, err = s.ImportInbound(data, InboundConflictSkipClients, false, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Skipped) != 2 || len(result.Inbound.ClientStats) != 0 {
+		t.Errorf("skipped %v, kept %d clients", result.Skipped, len(result.Inbound.ClientStats))
+	}
+
+	if _, _, err := s.ImportInbound(data, "merge", false, 1); err == nil {
+		t.Error("an unknown conflict policy was accepted")
+	}
+}
+
+func TestInboundImportVersions(t *testing.T) {
+	newTestDB(t)
+	var s InboundService
+	for name, doc := range map[string]string{
+		"no version":    `{"inbound":{"protocol":"vmess","port":1000,"settings":{"clients":[]}}}`,
+		"newer version": `{"version":99,"inbound":{"protocol":"vmess","port":1000,"settings":{"clients":[]}}}`,
+		"not JSON":      `{"version":1,`,
+		"bad protocol":  `{"version":1,"inbound":{"protocol":"ftp","port":1000,"settings":{}}}`,
+		"bad port":      `{"version":1,"inbound":{"protocol":"vmess","port":70000,"settings":{}}}`,
+		"bad settings":  `{"version":1,"inbound":{"protocol":"vmess","port":1000,"settings":[]}}`,
+		"duplicate email": `{"version":1,"inbound":{"protocol":"vmess","port":1000,"settings":{"clients":[` +
+			`{"id":"0f0c2d7b-6f2e-4b8e-8f4a-2a6e5f1c9d33","email":"a"},{"id":"5d2b3f8c-1a9e-4c6d-b7f0-8e4a2c1d6b55","email":"A"}]}}}`,
+	} {
+		if _, _, err := s.ImportInbound([]byte(doc), InboundConflictFail, false, 1); err == nil {
+			t.Errorf("%s: the document was imported", name)
+		}
+	}
+}
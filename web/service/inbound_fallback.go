@@ -0,0 +1,142 @@
+package service
+
+import (
+	"math"
+	"net"
+	"strconv"
+	"strings"
+
+	"x-ui/database/model"
+	"x-ui/util/common"
+
+	"github.com/goccy/go-json"
+)
+
+// fallbackAlpns are the ALPN values Xray matches fallbacks on, besides any.
+var fallbackAlpns = map[string]bool{
+	"h2":       true,
+	"http/1.1": true,
+}
+
+// checkFallbackDest checks where a fallback goes: a port, a unix socket or
+// host:port.
+func checkFallbackDest(dest any) error {
+	switch dest := dest.(type) {
+	case float64:
+		if dest != math.Trunc(dest) || dest < 1 || dest > 65535 {
+			return common.NewErrorf("%v is not a valid port", dest)
+		}
+		return nil
+	case string:
+		dest = strings.TrimSpace(dest)
+		if dest == "" {
+			return common.NewErrorf("can not be empty")
+		}
+		// A unix socket, "@" for the abstract namespace
+		if strings.HasPrefix(dest, "/") || strings.HasPrefix(dest, "@") {
+			return nil
+		}
+		port := dest
+		if strings.Contains(dest, ":") {
+			host, p, err := net.SplitHostPort(dest)
+			if err != nil || host == "" {
+				return common.NewErrorf("must be a port, a unix socket or host:port, not %q", dest)
+			}
+			port = p
+		}
+		n, err := strconv.Atoi(port)
+		if err != nil && port == dest {
+			return common.NewErrorf("must be a port, a unix socket or host:port, not %q", dest)
+		}
+		if err != nil || n < 1 || n > 65535 {
+			return common.NewErrorf("%s is not a valid port", port)
+		}
+		return nil
+	case nil:
+		return common.NewErrorf("can not be empty")
+	}
+	return common.NewErrorf("must be a port, a unix socket or host:port")
+}
+
+// normalizeFallbacks checks the fallbacks in the settings of an inbound, and
+// leaves out their empty fields. The settings are only rewritten if there are
+// fallbacks.
+func normalizeFallbacks(protocol model.Protocol, settings string) (string, error) {
+	var parsed map[string]any
+	if err := json.Unmarshal([]byte(settings), &parsed); err != nil {
+		return settings, nil
+	}
+	value, ok := parsed["fallbacks"]
+	if !ok || value == nil {
+		return settings, nil
+	}
+	fallbacks, ok := value.([]any)
+	if !ok {
+		return "", common.NewError("fallbacks must be a list")
+	}
+	if len(fallbacks) == 0 {
+		return settings, nil
+	}
+	if protocol != model.VLESS && protocol != model.Trojan {
+		return "", common.NewError("only VLESS and Trojan inbounds have fallbacks, not", protocol)
+	}
+
+	matches := map[string]int{}
+	for i, item := range fallbacks {
+		fallback, ok := item.(map[string]any)
+		if !ok {
+			return "", common.NewErrorf("fallbacks[%d]: must be an object", i)
+		}
+		for _, field := range []string{"name", "alpn", "path"} {
+			value, ok := fallback[field]
+			if !ok {
+				continue
+			}
+			text, ok := value.(string)
+			if !ok {
+				return "", common.NewErrorf("fallbacks[%d].%s: must be a string", i, field)
+			}
+			if text = strings.TrimSpace(text); text == "" {
+				delete(fallback, field)
+			} else {
+				fallback[field] = text
+			}
+		}
+		name, _ := fallback["name"].(string)
+		alpn, _ := fallback["alpn"].(string)
+		path, _ := fallback["path"].(string)
+		if alpn != "" && !fallbackAlpns[alpn] {
+			return "", common.NewErrorf("fallbacks[%d].alpn: must be h2 or http/1.1, not %q", i, alpn)
+		}
+		if path != "" && !strings.HasPrefix(path, "/") {
+			return "", common.NewErrorf("fallbacks[%d].path: must start with /", i)
+		}
+		if err := checkFallbackDest(fallback["dest"]); err != nil {
+			return "", common.NewErrorf("fallbacks[%d].dest: %v", i, err)
+		}
+		if dest, ok := fallback["dest"].(string); ok {
+			fallback["dest"] = strings.TrimSpace(dest)
+		}
+
+		xver := 0.0
+		if value, ok := fallback["xver"]; ok && value != nil {
+			if xver, ok = value.(float64); !ok || xver != math.Trunc(xver) || xver < 0 || xver > 2 {
+				return "", common.NewErrorf("fallbacks[%d].xver: must be 0, 1 or 2", i)
+			}
+		}
+		fallback["xver"] = int(xver)
+
+		// Xray keeps one fallback per name, ALPN and path
+		key := name + "\x00" + alpn + "\x00" + path
+		if j, ok := matches[key]; ok {
+			return "", common.NewErrorf("fallbacks[%d]: same name, alpn and path as fallbacks[%d]", i, j)
+		}
+		matches[key] = i
+	}
+
+	normalized, err := json.MarshalIndent(parsed, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(normalized), nil
+}
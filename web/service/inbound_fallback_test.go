@@ -0,0 +1,142 @@
+package service
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"x-ui/database/model"
+	"x-ui/xray"
+
+	"github.com/goccy/go-json"
+)
+
+const fallbackTestClients = `"clients":[{"id":"9c1f4c1e-6a4b-4d47-9a20-3c2f1d7e8b10","email":"fallback-1","enable":true}],"decryption":"none"`
+
+func TestNormalizeFallbacks(t *testing.T) {
+	settings := `{` + fallbackTestClients + `,"fallbacks":[` +
+		`{"name":" ","alpn":"","path":"","dest":8080,"xver":1},` +
+		`{"alpn":"h2","dest":" 127.0.0.1:8081 "},` +
+		`{"path":"/ws","dest":"/dev/shm/ws.sock","xver":2},` +
+		`{"name":"example.com","dest":"@abstract"}]}`
+	normalized, err := normalizeFallbacks(model.VLESS, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parsed struct {
+		Fallbacks []map[string]any `json:"fallbacks"`
+	}
+	if err := json.Unmarshal([]byte(normalized), &parsed); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		`{"dest":8080,"xver":1}`,
+		`{"alpn":"h2","dest":"127.0.0.1:8081","xver":0}`,
+		`{"dest":"/dev/shm/ws.sock","path":"/ws","xver":2}`,
+		`{"dest":"@abstract","name":"example.com","xver":0}`,
+	}
+	if len(parsed.Fallbacks) != len(want) {
+		t.Fatalf("normalized to %s", normalized)
+	}
+	for i, fallback := range parsed.Fallbacks {
+		data, _ := json.Marshal(fallback)
+		if !sameJSON(t, string(data), want[i]) {
+			t.Errorf("fallbacks[%d] = %s, want %s", i, data, want[i])
+		}
+	}
+
+	// Settings without fallbacks are left as they are
+	for _, settings := range []string{`{` + fallbackTestClients + `}`, `{"fallbacks":[]}`, `{"fallbacks":null}`, `not JSON`} {
+		if got, err := normalizeFallbacks(model.VMESS, settings); err != nil || got != settings {
+			t.Errorf("%s was normalized to %s, %v", settings, got, err)
+		}
+	}
+}
+
+func TestNormalizeFallbacksErrors(t *testing.T) {
+	tests := []struct {
+		fallbacks string
+		err       string
+	}{
+		{`{}`, "fallbacks must be a list"},
+		{`["8080"]`, "fallbacks[0]: must be an object"},
+		{`[{"dest":80},{"dest":0}]`, "fallbacks[1].dest: 0 is not a valid port"},
+		{`[{"dest":80.5}]`, "fallbacks[0].dest:"},
+		{`[{"dest":"70000"}]`, "fallbacks[0].dest: 70000 is not a valid port"},
+		{`[{"dest":"example.com"}]`, "fallbacks[0].dest: must be a port, a unix socket or host:port"},
+		{`[{"dest":":8080"}]`, "fallbacks[0].dest: must be a port, a unix socket or host:port"},
+		{`[{"dest":"127.0.0.1:http"}]`, "fallbacks[0].dest: http is not a valid port"},
+		{`[{"dest":" "}]`, "fallbacks[0].dest: can not be empty"},
+		{`[{"path":"/a","dest":80},{"path":"/b"}]`, "fallbacks[1].dest: can not be empty"},
+		{`[{"dest":true}]`, "fallbacks[0].dest: must be a port"},
+		{`[{"dest":80},{"path":"/a","dest":81},{"path":"/b","dest":82,"xver":3}]`, "fallbacks[2].xver: must be 0, 1 or 2"},
+		{`[{"dest":80,"xver":"1"}]`, "fallbacks[0].xver: must be 0, 1 or 2"},
+		{`[{"dest":80,"xver":1.5}]`, "fallbacks[0].xver: must be 0, 1 or 2"},
+		{`[{"dest":80},{"path":"ws","dest":81}]`, "fallbacks[1].path: must start with /"},
+		{`[{"alpn":"h3","dest":80}]`, `fallbacks[0].alpn: must be h2 or http/1.1, not "h3"`},
+		{`[{"name":1,"dest":80}]`, "fallbacks[0].name: must be a string"},
+		{`[{"alpn":"h2","path":"/a","dest":80},{"dest":81},{"alpn":"h2","path":" /a ","dest":82}]`,
+			"fallbacks[2]: same name, alpn and path as fallbacks[0]"},
+		{`[{"dest":80},{"name":"","dest":81}]`, "fallbacks[1]: same name, alpn and path as fallbacks[0]"},
+	}
+	for _, test := range tests {
+		_, err := normalizeFallbacks(model.Trojan, `{"clients":[],"fallbacks":`+test.fallbacks+`}`)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("fallbacks %s: error %v, want %q", test.fallbacks, err, test.err)
+		}
+	}
+
+	if _, err := normalizeFallbacks(model.VMESS, `{"fallbacks":[{"dest":80}]}`); err == nil {
+		t.Error("a VMess inbound took fallbacks")
+	}
+}
+
+func TestInboundFallbacksInXrayConfig(t *testing.T) {
+	newTestDB(t)
+	var s InboundService
+	inbound := &model.Inbound{
+		Remark: "vless fallbacks", Enable: true, Port: 24434, Protocol: model.VLESS, Tag: "inbound-24434",
+		Settings:       `{` + fallbackTestClients + `,"fallbacks":[{"dest":8080,"xver":""},{"path":"/ws","dest":"127.0.0.1:8081","xver":1}]}`,
+		StreamSettings: `{"network":"tcp","security":"none","tcpSettings":{"header":{"type":"none"}}}`,
+		Sniffing:       `{"enabled":false}`,
+	}
+	if _, _, err := s.AddInbound(inbound); err == nil {
+		t.Fatal("an inbound with an invalid xver was added")
+	}
+	inbound.Settings = strings.Replace(inbound.Settings, `"xver":""`, `"xver":0`, 1)
+	if _, _, err := s.AddInbound(inbound); err != nil {
+		t.Fatal(err)
+	}
+
+	xrayConfig, err := (&XrayService{}).GetXrayConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, config := range xrayConfig.InboundConfigs {
+		if config.Tag != inbound.Tag {
+			continue
+		}
+		found = true
+		var settings struct {
+			Fallbacks []map[string]any `json:"fallbacks"`
+		}
+		if err := json.Unmarshal(config.Settings, &settings); err != nil {
+			t.Fatal(err)
+		}
+		if len(settings.Fallbacks) != 2 || settings.Fallbacks[1]["path"] != "/ws" || settings.Fallbacks[1]["xver"] != 1.0 {
+			t.Errorf("the fallbacks of the config are %v", settings.Fallbacks)
+		}
+	}
+	if !found {
+		t.Fatal("the inbound is not in the xray config")
+	}
+
+	err = xray.TestConfig(xrayConfig)
+	if errors.Is(err, xray.ErrNoBinary) {
+		t.Skip("xray -test is not run:", err)
+	}
+	if err != nil {
+		t.Errorf("xray rejected the fallbacks: %v", err)
+	}
+}
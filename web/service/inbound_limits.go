@@ -0,0 +1,285 @@
+package service
+
+import (
+	"errors"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/web/locale"
+	"x-ui/xray"
+
+	"github.com/goccy/go-json"
+)
+
+// The limits of inbounds, as InboundLimitError names them.
+const (
+	LimitMaxClients     = "maxClients"
+	LimitMaxTotalGB     = "maxTotalAssignedGB"
+	LimitMaxExpiryDays  = "maxClientExpiryDays"
+	LimitAllowUnlimited = "allowUnlimited"
+)
+
+var inboundLimitCodes = map[string]locale.ErrorCode{
+	LimitMaxClients:     locale.ErrInboundMaxClients,
+	LimitMaxTotalGB:     locale.ErrInboundMaxTotalGB,
+	LimitMaxExpiryDays:  locale.ErrInboundMaxExpiry,
+	LimitAllowUnlimited: locale.ErrInboundUnlimited,
+}
+
+// InboundLimitError is a change of clients refused for going over a limit of
+// their inbound. It unwraps to the coded error of the limit.
+type InboundLimitError struct {
+	InboundId int    `json:"inboundId"`
+	Inbound   string `json:"inbound"`
+	Limit     string `json:"limit"`
+	Max       int64  `json:"max"`
+	// Usage is what the clients take of the limit, Requested what they would
+	// take after the change; in clients, GB or days like the limit
+	Usage     float64 `json:"usage"`
+	Requested float64 `json:"requested"`
+	// Email is the client going over a limit of each client
+	Email string `json:"email,omitempty"`
+}
+
+func (e *InboundLimitError) Error() string {
+	return e.Unwrap().Error()
+}
+
+func (e *InboundLimitError) Unwrap() error {
+	return locale.NewError(inboundLimitCodes[e.Limit],
+		"Inbound=="+e.Inbound,
+		"Max=="+strconv.FormatInt(e.Max, 10),
+		"Usage=="+strconv.FormatFloat(e.Usage, 'f', -1, 64),
+		"Requested=="+strconv.FormatFloat(e.Requested, 'f', -1, 64),
+		"Email=="+e.Email,
+	)
+}
+
+// limitedClient is what the limits of an inbound count of a client.
+type limitedClient struct {
+	email      string
+	totalGB    int64 // in bytes, 0 for unlimited
+	expiryTime int64
+}
+
+// limitedClients returns what the limits count of clients, as stored in the
+// settings of an inbound.
+func limitedClients(clients []any) []limitedClient {
+	limited := make([]limitedClient, 0, len(clients))
+	for _, item := range clients {
+		client, _ := item.(map[string]any)
+		email, _ := client["email"].(string)
+		limited = append(limited, limitedClient{
+			email:      email,
+			totalGB:    jsonInt64(client["totalGB"]),
+			expiryTime: jsonInt64(client["expiryTime"]),
+		})
+	}
+	return limited
+}
+
+// assignedBytes sums the traffic limits of clients.
+func assignedBytes(clients []limitedClient) int64 {
+	var total int64
+	for _, client := range clients {
+		total += max(client.totalGB, 0)
+	}
+	return total
+}
+
+// bytesToGB returns bytes in GB, to two decimals.
+func bytesToGB(bytes int64) float64 {
+	return math.Round(float64(bytes)/(1<<30)*100) / 100
+}
+
+// expiryDays returns in how many days a client with expiryTime expires at now,
+// or for how many days it is valid after its first use.
+func expiryDays(expiryTime int64, now int64) float64 {
+	const day = float64(24 * time.Hour / time.Millisecond)
+	if expiryTime < 0 {
+		return math.Round(float64(-expiryTime)/day*100) / 100
+	}
+	return math.Round(float64(max(expiryTime-now, 0))/day*100) / 100
+}
+
+// normalizeInboundLimits checks limits, which are none when nothing is limited.
+func normalizeInboundLimits(limits *model.InboundLimits) (*model.InboundLimits, error) {
+	if limits == nil {
+		return nil, nil
+	}
+	if limits.MaxClients < 0 || limits.MaxTotalAssignedGB < 0 || limits.MaxClientExpiryDays < 0 {
+		return nil, common.NewError("the limits of an inbound can't be negative")
+	}
+	if limits.MaxClients == 0 && limits.MaxTotalAssignedGB == 0 && limits.MaxClientExpiryDays == 0 {
+		return nil, nil
+	}
+	return limits, nil
+}
+
+// checkInboundLimits returns an *InboundLimitError if after, the clients of
+// inbound once changed from before, go over a limit of the inbound by more than
+// before did. Clients already over the limits of each client are kept as they
+// are, only those added or changed are checked.
+func checkInboundLimits(inbound *model.Inbound, before []limitedClient, after []limitedClient, now int64) error {
+	limits := inbound.Limits
+	if limits == nil {
+		return nil
+	}
+	refuse := func(limit string, max int64, usage float64, requested float64, email string) error {
+		return &InboundLimitError{
+			InboundId: inbound.Id,
+			Inbound:   inbound.Remark,
+			Limit:     limit,
+			Max:       max,
+			Usage:     usage,
+			Requested: requested,
+			Email:     email,
+		}
+	}
+
+	old := make(map[string]limitedClient, len(before))
+	for _, client := range before {
+		old[strings.ToLower(client.email)] = client
+	}
+	maxDays := int64(limits.MaxClientExpiryDays)
+	for _, client := range after {
+		prev, ok := old[strings.ToLower(client.email)]
+		quotaChanged := !ok || prev.totalGB != client.totalGB
+		expiryChanged := !ok || prev.expiryTime != client.expiryTime
+		if !limits.AllowUnlimited {
+			if quotaChanged && client.totalGB <= 0 && limits.MaxTotalAssignedGB > 0 {
+				return refuse(LimitAllowUnlimited, 0, 0, 0, client.email)
+			}
+			if expiryChanged && client.expiryTime == 0 && maxDays > 0 {
+				return refuse(LimitAllowUnlimited, 0, 0, 0, client.email)
+			}
+		}
+		if expiryChanged && client.expiryTime != 0 && maxDays > 0 {
+			// Whole days count, a client set to expire later on the last day passes
+			if days := expiryDays(client.expiryTime, now); int64(days) > maxDays {
+				usage := 0.0
+				if ok && prev.expiryTime != 0 {
+					usage = expiryDays(prev.expiryTime, now)
+				}
+				return refuse(LimitMaxExpiryDays, maxDays, usage, days, client.email)
+			}
+		}
+	}
+
+	if count := len(after); limits.MaxClients > 0 && count > limits.MaxClients && count > len(before) {
+		return refuse(LimitMaxClients, int64(limits.MaxClients), float64(len(before)), float64(count), "")
+	}
+	if limits.MaxTotalAssignedGB > 0 {
+		usage, requested := assignedBytes(before), assignedBytes(after)
+		if requested > limits.MaxTotalAssignedGB<<30 && requested > usage {
+			return refuse(LimitMaxTotalGB, limits.MaxTotalAssignedGB, bytesToGB(usage), bytesToGB(requested), "")
+		}
+	}
+	return nil
+}
+
+// settingsClients returns what the limits count of the clients of settings.
+func settingsClients(settings string) ([]limitedClient, error) {
+	var parsed map[string]any
+	if err := json.Unmarshal([]byte(settings), &parsed); err != nil {
+		return nil, err
+	}
+	clients, _ := parsed["clients"].([]any)
+	return limitedClients(clients), nil
+}
+
+// checkUpdateLimits checks the limits of inbound for its client with email
+// replaced by the clients of settings.
+func checkUpdateLimits(inbound *model.Inbound, email string, settings string) error {
+	if inbound.Limits == nil {
+		return nil
+	}
+	before, err := settingsClients(inbound.Settings)
+	if err != nil {
+		return err
+	}
+	replacing, err := settingsClients(settings)
+	if err != nil {
+		return err
+	}
+	after := slices.DeleteFunc(slices.Clone(before), func(client limitedClient) bool {
+		return strings.EqualFold(client.email, email)
+	})
+	return checkInboundLimits(inbound, before, append(after, replacing...), time.Now().UnixMilli())
+}
+
+// limitRejected records a change of clients that err refused for going over a
+// limit of their inbound, if it did, in the audit log and for the webhooks. The
+// caller of the change is unknown here; the request, if it came from one, is
+// audited on its own. It must not be called in a transaction.
+func (s *InboundService) limitRejected(err error) {
+	var limitErr *InboundLimitError
+	if !errors.As(err, &limitErr) {
+		return
+	}
+	logger.Infof("a change of the clients of inbound %d was refused for its limit %s", limitErr.InboundId, limitErr.Limit)
+	before := map[string]any{limitErr.Limit: limitErr.Usage}
+	after := map[string]any{limitErr.Limit: limitErr.Requested, "max": limitErr.Max}
+	if limitErr.Email != "" {
+		after["email"] = limitErr.Email
+	}
+	(&AuditService{}).Record(&model.AuditLog{
+		Actor:      "system",
+		Action:     "inbound.limitRejected",
+		EntityType: "inbound",
+		EntityId:   strconv.Itoa(limitErr.InboundId),
+		Success:    false,
+		Diff:       AuditDiff(before, after),
+	})
+	s.webhookService.Emit(WebhookClientRejected, limitErr)
+}
+
+// SetInboundLimits sets the limits of the clients of an inbound, or removes
+// them if nil. Clients already over the new limits are kept.
+func (s *InboundService) SetInboundLimits(id int, limits *model.InboundLimits) (*model.Inbound, error) {
+	limits, err := normalizeInboundLimits(limits)
+	if err != nil {
+		return nil, err
+	}
+	unlock := s.lockInbound(id)
+	defer unlock()
+
+	inbound, err := s.GetInbound(id)
+	if err != nil {
+		return nil, err
+	}
+	inbound.Limits = limits
+	if err := database.GetDB().Model(inbound).Select("limits").Updates(inbound).Error; err != nil {
+		return nil, err
+	}
+	if err := database.GetDB().Model(xray.ClientTraffic{}).Where("inbound_id = ?", id).Find(&inbound.ClientStats).Error; err != nil {
+		return nil, err
+	}
+	SetLimitUsage(inbound)
+	return inbound, nil
+}
+
+// SetLimitUsage fills in the LimitUsage of the inbounds with limits from their
+// ClientStats.
+func SetLimitUsage(inbounds ...*model.Inbound) {
+	for _, inbound := range inbounds {
+		if inbound.Limits == nil {
+			continue
+		}
+		var assigned int64
+		for _, stat := range inbound.ClientStats {
+			assigned += max(stat.Total, 0)
+		}
+		inbound.LimitUsage = &model.InboundLimitUsage{
+			Clients:    len(inbound.ClientStats),
+			AssignedGB: bytesToGB(assigned),
+		}
+	}
+}
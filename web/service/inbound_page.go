@@ -0,0 +1,292 @@
+package service
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/util/common"
+)
+
+// InboundSummary is an inbound without its settings and clients, with the
+// counts and the traffic of its clients, for lists of many inbounds.
+type InboundSummary struct {
+	Id         int    `json:"id"`
+	Remark     string `json:"remark"`
+	Enable     bool   `json:"enable"`
+	Listen     string `json:"listen"`
+	Port       int    `json:"port"`
+	PortEnd    int    `json:"portEnd,omitempty"`
+	Protocol   string `json:"protocol"`
+	Tag        string `json:"tag"`
+	Up         int64  `json:"up"`
+	Down       int64  `json:"down"`
+	Total      int64  `json:"total"`
+	ExpiryTime int64  `json:"expiryTime"`
+	// Clients counts the clients, ClientCounts them by state
+	Clients      int                        `json:"clients"`
+	ClientCounts *model.InboundClientCounts `json:"clientCounts" gorm:"-"`
+	Active       int                        `json:"-"`
+	Quota        int                        `json:"-"`
+	Expiry       int                        `json:"-"`
+	Admin        int                        `json:"-"`
+	IpLimit      int                        `json:"-"`
+	// ClientUp and ClientDown are the traffic of the clients
+	ClientUp   int64 `json:"clientUp"`
+	ClientDown int64 `json:"clientDown"`
+}
+
+// ListInbounds returns the inbounds from offset on, at most limit of them, by
+// id, and the number of all of them.
+func (s *InboundService) ListInbounds(limit int, offset int) ([]*model.Inbound, int64, error) {
+	limit, offset = clientPageBounds(limit, offset)
+	db := database.GetDB()
+	var total int64
+	if err := db.Model(model.Inbound{}).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	inbounds := make([]*model.Inbound, 0)
+	err := db.Model(model.Inbound{}).Preload("ClientStats").
+		Order("id").Limit(limit).Offset(offset).Find(&inbounds).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	SetClientCounts(inbounds...)
+	s.setScheduleStates(inbounds...)
+	s.setRealityHealth(inbounds...)
+	s.setBindStates(inbounds...)
+	SetLimitUsage(inbounds...)
+	return inbounds, total, nil
+}
+
+// ListInboundSummaries returns the summaries of the inbounds from offset on,
+// at most limit of them, by id, and the number of all inbounds. The clients
+// are counted from client_traffics, the settings are not read.
+func (s *InboundService) ListInboundSummaries(limit int, offset int) ([]InboundSummary, int64, error) {
+	limit, offset = clientPageBounds(limit, offset)
+	db := database.GetDB()
+	var total int64
+	if err := db.Model(model.Inbound{}).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	summaries := make([]InboundSummary, 0)
+	err := db.Raw(`
+SELECT page.id, page.remark, page.enable, page.listen, page.port, COALESCE(page.port_end, 0) AS port_end,
+	page.protocol, page.tag, page.up, page.down, page.total, page.expiry_time,
+	COALESCE(counts.clients, 0) AS clients, COALESCE(counts.active, 0) AS active,
+	COALESCE(counts.quota, 0) AS quota, COALESCE(counts.expiry, 0) AS expiry,
+	COALESCE(counts.admin, 0) AS admin, COALESCE(counts.ip_limit, 0) AS ip_limit,
+	COALESCE(counts.client_up, 0) AS client_up, COALESCE(counts.client_down, 0) AS client_down
+FROM (
+	SELECT * FROM inbounds ORDER BY id LIMIT @limit OFFSET @offset
+) AS page
+	LEFT JOIN (
+		SELECT inbound_id, COUNT(*) AS clients,
+			SUM(CASE WHEN COALESCE(disabled_reason, '') = @admin THEN 0 WHEN enable = @on THEN 1 ELSE 0 END) AS active,
+			SUM(CASE WHEN COALESCE(disabled_reason, '') IN (@admin, @expiry, @iplimit) OR enable = @on THEN 0 ELSE 1 END) AS quota,
+			SUM(CASE WHEN COALESCE(disabled_reason, '') = @expiry AND enable = @off THEN 1 ELSE 0 END) AS expiry,
+			SUM(CASE WHEN COALESCE(disabled_reason, '') = @admin THEN 1 ELSE 0 END) AS admin,
+			SUM(CASE WHEN COALESCE(disabled_reason, '') = @iplimit AND enable = @off THEN 1 ELSE 0 END) AS ip_limit,
+			SUM(up) AS client_up, SUM(down) AS client_down
+		FROM client_traffics
+		GROUP BY inbound_id
+	) AS counts ON counts.inbound_id = page.id
+ORDER BY page.id`,
+		sql.Named("limit", limit), sql.Named("offset", offset),
+		sql.Named("admin", ClientDisabledAdmin), sql.Named("expiry", ClientDisabledExpiry),
+		sql.Named("iplimit", ClientDisabledIpLimit),
+		sql.Named("on", true), sql.Named("off", false)).
+		Scan(&summaries).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	for i := range summaries {
+		summary := &summaries[i]
+		summary.ClientCounts = &model.InboundClientCounts{
+			Active:  summary.Active,
+			Quota:   summary.Quota,
+			Expiry:  summary.Expiry,
+			Admin:   summary.Admin,
+			IpLimit: summary.IpLimit,
+		}
+	}
+	return summaries, total, nil
+}
+
+// The filters of InboundClientQuery.
+const (
+	ClientFilterActive   = "active"
+	ClientFilterDisabled = "disabled"
+	ClientFilterDepleted = "depleted"
+	ClientFilterExpired  = "expired"
+	ClientFilterOnline   = "online"
+)
+
+// clientSortColumns are the sorts of InboundClientQuery, by the expression of
+// the client_traffics columns they sort by, the never expiring last for expiry.
+var clientSortColumns = map[string]string{
+	"email":    "LOWER({t}.email)",
+	"expiry":   "CASE WHEN {t}.expiry_time = 0 THEN 1 ELSE 0 END, {t}.expiry_time",
+	"traffic":  "{t}.up + {t}.down",
+	"lastSeen": "{t}.last_seen",
+}
+
+// InboundClientQuery selects the clients of an inbound: Filter is one of the
+// ClientFilter constants, Query a part of their email, and Sort one of
+// clientSortColumns, descending with a "-" in front.
+type InboundClientQuery struct {
+	Sort   string `form:"sort"`
+	Filter string `form:"filter"`
+	Query  string `form:"q"`
+}
+
+// orderBy returns the ORDER BY of the sort of the query over the
+// client_traffics of alias.
+func (q InboundClientQuery) orderBy(alias string) (string, error) {
+	sort, desc := strings.CutPrefix(q.Sort, "-")
+	if sort == "" {
+		sort = "email"
+	}
+	column, ok := clientSortColumns[sort]
+	if !ok {
+		return "", common.NewErrorf("unknown sort %q", q.Sort)
+	}
+	order := strings.ReplaceAll(column, "{t}", alias)
+	if desc {
+		order += " DESC"
+	}
+	return order + ", " + alias + ".id", nil
+}
+
+// where returns the conditions of the filter and the search of the query,
+// with their parameters, or ok false if no client can match.
+func (q InboundClientQuery) where(s *InboundService) (where string, params []any, ok bool, err error) {
+	conditions := []string{"inbound_id = @inbound"}
+	switch q.Filter {
+	case "":
+	case ClientFilterActive:
+		conditions = append(conditions, "enable = @on")
+	case ClientFilterDisabled:
+		conditions = append(conditions, "enable = @off")
+	case ClientFilterDepleted:
+		conditions = append(conditions, "total > 0 AND up + down >= total")
+	case ClientFilterExpired:
+		conditions = append(conditions, "expiry_time > 0 AND expiry_time <= @now")
+	case ClientFilterOnline:
+		online := s.GetOnlineClients()
+		if len(online) == 0 {
+			return "", nil, false, nil
+		}
+		conditions = append(conditions, "email IN @online")
+		params = append(params, sql.Named("online", online))
+	default:
+		return "", nil, false, common.NewErrorf("unknown filter %q", q.Filter)
+	}
+	if query := strings.ToLower(strings.TrimSpace(q.Query)); query != "" {
+		conditions = append(conditions, "LOWER(email) LIKE @substring ESCAPE '!'")
+		params = append(params, sql.Named("substring", "%"+escapeLike(query)+"%"))
+	}
+	params = append(params, sql.Named("on", true), sql.Named("off", false), sql.Named("now", time.Now().UnixMilli()))
+	return strings.Join(conditions, " AND "), params, true, nil
+}
+
+// ListInboundClients returns the clients of an inbound the query selects, from
+// offset on, at most limit of them, and the number of all of them. The clients
+// are selected and sorted over client_traffics; the settings of the inbound
+// are read once, for the clients returned.
+func (s *InboundService) ListInboundClients(inboundId int, query InboundClientQuery, limit int, offset int) ([]ClientListItem, int64, error) {
+	limit, offset = clientPageBounds(limit, offset)
+	order, err := query.orderBy("client_traffics")
+	if err != nil {
+		return nil, 0, err
+	}
+	where, params, ok, err := query.where(s)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	db := database.GetDB()
+	inbound := &model.Inbound{}
+	err = db.Model(model.Inbound{}).Select("id", "remark", "port", "protocol").Where("id = ?", inboundId).First(inbound).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	items := make([]ClientListItem, 0)
+	if !ok {
+		return items, 0, nil
+	}
+	params = append(params, sql.Named("inbound", inboundId))
+
+	var total int64
+	err = db.Raw(`SELECT COUNT(*) FROM client_traffics WHERE `+where, params...).Scan(&total).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	err = db.Raw(`
+SELECT inbound_id, email, up, down, total, expiry_time, last_seen, tags,
+	COALESCE(last_sub_fetch, 0) AS last_sub_fetch, COALESCE(last_user_agent, '') AS last_user_agent
+FROM client_traffics
+WHERE `+where+`
+ORDER BY `+order+`
+LIMIT @limit OFFSET @offset`,
+		append(params, sql.Named("limit", limit), sql.Named("offset", offset))...).
+		Scan(&items).Error
+	if err != nil || len(items) == 0 {
+		return items, total, err
+	}
+
+	emails := make([]string, len(items))
+	for i := range items {
+		emails[i] = items[i].Email
+	}
+	var settings []struct {
+		Email    string
+		ClientId string
+		SubId    string
+		TgId     int64
+		Enable   bool
+	}
+	err = db.Raw(`
+SELECT `+database.JSONText("client.value", "$.email")+` AS email,
+	COALESCE(`+database.JSONText("client.value", "$.id")+`, '') AS client_id,
+	COALESCE(`+database.JSONText("client.value", "$.subId")+`, '') AS sub_id,
+	COALESCE(`+database.JSONInt("client.value", "$.tgId")+`, 0) AS tg_id,
+	COALESCE(`+database.JSONBool("client.value", "$.enable")+`, 1) AS enable
+FROM inbounds,
+	`+database.JSONEach("inbounds.settings", "$.clients", "client")+`
+WHERE inbounds.id = ? AND `+database.JSONText("client.value", "$.email")+` IN ?`,
+		inboundId, emails).Scan(&settings).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	bySettings := make(map[string]int, len(settings))
+	for i := range settings {
+		bySettings[settings[i].Email] = i
+	}
+	for i := range items {
+		item := &items[i]
+		item.Remark, item.Port, item.Protocol = inbound.Remark, inbound.Port, string(inbound.Protocol)
+		item.Enable = true
+		if j, ok := bySettings[item.Email]; ok {
+			client := settings[j]
+			item.ClientId, item.SubId, item.TgId, item.Enable = client.ClientId, client.SubId, client.TgId, client.Enable
+		}
+		item.Tags = parseTagColumn(item.TagColumn)
+		item.LastSeen = max(item.LastSeen, clientLastSeen(item.Email))
+		item.addLastSubFetch()
+	}
+	return items, total, nil
+}
+
+// clientPageBounds returns limit within the limits of the listings, and
+// offset from 0 on.
+func clientPageBounds(limit int, offset int) (int, int) {
+	if limit <= 0 {
+		limit = clientSearchDefaultLimit
+	} else if limit > clientSearchMaxLimit {
+		limit = clientSearchMaxLimit
+	}
+	return limit, max(offset, 0)
+}
@@ -0,0 +1,79 @@
+package service
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"x-ui/database/model"
+	"x-ui/xray"
+
+	"gorm.io/gorm"
+)
+
+// pageTestDB opens a new panel database with an inbound of clients clients,
+// every tenth of them disabled, depleted and expired in turn, and returns it.
+func pageTestDB(tb testing.TB, clients int) *model.Inbound {
+	tb.Helper()
+	inbound := &model.Inbound{Remark: "page", Enable: true, Port: 20301, Protocol: model.Trojan, Tag: "inbound-20301"}
+	newTestDB(tb, func(db *gorm.DB) error {
+		var settings strings.Builder
+		traffics := make([]xray.ClientTraffic, clients)
+		for i := range traffics {
+			email := "client-" + strconv.Itoa(i) + "@example.com"
+			traffic := xray.ClientTraffic{Enable: true, Email: email, Up: int64(i * 1000), Down: int64(i * 3000), Total: 1 << 40}
+			switch i % 10 {
+			case 1:
+				traffic.Enable = false
+			case 2:
+				traffic.Total = traffic.Up + traffic.Down
+			case 3:
+				traffic.ExpiryTime = time.Now().Add(-time.Hour).UnixMilli()
+			}
+			traffics[i] = traffic
+			if i > 0 {
+				settings.WriteByte(',')
+			}
+			settings.WriteString(`{"password":"p` + strconv.Itoa(i) + `","email":"` + email + `","enable":` + strconv.FormatBool(traffic.Enable) + `,"subId":"s` + strconv.Itoa(i) + `"}`)
+		}
+		inbound.Settings = `{"clients":[` + settings.String() + `]}`
+		if err := db.Create(inbound).Error; err != nil {
+			return err
+		}
+		for i := range traffics {
+			traffics[i].InboundId = inbound.Id
+		}
+		return db.CreateInBatches(traffics, 500).Error
+	})
+	return inbound
+}
+
+func BenchmarkListInboundClients(b *testing.B) {
+	inbound := pageTestDB(b, 10000)
+	var s InboundService
+	for _, bench := range []struct {
+		name   string
+		query  InboundClientQuery
+		offset int
+	}{
+		{"first page", InboundClientQuery{}, 0},
+		{"last page", InboundClientQuery{}, 9950},
+		{"active by traffic", InboundClientQuery{Filter: ClientFilterActive, Sort: "-traffic"}, 100},
+		{"depleted", InboundClientQuery{Filter: ClientFilterDepleted}, 0},
+		{"expired by expiry", InboundClientQuery{Filter: ClientFilterExpired, Sort: "expiry"}, 0},
+		{"search", InboundClientQuery{Query: "client-99"}, 0},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			for b.Loop() {
+				items, total, err := s.ListInboundClients(inbound.Id, bench.query, 50, bench.offset)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if len(items) == 0 || total == 0 {
+					b.Fatalf("the page has %d of %d clients", len(items), total)
+				}
+			}
+		})
+	}
+}
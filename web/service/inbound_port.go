@@ -0,0 +1,144 @@
+package service
+
+import (
+	"crypto/rand"
+	"math/big"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"x-ui/database/model"
+	"x-ui/util/common"
+)
+
+const (
+	// randomPortAttempts bounds the random ports tried before giving up
+	randomPortAttempts = 100
+	// portReservationTTL is how long a port handed out by GetFreePorts is kept
+	// from other callers, to create the inbound on it
+	portReservationTTL = 2 * time.Minute
+	// MaxFreePorts is the most ports GetFreePorts hands out at once
+	MaxFreePorts = 20
+)
+
+var (
+	portReservationsMu sync.Mutex
+	portReservations   = map[int]time.Time{}
+)
+
+// portBindable tells whether no other program listens on port, for TCP and UDP.
+func portBindable(listen string, port int) bool {
+	// Fallbacks and unix sockets don't bind the address themselves
+	host := listen
+	if net.ParseIP(host) == nil {
+		host = ""
+	}
+	address := net.JoinHostPort(host, strconv.Itoa(port))
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return false
+	}
+	l.Close()
+	pc, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return false
+	}
+	pc.Close()
+	return true
+}
+
+// checkInboundPorts checks the port or port range of an inbound, and tells
+// whether an inbound other than ignoreId listens on one of its ports. A range
+// can't take the port of the panel or the subscription server either.
+func (s *InboundService) checkInboundPorts(inbound *model.Inbound, ignoreId int) (bool, error) {
+	if inbound.Port < 1 || inbound.Port > 65535 {
+		return false, common.NewError("invalid port:", inbound.Port)
+	}
+	if inbound.PortEnd != 0 && (inbound.PortEnd <= inbound.Port || inbound.PortEnd > 65535) {
+		return false, common.NewErrorf("invalid port range %d-%d", inbound.Port, inbound.PortEnd)
+	}
+	start, end := inbound.PortRange()
+	if start != end {
+		if used, err := s.panelPortIn(start, end); err != nil || used {
+			return used, err
+		}
+	}
+	return s.checkPortExist(inbound.Listen, start, end, ignoreId)
+}
+
+// randomFreePort picks a random port of the range of the settings that is
+// neither taken, reserved nor bound by another program, and reserves it. The
+// caller holds portReservationsMu.
+func (s *InboundService) randomFreePort(listen string) (int, error) {
+	first, err := s.settingService.GetRandomPortMin()
+	if err != nil {
+		return 0, err
+	}
+	last, err := s.settingService.GetRandomPortMax()
+	if err != nil {
+		return 0, err
+	}
+	if first <= 0 || last > 65535 || first > last {
+		return 0, common.NewErrorf("random port range %d-%d is not valid", first, last)
+	}
+
+	now := time.Now()
+	for port, expiry := range portReservations {
+		if now.After(expiry) {
+			delete(portReservations, port)
+		}
+	}
+	for range randomPortAttempts {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(last-first+1)))
+		if err != nil {
+			return 0, err
+		}
+		port := first + int(n.Int64())
+		if _, ok := portReservations[port]; ok {
+			continue
+		}
+		taken, err := s.portTaken(listen, port, port)
+		if err != nil {
+			return 0, err
+		}
+		if taken || !portBindable(listen, port) {
+			continue
+		}
+		portReservations[port] = now.Add(portReservationTTL)
+		return port, nil
+	}
+	return 0, common.NewErrorf("no free port found in %d-%d after %d attempts", first, last, randomPortAttempts)
+}
+
+// GetFreePorts returns count random free ports for inbounds on listen. They are
+// reserved for a short while, so that concurrent calls and inbounds created
+// with a random port don't get them.
+func (s *InboundService) GetFreePorts(listen string, count int) ([]int, error) {
+	if count < 1 || count > MaxFreePorts {
+		return nil, common.NewErrorf("count must be between 1 and %d", MaxFreePorts)
+	}
+	portReservationsMu.Lock()
+	defer portReservationsMu.Unlock()
+
+	ports := make([]int, 0, count)
+	for len(ports) < count {
+		port, err := s.randomFreePort(listen)
+		if err != nil {
+			for _, port := range ports {
+				delete(portReservations, port)
+			}
+			return nil, err
+		}
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
+
+// pickRandomPort reserves a random free port for an inbound created without
+// one.
+func (s *InboundService) pickRandomPort(listen string) (int, error) {
+	portReservationsMu.Lock()
+	defer portReservationsMu.Unlock()
+	return s.randomFreePort(listen)
+}
@@ -0,0 +1,399 @@
+package service
+
+import (
+	"slices"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/web/entity"
+
+	"github.com/goccy/go-json"
+	"github.com/robfig/cron/v3"
+)
+
+const (
+	// maxScheduleWindows is how many windows a schedule takes
+	maxScheduleWindows = 32
+	// maxScheduleBoundaries is how many starts and ends of windows are looked
+	// through for the next transition, past which a schedule never switches
+	maxScheduleBoundaries = 1000
+	// spanDays is how many days ahead the starts and ends of the weekly windows
+	// are looked for, a week and the window crossing midnight
+	spanDays = 8
+)
+
+// ScheduleTransition is an inbound a schedule switched on or off.
+type ScheduleTransition struct {
+	InboundId int    `json:"inboundId"`
+	Tag       string `json:"tag"`
+	Enable    bool   `json:"enable"`
+}
+
+// scheduleWindow is a window of a schedule, parsed.
+type scheduleWindow struct {
+	days   [7]bool
+	start  int // minutes into the day
+	end    int
+	cron   cron.Schedule
+	length time.Duration
+}
+
+// compiledSchedule is a schedule, parsed.
+type compiledSchedule struct {
+	off     bool
+	windows []scheduleWindow
+}
+
+// compileSchedule parses and checks schedule.
+func compileSchedule(schedule *model.InboundSchedule) (*compiledSchedule, error) {
+	if schedule.Mode != model.ScheduleModeOn && schedule.Mode != model.ScheduleModeOff {
+		return nil, common.NewErrorf("the schedule mode %q must be %s or %s", schedule.Mode, model.ScheduleModeOn, model.ScheduleModeOff)
+	}
+	if len(schedule.Windows) == 0 {
+		return nil, common.NewError("the schedule has no windows")
+	}
+	if len(schedule.Windows) > maxScheduleWindows {
+		return nil, common.NewErrorf("a schedule takes at most %d windows", maxScheduleWindows)
+	}
+	compiled := &compiledSchedule{off: schedule.Mode == model.ScheduleModeOff}
+	for i, window := range schedule.Windows {
+		parsed := scheduleWindow{}
+		if window.Cron != "" {
+			if window.Start != "" || window.End != "" || len(window.Days) > 0 {
+				return nil, common.NewErrorf("schedule window %d has a cron spec and times of the week", i+1)
+			}
+			spec, err := entity.CronParser.Parse(window.Cron)
+			if err != nil {
+				return nil, common.NewErrorf("schedule window %d: the cron spec %q: %v", i+1, window.Cron, err)
+			}
+			if window.Minutes < 1 || window.Minutes > 7*24*60 {
+				return nil, common.NewErrorf("schedule window %d must last between 1 and %d minutes", i+1, 7*24*60)
+			}
+			parsed.cron, parsed.length = spec, time.Duration(window.Minutes)*time.Minute
+			compiled.windows = append(compiled.windows, parsed)
+			continue
+		}
+		if window.Minutes != 0 {
+			return nil, common.NewErrorf("schedule window %d lasts from its start to its end, minutes are for cron specs", i+1)
+		}
+		start, err1 := time.Parse("15:04", window.Start)
+		end, err2 := time.Parse("15:04", window.End)
+		if err1 != nil || err2 != nil {
+			return nil, common.NewErrorf("schedule window %d needs a start and an end like 08:30", i+1)
+		}
+		parsed.start = start.Hour()*60 + start.Minute()
+		parsed.end = end.Hour()*60 + end.Minute()
+		for _, day := range window.Days {
+			if day < 0 || day > 6 {
+				return nil, common.NewErrorf("schedule window %d: the day %d must be between 0 (Sunday) and 6", i+1, day)
+			}
+			parsed.days[day] = true
+		}
+		if len(window.Days) == 0 {
+			parsed.days = [7]bool{true, true, true, true, true, true, true}
+		}
+		compiled.windows = append(compiled.windows, parsed)
+	}
+	return compiled, nil
+}
+
+// normalizeSchedule checks schedule and puts it in order: the mode defaults to
+// on and the days of the windows are sorted. A schedule that never switches
+// the inbound is refused, as the inbound would be always on or always off.
+func normalizeSchedule(schedule *model.InboundSchedule) (*model.InboundSchedule, error) {
+	if schedule == nil {
+		return nil, nil
+	}
+	normalized := &model.InboundSchedule{Mode: schedule.Mode, Windows: make([]model.ScheduleWindow, 0, len(schedule.Windows))}
+	if normalized.Mode == "" {
+		normalized.Mode = model.ScheduleModeOn
+	}
+	for _, window := range schedule.Windows {
+		days := slices.Clone(window.Days)
+		slices.Sort(days)
+		window.Days = slices.Compact(days)
+		normalized.Windows = append(normalized.Windows, window)
+	}
+	compiled, err := compileSchedule(normalized)
+	if err != nil {
+		return nil, err
+	}
+	if compiled.next(time.Now()).IsZero() {
+		return nil, common.NewError("the schedule never switches the inbound, its windows leave no time out")
+	}
+	return normalized, nil
+}
+
+// span returns the window that starts offset days from the day of t, if it
+// is on on that day.
+func (w scheduleWindow) span(t time.Time, offset int) (time.Time, time.Time, bool) {
+	year, month, day := t.Date()
+	date := time.Date(year, month, day+offset, 0, 0, 0, 0, t.Location())
+	if !w.days[date.Weekday()] {
+		return time.Time{}, time.Time{}, false
+	}
+	endDay := day + offset
+	if w.end <= w.start {
+		endDay++
+	}
+	start := time.Date(year, month, day+offset, w.start/60, w.start%60, 0, 0, t.Location())
+	end := time.Date(year, month, endDay, w.end/60, w.end%60, 0, 0, t.Location())
+	return start, end, true
+}
+
+// open tells whether t falls in the window.
+func (w scheduleWindow) open(t time.Time) bool {
+	if w.cron != nil {
+		// A window is open if the spec fired within its length before t
+		return !w.cron.Next(t.Add(-w.length)).After(t)
+	}
+	for _, offset := range []int{-1, 0} {
+		start, end, ok := w.span(t, offset)
+		if ok && !t.Before(start) && t.Before(end) {
+			return true
+		}
+	}
+	return false
+}
+
+// boundary returns the first start or end of the window after t, zero if it
+// has none.
+func (w scheduleWindow) boundary(t time.Time) time.Time {
+	var next time.Time
+	earlier := func(candidate time.Time) {
+		if !candidate.IsZero() && candidate.After(t) && (next.IsZero() || candidate.Before(next)) {
+			next = candidate
+		}
+	}
+	if w.cron != nil {
+		earlier(w.cron.Next(t))
+		if first := w.cron.Next(t.Add(-w.length)); !first.After(t) {
+			earlier(first.Add(w.length))
+		}
+		return next
+	}
+	for offset := -1; offset <= spanDays; offset++ {
+		if start, end, ok := w.span(t, offset); ok {
+			earlier(start)
+			earlier(end)
+		}
+	}
+	return next
+}
+
+// on tells whether the schedule has the inbound on at t.
+func (c *compiledSchedule) on(t time.Time) bool {
+	open := slices.ContainsFunc(c.windows, func(w scheduleWindow) bool {
+		return w.open(t)
+	})
+	return open != c.off
+}
+
+// next returns when the schedule next switches the inbound after now, zero if
+// it never does.
+func (c *compiledSchedule) next(now time.Time) time.Time {
+	on := c.on(now)
+	t := now
+	for range maxScheduleBoundaries {
+		var next time.Time
+		for _, w := range c.windows {
+			if boundary := w.boundary(t); !boundary.IsZero() && (next.IsZero() || boundary.Before(next)) {
+				next = boundary
+			}
+		}
+		if next.IsZero() || c.on(next) != on {
+			return next
+		}
+		t = next
+	}
+	return time.Time{}
+}
+
+// scheduleNow returns the time in the time zone of the panel, which the
+// schedules are in.
+func (s *InboundService) scheduleNow() time.Time {
+	loc, err := s.settingService.GetTimeLocation()
+	if err != nil {
+		logger.Warning("Unable to get the time zone of the inbound schedules:", err)
+		loc = time.Local
+	}
+	return time.Now().In(loc)
+}
+
+// setScheduleStates fills in the ScheduleState of the scheduled inbounds.
+func (s *InboundService) setScheduleStates(inbounds ...*model.Inbound) {
+	var now time.Time
+	for _, inbound := range inbounds {
+		if inbound.Schedule == nil {
+			continue
+		}
+		schedule, err := compileSchedule(inbound.Schedule)
+		if err != nil {
+			continue
+		}
+		if now.IsZero() {
+			now = s.scheduleNow()
+		}
+		state := &model.InboundScheduleState{
+			On:         schedule.on(now),
+			Overridden: inbound.ScheduleOverride > now.UnixMilli(),
+		}
+		if next := schedule.next(now); !next.IsZero() {
+			state.NextTransition = next.UnixMilli()
+		}
+		inbound.ScheduleState = state
+	}
+}
+
+// scheduleOverride returns until when a manual switch of a scheduled inbound
+// to enable holds: until the next transition of the schedule, or not at all if
+// the schedule has the inbound so anyway.
+func (s *InboundService) scheduleOverride(schedule *model.InboundSchedule, enable bool) int64 {
+	compiled, err := compileSchedule(schedule)
+	if err != nil {
+		return 0
+	}
+	now := s.scheduleNow()
+	next := compiled.next(now)
+	if compiled.on(now) == enable || next.IsZero() {
+		return 0
+	}
+	return next.UnixMilli()
+}
+
+// inboundFinished tells whether inbound is out of traffic or expired, which a
+// schedule doesn't enable it over.
+func inboundFinished(inbound *model.Inbound, now int64) bool {
+	return (inbound.Total > 0 && inbound.Up+inbound.Down >= inbound.Total) ||
+		(inbound.ExpiryTime > 0 && inbound.ExpiryTime <= now)
+}
+
+// SetInboundSchedule sets the schedule of an inbound and switches it to the
+// state the schedule has it in now, with no manual override. A nil schedule
+// deletes it, and the inbound is enabled again.
+func (s *InboundService) SetInboundSchedule(id int, schedule *model.InboundSchedule) (*model.Inbound, bool, error) {
+	schedule, err := normalizeSchedule(schedule)
+	if err != nil {
+		return nil, false, err
+	}
+	inbound, err := s.GetInbound(id)
+	if err != nil {
+		return nil, false, err
+	}
+	inbound.Schedule = schedule
+	inbound.ScheduleOverride = 0
+	err = database.GetDB().Model(inbound).Select("schedule", "schedule_override").Updates(inbound).Error
+	if err != nil {
+		return nil, false, err
+	}
+
+	enable := true
+	if schedule != nil {
+		compiled, err := compileSchedule(schedule)
+		if err != nil {
+			return nil, false, err
+		}
+		enable = compiled.on(s.scheduleNow())
+	}
+	needRestart := false
+	if enable != inbound.Enable && (!enable || !inboundFinished(inbound, time.Now().UnixMilli())) {
+		needRestart, err = s.switchInbound(inbound, enable)
+	}
+	s.setScheduleStates(inbound)
+	return inbound, needRestart, err
+}
+
+// RunSchedules switches the scheduled inbounds to the state their schedule
+// has them in now. The manual overrides hold until they end, and the inbounds
+// out of traffic or expired are not enabled.
+func (s *InboundService) RunSchedules() ([]ScheduleTransition, bool, error) {
+	var inbounds []*model.Inbound
+	db := database.GetDB()
+	err := db.Model(model.Inbound{}).
+		Select("id", "tag", "enable", "up", "down", "total", "expiry_time", "schedule", "schedule_override").
+		Find(&inbounds).Error
+	if err != nil {
+		return nil, false, err
+	}
+	now := s.scheduleNow()
+	transitions := make([]ScheduleTransition, 0)
+	needRestart := false
+	for _, inbound := range inbounds {
+		if inbound.Schedule == nil || inbound.ScheduleOverride > now.UnixMilli() {
+			continue
+		}
+		if inbound.ScheduleOverride != 0 {
+			if err := db.Model(inbound).Update("schedule_override", 0).Error; err != nil {
+				return transitions, needRestart, err
+			}
+		}
+		schedule, err := compileSchedule(inbound.Schedule)
+		if err != nil {
+			logger.Warning("Invalid schedule of inbound", inbound.Tag, ":", err)
+			continue
+		}
+		enable := schedule.on(now)
+		if enable == inbound.Enable || (enable && inboundFinished(inbound, now.UnixMilli())) {
+			continue
+		}
+		restart, err := s.switchInbound(inbound, enable)
+		if err != nil {
+			return transitions, needRestart, err
+		}
+		needRestart = needRestart || restart
+		transitions = append(transitions, ScheduleTransition{InboundId: inbound.Id, Tag: inbound.Tag, Enable: enable})
+	}
+	return transitions, needRestart, nil
+}
+
+// switchInbound enables or disables an inbound, in the database and in Xray
+// through the API. It returns whether Xray needs a restart instead.
+func (s *InboundService) switchInbound(inbound *model.Inbound, enable bool) (bool, error) {
+	err := database.GetDB().Model(model.Inbound{}).Where("id = ?", inbound.Id).Update("enable", enable).Error
+	if err != nil {
+		return false, err
+	}
+	inbound.Enable = enable
+
+	var inboundJson []byte
+	if enable {
+		// The config of the inbound as a restart would give it to Xray, with
+		// only its enabled clients
+		var xrayService XrayService
+		config, err := xrayService.GetXrayConfig()
+		if err != nil {
+			return true, nil
+		}
+		for _, inboundConfig := range config.InboundConfigs {
+			if inboundConfig.Tag == inbound.Tag {
+				inboundJson, err = json.Marshal(inboundConfig)
+				if err != nil {
+					return true, nil
+				}
+			}
+		}
+		if inboundJson == nil {
+			return true, nil
+		}
+	}
+
+	s.muXray.Lock()
+	defer s.muXray.Unlock()
+	if s.initXrayAPI() != nil {
+		return true, nil
+	}
+	defer s.xrayApi.Close()
+	if enable {
+		err = s.xrayApi.AddInbound(inboundJson)
+	} else {
+		err = s.xrayApi.DelInbound(inbound.Tag)
+	}
+	if err != nil {
+		logger.Debug("Unable to switch inbound", inbound.Tag, "by api:", err)
+		return true, nil
+	}
+	return false, nil
+}
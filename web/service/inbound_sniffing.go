@@ -0,0 +1,93 @@
+package service
+
+import (
+	"slices"
+	"strings"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/common"
+
+	"github.com/goccy/go-json"
+)
+
+// sniffingDestOverrides are the protocols Xray sniffs.
+var sniffingDestOverrides = map[string]bool{
+	"http":           true,
+	"tls":            true,
+	"quic":           true,
+	"fakedns":        true,
+	"fakedns+others": true,
+}
+
+// emptySniffing is the sniffing of inbounds saved without one, off.
+func emptySniffing() model.Sniffing {
+	return model.Sniffing{DestOverride: []string{"http", "tls", "quic", "fakedns"}}
+}
+
+// normalizeSniffing checks the sniffing of an inbound and writes it the way the
+// panel does, with every field. The fields left out are the default ones.
+func normalizeSniffing(sniffing string) (string, error) {
+	parsed := emptySniffing()
+	if strings.TrimSpace(sniffing) != "" {
+		if err := json.Unmarshal([]byte(sniffing), &parsed); err != nil {
+			return "", common.NewErrorf("sniffing: %v", err)
+		}
+	}
+
+	destOverride := make([]string, 0, len(parsed.DestOverride))
+	for _, protocol := range parsed.DestOverride {
+		protocol = strings.ToLower(strings.TrimSpace(protocol))
+		if !sniffingDestOverrides[protocol] {
+			return "", common.NewErrorf("sniffing.destOverride: unknown protocol %q", protocol)
+		}
+		if !slices.Contains(destOverride, protocol) {
+			destOverride = append(destOverride, protocol)
+		}
+	}
+	parsed.DestOverride = destOverride
+	if parsed.Enabled && len(destOverride) == 0 {
+		return "", common.NewError("sniffing.destOverride: can not be empty when sniffing is enabled")
+	}
+
+	domains := make([]string, 0, len(parsed.DomainsExcluded))
+	for _, domain := range parsed.DomainsExcluded {
+		if domain = strings.TrimSpace(domain); domain != "" && !slices.Contains(domains, domain) {
+			domains = append(domains, domain)
+		}
+	}
+	parsed.DomainsExcluded = domains
+
+	normalized, err := json.MarshalIndent(parsed, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(normalized), nil
+}
+
+// MigrationSniffing writes the sniffing of every inbound the way the panel does,
+// giving the inbounds saved with an empty or partial one every field.
+func (s *InboundService) MigrationSniffing() {
+	db := database.GetDB()
+	var inbounds []*model.Inbound
+	if err := db.Model(model.Inbound{}).Select("id", "sniffing").Find(&inbounds).Error; err != nil {
+		logger.Warning("Error in migrating sniffing:", err)
+		return
+	}
+	for _, inbound := range inbounds {
+		sniffing, err := normalizeSniffing(inbound.Sniffing)
+		if err != nil {
+			logger.Warningf("Invalid sniffing of inbound %d: %v", inbound.Id, err)
+			continue
+		}
+		if sniffing == inbound.Sniffing {
+			continue
+		}
+		err = db.Model(model.Inbound{}).Where("id = ?", inbound.Id).Update("sniffing", sniffing).Error
+		if err != nil {
+			logger.Warning("Error in migrating sniffing:", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/util/common"
+
+	"github.com/goccy/go-json"
+)
+
+const (
+	inboundTemplateMaxName = 64
+
+	defaultSniffing = `{"enabled":false,"destOverride":["http","tls","quic","fakedns"],"metadataOnly":false,"routeOnly":false}`
+	defaultAllocate = `{"strategy":"always","refresh":5,"concurrency":3}`
+)
+
+// builtinInboundTemplates are offered on every panel. They can be used and
+// cloned, but not changed or deleted. The TLS ones take the certificate of the
+// panel, the Reality one gets its keys when an inbound is created from it.
+var builtinInboundTemplates = []model.InboundTemplate{
+	{
+		Id:         -1,
+		Name:       "vless-reality-vision",
+		NewReality: true,
+		Protocol:   model.VLESS,
+		Settings:   `{"clients":[],"decryption":"none","fallbacks":[]}`,
+		StreamSettings: `{"network":"tcp","security":"reality","externalProxy":[],
+			"realitySettings":{"show":false,"xver":0,"dest":"yahoo.com:443","serverNames":["yahoo.com","www.yahoo.com"],
+			"privateKey":"","minClientVer":"","maxClientVer":"","maxTimediff":0,"shortIds":[],
+			"settings":{"publicKey":"","fingerprint":"chrome","serverName":"","spiderX":"/"}},
+			"tcpSettings":{"acceptProxyProtocol":false,"header":{"type":"none"}}}`,
+		Sniffing: `{"enabled":true,"destOverride":["http","tls","quic","fakedns"],"metadataOnly":false,"routeOnly":false}`,
+		Allocate: defaultAllocate,
+	},
+	{
+		Id:       -2,
+		Name:     "vmess-ws-tls",
+		Protocol: model.VMESS,
+		Settings: `{"clients":[]}`,
+		StreamSettings: `{"network":"ws","security":"tls","externalProxy":[],
+			"tlsSettings":{"serverName":"","minVersion":"1.2","maxVersion":"1.3","cipherSuites":"","rejectUnknownSni":false,
+			"certificates":[{"certificateFile":"","keyFile":"","ocspStapling":3600}],"alpn":["http/1.1"],
+			"settings":{"allowInsecure":false,"fingerprint":"chrome"}},
+			"wsSettings":{"acceptProxyProtocol":false,"path":"/","host":"","headers":{}}}`,
+		Sniffing: defaultSniffing,
+		Allocate: defaultAllocate,
+	},
+	{
+		Id:       -3,
+		Name:     "trojan-tcp-tls",
+		Protocol: model.Trojan,
+		Settings: `{"clients":[],"fallbacks":[]}`,
+		StreamSettings: `{"network":"tcp","security":"tls","externalProxy":[],
+			"tlsSettings":{"serverName":"","minVersion":"1.2","maxVersion":"1.3","cipherSuites":"","rejectUnknownSni":false,
+			"certificates":[{"certificateFile":"","keyFile":"","ocspStapling":3600}],"alpn":["h2","http/1.1"],
+			"settings":{"allowInsecure":false,"fingerprint":"chrome"}},
+			"tcpSettings":{"acceptProxyProtocol":false,"header":{"type":"none"}}}`,
+		Sniffing: defaultSniffing,
+		Allocate: defaultAllocate,
+	},
+}
+
+func init() {
+	// The built-in stream settings are wrapped for reading
+	for i := range builtinInboundTemplates {
+		var stream bytes.Buffer
+		if err := json.Compact(&stream, []byte(builtinInboundTemplates[i].StreamSettings)); err != nil {
+			panic(err)
+		}
+		builtinInboundTemplates[i].StreamSettings = stream.String()
+	}
+}
+
+// InboundTemplateService manages the templates inbounds are created from.
+type InboundTemplateService struct {
+	inboundService InboundService
+	settingService SettingService
+}
+
+// GetTemplates returns the built-in templates, then the saved ones.
+func (s *InboundTemplateService) GetTemplates() ([]model.InboundTemplate, error) {
+	var saved []model.InboundTemplate
+	if err := database.GetDB().Order("id").Find(&saved).Error; err != nil {
+		return nil, err
+	}
+	templates := make([]model.InboundTemplate, 0, len(builtinInboundTemplates)+len(saved))
+	for _, template := range builtinInboundTemplates {
+		template.Builtin = true
+		templates = append(templates, template)
+	}
+	return append(templates, saved...), nil
+}
+
+func (s *InboundTemplateService) GetTemplate(id int) (*model.InboundTemplate, error) {
+	for _, template := range builtinInboundTemplates {
+		if template.Id == id {
+			template.Builtin = true
+			return &template, nil
+		}
+	}
+	template := &model.InboundTemplate{}
+	if err := database.GetDB().First(template, id).Error; err != nil {
+		if database.IsNotFound(err) {
+			return nil, common.NewError("inbound template not found:", id)
+		}
+		return nil, err
+	}
+	return template, nil
+}
+
+func (s *InboundTemplateService) checkName(name string) error {
+	if name == "" {
+		return common.NewError("template name can not be empty")
+	}
+	if len([]rune(name)) > inboundTemplateMaxName {
+		return common.NewErrorf("template name is longer than %d characters", inboundTemplateMaxName)
+	}
+	for _, template := range builtinInboundTemplates {
+		if strings.EqualFold(template.Name, name) {
+			return common.NewError("template name already used:", name)
+		}
+	}
+	var count int64
+	err := database.GetDB().Model(model.InboundTemplate{}).Where("LOWER(name) = LOWER(?)", name).Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return common.NewError("template name already used:", name)
+	}
+	return nil
+}
+
+// SaveTemplate stores template under its name, taking the inbound inboundId
+// unless it is 0. The clients are left out.
+func (s *InboundTemplateService) SaveTemplate(template *model.InboundTemplate, inboundId int) (*model.InboundTemplate, error) {
+	template.Name = strings.TrimSpace(template.Name)
+	if err := s.checkName(template.Name); err != nil {
+		return nil, err
+	}
+	if inboundId > 0 {
+		inbound, err := s.inboundService.GetInbound(inboundId)
+		if err != nil {
+			return nil, err
+		}
+		template.Listen = inbound.Listen
+		template.Protocol = inbound.Protocol
+		template.Settings = inbound.Settings
+		template.StreamSettings = inbound.StreamSettings
+		template.Sniffing = inbound.Sniffing
+		template.Allocate = inbound.Allocate
+		template.RemarkTemplate = inbound.RemarkTemplate
+	}
+	switch template.Protocol {
+	case model.VMESS, model.VLESS, model.Trojan, model.Shadowsocks, model.DOKODEMO,
+		model.Socks, model.HTTP, model.WireGuard:
+	default:
+		return nil, common.NewError("unknown protocol:", template.Protocol)
+	}
+
+	var settings map[string]any
+	if err := json.Unmarshal([]byte(template.Settings), &settings); err != nil || settings == nil {
+		return nil, common.NewError("settings must be an object")
+	}
+	if _, ok := settings["clients"]; ok {
+		settings["clients"] = []any{}
+	}
+	newSettings, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	template.Settings = string(newSettings)
+	for name, value := range map[string]string{
+		"streamSettings": template.StreamSettings,
+		"sniffing":       template.Sniffing,
+		"allocate":       template.Allocate,
+	} {
+		var object map[string]any
+		if strings.TrimSpace(value) != "" && (json.Unmarshal([]byte(value), &object) != nil || object == nil) {
+			return nil, common.NewErrorf("%s must be an object", name)
+		}
+	}
+
+	template.Id = 0
+	template.Builtin = false
+	template.CreatedAt = time.Now().UnixMilli()
+	if err := database.GetDB().Create(template).Error; err != nil {
+		return nil, err
+	}
+	return template, nil
+}
+
+// CloneTemplate saves a copy of a template, the only way to change a built-in
+// one. name defaults to the name of the template with " (copy)".
+func (s *InboundTemplateService) CloneTemplate(id int, name string) (*model.InboundTemplate, error) {
+	template, err := s.GetTemplate(id)
+	if err != nil {
+		return nil, err
+	}
+	if name = strings.TrimSpace(name); name == "" {
+		name = template.Name + " (copy)"
+		for n := 2; s.checkName(name) != nil; n++ {
+			name = fmt.Sprintf("%s (copy %d)", template.Name, n)
+		}
+	}
+	template.Name = name
+	return s.SaveTemplate(template, 0)
+}
+
+func (s *InboundTemplateService) DelTemplate(id int) error {
+	template, err := s.GetTemplate(id)
+	if err != nil {
+		return err
+	}
+	if template.Builtin {
+		return common.NewError("built-in templates can not be deleted:", template.Name)
+	}
+	return database.GetDB().Delete(model.InboundTemplate{}, id).Error
+}
+
+// ApplyTemplate fills in an inbound to create from its template. The fields set
+// on the inbound override the template; of the settings, each key does, so
+// that the initial clients can be given. A Reality inbound gets a new key pair
+// if the template asks for it or has none, and TLS without a certificate gets
+// the one of the panel.
+func (s *InboundTemplateService) ApplyTemplate(inbound *model.Inbound) error {
+	template, err := s.GetTemplate(inbound.TemplateId)
+	if err != nil {
+		return err
+	}
+	if inbound.Protocol != "" && inbound.Protocol != template.Protocol {
+		return common.NewErrorf("the template is for %s, not %s", template.Protocol, inbound.Protocol)
+	}
+	inbound.Protocol = template.Protocol
+	if inbound.Remark == "" {
+		inbound.Remark = template.Name
+	}
+	if inbound.Listen == "" {
+		inbound.Listen = template.Listen
+	}
+	if inbound.RemarkTemplate == "" {
+		inbound.RemarkTemplate = template.RemarkTemplate
+	}
+	if inbound.Sniffing == "" {
+		inbound.Sniffing = template.Sniffing
+	}
+	if inbound.Allocate == "" {
+		inbound.Allocate = template.Allocate
+	}
+
+	var settings map[string]any
+	if err := json.Unmarshal([]byte(template.Settings), &settings); err != nil {
+		return err
+	}
+	if inbound.Settings != "" {
+		var overrides map[string]any
+		if err := json.Unmarshal([]byte(inbound.Settings), &overrides); err != nil {
+			return common.NewError("settings must be an object")
+		}
+		for key, value := range overrides {
+			settings[key] = value
+		}
+	}
+	newSettings, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return err
+	}
+	inbound.Settings = string(newSettings)
+
+	if inbound.StreamSettings != "" || template.StreamSettings == "" {
+		return nil
+	}
+	var stream map[string]any
+	if err := json.Unmarshal([]byte(template.StreamSettings), &stream); err != nil {
+		return err
+	}
+	if reality, ok := stream["realitySettings"].(map[string]any); ok && stream["security"] == "reality" {
+		if key, _ := reality["privateKey"].(string); template.NewReality || key == "" {
+			if err := newReality(stream); err != nil {
+				return err
+			}
+		}
+	}
+	if tls, ok := stream["tlsSettings"].(map[string]any); ok && stream["security"] == "tls" {
+		certFile, _ := s.settingService.GetCertFile()
+		keyFile, _ := s.settingService.GetKeyFile()
+		certificates, _ := tls["certificates"].([]any)
+		for _, item := range certificates {
+			certificate, _ := item.(map[string]any)
+			if file, _ := certificate["certificateFile"].(string); certificate != nil && file == "" && certificate["certificate"] == nil {
+				certificate["certificateFile"] = certFile
+				certificate["keyFile"] = keyFile
+			}
+		}
+	}
+	newStream, err := json.MarshalIndent(stream, "", "  ")
+	if err != nil {
+		return err
+	}
+	inbound.StreamSettings = string(newStream)
+	return nil
+}
@@ -0,0 +1,150 @@
+package service
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/xray"
+
+	"gorm.io/gorm"
+)
+
+// trafficTestDB opens an empty database with an inbound of a client and an
+// inbound without clients, returning them.
+func trafficTestDB(t *testing.T) (*model.Inbound, *model.Inbound) {
+	t.Helper()
+	withClient := &model.Inbound{
+		Remark: "vless", Enable: true, Port: 20001, Protocol: model.VLESS, Tag: "inbound-20001",
+		Settings: `{"clients":[{"id":"6b6f3c2e-8f0b-4c3a-9a57-0c5d42d3a0f1","email":"alice","enable":true}],"decryption":"none"}`,
+	}
+	noClients := &model.Inbound{
+		Remark: "dns", Enable: true, Port: 20002, Protocol: model.DOKODEMO, Tag: "inbound-20002",
+		Settings: `{"address":"1.1.1.1","port":53,"network":"tcp,udp"}`,
+	}
+	newTestDB(t, seedInbounds(withClient, noClients), func(db *gorm.DB) error {
+		return db.Create(&xray.ClientTraffic{InboundId: withClient.Id, Enable: true, Email: "alice"}).Error
+	})
+	return withClient, noClients
+}
+
+func reloadInbound(t *testing.T, inbound *model.Inbound) *model.Inbound {
+	t.Helper()
+	var reloaded model.Inbound
+	if err := database.GetDB().First(&reloaded, inbound.Id).Error; err != nil {
+		t.Fatal(err)
+	}
+	return &reloaded
+}
+
+func TestInboundTrafficIsNotCountedTwice(t *testing.T) {
+	withClient, noClients := trafficTestDB(t)
+	var s InboundService
+
+	// Xray counts the traffic of the client within that of its inbound
+	err, _ := s.AddTraffic([]*xray.Traffic{
+		{IsInbound: true, Tag: withClient.Tag, Up: 100, Down: 1000},
+		{IsInbound: true, Tag: noClients.Tag, Up: 20, Down: 200},
+		{IsOutbound: true, Tag: "direct", Up: 120, Down: 1200},
+	}, []*xray.ClientTraffic{
+		{Email: "alice", Up: 100, Down: 1000},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.FlushTraffic(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []struct {
+		inbound  *model.Inbound
+		up, down int64
+	}{{withClient, 100, 1000}, {noClients, 20, 200}} {
+		got := reloadInbound(t, want.inbound)
+		if got.Up != want.up || got.Down != want.down {
+			t.Errorf("inbound %s has %d/%d, want %d/%d", got.Tag, got.Up, got.Down, want.up, want.down)
+		}
+	}
+	var client xray.ClientTraffic
+	if err := database.GetDB().Where("email = ?", "alice").First(&client).Error; err != nil {
+		t.Fatal(err)
+	}
+	if client.Up != 100 || client.Down != 1000 {
+		t.Errorf("client has %d/%d, want 100/1000", client.Up, client.Down)
+	}
+	// The panel total is the sum of the inbounds, without the clients or the
+	// outbounds counted again
+	total, err := panelTrafficSince(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 1320 {
+		t.Errorf("panel traffic is %d, want 1320", total)
+	}
+}
+
+func TestInboundWithoutClientsIsDisabledOverQuota(t *testing.T) {
+	_, noClients := trafficTestDB(t)
+	if err := database.GetDB().Model(noClients).Update("total", 100).Error; err != nil {
+		t.Fatal(err)
+	}
+	var s InboundService
+
+	err, _ := s.AddTraffic([]*xray.Traffic{{IsInbound: true, Tag: noClients.Tag, Up: 10, Down: 50}}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reloadInbound(t, noClients).Enable {
+		t.Fatal("the inbound was disabled under its quota")
+	}
+	// Reaching the quota flushes at once, without waiting for the interval
+	err, _ = s.AddTraffic([]*xray.Traffic{{IsInbound: true, Tag: noClients.Tag, Up: 10, Down: 40}}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := reloadInbound(t, noClients)
+	if got.Up+got.Down != 110 {
+		t.Errorf("inbound has %d bytes, want 110", got.Up+got.Down)
+	}
+	if got.Enable {
+		t.Error("the inbound over its quota is still enabled")
+	}
+}
+
+func TestInboundWithoutClientsIsDisabledOnExpiry(t *testing.T) {
+	_, noClients := trafficTestDB(t)
+	expiry := time.Now().Add(-time.Minute).UnixMilli()
+	if err := database.GetDB().Model(noClients).Update("expiry_time", expiry).Error; err != nil {
+		t.Fatal(err)
+	}
+	var s InboundService
+
+	if err, _ := s.AddTraffic(nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if reloadInbound(t, noClients).Enable {
+		t.Error("the expired inbound is still enabled")
+	}
+}
+
+func TestWithInboundStats(t *testing.T) {
+	policy := []byte(`{"levels":{"0":{"statsUserUplink":true}},"system":{"statsOutboundUplink":true}}`)
+	var got map[string]any
+	if err := json.Unmarshal(withInboundStats(policy), &got); err != nil {
+		t.Fatal(err)
+	}
+	system := got["system"].(map[string]any)
+	if system["statsInboundUplink"] != true || system["statsInboundDownlink"] != true {
+		t.Errorf("inbound counters are not turned on: %v", system)
+	}
+	if system["statsOutboundUplink"] != true || got["levels"] == nil {
+		t.Errorf("the rest of the policy is lost: %v", got)
+	}
+
+	on := []byte(`{"system":{"statsInboundUplink":true,"statsInboundDownlink":true}}`)
+	if string(withInboundStats(on)) != string(on) {
+		t.Error("a policy with the counters on was changed")
+	}
+}
@@ -0,0 +1,183 @@
+package service
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+
+	"x-ui/util/common"
+
+	"github.com/goccy/go-json"
+)
+
+// transportMinVersions are the first versions of Xray that have a transport of
+// the inbounds, for the transports newer than the panel expects of any binary.
+var transportMinVersions = map[string]string{
+	"httpupgrade": "v1.8.9",
+	"xhttp":       "v24.11.30",
+}
+
+// xhttpModes are the modes an XHTTP inbound takes uploads in.
+var xhttpModes = []string{"auto", "packet-up", "stream-up", "stream-one"}
+
+// normalizeStreamSettings checks the settings of the HTTPUpgrade and XHTTP
+// transports in the stream settings of an inbound and fills in their defaults.
+// SplitHTTP, the former name of XHTTP, is renamed. The other transports are
+// left as they are.
+func normalizeStreamSettings(streamSettings string) (string, error) {
+	if strings.TrimSpace(streamSettings) == "" {
+		return streamSettings, nil
+	}
+	stream := map[string]any{}
+	if err := json.Unmarshal([]byte(streamSettings), &stream); err != nil {
+		return "", common.NewErrorf("stream settings: %v", err)
+	}
+	network, _ := stream["network"].(string)
+	if network == "splithttp" {
+		network = "xhttp"
+		stream["network"] = network
+		if _, ok := stream["xhttpSettings"]; !ok {
+			stream["xhttpSettings"] = stream["splithttpSettings"]
+		}
+		delete(stream, "splithttpSettings")
+	}
+	if _, ok := transportMinVersions[network]; !ok {
+		return streamSettings, nil
+	}
+
+	settings, ok := stream[network+"Settings"].(map[string]any)
+	if !ok {
+		if stream[network+"Settings"] != nil {
+			return "", common.NewErrorf("%sSettings must be an object", network)
+		}
+		settings = map[string]any{}
+	}
+	if err := normalizeTransportPath(network, settings); err != nil {
+		return "", err
+	}
+	if network == "xhttp" {
+		if err := normalizeXHTTPSettings(settings); err != nil {
+			return "", err
+		}
+	}
+	stream[network+"Settings"] = settings
+	if err := checkTransportVersion(network, installedXrayVersion()); err != nil {
+		return "", err
+	}
+
+	normalized, err := json.MarshalIndent(stream, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(normalized), nil
+}
+
+// normalizeTransportPath checks the path and the host of the settings of an
+// HTTP based transport; the path defaults to "/".
+func normalizeTransportPath(network string, settings map[string]any) error {
+	path, ok := settings["path"].(string)
+	if !ok && settings["path"] != nil {
+		return common.NewErrorf("%sSettings.path must be a string", network)
+	}
+	path = strings.TrimSpace(path)
+	if path == "" {
+		path = "/"
+	}
+	if !strings.HasPrefix(path, "/") {
+		return common.NewErrorf("%sSettings.path %q must start with /", network, path)
+	}
+	settings["path"] = path
+	host, ok := settings["host"].(string)
+	if !ok && settings["host"] != nil {
+		return common.NewErrorf("%sSettings.host must be a string", network)
+	}
+	host = strings.TrimSpace(host)
+	if strings.ContainsAny(host, " /") {
+		return common.NewErrorf("%sSettings.host %q is not a host name", network, host)
+	}
+	settings["host"] = host
+	return nil
+}
+
+// normalizeXHTTPSettings checks the mode, the padding and the keep-alive
+// options of the settings of an XHTTP inbound.
+func normalizeXHTTPSettings(settings map[string]any) error {
+	mode, _ := settings["mode"].(string)
+	if mode == "" {
+		mode = "auto"
+	}
+	if !slices.Contains(xhttpModes, mode) {
+		return common.NewErrorf("xhttpSettings.mode %q must be one of %s", mode, strings.Join(xhttpModes, ", "))
+	}
+	settings["mode"] = mode
+
+	// The ranges Xray takes as "min-max" strings or as single numbers
+	for _, key := range []string{"xPaddingBytes", "scMaxEachPostBytes", "scStreamUpServerSecs"} {
+		value, ok, err := xhttpRange(settings[key])
+		if err != nil {
+			return common.NewErrorf("xhttpSettings.%s %v", key, err)
+		}
+		if ok {
+			settings[key] = value
+		} else {
+			delete(settings, key)
+		}
+	}
+	if posts, ok := settings["scMaxBufferedPosts"]; ok && posts != nil {
+		number, ok := posts.(float64)
+		if !ok || number < 1 || number != float64(int64(number)) {
+			return common.NewError("xhttpSettings.scMaxBufferedPosts must be a positive whole number")
+		}
+	}
+	if noSSEHeader, ok := settings["noSSEHeader"]; ok && noSSEHeader != nil {
+		if _, ok := noSSEHeader.(bool); !ok {
+			return common.NewError("xhttpSettings.noSSEHeader must be true or false")
+		}
+	}
+	return nil
+}
+
+// xhttpRange returns an XHTTP range as a "min-max" or single number string, and
+// whether it is set at all.
+func xhttpRange(value any) (string, bool, error) {
+	var text string
+	switch value := value.(type) {
+	case nil:
+		return "", false, nil
+	case float64:
+		text = strconv.FormatFloat(value, 'f', -1, 64)
+	case string:
+		text = strings.ReplaceAll(value, " ", "")
+	default:
+		return "", false, common.NewError("must be a number or a range like 100-1000")
+	}
+	if text == "" {
+		return "", false, nil
+	}
+	low, high, isRange := strings.Cut(text, "-")
+	from, err1 := strconv.ParseUint(low, 10, 32)
+	to, err2 := from, error(nil)
+	if isRange {
+		to, err2 = strconv.ParseUint(high, 10, 32)
+	}
+	if err1 != nil || err2 != nil {
+		return "", false, common.NewErrorf("%q must be a number or a range like 100-1000", text)
+	}
+	if from > to {
+		return "", false, common.NewErrorf("%q starts after it ends", text)
+	}
+	return text, true, nil
+}
+
+// checkTransportVersion fails if the version of Xray installed is older than
+// the first one with network. An unknown version passes, Xray tells then.
+func checkTransportVersion(network string, version string) error {
+	minimum, ok := transportMinVersions[network]
+	if !ok || version == "" {
+		return nil
+	}
+	if !xrayVersionAtLeast(version, minimum) {
+		return common.NewErrorf("the %s transport needs Xray %s or later, %s is installed", network, minimum, version)
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package service
+
+import (
+	"reflect"
+	"slices"
+	"strings"
+
+	"x-ui/database/model"
+	"x-ui/util/common"
+
+	"github.com/goccy/go-json"
+)
+
+// linkFingerprints are the uTLS fingerprints links can give clients.
+var linkFingerprints = []string{"chrome", "firefox", "safari", "ios", "android", "edge", "360", "qq", "random", "randomized"}
+
+// linkALPNs are the protocols links can give clients to negotiate over TLS.
+var linkALPNs = []string{"h3", "h2", "http/1.1"}
+
+// maxWSEarlyData is the largest early data of WebSocket links can ask for.
+const maxWSEarlyData = 65536
+
+// normalizeLinkOptions checks the link options of an inbound or of a client and
+// returns them with their lists cleaned, nil if they set nothing.
+func normalizeLinkOptions(options *model.LinkOptions) (*model.LinkOptions, error) {
+	if options == nil {
+		return nil, nil
+	}
+	normalized := *options
+	if normalized.MuxConcurrency < 0 || normalized.MuxConcurrency > 1024 {
+		return nil, common.NewErrorf("the mux concurrency %d must be between 1 and 1024", normalized.MuxConcurrency)
+	}
+	normalized.ALPN = nil
+	for _, alpn := range options.ALPN {
+		alpn = strings.ToLower(strings.TrimSpace(alpn))
+		if alpn == "" || slices.Contains(normalized.ALPN, alpn) {
+			continue
+		}
+		if !slices.Contains(linkALPNs, alpn) {
+			return nil, common.NewErrorf("ALPN %q must be one of %s", alpn, strings.Join(linkALPNs, ", "))
+		}
+		normalized.ALPN = append(normalized.ALPN, alpn)
+	}
+	normalized.Fingerprint = strings.ToLower(strings.TrimSpace(normalized.Fingerprint))
+	if normalized.Fingerprint != "" && !slices.Contains(linkFingerprints, normalized.Fingerprint) {
+		return nil, common.NewErrorf("fingerprint %q must be one of %s", normalized.Fingerprint, strings.Join(linkFingerprints, ", "))
+	}
+	if normalized.WSEarlyData < 0 || normalized.WSEarlyData > maxWSEarlyData {
+		return nil, common.NewErrorf("the WebSocket early data %d must be between 1 and %d bytes", normalized.WSEarlyData, maxWSEarlyData)
+	}
+	normalized.WSEarlyDataHeader = strings.TrimSpace(normalized.WSEarlyDataHeader)
+	if normalized.WSEarlyDataHeader != "" {
+		if normalized.WSEarlyData == 0 {
+			return nil, common.NewError("the WebSocket early data header needs an early data size")
+		}
+		if strings.ContainsAny(normalized.WSEarlyDataHeader, " \t\r\n:") {
+			return nil, common.NewErrorf("the WebSocket early data header %q is not a header name", normalized.WSEarlyDataHeader)
+		}
+	}
+	if reflect.ValueOf(normalized).IsZero() {
+		return nil, nil
+	}
+	return &normalized, nil
+}
+
+// normalizeClientLinkOptions checks the link options of a client as stored in
+// the settings of an inbound, and drops them if they set nothing.
+func normalizeClientLinkOptions(client map[string]any) error {
+	data, err := json.Marshal(client["linkOptions"])
+	if err != nil {
+		return err
+	}
+	var options *model.LinkOptions
+	if err := json.Unmarshal(data, &options); err != nil {
+		return common.NewError("the link options of a client are not valid:", err)
+	}
+	if options, err = normalizeLinkOptions(options); err != nil {
+		return err
+	}
+	if options == nil {
+		delete(client, "linkOptions")
+	} else {
+		client["linkOptions"] = options
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package service
+
+import (
+	"strings"
+	"testing"
+
+	"x-ui/database/model"
+
+	"github.com/goccy/go-json"
+)
+
+func TestNormalizeLinkOptions(t *testing.T) {
+	options, err := normalizeLinkOptions(&model.LinkOptions{
+		ALPN: []string{" H2 ", "", "h2", "http/1.1"}, Fingerprint: " Chrome ", WSEarlyData: 2048, WSEarlyDataHeader: " X-Early-Data ",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(options.ALPN, ",") != "h2,http/1.1" || options.Fingerprint != "chrome" || options.WSEarlyDataHeader != "X-Early-Data" {
+		t.Errorf("the options are normalized to %+v", options)
+	}
+	// Options that set nothing are dropped
+	for _, empty := range []*model.LinkOptions{nil, {}, {ALPN: []string{" "}}} {
+		if options, err := normalizeLinkOptions(empty); options != nil || err != nil {
+			t.Errorf("%+v is normalized to %+v, %v", empty, options, err)
+		}
+	}
+
+	tests := []struct {
+		options model.LinkOptions
+		err     string
+	}{
+		{model.LinkOptions{MuxConcurrency: -1}, "mux concurrency"},
+		{model.LinkOptions{MuxConcurrency: 1025}, "mux concurrency"},
+		{model.LinkOptions{ALPN: []string{"h2", "spdy/3"}}, `ALPN "spdy/3"`},
+		{model.LinkOptions{Fingerprint: "netscape"}, `fingerprint "netscape"`},
+		{model.LinkOptions{WSEarlyData: 65537}, "early data 65537"},
+		{model.LinkOptions{WSEarlyDataHeader: "X-Early-Data"}, "needs an early data size"},
+		{model.LinkOptions{WSEarlyData: 1, WSEarlyDataHeader: "X Early"}, "not a header name"},
+	}
+	for _, test := range tests {
+		if _, err := normalizeLinkOptions(&test.options); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%+v: error %v, want %q", test.options, err, test.err)
+		}
+	}
+}
+
+func TestNormalizeClientLinkOptions(t *testing.T) {
+	settings, err := normalizeClients(`{"clients":[` +
+		`{"email":"a","linkOptions":{"fingerprint":"Safari","mux":false}},` +
+		`{"email":"b","linkOptions":{"alpn":[""]}}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parsed struct {
+		Clients []model.Client `json:"clients"`
+	}
+	if err := json.Unmarshal([]byte(settings), &parsed); err != nil {
+		t.Fatal(err)
+	}
+	a, b := parsed.Clients[0].LinkOptions, parsed.Clients[1].LinkOptions
+	if a == nil || a.Fingerprint != "safari" || a.Mux == nil || *a.Mux || b != nil {
+		t.Errorf("the link options of the clients are normalized to %+v and %+v", a, b)
+	}
+	for _, invalid := range []string{`{"fingerprint":"x"}`, `{"muxConcurrency":"8"}`, `"chrome"`} {
+		if _, err := normalizeClients(`{"clients":[{"email":"a","linkOptions":` + invalid + `}]}`); err == nil {
+			t.Errorf("the link options %s of a client were saved", invalid)
+		}
+	}
+}
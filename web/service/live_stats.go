@@ -0,0 +1,236 @@
+package service
+
+import (
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"x-ui/database"
+	"x-ui/xray"
+)
+
+// The topics of the live stats a stream subscribes to.
+const (
+	LiveStatsStatus   = "status"
+	LiveStatsInbounds = "inbounds"
+	LiveStatsOnline   = "online"
+)
+
+// LiveStatsTopics are all topics of the live stats.
+var LiveStatsTopics = []string{LiveStatsStatus, LiveStatsInbounds, LiveStatsOnline}
+
+// liveStatsPollIdle is how long the frames are still made after the last long
+// poll, for the next poll of the same client to find them
+const liveStatsPollIdle = time.Minute
+
+// InboundThroughput is the traffic of an inbound in the last run of the
+// traffic job, and its rates over the run, in bytes per second.
+type InboundThroughput struct {
+	Tag      string `json:"tag"`
+	Up       int64  `json:"up"`
+	Down     int64  `json:"down"`
+	UpRate   int64  `json:"upRate"`
+	DownRate int64  `json:"downRate"`
+}
+
+// OnlineCounts counts the clients online, in all and by the tag of their
+// inbound.
+type OnlineCounts struct {
+	Total    int            `json:"total"`
+	Inbounds map[string]int `json:"inbounds"`
+}
+
+// LiveStats is a frame of the live stats, made with every status the status
+// job takes. Seq counts the frames from 1 since the panel started.
+type LiveStats struct {
+	Seq      int64               `json:"seq"`
+	Time     int64               `json:"time"`
+	Status   *Status             `json:"status,omitempty"`
+	Inbounds []InboundThroughput `json:"inbounds,omitempty"`
+	Online   *OnlineCounts       `json:"online,omitempty"`
+}
+
+// Only returns the frame with the topics given only.
+func (l *LiveStats) Only(topics []string) *LiveStats {
+	frame := &LiveStats{Seq: l.Seq, Time: l.Time}
+	if slices.Contains(topics, LiveStatsStatus) {
+		frame.Status = l.Status
+	}
+	if slices.Contains(topics, LiveStatsInbounds) {
+		frame.Inbounds = l.Inbounds
+	}
+	if slices.Contains(topics, LiveStatsOnline) {
+		frame.Online = l.Online
+	}
+	return frame
+}
+
+// liveStatsHub keeps the last frame of the live stats for the streams and the
+// long polls. Each frame closes changed and replaces it, so the ones waiting
+// wake up and read the last frame: a slow one skips the frames in between.
+type liveStatsHub struct {
+	lock    sync.RWMutex
+	last    *LiveStats
+	changed chan struct{}
+	// streams counts the open streams, the frames are only made for someone
+	streams  int
+	polledAt time.Time
+
+	throughput []InboundThroughput
+	trafficAt  time.Time
+}
+
+var liveStats = &liveStatsHub{changed: make(chan struct{})}
+
+// recordLiveTraffic keeps the traffic of the inbounds in a run of the traffic
+// job for the live stats.
+func recordLiveTraffic(traffics []*xray.Traffic) {
+	now := time.Now()
+	byTag := map[string]*InboundThroughput{}
+	for _, traffic := range traffics {
+		if traffic == nil || !traffic.IsInbound || traffic.Tag == "api" {
+			continue
+		}
+		throughput := byTag[traffic.Tag]
+		if throughput == nil {
+			throughput = &InboundThroughput{Tag: traffic.Tag}
+			byTag[traffic.Tag] = throughput
+		}
+		throughput.Up += traffic.Up
+		throughput.Down += traffic.Down
+	}
+
+	liveStats.lock.Lock()
+	defer liveStats.lock.Unlock()
+	elapsed := now.Sub(liveStats.trafficAt).Seconds()
+	throughput := make([]InboundThroughput, 0, len(byTag))
+	for _, t := range byTag {
+		// The first run has nothing to measure the rates against
+		if !liveStats.trafficAt.IsZero() && elapsed > 0 {
+			t.UpRate = int64(float64(t.Up) / elapsed)
+			t.DownRate = int64(float64(t.Down) / elapsed)
+		}
+		throughput = append(throughput, *t)
+	}
+	sort.Slice(throughput, func(i, j int) bool { return throughput[i].Tag < throughput[j].Tag })
+	liveStats.throughput = throughput
+	liveStats.trafficAt = now
+}
+
+// liveThroughput returns the throughput of the inbound tag in the last run of
+// the traffic job, if the run measured it.
+func liveThroughput(tag string) (InboundThroughput, bool) {
+	liveStats.lock.RLock()
+	defer liveStats.lock.RUnlock()
+	for _, throughput := range liveStats.throughput {
+		if throughput.Tag == tag {
+			return throughput, true
+		}
+	}
+	return InboundThroughput{}, false
+}
+
+// publishLiveStats makes the frame of status and wakes up the streams and the
+// long polls, if there are any.
+func (s *ServerService) publishLiveStats(status *Status) {
+	liveStats.lock.RLock()
+	wanted := liveStats.streams > 0 || time.Since(liveStats.polledAt) < liveStatsPollIdle
+	liveStats.lock.RUnlock()
+	if !wanted {
+		return
+	}
+	online := s.onlineCounts()
+
+	liveStats.lock.Lock()
+	defer liveStats.lock.Unlock()
+	frame := &LiveStats{
+		Time:     status.T.UnixMilli(),
+		Status:   status,
+		Inbounds: liveStats.throughput,
+		Online:   online,
+	}
+	if liveStats.last != nil {
+		frame.Seq = liveStats.last.Seq
+	}
+	frame.Seq++
+	liveStats.last = frame
+	close(liveStats.changed)
+	liveStats.changed = make(chan struct{})
+}
+
+// onlineCounts counts the clients online by the tags of their inbounds.
+func (s *ServerService) onlineCounts() *OnlineCounts {
+	emails := s.inboundService.GetOnlineClients()
+	counts := &OnlineCounts{Total: len(emails), Inbounds: map[string]int{}}
+	if len(emails) == 0 {
+		return counts
+	}
+	var rows []struct {
+		Tag     string
+		Clients int
+	}
+	err := database.GetDB().Raw(`
+SELECT inbounds.tag, COUNT(*) AS clients
+FROM client_traffics
+	JOIN inbounds ON inbounds.id = client_traffics.inbound_id
+WHERE client_traffics.email IN ?
+GROUP BY inbounds.tag`, emails).Scan(&rows).Error
+	if err != nil {
+		return counts
+	}
+	for _, row := range rows {
+		counts.Inbounds[row.Tag] = row.Clients
+	}
+	return counts
+}
+
+// WatchLiveStats has the frames of the live stats made for a stream until
+// the function it returns is called.
+func (s *ServerService) WatchLiveStats() func() {
+	liveStats.lock.Lock()
+	liveStats.streams++
+	liveStats.lock.Unlock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			liveStats.lock.Lock()
+			liveStats.streams--
+			liveStats.lock.Unlock()
+		})
+	}
+}
+
+// NextLiveStats returns the last frame if it is newer than the frame since,
+// or nil and a channel closed once there is a newer one.
+func (s *ServerService) NextLiveStats(since int64) (*LiveStats, <-chan struct{}) {
+	liveStats.lock.RLock()
+	defer liveStats.lock.RUnlock()
+	if liveStats.last != nil && liveStats.last.Seq > since {
+		return liveStats.last, nil
+	}
+	return nil, liveStats.changed
+}
+
+// PollLiveStats waits at most timeout for a frame newer than the frame since,
+// for the clients that can't open a stream, and returns the last frame. The
+// frames are made for a while after each poll.
+func (s *ServerService) PollLiveStats(since int64, timeout time.Duration) *LiveStats {
+	liveStats.lock.Lock()
+	liveStats.polledAt = time.Now()
+	liveStats.lock.Unlock()
+
+	frame, changed := s.NextLiveStats(since)
+	if frame != nil {
+		return frame
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-changed:
+	case <-timer.C:
+	}
+	liveStats.lock.RLock()
+	defer liveStats.lock.RUnlock()
+	return liveStats.last
+}
@@ -0,0 +1,121 @@
+package service
+
+import (
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+
+	"gorm.io/gorm"
+)
+
+// LockoutService persists failed login counters per IP and username and locks the
+// pair once lockoutThreshold failures happen within lockoutWindow minutes. A
+// locked pair locks the IP for every username, so it can't go on guessing
+// other ones.
+type LockoutService struct {
+	settingService SettingService
+}
+
+// IsLocked reports whether logins from ip are currently locked and, if so,
+// until when. It is meant to be called before the password is checked.
+func (s *LockoutService) IsLocked(ip string) (bool, time.Time) {
+	threshold, err := s.settingService.GetLockoutThreshold()
+	if err != nil || threshold <= 0 {
+		return false, time.Time{}
+	}
+
+	db := database.GetDB()
+	lockout := &model.LoginLockout{}
+	err = db.Where("ip = ? AND locked_until > ?", ip, time.Now().UnixMilli()).Order("locked_until desc").First(lockout).Error
+	if err != nil {
+		return false, time.Time{}
+	}
+	return true, time.UnixMilli(lockout.LockedUntil)
+}
+
+// RecordFailure counts a failed login and locks the pair once the threshold is
+// reached. It returns whether the pair is locked now. The pairs whose failures
+// and lock are over are deleted along, as every username tried adds one.
+func (s *LockoutService) RecordFailure(ip string, username string) (bool, error) {
+	threshold, err := s.settingService.GetLockoutThreshold()
+	if err != nil || threshold <= 0 {
+		return false, err
+	}
+	window, err := s.settingService.GetLockoutWindow()
+	if err != nil {
+		return false, err
+	}
+	duration, err := s.settingService.GetLockoutDuration()
+	if err != nil {
+		return false, err
+	}
+
+	now := time.Now()
+	locked := false
+	windowStart := now.Add(-time.Duration(window) * time.Minute).UnixMilli()
+	err = database.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("(locked_until > 0 AND locked_until <= ?) OR (locked_until = 0 AND first_failure < ?)", now.UnixMilli(), windowStart).
+			Delete(&model.LoginLockout{}).Error
+		if err != nil {
+			return err
+		}
+
+		lockout := &model.LoginLockout{}
+		err = tx.Where("ip = ? AND username = ?", ip, username).First(lockout).Error
+		if err != nil && err != gorm.ErrRecordNotFound {
+			return err
+		}
+
+		expired := lockout.LockedUntil > 0 && lockout.LockedUntil <= now.UnixMilli()
+		if lockout.Id == 0 || lockout.FirstFailure < windowStart || expired {
+			lockout.Ip = ip
+			lockout.Username = username
+			lockout.Failures = 0
+			lockout.FirstFailure = now.UnixMilli()
+			lockout.LockedUntil = 0
+		}
+		lockout.Failures++
+		lockout.LastFailure = now.UnixMilli()
+		if lockout.Failures >= threshold {
+			lockout.LockedUntil = now.Add(time.Duration(duration) * time.Minute).UnixMilli()
+			locked = true
+		}
+		return tx.Save(lockout).Error
+	})
+	return locked, err
+}
+
+// Reset forgets the failures of the pair, e.g. after a successful login.
+func (s *LockoutService) Reset(ip string, username string) error {
+	db := database.GetDB()
+	return db.Where("ip = ? AND username = ?", ip, username).Delete(&model.LoginLockout{}).Error
+}
+
+// GetLockouts returns the currently locked pairs.
+func (s *LockoutService) GetLockouts() ([]model.LoginLockout, error) {
+	db := database.GetDB()
+	var lockouts []model.LoginLockout
+	err := db.Where("locked_until > ?", time.Now().UnixMilli()).Order("locked_until desc").Find(&lockouts).Error
+	return lockouts, err
+}
+
+// DelLockout unlocks the IP of the pair id, with the counters of all its
+// usernames.
+func (s *LockoutService) DelLockout(id int) error {
+	db := database.GetDB()
+	lockout := &model.LoginLockout{}
+	if err := db.First(lockout, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil
+		}
+		return err
+	}
+	return db.Where("ip = ?", lockout.Ip).Delete(&model.LoginLockout{}).Error
+}
+
+// DelAllLockouts unlocks everything and clears the failure counters.
+func (s *LockoutService) DelAllLockouts() error {
+	db := database.GetDB()
+	return db.Where("1 = 1").Delete(&model.LoginLockout{}).Error
+}
@@ -0,0 +1,106 @@
+package service
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"x-ui/database/model"
+)
+
+func TestLockoutByIp(t *testing.T) {
+	db := newTestDB(t)
+	settings := &SettingService{}
+	if err := settings.setInt("lockoutThreshold", 3); err != nil {
+		t.Fatal(err)
+	}
+	s := &LockoutService{}
+
+	// The failures are counted for each username
+	for _, username := range []string{"admin", "root", "admin", "root"} {
+		if locked, err := s.RecordFailure("192.0.2.1", username); err != nil || locked {
+			t.Fatalf("the failure of %s locked %v, %v", username, locked, err)
+		}
+	}
+	if locked, _ := s.IsLocked("192.0.2.1"); locked {
+		t.Fatal("the IP is locked before a username reached the threshold")
+	}
+	locked, err := s.RecordFailure("192.0.2.1", "admin")
+	if err != nil || !locked {
+		t.Fatalf("the third failure of admin locked %v, %v", locked, err)
+	}
+
+	// The locked IP can't try another username, other IPs still can
+	locked, until := s.IsLocked("192.0.2.1")
+	if !locked || time.Until(until) < 29*time.Minute || time.Until(until) > 30*time.Minute {
+		t.Errorf("the IP is locked %v until %s", locked, until)
+	}
+	if locked, _ := s.IsLocked("192.0.2.2"); locked {
+		t.Error("another IP is locked")
+	}
+	// Nor can it once the lock of another username ends sooner
+	if err := db.Model(model.LoginLockout{}).Where("username = ?", "root").
+		Update("locked_until", time.Now().Add(time.Minute).UnixMilli()).Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, until := s.IsLocked("192.0.2.1"); time.Until(until) < 29*time.Minute {
+		t.Errorf("the IP is locked until %s, not until its last lock ends", until)
+	}
+
+	// Lifting the lock of the IP by the id of a pair unlocks all its usernames
+	lockouts, err := s.GetLockouts()
+	if err != nil || len(lockouts) != 2 {
+		t.Fatalf("the lockouts are %+v, %v", lockouts, err)
+	}
+	if err := s.DelLockout(lockouts[1].Id); err != nil {
+		t.Fatal(err)
+	}
+	if locked, _ := s.IsLocked("192.0.2.1"); locked {
+		t.Error("the IP is still locked after its lockout was removed")
+	}
+	var left int64
+	db.Model(model.LoginLockout{}).Where("ip = ?", "192.0.2.1").Count(&left)
+	if left != 0 {
+		t.Errorf("%d lockouts of the IP are left", left)
+	}
+	if err := s.DelLockout(lockouts[0].Id); err != nil {
+		t.Errorf("removing a lockout already removed failed: %v", err)
+	}
+
+	// Lockouts can be turned off
+	s.RecordFailure("192.0.2.3", "admin")
+	s.RecordFailure("192.0.2.3", "admin")
+	s.RecordFailure("192.0.2.3", "admin")
+	if err := settings.setInt("lockoutThreshold", 0); err != nil {
+		t.Fatal(err)
+	}
+	if locked, _ := s.IsLocked("192.0.2.3"); locked {
+		t.Error("the IP is locked with lockouts turned off")
+	}
+}
+
+func TestLockoutsPruned(t *testing.T) {
+	db := newTestDB(t)
+	if err := (&SettingService{}).setInt("lockoutThreshold", 3); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	lockouts := []model.LoginLockout{
+		{Ip: "192.0.2.1", Username: "stale", Failures: 1, FirstFailure: now.Add(-time.Hour).UnixMilli()},
+		{Ip: "192.0.2.1", Username: "unlocked", Failures: 3, FirstFailure: now.Add(-time.Hour).UnixMilli(), LockedUntil: now.Add(-time.Minute).UnixMilli()},
+		{Ip: "192.0.2.2", Username: "recent", Failures: 1, FirstFailure: now.Add(-time.Minute).UnixMilli()},
+		{Ip: "192.0.2.3", Username: "locked", Failures: 3, FirstFailure: now.Add(-time.Hour).UnixMilli(), LockedUntil: now.Add(time.Minute).UnixMilli()},
+	}
+	if err := db.Create(&lockouts).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := (&LockoutService{}).RecordFailure("192.0.2.4", "admin"); err != nil {
+		t.Fatal(err)
+	}
+	var left []string
+	db.Model(model.LoginLockout{}).Order("username").Pluck("username", &left)
+	if want := []string{"admin", "locked", "recent"}; !slices.Equal(left, want) {
+		t.Errorf("the lockouts left are %v, want %v", left, want)
+	}
+}
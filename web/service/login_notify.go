@@ -0,0 +1,321 @@
+package service
+
+import (
+	"fmt"
+	"html"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"x-ui/config"
+	"x-ui/database/model"
+	"x-ui/logger"
+
+	"github.com/mymmrac/telego"
+	tu "github.com/mymmrac/telego/telegoutil"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+const (
+	// loginNoticeKeys bounds the memory used to hold back repeated notifications
+	loginNoticeKeys = 10000
+	// loginNoticeMaxUA is how much of the user agent goes into a notification
+	loginNoticeMaxUA = 200
+)
+
+// LoginNotice is a login to the panel, or a request authenticated with an API
+// token, to notify the admins of.
+type LoginNotice struct {
+	Status   LoginStatus
+	Username string
+	// Password is only sent for failed logins
+	Password string
+	// Ip is the real IP of the client, PeerIp the address the request came
+	// from, which is the reverse proxy in front of the panel if there is one
+	Ip        string
+	PeerIp    string
+	UserAgent string
+	// ApiToken is the name of the token of a token authenticated request
+	ApiToken string
+	Time     time.Time
+}
+
+type loginNoticeSeen struct {
+	last     time.Time
+	withheld int
+}
+
+// loginNotices holds back the notifications repeated for the same user and IP
+// within the notification interval, so a script that keeps logging in doesn't
+// flood the chat.
+var loginNotices = struct {
+	sync.Mutex
+	seen map[string]*loginNoticeSeen
+}{seen: make(map[string]*loginNoticeSeen)}
+
+// allowLoginNotice reports whether the notification of key is due, and how many
+// were held back since the last one was sent.
+func allowLoginNotice(key string, interval time.Duration, now time.Time) (bool, *loginNoticeSeen) {
+	if interval <= 0 {
+		return true, nil
+	}
+	loginNotices.Lock()
+	defer loginNotices.Unlock()
+	if seen, ok := loginNotices.seen[key]; ok {
+		if now.Sub(seen.last) < interval {
+			seen.withheld++
+			return false, nil
+		}
+		previous := *seen
+		seen.last, seen.withheld = now, 0
+		return true, &previous
+	}
+	if len(loginNotices.seen) >= loginNoticeKeys {
+		for k, seen := range loginNotices.seen {
+			if now.Sub(seen.last) >= interval {
+				delete(loginNotices.seen, k)
+			}
+		}
+		if len(loginNotices.seen) >= loginNoticeKeys {
+			loginNotices.seen = make(map[string]*loginNoticeSeen)
+		}
+	}
+	loginNotices.seen[key] = &loginNoticeSeen{last: now}
+	return true, nil
+}
+
+func (t *Tgbot) UserLoginNotify(notice LoginNotice) {
+	if !t.AlertsOn(AlertLogin) {
+		return
+	}
+
+	if notice.Username == "" || notice.Ip == "" {
+		logger.Warning("UserLoginNotify failed, invalid info!")
+		return
+	}
+
+	loginNotifyEnabled, err := t.settingService.GetTgBotLoginNotify()
+	if err != nil || !loginNotifyEnabled {
+		return
+	}
+	switch {
+	case notice.ApiToken != "":
+		enabled, err := t.settingService.GetTgBotLoginNotifyApi()
+		if err != nil || !enabled {
+			return
+		}
+	case notice.Status == LoginFail:
+		enabled, err := t.settingService.GetTgBotLoginNotifyFailed()
+		if err != nil || !enabled {
+			return
+		}
+	}
+
+	interval, err := t.settingService.GetTgBotLoginNotifyInterval()
+	if err != nil {
+		interval = 0
+	}
+	key := fmt.Sprint(notice.Status, "\n", notice.ApiToken, "\n", notice.Username, "\n", notice.Ip)
+	due, previous := allowLoginNotice(key, time.Duration(interval)*time.Minute, notice.Time)
+	if !due {
+		return
+	}
+
+	location := lookupLocation(notice.Ip)
+	userAgent := []rune(notice.UserAgent)
+	if len(userAgent) > loginNoticeMaxUA {
+		userAgent = append(userAgent[:loginNoticeMaxUA], '…')
+	}
+	vars := map[string]string{
+		"ServerName": hostname,
+		"Username":   notice.Username,
+		"IP":         notice.Ip,
+		"Location":   location,
+		"UserAgent":  string(userAgent),
+		"ApiToken":   notice.ApiToken,
+		"Time":       notice.Time.Format("2006-01-02 15:04:05"),
+		"Withheld":   "0",
+	}
+	switch {
+	case notice.ApiToken != "":
+		vars["Status"] = "token"
+	case notice.Status == LoginSuccess:
+		vars["Status"] = "success"
+	default:
+		vars["Status"] = "failed"
+		vars["Password"] = notice.Password
+	}
+	if notice.PeerIp != notice.Ip {
+		vars["ProxyIP"] = notice.PeerIp
+	}
+	if previous != nil {
+		vars["Withheld"] = strconv.Itoa(previous.withheld)
+	}
+
+	msg := t.renderTemplate("login", vars)
+	if msg == "" {
+		msg = t.loginNoticeMsg(notice, location, string(userAgent), previous)
+	}
+
+	if notice.Status == LoginFail {
+		t.SendAlert(AlertLogin, msg)
+		return
+	}
+	t.SendAlert(AlertLogin, msg, tu.InlineKeyboard(
+		tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.lockPanel")).WithCallbackData("lock_panel"),
+		),
+	))
+}
+
+// loginNoticeMsg is the built-in message of a login notice.
+func (t *Tgbot) loginNoticeMsg(notice LoginNotice, location string, userAgent string, previous *loginNoticeSeen) string {
+	msg := ""
+	switch {
+	case notice.ApiToken != "":
+		msg += t.I18nBot("tgbot.messages.loginApiToken", "Token=="+html.EscapeString(notice.ApiToken))
+	case notice.Status == LoginSuccess:
+		msg += t.I18nBot("tgbot.messages.loginSuccess")
+	default:
+		msg += t.I18nBot("tgbot.messages.loginFailed")
+	}
+	msg += t.I18nBot("tgbot.messages.hostname", "Hostname=="+hostname)
+	if notice.Status == LoginFail {
+		msg += t.I18nBot("tgbot.messages.password", "Password=="+html.EscapeString(notice.Password))
+	}
+	msg += t.I18nBot("tgbot.messages.username", "Username=="+html.EscapeString(notice.Username))
+	msg += t.I18nBot("tgbot.messages.ip", "IP=="+html.EscapeString(notice.Ip))
+	if notice.PeerIp != "" && notice.PeerIp != notice.Ip {
+		msg += t.I18nBot("tgbot.messages.loginProxy", "IP=="+html.EscapeString(notice.PeerIp))
+	}
+	if location != "" {
+		msg += t.I18nBot("tgbot.messages.loginLocation", "Location=="+html.EscapeString(location))
+	}
+	if userAgent != "" {
+		msg += t.I18nBot("tgbot.messages.loginUserAgent", "UserAgent=="+html.EscapeString(userAgent))
+	}
+	msg += t.I18nBot("tgbot.messages.time", "Time=="+notice.Time.Format("2006-01-02 15:04:05"))
+	if previous != nil && previous.withheld > 0 {
+		msg += t.I18nBot("tgbot.messages.loginWithheld", "Count=="+strconv.Itoa(previous.withheld),
+			"Time=="+previous.last.Format("2006-01-02 15:04:05"))
+	}
+	return msg
+}
+
+// lockPanel answers the "Not me" button of a login notification: it turns the
+// maintenance mode on, so only admins get in, and ends every login session.
+func (t *Tgbot) lockPanel(callbackQuery *telego.CallbackQuery) {
+	chatId := callbackQuery.Message.GetChat().ID
+	actor := fmt.Sprintf("telegram:%d", callbackQuery.From.ID)
+
+	state, err := t.settingService.GetMaintenance()
+	if err == nil {
+		state.Enable = true
+		err = t.settingService.SetMaintenance(state)
+	}
+	var revoked int64
+	if err == nil {
+		revoked, err = t.loginSessions.DelAllSessions()
+	}
+	t.auditService.Record(&model.AuditLog{
+		Actor:      actor,
+		Action:     "panel.lock",
+		EntityType: "panel",
+		Success:    err == nil,
+	})
+	if err != nil {
+		logger.Warning("locking the panel failed:", err)
+		t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.errorOperation"))
+		return
+	}
+	logger.Warningf("the panel was locked by %s, %d sessions were revoked", actor, revoked)
+
+	t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.successfulOperation"))
+	t.editMessageCallbackTgBot(chatId, callbackQuery.Message.GetMessageID(), nil)
+	name := callbackQuery.From.Username
+	if name == "" {
+		name = callbackQuery.From.FirstName
+	}
+	t.SendMsgToTgbotAdmins(t.I18nBot("tgbot.messages.panelLocked", "User=="+html.EscapeString(name),
+		"Count=="+strconv.FormatInt(revoked, 10)))
+}
+
+// geoRecord holds the fields of the MaxMind City, Country and ASN databases, and
+// of the compatible ones such as those of DB-IP.
+type geoRecord struct {
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Country struct {
+		IsoCode string            `maxminddb:"iso_code"`
+		Names   map[string]string `maxminddb:"names"`
+	} `maxminddb:"country"`
+	AutonomousSystemNumber       uint   `maxminddb:"autonomous_system_number"`
+	AutonomousSystemOrganization string `maxminddb:"autonomous_system_organization"`
+}
+
+// lookupLocation describes where ip is from with the .mmdb databases of the
+// bin folder, such as "Berlin, Germany (DE), AS3320 Deutsche Telekom AG". It
+// returns "" without a database, or for a private address.
+func lookupLocation(ip string) string {
+	addr := net.ParseIP(ip)
+	if addr == nil || addr.IsPrivate() || addr.IsLoopback() || addr.IsLinkLocalUnicast() {
+		return ""
+	}
+	files, err := filepath.Glob(filepath.Join(config.GetBinFolderPath(), "*.mmdb"))
+	if err != nil || len(files) == 0 {
+		return ""
+	}
+	sort.Strings(files)
+
+	var city, country, code, asn, org string
+	for _, file := range files {
+		reader, err := maxminddb.Open(file)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				logger.Debug("unable to open", file, "for the login location:", err)
+			}
+			continue
+		}
+		var record geoRecord
+		err = reader.Lookup(addr, &record)
+		reader.Close()
+		if err != nil {
+			logger.Debug("login location lookup in", file, "failed:", err)
+			continue
+		}
+		if city == "" {
+			city = record.City.Names["en"]
+		}
+		if country == "" {
+			country, code = record.Country.Names["en"], record.Country.IsoCode
+		}
+		if asn == "" && record.AutonomousSystemNumber != 0 {
+			asn = "AS" + strconv.FormatUint(uint64(record.AutonomousSystemNumber), 10)
+			org = record.AutonomousSystemOrganization
+		}
+	}
+
+	var parts []string
+	place := country
+	if code != "" && country != "" {
+		place += " (" + code + ")"
+	} else if code != "" {
+		place = code
+	}
+	if city != "" && place != "" {
+		place = city + ", " + place
+	}
+	if place != "" {
+		parts = append(parts, place)
+	}
+	if asn != "" {
+		parts = append(parts, strings.TrimSpace(asn+" "+org))
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,428 @@
+package service
+
+import (
+	"cmp"
+	"crypto/rand"
+	"encoding/base64"
+	"html"
+	"slices"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/common"
+
+	"gorm.io/gorm"
+)
+
+const (
+	loginSessionIdBytes = 32
+	loginSessionMaxUA   = 256
+
+	// loginSessionTouchInterval limits how often the last activity is written
+	loginSessionTouchInterval = time.Minute
+
+	// loginSessionIdleTTL removes sessions without an expiry, which last until the
+	// browser is closed, once they have not been used for this long
+	loginSessionIdleTTL = 30 * 24 * time.Hour
+
+	// refreshReuseGrace is how long a rotated refresh token may still come in
+	// from its device without counting as stolen, for the requests that were
+	// sent before the rotated cookie arrived
+	refreshReuseGrace = 30 * time.Second
+)
+
+// LoginSessionService keeps the panel logins in the database, so they can be
+// listed and revoked from another device.
+type LoginSessionService struct {
+	settingService SettingService
+}
+
+// RememberedLogin is a remember-me session with the tokens for its cookies.
+type RememberedLogin struct {
+	Session      *model.LoginSession
+	Token        string
+	RefreshToken string
+	// Reused tells that the refresh token presented had been rotated already,
+	// Session was ended for it
+	Reused bool
+	// Rotated tells that another request of the device refreshed the session
+	// a moment ago, with the same refresh token
+	Rotated bool
+	// Exceeded is the coded error of the session limit Session went over, it
+	// was ended for it
+	Exceeded error
+}
+
+func newSessionToken() (string, error) {
+	buf := make([]byte, loginSessionIdBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// Create starts a session and returns the id to keep in the cookie. A maxAge of
+// zero creates a session without an expiry. A login beyond the sessions the user
+// may have ends the oldest one, or is refused with a coded error.
+func (s *LoginSessionService) Create(userId int, ip string, userAgent string, maxAge time.Duration) (string, error) {
+	token, err := newSessionToken()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	loginSession := &model.LoginSession{
+		TokenHash:    hashToken(token),
+		UserId:       userId,
+		Ip:           ip,
+		UserAgent:    truncateUserAgent(userAgent),
+		CreatedAt:    now.UnixMilli(),
+		LastActiveAt: now.UnixMilli(),
+	}
+	if maxAge > 0 {
+		loginSession.ExpiresAt = now.Add(maxAge).UnixMilli()
+	}
+	if err := s.createLimited(loginSession); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// RememberMeEnabled tells whether logins may be remembered, with the lifetimes
+// of their session cookies and of their refresh tokens.
+func (s *LoginSessionService) RememberMeEnabled() (bool, time.Duration, time.Duration) {
+	minutes, err := s.settingService.GetRememberSessionMaxAge()
+	if err != nil || minutes < 1 {
+		minutes = 15
+	}
+	days, err := s.settingService.GetRememberMaxAge()
+	if err != nil || days <= 0 {
+		return false, 0, 0
+	}
+	return true, time.Duration(minutes) * time.Minute, time.Duration(days) * 24 * time.Hour
+}
+
+// CreateRemembered starts a remember-me session for the device, with a short
+// lived session token and a refresh token bound to the device, within the
+// session limits of the user like Create.
+func (s *LoginSessionService) CreateRemembered(userId int, ip string, userAgent string, device string) (*RememberedLogin, error) {
+	enabled, maxAge, refreshAge := s.RememberMeEnabled()
+	if !enabled {
+		return nil, common.NewError("remember-me is disabled")
+	}
+	token, err := newSessionToken()
+	if err != nil {
+		return nil, err
+	}
+	refresh, err := newSessionToken()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	loginSession := &model.LoginSession{
+		TokenHash:        hashToken(token),
+		UserId:           userId,
+		Ip:               ip,
+		UserAgent:        truncateUserAgent(userAgent),
+		CreatedAt:        now.UnixMilli(),
+		LastActiveAt:     now.UnixMilli(),
+		ExpiresAt:        now.Add(maxAge).UnixMilli(),
+		RememberMe:       true,
+		RefreshHash:      hashToken(refresh),
+		DeviceHash:       hashToken(device),
+		RefreshExpiresAt: now.Add(refreshAge).UnixMilli(),
+		RefreshedAt:      now.UnixMilli(),
+	}
+	if err := s.createLimited(loginSession); err != nil {
+		return nil, err
+	}
+	return &RememberedLogin{Session: loginSession, Token: token, RefreshToken: refresh}, nil
+}
+
+// Refresh renews a remember-me session with its refresh token from the device
+// it was issued to, and rotates both of its tokens. A rotated refresh token
+// presented again, or a refresh token from another device, means it was
+// stolen: the session is ended, and the result tells it was reused. A session
+// that went over its idle timeout or lifetime is ended as well.
+func (s *LoginSessionService) Refresh(refresh string, device string, ip string, userAgent string) (*RememberedLogin, error) {
+	enabled, maxAge, _ := s.RememberMeEnabled()
+	if !enabled {
+		return nil, common.NewError("remember-me is disabled")
+	}
+	if refresh == "" {
+		return nil, common.NewError("no refresh token")
+	}
+	result := &RememberedLogin{}
+	err := database.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		loginSession := &model.LoginSession{}
+		err := tx.Model(model.LoginSession{}).Where("refresh_hash = ?", hashToken(refresh)).First(loginSession).Error
+		if database.IsNotFound(err) {
+			return s.refreshReused(tx, refresh, device, result)
+		} else if err != nil {
+			return err
+		}
+		if now.UnixMilli() >= loginSession.RefreshExpiresAt {
+			return common.NewError("refresh token expired")
+		}
+		if loginSession.DeviceHash != hashToken(device) {
+			result.Session, result.Reused = loginSession, true
+			return endRemembered(tx, loginSession.Id)
+		}
+		user := &model.User{}
+		if err := tx.Model(model.User{}).Where("id = ?", loginSession.UserId).First(user).Error; err != nil {
+			// The login of a user that is gone is turned down by the caller
+			user = nil
+		}
+		if err := s.SessionLimitsOf(user).exceeded(loginSession, lastActivity(loginSession), now); err != nil {
+			result.Session, result.Exceeded = loginSession, err
+			return endRemembered(tx, loginSession.Id)
+		}
+
+		token, err := newSessionToken()
+		if err != nil {
+			return err
+		}
+		next, err := newSessionToken()
+		if err != nil {
+			return err
+		}
+		rotated := &model.RotatedRefreshToken{
+			TokenHash: loginSession.RefreshHash,
+			SessionId: loginSession.Id,
+			RotatedAt: now.UnixMilli(),
+			ExpiresAt: loginSession.RefreshExpiresAt,
+		}
+		if err := tx.Create(rotated).Error; err != nil {
+			return err
+		}
+		loginSession.TokenHash = hashToken(token)
+		loginSession.RefreshHash = hashToken(next)
+		loginSession.Ip = ip
+		loginSession.UserAgent = truncateUserAgent(userAgent)
+		loginSession.LastActiveAt = now.UnixMilli()
+		loginSession.RefreshedAt = now.UnixMilli()
+		loginSession.ExpiresAt = min(now.Add(maxAge).UnixMilli(), loginSession.RefreshExpiresAt)
+		updated := tx.Model(model.LoginSession{}).
+			Where("id = ? AND refresh_hash = ?", loginSession.Id, rotated.TokenHash).
+			Updates(map[string]any{
+				"token_hash":     loginSession.TokenHash,
+				"refresh_hash":   loginSession.RefreshHash,
+				"ip":             loginSession.Ip,
+				"user_agent":     loginSession.UserAgent,
+				"last_active_at": loginSession.LastActiveAt,
+				"refreshed_at":   loginSession.RefreshedAt,
+				"expires_at":     loginSession.ExpiresAt,
+			})
+		if updated.Error != nil {
+			return updated.Error
+		}
+		if updated.RowsAffected == 0 {
+			// Another request refreshed the session in the meantime
+			result.Rotated = true
+			return common.NewError("refresh token was rotated already")
+		}
+		result.Session, result.Token, result.RefreshToken = loginSession, token, next
+		return nil
+	})
+	if result.Reused {
+		// The session is ended even though the refresh failed
+		return result, common.NewError("refresh token was reused")
+	}
+	if result.Exceeded != nil && err == nil {
+		logger.Infof("login session %d of user %d was ended: %v", result.Session.Id, result.Session.UserId, result.Exceeded)
+		return result, result.Exceeded
+	}
+	if result.Rotated {
+		return result, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// refreshReused handles a refresh token that is not the current one of any
+// session: one rotated a moment ago on the same device is only turned down,
+// otherwise the session it belonged to is ended.
+func (s *LoginSessionService) refreshReused(tx *gorm.DB, refresh string, device string, result *RememberedLogin) error {
+	rotated := &model.RotatedRefreshToken{}
+	err := tx.Model(model.RotatedRefreshToken{}).Where("token_hash = ?", hashToken(refresh)).First(rotated).Error
+	if database.IsNotFound(err) {
+		return common.NewError("refresh token is unknown")
+	} else if err != nil {
+		return err
+	}
+	loginSession := &model.LoginSession{}
+	err = tx.Model(model.LoginSession{}).Where("id = ?", rotated.SessionId).First(loginSession).Error
+	if database.IsNotFound(err) {
+		return common.NewError("login session was revoked")
+	} else if err != nil {
+		return err
+	}
+	if loginSession.DeviceHash == hashToken(device) && time.Now().UnixMilli()-rotated.RotatedAt < refreshReuseGrace.Milliseconds() {
+		result.Rotated = true
+		return common.NewError("refresh token was rotated already")
+	}
+	result.Session, result.Reused = loginSession, true
+	return endRemembered(tx, loginSession.Id)
+}
+
+// endRemembered deletes a remember-me session with its rotated refresh tokens.
+func endRemembered(tx *gorm.DB, id int) error {
+	if err := tx.Where("session_id = ?", id).Delete(model.RotatedRefreshToken{}).Error; err != nil {
+		return err
+	}
+	return tx.Where("id = ?", id).Delete(model.LoginSession{}).Error
+}
+
+// Validate returns the session of token if it belongs to user and is neither
+// revoked nor expired, and records the activity; see loginActivity for when it
+// is written. A session that went over the idle timeout or the lifetime of the
+// user is ended, with a coded error telling which.
+func (s *LoginSessionService) Validate(token string, user *model.User, ip string, userAgent string) (*model.LoginSession, error) {
+	if token == "" {
+		return nil, common.NewError("no login session")
+	}
+	db := database.GetDB()
+	loginSession := &model.LoginSession{}
+	err := db.Model(model.LoginSession{}).
+		Where("token_hash = ? AND user_id = ?", hashToken(token), user.Id).
+		First(loginSession).Error
+	if database.IsNotFound(err) {
+		return nil, common.NewError("login session was revoked")
+	} else if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if loginSession.ExpiresAt != 0 && now.UnixMilli() >= loginSession.ExpiresAt ||
+		loginSession.ExpiresAt == 0 && now.UnixMilli()-loginSession.LastActiveAt >= loginSessionIdleTTL.Milliseconds() {
+		return nil, common.NewError("login session expired")
+	}
+	if err := s.SessionLimitsOf(user).exceeded(loginSession, lastActivity(loginSession), now); err != nil {
+		return nil, endExceeded(loginSession, err)
+	}
+	if touchActivity(loginSession, ip, now.UnixMilli()) {
+		loginSession.Ip = ip
+		loginSession.UserAgent = truncateUserAgent(userAgent)
+		err := db.Model(model.LoginSession{}).
+			Where("id = ?", loginSession.Id).
+			Updates(map[string]any{
+				"last_active_at": loginSession.LastActiveAt,
+				"ip":             loginSession.Ip,
+				"user_agent":     loginSession.UserAgent,
+			}).Error
+		if err != nil {
+			return nil, err
+		}
+	}
+	return loginSession, nil
+}
+
+// GetSessions returns the sessions of the user, with their last activity as
+// recorded in memory, the latest used first.
+func (s *LoginSessionService) GetSessions(userId int) ([]*model.LoginSession, error) {
+	sessions := make([]*model.LoginSession, 0)
+	err := database.GetDB().Model(model.LoginSession{}).
+		Where("user_id = ?", userId).
+		Find(&sessions).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, loginSession := range sessions {
+		loginSession.LastActiveAt = lastActivity(loginSession)
+	}
+	slices.SortStableFunc(sessions, func(a, b *model.LoginSession) int {
+		return cmp.Compare(b.LastActiveAt, a.LastActiveAt)
+	})
+	return sessions, nil
+}
+
+func (s *LoginSessionService) DelSession(userId int, id int) error {
+	result := database.GetDB().
+		Where("id = ? AND user_id = ?", id, userId).
+		Delete(model.LoginSession{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return common.NewError("session not found")
+	}
+	return nil
+}
+
+// DelByToken ends the session of the cookie id token, for logging out.
+func (s *LoginSessionService) DelByToken(token string) error {
+	if token == "" {
+		return nil
+	}
+	return database.GetDB().Where("token_hash = ?", hashToken(token)).Delete(model.LoginSession{}).Error
+}
+
+// DelByRefreshToken ends the remember-me session of a refresh token, for
+// logging out once its session cookie expired.
+func (s *LoginSessionService) DelByRefreshToken(refresh string) error {
+	if refresh == "" {
+		return nil
+	}
+	return database.GetDB().Where("refresh_hash = ?", hashToken(refresh)).Delete(model.LoginSession{}).Error
+}
+
+// DelOtherSessions revokes every session of the user except the one with id
+// keepId, and returns how many were revoked. A keepId of zero revokes them all.
+func (s *LoginSessionService) DelOtherSessions(userId int, keepId int) (int64, error) {
+	result := database.GetDB().
+		Where("user_id = ? AND id != ?", userId, keepId).
+		Delete(model.LoginSession{})
+	return result.RowsAffected, result.Error
+}
+
+// DelAllSessions revokes the sessions of every user, and returns how many were
+// revoked.
+func (s *LoginSessionService) DelAllSessions() (int64, error) {
+	result := database.GetDB().Where("1 = 1").Delete(model.LoginSession{})
+	return result.RowsAffected, result.Error
+}
+
+// Prune deletes expired sessions, remember-me ones once their refresh token
+// expired too, sessions without an expiry that have been idle for too long, and
+// the rotated refresh tokens of sessions that are gone.
+func (s *LoginSessionService) Prune() (int64, error) {
+	now := time.Now()
+	db := database.GetDB()
+	result := db.
+		Where("(expires_at != 0 AND expires_at <= ? AND refresh_expires_at <= ?) OR (expires_at = 0 AND last_active_at < ?)",
+			now.UnixMilli(), now.UnixMilli(), now.Add(-loginSessionIdleTTL).UnixMilli()).
+		Delete(model.LoginSession{})
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	forgetActivity(now)
+	err := db.
+		Where("expires_at <= ? OR session_id NOT IN (?)", now.UnixMilli(), db.Model(model.LoginSession{}).Select("id")).
+		Delete(model.RotatedRefreshToken{}).Error
+	return result.RowsAffected, err
+}
+
+func truncateUserAgent(userAgent string) string {
+	if len(userAgent) > loginSessionMaxUA {
+		return userAgent[:loginSessionMaxUA]
+	}
+	return userAgent
+}
+
+// RefreshReused tells the admins that a rotated refresh token of a
+// remember-me login was presented again, from ip, and that the login was ended.
+func (t *Tgbot) RefreshReused(username string, ip string) {
+	if !t.AlertsOn(AlertLogin) {
+		return
+	}
+	msg := t.I18nBot("tgbot.messages.refreshReused")
+	msg += t.I18nBot("tgbot.messages.username", "Username=="+html.EscapeString(username))
+	msg += t.I18nBot("tgbot.messages.ip", "IP=="+html.EscapeString(ip))
+	msg += t.I18nBot("tgbot.messages.hostname", "Hostname=="+hostname)
+	t.SendAlert(AlertLogin, msg)
+}
@@ -0,0 +1,202 @@
+package service
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/web/locale"
+
+	"gorm.io/gorm"
+)
+
+// The policies of a login beyond the sessions a user may have at once
+const (
+	SessionLimitEvict  = "evict"
+	SessionLimitReject = "reject"
+)
+
+// SessionLimits are the limits of the login sessions of a user, zero is no
+// limit. Reject refuses a login beyond MaxSessions instead of ending the oldest
+// session for it.
+type SessionLimits struct {
+	Idle        time.Duration
+	Lifetime    time.Duration
+	MaxSessions int
+	Reject      bool
+}
+
+// SessionLimitsOf returns the limits of the sessions of user, those of the
+// settings with the overrides of the user. A nil user has those of the settings.
+func (s *LoginSessionService) SessionLimitsOf(user *model.User) SessionLimits {
+	idle, err := s.settingService.GetSessionIdleTimeout()
+	if err != nil {
+		logger.Warning("Unable to get the session idle timeout:", err)
+	}
+	lifetime, err := s.settingService.GetSessionLifetime()
+	if err != nil {
+		logger.Warning("Unable to get the session lifetime:", err)
+	}
+	maxSessions, err := s.settingService.GetSessionMaxConcurrent()
+	if err != nil {
+		logger.Warning("Unable to get the most sessions of a user:", err)
+	}
+	policy, _ := s.settingService.GetSessionLimitPolicy()
+	if user != nil && user.SessionLimits != nil {
+		if user.SessionLimits.IdleMinutes != nil {
+			idle = *user.SessionLimits.IdleMinutes
+		}
+		if user.SessionLimits.LifetimeMinutes != nil {
+			lifetime = *user.SessionLimits.LifetimeMinutes
+		}
+		if user.SessionLimits.MaxSessions != nil {
+			maxSessions = *user.SessionLimits.MaxSessions
+		}
+	}
+	return SessionLimits{
+		Idle:        time.Duration(max(idle, 0)) * time.Minute,
+		Lifetime:    time.Duration(max(lifetime, 0)) * time.Minute,
+		MaxSessions: max(maxSessions, 0),
+		Reject:      policy == SessionLimitReject,
+	}
+}
+
+// exceeded returns the coded error of the limit a session last active at
+// lastActive goes over at now, nil if it goes over none.
+func (l SessionLimits) exceeded(loginSession *model.LoginSession, lastActive int64, now time.Time) error {
+	if l.Lifetime > 0 && now.UnixMilli()-loginSession.CreatedAt >= l.Lifetime.Milliseconds() {
+		return locale.NewError(locale.ErrSessionLifetime, "Minutes=="+strconv.Itoa(int(l.Lifetime/time.Minute)))
+	}
+	if l.Idle > 0 && now.UnixMilli()-lastActive >= l.Idle.Milliseconds() {
+		return locale.NewError(locale.ErrSessionIdle, "Minutes=="+strconv.Itoa(int(l.Idle/time.Minute)))
+	}
+	return nil
+}
+
+// sessionActivity is the last activity of a session: of its last request and
+// as it was last written to the database.
+type sessionActivity struct {
+	last    int64
+	written int64
+	ip      string
+}
+
+// loginActivity keeps the last activity of the sessions in memory. The requests
+// of a session only write theirs once per loginSessionTouchInterval, or when its
+// IP changes, and of requests coming in at once only one writes it.
+var loginActivity = struct {
+	sync.Mutex
+	sessions map[int]*sessionActivity
+}{sessions: map[int]*sessionActivity{}}
+
+// activityOf returns the activity of loginSession, the one in memory unless the
+// database has a later one, e.g. after a refresh or a restart. It must be called
+// with loginActivity locked.
+func activityOf(loginSession *model.LoginSession) *sessionActivity {
+	activity := loginActivity.sessions[loginSession.Id]
+	if activity == nil {
+		activity = &sessionActivity{ip: loginSession.Ip}
+		loginActivity.sessions[loginSession.Id] = activity
+	}
+	if loginSession.LastActiveAt > activity.written {
+		activity.written = loginSession.LastActiveAt
+		activity.ip = loginSession.Ip
+	}
+	activity.last = max(activity.last, loginSession.LastActiveAt)
+	return activity
+}
+
+// lastActivity returns when loginSession was last used.
+func lastActivity(loginSession *model.LoginSession) int64 {
+	loginActivity.Lock()
+	defer loginActivity.Unlock()
+	return activityOf(loginSession).last
+}
+
+// touchActivity records a request of loginSession from ip at now, and tells
+// whether the request is the one to write the activity. LastActiveAt of
+// loginSession is set to the activity either way.
+func touchActivity(loginSession *model.LoginSession, ip string, now int64) bool {
+	loginActivity.Lock()
+	defer loginActivity.Unlock()
+	activity := activityOf(loginSession)
+	activity.last = max(activity.last, now)
+	loginSession.LastActiveAt = activity.last
+	if now-activity.written < loginSessionTouchInterval.Milliseconds() && activity.ip == ip {
+		return false
+	}
+	// Claimed before the write, the requests in the meantime leave it to this one
+	activity.written, activity.ip = now, ip
+	return true
+}
+
+// forgetActivity drops the activity in memory of the sessions that were written
+// or were not used for loginSessionIdleTTL, and of those that are gone.
+func forgetActivity(now time.Time) {
+	loginActivity.Lock()
+	defer loginActivity.Unlock()
+	stale := now.Add(-loginSessionIdleTTL).UnixMilli()
+	for id, activity := range loginActivity.sessions {
+		if activity.last <= activity.written || activity.last < stale {
+			delete(loginActivity.sessions, id)
+		}
+	}
+}
+
+// makeRoom ends the oldest sessions of a user with limits going into a new
+// one, so the user keeps at most MaxSessions, or refuses the login if limits
+// reject it.
+func (s *LoginSessionService) makeRoom(tx *gorm.DB, userId int, limits SessionLimits) error {
+	if limits.MaxSessions <= 0 {
+		return nil
+	}
+	sessions := make([]*model.LoginSession, 0)
+	err := tx.Model(model.LoginSession{}).Where("user_id = ?", userId).Order("created_at, id").Find(&sessions).Error
+	if err != nil {
+		return err
+	}
+	extra := len(sessions) - limits.MaxSessions + 1
+	if extra <= 0 {
+		return nil
+	}
+	if limits.Reject {
+		return locale.NewError(locale.ErrSessionLimit, "Max=="+strconv.Itoa(limits.MaxSessions))
+	}
+	for _, loginSession := range sessions[:extra] {
+		if err := endRemembered(tx, loginSession.Id); err != nil {
+			return err
+		}
+		logger.Infof("login session %d of user %d was ended for a new login, at most %d are allowed", loginSession.Id, userId, limits.MaxSessions)
+	}
+	return nil
+}
+
+// createLimited creates loginSession for its user, within the limits of the
+// user on how many sessions it may have.
+func (s *LoginSessionService) createLimited(loginSession *model.LoginSession) error {
+	user, err := (&UserService{}).GetUserById(loginSession.UserId)
+	if err != nil {
+		return err
+	}
+	limits := s.SessionLimitsOf(user)
+	return database.Transaction(func(tx *gorm.DB) error {
+		if err := s.makeRoom(tx, loginSession.UserId, limits); err != nil {
+			return err
+		}
+		return tx.Create(loginSession).Error
+	})
+}
+
+// endExceeded ends loginSession for going over a limit, with err telling which.
+func endExceeded(loginSession *model.LoginSession, err error) error {
+	logger.Infof("login session %d of user %d was ended: %v", loginSession.Id, loginSession.UserId, err)
+	if endErr := database.Transaction(func(tx *gorm.DB) error {
+		return endRemembered(tx, loginSession.Id)
+	}); endErr != nil {
+		return endErr
+	}
+	return err
+}
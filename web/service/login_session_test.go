@@ -0,0 +1,346 @@
+package service
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/web/locale"
+
+	"gorm.io/gorm"
+)
+
+// sessionTestDB opens a database with a user, forgets the activity of the
+// sessions of other tests, and returns the user and a counter of the writes
+// of the login sessions.
+func sessionTestDB(t *testing.T) (*model.User, *atomic.Int64) {
+	t.Helper()
+	forget := func() {
+		loginActivity.Lock()
+		loginActivity.sessions = map[int]*sessionActivity{}
+		loginActivity.Unlock()
+	}
+	forget()
+	t.Cleanup(forget)
+	user := &model.User{Username: "session-user", Password: "unused", Role: model.RoleAdmin}
+	writes := &atomic.Int64{}
+	newTestDB(t, func(db *gorm.DB) error {
+		return db.Create(user).Error
+	}, func(db *gorm.DB) error {
+		return db.Callback().Update().After("gorm:update").Register("test:session_writes", func(tx *gorm.DB) {
+			if tx.Statement.Table == "login_sessions" && tx.Error == nil {
+				writes.Add(1)
+			}
+		})
+	})
+	return user, writes
+}
+
+// storedSession returns the login session with id as the database has it.
+func storedSession(t *testing.T, id int) *model.LoginSession {
+	t.Helper()
+	loginSession := &model.LoginSession{}
+	err := database.GetDB().Model(model.LoginSession{}).Where("id = ?", id).First(loginSession).Error
+	if database.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return loginSession
+}
+
+// ageSession moves the times of the session with id back by age in the
+// database, and forgets its activity in memory.
+func ageSession(t *testing.T, id int, age time.Duration) {
+	t.Helper()
+	err := database.GetDB().Model(model.LoginSession{}).Where("id = ?", id).Updates(map[string]any{
+		"created_at":     gorm.Expr("created_at - ?", age.Milliseconds()),
+		"last_active_at": gorm.Expr("last_active_at - ?", age.Milliseconds()),
+	}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	loginActivity.Lock()
+	delete(loginActivity.sessions, id)
+	loginActivity.Unlock()
+}
+
+func createSession(t *testing.T, s *LoginSessionService, user *model.User) (string, *model.LoginSession) {
+	t.Helper()
+	token, err := s.Create(user.Id, "198.51.100.1", "Firefox", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loginSession := &model.LoginSession{}
+	if err := database.GetDB().Where("token_hash = ?", hashToken(token)).First(loginSession).Error; err != nil {
+		t.Fatal(err)
+	}
+	return token, loginSession
+}
+
+func TestTouchActivity(t *testing.T) {
+	sessionTestDB(t)
+	now := time.Now().UnixMilli()
+	loginSession := &model.LoginSession{Id: 1, Ip: "198.51.100.1", LastActiveAt: now - 2*time.Minute.Milliseconds()}
+
+	if !touchActivity(loginSession, "198.51.100.1", now) || loginSession.LastActiveAt != now {
+		t.Error("the first request after a minute isn't written")
+	}
+	// Within the minute only the activity in memory moves
+	if touchActivity(loginSession, "198.51.100.1", now+1000) || loginSession.LastActiveAt != now+1000 {
+		t.Errorf("a request within the minute is written, the activity is %d", loginSession.LastActiveAt-now)
+	}
+	// A request that comes in late doesn't move the activity back
+	if touchActivity(loginSession, "198.51.100.1", now+500) || loginSession.LastActiveAt != now+1000 {
+		t.Errorf("a late request moved the activity to %d", loginSession.LastActiveAt-now)
+	}
+	if lastActivity(&model.LoginSession{Id: 1, LastActiveAt: now}) != now+1000 {
+		t.Error("the activity in memory is lost")
+	}
+	if !touchActivity(loginSession, "203.0.113.7", now+2000) {
+		t.Error("a request from another IP isn't written")
+	}
+	if !touchActivity(loginSession, "203.0.113.7", now+2000+time.Minute.Milliseconds()) {
+		t.Error("a request a minute after the last write isn't written")
+	}
+
+	// Written activity is forgotten, the rest until it is stale
+	touchActivity(loginSession, "203.0.113.7", now+3000+time.Minute.Milliseconds())
+	touchActivity(&model.LoginSession{Id: 2, Ip: "198.51.100.1"}, "198.51.100.1", now)
+	forgetActivity(time.UnixMilli(now))
+	loginActivity.Lock()
+	_, pending := loginActivity.sessions[1]
+	_, written := loginActivity.sessions[2]
+	loginActivity.Unlock()
+	if !pending || written {
+		t.Errorf("forgetting the activity kept the pending one %v and the written one %v", pending, written)
+	}
+	forgetActivity(time.UnixMilli(now).Add(loginSessionIdleTTL + 2*time.Minute))
+	if len(loginActivity.sessions) != 0 {
+		t.Error("the stale activity is kept")
+	}
+}
+
+func TestSessionActivityCoalesced(t *testing.T) {
+	user, writes := sessionTestDB(t)
+	var s LoginSessionService
+	token, loginSession := createSession(t, &s, user)
+	ageSession(t, loginSession.Id, 2*time.Minute)
+	validate := func(n int, ip string) {
+		t.Helper()
+		var wg sync.WaitGroup
+		errs := make(chan error, n)
+		for range n {
+			wg.Go(func() {
+				if _, err := s.Validate(token, user, ip, "Firefox"); err != nil {
+					errs <- err
+				}
+			})
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Fatal("a parallel request was refused:", err)
+		}
+	}
+
+	// Of the requests coming in at once, one writes the activity
+	writes.Store(0)
+	before := time.Now().UnixMilli()
+	validate(50, "198.51.100.1")
+	if n := writes.Load(); n != 1 {
+		t.Errorf("50 parallel requests wrote the activity %d times", n)
+	}
+	stored := storedSession(t, loginSession.Id)
+	if stored.LastActiveAt < before {
+		t.Errorf("the activity written is %d ms before the requests", before-stored.LastActiveAt)
+	}
+	// Within the minute none does
+	time.Sleep(10 * time.Millisecond)
+	validate(50, "198.51.100.1")
+	if n := writes.Load(); n != 1 {
+		t.Errorf("the requests within the minute wrote the activity %d more times", n-1)
+	}
+	// The list has the last activity in memory, later than the one written
+	sessions, err := s.GetSessions(user.Id)
+	if err != nil || len(sessions) != 1 || sessions[0].LastActiveAt <= stored.LastActiveAt {
+		t.Errorf("the sessions listed are %+v, %v", sessions, err)
+	}
+	// A new IP is written right away, once
+	validate(20, "203.0.113.7")
+	if n := writes.Load(); n != 2 {
+		t.Errorf("the requests from a new IP wrote %d times", n-1)
+	}
+	if stored := storedSession(t, loginSession.Id); stored.Ip != "203.0.113.7" {
+		t.Errorf("the IP written is %s", stored.Ip)
+	}
+}
+
+// sessionLimitCode returns the code of the session limit err tells of.
+func sessionLimitCode(err error) locale.ErrorCode {
+	var coded *locale.Error
+	if errors.As(err, &coded) {
+		return coded.Code
+	}
+	return ""
+}
+
+func TestSessionTimeouts(t *testing.T) {
+	user, _ := sessionTestDB(t)
+	var s LoginSessionService
+	if err := s.settingService.setInt("sessionIdleTimeout", 15); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.settingService.setInt("sessionLifetime", 60); err != nil {
+		t.Fatal(err)
+	}
+
+	token, loginSession := createSession(t, &s, user)
+	ageSession(t, loginSession.Id, 14*time.Minute)
+	if _, err := s.Validate(token, user, "198.51.100.1", "Firefox"); err != nil {
+		t.Fatal("the session idle for 14 minutes is refused:", err)
+	}
+	ageSession(t, loginSession.Id, 16*time.Minute)
+	_, err := s.Validate(token, user, "198.51.100.1", "Firefox")
+	if sessionLimitCode(err) != locale.ErrSessionIdle || err.Error() != "You were logged out after 15 minutes of inactivity, please log in again" {
+		t.Errorf("the idle session gave %v", err)
+	}
+	if storedSession(t, loginSession.Id) != nil {
+		t.Error("the idle session wasn't ended")
+	}
+
+	// Used in the meantime, as in memory, a session isn't idle even though the
+	// database has an older activity
+	token, loginSession = createSession(t, &s, user)
+	ageSession(t, loginSession.Id, 16*time.Minute)
+	loginActivity.Lock()
+	loginActivity.sessions[loginSession.Id] = &sessionActivity{last: time.Now().UnixMilli(), written: 1, ip: "198.51.100.1"}
+	loginActivity.Unlock()
+	if _, err := s.Validate(token, user, "198.51.100.1", "Firefox"); err != nil {
+		t.Error("the session used in memory is idle:", err)
+	}
+
+	// However active, a session ends after its lifetime
+	token, loginSession = createSession(t, &s, user)
+	if err := database.GetDB().Model(model.LoginSession{}).Where("id = ?", loginSession.Id).
+		Update("created_at", time.Now().Add(-61*time.Minute).UnixMilli()).Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Validate(token, user, "198.51.100.1", "Firefox"); sessionLimitCode(err) != locale.ErrSessionLifetime {
+		t.Errorf("the session past its lifetime gave %v", err)
+	}
+
+	// The limits of the user override those of the settings
+	noIdle := 0
+	user.SessionLimits = &model.SessionLimits{IdleMinutes: &noIdle}
+	token, loginSession = createSession(t, &s, user)
+	ageSession(t, loginSession.Id, 50*time.Minute)
+	if _, err := s.Validate(token, user, "198.51.100.1", "Firefox"); err != nil {
+		t.Error("the session of a user without an idle timeout is idle:", err)
+	}
+}
+
+func TestSessionLimitsOf(t *testing.T) {
+	sessionTestDB(t)
+	var s LoginSessionService
+	for key, value := range map[string]int{"sessionIdleTimeout": 15, "sessionLifetime": -5, "sessionMaxConcurrent": 2} {
+		if err := s.settingService.setInt(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if limits := s.SessionLimitsOf(nil); limits != (SessionLimits{Idle: 15 * time.Minute, MaxSessions: 2}) {
+		t.Errorf("the limits of the settings are %+v", limits)
+	}
+	if err := s.settingService.setString("sessionLimitPolicy", SessionLimitReject); err != nil {
+		t.Fatal(err)
+	}
+	lifetime, most := 480, 0
+	user := &model.User{SessionLimits: &model.SessionLimits{LifetimeMinutes: &lifetime, MaxSessions: &most}}
+	if limits := s.SessionLimitsOf(user); limits != (SessionLimits{Idle: 15 * time.Minute, Lifetime: 8 * time.Hour, Reject: true}) {
+		t.Errorf("the limits of the user are %+v", limits)
+	}
+}
+
+func TestSessionMaxConcurrent(t *testing.T) {
+	user, _ := sessionTestDB(t)
+	var s LoginSessionService
+	if err := s.settingService.setInt("sessionMaxConcurrent", 2); err != nil {
+		t.Fatal(err)
+	}
+	count := func() int64 {
+		var n int64
+		if err := database.GetDB().Model(model.LoginSession{}).Where("user_id = ?", user.Id).Count(&n).Error; err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	// Evicting, a third login ends the oldest session
+	oldest, _ := createSession(t, &s, user)
+	second, _ := createSession(t, &s, user)
+	third, _ := createSession(t, &s, user)
+	if n := count(); n != 2 {
+		t.Errorf("the user has %d sessions", n)
+	}
+	if _, err := s.Validate(oldest, user, "198.51.100.1", "Firefox"); err == nil {
+		t.Error("the oldest session wasn't ended")
+	}
+	for _, token := range []string{second, third} {
+		if _, err := s.Validate(token, user, "198.51.100.1", "Firefox"); err != nil {
+			t.Error("a newer session was ended:", err)
+		}
+	}
+
+	// Rejecting, the login is refused and the sessions are kept
+	if err := s.settingService.setString("sessionLimitPolicy", SessionLimitReject); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Create(user.Id, "198.51.100.1", "Firefox", 0); sessionLimitCode(err) != locale.ErrSessionLimit {
+		t.Errorf("the login beyond the limit gave %v", err)
+	}
+	if err := s.settingService.setInt("rememberMaxAge", 30); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.CreateRemembered(user.Id, "198.51.100.1", "Firefox", "device"); sessionLimitCode(err) != locale.ErrSessionLimit {
+		t.Errorf("the remembered login beyond the limit gave %v", err)
+	}
+	if n := count(); n != 2 {
+		t.Errorf("the refused logins left %d sessions", n)
+	}
+
+	// A user allowed more
+	most := 3
+	if err := (&UserService{}).SetSessionLimits(user.Id, &model.SessionLimits{MaxSessions: &most}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Create(user.Id, "198.51.100.1", "Firefox", 0); err != nil {
+		t.Error("the login within the limit of the user was refused:", err)
+	}
+}
+
+func TestRefreshSessionLimits(t *testing.T) {
+	user, _ := sessionTestDB(t)
+	var s LoginSessionService
+	if err := s.settingService.setInt("rememberMaxAge", 30); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.settingService.setInt("sessionIdleTimeout", 15); err != nil {
+		t.Fatal(err)
+	}
+	login, err := s.CreateRemembered(user.Id, "198.51.100.1", "Firefox", "device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ageSession(t, login.Session.Id, 20*time.Minute)
+	result, err := s.Refresh(login.RefreshToken, "device", "198.51.100.1", "Firefox")
+	if sessionLimitCode(err) != locale.ErrSessionIdle || result == nil || result.Exceeded == nil {
+		t.Errorf("refreshing the idle session gave %+v, %v", result, err)
+	}
+	if storedSession(t, login.Session.Id) != nil {
+		t.Error("the idle remembered session wasn't ended")
+	}
+}
@@ -0,0 +1,96 @@
+package service
+
+import (
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/xray"
+)
+
+// MetricsSnapshot is the state of the panel in a few numbers, for the monitors
+// that don't scrape Prometheus. Its field names are kept as they are.
+type MetricsSnapshot struct {
+	Time                 int64                    `json:"time" description:"When the snapshot was taken, in unix milliseconds"`
+	PanelUptime          int64                    `json:"panelUptimeSeconds" description:"Seconds since the panel started"`
+	XrayRunning          bool                     `json:"xrayRunning" description:"Whether Xray is running"`
+	XrayUptime           int64                    `json:"xrayUptimeSeconds" description:"Seconds since Xray started, 0 if it is not running"`
+	ClientsTotal         int64                    `json:"clientsTotal" description:"Clients of all inbounds"`
+	ClientsOnline        int                      `json:"clientsOnline" description:"Clients seen within the online window"`
+	DbSize               int64                    `json:"dbSizeBytes" description:"Size of the database in bytes"`
+	LastBackupAge        int64                    `json:"lastBackupAgeSeconds" description:"Seconds since the last backup of the backup folder, -1 if there is none"`
+	FailedLoginsLastHour int                      `json:"failedLoginsLastHour" description:"Logins that failed in the last hour"`
+	PendingAlerts        int                      `json:"pendingAlerts" description:"Alerts to the email and the webhook not sent yet"`
+	Inbounds             []MetricsSnapshotInbound `json:"inbounds" description:"Traffic of each inbound"`
+}
+
+// MetricsSnapshotInbound is the traffic of an inbound in a MetricsSnapshot,
+// today's as of the last flush of the traffic.
+type MetricsSnapshotInbound struct {
+	Id        int    `json:"id" description:"Id of the inbound"`
+	Tag       string `json:"tag" description:"Tag of the inbound"`
+	Up        int64  `json:"upBytes" description:"Bytes uploaded in all"`
+	Down      int64  `json:"downBytes" description:"Bytes downloaded in all"`
+	UpToday   int64  `json:"upTodayBytes" description:"Bytes uploaded since the start of the day in the panel time zone"`
+	DownToday int64  `json:"downTodayBytes" description:"Bytes downloaded since the start of the day in the panel time zone"`
+}
+
+// MetricsSnapshotService takes the snapshots of the metrics. Everything is read
+// from memory or with a query of a few rows, the clients are only counted.
+type MetricsSnapshotService struct {
+	xrayService    XrayService
+	inboundService InboundService
+	backupService  BackupService
+	alertService   AlertService
+}
+
+// GetSnapshot takes a snapshot of the metrics. A number that can't be read is
+// logged and left at 0, the snapshot fails only without the inbounds.
+func (s *MetricsSnapshotService) GetSnapshot() (*MetricsSnapshot, error) {
+	now := time.Now()
+	snapshot := &MetricsSnapshot{
+		Time:                 now.UnixMilli(),
+		PanelUptime:          int64(now.Sub(panelStartTime).Seconds()),
+		XrayRunning:          s.xrayService.IsXrayRunning(),
+		XrayUptime:           int64(s.xrayService.GetXrayUptime()),
+		ClientsOnline:        len(s.inboundService.GetOnlineClients()),
+		LastBackupAge:        -1,
+		FailedLoginsLastHour: logger.AuthFailures(),
+		PendingAlerts:        s.alertService.PendingAlerts(),
+		Inbounds:             []MetricsSnapshotInbound{},
+	}
+
+	db := database.GetDB()
+	var inbounds []model.Inbound
+	if err := db.Model(model.Inbound{}).Select("id, tag, up, down").Order("id").Find(&inbounds).Error; err != nil {
+		return nil, err
+	}
+	today, err := s.inboundService.GetInboundsTrafficToday()
+	if err != nil {
+		logger.Warning("metrics snapshot: get the traffic of today failed:", err)
+	}
+	for _, inbound := range inbounds {
+		snapshot.Inbounds = append(snapshot.Inbounds, MetricsSnapshotInbound{
+			Id:        inbound.Id,
+			Tag:       inbound.Tag,
+			Up:        inbound.Up,
+			Down:      inbound.Down,
+			UpToday:   today[inbound.Id].Up,
+			DownToday: today[inbound.Id].Down,
+		})
+	}
+
+	if err := db.Model(xray.ClientTraffic{}).Count(&snapshot.ClientsTotal).Error; err != nil {
+		logger.Warning("metrics snapshot: count the clients failed:", err)
+	}
+	if snapshot.DbSize, err = database.Size(); err != nil {
+		logger.Warning("metrics snapshot: get the database size failed:", err)
+	}
+	if backups, err := s.backupService.List(); err != nil {
+		logger.Warning("metrics snapshot: list the backups failed:", err)
+	} else if len(backups) > 0 {
+		snapshot.LastBackupAge = max(int64(now.Sub(backups[0].Time).Seconds()), 0)
+	}
+	return snapshot, nil
+}
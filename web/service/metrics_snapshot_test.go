@@ -0,0 +1,148 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/xray"
+
+	"gorm.io/gorm"
+)
+
+// metricsTestDB opens a new panel database with inbounds, each with clients
+// of their own, and returns the inbounds. The traffic of today is counted
+// afresh for it.
+func metricsTestDB(tb testing.TB, inbounds int, clients int) []*model.Inbound {
+	tb.Helper()
+	inboundsToday.Lock()
+	inboundsToday.inbounds = nil
+	inboundsToday.Unlock()
+
+	created := make([]*model.Inbound, 0, inbounds)
+	newTestDB(tb, func(db *gorm.DB) error {
+		for i := range inbounds {
+			port := 20101 + i
+			inbound := &model.Inbound{
+				Remark: "metrics", Enable: true, Port: port, Protocol: model.Trojan, Tag: "inbound-" + strconv.Itoa(port),
+				Up: int64(1000 * (i + 1)), Down: int64(2000 * (i + 1)), Settings: `{"clients":[]}`,
+			}
+			if err := db.Create(inbound).Error; err != nil {
+				return err
+			}
+			traffics := make([]xray.ClientTraffic, clients)
+			for j := range traffics {
+				traffics[j] = xray.ClientTraffic{InboundId: inbound.Id, Enable: true, Email: inbound.Tag + "-" + strconv.Itoa(j), Up: 10, Down: 20}
+			}
+			if err := db.CreateInBatches(traffics, 500).Error; err != nil {
+				return err
+			}
+			created = append(created, inbound)
+		}
+		return nil
+	})
+	return created
+}
+
+// addHourlyTraffic adds the traffic of an inbound in the hour at.
+func addHourlyTraffic(t *testing.T, inbound *model.Inbound, at time.Time, up int64, down int64) {
+	t.Helper()
+	err := database.GetDB().Create(&model.HourlyTraffic{
+		Entity: model.TrafficEntityInbound, EntityId: strconv.Itoa(inbound.Id), Hour: at.UnixMilli(), Up: up, Down: down,
+	}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMetricsSnapshot(t *testing.T) {
+	inbounds := metricsTestDB(t, 2, 3)
+	today := dayStart(time.Now().In(panelLocation()))
+	addHourlyTraffic(t, inbounds[0], today, 100, 200)
+	addHourlyTraffic(t, inbounds[0], today.Add(time.Hour), 10, 20)
+	addHourlyTraffic(t, inbounds[0], today.Add(-time.Hour), 5000, 5000)
+	addHourlyTraffic(t, inbounds[1], today.Add(-time.Hour), 5000, 5000)
+
+	s := &MetricsSnapshotService{}
+	snapshot, err := s.GetSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.ClientsTotal != 6 || snapshot.XrayRunning || snapshot.XrayUptime != 0 || snapshot.PanelUptime < 0 {
+		t.Errorf("the snapshot is %+v", snapshot)
+	}
+	if snapshot.DbSize <= 0 || snapshot.LastBackupAge != -1 || snapshot.PendingAlerts != int(alertsPending.Load()) {
+		t.Errorf("the snapshot has the database of %d bytes, the last backup %ds ago, %d pending alerts",
+			snapshot.DbSize, snapshot.LastBackupAge, snapshot.PendingAlerts)
+	}
+	want := []MetricsSnapshotInbound{
+		{Id: inbounds[0].Id, Tag: "inbound-20101", Up: 1000, Down: 2000, UpToday: 110, DownToday: 220},
+		{Id: inbounds[1].Id, Tag: "inbound-20102", Up: 2000, Down: 4000},
+	}
+	if len(snapshot.Inbounds) != len(want) || snapshot.Inbounds[0] != want[0] || snapshot.Inbounds[1] != want[1] {
+		t.Errorf("the inbounds are %+v, want %+v", snapshot.Inbounds, want)
+	}
+
+	// The traffic of today is cached until the next flush
+	addHourlyTraffic(t, inbounds[1], today.Add(2*time.Hour), 1, 2)
+	if snapshot, _ := s.GetSnapshot(); snapshot.Inbounds[1].UpToday != 0 {
+		t.Errorf("the traffic of today was counted again before a flush: %+v", snapshot.Inbounds[1])
+	}
+	trafficFlushed(nil, nil)
+	if snapshot, _ := s.GetSnapshot(); snapshot.Inbounds[1].UpToday != 1 || snapshot.Inbounds[1].DownToday != 2 {
+		t.Errorf("the traffic of today after a flush is %+v", snapshot.Inbounds[1])
+	}
+
+	// The age of the last backup of the backup folder
+	backups := filepath.Join(os.Getenv("XUI_DB_FOLDER"), "backups")
+	if err := os.MkdirAll(backups, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, age := range []time.Duration{90 * time.Minute, 48 * time.Hour} {
+		name := "x-ui-" + time.Now().Add(-age).Format(backupTimeLayout) + "-v2.5.0.db"
+		if err := os.WriteFile(filepath.Join(backups, name), []byte("backup"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if snapshot, _ := s.GetSnapshot(); snapshot.LastBackupAge < 5399 || snapshot.LastBackupAge > 5402 {
+		t.Errorf("the last backup is %ds old, want 5400", snapshot.LastBackupAge)
+	}
+}
+
+// metricsSnapshotBudget is how long a snapshot of a node with thousands of
+// clients may take
+const metricsSnapshotBudget = 100 * time.Millisecond
+
+func TestMetricsSnapshotFast(t *testing.T) {
+	metricsTestDB(t, 40, 500)
+	s := &MetricsSnapshotService{}
+	// The first one counts the traffic of today, as after each flush
+	start := time.Now()
+	snapshot, err := s.GetSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(start); took >= metricsSnapshotBudget {
+		t.Errorf("a snapshot of %d clients took %s", snapshot.ClientsTotal, took)
+	}
+	if snapshot.ClientsTotal != 20000 || len(snapshot.Inbounds) != 40 {
+		t.Errorf("the snapshot has %d clients, %d inbounds", snapshot.ClientsTotal, len(snapshot.Inbounds))
+	}
+}
+
+func BenchmarkMetricsSnapshot(b *testing.B) {
+	metricsTestDB(b, 40, 500)
+	s := &MetricsSnapshotService{}
+	for b.Loop() {
+		if _, err := s.GetSnapshot(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if perOp := b.Elapsed() / time.Duration(b.N); perOp >= metricsSnapshotBudget {
+		b.Errorf("a snapshot of 20000 clients took %s", perOp)
+	}
+}
@@ -0,0 +1,899 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"maps"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/util/crypto"
+	"x-ui/xray"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// nodeSyncInterval is how often a node is synced when nothing changed on
+	// the panel, for the drift on the node and its traffic
+	nodeSyncInterval = time.Minute
+	// nodeSyncTimeout bounds a sync of a node
+	nodeSyncTimeout = 5 * time.Minute
+)
+
+// The actions of a sync on the inbounds of a node.
+const (
+	NodeCreate = "create"
+	NodeUpdate = "update"
+	NodeDelete = "delete"
+	// NodeAdopt takes an inbound the node already has as the panel has it
+	NodeAdopt = "adopt"
+	// NodeConflict leaves an inbound changed on the node as it is, until the
+	// conflict is resolved
+	NodeConflict = "conflict"
+)
+
+// What the resolution of a conflict keeps.
+const (
+	NodeKeepMaster = "master"
+	NodeKeepNode   = "node"
+)
+
+var (
+	// nodeSyncLock lets a single sync run at a time, of the job or of the API
+	nodeSyncLock sync.Mutex
+	// nodeJobLock skips the runs of the job while the last one still syncs
+	nodeJobLock sync.Mutex
+	// nodeSyncWrites are the writes to the inbounds and the clients as of the
+	// last sync of each node, by its id
+	nodeSyncWrites = map[int]uint64{}
+)
+
+// NodeChange is what a sync did, or would do, to an inbound of a node: the
+// fields and the clients of the node that differ from those of the panel.
+type NodeChange struct {
+	Tag            string   `json:"tag"`
+	Action         string   `json:"action"`
+	Reason         string   `json:"reason"`
+	Fields         []string `json:"fields,omitempty"`
+	ClientsAdded   []string `json:"clientsAdded,omitempty"`
+	ClientsRemoved []string `json:"clientsRemoved,omitempty"`
+	ClientsChanged []string `json:"clientsChanged,omitempty"`
+	// ConflictAt is when the conflict was first seen, for the open ones
+	ConflictAt int64  `json:"conflictAt,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// NodeSyncResult is how a sync of a node went, or would go for a dry run.
+// InSync counts the inbounds the node has as the panel.
+type NodeSyncResult struct {
+	Node    string       `json:"node"`
+	DryRun  bool         `json:"dryRun"`
+	InSync  int          `json:"inSync"`
+	Changes []NodeChange `json:"changes"`
+}
+
+// NodeService keeps the nodes, remote panels the inbounds of the panel and
+// their clients are pushed to through their API. A sync pushes what changed
+// on the panel, re-applies what drifted on the node and pulls the traffic of
+// the clients back, for the quotas to count the traffic of all nodes. The
+// panel enforces the quotas and the expiry of the clients: they are pushed
+// without them, disabled once the panel disables them.
+type NodeService struct {
+	settingService SettingService
+	webhookService WebhookService
+}
+
+// GetNodes returns the nodes with their tokens masked and their open
+// conflicts counted.
+func (s *NodeService) GetNodes() ([]*model.Node, error) {
+	db := database.GetDB()
+	nodes := []*model.Node{}
+	if err := db.Model(model.Node{}).Order("id").Find(&nodes).Error; err != nil {
+		return nil, err
+	}
+	var counts []struct {
+		NodeId    int
+		Conflicts int
+	}
+	err := db.Model(model.NodeInbound{}).Select("node_id, COUNT(*) AS conflicts").
+		Where("conflict <> ''").Group("node_id").Scan(&counts).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, node := range nodes {
+		maskNode(node)
+		for _, count := range counts {
+			if count.NodeId == node.Id {
+				node.Conflicts = count.Conflicts
+			}
+		}
+	}
+	return nodes, nil
+}
+
+// GetNode returns a node with its token masked.
+func (s *NodeService) GetNode(id int) (*model.Node, error) {
+	node := &model.Node{}
+	if err := database.GetDB().Model(model.Node{}).Where("id = ?", id).First(node).Error; err != nil {
+		return nil, err
+	}
+	maskNode(node)
+	return node, nil
+}
+
+func maskNode(node *model.Node) {
+	if node.Token != "" {
+		node.Token = remoteSecretMask
+	}
+}
+
+// getNode returns a node with its token decrypted.
+func (s *NodeService) getNode(id int) (*model.Node, error) {
+	node := &model.Node{}
+	if err := database.GetDB().Model(model.Node{}).Where("id = ?", id).First(node).Error; err != nil {
+		return nil, err
+	}
+	if node.Token == "" {
+		return node, nil
+	}
+	key, err := s.settingService.GetSecret()
+	if err != nil {
+		return nil, err
+	}
+	if node.Token, err = crypto.Decrypt(key, node.Token); err != nil {
+		return nil, common.NewErrorf("unable to decrypt the token of node %s: %v", node.Name, err)
+	}
+	return node, nil
+}
+
+// checkNode validates a node and puts its fields in their stored form.
+func (s *NodeService) checkNode(node *model.Node) error {
+	node.Name = strings.TrimSpace(node.Name)
+	if node.Name == "" {
+		return common.NewError("the node needs a name")
+	}
+	base, err := parseNodeUrl(node.ApiUrl)
+	if err != nil {
+		return err
+	}
+	node.ApiUrl = base.String()
+	node.Token = strings.TrimSpace(node.Token)
+	if node.Token == "" {
+		return common.NewErrorf("node %s needs an API token", node.Name)
+	}
+	switch node.ConflictPolicy {
+	case "":
+		node.ConflictPolicy = model.NodeMasterWins
+	case model.NodeMasterWins, model.NodeManual:
+	default:
+		return common.NewErrorf("unknown conflict policy %q", node.ConflictPolicy)
+	}
+	tags := []string{}
+	for _, tag := range node.Inbounds {
+		if tag = strings.TrimSpace(tag); tag != "" && !slices.Contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	node.Inbounds = tags
+	return nil
+}
+
+// sealNode encrypts the token of a node.
+func (s *NodeService) sealNode(node *model.Node) error {
+	key, err := s.settingService.GetSecret()
+	if err != nil {
+		return err
+	}
+	node.Token, err = crypto.Encrypt(key, node.Token)
+	return err
+}
+
+// AddNode adds a node, synced by the next run of the job if it is enabled.
+func (s *NodeService) AddNode(node *model.Node) (*model.Node, error) {
+	node.Id = 0
+	node.Healthy, node.XrayState, node.Latency, node.LastError, node.LastSyncAt = false, "", 0, "", 0
+	if err := s.checkNode(node); err != nil {
+		return nil, err
+	}
+	if err := s.sealNode(node); err != nil {
+		return nil, err
+	}
+	if err := database.GetDB().Create(node).Error; err != nil {
+		return nil, err
+	}
+	return s.GetNode(node.Id)
+}
+
+// UpdateNode replaces the settings of a node, its health kept. The mask as
+// the token keeps the saved one. A node moved to another URL is another panel:
+// what was pushed to the old one is forgotten, not deleted from it.
+func (s *NodeService) UpdateNode(node *model.Node) (*model.Node, error) {
+	old, err := s.getNode(node.Id)
+	if err != nil {
+		return nil, err
+	}
+	if node.Token == remoteSecretMask {
+		node.Token = old.Token
+	}
+	if err := s.checkNode(node); err != nil {
+		return nil, err
+	}
+	node.Healthy, node.XrayState, node.Latency, node.LastError, node.LastSyncAt =
+		old.Healthy, old.XrayState, old.Latency, old.LastError, old.LastSyncAt
+	if err := s.sealNode(node); err != nil {
+		return nil, err
+	}
+
+	nodeSyncLock.Lock()
+	defer nodeSyncLock.Unlock()
+	err = database.GetDB().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(node).Error; err != nil {
+			return err
+		}
+		if node.ApiUrl == old.ApiUrl {
+			return nil
+		}
+		return forgetNode(tx, node.Id)
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Synced again by the next run of the job
+	delete(nodeSyncWrites, node.Id)
+	return s.GetNode(node.Id)
+}
+
+// DelNode deletes a node. The inbounds pushed to it are left on it.
+func (s *NodeService) DelNode(id int) error {
+	nodeSyncLock.Lock()
+	defer nodeSyncLock.Unlock()
+	delete(nodeSyncWrites, id)
+	return database.GetDB().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(model.Node{}, id).Error; err != nil {
+			return err
+		}
+		return forgetNode(tx, id)
+	})
+}
+
+// forgetNode deletes what was pushed to a node and pulled from it.
+func forgetNode(tx *gorm.DB, id int) error {
+	if err := tx.Where("node_id = ?", id).Delete(model.NodeInbound{}).Error; err != nil {
+		return err
+	}
+	return tx.Where("node_id = ?", id).Delete(model.NodeClientTraffic{}).Error
+}
+
+// SyncNodes syncs the enabled nodes the inbounds or the clients of the panel
+// changed for since their last sync, and those last synced a while ago.
+func (s *NodeService) SyncNodes() {
+	if !nodeJobLock.TryLock() {
+		return
+	}
+	defer nodeJobLock.Unlock()
+	nodes := []*model.Node{}
+	if err := database.GetDB().Model(model.Node{}).Where("enable = ?", true).Order("id").Find(&nodes).Error; err != nil {
+		logger.Warning("Unable to read the nodes:", err)
+		return
+	}
+	writes := database.Writes("inbounds", "client_traffics")
+	for _, node := range nodes {
+		nodeSyncLock.Lock()
+		last, synced := nodeSyncWrites[node.Id]
+		nodeSyncLock.Unlock()
+		if synced && last == writes && time.Since(time.UnixMilli(node.LastSyncAt)) < nodeSyncInterval {
+			continue
+		}
+		if _, err := s.Sync(node.Id, false); err != nil {
+			logger.Warning("Unable to sync node", node.Name+":", err)
+		}
+	}
+}
+
+// Sync brings a node to the inbounds of the panel in its scope and pulls its
+// traffic, or with dryRun only tells what it would change. The health of the
+// node is kept from how a sync went.
+func (s *NodeService) Sync(id int, dryRun bool) (*NodeSyncResult, error) {
+	nodeSyncLock.Lock()
+	defer nodeSyncLock.Unlock()
+	node, err := s.getNode(id)
+	if err != nil {
+		return nil, err
+	}
+	writes := database.Writes("inbounds", "client_traffics")
+	result, err := s.sync(node, dryRun)
+	if dryRun {
+		return result, err
+	}
+	nodeSyncWrites[node.Id] = writes
+
+	updates := map[string]any{
+		"healthy":      err == nil,
+		"xray_state":   node.XrayState,
+		"latency":      node.Latency,
+		"last_error":   "",
+		"last_sync_at": time.Now().UnixMilli(),
+	}
+	if err != nil {
+		updates["last_error"] = err.Error()
+		if node.Healthy {
+			logger.Warning("Node", node.Name, "is unhealthy:", err)
+		}
+	} else if !node.Healthy && node.LastSyncAt > 0 {
+		logger.Info("Node", node.Name, "is healthy again")
+	}
+	if errSave := database.GetDB().Model(model.Node{}).Where("id = ?", node.Id).Updates(updates).Error; errSave != nil {
+		logger.Warning("Unable to save the health of node", node.Name+":", errSave)
+	}
+	return result, err
+}
+
+// GetConflicts returns the inbounds of a node changed on it that the policy
+// of the node keeps until they are resolved, with how they differ from the
+// panel.
+func (s *NodeService) GetConflicts(id int) ([]NodeChange, error) {
+	result, err := s.Sync(id, true)
+	if err != nil {
+		return nil, err
+	}
+	conflicts := []NodeChange{}
+	for _, change := range result.Changes {
+		if change.Action == NodeConflict {
+			conflicts = append(conflicts, change)
+		}
+	}
+	return conflicts, nil
+}
+
+// ResolveConflict ends the conflict of an inbound of a node by keeping the
+// inbound of the panel, pushed over the one of the node, or the one of the
+// node, kept until the inbound changes on the panel again.
+func (s *NodeService) ResolveConflict(id int, tag string, keep string) (*NodeChange, error) {
+	if keep != NodeKeepMaster && keep != NodeKeepNode {
+		return nil, common.NewErrorf("a conflict keeps %q or %q, not %q", NodeKeepMaster, NodeKeepNode, keep)
+	}
+	nodeSyncLock.Lock()
+	defer nodeSyncLock.Unlock()
+	node, err := s.getNode(id)
+	if err != nil {
+		return nil, err
+	}
+	state := &model.NodeInbound{}
+	err = database.GetDB().Model(model.NodeInbound{}).Where("node_id = ? AND tag = ?", id, tag).First(state).Error
+	if err != nil {
+		return nil, err
+	}
+	if state.Conflict == "" {
+		return nil, common.NewErrorf("inbound %s has no conflict on node %s", tag, node.Name)
+	}
+
+	client, err := newNodeClient(node)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), nodeSyncTimeout)
+	defer cancel()
+	remotes, err := client.inbounds(ctx)
+	if err != nil {
+		return nil, err
+	}
+	wants, _, err := s.nodeInbounds(node)
+	if err != nil {
+		return nil, err
+	}
+	want, remote := findInbound(wants, tag), findInbound(remotes, tag)
+	if want == nil || remote == nil {
+		return nil, common.NewErrorf("inbound %s is not on both the panel and node %s anymore", tag, node.Name)
+	}
+
+	change := &NodeChange{Tag: tag, Action: NodeAdopt, Reason: "conflict resolved for the node"}
+	change.Fields, change.ClientsAdded, change.ClientsRemoved, change.ClientsChanged = diffNodeInbound(want, remote)
+	if keep == NodeKeepMaster {
+		change.Action, change.Reason = NodeUpdate, "conflict resolved for the panel"
+		if err := s.push(ctx, client, node, want, remote, state); err != nil {
+			return nil, err
+		}
+		return change, nil
+	}
+	state.Pushed, state.Remote, state.Conflict = nodeInboundHash(want), nodeInboundHash(remote), ""
+	return change, database.GetDB().Save(state).Error
+}
+
+// sync reconciles the inbounds of a node with those of the panel. Deleted
+// inbounds go first, for their ports to be free for those that replace them.
+func (s *NodeService) sync(node *model.Node, dryRun bool) (*NodeSyncResult, error) {
+	result := &NodeSyncResult{Node: node.Name, DryRun: dryRun, Changes: []NodeChange{}}
+	client, err := newNodeClient(node)
+	if err != nil {
+		return result, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), nodeSyncTimeout)
+	defer cancel()
+	start := time.Now()
+	if node.XrayState, err = client.status(ctx); err != nil {
+		return result, err
+	}
+	node.Latency = time.Since(start).Milliseconds()
+	remotes, err := client.inbounds(ctx)
+	if err != nil {
+		return result, err
+	}
+	wants, emails, err := s.nodeInbounds(node)
+	if err != nil {
+		return result, err
+	}
+	rows := []*model.NodeInbound{}
+	if err := database.GetDB().Model(model.NodeInbound{}).Where("node_id = ?", node.Id).Find(&rows).Error; err != nil {
+		return result, err
+	}
+	states := map[string]*model.NodeInbound{}
+	for _, row := range rows {
+		states[row.Tag] = row
+	}
+	if !dryRun {
+		if err := s.pullTraffic(node, remotes, states, emails); err != nil {
+			return result, err
+		}
+	}
+
+	errs := []error{}
+	for _, state := range rows {
+		if findInbound(wants, state.Tag) != nil {
+			continue
+		}
+		remote := findInbound(remotes, state.Tag)
+		if remote != nil {
+			change := NodeChange{Tag: state.Tag, Action: NodeDelete, Reason: "no longer pushed to the node"}
+			if !dryRun {
+				if err := client.deleteInbound(ctx, remote.Id); err != nil {
+					change.Error = err.Error()
+					errs = append(errs, err)
+					result.Changes = append(result.Changes, change)
+					continue
+				}
+			}
+			result.Changes = append(result.Changes, change)
+		}
+		if !dryRun {
+			if err := database.GetDB().Delete(state).Error; err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	for _, want := range wants {
+		change, err := s.syncInbound(ctx, client, node, want, findInbound(remotes, want.Tag), states[want.Tag], dryRun)
+		if err != nil {
+			errs = append(errs, common.NewErrorf("%s: %v", want.Tag, err))
+			change.Error = err.Error()
+		}
+		if change == nil {
+			result.InSync++
+			continue
+		}
+		result.Changes = append(result.Changes, *change)
+	}
+	return result, common.Combine(errs...)
+}
+
+// syncInbound reconciles an inbound of the panel with the one of the node of
+// the same tag, remote, given the state it was last pushed in. It returns nil
+// for an inbound in sync.
+func (s *NodeService) syncInbound(ctx context.Context, client *nodeClient, node *model.Node, want *model.Inbound, remote *model.Inbound, state *model.NodeInbound, dryRun bool) (*NodeChange, error) {
+	wantHash := nodeInboundHash(want)
+	change := &NodeChange{Tag: want.Tag}
+	if remote == nil {
+		change.Action, change.Reason = NodeCreate, "missing on the node"
+		if state != nil {
+			change.Reason = "deleted on the node"
+		}
+		change.ClientsAdded = slices.Sorted(maps.Keys(nodeClients(want.Settings)))
+	} else {
+		remoteHash := nodeInboundHash(remote)
+		change.Fields, change.ClientsAdded, change.ClientsRemoved, change.ClientsChanged = diffNodeInbound(want, remote)
+		switch {
+		case state == nil && remoteHash == wantHash:
+			change.Action, change.Reason = NodeAdopt, "already on the node"
+		case state == nil:
+			change.Action, change.Reason = NodeUpdate, "first sync of an inbound the node has"
+		case remoteHash != state.Remote && node.ConflictPolicy == model.NodeManual:
+			change.Action, change.Reason, change.ConflictAt = NodeConflict, "changed on the node", state.ConflictAt
+		case remoteHash != state.Remote:
+			change.Action, change.Reason = NodeUpdate, "changed on the node, the panel wins"
+		case wantHash != state.Pushed:
+			change.Action, change.Reason = NodeUpdate, "changed on the panel"
+		default:
+			return nil, nil
+		}
+		if change.Action == NodeConflict && !dryRun && state.Conflict != remoteHash {
+			if state.Conflict == "" {
+				state.ConflictAt = time.Now().UnixMilli()
+				change.ConflictAt = state.ConflictAt
+			}
+			state.Conflict = remoteHash
+			s.reportConflict(node, want.Tag, change)
+			return change, database.GetDB().Save(state).Error
+		}
+		if state != nil && remoteHash != state.Remote && change.Action == NodeUpdate && !dryRun {
+			state.ConflictAt = time.Now().UnixMilli()
+			s.reportConflict(node, want.Tag, change)
+		}
+	}
+	if dryRun || change.Action == NodeConflict {
+		return change, nil
+	}
+	if state == nil {
+		state = &model.NodeInbound{NodeId: node.Id, Tag: want.Tag}
+	}
+	if change.Action == NodeAdopt {
+		state.Pushed, state.Remote, state.PushedAt = wantHash, nodeInboundHash(remote), time.Now().UnixMilli()
+		state.Up, state.Down = remote.Up, remote.Down
+		if err := database.GetDB().Save(state).Error; err != nil {
+			return change, err
+		}
+		return change, baselineNodeClients(node.Id, remote)
+	}
+	return change, s.push(ctx, client, node, want, remote, state)
+}
+
+// push creates the inbound want on the node, or updates remote to it, and
+// keeps the state of the inbound as the node has it after.
+func (s *NodeService) push(ctx context.Context, client *nodeClient, node *model.Node, want *model.Inbound, remote *model.Inbound, state *model.NodeInbound) error {
+	var pushed *model.Inbound
+	var err error
+	if remote == nil {
+		pushed, err = client.createInbound(ctx, nodeInboundBody(want))
+	} else {
+		pushed, err = client.updateInbound(ctx, remote.Id, nodeInboundBody(want))
+	}
+	if err != nil {
+		return err
+	}
+	if remote == nil || state.Id == 0 {
+		state.Up, state.Down = pushed.Up, pushed.Down
+	}
+	state.Pushed, state.Remote, state.Conflict = nodeInboundHash(want), nodeInboundHash(pushed), ""
+	state.PushedAt = time.Now().UnixMilli()
+	if err := database.GetDB().Save(state).Error; err != nil {
+		return err
+	}
+	logger.Debug("Pushed inbound", want.Tag, "to node", node.Name)
+	return baselineNodeClients(node.Id, pushed)
+}
+
+// reportConflict tells of an inbound changed on a node, and how its policy
+// handles it.
+func (s *NodeService) reportConflict(node *model.Node, tag string, change *NodeChange) {
+	logger.Warningf("Inbound %s was changed on node %s (%s), %s policy", tag, node.Name,
+		strings.Join(append(slices.Clone(change.Fields), change.ClientsChanged...), ", "), node.ConflictPolicy)
+	s.webhookService.Emit(WebhookNodeConflict, map[string]any{
+		"node":           node.Name,
+		"tag":            tag,
+		"policy":         node.ConflictPolicy,
+		"fields":         change.Fields,
+		"clientsAdded":   change.ClientsAdded,
+		"clientsRemoved": change.ClientsRemoved,
+		"clientsChanged": change.ClientsChanged,
+	})
+}
+
+// pullTraffic adds the traffic a node counted since the last pull, of the
+// inbounds pushed to it and of the clients of the panel, to the traffic of the
+// panel. A counter lower than last time was reset on the node and counts
+// from 0.
+func (s *NodeService) pullTraffic(node *model.Node, remotes []*model.Inbound, states map[string]*model.NodeInbound, emails map[string]bool) error {
+	db := database.GetDB()
+	rows := []*model.NodeClientTraffic{}
+	if err := db.Model(model.NodeClientTraffic{}).Where("node_id = ?", node.Id).Find(&rows).Error; err != nil {
+		return err
+	}
+	byEmail := make(map[string]*model.NodeClientTraffic, len(rows))
+	for _, row := range rows {
+		byEmail[row.Email] = row
+	}
+
+	inboundTraffics := []*xray.Traffic{}
+	clientTraffics := []*xray.ClientTraffic{}
+	pulled := []*model.NodeInbound{}
+	seen := map[string]bool{}
+	for _, remote := range remotes {
+		state := states[remote.Tag]
+		if state == nil {
+			continue
+		}
+		up, down := nodeCounterDelta(state.Up, remote.Up), nodeCounterDelta(state.Down, remote.Down)
+		if up+down > 0 {
+			inboundTraffics = append(inboundTraffics, &xray.Traffic{IsInbound: true, Tag: remote.Tag, Up: up, Down: down})
+		}
+		state.Up, state.Down = remote.Up, remote.Down
+		pulled = append(pulled, state)
+		for _, stat := range remote.ClientStats {
+			if !emails[stat.Email] {
+				continue
+			}
+			seen[stat.Email] = true
+			row := byEmail[stat.Email]
+			if row == nil {
+				row = &model.NodeClientTraffic{NodeId: node.Id, Email: stat.Email}
+				byEmail[stat.Email] = row
+			}
+			up, down := nodeCounterDelta(row.Up, stat.Up), nodeCounterDelta(row.Down, stat.Down)
+			if up+down > 0 {
+				clientTraffics = append(clientTraffics, &xray.ClientTraffic{Email: stat.Email, Up: up, Down: down})
+			}
+			row.Up, row.Down = stat.Up, stat.Down
+		}
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		for _, state := range pulled {
+			if err := tx.Model(state).Updates(map[string]any{"up": state.Up, "down": state.Down}).Error; err != nil {
+				return err
+			}
+		}
+		gone := []int{}
+		for email, row := range byEmail {
+			if !seen[email] {
+				if row.Id != 0 {
+					gone = append(gone, row.Id)
+				}
+				continue
+			}
+			if err := tx.Save(row).Error; err != nil {
+				return err
+			}
+		}
+		if len(gone) == 0 {
+			return nil
+		}
+		return tx.Delete(model.NodeClientTraffic{}, gone).Error
+	})
+	if err != nil {
+		return err
+	}
+	// Written with the traffic of the panel by the next flush of the traffic job
+	bufferTraffic(inboundTraffics, clientTraffics, nil)
+	return nil
+}
+
+func nodeCounterDelta(last int64, now int64) int64 {
+	if now < last {
+		return now
+	}
+	return now - last
+}
+
+// baselineNodeClients keeps the counters of the clients of an inbound just
+// pushed to a node, or adopted, for the traffic they counted before not to be
+// pulled.
+func baselineNodeClients(nodeId int, inbound *model.Inbound) error {
+	rows := []model.NodeClientTraffic{}
+	for _, stat := range inbound.ClientStats {
+		rows = append(rows, model.NodeClientTraffic{NodeId: nodeId, Email: stat.Email, Up: stat.Up, Down: stat.Down})
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	return database.GetDB().Clauses(clause.OnConflict{DoNothing: true}).Create(&rows).Error
+}
+
+// nodeInbounds returns the inbounds of the panel in the scope of a node, by
+// id, as they are pushed to it, and the emails of their clients.
+func (s *NodeService) nodeInbounds(node *model.Node) ([]*model.Inbound, map[string]bool, error) {
+	query := database.GetDB().Model(model.Inbound{}).Preload("ClientStats").Order("id")
+	if len(node.Inbounds) > 0 {
+		query = query.Where("tag IN ?", node.Inbounds)
+	}
+	inbounds := []*model.Inbound{}
+	if err := query.Find(&inbounds).Error; err != nil {
+		return nil, nil, err
+	}
+	wants := make([]*model.Inbound, 0, len(inbounds))
+	emails := map[string]bool{}
+	for _, inbound := range inbounds {
+		want, err := nodeInbound(inbound)
+		if err != nil {
+			return nil, nil, common.NewErrorf("inbound %s: %v", inbound.Tag, err)
+		}
+		wants = append(wants, want)
+		for _, stat := range inbound.ClientStats {
+			emails[stat.Email] = true
+		}
+	}
+	return wants, emails, nil
+}
+
+// nodeInbound returns an inbound as it is pushed to the nodes: without its
+// quota and expiry, nor those of its clients, and with the clients the panel
+// disabled disabled.
+func nodeInbound(inbound *model.Inbound) (*model.Inbound, error) {
+	enabled := make(map[string]bool, len(inbound.ClientStats))
+	for _, stat := range inbound.ClientStats {
+		enabled[stat.Email] = stat.Enable
+	}
+	settings := inbound.Settings
+	if settings != "" {
+		doc := map[string]any{}
+		decoder := json.NewDecoder(strings.NewReader(settings))
+		// The big numbers, as the ids of Telegram, are kept as they are
+		decoder.UseNumber()
+		if err := decoder.Decode(&doc); err != nil {
+			return nil, err
+		}
+		clients, _ := doc["clients"].([]any)
+		for _, entry := range clients {
+			client, ok := entry.(map[string]any)
+			if !ok {
+				continue
+			}
+			email, _ := client["email"].(string)
+			enable, set := client["enable"].(bool)
+			if on, ok := enabled[email]; ok && !on {
+				enable = false
+			} else if !set {
+				enable = true
+			}
+			client["enable"], client["totalGB"], client["expiryTime"], client["reset"] = enable, 0, 0, 0
+		}
+		data, err := json.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+		settings = string(data)
+	}
+	return &model.Inbound{
+		Remark:             inbound.Remark,
+		Enable:             inbound.Enable,
+		Listen:             inbound.Listen,
+		Port:               inbound.Port,
+		PortEnd:            inbound.PortEnd,
+		Protocol:           inbound.Protocol,
+		Settings:           settings,
+		StreamSettings:     inbound.StreamSettings,
+		Tag:                inbound.Tag,
+		Sniffing:           inbound.Sniffing,
+		Allocate:           inbound.Allocate,
+		RemarkTemplate:     inbound.RemarkTemplate,
+		SubIncludeDisabled: inbound.SubIncludeDisabled,
+		ClientDefaults:     inbound.ClientDefaults,
+	}, nil
+}
+
+// nodeInboundBody returns the fields of an inbound that are pushed.
+func nodeInboundBody(inbound *model.Inbound) map[string]any {
+	return map[string]any{
+		"remark":             inbound.Remark,
+		"enable":             inbound.Enable,
+		"total":              inbound.Total,
+		"expiryTime":         inbound.ExpiryTime,
+		"listen":             inbound.Listen,
+		"port":               inbound.Port,
+		"portEnd":            inbound.PortEnd,
+		"protocol":           inbound.Protocol,
+		"settings":           inbound.Settings,
+		"streamSettings":     inbound.StreamSettings,
+		"tag":                inbound.Tag,
+		"sniffing":           inbound.Sniffing,
+		"allocate":           inbound.Allocate,
+		"remarkTemplate":     inbound.RemarkTemplate,
+		"subIncludeDisabled": inbound.SubIncludeDisabled,
+		"clientDefaults":     inbound.ClientDefaults,
+	}
+}
+
+// nodeInboundFields returns the pushed fields of an inbound, those in JSON in
+// one form whatever their spacing and the order of their keys.
+func nodeInboundFields(inbound *model.Inbound) map[string]any {
+	fields := nodeInboundBody(inbound)
+	for _, name := range []string{"settings", "streamSettings", "sniffing", "allocate"} {
+		fields[name] = canonicalJSON(fields[name].(string))
+	}
+	return fields
+}
+
+// canonicalJSON returns value marshalled again, or as it is if it is not JSON.
+func canonicalJSON(value string) string {
+	var doc any
+	decoder := json.NewDecoder(strings.NewReader(value))
+	decoder.UseNumber()
+	if decoder.Decode(&doc) != nil {
+		return value
+	}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return value
+	}
+	return string(data)
+}
+
+// nodeInboundHash tells whether the pushed fields of an inbound changed.
+func nodeInboundHash(inbound *model.Inbound) string {
+	data, _ := json.Marshal(nodeInboundFields(inbound))
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// nodeClients returns the clients in settings, in canonical JSON by email.
+func nodeClients(settings string) map[string]string {
+	doc := struct {
+		Clients []json.RawMessage `json:"clients"`
+	}{}
+	json.Unmarshal([]byte(settings), &doc)
+	clients := make(map[string]string, len(doc.Clients))
+	for _, raw := range doc.Clients {
+		client := struct {
+			Email string `json:"email"`
+		}{}
+		if json.Unmarshal(raw, &client) == nil {
+			clients[client.Email] = canonicalJSON(string(raw))
+		}
+	}
+	return clients
+}
+
+// diffNodeInbound returns the pushed fields that differ between the inbound
+// of the panel and the one of the node, and the clients the node lacks, has
+// in addition and has otherwise. The clients only count in settings if
+// nothing else differs there.
+func diffNodeInbound(want *model.Inbound, remote *model.Inbound) (fields []string, added []string, removed []string, changed []string) {
+	wantClients, remoteClients := nodeClients(want.Settings), nodeClients(remote.Settings)
+	for email, client := range wantClients {
+		if other, ok := remoteClients[email]; !ok {
+			added = append(added, email)
+		} else if other != client {
+			changed = append(changed, email)
+		}
+	}
+	for email := range remoteClients {
+		if _, ok := wantClients[email]; !ok {
+			removed = append(removed, email)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(changed)
+
+	wantFields, remoteFields := nodeInboundFields(want), nodeInboundFields(remote)
+	for name, value := range wantFields {
+		if reflect.DeepEqual(value, remoteFields[name]) {
+			continue
+		}
+		if name == "settings" && withoutClients(want.Settings) == withoutClients(remote.Settings) {
+			continue
+		}
+		fields = append(fields, name)
+	}
+	sort.Strings(fields)
+	return fields, added, removed, changed
+}
+
+// withoutClients returns settings without their clients, in canonical JSON.
+func withoutClients(settings string) string {
+	doc := map[string]json.RawMessage{}
+	if json.Unmarshal([]byte(settings), &doc) != nil {
+		return settings
+	}
+	delete(doc, "clients")
+	data, _ := json.Marshal(doc)
+	return canonicalJSON(string(data))
+}
+
+func findInbound(inbounds []*model.Inbound, tag string) *model.Inbound {
+	for _, inbound := range inbounds {
+		if inbound.Tag == tag {
+			return inbound
+		}
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"x-ui/config"
+	"x-ui/database/model"
+	"x-ui/util/common"
+	"x-ui/web/entity"
+)
+
+const (
+	// nodeTimeout bounds a request to the API of a node
+	nodeTimeout = 30 * time.Second
+	// nodePageSize is how many inbounds are listed from a node a request, the
+	// most its v2 API replies with
+	nodePageSize = 500
+	// nodeReplyLimit bounds the replies of a node
+	nodeReplyLimit = 64 << 20
+)
+
+// nodeClient calls the v2 API of a node with its token.
+type nodeClient struct {
+	base   *url.URL
+	token  string
+	client *http.Client
+}
+
+// parseNodeUrl returns the URL of the panel of a node, with a slash at the end
+// of its base path.
+func parseNodeUrl(apiUrl string) (*url.URL, error) {
+	base, err := url.Parse(strings.TrimSpace(apiUrl))
+	if err != nil {
+		return nil, common.NewErrorf("the URL of the node is not valid: %v", err)
+	}
+	if (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+		return nil, common.NewError("the URL of the node must be an http or https URL")
+	}
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+	}
+	base.RawQuery, base.Fragment = "", ""
+	return base, nil
+}
+
+func newNodeClient(node *model.Node) (*nodeClient, error) {
+	base, err := parseNodeUrl(node.ApiUrl)
+	if err != nil {
+		return nil, err
+	}
+	return &nodeClient{base: base, token: node.Token, client: &http.Client{Timeout: nodeTimeout}}, nil
+}
+
+// call does a request to the route of the v2 API of the node, with body as
+// JSON if it is not nil, and decodes the data of the reply into data.
+func (c *nodeClient) call(ctx context.Context, method string, route string, query url.Values, body any, data any) error {
+	target := c.base.JoinPath("panel/api/v2", route)
+	target.RawQuery = query.Encode()
+	var reader io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target.String(), reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", "3x-ui/"+config.GetVersion())
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	reply := struct {
+		Success bool                  `json:"success"`
+		Data    json.RawMessage       `json:"data"`
+		Error   *entity.ResponseError `json:"error"`
+	}{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, nodeReplyLimit)).Decode(&reply); err != nil {
+		return common.NewErrorf("%s %s answered %s, not the v2 API", method, target.Path, resp.Status)
+	}
+	if !reply.Success {
+		if reply.Error != nil {
+			return common.NewErrorf("%s %s answered %s: %s", method, target.Path, resp.Status, reply.Error.Message)
+		}
+		return common.NewErrorf("%s %s answered %s", method, target.Path, resp.Status)
+	}
+	if data == nil || len(reply.Data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(reply.Data, data)
+}
+
+// status returns the state of Xray on the node.
+func (c *nodeClient) status(ctx context.Context) (string, error) {
+	status := struct {
+		Xray struct {
+			State string `json:"state"`
+		} `json:"xray"`
+	}{}
+	err := c.call(ctx, http.MethodGet, "server/status", nil, nil, &status)
+	return status.Xray.State, err
+}
+
+// inbounds returns all inbounds of the node, with the traffic of their
+// clients.
+func (c *nodeClient) inbounds(ctx context.Context) ([]*model.Inbound, error) {
+	inbounds := []*model.Inbound{}
+	for page := 1; ; page++ {
+		items := []*model.Inbound{}
+		reply := entity.Page{Items: &items}
+		query := url.Values{"page": {strconv.Itoa(page)}, "pageSize": {strconv.Itoa(nodePageSize)}}
+		if err := c.call(ctx, http.MethodGet, "inbounds", query, nil, &reply); err != nil {
+			return nil, err
+		}
+		inbounds = append(inbounds, items...)
+		if len(items) == 0 || int64(len(inbounds)) >= reply.Total {
+			return inbounds, nil
+		}
+	}
+}
+
+// createInbound adds an inbound to the node and returns it as the node has it.
+func (c *nodeClient) createInbound(ctx context.Context, body map[string]any) (*model.Inbound, error) {
+	inbound := &model.Inbound{}
+	return inbound, c.call(ctx, http.MethodPost, "inbounds", nil, body, inbound)
+}
+
+// updateInbound changes the fields of body of an inbound of the node and
+// returns it as the node has it.
+func (c *nodeClient) updateInbound(ctx context.Context, id int, body map[string]any) (*model.Inbound, error) {
+	inbound := &model.Inbound{}
+	return inbound, c.call(ctx, http.MethodPatch, "inbounds/"+strconv.Itoa(id), nil, body, inbound)
+}
+
+// deleteInbound deletes an inbound of the node for good, not to its trash.
+func (c *nodeClient) deleteInbound(ctx context.Context, id int) error {
+	query := url.Values{"permanent": {"true"}}
+	return c.call(ctx, http.MethodDelete, "inbounds/"+strconv.Itoa(id), query, nil, nil)
+}
@@ -0,0 +1,214 @@
+package service
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"x-ui/database"
+	"x-ui/xray"
+)
+
+// defaultOnlineWindow is how long a client counts as online after it was last
+// seen, if the setting can't be read
+const defaultOnlineWindow = 60 * time.Second
+
+// OnlineClient is a client seen within the online window, with the IPs the
+// access log shows it connected from within it.
+type OnlineClient struct {
+	Email     string   `json:"email"`
+	InboundId int      `json:"inboundId"`
+	Inbound   string   `json:"inbound"`
+	LastSeen  int64    `json:"lastSeen"`
+	IPs       []string `json:"ips"`
+}
+
+// clientSighting is when a client was last seen, by its traffic or in the
+// access log, and from which IPs.
+type clientSighting struct {
+	lastSeen time.Time
+	ips      map[string]time.Time
+}
+
+// sightings are the clients seen since the panel started. Their last seen times
+// are saved to the client traffics with the traffic, then the ones out of the
+// online window are dropped.
+var (
+	sightingsLock sync.Mutex
+	sightings     = map[string]*clientSighting{}
+)
+
+func seeClient(email string, ip string, at time.Time) {
+	sightingsLock.Lock()
+	defer sightingsLock.Unlock()
+	sighting := sightings[email]
+	if sighting == nil {
+		sighting = &clientSighting{ips: map[string]time.Time{}}
+		sightings[email] = sighting
+	}
+	if at.After(sighting.lastSeen) {
+		sighting.lastSeen = at
+	}
+	if ip != "" && at.After(sighting.ips[ip]) {
+		sighting.ips[ip] = at
+	}
+}
+
+// clientLastSeen returns when a client was last seen since the panel started,
+// in milliseconds, or 0.
+func clientLastSeen(email string) int64 {
+	sightingsLock.Lock()
+	defer sightingsLock.Unlock()
+	if sighting := sightings[email]; sighting != nil {
+		return sighting.lastSeen.UnixMilli()
+	}
+	return 0
+}
+
+// sightedClients returns when the clients seen since the panel started were
+// last seen, in milliseconds, by email.
+func sightedClients() map[string]int64 {
+	sightingsLock.Lock()
+	defer sightingsLock.Unlock()
+	lastSeen := make(map[string]int64, len(sightings))
+	for email, sighting := range sightings {
+		lastSeen[email] = sighting.lastSeen.UnixMilli()
+	}
+	return lastSeen
+}
+
+// forgetSightings drops the clients and the IPs last seen before cutoff, once
+// their last seen times are persisted.
+func forgetSightings(cutoff time.Time) {
+	sightingsLock.Lock()
+	defer sightingsLock.Unlock()
+	for email, sighting := range sightings {
+		if sighting.lastSeen.Before(cutoff) {
+			delete(sightings, email)
+			continue
+		}
+		for ip, at := range sighting.ips {
+			if at.Before(cutoff) {
+				delete(sighting.ips, ip)
+			}
+		}
+	}
+}
+
+// SeeClientIp records that the access log shows a client connecting from ip at
+// at, for the online clients and the geo stats.
+func (s *InboundService) SeeClientIp(email string, ip string, at time.Time) {
+	seeClient(email, ip, at)
+	seeGeoConnection(email, ip, at)
+}
+
+// forgetOldSightings drops the clients last seen before the online window, once
+// their last sighting is flushed. It reads the settings, so it is called after
+// the flush commits: loading them again within the transaction of the flush
+// could wait for a connection on the lock the transaction holds.
+func (s *InboundService) forgetOldSightings() {
+	forgetSightings(time.Now().Add(-s.onlineWindow()))
+}
+
+func (s *InboundService) onlineWindow() time.Duration {
+	seconds, err := s.settingService.GetOnlineWindow()
+	if err != nil || seconds <= 0 {
+		return defaultOnlineWindow
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// onlineSightings returns the clients seen within the online window, with the
+// IPs seen within it, by email.
+func (s *InboundService) onlineSightings() map[string]clientSighting {
+	cutoff := time.Now().Add(-s.onlineWindow())
+	sightingsLock.Lock()
+	defer sightingsLock.Unlock()
+	online := map[string]clientSighting{}
+	for email, sighting := range sightings {
+		if sighting.lastSeen.Before(cutoff) {
+			continue
+		}
+		ips := map[string]time.Time{}
+		for ip, at := range sighting.ips {
+			if !at.Before(cutoff) {
+				ips[ip] = at
+			}
+		}
+		online[email] = clientSighting{lastSeen: sighting.lastSeen, ips: ips}
+	}
+	return online
+}
+
+// GetOnlineClients returns the emails of the clients seen within the online
+// window, sorted.
+func (s *InboundService) GetOnlineClients() []string {
+	online := s.onlineSightings()
+	emails := make([]string, 0, len(online))
+	for email := range online {
+		emails = append(emails, email)
+	}
+	sort.Strings(emails)
+	return emails
+}
+
+// ListOnlineClients returns the clients seen within the online window with
+// their inbound, the latest seen first.
+func (s *InboundService) ListOnlineClients() ([]OnlineClient, error) {
+	online := s.onlineSightings()
+	clients := make([]OnlineClient, 0, len(online))
+	if len(online) == 0 {
+		return clients, nil
+	}
+	emails := make([]string, 0, len(online))
+	for email := range online {
+		emails = append(emails, email)
+	}
+	var rows []struct {
+		Email     string
+		InboundId int
+		Remark    string
+	}
+	err := database.GetDB().Model(xray.ClientTraffic{}).
+		Select("client_traffics.email, client_traffics.inbound_id, inbounds.remark").
+		Joins("LEFT JOIN inbounds ON inbounds.id = client_traffics.inbound_id").
+		Where("client_traffics.email IN ?", emails).
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		sighting := online[row.Email]
+		ips := make([]string, 0, len(sighting.ips))
+		for ip := range sighting.ips {
+			ips = append(ips, ip)
+		}
+		sort.Slice(ips, func(a, b int) bool {
+			return sighting.ips[ips[a]].After(sighting.ips[ips[b]])
+		})
+		clients = append(clients, OnlineClient{
+			Email:     row.Email,
+			InboundId: row.InboundId,
+			Inbound:   row.Remark,
+			LastSeen:  sighting.lastSeen.UnixMilli(),
+			IPs:       ips,
+		})
+	}
+	sort.Slice(clients, func(a, b int) bool {
+		if clients[a].LastSeen != clients[b].LastSeen {
+			return clients[a].LastSeen > clients[b].LastSeen
+		}
+		return clients[a].Email < clients[b].Email
+	})
+	return clients, nil
+}
+
+// CountInactiveClients returns how many clients haven't been seen for more than
+// days; clients never seen aren't counted.
+func (s *InboundService) CountInactiveClients(days int) (int64, error) {
+	var count int64
+	err := database.GetDB().Model(xray.ClientTraffic{}).
+		Where("last_seen > 0 AND last_seen <= ?", time.Now().AddDate(0, 0, -days).UnixMilli()).
+		Count(&count).Error
+	return count, err
+}
@@ -4,64 +4,32 @@ import (
 	"x-ui/database"
 	"x-ui/database/model"
 	"x-ui/logger"
-	"x-ui/xray"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type OutboundService struct{}
 
-func (s *OutboundService) AddTraffic(traffics []*xray.Traffic, clientTraffics []*xray.ClientTraffic) (error, bool) {
-	var err error
-	db := database.GetDB()
-	tx := db.Begin()
-
-	defer func() {
-		if err != nil {
-			tx.Rollback()
-		} else {
-			tx.Commit()
-		}
-	}()
-
-	err = s.addOutboundTraffic(tx, traffics)
-	if err != nil {
-		return err, false
-	}
-
-	return nil, false
-}
-
-func (s *OutboundService) addOutboundTraffic(tx *gorm.DB, traffics []*xray.Traffic) error {
+// addOutboundTraffic adds the traffic of outbounds by tag, creating the ones
+// not counted before.
+func (s *OutboundService) addOutboundTraffic(tx *gorm.DB, traffics map[string]*trafficDelta) error {
 	if len(traffics) == 0 {
 		return nil
 	}
-
-	var err error
-
-	for _, traffic := range traffics {
-		if traffic.IsOutbound {
-
-			var outbound model.OutboundTraffics
-
-			err = tx.Model(&model.OutboundTraffics{}).Where("tag = ?", traffic.Tag).
-				FirstOrCreate(&outbound).Error
-			if err != nil {
-				return err
-			}
-
-			outbound.Tag = traffic.Tag
-			outbound.Up = outbound.Up + traffic.Up
-			outbound.Down = outbound.Down + traffic.Down
-			outbound.Total = outbound.Up + outbound.Down
-
-			err = tx.Save(&outbound).Error
-			if err != nil {
-				return err
-			}
-		}
+	rows := make([]model.OutboundTraffics, 0, len(traffics))
+	for tag, delta := range traffics {
+		rows = append(rows, model.OutboundTraffics{Tag: tag, Up: delta.up, Down: delta.down, Total: delta.up + delta.down})
 	}
-	return nil
+	// The total comes first, MySQL assigning the columns in order
+	return tx.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "tag"}},
+		DoUpdates: clause.Set{
+			{Column: clause.Column{Name: "total"}, Value: gorm.Expr("outbound_traffics.up + outbound_traffics.down + " + database.Excluded("total"))},
+			{Column: clause.Column{Name: "up"}, Value: gorm.Expr("outbound_traffics.up + " + database.Excluded("up"))},
+			{Column: clause.Column{Name: "down"}, Value: gorm.Expr("outbound_traffics.down + " + database.Excluded("down"))},
+		},
+	}).CreateInBatches(rows, trafficFlushBatch).Error
 }
 
 func (s *OutboundService) GetOutboundsTraffic() ([]*model.OutboundTraffics, error) {
@@ -78,6 +46,11 @@ func (s *OutboundService) GetOutboundsTraffic() ([]*model.OutboundTraffics, erro
 }
 
 func (s *OutboundService) ResetOutboundTraffic(tag string) error {
+	// The traffic counted before the reset is written first, not added after it
+	var inboundService InboundService
+	if err := inboundService.FlushTraffic(); err != nil {
+		return err
+	}
 	db := database.GetDB()
 
 	whereText := "tag "
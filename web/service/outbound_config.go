@@ -0,0 +1,518 @@
+package service
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/util/common"
+	"x-ui/xray"
+
+	"github.com/goccy/go-json"
+)
+
+const outboundTagMaxLength = 64
+
+// outboundServers names the list of servers in the settings of the outbound
+// protocols that connect to one, with the fields every server needs.
+var outboundServers = map[string]struct {
+	list   string
+	fields []string
+}{
+	"vmess":       {"vnext", []string{"address", "port"}},
+	"vless":       {"vnext", []string{"address", "port"}},
+	"trojan":      {"servers", []string{"address", "port", "password"}},
+	"shadowsocks": {"servers", []string{"address", "port", "method", "password"}},
+	"socks":       {"servers", []string{"address", "port"}},
+	"http":        {"servers", []string{"address", "port"}},
+}
+
+// outboundProtocols are the protocols of Xray outbounds that need no server.
+var outboundProtocols = map[string]bool{
+	"freedom":   true,
+	"blackhole": true,
+	"dns":       true,
+	"loopback":  true,
+	"wireguard": true,
+}
+
+// ruleRef is the outbound or the balancer a routing rule sends to.
+type ruleRef struct {
+	name        string
+	outboundTag string
+	balancerTag string
+}
+
+// templateRefs are the tags in the config template: those of its inbounds and
+// outbounds, and the outbounds its routing sends to. Loaded with
+// loadTemplateRefs, they have those of the panel as well.
+type templateRefs struct {
+	inbounds  []string
+	outbounds []string
+	// apiTag is the tag of the API, which routing rules send to like an outbound
+	apiTag string
+	rules  []ruleRef
+	// balancers are the tags and selectors of the balancers
+	balancers []struct {
+		Tag         string   `json:"tag"`
+		Selector    []string `json:"selector"`
+		FallbackTag string   `json:"fallbackTag"`
+	}
+	panelOutbounds []string
+	panelBalancers []model.Balancer
+	// panelInbounds are the tags of the inbounds of the panel
+	panelInbounds []string
+}
+
+func parseTemplateRefs(template string) (*templateRefs, error) {
+	var config struct {
+		Inbounds []struct {
+			Tag string `json:"tag"`
+		} `json:"inbounds"`
+		Outbounds []struct {
+			Tag string `json:"tag"`
+		} `json:"outbounds"`
+		API struct {
+			Tag string `json:"tag"`
+		} `json:"api"`
+		Routing struct {
+			Rules []struct {
+				OutboundTag string `json:"outboundTag"`
+				BalancerTag string `json:"balancerTag"`
+			} `json:"rules"`
+			Balancers json.RawMessage `json:"balancers"`
+		} `json:"routing"`
+	}
+	if err := json.Unmarshal([]byte(template), &config); err != nil {
+		return nil, common.NewError("xray template config invalid:", err)
+	}
+	refs := &templateRefs{apiTag: config.API.Tag}
+	for _, inbound := range config.Inbounds {
+		refs.inbounds = append(refs.inbounds, inbound.Tag)
+	}
+	for _, outbound := range config.Outbounds {
+		refs.outbounds = append(refs.outbounds, outbound.Tag)
+	}
+	for i, rule := range config.Routing.Rules {
+		refs.rules = append(refs.rules, ruleRef{
+			name:        fmt.Sprintf("routing rule %d of the xray config template", i+1),
+			outboundTag: rule.OutboundTag,
+			balancerTag: rule.BalancerTag,
+		})
+	}
+	if len(config.Routing.Balancers) > 0 {
+		json.Unmarshal(config.Routing.Balancers, &refs.balancers)
+	}
+	return refs, nil
+}
+
+// usedBy tells what of the routing sends to the outbound tag, "" if nothing
+// does. Balancers select the outbounds whose tags start with one of their
+// selectors.
+func (r *templateRefs) usedBy(tag string) string {
+	for _, rule := range r.rules {
+		if rule.outboundTag == tag {
+			return rule.name
+		}
+	}
+	for _, balancer := range r.balancers {
+		if balancer.FallbackTag == tag {
+			return "the fallback of balancer " + balancer.Tag
+		}
+		for _, selector := range balancer.Selector {
+			if selector != "" && strings.HasPrefix(tag, selector) {
+				return "balancer " + balancer.Tag
+			}
+		}
+	}
+	// A balancer of the panel only needs one of its outbounds
+	tags := append(slices.Clone(r.outbounds), r.panelOutbounds...)
+	for _, balancer := range r.panelBalancers {
+		if balancer.FallbackTag == tag {
+			return "the fallback of balancer " + balancer.Tag
+		}
+		if members := balancerMembers(balancer.Selector, tags); len(members) == 1 && members[0] == tag {
+			return "balancer " + balancer.Tag + ", as its only outbound,"
+		}
+	}
+	return ""
+}
+
+// balancerUsedBy tells which routing rule sends to the balancer tag, "" if none
+// does.
+func (r *templateRefs) balancerUsedBy(tag string) string {
+	for _, rule := range r.rules {
+		if rule.balancerTag == tag {
+			return rule.name
+		}
+	}
+	return ""
+}
+
+// hasBalancer tells if there is a balancer with the tag, in the template or in
+// the panel.
+func (r *templateRefs) hasBalancer(tag string) bool {
+	for _, balancer := range r.balancers {
+		if balancer.Tag == tag {
+			return true
+		}
+	}
+	for _, balancer := range r.panelBalancers {
+		if balancer.Tag == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func parseJSONObject(field string, value string) (map[string]any, error) {
+	var object map[string]any
+	if err := json.Unmarshal([]byte(value), &object); err != nil || object == nil {
+		return nil, common.NewErrorf("%s must be a JSON object", field)
+	}
+	return object, nil
+}
+
+// checkOutboundSettings checks that settings have what the protocol of an
+// outbound needs to connect.
+func checkOutboundSettings(protocol string, settings map[string]any) error {
+	switch protocol {
+	case "loopback":
+		if tag, _ := settings["inboundTag"].(string); tag == "" {
+			return common.NewError("settings.inboundTag: can not be empty")
+		}
+		return nil
+	case "wireguard":
+		if key, _ := settings["secretKey"].(string); key == "" {
+			return common.NewError("settings.secretKey: can not be empty")
+		}
+		peers, _ := settings["peers"].([]any)
+		if len(peers) == 0 {
+			return common.NewError("settings.peers: can not be empty")
+		}
+		for i, item := range peers {
+			peer, _ := item.(map[string]any)
+			for _, field := range []string{"publicKey", "endpoint"} {
+				if value, _ := peer[field].(string); value == "" {
+					return common.NewErrorf("settings.peers[%d].%s: can not be empty", i, field)
+				}
+			}
+		}
+		return nil
+	}
+	if outboundProtocols[protocol] {
+		return nil
+	}
+
+	servers, ok := outboundServers[protocol]
+	if !ok {
+		return common.NewError("unknown outbound protocol:", protocol)
+	}
+	list, _ := settings[servers.list].([]any)
+	if len(list) == 0 {
+		return common.NewErrorf("settings.%s: can not be empty", servers.list)
+	}
+	for i, item := range list {
+		server, ok := item.(map[string]any)
+		if !ok {
+			return common.NewErrorf("settings.%s[%d]: must be an object", servers.list, i)
+		}
+		for _, field := range servers.fields {
+			switch value := server[field].(type) {
+			case string:
+				if value != "" {
+					continue
+				}
+			case float64:
+				if field == "port" && value >= 1 && value <= 65535 {
+					continue
+				}
+			}
+			return common.NewErrorf("settings.%s[%d].%s: is missing or invalid", servers.list, i, field)
+		}
+		if servers.list != "vnext" {
+			continue
+		}
+		users, _ := server["users"].([]any)
+		if len(users) == 0 {
+			return common.NewErrorf("settings.vnext[%d].users: can not be empty", i)
+		}
+		for j, item := range users {
+			user, _ := item.(map[string]any)
+			if id, _ := user["id"].(string); id == "" {
+				return common.NewErrorf("settings.vnext[%d].users[%d].id: can not be empty", i, j)
+			}
+		}
+	}
+	return nil
+}
+
+// checkOutbound checks an outbound to save, with its tag used neither by
+// another outbound nor a balancer, and writes its JSON fields compactly.
+func (s *OutboundService) checkOutbound(outbound *model.Outbound, refs *templateRefs) error {
+	if err := checkOutboundTag(outbound, refs); err != nil {
+		return err
+	}
+	var count int64
+	err := database.GetDB().Model(model.Outbound{}).
+		Where("tag = ? AND id <> ?", outbound.Tag, outbound.Id).Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return common.NewErrorf("tag %s is used by another outbound", outbound.Tag)
+	}
+	return checkOutboundConfig(outbound)
+}
+
+// checkOutboundTag checks that an outbound has a tag that neither the config
+// template nor a balancer uses.
+func checkOutboundTag(outbound *model.Outbound, refs *templateRefs) error {
+	outbound.Tag = strings.TrimSpace(outbound.Tag)
+	outbound.Protocol = strings.TrimSpace(outbound.Protocol)
+	outbound.SendThrough = strings.TrimSpace(outbound.SendThrough)
+	if outbound.Tag == "" {
+		return common.NewError("tag can not be empty")
+	}
+	if len(outbound.Tag) > outboundTagMaxLength {
+		return common.NewErrorf("tag is longer than %d characters", outboundTagMaxLength)
+	}
+	if slices.Contains(refs.outbounds, outbound.Tag) {
+		return common.NewErrorf("tag %s is used by an outbound of the xray config template", outbound.Tag)
+	}
+	if refs.hasBalancer(outbound.Tag) {
+		return common.NewErrorf("tag %s is used by a balancer", outbound.Tag)
+	}
+	return nil
+}
+
+// checkOutboundConfig checks the protocol and the JSON fields of an outbound,
+// and writes them compactly.
+func checkOutboundConfig(outbound *model.Outbound) error {
+	if strings.TrimSpace(outbound.Settings) == "" {
+		outbound.Settings = "{}"
+	}
+	settings, err := parseJSONObject("settings", outbound.Settings)
+	if err != nil {
+		return err
+	}
+	if err := checkOutboundSettings(outbound.Protocol, settings); err != nil {
+		return err
+	}
+	fields := map[string]*string{
+		"settings":       &outbound.Settings,
+		"streamSettings": &outbound.StreamSettings,
+		"mux":            &outbound.Mux,
+	}
+	for field, value := range fields {
+		if strings.TrimSpace(*value) == "" {
+			*value = ""
+			continue
+		}
+		object, err := parseJSONObject(field, *value)
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(object)
+		if err != nil {
+			return err
+		}
+		*value = string(data)
+	}
+	return nil
+}
+
+// loadTemplateRefs returns the tags of the config template, with the outbounds,
+// routing rules and balancers of the panel.
+func loadTemplateRefs() (*templateRefs, error) {
+	var settingService SettingService
+	template, err := settingService.GetXrayConfigTemplate()
+	if err != nil {
+		return nil, err
+	}
+	refs, err := parseTemplateRefs(template)
+	if err != nil {
+		return nil, err
+	}
+	err = database.GetDB().Model(model.Outbound{}).Order("id").Pluck("tag", &refs.panelOutbounds).Error
+	if err != nil {
+		return nil, err
+	}
+	err = database.GetDB().Model(model.Inbound{}).Pluck("tag", &refs.panelInbounds).Error
+	if err != nil {
+		return nil, err
+	}
+	var routingService RoutingService
+	rules, err := routingService.GetRules()
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range rules {
+		refs.rules = append(refs.rules, ruleRef{
+			name:        routingRuleName(&rule),
+			outboundTag: rule.OutboundTag,
+			balancerTag: rule.BalancerTag,
+		})
+	}
+	var balancerService BalancerService
+	if refs.panelBalancers, err = balancerService.GetBalancers(); err != nil {
+		return nil, err
+	}
+	return refs, nil
+}
+
+func (s *OutboundService) GetOutbounds() ([]model.Outbound, error) {
+	var outbounds []model.Outbound
+	err := database.GetDB().Order("id").Find(&outbounds).Error
+	return outbounds, err
+}
+
+func (s *OutboundService) GetOutbound(id int) (*model.Outbound, error) {
+	outbound := &model.Outbound{}
+	if err := database.GetDB().First(outbound, id).Error; err != nil {
+		if database.IsNotFound(err) {
+			return nil, common.NewError("outbound not found:", id)
+		}
+		return nil, err
+	}
+	return outbound, nil
+}
+
+func (s *OutboundService) AddOutbound(outbound *model.Outbound) (*model.Outbound, error) {
+	refs, err := loadTemplateRefs()
+	if err != nil {
+		return nil, err
+	}
+	outbound.Id = 0
+	if err := s.checkOutbound(outbound, refs); err != nil {
+		return nil, err
+	}
+	outbound.UpdatedAt = time.Now().UnixMilli()
+	if err := database.GetDB().Create(outbound).Error; err != nil {
+		return nil, err
+	}
+	return outbound, nil
+}
+
+// UpdateOutbound replaces an outbound. Its tag can't change while the routing
+// or a client sends to it.
+func (s *OutboundService) UpdateOutbound(outbound *model.Outbound) (*model.Outbound, error) {
+	old, err := s.GetOutbound(outbound.Id)
+	if err != nil {
+		return nil, err
+	}
+	refs, err := loadTemplateRefs()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkOutbound(outbound, refs); err != nil {
+		return nil, err
+	}
+	if outbound.Tag != old.Tag {
+		if user := refs.usedBy(old.Tag); user != "" {
+			return nil, common.NewErrorf("outbound %s can not be renamed, %s sends to it", old.Tag, user)
+		}
+		if err := checkOutboundUnused(old.Tag, "renamed"); err != nil {
+			return nil, err
+		}
+	}
+	outbound.UpdatedAt = time.Now().UnixMilli()
+	if err := database.GetDB().Save(outbound).Error; err != nil {
+		return nil, err
+	}
+	return outbound, nil
+}
+
+// DelOutbound deletes an outbound neither the routing nor a client sends to.
+func (s *OutboundService) DelOutbound(id int) error {
+	outbound, err := s.GetOutbound(id)
+	if err != nil {
+		return err
+	}
+	refs, err := loadTemplateRefs()
+	if err != nil {
+		return err
+	}
+	if user := refs.usedBy(outbound.Tag); user != "" {
+		return common.NewErrorf("outbound %s can not be deleted, %s sends to it", outbound.Tag, user)
+	}
+	if err := checkOutboundUnused(outbound.Tag, "deleted"); err != nil {
+		return err
+	}
+	return database.GetDB().Delete(model.Outbound{}, id).Error
+}
+
+// checkTemplateOutbounds checks that the outbounds and balancers of a config
+// template don't take the tags of the outbounds and balancers of the panel,
+// and that it keeps the outbounds clients are sent to.
+func (s *OutboundService) checkTemplateOutbounds(template string) error {
+	refs, err := parseTemplateRefs(template)
+	if err != nil {
+		return err
+	}
+	var tags []string
+	err = database.GetDB().Model(model.Outbound{}).Where("tag IN ?", refs.outbounds).Pluck("tag", &tags).Error
+	if err != nil {
+		return err
+	}
+	if len(tags) > 0 {
+		return common.NewErrorf("outbound tag %s is used by an outbound of the panel", tags[0])
+	}
+	balancerTags := make([]string, 0, len(refs.balancers))
+	for _, balancer := range refs.balancers {
+		balancerTags = append(balancerTags, balancer.Tag)
+	}
+	err = database.GetDB().Model(model.Balancer{}).Where("tag IN ?", balancerTags).Pluck("tag", &tags).Error
+	if err != nil {
+		return err
+	}
+	if len(tags) > 0 {
+		return common.NewErrorf("balancer tag %s is used by a balancer of the panel", tags[0])
+	}
+
+	clients, err := clientsByOutbound(`"outboundTag"`)
+	if err != nil {
+		return err
+	}
+	var panelTags []string
+	if err := database.GetDB().Model(model.Outbound{}).Pluck("tag", &panelTags).Error; err != nil {
+		return err
+	}
+	for tag, emails := range clients {
+		if !slices.Contains(refs.outbounds, tag) && !slices.Contains(panelTags, tag) {
+			return common.NewErrorf("outbound %s can not be removed, clients %s are sent to it", tag, strings.Join(emails, ", "))
+		}
+	}
+	return nil
+}
+
+// addOutbounds adds the outbounds of the panel to a config generated from the
+// template, after its own.
+func (s *OutboundService) addOutbounds(config *xray.Config) error {
+	outbounds, err := s.GetOutbounds()
+	if err != nil || len(outbounds) == 0 {
+		return err
+	}
+	var configs []json.RawMessage
+	if len(config.OutboundConfigs) > 0 {
+		if err := json.Unmarshal(config.OutboundConfigs, &configs); err != nil {
+			return common.NewError("xray template config invalid:", err)
+		}
+	}
+	for i := range outbounds {
+		data, err := json.Marshal(outbounds[i].GenXrayOutboundConfig())
+		if err != nil {
+			return err
+		}
+		configs = append(configs, data)
+	}
+	data, err := json.MarshalIndent(configs, "", "  ")
+	if err != nil {
+		return err
+	}
+	config.OutboundConfigs = data
+	return nil
+}
@@ -1,14 +1,23 @@
 package service
 
 import (
+	"errors"
+	"net"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"x-ui/logger"
+	"x-ui/web/global"
+	"x-ui/web/network"
 )
 
-type PanelService struct{}
+type PanelService struct {
+	settingService SettingService
+}
 
 func (s *PanelService) RestartPanel(delay time.Duration) error {
 	p, err := os.FindProcess(syscall.Getpid())
@@ -24,3 +33,65 @@ func (s *PanelService) RestartPanel(delay time.Duration) error {
 	}()
 	return nil
 }
+
+// ApplySettings restarts the panel on its saved settings once it has checked
+// that the certificate loads and the new address can be bound; if not, the
+// panel keeps running as it is and the error is returned. It returns the URL
+// of the panel after the restart, for a request made over TLS if secure and to
+// origin, the host and port the browser reached the panel at.
+func (s *PanelService) ApplySettings(secure bool, origin string) (string, error) {
+	server := global.GetWebServer()
+	if server == nil {
+		return "", errors.New("the web server is not running")
+	}
+	if err := server.PrepareRestart(); err != nil {
+		return "", err
+	}
+	panelURL, err := s.panelURL(secure, origin)
+	if err != nil {
+		return "", err
+	}
+	logger.Info("Restarting the panel on its settings, it will be at", panelURL)
+	return panelURL, s.RestartPanel(time.Second)
+}
+
+// panelURL returns the URL of the panel with its saved settings. A panel on a
+// unix socket or the loopback sits behind a reverse proxy, it keeps the origin
+// of the request.
+func (s *PanelService) panelURL(secure bool, origin string) (string, error) {
+	listen, err := s.settingService.GetListen()
+	if err != nil {
+		return "", err
+	}
+	basePath, err := s.settingService.GetBasePath()
+	if err != nil {
+		return "", err
+	}
+	panelURL := &url.URL{Scheme: "http", Host: origin, Path: basePath + "panel/"}
+	if secure {
+		panelURL.Scheme = "https"
+	}
+	if _, isSocket := network.UnixSocketPath(listen); isSocket || isLoopback(listen) {
+		return panelURL.String(), nil
+	}
+
+	port, err := s.settingService.GetPort()
+	if err != nil {
+		return "", err
+	}
+	certFile, _ := s.settingService.GetCertFile()
+	keyFile, _ := s.settingService.GetKeyFile()
+	panelURL.Scheme = "http"
+	if certFile != "" || keyFile != "" {
+		panelURL.Scheme = "https"
+	}
+	host, _, err := net.SplitHostPort(origin)
+	if err != nil {
+		host = strings.Trim(origin, "[]")
+	}
+	if domain, _ := s.settingService.GetWebDomain(); domain != "" {
+		host = domain
+	}
+	panelURL.Host = net.JoinHostPort(host, strconv.Itoa(port))
+	return panelURL.String(), nil
+}
@@ -0,0 +1,1292 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"x-ui/config"
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/xray"
+
+	"github.com/goccy/go-json"
+	"gorm.io/gorm"
+)
+
+// PanelExportVersion is the version of the panel export format. Raise it on
+// incompatible changes and add a step to panelExportUpgrades, so that older
+// bundles can still be imported.
+const PanelExportVersion = 1
+
+// panelExportUpgrades turn a bundle of the version they are keyed by into one
+// of the next version.
+var panelExportUpgrades = map[int]func(doc map[string]any) error{}
+
+const (
+	// PanelImportReplaceAll replaces the users, inbounds, outbounds, balancers
+	// and routing rules with those of the bundle
+	PanelImportReplaceAll = "replace-all"
+	// PanelImportKeepExisting adds what the panel doesn't have, and keeps what
+	// it has of the same name
+	PanelImportKeepExisting = "merge-keep-existing"
+	// PanelImportOverwrite adds what the panel doesn't have, and replaces what
+	// it has of the same name
+	PanelImportOverwrite = "merge-overwrite"
+)
+
+// panelLocalSettings belong to the host, and are neither exported nor
+// imported: the secret the panel signs and encrypts with, and the paths of the
+// backups and of Xray.
+var panelLocalSettings = []string{"secret", "backupDir", "xrayBinaryPath", "xrayAssetDir", "xrayWorkDir", "tgBotBackupFailures", "setupState"}
+
+// panelSecretSettings are the settings an export without secrets leaves out.
+var panelSecretSettings = []string{
+	"tgBotToken", "tgBotProxy", "twoFactorToken", "metricsToken", "warp",
+	"backupPassphrase", "backupRemotes", "xrayDownloadProxy", "webhookSecret",
+	"acmeSettings", "acmeAccountKey",
+}
+
+// panelCertificateSettings are the certificate and key files of the panel and
+// of the subscriptions.
+var panelCertificateSettings = []string{"webCertFile", "webKeyFile", "subCertFile", "subKeyFile"}
+
+// PanelExport is what a panel is made of, to move it to another host: the
+// settings, the users, the inbounds with their clients, the outbounds and the
+// routing, and the certificate files they use.
+type PanelExport struct {
+	Version      int    `json:"version"`
+	ExportedAt   int64  `json:"exportedAt"`
+	PanelVersion string `json:"panelVersion"`
+	// SecretsStripped tells that the secrets of the settings and the
+	// two-factor secrets of the users were left out
+	SecretsStripped bool `json:"secretsStripped,omitempty"`
+	// Settings are the values of the settings by key, with the secrets the
+	// panel encrypts decrypted
+	Settings     map[string]string     `json:"settings"`
+	Users        []PanelExportUser     `json:"users"`
+	Inbounds     []PanelExportInbound  `json:"inbounds"`
+	Outbounds    []PanelExportOutbound `json:"outbounds"`
+	Balancers    []PanelExportBalancer `json:"balancers"`
+	RoutingRules []PanelExportRule     `json:"routingRules"`
+	// Files are the contents of the certificate and key files, by the paths
+	// the settings and the inbounds have for them
+	Files []PanelExportFile `json:"files"`
+}
+
+type PanelExportUser struct {
+	Username string `json:"username"`
+	// Password is the hash of the password
+	Password string `json:"password"`
+	Role     string `json:"role"`
+	TgChatId int64  `json:"tgChatId,omitempty"`
+	// TotpSecret is decrypted, RecoveryCodes are the hashes of the codes
+	TotpSecret    string `json:"totpSecret,omitempty"`
+	TotpEnabled   bool   `json:"totpEnabled,omitempty"`
+	TotpEnabledAt int64  `json:"totpEnabledAt,omitempty"`
+	RecoveryCodes string `json:"recoveryCodes,omitempty"`
+}
+
+type PanelExportInbound struct {
+	InboundExportInbound
+	Tag string `json:"tag"`
+	// Owner is the username of the user the inbound belongs to
+	Owner       string                 `json:"owner,omitempty"`
+	ClientStats []InboundExportTraffic `json:"clientStats,omitempty"`
+}
+
+type PanelExportOutbound struct {
+	Tag            string          `json:"tag"`
+	Protocol       string          `json:"protocol"`
+	SendThrough    string          `json:"sendThrough,omitempty"`
+	Settings       json.RawMessage `json:"settings,omitempty"`
+	StreamSettings json.RawMessage `json:"streamSettings,omitempty"`
+	Mux            json.RawMessage `json:"mux,omitempty"`
+}
+
+type PanelExportBalancer struct {
+	Tag         string   `json:"tag"`
+	Selector    []string `json:"selector"`
+	Strategy    string   `json:"strategy"`
+	FallbackTag string   `json:"fallbackTag,omitempty"`
+}
+
+// PanelExportRule is a routing rule, in the order Xray matches them.
+type PanelExportRule struct {
+	Remark      string   `json:"remark,omitempty"`
+	Domain      []string `json:"domain,omitempty"`
+	Ip          []string `json:"ip,omitempty"`
+	Port        string   `json:"port,omitempty"`
+	SourcePort  string   `json:"sourcePort,omitempty"`
+	Network     string   `json:"network,omitempty"`
+	Protocol    []string `json:"protocol,omitempty"`
+	InboundTag  []string `json:"inboundTag,omitempty"`
+	User        []string `json:"user,omitempty"`
+	OutboundTag string   `json:"outboundTag,omitempty"`
+	BalancerTag string   `json:"balancerTag,omitempty"`
+}
+
+type PanelExportFile struct {
+	Path string `json:"path"`
+	Data []byte `json:"data"`
+}
+
+// PanelImportResult counts what an import changed.
+type PanelImportResult struct {
+	Settings     int `json:"settings"`
+	Users        int `json:"users"`
+	Inbounds     int `json:"inbounds"`
+	Outbounds    int `json:"outbounds"`
+	Balancers    int `json:"balancers"`
+	RoutingRules int `json:"routingRules"`
+	// Files maps the paths of the bundle to the files written for them
+	Files map[string]string `json:"files,omitempty"`
+	// Skipped are what a merge keeping the existing ones left out
+	Skipped []string `json:"skipped,omitempty"`
+	// XrayError is why Xray didn't start after the import
+	XrayError string `json:"xrayError,omitempty"`
+}
+
+// PanelExportService exports a whole panel and imports it on another host.
+type PanelExportService struct {
+	settingService SettingService
+	inboundService InboundService
+	userService    UserService
+	backupService  BackupService
+	xrayService    XrayService
+}
+
+// Export returns the panel as a bundle. The secrets the panel encrypts with its
+// secret are decrypted, for the panel importing them to encrypt them with its
+// own; stripSecrets leaves them out with the other secrets of the settings and
+// the two-factor secrets of the users. stripTraffic leaves the traffic
+// counters out. The settings of the host, passkeys, API tokens, sessions and
+// the traffic history are not exported.
+func (s *PanelExportService) Export(stripSecrets bool, stripTraffic bool) (*PanelExport, error) {
+	db := database.GetDB()
+	doc := &PanelExport{
+		Version:         PanelExportVersion,
+		ExportedAt:      time.Now().UnixMilli(),
+		PanelVersion:    config.GetVersion(),
+		SecretsStripped: stripSecrets,
+		Settings:        map[string]string{},
+		Users:           []PanelExportUser{},
+		Inbounds:        []PanelExportInbound{},
+		Outbounds:       []PanelExportOutbound{},
+		Balancers:       []PanelExportBalancer{},
+		RoutingRules:    []PanelExportRule{},
+		Files:           []PanelExportFile{},
+	}
+
+	var settings []*model.Setting
+	if err := db.Model(model.Setting{}).Find(&settings).Error; err != nil {
+		return nil, err
+	}
+	for key, value := range defaultValueMap {
+		doc.Settings[key] = value
+	}
+	for _, setting := range settings {
+		if _, ok := defaultValueMap[setting.Key]; ok {
+			doc.Settings[setting.Key] = setting.Value
+		}
+	}
+	for _, key := range panelLocalSettings {
+		delete(doc.Settings, key)
+	}
+	if stripSecrets {
+		for _, key := range panelSecretSettings {
+			delete(doc.Settings, key)
+		}
+	} else {
+		remotes, err := s.backupService.getRemotes()
+		if err != nil {
+			return nil, err
+		}
+		data, err := json.Marshal(remotes)
+		if err != nil {
+			return nil, err
+		}
+		doc.Settings["backupRemotes"] = string(data)
+	}
+
+	var users []*model.User
+	if err := db.Model(model.User{}).Order("id").Find(&users).Error; err != nil {
+		return nil, err
+	}
+	usernames := map[int]string{}
+	for _, user := range users {
+		usernames[user.Id] = user.Username
+		exported := PanelExportUser{
+			Username: user.Username,
+			Password: user.Password,
+			Role:     user.Role,
+			TgChatId: user.TgChatId,
+		}
+		if !stripSecrets && user.TotpSecret != "" {
+			secret, err := s.userService.decryptSecret(user.TotpSecret)
+			if err != nil {
+				return nil, common.NewErrorf("unable to decrypt the two-factor secret of %s: %v", user.Username, err)
+			}
+			exported.TotpSecret = secret
+			exported.TotpEnabled = user.TotpEnabled
+			exported.TotpEnabledAt = user.TotpEnabledAt
+			exported.RecoveryCodes = user.RecoveryCodes
+		}
+		doc.Users = append(doc.Users, exported)
+	}
+
+	files := []string{}
+	for _, key := range panelCertificateSettings {
+		if doc.Settings[key] != "" {
+			files = append(files, doc.Settings[key])
+		}
+	}
+	var inbounds []*model.Inbound
+	if err := db.Model(model.Inbound{}).Order("id").Find(&inbounds).Error; err != nil {
+		return nil, err
+	}
+	for _, inbound := range inbounds {
+		exported, err := s.inboundService.ExportInbound(inbound.Id, stripTraffic)
+		if err != nil {
+			return nil, err
+		}
+		doc.Inbounds = append(doc.Inbounds, PanelExportInbound{
+			InboundExportInbound: exported.Inbound,
+			Tag:                  inbound.Tag,
+			Owner:                usernames[inbound.UserId],
+			ClientStats:          exported.ClientStats,
+		})
+		files = append(files, streamCertificateFiles(inbound.StreamSettings)...)
+	}
+
+	var outboundService OutboundService
+	outbounds, err := outboundService.GetOutbounds()
+	if err != nil {
+		return nil, err
+	}
+	for _, outbound := range outbounds {
+		doc.Outbounds = append(doc.Outbounds, PanelExportOutbound{
+			Tag:            outbound.Tag,
+			Protocol:       outbound.Protocol,
+			SendThrough:    outbound.SendThrough,
+			Settings:       rawJSON(outbound.Settings),
+			StreamSettings: rawJSON(outbound.StreamSettings),
+			Mux:            rawJSON(outbound.Mux),
+		})
+	}
+	var balancerService BalancerService
+	balancers, err := balancerService.GetBalancers()
+	if err != nil {
+		return nil, err
+	}
+	for _, balancer := range balancers {
+		doc.Balancers = append(doc.Balancers, PanelExportBalancer{
+			Tag:         balancer.Tag,
+			Selector:    balancer.Selector,
+			Strategy:    balancer.Strategy,
+			FallbackTag: balancer.FallbackTag,
+		})
+	}
+	var routingService RoutingService
+	rules, err := routingService.GetRules()
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range rules {
+		doc.RoutingRules = append(doc.RoutingRules, PanelExportRule{
+			Remark:      rule.Remark,
+			Domain:      rule.Domain,
+			Ip:          rule.Ip,
+			Port:        rule.Port,
+			SourcePort:  rule.SourcePort,
+			Network:     rule.Network,
+			Protocol:    rule.Protocol,
+			InboundTag:  rule.InboundTag,
+			User:        rule.User,
+			OutboundTag: rule.OutboundTag,
+			BalancerTag: rule.BalancerTag,
+		})
+	}
+
+	for _, file := range files {
+		if slices.ContainsFunc(doc.Files, func(f PanelExportFile) bool { return f.Path == file }) {
+			continue
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			logger.Warning("Unable to export the file", file+":", err)
+			continue
+		}
+		doc.Files = append(doc.Files, PanelExportFile{Path: file, Data: data})
+	}
+	return doc, nil
+}
+
+// parsePanelExport reads a bundle of any version up to the current one and
+// upgrades it to the current one.
+func parsePanelExport(data []byte) (*PanelExport, error) {
+	var raw map[string]any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, common.NewError("invalid panel export:", err)
+	}
+	version := int(jsonInt64(raw["version"]))
+	if version < 1 {
+		return nil, common.NewError("the panel export has no version")
+	}
+	if version > PanelExportVersion {
+		return nil, common.NewErrorf("the panel export has version %d, this panel reads up to %d: update the panel to import it", version, PanelExportVersion)
+	}
+	for ; version < PanelExportVersion; version++ {
+		if err := panelExportUpgrades[version](raw); err != nil {
+			return nil, err
+		}
+	}
+	raw["version"] = version
+	if upgraded, err := json.Marshal(raw); err == nil {
+		data = upgraded
+	}
+
+	doc := &PanelExport{}
+	if err := json.Unmarshal(data, doc); err != nil {
+		return nil, common.NewError("invalid panel export:", err)
+	}
+	return doc, nil
+}
+
+func (doc *PanelExport) validate() error {
+	usernames := map[string]bool{}
+	for _, user := range doc.Users {
+		if strings.TrimSpace(user.Username) == "" {
+			return common.NewError("a user has no username")
+		}
+		if usernames[user.Username] {
+			return common.NewError("duplicate username:", user.Username)
+		}
+		usernames[user.Username] = true
+		if !IsValidRole(user.Role) {
+			return common.NewErrorf("user %s has the unknown role %q", user.Username, user.Role)
+		}
+		if user.Password == "" {
+			return common.NewErrorf("user %s has no password", user.Username)
+		}
+		if user.TotpEnabled && user.TotpSecret == "" {
+			return common.NewErrorf("user %s has two-factor authentication without a secret", user.Username)
+		}
+	}
+
+	tags := map[string]bool{}
+	for i := range doc.Inbounds {
+		in := &doc.Inbounds[i]
+		if in.Tag == "" {
+			in.Tag = InboundTag(in.Listen, in.Port)
+		}
+		if err := (&InboundExport{Inbound: in.InboundExportInbound}).validate(); err != nil {
+			return common.NewErrorf("inbound %s: %v", in.Tag, err)
+		}
+		if tags[in.Tag] {
+			return common.NewError("duplicate inbound tag:", in.Tag)
+		}
+		tags[in.Tag] = true
+	}
+	tags = map[string]bool{}
+	for _, outbound := range doc.Outbounds {
+		if tags[outbound.Tag] {
+			return common.NewError("duplicate outbound tag:", outbound.Tag)
+		}
+		tags[outbound.Tag] = true
+	}
+	for _, balancer := range doc.Balancers {
+		if tags[balancer.Tag] {
+			return common.NewError("duplicate outbound or balancer tag:", balancer.Tag)
+		}
+		tags[balancer.Tag] = true
+	}
+	paths := map[string]bool{}
+	for _, file := range doc.Files {
+		if file.Path == "" || paths[file.Path] {
+			return common.NewErrorf("the file path %q is empty or duplicate", file.Path)
+		}
+		paths[file.Path] = true
+	}
+	return nil
+}
+
+// panelImport is an import being planned: what it changes is worked out and
+// checked first, then applied in one transaction.
+type panelImport struct {
+	s      *PanelExportService
+	doc    *PanelExport
+	policy string
+	result *PanelImportResult
+
+	// settings are the values to store by key
+	settings map[string]string
+
+	delUsers    []int
+	addUsers    []PanelExportUser
+	updateUsers map[int]PanelExportUser
+
+	keptInbounds []*model.Inbound
+	delInbounds  []*model.Inbound
+	addInbounds  []*model.Inbound
+	owners       []string
+
+	keptOutbounds []model.Outbound
+	delOutbounds  []int
+	addOutbounds  []model.Outbound
+	keptBalancers []model.Balancer
+	delBalancers  []int
+	addBalancers  []model.Balancer
+	keptRules     []model.RoutingRule
+	delRules      []int
+	addRules      []model.RoutingRule
+
+	// created are the files the import wrote, removed if it fails
+	created []string
+}
+
+// Import applies a bundle of Export with the policy, all of it or, if anything
+// of it is invalid or doesn't fit, nothing. The certificate files are written to
+// the certs folder next to the database, and the settings and inbounds that
+// refer to them are changed to their new paths. Xray is restarted once after.
+//
+// With PanelImportReplaceAll, the users, inbounds, outbounds, balancers and
+// routing rules of the panel are replaced with those of the bundle. The merges
+// keep those of the bundle whose username or tag the panel doesn't have and
+// either keep what the panel has, skipping the rest with the clients whose
+// emails are taken, or replace it. The settings of the bundle are set, but with
+// PanelImportKeepExisting those the panel has set. The merges add the routing
+// rules of the bundle the panel doesn't have after its own.
+func (s *PanelExportService) Import(data []byte, policy string) (*PanelImportResult, error) {
+	switch policy {
+	case PanelImportReplaceAll, PanelImportKeepExisting, PanelImportOverwrite:
+	default:
+		return nil, common.NewErrorf("unknown import policy %q, use %s, %s or %s", policy,
+			PanelImportReplaceAll, PanelImportKeepExisting, PanelImportOverwrite)
+	}
+	doc, err := parsePanelExport(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := doc.validate(); err != nil {
+		return nil, err
+	}
+	// The buffered traffic goes to the clients before they may be replaced
+	if err := s.inboundService.FlushTraffic(); err != nil {
+		return nil, err
+	}
+
+	p := &panelImport{
+		s:           s,
+		doc:         doc,
+		policy:      policy,
+		result:      &PanelImportResult{},
+		updateUsers: map[int]PanelExportUser{},
+	}
+	err = p.plan()
+	if err == nil {
+		err = database.Transaction(p.apply)
+		InvalidateSettings()
+	}
+	if err != nil {
+		for _, file := range p.created {
+			os.Remove(file)
+		}
+		return nil, err
+	}
+	logger.Infof("panel imported with %s: %d settings, %d users, %d inbounds, %d outbounds, %d balancers, %d routing rules",
+		policy, p.result.Settings, p.result.Users, p.result.Inbounds, p.result.Outbounds, p.result.Balancers, p.result.RoutingRules)
+
+	if err := s.xrayService.RestartXray(true); err != nil {
+		logger.Warning("Xray failed to start after the panel import:", err)
+		p.result.XrayError = err.Error()
+	}
+	return p.result, nil
+}
+
+func (p *panelImport) skip(what string) {
+	p.result.Skipped = append(p.result.Skipped, what)
+}
+
+// plan works out and checks the changes of the import, and writes the files
+// it needs.
+func (p *panelImport) plan() error {
+	if err := p.planSettings(); err != nil {
+		return err
+	}
+	if err := p.planUsers(); err != nil {
+		return err
+	}
+	if err := p.planInbounds(); err != nil {
+		return err
+	}
+	if err := p.planRouting(); err != nil {
+		return err
+	}
+	if err := p.writeFiles(); err != nil {
+		return err
+	}
+	return p.checkSettings()
+}
+
+func (p *panelImport) planSettings() error {
+	var stored []*model.Setting
+	if err := database.GetDB().Model(model.Setting{}).Find(&stored).Error; err != nil {
+		return err
+	}
+	keys := map[string]bool{}
+	for _, setting := range stored {
+		keys[setting.Key] = true
+	}
+	p.settings = map[string]string{}
+	for key, value := range p.doc.Settings {
+		// Unknown settings are those of a newer panel, or of an older one that
+		// the panel dropped
+		if _, ok := defaultValueMap[key]; !ok || slices.Contains(panelLocalSettings, key) {
+			continue
+		}
+		if keys[key] && p.policy == PanelImportKeepExisting {
+			continue
+		}
+		p.settings[key] = value
+	}
+
+	if value, ok := p.settings["backupRemotes"]; ok {
+		remotes := []BackupRemote{}
+		if err := json.Unmarshal([]byte(value), &remotes); err != nil {
+			return common.NewErrorf("the backup remotes are not valid: %v", err)
+		}
+		sealed, err := p.s.backupService.sealRemotes(remotes)
+		if err != nil {
+			return err
+		}
+		p.settings["backupRemotes"] = sealed
+	}
+	if value, ok := p.settings["xrayTemplateConfig"]; ok {
+		if _, err := parseTemplateRefs(value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// settingValue returns the value a setting has after the import.
+func (p *panelImport) settingValue(key string) (string, error) {
+	if value, ok := p.settings[key]; ok {
+		return value, nil
+	}
+	return p.s.settingService.GetString(key)
+}
+
+func (p *panelImport) planUsers() error {
+	var users []*model.User
+	if err := database.GetDB().Model(model.User{}).Order("id").Find(&users).Error; err != nil {
+		return err
+	}
+	existing := map[string]*model.User{}
+	for _, user := range users {
+		existing[user.Username] = user
+	}
+	imported := map[string]bool{}
+	for _, user := range p.doc.Users {
+		imported[user.Username] = true
+		old, ok := existing[user.Username]
+		switch {
+		case !ok:
+			p.addUsers = append(p.addUsers, user)
+		case p.policy == PanelImportKeepExisting:
+			p.skip("user " + user.Username)
+		default:
+			p.updateUsers[old.Id] = user
+		}
+	}
+
+	admin := false
+	for _, user := range p.addUsers {
+		admin = admin || user.Role == model.RoleAdmin
+	}
+	for _, user := range users {
+		if p.policy == PanelImportReplaceAll && !imported[user.Username] {
+			p.delUsers = append(p.delUsers, user.Id)
+			continue
+		}
+		role := user.Role
+		if updated, ok := p.updateUsers[user.Id]; ok {
+			role = updated.Role
+		}
+		admin = admin || role == model.RoleAdmin
+	}
+	if !admin {
+		return common.NewError("the import would leave the panel without an admin")
+	}
+	return nil
+}
+
+// inboundsOverlap tells whether two inbounds listen on a same port.
+func inboundsOverlap(a *model.Inbound, b *model.Inbound) bool {
+	anyAddress := func(listen string) bool {
+		return listen == "" || listen == "0.0.0.0" || listen == "::" || listen == "::0"
+	}
+	if a.Listen != b.Listen && !anyAddress(a.Listen) && !anyAddress(b.Listen) {
+		return false
+	}
+	aStart, aEnd := a.PortRange()
+	bStart, bEnd := b.PortRange()
+	return aStart <= bEnd && bStart <= aEnd
+}
+
+func (p *panelImport) planInbounds() error {
+	var inbounds []*model.Inbound
+	if err := database.GetDB().Model(model.Inbound{}).Order("id").Find(&inbounds).Error; err != nil {
+		return err
+	}
+	existing := map[string]*model.Inbound{}
+	for _, inbound := range inbounds {
+		existing[inbound.Tag] = inbound
+	}
+	imported := []*PanelExportInbound{}
+	for i := range p.doc.Inbounds {
+		in := &p.doc.Inbounds[i]
+		if old, ok := existing[in.Tag]; ok && p.policy != PanelImportReplaceAll {
+			if p.policy == PanelImportKeepExisting {
+				p.skip("inbound " + in.Tag)
+				continue
+			}
+			p.delInbounds = append(p.delInbounds, old)
+		}
+		imported = append(imported, in)
+	}
+	if p.policy == PanelImportReplaceAll {
+		p.delInbounds = inbounds
+	}
+	for _, inbound := range inbounds {
+		if !slices.Contains(p.delInbounds, inbound) {
+			p.keptInbounds = append(p.keptInbounds, inbound)
+		}
+	}
+
+	panelPorts := []int{}
+	for _, key := range []string{"webPort", "subPort"} {
+		value, err := p.settingValue(key)
+		if err != nil {
+			return err
+		}
+		port, _ := strconv.Atoi(value)
+		panelPorts = append(panelPorts, port)
+	}
+	// used has the inbounds of the emails taken
+	used := map[string]string{}
+	for _, inbound := range p.keptInbounds {
+		clients, _ := p.s.inboundService.GetClients(inbound)
+		for _, client := range clients {
+			used[strings.ToLower(client.Email)] = inbound.Tag
+		}
+	}
+
+	for _, in := range imported {
+		ports := &model.Inbound{Listen: in.Listen, Port: in.Port, PortEnd: in.PortEnd}
+		conflict := ""
+		start, end := ports.PortRange()
+		for _, port := range panelPorts {
+			if port >= start && port <= end {
+				conflict = "the panel"
+			}
+		}
+		for _, other := range append(slices.Clone(p.keptInbounds), p.addInbounds...) {
+			if conflict == "" && inboundsOverlap(ports, other) {
+				conflict = "inbound " + other.Tag
+			}
+		}
+		if conflict != "" {
+			if p.policy == PanelImportKeepExisting {
+				p.skip("inbound " + in.Tag)
+				continue
+			}
+			return common.NewErrorf("inbound %s: port %s is used by %s", in.Tag, ports.PortString(), conflict)
+		}
+
+		inbound, err := p.importedInbound(in, used)
+		if err != nil {
+			return common.NewErrorf("inbound %s: %v", in.Tag, err)
+		}
+
+		clients, _ := p.s.inboundService.GetClients(inbound)
+		for _, client := range clients {
+			if tag, ok := used[strings.ToLower(client.Email)]; ok {
+				return common.NewErrorf("inbound %s: the email %s is used by inbound %s", in.Tag, client.Email, tag)
+			}
+		}
+		for _, client := range clients {
+			used[strings.ToLower(client.Email)] = inbound.Tag
+		}
+		p.addInbounds = append(p.addInbounds, inbound)
+		p.owners = append(p.owners, in.Owner)
+	}
+	return nil
+}
+
+// importedInbound returns the inbound to create for one of the bundle, without
+// the clients whose emails are used when the existing ones are kept.
+func (p *panelImport) importedInbound(in *PanelExportInbound, used map[string]string) (*model.Inbound, error) {
+	var settings map[string]any
+	if err := json.Unmarshal(in.Settings, &settings); err != nil {
+		return nil, err
+	}
+	stats := map[string]*InboundExportTraffic{}
+	for i := range in.ClientStats {
+		stats[in.ClientStats[i].Email] = &in.ClientStats[i]
+	}
+	var clientStats []xray.ClientTraffic
+	if clients, ok := settings["clients"].([]any); ok {
+		kept := make([]any, 0, len(clients))
+		for _, item := range clients {
+			client, _ := item.(map[string]any)
+			email, _ := client["email"].(string)
+			if _, ok := used[strings.ToLower(email)]; ok && p.policy == PanelImportKeepExisting {
+				p.skip("client " + email)
+				continue
+			}
+			kept = append(kept, client)
+			clientStats = append(clientStats, importedClientStat(client, stats[email], email))
+		}
+		settings["clients"] = kept
+	}
+	data, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	inbound := &model.Inbound{
+		Up:             in.Up,
+		Down:           in.Down,
+		Total:          in.Total,
+		Remark:         in.Remark,
+		RemarkTemplate: in.RemarkTemplate,
+		Enable:         in.Enable,
+		ExpiryTime:     in.ExpiryTime,
+		ClientStats:    clientStats,
+		Listen:         in.Listen,
+		Port:           in.Port,
+		PortEnd:        in.PortEnd,
+		Protocol:       in.Protocol,
+		StreamSettings: string(in.StreamSettings),
+		Tag:            in.Tag,
+		Allocate:       string(in.Allocate),
+	}
+	if inbound.Settings, err = normalizeClients(string(data)); err != nil {
+		return nil, err
+	}
+	if inbound.Settings, err = normalizeFallbacks(inbound.Protocol, inbound.Settings); err != nil {
+		return nil, err
+	}
+	if inbound.Sniffing, err = normalizeSniffing(string(in.Sniffing)); err != nil {
+		return nil, err
+	}
+	clients, err := p.s.inboundService.GetClients(inbound)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkClientIds(inbound.Protocol, clients); err != nil {
+		return nil, err
+	}
+	if _, err := checkClientFlows(inbound, clients); err != nil {
+		return nil, err
+	}
+	if _, err := checkShadowsocksKeys(inbound, clients); err != nil {
+		return nil, err
+	}
+	markClientStats(inbound, clients)
+	return inbound, nil
+}
+
+// ruleKey tells routing rules apart, by what they match and where they send.
+func ruleKey(rule *model.RoutingRule) string {
+	data, _ := json.Marshal(rule.GenXrayRuleConfig())
+	return rule.Remark + "\n" + string(data)
+}
+
+// importedRuleName names a routing rule of the bundle by its position in it.
+func importedRuleName(rule *model.RoutingRule) string {
+	if rule.Remark != "" {
+		return fmt.Sprintf("routing rule %d of the bundle (%s)", rule.Position+1, rule.Remark)
+	}
+	return fmt.Sprintf("routing rule %d of the bundle", rule.Position+1)
+}
+
+func (p *panelImport) planRouting() error {
+	var outboundService OutboundService
+	outbounds, err := outboundService.GetOutbounds()
+	if err != nil {
+		return err
+	}
+	outboundIndex := map[string]int{}
+	for i, outbound := range outbounds {
+		outboundIndex[outbound.Tag] = i
+	}
+	replaced := map[int]bool{}
+	for _, exported := range p.doc.Outbounds {
+		if i, ok := outboundIndex[exported.Tag]; ok && p.policy != PanelImportReplaceAll {
+			if p.policy == PanelImportKeepExisting {
+				p.skip("outbound " + exported.Tag)
+				continue
+			}
+			replaced[i] = true
+		}
+		p.addOutbounds = append(p.addOutbounds, model.Outbound{
+			Tag:            exported.Tag,
+			Protocol:       exported.Protocol,
+			SendThrough:    exported.SendThrough,
+			Settings:       string(exported.Settings),
+			StreamSettings: string(exported.StreamSettings),
+			Mux:            string(exported.Mux),
+		})
+	}
+	for i, outbound := range outbounds {
+		if replaced[i] || p.policy == PanelImportReplaceAll {
+			p.delOutbounds = append(p.delOutbounds, outbound.Id)
+		} else {
+			p.keptOutbounds = append(p.keptOutbounds, outbound)
+		}
+	}
+
+	var balancerService BalancerService
+	balancers, err := balancerService.GetBalancers()
+	if err != nil {
+		return err
+	}
+	balancerIndex := map[string]int{}
+	for i, balancer := range balancers {
+		balancerIndex[balancer.Tag] = i
+	}
+	replaced = map[int]bool{}
+	for _, exported := range p.doc.Balancers {
+		if i, ok := balancerIndex[exported.Tag]; ok && p.policy != PanelImportReplaceAll {
+			if p.policy == PanelImportKeepExisting {
+				p.skip("balancer " + exported.Tag)
+				continue
+			}
+			replaced[i] = true
+		}
+		p.addBalancers = append(p.addBalancers, model.Balancer{
+			Tag:         exported.Tag,
+			Selector:    exported.Selector,
+			Strategy:    exported.Strategy,
+			FallbackTag: exported.FallbackTag,
+		})
+	}
+	for i, balancer := range balancers {
+		if replaced[i] || p.policy == PanelImportReplaceAll {
+			p.delBalancers = append(p.delBalancers, balancer.Id)
+		} else {
+			p.keptBalancers = append(p.keptBalancers, balancer)
+		}
+	}
+
+	var routingService RoutingService
+	rules, err := routingService.GetRules()
+	if err != nil {
+		return err
+	}
+	keys := map[string]bool{}
+	for i := range rules {
+		if p.policy == PanelImportReplaceAll {
+			p.delRules = append(p.delRules, rules[i].Id)
+			continue
+		}
+		p.keptRules = append(p.keptRules, rules[i])
+		keys[ruleKey(&rules[i])] = true
+	}
+	for i, exported := range p.doc.RoutingRules {
+		// Until it is created, the position is the one in the bundle
+		rule := model.RoutingRule{
+			Position:    i,
+			Remark:      exported.Remark,
+			Domain:      exported.Domain,
+			Ip:          exported.Ip,
+			Port:        exported.Port,
+			SourcePort:  exported.SourcePort,
+			Network:     exported.Network,
+			Protocol:    exported.Protocol,
+			InboundTag:  exported.InboundTag,
+			User:        exported.User,
+			OutboundTag: exported.OutboundTag,
+			BalancerTag: exported.BalancerTag,
+		}
+		if keys[ruleKey(&rule)] {
+			p.skip(importedRuleName(&rule))
+			continue
+		}
+		p.addRules = append(p.addRules, rule)
+	}
+	return p.checkRouting()
+}
+
+// checkRouting checks the outbounds, balancers and routing rules to add
+// against the config template and what the panel has after the import.
+func (p *panelImport) checkRouting() error {
+	template, err := p.settingValue("xrayTemplateConfig")
+	if err != nil {
+		return err
+	}
+	refs, err := parseTemplateRefs(template)
+	if err != nil {
+		return err
+	}
+	for _, outbound := range append(slices.Clone(p.keptOutbounds), p.addOutbounds...) {
+		refs.panelOutbounds = append(refs.panelOutbounds, outbound.Tag)
+	}
+	// The balancers to add are told apart from each other by their index
+	refs.panelBalancers = slices.Clone(p.keptBalancers)
+	for i := range p.addBalancers {
+		p.addBalancers[i].Id = -1 - i
+		refs.panelBalancers = append(refs.panelBalancers, p.addBalancers[i])
+	}
+	for _, inbound := range append(slices.Clone(p.keptInbounds), p.addInbounds...) {
+		refs.panelInbounds = append(refs.panelInbounds, inbound.Tag)
+	}
+
+	for i := range p.addOutbounds {
+		outbound := &p.addOutbounds[i]
+		if err := checkOutboundTag(outbound, refs); err != nil {
+			return common.NewErrorf("outbound %s: %v", outbound.Tag, err)
+		}
+		if slices.ContainsFunc(p.keptOutbounds, func(kept model.Outbound) bool { return kept.Tag == outbound.Tag }) {
+			return common.NewErrorf("outbound %s: the tag is used by another outbound", outbound.Tag)
+		}
+		if err := checkOutboundConfig(outbound); err != nil {
+			return common.NewErrorf("outbound %s: %v", outbound.Tag, err)
+		}
+	}
+	var balancerService BalancerService
+	for i := range p.addBalancers {
+		balancer := &p.addBalancers[i]
+		if err := balancerService.checkBalancer(balancer, refs); err != nil {
+			return common.NewErrorf("balancer %s: %v", balancer.Tag, err)
+		}
+	}
+	for i := range p.addBalancers {
+		p.addBalancers[i].Id = 0
+	}
+	var routingService RoutingService
+	for i := range p.addRules {
+		rule := &p.addRules[i]
+		if err := routingService.checkRule(rule, refs); err != nil {
+			return common.NewErrorf("%s: %v", importedRuleName(rule), err)
+		}
+	}
+	return nil
+}
+
+// writeFiles writes the files of the bundle that the settings and inbounds to
+// import refer to into the certs folder, and points them to the new paths.
+func (p *panelImport) writeFiles() error {
+	needed := map[string]bool{}
+	for _, key := range panelCertificateSettings {
+		if value := p.settings[key]; value != "" {
+			needed[value] = true
+		}
+	}
+	for _, inbound := range p.addInbounds {
+		for _, file := range streamCertificateFiles(inbound.StreamSettings) {
+			needed[file] = true
+		}
+	}
+	paths := map[string]string{}
+	dir := filepath.Join(config.GetDBFolderPath(), "certs")
+	for _, file := range p.doc.Files {
+		if !needed[file.Path] {
+			continue
+		}
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return err
+		}
+		// The folder is kept in the name, for the likes of fullchain.pem of
+		// several domains
+		name := filepath.Base(file.Path)
+		if parent := filepath.Base(filepath.Dir(file.Path)); parent != "." && parent != string(filepath.Separator) {
+			name = parent + "-" + name
+		}
+		path, created, err := writeImportedFile(dir, name, file.Data)
+		if err != nil {
+			return err
+		}
+		if created {
+			p.created = append(p.created, path)
+		}
+		paths[file.Path] = path
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+	p.result.Files = paths
+
+	for _, key := range panelCertificateSettings {
+		if path, ok := paths[p.settings[key]]; ok {
+			p.settings[key] = path
+		}
+	}
+	for _, inbound := range p.addInbounds {
+		stream, err := rewriteStreamCertificateFiles(inbound.StreamSettings, paths)
+		if err != nil {
+			return common.NewErrorf("inbound %s: %v", inbound.Tag, err)
+		}
+		inbound.StreamSettings = stream
+	}
+	return nil
+}
+
+// writeImportedFile writes data to name in dir, or to name with a number if a
+// file with other data has the name. It returns the path, and whether the file
+// was written rather than already there.
+func writeImportedFile(dir string, name string, data []byte) (string, bool, error) {
+	ext := filepath.Ext(name)
+	for n := 1; ; n++ {
+		path := filepath.Join(dir, name)
+		if n > 1 {
+			path = filepath.Join(dir, fmt.Sprintf("%s-%d%s", strings.TrimSuffix(name, ext), n, ext))
+		}
+		existing, err := os.ReadFile(path)
+		if err == nil {
+			if bytes.Equal(existing, data) {
+				return path, false, nil
+			}
+			continue
+		}
+		if !os.IsNotExist(err) {
+			return "", false, err
+		}
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+		if err != nil {
+			return "", false, err
+		}
+		_, err = file.Write(data)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(path)
+			return "", false, err
+		}
+		return path, true, nil
+	}
+}
+
+// rewriteStreamCertificateFiles changes the certificate and key files of the
+// TLS settings of streamSettings to their new paths.
+func rewriteStreamCertificateFiles(streamSettings string, paths map[string]string) (string, error) {
+	if len(streamCertificateFiles(streamSettings)) == 0 {
+		return streamSettings, nil
+	}
+	var stream map[string]any
+	if err := json.Unmarshal([]byte(streamSettings), &stream); err != nil {
+		return "", err
+	}
+	tlsSettings, _ := stream["tlsSettings"].(map[string]any)
+	certificates, _ := tlsSettings["certificates"].([]any)
+	for _, item := range certificates {
+		certificate, _ := item.(map[string]any)
+		for _, key := range []string{"certificateFile", "keyFile"} {
+			if file, ok := certificate[key].(string); ok && paths[file] != "" {
+				certificate[key] = paths[file]
+			}
+		}
+	}
+	data, err := json.MarshalIndent(stream, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// checkSettings checks the settings the import makes, with the certificate
+// files at their new paths.
+func (p *panelImport) checkSettings() error {
+	allSetting, err := p.s.settingService.GetAllSetting()
+	if err != nil {
+		return err
+	}
+	for key, value := range p.settings {
+		if err := setAllSettingField(allSetting, key, value); err != nil {
+			return common.NewErrorf("setting %s: %v", key, err)
+		}
+	}
+	return allSetting.CheckValid()
+}
+
+// apply makes the changes of the import in tx.
+func (p *panelImport) apply(tx *gorm.DB) error {
+	for key, value := range p.settings {
+		if err := tx.Where(map[string]any{"key": key}).Delete(model.Setting{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(&model.Setting{Key: key, Value: value}).Error; err != nil {
+			return err
+		}
+	}
+	p.result.Settings = len(p.settings)
+
+	if err := p.applyUsers(tx); err != nil {
+		return err
+	}
+	if err := p.applyInbounds(tx); err != nil {
+		return err
+	}
+
+	if len(p.delOutbounds) > 0 {
+		if err := tx.Delete(model.Outbound{}, p.delOutbounds).Error; err != nil {
+			return err
+		}
+	}
+	for i := range p.addOutbounds {
+		if err := tx.Create(&p.addOutbounds[i]).Error; err != nil {
+			return err
+		}
+	}
+	p.result.Outbounds = len(p.addOutbounds)
+	if len(p.delBalancers) > 0 {
+		if err := tx.Delete(model.Balancer{}, p.delBalancers).Error; err != nil {
+			return err
+		}
+	}
+	for i := range p.addBalancers {
+		if err := tx.Create(&p.addBalancers[i]).Error; err != nil {
+			return err
+		}
+	}
+	p.result.Balancers = len(p.addBalancers)
+	if len(p.delRules) > 0 {
+		if err := tx.Delete(model.RoutingRule{}, p.delRules).Error; err != nil {
+			return err
+		}
+	}
+	position := 0
+	if len(p.keptRules) > 0 {
+		position = p.keptRules[len(p.keptRules)-1].Position + 1
+	}
+	for i := range p.addRules {
+		p.addRules[i].Position = position + i
+		if err := tx.Create(&p.addRules[i]).Error; err != nil {
+			return err
+		}
+	}
+	p.result.RoutingRules = len(p.addRules)
+	return nil
+}
+
+// importedUser returns the columns of a user of the bundle, with the two-factor
+// secret encrypted with the secret of the panel.
+func (p *panelImport) importedUser(user PanelExportUser) (map[string]any, error) {
+	secret := ""
+	if user.TotpSecret != "" {
+		var err error
+		if secret, err = p.s.userService.encryptSecret(user.TotpSecret); err != nil {
+			return nil, err
+		}
+	}
+	return map[string]any{
+		"password":        user.Password,
+		"role":            user.Role,
+		"tg_chat_id":      user.TgChatId,
+		"totp_secret":     secret,
+		"totp_enabled":    user.TotpEnabled,
+		"totp_enabled_at": user.TotpEnabledAt,
+		"totp_last_step":  0,
+		"recovery_codes":  user.RecoveryCodes,
+	}, nil
+}
+
+func (p *panelImport) applyUsers(tx *gorm.DB) error {
+	for _, id := range p.delUsers {
+		for _, table := range []any{model.WebAuthnCredential{}, model.ApiToken{}, model.LoginSession{}} {
+			if err := tx.Where("user_id = ?", id).Delete(table).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Delete(model.User{}, id).Error; err != nil {
+			return err
+		}
+	}
+	for id, user := range p.updateUsers {
+		columns, err := p.importedUser(user)
+		if err != nil {
+			return err
+		}
+		old := &model.User{}
+		if err := tx.Model(model.User{}).Where("id = ?", id).First(old).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(model.User{}).Where("id = ?", id).Updates(columns).Error; err != nil {
+			return err
+		}
+		// Like a reset password, a changed one logs the user out
+		if old.Password != user.Password {
+			if err := tx.Where("user_id = ?", id).Delete(model.LoginSession{}).Error; err != nil {
+				return err
+			}
+		}
+	}
+	for _, user := range p.addUsers {
+		created := &model.User{Username: user.Username, Password: user.Password, Role: user.Role}
+		if err := tx.Create(created).Error; err != nil {
+			return err
+		}
+		columns, err := p.importedUser(user)
+		if err != nil {
+			return err
+		}
+		if err := tx.Model(model.User{}).Where("id = ?", created.Id).Updates(columns).Error; err != nil {
+			return err
+		}
+	}
+	p.result.Users = len(p.updateUsers) + len(p.addUsers)
+	return nil
+}
+
+func (p *panelImport) applyInbounds(tx *gorm.DB) error {
+	for _, inbound := range p.delInbounds {
+		clients, _ := p.s.inboundService.GetClients(inbound)
+		for _, client := range clients {
+			if err := p.s.inboundService.DelClientIPs(tx, client.Email); err != nil {
+				return err
+			}
+		}
+		if err := tx.Where("inbound_id = ?", inbound.Id).Delete(xray.ClientTraffic{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(model.Inbound{}, inbound.Id).Error; err != nil {
+			return err
+		}
+	}
+
+	// The inbounds belong to the users of the bundle, or else to the first admin
+	var users []*model.User
+	if err := tx.Model(model.User{}).Order("id").Find(&users).Error; err != nil {
+		return err
+	}
+	userIds := map[string]int{}
+	adminId := 0
+	for _, user := range users {
+		userIds[user.Username] = user.Id
+		if adminId == 0 && user.Role == model.RoleAdmin {
+			adminId = user.Id
+		}
+	}
+	for i, inbound := range p.addInbounds {
+		inbound.UserId = adminId
+		if id, ok := userIds[p.owners[i]]; ok {
+			inbound.UserId = id
+		}
+		if err := tx.Create(inbound).Error; err != nil {
+			return err
+		}
+	}
+	p.result.Inbounds = len(p.addInbounds)
+	return nil
+}
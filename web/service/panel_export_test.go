@@ -0,0 +1,360 @@
+package service
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"x-ui/config"
+	"x-ui/database/model"
+
+	"github.com/goccy/go-json"
+)
+
+const panelExportTotpSecret = "JBSWY3DPEHPK3PXP"
+
+// testCertificate writes a self-signed certificate and its key to
+// dir/example.com, and returns their paths.
+func testCertificate(t *testing.T, dir string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir = filepath.Join(dir, "example.com")
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "fullchain.pem"), filepath.Join(dir, "privkey.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// populatedPanel fills a new panel with a setting of each kind, a second user,
+// an admin with two-factor authentication, inbounds with clients and traffic,
+// one of them with TLS, an outbound, a balancer and a routing rule.
+func populatedPanel(t *testing.T) {
+	t.Helper()
+	db := newTestDB(t)
+	dir := config.GetDBFolderPath()
+	certFile, keyFile := testCertificate(t, t.TempDir())
+	var settingService SettingService
+	for key, value := range map[string]string{
+		"webCertFile": certFile, "webKeyFile": keyFile, "tgBotToken": "123456:panel-export-token",
+		"remarkModel": "-ieo", "backupDir": filepath.Join(dir, "backups"),
+	} {
+		if err := settingService.setString(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var backupService BackupService
+	if err := backupService.SaveRemotes([]BackupRemote{{
+		Name: "dav", Type: RemoteWebDAV, Enable: true, URL: "https://dav.example/backups", Username: "user", Password: "dav-password",
+	}}); err != nil {
+		t.Fatal(err)
+	}
+
+	var userService UserService
+	secret, err := userService.encryptSecret(panelExportTotpSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Model(model.User{}).Where("username = ?", "admin").
+		Updates(map[string]any{"totp_secret": secret, "totp_enabled": true, "totp_enabled_at": 1700000000000}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create(&model.User{Username: "ops", Password: "$2a$10$opsHashOfThePassword", Role: model.RoleOperator}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	admin, err := userService.GetFirstUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var inboundService InboundService
+	tlsInbound := model.Inbound{
+		Remark: "trojan tls", Enable: true, Port: 24437, Protocol: model.Trojan,
+		Settings: `{"clients":[{"password":"Vb7pQ1wK9sT3","email":"panel-tls-1","enable":true}],"fallbacks":[]}`,
+		StreamSettings: `{"network":"tcp","security":"tls","tlsSettings":{"serverName":"example.com",` +
+			`"certificates":[{"certificateFile":"` + certFile + `","keyFile":"` + keyFile + `"}]}}`,
+		Sniffing: `{"enabled":true,"destOverride":["http","tls"]}`,
+	}
+	for _, template := range []model.Inbound{exportTestInbounds[0], tlsInbound} {
+		inbound := template
+		inbound.Tag = InboundTag(inbound.Listen, inbound.Port)
+		inbound.UserId = admin.Id
+		added, _, err := inboundService.AddInbound(&inbound)
+		if err != nil {
+			t.Fatalf("add %s: %v", template.Remark, err)
+		}
+		if err := db.Model(added).Updates(map[string]any{"up": 1000, "down": 2000}).Error; err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Exec("UPDATE client_traffics SET up = 10, down = 20 WHERE inbound_id = ?", added.Id).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := (&OutboundService{}).AddOutbound(&model.Outbound{Tag: "warp-out", Protocol: "freedom", Settings: `{"domainStrategy":"UseIP"}`}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&BalancerService{}).AddBalancer(&model.Balancer{Tag: "warp-balancer", Selector: []string{"warp"}, Strategy: "random"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&RoutingService{}).AddRule(&model.RoutingRule{
+		Remark: "tls to warp", InboundTag: []string{"inbound-24437"}, BalancerTag: "warp-balancer",
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// panelImportXray leaves the import without an Xray to restart, so that it
+// reports the failed restart rather than waiting on one.
+func panelImportXray(t *testing.T) {
+	t.Helper()
+	t.Setenv("XUI_BIN_FOLDER", t.TempDir())
+	t.Setenv("XUI_LOG_FOLDER", t.TempDir())
+	t.Cleanup(func() { p = nil })
+}
+
+func exportPanel(t *testing.T, stripSecrets bool, stripTraffic bool) []byte {
+	t.Helper()
+	doc, err := (&PanelExportService{}).Export(stripSecrets, stripTraffic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc.ExportedAt = 0
+	data, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestPanelExportRoundTrip(t *testing.T) {
+	panelImportXray(t)
+	populatedPanel(t)
+	exported := exportPanel(t, false, false)
+
+	newTestDB(t)
+	dir := config.GetDBFolderPath()
+	var s PanelExportService
+	result, err := s.Import(exported, PanelImportReplaceAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Xray failing to start doesn't undo the import
+	if result.XrayError == "" {
+		t.Error("the import restarted an Xray that isn't there")
+	}
+	if result.Users != 2 || result.Inbounds != 2 || result.Outbounds != 1 || result.Balancers != 1 || result.RoutingRules != 1 {
+		t.Errorf("the import result is %+v", result)
+	}
+	// The files are written next to the database, the settings and the
+	// inbound use them there
+	if len(result.Files) != 2 {
+		t.Fatalf("the files written are %v", result.Files)
+	}
+	reimported := string(exportPanel(t, false, false))
+	for old, path := range result.Files {
+		if filepath.Dir(path) != filepath.Join(dir, "certs") || !strings.HasPrefix(filepath.Base(path), "example.com-") {
+			t.Errorf("%s was written to %s", old, path)
+		}
+		if strings.Contains(reimported, old) {
+			t.Errorf("the import still refers to %s", old)
+		}
+		reimported = strings.ReplaceAll(reimported, path, old)
+	}
+	if !sameJSON(t, reimported, string(exported)) {
+		t.Errorf("the export of the import differs:\n%s\nwant\n%s", reimported, exported)
+	}
+
+	// The secrets are sealed with the secret of the new panel
+	var userService UserService
+	admin, err := userService.GetFirstUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret, err := userService.decryptSecret(admin.TotpSecret); err != nil || secret != panelExportTotpSecret || !admin.TotpEnabled {
+		t.Errorf("the two-factor secret of the admin is %q, %v", secret, err)
+	}
+	remotes, err := (&BackupService{}).getRemotes()
+	if err != nil || len(remotes) != 1 || remotes[0].Password != "dav-password" {
+		t.Errorf("the backup remotes are %v, %v", remotes, err)
+	}
+	// The settings of the host are its own
+	var settingService SettingService
+	if backupDir, _ := settingService.GetString("backupDir"); backupDir != "" {
+		t.Errorf("the backup folder of the other host was imported: %s", backupDir)
+	}
+}
+
+func TestPanelExportStripped(t *testing.T) {
+	populatedPanel(t)
+	data := exportPanel(t, true, true)
+	for _, secret := range []string{"panel-export-token", "dav-password", panelExportTotpSecret, `"backupDir"`, `"secret"`} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("the stripped export has %s", secret)
+		}
+	}
+	var doc PanelExport
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if !doc.SecretsStripped || len(doc.Users) != 2 || len(doc.Inbounds) != 2 || doc.Settings["remarkModel"] != "-ieo" {
+		t.Errorf("the stripped export is %+v", doc)
+	}
+	for _, in := range doc.Inbounds {
+		if in.Up != 0 || in.Down != 0 || len(in.ClientStats) != 0 {
+			t.Errorf("inbound %s has traffic: %+v", in.Tag, in)
+		}
+	}
+}
+
+// panelState is what an import may change, to tell that a failed one didn't.
+func panelState(t *testing.T) string {
+	t.Helper()
+	data := exportPanel(t, false, false)
+	entries, _ := os.ReadDir(filepath.Join(os.Getenv("XUI_DB_FOLDER"), "certs"))
+	for _, entry := range entries {
+		data = append(data, entry.Name()...)
+	}
+	return string(data)
+}
+
+func TestPanelImportRejected(t *testing.T) {
+	panelImportXray(t)
+	populatedPanel(t)
+	exported := exportPanel(t, false, false)
+
+	newTestDB(t)
+	inbound := &model.Inbound{
+		Remark: "taken email", Enable: true, Port: 24438, Protocol: model.VMESS, Tag: "inbound-24438",
+		Settings: `{"clients":[{"id":"3b1e7a52-9f0c-4d8e-a6b2-5c7d9e1f2a44","email":"reality-1","enable":true}]}`,
+	}
+	if _, _, err := (&InboundService{}).AddInbound(inbound); err != nil {
+		t.Fatal(err)
+	}
+	before := panelState(t)
+	var s PanelExportService
+
+	var doc map[string]any
+	if err := json.Unmarshal(exported, &doc); err != nil {
+		t.Fatal(err)
+	}
+	doc["version"] = PanelExportVersion + 1
+	newer, _ := json.Marshal(doc)
+	tests := []struct {
+		data   []byte
+		policy string
+		err    string
+	}{
+		{newer, PanelImportReplaceAll, "update the panel to import it"},
+		{[]byte(`{"settings":{}}`), PanelImportReplaceAll, "has no version"},
+		{exported, "merge", "unknown import policy"},
+		{exported, PanelImportOverwrite, "the email reality-1 is used by inbound inbound-24438"},
+		{[]byte(strings.Replace(string(exported), `"role":"admin"`, `"role":"viewer"`, 1)), PanelImportReplaceAll, "without an admin"},
+	}
+	for _, test := range tests {
+		_, err := s.Import(test.data, test.policy)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("import %s: error %v, want %q", test.policy, err, test.err)
+		}
+		if after := panelState(t); after != before {
+			t.Errorf("the rejected import %q changed the panel", test.err)
+		}
+	}
+}
+
+func TestPanelImportMerge(t *testing.T) {
+	panelImportXray(t)
+	populatedPanel(t)
+	exported := exportPanel(t, false, false)
+
+	newTestDB(t)
+	var settingService SettingService
+	if err := settingService.setString("tgBotToken", "654321:own-token"); err != nil {
+		t.Fatal(err)
+	}
+	var inboundService InboundService
+	own := exportTestInbounds[0]
+	own.Remark, own.Tag = "own reality", "inbound-24431"
+	own.Settings = strings.Replace(own.Settings, "reality-1", "own-1", 1)
+	if _, _, err := inboundService.AddInbound(&own); err != nil {
+		t.Fatal(err)
+	}
+	var s PanelExportService
+
+	// Keeping the existing ones, the bundle only adds
+	result, err := s.Import(exported, PanelImportKeepExisting)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Inbounds != 1 || result.Users != 1 || !strings.Contains(strings.Join(result.Skipped, ","), "inbound inbound-24431") ||
+		!strings.Contains(strings.Join(result.Skipped, ","), "user admin") {
+		t.Errorf("the merge keeping the existing ones gave %+v", result)
+	}
+	if token, _ := settingService.GetTgBotToken(); token != "654321:own-token" {
+		t.Errorf("the token was replaced with %s", token)
+	}
+	if inbound, _ := inboundService.GetInbound(own.Id); inbound == nil || inbound.Remark != "own reality" {
+		t.Errorf("the inbound was replaced with %+v", inbound)
+	}
+	// Imported again, nothing more is added
+	again, err := s.Import(exported, PanelImportKeepExisting)
+	if err != nil || again.Inbounds+again.Users+again.Outbounds+again.Balancers+again.RoutingRules != 0 {
+		t.Errorf("the second merge gave %+v, %v", again, err)
+	}
+
+	// Overwriting, the bundle replaces what has the same name
+	result, err = s.Import(exported, PanelImportOverwrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Inbounds != 2 || len(result.Skipped) != 1 {
+		t.Errorf("the overwriting merge gave %+v", result)
+	}
+	if token, _ := settingService.GetTgBotToken(); token != "123456:panel-export-token" {
+		t.Errorf("the token is %s", token)
+	}
+	inbounds, err := inboundService.GetAllInbounds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	remarks := []string{}
+	for _, inbound := range inbounds {
+		remarks = append(remarks, inbound.Remark)
+	}
+	if len(inbounds) != 2 || !strings.Contains(strings.Join(remarks, ","), "vless reality") {
+		t.Errorf("the inbounds are %v", remarks)
+	}
+}
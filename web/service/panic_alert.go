@@ -0,0 +1,145 @@
+package service
+
+import (
+	"html"
+	"strings"
+	"sync"
+	"time"
+
+	"x-ui/logger"
+)
+
+const (
+	panicAlertQueueSize = 16
+	panicAlertInterval  = 5 * time.Minute
+	panicAlertMaxError  = 300
+	panicAlertMaxFrames = 5
+)
+
+// PanicAlert is the information about a recovered panic that is sent to the admins.
+type PanicAlert struct {
+	RequestID string
+	Method    string
+	Path      string
+	Route     string
+	Error     string
+	Stack     string
+}
+
+var (
+	panicAlertOnce  sync.Once
+	panicAlertQueue chan PanicAlert
+	panicAlertMu    sync.Mutex
+	panicAlertSent  = map[string]time.Time{}
+)
+
+// PanicNotify queues a panic alert for the admins. It never blocks the
+// caller: alerts with a signature already reported within panicAlertInterval are
+// dropped, as are alerts that don't fit into the queue.
+func (t *Tgbot) PanicNotify(alert PanicAlert) {
+	if !t.AlertsOn(AlertPanic) {
+		return
+	}
+
+	enabled, err := t.settingService.GetTgBotPanicNotify()
+	if err != nil || !enabled {
+		return
+	}
+
+	if !allowPanicAlert(alert.signature(), time.Now()) {
+		return
+	}
+
+	panicAlertOnce.Do(func() {
+		panicAlertQueue = make(chan PanicAlert, panicAlertQueueSize)
+		go t.panicAlertWorker()
+	})
+
+	select {
+	case panicAlertQueue <- alert:
+	default:
+		logger.Warning("panic alert queue is full, dropping alert for", alert.Method, alert.Path)
+	}
+}
+
+func (t *Tgbot) panicAlertWorker() {
+	for alert := range panicAlertQueue {
+		if !t.AlertsOn(AlertPanic) {
+			continue
+		}
+
+		msg := t.I18nBot("tgbot.messages.panic")
+		msg += t.I18nBot("tgbot.messages.hostname", "Hostname=="+hostname)
+		msg += t.I18nBot("tgbot.messages.request", "Method=="+alert.Method, "Path=="+html.EscapeString(alert.Path))
+		if alert.RequestID != "" {
+			msg += t.I18nBot("tgbot.messages.requestId", "RequestID=="+html.EscapeString(alert.RequestID))
+		}
+		msg += t.I18nBot("tgbot.messages.error", "Error=="+html.EscapeString(truncateString(alert.Error, panicAlertMaxError)))
+		if frames := stackFrames(alert.Stack, panicAlertMaxFrames); len(frames) > 0 {
+			msg += t.I18nBot("tgbot.messages.stack", "Stack==<code>"+html.EscapeString(strings.Join(frames, "\n"))+"</code>")
+		}
+		msg += t.I18nBot("tgbot.messages.time", "Time=="+t.formatTime(time.Now().UnixMilli()))
+		t.SendAlert(AlertPanic, msg)
+	}
+}
+
+// signature identifies panics that come from the same place with the same error,
+// so a handler that panics on every request doesn't flood the chat.
+func (a PanicAlert) signature() string {
+	route := a.Route
+	if route == "" {
+		route = a.Path
+	}
+	frame := ""
+	if frames := stackFrames(a.Stack, 1); len(frames) > 0 {
+		frame = frames[0]
+	}
+	return a.Method + " " + route + "|" + a.Error + "|" + frame
+}
+
+func allowPanicAlert(signature string, now time.Time) bool {
+	panicAlertMu.Lock()
+	defer panicAlertMu.Unlock()
+
+	for sig, sent := range panicAlertSent {
+		if now.Sub(sent) >= panicAlertInterval {
+			delete(panicAlertSent, sig)
+		}
+	}
+	if _, ok := panicAlertSent[signature]; ok {
+		return false
+	}
+	panicAlertSent[signature] = now
+	return true
+}
+
+// stackFrames extracts up to n "function file:line" frames from a debug.Stack()
+// dump, skipping the runtime and recovery frames that are present in every panic.
+func stackFrames(stack string, n int) []string {
+	lines := strings.Split(stack, "\n")
+	frames := make([]string, 0, n)
+	for i := 1; i+1 < len(lines) && len(frames) < n; i += 2 {
+		fn := strings.TrimSpace(lines[i])
+		loc := strings.TrimSpace(lines[i+1])
+		if idx := strings.LastIndex(loc, " +0x"); idx > 0 {
+			loc = loc[:idx]
+		}
+		switch {
+		case strings.HasPrefix(fn, "runtime/debug."),
+			strings.HasPrefix(fn, "runtime."),
+			strings.HasPrefix(fn, "panic("),
+			strings.Contains(fn, "middleware.RecoveryJSON"):
+			continue
+		}
+		frames = append(frames, fn+" "+loc)
+	}
+	return frames
+}
+
+func truncateString(s string, max int) string {
+	runes := []rune(s)
+	if len(runes) <= max {
+		return s
+	}
+	return string(runes[:max]) + "..."
+}
@@ -0,0 +1,69 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+
+	"x-ui/util/common"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// The sizes in pixels QR codes are made in, QRCodeDefaultSize if none is asked.
+const (
+	QRCodeDefaultSize = 256
+	QRCodeMinSize     = 64
+	QRCodeMaxSize     = 1024
+)
+
+var qrCodeLevels = map[string]qrcode.RecoveryLevel{
+	"L": qrcode.Low,
+	"M": qrcode.Medium,
+	"Q": qrcode.High,
+	"H": qrcode.Highest,
+}
+
+// EncodeQRCode returns the QR code of content as a PNG of size pixels, or an
+// SVG if format is "svg", with its content type. level is the error correction
+// level, L, M, Q or H, M if empty.
+func EncodeQRCode(content string, size int, level string, format string) ([]byte, string, error) {
+	if level == "" {
+		level = "M"
+	}
+	recovery, ok := qrCodeLevels[strings.ToUpper(level)]
+	if !ok {
+		return nil, "", common.NewError("error correction level must be L, M, Q or H:", level)
+	}
+	if size < QRCodeMinSize || size > QRCodeMaxSize {
+		return nil, "", common.NewErrorf("size must be from %d to %d pixels: %d", QRCodeMinSize, QRCodeMaxSize, size)
+	}
+	code, err := qrcode.New(content, recovery)
+	if err != nil {
+		return nil, "", err
+	}
+	switch format {
+	case "", "png":
+		png, err := code.PNG(size)
+		return png, "image/png", err
+	case "svg":
+		return qrCodeSVG(code.Bitmap(), size), "image/svg+xml", nil
+	}
+	return nil, "", common.NewError("format must be png or svg:", format)
+}
+
+// qrCodeSVG draws the modules of bitmap, quiet zone included, as a path of
+// one unit squares scaled to size.
+func qrCodeSVG(bitmap [][]bool, size int) []byte {
+	var path strings.Builder
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&path, "M%d %dh1v1h-1z", x, y)
+			}
+		}
+	}
+	modules := len(bitmap)
+	return []byte(fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges"><rect width="100%%" height="100%%" fill="#fff"/><path fill="#000" d="%s"/></svg>
+`, size, size, modules, modules, path.String()))
+}
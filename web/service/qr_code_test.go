@@ -0,0 +1,135 @@
+package service
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"regexp"
+	"strconv"
+	"testing"
+
+	"github.com/makiuchi-d/gozxing"
+	"github.com/makiuchi-d/gozxing/qrcode"
+)
+
+// qrTestLink is a share link like the panel makes, with its remark escaped.
+const qrTestLink = "vless://5d2b3f8c-1a9e-4c6d-b7f0-8e4a2c1d6b55@example.com:443?type=tcp&security=reality&pbk=jNXHt1yRo0vDuchQlIP6Z0ZvjT3KtzVI-T4E7RoLJS0&fp=chrome&sni=www.microsoft.com&sid=6ba85179e30d4fc2&spx=%2F&flow=xtls-rprx-vision#%D0%A1%D0%B5%D1%80%D0%B2%D0%B5%D1%80%20%F0%9F%87%A9%F0%9F%87%AA-user%40example.com"
+
+// decodeQRCode returns the content and error correction level of the QR code
+// of img.
+func decodeQRCode(t *testing.T, img image.Image) (string, string) {
+	t.Helper()
+	bitmap, err := gozxing.NewBinaryBitmapFromImage(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := qrcode.NewQRCodeReader().Decode(bitmap, map[gozxing.DecodeHintType]any{gozxing.DecodeHintType_TRY_HARDER: true})
+	if err != nil {
+		t.Fatal("the QR code can't be decoded:", err)
+	}
+	level, _ := result.GetResultMetadata()[gozxing.ResultMetadataType_ERROR_CORRECTION_LEVEL].(string)
+	return result.GetText(), level
+}
+
+var svgSquare = regexp.MustCompile(`M(\d+) (\d+)h1v1h-1z`)
+var svgViewBox = regexp.MustCompile(`viewBox="0 0 (\d+) (\d+)"`)
+
+// rasterizeQRCode draws the squares of the SVG QR code of data, scale pixels
+// a module.
+func rasterizeQRCode(t *testing.T, data []byte, scale int) image.Image {
+	t.Helper()
+	viewBox := svgViewBox.FindSubmatch(data)
+	if viewBox == nil {
+		t.Fatalf("the SVG has no view box: %s", data)
+	}
+	modules, _ := strconv.Atoi(string(viewBox[1]))
+	img := image.NewGray(image.Rect(0, 0, modules*scale, modules*scale))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+	for _, square := range svgSquare.FindAllSubmatch(data, -1) {
+		x, _ := strconv.Atoi(string(square[1]))
+		y, _ := strconv.Atoi(string(square[2]))
+		for dy := range scale {
+			for dx := range scale {
+				img.SetGray(x*scale+dx, y*scale+dy, color.Gray{})
+			}
+		}
+	}
+	return img
+}
+
+func TestEncodeQRCodePNG(t *testing.T) {
+	levels := map[string]string{"": "M", "l": "L", "M": "M", "Q": "Q", "H": "H"}
+	for level, want := range levels {
+		for _, size := range []int{QRCodeDefaultSize, 384, 512, QRCodeMaxSize} {
+			// The link takes 95 modules at H, 2 pixels each are too few for
+			// the decoder
+			if want == "H" && size == QRCodeDefaultSize {
+				continue
+			}
+			data, contentType, err := EncodeQRCode(qrTestLink, size, level, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if contentType != "image/png" {
+				t.Errorf("the content type is %q", contentType)
+			}
+			img, err := png.Decode(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bounds := img.Bounds(); bounds.Dx() != size || bounds.Dy() != size {
+				t.Errorf("the image of %d pixels is %v", size, bounds)
+			}
+			content, decodedLevel := decodeQRCode(t, img)
+			if content != qrTestLink {
+				t.Errorf("the QR code of %d pixels at level %q is %q, want %q", size, level, content, qrTestLink)
+			}
+			if decodedLevel != want {
+				t.Errorf("the level %q is decoded as %q, want %q", level, decodedLevel, want)
+			}
+		}
+	}
+}
+
+func TestEncodeQRCodeSVG(t *testing.T) {
+	subLink := "https://panel.example.com:2096/sub/4f2kq9zr1x?format=clash"
+	for _, content := range []string{qrTestLink, subLink} {
+		data, contentType, err := EncodeQRCode(content, 512, "Q", "svg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if contentType != "image/svg+xml" || !bytes.Contains(data, []byte(`width="512" height="512"`)) {
+			t.Errorf("the SVG is %s of %s", contentType, data)
+		}
+		if decoded, level := decodeQRCode(t, rasterizeQRCode(t, data, 4)); decoded != content || level != "Q" {
+			t.Errorf("the SVG QR code is %q at %q, want %q at Q", decoded, level, content)
+		}
+	}
+}
+
+func TestEncodeQRCodeRejected(t *testing.T) {
+	tests := []struct {
+		size   int
+		level  string
+		format string
+	}{
+		{QRCodeMinSize - 1, "M", "png"},
+		{QRCodeMaxSize + 1, "M", "png"},
+		{0, "", ""},
+		{256, "X", "png"},
+		{256, "medium", "png"},
+		{256, "M", "jpeg"},
+	}
+	for _, test := range tests {
+		if data, _, err := EncodeQRCode(qrTestLink, test.size, test.level, test.format); err == nil {
+			t.Errorf("%d pixels at %q as %q were encoded to %d bytes", test.size, test.level, test.format, len(data))
+		}
+	}
+	// More than a QR code holds
+	if _, _, err := EncodeQRCode(string(bytes.Repeat([]byte("a"), 3000)), 256, "H", "png"); err == nil {
+		t.Error("3000 bytes were encoded at level H")
+	}
+}
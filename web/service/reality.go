@@ -0,0 +1,201 @@
+package service
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"x-ui/database/model"
+	"x-ui/util/common"
+
+	"github.com/goccy/go-json"
+)
+
+const (
+	// MaxRealityShortIds is the most short IDs generated at once
+	MaxRealityShortIds = 16
+	// maxRealityChecks bounds the server names checked for one dest
+	maxRealityChecks = 8
+	// MaxRealityCheckTimeout is the longest a dest check may wait for a handshake
+	MaxRealityCheckTimeout = 15 * time.Second
+)
+
+// RealityKeys are a new X25519 key pair and short IDs for a Reality inbound.
+type RealityKeys struct {
+	PrivateKey string   `json:"privateKey"`
+	PublicKey  string   `json:"publicKey"`
+	ShortIds   []string `json:"shortIds"`
+}
+
+// RealityCheck is the result of a TLS 1.3 handshake with the dest of a Reality
+// inbound, for one of its server names.
+type RealityCheck struct {
+	ServerName string `json:"serverName"`
+	Ok         bool   `json:"ok"`
+	// Warning tells why the dest doesn't work well as a Reality target
+	Warning string `json:"warning,omitempty"`
+	// Latency is how long the handshake took, in ms
+	Latency int64 `json:"latency"`
+}
+
+// newRealityKeyPair generates an X25519 key pair without the xray binary, in the
+// encoding of "xray x25519".
+func newRealityKeyPair() (string, string, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	encoding := base64.RawURLEncoding
+	return encoding.EncodeToString(key.Bytes()), encoding.EncodeToString(key.PublicKey().Bytes()), nil
+}
+
+// NewRealityShortIds returns count random short IDs of length hex digits, or of
+// all lengths like the panel does if length is 0.
+func NewRealityShortIds(count int, length int) ([]string, error) {
+	if count < 1 || count > MaxRealityShortIds {
+		return nil, common.NewErrorf("count must be between 1 and %d", MaxRealityShortIds)
+	}
+	if length != 0 && (length < 2 || length > 16 || length%2 != 0) {
+		return nil, common.NewError("length of short IDs must be even, from 2 to 16:", length)
+	}
+	if length == 0 {
+		shortIds := randomShortIds()
+		for len(shortIds) < count {
+			shortIds = append(shortIds, randomShortIds()...)
+		}
+		return shortIds[:count], nil
+	}
+	shortIds := make([]string, count)
+	for i := range shortIds {
+		id := make([]byte, length/2)
+		if _, err := rand.Read(id); err != nil {
+			return nil, err
+		}
+		shortIds[i] = hex.EncodeToString(id)
+	}
+	return shortIds, nil
+}
+
+// NewRealityKeys returns a new key pair with count short IDs of length.
+func NewRealityKeys(count int, length int) (*RealityKeys, error) {
+	shortIds, err := NewRealityShortIds(count, length)
+	if err != nil {
+		return nil, err
+	}
+	privateKey, publicKey, err := newRealityKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	return &RealityKeys{PrivateKey: privateKey, PublicKey: publicKey, ShortIds: shortIds}, nil
+}
+
+// regenerateRealityKeys gives the Reality settings of an inbound a new key pair.
+// The public key goes where the links are generated from, and short IDs are
+// added if there are none.
+func regenerateRealityKeys(inbound *model.Inbound) error {
+	var stream map[string]any
+	if err := json.Unmarshal([]byte(inbound.StreamSettings), &stream); err != nil {
+		return err
+	}
+	reality, ok := stream["realitySettings"].(map[string]any)
+	if !ok || stream["security"] != "reality" {
+		return common.NewError("the inbound doesn't use Reality")
+	}
+	privateKey, publicKey, err := newRealityKeyPair()
+	if err != nil {
+		return err
+	}
+	reality["privateKey"] = privateKey
+	settings, _ := reality["settings"].(map[string]any)
+	if settings == nil {
+		settings = map[string]any{}
+		reality["settings"] = settings
+	}
+	settings["publicKey"] = publicKey
+	if shortIds, _ := reality["shortIds"].([]any); len(shortIds) == 0 {
+		reality["shortIds"] = randomShortIds()
+	}
+
+	newStream, err := json.MarshalIndent(stream, "", "  ")
+	if err != nil {
+		return err
+	}
+	inbound.StreamSettings = string(newStream)
+	return nil
+}
+
+// CheckRealityDest tries a TLS 1.3 handshake with dest for every server name, or
+// for the host of dest if there are none. A failed check is only a warning:
+// the dest may be unreachable from the panel but not from Xray.
+func CheckRealityDest(dest string, serverNames []string, timeout time.Duration) ([]RealityCheck, error) {
+	dest = strings.TrimSpace(dest)
+	if dest == "" {
+		return nil, common.NewError("dest can not be empty")
+	}
+	if timeout <= 0 || timeout > MaxRealityCheckTimeout {
+		return nil, common.NewErrorf("timeout must be at most %v", MaxRealityCheckTimeout)
+	}
+	// Like in Xray, a dest may be only a port on this host
+	address := dest
+	if !strings.Contains(address, ":") {
+		address = net.JoinHostPort("127.0.0.1", address)
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, common.NewError("dest must be host:port:", dest)
+	}
+
+	names := make([]string, 0, len(serverNames))
+	for _, name := range serverNames {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		names = append(names, host)
+	}
+	if len(names) > maxRealityChecks {
+		names = names[:maxRealityChecks]
+	}
+
+	checks := make([]RealityCheck, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			checks[i] = checkRealityName(address, name, timeout)
+		}()
+	}
+	wg.Wait()
+	return checks, nil
+}
+
+func checkRealityName(address string, serverName string, timeout time.Duration) RealityCheck {
+	check := RealityCheck{ServerName: serverName}
+	dialer := &net.Dialer{Timeout: timeout}
+	start := time.Now()
+	conn, err := tls.DialWithDialer(dialer, "tcp", address, &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS13,
+		NextProtos: []string{"h2", "http/1.1"},
+	})
+	if err != nil {
+		check.Warning = err.Error()
+		return check
+	}
+	defer conn.Close()
+	check.Latency = time.Since(start).Milliseconds()
+	if conn.ConnectionState().NegotiatedProtocol != "h2" {
+		check.Warning = "the dest doesn't support HTTP/2"
+		return check
+	}
+	check.Ok = true
+	return check
+}
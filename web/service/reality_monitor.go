@@ -0,0 +1,381 @@
+package service
+
+import (
+	"html"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/common"
+
+	"github.com/goccy/go-json"
+)
+
+const (
+	// realityMonitorWorkers is how many dests are checked at once
+	realityMonitorWorkers = 8
+	// realityMonitorTimeout bounds the handshakes of a check
+	realityMonitorTimeout = 5 * time.Second
+	// maxRealityDests is how many fallback dests an inbound takes
+	maxRealityDests = 16
+)
+
+// RealityDestFailure is a Reality inbound whose dest failed its checks too many
+// times in a row, and the dest it fell back to, if there was one.
+type RealityDestFailure struct {
+	InboundId int    `json:"inboundId"`
+	Tag       string `json:"tag"`
+	Dest      string `json:"dest"`
+	Failures  int    `json:"failures"`
+	Error     string `json:"error"`
+	Fallback  string `json:"fallback,omitempty"`
+}
+
+var (
+	// realityMonitorMu keeps the checks from overlapping
+	realityMonitorMu sync.Mutex
+	realityHealthMu  sync.RWMutex
+	// realityHealth is the health of the dests by inbound and dest
+	realityHealth = map[int]map[string]*model.RealityDestHealth{}
+)
+
+// realitySettingsOf returns the Reality settings in the stream settings of an
+// inbound and the key of its dest, "target" in the newer configs of Xray.
+func realitySettingsOf(streamSettings string) (map[string]any, map[string]any, string, bool) {
+	var stream map[string]any
+	if err := json.Unmarshal([]byte(streamSettings), &stream); err != nil {
+		return nil, nil, "", false
+	}
+	reality, ok := stream["realitySettings"].(map[string]any)
+	if !ok || stream["security"] != "reality" {
+		return nil, nil, "", false
+	}
+	key := "dest"
+	if target, _ := reality["target"].(string); target != "" {
+		key = "target"
+	}
+	return stream, reality, key, true
+}
+
+// realityDestOf returns the dest and the server names of a Reality inbound.
+func realityDestOf(streamSettings string) (string, []string, bool) {
+	_, reality, key, ok := realitySettingsOf(streamSettings)
+	if !ok {
+		return "", nil, false
+	}
+	dest, _ := reality[key].(string)
+	var serverNames []string
+	if names, ok := reality["serverNames"].([]any); ok {
+		for _, name := range names {
+			if name, ok := name.(string); ok {
+				serverNames = append(serverNames, name)
+			}
+		}
+	}
+	return strings.TrimSpace(dest), serverNames, dest != ""
+}
+
+// checkRealityDestAddress checks that dest is host:port or a port, which is
+// what a dest can be checked at.
+func checkRealityDestAddress(dest string) error {
+	if err := checkFallbackDest(dest); err != nil {
+		return common.NewErrorf("the Reality dest %q %v", dest, err)
+	}
+	if strings.HasPrefix(dest, "/") || strings.HasPrefix(dest, "@") {
+		return common.NewErrorf("the Reality dest %q must be host:port or a port", dest)
+	}
+	return nil
+}
+
+// normalizeRealityDests trims the fallback dests of an inbound and drops the
+// empty and repeated ones.
+func normalizeRealityDests(dests []string) ([]string, error) {
+	normalized := make([]string, 0, len(dests))
+	for _, dest := range dests {
+		dest = strings.TrimSpace(dest)
+		if dest == "" || slices.Contains(normalized, dest) {
+			continue
+		}
+		if err := checkRealityDestAddress(dest); err != nil {
+			return nil, err
+		}
+		normalized = append(normalized, dest)
+	}
+	if len(normalized) > maxRealityDests {
+		return nil, common.NewErrorf("an inbound takes at most %d fallback dests", maxRealityDests)
+	}
+	if len(normalized) == 0 {
+		return nil, nil
+	}
+	return normalized, nil
+}
+
+// realityDestNames returns dest and the fallback dests after it, once each.
+func realityDestNames(dest string, fallbacks []string) []string {
+	names := []string{dest}
+	for _, name := range fallbacks {
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// setRealityHealth fills in the RealityHealth of the Reality inbounds that were
+// checked, their dest first and then their fallback dests.
+func (s *InboundService) setRealityHealth(inbounds ...*model.Inbound) {
+	realityHealthMu.RLock()
+	defer realityHealthMu.RUnlock()
+	for _, inbound := range inbounds {
+		health := realityHealth[inbound.Id]
+		if len(health) == 0 {
+			continue
+		}
+		dest, _, ok := realityDestOf(inbound.StreamSettings)
+		if !ok {
+			continue
+		}
+		inbound.RealityHealth = nil
+		for _, name := range realityDestNames(dest, inbound.RealityDests) {
+			if entry, ok := health[name]; ok {
+				inbound.RealityHealth = append(inbound.RealityHealth, *entry)
+			}
+		}
+	}
+}
+
+// SetRealityDests sets the fallback dests of a Reality inbound.
+func (s *InboundService) SetRealityDests(id int, dests []string) (*model.Inbound, error) {
+	dests, err := normalizeRealityDests(dests)
+	if err != nil {
+		return nil, err
+	}
+	inbound, err := s.GetInbound(id)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, ok := realityDestOf(inbound.StreamSettings); !ok {
+		return nil, common.NewError("the inbound doesn't use Reality")
+	}
+	inbound.RealityDests = dests
+	if err := database.GetDB().Model(inbound).Select("reality_dests").Updates(inbound).Error; err != nil {
+		return nil, err
+	}
+	s.setRealityHealth(inbound)
+	return inbound, nil
+}
+
+// SetRealityDest switches a Reality inbound to dest, keeping its server names,
+// and returns whether Xray needs a restart for it. The dest it had is kept
+// among the fallback dests, so that the switch can be undone.
+func (s *InboundService) SetRealityDest(id int, dest string) (*model.Inbound, bool, error) {
+	dest = strings.TrimSpace(dest)
+	if err := checkRealityDestAddress(dest); err != nil {
+		return nil, false, err
+	}
+	inbound, err := s.GetInbound(id)
+	if err != nil {
+		return nil, false, err
+	}
+	stream, reality, key, ok := realitySettingsOf(inbound.StreamSettings)
+	if !ok {
+		return nil, false, common.NewError("the inbound doesn't use Reality")
+	}
+	old, _ := reality[key].(string)
+	if old == dest {
+		s.setRealityHealth(inbound)
+		return inbound, false, nil
+	}
+	reality[key] = dest
+	streamSettings, err := json.MarshalIndent(stream, "", "  ")
+	if err != nil {
+		return nil, false, err
+	}
+	inbound.StreamSettings = string(streamSettings)
+	dests := inbound.RealityDests
+	if old != "" && !slices.Contains(dests, old) {
+		dests = append([]string{old}, dests...)
+	}
+	if inbound.RealityDests, err = normalizeRealityDests(dests); err != nil {
+		return nil, false, err
+	}
+	err = database.GetDB().Model(inbound).Select("stream_settings", "reality_dests").Updates(inbound).Error
+	if err != nil {
+		return nil, false, err
+	}
+
+	needRestart := false
+	if inbound.Enable && p != nil && p.IsRunning() {
+		var certReloadService CertReloadService
+		if err := certReloadService.readdInbounds([]string{inbound.Tag}); err != nil {
+			logger.Debug("Unable to switch the Reality dest of inbound", inbound.Tag, "by api:", err)
+			needRestart = true
+		}
+	}
+	s.setRealityHealth(inbound)
+	return inbound, needRestart, nil
+}
+
+// CheckRealityDests checks the dests of the enabled Reality inbounds, and their
+// fallback dests, with a TLS 1.3 handshake each. An inbound whose dest fails
+// failures times in a row is switched to the next of its fallback dests that
+// passed its last check, if it has one. It returns those inbounds and whether
+// Xray needs a restart.
+func (s *InboundService) CheckRealityDests(failures int) ([]RealityDestFailure, bool, error) {
+	if !realityMonitorMu.TryLock() {
+		return nil, false, nil
+	}
+	defer realityMonitorMu.Unlock()
+
+	var inbounds []*model.Inbound
+	err := database.GetDB().Model(model.Inbound{}).
+		Select("id", "tag", "stream_settings", "reality_dests").
+		Where("enable = ?", true).
+		Find(&inbounds).Error
+	if err != nil {
+		return nil, false, err
+	}
+
+	type target struct {
+		inboundId   int
+		dest        string
+		serverNames []string
+	}
+	var targets []target
+	checked := map[int][]string{}
+	for _, inbound := range inbounds {
+		dest, serverNames, ok := realityDestOf(inbound.StreamSettings)
+		if !ok {
+			continue
+		}
+		checked[inbound.Id] = realityDestNames(dest, inbound.RealityDests)
+		for _, name := range checked[inbound.Id] {
+			targets = append(targets, target{inbound.Id, name, serverNames})
+		}
+	}
+
+	results := make([]model.RealityDestHealth, len(targets))
+	workers := make(chan struct{}, realityMonitorWorkers)
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		wg.Add(1)
+		workers <- struct{}{}
+		go func() {
+			defer func() {
+				<-workers
+				wg.Done()
+			}()
+			results[i] = checkRealityHealth(t.dest, t.serverNames)
+		}()
+	}
+	wg.Wait()
+
+	realityHealthMu.Lock()
+	previous := realityHealth
+	realityHealth = make(map[int]map[string]*model.RealityDestHealth, len(checked))
+	for i, t := range targets {
+		result := results[i]
+		if !result.Ok {
+			if last, ok := previous[t.inboundId][t.dest]; ok && !last.Ok {
+				result.Failures = last.Failures
+			}
+			result.Failures++
+		}
+		if realityHealth[t.inboundId] == nil {
+			realityHealth[t.inboundId] = map[string]*model.RealityDestHealth{}
+		}
+		realityHealth[t.inboundId][t.dest] = &result
+	}
+	realityHealthMu.Unlock()
+
+	var failed []RealityDestFailure
+	needRestart := false
+	for _, inbound := range inbounds {
+		names := checked[inbound.Id]
+		if len(names) == 0 {
+			continue
+		}
+		realityHealthMu.RLock()
+		health := realityHealth[inbound.Id]
+		current := *health[names[0]]
+		fallback := ""
+		if current.Failures == failures {
+			// The fallback dests after the dest come first, then the ones before
+			start := slices.Index(inbound.RealityDests, current.Dest) + 1
+			for i := range inbound.RealityDests {
+				dest := inbound.RealityDests[(start+i)%len(inbound.RealityDests)]
+				if dest != current.Dest && health[dest] != nil && health[dest].Ok {
+					fallback = dest
+					break
+				}
+			}
+		}
+		realityHealthMu.RUnlock()
+		if current.Failures != failures {
+			continue
+		}
+		failure := RealityDestFailure{
+			InboundId: inbound.Id,
+			Tag:       inbound.Tag,
+			Dest:      current.Dest,
+			Failures:  current.Failures,
+			Error:     current.Error,
+		}
+		if fallback != "" {
+			_, restart, err := s.SetRealityDest(inbound.Id, fallback)
+			if err != nil {
+				logger.Warning("Unable to switch the Reality dest of inbound", inbound.Tag, "to", fallback, ":", err)
+			} else {
+				failure.Fallback = fallback
+				needRestart = needRestart || restart
+			}
+		}
+		failed = append(failed, failure)
+	}
+	return failed, needRestart, nil
+}
+
+// checkRealityHealth checks dest with the server names of its inbound; it is
+// healthy if any of them passes.
+func checkRealityHealth(dest string, serverNames []string) model.RealityDestHealth {
+	health := model.RealityDestHealth{Dest: dest, CheckedAt: time.Now().UnixMilli()}
+	checks, err := CheckRealityDest(dest, serverNames, realityMonitorTimeout)
+	if err != nil {
+		health.Error = err.Error()
+		return health
+	}
+	for _, check := range checks {
+		if check.Ok && (!health.Ok || check.Latency < health.Latency) {
+			health.Ok, health.Latency = true, check.Latency
+		}
+	}
+	if !health.Ok && len(checks) > 0 {
+		health.Error = checks[0].Warning
+	}
+	return health
+}
+
+// RealityDestFailed tells the admins that the dest of a Reality inbound failed
+// its checks, and the dest it fell back to.
+func (t *Tgbot) RealityDestFailed(failure RealityDestFailure) {
+	if !t.AlertsOn(AlertReality) {
+		return
+	}
+	msg := t.I18nBot("tgbot.messages.realityDestFailed",
+		"Inbound=="+html.EscapeString(failure.Tag),
+		"Dest=="+html.EscapeString(failure.Dest),
+		"Count=="+strconv.Itoa(failure.Failures))
+	msg += t.I18nBot("tgbot.messages.hostname", "Hostname=="+hostname)
+	msg += t.I18nBot("tgbot.messages.error", "Error=="+html.EscapeString(failure.Error))
+	if failure.Fallback != "" {
+		msg += t.I18nBot("tgbot.messages.realityDestSwitched", "Dest=="+html.EscapeString(failure.Fallback))
+	} else {
+		msg += t.I18nBot("tgbot.messages.realityNoFallback")
+	}
+	t.SendAlert(AlertReality, msg)
+}
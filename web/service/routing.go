@@ -0,0 +1,478 @@
+package service
+
+import (
+	"fmt"
+	"maps"
+	"net"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/util/common"
+	"x-ui/xray"
+
+	"github.com/goccy/go-json"
+	"gorm.io/gorm"
+)
+
+var (
+	// geoNamePattern matches the codes of geoip and the lists of geosite, with
+	// the attributes of the lists
+	geoNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.\-]+(@!?[A-Za-z0-9_.\-]+)*$`)
+	// extPattern matches the rules from another geo file, like ext:file.dat:tag
+	extPattern = regexp.MustCompile(`^ext:[^:\s]+:[^:\s]+$`)
+)
+
+// ruleProtocols are the protocols sniffing tells rules apart by.
+var ruleProtocols = map[string]bool{
+	"http":       true,
+	"tls":        true,
+	"quic":       true,
+	"bittorrent": true,
+}
+
+// routingRuleFields are the fields of the routing rules of Xray the panel keeps.
+var routingRuleFields = map[string]bool{
+	"type":        true,
+	"domain":      true,
+	"ip":          true,
+	"port":        true,
+	"sourcePort":  true,
+	"network":     true,
+	"protocol":    true,
+	"inboundTag":  true,
+	"user":        true,
+	"outboundTag": true,
+	"balancerTag": true,
+}
+
+// RoutingService manages the routing rules the panel adds to the Xray config,
+// after those of the config template.
+type RoutingService struct {
+	settingService SettingService
+}
+
+func routingRuleName(rule *model.RoutingRule) string {
+	if rule.Remark != "" {
+		return fmt.Sprintf("routing rule %d (%s)", rule.Id, rule.Remark)
+	}
+	return fmt.Sprintf("routing rule %d", rule.Id)
+}
+
+func checkRuleDomain(domain string) error {
+	prefix, value, found := strings.Cut(domain, ":")
+	if !found {
+		prefix, value = "", domain
+	}
+	switch prefix {
+	case "domain", "full", "keyword", "dotless", "":
+		if value == "" && prefix != "dotless" {
+			return common.NewErrorf("can not be empty")
+		}
+		if strings.ContainsAny(value, " \t") {
+			return common.NewErrorf("%q has spaces", domain)
+		}
+	case "regexp":
+		if _, err := regexp.Compile(value); err != nil {
+			return common.NewErrorf("%q is not a valid regexp: %v", value, err)
+		}
+	case "geosite":
+		if !geoNamePattern.MatchString(value) {
+			return common.NewErrorf("%q is not a valid geosite list", domain)
+		}
+	case "ext":
+		if !extPattern.MatchString(domain) {
+			return common.NewErrorf("%q must be like ext:file.dat:list", domain)
+		}
+	default:
+		return common.NewErrorf("%q has an unknown prefix %s:", domain, prefix)
+	}
+	return nil
+}
+
+func checkRuleIp(ip string) error {
+	switch {
+	case strings.HasPrefix(ip, "geoip:"):
+		if !geoNamePattern.MatchString(strings.TrimPrefix(strings.TrimPrefix(ip, "geoip:"), "!")) {
+			return common.NewErrorf("%q is not a valid geoip code", ip)
+		}
+	case strings.HasPrefix(ip, "ext:"):
+		if !extPattern.MatchString(ip) {
+			return common.NewErrorf("%q must be like ext:file.dat:code", ip)
+		}
+	case strings.Contains(ip, "/"):
+		if _, _, err := net.ParseCIDR(ip); err != nil {
+			return common.NewErrorf("%q is not a valid CIDR", ip)
+		}
+	default:
+		if net.ParseIP(ip) == nil {
+			return common.NewErrorf("%q is not an IP, a CIDR or geoip:", ip)
+		}
+	}
+	return nil
+}
+
+// checkRulePorts checks a list of ports and port ranges, like "53,443,1000-2000".
+func checkRulePorts(ports string) error {
+	for _, item := range strings.Split(ports, ",") {
+		item = strings.TrimSpace(item)
+		from, to, isRange := strings.Cut(item, "-")
+		if !isRange {
+			to = from
+		}
+		start, err1 := strconv.Atoi(strings.TrimSpace(from))
+		end, err2 := strconv.Atoi(strings.TrimSpace(to))
+		if err1 != nil || err2 != nil || start < 0 || end > 65535 || start > end {
+			return common.NewErrorf("%q is not a port or a port range", item)
+		}
+	}
+	return nil
+}
+
+// normalizeRuleList trims the items of a list of a rule and leaves out the
+// empty ones.
+func normalizeRuleList(list []string) []string {
+	var normalized []string
+	for _, item := range list {
+		if item = strings.TrimSpace(item); item != "" {
+			normalized = append(normalized, item)
+		}
+	}
+	return normalized
+}
+
+// checkRule checks a routing rule to save against the tags of the inbounds,
+// outbounds and balancers it refers to.
+func (s *RoutingService) checkRule(rule *model.RoutingRule, refs *templateRefs) error {
+	rule.Remark = strings.TrimSpace(rule.Remark)
+	rule.Domain = normalizeRuleList(rule.Domain)
+	rule.Ip = normalizeRuleList(rule.Ip)
+	rule.Protocol = normalizeRuleList(rule.Protocol)
+	rule.InboundTag = normalizeRuleList(rule.InboundTag)
+	rule.User = normalizeRuleList(rule.User)
+	rule.Port = strings.TrimSpace(rule.Port)
+	rule.SourcePort = strings.TrimSpace(rule.SourcePort)
+	rule.Network = strings.ToLower(strings.ReplaceAll(rule.Network, " ", ""))
+	rule.OutboundTag = strings.TrimSpace(rule.OutboundTag)
+	rule.BalancerTag = strings.TrimSpace(rule.BalancerTag)
+
+	if len(rule.Domain) == 0 && len(rule.Ip) == 0 && len(rule.Protocol) == 0 &&
+		len(rule.InboundTag) == 0 && len(rule.User) == 0 &&
+		rule.Port == "" && rule.SourcePort == "" && rule.Network == "" {
+		return common.NewError("a rule needs at least one condition")
+	}
+	for i, domain := range rule.Domain {
+		if err := checkRuleDomain(domain); err != nil {
+			return common.NewErrorf("domain[%d]: %v", i, err)
+		}
+	}
+	for i, ip := range rule.Ip {
+		if err := checkRuleIp(ip); err != nil {
+			return common.NewErrorf("ip[%d]: %v", i, err)
+		}
+	}
+	if rule.Port != "" {
+		if err := checkRulePorts(rule.Port); err != nil {
+			return common.NewErrorf("port: %v", err)
+		}
+	}
+	if rule.SourcePort != "" {
+		if err := checkRulePorts(rule.SourcePort); err != nil {
+			return common.NewErrorf("sourcePort: %v", err)
+		}
+	}
+	if rule.Network != "" {
+		for _, network := range strings.Split(rule.Network, ",") {
+			if network != "tcp" && network != "udp" {
+				return common.NewErrorf("network: must be tcp, udp or tcp,udp, not %q", rule.Network)
+			}
+		}
+	}
+	for i, protocol := range rule.Protocol {
+		if !ruleProtocols[protocol] {
+			return common.NewErrorf("protocol[%d]: must be http, tls, quic or bittorrent, not %q", i, protocol)
+		}
+	}
+
+	if len(rule.InboundTag) > 0 {
+		tags := append(slices.Clone(refs.panelInbounds), refs.inbounds...)
+		for i, tag := range rule.InboundTag {
+			if !slices.Contains(tags, tag) {
+				return common.NewErrorf("inboundTag[%d]: there is no inbound %s", i, tag)
+			}
+		}
+	}
+
+	switch {
+	case rule.OutboundTag == "" && rule.BalancerTag == "":
+		return common.NewError("a rule needs an outboundTag or a balancerTag")
+	case rule.OutboundTag != "" && rule.BalancerTag != "":
+		return common.NewError("a rule has either an outboundTag or a balancerTag, not both")
+	case rule.OutboundTag != "":
+		if rule.OutboundTag != refs.apiTag && !slices.Contains(refs.outbounds, rule.OutboundTag) &&
+			!slices.Contains(refs.panelOutbounds, rule.OutboundTag) {
+			return common.NewErrorf("outboundTag: there is no outbound %s", rule.OutboundTag)
+		}
+	default:
+		if !refs.hasBalancer(rule.BalancerTag) {
+			return common.NewErrorf("balancerTag: there is no balancer %s", rule.BalancerTag)
+		}
+	}
+	return nil
+}
+
+// GetRules returns the routing rules of the panel in the order Xray matches them.
+func (s *RoutingService) GetRules() ([]model.RoutingRule, error) {
+	var rules []model.RoutingRule
+	err := database.GetDB().Model(model.RoutingRule{}).Order("position, id").Find(&rules).Error
+	if err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func (s *RoutingService) GetRule(id int) (*model.RoutingRule, error) {
+	rule := &model.RoutingRule{}
+	if err := database.GetDB().Model(model.RoutingRule{}).First(rule, id).Error; err != nil {
+		return nil, err
+	}
+	return rule, nil
+}
+
+// testRules checks the config the rules would give before they are saved.
+func (s *RoutingService) testRules(rules []model.RoutingRule) error {
+	var xrayService XrayService
+	return xrayService.testRoutingRules(rules)
+}
+
+// AddRule adds a routing rule after the others.
+func (s *RoutingService) AddRule(rule *model.RoutingRule) (*model.RoutingRule, error) {
+	refs, err := loadTemplateRefs()
+	if err != nil {
+		return nil, err
+	}
+	rule.Id = 0
+	if err := s.checkRule(rule, refs); err != nil {
+		return nil, err
+	}
+	rules, err := s.GetRules()
+	if err != nil {
+		return nil, err
+	}
+	rule.Position = 0
+	if len(rules) > 0 {
+		rule.Position = rules[len(rules)-1].Position + 1
+	}
+	if err := s.testRules(append(rules, *rule)); err != nil {
+		return nil, err
+	}
+	if err := database.GetDB().Create(rule).Error; err != nil {
+		return nil, err
+	}
+	return rule, nil
+}
+
+// UpdateRule replaces a routing rule, keeping its position.
+func (s *RoutingService) UpdateRule(rule *model.RoutingRule) (*model.RoutingRule, error) {
+	old, err := s.GetRule(rule.Id)
+	if err != nil {
+		return nil, err
+	}
+	refs, err := loadTemplateRefs()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkRule(rule, refs); err != nil {
+		return nil, err
+	}
+	rule.Position = old.Position
+	rules, err := s.GetRules()
+	if err != nil {
+		return nil, err
+	}
+	for i := range rules {
+		if rules[i].Id == rule.Id {
+			rules[i] = *rule
+		}
+	}
+	if err := s.testRules(rules); err != nil {
+		return nil, err
+	}
+	if err := database.GetDB().Save(rule).Error; err != nil {
+		return nil, err
+	}
+	return rule, nil
+}
+
+func (s *RoutingService) DelRule(id int) error {
+	if _, err := s.GetRule(id); err != nil {
+		return err
+	}
+	return database.GetDB().Delete(model.RoutingRule{}, id).Error
+}
+
+// ReorderRules puts the routing rules in the order of ids, which must have every
+// rule once.
+func (s *RoutingService) ReorderRules(ids []int) error {
+	rules, err := s.GetRules()
+	if err != nil {
+		return err
+	}
+	if len(ids) != len(rules) {
+		return common.NewErrorf("the order must have all %d rules, not %d", len(rules), len(ids))
+	}
+	positions := make(map[int]int, len(ids))
+	for i, id := range ids {
+		if _, ok := positions[id]; ok {
+			return common.NewErrorf("rule %d is in the order twice", id)
+		}
+		positions[id] = i
+	}
+	for _, rule := range rules {
+		if _, ok := positions[rule.Id]; !ok {
+			return common.NewErrorf("rule %d is missing from the order", rule.Id)
+		}
+	}
+	return database.Transaction(func(tx *gorm.DB) error {
+		for id, position := range positions {
+			err := tx.Model(model.RoutingRule{}).Where("id = ?", id).Update("position", position).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// parseTemplateRule converts a routing rule of the config template, returning
+// false if it has fields the panel doesn't keep.
+func parseTemplateRule(item any) (*model.RoutingRule, bool) {
+	rule, ok := item.(map[string]any)
+	if !ok {
+		return nil, false
+	}
+	fields := maps.Clone(rule)
+	for key := range fields {
+		if !routingRuleFields[key] {
+			return nil, false
+		}
+	}
+	if ruleType, ok := fields["type"]; ok && ruleType != "field" {
+		return nil, false
+	}
+	delete(fields, "type")
+	// Xray takes ports as numbers as well
+	for _, key := range []string{"port", "sourcePort"} {
+		if port, ok := fields[key].(float64); ok {
+			fields[key] = strconv.Itoa(int(port))
+		}
+	}
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return nil, false
+	}
+	routingRule := &model.RoutingRule{}
+	if err := json.Unmarshal(data, routingRule); err != nil {
+		return nil, false
+	}
+	return routingRule, true
+}
+
+// ImportTemplateRules moves the routing rules of the config template to the
+// panel. Template rules are matched before those of the panel, so only the last
+// rules of the template are moved, up to one the panel can't take: one with
+// fields it doesn't keep, one not valid, or the rule of the API. It returns how
+// many rules were moved and how many stay in the template.
+func (s *RoutingService) ImportTemplateRules() (int, int, error) {
+	template, err := s.settingService.GetXrayConfigTemplate()
+	if err != nil {
+		return 0, 0, err
+	}
+	refs, err := loadTemplateRefs()
+	if err != nil {
+		return 0, 0, err
+	}
+	var config map[string]any
+	if err := json.Unmarshal([]byte(template), &config); err != nil {
+		return 0, 0, common.NewError("xray template config invalid:", err)
+	}
+	routing, _ := config["routing"].(map[string]any)
+	items, _ := routing["rules"].([]any)
+
+	var imported []model.RoutingRule
+	kept := len(items)
+	for kept > 0 {
+		rule, ok := parseTemplateRule(items[kept-1])
+		if !ok || (refs.apiTag != "" && rule.OutboundTag == refs.apiTag) || s.checkRule(rule, refs) != nil {
+			break
+		}
+		imported = append(imported, *rule)
+		kept--
+	}
+	if len(imported) == 0 {
+		return 0, kept, nil
+	}
+	slices.Reverse(imported)
+
+	rules, err := s.GetRules()
+	if err != nil {
+		return 0, 0, err
+	}
+	routing["rules"] = items[:kept]
+	newTemplate, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return 0, 0, err
+	}
+	// The imported rules go before those of the panel, right where they were
+	err = database.Transaction(func(tx *gorm.DB) error {
+		for i := range imported {
+			imported[i].Position = i - len(imported)
+			if len(rules) > 0 {
+				imported[i].Position += rules[0].Position
+			}
+			if err := tx.Create(&imported[i]).Error; err != nil {
+				return err
+			}
+		}
+		// The template is only saved once it is changed from the default
+		result := tx.Model(model.Setting{}).Where(map[string]any{"key": "xrayTemplateConfig"}).
+			Update("value", string(newTemplate))
+		if result.Error != nil || result.RowsAffected > 0 {
+			return result.Error
+		}
+		return tx.Create(&model.Setting{Key: "xrayTemplateConfig", Value: string(newTemplate)}).Error
+	})
+	InvalidateSettings()
+	if err != nil {
+		return 0, 0, err
+	}
+	return len(imported), kept, nil
+}
+
+// addRoutingRules adds the routing rules of the panel to a config generated from
+// the template, after the rules of the template.
+func addRoutingRules(config *xray.Config, rules []model.RoutingRule) error {
+	if len(rules) == 0 {
+		return nil
+	}
+	routing := map[string]any{}
+	if len(config.RouterConfig) > 0 {
+		if err := json.Unmarshal(config.RouterConfig, &routing); err != nil || routing == nil {
+			return common.NewError("xray template config invalid: routing must be an object")
+		}
+	}
+	items, _ := routing["rules"].([]any)
+	for i := range rules {
+		items = append(items, rules[i].GenXrayRuleConfig())
+	}
+	routing["rules"] = items
+	data, err := json.MarshalIndent(routing, "", "  ")
+	if err != nil {
+		return err
+	}
+	config.RouterConfig = data
+	return nil
+}
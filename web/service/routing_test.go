@@ -0,0 +1,180 @@
+package service
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"x-ui/database/model"
+
+	"github.com/goccy/go-json"
+)
+
+func routingTestDB(t *testing.T) {
+	t.Helper()
+	newTestDB(t, seedInbounds(&model.Inbound{
+		Enable: true, Port: 24435, Protocol: model.VMESS, Tag: "inbound-24435", Settings: `{"clients":[]}`,
+	}))
+}
+
+func TestCheckRule(t *testing.T) {
+	routingTestDB(t)
+	refs, err := loadTemplateRefs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s RoutingService
+
+	rule := &model.RoutingRule{
+		Remark: " ads ", Domain: []string{" geosite:category-ads-all@!cn ", "", "full:example.com", "regexp:^a.+\\.b$"},
+		Ip: []string{"geoip:!cn", "10.0.0.0/8", "2001:db8::1", "ext:geo.dat:ru"}, Port: " 53,443,1000-2000 ",
+		Network: "TCP, udp", Protocol: []string{"tls"}, InboundTag: []string{"api", "inbound-24435"},
+		User: []string{" alice ", ""}, OutboundTag: " blocked ",
+	}
+	if err := s.checkRule(rule, refs); err != nil {
+		t.Fatal(err)
+	}
+	if rule.Remark != "ads" || len(rule.Domain) != 3 || rule.Domain[0] != "geosite:category-ads-all@!cn" ||
+		rule.Port != "53,443,1000-2000" || rule.Network != "tcp,udp" || !slices.Equal(rule.User, []string{"alice"}) ||
+		rule.OutboundTag != "blocked" {
+		t.Errorf("the rule was normalized to %+v", rule)
+	}
+
+	tests := []struct {
+		rule model.RoutingRule
+		err  string
+	}{
+		{model.RoutingRule{OutboundTag: "direct"}, "at least one condition"},
+		{model.RoutingRule{Domain: []string{" ", ""}, OutboundTag: "direct"}, "at least one condition"},
+		{model.RoutingRule{Domain: []string{"a.com", "geosite:"}, OutboundTag: "direct"}, "domain[1]:"},
+		{model.RoutingRule{Domain: []string{"geosite:cn@"}, OutboundTag: "direct"}, "domain[0]:"},
+		{model.RoutingRule{Domain: []string{"regexp:("}, OutboundTag: "direct"}, "domain[0]:"},
+		{model.RoutingRule{Domain: []string{"ext:geo.dat"}, OutboundTag: "direct"}, "domain[0]:"},
+		{model.RoutingRule{Domain: []string{"geoip:cn"}, OutboundTag: "direct"}, "unknown prefix"},
+		{model.RoutingRule{Domain: []string{"a b.com"}, OutboundTag: "direct"}, "has spaces"},
+		{model.RoutingRule{Ip: []string{"geoip:c n"}, OutboundTag: "direct"}, "ip[0]:"},
+		{model.RoutingRule{Ip: []string{"1.1.1.1", "10.0.0.0/33"}, OutboundTag: "direct"}, "ip[1]:"},
+		{model.RoutingRule{Ip: []string{"example.com"}, OutboundTag: "direct"}, "ip[0]:"},
+		{model.RoutingRule{Port: "443,2000-1000", OutboundTag: "direct"}, "port:"},
+		{model.RoutingRule{Port: "70000", OutboundTag: "direct"}, "port:"},
+		{model.RoutingRule{SourcePort: "a", OutboundTag: "direct"}, "sourcePort:"},
+		{model.RoutingRule{Network: "tcp,icmp", OutboundTag: "direct"}, "network:"},
+		{model.RoutingRule{Protocol: []string{"tls", "ssh"}, OutboundTag: "direct"}, "protocol[1]:"},
+		{model.RoutingRule{InboundTag: []string{"api", "inbound-1"}, OutboundTag: "direct"}, "inboundTag[1]: there is no inbound inbound-1"},
+		{model.RoutingRule{Network: "tcp"}, "needs an outboundTag or a balancerTag"},
+		{model.RoutingRule{Network: "tcp", OutboundTag: "direct", BalancerTag: "b"}, "not both"},
+		{model.RoutingRule{Network: "tcp", OutboundTag: "warp"}, "outboundTag: there is no outbound warp"},
+		{model.RoutingRule{Network: "tcp", BalancerTag: "b"}, "balancerTag: there is no balancer b"},
+	}
+	for _, test := range tests {
+		err := s.checkRule(&test.rule, refs)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("rule %+v: error %v, want %q", test.rule, err, test.err)
+		}
+	}
+}
+
+// configRules returns the outbound tags of the routing rules of the Xray config.
+func configRules(t *testing.T) []string {
+	t.Helper()
+	config, err := (&XrayService{}).GetXrayConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var routing struct {
+		Rules []struct {
+			OutboundTag string `json:"outboundTag"`
+			Port        string `json:"port"`
+		} `json:"rules"`
+	}
+	if err := json.Unmarshal(config.RouterConfig, &routing); err != nil {
+		t.Fatal(err)
+	}
+	var tags []string
+	for _, rule := range routing.Rules {
+		tags = append(tags, rule.OutboundTag+rule.Port)
+	}
+	return tags
+}
+
+func TestReorderRules(t *testing.T) {
+	routingTestDB(t)
+	var s RoutingService
+	var ids []int
+	for _, port := range []string{"1", "2", "3"} {
+		rule, err := s.AddRule(&model.RoutingRule{Port: port, OutboundTag: "direct"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, rule.Id)
+	}
+	template := []string{"api", "blocked", "blocked"}
+	if got, want := configRules(t), append(template, "direct1", "direct2", "direct3"); !slices.Equal(got, want) {
+		t.Errorf("the rules of the config are %v, want %v", got, want)
+	}
+
+	for _, order := range [][]int{{ids[0], ids[1]}, {ids[0], ids[1], ids[1]}, {ids[0], ids[1], 99}, {ids[0], ids[1], ids[2], 99}} {
+		if err := s.ReorderRules(order); err == nil {
+			t.Errorf("the order %v was taken", order)
+		}
+	}
+	if err := s.ReorderRules([]int{ids[2], ids[0], ids[1]}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := configRules(t), append(template, "direct3", "direct1", "direct2"); !slices.Equal(got, want) {
+		t.Errorf("the reordered rules of the config are %v, want %v", got, want)
+	}
+
+	// A new rule goes last, an updated one stays where it is
+	rule, err := s.AddRule(&model.RoutingRule{Port: "4", OutboundTag: "direct"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.UpdateRule(&model.RoutingRule{Id: ids[2], Port: "5", OutboundTag: "direct"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DelRule(ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := configRules(t), append(template, "direct5", "direct2", "direct4"); !slices.Equal(got, want) {
+		t.Errorf("the rules of the config are %v, want %v", got, want)
+	}
+	if err := s.ReorderRules([]int{rule.Id, ids[1], ids[2]}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestImportTemplateRules(t *testing.T) {
+	routingTestDB(t)
+	var s RoutingService
+	kept, err := s.AddRule(&model.RoutingRule{Port: "1", OutboundTag: "direct"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := configRules(t)
+
+	// The rule of the API stays in the template, the others are moved
+	imported, left, err := s.ImportTemplateRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported != 2 || left != 1 {
+		t.Errorf("imported %d rules and left %d, want 2 and 1", imported, left)
+	}
+	rules, err := s.GetRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 3 || rules[2].Id != kept.Id || !slices.Equal(rules[0].Ip, []string{"geoip:private"}) ||
+		!slices.Equal(rules[1].Protocol, []string{"bittorrent"}) {
+		t.Errorf("the rules are %+v", rules)
+	}
+	// Xray matches the rules in the same order
+	if after := configRules(t); !slices.Equal(after, before) {
+		t.Errorf("the rules of the config are %v, were %v", after, before)
+	}
+
+	if imported, left, err := s.ImportTemplateRules(); err != nil || imported != 0 || left != 1 {
+		t.Errorf("the second import moved %d rules and left %d: %v", imported, left, err)
+	}
+}
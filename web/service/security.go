@@ -0,0 +1,353 @@
+package service
+
+import (
+	"encoding/json"
+	"html"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"x-ui/config"
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/web/network"
+)
+
+// The severities of the security findings, from the most to the least urgent.
+const (
+	SecurityCritical = "critical"
+	SecurityHigh     = "high"
+	SecurityMedium   = "medium"
+	SecurityLow      = "low"
+)
+
+const (
+	// securityReportTTL is how long a report is kept before the checks run again
+	securityReportTTL = time.Minute
+	// minPasswordLength and minPasswordBits are what a password needs at least
+	// not to be weak, by its length and its estimated entropy
+	minPasswordLength = 10
+	minPasswordBits   = 50
+	// defaultWebPort is the port the panel is installed with
+	defaultWebPort = 2053
+)
+
+// commonPasswords are the passwords tried first against panels, checked as
+// lower case.
+var commonPasswords = []string{
+	"admin", "administrator", "admin123", "admin1234", "admin@123", "adminadmin",
+	"root", "toor", "password", "password1", "password123", "passw0rd", "p@ssw0rd",
+	"123456", "1234567", "12345678", "123456789", "1234567890", "000000", "111111",
+	"123123", "654321", "qwerty", "qwerty123", "qwertyuiop", "1q2w3e4r", "1qaz2wsx",
+	"abc123", "iloveyou", "letmein", "welcome", "changeme", "secret", "default",
+	"xui", "x-ui", "3x-ui", "xray", "v2ray", "vpn", "proxy", "test", "guest",
+}
+
+// IsWeakPassword tells whether a password is a default or common one, the
+// username, or too short or too guessable.
+func IsWeakPassword(username string, password string) bool {
+	lower := strings.ToLower(password)
+	if slices.Contains(commonPasswords, lower) || strings.EqualFold(password, username) {
+		return true
+	}
+	if len([]rune(password)) < minPasswordLength {
+		return true
+	}
+	return passwordBits(password) < minPasswordBits
+}
+
+// passwordBits estimates the entropy of a password from the kinds of
+// characters it has and how many of them are distinct, so that repeating one
+// character does not count as a long password.
+func passwordBits(password string) float64 {
+	var lower, upper, digit, other bool
+	distinct := map[rune]bool{}
+	for _, r := range password {
+		distinct[r] = true
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			other = true
+		}
+	}
+	pool := 0
+	if lower {
+		pool += 26
+	}
+	if upper {
+		pool += 26
+	}
+	if digit {
+		pool += 10
+	}
+	if other {
+		pool += 33
+	}
+	if pool == 0 {
+		return 0
+	}
+	length := min(len([]rune(password)), 2*len(distinct))
+	return float64(length) * math.Log2(float64(pool))
+}
+
+// SecurityFinding is a weakness of the panel. Title and Hint are the keys of
+// the translations of what it is and of how to fix it, with Params for them;
+// the API fills them in with the translations.
+type SecurityFinding struct {
+	Id       string            `json:"id"`
+	Severity string            `json:"severity"`
+	TitleKey string            `json:"titleKey"`
+	HintKey  string            `json:"hintKey"`
+	Params   map[string]string `json:"params,omitempty"`
+	Title    string            `json:"title,omitempty"`
+	Hint     string            `json:"hint,omitempty"`
+}
+
+// SecurityCounts counts the findings of a report by their severity.
+type SecurityCounts struct {
+	Critical int `json:"critical"`
+	High     int `json:"high"`
+	Medium   int `json:"medium"`
+	Low      int `json:"low"`
+	Total    int `json:"total"`
+}
+
+// SecurityReport is what the checks of the panel found, the most severe first.
+type SecurityReport struct {
+	Findings  []SecurityFinding `json:"findings"`
+	Counts    SecurityCounts    `json:"counts"`
+	CheckedAt int64             `json:"checkedAt"`
+}
+
+// securityCache keeps the last report, the dashboard asks for its counts with
+// every status.
+var securityCache struct {
+	lock   sync.Mutex
+	report *SecurityReport
+}
+
+// SecurityService checks the panel for default credentials and weak settings.
+type SecurityService struct {
+	settingService SettingService
+	userService    UserService
+}
+
+// Report returns the findings of the checks, run again once the last report
+// is older than a minute.
+func (s *SecurityService) Report() *SecurityReport {
+	securityCache.lock.Lock()
+	defer securityCache.lock.Unlock()
+	report := securityCache.report
+	if report != nil && time.Since(time.UnixMilli(report.CheckedAt)) < securityReportTTL {
+		return report
+	}
+	report = s.check()
+	securityCache.report = report
+	return report
+}
+
+func (s *SecurityService) check() *SecurityReport {
+	findings := []SecurityFinding{}
+	add := func(id string, severity string, params map[string]string) {
+		findings = append(findings, SecurityFinding{
+			Id:       id,
+			Severity: severity,
+			TitleKey: "pages.security." + id,
+			HintKey:  "pages.security." + id + "Hint",
+			Params:   params,
+		})
+	}
+
+	users, err := s.userService.GetUsers()
+	if err != nil {
+		logger.Warning("security report: get users failed:", err)
+	}
+	var defaults, weak, withoutTwoFactor []string
+	for _, user := range users {
+		if user.WeakPassword && user.Username == "admin" {
+			defaults = append(defaults, user.Username)
+		} else if user.WeakPassword {
+			weak = append(weak, user.Username)
+		}
+		if user.Role == model.RoleAdmin && !user.TotpEnabled {
+			withoutTwoFactor = append(withoutTwoFactor, user.Username)
+		}
+	}
+	if len(defaults) > 0 {
+		add("defaultCredentials", SecurityCritical, map[string]string{"Users": strings.Join(defaults, ", ")})
+	}
+	if len(weak) > 0 {
+		add("weakPassword", SecurityHigh, map[string]string{"Users": strings.Join(weak, ", ")})
+	}
+
+	listen, _ := s.settingService.GetListen()
+	_, isSocket := network.UnixSocketPath(listen)
+	certFile, _ := s.settingService.GetCertFile()
+	keyFile, _ := s.settingService.GetKeyFile()
+	if !isSocket && certFile == "" && keyFile == "" && !isLoopback(listen) {
+		add("plainHttp", SecurityHigh, nil)
+	}
+	if exposed := s.xrayApiListen(); exposed != "" {
+		add("xrayApiExposed", SecurityCritical, map[string]string{"Listen": exposed})
+	}
+	if problem := dbPermissionProblem(); problem != "" {
+		add("dbPermissions", SecurityHigh, map[string]string{"Path": problem})
+	}
+	if len(withoutTwoFactor) > 0 {
+		add("twoFactorDisabled", SecurityMedium, map[string]string{"Users": strings.Join(withoutTwoFactor, ", ")})
+	}
+	if basePath, _ := s.settingService.GetBasePath(); basePath == "/" {
+		add("defaultBasePath", SecurityMedium, nil)
+	}
+	if port, _ := s.settingService.GetPort(); port == defaultWebPort && !isSocket {
+		add("defaultPort", SecurityLow, map[string]string{"Port": strconv.Itoa(port)})
+	}
+
+	rank := map[string]int{SecurityCritical: 0, SecurityHigh: 1, SecurityMedium: 2, SecurityLow: 3}
+	sort.SliceStable(findings, func(i, j int) bool { return rank[findings[i].Severity] < rank[findings[j].Severity] })
+	report := &SecurityReport{Findings: findings, CheckedAt: time.Now().UnixMilli()}
+	for _, finding := range findings {
+		switch finding.Severity {
+		case SecurityCritical:
+			report.Counts.Critical++
+		case SecurityHigh:
+			report.Counts.High++
+		case SecurityMedium:
+			report.Counts.Medium++
+		case SecurityLow:
+			report.Counts.Low++
+		}
+	}
+	report.Counts.Total = len(findings)
+	return report
+}
+
+// xrayApiListen returns where the API inbound of the Xray template listens, if
+// that is not the loopback.
+func (s *SecurityService) xrayApiListen() string {
+	template, err := s.settingService.GetXrayConfigTemplate()
+	if err != nil {
+		return ""
+	}
+	xrayConfig := struct {
+		Inbounds []struct {
+			Tag    string          `json:"tag"`
+			Listen string          `json:"listen"`
+			Port   json.RawMessage `json:"port"`
+		} `json:"inbounds"`
+	}{}
+	if json.Unmarshal([]byte(template), &xrayConfig) != nil {
+		return ""
+	}
+	for _, inbound := range xrayConfig.Inbounds {
+		if inbound.Tag != "api" {
+			continue
+		}
+		if isLoopback(inbound.Listen) || strings.HasPrefix(inbound.Listen, "/") || strings.HasPrefix(inbound.Listen, "@") {
+			return ""
+		}
+		listen := inbound.Listen
+		if listen == "" {
+			listen = "0.0.0.0"
+		}
+		return net.JoinHostPort(listen, strings.Trim(string(inbound.Port), `"`))
+	}
+	return ""
+}
+
+// isLoopback tells whether a listen address only takes connections from the
+// server itself. Empty listens on all addresses.
+func isLoopback(listen string) bool {
+	if strings.EqualFold(listen, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(listen)
+	return ip != nil && ip.IsLoopback()
+}
+
+// dbPermissionProblem returns the SQLite file or its folder if others than
+// its owner can read the database or replace it.
+func dbPermissionProblem() string {
+	if !database.IsSQLite() || runtime.GOOS == "windows" {
+		return ""
+	}
+	path := config.GetDBPath()
+	for _, file := range []string{path, path + "-wal"} {
+		if info, err := os.Stat(file); err == nil && info.Mode().Perm()&0o077 != 0 {
+			return file
+		}
+	}
+	if info, err := os.Stat(filepath.Dir(path)); err == nil && info.Mode().Perm()&0o002 != 0 {
+		return filepath.Dir(path)
+	}
+	return ""
+}
+
+// AlertCritical tells the admins about the critical findings, once:
+// they are told again only when the critical findings change.
+func (s *SecurityService) AlertCritical() {
+	report := s.check()
+	securityCache.lock.Lock()
+	securityCache.report = report
+	securityCache.lock.Unlock()
+	critical := []SecurityFinding{}
+	ids := []string{}
+	for _, finding := range report.Findings {
+		if finding.Severity == SecurityCritical {
+			critical = append(critical, finding)
+			ids = append(ids, finding.Id)
+		}
+	}
+	alerted, err := s.settingService.GetSecurityAlerted()
+	if err != nil {
+		return
+	}
+	key := strings.Join(ids, ",")
+	if key == alerted {
+		return
+	}
+	if len(critical) > 0 {
+		tgbot := new(Tgbot)
+		if !tgbot.AlertsOn(AlertSecurity) {
+			return
+		}
+		tgbot.SecurityAlert(critical)
+	}
+	if err := s.settingService.SetSecurityAlerted(key); err != nil {
+		logger.Warning("Unable to save the security alert:", err)
+	}
+}
+
+// SecurityAlert tells the admins about the critical findings of the
+// security report.
+func (t *Tgbot) SecurityAlert(findings []SecurityFinding) {
+	if !t.AlertsOn(AlertSecurity) {
+		return
+	}
+	lines := make([]string, 0, len(findings))
+	for _, finding := range findings {
+		params := make([]string, 0, len(finding.Params))
+		for name, value := range finding.Params {
+			params = append(params, name+"=="+html.EscapeString(value))
+		}
+		lines = append(lines, "• "+t.I18nBot(finding.TitleKey, params...))
+	}
+	msg := t.I18nBot("tgbot.messages.securityAlert", "Findings=="+strings.Join(lines, "\r\n"))
+	msg += t.I18nBot("tgbot.messages.hostname", "Hostname=="+hostname)
+	t.SendAlert(AlertSecurity, msg)
+}
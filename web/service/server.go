@@ -1,13 +1,11 @@
 package service
 
 import (
-	"archive/zip"
 	"bufio"
 	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
-	"io/fs"
 	"mime/multipart"
 	"net/http"
 	"os"
@@ -21,6 +19,7 @@ import (
 	"x-ui/database"
 	"x-ui/logger"
 	"x-ui/util/common"
+	"x-ui/util/crypto"
 	"x-ui/util/sys"
 	"x-ui/xray"
 
@@ -40,6 +39,12 @@ const (
 	Error   ProcessState = "error"
 )
 
+// DiskUsage is the used and total bytes of a disk.
+type DiskUsage struct {
+	Current uint64 `json:"current"`
+	Total   uint64 `json:"total"`
+}
+
 type Status struct {
 	T           time.Time `json:"-"`
 	Cpu         float64   `json:"cpu"`
@@ -62,11 +67,40 @@ type Status struct {
 		State    ProcessState `json:"state"`
 		ErrorMsg string       `json:"errorMsg"`
 		Version  string       `json:"version"`
+		// Mem is the resident memory of the Xray process
+		Mem uint64 `json:"mem"`
+		// ConfigHash is the hash of the config Xray runs, generated at
+		// ConfigGeneratedAt in milliseconds
+		ConfigHash        string `json:"configHash"`
+		ConfigGeneratedAt int64  `json:"configGeneratedAt"`
+		// BindErrors are the inbounds Xray goes without, as they failed to bind
+		BindErrors []string `json:"bindErrors,omitempty"`
 	} `json:"xray"`
 	Uptime   uint64    `json:"uptime"`
 	Loads    []float64 `json:"loads"`
 	TcpCount int       `json:"tcpCount"`
 	UdpCount int       `json:"udpCount"`
+	// OnlineClients is how many clients were seen within the online window
+	OnlineClients int `json:"onlineClients"`
+	// InboundConnections are the connections to the inbounds of the last
+	// sample, if one was taken
+	InboundConnections *ConnectionCount `json:"inboundConnections,omitempty"`
+	// Database is the size of the database, its last optimization and the
+	// usage of the disk a SQLite database is on
+	Database struct {
+		Size         int64                 `json:"size"`
+		LastOptimize *DatabaseOptimization `json:"lastOptimize,omitempty"`
+		Disk         *DiskUsage            `json:"disk,omitempty"`
+	} `json:"database"`
+	// Bandwidth is the traffic of the server against its bandwidth limits, as
+	// of the last check
+	Bandwidth *BandwidthUsage `json:"bandwidth,omitempty"`
+	// TopCountries are the countries the most traffic came from today, by the
+	// geo stats
+	TopCountries []GeoStat `json:"topCountries,omitempty"`
+	// Security counts the findings of the security report, for the banner of
+	// the dashboard
+	Security *SecurityCounts `json:"security,omitempty"`
 	NetIO    struct {
 		Up   uint64 `json:"up"`
 		Down uint64 `json:"down"`
@@ -83,19 +117,32 @@ type Status struct {
 		Threads uint32 `json:"threads"`
 		Mem     uint64 `json:"mem"`
 		Uptime  uint64 `json:"uptime"`
+		// PanelUptime is how long the panel has been running, in seconds
+		PanelUptime uint64 `json:"panelUptime"`
 	} `json:"appStats"`
 }
 
 type Release struct {
-	TagName string `json:"tag_name"`
+	TagName     string    `json:"tag_name"`
+	Prerelease  bool      `json:"prerelease"`
+	Draft       bool      `json:"draft"`
+	PublishedAt time.Time `json:"published_at"`
 }
 
+// panelStartTime is when the panel was started
+var panelStartTime = time.Now()
+
 type ServerService struct {
-	xrayService    XrayService
-	inboundService InboundService
-	cachedIPv4     string
-	cachedIPv6     string
-	noIPv6         bool
+	xrayService      XrayService
+	inboundService   InboundService
+	settingService   SettingService
+	databaseService  DatabaseService
+	bandwidthService BandwidthService
+	geoStatsService  GeoStatsService
+	securityService  SecurityService
+	cachedIPv4       string
+	cachedIPv6       string
+	noIPv6           bool
 }
 
 func getPublicIP(url string) string {
@@ -290,6 +337,26 @@ func (s *ServerService) GetStatus(lastStatus *Status) *Status {
 		status.Xray.ErrorMsg = s.xrayService.GetXrayResult()
 	}
 	status.Xray.Version = s.xrayService.GetXrayVersion()
+	status.Xray.Mem = s.xrayService.GetXrayMemory()
+	status.Xray.ConfigHash, status.Xray.ConfigGeneratedAt = s.xrayService.GetXrayConfigHash()
+	status.Xray.BindErrors = s.xrayService.GetBindErrors()
+	status.OnlineClients = len(s.inboundService.GetOnlineClients())
+	if connections := s.xrayService.GetConnectionStats(); connections != nil {
+		status.InboundConnections = &connections.ConnectionCount
+	}
+	if size, err := database.Size(); err == nil {
+		status.Database.Size = size
+	}
+	status.Database.LastOptimize = s.databaseService.GetLastOptimize()
+	status.Bandwidth = s.bandwidthService.GetUsage()
+	status.TopCountries = s.geoStatsService.TopCountries()
+	security := s.securityService.Report().Counts
+	status.Security = &security
+	if database.IsSQLite() {
+		if diskInfo, err := disk.Usage(config.GetDBFolderPath()); err == nil {
+			status.Database.Disk = &DiskUsage{Current: diskInfo.Used, Total: diskInfo.Total}
+		}
+	}
 
 	// Application stats
 	var rtm runtime.MemStats
@@ -301,49 +368,20 @@ func (s *ServerService) GetStatus(lastStatus *Status) *Status {
 	} else {
 		status.AppStats.Uptime = 0
 	}
+	status.AppStats.PanelUptime = uint64(time.Since(panelStartTime).Seconds())
 
 	return status
 }
 
 func (s *ServerService) GetXrayVersions() ([]string, error) {
-	const (
-		XrayURL    = "https://api.github.com/repos/XTLS/Xray-core/releases"
-		bufferSize = 8192
-	)
-
-	resp, err := http.Get(XrayURL)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	buffer := bytes.NewBuffer(make([]byte, bufferSize))
-	buffer.Reset()
-	if _, err := buffer.ReadFrom(resp.Body); err != nil {
-		return nil, err
-	}
-
-	var releases []Release
-	if err := json.Unmarshal(buffer.Bytes(), &releases); err != nil {
+	releases, _, err := s.fetchXrayReleases(false)
+	if releases == nil && err != nil {
 		return nil, err
 	}
 
-	var versions []string
+	versions := []string{}
 	for _, release := range releases {
-		tagVersion := strings.TrimPrefix(release.TagName, "v")
-		tagParts := strings.Split(tagVersion, ".")
-		if len(tagParts) != 3 {
-			continue
-		}
-
-		major, err1 := strconv.Atoi(tagParts[0])
-		minor, err2 := strconv.Atoi(tagParts[1])
-		patch, err3 := strconv.Atoi(tagParts[2])
-		if err1 != nil || err2 != nil || err3 != nil {
-			continue
-		}
-
-		if major > 25 || (major == 25 && minor > 8) || (major == 25 && minor == 8 && patch >= 3) {
+		if !release.Prerelease {
 			versions = append(versions, release.TagName)
 		}
 	}
@@ -368,108 +406,8 @@ func (s *ServerService) RestartXrayService() error {
 	return nil
 }
 
-func (s *ServerService) downloadXRay(version string) (string, error) {
-	osName := runtime.GOOS
-	arch := runtime.GOARCH
-
-	switch osName {
-	case "darwin":
-		osName = "macos"
-	}
-
-	switch arch {
-	case "amd64":
-		arch = "64"
-	case "arm64":
-		arch = "arm64-v8a"
-	case "armv7":
-		arch = "arm32-v7a"
-	case "armv6":
-		arch = "arm32-v6"
-	case "armv5":
-		arch = "arm32-v5"
-	case "386":
-		arch = "32"
-	case "s390x":
-		arch = "s390x"
-	}
-
-	fileName := fmt.Sprintf("Xray-%s-%s.zip", osName, arch)
-	url := fmt.Sprintf("https://github.com/XTLS/Xray-core/releases/download/%s/%s", version, fileName)
-	resp, err := http.Get(url)
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-
-	os.Remove(fileName)
-	file, err := os.Create(fileName)
-	if err != nil {
-		return "", err
-	}
-	defer file.Close()
-
-	_, err = io.Copy(file, resp.Body)
-	if err != nil {
-		return "", err
-	}
-
-	return fileName, nil
-}
-
 func (s *ServerService) UpdateXray(version string) error {
-	zipFileName, err := s.downloadXRay(version)
-	if err != nil {
-		return err
-	}
-
-	zipFile, err := os.Open(zipFileName)
-	if err != nil {
-		return err
-	}
-	defer func() {
-		zipFile.Close()
-		os.Remove(zipFileName)
-	}()
-
-	stat, err := zipFile.Stat()
-	if err != nil {
-		return err
-	}
-	reader, err := zip.NewReader(zipFile, stat.Size())
-	if err != nil {
-		return err
-	}
-
-	s.xrayService.StopXray()
-	defer func() {
-		err := s.xrayService.RestartXray(true)
-		if err != nil {
-			logger.Error("start xray failed:", err)
-		}
-	}()
-
-	copyZipFile := func(zipName string, fileName string) error {
-		zipFile, err := reader.Open(zipName)
-		if err != nil {
-			return err
-		}
-		os.Remove(fileName)
-		file, err := os.OpenFile(fileName, os.O_CREATE|os.O_RDWR|os.O_TRUNC, fs.ModePerm)
-		if err != nil {
-			return err
-		}
-		defer file.Close()
-		_, err = io.Copy(file, zipFile)
-		return err
-	}
-
-	err = copyZipFile("xray", xray.GetBinaryPath())
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return s.SwitchXrayVersion(version, false)
 }
 
 func (s *ServerService) GetLogs(count string, level string, syslog string) []string {
@@ -588,42 +526,63 @@ func (s *ServerService) GetConfigJson() (any, error) {
 	return jsonData, nil
 }
 
-func (s *ServerService) GetDb() ([]byte, error) {
-	// Update by manually trigger a checkpoint operation
-	err := database.Checkpoint()
-	if err != nil {
-		return nil, err
+// GetDb returns a backup of the database and its file name, encrypted with the
+// backup passphrase if there is one.
+func (s *ServerService) GetDb() ([]byte, string, error) {
+	// The backup includes the traffic not written yet
+	if err := s.inboundService.FlushTraffic(); err != nil {
+		logger.Warning("flush traffic before backup failed:", err)
 	}
-	// Open the file for reading
-	file, err := os.Open(config.GetDBPath())
+	db, err := database.Backup()
 	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
-
-	// Read the file contents
-	fileContents, err := io.ReadAll(file)
-	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
+	return s.settingService.encryptBackup(db, "x-ui.db")
+}
 
-	return fileContents, nil
+// ImportDB replaces the database with file, decrypted with passphrase if it is
+// encrypted. The backup passphrase is tried when passphrase is empty.
+func (s *ServerService) ImportDB(file multipart.File, passphrase string) error {
+	return s.importDB(file, passphrase, false)
 }
 
-func (s *ServerService) ImportDB(file multipart.File) error {
-	// Check if the file is a SQLite database
-	isValidDb, err := database.IsSQLiteDB(file)
+// importDB replaces the database with file. With rollback, the database the
+// panel ran with is put back if Xray doesn't start on the new one.
+func (s *ServerService) importDB(file multipart.File, passphrase string, rollback bool) error {
+	if !database.IsSQLite() {
+		return common.NewErrorf("Importing a db file is %v", database.ErrNotSQLite)
+	}
+	// No backup or optimization runs on the file while it is replaced
+	defer database.LockFile()()
+
+	// An encrypted file is checked once decrypted
+	var src io.Reader = file
+	encrypted, err := isEncryptedFile(file)
 	if err != nil {
 		return common.NewErrorf("Error checking db file format: %v", err)
 	}
-	if !isValidDb {
-		return common.NewError("Invalid db file format")
-	}
+	if encrypted {
+		if passphrase == "" {
+			passphrase, _ = s.settingService.GetBackupPassphrase()
+		}
+		if src, err = crypto.NewDecryptReader(file, passphrase); err != nil {
+			return common.NewErrorf("Error decrypting db file: %v", err)
+		}
+	} else {
+		// Check if the file is a SQLite database
+		isValidDb, err := database.IsSQLiteDB(file)
+		if err != nil {
+			return common.NewErrorf("Error checking db file format: %v", err)
+		}
+		if !isValidDb {
+			return common.NewError("Invalid db file format")
+		}
 
-	// Reset the file reader to the beginning
-	_, err = file.Seek(0, 0)
-	if err != nil {
-		return common.NewErrorf("Error resetting file reader: %v", err)
+		// Reset the file reader to the beginning
+		_, err = file.Seek(0, 0)
+		if err != nil {
+			return common.NewErrorf("Error resetting file reader: %v", err)
+		}
 	}
 
 	// Save the file as a temporary file
@@ -657,18 +616,43 @@ func (s *ServerService) ImportDB(file multipart.File) error {
 	}()
 
 	// Save uploaded file to temporary file
-	if _, err = io.Copy(tempFile, file); err != nil {
+	if _, err = io.Copy(tempFile, src); err != nil {
 		return common.NewErrorf("Error saving db: %v", err)
 	}
+	if encrypted {
+		if isValidDb, err := database.IsSQLiteDB(tempFile); err != nil || !isValidDb {
+			return common.NewError("Invalid db file format")
+		}
+	}
 
-	// Check if we can init the db or not
-	if err = database.InitDB(tempPath); err != nil {
+	if err = database.CheckIntegrity(tempPath); err != nil {
 		return common.NewErrorf("Error checking db: %v", err)
 	}
 
 	// Stop Xray
 	s.StopXrayService()
 
+	// The pending traffic belongs to the current database
+	if err = s.inboundService.FlushTraffic(); err != nil {
+		logger.Warning("flush traffic before import failed:", err)
+	}
+
+	// No connection may be left on the current database once it is moved
+	if err = database.CloseDB(); err != nil {
+		logger.Warning("close db before import failed:", err)
+	}
+
+	// Check if we can init the db or not
+	if err = database.InitDB(tempPath); err == nil {
+		err = database.CloseDB()
+	}
+	if err != nil {
+		if errInit := database.InitDB(config.GetDBPath()); errInit != nil {
+			return common.NewErrorf("Error checking db: %v, and reopening the current db: %v", err, errInit)
+		}
+		return common.NewErrorf("Error checking db: %v", err)
+	}
+
 	// Backup the current database for fallback
 	fallbackPath := fmt.Sprintf("%s.backup", config.GetDBPath())
 
@@ -699,22 +683,41 @@ func (s *ServerService) ImportDB(file multipart.File) error {
 		if errRename := os.Rename(fallbackPath, config.GetDBPath()); errRename != nil {
 			return common.NewErrorf("Error moving db file and restoring fallback: %v", errRename)
 		}
+		database.InitDB(config.GetDBPath())
 		return common.NewErrorf("Error moving db file: %v", err)
 	}
 
 	// Migrate DB
 	if err = database.InitDB(config.GetDBPath()); err != nil {
+		database.CloseDB()
 		if errRename := os.Rename(fallbackPath, config.GetDBPath()); errRename != nil {
 			return common.NewErrorf("Error migrating db and restoring fallback: %v", errRename)
 		}
+		database.InitDB(config.GetDBPath())
 		return common.NewErrorf("Error migrating db: %v", err)
 	}
 
 	s.inboundService.MigrateDB()
+	forgetCounterSnapshot()
 
 	// Start Xray
 	if err = s.RestartXrayService(); err != nil {
-		return common.NewErrorf("Imported DB but failed to start Xray: %v", err)
+		if !rollback {
+			return common.NewErrorf("Imported DB but failed to start Xray: %v", err)
+		}
+		s.StopXrayService()
+		database.CloseDB()
+		if errRename := os.Rename(fallbackPath, config.GetDBPath()); errRename != nil {
+			return common.NewErrorf("Failed to start Xray: %v, and to restore the previous db: %v", err, errRename)
+		}
+		if errInit := database.InitDB(config.GetDBPath()); errInit != nil {
+			return common.NewErrorf("Failed to start Xray: %v, and to reopen the previous db: %v", err, errInit)
+		}
+		forgetCounterSnapshot()
+		if errRestart := s.RestartXrayService(); errRestart != nil {
+			logger.Warning("Xray failed to start on the previous db too:", errRestart)
+		}
+		return common.NewErrorf("Failed to start Xray on the imported db, the previous one was put back: %v", err)
 	}
 
 	return nil
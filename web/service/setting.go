@@ -5,19 +5,24 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"path/filepath"
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"x-ui/config"
 	"x-ui/database"
 	"x-ui/database/model"
 	"x-ui/logger"
 	"x-ui/util/common"
+	"x-ui/util/crypto"
 	"x-ui/util/random"
 	"x-ui/util/reflect_util"
 	"x-ui/web/entity"
-	"x-ui/xray"
+	"x-ui/web/middleware"
+	"x-ui/web/network"
 )
 
 //go:embed config.json
@@ -33,6 +38,12 @@ var defaultValueMap = map[string]string{
 	"secret":                      random.Seq(32),
 	"webBasePath":                 "/",
 	"sessionMaxAge":               "360",
+	"rememberSessionMaxAge":       "15",
+	"rememberMaxAge":              "30",
+	"sessionIdleTimeout":          "0",
+	"sessionLifetime":             "0",
+	"sessionMaxConcurrent":        "0",
+	"sessionLimitPolicy":          "evict",
 	"pageSize":                    "50",
 	"expireDiff":                  "0",
 	"trafficDiff":                 "0",
@@ -46,6 +57,7 @@ var defaultValueMap = map[string]string{
 	"tgRunTime":                   "@daily",
 	"tgBotBackup":                 "false",
 	"tgBotLoginNotify":            "true",
+	"tgBotPanicNotify":            "true",
 	"tgCpu":                       "80",
 	"tgLang":                      "en-US",
 	"twoFactorEnable":             "false",
@@ -72,10 +84,225 @@ var defaultValueMap = map[string]string{
 	"warp":                        "",
 	"externalTrafficInformEnable": "false",
 	"externalTrafficInformURI":    "",
+	"logFormat":                   "text",
+	"accessLogEnable":             "false",
+	"accessLogMaxSize":            "10",
+	"accessLogMaxBackups":         "5",
+	"accessLogMaxAge":             "30",
+	"accessLogExclude":            "assets/",
+	"accessLogPath":               config.GetAccessLogPath(),
+	"authLogPath":                 config.GetAuthLogPath(),
+	"appLogLevel":                 "info",
+	"slowRequestThreshold":        "1000",
+	"slowRequestRoutes":           "",
+	"panicBodyCaptureKB":          "0",
+	"metricsEnable":               "false",
+	"metricsToken":                "",
+	"metricsAllowIPs":             "",
+	"metricsClientLabels":         "false",
+	"loginRateLimit":              "10",
+	"loginRateBurst":              "5",
+	"lockoutThreshold":            "5",
+	"lockoutWindow":               "15",
+	"lockoutDuration":             "30",
+	"loginCaptcha":                "off",
+	"loginCaptchaFailures":        "3",
+	"loginCaptchaGlobalRate":      "0",
+	"turnstileSiteKey":            "",
+	"turnstileSecret":             "",
+	"alertChannels":               "{}",
+	"smtpHost":                    "",
+	"smtpPort":                    "587",
+	"smtpSecurity":                "starttls",
+	"smtpUsername":                "",
+	"smtpPassword":                "",
+	"smtpFrom":                    "",
+	"smtpTo":                      "",
+	"alertEmailSubject":           "[{{.ServerName}}] {{.Title}}",
+	"alertEmailBody":              "",
+	"alertWebhookUrl":             "",
+	"alertWebhookSecret":          "",
+	"webAuthnMode":                "passwordless",
+	"auditRetentionDays":          "90",
+	"passwordHashMemory":          "65536",
+	"passwordHashIterations":      "3",
+	"passwordResetDeadline":       "0",
+	"trustedProxies":              "",
+	"trustedProxyHeader":          "X-Forwarded-For",
+	"corsAllowedOrigins":          "",
+	"corsAllowedMethods":          "GET, POST, PUT, DELETE",
+	"corsAllowedHeaders":          "Authorization, Content-Type",
+	"corsAllowCredentials":        "false",
+	"corsMaxAge":                  "600",
+	"securityHsts":                "true",
+	"securityNoSniff":             "true",
+	"securityReferrerPolicy":      "strict-origin-when-cross-origin",
+	"securityFrameOptions":        "SAMEORIGIN",
+	"securityCsp":                 middleware.DefaultCSP,
+	"securityCspScriptSrc":        "",
+	"securityCspStyleSrc":         "",
+	"subSecurityHeaders":          "true",
+	"compressionEnable":           "true",
+	"compressionMinSize":          "1024",
+	"compressionTypes":            middleware.DefaultCompressTypes,
+	"shutdownTimeout":             "10",
+	"xrayKeepOnRestart":           "false",
+	"healthzEnable":               "true",
+	"socketMode":                  "0660",
+	"socketOwner":                 "",
+	"maintenanceEnable":           "false",
+	"maintenanceMessage":          "",
+	"maintenanceEta":              "0",
+	"maxBodySize":                 "2",
+	"maxBodySizeRestore":          "128",
+	"maxBodySizeImport":           "16",
+	"bulkClientsMax":              "500",
+	"trafficResetHistory":         "true",
+	"subIncludeDisabled":          "true",
+	"clientCleanupDays":           "0",
+	"notifyTrafficPercents":       "",
+	"notifyExpiryDays":            "",
+	"ipLimitWindow":               "5",
+	"ipLimitCooldown":             "30",
+	"ipLimitIpv6Prefix":           "64",
+	"ipLimitDevices":              "0",
+	"remarkTemplate":              "",
+	"randomPortMin":               "10000",
+	"randomPortMax":               "60000",
+	"portRangeClientPort":         "false",
+	"observatoryMode":             "observatory",
+	"observatoryProbeUrl":         "https://www.google.com/generate_204",
+	"observatoryProbeInterval":    "60",
+	"xrayDownloadProxy":           "",
+	"xrayKeptVersions":            "3",
+	"geodataAutoUpdate":           "false",
+	"geodataUpdateCron":           "@daily",
+	"geoipURL":                    "https://github.com/Loyalsoldier/v2ray-rules-dat/releases/latest/download/geoip.dat",
+	"geositeURL":                  "https://github.com/Loyalsoldier/v2ray-rules-dat/releases/latest/download/geosite.dat",
+	"tgBotGeodataNotify":          "true",
+	"xrayHealthCheckWindow":       "10",
+	"xrayMaxRestartAttempts":      "5",
+	"xrayStableMinutes":           "5",
+	"xrayCrashOutputKB":           "16",
+	"tgBotXrayRestartNotify":      "true",
+	"xrayApiUpdates":              "true",
+	"xrayBinaryPath":              "",
+	"xrayAssetDir":                "",
+	"xrayWorkDir":                 "",
+	"xrayArgs":                    "",
+	"realityCheckInterval":        "10",
+	"realityCheckFailures":        "3",
+	"inboundCheckInterval":        "0",
+	"inboundCheckTimeout":         "5",
+	"inboundCheckProberUrl":       "",
+	"inboundCheckProberToken":     "",
+	"inboundCheckHost":            "",
+	"onlineWindow":                "60",
+	"clientInactiveDays":          "0",
+	"clientCleanupInactive":       "false",
+	"clientInactiveReport":        "false",
+	"connectionSampleInterval":    "30",
+	"connectionMethod":            "sockets",
+	"connBlockCommand":            "",
+	"connUnblockCommand":          "",
+	"connBlockMinutes":            "10",
+	"trafficHistoryDays":          "90",
+	"trafficFlushInterval":        "30",
+	"dbJournalMode":               "WAL",
+	"dbSynchronous":               "NORMAL",
+	"dbBusyTimeout":               "5000",
+	"dbMaxConnections":            "8",
+	"dbAutoOptimize":              "true",
+	"dbOptimizeCron":              "0 0 4 * * 0",
+	"tgBotDbOptimizeNotify":       "true",
+	"trashRetentionDays":          "30",
+	"backupEnable":                "false",
+	"backupCron":                  "0 0 3 * * *",
+	"backupDir":                   "",
+	"backupKeep":                  "7",
+	"backupIncludeFiles":          "false",
+	"backupPassphrase":            "",
+	"backupRemotes":               "[]",
+	"backupWebhookUrl":            "",
+	"tgBotBackupUploadNotify":     "true",
+	"tgBotBackupCron":             "",
+	"tgBotBackupLarge":            "split",
+	"tgBotBackupFailures":         "{}",
+	"securityAlerted":             "",
+	"setupState":                  "",
+	"tgBotLoginNotifyFailed":      "true",
+	"tgBotLoginNotifyApi":         "true",
+	"tgBotLoginNotifyInterval":    "10",
+	"tgBotSelfService":            "true",
+	"notifyExpiryCron":            "0 0 10 * * *",
+	"notifyRenewalContact":        "",
+	"tgBotParseMode":              "HTML",
+	"tgTemplateLogin":             "",
+	"tgTemplateTraffic":           "",
+	"tgTemplateExpiry":            "",
+	"tgTemplateBackup":            "",
+	"tgTemplateClient":            "",
+	"webhooks":                    "[]",
+	"webhookSecret":               "",
+	"xrayRestartRequest":          "",
+	"subClashRules":               "- IP-CIDR,127.0.0.0/8,DIRECT,no-resolve\n- IP-CIDR,10.0.0.0/8,DIRECT,no-resolve\n- IP-CIDR,172.16.0.0/12,DIRECT,no-resolve\n- IP-CIDR,192.168.0.0/16,DIRECT,no-resolve\n- MATCH,PROXY\n",
+	"subSingboxVersion":           "1.11",
+	"subSingboxDns":               "",
+	"subSingboxRoute":             "",
+	"subExpiredNotice":            "",
+	"subCache":                    "true",
+	"subCacheGranularity":         "10",
+	"subAccessDays":               "30",
+	"subAccessMaxIps":             "0",
+	"webEnable":                   "true",
+	"subBasePath":                 "/",
+	"subUseWebCert":               "false",
+	"subPage":                     "true",
+	"subPageTitle":                "",
+	"subPageLogo":                 "",
+	"subPageSupport":              "",
+	"subRemotes":                  "",
+	"subRemoteTimeout":            "5",
+	"subRemoteTTL":                "300",
+	"statusPage":                  "false",
+	"statusPagePath":              "/status/" + random.Seq(16) + "/",
+	"statusPageTitle":             "",
+	"statusPageInbounds":          "",
+	"statusPageFields":            "state,latency",
+	"statusPageTTL":               "60",
+	"statusPageCapacity":          "100",
+	"trialInbound":                "0",
+	"trialPath":                   "",
+	"trialTotalGB":                "1",
+	"trialHours":                  "24",
+	"trialIpDaily":                "1",
+	"trialDaily":                  "20",
+	"trialCaptcha":                "off",
+	"trialTelegram":               "false",
+	"trialCooldown":               "24",
+	"trialCleanupHours":           "24",
+	"statusSampleInterval":        "2",
+	"statusHistoryDays":           "7",
+	"bandwidthSource":             "interface",
+	"bandwidthMonthlyLimit":       "0",
+	"bandwidthDailyLimit":         "0",
+	"bandwidthResetDay":           "1",
+	"bandwidthAlertPercents":      "80,90",
+	"bandwidthAction":             "alert",
+	"geoStatsDatabase":            "",
+	"geoStatsDays":                "90",
+	"webCertAcme":                 "",
+	"subCertAcme":                 "",
+	"acmeSettings":                "{}",
+	"acmeAccountKey":              "",
+}
+
+type SettingService struct {
+	// overrides are values of settings read instead of the saved ones, to tell
+	// what saving them would change
+	overrides map[string]string
 }
 
-type SettingService struct{}
-
 func (s *SettingService) GetDefaultJsonConfig() (any, error) {
 	var jsonData any
 	err := json.Unmarshal([]byte(xrayTemplateConfig), &jsonData)
@@ -86,72 +313,27 @@ func (s *SettingService) GetDefaultJsonConfig() (any, error) {
 }
 
 func (s *SettingService) GetAllSetting() (*entity.AllSetting, error) {
-	db := database.GetDB()
-	settings := make([]*model.Setting, 0)
-	err := db.Model(model.Setting{}).Not("key = ?", "xrayTemplateConfig").Find(&settings).Error
+	settings, err := savedSettings()
 	if err != nil {
 		return nil, err
 	}
 	allSetting := &entity.AllSetting{}
-	t := reflect.TypeOf(allSetting).Elem()
-	v := reflect.ValueOf(allSetting).Elem()
-	fields := reflect_util.GetFields(t)
-
-	setSetting := func(key, value string) (err error) {
-		defer func() {
-			panicErr := recover()
-			if panicErr != nil {
-				err = errors.New(fmt.Sprint(panicErr))
-			}
-		}()
-
-		var found bool
-		var field reflect.StructField
-		for _, f := range fields {
-			if f.Tag.Get("json") == key {
-				field = f
-				found = true
-				break
-			}
-		}
-
-		if !found {
-			// Some settings are automatically generated, no need to return to the front end to modify the user
-			return nil
-		}
-
-		fieldV := v.FieldByName(field.Name)
-		switch t := fieldV.Interface().(type) {
-		case int:
-			n, err := strconv.ParseInt(value, 10, 64)
-			if err != nil {
-				return err
-			}
-			fieldV.SetInt(n)
-		case string:
-			fieldV.SetString(value)
-		case bool:
-			fieldV.SetBool(value == "true")
-		default:
-			return common.NewErrorf("unknown field %v type %v", key, t)
-		}
-		return
-	}
-
 	keyMap := map[string]bool{}
-	for _, setting := range settings {
-		err := setSetting(setting.Key, setting.Value)
-		if err != nil {
+	for key, value := range settings {
+		if key == "xrayTemplateConfig" {
+			continue
+		}
+		if err := setAllSettingField(allSetting, key, value); err != nil {
 			return nil, err
 		}
-		keyMap[setting.Key] = true
+		keyMap[key] = true
 	}
 
 	for key, value := range defaultValueMap {
 		if keyMap[key] {
 			continue
 		}
-		err := setSetting(key, value)
+		err := setAllSettingField(allSetting, key, value)
 		if err != nil {
 			return nil, err
 		}
@@ -160,9 +342,55 @@ func (s *SettingService) GetAllSetting() (*entity.AllSetting, error) {
 	return allSetting, nil
 }
 
+// setAllSettingField sets the field of allSetting of the setting key to the
+// stored value, if the setting has one.
+func setAllSettingField(allSetting *entity.AllSetting, key string, value string) (err error) {
+	defer func() {
+		panicErr := recover()
+		if panicErr != nil {
+			err = errors.New(fmt.Sprint(panicErr))
+		}
+	}()
+
+	t := reflect.TypeOf(allSetting).Elem()
+	v := reflect.ValueOf(allSetting).Elem()
+	var found bool
+	var field reflect.StructField
+	for _, f := range reflect_util.GetFields(t) {
+		if f.Tag.Get("json") == key {
+			field = f
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		// Some settings are automatically generated, no need to return to the front end to modify the user
+		return nil
+	}
+
+	fieldV := v.FieldByName(field.Name)
+	switch t := fieldV.Interface().(type) {
+	case int:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		fieldV.SetInt(n)
+	case string:
+		fieldV.SetString(value)
+	case bool:
+		fieldV.SetBool(value == "true")
+	default:
+		return common.NewErrorf("unknown field %v type %v", key, t)
+	}
+	return
+}
+
 func (s *SettingService) ResetSettings() error {
 	db := database.GetDB()
 	err := db.Where("1 = 1").Delete(model.Setting{}).Error
+	InvalidateSettings()
 	if err != nil {
 		return err
 	}
@@ -170,80 +398,28 @@ func (s *SettingService) ResetSettings() error {
 		Where("1 = 1").Error
 }
 
-func (s *SettingService) getSetting(key string) (*model.Setting, error) {
-	db := database.GetDB()
-	setting := &model.Setting{}
-	err := db.Model(model.Setting{}).Where("key = ?", key).First(setting).Error
-	if err != nil {
-		return nil, err
-	}
-	return setting, nil
-}
-
 func (s *SettingService) saveSetting(key string, value string) error {
-	setting, err := s.getSetting(key)
-	db := database.GetDB()
-	if database.IsNotFound(err) {
-		return db.Create(&model.Setting{
-			Key:   key,
-			Value: value,
-		}).Error
-	} else if err != nil {
-		return err
-	}
-	setting.Key = key
-	setting.Value = value
-	return db.Save(setting).Error
-}
-
-func (s *SettingService) getString(key string) (string, error) {
-	setting, err := s.getSetting(key)
-	if database.IsNotFound(err) {
-		value, ok := defaultValueMap[key]
-		if !ok {
-			return "", common.NewErrorf("key <%v> not in defaultValueMap", key)
-		}
-		return value, nil
-	} else if err != nil {
-		return "", err
-	}
-	return setting.Value, nil
+	return storeSetting(key, value)
 }
 
 func (s *SettingService) setString(key string, value string) error {
 	return s.saveSetting(key, value)
 }
 
-func (s *SettingService) getBool(key string) (bool, error) {
-	str, err := s.getString(key)
-	if err != nil {
-		return false, err
-	}
-	return strconv.ParseBool(str)
-}
-
 func (s *SettingService) setBool(key string, value bool) error {
 	return s.setString(key, strconv.FormatBool(value))
 }
 
-func (s *SettingService) getInt(key string) (int, error) {
-	str, err := s.getString(key)
-	if err != nil {
-		return 0, err
-	}
-	return strconv.Atoi(str)
-}
-
 func (s *SettingService) setInt(key string, value int) error {
 	return s.setString(key, strconv.Itoa(value))
 }
 
 func (s *SettingService) GetXrayConfigTemplate() (string, error) {
-	return s.getString("xrayTemplateConfig")
+	return s.GetString("xrayTemplateConfig")
 }
 
 func (s *SettingService) GetListen() (string, error) {
-	return s.getString("webListen")
+	return s.GetString("webListen")
 }
 
 func (s *SettingService) SetListen(ip string) error {
@@ -251,11 +427,11 @@ func (s *SettingService) SetListen(ip string) error {
 }
 
 func (s *SettingService) GetWebDomain() (string, error) {
-	return s.getString("webDomain")
+	return s.GetString("webDomain")
 }
 
 func (s *SettingService) GetTgBotToken() (string, error) {
-	return s.getString("tgBotToken")
+	return s.GetString("tgBotToken")
 }
 
 func (s *SettingService) SetTgBotToken(token string) error {
@@ -263,7 +439,7 @@ func (s *SettingService) SetTgBotToken(token string) error {
 }
 
 func (s *SettingService) GetTgBotProxy() (string, error) {
-	return s.getString("tgBotProxy")
+	return s.GetString("tgBotProxy")
 }
 
 func (s *SettingService) SetTgBotProxy(token string) error {
@@ -271,7 +447,7 @@ func (s *SettingService) SetTgBotProxy(token string) error {
 }
 
 func (s *SettingService) GetTgBotAPIServer() (string, error) {
-	return s.getString("tgBotAPIServer")
+	return s.GetString("tgBotAPIServer")
 }
 
 func (s *SettingService) SetTgBotAPIServer(token string) error {
@@ -279,15 +455,18 @@ func (s *SettingService) SetTgBotAPIServer(token string) error {
 }
 
 func (s *SettingService) GetTgBotChatId() (string, error) {
-	return s.getString("tgBotChatId")
+	return s.GetString("tgBotChatId")
 }
 
 func (s *SettingService) SetTgBotChatId(chatIds string) error {
+	if _, err := parseTgBotChats(chatIds); err != nil {
+		return err
+	}
 	return s.setString("tgBotChatId", chatIds)
 }
 
 func (s *SettingService) GetTgbotEnabled() (bool, error) {
-	return s.getBool("tgBotEnable")
+	return s.GetBool("tgBotEnable")
 }
 
 func (s *SettingService) SetTgbotEnabled(value bool) error {
@@ -295,7 +474,7 @@ func (s *SettingService) SetTgbotEnabled(value bool) error {
 }
 
 func (s *SettingService) GetTgbotRuntime() (string, error) {
-	return s.getString("tgRunTime")
+	return s.GetString("tgRunTime")
 }
 
 func (s *SettingService) SetTgbotRuntime(time string) error {
@@ -303,23 +482,27 @@ func (s *SettingService) SetTgbotRuntime(time string) error {
 }
 
 func (s *SettingService) GetTgBotBackup() (bool, error) {
-	return s.getBool("tgBotBackup")
+	return s.GetBool("tgBotBackup")
 }
 
 func (s *SettingService) GetTgBotLoginNotify() (bool, error) {
-	return s.getBool("tgBotLoginNotify")
+	return s.GetBool("tgBotLoginNotify")
+}
+
+func (s *SettingService) GetTgBotPanicNotify() (bool, error) {
+	return s.GetBool("tgBotPanicNotify")
 }
 
 func (s *SettingService) GetTgCpu() (int, error) {
-	return s.getInt("tgCpu")
+	return s.GetInt("tgCpu")
 }
 
 func (s *SettingService) GetTgLang() (string, error) {
-	return s.getString("tgLang")
+	return s.GetString("tgLang")
 }
 
 func (s *SettingService) GetTwoFactorEnable() (bool, error) {
-	return s.getBool("twoFactorEnable")
+	return s.GetBool("twoFactorEnable")
 }
 
 func (s *SettingService) SetTwoFactorEnable(value bool) error {
@@ -327,7 +510,7 @@ func (s *SettingService) SetTwoFactorEnable(value bool) error {
 }
 
 func (s *SettingService) GetTwoFactorToken() (string, error) {
-	return s.getString("twoFactorToken")
+	return s.GetString("twoFactorToken")
 }
 
 func (s *SettingService) SetTwoFactorToken(value string) error {
@@ -335,7 +518,7 @@ func (s *SettingService) SetTwoFactorToken(value string) error {
 }
 
 func (s *SettingService) GetPort() (int, error) {
-	return s.getInt("webPort")
+	return s.GetInt("webPort")
 }
 
 func (s *SettingService) SetPort(port int) error {
@@ -346,8 +529,15 @@ func (s *SettingService) SetCertFile(webCertFile string) error {
 	return s.setString("webCertFile", webCertFile)
 }
 
+// GetCertFile returns the cert file of the panel: the one of the ACME
+// certificate it is set to use, or the file of the settings.
 func (s *SettingService) GetCertFile() (string, error) {
-	return s.getString("webCertFile")
+	domain, err := s.GetString("webCertAcme")
+	if err != nil || domain == "" {
+		return s.GetString("webCertFile")
+	}
+	certFile, _ := acmeCertFiles(domain)
+	return certFile, nil
 }
 
 func (s *SettingService) SetKeyFile(webKeyFile string) error {
@@ -355,27 +545,68 @@ func (s *SettingService) SetKeyFile(webKeyFile string) error {
 }
 
 func (s *SettingService) GetKeyFile() (string, error) {
-	return s.getString("webKeyFile")
+	domain, err := s.GetString("webCertAcme")
+	if err != nil || domain == "" {
+		return s.GetString("webKeyFile")
+	}
+	_, keyFile := acmeCertFiles(domain)
+	return keyFile, nil
 }
 
 func (s *SettingService) GetExpireDiff() (int, error) {
-	return s.getInt("expireDiff")
+	return s.GetInt("expireDiff")
 }
 
 func (s *SettingService) GetTrafficDiff() (int, error) {
-	return s.getInt("trafficDiff")
+	return s.GetInt("trafficDiff")
 }
 
 func (s *SettingService) GetSessionMaxAge() (int, error) {
-	return s.getInt("sessionMaxAge")
+	return s.GetInt("sessionMaxAge")
+}
+
+// GetRememberSessionMaxAge returns the minutes a session cookie of a remember-me
+// login lasts before it is refreshed.
+func (s *SettingService) GetRememberSessionMaxAge() (int, error) {
+	return s.GetInt("rememberSessionMaxAge")
+}
+
+// GetRememberMaxAge returns the days a remember-me login lasts, zero disables
+// remember-me.
+func (s *SettingService) GetRememberMaxAge() (int, error) {
+	return s.GetInt("rememberMaxAge")
+}
+
+// GetSessionIdleTimeout returns the minutes a login session may go unused before
+// it ends, zero for no limit.
+func (s *SettingService) GetSessionIdleTimeout() (int, error) {
+	return s.GetInt("sessionIdleTimeout")
+}
+
+// GetSessionLifetime returns the minutes a login session lasts at most since
+// the login, refreshes included, zero for no limit.
+func (s *SettingService) GetSessionLifetime() (int, error) {
+	return s.GetInt("sessionLifetime")
+}
+
+// GetSessionMaxConcurrent returns how many login sessions a user may have at
+// once, zero for no limit.
+func (s *SettingService) GetSessionMaxConcurrent() (int, error) {
+	return s.GetInt("sessionMaxConcurrent")
+}
+
+// GetSessionLimitPolicy returns what a login beyond the sessions a user may
+// have does: "evict" ends the oldest session, "reject" refuses the login.
+func (s *SettingService) GetSessionLimitPolicy() (string, error) {
+	return s.GetString("sessionLimitPolicy")
 }
 
 func (s *SettingService) GetRemarkModel() (string, error) {
-	return s.getString("remarkModel")
+	return s.GetString("remarkModel")
 }
 
 func (s *SettingService) GetSecret() ([]byte, error) {
-	secret, err := s.getString("secret")
+	secret, err := s.GetString("secret")
 	if secret == defaultValueMap["secret"] {
 		err := s.saveSetting("secret", secret)
 		if err != nil {
@@ -396,7 +627,7 @@ func (s *SettingService) SetBasePath(basePath string) error {
 }
 
 func (s *SettingService) GetBasePath() (string, error) {
-	basePath, err := s.getString("webBasePath")
+	basePath, err := s.GetString("webBasePath")
 	if err != nil {
 		return "", err
 	}
@@ -410,7 +641,7 @@ func (s *SettingService) GetBasePath() (string, error) {
 }
 
 func (s *SettingService) GetTimeLocation() (*time.Location, error) {
-	l, err := s.getString("timeLocation")
+	l, err := s.GetString("timeLocation")
 	if err != nil {
 		return nil, err
 	}
@@ -424,87 +655,87 @@ func (s *SettingService) GetTimeLocation() (*time.Location, error) {
 }
 
 func (s *SettingService) GetSubEnable() (bool, error) {
-	return s.getBool("subEnable")
+	return s.GetBool("subEnable")
 }
 
 func (s *SettingService) GetSubTitle() (string, error) {
-	return s.getString("subTitle")
+	return s.GetString("subTitle")
 }
 
 func (s *SettingService) GetSubListen() (string, error) {
-	return s.getString("subListen")
+	return s.GetString("subListen")
 }
 
 func (s *SettingService) GetSubPort() (int, error) {
-	return s.getInt("subPort")
+	return s.GetInt("subPort")
 }
 
 func (s *SettingService) GetSubPath() (string, error) {
-	return s.getString("subPath")
+	return s.GetString("subPath")
 }
 
 func (s *SettingService) GetSubJsonPath() (string, error) {
-	return s.getString("subJsonPath")
+	return s.GetString("subJsonPath")
 }
 
 func (s *SettingService) GetSubDomain() (string, error) {
-	return s.getString("subDomain")
+	return s.GetString("subDomain")
 }
 
 func (s *SettingService) GetSubCertFile() (string, error) {
-	return s.getString("subCertFile")
+	return s.GetString("subCertFile")
 }
 
 func (s *SettingService) GetSubKeyFile() (string, error) {
-	return s.getString("subKeyFile")
+	return s.GetString("subKeyFile")
 }
 
 func (s *SettingService) GetSubUpdates() (string, error) {
-	return s.getString("subUpdates")
+	return s.GetString("subUpdates")
 }
 
 func (s *SettingService) GetSubEncrypt() (bool, error) {
-	return s.getBool("subEncrypt")
+	return s.GetBool("subEncrypt")
 }
 
 func (s *SettingService) GetSubShowInfo() (bool, error) {
-	return s.getBool("subShowInfo")
+	return s.GetBool("subShowInfo")
 }
 
 func (s *SettingService) GetPageSize() (int, error) {
-	return s.getInt("pageSize")
+	return s.GetInt("pageSize")
 }
 
 func (s *SettingService) GetSubURI() (string, error) {
-	return s.getString("subURI")
+	return s.GetString("subURI")
 }
 
 func (s *SettingService) GetSubJsonURI() (string, error) {
-	return s.getString("subJsonURI")
+	return s.GetString("subJsonURI")
 }
 
 func (s *SettingService) GetSubJsonFragment() (string, error) {
-	return s.getString("subJsonFragment")
+	return s.GetString("subJsonFragment")
 }
 
 func (s *SettingService) GetSubJsonNoises() (string, error) {
-	return s.getString("subJsonNoises")
+	return s.GetString("subJsonNoises")
 }
 
 func (s *SettingService) GetSubJsonMux() (string, error) {
-	return s.getString("subJsonMux")
+	return s.GetString("subJsonMux")
 }
 
 func (s *SettingService) GetSubJsonRules() (string, error) {
-	return s.getString("subJsonRules")
+	return s.GetString("subJsonRules")
 }
 
 func (s *SettingService) GetDatepicker() (string, error) {
-	return s.getString("datepicker")
+	return s.GetString("datepicker")
 }
 
 func (s *SettingService) GetWarp() (string, error) {
-	return s.getString("warp")
+	return s.GetString("warp")
 }
 
 func (s *SettingService) SetWarp(data string) error {
@@ -512,7 +743,7 @@ func (s *SettingService) SetWarp(data string) error {
 }
 
 func (s *SettingService) GetExternalTrafficInformEnable() (bool, error) {
-	return s.getBool("externalTrafficInformEnable")
+	return s.GetBool("externalTrafficInformEnable")
 }
 
 func (s *SettingService) SetExternalTrafficInformEnable(value bool) error {
@@ -520,115 +751,1166 @@ func (s *SettingService) SetExternalTrafficInformEnable(value bool) error {
 }
 
 func (s *SettingService) GetExternalTrafficInformURI() (string, error) {
-	return s.getString("externalTrafficInformURI")
+	return s.GetString("externalTrafficInformURI")
 }
 
 func (s *SettingService) SetExternalTrafficInformURI(InformURI string) error {
 	return s.setString("externalTrafficInformURI", InformURI)
 }
 
+// GetIpLimitEnable tells whether IP limits can be set. They always can, Xray
+// writes the access log they are enforced from once a client has one.
 func (s *SettingService) GetIpLimitEnable() (bool, error) {
-	accessLogPath, err := xray.GetAccessLogPath()
+	return true, nil
+}
+
+func (s *SettingService) GetLogFormat() (string, error) {
+	return s.GetString("logFormat")
+}
+
+func (s *SettingService) GetAccessLogEnable() (bool, error) {
+	return s.GetBool("accessLogEnable")
+}
+
+func (s *SettingService) GetAccessLogMaxSize() (int, error) {
+	return s.GetInt("accessLogMaxSize")
+}
+
+func (s *SettingService) GetAccessLogMaxBackups() (int, error) {
+	return s.GetInt("accessLogMaxBackups")
+}
+
+func (s *SettingService) GetAccessLogMaxAge() (int, error) {
+	return s.GetInt("accessLogMaxAge")
+}
+
+func (s *SettingService) GetAccessLogExclude() (string, error) {
+	return s.GetString("accessLogExclude")
+}
+
+func (s *SettingService) GetAccessLogPath() (string, error) {
+	return s.GetString("accessLogPath")
+}
+
+// GetAuthLogPath returns the file of the login audit log fail2ban reads.
+func (s *SettingService) GetAuthLogPath() (string, error) {
+	return s.GetString("authLogPath")
+}
+
+// GetAppLogLevel returns the least severe level of the log lines of the panel
+// that are persisted, "off" for none.
+func (s *SettingService) GetAppLogLevel() (string, error) {
+	return s.GetString("appLogLevel")
+}
+
+func (s *SettingService) GetSlowRequestThreshold() (int, error) {
+	return s.GetInt("slowRequestThreshold")
+}
+
+func (s *SettingService) GetSlowRequestRoutes() (string, error) {
+	return s.GetString("slowRequestRoutes")
+}
+
+func (s *SettingService) GetMetricsEnable() (bool, error) {
+	return s.GetBool("metricsEnable")
+}
+
+func (s *SettingService) GetMetricsToken() (string, error) {
+	return s.GetString("metricsToken")
+}
+
+func (s *SettingService) GetMetricsAllowIPs() (string, error) {
+	return s.GetString("metricsAllowIPs")
+}
+
+func (s *SettingService) GetMetricsClientLabels() (bool, error) {
+	return s.GetBool("metricsClientLabels")
+}
+
+func (s *SettingService) GetLoginRateLimit() (int, error) {
+	return s.GetInt("loginRateLimit")
+}
+
+func (s *SettingService) GetLoginRateBurst() (int, error) {
+	return s.GetInt("loginRateBurst")
+}
+
+func (s *SettingService) GetLockoutThreshold() (int, error) {
+	return s.GetInt("lockoutThreshold")
+}
+
+func (s *SettingService) GetLockoutWindow() (int, error) {
+	return s.GetInt("lockoutWindow")
+}
+
+func (s *SettingService) GetLockoutDuration() (int, error) {
+	return s.GetInt("lockoutDuration")
+}
+
+// GetLoginCaptcha returns the kind of challenge suspicious logins get: off,
+// math or turnstile.
+func (s *SettingService) GetLoginCaptcha() (string, error) {
+	return s.GetString("loginCaptcha")
+}
+
+func (s *SettingService) GetLoginCaptchaFailures() (int, error) {
+	return s.GetInt("loginCaptchaFailures")
+}
+
+func (s *SettingService) GetLoginCaptchaGlobalRate() (int, error) {
+	return s.GetInt("loginCaptchaGlobalRate")
+}
+
+func (s *SettingService) GetTurnstileSiteKey() (string, error) {
+	return s.GetString("turnstileSiteKey")
+}
+
+func (s *SettingService) GetTurnstileSecret() (string, error) {
+	return s.GetString("turnstileSecret")
+}
+
+// GetAlertChannels returns the channels the alerts go to, a JSON object of the
+// channels by alert.
+func (s *SettingService) GetAlertChannels() (string, error) {
+	return s.GetString("alertChannels")
+}
+
+// GetAlertConfig returns where the alerts go besides Telegram.
+func (s *SettingService) GetAlertConfig() (*entity.AlertConfig, error) {
+	allSetting, err := s.GetAllSetting()
 	if err != nil {
-		return false, err
+		return nil, err
 	}
-	return (accessLogPath != "none" && accessLogPath != ""), nil
+	config := allSetting.AlertConfig()
+	return &config, nil
 }
 
-func (s *SettingService) UpdateAllSetting(allSetting *entity.AllSetting) error {
-	if err := allSetting.CheckValid(); err != nil {
-		return err
+func (s *SettingService) GetWebAuthnMode() (string, error) {
+	return s.GetString("webAuthnMode")
+}
+
+func (s *SettingService) GetAuditRetentionDays() (int, error) {
+	return s.GetInt("auditRetentionDays")
+}
+
+func (s *SettingService) GetPasswordHashMemory() (int, error) {
+	return s.GetInt("passwordHashMemory")
+}
+
+func (s *SettingService) GetPasswordHashIterations() (int, error) {
+	return s.GetInt("passwordHashIterations")
+}
+
+// GetArgon2Params returns the parameters new password hashes are created with.
+func (s *SettingService) GetArgon2Params() crypto.Argon2Params {
+	params := crypto.DefaultArgon2Params
+	if memory, err := s.GetPasswordHashMemory(); err == nil && memory > 0 {
+		params.Memory = uint32(memory)
+	}
+	if iterations, err := s.GetPasswordHashIterations(); err == nil && iterations > 0 {
+		params.Iterations = uint32(iterations)
 	}
+	return params
+}
 
-	v := reflect.ValueOf(allSetting).Elem()
-	t := reflect.TypeOf(allSetting).Elem()
-	fields := reflect_util.GetFields(t)
-	errs := make([]error, 0)
-	for _, field := range fields {
-		key := field.Tag.Get("json")
-		fieldV := v.FieldByName(field.Name)
-		value := fmt.Sprint(fieldV.Interface())
-		err := s.saveSetting(key, value)
-		if err != nil {
-			errs = append(errs, err)
-		}
+// GetPasswordResetDeadline returns the unix milliseconds after which passwords
+// still stored with an outdated hash are no longer accepted, or 0 if there is no
+// deadline.
+func (s *SettingService) GetPasswordResetDeadline() (int64, error) {
+	str, err := s.GetString("passwordResetDeadline")
+	if err != nil {
+		return 0, err
 	}
-	return common.Combine(errs...)
+	return strconv.ParseInt(str, 10, 64)
 }
 
-func (s *SettingService) GetDefaultXrayConfig() (any, error) {
-	var jsonData any
-	err := json.Unmarshal([]byte(xrayTemplateConfig), &jsonData)
+func (s *SettingService) SetPasswordResetDeadline(deadline int64) error {
+	return s.setString("passwordResetDeadline", strconv.FormatInt(deadline, 10))
+}
+
+// The maintenance mode is checked on every request, and may be switched by the
+// CLI from another process; it is read from the database at most every 2s.
+var (
+	maintenanceLock  sync.Mutex
+	maintenanceState middleware.MaintenanceState
+	maintenanceRead  time.Time
+)
+
+const maintenanceCacheTTL = 2 * time.Second
+
+func (s *SettingService) GetMaintenance() (middleware.MaintenanceState, error) {
+	maintenanceLock.Lock()
+	defer maintenanceLock.Unlock()
+	if time.Since(maintenanceRead) < maintenanceCacheTTL {
+		return maintenanceState, nil
+	}
+	enable, err := s.GetBool("maintenanceEnable")
 	if err != nil {
-		return nil, err
+		return maintenanceState, err
 	}
-	return jsonData, nil
+	message, err := s.GetString("maintenanceMessage")
+	if err != nil {
+		return maintenanceState, err
+	}
+	etaStr, err := s.GetString("maintenanceEta")
+	if err != nil {
+		return maintenanceState, err
+	}
+	eta, err := strconv.ParseInt(etaStr, 10, 64)
+	if err != nil {
+		return maintenanceState, err
+	}
+	maintenanceState = middleware.MaintenanceState{Enable: enable, Message: message, Eta: eta}
+	maintenanceRead = time.Now()
+	return maintenanceState, nil
 }
 
-func (s *SettingService) GetDefaultSettings(host string) (any, error) {
-	type settingFunc func() (any, error)
-	settings := map[string]settingFunc{
-		"expireDiff":    func() (any, error) { return s.GetExpireDiff() },
-		"trafficDiff":   func() (any, error) { return s.GetTrafficDiff() },
-		"pageSize":      func() (any, error) { return s.GetPageSize() },
-		"defaultCert":   func() (any, error) { return s.GetCertFile() },
-		"defaultKey":    func() (any, error) { return s.GetKeyFile() },
-		"tgBotEnable":   func() (any, error) { return s.GetTgbotEnabled() },
-		"subEnable":     func() (any, error) { return s.GetSubEnable() },
-		"subTitle":      func() (any, error) { return s.GetSubTitle() },
-		"subURI":        func() (any, error) { return s.GetSubURI() },
-		"subJsonURI":    func() (any, error) { return s.GetSubJsonURI() },
-		"remarkModel":   func() (any, error) { return s.GetRemarkModel() },
-		"datepicker":    func() (any, error) { return s.GetDatepicker() },
-		"ipLimitEnable": func() (any, error) { return s.GetIpLimitEnable() },
+func (s *SettingService) SetMaintenance(state middleware.MaintenanceState) error {
+	maintenanceLock.Lock()
+	defer maintenanceLock.Unlock()
+	maintenanceRead = time.Time{}
+	if !state.Enable {
+		state.Message, state.Eta = "", 0
+	}
+	if err := s.setBool("maintenanceEnable", state.Enable); err != nil {
+		return err
+	}
+	if err := s.setString("maintenanceMessage", state.Message); err != nil {
+		return err
 	}
+	return s.setString("maintenanceEta", strconv.FormatInt(state.Eta, 10))
+}
 
-	result := make(map[string]any)
+func (s *SettingService) GetTrustedProxies() (string, error) {
+	return s.GetString("trustedProxies")
+}
 
-	for key, fn := range settings {
-		value, err := fn()
-		if err != nil {
-			return "", err
-		}
-		result[key] = value
-	}
+func (s *SettingService) GetTrustedProxyHeader() (string, error) {
+	return s.GetString("trustedProxyHeader")
+}
 
-	if result["subEnable"].(bool) && (result["subURI"].(string) == "" || result["subJsonURI"].(string) == "") {
-		subURI := ""
-		subTitle, _ := s.GetSubTitle()
-		subPort, _ := s.GetSubPort()
-		subPath, _ := s.GetSubPath()
-		subJsonPath, _ := s.GetSubJsonPath()
-		subDomain, _ := s.GetSubDomain()
-		subKeyFile, _ := s.GetSubKeyFile()
-		subCertFile, _ := s.GetSubCertFile()
-		subTLS := false
-		if subKeyFile != "" && subCertFile != "" {
-			subTLS = true
-		}
-		if subDomain == "" {
-			subDomain = strings.Split(host, ":")[0]
-		}
-		if subTLS {
-			subURI = "https://"
-		} else {
-			subURI = "http://"
-		}
-		if (subPort == 443 && subTLS) || (subPort == 80 && !subTLS) {
-			subURI += subDomain
-		} else {
-			subURI += fmt.Sprintf("%s:%d", subDomain, subPort)
-		}
-		if result["subURI"].(string) == "" {
-			result["subURI"] = subURI + subPath
-		}
-		if result["subTitle"].(string) == "" {
-			result["subTitle"] = subTitle
-		}
-		if result["subJsonURI"].(string) == "" {
-			result["subJsonURI"] = subURI + subJsonPath
-		}
+// GetShutdownTimeout returns how long the servers wait for in-flight requests
+// when shutting down.
+func (s *SettingService) GetShutdownTimeout() time.Duration {
+	timeout, err := s.GetDuration("shutdownTimeout", time.Second)
+	if err != nil || timeout <= 0 {
+		seconds, _ := strconv.Atoi(defaultValueMap["shutdownTimeout"])
+		timeout = time.Duration(seconds) * time.Second
 	}
+	return timeout
+}
 
-	return result, nil
+func (s *SettingService) GetXrayKeepOnRestart() (bool, error) {
+	return s.GetBool("xrayKeepOnRestart")
+}
+
+func (s *SettingService) GetHealthzEnable() (bool, error) {
+	return s.GetBool("healthzEnable")
+}
+
+func (s *SettingService) GetSocketMode() (string, error) {
+	return s.GetString("socketMode")
+}
+
+func (s *SettingService) GetSocketOwner() (string, error) {
+	return s.GetString("socketOwner")
+}
+
+func (s *SettingService) GetBulkClientsMax() (int, error) {
+	return s.GetInt("bulkClientsMax")
+}
+
+func (s *SettingService) GetTrafficResetHistory() (bool, error) {
+	return s.GetBool("trafficResetHistory")
+}
+
+func (s *SettingService) GetSubIncludeDisabled() (bool, error) {
+	return s.GetBool("subIncludeDisabled")
+}
+
+func (s *SettingService) GetClientCleanupDays() (int, error) {
+	return s.GetInt("clientCleanupDays")
+}
+
+func (s *SettingService) GetNotifyTrafficPercents() (string, error) {
+	return s.GetString("notifyTrafficPercents")
+}
+
+func (s *SettingService) GetNotifyExpiryDays() (string, error) {
+	return s.GetString("notifyExpiryDays")
+}
+
+func (s *SettingService) GetIpLimitWindow() (int, error) {
+	return s.GetInt("ipLimitWindow")
+}
+
+func (s *SettingService) GetIpLimitCooldown() (int, error) {
+	return s.GetInt("ipLimitCooldown")
+}
+
+func (s *SettingService) GetIpLimitIpv6Prefix() (int, error) {
+	return s.GetInt("ipLimitIpv6Prefix")
+}
+
+func (s *SettingService) GetIpLimitDevices() (time.Duration, error) {
+	return s.GetDuration("ipLimitDevices", time.Minute)
+}
+
+func (s *SettingService) GetRemarkTemplate() (string, error) {
+	return s.GetString("remarkTemplate")
+}
+
+func (s *SettingService) GetRandomPortMin() (int, error) {
+	return s.GetInt("randomPortMin")
+}
+
+func (s *SettingService) GetRandomPortMax() (int, error) {
+	return s.GetInt("randomPortMax")
+}
+
+func (s *SettingService) GetPortRangeClientPort() (bool, error) {
+	return s.GetBool("portRangeClientPort")
+}
+
+func (s *SettingService) GetObservatoryMode() (string, error) {
+	return s.GetString("observatoryMode")
+}
+
+func (s *SettingService) GetObservatoryProbeURL() (string, error) {
+	return s.GetString("observatoryProbeUrl")
+}
+
+func (s *SettingService) GetObservatoryProbeInterval() (int, error) {
+	return s.GetInt("observatoryProbeInterval")
+}
+
+func (s *SettingService) GetXrayDownloadProxy() (string, error) {
+	return s.GetString("xrayDownloadProxy")
+}
+
+func (s *SettingService) GetXrayKeptVersions() (int, error) {
+	return s.GetInt("xrayKeptVersions")
+}
+
+func (s *SettingService) GetGeodataAutoUpdate() (bool, error) {
+	return s.GetBool("geodataAutoUpdate")
+}
+
+func (s *SettingService) GetGeodataUpdateCron() (string, error) {
+	return s.GetString("geodataUpdateCron")
+}
+
+func (s *SettingService) GetGeoipURL() (string, error) {
+	return s.GetString("geoipURL")
+}
+
+func (s *SettingService) GetGeositeURL() (string, error) {
+	return s.GetString("geositeURL")
+}
+
+func (s *SettingService) GetTgBotGeodataNotify() (bool, error) {
+	return s.GetBool("tgBotGeodataNotify")
+}
+
+func (s *SettingService) GetXrayHealthCheckWindow() (int, error) {
+	return s.GetInt("xrayHealthCheckWindow")
+}
+
+func (s *SettingService) GetXrayMaxRestartAttempts() (int, error) {
+	return s.GetInt("xrayMaxRestartAttempts")
+}
+
+// GetXrayStableMinutes returns how long Xray has to stay up for the restarts
+// after its crashes to start over.
+func (s *SettingService) GetXrayStableMinutes() (int, error) {
+	return s.GetInt("xrayStableMinutes")
+}
+
+// GetXrayCrashOutputKB returns how much of the end of the stderr of Xray goes
+// in its crash reports, in KB.
+func (s *SettingService) GetXrayCrashOutputKB() (int, error) {
+	return s.GetInt("xrayCrashOutputKB")
+}
+
+func (s *SettingService) GetTgBotXrayRestartNotify() (bool, error) {
+	return s.GetBool("tgBotXrayRestartNotify")
+}
+
+func (s *SettingService) GetXrayApiUpdates() (bool, error) {
+	return s.GetBool("xrayApiUpdates")
+}
+
+func (s *SettingService) GetXrayBinaryPath() (string, error) {
+	return s.GetString("xrayBinaryPath")
+}
+
+func (s *SettingService) GetXrayAssetDir() (string, error) {
+	return s.GetString("xrayAssetDir")
+}
+
+func (s *SettingService) GetXrayWorkDir() (string, error) {
+	return s.GetString("xrayWorkDir")
+}
+
+func (s *SettingService) GetXrayArgs() (string, error) {
+	return s.GetString("xrayArgs")
+}
+
+// GetRealityCheckInterval returns how often the dests of the Reality inbounds
+// are checked, in minutes, 0 for never.
+func (s *SettingService) GetRealityCheckInterval() (int, error) {
+	return s.GetInt("realityCheckInterval")
+}
+
+// GetRealityCheckFailures returns how many checks of the dest of a Reality
+// inbound fail in a row before it is alerted and falls back.
+func (s *SettingService) GetRealityCheckFailures() (int, error) {
+	return s.GetInt("realityCheckFailures")
+}
+
+// GetInboundCheckInterval returns how often the enabled inbounds are checked
+// for whether they are reachable, in minutes, 0 for never.
+func (s *SettingService) GetInboundCheckInterval() (int, error) {
+	return s.GetInt("inboundCheckInterval")
+}
+
+// GetInboundCheckTimeout returns the seconds each step of the check of an
+// inbound may take.
+func (s *SettingService) GetInboundCheckTimeout() (int, error) {
+	return s.GetInt("inboundCheckTimeout")
+}
+
+// GetInboundCheckProberUrl returns the URL of the prober that checks the
+// inbounds from outside, none for checking them only from the panel.
+func (s *SettingService) GetInboundCheckProberUrl() (string, error) {
+	return s.GetString("inboundCheckProberUrl")
+}
+
+// GetInboundCheckProberToken returns the bearer token for the prober, e.g. an
+// API token of the panel that probes.
+func (s *SettingService) GetInboundCheckProberToken() (string, error) {
+	return s.GetString("inboundCheckProberToken")
+}
+
+// GetInboundCheckHost returns the host the prober connects to, none for the
+// address the probes come from.
+func (s *SettingService) GetInboundCheckHost() (string, error) {
+	return s.GetString("inboundCheckHost")
+}
+
+func (s *SettingService) GetOnlineWindow() (int, error) {
+	return s.GetInt("onlineWindow")
+}
+
+func (s *SettingService) GetClientInactiveDays() (int, error) {
+	return s.GetInt("clientInactiveDays")
+}
+
+func (s *SettingService) GetClientCleanupInactive() (bool, error) {
+	return s.GetBool("clientCleanupInactive")
+}
+
+// GetClientCleanupInactiveDays returns how long a client may go unseen before
+// the cleanup deletes it, 0 if the cleanup leaves unseen clients alone.
+func (s *SettingService) GetClientCleanupInactiveDays() int {
+	if enabled, err := s.GetClientCleanupInactive(); err != nil || !enabled {
+		return 0
+	}
+	days, _ := s.GetClientInactiveDays()
+	return days
+}
+
+func (s *SettingService) GetClientInactiveReport() (bool, error) {
+	return s.GetBool("clientInactiveReport")
+}
+
+// GetClientInactiveReportDays returns the inactivity period of the weekly
+// digest of the clients that became inactive, 0 if the digest is off.
+func (s *SettingService) GetClientInactiveReportDays() int {
+	if enabled, err := s.GetClientInactiveReport(); err != nil || !enabled {
+		return 0
+	}
+	days, _ := s.GetClientInactiveDays()
+	return days
+}
+
+func (s *SettingService) GetConnectionSampleInterval() (int, error) {
+	return s.GetInt("connectionSampleInterval")
+}
+
+func (s *SettingService) GetConnectionMethod() (string, error) {
+	return s.GetString("connectionMethod")
+}
+
+func (s *SettingService) GetConnBlockCommand() (string, error) {
+	return s.GetString("connBlockCommand")
+}
+
+func (s *SettingService) GetConnUnblockCommand() (string, error) {
+	return s.GetString("connUnblockCommand")
+}
+
+func (s *SettingService) GetConnBlockMinutes() (int, error) {
+	return s.GetInt("connBlockMinutes")
+}
+
+func (s *SettingService) GetTrafficHistoryDays() (int, error) {
+	return s.GetInt("trafficHistoryDays")
+}
+
+func (s *SettingService) GetTrafficFlushInterval() (int, error) {
+	return s.GetInt("trafficFlushInterval")
+}
+
+func (s *SettingService) GetDbJournalMode() (string, error) {
+	return s.GetString("dbJournalMode")
+}
+
+func (s *SettingService) GetDbSynchronous() (string, error) {
+	return s.GetString("dbSynchronous")
+}
+
+func (s *SettingService) GetDbBusyTimeout() (int, error) {
+	return s.GetInt("dbBusyTimeout")
+}
+
+func (s *SettingService) GetDbMaxConnections() (int, error) {
+	return s.GetInt("dbMaxConnections")
+}
+
+func (s *SettingService) GetDbAutoOptimize() (bool, error) {
+	return s.GetBool("dbAutoOptimize")
+}
+
+func (s *SettingService) GetDbOptimizeCron() (string, error) {
+	return s.GetString("dbOptimizeCron")
+}
+
+func (s *SettingService) GetTgBotDbOptimizeNotify() (bool, error) {
+	return s.GetBool("tgBotDbOptimizeNotify")
+}
+
+func (s *SettingService) GetTrashRetentionDays() (int, error) {
+	return s.GetInt("trashRetentionDays")
+}
+
+func (s *SettingService) GetBackupEnable() (bool, error) {
+	return s.GetBool("backupEnable")
+}
+
+func (s *SettingService) GetBackupCron() (string, error) {
+	return s.GetString("backupCron")
+}
+
+func (s *SettingService) GetBackupDir() (string, error) {
+	return s.GetString("backupDir")
+}
+
+func (s *SettingService) GetBackupKeep() (int, error) {
+	return s.GetInt("backupKeep")
+}
+
+func (s *SettingService) GetBackupIncludeFiles() (bool, error) {
+	return s.GetBool("backupIncludeFiles")
+}
+
+func (s *SettingService) GetBackupPassphrase() (string, error) {
+	return s.GetString("backupPassphrase")
+}
+
+func (s *SettingService) GetBackupRemotes() (string, error) {
+	return s.GetString("backupRemotes")
+}
+
+func (s *SettingService) SetBackupRemotes(value string) error {
+	return s.setString("backupRemotes", value)
+}
+
+func (s *SettingService) GetBackupWebhookUrl() (string, error) {
+	return s.GetString("backupWebhookUrl")
+}
+
+func (s *SettingService) GetTgBotBackupUploadNotify() (bool, error) {
+	return s.GetBool("tgBotBackupUploadNotify")
+}
+
+func (s *SettingService) GetTgBotBackupCron() (string, error) {
+	return s.GetString("tgBotBackupCron")
+}
+
+func (s *SettingService) GetTgBotBackupLarge() (string, error) {
+	return s.GetString("tgBotBackupLarge")
+}
+
+func (s *SettingService) GetTgBotBackupFailures() (string, error) {
+	return s.GetString("tgBotBackupFailures")
+}
+
+func (s *SettingService) SetTgBotBackupFailures(value string) error {
+	return s.setString("tgBotBackupFailures", value)
+}
+
+// GetSetupState returns the state of the first-run setup, SetupPending or
+// SetupDone, or empty before it was found out.
+func (s *SettingService) GetSetupState() (string, error) {
+	return s.GetString("setupState")
+}
+
+func (s *SettingService) SetSetupState(state string) error {
+	return s.setString("setupState", state)
+}
+
+// GetSecurityAlerted returns the critical security findings the Telegram admins
+// were last told about, comma separated.
+func (s *SettingService) GetSecurityAlerted() (string, error) {
+	return s.GetString("securityAlerted")
+}
+
+func (s *SettingService) SetSecurityAlerted(value string) error {
+	return s.setString("securityAlerted", value)
+}
+
+func (s *SettingService) GetTgBotLoginNotifyFailed() (bool, error) {
+	return s.GetBool("tgBotLoginNotifyFailed")
+}
+
+func (s *SettingService) GetTgBotLoginNotifyApi() (bool, error) {
+	return s.GetBool("tgBotLoginNotifyApi")
+}
+
+func (s *SettingService) GetTgBotLoginNotifyInterval() (int, error) {
+	return s.GetInt("tgBotLoginNotifyInterval")
+}
+
+func (s *SettingService) GetTgBotSelfService() (bool, error) {
+	return s.GetBool("tgBotSelfService")
+}
+
+func (s *SettingService) GetNotifyExpiryCron() (string, error) {
+	return s.GetString("notifyExpiryCron")
+}
+
+func (s *SettingService) GetNotifyRenewalContact() (string, error) {
+	return s.GetString("notifyRenewalContact")
+}
+
+func (s *SettingService) GetTgBotParseMode() (string, error) {
+	return s.GetString("tgBotParseMode")
+}
+
+func (s *SettingService) GetTgTemplateLogin() (string, error) {
+	return s.GetString("tgTemplateLogin")
+}
+
+func (s *SettingService) GetTgTemplateTraffic() (string, error) {
+	return s.GetString("tgTemplateTraffic")
+}
+
+func (s *SettingService) GetTgTemplateExpiry() (string, error) {
+	return s.GetString("tgTemplateExpiry")
+}
+
+func (s *SettingService) GetTgTemplateBackup() (string, error) {
+	return s.GetString("tgTemplateBackup")
+}
+
+func (s *SettingService) GetTgTemplateClient() (string, error) {
+	return s.GetString("tgTemplateClient")
+}
+
+func (s *SettingService) GetWebhooks() (string, error) {
+	return s.GetString("webhooks")
+}
+
+func (s *SettingService) SetWebhooks(value string) error {
+	return s.setString("webhooks", value)
+}
+
+func (s *SettingService) GetWebhookSecret() (string, error) {
+	return s.GetString("webhookSecret")
+}
+
+func (s *SettingService) SetWebhookSecret(value string) error {
+	return s.setString("webhookSecret", value)
+}
+
+func (s *SettingService) GetXrayRestartRequest() (string, error) {
+	return s.GetString("xrayRestartRequest")
+}
+
+func (s *SettingService) SetXrayRestartRequest(value string) error {
+	return s.setString("xrayRestartRequest", value)
+}
+
+func (s *SettingService) GetSubClashRules() (string, error) {
+	return s.GetString("subClashRules")
+}
+
+func (s *SettingService) GetSubSingboxVersion() (string, error) {
+	return s.GetString("subSingboxVersion")
+}
+
+func (s *SettingService) GetSubSingboxDns() (string, error) {
+	return s.GetString("subSingboxDns")
+}
+
+func (s *SettingService) GetSubSingboxRoute() (string, error) {
+	return s.GetString("subSingboxRoute")
+}
+
+func (s *SettingService) GetSubExpiredNotice() (string, error) {
+	return s.GetString("subExpiredNotice")
+}
+
+func (s *SettingService) GetSubCache() (bool, error) {
+	return s.GetBool("subCache")
+}
+
+func (s *SettingService) GetSubCacheGranularity() (int, error) {
+	return s.GetInt("subCacheGranularity")
+}
+
+func (s *SettingService) GetSubAccessDays() (int, error) {
+	return s.GetInt("subAccessDays")
+}
+
+func (s *SettingService) GetSubAccessMaxIps() (int, error) {
+	return s.GetInt("subAccessMaxIps")
+}
+
+func (s *SettingService) GetWebEnable() (bool, error) {
+	return s.GetBool("webEnable")
+}
+
+func (s *SettingService) SetWebEnable(value bool) error {
+	return s.setBool("webEnable", value)
+}
+
+// GetSubBasePath returns the path the subscription paths are under, with a
+// leading and a trailing slash.
+func (s *SettingService) GetSubBasePath() (string, error) {
+	basePath, err := s.GetString("subBasePath")
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(basePath, "/") {
+		basePath = "/" + basePath
+	}
+	if !strings.HasSuffix(basePath, "/") {
+		basePath += "/"
+	}
+	return basePath, nil
+}
+
+func (s *SettingService) GetSubUseWebCert() (bool, error) {
+	return s.GetBool("subUseWebCert")
+}
+
+// CheckListeners fails if the panel and the subscription server are both on
+// and set to listen on the same address, the one started second would fail to
+// bind, or take over the unix socket of the first one.
+func (s *SettingService) CheckListeners() error {
+	webEnable, err := s.GetWebEnable()
+	if err != nil {
+		return err
+	}
+	subEnable, err := s.GetSubEnable()
+	if err != nil {
+		return err
+	}
+	if !webEnable || !subEnable {
+		return nil
+	}
+	webListen, err := s.GetListen()
+	if err != nil {
+		return err
+	}
+	webPort, err := s.GetPort()
+	if err != nil {
+		return err
+	}
+	subListen, err := s.GetSubListen()
+	if err != nil {
+		return err
+	}
+	subPort, err := s.GetSubPort()
+	if err != nil {
+		return err
+	}
+	if !network.Overlaps(webListen, webPort, subListen, subPort) {
+		return nil
+	}
+	if socketPath, ok := network.UnixSocketPath(webListen); ok {
+		return common.NewError("the panel and the subscription server are both set to listen on the unix socket", socketPath)
+	}
+	return common.NewErrorf("the panel (%s:%d) and the subscription server (%s:%d) are set to listen on the same port", webListen, webPort, subListen, subPort)
+}
+
+// GetSubCert returns the cert and key files of the subscription server: those
+// of its ACME certificate or its own, or the panel's if it has none and is set
+// to reuse them.
+func (s *SettingService) GetSubCert() (string, string, error) {
+	domain, err := s.GetString("subCertAcme")
+	if err != nil {
+		return "", "", err
+	}
+	if domain != "" {
+		certFile, keyFile := acmeCertFiles(domain)
+		return certFile, keyFile, nil
+	}
+	certFile, err := s.GetSubCertFile()
+	if err != nil {
+		return "", "", err
+	}
+	keyFile, err := s.GetSubKeyFile()
+	if err != nil {
+		return "", "", err
+	}
+	if certFile != "" || keyFile != "" {
+		return certFile, keyFile, nil
+	}
+	useWebCert, err := s.GetSubUseWebCert()
+	if err != nil || !useWebCert {
+		return "", "", err
+	}
+	if certFile, err = s.GetCertFile(); err != nil {
+		return "", "", err
+	}
+	if keyFile, err = s.GetKeyFile(); err != nil {
+		return "", "", err
+	}
+	return certFile, keyFile, nil
+}
+
+func (s *SettingService) GetSubPage() (bool, error) {
+	return s.GetBool("subPage")
+}
+
+func (s *SettingService) GetSubPageTitle() (string, error) {
+	return s.GetString("subPageTitle")
+}
+
+func (s *SettingService) GetSubPageLogo() (string, error) {
+	return s.GetString("subPageLogo")
+}
+
+func (s *SettingService) GetSubPageSupport() (string, error) {
+	return s.GetString("subPageSupport")
+}
+
+func (s *SettingService) GetSubRemotes() (string, error) {
+	return s.GetString("subRemotes")
+}
+
+func (s *SettingService) GetSubRemoteTimeout() (int, error) {
+	return s.GetInt("subRemoteTimeout")
+}
+
+func (s *SettingService) GetSubRemoteTTL() (int, error) {
+	return s.GetInt("subRemoteTTL")
+}
+
+func (s *SettingService) GetStatusPage() (bool, error) {
+	return s.GetBool("statusPage")
+}
+
+func (s *SettingService) GetStatusPagePath() (string, error) {
+	return s.GetString("statusPagePath")
+}
+
+func (s *SettingService) GetStatusPageTitle() (string, error) {
+	return s.GetString("statusPageTitle")
+}
+
+func (s *SettingService) GetStatusPageInbounds() (string, error) {
+	return s.GetString("statusPageInbounds")
+}
+
+func (s *SettingService) GetStatusPageFields() (string, error) {
+	return s.GetString("statusPageFields")
+}
+
+func (s *SettingService) GetStatusPageTTL() (int, error) {
+	return s.GetInt("statusPageTTL")
+}
+
+// GetStatusPageCapacity returns the throughput of an inbound, in Mbps, the
+// load levels of the public status page are relative to.
+func (s *SettingService) GetStatusPageCapacity() (int, error) {
+	return s.GetInt("statusPageCapacity")
+}
+
+// GetTrialInbound returns the id of the inbound the trial clients are created
+// on, 0 if there are no trials.
+func (s *SettingService) GetTrialInbound() (int, error) {
+	return s.GetInt("trialInbound")
+}
+
+// GetTrialPath returns the path of the trial endpoint on the subscription
+// server, "" if there are no trials.
+func (s *SettingService) GetTrialPath() (string, error) {
+	return s.GetString("trialPath")
+}
+
+func (s *SettingService) GetTrialTotalGB() (int, error) {
+	return s.GetInt("trialTotalGB")
+}
+
+func (s *SettingService) GetTrialDuration() (time.Duration, error) {
+	return s.GetDuration("trialHours", time.Hour)
+}
+
+// GetTrialIpDaily returns how many trials an IP gets a day, any if 0.
+func (s *SettingService) GetTrialIpDaily() (int, error) {
+	return s.GetInt("trialIpDaily")
+}
+
+// GetTrialDaily returns how many trials are handed out a day, any if 0.
+func (s *SettingService) GetTrialDaily() (int, error) {
+	return s.GetInt("trialDaily")
+}
+
+// GetTrialCaptcha returns the kind of challenge a trial has to pass: off, math
+// or turnstile.
+func (s *SettingService) GetTrialCaptcha() (string, error) {
+	return s.GetString("trialCaptcha")
+}
+
+func (s *SettingService) GetTrialTelegram() (bool, error) {
+	return s.GetBool("trialTelegram")
+}
+
+// GetTrialCooldown returns how long an IP or a Telegram user that got a trial
+// gets the same one back.
+func (s *SettingService) GetTrialCooldown() (time.Duration, error) {
+	return s.GetDuration("trialCooldown", time.Hour)
+}
+
+// GetTrialCleanup returns how long a trial client is kept after it was disabled
+// for its quota or its expiry, 0 for as long as the other clients.
+func (s *SettingService) GetTrialCleanup() (time.Duration, error) {
+	return s.GetDuration("trialCleanupHours", time.Hour)
+}
+
+func (s *SettingService) GetStatusSampleInterval() (int, error) {
+	return s.GetInt("statusSampleInterval")
+}
+
+func (s *SettingService) GetStatusHistoryDays() (int, error) {
+	return s.GetInt("statusHistoryDays")
+}
+
+func (s *SettingService) GetBandwidthSource() (string, error) {
+	return s.GetString("bandwidthSource")
+}
+
+func (s *SettingService) GetBandwidthMonthlyLimit() (int, error) {
+	return s.GetInt("bandwidthMonthlyLimit")
+}
+
+func (s *SettingService) GetBandwidthDailyLimit() (int, error) {
+	return s.GetInt("bandwidthDailyLimit")
+}
+
+func (s *SettingService) GetBandwidthResetDay() (int, error) {
+	return s.GetInt("bandwidthResetDay")
+}
+
+func (s *SettingService) GetBandwidthAlertPercents() (string, error) {
+	return s.GetString("bandwidthAlertPercents")
+}
+
+func (s *SettingService) GetBandwidthAction() (string, error) {
+	return s.GetString("bandwidthAction")
+}
+
+// GetGeoStatsDatabase returns the .mmdb database the countries of the clients
+// are looked up in, GeoLite2-Country.mmdb of the bin folder if none is set.
+func (s *SettingService) GetGeoStatsDatabase() (string, error) {
+	path, err := s.GetString("geoStatsDatabase")
+	if err != nil || path != "" {
+		return path, err
+	}
+	return filepath.Join(config.GetBinFolderPath(), "GeoLite2-Country.mmdb"), nil
+}
+
+func (s *SettingService) GetGeoStatsDays() (int, error) {
+	return s.GetInt("geoStatsDays")
+}
+
+func (s *SettingService) GetAcmeSettings() (string, error) {
+	return s.GetString("acmeSettings")
+}
+
+func (s *SettingService) SetAcmeSettings(value string) error {
+	return s.setString("acmeSettings", value)
+}
+
+// GetAcmeAccountKey returns the key of the ACME account, encrypted with the
+// secret of the panel, empty before the first issuance.
+func (s *SettingService) GetAcmeAccountKey() (string, error) {
+	return s.GetString("acmeAccountKey")
+}
+
+func (s *SettingService) SetAcmeAccountKey(value string) error {
+	return s.setString("acmeAccountKey", value)
+}
+
+// CheckAllSetting checks allSetting as UpdateAllSetting does before saving it.
+func (s *SettingService) CheckAllSetting(allSetting *entity.AllSetting) error {
+	if err := allSetting.CheckValid(); err != nil {
+		return err
+	}
+	if err := checkXrayBinary(allSetting); err != nil {
+		return err
+	}
+	if _, err := parseTgBotChats(allSetting.TgBotChatId); err != nil {
+		return err
+	}
+	if _, err := parseAlertChannels(allSetting.AlertChannels); err != nil {
+		return err
+	}
+	if err := checkAlertTemplates(allSetting.AlertConfig()); err != nil {
+		return err
+	}
+	return checkConnBlockCommands(allSetting.ConnBlockCommand, allSetting.ConnUnblockCommand)
+}
+
+func (s *SettingService) UpdateAllSetting(allSetting *entity.AllSetting) error {
+	if err := s.CheckAllSetting(allSetting); err != nil {
+		return err
+	}
+
+	errs := make([]error, 0)
+	for key, value := range settingValues(allSetting) {
+		err := s.saveSetting(key, value)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return common.Combine(errs...)
+}
+
+func (s *SettingService) GetDefaultXrayConfig() (any, error) {
+	var jsonData any
+	err := json.Unmarshal([]byte(xrayTemplateConfig), &jsonData)
+	if err != nil {
+		return nil, err
+	}
+	return jsonData, nil
+}
+
+func (s *SettingService) GetDefaultSettings(host string) (any, error) {
+	type settingFunc func() (any, error)
+	settings := map[string]settingFunc{
+		"expireDiff":          func() (any, error) { return s.GetExpireDiff() },
+		"trafficDiff":         func() (any, error) { return s.GetTrafficDiff() },
+		"pageSize":            func() (any, error) { return s.GetPageSize() },
+		"defaultCert":         func() (any, error) { return s.GetCertFile() },
+		"defaultKey":          func() (any, error) { return s.GetKeyFile() },
+		"tgBotEnable":         func() (any, error) { return s.GetTgbotEnabled() },
+		"subEnable":           func() (any, error) { return s.GetSubEnable() },
+		"subTitle":            func() (any, error) { return s.GetSubTitle() },
+		"subURI":              func() (any, error) { return s.GetSubURI() },
+		"subJsonURI":          func() (any, error) { return s.GetSubJsonURI() },
+		"remarkModel":         func() (any, error) { return s.GetRemarkModel() },
+		"remarkTemplate":      func() (any, error) { return s.GetRemarkTemplate() },
+		"portRangeClientPort": func() (any, error) { return s.GetPortRangeClientPort() },
+		"datepicker":          func() (any, error) { return s.GetDatepicker() },
+		"ipLimitEnable":       func() (any, error) { return s.GetIpLimitEnable() },
+	}
+
+	result := make(map[string]any)
+
+	for key, fn := range settings {
+		value, err := fn()
+		if err != nil {
+			return "", err
+		}
+		result[key] = value
+	}
+
+	if result["subEnable"].(bool) && (result["subURI"].(string) == "" || result["subJsonURI"].(string) == "") {
+		subURI := ""
+		subTitle, _ := s.GetSubTitle()
+		subPort, _ := s.GetSubPort()
+		subBasePath, _ := s.GetSubBasePath()
+		subPath, _ := s.GetSubPath()
+		subJsonPath, _ := s.GetSubJsonPath()
+		subDomain, _ := s.GetSubDomain()
+		subCertFile, subKeyFile, _ := s.GetSubCert()
+		subTLS := false
+		if subKeyFile != "" && subCertFile != "" {
+			subTLS = true
+		}
+		if subDomain == "" {
+			subDomain = strings.Split(host, ":")[0]
+		}
+		if subTLS {
+			subURI = "https://"
+		} else {
+			subURI = "http://"
+		}
+		if (subPort == 443 && subTLS) || (subPort == 80 && !subTLS) {
+			subURI += subDomain
+		} else {
+			subURI += fmt.Sprintf("%s:%d", subDomain, subPort)
+		}
+		subURI += strings.TrimSuffix(subBasePath, "/")
+		if result["subURI"].(string) == "" {
+			result["subURI"] = subURI + subPath
+		}
+		if result["subTitle"].(string) == "" {
+			result["subTitle"] = subTitle
+		}
+		if result["subJsonURI"].(string) == "" {
+			result["subJsonURI"] = subURI + subJsonPath
+		}
+	}
+
+	return result, nil
+}
+
+// SubLinks are the URLs of a subscription in each of its formats.
+type SubLinks struct {
+	Links   string `json:"links"`
+	Clash   string `json:"clash"`
+	Singbox string `json:"singbox"`
+	Json    string `json:"json"`
+}
+
+// GetSubLinks returns the URLs of the subscription subId as the panel shows
+// them, or nil if subscriptions are off.
+func (s *SettingService) GetSubLinks(host string, subId string) (*SubLinks, error) {
+	defaults, err := s.GetDefaultSettings(host)
+	if err != nil {
+		return nil, err
+	}
+	settings, _ := defaults.(map[string]any)
+	if settings["subEnable"] != true || subId == "" {
+		return nil, nil
+	}
+	subURI, _ := settings["subURI"].(string)
+	subJsonURI, _ := settings["subJsonURI"].(string)
+	return &SubLinks{
+		Links:   subURI + subId,
+		Clash:   subURI + subId + "?format=clash",
+		Singbox: subURI + subId + "?format=singbox",
+		Json:    subJsonURI + subId,
+	}, nil
+}
+
+// GetSubLink returns the subscription URL of subId as the panel shows it, or ""
+// if subscriptions are off. Without a subscription domain the URL is on host.
+func (s *SettingService) GetSubLink(host string, subId string) (string, error) {
+	defaults, err := s.GetDefaultSettings(host)
+	if err != nil {
+		return "", err
+	}
+	settings, _ := defaults.(map[string]any)
+	if settings["subEnable"] != true || subId == "" {
+		return "", nil
+	}
+	subURI, _ := settings["subURI"].(string)
+	return subURI + subId, nil
 }
@@ -0,0 +1,191 @@
+package service
+
+import (
+	"fmt"
+	"reflect"
+
+	"x-ui/util/reflect_util"
+	"x-ui/web/entity"
+	"x-ui/xray"
+)
+
+// What it takes for a change of a setting to take effect
+const (
+	// SettingImpactWeb settings take effect at once, the panel reads them as it
+	// needs them
+	SettingImpactWeb = "web"
+	// SettingImpactXray settings change the config or the process of Xray, which
+	// is restarted for them
+	SettingImpactXray = "xray"
+	// SettingImpactRestart settings are read as the panel starts, they take effect
+	// once it is restarted, unless a listener of OnSettingChange applies them live
+	SettingImpactRestart = "restart"
+)
+
+// xraySettings are the settings of the generated config and of the Xray process.
+var xraySettings = []string{
+	"observatoryMode", "observatoryProbeUrl", "observatoryProbeInterval", "xrayBinaryPath",
+	"xrayAssetDir", "xrayWorkDir", "xrayArgs",
+}
+
+// restartSettings are the settings of the servers, the middleware and the jobs,
+// read as the panel starts. The schedules of the jobs are applied live.
+var restartSettings = []string{
+	"webListen", "webDomain", "webPort", "webCertFile", "webKeyFile", "webCertAcme", "webBasePath",
+	"remarkModel", "tgBotEnable", "tgRunTime", "tgCpu", "timeLocation", "subEnable", "subTitle",
+	"subListen", "subPort", "subPath", "subDomain", "subCertFile", "subKeyFile", "subCertAcme",
+	"subUpdates", "subEncrypt", "subShowInfo", "subURI", "subJsonPath", "subJsonFragment",
+	"subJsonNoises", "subJsonMux", "subJsonRules", "logFormat", "accessLogEnable",
+	"accessLogMaxSize", "accessLogMaxBackups", "accessLogMaxAge", "accessLogExclude",
+	"accessLogPath", "authLogPath", "appLogLevel", "slowRequestThreshold", "slowRequestRoutes",
+	"panicBodyCaptureKB", "trustedProxies", "trustedProxyHeader", "corsAllowedOrigins", "corsAllowedMethods",
+	"corsAllowedHeaders", "corsAllowCredentials", "corsMaxAge", "securityHsts", "securityNoSniff",
+	"securityReferrerPolicy", "securityFrameOptions", "securityCsp", "securityCspScriptSrc",
+	"securityCspStyleSrc", "subSecurityHeaders", "compressionEnable", "compressionMinSize",
+	"compressionTypes", "shutdownTimeout", "socketMode", "socketOwner", "maxBodySize",
+	"maxBodySizeRestore", "maxBodySizeImport", "geodataAutoUpdate", "geodataUpdateCron",
+	"realityCheckInterval", "inboundCheckInterval", "connectionSampleInterval", "dbJournalMode",
+	"dbSynchronous", "dbBusyTimeout", "dbMaxConnections", "dbAutoOptimize", "dbOptimizeCron",
+	"backupEnable", "backupCron", "tgBotBackupCron", "notifyExpiryCron", "subClashRules",
+	"subSingboxVersion", "subSingboxDns", "subSingboxRoute", "subCache", "subCacheGranularity",
+	"webEnable", "subBasePath", "subUseWebCert", "subPage", "subPageTitle", "subPageLogo",
+	"subPageSupport", "subRemotes", "subRemoteTimeout", "subRemoteTTL", "statusPage",
+	"statusPagePath", "statusPageTitle", "statusPageInbounds", "statusPageFields", "statusPageTTL",
+	"statusPageCapacity", "statusSampleInterval", "trialInbound", "trialPath",
+}
+
+// webSettings are the settings the panel reads as it needs them.
+var webSettings = []string{
+	"sessionMaxAge", "rememberSessionMaxAge", "rememberMaxAge", "sessionIdleTimeout",
+	"sessionLifetime", "sessionMaxConcurrent", "sessionLimitPolicy", "pageSize", "expireDiff",
+	"trafficDiff", "tgBotToken", "tgBotProxy", "tgBotAPIServer", "tgBotChatId", "tgBotBackup",
+	"tgBotLoginNotify", "tgBotPanicNotify", "tgLang", "externalTrafficInformEnable",
+	"externalTrafficInformURI", "subJsonURI", "datepicker", "metricsEnable", "metricsToken",
+	"metricsAllowIPs", "metricsClientLabels", "loginRateLimit", "loginRateBurst",
+	"lockoutThreshold", "lockoutWindow", "lockoutDuration", "loginCaptcha", "loginCaptchaFailures",
+	"loginCaptchaGlobalRate", "turnstileSiteKey", "turnstileSecret", "webAuthnMode",
+	"auditRetentionDays", "passwordHashMemory", "passwordHashIterations", "xrayKeepOnRestart",
+	"healthzEnable", "bulkClientsMax", "trafficResetHistory", "subIncludeDisabled",
+	"clientCleanupDays", "notifyTrafficPercents", "notifyExpiryDays", "ipLimitWindow",
+	"ipLimitCooldown", "ipLimitIpv6Prefix", "ipLimitDevices", "remarkTemplate", "randomPortMin", "randomPortMax",
+	"portRangeClientPort", "xrayDownloadProxy", "xrayKeptVersions", "geoipURL", "geositeURL",
+	"tgBotGeodataNotify", "xrayHealthCheckWindow", "xrayMaxRestartAttempts", "xrayStableMinutes",
+	"xrayCrashOutputKB", "tgBotXrayRestartNotify", "xrayApiUpdates", "realityCheckFailures",
+	"inboundCheckTimeout", "inboundCheckProberUrl", "inboundCheckProberToken", "inboundCheckHost",
+	"onlineWindow", "clientInactiveDays", "clientCleanupInactive", "clientInactiveReport",
+	"connectionMethod", "connBlockCommand", "connUnblockCommand", "connBlockMinutes",
+	"trafficHistoryDays", "trafficFlushInterval", "tgBotDbOptimizeNotify", "trashRetentionDays",
+	"backupDir", "backupKeep", "backupIncludeFiles", "backupPassphrase", "backupWebhookUrl",
+	"tgBotBackupUploadNotify", "tgBotBackupLarge", "tgBotLoginNotifyFailed", "tgBotLoginNotifyApi",
+	"tgBotLoginNotifyInterval", "tgBotSelfService", "notifyRenewalContact", "tgBotParseMode",
+	"tgTemplateLogin", "tgTemplateTraffic", "tgTemplateExpiry", "tgTemplateBackup",
+	"tgTemplateClient", "alertChannels", "smtpHost", "smtpPort", "smtpSecurity", "smtpUsername",
+	"smtpPassword", "smtpFrom", "smtpTo", "alertEmailSubject", "alertEmailBody", "alertWebhookUrl",
+	"alertWebhookSecret", "subExpiredNotice", "subAccessDays", "subAccessMaxIps",
+	"statusHistoryDays", "bandwidthSource", "bandwidthMonthlyLimit", "bandwidthDailyLimit",
+	"bandwidthResetDay", "bandwidthAlertPercents", "bandwidthAction", "geoStatsDatabase",
+	"geoStatsDays", "trialTotalGB", "trialHours", "trialIpDaily", "trialDaily", "trialCaptcha",
+	"trialTelegram", "trialCooldown", "trialCleanupHours",
+}
+
+// settingImpacts is the impact of every setting of entity.AllSetting; a setting
+// added there has to be added to one of the lists above, which the tests check.
+var settingImpacts = map[string]string{}
+
+func init() {
+	for impact, keys := range map[string][]string{
+		SettingImpactXray:    xraySettings,
+		SettingImpactRestart: restartSettings,
+		SettingImpactWeb:     webSettings,
+	} {
+		for _, key := range keys {
+			settingImpacts[key] = impact
+		}
+	}
+}
+
+// settingImpact returns the impact of the setting key. A setting of no list is
+// taken to need a restart of the panel, the safe guess.
+func settingImpact(key string) string {
+	if impact, ok := settingImpacts[key]; ok {
+		return impact
+	}
+	return SettingImpactRestart
+}
+
+// SettingsChange is what saving settings changes: the settings that change, the
+// impact of each and whether it takes effect at once, whether Xray is restarted
+// for them and with what changes to its config, and whether the panel has to be
+// restarted.
+type SettingsChange struct {
+	Changed      []string          `json:"changed"`
+	Impacts      map[string]string `json:"impacts"`
+	HotApplied   map[string]bool   `json:"hotApplied"`
+	XrayRestart  bool              `json:"xrayRestart"`
+	PanelRestart bool              `json:"panelRestart"`
+	Diff         ConfigDiff        `json:"diff"`
+}
+
+// settingValues returns the settings of allSetting by their keys, as they are
+// saved.
+func settingValues(allSetting *entity.AllSetting) map[string]string {
+	v := reflect.ValueOf(allSetting).Elem()
+	values := map[string]string{}
+	for _, field := range reflect_util.GetFields(v.Type()) {
+		values[field.Tag.Get("json")] = fmt.Sprint(v.FieldByName(field.Name).Interface())
+	}
+	return values
+}
+
+// configWith generates the config of Xray with values instead of the saved
+// settings. Nothing is saved or applied.
+func (s *XrayService) configWith(values map[string]string) (*xray.Config, error) {
+	settings := SettingService{overrides: values}
+	preview := &XrayService{
+		inboundService:  InboundService{settingService: settings},
+		routingService:  RoutingService{settingService: settings},
+		balancerService: BalancerService{settingService: settings},
+		settingService:  settings,
+	}
+	return preview.GetXrayConfig()
+}
+
+// SettingsChange returns what changing the settings from before to after
+// changes. The diff is of the configs generated with either, it is only made
+// if a setting of Xray changes.
+func (s *XrayService) SettingsChange(before, after *entity.AllSetting) (*SettingsChange, error) {
+	change := &SettingsChange{
+		Changed:    []string{},
+		Impacts:    map[string]string{},
+		HotApplied: map[string]bool{},
+		Diff:       ConfigDiff{Added: []string{}, Removed: []string{}, Changed: []string{}},
+	}
+	old, new := settingValues(before), settingValues(after)
+	for _, field := range reflect_util.GetFields(reflect.TypeOf(entity.AllSetting{})) {
+		key := field.Tag.Get("json")
+		if old[key] == new[key] {
+			continue
+		}
+		impact := settingImpact(key)
+		change.Changed = append(change.Changed, key)
+		change.Impacts[key] = impact
+		change.HotApplied[key] = impact == SettingImpactWeb || impact == SettingImpactRestart && settingIsLive(key)
+		change.XrayRestart = change.XrayRestart || impact == SettingImpactXray
+		change.PanelRestart = change.PanelRestart || impact == SettingImpactRestart && !change.HotApplied[key]
+	}
+	if !change.XrayRestart {
+		return change, nil
+	}
+	oldConfig, err := s.configWith(old)
+	if err != nil {
+		return nil, err
+	}
+	newConfig, err := s.configWith(new)
+	if err != nil {
+		return nil, err
+	}
+	if change.Diff, err = diffConfigs(oldConfig, newConfig); err != nil {
+		return nil, err
+	}
+	return change, nil
+}
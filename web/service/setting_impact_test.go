@@ -0,0 +1,107 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+
+	"x-ui/util/reflect_util"
+	"x-ui/web/entity"
+)
+
+func allSettingKeys() map[string]bool {
+	keys := map[string]bool{}
+	for _, field := range reflect_util.GetFields(reflect.TypeOf(entity.AllSetting{})) {
+		keys[field.Tag.Get("json")] = true
+	}
+	return keys
+}
+
+func TestSettingImpactsComplete(t *testing.T) {
+	keys := allSettingKeys()
+	seen := map[string]string{}
+	for impact, list := range map[string][]string{
+		SettingImpactXray:    xraySettings,
+		SettingImpactRestart: restartSettings,
+		SettingImpactWeb:     webSettings,
+	} {
+		for _, key := range list {
+			if other, ok := seen[key]; ok {
+				t.Errorf("setting %s is both of impact %s and %s", key, other, impact)
+			}
+			seen[key] = impact
+			if !keys[key] {
+				t.Errorf("setting %s of impact %s is not a setting of entity.AllSetting", key, impact)
+			}
+		}
+	}
+	for key := range keys {
+		if _, ok := seen[key]; !ok {
+			t.Errorf("setting %s has no impact declared", key)
+		}
+	}
+}
+
+func TestSettingsHaveDefaults(t *testing.T) {
+	for key := range allSettingKeys() {
+		if _, ok := defaultValueMap[key]; !ok {
+			t.Errorf("setting %s has no default", key)
+		}
+	}
+}
+
+func TestSettingImpactUnknown(t *testing.T) {
+	if impact := settingImpact("noSuchSetting"); impact != SettingImpactRestart {
+		t.Errorf("impact of an unknown setting = %q, want %q", impact, SettingImpactRestart)
+	}
+	if impact := settingImpact("pageSize"); impact != SettingImpactWeb {
+		t.Errorf("impact of pageSize = %q, want %q", impact, SettingImpactWeb)
+	}
+}
+
+func TestSettingsChangeImpacts(t *testing.T) {
+	before := &entity.AllSetting{PageSize: 25, WebPort: 2053}
+	after := &entity.AllSetting{PageSize: 50, WebPort: 2054}
+	var s XrayService
+	change, err := s.SettingsChange(before, after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(change.Changed, []string{"webPort", "pageSize"}) && !reflect.DeepEqual(change.Changed, []string{"pageSize", "webPort"}) {
+		t.Fatalf("changed = %v", change.Changed)
+	}
+	if !change.HotApplied["pageSize"] || change.HotApplied["webPort"] {
+		t.Errorf("hot applied = %v", change.HotApplied)
+	}
+	if !change.PanelRestart || change.XrayRestart {
+		t.Errorf("panel restart = %v, xray restart = %v", change.PanelRestart, change.XrayRestart)
+	}
+}
+
+func TestSettingsChangeHotAppliedByListener(t *testing.T) {
+	before := &entity.AllSetting{TgRunTime: "@daily", WebPort: 2053}
+	after := &entity.AllSetting{TgRunTime: "@hourly", WebPort: 2054}
+	var s XrayService
+	// The runtime of the bot needs a restart, unless its job is rescheduled live
+	change, err := s.SettingsChange(before, after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if change.HotApplied["tgRunTime"] || !change.PanelRestart {
+		t.Errorf("without a listener hot applied = %v, panel restart = %v", change.HotApplied, change.PanelRestart)
+	}
+	stop := OnSettingChange(func(string, string) {}, "tgRunTime")
+	defer stop()
+	if change, err = s.SettingsChange(before, after); err != nil {
+		t.Fatal(err)
+	}
+	if !change.HotApplied["tgRunTime"] || change.HotApplied["webPort"] || !change.PanelRestart {
+		t.Errorf("with a listener hot applied = %v, panel restart = %v", change.HotApplied, change.PanelRestart)
+	}
+	after.WebPort = 2053
+	if change, err = s.SettingsChange(before, after); err != nil {
+		t.Fatal(err)
+	}
+	if !change.HotApplied["tgRunTime"] || change.PanelRestart {
+		t.Errorf("live only, hot applied = %v, panel restart = %v", change.HotApplied, change.PanelRestart)
+	}
+}
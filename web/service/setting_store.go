@@ -0,0 +1,280 @@
+package service
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/common"
+
+	"gorm.io/gorm"
+)
+
+// settingsTTL is how long the settings are read from memory before they are
+// loaded again, for the changes the x-ui command makes in another process
+const settingsTTL = 5 * time.Second
+
+// SettingListener is called with a setting that changed and its new value.
+type SettingListener func(key string, value string)
+
+var (
+	// settingStore holds the saved settings, loaded all at once. Readers share
+	// it, saving a setting updates it along with the database.
+	settingStore struct {
+		sync.RWMutex
+		values   map[string]string
+		db       *gorm.DB
+		loadedAt time.Time
+	}
+
+	settingListenersMu sync.RWMutex
+	settingListeners   = map[string][]*settingListener{}
+)
+
+// settingListener is a listener as registered, to tell it apart when removed
+type settingListener struct {
+	listener SettingListener
+}
+
+// OnSettingChange calls listener after one of keys changed, saved by the panel
+// or loaded as another process changed it, and returns the func to stop it. A
+// listener applies the change live, the settings it listens to take effect
+// without restarting the panel.
+func OnSettingChange(listener SettingListener, keys ...string) func() {
+	registered := &settingListener{listener: listener}
+	settingListenersMu.Lock()
+	defer settingListenersMu.Unlock()
+	for _, key := range keys {
+		settingListeners[key] = append(settingListeners[key], registered)
+	}
+	return func() {
+		settingListenersMu.Lock()
+		defer settingListenersMu.Unlock()
+		for _, key := range keys {
+			listeners := settingListeners[key][:0]
+			for _, l := range settingListeners[key] {
+				if l != registered {
+					listeners = append(listeners, l)
+				}
+			}
+			if len(listeners) == 0 {
+				delete(settingListeners, key)
+			} else {
+				settingListeners[key] = listeners
+			}
+		}
+	}
+}
+
+// settingIsLive tells whether a listener applies the changes of key live.
+func settingIsLive(key string) bool {
+	settingListenersMu.RLock()
+	defer settingListenersMu.RUnlock()
+	return len(settingListeners[key]) > 0
+}
+
+// notifySettings calls the listeners of the settings that changed.
+func notifySettings(changed map[string]string) {
+	for key, value := range changed {
+		settingListenersMu.RLock()
+		listeners := append([]*settingListener(nil), settingListeners[key]...)
+		settingListenersMu.RUnlock()
+		for _, l := range listeners {
+			l.listener(key, value)
+		}
+	}
+}
+
+// InvalidateSettings has the settings loaded again on their next read, after
+// they were written to the database other than by saving them.
+func InvalidateSettings() {
+	settingStore.Lock()
+	settingStore.loadedAt = time.Time{}
+	settingStore.Unlock()
+}
+
+// settingsFresh tells whether the settings in memory can be read. Called with
+// the lock of the store held.
+func settingsFresh(db *gorm.DB) bool {
+	return settingStore.values != nil && settingStore.db == db && time.Since(settingStore.loadedAt) < settingsTTL
+}
+
+// loadSettings loads the settings from the database, unless they are fresh, and
+// returns those that changed since they were last loaded. Called with the lock
+// of the store held.
+func loadSettings(db *gorm.DB) (map[string]string, error) {
+	if settingsFresh(db) {
+		return map[string]string{}, nil
+	}
+	settings := make([]*model.Setting, 0)
+	if err := db.Model(model.Setting{}).Find(&settings).Error; err != nil {
+		return nil, err
+	}
+	values := make(map[string]string, len(settings))
+	for _, setting := range settings {
+		values[setting.Key] = setting.Value
+	}
+
+	// A change of the database, like a restore, tells the listeners nothing
+	changed := map[string]string{}
+	if settingStore.values != nil && settingStore.db == db {
+		for key, value := range values {
+			if old, ok := settingStore.values[key]; !ok || old != value {
+				changed[key] = value
+			}
+		}
+		for key := range settingStore.values {
+			if _, ok := values[key]; !ok {
+				changed[key] = defaultValueMap[key]
+			}
+		}
+	}
+	settingStore.values = values
+	settingStore.db = db
+	settingStore.loadedAt = time.Now()
+	return changed, nil
+}
+
+// savedSetting returns the saved value of key, and whether it has one.
+func savedSetting(key string) (string, bool, error) {
+	db := database.GetDB()
+	settingStore.RLock()
+	if settingsFresh(db) {
+		value, ok := settingStore.values[key]
+		settingStore.RUnlock()
+		return value, ok, nil
+	}
+	settingStore.RUnlock()
+
+	settingStore.Lock()
+	changed, err := loadSettings(db)
+	value, ok := settingStore.values[key]
+	settingStore.Unlock()
+	if err != nil {
+		return "", false, err
+	}
+	notifySettings(changed)
+	return value, ok, nil
+}
+
+// savedSettings returns all the saved settings.
+func savedSettings() (map[string]string, error) {
+	db := database.GetDB()
+	settingStore.Lock()
+	changed, err := loadSettings(db)
+	values := make(map[string]string, len(settingStore.values))
+	for key, value := range settingStore.values {
+		values[key] = value
+	}
+	settingStore.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	notifySettings(changed)
+	return values, nil
+}
+
+// storeSetting saves value as the setting key and tells the listeners if it
+// changed.
+func storeSetting(key string, value string) error {
+	db := database.GetDB()
+	settingStore.Lock()
+	changed, err := loadSettings(db)
+	if err != nil {
+		settingStore.Unlock()
+		return err
+	}
+	old, ok := settingStore.values[key]
+	if !ok {
+		err = db.Create(&model.Setting{Key: key, Value: value}).Error
+	} else if old != value {
+		err = db.Model(model.Setting{}).Where(map[string]any{"key": key}).Update("value", value).Error
+	}
+	if err == nil {
+		settingStore.values[key] = value
+		if ok && old != value || !ok && defaultValueMap[key] != value {
+			changed[key] = value
+		}
+	}
+	settingStore.Unlock()
+	notifySettings(changed)
+	return err
+}
+
+// GetString returns the setting key, its default if it isn't saved.
+func (s *SettingService) GetString(key string) (string, error) {
+	if value, ok := s.overrides[key]; ok {
+		return value, nil
+	}
+	value, ok, err := savedSetting(key)
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		return value, nil
+	}
+	value, ok = defaultValueMap[key]
+	if !ok {
+		return "", common.NewErrorf("key <%v> not in defaultValueMap", key)
+	}
+	return value, nil
+}
+
+// typedSetting returns the setting key parsed by parse. A saved value that
+// doesn't parse gives way to the default, which the settings are validated
+// against when they are saved.
+func typedSetting[T any](s *SettingService, key string, parse func(string) (T, error)) (T, error) {
+	var zero T
+	str, err := s.GetString(key)
+	if err != nil {
+		return zero, err
+	}
+	value, err := parse(str)
+	if err == nil {
+		return value, nil
+	}
+	fallback, ok := defaultValueMap[key]
+	if !ok || fallback == str {
+		return zero, err
+	}
+	logger.Warningf("setting %s is not valid (%v), using its default %q", key, err, fallback)
+	return parse(fallback)
+}
+
+// GetInt returns the setting key as an integer.
+func (s *SettingService) GetInt(key string) (int, error) {
+	return typedSetting(s, key, func(str string) (int, error) {
+		return strconv.Atoi(strings.TrimSpace(str))
+	})
+}
+
+// GetBool returns the setting key as a boolean.
+func (s *SettingService) GetBool(key string) (bool, error) {
+	return typedSetting(s, key, strconv.ParseBool)
+}
+
+// GetDuration returns the setting key, an integer of units, as a duration.
+func (s *SettingService) GetDuration(key string, unit time.Duration) (time.Duration, error) {
+	return typedSetting(s, key, func(str string) (time.Duration, error) {
+		n, err := strconv.Atoi(strings.TrimSpace(str))
+		return time.Duration(n) * unit, err
+	})
+}
+
+// GetStringSlice returns the setting key as the items of a list separated by
+// commas or new lines, without the empty ones.
+func (s *SettingService) GetStringSlice(key string) ([]string, error) {
+	return typedSetting(s, key, func(str string) ([]string, error) {
+		items := make([]string, 0)
+		for _, item := range strings.FieldsFunc(str, func(r rune) bool { return r == ',' || r == '\n' }) {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		return items, nil
+	})
+}
@@ -0,0 +1,189 @@
+package service
+
+import (
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+)
+
+func TestTypedSettings(t *testing.T) {
+	newTestDB(t)
+	s := &SettingService{}
+	for key, value := range map[string]string{
+		"pageSize":        " 50 ",
+		"subEnable":       "true",
+		"sessionMaxAge":   "90",
+		"metricsAllowIPs": "10.0.0.0/8, ,192.168.0.0/16\n172.16.0.0/12,",
+		"expireDiff":      "soon",
+	} {
+		if err := s.setString(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, err := s.GetInt("pageSize"); err != nil || n != 50 {
+		t.Errorf("GetInt gave %d, %v", n, err)
+	}
+	if on, err := s.GetBool("subEnable"); err != nil || !on {
+		t.Errorf("GetBool gave %v, %v", on, err)
+	}
+	if d, err := s.GetDuration("sessionMaxAge", time.Minute); err != nil || d != 90*time.Minute {
+		t.Errorf("GetDuration gave %v, %v", d, err)
+	}
+	if items, err := s.GetStringSlice("corsAllowedMethods"); err != nil || len(items) != 4 || items[3] != "DELETE" {
+		t.Errorf("GetStringSlice of the default gave %q, %v", items, err)
+	}
+	items, err := s.GetStringSlice("metricsAllowIPs")
+	if want := []string{"10.0.0.0/8", "192.168.0.0/16", "172.16.0.0/12"}; err != nil || !slices.Equal(items, want) {
+		t.Errorf("GetStringSlice gave %q, %v; want %q", items, err, want)
+	}
+	// A saved value that isn't valid gives way to the default
+	if n, err := s.GetInt("expireDiff"); err != nil || n != 0 {
+		t.Errorf("GetInt of an invalid value gave %d, %v", n, err)
+	}
+	if _, err := s.GetString("noSuchSetting"); err == nil {
+		t.Error("a setting without a default was read")
+	}
+}
+
+func TestConcurrentSettings(t *testing.T) {
+	newTestDB(t)
+	s := &SettingService{}
+	if err := s.setInt("pageSize", 1000); err != nil {
+		t.Fatal(err)
+	}
+	// While pageSize is updated, and loaded again, the readers see one of its
+	// values and never go without it
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	errs := make(chan string, 100)
+	for range 8 {
+		wg.Go(func() {
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				n, err := s.GetInt("pageSize")
+				if err != nil || n < 1000 || n > 1100 {
+					errs <- "pageSize is " + strconv.Itoa(n)
+					return
+				}
+				all, err := savedSettings()
+				if err != nil {
+					errs <- err.Error()
+					return
+				}
+				if _, ok := all["pageSize"]; !ok {
+					errs <- "the settings have no pageSize"
+					return
+				}
+			}
+		})
+	}
+	for i := range 100 {
+		if err := s.setInt("pageSize", 1000+i+1); err != nil {
+			t.Fatal(err)
+		}
+		if i%10 == 0 {
+			// As after a change by the x-ui command
+			InvalidateSettings()
+		}
+	}
+	close(stop)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if n, err := s.GetInt("pageSize"); err != nil || n != 1100 {
+		t.Errorf("after the updates pageSize is %d, %v", n, err)
+	}
+	var stored model.Setting
+	if err := database.GetDB().Where("key = ?", "pageSize").First(&stored).Error; err != nil || stored.Value != "1100" {
+		t.Errorf("the database has pageSize %q, %v", stored.Value, err)
+	}
+}
+
+func TestSettingListeners(t *testing.T) {
+	newTestDB(t)
+	s := &SettingService{}
+	type change struct{ key, value string }
+	var mu sync.Mutex
+	var changes []change
+	listen := func(key, value string) {
+		mu.Lock()
+		changes = append(changes, change{key, value})
+		mu.Unlock()
+	}
+	took := func() []change {
+		mu.Lock()
+		defer mu.Unlock()
+		taken := changes
+		changes = nil
+		return taken
+	}
+	stop := OnSettingChange(listen, "backupCron", "backupEnable")
+	if !settingIsLive("backupCron") || settingIsLive("pageSize") {
+		t.Error("the live settings are not those listened to")
+	}
+
+	// Saved by the panel
+	if err := s.setString("backupCron", "0 30 2 * * *"); err != nil {
+		t.Fatal(err)
+	}
+	if got := took(); len(got) != 1 || got[0] != (change{"backupCron", "0 30 2 * * *"}) {
+		t.Errorf("saving the setting told %v", got)
+	}
+	// Saved the same, or its default, or another setting: nothing changed
+	s.setString("backupCron", "0 30 2 * * *")
+	s.setBool("backupEnable", false)
+	s.setInt("pageSize", 30)
+	if got := took(); len(got) != 0 {
+		t.Errorf("saving unchanged settings told %v", got)
+	}
+
+	// Changed by another process, the change is told as it is loaded
+	if err := database.GetDB().Model(model.Setting{}).Where("key = ?", "backupCron").Update("value", "0 0 5 * * *").Error; err != nil {
+		t.Fatal(err)
+	}
+	InvalidateSettings()
+	if cron, _ := s.GetBackupCron(); cron != "0 0 5 * * *" {
+		t.Errorf("backupCron is %q", cron)
+	}
+	if got := took(); len(got) != 1 || got[0] != (change{"backupCron", "0 0 5 * * *"}) {
+		t.Errorf("loading the change told %v", got)
+	}
+	// Removed, it is back to its default
+	if err := database.GetDB().Where("key = ?", "backupCron").Delete(model.Setting{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	InvalidateSettings()
+	s.GetBackupCron()
+	if got := took(); len(got) != 1 || got[0] != (change{"backupCron", defaultValueMap["backupCron"]}) {
+		t.Errorf("removing the setting told %v", got)
+	}
+
+	// Another database, as after a restore, tells nothing
+	newTestDB(t)
+	if err := database.GetDB().Create(&model.Setting{Key: "backupCron", Value: "0 0 6 * * *"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if cron, _ := s.GetBackupCron(); cron != "0 0 6 * * *" {
+		t.Errorf("backupCron of the new database is %q", cron)
+	}
+	if got := took(); len(got) != 0 {
+		t.Errorf("the new database told %v", got)
+	}
+
+	stop()
+	s.setString("backupCron", "0 0 7 * * *")
+	if got := took(); len(got) != 0 || settingIsLive("backupCron") {
+		t.Errorf("the stopped listener was told %v", got)
+	}
+}
@@ -0,0 +1,393 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/json"
+	"math/big"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/util/crypto"
+	"x-ui/web/locale"
+	"x-ui/web/network"
+
+	"github.com/xlzd/gotp"
+	"gorm.io/gorm"
+)
+
+// The states of the first-run setup, as stored in the settings.
+const (
+	SetupPending = "pending"
+	SetupDone    = "done"
+)
+
+const (
+	// setupDefaultUsername and setupDefaultPassword are the credentials of the
+	// user the database is created with
+	setupDefaultUsername = "admin"
+	setupDefaultPassword = "admin"
+	// setupPasswordLength and setupNameLength are the lengths of the generated
+	// passwords, and of the generated usernames and base paths
+	setupPasswordLength = 24
+	setupNameLength     = 12
+	// setupPortMin and setupPortMax bound the generated ports
+	setupPortMin = 10000
+	setupPortMax = 60000
+	// setupAcmeHttpPort is where the HTTP-01 challenge of a certificate
+	// issued by the setup is answered
+	setupAcmeHttpPort = 80
+)
+
+// setupAlphabet leaves out the characters that are easily mistaken for others
+const setupAlphabet = "abcdefghijkmnopqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+var setupPathSegment = regexp.MustCompile(`^[A-Za-z0-9._~-]+$`)
+
+// setupLock lets one setup run at a time in the process, the state in the
+// database guards against the others
+var setupLock sync.Mutex
+
+// SetupForm is what the first-run setup sets the panel up with. The
+// username, password, base path and port are generated if empty.
+type SetupForm struct {
+	Username    string `json:"username" form:"username"`
+	Password    string `json:"password" form:"password"`
+	WebBasePath string `json:"webBasePath" form:"webBasePath"`
+	WebPort     int    `json:"webPort" form:"webPort"`
+	// The certificate of the panel: its files, or a domain to issue one for over
+	// ACME, with HTTP-01 on port 80
+	CertFile   string `json:"certFile" form:"certFile"`
+	KeyFile    string `json:"keyFile" form:"keyFile"`
+	AcmeDomain string `json:"acmeDomain" form:"acmeDomain"`
+	AcmeEmail  string `json:"acmeEmail" form:"acmeEmail"`
+	// TwoFactorSecret is from NewSetupTwoFactor and TwoFactorCode a code of it
+	// from the authenticator app, to turn two-factor authentication on
+	TwoFactorSecret string `json:"twoFactorSecret" form:"twoFactorSecret"`
+	TwoFactorCode   string `json:"twoFactorCode" form:"twoFactorCode"`
+}
+
+// SetupResult is how the panel was set up. The password is only returned
+// if it was generated, and never again.
+type SetupResult struct {
+	Username      string   `json:"username"`
+	Password      string   `json:"password,omitempty"`
+	WebBasePath   string   `json:"webBasePath"`
+	WebPort       int      `json:"webPort"`
+	AcmeDomain    string   `json:"acmeDomain,omitempty"`
+	TwoFactor     bool     `json:"twoFactor"`
+	RecoveryCodes []string `json:"recoveryCodes,omitempty"`
+	// Url is where the panel is after its restart
+	Url string `json:"url,omitempty"`
+}
+
+// SetupService sets up a new panel: until it did, the panel only serves the
+// setup.
+type SetupService struct {
+	settingService SettingService
+	userService    UserService
+	acmeService    AcmeService
+}
+
+// InitSetup finds out, once, whether the panel still has to be set up. It has
+// if its only user still has the default credentials, then nobody ever set
+// them; a panel set up otherwise is done.
+func (s *SetupService) InitSetup() error {
+	state, err := s.settingService.GetSetupState()
+	if err != nil || state != "" {
+		return err
+	}
+	users, err := s.userService.GetUsers()
+	if err != nil {
+		return err
+	}
+	state = SetupDone
+	if len(users) == 1 && users[0].Username == setupDefaultUsername && crypto.CheckPasswordHash(users[0].Password, setupDefaultPassword) {
+		state = SetupPending
+	}
+	return s.settingService.SetSetupState(state)
+}
+
+// Pending tells whether the panel still has to be set up.
+func (s *SetupService) Pending() bool {
+	state, err := s.settingService.GetSetupState()
+	if err != nil {
+		logger.Warning("Unable to get the state of the setup:", err)
+		return false
+	}
+	return state == SetupPending
+}
+
+// ResetSetup lets the panel be set up again, it is meant for the CLI.
+func (s *SetupService) ResetSetup() error {
+	return s.settingService.SetSetupState(SetupPending)
+}
+
+// NewSetupTwoFactor returns a new TOTP secret for the user of the setup. It
+// is not stored: the setup gets it back, with a code of it.
+func (s *SetupService) NewSetupTwoFactor(username string) (*TwoFactorSetup, error) {
+	if !s.Pending() {
+		return nil, locale.NewError(locale.ErrSetupDone)
+	}
+	username = strings.TrimSpace(username)
+	if username == "" {
+		return nil, common.NewError("username can not be empty")
+	}
+	secret := gotp.RandomSecret(totpSecretBytes)
+	if secret == "" {
+		return nil, common.NewError("unable to generate two-factor secret")
+	}
+	return &TwoFactorSetup{
+		Secret: secret,
+		URI:    gotp.NewDefaultTOTP(secret).ProvisioningUri(username, totpIssuer),
+	}, nil
+}
+
+// Setup sets up the panel with form, in one transaction, and marks it set up
+// for good. The panel has to be restarted on its new settings afterwards, and
+// the certificate of an ACME domain issued with IssueSetupCertificate.
+func (s *SetupService) Setup(form *SetupForm) (*SetupResult, error) {
+	setupLock.Lock()
+	defer setupLock.Unlock()
+	if !s.Pending() {
+		return nil, locale.NewError(locale.ErrSetupDone)
+	}
+
+	result := &SetupResult{}
+	var err error
+	if result.Username, err = setupUsername(form.Username); err != nil {
+		return nil, err
+	}
+	password := form.Password
+	if password == "" {
+		if password, err = randomSetupString(setupPasswordLength); err != nil {
+			return nil, err
+		}
+		result.Password = password
+	} else if IsWeakPassword(result.Username, password) {
+		return nil, common.NewErrorf("the password is too weak: it needs at least %d characters, and can not be the username nor a common password", minPasswordLength)
+	}
+	if result.WebBasePath, err = setupBasePath(form.WebBasePath); err != nil {
+		return nil, err
+	}
+	if result.WebPort, err = s.setupPort(form.WebPort); err != nil {
+		return nil, err
+	}
+
+	settings := map[string]string{
+		"webBasePath": result.WebBasePath,
+		"webPort":     strconv.Itoa(result.WebPort),
+		"webCertFile": strings.TrimSpace(form.CertFile),
+		"webKeyFile":  strings.TrimSpace(form.KeyFile),
+		"webCertAcme": "",
+	}
+	domain := strings.TrimSpace(form.AcmeDomain)
+	if settings["webCertFile"] != "" || settings["webKeyFile"] != "" {
+		if domain != "" {
+			return nil, common.NewError("give either the certificate files or an ACME domain")
+		}
+		if _, err := tls.LoadX509KeyPair(settings["webCertFile"], settings["webKeyFile"]); err != nil {
+			return nil, common.NewError("the certificate files do not load:", err)
+		}
+	}
+	if domain != "" {
+		acme := &AcmeSettings{
+			Email:     form.AcmeEmail,
+			Domains:   []string{domain},
+			Challenge: AcmeChallengeHTTP,
+			HttpPort:  setupAcmeHttpPort,
+		}
+		if err := acme.validate(); err != nil {
+			return nil, err
+		}
+		data, err := json.Marshal(acme)
+		if err != nil {
+			return nil, err
+		}
+		settings["acmeSettings"] = string(data)
+		result.AcmeDomain = acme.Domains[0]
+	}
+
+	user, err := s.userService.GetFirstUser()
+	if err != nil {
+		return nil, err
+	}
+	hashedPassword, err := s.userService.hashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+	updates := map[string]any{
+		"username":      result.Username,
+		"password":      hashedPassword,
+		"role":          model.RoleAdmin,
+		"weak_password": false,
+	}
+	if form.TwoFactorSecret != "" {
+		step := matchTOTP(form.TwoFactorSecret, strings.TrimSpace(form.TwoFactorCode), 0)
+		if step == 0 {
+			return nil, common.NewError("invalid two-factor code")
+		}
+		encrypted, err := s.userService.encryptSecret(form.TwoFactorSecret)
+		if err != nil {
+			return nil, err
+		}
+		codes, hashed, err := newRecoveryCodes()
+		if err != nil {
+			return nil, err
+		}
+		updates["totp_secret"] = encrypted
+		updates["totp_enabled"] = true
+		updates["totp_enabled_at"] = time.Now().UnixMilli()
+		updates["totp_last_step"] = step
+		updates["recovery_codes"] = hashed
+		result.TwoFactor = true
+		result.RecoveryCodes = codes
+	}
+
+	err = database.Transaction(func(tx *gorm.DB) error {
+		// Only one setup gets to flip the state, whichever process it runs in
+		flip := tx.Model(model.Setting{}).
+			Where(map[string]any{"key": "setupState", "value": SetupPending}).
+			Update("value", SetupDone)
+		if flip.Error != nil {
+			return flip.Error
+		}
+		if flip.RowsAffected == 0 {
+			return locale.NewError(locale.ErrSetupDone)
+		}
+		if err := tx.Model(model.User{}).Where("id = ?", user.Id).Updates(updates).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", user.Id).Delete(model.LoginSession{}).Error; err != nil {
+			return err
+		}
+		for key, value := range settings {
+			if err := tx.Where(map[string]any{"key": key}).Delete(model.Setting{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Create(&model.Setting{Key: key, Value: value}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	InvalidateSettings()
+	if err != nil {
+		return nil, err
+	}
+	logger.Infof("The panel was set up for %s on port %d", result.Username, result.WebPort)
+	return result, nil
+}
+
+// IssueSetupCertificate issues the certificate of the ACME domain of the setup,
+// and has the panel use it once it is issued.
+func (s *SetupService) IssueSetupCertificate(domain string) error {
+	if err := s.acmeService.Issue(domain); err != nil {
+		return err
+	}
+	return s.settingService.setString("webCertAcme", domain)
+}
+
+// setupUsername returns username, or a generated one if it is empty.
+func setupUsername(username string) (string, error) {
+	username = strings.TrimSpace(username)
+	if username != "" {
+		return username, nil
+	}
+	username, err := randomSetupString(setupNameLength)
+	return strings.ToLower(username), err
+}
+
+// setupBasePath returns basePath with slashes around it, or a generated one
+// if it is empty. The panel can not be left at the root.
+func setupBasePath(basePath string) (string, error) {
+	basePath = strings.Trim(strings.TrimSpace(basePath), "/")
+	if basePath == "" {
+		name, err := randomSetupString(setupNameLength)
+		if err != nil {
+			return "", err
+		}
+		return "/" + strings.ToLower(name) + "/", nil
+	}
+	for _, segment := range strings.Split(basePath, "/") {
+		if !setupPathSegment.MatchString(segment) {
+			return "", common.NewErrorf("the base path %q may only have letters, digits and ._~- between its slashes", basePath)
+		}
+	}
+	return "/" + basePath + "/", nil
+}
+
+// setupPort returns port after checking that the panel can listen on it, or
+// a free one if it is 0.
+func (s *SetupService) setupPort(port int) (int, error) {
+	if port < 0 || port > 65535 {
+		return 0, common.NewError("web port is not a valid port:", port)
+	}
+	current, err := s.settingService.GetPort()
+	if err != nil {
+		return 0, err
+	}
+	subPort, err := s.settingService.GetSubPort()
+	if err != nil {
+		return 0, err
+	}
+	listen, err := s.settingService.GetListen()
+	if err != nil {
+		return 0, err
+	}
+	free := func(port int) bool {
+		if port == subPort {
+			return false
+		}
+		if _, isSocket := network.UnixSocketPath(listen); isSocket || port == current {
+			return true
+		}
+		listener, err := net.Listen("tcp", net.JoinHostPort(listen, strconv.Itoa(port)))
+		if err != nil {
+			return false
+		}
+		listener.Close()
+		return true
+	}
+	if port != 0 {
+		if port == defaultWebPort {
+			return 0, common.NewErrorf("the panel can not be left on its default port %d", defaultWebPort)
+		}
+		if !free(port) {
+			return 0, common.NewErrorf("port %d is in use", port)
+		}
+		return port, nil
+	}
+	for range 20 {
+		n, err := rand.Int(rand.Reader, big.NewInt(setupPortMax-setupPortMin))
+		if err != nil {
+			return 0, err
+		}
+		if port := setupPortMin + int(n.Int64()); free(port) {
+			return port, nil
+		}
+	}
+	return 0, common.NewError("no free port was found for the panel")
+}
+
+// randomSetupString returns length random characters of setupAlphabet.
+func randomSetupString(length int) (string, error) {
+	max := big.NewInt(int64(len(setupAlphabet)))
+	chars := make([]byte, length)
+	for i := range chars {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		chars[i] = setupAlphabet[n.Int64()]
+	}
+	return string(chars), nil
+}
@@ -0,0 +1,167 @@
+package service
+
+import (
+	"encoding/base64"
+	"strings"
+
+	"x-ui/database/model"
+	"x-ui/util/common"
+
+	"github.com/goccy/go-json"
+)
+
+// ssKeyLengths are the lengths in bytes of the base64 keys the Shadowsocks 2022
+// methods take, for the inbound and for each client alike.
+var ssKeyLengths = map[string]int{
+	"2022-blake3-aes-128-gcm":       16,
+	"2022-blake3-aes-256-gcm":       32,
+	"2022-blake3-chacha20-poly1305": 32,
+}
+
+// isSS2022 tells whether method is a Shadowsocks 2022 method.
+func isSS2022(method string) bool {
+	return strings.HasPrefix(method, "2022")
+}
+
+// ssMultiUser tells whether Xray takes clients on an inbound of method; the
+// 2022 ChaCha20 method only has the key of the inbound.
+func ssMultiUser(method string) bool {
+	return method != "2022-blake3-chacha20-poly1305"
+}
+
+// shadowsocksMethod returns the cipher of a Shadowsocks inbound.
+func shadowsocksMethod(inbound *model.Inbound) string {
+	settings := map[string]any{}
+	json.Unmarshal([]byte(inbound.Settings), &settings)
+	method, _ := settings["method"].(string)
+	return method
+}
+
+// shadowsocksKey returns the key of a Shadowsocks inbound, its own with a 2022
+// method besides those of its clients.
+func shadowsocksKey(inbound *model.Inbound) string {
+	settings := map[string]any{}
+	json.Unmarshal([]byte(inbound.Settings), &settings)
+	key, _ := settings["password"].(string)
+	return key
+}
+
+// checkSSKey checks that key is the base64 of length bytes.
+func checkSSKey(key string, length int) error {
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(decoded) != length {
+		return common.NewErrorf("must be the base64 of a key of %d bytes", length)
+	}
+	return nil
+}
+
+// checkShadowsocksKeys checks that the key of a Shadowsocks inbound and those
+// of clients fit its method: with a 2022 method they are all keys of its
+// length. It returns the index of the first client that fails, -1 if the error
+// isn't about a client.
+func checkShadowsocksKeys(inbound *model.Inbound, clients []model.Client) (int, error) {
+	if inbound.Protocol != model.Shadowsocks {
+		return -1, nil
+	}
+	method := shadowsocksMethod(inbound)
+	length, ok := ssKeyLengths[method]
+	if !ok {
+		for i, client := range clients {
+			if client.Password == "" {
+				return i, common.NewErrorf("client %s has no password", client.Email)
+			}
+		}
+		return -1, nil
+	}
+	if err := checkSSKey(shadowsocksKey(inbound), length); err != nil {
+		return -1, common.NewErrorf("the key of the inbound for %s %v", method, err)
+	}
+	if !ssMultiUser(method) && len(clients) > 0 {
+		return 0, common.NewErrorf("%s has no clients, only the key of the inbound", method)
+	}
+	for i, client := range clients {
+		if err := checkSSKey(client.Password, length); err != nil {
+			return i, common.NewErrorf("the key of client %s for %s %v", client.Email, method, err)
+		}
+	}
+	return -1, nil
+}
+
+// fillShadowsocksClients gives the clients of settings that have no key one of
+// the length method takes, and the clients the method Xray expects of them:
+// none with a 2022 method, the one of the inbound with the others.
+func fillShadowsocksClients(settings string, method string) (string, error) {
+	var parsed map[string]any
+	if err := json.Unmarshal([]byte(settings), &parsed); err != nil {
+		return settings, nil
+	}
+	clients, _ := parsed["clients"].([]any)
+	if len(clients) == 0 {
+		return settings, nil
+	}
+	clientMethod := method
+	if isSS2022(method) {
+		clientMethod = ""
+	}
+	for _, item := range clients {
+		client, ok := item.(map[string]any)
+		if !ok {
+			continue
+		}
+		if password, _ := client["password"].(string); password == "" {
+			client["password"] = randomShadowsocksPassword(method)
+		}
+		client["method"] = clientMethod
+	}
+	filled, err := json.MarshalIndent(parsed, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(filled), nil
+}
+
+// migrateShadowsocksKeys carries the keys of a Shadowsocks inbound over a change
+// of its method. With the migration asked for, the inbound and all its clients
+// get new keys of the length of the new method; without it, a change between
+// methods with other keys fails while the inbound has clients, whose links
+// would stop working.
+func (s *InboundService) migrateShadowsocksKeys(oldInbound *model.Inbound, inbound *model.Inbound) error {
+	if inbound.Protocol != model.Shadowsocks {
+		return nil
+	}
+	method := shadowsocksMethod(inbound)
+	if inbound.MigrateShadowsocksKeys {
+		var settings map[string]any
+		if err := json.Unmarshal([]byte(inbound.Settings), &settings); err != nil {
+			return err
+		}
+		if isSS2022(method) {
+			settings["password"] = randomShadowsocksPassword(method)
+		}
+		clients, _ := settings["clients"].([]any)
+		for _, item := range clients {
+			if client, ok := item.(map[string]any); ok {
+				client["password"] = ""
+			}
+		}
+		migrated, err := json.MarshalIndent(settings, "", "  ")
+		if err != nil {
+			return err
+		}
+		inbound.Settings, err = fillShadowsocksClients(string(migrated), method)
+		return err
+	}
+
+	if oldInbound.Protocol != model.Shadowsocks {
+		return nil
+	}
+	oldMethod := shadowsocksMethod(oldInbound)
+	if isSS2022(oldMethod) == isSS2022(method) && ssKeyLengths[oldMethod] == ssKeyLengths[method] {
+		return nil
+	}
+	oldClients, err := s.GetClients(oldInbound)
+	if err != nil || len(oldClients) == 0 {
+		return err
+	}
+	return common.NewErrorf("switching from %s to %s changes the keys of the clients, migrate the keys to regenerate them all", oldMethod, method)
+}
@@ -0,0 +1,412 @@
+package service
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/common"
+
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// statusRingSize is how many samples are kept in memory, the last hour of
+	// them at the default interval
+	statusRingSize = 1800
+	// statusHistoryBatch is how many minutes are held before they are written
+	// to the history at once
+	statusHistoryBatch = 10
+	// maxStatusPending bounds the minutes held while the database can't be
+	// written, a day of them
+	maxStatusPending = 24 * 60
+	// maxStatusHistoryPoints is the most buckets a status history has
+	maxStatusHistoryPoints = 2400
+)
+
+// StatusSample is the status of the server at Time, in milliseconds, the
+// rates in bytes per second.
+type StatusSample struct {
+	Time     int64
+	Cpu      float64
+	Mem      uint64
+	Swap     uint64
+	Disk     uint64
+	NetUp    uint64
+	NetDown  uint64
+	TcpCount int
+	XrayMem  uint64
+}
+
+// statusSeriesNames are the series of a StatusHistory.
+var statusSeriesNames = []string{"cpu", "mem", "swap", "disk", "netUp", "netDown", "tcpCount", "xrayMem"}
+
+func (s *StatusSample) values() []float64 {
+	return []float64{s.Cpu, float64(s.Mem), float64(s.Swap), float64(s.Disk), float64(s.NetUp), float64(s.NetDown), float64(s.TcpCount), float64(s.XrayMem)}
+}
+
+func statusMinuteValues(m *model.StatusMinute) []float64 {
+	return []float64{m.Cpu, float64(m.Mem), float64(m.Swap), float64(m.Disk), float64(m.NetUp), float64(m.NetDown), float64(m.TcpCount), float64(m.XrayMem)}
+}
+
+// StatusHistory is the status of the server from From to To by buckets of
+// Step milliseconds starting at Times, every bucket included. The series are
+// aligned on Times, a bucket without a sample is null in all of them; CPU is
+// in percent, the rates in bytes per second and the rest in bytes.
+type StatusHistory struct {
+	Resolution string                `json:"resolution"`
+	From       int64                 `json:"from"`
+	To         int64                 `json:"to"`
+	Step       int64                 `json:"step"`
+	Times      []int64               `json:"times"`
+	Series     map[string][]*float64 `json:"series"`
+}
+
+// StatusHistoryQuery picks a range of the status history. From and To are in
+// milliseconds; the buckets holding them are included.
+type StatusHistoryQuery struct {
+	From       int64  `form:"from"`
+	To         int64  `form:"to"`
+	Resolution string `form:"resolution"`
+}
+
+// statusSampler keeps the samples of the status job: the last status for the
+// dashboard, the recent samples, and the minutes that are yet to be written.
+type statusSampler struct {
+	lock     sync.RWMutex
+	last     *Status
+	interval time.Duration
+	ring     [statusRingSize]StatusSample
+	next     int
+	count    int
+	// minute are the samples of the minute being sampled
+	minute  []StatusSample
+	pending []model.StatusMinute
+
+	subscribers map[chan *Status]bool
+}
+
+var sampler = &statusSampler{subscribers: map[chan *Status]bool{}}
+
+// SampleStatus takes a status of the server, keeps it for the dashboard and
+// the history, and sends it to the subscribers. The minutes are written to
+// the history by batches.
+func (s *ServerService) SampleStatus(interval time.Duration) {
+	sampler.lock.RLock()
+	last := sampler.last
+	sampler.lock.RUnlock()
+	status := s.GetStatus(last)
+	sample := StatusSample{
+		Time:     status.T.UnixMilli(),
+		Cpu:      status.Cpu,
+		Mem:      status.Mem.Current,
+		Swap:     status.Swap.Current,
+		Disk:     status.Disk.Current,
+		TcpCount: status.TcpCount,
+		XrayMem:  status.Xray.Mem,
+	}
+	// The first status has no rates, it has nothing to be measured against
+	if last != nil {
+		sample.NetUp = status.NetIO.Up
+		sample.NetDown = status.NetIO.Down
+	}
+
+	sampler.lock.Lock()
+	sampler.last = status
+	sampler.interval = interval
+	sampler.ring[sampler.next] = sample
+	sampler.next = (sampler.next + 1) % statusRingSize
+	sampler.count = min(sampler.count+1, statusRingSize)
+	if len(sampler.minute) > 0 && minuteStart(sampler.minute[0].Time) != minuteStart(sample.Time) {
+		sampler.pending = append(sampler.pending, averageMinute(sampler.minute))
+		sampler.minute = nil
+	}
+	sampler.minute = append(sampler.minute, sample)
+	flush := len(sampler.pending) >= statusHistoryBatch
+	for subscriber := range sampler.subscribers {
+		// A subscriber still busy with the status before gets the next one
+		select {
+		case subscriber <- status:
+		default:
+		}
+	}
+	sampler.lock.Unlock()
+	s.publishLiveStats(status)
+
+	if flush {
+		if err := s.FlushStatusHistory(); err != nil {
+			logger.Warning("write status history failed:", err)
+		}
+	}
+}
+
+// GetLastStatus returns the last status the status job took, nil if it took
+// none yet.
+func (s *ServerService) GetLastStatus() *Status {
+	sampler.lock.RLock()
+	defer sampler.lock.RUnlock()
+	return sampler.last
+}
+
+// SubscribeStatus returns a channel getting every status the status job
+// takes, and the function ending the subscription, which closes it.
+func (s *ServerService) SubscribeStatus() (<-chan *Status, func()) {
+	updates := make(chan *Status, 1)
+	sampler.lock.Lock()
+	sampler.subscribers[updates] = true
+	sampler.lock.Unlock()
+	var once sync.Once
+	return updates, func() {
+		once.Do(func() {
+			sampler.lock.Lock()
+			delete(sampler.subscribers, updates)
+			sampler.lock.Unlock()
+			close(updates)
+		})
+	}
+}
+
+// FlushStatusHistory writes the minutes sampled so far to the history, the
+// one being sampled included. The minutes that can't be written are kept for
+// the next time.
+func (s *ServerService) FlushStatusHistory() error {
+	sampler.lock.Lock()
+	minutes := sampler.pending
+	sampler.pending = nil
+	// The minute being sampled is written again once it is over
+	current := append([]model.StatusMinute{}, minutes...)
+	if len(sampler.minute) > 0 {
+		current = append(current, averageMinute(sampler.minute))
+	}
+	sampler.lock.Unlock()
+	if len(current) == 0 {
+		return nil
+	}
+
+	err := database.GetDB().Clauses(clause.OnConflict{UpdateAll: true}).CreateInBatches(current, statusHistoryBatch*10).Error
+	if err != nil {
+		sampler.lock.Lock()
+		sampler.pending = append(minutes, sampler.pending...)
+		if len(sampler.pending) > maxStatusPending {
+			sampler.pending = sampler.pending[len(sampler.pending)-maxStatusPending:]
+		}
+		sampler.lock.Unlock()
+	}
+	return err
+}
+
+// PruneStatusHistory deletes the minutes of the status history older than
+// days, none if days is 0.
+func (s *ServerService) PruneStatusHistory(days int) (int64, error) {
+	if days <= 0 {
+		return 0, nil
+	}
+	cutoff := dayStart(time.Now().AddDate(0, 0, -days)).UnixMilli()
+	result := database.GetDB().Where("minute < ?", cutoff).Delete(model.StatusMinute{})
+	return result.RowsAffected, result.Error
+}
+
+// GetStatusHistory returns the status of the server over a range: the samples
+// kept in memory with the raw resolution, or the history by minutes or hours.
+// It covers the last hour of samples, the last day by minutes or the last week
+// by hours unless told otherwise.
+func (s *ServerService) GetStatusHistory(query StatusHistoryQuery) (*StatusHistory, error) {
+	var step time.Duration
+	var span time.Duration
+	bucket := func(t time.Time) time.Time { return t.Truncate(step) }
+	switch query.Resolution {
+	case "minute", "":
+		query.Resolution = "minute"
+		step, span = time.Minute, 24*time.Hour
+	case "raw":
+		sampler.lock.RLock()
+		step = sampler.interval
+		sampler.lock.RUnlock()
+		if step <= 0 {
+			return nil, common.NewError("the status has not been sampled yet")
+		}
+		span = time.Hour
+	case "hour":
+		step, span = time.Hour, 7*24*time.Hour
+		bucket = hourStart
+	default:
+		return nil, common.NewErrorf("unknown status history resolution: %s", query.Resolution)
+	}
+
+	to := time.Now()
+	if query.To > 0 {
+		to = time.UnixMilli(query.To)
+	}
+	from := to.Add(-span)
+	if query.From > 0 {
+		from = time.UnixMilli(query.From)
+	}
+	if from.After(to) {
+		return nil, common.NewError("the status history range starts after it ends")
+	}
+	if to.Sub(bucket(from))/step >= maxStatusHistoryPoints {
+		return nil, common.NewErrorf("the status history range has more than %d buckets, use a coarser resolution", maxStatusHistoryPoints)
+	}
+
+	history := &StatusHistory{
+		Resolution: query.Resolution,
+		From:       bucket(from).UnixMilli(),
+		To:         to.UnixMilli(),
+		Step:       step.Milliseconds(),
+		Times:      []int64{},
+		Series:     map[string][]*float64{},
+	}
+	index := map[int64]int{}
+	for t := bucket(from); !t.After(to); t = t.Add(step) {
+		index[t.UnixMilli()] = len(history.Times)
+		history.Times = append(history.Times, t.UnixMilli())
+	}
+	sums := make([][]float64, len(history.Times))
+	counts := make([]int, len(history.Times))
+	add := func(at int64, values []float64) {
+		i, ok := index[bucket(time.UnixMilli(at)).UnixMilli()]
+		if !ok {
+			return
+		}
+		if sums[i] == nil {
+			sums[i] = make([]float64, len(values))
+		}
+		for j, value := range values {
+			sums[i][j] += value
+		}
+		counts[i]++
+	}
+
+	if query.Resolution == "raw" {
+		for _, sample := range recentSamples(history.From, history.To) {
+			add(sample.Time, sample.values())
+		}
+	} else {
+		minutes, err := s.statusMinutes(history.From, history.To)
+		if err != nil {
+			return nil, err
+		}
+		for _, minute := range minutes {
+			add(minute.Minute, statusMinuteValues(&minute))
+		}
+	}
+
+	for j, name := range statusSeriesNames {
+		series := make([]*float64, len(history.Times))
+		for i := range series {
+			if counts[i] > 0 {
+				average := sums[i][j] / float64(counts[i])
+				series[i] = &average
+			}
+		}
+		history.Series[name] = series
+	}
+	return history, nil
+}
+
+// statusMinutes returns the minutes of the history from from to to, the ones
+// not written yet and the one being sampled included.
+func (s *ServerService) statusMinutes(from int64, to int64) ([]model.StatusMinute, error) {
+	var minutes []model.StatusMinute
+	err := database.GetDB().Model(model.StatusMinute{}).
+		Where("minute >= ? AND minute <= ?", from, to).
+		Order("minute").
+		Find(&minutes).Error
+	if err != nil {
+		return nil, err
+	}
+	sampler.lock.RLock()
+	held := append([]model.StatusMinute{}, sampler.pending...)
+	if len(sampler.minute) > 0 {
+		held = append(held, averageMinute(sampler.minute))
+	}
+	sampler.lock.RUnlock()
+	// A minute held is newer than the one written of it, if any
+	written := map[int64]int{}
+	for i, minute := range minutes {
+		written[minute.Minute] = i
+	}
+	for _, minute := range held {
+		if minute.Minute < from || minute.Minute > to {
+			continue
+		}
+		if i, ok := written[minute.Minute]; ok {
+			minutes[i] = minute
+		} else {
+			minutes = append(minutes, minute)
+		}
+	}
+	return minutes, nil
+}
+
+// recentSamples returns the samples kept in memory taken from from to to,
+// oldest first.
+func recentSamples(from int64, to int64) []StatusSample {
+	sampler.lock.RLock()
+	defer sampler.lock.RUnlock()
+	samples := make([]StatusSample, 0, sampler.count)
+	start := (sampler.next - sampler.count + statusRingSize) % statusRingSize
+	for i := 0; i < sampler.count; i++ {
+		sample := sampler.ring[(start+i)%statusRingSize]
+		if sample.Time >= from && sample.Time <= to {
+			samples = append(samples, sample)
+		}
+	}
+	return samples
+}
+
+func minuteStart(t int64) int64 {
+	return t - t%time.Minute.Milliseconds()
+}
+
+// averageMinute averages the samples of a minute.
+func averageMinute(samples []StatusSample) model.StatusMinute {
+	minute := model.StatusMinute{Minute: minuteStart(samples[0].Time)}
+	var cpu float64
+	var mem, swap, disk, up, down, xrayMem uint64
+	var tcp int
+	for _, sample := range samples {
+		cpu += sample.Cpu
+		mem += sample.Mem
+		swap += sample.Swap
+		disk += sample.Disk
+		up += sample.NetUp
+		down += sample.NetDown
+		tcp += sample.TcpCount
+		xrayMem += sample.XrayMem
+	}
+	n := uint64(len(samples))
+	minute.Cpu = cpu / float64(n)
+	minute.Mem = int64(mem / n)
+	minute.Swap = int64(swap / n)
+	minute.Disk = int64(disk / n)
+	minute.NetUp = int64(up / n)
+	minute.NetDown = int64(down / n)
+	minute.TcpCount = tcp / len(samples)
+	minute.XrayMem = int64(xrayMem / n)
+	return minute
+}
+
+// StatusDelta returns the fields of the JSON of status that differ from the
+// ones of last, all of them if last is nil, and the fields of status for the
+// next delta.
+func StatusDelta(last map[string]json.RawMessage, status *Status) (map[string]json.RawMessage, map[string]json.RawMessage, error) {
+	encoded, err := json.Marshal(status)
+	if err != nil {
+		return nil, nil, err
+	}
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(encoded, &fields); err != nil {
+		return nil, nil, err
+	}
+	delta := map[string]json.RawMessage{}
+	for name, value := range fields {
+		if previous, ok := last[name]; !ok || string(previous) != string(value) {
+			delta[name] = value
+		}
+	}
+	return delta, fields, nil
+}
@@ -0,0 +1,178 @@
+package service
+
+import (
+	"encoding/json"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/web/entity"
+)
+
+// statusProbeTimeout bounds the dial of the port of an inbound.
+const statusProbeTimeout = 2 * time.Second
+
+// The states and the load levels of the inbounds on the public status page.
+const (
+	StatusUp   = "up"
+	StatusDown = "down"
+
+	StatusLoadLow    = "low"
+	StatusLoadMedium = "medium"
+	StatusLoadHigh   = "high"
+)
+
+// PublicInboundStatus is what the public status page tells of an inbound, and
+// all it can tell: no ports, clients nor traffic ever go in it. Name is the
+// remark of the inbound, or its place on the page if it has none; the fields
+// the settings leave out are empty.
+type PublicInboundStatus struct {
+	Name  string `json:"name"`
+	State string `json:"state,omitempty"`
+	// Latency is how long the port of the inbound took to accept a
+	// connection of the panel, in ms; inbounds over UDP don't have one
+	Latency *int64 `json:"latency,omitempty"`
+	Load    string `json:"load,omitempty"`
+}
+
+// PublicStatus is the public status page, as of UpdatedAt in ms.
+type PublicStatus struct {
+	UpdatedAt int64                 `json:"updatedAt"`
+	Inbounds  []PublicInboundStatus `json:"inbounds"`
+}
+
+// StatusPageService checks the inbounds of the public status page.
+type StatusPageService struct {
+	xrayService XrayService
+}
+
+// PublicStatus checks the inbounds ids and tells of them the fields only.
+// capacity is the throughput in Mbps of an inbound under high load.
+func (s *StatusPageService) PublicStatus(ids []int, fields []string, capacity int) (*PublicStatus, error) {
+	status := &PublicStatus{UpdatedAt: time.Now().UnixMilli(), Inbounds: []PublicInboundStatus{}}
+	if len(ids) == 0 {
+		return status, nil
+	}
+	var inbounds []*model.Inbound
+	err := database.GetDB().Model(model.Inbound{}).
+		Select("id", "remark", "enable", "listen", "port", "protocol", "stream_settings", "tag").
+		Where("id IN ?", ids).Find(&inbounds).Error
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(inbounds, func(a, b *model.Inbound) int {
+		return slices.Index(ids, a.Id) - slices.Index(ids, b.Id)
+	})
+
+	running := s.xrayService.IsXrayRunning()
+	status.Inbounds = make([]PublicInboundStatus, len(inbounds))
+	var wg sync.WaitGroup
+	for i, inbound := range inbounds {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			status.Inbounds[i] = publicInboundStatus(inbound, i, running, fields, capacity)
+		}()
+	}
+	wg.Wait()
+	return status, nil
+}
+
+// publicInboundStatus checks the inbound at place i of the page. It is the
+// only place filling a PublicInboundStatus, from nothing but the fields.
+func publicInboundStatus(inbound *model.Inbound, i int, running bool, fields []string, capacity int) PublicInboundStatus {
+	result := PublicInboundStatus{Name: strings.TrimSpace(inbound.Remark)}
+	if result.Name == "" {
+		result.Name = "#" + strconv.Itoa(i+1)
+	}
+	up := running && inbound.Enable
+	var latency *int64
+	if up {
+		latency, up = probeInbound(inbound)
+	}
+	state := StatusDown
+	if up {
+		state = StatusUp
+	}
+	for _, field := range fields {
+		switch field {
+		case entity.StatusPageState:
+			result.State = state
+		case entity.StatusPageLatency:
+			if up {
+				result.Latency = latency
+			}
+		case entity.StatusPageLoad:
+			if up {
+				result.Load = inboundLoad(inbound.Tag, capacity)
+			}
+		}
+	}
+	return result
+}
+
+// probeInbound dials the port of an inbound from the panel and tells how long
+// it took. Inbounds over UDP can't be dialed, they are up as long as Xray runs
+// them.
+func probeInbound(inbound *model.Inbound) (*int64, bool) {
+	if inboundOverUDP(inbound) {
+		return nil, true
+	}
+	network, address := "tcp", inbound.Listen
+	switch {
+	case strings.HasPrefix(address, "/") || strings.HasPrefix(address, "@"):
+		network = "unix"
+		address = strings.SplitN(address, ",", 2)[0]
+	case address == "" || address == "0.0.0.0":
+		address = net.JoinHostPort("127.0.0.1", strconv.Itoa(inbound.Port))
+	case address == "::":
+		address = net.JoinHostPort("::1", strconv.Itoa(inbound.Port))
+	default:
+		address = net.JoinHostPort(address, strconv.Itoa(inbound.Port))
+	}
+	start := time.Now()
+	conn, err := net.DialTimeout(network, address, statusProbeTimeout)
+	if err != nil {
+		return nil, false
+	}
+	latency := time.Since(start).Milliseconds()
+	conn.Close()
+	return &latency, true
+}
+
+// inboundOverUDP tells whether an inbound listens on UDP only.
+func inboundOverUDP(inbound *model.Inbound) bool {
+	if inbound.Protocol == model.WireGuard {
+		return true
+	}
+	var stream struct {
+		Network string `json:"network"`
+	}
+	if json.Unmarshal([]byte(inbound.StreamSettings), &stream) != nil {
+		return false
+	}
+	return stream.Network == "kcp"
+}
+
+// inboundLoad buckets the throughput of the inbound tag in the last run of the
+// traffic job: under 40% of capacity is low, under 80% medium.
+func inboundLoad(tag string, capacity int) string {
+	throughput, ok := liveThroughput(tag)
+	if !ok || capacity <= 0 {
+		return StatusLoadLow
+	}
+	mbps := float64(throughput.UpRate+throughput.DownRate) * 8 / 1e6
+	switch share := mbps / float64(capacity); {
+	case share < 0.4:
+		return StatusLoadLow
+	case share < 0.8:
+		return StatusLoadMedium
+	default:
+		return StatusLoadHigh
+	}
+}
@@ -0,0 +1,176 @@
+package service
+
+import (
+	"encoding/json"
+	"net"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/web/entity"
+	"x-ui/xray"
+)
+
+// jsonFields returns the JSON names of the fields of the struct typ.
+func jsonFields(typ reflect.Type) []string {
+	var names []string
+	for i := range typ.NumField() {
+		name, _, _ := strings.Cut(typ.Field(i).Tag.Get("json"), ",")
+		names = append(names, name)
+	}
+	return names
+}
+
+func TestPublicStatusFields(t *testing.T) {
+	// Adding a field to the page is a decision, not an accident
+	if fields := jsonFields(reflect.TypeFor[PublicStatus]()); !slices.Equal(fields, []string{"updatedAt", "inbounds"}) {
+		t.Errorf("the status page has the fields %v", fields)
+	}
+	if fields := jsonFields(reflect.TypeFor[PublicInboundStatus]()); !slices.Equal(fields, []string{"name", "state", "latency", "load"}) {
+		t.Errorf("the inbounds of the status page have the fields %v", fields)
+	}
+}
+
+// statusTestDB opens a database with an inbound listening on the port of
+// listener, with a client and its traffic, and returns it.
+func statusTestDB(t *testing.T, listener net.Listener) *model.Inbound {
+	t.Helper()
+	port := listener.Addr().(*net.TCPAddr).Port
+	inbound := &model.Inbound{
+		Remark: " Frankfurt ", Enable: true, Listen: "127.0.0.1", Port: port, Protocol: model.Trojan,
+		Tag: "inbound-" + strconv.Itoa(port), Up: 123456789, Down: 987654321,
+		Settings:       `{"clients":[{"password":"secret-password","email":"alice@example.com","enable":true}]}`,
+		StreamSettings: `{"network":"tcp","security":"none"}`,
+	}
+	db := newTestDB(t, seedInbounds(inbound))
+	traffic := &xray.ClientTraffic{InboundId: inbound.Id, Enable: true, Email: "alice@example.com", Up: 555555, Down: 777777}
+	if err := db.Create(traffic).Error; err != nil {
+		t.Fatal(err)
+	}
+	return inbound
+}
+
+func TestPublicInboundStatus(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	inbound := statusTestDB(t, listener)
+	all := []string{entity.StatusPageState, entity.StatusPageLatency, entity.StatusPageLoad}
+
+	status := publicInboundStatus(inbound, 0, true, all, 100)
+	if status.Name != "Frankfurt" || status.State != StatusUp || status.Latency == nil || status.Load != StatusLoadLow {
+		t.Errorf("the inbound is %+v", status)
+	}
+	data, _ := json.Marshal(status)
+	for _, secret := range []string{strconv.Itoa(inbound.Port), inbound.Tag, "alice", "secret-password", "123456789", "987654321", "555555", "777777", "trojan", "127.0.0.1"} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("the status %s tells %q", data, secret)
+		}
+	}
+
+	// Only the fields of the settings
+	if status := publicInboundStatus(inbound, 0, true, []string{entity.StatusPageState}, 100); status.Latency != nil || status.Load != "" {
+		t.Errorf("the state alone is %+v", status)
+	}
+	// A stopped Xray, a disabled inbound and a closed port are down, without
+	// latency or load
+	disabled := *inbound
+	disabled.Enable = false
+	gone, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gone.Close()
+	closed := *inbound
+	closed.Port = gone.Addr().(*net.TCPAddr).Port
+	closed.Remark = ""
+	for i, test := range []struct {
+		inbound *model.Inbound
+		running bool
+	}{{inbound, false}, {&disabled, true}, {&closed, true}} {
+		status := publicInboundStatus(test.inbound, i, test.running, all, 100)
+		if status.State != StatusDown || status.Latency != nil || status.Load != "" {
+			t.Errorf("the inbound %d is %+v", i, status)
+		}
+	}
+	if status := publicInboundStatus(&closed, 2, false, all, 100); status.Name != "#3" {
+		t.Errorf("the inbound without a remark is named %q", status.Name)
+	}
+	// Over UDP the inbound is up without a latency
+	kcp := closed
+	kcp.StreamSettings = `{"network":"kcp"}`
+	if status := publicInboundStatus(&kcp, 0, true, all, 100); status.State != StatusUp || status.Latency != nil {
+		t.Errorf("the kcp inbound is %+v", status)
+	}
+}
+
+func TestPublicStatus(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	inbound := statusTestDB(t, listener)
+	second := &model.Inbound{Remark: "Paris", Enable: true, Port: 20041, Protocol: model.VLESS, Tag: "inbound-20041", Settings: `{"clients":[]}`}
+	if err := database.GetDB().Create(second).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	var s StatusPageService
+	// In the order of the settings, leaving out the inbounds that are gone
+	status, err := s.PublicStatus([]int{second.Id, 999, inbound.Id}, []string{entity.StatusPageState}, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Inbounds) != 2 || status.Inbounds[0].Name != "Paris" || status.Inbounds[1].Name != "Frankfurt" || status.UpdatedAt == 0 {
+		t.Errorf("the status is %+v", status)
+	}
+	data, _ := json.Marshal(status)
+	if strings.Contains(string(data), "alice") || strings.Contains(string(data), strconv.Itoa(inbound.Port)) {
+		t.Errorf("the status page tells %s", data)
+	}
+	if status, err := s.PublicStatus(nil, nil, 100); err != nil || status.Inbounds == nil || len(status.Inbounds) != 0 {
+		t.Errorf("the status without inbounds is %+v, %v", status, err)
+	}
+}
+
+func TestInboundLoad(t *testing.T) {
+	liveStats.lock.Lock()
+	saved := liveStats.throughput
+	// 10, 50 and 90 Mbps
+	liveStats.throughput = []InboundThroughput{
+		{Tag: "low", UpRate: 250_000, DownRate: 1_000_000},
+		{Tag: "medium", UpRate: 1_250_000, DownRate: 5_000_000},
+		{Tag: "high", UpRate: 1_250_000, DownRate: 10_000_000},
+	}
+	liveStats.lock.Unlock()
+	defer func() {
+		liveStats.lock.Lock()
+		liveStats.throughput = saved
+		liveStats.lock.Unlock()
+	}()
+
+	tests := []struct {
+		tag      string
+		capacity int
+		want     string
+	}{
+		{"low", 100, StatusLoadLow},
+		{"medium", 100, StatusLoadMedium},
+		{"high", 100, StatusLoadHigh},
+		{"high", 1000, StatusLoadLow},
+		{"medium", 0, StatusLoadLow},
+		{"unmeasured", 100, StatusLoadLow},
+	}
+	for _, test := range tests {
+		if load := inboundLoad(test.tag, test.capacity); load != test.want {
+			t.Errorf("the load of %s against %d Mbps is %s, want %s", test.tag, test.capacity, load, test.want)
+		}
+	}
+}
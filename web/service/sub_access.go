@@ -0,0 +1,236 @@
+package service
+
+import (
+	"fmt"
+	"html"
+	"strings"
+	"sync"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// subAccessQueueMax bounds the fetches waiting to be written, the ones
+	// beyond it are dropped
+	subAccessQueueMax = 10000
+	// subAccessBatch is how many fetches a statement of a flush writes at most
+	subAccessBatch = 500
+	// The fetches listed by default, and at most
+	subAccessDefaultLimit = 50
+	subAccessMaxLimit     = 1000
+	// subAccessShareWindow is how far back the IPs a subscription was fetched
+	// from are counted for it to be flagged as shared
+	subAccessShareWindow = 24 * time.Hour
+	// subAccessReportedIps is how many of the IPs of a shared subscription the
+	// Telegram notice lists
+	subAccessReportedIps = 10
+)
+
+// The fetches of the subscriptions not written yet, and when each subscription
+// was last flagged as shared, to flag it once per window.
+var (
+	subAccessLock    sync.Mutex
+	subAccessQueue   []*model.SubAccess
+	subAccessFlagged = map[string]time.Time{}
+)
+
+// SubAccessService records the fetches of the subscriptions, and flags the
+// subscriptions fetched from more IPs than they likely have devices.
+type SubAccessService struct {
+	settingService SettingService
+	webhookService WebhookService
+	inboundService InboundService
+}
+
+// Record queues a fetch of the subscription subId listing the clients of emails,
+// on device or an unlabeled one if "", to be written by the next flush. It does
+// not touch the database, it is on the path of every subscription request.
+func (s *SubAccessService) Record(subId string, emails []string, ip string, userAgent string, device string) {
+	access := &model.SubAccess{
+		SubId:     subId,
+		Emails:    "," + strings.Join(emails, ",") + ",",
+		Ip:        ip,
+		UserAgent: userAgent,
+		Device:    device,
+		CreatedAt: time.Now().UnixMilli(),
+	}
+	subAccessLock.Lock()
+	defer subAccessLock.Unlock()
+	if len(subAccessQueue) >= subAccessQueueMax {
+		return
+	}
+	subAccessQueue = append(subAccessQueue, access)
+}
+
+// Flush writes the queued fetches, saves the last fetch of their clients, and
+// flags the subscriptions fetched from too many IPs. On failure the fetches
+// stay queued.
+func (s *SubAccessService) Flush() error {
+	subAccessLock.Lock()
+	queue := subAccessQueue
+	subAccessQueue = nil
+	subAccessLock.Unlock()
+	if len(queue) == 0 {
+		return nil
+	}
+
+	latest := map[string]*model.SubAccess{}
+	for _, access := range queue {
+		for _, email := range subAccessEmails(access.Emails) {
+			latest[email] = access
+		}
+	}
+	values := make([][]any, 0, len(latest))
+	for email, access := range latest {
+		values = append(values, []any{email, access.CreatedAt, access.UserAgent})
+	}
+	err := database.Transaction(func(tx *gorm.DB) error {
+		if err := tx.CreateInBatches(queue, subAccessBatch).Error; err != nil {
+			return err
+		}
+		return updateByKey(tx, "client_traffics", "email", []string{"last_sub_fetch = %s", "last_user_agent = %s"}, values)
+	})
+	if err != nil {
+		subAccessLock.Lock()
+		subAccessQueue = append(queue, subAccessQueue...)
+		subAccessQueue = subAccessQueue[:min(len(subAccessQueue), subAccessQueueMax)]
+		subAccessLock.Unlock()
+		return err
+	}
+
+	maxIps, err := s.settingService.GetSubAccessMaxIps()
+	if err != nil || maxIps <= 0 {
+		return nil
+	}
+	checked := map[string]bool{}
+	for _, access := range queue {
+		if checked[access.SubId] {
+			continue
+		}
+		checked[access.SubId] = true
+		s.checkShared(access, maxIps)
+	}
+	return nil
+}
+
+// checkShared flags the subscription of access if it was fetched from more than
+// maxIps IPs within the window, and was not flagged within it yet.
+func (s *SubAccessService) checkShared(access *model.SubAccess, maxIps int) {
+	now := time.Now()
+	subAccessLock.Lock()
+	flagged := now.Sub(subAccessFlagged[access.SubId]) < subAccessShareWindow
+	subAccessLock.Unlock()
+	if flagged {
+		return
+	}
+
+	var ips []string
+	err := database.GetDB().Model(model.SubAccess{}).
+		Where("sub_id = ? AND created_at >= ?", access.SubId, now.Add(-subAccessShareWindow).UnixMilli()).
+		Distinct().Pluck("ip", &ips).Error
+	if err != nil {
+		logger.Warning("Unable to count the IPs of a subscription:", err)
+		return
+	}
+	if len(ips) <= maxIps {
+		return
+	}
+
+	subAccessLock.Lock()
+	subAccessFlagged[access.SubId] = now
+	subAccessLock.Unlock()
+	emails := subAccessEmails(access.Emails)
+	logger.Warningf("subscription %s of %s fetched from %d IPs within %v", access.SubId, strings.Join(emails, ", "), len(ips), subAccessShareWindow)
+	go new(Tgbot).SubSharedNotify(access.SubId, emails, ips)
+	s.webhookService.Emit(WebhookSubShared, map[string]any{
+		"subId":  access.SubId,
+		"emails": emails,
+		"ips":    ips,
+		"window": int(subAccessShareWindow / time.Second),
+	})
+}
+
+// GetSubAccess returns the last fetches of the subscription of the client of
+// email, newest first, at most limit of them.
+func (s *SubAccessService) GetSubAccess(email string, limit int) ([]*model.SubAccess, error) {
+	if limit <= 0 {
+		limit = subAccessDefaultLimit
+	} else if limit > subAccessMaxLimit {
+		limit = subAccessMaxLimit
+	}
+	accesses := make([]*model.SubAccess, 0)
+	err := database.GetDB().
+		Where("emails LIKE ? ESCAPE '!'", "%,"+escapeLike(email)+",%").
+		Order("created_at DESC, id DESC").Limit(limit).
+		Find(&accesses).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, access := range accesses {
+		access.Clients = subAccessEmails(access.Emails)
+	}
+	return accesses, nil
+}
+
+// Prune removes the fetches older than days, none if days is 0.
+func (s *SubAccessService) Prune(days int) (int64, error) {
+	now := time.Now()
+	subAccessLock.Lock()
+	for subId, flagged := range subAccessFlagged {
+		if now.Sub(flagged) >= subAccessShareWindow {
+			delete(subAccessFlagged, subId)
+		}
+	}
+	subAccessLock.Unlock()
+	if days <= 0 {
+		return 0, nil
+	}
+	cutoff := now.AddDate(0, 0, -days).UnixMilli()
+	result := database.GetDB().Where("created_at < ?", cutoff).Delete(model.SubAccess{})
+	return result.RowsAffected, result.Error
+}
+
+// subAccessLastFetch returns when the subscription of the client of email was
+// last fetched, and by which app, counting the fetches not written yet.
+func subAccessLastFetch(email string) (int64, string) {
+	subAccessLock.Lock()
+	defer subAccessLock.Unlock()
+	column := "," + email + ","
+	for i := len(subAccessQueue) - 1; i >= 0; i-- {
+		if strings.Contains(subAccessQueue[i].Emails, column) {
+			return subAccessQueue[i].CreatedAt, subAccessQueue[i].UserAgent
+		}
+	}
+	return 0, ""
+}
+
+func subAccessEmails(column string) []string {
+	emails := []string{}
+	for _, email := range strings.Split(strings.Trim(column, ","), ",") {
+		if email != "" {
+			emails = append(emails, email)
+		}
+	}
+	return emails
+}
+
+// SubSharedNotify tells the admins that the subscription subId of the
+// clients of emails was fetched from ips, more than it may be.
+func (t *Tgbot) SubSharedNotify(subId string, emails []string, ips []string) {
+	if !t.AlertsOn(AlertSubShared) {
+		return
+	}
+	msg := t.I18nBot("tgbot.messages.subShared",
+		"SubId=="+html.EscapeString(subId),
+		"Emails=="+html.EscapeString(strings.Join(emails, ", ")),
+		"Count=="+fmt.Sprint(len(ips)))
+	msg += t.I18nBot("tgbot.messages.hostname", "Hostname=="+hostname)
+	listed := ips[:min(len(ips), subAccessReportedIps)]
+	msg += t.I18nBot("tgbot.messages.ips", "IPs=="+html.EscapeString(strings.Join(listed, "\r\n")))
+	t.SendAlert(AlertSubShared, msg)
+}
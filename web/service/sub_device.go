@@ -0,0 +1,170 @@
+package service
+
+import (
+	"html"
+	"regexp"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/util/common"
+	"x-ui/web/network"
+)
+
+const (
+	// subDeviceIps is how many of the IPs of a device are listed, the last ones
+	subDeviceIps = 20
+)
+
+// subDeviceLabel matches the labels of the devices in the subscription URLs
+var subDeviceLabel = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,31}$`)
+
+// IsValidSubDevice tells whether device is a label of a device a subscription
+// URL may carry: up to 32 letters, digits, dots, dashes and underscores.
+func IsValidSubDevice(device string) bool {
+	return subDeviceLabel.MatchString(device)
+}
+
+// SubDevice is a device the subscription of a client is fetched on, by the
+// label of its URL; Device is "" for the fetches without a label.
+type SubDevice struct {
+	Device     string   `json:"device"`
+	Fetches    int64    `json:"fetches"`
+	FirstFetch int64    `json:"firstFetch"`
+	LastFetch  int64    `json:"lastFetch"`
+	LastIp     string   `json:"lastIp"`
+	UserAgent  string   `json:"userAgent"`
+	Ips        []string `json:"ips" gorm:"-"`
+}
+
+// GetSubDevices returns the devices the subscription subId was fetched on
+// within the retention of the fetches, the last fetched first.
+func (s *SubAccessService) GetSubDevices(subId string) ([]SubDevice, error) {
+	devices := make([]SubDevice, 0)
+	if subId == "" {
+		return devices, nil
+	}
+	db := database.GetDB()
+	err := db.Model(model.SubAccess{}).
+		Select("device, COUNT(*) AS fetches, MIN(created_at) AS first_fetch, MAX(created_at) AS last_fetch").
+		Where("sub_id = ?", subId).Group("device").Order("last_fetch DESC").
+		Scan(&devices).Error
+	if err != nil {
+		return nil, err
+	}
+	for i := range devices {
+		device := &devices[i]
+		var accesses []model.SubAccess
+		err := db.Model(model.SubAccess{}).Select("ip, user_agent, created_at").
+			Where("sub_id = ? AND device = ?", subId, device.Device).
+			Order("created_at DESC, id DESC").Limit(subAccessMaxLimit).
+			Find(&accesses).Error
+		if err != nil {
+			return nil, err
+		}
+		device.Ips = []string{}
+		seen := map[string]bool{}
+		for _, access := range accesses {
+			if device.LastIp == "" {
+				device.LastIp, device.UserAgent = access.Ip, access.UserAgent
+			}
+			if !seen[access.Ip] && len(device.Ips) < subDeviceIps {
+				seen[access.Ip] = true
+				device.Ips = append(device.Ips, access.Ip)
+			}
+		}
+	}
+	return devices, nil
+}
+
+// GetClientSubDevices returns the devices the subscription of the client of
+// email was fetched on.
+func (s *SubAccessService) GetClientSubDevices(email string) ([]SubDevice, error) {
+	_, client, err := s.inboundService.GetClientByEmail(email)
+	if err != nil {
+		return nil, err
+	}
+	return s.GetSubDevices(client.SubID)
+}
+
+// RevokeSubDevice takes the subscription away from a device of the client of
+// email by giving the client a new subscription ID: the old link stops working
+// on all its devices, the new one is for those it keeps. It returns whether
+// Xray has to be restarted.
+func (s *SubAccessService) RevokeSubDevice(email string, device string) (*ClientRotateResult, bool, error) {
+	devices, err := s.GetClientSubDevices(email)
+	if err != nil {
+		return nil, false, err
+	}
+	found := false
+	for _, d := range devices {
+		found = found || d.Device == device && device != ""
+	}
+	if !found {
+		return nil, false, common.NewError("device not found:", device)
+	}
+	return s.inboundService.RotateClient(email, &ClientRotate{RotateSubId: true})
+}
+
+// attributeDevices sets the device of the IPs of the client of email with the
+// subscription subId, as they were seen at seenAt if the access log didn't show
+// when: the labeled device that fetched the subscription from the same source
+// within window of it, the nearest in time.
+func (s *InboundService) attributeDevices(email string, subId string, window time.Duration, v6Prefix int, seenAt int64, ips []ClientIp) error {
+	if subId == "" || len(ips) == 0 {
+		return nil
+	}
+	sightingsLock.Lock()
+	seen := make([]int64, len(ips))
+	from := seenAt
+	for i, ip := range ips {
+		seen[i] = seenAt
+		if sighting := sightings[email]; sighting != nil && !sighting.ips[ip.Ip].IsZero() {
+			seen[i] = sighting.ips[ip.Ip].UnixMilli()
+		}
+		from = min(from, seen[i])
+	}
+	sightingsLock.Unlock()
+
+	var fetches []model.SubAccess
+	err := database.GetDB().Model(model.SubAccess{}).Select("device, ip, created_at").
+		Where("sub_id = ? AND device != '' AND created_at >= ?", subId, from-window.Milliseconds()).
+		Find(&fetches).Error
+	if err != nil {
+		return err
+	}
+	bySource := map[string][]model.SubAccess{}
+	for _, fetch := range fetches {
+		if source, ok := network.IpSource(fetch.Ip, v6Prefix); ok {
+			bySource[source] = append(bySource[source], fetch)
+		}
+	}
+	for i := range ips {
+		nearest := window.Milliseconds() + 1
+		for _, fetch := range bySource[ips[i].Source] {
+			if apart := max(fetch.CreatedAt-seen[i], seen[i]-fetch.CreatedAt); apart < nearest {
+				nearest, ips[i].Device = apart, fetch.Device
+			}
+		}
+	}
+	return nil
+}
+
+// SubDeviceRevoked sends the client of result, whose device lost its
+// subscription, the new link on the Telegram user of the client. It returns
+// whether it was sent, it isn't without the bot, a Telegram user or
+// subscriptions.
+func (t *Tgbot) SubDeviceRevoked(result *ClientRotateResult, device string) bool {
+	if !t.IsRunning() || result.Client.TgID == 0 {
+		return false
+	}
+	link, err := t.subLink(result.SubId)
+	if err != nil || link == "" {
+		return false
+	}
+	t.SendMsgToTgbot(result.Client.TgID, t.I18nBot("tgbot.messages.subDeviceRevoked",
+		"Email=="+html.EscapeString(result.Email),
+		"Device=="+html.EscapeString(device),
+		"Link=="+link))
+	return true
+}
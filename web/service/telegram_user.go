@@ -0,0 +1,102 @@
+package service
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/common"
+
+	"github.com/mymmrac/telego"
+	"gorm.io/gorm/clause"
+)
+
+// telegramUserTouchInterval limits how often a user who keeps writing to the
+// bot is written to the database
+const telegramUserTouchInterval = time.Hour
+
+type telegramUserSeen struct {
+	username string
+	at       time.Time
+}
+
+// telegramUsersSeen caches when each user was last written, by id
+var telegramUsersSeen sync.Map
+
+// TelegramUserService remembers the Telegram users the bot has heard from, so
+// that clients can be given the chat id of a @username.
+type TelegramUserService struct{}
+
+// Remember records user as seen by the bot.
+func (s *TelegramUserService) Remember(user *telego.User) {
+	if user == nil || user.IsBot {
+		return
+	}
+	username := strings.ToLower(user.Username)
+	now := time.Now()
+	if seen, ok := telegramUsersSeen.Load(user.ID); ok {
+		last := seen.(telegramUserSeen)
+		if last.username == username && now.Sub(last.at) < telegramUserTouchInterval {
+			return
+		}
+	}
+	err := database.GetDB().Clauses(clause.OnConflict{UpdateAll: true}).Create(&model.TelegramUser{
+		Id:        user.ID,
+		Username:  username,
+		FirstName: user.FirstName,
+		SeenAt:    now.UnixMilli(),
+	}).Error
+	if err != nil {
+		logger.Warning("Unable to remember the Telegram user:", err)
+		return
+	}
+	telegramUsersSeen.Store(user.ID, telegramUserSeen{username: username, at: now})
+}
+
+// Resolve returns the chat id of the user with a @username. Usernames can
+// change hands, the user who had it most recently wins.
+func (s *TelegramUserService) Resolve(username string) (int64, error) {
+	username = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(username), "@"))
+	if username == "" {
+		return 0, common.NewError("empty Telegram username")
+	}
+	user := &model.TelegramUser{}
+	err := database.GetDB().Where("username = ?", username).Order("seen_at DESC").First(user).Error
+	if database.IsNotFound(err) {
+		return 0, common.NewErrorf("the Telegram user @%s hasn't written to the bot yet", username)
+	} else if err != nil {
+		return 0, err
+	}
+	return user.Id, nil
+}
+
+// normalizeTgId turns a tgId given as a string, a chat id or a @username, into
+// the chat id. It reports whether the client was changed.
+func normalizeTgId(client map[string]any) (bool, error) {
+	value, ok := client["tgId"].(string)
+	if !ok {
+		return false, nil
+	}
+	value = strings.TrimSpace(value)
+	switch {
+	case value == "":
+		client["tgId"] = 0
+	case strings.HasPrefix(value, "@"):
+		tgId, err := (&TelegramUserService{}).Resolve(value)
+		if err != nil {
+			return false, err
+		}
+		client["tgId"] = tgId
+	default:
+		tgId, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return false, common.NewErrorf("%q is neither a Telegram chat id nor a @username", value)
+		}
+		client["tgId"] = tgId
+	}
+	return true, nil
+}
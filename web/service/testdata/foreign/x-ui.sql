@@ -0,0 +1,27 @@
+-- The database of a legacy x-ui panel, with the tables of its inbounds and the
+-- traffic of their clients
+CREATE TABLE `users` (`id` integer, `username` text, `password` text, PRIMARY KEY (`id`));
+INSERT INTO `users` VALUES (1, 'admin', 'admin');
+CREATE TABLE `inbounds` (`id` integer, `user_id` integer, `up` integer, `down` integer, `total` integer, `remark` text, `enable` numeric, `expiry_time` integer, `listen` text, `port` integer UNIQUE, `protocol` text, `settings` text, `stream_settings` text, `tag` text UNIQUE, `sniffing` text, PRIMARY KEY (`id`));
+INSERT INTO `inbounds` VALUES (1, 1, 1000, 2000, 0, 'Legacy VLESS', 1, 0, '', 20071, 'vless',
+  '{"clients":[{"id":"a0713e89-2acb-4e8e-aae5-9e9aa0e76149","flow":"xtls-rprx-vision","email":"alice","limitIp":2,"totalGB":10737418240,"expiryTime":1893456000000,"enable":true,"tgId":"","subId":"alice-sub"},{"id":"807c13d4-5b53-4b0f-8aa6-29979342f436","flow":"xtls-rprx-vision","email":"bob","limitIp":0,"totalGB":0,"expiryTime":0,"enable":false,"tgId":"","subId":""}],"decryption":"none","fallbacks":[]}',
+  '{"network":"tcp","security":"tls","tlsSettings":{"serverName":"legacy.example.com","certificates":[{"certificateFile":"/root/cert.crt","keyFile":"/root/private.key"}]},"tcpSettings":{"header":{"type":"none"}}}',
+  'inbound-20071', '{"enabled":true,"destOverride":["http","tls"]}');
+INSERT INTO `inbounds` VALUES (2, 1, 0, 0, 0, 'Legacy VMess', 1, 0, '', 20072, 'vmess',
+  '{"clients":[{"id":"54b0ec4d-8d2a-4bc9-9a63-1c8e5f0d2a7b","alterId":0,"email":"alice"},{"id":"c3a1f6e0-7b2d-4e89-a5c4-0d9e8f1b2a36","alterId":64}],"disableInsecureEncryption":false}',
+  '{"network":"ws","security":"none","wsSettings":{"path":"/legacy","headers":{}}}',
+  '', '{"enabled":true,"destOverride":["http","tls"]}');
+INSERT INTO `inbounds` VALUES (3, 1, 0, 0, 0, 'Legacy Trojan', 0, 0, '', 20073, 'trojan',
+  '{"clients":[{"password":"carol-trojan","email":"carol","flow":""}],"fallbacks":[]}',
+  '{"network":"tcp","security":"none","tcpSettings":{"header":{"type":"none"}}}',
+  'inbound-20073', '{"enabled":false,"destOverride":["http","tls"]}');
+INSERT INTO `inbounds` VALUES (4, 1, 0, 0, 0, 'Legacy Shadowsocks', 1, 0, '', 20074, 'shadowsocks',
+  '{"method":"aes-256-gcm","password":"legacy-ss","network":"tcp,udp"}',
+  '{"network":"tcp","security":"none","tcpSettings":{"header":{"type":"none"}}}',
+  'inbound-20074', '{"enabled":true,"destOverride":["http","tls"]}');
+INSERT INTO `inbounds` VALUES (5, 1, 0, 0, 0, 'Legacy MTProto', 1, 0, '', 20075, 'mtproto',
+  '{"users":[{"secret":"b0cbcef5a486d9636472ac27f8e11a9d"}]}', '{}', 'inbound-20075', '{}');
+CREATE TABLE `client_traffics` (`id` integer, `inbound_id` integer, `enable` numeric, `email` text UNIQUE, `up` integer, `down` integer, `expiry_time` integer, `total` integer, `reset` integer DEFAULT 0, PRIMARY KEY (`id`));
+INSERT INTO `client_traffics` VALUES (1, 1, 1, 'alice', 123, 456, 1893456000000, 10737418240, 30);
+INSERT INTO `client_traffics` VALUES (2, 1, 0, 'bob', 7, 8, 0, 0, 0);
+INSERT INTO `client_traffics` VALUES (3, 3, 1, 'carol', 9, 10, 0, 0, 0);
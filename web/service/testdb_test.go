@@ -0,0 +1,43 @@
+package service
+
+import (
+	"testing"
+
+	"x-ui/database"
+	"x-ui/database/model"
+
+	"gorm.io/gorm"
+)
+
+// newTestDB opens an empty panel database in a folder of its own, which is
+// the database folder for the test, runs the seeds on it in order and
+// returns it. The traffic other tests left pending is dropped.
+func newTestDB(tb testing.TB, seeds ...func(db *gorm.DB) error) *gorm.DB {
+	tb.Helper()
+	dir := tb.TempDir()
+	tb.Setenv("XUI_DB_FOLDER", dir)
+	if err := database.InitDB(dir + "/x-ui.db"); err != nil {
+		tb.Fatal(err)
+	}
+	takePendingTraffic()
+	db := database.GetDB()
+	for _, seed := range seeds {
+		if err := seed(db); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return db
+}
+
+// seedInbounds is a seed of newTestDB that creates the inbounds, each taking
+// its id.
+func seedInbounds(inbounds ...*model.Inbound) func(db *gorm.DB) error {
+	return func(db *gorm.DB) error {
+		for _, inbound := range inbounds {
+			if err := db.Create(inbound).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
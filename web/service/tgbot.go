@@ -11,6 +11,7 @@ import (
 	"net"
 	"net/url"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
@@ -31,14 +32,25 @@ import (
 	tu "github.com/mymmrac/telego/telegoutil"
 	"github.com/valyala/fasthttp"
 	"github.com/valyala/fasthttp/fasthttpproxy"
+	"golang.org/x/net/http/httpproxy"
+)
+
+const (
+	// tgBotDialTimeout limits connecting through the proxy of the bot
+	tgBotDialTimeout = 15 * time.Second
+	// tgBotTestTimeout limits a test of the connection of the bot
+	tgBotTestTimeout = 20 * time.Second
 )
 
 var (
 	bot         *telego.Bot
 	botHandler  *th.BotHandler
-	adminIds    []int64
+	stopPolling context.CancelFunc
 	isRunning   bool
 	hostname    string
+	// botUsername is the username of the connected bot, for the links that open
+	// a chat with it
+	botUsername string
 	hashStorage *global.HashStorage
 
 	// clients data to adding new client
@@ -75,6 +87,10 @@ type Tgbot struct {
 	settingService SettingService
 	serverService  ServerService
 	xrayService    XrayService
+	userService    UserService
+	auditService   AuditService
+	loginSessions  LoginSessionService
+	telegramUsers  TelegramUserService
 	lastStatus     *Status
 }
 
@@ -102,6 +118,11 @@ func (t *Tgbot) Start(i18nFS embed.FS) error {
 
 	t.SetHostname()
 
+	return t.connect()
+}
+
+// connect creates the bot with its settings and starts receiving its updates.
+func (t *Tgbot) connect() error {
 	// Get Telegram bot token
 	tgBotToken, err := t.settingService.GetTgBotToken()
 	if err != nil || tgBotToken == "" {
@@ -109,23 +130,16 @@ func (t *Tgbot) Start(i18nFS embed.FS) error {
 		return err
 	}
 
-	// Get Telegram bot chat ID(s)
+	// Get Telegram bot chat ID(s). They are read again on every update, so that
+	// roles can change while the bot runs.
 	tgBotID, err := t.settingService.GetTgBotChatId()
 	if err != nil {
 		logger.Warning("Failed to get Telegram bot chat ID:", err)
 		return err
 	}
-
-	// Parse admin IDs from comma-separated string
-	if tgBotID != "" {
-		for _, adminID := range strings.Split(tgBotID, ",") {
-			id, err := strconv.Atoi(adminID)
-			if err != nil {
-				logger.Warning("Failed to parse admin ID from Telegram bot chat ID:", err)
-				return err
-			}
-			adminIds = append(adminIds, int64(id))
-		}
+	if _, err := parseTgBotChats(tgBotID); err != nil {
+		logger.Warning("Failed to parse admin ID from Telegram bot chat ID:", err)
+		return err
 	}
 
 	// Get Telegram bot proxy URL
@@ -143,10 +157,19 @@ func (t *Tgbot) Start(i18nFS embed.FS) error {
 	// Create new Telegram bot instance
 	bot, err = t.NewBot(tgBotToken, tgBotProxy, tgBotAPIServer)
 	if err != nil {
+		err = redactBotError(err, tgBotToken, tgBotProxy)
 		logger.Error("Failed to initialize Telegram bot API:", err)
 		return err
 	}
 
+	ctx, cancel := context.WithTimeout(context.Background(), tgBotTestTimeout)
+	if me, err := bot.GetMe(ctx); err != nil {
+		logger.Warning("Failed to get the bot username:", redactBotError(err, tgBotToken, tgBotProxy))
+	} else {
+		botUsername = me.Username
+	}
+	cancel()
+
 	// After bot initialization, set up bot commands with localized descriptions
 	err = bot.SetMyCommands(context.Background(), &telego.SetMyCommandsParams{
 		Commands: []telego.BotCommand{
@@ -154,62 +177,128 @@ func (t *Tgbot) Start(i18nFS embed.FS) error {
 			{Command: "help", Description: t.I18nBot("tgbot.commands.helpDesc")},
 			{Command: "status", Description: t.I18nBot("tgbot.commands.statusDesc")},
 			{Command: "id", Description: t.I18nBot("tgbot.commands.idDesc")},
+			{Command: "usage", Description: t.I18nBot("tgbot.commands.usageDesc")},
+			{Command: "mylink", Description: t.I18nBot("tgbot.commands.mylinkDesc")},
 		},
 	})
 	if err != nil {
-		logger.Warning("Failed to set bot commands:", err)
+		logger.Warning("Failed to set bot commands:", redactBotError(err, tgBotToken, tgBotProxy))
 	}
 
 	// Start receiving Telegram bot messages
 	if !isRunning {
 		logger.Info("Telegram bot receiver started")
-		go t.OnReceive()
+		// Stop cancels the long polling, for the bot to be connected again
+		var ctx context.Context
+		ctx, stopPolling = context.WithCancel(context.Background())
+		go t.OnReceive(ctx)
 		isRunning = true
 	}
 
 	return nil
 }
 
+// NewBot creates a bot that connects to the Bot API server at apiServerUrl, or
+// to Telegram's, through the SOCKS5 or HTTP proxy at proxyUrl if it is set.
 func (t *Tgbot) NewBot(token string, proxyUrl string, apiServerUrl string) (*telego.Bot, error) {
-	if proxyUrl == "" && apiServerUrl == "" {
-		return telego.NewBot(token)
-	}
-
+	var options []telego.BotOption
 	if proxyUrl != "" {
-		if !strings.HasPrefix(proxyUrl, "socks5://") {
-			logger.Warning("Invalid socks5 URL, using default")
-			return telego.NewBot(token)
+		dialer := &fasthttpproxy.Dialer{
+			Config:         httpproxy.Config{HTTPProxy: proxyUrl, HTTPSProxy: proxyUrl},
+			Timeout:        tgBotDialTimeout,
+			ConnectTimeout: tgBotDialTimeout,
 		}
-
-		_, err := url.Parse(proxyUrl)
+		dial, err := dialer.GetDialFunc(false)
 		if err != nil {
-			logger.Warningf("Can't parse proxy URL, using default instance for tgbot: %v", err)
-			return telego.NewBot(token)
+			// The error would show the credentials of the proxy
+			return nil, common.NewError("invalid Telegram bot proxy:", redactProxyURL(proxyUrl))
 		}
+		options = append(options, telego.WithFastHTTPClient(&fasthttp.Client{Dial: dial}))
+	}
+	if apiServerUrl != "" {
+		options = append(options, telego.WithAPIServer(strings.TrimSuffix(apiServerUrl, "/")))
+	}
+	return telego.NewBot(token, options...)
+}
+
+// TgBotTest is how a test of the connection of the bot went.
+type TgBotTest struct {
+	Username string `json:"username"`
+	// Latency is how long getMe took, in milliseconds
+	Latency int64 `json:"latency"`
+}
 
-		return telego.NewBot(token, telego.WithFastHTTPClient(&fasthttp.Client{
-			Dial: fasthttpproxy.FasthttpSocksDialer(proxyUrl),
-		}))
+// TestConnection calls getMe with a bot made of token, proxyUrl and
+// apiServerUrl, which may not be saved yet, and tells how long it took.
+func (t *Tgbot) TestConnection(token string, proxyUrl string, apiServerUrl string) (*TgBotTest, error) {
+	testBot, err := t.NewBot(token, proxyUrl, apiServerUrl)
+	if err != nil {
+		return nil, redactBotError(err, token, proxyUrl)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), tgBotTestTimeout)
+	defer cancel()
+	start := time.Now()
+	me, err := testBot.GetMe(ctx)
+	if err != nil {
+		return nil, redactBotError(err, token, proxyUrl)
 	}
+	return &TgBotTest{Username: me.Username, Latency: time.Since(start).Milliseconds()}, nil
+}
 
-	if !strings.HasPrefix(apiServerUrl, "http") {
-		logger.Warning("Invalid http(s) URL, using default")
-		return telego.NewBot(token)
+// Reconnect connects the running bot again with its settings, for a new token,
+// proxy or API server to take effect without restarting the panel.
+func (t *Tgbot) Reconnect() error {
+	if !isRunning {
+		return nil
 	}
+	t.Stop()
+	logger.Info("Reconnecting the Telegram bot")
+	return t.connect()
+}
 
-	_, err := url.Parse(apiServerUrl)
+// redactProxyURL returns the proxy URL without its credentials.
+func redactProxyURL(proxyUrl string) string {
+	u, err := url.Parse(proxyUrl)
 	if err != nil {
-		logger.Warningf("Can't parse API server URL, using default instance for tgbot: %v", err)
-		return telego.NewBot(token)
+		return "***"
 	}
+	u.User = nil
+	return u.String()
+}
 
-	return telego.NewBot(token, telego.WithAPIServer(apiServerUrl))
+// redactBotError hides the token and the proxy credentials the errors of the
+// bot may carry, so that they can be logged and shown.
+func redactBotError(err error, token string, proxyUrl string) error {
+	if err == nil {
+		return nil
+	}
+	msg := err.Error()
+	secrets := []string{token}
+	if u, parseErr := url.Parse(proxyUrl); parseErr == nil && u.User != nil {
+		password, _ := u.User.Password()
+		secrets = append(secrets, u.User.String(), password)
+	}
+	for _, secret := range secrets {
+		if secret != "" {
+			msg = strings.ReplaceAll(msg, secret, "***")
+		}
+	}
+	return errors.New(msg)
 }
 
 func (t *Tgbot) IsRunning() bool {
 	return isRunning
 }
 
+// StartLink returns the link that opens a chat with the bot and sends it /start
+// with payload, "" if the bot isn't running or its username isn't known.
+func (t *Tgbot) StartLink(payload string) string {
+	if !isRunning || botUsername == "" {
+		return ""
+	}
+	return "https://t.me/" + botUsername + "?start=" + payload
+}
+
 func (t *Tgbot) SetHostname() {
 	host, err := os.Hostname()
 	if err != nil {
@@ -224,9 +313,12 @@ func (t *Tgbot) Stop() {
 	if botHandler != nil {
 		botHandler.Stop()
 	}
+	if stopPolling != nil {
+		stopPolling()
+		stopPolling = nil
+	}
 	logger.Info("Stop Telegram receiver ...")
 	isRunning = false
-	adminIds = nil
 }
 
 func (t *Tgbot) encodeQuery(query string) string {
@@ -251,15 +343,26 @@ func (t *Tgbot) decodeQuery(query string) (string, error) {
 	return decoded, nil
 }
 
-func (t *Tgbot) OnReceive() {
+func (t *Tgbot) OnReceive(ctx context.Context) {
 	params := telego.GetUpdatesParams{
 		Timeout: 10,
 	}
 
-	updates, _ := bot.UpdatesViaLongPolling(context.Background(), &params)
+	updates, _ := bot.UpdatesViaLongPolling(ctx, &params)
 
 	botHandler, _ = th.NewBotHandler(bot, updates)
 
+	// Remember who writes to the bot, so clients can be given their @username
+	botHandler.Use(func(ctx *th.Context, update telego.Update) error {
+		switch {
+		case update.Message != nil:
+			t.telegramUsers.Remember(update.Message.From)
+		case update.CallbackQuery != nil:
+			t.telegramUsers.Remember(&update.CallbackQuery.From)
+		}
+		return ctx.Next(update)
+	})
+
 	botHandler.HandleMessage(func(ctx *th.Context, message telego.Message) error {
 		delete(userStates, message.Chat.ID)
 		t.SendMsgToTgbot(message.Chat.ID, t.I18nBot("tgbot.keyboardClosed"), tu.ReplyKeyboardRemove())
@@ -268,18 +371,22 @@ func (t *Tgbot) OnReceive() {
 
 	botHandler.HandleMessage(func(ctx *th.Context, message telego.Message) error {
 		delete(userStates, message.Chat.ID)
-		t.answerCommand(&message, message.Chat.ID, checkAdmin(message.From.ID))
+		t.answerCommand(&message, message.Chat.ID, t.chatRole(message.From.ID))
 		return nil
 	}, th.AnyCommand())
 
 	botHandler.HandleCallbackQuery(func(ctx *th.Context, query telego.CallbackQuery) error {
 		delete(userStates, query.Message.GetChat().ID)
-		t.answerCallback(&query, checkAdmin(query.From.ID))
+		t.answerCallback(&query, t.chatRole(query.From.ID))
 		return nil
 	}, th.AnyCallbackQueryWithMessage())
 
 	botHandler.HandleMessage(func(ctx *th.Context, message telego.Message) error {
-		if userState, exists := userStates[message.Chat.ID]; exists {
+		role := t.chatRole(message.From.ID)
+		if role >= tgRoleSupport && t.answerAddClientMessage(&message) {
+			return nil
+		}
+		if userState, exists := userStates[message.Chat.ID]; exists && role >= tgRoleSupport {
 			switch userState {
 			case "awaiting_id":
 				if client_Id == strings.TrimSpace(message.Text) {
@@ -401,7 +508,7 @@ func (t *Tgbot) OnReceive() {
 
 		} else {
 			if message.UsersShared != nil {
-				if checkAdmin(message.From.ID) {
+				if role >= tgRoleSupport {
 					for _, sharedUser := range message.UsersShared.Users {
 						userID := sharedUser.UserID
 						needRestart, err := t.inboundService.SetClientTelegramUserID(message.UsersShared.RequestID, userID)
@@ -427,11 +534,27 @@ func (t *Tgbot) OnReceive() {
 	botHandler.Start()
 }
 
-func (t *Tgbot) answerCommand(message *telego.Message, chatId int64, isAdmin bool) {
+func (t *Tgbot) answerCommand(message *telego.Message, chatId int64, role tgRole) {
 	msg, onlyMessage := "", false
+	isAdmin := role != tgRoleNone
 
 	command, _, commandArgs := tu.ParseCommand(message.Text)
 
+	if !isAdmin {
+		if allowed, limited := t.allowCommand(chatId, command); !allowed {
+			t.SendMsgToTgbot(chatId, limited)
+			return
+		}
+	} else if action, ok := tgCommands[command]; ok {
+		if role < action.role {
+			t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.answers.notAllowed"))
+			return
+		}
+		if action.echo {
+			t.echoAction(message.From, role, message.Text)
+		}
+	}
+
 	// Helper function to handle unknown commands.
 	handleUnknownCommand := func() {
 		msg += t.I18nBot("tgbot.commands.unknown")
@@ -443,6 +566,11 @@ func (t *Tgbot) answerCommand(message *telego.Message, chatId int64, isAdmin boo
 		msg += t.I18nBot("tgbot.commands.help")
 		msg += t.I18nBot("tgbot.commands.pleaseChoose")
 	case "start":
+		if len(commandArgs) > 0 && strings.HasPrefix(commandArgs[0], TrialStartPrefix) {
+			onlyMessage = true
+			msg += t.confirmTrial(message.From.ID, strings.TrimPrefix(commandArgs[0], TrialStartPrefix))
+			break
+		}
 		msg += t.I18nBot("tgbot.commands.start", "Firstname=="+message.From.FirstName)
 		if isAdmin {
 			msg += t.I18nBot("tgbot.commands.welcome", "Hostname=="+hostname)
@@ -450,20 +578,32 @@ func (t *Tgbot) answerCommand(message *telego.Message, chatId int64, isAdmin boo
 		msg += "\n\n" + t.I18nBot("tgbot.commands.pleaseChoose")
 	case "status":
 		onlyMessage = true
-		msg += t.I18nBot("tgbot.commands.status")
+		if isAdmin {
+			t.getStatus(chatId)
+		} else {
+			msg += t.I18nBot("tgbot.commands.status")
+		}
 	case "id":
 		onlyMessage = true
 		msg += t.I18nBot("tgbot.commands.getID", "ID=="+strconv.FormatInt(message.From.ID, 10))
 	case "usage":
 		onlyMessage = true
-		if len(commandArgs) > 0 {
-			if isAdmin {
-				t.searchClient(chatId, commandArgs[0])
-			} else {
-				t.getClientUsage(chatId, int64(message.From.ID), commandArgs[0])
-			}
-		} else {
+		switch {
+		case isAdmin && len(commandArgs) > 0:
+			t.searchClient(chatId, commandArgs[0])
+		case isAdmin:
 			msg += t.I18nBot("tgbot.commands.usage")
+		case !t.selfServiceEnabled():
+			msg += t.I18nBot("tgbot.answers.selfServiceOff")
+		default:
+			t.getClientUsage(chatId, message.From.ID, commandArgs...)
+		}
+	case "mylink":
+		onlyMessage = true
+		if isAdmin || t.selfServiceEnabled() {
+			t.clientLinks(message.From.ID)
+		} else {
+			msg += t.I18nBot("tgbot.answers.selfServiceOff")
 		}
 	case "inbound":
 		onlyMessage = true
@@ -472,6 +612,27 @@ func (t *Tgbot) answerCommand(message *telego.Message, chatId int64, isAdmin boo
 		} else {
 			handleUnknownCommand()
 		}
+	case "addclient":
+		onlyMessage = true
+		if isAdmin {
+			t.startAddClient(chatId)
+		} else {
+			handleUnknownCommand()
+		}
+	case "cancel":
+		onlyMessage = true
+		if isAdmin {
+			msg += t.cancelAddClient(chatId)
+		} else {
+			handleUnknownCommand()
+		}
+	case "restartxray":
+		onlyMessage = true
+		if isAdmin {
+			t.askRestartXray(chatId)
+		} else {
+			handleUnknownCommand()
+		}
 	case "restart":
 		onlyMessage = true
 		if isAdmin {
@@ -530,8 +691,14 @@ func (t *Tgbot) randomShadowSocksPassword() string {
 	return base64.StdEncoding.EncodeToString(array)
 }
 
-func (t *Tgbot) answerCallback(callbackQuery *telego.CallbackQuery, isAdmin bool) {
+func (t *Tgbot) answerCallback(callbackQuery *telego.CallbackQuery, role tgRole) {
 	chatId := callbackQuery.Message.GetChat().ID
+	isAdmin := role != tgRoleNone
+
+	if !isAdmin || clientCallbacks[callbackQuery.Data] {
+		t.answerClientCallback(callbackQuery, isAdmin)
+		return
+	}
 
 	if isAdmin {
 		// get query from hash storage
@@ -540,6 +707,16 @@ func (t *Tgbot) answerCallback(callbackQuery *telego.CallbackQuery, isAdmin bool
 			t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.noQuery"))
 			return
 		}
+		if _, action := t.callbackAction(decodedQuery); role < action.role {
+			t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.notAllowed"))
+			return
+		} else if action.echo {
+			t.echoAction(&callbackQuery.From, role, decodedQuery)
+		}
+		if strings.HasPrefix(decodedQuery, addClientCallback) {
+			t.answerAddClient(callbackQuery, decodedQuery)
+			return
+		}
 		dataArray := strings.Split(decodedQuery, " ")
 
 		if len(dataArray) >= 2 && len(dataArray[1]) > 0 {
@@ -1255,6 +1432,27 @@ func (t *Tgbot) answerCallback(callbackQuery *telego.CallbackQuery, isAdmin bool
 				} else {
 					t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.errorOperation"))
 				}
+			case "rotate_sub":
+				inlineKeyboard := tu.InlineKeyboard(
+					tu.InlineKeyboardRow(
+						tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.cancel")).WithCallbackData(t.encodeQuery("client_cancel "+email)),
+					),
+					tu.InlineKeyboardRow(
+						tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.confirmRotateSub")).WithCallbackData(t.encodeQuery("rotate_sub_c "+email)),
+					),
+				)
+				t.editMessageCallbackTgBot(chatId, callbackQuery.Message.GetMessageID(), inlineKeyboard)
+			case "rotate_sub_c":
+				if sent, err := t.rotateSubscription(chatId, email); err == nil {
+					if sent {
+						t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.rotateSubSuccess", "Email=="+email))
+					} else {
+						t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.successfulOperation"))
+					}
+					t.searchClient(chatId, email, callbackQuery.Message.GetMessageID())
+				} else {
+					t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.errorOperation"))
+				}
 			case "get_clients":
 				inboundId := dataArray[1]
 				inboundIdInt, err := strconv.Atoi(inboundId)
@@ -1330,6 +1528,8 @@ func (t *Tgbot) answerCallback(callbackQuery *telego.CallbackQuery, isAdmin bool
 	}
 
 	switch callbackQuery.Data {
+	case "lock_panel":
+		t.lockPanel(callbackQuery)
 	case "get_usage":
 		t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.buttons.serverUsage"))
 		t.getServerUsage(chatId)
@@ -1348,13 +1548,6 @@ func (t *Tgbot) answerCallback(callbackQuery *telego.CallbackQuery, isAdmin bool
 	case "get_banlogs":
 		t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.buttons.getBanLogs"))
 		t.sendBanLogs(chatId, true)
-	case "client_traffic":
-		tgUserID := callbackQuery.From.ID
-		t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.buttons.clientUsage"))
-		t.getClientUsage(chatId, tgUserID)
-	case "client_commands":
-		t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.buttons.commands"))
-		t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.commands.helpClientCommands"))
 	case "onlines":
 		t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.buttons.onlines"))
 		t.onlineClients(chatId)
@@ -1585,6 +1778,15 @@ func (t *Tgbot) answerCallback(callbackQuery *telego.CallbackQuery, isAdmin bool
 			t.deleteMessageTgBot(chatId, callbackQuery.Message.GetMessageID())
 			t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.answers.successfulOperation"), tu.ReplyKeyboardRemove())
 		}
+	case "status_refresh":
+		t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.successfulOperation"))
+		t.getStatus(chatId, callbackQuery.Message.GetMessageID())
+	case "restart_xray_cancel":
+		t.deleteMessageTgBot(chatId, callbackQuery.Message.GetMessageID())
+		t.SendMsgToTgbotDeleteAfter(chatId, t.I18nBot("tgbot.messages.cancel"), 1, tu.ReplyKeyboardRemove())
+	case "restart_xray_c":
+		t.deleteMessageTgBot(chatId, callbackQuery.Message.GetMessageID())
+		t.restartXray(chatId)
 	case "reset_all_traffics_cancel":
 		t.deleteMessageTgBot(chatId, callbackQuery.Message.GetMessageID())
 		t.SendMsgToTgbotDeleteAfter(chatId, t.I18nBot("tgbot.messages.cancel"), 1, tu.ReplyKeyboardRemove())
@@ -1668,9 +1870,9 @@ func (t *Tgbot) BuildInboundClientDataMessage(inbound_remark string, protocol mo
 	if client_ExpiryTime == 0 {
 		expiryTime = t.I18nBot("tgbot.unlimited")
 	} else if diff > 172800 {
-		expiryTime = time.Unix((client_ExpiryTime / 1000), 0).Format("2006-01-02 15:04:05")
+		expiryTime = t.formatTime(client_ExpiryTime)
 	} else if client_ExpiryTime < 0 {
-		expiryTime = fmt.Sprintf("%d %s", client_ExpiryTime/-86400000, t.I18nBot("tgbot.days"))
+		expiryTime = t.I18nBot("tgbot.startsOnFirstUse", "Days=="+strconv.FormatInt(client_ExpiryTime/-86400000, 10))
 	} else {
 		expiryTime = fmt.Sprintf("%d %s", diff/3600, t.I18nBot("tgbot.hours"))
 	}
@@ -1806,15 +2008,6 @@ func (t *Tgbot) SubmitAddClient() (bool, error) {
 	return t.inboundService.AddInboundClient(newInbound)
 }
 
-func checkAdmin(tgId int64) bool {
-	for _, adminId := range adminIds {
-		if adminId == tgId {
-			return true
-		}
-	}
-	return false
-}
-
 func (t *Tgbot) SendAnswer(chatId int64, msg string, isAdmin bool) {
 	numericKeyboard := tu.InlineKeyboard(
 		tu.InlineKeyboardRow(
@@ -1852,8 +2045,11 @@ func (t *Tgbot) SendAnswer(chatId int64, msg string, isAdmin bool) {
 	var ReplyMarkup telego.ReplyMarkup
 	if isAdmin {
 		ReplyMarkup = numericKeyboard
-	} else {
+	} else if t.selfServiceEnabled() {
 		ReplyMarkup = numericKeyboardClient
+	} else {
+		t.SendMsgToTgbot(chatId, msg)
+		return
 	}
 	t.SendMsgToTgbot(chatId, msg, ReplyMarkup)
 }
@@ -1896,9 +2092,10 @@ func (t *Tgbot) SendMsgToTgbot(chatId int64, msg string, replyMarkup ...telego.R
 			Text:      message,
 			ParseMode: "HTML",
 		}
-		// only add replyMarkup to last message
+		// only add replyMarkup to last message, without the buttons the chat
+		// can't use
 		if len(replyMarkup) > 0 && n == (len(allMessages)-1) {
-			params.ReplyMarkup = replyMarkup[0]
+			params.ReplyMarkup = t.chatReplyMarkup(chatId, replyMarkup[0])
 		}
 		_, err := bot.SendMessage(context.Background(), &params)
 		if err != nil {
@@ -1908,15 +2105,15 @@ func (t *Tgbot) SendMsgToTgbot(chatId int64, msg string, replyMarkup ...telego.R
 	}
 }
 
+// SendMsgToTgbotAdmins sends msg to the chats with the full role.
 func (t *Tgbot) SendMsgToTgbotAdmins(msg string, replyMarkup ...telego.ReplyMarkup) {
-	if len(replyMarkup) > 0 {
-		for _, adminId := range adminIds {
-			t.SendMsgToTgbot(adminId, msg, replyMarkup[0])
-		}
-	} else {
-		for _, adminId := range adminIds {
-			t.SendMsgToTgbot(adminId, msg)
-		}
+	t.sendMsgToTgbotRole(tgRoleFull, msg, replyMarkup...)
+}
+
+// sendMsgToTgbotRole sends msg to the chats with at least role.
+func (t *Tgbot) sendMsgToTgbotRole(role tgRole, msg string, replyMarkup ...telego.ReplyMarkup) {
+	for _, chatId := range t.chatsWithRole(role) {
+		t.SendMsgToTgbot(chatId, msg, replyMarkup...)
 	}
 }
 
@@ -1925,12 +2122,20 @@ func (t *Tgbot) SendReport() {
 	if err == nil && len(runTime) > 0 {
 		msg := ""
 		msg += t.I18nBot("tgbot.messages.report", "RunTime=="+runTime)
-		msg += t.I18nBot("tgbot.messages.datetime", "DateTime=="+time.Now().Format("2006-01-02 15:04:05"))
-		t.SendMsgToTgbotAdmins(msg)
+		msg += t.I18nBot("tgbot.messages.datetime", "DateTime=="+t.formatTime(time.Now().UnixMilli()))
+		t.sendMsgToTgbotRole(tgRoleReadonly, msg)
 	}
 
 	info := t.sendServerUsage()
-	t.SendMsgToTgbotAdmins(info)
+	t.sendMsgToTgbotRole(tgRoleReadonly, info)
+
+	if days, err := t.settingService.GetClientInactiveDays(); err == nil && days > 0 {
+		count, err := t.inboundService.CountInactiveClients(days)
+		if err == nil && count > 0 {
+			t.sendMsgToTgbotRole(tgRoleReadonly, t.I18nBot("tgbot.messages.inactiveClients",
+				"Days=="+strconv.Itoa(days), "Count=="+strconv.FormatInt(count, 10)))
+		}
+	}
 
 	t.sendExhaustedToAdmins()
 	t.notifyExhausted()
@@ -1945,8 +2150,8 @@ func (t *Tgbot) SendBackupToAdmins() {
 	if !t.IsRunning() {
 		return
 	}
-	for _, adminId := range adminIds {
-		t.sendBackup(int64(adminId))
+	for _, adminId := range t.chatsWithRole(tgRoleFull) {
+		t.sendBackup(adminId)
 	}
 }
 
@@ -1954,8 +2159,8 @@ func (t *Tgbot) sendExhaustedToAdmins() {
 	if !t.IsRunning() {
 		return
 	}
-	for _, adminId := range adminIds {
-		t.getExhausted(int64(adminId))
+	for _, adminId := range t.chatsWithRole(tgRoleReadonly) {
+		t.getExhausted(adminId)
 	}
 }
 
@@ -1985,7 +2190,7 @@ func (t *Tgbot) prepareServerUsageInfo() string {
 
 	// get latest status of server
 	t.lastStatus = t.serverService.GetStatus(t.lastStatus)
-	onlines := p.GetOnlineClients()
+	onlines := t.inboundService.GetOnlineClients()
 
 	info += t.I18nBot("tgbot.messages.hostname", "Hostname=="+hostname)
 	info += t.I18nBot("tgbot.messages.version", "Version=="+config.GetVersion())
@@ -2029,37 +2234,6 @@ func (t *Tgbot) prepareServerUsageInfo() string {
 	return info
 }
 
-func (t *Tgbot) UserLoginNotify(username string, password string, ip string, time string, status LoginStatus) {
-	if !t.IsRunning() {
-		return
-	}
-
-	if username == "" || ip == "" || time == "" {
-		logger.Warning("UserLoginNotify failed, invalid info!")
-		return
-	}
-
-	loginNotifyEnabled, err := t.settingService.GetTgBotLoginNotify()
-	if err != nil || !loginNotifyEnabled {
-		return
-	}
-
-	msg := ""
-	switch status {
-	case LoginSuccess:
-		msg += t.I18nBot("tgbot.messages.loginSuccess")
-		msg += t.I18nBot("tgbot.messages.hostname", "Hostname=="+hostname)
-	case LoginFail:
-		msg += t.I18nBot("tgbot.messages.loginFailed")
-		msg += t.I18nBot("tgbot.messages.hostname", "Hostname=="+hostname)
-		msg += t.I18nBot("tgbot.messages.password", "Password=="+password)
-	}
-	msg += t.I18nBot("tgbot.messages.username", "Username=="+username)
-	msg += t.I18nBot("tgbot.messages.ip", "IP=="+ip)
-	msg += t.I18nBot("tgbot.messages.time", "Time=="+time)
-	t.SendMsgToTgbotAdmins(msg)
-}
-
 func (t *Tgbot) getInboundUsages() string {
 	info := ""
 	// get traffic
@@ -2072,13 +2246,13 @@ func (t *Tgbot) getInboundUsages() string {
 		// TODO:Sub-node push, automatic conversion format
 		for _, inbound := range inbounds {
 			info += t.I18nBot("tgbot.messages.inbound", "Remark=="+inbound.Remark)
-			info += t.I18nBot("tgbot.messages.port", "Port=="+strconv.Itoa(inbound.Port))
+			info += t.I18nBot("tgbot.messages.port", "Port=="+inbound.PortString())
 			info += t.I18nBot("tgbot.messages.traffic", "Total=="+common.FormatTraffic((inbound.Up+inbound.Down)), "Upload=="+common.FormatTraffic(inbound.Up), "Download=="+common.FormatTraffic(inbound.Down))
 
 			if inbound.ExpiryTime == 0 {
 				info += t.I18nBot("tgbot.messages.expire", "Time=="+t.I18nBot("tgbot.unlimited"))
 			} else {
-				info += t.I18nBot("tgbot.messages.expire", "Time=="+time.Unix((inbound.ExpiryTime/1000), 0).Format("2006-01-02 15:04:05"))
+				info += t.I18nBot("tgbot.messages.expire", "Time=="+t.formatTime(inbound.ExpiryTime))
 			}
 			info += "\r\n"
 		}
@@ -2208,7 +2382,7 @@ func (t *Tgbot) clientInfoMsg(
 	if traffic.ExpiryTime == 0 {
 		expiryTime = t.I18nBot("tgbot.unlimited")
 	} else if diff > 172800 || !traffic.Enable {
-		expiryTime = time.Unix((traffic.ExpiryTime / 1000), 0).Format("2006-01-02 15:04:05")
+		expiryTime = t.formatTime(traffic.ExpiryTime)
 		if diff > 0 {
 			days := diff / 86400
 			hours := (diff % 86400) / 3600
@@ -2226,7 +2400,7 @@ func (t *Tgbot) clientInfoMsg(
 			expiryTime += fmt.Sprintf(" (%s)", remainingTime)
 		}
 	} else if traffic.ExpiryTime < 0 {
-		expiryTime = fmt.Sprintf("%d %s", traffic.ExpiryTime/-86400000, t.I18nBot("tgbot.days"))
+		expiryTime = t.I18nBot("tgbot.startsOnFirstUse", "Days=="+strconv.FormatInt(traffic.ExpiryTime/-86400000, 10))
 		flag = true
 	} else {
 		expiryTime = fmt.Sprintf("%d %s", diff/3600, t.I18nBot("tgbot.hours"))
@@ -2260,7 +2434,7 @@ func (t *Tgbot) clientInfoMsg(
 
 	status := t.I18nBot("tgbot.offline")
 	if p.IsRunning() {
-		for _, online := range p.GetOnlineClients() {
+		for _, online := range t.inboundService.GetOnlineClients() {
 			if online == traffic.Email {
 				status = t.I18nBot("tgbot.online")
 				break
@@ -2268,8 +2442,25 @@ func (t *Tgbot) clientInfoMsg(
 		}
 	}
 
-	output := ""
+	tags := parseTagColumn(traffic.Tags)
+	output := t.renderTemplate("client", t.trafficVars(map[string]string{
+		"ServerName": hostname,
+		"Email":      traffic.Email,
+		"Tags":       strings.Join(tags, ", "),
+		"Enabled":    enabled,
+		"Online":     status,
+		"Active":     active,
+		"Expiry":     expiryTime,
+		"ExpiryDate": t.templateDate(traffic.ExpiryTime),
+	}, traffic.Up, traffic.Down, traffic.Total))
+	if output != "" {
+		return output
+	}
+
 	output += t.I18nBot("tgbot.messages.email", "Email=="+traffic.Email)
+	if len(tags) > 0 {
+		output += t.I18nBot("tgbot.messages.tags", "Tags=="+strings.Join(tags, ", "))
+	}
 	if printEnabled {
 		output += t.I18nBot("tgbot.messages.enabled", "Enable=="+enabled)
 	}
@@ -2292,7 +2483,7 @@ func (t *Tgbot) clientInfoMsg(
 		output += t.I18nBot("tgbot.messages.total", "UpDown=="+common.FormatTraffic((traffic.Up+traffic.Down)), "Total=="+total)
 	}
 	if printRefreshed {
-		output += t.I18nBot("tgbot.messages.refreshedOn", "Time=="+time.Now().Format("2006-01-02 15:04:05"))
+		output += t.I18nBot("tgbot.messages.refreshedOn", "Time=="+t.formatTime(time.Now().UnixMilli()))
 	}
 
 	return output
@@ -2312,32 +2503,19 @@ func (t *Tgbot) getClientUsage(chatId int64, tgUserID int64, email ...string) {
 		return
 	}
 
-	output := ""
-
-	if len(traffics) > 0 {
-		if len(email) > 0 {
-			for _, traffic := range traffics {
-				if traffic.Email == email[0] {
-					output := t.clientInfoMsg(traffic, true, true, true, true, true, true)
-					t.SendMsgToTgbot(chatId, output)
-					return
-				}
-			}
-			msg := t.I18nBot("tgbot.noResult")
-			t.SendMsgToTgbot(chatId, msg)
+	if len(email) == 0 {
+		t.clientUsage(chatId, tgUserID)
+		return
+	}
+	for _, traffic := range traffics {
+		if traffic.Email == email[0] {
+			output := t.clientInfoMsg(traffic, true, true, true, true, true, true)
+			t.SendMsgToTgbot(chatId, output)
 			return
-		} else {
-			for _, traffic := range traffics {
-				output += t.clientInfoMsg(traffic, true, true, true, true, true, false)
-				output += "\r\n"
-			}
 		}
 	}
-
-	output += t.I18nBot("tgbot.messages.refreshedOn", "Time=="+time.Now().Format("2006-01-02 15:04:05"))
-	t.SendMsgToTgbot(chatId, output)
-	output = t.I18nBot("tgbot.commands.pleaseChoose")
-	t.SendAnswer(chatId, output, false)
+	msg := t.I18nBot("tgbot.noResult")
+	t.SendMsgToTgbot(chatId, msg)
 }
 
 func (t *Tgbot) searchClientIps(chatId int64, email string, messageID ...int) {
@@ -2349,7 +2527,7 @@ func (t *Tgbot) searchClientIps(chatId int64, email string, messageID ...int) {
 	output := ""
 	output += t.I18nBot("tgbot.messages.email", "Email=="+email)
 	output += t.I18nBot("tgbot.messages.ips", "IPs=="+ips)
-	output += t.I18nBot("tgbot.messages.refreshedOn", "Time=="+time.Now().Format("2006-01-02 15:04:05"))
+	output += t.I18nBot("tgbot.messages.refreshedOn", "Time=="+t.formatTime(time.Now().UnixMilli()))
 
 	inlineKeyboard := tu.InlineKeyboard(
 		tu.InlineKeyboardRow(
@@ -2388,7 +2566,7 @@ func (t *Tgbot) clientTelegramUserInfo(chatId int64, email string, messageID ...
 	output := ""
 	output += t.I18nBot("tgbot.messages.email", "Email=="+email)
 	output += t.I18nBot("tgbot.messages.TGUser", "TelegramID=="+tgId)
-	output += t.I18nBot("tgbot.messages.refreshedOn", "Time=="+time.Now().Format("2006-01-02 15:04:05"))
+	output += t.I18nBot("tgbot.messages.refreshedOn", "Time=="+t.formatTime(time.Now().UnixMilli()))
 
 	inlineKeyboard := tu.InlineKeyboard(
 		tu.InlineKeyboardRow(
@@ -2456,12 +2634,55 @@ func (t *Tgbot) searchClient(chatId int64, email string, messageID ...int) {
 		tu.InlineKeyboardRow(
 			tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.toggle")).WithCallbackData(t.encodeQuery("toggle_enable "+email)),
 		),
+		tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.rotateSub")).WithCallbackData(t.encodeQuery("rotate_sub "+email)),
+		),
 	)
 	if len(messageID) > 0 {
 		t.editMessageTgBot(chatId, messageID[0], output, inlineKeyboard)
 	} else {
 		t.SendMsgToTgbot(chatId, output, inlineKeyboard)
+		t.sendClientQRCode(chatId, email)
+	}
+}
+
+// rotateSubscription gives a client a new subscription ID for the admin in
+// chatId and sends the new link to the client, or to the admin if the client
+// has no Telegram user. It returns whether the link was sent, it isn't while
+// subscriptions are off.
+func (t *Tgbot) rotateSubscription(chatId int64, email string) (bool, error) {
+	result, needRestart, err := t.inboundService.RotateClient(email, &ClientRotate{RotateSubId: true})
+	entry := &model.AuditLog{
+		Actor:      fmt.Sprintf("telegram:%d", chatId),
+		Action:     "client.rotate",
+		EntityType: "client",
+		EntityId:   email,
+		Success:    err == nil,
+	}
+	if err == nil {
+		// The new subscription ID is a secret, only what changed is logged
+		entry.Diff = AuditDiff(map[string]any{}, map[string]any{"rotated": result.Rotated})
+	}
+	t.auditService.Record(entry)
+	if err != nil {
+		logger.Warning("rotate subscription failed:", err)
+		return false, err
+	}
+	if needRestart {
+		t.xrayService.SetToNeedRestart()
+	}
+
+	link, err := t.subLink(result.SubId)
+	if err != nil || link == "" {
+		return false, err
 	}
+	msg := t.I18nBot("tgbot.messages.subRotated", "Email=="+result.Email, "Link=="+link)
+	if result.Client.TgID != 0 {
+		t.SendMsgToTgbot(result.Client.TgID, msg)
+	} else {
+		t.SendMsgToTgbot(chatId, msg)
+	}
+	return true, nil
 }
 
 func (t *Tgbot) addClient(chatId int64, msg string, messageID ...int) {
@@ -2577,13 +2798,13 @@ func (t *Tgbot) searchInbound(chatId int64, remark string) {
 	for _, inbound := range inbounds {
 		info := ""
 		info += t.I18nBot("tgbot.messages.inbound", "Remark=="+inbound.Remark)
-		info += t.I18nBot("tgbot.messages.port", "Port=="+strconv.Itoa(inbound.Port))
+		info += t.I18nBot("tgbot.messages.port", "Port=="+inbound.PortString())
 		info += t.I18nBot("tgbot.messages.traffic", "Total=="+common.FormatTraffic((inbound.Up+inbound.Down)), "Upload=="+common.FormatTraffic(inbound.Up), "Download=="+common.FormatTraffic(inbound.Down))
 
 		if inbound.ExpiryTime == 0 {
 			info += t.I18nBot("tgbot.messages.expire", "Time=="+t.I18nBot("tgbot.unlimited"))
 		} else {
-			info += t.I18nBot("tgbot.messages.expire", "Time=="+time.Unix((inbound.ExpiryTime/1000), 0).Format("2006-01-02 15:04:05"))
+			info += t.I18nBot("tgbot.messages.expire", "Time=="+t.formatTime(inbound.ExpiryTime))
 		}
 		t.SendMsgToTgbot(chatId, info)
 
@@ -2653,12 +2874,12 @@ func (t *Tgbot) getExhausted(chatId int64) {
 
 		for _, inbound := range exhaustedInbounds {
 			output += t.I18nBot("tgbot.messages.inbound", "Remark=="+inbound.Remark)
-			output += t.I18nBot("tgbot.messages.port", "Port=="+strconv.Itoa(inbound.Port))
+			output += t.I18nBot("tgbot.messages.port", "Port=="+inbound.PortString())
 			output += t.I18nBot("tgbot.messages.traffic", "Total=="+common.FormatTraffic((inbound.Up+inbound.Down)), "Upload=="+common.FormatTraffic(inbound.Up), "Download=="+common.FormatTraffic(inbound.Down))
 			if inbound.ExpiryTime == 0 {
 				output += t.I18nBot("tgbot.messages.expire", "Time=="+t.I18nBot("tgbot.unlimited"))
 			} else {
-				output += t.I18nBot("tgbot.messages.expire", "Time=="+time.Unix((inbound.ExpiryTime/1000), 0).Format("2006-01-02 15:04:05"))
+				output += t.I18nBot("tgbot.messages.expire", "Time=="+t.formatTime(inbound.ExpiryTime))
 			}
 			output += "\r\n"
 		}
@@ -2684,11 +2905,11 @@ func (t *Tgbot) getExhausted(chatId int64) {
 		} else {
 			cols = 2
 		}
-		output += t.I18nBot("tgbot.messages.refreshedOn", "Time=="+time.Now().Format("2006-01-02 15:04:05"))
+		output += t.I18nBot("tgbot.messages.refreshedOn", "Time=="+t.formatTime(time.Now().UnixMilli()))
 		keyboard := tu.InlineKeyboardGrid(tu.InlineKeyboardCols(cols, buttons...))
 		t.SendMsgToTgbot(chatId, output, keyboard)
 	} else {
-		output += t.I18nBot("tgbot.messages.refreshedOn", "Time=="+time.Now().Format("2006-01-02 15:04:05"))
+		output += t.I18nBot("tgbot.messages.refreshedOn", "Time=="+t.formatTime(time.Now().UnixMilli()))
 		t.SendMsgToTgbot(chatId, output)
 	}
 }
@@ -2711,7 +2932,8 @@ func (t *Tgbot) notifyExhausted() {
 		logger.Warning("Unable to load Inbounds", err)
 	}
 
-	var chatIDsDone []int64
+	// The admin chats get the list of every client instead
+	chatIDsDone := t.chatsWithRole(tgRoleReadonly)
 	for _, inbound := range inbounds {
 		if inbound.Enable {
 			if len(inbound.ClientStats) > 0 {
@@ -2720,7 +2942,7 @@ func (t *Tgbot) notifyExhausted() {
 					for _, client := range clients {
 						if client.TgID != 0 {
 							chatID := client.TgID
-							if !int64Contains(chatIDsDone, chatID) && !checkAdmin(chatID) {
+							if !int64Contains(chatIDsDone, chatID) {
 								var disabledClients []xray.ClientTraffic
 								var exhaustedClients []xray.ClientTraffic
 								traffics, err := t.inboundService.GetClientTrafficTgBot(client.TgID)
@@ -2764,6 +2986,36 @@ func (t *Tgbot) notifyExhausted() {
 	}
 }
 
+// NotifyThreshold tells the user of a client, or the admins if it has no
+// Telegram ID, that it crossed a notification threshold.
+func (t *Tgbot) NotifyThreshold(crossing *ClientThresholdCrossing) {
+	if crossing.TgId != 0 && !t.IsRunning() || crossing.TgId == 0 && !t.AlertsOn(AlertTraffic) {
+		return
+	}
+	msg := t.renderTemplate("traffic", t.trafficVars(map[string]string{
+		"ServerName": hostname,
+		"Email":      crossing.Email,
+		"Percent":    strconv.Itoa(crossing.Percent),
+		"ExpiryDate": t.templateDate(crossing.ExpiryTime),
+	}, crossing.Up, crossing.Down, crossing.Total))
+	if msg == "" {
+		msg = t.I18nBot("tgbot.messages.trafficThreshold", "Email=="+crossing.Email, "Percent=="+strconv.Itoa(crossing.Percent))
+		msg += t.clientInfoMsg(&xray.ClientTraffic{
+			Email:      crossing.Email,
+			Enable:     true,
+			Up:         crossing.Up,
+			Down:       crossing.Down,
+			Total:      crossing.Total,
+			ExpiryTime: crossing.ExpiryTime,
+		}, false, false, false, true, true, false)
+	}
+	if crossing.TgId != 0 {
+		t.SendMsgToTgbot(crossing.TgId, msg)
+	} else {
+		t.SendAlert(AlertTraffic, msg)
+	}
+}
+
 func int64Contains(slice []int64, item int64) bool {
 	for _, s := range slice {
 		if s == item {
@@ -2778,7 +3030,7 @@ func (t *Tgbot) onlineClients(chatId int64, messageID ...int) {
 		return
 	}
 
-	onlines := p.GetOnlineClients()
+	onlines := t.inboundService.GetOnlineClients()
 	onlinesCount := len(onlines)
 	output := t.I18nBot("tgbot.messages.onlinesCount", "Count=="+fmt.Sprint(onlinesCount))
 	keyboard := tu.InlineKeyboard(tu.InlineKeyboardRow(
@@ -2808,34 +3060,45 @@ func (t *Tgbot) onlineClients(chatId int64, messageID ...int) {
 }
 
 func (t *Tgbot) sendBackup(chatId int64) {
-	output := t.I18nBot("tgbot.messages.backupTime", "Time=="+time.Now().Format("2006-01-02 15:04:05"))
+	output := t.I18nBot("tgbot.messages.backupTime", "Time=="+t.formatTime(time.Now().UnixMilli()))
 	t.SendMsgToTgbot(chatId, output)
 
-	// Update by manually trigger a checkpoint operation
-	err := database.Checkpoint()
-	if err != nil {
-		logger.Error("Error in trigger a checkpoint operation: ", err)
+	// The backup includes the traffic not written yet
+	if err := t.inboundService.FlushTraffic(); err != nil {
+		logger.Warning("Error in flushing traffic before backup: ", err)
 	}
 
-	file, err := os.Open(config.GetDBPath())
-	if err == nil {
-		document := tu.Document(
-			tu.ID(chatId),
-			tu.File(file),
-		)
-		_, err = bot.SendDocument(context.Background(), document)
-		if err != nil {
-			logger.Error("Error in uploading backup: ", err)
+	// Other databases are backed up with their own tools. Both files are
+	// encrypted when there is a backup passphrase
+	if database.IsSQLite() {
+		db, err := database.Backup()
+		var name string
+		if err == nil {
+			db, name, err = t.settingService.encryptBackup(db, filepath.Base(config.GetDBPath()))
+		}
+		if err == nil {
+			document := tu.Document(
+				tu.ID(chatId),
+				tu.FileFromBytes(db, name),
+			)
+			_, err = bot.SendDocument(context.Background(), document)
+			if err != nil {
+				logger.Error("Error in uploading backup: ", err)
+			}
+		} else {
+			logger.Error("Error in making db backup: ", err)
 		}
-	} else {
-		logger.Error("Error in opening db file for backup: ", err)
 	}
 
-	file, err = os.Open(xray.GetConfigPath())
+	xrayConfig, err := os.ReadFile(xray.GetConfigPath())
+	var name string
+	if err == nil {
+		xrayConfig, name, err = t.settingService.encryptBackup(xrayConfig, filepath.Base(xray.GetConfigPath()))
+	}
 	if err == nil {
 		document := tu.Document(
 			tu.ID(chatId),
-			tu.File(file),
+			tu.FileFromBytes(xrayConfig, name),
 		)
 		_, err = bot.SendDocument(context.Background(), document)
 		if err != nil {
@@ -2848,7 +3111,7 @@ func (t *Tgbot) sendBackup(chatId int64) {
 
 func (t *Tgbot) sendBanLogs(chatId int64, dt bool) {
 	if dt {
-		output := t.I18nBot("tgbot.messages.datetime", "DateTime=="+time.Now().Format("2006-01-02 15:04:05"))
+		output := t.I18nBot("tgbot.messages.datetime", "DateTime=="+t.formatTime(time.Now().UnixMilli()))
 		t.SendMsgToTgbot(chatId, output)
 	}
 
@@ -2906,6 +3169,9 @@ func (t *Tgbot) sendCallbackAnswerTgBot(id string, message string) {
 }
 
 func (t *Tgbot) editMessageCallbackTgBot(chatId int64, messageID int, inlineKeyboard *telego.InlineKeyboardMarkup) {
+	if inlineKeyboard != nil {
+		inlineKeyboard = t.roleKeyboard(t.chatRole(chatId), inlineKeyboard)
+	}
 	params := telego.EditMessageReplyMarkupParams{
 		ChatID:      tu.ID(chatId),
 		MessageID:   messageID,
@@ -2924,7 +3190,7 @@ func (t *Tgbot) editMessageTgBot(chatId int64, messageID int, text string, inlin
 		ParseMode: "HTML",
 	}
 	if len(inlineKeyboard) > 0 {
-		params.ReplyMarkup = inlineKeyboard[0]
+		params.ReplyMarkup = t.roleKeyboard(t.chatRole(chatId), inlineKeyboard[0])
 	}
 	if _, err := bot.EditMessageText(context.Background(), &params); err != nil {
 		logger.Warning(err)
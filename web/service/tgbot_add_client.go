@@ -0,0 +1,349 @@
+package service
+
+import (
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"x-ui/database/model"
+	"x-ui/logger"
+
+	"github.com/mymmrac/telego"
+	tu "github.com/mymmrac/telego/telegoutil"
+)
+
+const (
+	// addClientTimeout is how long a client creation waits for the admin before
+	// it is abandoned
+	addClientTimeout = 10 * time.Minute
+	// addClientConversationsMax bounds the client creations in progress, the
+	// oldest one is dropped for a new one
+	addClientConversationsMax = 100
+	// addClientCallback prefixes the buttons of the client creation
+	addClientCallback = "addclient_"
+)
+
+// addClientQuotas are the traffic limits offered, in gigabytes, and
+// addClientDurations the validities, in days; 0 is unlimited.
+var (
+	addClientQuotas    = []int{50, 200, 0}
+	addClientDurations = []int{30, 90, 0}
+)
+
+// ShareLinker returns the share links of the client with email of inbound for
+// clients that connect to host, one per line.
+type ShareLinker func(inbound *model.Inbound, email string, host string) string
+
+var shareLinker ShareLinker
+
+// SetShareLinker sets how the bot makes the share links of the clients it
+// creates. The links are made by the sub package, which can't be imported here.
+func SetShareLinker(linker ShareLinker) {
+	shareLinker = linker
+}
+
+type addClientStep int
+
+const (
+	addClientInbound addClientStep = iota
+	addClientEmail
+	addClientQuota
+	addClientExpiry
+)
+
+// addClientConversation is a client creation in progress in a chat.
+type addClientConversation struct {
+	step      addClientStep
+	inboundId int
+	remark    string
+	email     string
+	totalGB   int
+	updatedAt time.Time
+}
+
+var addClientConversations = struct {
+	sync.Mutex
+	byChat map[int64]addClientConversation
+}{byChat: make(map[int64]addClientConversation)}
+
+// getAddClient returns the client creation in progress in chatId, and whether
+// one was dropped for being abandoned too long.
+func getAddClient(chatId int64) (*addClientConversation, bool) {
+	addClientConversations.Lock()
+	defer addClientConversations.Unlock()
+	conv, ok := addClientConversations.byChat[chatId]
+	if !ok {
+		return nil, false
+	}
+	if time.Since(conv.updatedAt) > addClientTimeout {
+		delete(addClientConversations.byChat, chatId)
+		return nil, true
+	}
+	return &conv, false
+}
+
+// putAddClient saves the client creation of chatId, making room for it if
+// there are too many.
+func putAddClient(chatId int64, conv *addClientConversation) {
+	addClientConversations.Lock()
+	defer addClientConversations.Unlock()
+	byChat := addClientConversations.byChat
+	if _, ok := byChat[chatId]; !ok && len(byChat) >= addClientConversationsMax {
+		oldest := int64(0)
+		for id, other := range byChat {
+			if time.Since(other.updatedAt) > addClientTimeout {
+				delete(byChat, id)
+			} else if oldest == 0 || other.updatedAt.Before(byChat[oldest].updatedAt) {
+				oldest = id
+			}
+		}
+		if len(byChat) >= addClientConversationsMax {
+			delete(byChat, oldest)
+		}
+	}
+	conv.updatedAt = time.Now()
+	byChat[chatId] = *conv
+}
+
+// endAddClient drops the client creation of chatId, and reports whether there
+// was one.
+func endAddClient(chatId int64) bool {
+	addClientConversations.Lock()
+	defer addClientConversations.Unlock()
+	_, ok := addClientConversations.byChat[chatId]
+	delete(addClientConversations.byChat, chatId)
+	return ok
+}
+
+func (t *Tgbot) addClientCancelRow() []telego.InlineKeyboardButton {
+	return tu.InlineKeyboardRow(
+		tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.cancel")).WithCallbackData(addClientCallback + "cancel"),
+	)
+}
+
+// startAddClient answers /addclient: it asks for the inbound of the new client.
+func (t *Tgbot) startAddClient(chatId int64) {
+	inbounds, err := t.inboundService.GetAllInbounds()
+	if err != nil {
+		logger.Warning("Unable to get the inbounds:", err)
+		t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.answers.getInboundsFailed"))
+		return
+	}
+	var rows [][]telego.InlineKeyboardButton
+	for _, inbound := range inbounds {
+		switch inbound.Protocol {
+		case model.VMESS, model.VLESS, model.Trojan, model.Shadowsocks:
+		default:
+			continue
+		}
+		label := fmt.Sprintf("%s (%d)", inbound.Remark, inbound.Port)
+		rows = append(rows, tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton(label).WithCallbackData(fmt.Sprintf("%sinbound %d", addClientCallback, inbound.Id)),
+		))
+	}
+	if len(rows) == 0 {
+		t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.noInbounds"))
+		return
+	}
+	rows = append(rows, t.addClientCancelRow())
+
+	putAddClient(chatId, &addClientConversation{step: addClientInbound})
+	t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.answers.chooseInbound"), tu.InlineKeyboard(rows...))
+}
+
+// cancelAddClient answers /cancel.
+func (t *Tgbot) cancelAddClient(chatId int64) string {
+	endAddClient(chatId)
+	return t.I18nBot("tgbot.messages.cancel")
+}
+
+// answerAddClient answers the buttons of a client creation, query being the
+// callback data.
+func (t *Tgbot) answerAddClient(callbackQuery *telego.CallbackQuery, query string) {
+	chatId := callbackQuery.Message.GetChat().ID
+	messageID := callbackQuery.Message.GetMessageID()
+	action, arg, _ := strings.Cut(strings.TrimPrefix(query, addClientCallback), " ")
+
+	if action == "cancel" {
+		t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.buttons.cancel"))
+		t.editMessageTgBot(chatId, messageID, t.cancelAddClient(chatId))
+		return
+	}
+
+	conv, expired := getAddClient(chatId)
+	if conv == nil {
+		msg := t.I18nBot("tgbot.noQuery")
+		if expired {
+			msg = t.I18nBot("tgbot.messages.addClientTimedOut")
+		}
+		t.sendCallbackAnswerTgBot(callbackQuery.ID, msg)
+		t.editMessageTgBot(chatId, messageID, msg)
+		return
+	}
+	value, err := strconv.Atoi(arg)
+	if err != nil {
+		t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.noQuery"))
+		return
+	}
+
+	switch {
+	case action == "inbound" && conv.step == addClientInbound:
+		inbound, err := t.inboundService.GetInbound(value)
+		if err != nil {
+			t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.getInboundsFailed"))
+			return
+		}
+		conv.inboundId, conv.remark, conv.step = inbound.Id, inbound.Remark, addClientEmail
+		putAddClient(chatId, conv)
+		t.sendCallbackAnswerTgBot(callbackQuery.ID, inbound.Remark)
+		t.editMessageTgBot(chatId, messageID, t.I18nBot("tgbot.messages.addClientEmail", "Inbound=="+html.EscapeString(inbound.Remark)),
+			tu.InlineKeyboard(t.addClientCancelRow()))
+	case action == "quota" && conv.step == addClientQuota:
+		conv.totalGB, conv.step = max(value, 0), addClientExpiry
+		putAddClient(chatId, conv)
+		t.sendCallbackAnswerTgBot(callbackQuery.ID, t.addClientQuotaLabel(conv.totalGB))
+		t.editMessageTgBot(chatId, messageID, t.I18nBot("tgbot.messages.addClientExpiry", "Email=="+html.EscapeString(conv.email)),
+			t.addClientChoices("expiry", addClientDurations, t.addClientDurationLabel))
+	case action == "expiry" && conv.step == addClientExpiry:
+		endAddClient(chatId)
+		days := max(value, 0)
+		t.sendCallbackAnswerTgBot(callbackQuery.ID, t.addClientDurationLabel(days))
+		t.editMessageCallbackTgBot(chatId, messageID, nil)
+		t.createClient(chatId, conv, days)
+	default:
+		// A button of a step that is already past
+		t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.noQuery"))
+	}
+}
+
+// answerAddClientMessage takes the email of a client creation from message,
+// and reports whether the message was one.
+func (t *Tgbot) answerAddClientMessage(message *telego.Message) bool {
+	chatId := message.Chat.ID
+	conv, expired := getAddClient(chatId)
+	if conv == nil {
+		if expired {
+			t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.messages.addClientTimedOut"))
+		}
+		return expired
+	}
+	if conv.step != addClientEmail {
+		return false
+	}
+
+	fields := strings.Fields(message.Text)
+	if len(fields) != 1 {
+		t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.messages.incorrect_input"), tu.InlineKeyboard(t.addClientCancelRow()))
+		return true
+	}
+	email := fields[0]
+	if _, err := t.inboundService.checkClientEmails([]model.Client{{Email: email}}, nil); err != nil {
+		t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.messages.addClientEmailTaken", "Error=="+html.EscapeString(err.Error())),
+			tu.InlineKeyboard(t.addClientCancelRow()))
+		return true
+	}
+
+	conv.email, conv.step = email, addClientQuota
+	putAddClient(chatId, conv)
+	t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.messages.addClientQuota", "Email=="+html.EscapeString(email)),
+		t.addClientChoices("quota", addClientQuotas, t.addClientQuotaLabel))
+	return true
+}
+
+// addClientChoices is a keyboard with a button for each of values, and one to
+// cancel.
+func (t *Tgbot) addClientChoices(action string, values []int, label func(int) string) *telego.InlineKeyboardMarkup {
+	var buttons []telego.InlineKeyboardButton
+	for _, value := range values {
+		buttons = append(buttons, tu.InlineKeyboardButton(label(value)).
+			WithCallbackData(fmt.Sprintf("%s%s %d", addClientCallback, action, value)))
+	}
+	return tu.InlineKeyboard(tu.InlineKeyboardRow(buttons...), t.addClientCancelRow())
+}
+
+func (t *Tgbot) addClientQuotaLabel(gb int) string {
+	if gb == 0 {
+		return t.I18nBot("tgbot.buttons.noLimit")
+	}
+	return fmt.Sprintf("%d GB", gb)
+}
+
+func (t *Tgbot) addClientDurationLabel(days int) string {
+	if days == 0 {
+		return t.I18nBot("tgbot.buttons.noLimit")
+	}
+	return fmt.Sprintf("%d %s", days, t.I18nBot("tgbot.days"))
+}
+
+// createClient adds the client of conv valid for days, and sends its links and
+// the QR code of its subscription, or of its share link without one.
+func (t *Tgbot) createClient(chatId int64, conv *addClientConversation, days int) {
+	inbound, err := t.inboundService.GetInbound(conv.inboundId)
+	if err != nil {
+		t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.messages.error_add_client", "error=="+html.EscapeString(err.Error())))
+		return
+	}
+	var expiryTime int64
+	if days > 0 {
+		expiryTime = time.Now().AddDate(0, 0, days).UnixMilli()
+	}
+	client, settings, err := NewClient(inbound, conv.email, float64(conv.totalGB), expiryTime)
+	if err != nil {
+		t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.messages.error_add_client", "error=="+html.EscapeString(err.Error())))
+		return
+	}
+
+	needRestart, err := t.inboundService.AddInboundClient(&model.Inbound{Id: inbound.Id, Settings: settings})
+	entry := &model.AuditLog{
+		Actor:      fmt.Sprintf("telegram:%d", chatId),
+		Action:     "inbound.addClient",
+		EntityType: "inbound",
+		EntityId:   strconv.Itoa(inbound.Id),
+		Success:    err == nil,
+	}
+	if err == nil {
+		entry.Diff = AuditDiff(map[string]any{}, map[string]any{"email": client.Email})
+	}
+	t.auditService.Record(entry)
+	if err != nil {
+		logger.Warning("adding a client from Telegram failed:", err)
+		t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.messages.error_add_client", "error=="+html.EscapeString(err.Error())))
+		return
+	}
+	if needRestart {
+		t.xrayService.SetToNeedRestart()
+	}
+
+	msg := t.I18nBot("tgbot.messages.addClientCreated", "Email=="+html.EscapeString(client.Email),
+		"Inbound=="+html.EscapeString(conv.remark))
+	var links []string
+	if shareLinker != nil {
+		if inbound, err = t.inboundService.GetInbound(conv.inboundId); err == nil {
+			links = strings.Fields(shareLinker(inbound, client.Email, t.linkHost()))
+		}
+	}
+	for _, link := range links {
+		msg += t.I18nBot("tgbot.messages.shareLink", "Link=="+html.EscapeString(link))
+	}
+	subLink, err := t.subLink(client.SubID)
+	if err != nil {
+		logger.Warning("Unable to get the subscription link:", err)
+	}
+	if subLink != "" {
+		msg += t.I18nBot("tgbot.messages.subLink", "Email=="+html.EscapeString(client.Email), "Link=="+html.EscapeString(subLink))
+	}
+	t.SendMsgToTgbot(chatId, msg)
+
+	qr := subLink
+	if qr == "" && len(links) > 0 {
+		qr = links[0]
+	}
+	if qr != "" {
+		if err := t.sendQRCode(chatId, qr, html.EscapeString(client.Email)); err != nil {
+			logger.Warning("Error sending the QR code of the new client:", err)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package service
+
+import (
+	"context"
+	"html"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/web/middleware"
+
+	"github.com/mymmrac/telego"
+	tu "github.com/mymmrac/telego/telegoutil"
+)
+
+const (
+	// tgCommandsPerMinute and tgCommandBurst limit every command and button of
+	// a chat that isn't an admin's, each on its own
+	tgCommandsPerMinute = 6
+	tgCommandBurst      = 3
+	// tgCommandLimiterKeys bounds the memory used by the command rate limiter
+	tgCommandLimiterKeys = 10000
+	// tgQRCodeSize is the width and height of the QR codes of the links, in pixels
+	tgQRCodeSize = 512
+)
+
+var tgCommandLimiter = middleware.NewRateLimiter(tgCommandsPerMinute, tgCommandBurst, tgCommandLimiterKeys)
+
+// clientCallbacks are the buttons of the clients, which are all that users
+// who aren't admins may press.
+var clientCallbacks = map[string]bool{
+	"client_traffic":       true,
+	"client_commands":      true,
+	"client_usage_refresh": true,
+	"client_link":          true,
+}
+
+// allowCommand takes a token of the command of chatId from the rate limiter,
+// and tells how long to wait when there is none.
+func (t *Tgbot) allowCommand(chatId int64, command string) (bool, string) {
+	allowed, wait := tgCommandLimiter.Allow(strconv.FormatInt(chatId, 10) + " " + command)
+	if allowed {
+		return true, ""
+	}
+	seconds := int(math.Ceil(wait.Seconds()))
+	return false, t.I18nBot("tgbot.answers.tooManyRequests", "Seconds=="+strconv.Itoa(seconds))
+}
+
+// selfServiceEnabled reports whether users who aren't admins may look up their
+// own clients.
+func (t *Tgbot) selfServiceEnabled() bool {
+	enabled, err := t.settingService.GetTgBotSelfService()
+	if err != nil {
+		logger.Warning("Unable to get the Telegram self-service setting:", err)
+		return false
+	}
+	return enabled
+}
+
+// answerClientCallback answers the client buttons, the only ones of users who
+// aren't admins. Those are rate limited and subject to the self-service
+// setting.
+func (t *Tgbot) answerClientCallback(callbackQuery *telego.CallbackQuery, isAdmin bool) {
+	chatId := callbackQuery.Message.GetChat().ID
+	tgUserID := callbackQuery.From.ID
+	data := callbackQuery.Data
+
+	if !clientCallbacks[data] {
+		t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.noResult"))
+		return
+	}
+	if !isAdmin {
+		if !t.selfServiceEnabled() {
+			t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.selfServiceOff"))
+			return
+		}
+		if allowed, msg := t.allowCommand(chatId, data); !allowed {
+			t.sendCallbackAnswerTgBot(callbackQuery.ID, msg)
+			return
+		}
+	}
+
+	switch data {
+	case "client_traffic":
+		t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.buttons.clientUsage"))
+		t.clientUsage(chatId, tgUserID)
+	case "client_usage_refresh":
+		t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.successfulOperation"))
+		t.clientUsage(chatId, tgUserID, callbackQuery.Message.GetMessageID())
+	case "client_link":
+		t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.buttons.clientLink"))
+		t.clientLinks(tgUserID)
+	case "client_commands":
+		t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.buttons.commands"))
+		t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.commands.helpClientCommands"))
+	}
+}
+
+// clientUsage sends the user tgUserID the traffic, the expiry date and the
+// online status of their clients, or edits messageID to refresh them.
+func (t *Tgbot) clientUsage(chatId int64, tgUserID int64, messageID ...int) {
+	traffics, err := t.inboundService.GetClientTrafficTgBot(tgUserID)
+	if err != nil {
+		logger.Warning(err)
+		t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.wentWrong"))
+		return
+	}
+	if len(traffics) == 0 {
+		t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.answers.askToAddUserId", "TgUserID=="+strconv.FormatInt(tgUserID, 10)))
+		return
+	}
+
+	output := ""
+	for _, traffic := range traffics {
+		output += t.clientInfoMsg(traffic, true, true, true, true, true, false)
+		remaining := t.I18nBot("tgbot.unlimited")
+		if traffic.Total > 0 {
+			remaining = common.FormatTraffic(max(traffic.Total-traffic.Up-traffic.Down, 0))
+		}
+		output += t.I18nBot("tgbot.messages.remaining", "Remaining=="+remaining)
+		output += "\r\n"
+	}
+	output += t.I18nBot("tgbot.messages.refreshedOn", "Time=="+t.formatTime(time.Now().UnixMilli()))
+
+	inlineKeyboard := tu.InlineKeyboard(
+		tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.refresh")).WithCallbackData("client_usage_refresh"),
+			tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.clientLink")).WithCallbackData("client_link"),
+		),
+	)
+	if len(messageID) > 0 {
+		t.editMessageTgBot(chatId, messageID[0], output, inlineKeyboard)
+	} else {
+		t.SendMsgToTgbot(chatId, output, inlineKeyboard)
+	}
+}
+
+// clientLinks sends the user tgUserID, in a private chat, the subscription link
+// of each of their subscriptions with its QR code.
+func (t *Tgbot) clientLinks(tgUserID int64) {
+	clients, err := t.inboundService.GetClientsByTgId(tgUserID)
+	if err != nil {
+		logger.Warning(err)
+		t.SendMsgToTgbot(tgUserID, t.I18nBot("tgbot.wentWrong"))
+		return
+	}
+	if len(clients) == 0 {
+		t.SendMsgToTgbot(tgUserID, t.I18nBot("tgbot.answers.askToAddUserId", "TgUserID=="+strconv.FormatInt(tgUserID, 10)))
+		return
+	}
+
+	// Clients of several inbounds share the link of their subscription id
+	var subIds []string
+	emails := make(map[string][]string)
+	for _, client := range clients {
+		if client.SubID == "" {
+			continue
+		}
+		if _, ok := emails[client.SubID]; !ok {
+			subIds = append(subIds, client.SubID)
+		}
+		emails[client.SubID] = append(emails[client.SubID], html.EscapeString(client.Email))
+	}
+
+	sent := false
+	for _, subId := range subIds {
+		link, err := t.subLink(subId)
+		if err != nil {
+			logger.Warning("Unable to get the subscription link:", err)
+			t.SendMsgToTgbot(tgUserID, t.I18nBot("tgbot.wentWrong"))
+			return
+		}
+		if link == "" {
+			break
+		}
+		caption := t.I18nBot("tgbot.messages.subLink", "Email=="+strings.Join(emails[subId], ", "), "Link=="+html.EscapeString(link))
+		sent = true
+		if err := t.sendQRCode(tgUserID, link, caption); err != nil {
+			// The link is still of use without its QR code
+			logger.Warning("Error sending the QR code of the subscription link:", err)
+			t.SendMsgToTgbot(tgUserID, caption)
+		}
+	}
+	if !sent {
+		t.SendMsgToTgbot(tgUserID, t.I18nBot("tgbot.answers.noSubscription"))
+	}
+}
+
+// sendQRCode sends chatId the QR code of content as a photo with caption.
+func (t *Tgbot) sendQRCode(chatId int64, content string, caption string) error {
+	png, _, err := EncodeQRCode(content, tgQRCodeSize, "M", "png")
+	if err != nil {
+		return err
+	}
+	_, err = bot.SendPhoto(context.Background(), &telego.SendPhotoParams{
+		ChatID:    tu.ID(chatId),
+		Photo:     tu.FileFromBytes(png, "qr.png"),
+		Caption:   caption,
+		ParseMode: telego.ModeHTML,
+	})
+	return err
+}
+
+// sendClientQRCode sends chatId the QR code of the subscription link of the
+// client of email, or of its first share link if subscriptions are off. A peer
+// of a WireGuard inbound gets its wg-quick config, as a QR code and a file.
+func (t *Tgbot) sendClientQRCode(chatId int64, email string) {
+	traffic, inbound, err := t.inboundService.GetClientInboundByEmail(email)
+	if err != nil || inbound == nil {
+		return
+	}
+	if inbound.Protocol == model.WireGuard {
+		t.sendWireguardConf(chatId, inbound, traffic.Email)
+		return
+	}
+	content := ""
+	if clients, err := t.inboundService.GetClients(inbound); err == nil {
+		for _, client := range clients {
+			if client.Email == traffic.Email {
+				content, _ = t.subLink(client.SubID)
+			}
+		}
+	}
+	if content == "" && shareLinker != nil {
+		if links := strings.Fields(shareLinker(inbound, email, t.linkHost())); len(links) > 0 {
+			content = links[0]
+		}
+	}
+	if content == "" {
+		return
+	}
+	if err := t.sendQRCode(chatId, content, html.EscapeString(email)); err != nil {
+		logger.Warning("Error sending the QR code of a client:", err)
+	}
+}
+
+// sendWireguardConf sends chatId the wg-quick config of the peer of email of a
+// WireGuard inbound.
+func (t *Tgbot) sendWireguardConf(chatId int64, inbound *model.Inbound, email string) {
+	conf, err := t.inboundService.WireguardConf(inbound, email, t.linkHost())
+	if err != nil {
+		logger.Warning("Error making the WireGuard config of a client:", err)
+		return
+	}
+	if err := t.sendQRCode(chatId, conf, html.EscapeString(email)); err != nil {
+		logger.Warning("Error sending the QR code of a client:", err)
+	}
+	_, err = bot.SendDocument(context.Background(), tu.Document(
+		tu.ID(chatId),
+		tu.FileFromBytes([]byte(conf), email+".conf"),
+	))
+	if err != nil {
+		logger.Warning("Error sending the WireGuard config of a client:", err)
+	}
+}
+
+// linkHost is the host the links sent by the bot point to: the panel domain,
+// or the host name of the server.
+func (t *Tgbot) linkHost() string {
+	host, _ := t.settingService.GetWebDomain()
+	if host == "" {
+		host = hostname
+	}
+	return host
+}
+
+// subLink returns the subscription link of subId, or "" if subscriptions are
+// off. Without a subscription domain it is on the link host.
+func (t *Tgbot) subLink(subId string) (string, error) {
+	return t.settingService.GetSubLink(t.linkHost(), subId)
+}
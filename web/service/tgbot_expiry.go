@@ -0,0 +1,80 @@
+package service
+
+import (
+	"html"
+	"strconv"
+	"strings"
+	"time"
+
+	"x-ui/logger"
+	"x-ui/util/common"
+)
+
+// expiryDigestPage is how many clients of the admin digest go in a message
+const expiryDigestPage = 30
+
+// NotifyExpiryReminders reminds the users of reminders of their expiry. The
+// clients without a Telegram ID are sent to the admins, together in a digest.
+func (t *Tgbot) NotifyExpiryReminders(reminders []ClientExpiryReminder) {
+	if len(reminders) == 0 {
+		return
+	}
+	loc, err := t.settingService.GetTimeLocation()
+	if err != nil {
+		logger.Warning("Unable to get the time zone of the expiry reminders:", err)
+		loc = time.Local
+	}
+	contact, err := t.settingService.GetNotifyRenewalContact()
+	if err != nil {
+		logger.Warning("Unable to get the renewal contact:", err)
+	}
+
+	var digest []string
+	for i := range reminders {
+		reminder := &reminders[i]
+		email := html.EscapeString(reminder.Email)
+		date := time.UnixMilli(reminder.ExpiryTime).In(loc).Format("2006-01-02 15:04")
+		remaining := t.I18nBot("tgbot.buttons.noLimit")
+		if reminder.Total > 0 {
+			remaining = common.FormatTraffic(max(reminder.Total-reminder.Up-reminder.Down, 0))
+		}
+
+		if reminder.TgId == 0 {
+			digest = append(digest, t.I18nBot("tgbot.messages.expiryDigestLine",
+				"Email=="+email, "Days=="+strconv.Itoa(reminder.Days), "Date=="+date, "Remaining=="+remaining))
+			continue
+		}
+
+		msg := t.renderTemplate("expiry", t.trafficVars(map[string]string{
+			"ServerName": hostname,
+			"Email":      reminder.Email,
+			"Days":       strconv.Itoa(reminder.Days),
+			"ExpiryDate": date,
+			"Contact":    contact,
+		}, reminder.Up, reminder.Down, reminder.Total))
+		if msg == "" {
+			if reminder.Days == 0 {
+				msg = t.I18nBot("tgbot.messages.expiryReminderToday", "Email=="+email, "Date=="+date)
+			} else {
+				msg = t.I18nBot("tgbot.messages.expiryReminder", "Email=="+email, "Days=="+strconv.Itoa(reminder.Days), "Date=="+date)
+			}
+			msg += t.I18nBot("tgbot.messages.remaining", "Remaining=="+remaining)
+			if contact != "" {
+				msg += t.I18nBot("tgbot.messages.renewalContact", "Contact=="+html.EscapeString(contact))
+			}
+		}
+		if t.IsRunning() {
+			t.SendMsgToTgbot(reminder.TgId, msg)
+		}
+	}
+
+	if len(digest) == 0 || !t.AlertsOn(AlertExpiry) {
+		return
+	}
+	msg := t.I18nBot("tgbot.messages.expiryDigest", "Count=="+strconv.Itoa(len(digest)))
+	// Pages of clients are apart, so that a long digest is split between them
+	for start := 0; start < len(digest); start += expiryDigestPage {
+		msg += "\r\n" + strings.Join(digest[start:min(start+expiryDigestPage, len(digest))], "")
+	}
+	t.SendAlert(AlertExpiry, msg)
+}
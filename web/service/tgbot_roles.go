@@ -0,0 +1,307 @@
+package service
+
+import (
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/common"
+
+	"github.com/mymmrac/telego"
+)
+
+// tgRole is what a chat may do with the bot, each role can do all the lesser
+// ones can.
+type tgRole int
+
+const (
+	// tgRoleNone is every chat that isn't an admin's, it only has the client
+	// buttons
+	tgRoleNone tgRole = iota
+	// tgRoleReadonly looks up clients, inbounds and the server
+	tgRoleReadonly
+	// tgRoleSupport changes and adds clients too
+	tgRoleSupport
+	// tgRoleFull also gets backups, resets every client and controls the server
+	tgRoleFull
+)
+
+var tgRoleNames = map[tgRole]string{
+	tgRoleReadonly: "readonly",
+	tgRoleSupport:  "support",
+	tgRoleFull:     "full",
+}
+
+func (r tgRole) String() string {
+	return tgRoleNames[r]
+}
+
+// tgAction is what it takes to run a command or a button of the bot.
+type tgAction struct {
+	role tgRole
+	// echo tells the full admins when the action is run, those are the ones
+	// that change something
+	echo bool
+}
+
+// tgCommands are the admin commands, the others are everyone's.
+var tgCommands = map[string]tgAction{
+	"inbound":     {role: tgRoleReadonly},
+	"status":      {role: tgRoleReadonly},
+	"addclient":   {role: tgRoleSupport},
+	"cancel":      {role: tgRoleSupport},
+	"restart":     {role: tgRoleFull, echo: true},
+	"restartxray": {role: tgRoleFull},
+}
+
+// tgCallbacks are the admin buttons, by the first word of their data. Buttons
+// missing from here need the full role.
+var tgCallbacks = map[string]tgAction{
+	"client_get_usage":                {role: tgRoleReadonly},
+	"client_refresh":                  {role: tgRoleReadonly},
+	"client_cancel":                   {role: tgRoleReadonly},
+	"ips_refresh":                     {role: tgRoleReadonly},
+	"ips_cancel":                      {role: tgRoleReadonly},
+	"ip_log":                          {role: tgRoleReadonly},
+	"tgid_refresh":                    {role: tgRoleReadonly},
+	"tgid_cancel":                     {role: tgRoleReadonly},
+	"get_clients":                     {role: tgRoleReadonly},
+	"get_inbounds":                    {role: tgRoleReadonly},
+	"get_usage":                       {role: tgRoleReadonly},
+	"usage_refresh":                   {role: tgRoleReadonly},
+	"inbounds":                        {role: tgRoleReadonly},
+	"deplete_soon":                    {role: tgRoleReadonly},
+	"onlines":                         {role: tgRoleReadonly},
+	"onlines_refresh":                 {role: tgRoleReadonly},
+	"commands":                        {role: tgRoleReadonly},
+	"get_sorted_traffic_usage_report": {role: tgRoleReadonly},
+	"status_refresh":                  {role: tgRoleReadonly},
+
+	"reset_traffic":                  {role: tgRoleSupport},
+	"reset_traffic_c":                {role: tgRoleSupport, echo: true},
+	"limit_traffic":                  {role: tgRoleSupport},
+	"limit_traffic_in":               {role: tgRoleSupport},
+	"limit_traffic_c":                {role: tgRoleSupport, echo: true},
+	"reset_exp":                      {role: tgRoleSupport},
+	"reset_exp_in":                   {role: tgRoleSupport},
+	"reset_exp_c":                    {role: tgRoleSupport, echo: true},
+	"ip_limit":                       {role: tgRoleSupport},
+	"ip_limit_in":                    {role: tgRoleSupport},
+	"ip_limit_c":                     {role: tgRoleSupport, echo: true},
+	"clear_ips":                      {role: tgRoleSupport},
+	"clear_ips_c":                    {role: tgRoleSupport, echo: true},
+	"tg_user":                        {role: tgRoleSupport},
+	"tgid_remove":                    {role: tgRoleSupport},
+	"tgid_remove_c":                  {role: tgRoleSupport, echo: true},
+	"toggle_enable":                  {role: tgRoleSupport},
+	"toggle_enable_c":                {role: tgRoleSupport, echo: true},
+	"rotate_sub":                     {role: tgRoleSupport},
+	"rotate_sub_c":                   {role: tgRoleSupport, echo: true},
+	"add_client":                     {role: tgRoleSupport},
+	"add_client_to":                  {role: tgRoleSupport},
+	"add_client_cancel":              {role: tgRoleSupport},
+	"add_client_default_info":        {role: tgRoleSupport},
+	"add_client_ch_default_email":    {role: tgRoleSupport},
+	"add_client_ch_default_id":       {role: tgRoleSupport},
+	"add_client_ch_default_pass_tr":  {role: tgRoleSupport},
+	"add_client_ch_default_pass_sh":  {role: tgRoleSupport},
+	"add_client_ch_default_comment":  {role: tgRoleSupport},
+	"add_client_ch_default_traffic":  {role: tgRoleSupport},
+	"add_client_ch_default_exp":      {role: tgRoleSupport},
+	"add_client_ch_default_ip_limit": {role: tgRoleSupport},
+	"add_client_default_traffic_exp": {role: tgRoleSupport},
+	"add_client_default_ip_limit":    {role: tgRoleSupport},
+	"add_client_limit_traffic_c":     {role: tgRoleSupport},
+	"add_client_limit_traffic_in":    {role: tgRoleSupport},
+	"add_client_reset_exp_c":         {role: tgRoleSupport},
+	"add_client_reset_exp_in":        {role: tgRoleSupport},
+	"add_client_ip_limit_c":          {role: tgRoleSupport},
+	"add_client_ip_limit_in":         {role: tgRoleSupport},
+	"add_client_submit_disable":      {role: tgRoleSupport, echo: true},
+	"add_client_submit_enable":       {role: tgRoleSupport, echo: true},
+	addClientCallback + "cancel":     {role: tgRoleSupport},
+	addClientCallback + "inbound":    {role: tgRoleSupport},
+	addClientCallback + "quota":      {role: tgRoleSupport},
+	addClientCallback + "expiry":     {role: tgRoleSupport, echo: true},
+
+	"get_backup":                {role: tgRoleFull, echo: true},
+	"get_banlogs":               {role: tgRoleFull, echo: true},
+	"lock_panel":                {role: tgRoleFull, echo: true},
+	"reset_all_traffics":        {role: tgRoleFull},
+	"reset_all_traffics_cancel": {role: tgRoleFull},
+	"reset_all_traffics_c":      {role: tgRoleFull, echo: true},
+	"restart_xray_cancel":       {role: tgRoleFull},
+	"restart_xray_c":            {role: tgRoleFull, echo: true},
+}
+
+// callbackAction returns the action of the button data, which may be hashed.
+func (t *Tgbot) callbackAction(data string) (string, tgAction) {
+	decoded, err := t.decodeQuery(data)
+	if err != nil {
+		return "", tgAction{role: tgRoleFull}
+	}
+	if clientCallbacks[decoded] {
+		return decoded, tgAction{role: tgRoleNone}
+	}
+	name, _, _ := strings.Cut(decoded, " ")
+	action, ok := tgCallbacks[name]
+	if !ok {
+		action.role = tgRoleFull
+	}
+	return decoded, action
+}
+
+type tgChat struct {
+	id   int64
+	role tgRole
+}
+
+// parseTgBotChats parses the admin chats setting: chat ids separated by commas,
+// each with an optional ":role". A chat without one has the full role.
+func parseTgBotChats(value string) ([]tgChat, error) {
+	var chats []tgChat
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		idText, roleText, hasRole := strings.Cut(entry, ":")
+		id, err := strconv.ParseInt(strings.TrimSpace(idText), 10, 64)
+		if err != nil {
+			return chats, common.NewErrorf("invalid Telegram chat id: %s", entry)
+		}
+		chat := tgChat{id: id, role: tgRoleFull}
+		if hasRole {
+			chat.role = tgRoleNone
+			roleText = strings.ToLower(strings.TrimSpace(roleText))
+			for role, name := range tgRoleNames {
+				if name == roleText {
+					chat.role = role
+				}
+			}
+			if chat.role == tgRoleNone {
+				return chats, common.NewErrorf("invalid Telegram chat role %q of %d, it must be full, support or readonly", roleText, id)
+			}
+		}
+		chats = append(chats, chat)
+	}
+	return chats, nil
+}
+
+// panelUserRoles are the roles of the chats linked to panel users.
+var panelUserRoles = map[string]tgRole{
+	model.RoleAdmin:    tgRoleFull,
+	model.RoleOperator: tgRoleSupport,
+	model.RoleViewer:   tgRoleReadonly,
+}
+
+// botChats returns the admin chats: the ones of the setting, then the ones
+// linked to panel users. They are read every time so that changes take effect
+// right away.
+func (t *Tgbot) botChats() []tgChat {
+	value, err := t.settingService.GetTgBotChatId()
+	if err != nil {
+		logger.Warning("Unable to get the Telegram bot chats:", err)
+	}
+	chats, err := parseTgBotChats(value)
+	if err != nil {
+		logger.Warning("Unable to parse the Telegram bot chats:", err)
+	}
+	users, err := t.userService.GetUsers()
+	if err != nil {
+		logger.Warning("Failed to get panel users for the Telegram bot:", err)
+	}
+	for _, user := range users {
+		if user.TgChatId != 0 {
+			chats = append(chats, tgChat{id: user.TgChatId, role: panelUserRoles[user.Role]})
+		}
+	}
+
+	// A chat given several times has its highest role
+	merged := make([]tgChat, 0, len(chats))
+	index := make(map[int64]int)
+	for _, chat := range chats {
+		if i, ok := index[chat.id]; ok {
+			merged[i].role = max(merged[i].role, chat.role)
+			continue
+		}
+		index[chat.id] = len(merged)
+		merged = append(merged, chat)
+	}
+	return merged
+}
+
+// chatRole returns the role of chatId.
+func (t *Tgbot) chatRole(chatId int64) tgRole {
+	for _, chat := range t.botChats() {
+		if chat.id == chatId {
+			return chat.role
+		}
+	}
+	return tgRoleNone
+}
+
+// chatsWithRole returns the admin chats with at least role.
+func (t *Tgbot) chatsWithRole(role tgRole) []int64 {
+	var ids []int64
+	for _, chat := range t.botChats() {
+		if chat.role >= role {
+			ids = append(ids, chat.id)
+		}
+	}
+	return ids
+}
+
+// echoAction tells the full admins, but the one who did it, that from ran
+// action.
+func (t *Tgbot) echoAction(from *telego.User, role tgRole, action string) {
+	user := html.EscapeString(from.FirstName)
+	if from.Username != "" {
+		user += " @" + html.EscapeString(from.Username)
+	}
+	user += fmt.Sprintf(" (%d)", from.ID)
+	msg := t.I18nBot("tgbot.messages.actionBy",
+		"User=="+user, "Role=="+role.String(), "Action=="+html.EscapeString(action))
+	for _, chatId := range t.chatsWithRole(tgRoleFull) {
+		if chatId != from.ID {
+			t.SendMsgToTgbot(chatId, msg)
+		}
+	}
+}
+
+// roleKeyboard drops the buttons of keyboard role can't use, and the rows left
+// empty.
+func (t *Tgbot) roleKeyboard(role tgRole, keyboard *telego.InlineKeyboardMarkup) *telego.InlineKeyboardMarkup {
+	var rows [][]telego.InlineKeyboardButton
+	for _, row := range keyboard.InlineKeyboard {
+		var buttons []telego.InlineKeyboardButton
+		for _, button := range row {
+			if button.CallbackData != "" {
+				if _, action := t.callbackAction(button.CallbackData); action.role > role {
+					continue
+				}
+			}
+			buttons = append(buttons, button)
+		}
+		if len(buttons) > 0 {
+			rows = append(rows, buttons)
+		}
+	}
+	return &telego.InlineKeyboardMarkup{InlineKeyboard: rows}
+}
+
+// chatReplyMarkup cuts an inline keyboard to what the role of chatId can use.
+func (t *Tgbot) chatReplyMarkup(chatId int64, replyMarkup telego.ReplyMarkup) telego.ReplyMarkup {
+	keyboard, ok := replyMarkup.(*telego.InlineKeyboardMarkup)
+	if !ok || keyboard == nil {
+		return replyMarkup
+	}
+	keyboard = t.roleKeyboard(t.chatRole(chatId), keyboard)
+	if len(keyboard.InlineKeyboard) == 0 {
+		return nil
+	}
+	return keyboard
+}
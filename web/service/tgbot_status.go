@@ -0,0 +1,184 @@
+package service
+
+import (
+	"fmt"
+	"html"
+	"strconv"
+	"time"
+
+	"x-ui/config"
+	"x-ui/logger"
+	"x-ui/util/common"
+
+	tu "github.com/mymmrac/telego/telegoutil"
+)
+
+const (
+	// tgStatusMaxAge is how old the last status may be for its CPU load and
+	// throughput to be shown, an older one is sampled again
+	tgStatusMaxAge = 10 * time.Second
+	// tgStatusSampleGap is the time between the two samples of a new status
+	tgStatusSampleGap = time.Second
+)
+
+// statusMarker grades a usage in percent.
+func statusMarker(percent float64) string {
+	switch {
+	case percent >= 90:
+		return "🔴"
+	case percent >= 70:
+		return "🟡"
+	default:
+		return "🟢"
+	}
+}
+
+// usagePercent returns how much of total current is, in percent.
+func usagePercent(current, total uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(current) * 100 / float64(total)
+}
+
+// serverStatus returns the status of the dashboard, the last one the status
+// job took. The CPU load and the throughput are measured since the status
+// before, so if that one is old it is sampled again a moment later for them to
+// be the current ones.
+func (t *Tgbot) serverStatus() *Status {
+	if status := t.serverService.GetLastStatus(); status != nil && time.Since(status.T) <= tgStatusMaxAge {
+		return status
+	}
+	if t.lastStatus == nil || time.Since(t.lastStatus.T) > tgStatusMaxAge {
+		t.lastStatus = t.serverService.GetStatus(t.lastStatus)
+		time.Sleep(tgStatusSampleGap)
+	}
+	t.lastStatus = t.serverService.GetStatus(t.lastStatus)
+	return t.lastStatus
+}
+
+// statusUptime writes seconds as days and hours, or as hours and minutes when
+// shorter than a day.
+func (t *Tgbot) statusUptime(seconds uint64) string {
+	days, hours, minutes := seconds/86400, seconds%86400/3600, seconds%3600/60
+	if days > 0 {
+		return fmt.Sprintf("%d %s %d %s", days, t.I18nBot("tgbot.days"), hours, t.I18nBot("tgbot.hours"))
+	}
+	return fmt.Sprintf("%d %s %d %s", hours, t.I18nBot("tgbot.hours"), minutes, t.I18nBot("tgbot.minutes"))
+}
+
+// usageLine is a line of the status about the usage of a resource.
+func (t *Tgbot) usageLine(name string, current, total uint64) string {
+	percent := usagePercent(current, total)
+	return t.I18nBot(name,
+		"Marker=="+statusMarker(percent),
+		"Current=="+common.FormatTraffic(int64(current)),
+		"Total=="+common.FormatTraffic(int64(total)),
+		"Percent=="+strconv.FormatFloat(percent, 'f', 0, 64))
+}
+
+// prepareStatusInfo writes the health of the server in a few lines.
+func (t *Tgbot) prepareStatusInfo() string {
+	status := t.serverStatus()
+	loc, err := t.settingService.GetTimeLocation()
+	if err != nil {
+		loc = time.Local
+	}
+
+	info := t.I18nBot("tgbot.messages.statusHead",
+		"Hostname=="+hostname,
+		"Version=="+config.GetVersion(),
+		"Uptime=="+t.statusUptime(status.AppStats.PanelUptime))
+
+	xrayMarker := "🟢"
+	switch status.Xray.State {
+	case Stop:
+		xrayMarker = "🟡"
+	case Error:
+		xrayMarker = "🔴"
+	}
+	info += t.I18nBot("tgbot.messages.statusXray",
+		"Marker=="+xrayMarker,
+		"Version=="+status.Xray.Version,
+		"State=="+string(status.Xray.State))
+	if status.Xray.State == Running {
+		info += t.I18nBot("tgbot.messages.statusXrayUptime", "Uptime=="+t.statusUptime(status.AppStats.Uptime))
+	} else if status.Xray.ErrorMsg != "" {
+		info += t.I18nBot("tgbot.messages.statusXrayError", "Error=="+html.EscapeString(status.Xray.ErrorMsg))
+	}
+
+	loads := []string{"0", "0", "0"}
+	for i, load := range status.Loads {
+		loads[i] = strconv.FormatFloat(load, 'f', 2, 64)
+	}
+	info += t.I18nBot("tgbot.messages.statusCpu",
+		"Marker=="+statusMarker(status.Cpu),
+		"Percent=="+strconv.FormatFloat(status.Cpu, 'f', 1, 64),
+		"Cores=="+strconv.Itoa(status.CpuCores),
+		"Threads=="+strconv.Itoa(status.LogicalPro),
+		"Load1=="+loads[0], "Load5=="+loads[1], "Load15=="+loads[2])
+	info += t.usageLine("tgbot.messages.statusMem", status.Mem.Current, status.Mem.Total)
+	info += t.usageLine("tgbot.messages.statusSwap", status.Swap.Current, status.Swap.Total)
+	// The disk of the database, but for a database on another server
+	if disk := status.Database.Disk; disk != nil {
+		info += t.usageLine("tgbot.messages.statusDisk", disk.Current, disk.Total)
+	} else {
+		info += t.usageLine("tgbot.messages.statusDisk", status.Disk.Current, status.Disk.Total)
+	}
+
+	info += t.I18nBot("tgbot.messages.statusNet",
+		"Up=="+common.FormatTraffic(int64(status.NetIO.Up)),
+		"Down=="+common.FormatTraffic(int64(status.NetIO.Down)),
+		"Sent=="+common.FormatTraffic(int64(status.NetTraffic.Sent)),
+		"Recv=="+common.FormatTraffic(int64(status.NetTraffic.Recv)))
+	info += t.I18nBot("tgbot.messages.onlinesCount", "Count=="+strconv.Itoa(status.OnlineClients))
+
+	var backupService BackupService
+	backups, err := backupService.List()
+	if err != nil {
+		logger.Warning("Unable to list the backups for the Telegram status:", err)
+	}
+	if len(backups) > 0 {
+		info += t.I18nBot("tgbot.messages.statusBackup", "Time=="+backups[0].Time.In(loc).Format("2006-01-02 15:04"))
+	} else {
+		info += t.I18nBot("tgbot.messages.statusNoBackup")
+	}
+
+	info += t.I18nBot("tgbot.messages.refreshedOn", "Time=="+time.Now().In(loc).Format("2006-01-02 15:04:05"))
+	return info
+}
+
+// getStatus sends the status of the server, or puts it in messageID.
+func (t *Tgbot) getStatus(chatId int64, messageID ...int) {
+	info := t.prepareStatusInfo()
+	keyboard := tu.InlineKeyboard(tu.InlineKeyboardRow(
+		tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.refresh")).WithCallbackData(t.encodeQuery("status_refresh"))))
+
+	if len(messageID) > 0 {
+		t.editMessageTgBot(chatId, messageID[0], info, keyboard)
+	} else {
+		t.SendMsgToTgbot(chatId, info, keyboard)
+	}
+}
+
+// askRestartXray asks to confirm a restart of Xray.
+func (t *Tgbot) askRestartXray(chatId int64) {
+	keyboard := tu.InlineKeyboard(
+		tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.cancel")).WithCallbackData(t.encodeQuery("restart_xray_cancel")),
+		),
+		tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.confirmRestartXray")).WithCallbackData(t.encodeQuery("restart_xray_c")),
+		),
+	)
+	t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.messages.restartXrayConfirm"), keyboard)
+}
+
+// restartXray restarts Xray and tells chatId how it went.
+func (t *Tgbot) restartXray(chatId int64) {
+	if err := t.xrayService.RestartXray(true); err != nil {
+		t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.commands.restartFailed", "Error=="+html.EscapeString(err.Error())))
+		return
+	}
+	t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.messages.xrayRestarted"))
+}
@@ -0,0 +1,410 @@
+package service
+
+import (
+	"html"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"x-ui/logger"
+	"x-ui/util/common"
+
+	xhtml "golang.org/x/net/html"
+)
+
+// Parse modes of the message templates
+const (
+	tgParseModeHTML       = "HTML"
+	tgParseModeMarkdownV2 = "MarkdownV2"
+)
+
+// tgTemplateKind is a message of the bot an admin can write a template for.
+type tgTemplateKind struct {
+	get func(*SettingService) (string, error)
+	// sample is the data of the preview, its keys are all the variables of the
+	// template
+	sample map[string]string
+}
+
+// tgTemplateKinds are the messages that can have a template, by the kind the
+// preview is asked for.
+var tgTemplateKinds = map[string]tgTemplateKind{
+	"login": {get: (*SettingService).GetTgTemplateLogin, sample: map[string]string{
+		"ServerName": "vpn-1",
+		// Status is success, failed or token
+		"Status":    "success",
+		"Username":  "admin",
+		"Password":  "",
+		"IP":        "203.0.113.7",
+		"ProxyIP":   "",
+		"Location":  "Amsterdam, Netherlands",
+		"UserAgent": "Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0",
+		"ApiToken":  "",
+		"Time":      "2025-01-31 09:30:00",
+		"Withheld":  "0",
+	}},
+	"traffic": {get: (*SettingService).GetTgTemplateTraffic, sample: withTrafficSample(map[string]string{
+		"ServerName": "vpn-1",
+		"Email":      "alice",
+		"Percent":    "80",
+		"ExpiryDate": "2025-02-28 00:00",
+	})},
+	"expiry": {get: (*SettingService).GetTgTemplateExpiry, sample: withTrafficSample(map[string]string{
+		"ServerName": "vpn-1",
+		"Email":      "alice",
+		"Days":       "3",
+		"ExpiryDate": "2025-02-28 00:00",
+		"Contact":    "@support",
+	})},
+	"backup": {get: (*SettingService).GetTgTemplateBackup, sample: map[string]string{
+		"ServerName": "vpn-1",
+		"Backup":     "x-ui-20250131-060000.db.gz",
+		"Size":       "1.25 MB",
+		"Time":       "2025-01-31 06:00:00",
+	}},
+	"client": {get: (*SettingService).GetTgTemplateClient, sample: withTrafficSample(map[string]string{
+		"ServerName": "vpn-1",
+		"Email":      "alice",
+		"Tags":       "family, premium",
+		"Enabled":    "✅ Yes",
+		"Online":     "🟢 Online",
+		"Active":     "✅ Yes",
+		"Expiry":     "2025-02-28 00:00:00 (28 Days)",
+		"ExpiryDate": "2025-02-28 00:00",
+	})},
+}
+
+// withTrafficSample adds the sample of the traffic variables to sample.
+func withTrafficSample(sample map[string]string) map[string]string {
+	sample["Upload"] = "2.00 GB"
+	sample["Download"] = "38.00 GB"
+	sample["Used"] = "40.00 GB"
+	sample["UsedGB"] = "40.00"
+	sample["Total"] = "50.00 GB"
+	sample["TotalGB"] = "50.00"
+	sample["Remaining"] = "10.00 GB"
+	sample["RemainingGB"] = "10.00"
+	return sample
+}
+
+// trafficVars returns the traffic variables of a client. The total and the
+// remaining traffic in GB are empty when it is unlimited.
+func (t *Tgbot) trafficVars(vars map[string]string, up int64, down int64, total int64) map[string]string {
+	gb := func(bytes int64) string {
+		return strconv.FormatFloat(float64(bytes)/(1<<30), 'f', 2, 64)
+	}
+	vars["Upload"] = common.FormatTraffic(up)
+	vars["Download"] = common.FormatTraffic(down)
+	vars["Used"] = common.FormatTraffic(up + down)
+	vars["UsedGB"] = gb(up + down)
+	if total > 0 {
+		remaining := max(total-up-down, 0)
+		vars["Total"] = common.FormatTraffic(total)
+		vars["TotalGB"] = gb(total)
+		vars["Remaining"] = common.FormatTraffic(remaining)
+		vars["RemainingGB"] = gb(remaining)
+	} else {
+		vars["Total"] = t.I18nBot("tgbot.buttons.noLimit")
+		vars["Remaining"] = vars["Total"]
+	}
+	return vars
+}
+
+// templateDate formats an expiry time of the clients for the templates, in the
+// panel time zone. It is empty when there is none.
+func (t *Tgbot) templateDate(expiryTime int64) string {
+	if expiryTime <= 0 {
+		return ""
+	}
+	loc, err := t.settingService.GetTimeLocation()
+	if err != nil {
+		loc = time.Local
+	}
+	return time.UnixMilli(expiryTime).In(loc).Format("2006-01-02 15:04")
+}
+
+// formatTime formats a time in unix milliseconds in the panel time zone, to the
+// second.
+func (t *Tgbot) formatTime(millis int64) string {
+	return time.UnixMilli(millis).In(panelLocation()).Format("2006-01-02 15:04:05")
+}
+
+// renderTemplate renders the template of kind with vars into the HTML the bot
+// sends. It returns "" when there is no template or it fails, for the caller to
+// build the built-in message instead.
+func (t *Tgbot) renderTemplate(kind string, vars map[string]string) string {
+	spec := tgTemplateKinds[kind]
+	text, err := spec.get(&t.settingService)
+	if err != nil || strings.TrimSpace(text) == "" {
+		return ""
+	}
+	parseMode, err := t.settingService.GetTgBotParseMode()
+	if err != nil {
+		parseMode = tgParseModeHTML
+	}
+	_, sent, err := renderTgTemplate(kind, text, parseMode, spec.sample, vars)
+	if err != nil {
+		logger.Warningf("The Telegram %s template failed, the built-in message is sent instead: %v", kind, err)
+		return ""
+	}
+	// Like the built-in messages, for the others to follow it in a message
+	return strings.TrimRight(sent, "\r\n") + "\r\n"
+}
+
+// TgTemplatePreview is a template rendered with the sample data of its message.
+type TgTemplatePreview struct {
+	// Text is in the parse mode of the template, HTML is what the bot sends
+	Text      string   `json:"text"`
+	HTML      string   `json:"html"`
+	Variables []string `json:"variables"`
+}
+
+// PreviewTemplate renders text as the template of kind with sample data, in
+// parseMode or the one of the settings if it is empty.
+func (t *Tgbot) PreviewTemplate(kind string, text string, parseMode string) (*TgTemplatePreview, error) {
+	spec, ok := tgTemplateKinds[kind]
+	if !ok {
+		return nil, common.NewError("unknown Telegram message:", kind)
+	}
+	if parseMode == "" {
+		parseMode, _ = t.settingService.GetTgBotParseMode()
+	}
+	rendered, sent, err := renderTgTemplate(kind, text, parseMode, spec.sample, spec.sample)
+	if err != nil {
+		return nil, err
+	}
+	preview := &TgTemplatePreview{Text: rendered, HTML: sent}
+	for name := range spec.sample {
+		preview.Variables = append(preview.Variables, name)
+	}
+	slices.Sort(preview.Variables)
+	return preview, nil
+}
+
+// renderTgTemplate executes text with vars escaped for parseMode. The
+// variables missing from vars but known from sample are empty, the unknown
+// ones are an error. It returns the message in parseMode and in HTML.
+func renderTgTemplate(kind string, text string, parseMode string, sample map[string]string, vars map[string]string) (string, string, error) {
+	var escape func(string) string
+	switch parseMode {
+	case tgParseModeHTML:
+		escape = html.EscapeString
+	case tgParseModeMarkdownV2:
+		escape = escapeMarkdownV2
+	default:
+		return "", "", common.NewError("unknown Telegram parse mode:", parseMode)
+	}
+	tmpl, err := template.New(kind).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", "", err
+	}
+	data := make(map[string]string, len(sample))
+	for name := range sample {
+		data[name] = escape(vars[name])
+	}
+	var out strings.Builder
+	if err := tmpl.Execute(&out, data); err != nil {
+		return "", "", err
+	}
+	rendered := out.String()
+	if strings.TrimSpace(rendered) == "" {
+		return "", "", common.NewError("the template renders an empty message")
+	}
+	if parseMode == tgParseModeHTML {
+		return rendered, rendered, checkTgHTML(rendered)
+	}
+	sent, err := markdownV2ToHTML(rendered)
+	return rendered, sent, err
+}
+
+// tgMarkdownV2Special are the characters MarkdownV2 needs escaped outside of
+// entities.
+const tgMarkdownV2Special = "_*[]()~`>#+-=|{}.!\\"
+
+func escapeMarkdownV2(s string) string {
+	var out strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(tgMarkdownV2Special, r) {
+			out.WriteByte('\\')
+		}
+		out.WriteRune(r)
+	}
+	return out.String()
+}
+
+// tgMarkdownV2Styles are the markers of the styles of MarkdownV2 with their
+// tag, the longer markers first.
+var tgMarkdownV2Styles = []struct {
+	marker string
+	tag    string
+}{
+	{"||", "tg-spoiler"},
+	{"__", "u"},
+	{"*", "b"},
+	{"_", "i"},
+	{"~", "s"},
+}
+
+// markdownV2ToHTML translates a MarkdownV2 message to HTML, which is what the
+// built-in messages it is sent with are in. Entities left open are an error,
+// like for Telegram; special characters that aren't escaped are kept as they are.
+func markdownV2ToHTML(s string) (string, error) {
+	runes := []rune(s)
+	var out []byte
+	// open are the styles and links not closed yet, links with where their
+	// tag goes once their URL is known
+	type entity struct {
+		marker string
+		at     int
+	}
+	var open []entity
+	quote, lineStart := false, true
+
+	// until returns the text up to the end marker, unescaping \end and \\
+	until := func(i int, end string) (string, int, bool) {
+		var text []rune
+		for ; i < len(runes); i++ {
+			if runes[i] == '\\' && i+1 < len(runes) {
+				i++
+				text = append(text, runes[i])
+				continue
+			}
+			if strings.HasPrefix(string(runes[i:min(i+len(end), len(runes))]), end) {
+				return string(text), i + len(end), true
+			}
+			text = append(text, runes[i])
+		}
+		return "", i, false
+	}
+
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		if lineStart {
+			lineStart = false
+			if r == '>' {
+				if !quote {
+					out = append(out, "<blockquote>"...)
+					quote = true
+				}
+				continue
+			}
+			if quote {
+				out = append(out, "</blockquote>"...)
+				quote = false
+			}
+		}
+		rest := string(runes[i:min(i+3, len(runes))])
+		switch {
+		case r == '\\' && i+1 < len(runes):
+			i++
+			out = append(out, html.EscapeString(string(runes[i]))...)
+		case strings.HasPrefix(rest, "```"):
+			code, next, ok := until(i+3, "```")
+			if !ok {
+				return "", common.NewError("a ``` block is not closed")
+			}
+			language, body, found := strings.Cut(code, "\n")
+			if found && language != "" && !strings.ContainsAny(language, " \t") {
+				out = append(out, `<pre><code class="language-`+html.EscapeString(language)+`">`+html.EscapeString(body)+"</code></pre>"...)
+			} else {
+				out = append(out, "<pre>"+html.EscapeString(code)+"</pre>"...)
+			}
+			i = next - 1
+		case r == '`':
+			code, next, ok := until(i+1, "`")
+			if !ok {
+				return "", common.NewError("a ` code is not closed")
+			}
+			out = append(out, "<code>"+html.EscapeString(code)+"</code>"...)
+			i = next - 1
+		case r == '[':
+			open = append(open, entity{marker: "[", at: len(out)})
+		case r == ']' && len(open) > 0 && open[len(open)-1].marker == "[" && i+1 < len(runes) && runes[i+1] == '(':
+			link, next, ok := until(i+2, ")")
+			if !ok {
+				return "", common.NewError("the URL of a link is not closed")
+			}
+			at := open[len(open)-1].at
+			open = open[:len(open)-1]
+			out = slices.Insert(out, at, []byte(`<a href="`+html.EscapeString(link)+`">`)...)
+			out = append(out, "</a>"...)
+			i = next - 1
+		case r == '\n':
+			out = append(out, '\n')
+			lineStart = true
+		default:
+			styled := false
+			for _, style := range tgMarkdownV2Styles {
+				if !strings.HasPrefix(string(runes[i:]), style.marker) {
+					continue
+				}
+				styled = true
+				if len(open) > 0 && open[len(open)-1].marker == style.marker {
+					open = open[:len(open)-1]
+					out = append(out, "</"+style.tag+">"...)
+				} else if slices.ContainsFunc(open, func(e entity) bool { return e.marker == style.marker }) {
+					return "", common.NewErrorf("%s is closed before the entities in it", style.marker)
+				} else {
+					open = append(open, entity{marker: style.marker})
+					out = append(out, "<"+style.tag+">"...)
+				}
+				i += len([]rune(style.marker)) - 1
+				break
+			}
+			if !styled {
+				out = append(out, html.EscapeString(string(r))...)
+			}
+		}
+	}
+	if quote {
+		out = append(out, "</blockquote>"...)
+	}
+	if len(open) > 0 {
+		return "", common.NewErrorf("%s is not closed", open[len(open)-1].marker)
+	}
+	return string(out), nil
+}
+
+// tgHTMLTags are the tags of the HTML parse mode of Telegram.
+var tgHTMLTags = map[string]bool{
+	"b": true, "strong": true, "i": true, "em": true, "u": true, "ins": true,
+	"s": true, "strike": true, "del": true, "span": true, "tg-spoiler": true,
+	"a": true, "code": true, "pre": true, "blockquote": true, "tg-emoji": true,
+}
+
+// checkTgHTML checks that s only has the tags Telegram knows, each closed in
+// order, so that a template doesn't keep its message from being sent.
+func checkTgHTML(s string) error {
+	var open []string
+	z := xhtml.NewTokenizer(strings.NewReader(s))
+	for {
+		switch z.Next() {
+		case xhtml.ErrorToken:
+			if z.Err() != io.EOF {
+				return z.Err()
+			}
+			if len(open) > 0 {
+				return common.NewErrorf("<%s> is not closed", open[len(open)-1])
+			}
+			return nil
+		case xhtml.StartTagToken:
+			name, _ := z.TagName()
+			if !tgHTMLTags[string(name)] {
+				return common.NewErrorf("Telegram doesn't support <%s>", name)
+			}
+			open = append(open, string(name))
+		case xhtml.EndTagToken:
+			name, _ := z.TagName()
+			if len(open) == 0 || open[len(open)-1] != string(name) {
+				return common.NewErrorf("</%s> doesn't close the last tag", name)
+			}
+			open = open[:len(open)-1]
+		case xhtml.SelfClosingTagToken:
+			name, _ := z.TagName()
+			return common.NewErrorf("Telegram doesn't support <%s/>", name)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package service
+
+import (
+	"strings"
+	"time"
+
+	"x-ui/logger"
+	"x-ui/util/common"
+)
+
+// expiryDateLayout is how an expiry entered as a date is written
+const expiryDateLayout = "2006-01-02"
+
+// panelLocation returns the time zone of the panel, the local one if the
+// settings can't be read.
+func panelLocation() *time.Location {
+	loc, err := (&SettingService{}).GetTimeLocation()
+	if err != nil {
+		logger.Warning("Unable to get the time zone of the panel:", err)
+		return time.Local
+	}
+	return loc
+}
+
+// EndOfDay returns the end of date, "2006-01-02", in loc in unix milliseconds:
+// the start of the next day there, so that all of the day is included. The day
+// is 23 or 25 hours long across a daylight saving change.
+func EndOfDay(date string, loc *time.Location) (int64, error) {
+	day, err := time.ParseInLocation(expiryDateLayout, strings.TrimSpace(date), loc)
+	if err != nil {
+		return 0, common.NewErrorf("%q is not a date like 2006-01-02", date)
+	}
+	year, month, dayOf := day.Date()
+	return time.Date(year, month, dayOf+1, 0, 0, 0, 0, loc).UnixMilli(), nil
+}
+
+// normalizeExpiryDate replaces the "expiryDate" of a client, a date, with the
+// expiryTime at its end in the panel time zone. The expiry is kept as that time,
+// so a later change of the time zone doesn't move it.
+func normalizeExpiryDate(client map[string]any) (bool, error) {
+	value, ok := client["expiryDate"]
+	if !ok {
+		return false, nil
+	}
+	delete(client, "expiryDate")
+	date, _ := value.(string)
+	if strings.TrimSpace(date) == "" {
+		return true, nil
+	}
+	expiryTime, err := EndOfDay(date, panelLocation())
+	if err != nil {
+		return false, err
+	}
+	client["expiryTime"] = expiryTime
+	return true, nil
+}
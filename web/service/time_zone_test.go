@@ -0,0 +1,195 @@
+package service
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+	// The zones of the tests load without the zone files of the system, as in
+	// the panel
+	_ "time/tzdata"
+)
+
+func mustLoadLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loc
+}
+
+func setTestTimeZone(t *testing.T, name string) {
+	t.Helper()
+	if err := (&SettingService{}).setString("timeLocation", name); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEndOfDay(t *testing.T) {
+	for _, c := range []struct {
+		zone, date string
+		want       string
+		hours      float64
+	}{
+		{"UTC", "2025-03-01", "2025-03-02T00:00:00Z", 24},
+		// Half an hour off the hours of UTC, the day ends on the day before there
+		{"Asia/Tehran", "2025-03-01", "2025-03-01T20:30:00Z", 24},
+		{"Asia/Tehran", " 2025-12-31 ", "2025-12-31T20:30:00Z", 24},
+		// The days the clocks change are an hour shorter or longer
+		{"America/New_York", "2025-03-09", "2025-03-10T04:00:00Z", 23},
+		{"America/New_York", "2025-11-02", "2025-11-03T05:00:00Z", 25},
+		{"Europe/Berlin", "2025-03-30", "2025-03-30T22:00:00Z", 23},
+		{"Europe/Berlin", "2025-10-26", "2025-10-26T23:00:00Z", 25},
+	} {
+		loc := mustLoadLocation(t, c.zone)
+		end, err := EndOfDay(c.date, loc)
+		if err != nil {
+			t.Errorf("%s in %s: %v", c.date, c.zone, err)
+			continue
+		}
+		if got := time.UnixMilli(end).UTC().Format(time.RFC3339); got != c.want {
+			t.Errorf("%s in %s ends at %s, want %s", c.date, c.zone, got, c.want)
+		}
+		start, _ := time.ParseInLocation(expiryDateLayout, strings.TrimSpace(c.date), loc)
+		if hours := time.UnixMilli(end).Sub(start).Hours(); hours != c.hours {
+			t.Errorf("%s in %s lasts %v hours, want %v", c.date, c.zone, hours, c.hours)
+		}
+	}
+	for _, date := range []string{"", "2025-02-30", "01/03/2025", "2025-03-01T10:00:00Z"} {
+		if _, err := EndOfDay(date, time.UTC); err == nil {
+			t.Errorf("%q was taken for a date", date)
+		}
+	}
+}
+
+// normalizedExpiry returns the client of settings after they're normalized.
+func normalizedExpiry(t *testing.T, settings string) map[string]any {
+	t.Helper()
+	normalized, err := normalizeClients(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parsed struct {
+		Clients []map[string]any `json:"clients"`
+	}
+	if err := json.Unmarshal([]byte(normalized), &parsed); err != nil || len(parsed.Clients) != 1 {
+		t.Fatalf("the normalized settings are %s, %v", normalized, err)
+	}
+	return parsed.Clients[0]
+}
+
+func TestNormalizeExpiryDate(t *testing.T) {
+	newTestDB(t)
+	setTestTimeZone(t, "Asia/Tehran")
+	client := normalizedExpiry(t, `{"clients":[{"email":"a1","expiryTime":0,"expiryDate":"2025-03-01"}]}`)
+	want := time.Date(2025, 3, 1, 20, 30, 0, 0, time.UTC).UnixMilli()
+	if _, ok := client["expiryDate"]; ok || jsonInt64(client["expiryTime"]) != want {
+		t.Fatalf("the client is %v, want the expiryTime %d", client, want)
+	}
+
+	// The expiry is stored as a time, another zone doesn't move it
+	setTestTimeZone(t, "UTC")
+	stored, _ := json.Marshal(map[string]any{"clients": []any{client}})
+	if moved := normalizedExpiry(t, string(stored)); jsonInt64(moved["expiryTime"]) != want {
+		t.Errorf("the expiry moved to %v in another zone", moved["expiryTime"])
+	}
+	// Entered again, the date ends in the new zone
+	if client := normalizedExpiry(t, `{"clients":[{"email":"a1","expiryDate":"2025-03-01"}]}`); jsonInt64(client["expiryTime"]) != want+int64(3*time.Hour+30*time.Minute)/1e6 {
+		t.Errorf("the date in UTC ends at %v", client["expiryTime"])
+	}
+
+	// An empty date keeps the expiry, a wrong one is refused
+	if client := normalizedExpiry(t, `{"clients":[{"email":"a1","expiryTime":42,"expiryDate":""}]}`); jsonInt64(client["expiryTime"]) != 42 {
+		t.Errorf("an empty date set the expiry to %v", client["expiryTime"])
+	}
+	if _, err := normalizeClients(`{"clients":[{"email":"a1","expiryDate":"2025-02-30"}]}`); err == nil {
+		t.Error("a wrong date was taken")
+	}
+}
+
+func TestClientPatchExpiryDate(t *testing.T) {
+	newTestDB(t)
+	setTestTimeZone(t, "Asia/Tehran")
+	patch := ClientPatch{ExpiryDate: "2025-03-01"}
+	if err := patch.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2025, 3, 1, 20, 30, 0, 0, time.UTC).UnixMilli(); patch.ExpiryTime == nil || *patch.ExpiryTime != want || patch.ExpiryDate != "" {
+		t.Errorf("the patch is %+v, want the expiryTime %d", patch, want)
+	}
+	expiryTime := int64(1)
+	if err := (&ClientPatch{ExpiryDate: "2025-03-01", ExpiryTime: &expiryTime}).validate(); err == nil {
+		t.Error("a patch with an expiryDate and an expiryTime was taken")
+	}
+}
+
+func TestDaysUntil(t *testing.T) {
+	tehran := mustLoadLocation(t, "Asia/Tehran")
+	newYork := mustLoadLocation(t, "America/New_York")
+	for _, c := range []struct {
+		name        string
+		now, expiry time.Time
+		loc         *time.Location
+		want        int
+	}{
+		// 23:00 at night in Tehran, still the same day in UTC
+		{"tomorrow in Tehran", time.Date(2025, 3, 1, 23, 0, 0, 0, tehran), time.Date(2025, 3, 2, 0, 30, 0, 0, tehran), tehran, 1},
+		{"the same day in UTC", time.Date(2025, 3, 1, 23, 0, 0, 0, tehran), time.Date(2025, 3, 2, 0, 30, 0, 0, tehran), time.UTC, 0},
+		{"a week in Tehran", time.Date(2025, 3, 1, 12, 0, 0, 0, tehran), time.Date(2025, 3, 8, 23, 59, 0, 0, tehran), tehran, 7},
+		// Across the start and the end of daylight saving time
+		{"across spring forward", time.Date(2025, 3, 8, 12, 0, 0, 0, newYork), time.Date(2025, 3, 10, 0, 0, 0, 0, newYork), newYork, 2},
+		{"across fall back", time.Date(2025, 11, 1, 23, 30, 0, 0, newYork), time.Date(2025, 11, 3, 0, 30, 0, 0, newYork), newYork, 2},
+		{"expired", time.Date(2025, 3, 10, 12, 0, 0, 0, newYork), time.Date(2025, 3, 8, 12, 0, 0, 0, newYork), newYork, -2},
+	} {
+		if got := daysUntil(c.expiry.UnixMilli(), c.now, c.loc); got != c.want {
+			t.Errorf("%s: %d days, want %d", c.name, got, c.want)
+		}
+	}
+}
+
+func TestResetPeriodInZone(t *testing.T) {
+	tehran := mustLoadLocation(t, "Asia/Tehran")
+	newYork := mustLoadLocation(t, "America/New_York")
+
+	// A monthly reset on the 1st fires at midnight in Tehran, on the last day
+	// of the month before in UTC
+	last, next, ok := resetPeriod(ResetPolicyMonthly, 1, time.Date(2025, 3, 1, 0, 10, 0, 0, tehran), tehran)
+	if !ok || !last.Equal(time.Date(2025, 2, 28, 20, 30, 0, 0, time.UTC)) || !next.Equal(time.Date(2025, 3, 31, 20, 30, 0, 0, time.UTC)) {
+		t.Errorf("the monthly reset in Tehran is from %s to %s", last.UTC(), next.UTC())
+	}
+	// The same instant in UTC is still in February
+	if last, _, _ := resetPeriod(ResetPolicyMonthly, 1, time.Date(2025, 3, 1, 0, 10, 0, 0, tehran), time.UTC); last.Month() != time.February {
+		t.Errorf("the monthly reset in UTC was last on %s", last)
+	}
+
+	// Daily resets stay at midnight across daylight saving changes
+	for _, day := range []time.Time{time.Date(2025, 3, 9, 12, 0, 0, 0, newYork), time.Date(2025, 11, 2, 12, 0, 0, 0, newYork)} {
+		last, next, _ := resetPeriod(ResetPolicyDaily, 0, day, newYork)
+		if last.Hour() != 0 || next.Hour() != 0 || next.Day() != day.Day()+1 {
+			t.Errorf("the daily reset of %s is from %s to %s", day, last, next)
+		}
+	}
+	// A weekly reset on Monday lasts a week, of 167 hours across spring forward
+	last, next, _ = resetPeriod(ResetPolicyWeekly, 1, time.Date(2025, 3, 12, 12, 0, 0, 0, newYork), newYork)
+	if last.Weekday() != time.Monday || last.Day() != 10 || next.Sub(last) != 7*24*time.Hour {
+		t.Errorf("the weekly reset is from %s to %s", last, next)
+	}
+	last, next, _ = resetPeriod(ResetPolicyWeekly, 1, time.Date(2025, 3, 5, 12, 0, 0, 0, newYork), newYork)
+	if last.Day() != 3 || next.Day() != 10 || next.Sub(last) != 167*time.Hour {
+		t.Errorf("the weekly reset across spring forward is from %s to %s", last, next)
+	}
+}
+
+func TestBotTimesInZone(t *testing.T) {
+	newTestDB(t)
+	setTestTimeZone(t, "Asia/Tehran")
+	bot := &Tgbot{}
+	at := time.Date(2025, 2, 28, 20, 30, 0, 0, time.UTC).UnixMilli()
+	if got := bot.formatTime(at); got != "2025-03-01 00:00:00" {
+		t.Errorf("the bot formats the time as %q", got)
+	}
+	if got := bot.templateDate(at); got != "2025-03-01 00:00" {
+		t.Errorf("the templates format the date as %q", got)
+	}
+}
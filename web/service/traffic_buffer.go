@@ -0,0 +1,358 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"x-ui/database"
+	"x-ui/logger"
+	"x-ui/web/metrics"
+	"x-ui/xray"
+
+	"gorm.io/gorm"
+)
+
+// trafficFlushBatch is how many rows a statement of a flush writes at most
+const trafficFlushBatch = 500
+
+// byKeyBatch is how many rows a statement with a CASE of byKey matches at most.
+// The CASE is looked through for each row, so its cost grows with the square
+// of the rows.
+const byKeyBatch = 50
+
+// trafficDelta is traffic counted from Xray and not written to the database yet.
+type trafficDelta struct {
+	up   int64
+	down int64
+}
+
+// trafficBatch is the traffic counted within an hour, by inbound and outbound
+// tag and by client email.
+type trafficBatch struct {
+	inbounds  map[string]*trafficDelta
+	outbounds map[string]*trafficDelta
+	clients   map[string]*trafficDelta
+}
+
+func newTrafficBatch() *trafficBatch {
+	return &trafficBatch{
+		inbounds:  map[string]*trafficDelta{},
+		outbounds: map[string]*trafficDelta{},
+		clients:   map[string]*trafficDelta{},
+	}
+}
+
+func addDelta(deltas map[string]*trafficDelta, key string, up int64, down int64) {
+	up, down = max(up, 0), max(down, 0)
+	if up == 0 && down == 0 {
+		return
+	}
+	delta := deltas[key]
+	if delta == nil {
+		delta = &trafficDelta{}
+		deltas[key] = delta
+	}
+	delta.up += up
+	delta.down += down
+}
+
+func (b *trafficBatch) merge(other *trafficBatch) {
+	for tag, delta := range other.inbounds {
+		addDelta(b.inbounds, tag, delta.up, delta.down)
+	}
+	for tag, delta := range other.outbounds {
+		addDelta(b.outbounds, tag, delta.up, delta.down)
+	}
+	for email, delta := range other.clients {
+		addDelta(b.clients, email, delta.up, delta.down)
+	}
+}
+
+// pendingTraffic is the traffic waiting to be flushed to the database, by the
+// hour it was counted in, and pendingCounters the counters of Xray it was
+// counted up to. A flush takes both, and puts them back if it fails.
+var (
+	pendingTrafficLock sync.Mutex
+	pendingTraffic     = map[int64]*trafficBatch{}
+	pendingCounters    *xray.CounterSnapshot
+	lastTrafficFlush   time.Time
+	// writtenTraffic is the traffic of each client flushed since the panel
+	// started
+	writtenTraffic = map[string]int64{}
+
+	// trafficFlushLock lets a single flush run at a time
+	trafficFlushLock sync.Mutex
+)
+
+// lockTrafficFlush takes trafficFlushLock, counting the times it had to wait
+// for another flush.
+func lockTrafficFlush() {
+	if !trafficFlushLock.TryLock() {
+		metrics.IncFlushContention()
+		trafficFlushLock.Lock()
+	}
+}
+
+// bufferTraffic adds traffic read from Xray up to counters to the pending
+// traffic, and makes counters the snapshot the next read is counted from.
+func bufferTraffic(inboundTraffics []*xray.Traffic, clientTraffics []*xray.ClientTraffic, counters *xray.CounterSnapshot) {
+	now := time.Now()
+	hour := hourStart(now).UnixMilli()
+	pendingTrafficLock.Lock()
+	defer pendingTrafficLock.Unlock()
+	batch := pendingTraffic[hour]
+	if batch == nil {
+		batch = newTrafficBatch()
+		pendingTraffic[hour] = batch
+	}
+	for _, traffic := range inboundTraffics {
+		if traffic.IsInbound {
+			addDelta(batch.inbounds, traffic.Tag, traffic.Up, traffic.Down)
+		} else if traffic.IsOutbound {
+			addDelta(batch.outbounds, traffic.Tag, traffic.Up, traffic.Down)
+		}
+	}
+	for _, traffic := range clientTraffics {
+		addDelta(batch.clients, traffic.Email, traffic.Up, traffic.Down)
+		addGeoTraffic(traffic.Email, traffic.Up, traffic.Down, now)
+		// A client passing traffic is online
+		if traffic.Up+traffic.Down > 0 {
+			seeClient(traffic.Email, "", now)
+		}
+	}
+	if len(batch.inbounds)+len(batch.outbounds)+len(batch.clients) == 0 {
+		delete(pendingTraffic, hour)
+	}
+	if counters != nil {
+		pendingCounters = counters
+		setCounterSnapshot(counters)
+	}
+}
+
+// takePendingTraffic takes the pending traffic out for a flush.
+func takePendingTraffic() (map[int64]*trafficBatch, *xray.CounterSnapshot) {
+	pendingTrafficLock.Lock()
+	defer pendingTrafficLock.Unlock()
+	batches, counters := pendingTraffic, pendingCounters
+	pendingTraffic, pendingCounters = map[int64]*trafficBatch{}, nil
+	return batches, counters
+}
+
+// restorePendingTraffic puts back the traffic of a failed flush, to be written
+// with the next one. Counters read since are newer and kept.
+func restorePendingTraffic(batches map[int64]*trafficBatch, counters *xray.CounterSnapshot) {
+	pendingTrafficLock.Lock()
+	defer pendingTrafficLock.Unlock()
+	for hour, batch := range batches {
+		if pending := pendingTraffic[hour]; pending != nil {
+			pending.merge(batch)
+		} else {
+			pendingTraffic[hour] = batch
+		}
+	}
+	if pendingCounters == nil {
+		pendingCounters = counters
+	}
+}
+
+// pendingTotal returns the pending traffic of all the hours together.
+func pendingTotal() *trafficBatch {
+	pendingTrafficLock.Lock()
+	defer pendingTrafficLock.Unlock()
+	total := newTrafficBatch()
+	for _, batch := range pendingTraffic {
+		total.merge(batch)
+	}
+	return total
+}
+
+// trafficFlushDue tells if the pending traffic is to be flushed now: every
+// trafficFlushInterval, and at once when it makes an enabled client or inbound
+// reach its traffic limit, so that it is disabled without waiting.
+func (s *InboundService) trafficFlushDue() (bool, error) {
+	interval, err := s.settingService.GetTrafficFlushInterval()
+	if err != nil {
+		return true, err
+	}
+	pendingTrafficLock.Lock()
+	empty := len(pendingTraffic) == 0 && pendingCounters == nil
+	last := lastTrafficFlush
+	pendingTrafficLock.Unlock()
+	if empty {
+		return false, nil
+	}
+	if time.Since(last) >= time.Duration(interval)*time.Second {
+		return true, nil
+	}
+
+	total := pendingTotal()
+	db := database.GetDB()
+	for _, pending := range []struct {
+		table  string
+		key    string
+		deltas map[string]*trafficDelta
+	}{
+		{"client_traffics", "email", total.clients},
+		{"inbounds", "tag", total.inbounds},
+	} {
+		values := make([][]any, 0, len(pending.deltas))
+		for key, delta := range pending.deltas {
+			values = append(values, []any{key, delta.up + delta.down})
+		}
+		reached, err := reachesLimit(db, pending.table, pending.key, values)
+		if err != nil || reached {
+			return true, err
+		}
+	}
+	return false, nil
+}
+
+// reachesLimit tells if adding the traffic of values, rows of a key of table
+// and an amount, makes an enabled row reach its total.
+func reachesLimit(db *gorm.DB, table string, key string, values [][]any) (bool, error) {
+	for start := 0; start < len(values); start += byKeyBatch {
+		batch := values[start:min(start+byKeyBatch, len(values))]
+		amount, args := byKey(key, batch, 1)
+		sql := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s IN ? AND enable = ? AND total > 0 AND up + down + %s >= total",
+			table, key, amount)
+		var count int64
+		if err := db.Raw(sql, append([]any{keysOf(batch), true}, args...)...).Scan(&count).Error; err != nil {
+			return false, err
+		}
+		if count > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// FlushTraffic writes the pending traffic to the database now, before a backup
+// or a shutdown. On failure the traffic stays pending.
+func (s *InboundService) FlushTraffic() error {
+	lockTrafficFlush()
+	defer trafficFlushLock.Unlock()
+	batches, counters := takePendingTraffic()
+	if len(batches) == 0 && counters == nil {
+		return nil
+	}
+	err := database.Transaction(func(tx *gorm.DB) error {
+		return s.writeTraffic(tx, batches, counters)
+	})
+	if err != nil {
+		restorePendingTraffic(batches, counters)
+		return err
+	}
+	trafficFlushed(batches, counters)
+	s.forgetOldSightings()
+	return nil
+}
+
+func trafficFlushed(batches map[int64]*trafficBatch, counters *xray.CounterSnapshot) {
+	if counters != nil {
+		markCounterSnapshotSaved(counters)
+	}
+	pendingTrafficLock.Lock()
+	lastTrafficFlush = time.Now()
+	for _, batch := range batches {
+		for email, delta := range batch.clients {
+			writtenTraffic[email] += delta.up + delta.down
+		}
+	}
+	pendingTrafficLock.Unlock()
+
+	inboundsToday.Lock()
+	inboundsToday.stale = true
+	inboundsToday.Unlock()
+}
+
+// WrittenTraffic returns the traffic of the clients of emails flushed to the
+// database since the panel started, for what shows their usage to tell how
+// much it changed without reading it.
+func WrittenTraffic(emails []string) int64 {
+	pendingTrafficLock.Lock()
+	defer pendingTrafficLock.Unlock()
+	var total int64
+	for _, email := range emails {
+		total += writtenTraffic[email]
+	}
+	return total
+}
+
+// writeTraffic writes taken pending traffic in tx with a few statements: the
+// counters it was counted up to, the totals of the inbounds, the clients and
+// the outbounds, and the traffic history.
+func (s *InboundService) writeTraffic(tx *gorm.DB, batches map[int64]*trafficBatch, counters *xray.CounterSnapshot) error {
+	if counters != nil {
+		if err := saveCounterSnapshot(tx, counters); err != nil {
+			return err
+		}
+	}
+	total := newTrafficBatch()
+	for _, batch := range batches {
+		total.merge(batch)
+	}
+	if err := s.addInboundTraffic(tx, total.inbounds); err != nil {
+		return err
+	}
+	if err := s.addClientTraffic(tx, total.clients); err != nil {
+		return err
+	}
+	var outboundService OutboundService
+	if err := outboundService.addOutboundTraffic(tx, total.outbounds); err != nil {
+		return err
+	}
+	// The counters are kept even if their history can't be
+	for hour, batch := range batches {
+		if err := s.addTrafficHistory(tx, hour, batch); err != nil {
+			logger.Warning("Error in adding traffic history:", err)
+			break
+		}
+	}
+	return nil
+}
+
+// byKey returns a CASE of the key column giving the value at index of the row
+// of values it is the first value of, with its arguments.
+func byKey(key string, values [][]any, index int) (string, []any) {
+	var expr strings.Builder
+	args := make([]any, 0, 2*len(values))
+	expr.WriteString("CASE " + key)
+	for _, row := range values {
+		expr.WriteString(" WHEN ? THEN ?")
+		args = append(args, row[0], row[index])
+	}
+	expr.WriteString(" END")
+	return expr.String(), args
+}
+
+func keysOf(values [][]any) []any {
+	keys := make([]any, len(values))
+	for i, row := range values {
+		keys[i] = row[0]
+	}
+	return keys
+}
+
+// updateByKey updates the rows of table matched by key, the first value of a
+// row of values, with sets: an assignment for each next value of the rows,
+// with %s where the value goes, such as "up = up + %s". Each statement updates
+// up to byKeyBatch rows.
+func updateByKey(tx *gorm.DB, table string, key string, sets []string, values [][]any) error {
+	for start := 0; start < len(values); start += byKeyBatch {
+		batch := values[start:min(start+byKeyBatch, len(values))]
+		assignments := make([]string, len(sets))
+		var args []any
+		for i, set := range sets {
+			value, valueArgs := byKey(key, batch, i+1)
+			assignments[i] = fmt.Sprintf(set, value)
+			args = append(args, valueArgs...)
+		}
+		sql := fmt.Sprintf("UPDATE %s SET %s WHERE %s IN ?", table, strings.Join(assignments, ", "), key)
+		if err := tx.Exec(sql, append(args, keysOf(batch))...).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
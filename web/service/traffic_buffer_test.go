@@ -0,0 +1,80 @@
+package service
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/xray"
+
+	"gorm.io/gorm"
+)
+
+// flushPerRow writes the traffic of a read of Xray a row at a time, as the
+// stats job did before it was buffered: an update for each inbound, and the
+// rows of the clients read and each saved back, along with the same traffic
+// history.
+func flushPerRow(s *InboundService, inboundTraffics []*xray.Traffic, clientTraffics []*xray.ClientTraffic) error {
+	return database.Transaction(func(tx *gorm.DB) error {
+		batch := newTrafficBatch()
+		for _, traffic := range inboundTraffics {
+			err := tx.Model(&model.Inbound{}).Where("tag = ?", traffic.Tag).Updates(map[string]any{
+				"up":   gorm.Expr("up + ?", traffic.Up),
+				"down": gorm.Expr("down + ?", traffic.Down),
+			}).Error
+			if err != nil {
+				return err
+			}
+			addDelta(batch.inbounds, traffic.Tag, traffic.Up, traffic.Down)
+		}
+		emails := make([]string, len(clientTraffics))
+		for i, traffic := range clientTraffics {
+			emails[i] = traffic.Email
+			addDelta(batch.clients, traffic.Email, traffic.Up, traffic.Down)
+		}
+		var rows []*xray.ClientTraffic
+		if err := tx.Where("email IN ?", emails).Find(&rows).Error; err != nil {
+			return err
+		}
+		for _, row := range rows {
+			if delta := batch.clients[row.Email]; delta != nil {
+				row.Up += delta.up
+				row.Down += delta.down
+			}
+		}
+		for _, row := range rows {
+			if err := tx.Save(row).Error; err != nil {
+				return err
+			}
+		}
+		return s.addTrafficHistory(tx, hourStart(time.Now()).UnixMilli(), batch)
+	})
+}
+
+func BenchmarkTrafficFlush(b *testing.B) {
+	inbounds := metricsTestDB(b, 1, 5000)
+	inboundTraffics := []*xray.Traffic{{IsInbound: true, Tag: inbounds[0].Tag, Up: 5000, Down: 10000}}
+	clientTraffics := make([]*xray.ClientTraffic, 5000)
+	for i := range clientTraffics {
+		clientTraffics[i] = &xray.ClientTraffic{Email: inbounds[0].Tag + "-" + strconv.Itoa(i), Up: 1, Down: 2}
+	}
+	s := &InboundService{}
+
+	b.Run("per row", func(b *testing.B) {
+		for b.Loop() {
+			if err := flushPerRow(s, inboundTraffics, clientTraffics); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("bulk", func(b *testing.B) {
+		for b.Loop() {
+			bufferTraffic(inboundTraffics, clientTraffics, nil)
+			if err := s.FlushTraffic(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,174 @@
+package service
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/xray"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// xrayCounterBatch is how many counters are written or deleted at once
+const xrayCounterBatch = 500
+
+// counterSnapshot is the snapshot of the counters of Xray the traffic was
+// counted up to, and savedCounterSnapshot the one the traffic in the database
+// was, loaded from the database on the first read.
+var (
+	counterSnapshotLock   sync.Mutex
+	counterSnapshot       *xray.CounterSnapshot
+	savedCounterSnapshot  *xray.CounterSnapshot
+	counterSnapshotLoaded bool
+)
+
+func loadCounterSnapshot() (*xray.CounterSnapshot, error) {
+	var counters []model.XrayCounter
+	if err := database.GetDB().Find(&counters).Error; err != nil {
+		return nil, err
+	}
+	if len(counters) == 0 {
+		return nil, nil
+	}
+	snapshot := &xray.CounterSnapshot{Counters: make(map[string]int64, len(counters))}
+	for _, counter := range counters {
+		if counter.Name == model.XrayCounterStarted {
+			snapshot.Started = time.UnixMilli(counter.Value)
+		} else {
+			snapshot.Counters[counter.Name] = counter.Value
+		}
+	}
+	return snapshot, nil
+}
+
+// loadedCounterSnapshots returns the counted and the saved snapshots, with
+// counterSnapshotLock held.
+func loadedCounterSnapshots() (*xray.CounterSnapshot, *xray.CounterSnapshot, error) {
+	if !counterSnapshotLoaded {
+		snapshot, err := loadCounterSnapshot()
+		if err != nil {
+			return nil, nil, err
+		}
+		counterSnapshot, savedCounterSnapshot, counterSnapshotLoaded = snapshot, snapshot, true
+	}
+	return counterSnapshot, savedCounterSnapshot, nil
+}
+
+// currentCounterSnapshot returns the snapshot the traffic was counted up to.
+func currentCounterSnapshot() (*xray.CounterSnapshot, error) {
+	counterSnapshotLock.Lock()
+	defer counterSnapshotLock.Unlock()
+	counted, _, err := loadedCounterSnapshots()
+	return counted, err
+}
+
+// countTraffic returns the traffic the counters observed from Xray, running for
+// uptime, grew by since they were last counted, with the snapshot to save along
+// with it. Counters that started from zero again are counted whole and logged.
+func countTraffic(observed map[string]int64, uptime time.Duration) ([]*xray.Traffic, []*xray.ClientTraffic, *xray.CounterSnapshot, error) {
+	previous, err := currentCounterSnapshot()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	started := time.Now().Add(-uptime)
+	deltas := previous.Deltas(started, observed)
+	switch {
+	case previous == nil:
+		logger.Debug("No Xray traffic counters saved yet, counting their values as new traffic")
+	case deltas.Restarted:
+		logger.Infof("Xray restarted since its traffic counters were last read, counting %d counters from zero", len(observed))
+		logger.Debugf("Xray started at %s, the saved counters are of a process started at %s", started.Format(time.RFC3339), previous.Started.Format(time.RFC3339))
+	}
+	if len(deltas.Resets) > 0 {
+		names := deltas.Resets
+		if len(names) > 5 {
+			names = names[:5]
+		}
+		logger.Infof("%d Xray traffic counters went back since they were last read, counting them from zero: %s", len(deltas.Resets), strings.Join(names, ", "))
+	}
+
+	next := &xray.CounterSnapshot{Started: started, Counters: observed}
+	if !deltas.Restarted {
+		next.Started = previous.Started
+	}
+	traffics, clientTraffics := xray.TrafficFromCounters(deltas.Deltas)
+	return traffics, clientTraffics, next, nil
+}
+
+// saveCounterSnapshot saves the counters that changed since the snapshot the
+// traffic in the database was counted up to, in the transaction of the traffic.
+func saveCounterSnapshot(tx *gorm.DB, next *xray.CounterSnapshot) error {
+	counterSnapshotLock.Lock()
+	_, previous, err := loadedCounterSnapshots()
+	counterSnapshotLock.Unlock()
+	if err != nil {
+		return err
+	}
+	var changed []model.XrayCounter
+	var stale []string
+	if previous == nil || !previous.Started.Equal(next.Started) {
+		changed = append(changed, model.XrayCounter{Name: model.XrayCounterStarted, Value: next.Started.UnixMilli()})
+	}
+	for name, value := range next.Counters {
+		var last int64
+		ok := false
+		if previous != nil {
+			last, ok = previous.Counters[name]
+		}
+		if !ok || last != value {
+			changed = append(changed, model.XrayCounter{Name: name, Value: value})
+		}
+	}
+	if previous != nil {
+		for name := range previous.Counters {
+			if _, ok := next.Counters[name]; !ok {
+				stale = append(stale, name)
+			}
+		}
+	}
+
+	if len(changed) > 0 {
+		err = tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "name"}},
+			DoUpdates: clause.AssignmentColumns([]string{"value"}),
+		}).CreateInBatches(changed, xrayCounterBatch).Error
+		if err != nil {
+			return err
+		}
+	}
+	for start := 0; start < len(stale); start += xrayCounterBatch {
+		end := min(start+xrayCounterBatch, len(stale))
+		if err := tx.Where("name IN ?", stale[start:end]).Delete(model.XrayCounter{}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setCounterSnapshot makes next the snapshot the traffic is counted up to.
+func setCounterSnapshot(next *xray.CounterSnapshot) {
+	counterSnapshotLock.Lock()
+	counterSnapshot, counterSnapshotLoaded = next, true
+	counterSnapshotLock.Unlock()
+}
+
+// markCounterSnapshotSaved makes next the snapshot the traffic in the database
+// is counted up to, once the traffic saved with it is committed.
+func markCounterSnapshotSaved(next *xray.CounterSnapshot) {
+	counterSnapshotLock.Lock()
+	savedCounterSnapshot = next
+	counterSnapshotLock.Unlock()
+}
+
+// forgetCounterSnapshot makes the snapshots be loaded again from the database,
+// after it was replaced.
+func forgetCounterSnapshot() {
+	counterSnapshotLock.Lock()
+	counterSnapshot, savedCounterSnapshot, counterSnapshotLoaded = nil, nil, false
+	counterSnapshotLock.Unlock()
+}
@@ -0,0 +1,117 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"x-ui/database"
+	"x-ui/xray"
+)
+
+// readCounters counts the traffic of counters read from an Xray running for
+// uptime and adds it, as the traffic job does, flushing it to the database.
+func readCounters(t *testing.T, uptime time.Duration, counters map[string]int64) {
+	t.Helper()
+	traffics, clientTraffics, snapshot, err := countTraffic(counters, uptime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s InboundService
+	if err, _ := s.AddTraffic(traffics, clientTraffics, snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.FlushTraffic(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func trafficCounters(inboundUp int64, clientUp int64) map[string]int64 {
+	return map[string]int64{
+		"inbound>>>inbound-20001>>>traffic>>>uplink": inboundUp,
+		"user>>>alice>>>traffic>>>uplink":            clientUp,
+	}
+}
+
+// restartPanel forgets what the panel keeps in memory of the traffic, as if it
+// started again on the same database.
+func restartPanel() {
+	takePendingTraffic()
+	forgetCounterSnapshot()
+}
+
+func TestTrafficAcrossRestarts(t *testing.T) {
+	withClient, _ := trafficTestDB(t)
+	forgetCounterSnapshot()
+	t.Cleanup(forgetCounterSnapshot)
+	check := func(step string, inboundUp int64, clientUp int64) {
+		t.Helper()
+		if got := reloadInbound(t, withClient).Up; got != inboundUp {
+			t.Errorf("%s: the inbound has %d up, want %d", step, got, inboundUp)
+		}
+		if got := clientTraffic(t, "alice").Up; got != clientUp {
+			t.Errorf("%s: the client has %d up, want %d", step, got, clientUp)
+		}
+	}
+
+	readCounters(t, time.Hour, trafficCounters(1000, 100))
+	check("first read", 1000, 100)
+	readCounters(t, time.Hour, trafficCounters(1500, 150))
+	check("same process", 1500, 150)
+
+	// Xray restarted: its counters started from zero, none of them is lost
+	readCounters(t, time.Second, trafficCounters(300, 30))
+	check("xray restart", 1800, 180)
+	readCounters(t, time.Second, trafficCounters(400, 40))
+	check("after the xray restart", 1900, 190)
+
+	// The panel restarted with Xray running on: what was counted isn't again
+	restartPanel()
+	readCounters(t, time.Second, trafficCounters(500, 50))
+	check("panel restart", 2000, 200)
+
+	// Both restarted
+	restartPanel()
+	readCounters(t, time.Hour+time.Minute, trafficCounters(70, 7))
+	check("both restarts", 2070, 207)
+
+	// A counter that went back while Xray ran on is counted from zero
+	readCounters(t, time.Hour+time.Minute, trafficCounters(100, 3))
+	check("counter reset", 2100, 210)
+}
+
+func TestTrafficNotSavedIsCountedAgain(t *testing.T) {
+	withClient, _ := trafficTestDB(t)
+	forgetCounterSnapshot()
+	t.Cleanup(forgetCounterSnapshot)
+	readCounters(t, time.Hour, trafficCounters(1000, 100))
+
+	// Traffic counted but lost before it was flushed, with the panel
+	if _, _, snapshot, err := countTraffic(trafficCounters(1200, 120), time.Hour); err != nil {
+		t.Fatal(err)
+	} else {
+		bufferTraffic([]*xray.Traffic{{IsInbound: true, Tag: withClient.Tag, Up: 200}}, nil, snapshot)
+	}
+	restartPanel()
+	readCounters(t, time.Hour, trafficCounters(1300, 130))
+	if got := reloadInbound(t, withClient).Up; got != 1300 {
+		t.Errorf("the inbound has %d up, want 1300", got)
+	}
+}
+
+func TestRestartTrafficCountsTowardsQuota(t *testing.T) {
+	trafficTestDB(t)
+	forgetCounterSnapshot()
+	t.Cleanup(forgetCounterSnapshot)
+	if err := database.GetDB().Model(xray.ClientTraffic{}).Where("email = ?", "alice").Update("total", 150).Error; err != nil {
+		t.Fatal(err)
+	}
+	readCounters(t, time.Hour, trafficCounters(1000, 100))
+	if !clientTraffic(t, "alice").Enable {
+		t.Fatal("the client was disabled under its quota")
+	}
+	// The traffic after a restart of Xray takes the client over its quota
+	readCounters(t, time.Second, trafficCounters(600, 60))
+	if stored := clientTraffic(t, "alice"); stored.Enable || stored.DisabledReason != ClientDisabledQuota {
+		t.Errorf("the client over its quota is %v %q", stored.Enable, stored.DisabledReason)
+	}
+}
@@ -0,0 +1,244 @@
+package service
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/util/common"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// trafficHistoryBatch is how many hours are written to the history at once
+	trafficHistoryBatch = 500
+	// maxTrafficHistoryPoints is the most buckets a series of the history has
+	maxTrafficHistoryPoints = 2400
+)
+
+// TrafficPoint is the traffic of a bucket of a series of the history, starting
+// at Time.
+type TrafficPoint struct {
+	Time int64 `json:"time"`
+	Up   int64 `json:"up"`
+	Down int64 `json:"down"`
+}
+
+// TrafficSeries is the traffic of an entity from From to To by buckets of an
+// hour or a day, every bucket included, with the total of the range.
+type TrafficSeries struct {
+	Entity     string         `json:"entity"`
+	Id         string         `json:"id,omitempty"`
+	Resolution string         `json:"resolution"`
+	From       int64          `json:"from"`
+	To         int64          `json:"to"`
+	Up         int64          `json:"up"`
+	Down       int64          `json:"down"`
+	Points     []TrafficPoint `json:"points"`
+}
+
+// TrafficHistoryQuery picks a series of the history. From and To are in
+// milliseconds; the buckets holding them are included.
+type TrafficHistoryQuery struct {
+	Entity     string `form:"entity"`
+	Id         string `form:"id"`
+	From       int64  `form:"from"`
+	To         int64  `form:"to"`
+	Resolution string `form:"resolution"`
+}
+
+// inboundsToday is the traffic of the inbounds today by id, as of the last
+// flush of the traffic, counted again once a flush made it stale
+var inboundsToday struct {
+	sync.Mutex
+	day      int64
+	stale    bool
+	inbounds map[int]TrafficPoint
+}
+
+// GetInboundsTrafficToday returns the traffic of the inbounds since the start of
+// the day in the panel time zone, by id, as it was last flushed.
+func (s *InboundService) GetInboundsTrafficToday() (map[int]TrafficPoint, error) {
+	day := dayStart(time.Now().In(panelLocation())).UnixMilli()
+	inboundsToday.Lock()
+	defer inboundsToday.Unlock()
+	if inboundsToday.inbounds == nil || inboundsToday.stale || inboundsToday.day != day {
+		var rows []struct {
+			EntityId string
+			Up       int64
+			Down     int64
+		}
+		err := database.GetDB().Model(model.HourlyTraffic{}).
+			Select("entity_id, SUM(up) AS up, SUM(down) AS down").
+			Where("entity = ? AND hour >= ?", model.TrafficEntityInbound, day).
+			Group("entity_id").Scan(&rows).Error
+		if err != nil {
+			return nil, err
+		}
+		inbounds := make(map[int]TrafficPoint, len(rows))
+		for _, row := range rows {
+			if id, err := strconv.Atoi(row.EntityId); err == nil {
+				inbounds[id] = TrafficPoint{Time: day, Up: row.Up, Down: row.Down}
+			}
+		}
+		inboundsToday.day, inboundsToday.stale, inboundsToday.inbounds = day, false, inbounds
+	}
+	today := make(map[int]TrafficPoint, len(inboundsToday.inbounds))
+	for id, point := range inboundsToday.inbounds {
+		today[id] = point
+	}
+	return today, nil
+}
+
+// hourStart returns the start of the hour t is in, in the local time, zones a
+// half hour off included.
+func hourStart(t time.Time) time.Time {
+	_, offset := t.Zone()
+	shift := time.Duration(offset) * time.Second % time.Hour
+	return t.Add(shift).Truncate(time.Hour).Add(-shift)
+}
+
+func dayStart(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// addTrafficHistory adds the traffic counted within an hour to it, for the
+// inbounds, the clients and the panel.
+func (s *InboundService) addTrafficHistory(tx *gorm.DB, hour int64, batch *trafficBatch) error {
+	var rows []model.HourlyTraffic
+	add := func(entity string, id string, up int64, down int64) {
+		if up == 0 && down == 0 {
+			return
+		}
+		rows = append(rows, model.HourlyTraffic{Entity: entity, EntityId: id, Hour: hour, Up: up, Down: down})
+	}
+
+	if len(batch.inbounds) > 0 {
+		tags := make([]string, 0, len(batch.inbounds))
+		for tag := range batch.inbounds {
+			tags = append(tags, tag)
+		}
+		var inbounds []model.Inbound
+		err := tx.Model(model.Inbound{}).Select("id, tag").Where("tag IN ?", tags).Find(&inbounds).Error
+		if err != nil {
+			return err
+		}
+		var panelUp, panelDown int64
+		for _, inbound := range inbounds {
+			delta := batch.inbounds[inbound.Tag]
+			add(model.TrafficEntityInbound, strconv.Itoa(inbound.Id), delta.up, delta.down)
+			panelUp += delta.up
+			panelDown += delta.down
+		}
+		add(model.TrafficEntityPanel, "", panelUp, panelDown)
+	}
+	for email, delta := range batch.clients {
+		add(model.TrafficEntityClient, email, delta.up, delta.down)
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+
+	return tx.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "entity"}, {Name: "entity_id"}, {Name: "hour"}},
+		DoUpdates: clause.Assignments(map[string]any{
+			"up":   gorm.Expr("traffic_history.up + " + database.Excluded("up")),
+			"down": gorm.Expr("traffic_history.down + " + database.Excluded("down")),
+		}),
+	}).CreateInBatches(rows, trafficHistoryBatch).Error
+}
+
+// PruneTrafficHistory deletes the hours of the traffic history older than
+// days, none if days is 0.
+func (s *InboundService) PruneTrafficHistory(days int) (int64, error) {
+	if days <= 0 {
+		return 0, nil
+	}
+	cutoff := dayStart(time.Now().AddDate(0, 0, -days)).UnixMilli()
+	result := database.GetDB().Where("hour < ?", cutoff).Delete(model.HourlyTraffic{})
+	return result.RowsAffected, result.Error
+}
+
+// GetTrafficHistory returns a series of the traffic history: of an inbound by
+// its id, of a client by its email, or of the whole panel. It covers the last
+// day by hours or the last 30 days by days unless told otherwise.
+func (s *InboundService) GetTrafficHistory(query TrafficHistoryQuery) (*TrafficSeries, error) {
+	switch query.Entity {
+	case model.TrafficEntityInbound, model.TrafficEntityClient:
+		if query.Id == "" {
+			return nil, common.NewErrorf("the traffic history of a %s needs its id", query.Entity)
+		}
+	case model.TrafficEntityPanel, "":
+		query.Entity, query.Id = model.TrafficEntityPanel, ""
+	default:
+		return nil, common.NewErrorf("unknown traffic history entity: %s", query.Entity)
+	}
+
+	var bucket func(time.Time) time.Time
+	var next func(time.Time) time.Time
+	var span time.Duration
+	switch query.Resolution {
+	case "hour", "":
+		query.Resolution = "hour"
+		bucket, span = hourStart, 24*time.Hour
+		next = func(t time.Time) time.Time { return t.Add(time.Hour) }
+	case "day":
+		bucket, span = dayStart, 30*24*time.Hour
+		next = func(t time.Time) time.Time { return t.AddDate(0, 0, 1) }
+	default:
+		return nil, common.NewErrorf("unknown traffic history resolution: %s", query.Resolution)
+	}
+
+	to := time.Now()
+	if query.To > 0 {
+		to = time.UnixMilli(query.To)
+	}
+	from := to.Add(-span)
+	if query.From > 0 {
+		from = time.UnixMilli(query.From)
+	}
+	if from.After(to) {
+		return nil, common.NewError("the traffic history range starts after it ends")
+	}
+
+	series := &TrafficSeries{
+		Entity:     query.Entity,
+		Id:         query.Id,
+		Resolution: query.Resolution,
+		From:       bucket(from).UnixMilli(),
+		To:         to.UnixMilli(),
+		Points:     []TrafficPoint{},
+	}
+	index := map[int64]int{}
+	for t := bucket(from); !t.After(to); t = next(t) {
+		if len(series.Points) == maxTrafficHistoryPoints {
+			return nil, common.NewErrorf("the traffic history range has more than %d buckets, use a coarser resolution", maxTrafficHistoryPoints)
+		}
+		index[t.UnixMilli()] = len(series.Points)
+		series.Points = append(series.Points, TrafficPoint{Time: t.UnixMilli()})
+	}
+
+	var hours []model.HourlyTraffic
+	err := database.GetDB().Model(model.HourlyTraffic{}).
+		Where("entity = ? AND entity_id = ? AND hour >= ? AND hour <= ?", query.Entity, query.Id, series.From, series.To).
+		Order("hour").
+		Find(&hours).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, hour := range hours {
+		i, ok := index[bucket(time.UnixMilli(hour.Hour)).UnixMilli()]
+		if !ok {
+			continue
+		}
+		series.Points[i].Up += hour.Up
+		series.Points[i].Down += hour.Down
+		series.Up += hour.Up
+		series.Down += hour.Down
+	}
+	return series, nil
+}
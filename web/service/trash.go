@@ -0,0 +1,254 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/xray"
+
+	"gorm.io/gorm"
+)
+
+// trashedInbound is the data of a deleted inbound in the trash, with the stats
+// of its clients.
+type trashedInbound struct {
+	Inbound *model.Inbound `json:"inbound"`
+	UserId  int            `json:"userId"`
+}
+
+// trashedClient is the data of a deleted client in the trash: its JSON in the
+// settings of its inbound and its traffic.
+type trashedClient struct {
+	Client  map[string]any      `json:"client"`
+	Traffic *xray.ClientTraffic `json:"traffic,omitempty"`
+}
+
+// GetTrash returns the entries of the trash, the last deleted first.
+func (s *InboundService) GetTrash() ([]*model.TrashEntry, error) {
+	var entries []*model.TrashEntry
+	err := database.GetDB().Order("deleted_at DESC, id DESC").Find(&entries).Error
+	return entries, err
+}
+
+// TrashInbound deletes an inbound like DelInbound, once it is in the trash with
+// its clients and their traffic. actor is who deleted it.
+func (s *InboundService) TrashInbound(id int, actor string) (bool, error) {
+	db := database.GetDB()
+	inbound := &model.Inbound{}
+	if err := db.Preload("ClientStats").First(inbound, id).Error; err != nil {
+		return false, err
+	}
+	clients, err := s.GetClients(inbound)
+	if err != nil {
+		return false, err
+	}
+	data, err := json.Marshal(trashedInbound{Inbound: inbound, UserId: inbound.UserId})
+	if err != nil {
+		return false, err
+	}
+	entry := &model.TrashEntry{
+		Kind:      model.TrashInbound,
+		InboundId: id,
+		Remark:    inbound.Remark,
+		Port:      inbound.Port,
+		Clients:   len(clients),
+		Data:      string(data),
+		DeletedAt: time.Now().UnixMilli(),
+		DeletedBy: actor,
+	}
+	if err := db.Create(entry).Error; err != nil {
+		return false, err
+	}
+	needRestart, err := s.DelInbound(id)
+	if err != nil {
+		db.Delete(entry)
+	}
+	return needRestart, err
+}
+
+// TrashInboundClient deletes a client like DelInboundClient, once it is in the
+// trash with its traffic. actor is who deleted it.
+func (s *InboundService) TrashInboundClient(inboundId int, clientId string, actor string) (bool, error) {
+	db := database.GetDB()
+	inbound, err := s.GetInbound(inboundId)
+	if err != nil {
+		return false, err
+	}
+	var settings map[string]any
+	if err := json.Unmarshal([]byte(inbound.Settings), &settings); err != nil {
+		return false, err
+	}
+	clientKey := "id"
+	switch inbound.Protocol {
+	case model.Trojan:
+		clientKey = "password"
+	case model.Shadowsocks, model.WireGuard:
+		clientKey = "email"
+	}
+	var client map[string]any
+	items, _ := settings["clients"].([]any)
+	for _, item := range items {
+		if c, ok := item.(map[string]any); ok && c[clientKey] == clientId {
+			client = c
+			break
+		}
+	}
+	if client == nil {
+		return false, common.NewError("client not found")
+	}
+
+	email, _ := client["email"].(string)
+	entry, err := s.trashClient(db, inbound, client, email, actor)
+	if err != nil {
+		return false, err
+	}
+	needRestart, err := s.DelInboundClient(inboundId, clientId)
+	if err != nil {
+		db.Delete(entry)
+	}
+	return needRestart, err
+}
+
+// trashClient puts a client of inbound and its traffic in the trash in tx.
+func (s *InboundService) trashClient(tx *gorm.DB, inbound *model.Inbound, client map[string]any, email string, actor string) (*model.TrashEntry, error) {
+	trashed := trashedClient{Client: client}
+	if email != "" {
+		traffic := &xray.ClientTraffic{}
+		err := tx.Where("email = ?", email).First(traffic).Error
+		if err == nil {
+			trashed.Traffic = traffic
+		} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+	}
+	data, err := json.Marshal(trashed)
+	if err != nil {
+		return nil, err
+	}
+	entry := &model.TrashEntry{
+		Kind:      model.TrashClient,
+		InboundId: inbound.Id,
+		Remark:    inbound.Remark,
+		Port:      inbound.Port,
+		Email:     email,
+		Data:      string(data),
+		DeletedAt: time.Now().UnixMilli(),
+		DeletedBy: actor,
+	}
+	return entry, tx.Create(entry).Error
+}
+
+// RestoreTrash puts an entry of the trash back and removes it from the trash. It
+// fails if the port, the tag or an email of what it restores was taken since,
+// or if the inbound of a client is gone; the entry stays in the trash then.
+func (s *InboundService) RestoreTrash(id int) (bool, error) {
+	db := database.GetDB()
+	entry := &model.TrashEntry{}
+	if err := db.First(entry, id).Error; err != nil {
+		return false, err
+	}
+	var needRestart bool
+	var err error
+	switch entry.Kind {
+	case model.TrashInbound:
+		needRestart, err = s.restoreInbound(entry)
+	case model.TrashClient:
+		needRestart, err = s.restoreClient(entry)
+	default:
+		err = common.NewErrorf("unknown trash entry kind %q", entry.Kind)
+	}
+	if err != nil {
+		return needRestart, err
+	}
+	return needRestart, db.Delete(entry).Error
+}
+
+// restoreInbound adds a deleted inbound back with its clients and their traffic,
+// under its id unless another inbound has it now.
+func (s *InboundService) restoreInbound(entry *model.TrashEntry) (bool, error) {
+	var trashed trashedInbound
+	if err := json.Unmarshal([]byte(entry.Data), &trashed); err != nil {
+		return false, err
+	}
+	inbound := trashed.Inbound
+	if inbound == nil {
+		return false, common.NewError("the trash entry has no inbound")
+	}
+	inbound.UserId = trashed.UserId
+
+	taken, err := s.tagTaken(inbound.Tag)
+	if err != nil {
+		return false, err
+	}
+	if taken {
+		return false, common.NewErrorf("the tag %s is used by another inbound", inbound.Tag)
+	}
+	var count int64
+	if err := database.GetDB().Model(model.Inbound{}).Where("id = ?", inbound.Id).Count(&count).Error; err != nil {
+		return false, err
+	}
+	if count > 0 {
+		inbound.Id = 0
+	}
+	for i := range inbound.ClientStats {
+		inbound.ClientStats[i].Id = 0
+		inbound.ClientStats[i].InboundId = inbound.Id
+	}
+	// AddInbound checks the ports and the emails against the other inbounds
+	_, needRestart, err := s.AddInbound(inbound)
+	return needRestart, err
+}
+
+// restoreClient adds a deleted client back to its inbound, then its traffic.
+func (s *InboundService) restoreClient(entry *model.TrashEntry) (bool, error) {
+	var trashed trashedClient
+	if err := json.Unmarshal([]byte(entry.Data), &trashed); err != nil {
+		return false, err
+	}
+	if _, err := s.GetInbound(entry.InboundId); errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, common.NewErrorf("the inbound %d of the client is gone, restore it first", entry.InboundId)
+	} else if err != nil {
+		return false, err
+	}
+	settings, err := json.Marshal(map[string]any{"clients": []any{trashed.Client}})
+	if err != nil {
+		return false, err
+	}
+	// AddInboundClient checks the email against the other clients
+	needRestart, err := s.AddInboundClient(&model.Inbound{Id: entry.InboundId, Settings: string(settings)})
+	if err != nil || trashed.Traffic == nil {
+		return needRestart, err
+	}
+
+	traffic := trashed.Traffic
+	err = database.GetDB().Model(xray.ClientTraffic{}).Where("email = ?", traffic.Email).Updates(map[string]any{
+		"up":              traffic.Up,
+		"down":            traffic.Down,
+		"enable":          traffic.Enable,
+		"disabled_reason": traffic.DisabledReason,
+		"disabled_at":     traffic.DisabledAt,
+		"last_reset":      traffic.LastReset,
+		"last_seen":       traffic.LastSeen,
+	}).Error
+	if err != nil {
+		logger.Warning("Unable to restore the traffic of", traffic.Email, err)
+	}
+	// A depleted client was added to Xray with the others
+	return needRestart || !traffic.Enable, nil
+}
+
+// PurgeTrash deletes the entries of the trash older than days for good, and
+// returns how many there were. Nothing is purged for 0 days.
+func (s *InboundService) PurgeTrash(days int) (int64, error) {
+	if days <= 0 {
+		return 0, nil
+	}
+	cutoff := time.Now().AddDate(0, 0, -days).UnixMilli()
+	result := database.GetDB().Where("deleted_at < ?", cutoff).Delete(model.TrashEntry{})
+	return result.RowsAffected, result.Error
+}
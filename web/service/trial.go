@@ -0,0 +1,399 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"sync"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/web/network"
+
+	"github.com/goccy/go-json"
+)
+
+const (
+	// TrialTag tags the clients handed out by the trial endpoint
+	TrialTag = "trial"
+	// TrialStartPrefix starts the /start payloads of the bot that confirm the
+	// Telegram user of a trial
+	TrialStartPrefix = "trial_"
+	// trialTelegramTTL is how long a trial can be confirmed in the bot
+	trialTelegramTTL = 10 * time.Minute
+	// maxTrialTelegramTokens bounds the trials waiting for their confirmation,
+	// the oldest are dropped first
+	maxTrialTelegramTokens = 10000
+	// trialKeep is how long the trials are kept at least, for the daily caps
+	trialKeep = 48 * time.Hour
+)
+
+// The states a trial request ends in.
+const (
+	// TrialCreated is a new trial client
+	TrialCreated = "created"
+	// TrialExisting is the trial the IP or the Telegram user got within the
+	// cooldown, handed out again
+	TrialExisting = "existing"
+	// TrialCaptcha asks to pass the challenge first
+	TrialCaptcha = "captcha"
+	// TrialTelegram asks to confirm the Telegram user in the bot first
+	TrialTelegram = "telegram"
+	// TrialUsed is a trial got within the cooldown and deleted since
+	TrialUsed = "used"
+	// TrialLimited is a daily cap reached
+	TrialLimited = "limited"
+	// TrialUnavailable asks for a Telegram confirmation without a running bot
+	TrialUnavailable = "unavailable"
+)
+
+// TrialRequest is what a request for a trial carries: the answer to the
+// challenge it was given and, once confirmed in the bot, its Telegram token.
+type TrialRequest struct {
+	CaptchaToken  string `json:"captchaToken" form:"captchaToken"`
+	CaptchaAnswer string `json:"captchaAnswer" form:"captchaAnswer"`
+	TelegramToken string `json:"telegramToken" form:"telegramToken"`
+}
+
+// TrialOffer is what a trial gives and what it takes to get one.
+type TrialOffer struct {
+	TotalGB  int               `json:"totalGB"`
+	Hours    int               `json:"hours"`
+	Telegram bool              `json:"telegram"`
+	Captcha  *CaptchaChallenge `json:"captcha,omitempty"`
+}
+
+// TrialResult is how a request for a trial went. The client is set for the
+// created and the existing trials, the challenge or the Telegram link for the
+// requests that have to pass them first.
+type TrialResult struct {
+	Status        string            `json:"status"`
+	Email         string            `json:"email,omitempty"`
+	Total         int64             `json:"total,omitempty"`
+	ExpiryTime    int64             `json:"expiryTime,omitempty"`
+	Captcha       *CaptchaChallenge `json:"captcha,omitempty"`
+	TelegramLink  string            `json:"telegramLink,omitempty"`
+	TelegramToken string            `json:"telegramToken,omitempty"`
+	// RetryAfter is the seconds until a used or a limited trial can be asked
+	// for again
+	RetryAfter int64 `json:"retryAfter,omitempty"`
+	// SubId and Inbound are of the client, to generate its links from
+	SubId   string         `json:"-"`
+	Inbound *model.Inbound `json:"-"`
+}
+
+var (
+	// trialLock makes the checks of the caps and the creation of a trial one
+	// step, so that parallel requests don't get past a cap
+	trialLock sync.Mutex
+
+	// trialTokens are the trials waiting for their Telegram user, by token.
+	// Their value is the id of the user once confirmed in the bot.
+	trialTokensLock sync.Mutex
+	trialTokens     = newCaptchaStore(maxTrialTelegramTokens)
+)
+
+// TrialService hands out the trial clients of the public trial endpoint, on
+// the inbound and with the limits of the trial settings.
+type TrialService struct {
+	settingService SettingService
+	inboundService InboundService
+	captchaService CaptchaService
+	auditService   AuditService
+	xrayService    XrayService
+	tgbotService   Tgbot
+}
+
+// Offer returns what a trial gives, and the challenge a request from ip has to
+// pass.
+func (s *TrialService) Offer(ip string) (*TrialOffer, error) {
+	totalGB, err1 := s.settingService.GetTrialTotalGB()
+	duration, err2 := s.settingService.GetTrialDuration()
+	telegram, err3 := s.settingService.GetTrialTelegram()
+	if err := common.Combine(err1, err2, err3); err != nil {
+		return nil, err
+	}
+	offer := &TrialOffer{TotalGB: totalGB, Hours: int(duration.Hours()), Telegram: telegram}
+	if kind := s.captchaKind(); kind != CaptchaOff {
+		if offer.Captcha, err1 = s.captchaService.NewChallenge(kind, ip); err1 != nil {
+			return nil, err1
+		}
+	}
+	return offer, nil
+}
+
+// captchaKind returns the kind of challenge the trials have to pass.
+func (s *TrialService) captchaKind() string {
+	kind, err := s.settingService.GetTrialCaptcha()
+	if err != nil {
+		return CaptchaOff
+	}
+	return s.captchaService.Resolve(kind)
+}
+
+// Request hands out a trial to ip: the one the IP or the Telegram user got
+// within the cooldown if there is one, a new client otherwise unless a daily cap
+// is reached. The request has to pass the challenge first, then, if the
+// settings ask for it, have its Telegram user confirmed in the bot, whose id the
+// client gets.
+func (s *TrialService) Request(req *TrialRequest, ip string) (*TrialResult, error) {
+	inboundId, err := s.settingService.GetTrialInbound()
+	if err != nil {
+		return nil, err
+	}
+	if inboundId <= 0 {
+		return nil, common.NewError("trials are off")
+	}
+	telegram, err := s.settingService.GetTrialTelegram()
+	if err != nil {
+		return nil, err
+	}
+
+	var tgId int64
+	if telegram && req.TelegramToken != "" {
+		confirmed, found := trialTelegramUser(req.TelegramToken)
+		if found && confirmed == 0 {
+			return &TrialResult{
+				Status:        TrialTelegram,
+				TelegramLink:  s.tgbotService.StartLink(TrialStartPrefix + req.TelegramToken),
+				TelegramToken: req.TelegramToken,
+			}, nil
+		}
+		tgId = confirmed
+	}
+	// A confirmed Telegram user passed the challenge to get its token
+	if tgId == 0 {
+		if kind := s.captchaKind(); kind != CaptchaOff && !s.captchaService.Verify(kind, ip, req.CaptchaToken, req.CaptchaAnswer) {
+			challenge, err := s.captchaService.NewChallenge(kind, ip)
+			if err != nil {
+				return nil, err
+			}
+			return &TrialResult{Status: TrialCaptcha, Captcha: challenge}, nil
+		}
+		if telegram {
+			return s.newTelegramToken()
+		}
+	}
+
+	result, err := s.handOut(inboundId, ip, tgId)
+	if err == nil && tgId != 0 && (result.Status == TrialCreated || result.Status == TrialExisting) {
+		trialTokensLock.Lock()
+		trialTokens.remove(req.TelegramToken)
+		trialTokensLock.Unlock()
+	}
+	return result, err
+}
+
+// newTelegramToken issues the token of a trial waiting for its Telegram user,
+// with the link that confirms it in the bot.
+func (s *TrialService) newTelegramToken() (*TrialResult, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	token := hex.EncodeToString(buf)
+	link := s.tgbotService.StartLink(TrialStartPrefix + token)
+	if link == "" {
+		return &TrialResult{Status: TrialUnavailable}, nil
+	}
+	trialTokensLock.Lock()
+	trialTokens.put(&captchaEntry{key: token, expires: time.Now().Add(trialTelegramTTL)})
+	trialTokensLock.Unlock()
+	return &TrialResult{Status: TrialTelegram, TelegramLink: link, TelegramToken: token}, nil
+}
+
+// trialTelegramUser returns the id of the Telegram user that confirmed the
+// trial of token, 0 if none did yet, and whether there is such a trial.
+func trialTelegramUser(token string) (int64, bool) {
+	trialTokensLock.Lock()
+	defer trialTokensLock.Unlock()
+	entry := trialTokens.get(token)
+	if entry == nil || time.Now().After(entry.expires) {
+		return 0, false
+	}
+	tgId, _ := strconv.ParseInt(entry.value, 10, 64)
+	return tgId, true
+}
+
+// confirmTrial confirms tgId as the Telegram user of the trial of token. It
+// returns false if there is no such trial or another user confirmed it.
+func confirmTrial(token string, tgId int64) bool {
+	trialTokensLock.Lock()
+	defer trialTokensLock.Unlock()
+	entry := trialTokens.get(token)
+	if entry == nil || time.Now().After(entry.expires) {
+		return false
+	}
+	if entry.value != "" {
+		return entry.value == strconv.FormatInt(tgId, 10)
+	}
+	entry.value = strconv.FormatInt(tgId, 10)
+	return true
+}
+
+// handOut hands out a trial on inboundId to ip and tgId, which passed the
+// challenges.
+func (s *TrialService) handOut(inboundId int, ip string, tgId int64) (*TrialResult, error) {
+	v6Prefix, err := s.settingService.GetIpLimitIpv6Prefix()
+	if err != nil {
+		return nil, err
+	}
+	source, ok := network.IpSource(ip, v6Prefix)
+	if !ok {
+		source = ip
+	}
+	cooldown, err1 := s.settingService.GetTrialCooldown()
+	ipDaily, err2 := s.settingService.GetTrialIpDaily()
+	daily, err3 := s.settingService.GetTrialDaily()
+	loc, err4 := s.settingService.GetTimeLocation()
+	if err := common.Combine(err1, err2, err3, err4); err != nil {
+		return nil, err
+	}
+
+	trialLock.Lock()
+	defer trialLock.Unlock()
+	db := database.GetDB()
+	now := time.Now()
+	if cooldown > 0 {
+		var trials []model.Trial
+		query := db.Where("created_at >= ?", now.Add(-cooldown).UnixMilli())
+		if tgId != 0 {
+			query = query.Where("source = ? OR tg_id = ?", source, tgId)
+		} else {
+			query = query.Where("source = ?", source)
+		}
+		if err := query.Order("created_at DESC").Limit(1).Find(&trials).Error; err != nil {
+			return nil, err
+		}
+		if len(trials) > 0 {
+			return s.existing(&trials[0], cooldown, now)
+		}
+	}
+
+	dayStart := dayStart(now.In(loc))
+	var count, ipCount int64
+	if err := db.Model(model.Trial{}).Where("created_at >= ?", dayStart.UnixMilli()).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	err = db.Model(model.Trial{}).Where("created_at >= ? AND source = ?", dayStart.UnixMilli(), source).Count(&ipCount).Error
+	if err != nil {
+		return nil, err
+	}
+	if daily > 0 && count >= int64(daily) || ipDaily > 0 && ipCount >= int64(ipDaily) {
+		retryAfter := int64(dayStart.AddDate(0, 0, 1).Sub(now).Seconds()) + 1
+		return &TrialResult{Status: TrialLimited, RetryAfter: retryAfter}, nil
+	}
+
+	result, err := s.create(inboundId, ip, tgId, now)
+	if err != nil {
+		return nil, err
+	}
+	trial := &model.Trial{Email: result.Email, Ip: ip, Source: source, TgId: tgId, CreatedAt: now.UnixMilli()}
+	if err := db.Create(trial).Error; err != nil {
+		return nil, err
+	}
+	keep := max(cooldown, trialKeep)
+	if err := db.Where("created_at < ?", now.Add(-keep).UnixMilli()).Delete(model.Trial{}).Error; err != nil {
+		logger.Warning("Unable to prune the trials:", err)
+	}
+	return result, nil
+}
+
+// existing returns trial again, or that it is used if its client is gone.
+func (s *TrialService) existing(trial *model.Trial, cooldown time.Duration, now time.Time) (*TrialResult, error) {
+	traffic, inbound, err := s.inboundService.GetClientInboundByEmail(trial.Email)
+	if err != nil {
+		return nil, err
+	}
+	if inbound == nil {
+		retryAfter := int64(time.UnixMilli(trial.CreatedAt).Add(cooldown).Sub(now).Seconds()) + 1
+		return &TrialResult{Status: TrialUsed, RetryAfter: retryAfter}, nil
+	}
+	_, client, err := s.inboundService.GetClientByEmail(trial.Email)
+	if err != nil {
+		return nil, err
+	}
+	return &TrialResult{
+		Status:     TrialExisting,
+		Email:      traffic.Email,
+		Total:      traffic.Total,
+		ExpiryTime: traffic.ExpiryTime,
+		SubId:      client.SubID,
+		Inbound:    inbound,
+	}, nil
+}
+
+// create adds a trial client for ip and tgId to inboundId, with the quota and
+// the duration of the settings.
+func (s *TrialService) create(inboundId int, ip string, tgId int64, now time.Time) (*TrialResult, error) {
+	totalGB, err1 := s.settingService.GetTrialTotalGB()
+	duration, err2 := s.settingService.GetTrialDuration()
+	if err := common.Combine(err1, err2); err != nil {
+		return nil, err
+	}
+	inbound, err := s.inboundService.GetInbound(inboundId)
+	if err != nil {
+		return nil, err
+	}
+	batch := &BulkClients{
+		Count:      1,
+		TotalGB:    float64(totalGB),
+		ExpiryTime: now.Add(duration).UnixMilli(),
+		TgID:       tgId,
+		Tags:       []string{TrialTag},
+		SubIdMode:  BulkSubIdClient,
+	}
+	clients, err := batch.clients(inbound)
+	if err != nil {
+		return nil, err
+	}
+	client := &clients[0]
+	client.Email = "trial-" + randomLowerAndNum(10)
+	settings, err := json.Marshal(map[string][]any{"clients": {bulkClientJSON(inbound.Protocol, client)}})
+	if err != nil {
+		return nil, err
+	}
+
+	needRestart, err := s.inboundService.AddInboundClient(&model.Inbound{Id: inbound.Id, Settings: string(settings)})
+	entry := &model.AuditLog{
+		Actor:      "trial:" + ip,
+		Action:     "client.trial",
+		EntityType: "client",
+		EntityId:   client.Email,
+		Success:    err == nil,
+	}
+	if err == nil {
+		entry.Diff = AuditDiff(map[string]any{}, map[string]any{"inboundId": inbound.Id, "tgId": tgId})
+	}
+	s.auditService.Record(entry)
+	if err != nil {
+		return nil, err
+	}
+	if needRestart {
+		s.xrayService.SetToNeedRestart()
+	}
+	if inbound, err = s.inboundService.GetInbound(inbound.Id); err != nil {
+		return nil, err
+	}
+	return &TrialResult{
+		Status:     TrialCreated,
+		Email:      client.Email,
+		Total:      client.TotalGB,
+		ExpiryTime: client.ExpiryTime,
+		SubId:      client.SubID,
+		Inbound:    inbound,
+	}, nil
+}
+
+// confirmTrial confirms the Telegram user tgId of the trial of token, from the
+// /start link of the trial endpoint, and returns the answer of the bot.
+func (t *Tgbot) confirmTrial(tgId int64, token string) string {
+	if !confirmTrial(token, tgId) {
+		return t.I18nBot("tgbot.messages.trialExpired")
+	}
+	logger.Infof("Telegram user %d confirmed a trial", tgId)
+	return t.I18nBot("tgbot.messages.trialConfirmed")
+}
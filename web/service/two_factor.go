@@ -0,0 +1,407 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/util/crypto"
+
+	"github.com/xlzd/gotp"
+	"gorm.io/gorm"
+)
+
+const (
+	totpIssuer         = "3x-ui"
+	totpPeriod         = 30
+	totpSecretBytes    = 20
+	recoveryCodeCount  = 10
+	recoveryCodeBytes  = 5
+	recoveryCodeLength = recoveryCodeBytes * 8 / 5
+)
+
+// TwoFactorSetup is returned when a user starts enrolling an authenticator app.
+// URI is the otpauth:// link and also the payload to render as a QR code.
+type TwoFactorSetup struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+func (s *UserService) GetUserById(id int) (*model.User, error) {
+	db := database.GetDB()
+	user := &model.User{}
+	err := db.Model(model.User{}).Where("id = ?", id).First(user).Error
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// HasTwoFactor reports whether any user has TOTP enabled, so the login page knows
+// to ask for a code.
+func (s *UserService) HasTwoFactor() (bool, error) {
+	var count int64
+	err := database.GetDB().Model(model.User{}).Where("totp_enabled = ?", true).Count(&count).Error
+	return count > 0, err
+}
+
+// GetSessionUser returns the current record of a session's user, or nil for
+// sessions of deleted users and sessions issued before the user enabled
+// two-factor authentication.
+func (s *UserService) GetSessionUser(userId int, loginTime int64) *model.User {
+	user, err := s.GetUserById(userId)
+	if err != nil {
+		if err != gorm.ErrRecordNotFound {
+			logger.Warning("check session err:", err)
+		}
+		return nil
+	}
+	if user.TotpEnabled && loginTime < user.TotpEnabledAt {
+		return nil
+	}
+	return user
+}
+
+// SetupTwoFactor generates a new TOTP secret for the user. The secret is stored
+// but stays inactive until EnableTwoFactor confirms a code generated from it.
+func (s *UserService) SetupTwoFactor(userId int) (*TwoFactorSetup, error) {
+	user, err := s.GetUserById(userId)
+	if err != nil {
+		return nil, err
+	}
+	if user.TotpEnabled {
+		return nil, common.NewError("two-factor authentication is already enabled")
+	}
+
+	secret := gotp.RandomSecret(totpSecretBytes)
+	if secret == "" {
+		return nil, common.NewError("unable to generate two-factor secret")
+	}
+	encrypted, err := s.encryptSecret(secret)
+	if err != nil {
+		return nil, err
+	}
+	err = database.GetDB().Model(model.User{}).
+		Where("id = ?", userId).
+		Updates(map[string]any{"totp_secret": encrypted, "totp_last_step": 0}).
+		Error
+	if err != nil {
+		return nil, err
+	}
+	return &TwoFactorSetup{
+		Secret: secret,
+		URI:    gotp.NewDefaultTOTP(secret).ProvisioningUri(user.Username, totpIssuer),
+	}, nil
+}
+
+// EnableTwoFactor activates the pending secret after checking a code from it and
+// returns a fresh set of recovery codes. Sessions issued before this moment are
+// no longer accepted.
+func (s *UserService) EnableTwoFactor(userId int, code string) ([]string, error) {
+	user, err := s.GetUserById(userId)
+	if err != nil {
+		return nil, err
+	}
+	if user.TotpEnabled {
+		return nil, common.NewError("two-factor authentication is already enabled")
+	}
+	if user.TotpSecret == "" {
+		return nil, common.NewError("two-factor setup was not started")
+	}
+	ok, err := s.checkTOTP(user, code)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, common.NewError("invalid two-factor code")
+	}
+
+	codes, hashed, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	err = database.GetDB().Model(model.User{}).
+		Where("id = ?", userId).
+		Updates(map[string]any{
+			"totp_enabled":    true,
+			"totp_enabled_at": time.Now().UnixMilli(),
+			"recovery_codes":  hashed,
+		}).Error
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// DisableTwoFactor turns TOTP off for the user after checking a code or recovery code.
+func (s *UserService) DisableTwoFactor(userId int, code string) error {
+	user, err := s.GetUserById(userId)
+	if err != nil {
+		return err
+	}
+	if !user.TotpEnabled {
+		return nil
+	}
+	ok, err := s.CheckTwoFactor(user, code)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return common.NewError("invalid two-factor code")
+	}
+	return s.clearTwoFactor(database.GetDB().Model(model.User{}).Where("id = ?", userId)).Error
+}
+
+// RegenerateRecoveryCodes replaces the user's recovery codes after checking a code.
+func (s *UserService) RegenerateRecoveryCodes(userId int, code string) ([]string, error) {
+	user, err := s.GetUserById(userId)
+	if err != nil {
+		return nil, err
+	}
+	if !user.TotpEnabled {
+		return nil, common.NewError("two-factor authentication is not enabled")
+	}
+	ok, err := s.CheckTwoFactor(user, code)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, common.NewError("invalid two-factor code")
+	}
+	codes, hashed, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	err = database.GetDB().Model(model.User{}).
+		Where("id = ?", userId).
+		Update("recovery_codes", hashed).
+		Error
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// ResetTwoFactor disables TOTP and removes the passkeys of the named user, or of
+// every user if username is empty. It is meant for the CLI when an authenticator
+// has been lost.
+func (s *UserService) ResetTwoFactor(username string) (int64, error) {
+	db := database.GetDB().Model(model.User{})
+	if username != "" {
+		db = db.Where("username = ?", username)
+	} else {
+		db = db.Where("1 = 1")
+	}
+	result := s.clearTwoFactor(db)
+	if result.Error != nil {
+		return 0, result.Error
+	}
+
+	// Passkeys can be a required second factor as well
+	passkeys := database.GetDB().Where("1 = 1")
+	if username != "" {
+		passkeys = database.GetDB().Where("user_id IN (?)", database.GetDB().Model(model.User{}).Select("id").Where("username = ?", username))
+	}
+	if err := passkeys.Delete(model.WebAuthnCredential{}).Error; err != nil {
+		return result.RowsAffected, err
+	}
+
+	// The legacy panel-wide token must go as well, or it would be migrated back
+	if username == "" {
+		if err := s.settingService.SetTwoFactorEnable(false); err != nil {
+			return result.RowsAffected, err
+		}
+		if err := s.settingService.SetTwoFactorToken(""); err != nil {
+			return result.RowsAffected, err
+		}
+	}
+	return result.RowsAffected, nil
+}
+
+// MigrateTwoFactor moves the panel-wide two-factor token of older versions to the
+// first user, so existing authenticator apps keep working.
+func (s *UserService) MigrateTwoFactor() error {
+	enabled, err := s.settingService.GetTwoFactorEnable()
+	if err != nil || !enabled {
+		return err
+	}
+	token, err := s.settingService.GetTwoFactorToken()
+	if err != nil {
+		return err
+	}
+	user, err := s.GetFirstUser()
+	if err != nil {
+		return err
+	}
+	if !user.TotpEnabled && token != "" {
+		encrypted, err := s.encryptSecret(token)
+		if err != nil {
+			return err
+		}
+		err = database.GetDB().Model(model.User{}).
+			Where("id = ?", user.Id).
+			Updates(map[string]any{
+				"totp_secret":     encrypted,
+				"totp_enabled":    true,
+				"totp_enabled_at": time.Now().UnixMilli(),
+			}).Error
+		if err != nil {
+			return err
+		}
+		logger.Infof("Two-factor authentication moved to user %s", user.Username)
+	}
+	if err := s.settingService.SetTwoFactorEnable(false); err != nil {
+		return err
+	}
+	return s.settingService.SetTwoFactorToken("")
+}
+
+// CheckTwoFactor accepts either a TOTP code or one of the user's recovery codes.
+// Both are single use: a TOTP step can't be replayed and a recovery code is consumed.
+func (s *UserService) CheckTwoFactor(user *model.User, code string) (bool, error) {
+	code = strings.TrimSpace(code)
+	if code == "" {
+		return false, nil
+	}
+	if len(code) == 6 && strings.Trim(code, "0123456789") == "" {
+		return s.checkTOTP(user, code)
+	}
+	return s.useRecoveryCode(user, code)
+}
+
+// checkTOTP verifies a code within one step of the current time and records the
+// matched step, so a code that has been used once is rejected afterwards.
+func (s *UserService) checkTOTP(user *model.User, code string) (bool, error) {
+	secret, err := s.decryptSecret(user.TotpSecret)
+	if err != nil {
+		return false, err
+	}
+	step := matchTOTP(secret, code, user.TotpLastStep)
+	if step == 0 {
+		return false, nil
+	}
+	// The conditional update makes concurrent logins with the same code race for it
+	result := database.GetDB().Model(model.User{}).
+		Where("id = ? AND totp_last_step < ?", user.Id, step).
+		Update("totp_last_step", step)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return false, nil
+	}
+	user.TotpLastStep = step
+	return true, nil
+}
+
+// matchTOTP returns the step after lastStep, within one step of the current
+// time, that code is the code of, or 0 if there is none.
+func matchTOTP(secret string, code string, lastStep int64) int64 {
+	totp := gotp.NewDefaultTOTP(secret)
+	current := time.Now().Unix() / totpPeriod
+	for _, step := range []int64{current - 1, current, current + 1} {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totp.At(step*totpPeriod)), []byte(code)) == 1 {
+			return step
+		}
+	}
+	return 0
+}
+
+func (s *UserService) useRecoveryCode(user *model.User, code string) (bool, error) {
+	if user.RecoveryCodes == "" {
+		return false, nil
+	}
+	var hashes []string
+	if err := json.Unmarshal([]byte(user.RecoveryCodes), &hashes); err != nil {
+		return false, err
+	}
+	hash := hashRecoveryCode(code)
+	for i, h := range hashes {
+		if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) != 1 {
+			continue
+		}
+		remaining, err := json.Marshal(append(hashes[:i:i], hashes[i+1:]...))
+		if err != nil {
+			return false, err
+		}
+		result := database.GetDB().Model(model.User{}).
+			Where("id = ? AND recovery_codes = ?", user.Id, user.RecoveryCodes).
+			Update("recovery_codes", string(remaining))
+		if result.Error != nil {
+			return false, result.Error
+		}
+		if result.RowsAffected == 0 {
+			return false, nil
+		}
+		user.RecoveryCodes = string(remaining)
+		logger.Infof("%s used a recovery code, %d left", user.Username, len(hashes)-1)
+		return true, nil
+	}
+	return false, nil
+}
+
+func (s *UserService) clearTwoFactor(db *gorm.DB) *gorm.DB {
+	return db.Updates(map[string]any{
+		"totp_secret":     "",
+		"totp_enabled":    false,
+		"totp_enabled_at": 0,
+		"totp_last_step":  0,
+		"recovery_codes":  "",
+	})
+}
+
+func (s *UserService) encryptSecret(secret string) (string, error) {
+	key, err := s.settingService.GetSecret()
+	if err != nil {
+		return "", err
+	}
+	return crypto.Encrypt(key, secret)
+}
+
+func (s *UserService) decryptSecret(encrypted string) (string, error) {
+	key, err := s.settingService.GetSecret()
+	if err != nil {
+		return "", err
+	}
+	return crypto.Decrypt(key, encrypted)
+}
+
+// newRecoveryCodes returns the codes to show once and their hashes to store.
+func newRecoveryCodes() ([]string, string, error) {
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		buf := make([]byte, recoveryCodeBytes*2)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, "", err
+		}
+		raw := strings.ToLower(encoding.EncodeToString(buf))
+		codes[i] = raw[:recoveryCodeLength] + "-" + raw[recoveryCodeLength:]
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	hashed, err := json.Marshal(hashes)
+	if err != nil {
+		return nil, "", err
+	}
+	return codes, string(hashed), nil
+}
+
+// hashRecoveryCode normalizes case and separators so codes can be typed loosely.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
@@ -2,16 +2,55 @@ package service
 
 import (
 	"errors"
+	"strings"
+	"time"
 
 	"x-ui/database"
 	"x-ui/database/model"
 	"x-ui/logger"
+	"x-ui/util/common"
 	"x-ui/util/crypto"
 
-	"github.com/xlzd/gotp"
 	"gorm.io/gorm"
 )
 
+// Reasons of a failed login, as written to the auth log
+const (
+	LoginReasonUnknownUser = "unknown_user"
+	LoginReasonBadPassword = "bad_password"
+	LoginReasonBad2FA      = "bad_2fa"
+	LoginReasonError       = "error"
+	LoginReasonRateLimited = "rate_limited"
+	LoginReasonLockedOut   = "locked_out"
+	LoginReasonBadPasskey  = "bad_passkey"
+	LoginReasonCaptcha     = "bad_captcha"
+	// A refresh token of a remember-me login was presented after it was rotated
+	LoginReasonRefreshReused = "refresh_reused"
+	// The password is right, but still stored with an outdated hash after the
+	// reset deadline
+	LoginReasonPasswordReset = "password_reset"
+	// The user has the most sessions allowed and new logins are rejected
+	LoginReasonSessionLimit = "session_limit"
+)
+
+// roleRanks orders the roles, a role may do everything a lower ranked one may
+var roleRanks = map[string]int{
+	model.RoleViewer:   1,
+	model.RoleOperator: 2,
+	model.RoleAdmin:    3,
+}
+
+// HasRole reports whether a user with role may do what required needs.
+func HasRole(role string, required string) bool {
+	rank, ok := roleRanks[role]
+	return ok && rank >= roleRanks[required]
+}
+
+func IsValidRole(role string) bool {
+	_, ok := roleRanks[role]
+	return ok
+}
+
 type UserService struct {
 	settingService SettingService
 }
@@ -29,7 +68,9 @@ func (s *UserService) GetFirstUser() (*model.User, error) {
 	return user, nil
 }
 
-func (s *UserService) CheckUser(username string, password string, twoFactorCode string) *model.User {
+// CheckUser returns the user if the credentials are valid, otherwise nil and one of
+// the LoginReason* constants.
+func (s *UserService) CheckUser(username string, password string, twoFactorCode string) (*model.User, string) {
 	db := database.GetDB()
 
 	user := &model.User{}
@@ -39,59 +80,138 @@ func (s *UserService) CheckUser(username string, password string, twoFactorCode
 		First(user).
 		Error
 	if err == gorm.ErrRecordNotFound {
-		return nil
+		return nil, LoginReasonUnknownUser
 	} else if err != nil {
 		logger.Warning("check user err:", err)
-		return nil
+		return nil, LoginReasonError
 	}
 
 	if !crypto.CheckPasswordHash(user.Password, password) {
-		return nil
-	}
-
-	twoFactorEnable, err := s.settingService.GetTwoFactorEnable()
-	if err != nil {
-		logger.Warning("check two factor err:", err)
-		return nil
+		return nil, LoginReasonBadPassword
 	}
 
-	if twoFactorEnable {
-		twoFactorToken, err := s.settingService.GetTwoFactorToken()
-
+	if user.TotpEnabled {
+		ok, err := s.CheckTwoFactor(user, twoFactorCode)
 		if err != nil {
-			logger.Warning("check two factor token err:", err)
-			return nil
+			logger.Warning("check two factor err:", err)
+			return nil, LoginReasonError
+		}
+		if !ok {
+			return nil, LoginReasonBad2FA
 		}
+	}
 
-		if gotp.NewDefaultTOTP(twoFactorToken).Now() != twoFactorCode {
-			return nil
+	if !crypto.IsArgon2idHash(user.Password) && s.passwordResetDue() {
+		return nil, LoginReasonPasswordReset
+	}
+	if weak := IsWeakPassword(user.Username, password); weak != user.WeakPassword {
+		if err := db.Model(user).Update("weak_password", weak).Error; err != nil {
+			logger.Warning("flag weak password err:", err)
+		}
+	}
+	// This is the only time the password is known, upgrade its hash to argon2id or
+	// to raised parameters
+	if crypto.NeedsRehash(user.Password, s.settingService.GetArgon2Params()) {
+		if err := s.rehashPassword(user, password); err != nil {
+			logger.Warning("rehash password err:", err)
 		}
 	}
 
-	return user
+	return user, ""
 }
 
-func (s *UserService) UpdateUser(id int, username string, password string) error {
-	db := database.GetDB()
-	hashedPassword, err := crypto.HashPasswordAsBcrypt(password)
+// hashPassword hashes with the argon2id parameters from the settings.
+func (s *UserService) hashPassword(password string) (string, error) {
+	return crypto.HashPasswordWithParams(password, s.settingService.GetArgon2Params())
+}
 
+func (s *UserService) rehashPassword(user *model.User, password string) error {
+	hashedPassword, err := s.hashPassword(password)
+	if err != nil {
+		return err
+	}
+	err = database.GetDB().Model(model.User{}).
+		Where("id = ? AND password = ?", user.Id, user.Password).
+		Update("password", hashedPassword).
+		Error
 	if err != nil {
 		return err
 	}
+	user.Password = hashedPassword
+	return nil
+}
+
+// passwordResetDue reports whether the deadline for upgrading outdated password
+// hashes has passed.
+func (s *UserService) passwordResetDue() bool {
+	deadline, err := s.settingService.GetPasswordResetDeadline()
+	if err != nil {
+		logger.Warning("get password reset deadline err:", err)
+		return false
+	}
+	return deadline > 0 && time.Now().UnixMilli() >= deadline
+}
 
-	twoFactorEnable, err := s.settingService.GetTwoFactorEnable()
+// GetStaleUsers returns the users whose password is still stored with a hash from
+// before argon2id; they never logged in since the upgrade.
+func (s *UserService) GetStaleUsers() ([]*model.User, error) {
+	users, err := s.GetUsers()
+	if err != nil {
+		return nil, err
+	}
+	stale := make([]*model.User, 0)
+	for _, user := range users {
+		if !crypto.IsArgon2idHash(user.Password) {
+			stale = append(stale, user)
+		}
+	}
+	return stale, nil
+}
+
+// ResetUserPassword sets the password of another user, and logs out all of their
+// sessions.
+func (s *UserService) ResetUserPassword(id int, password string) error {
+	if password == "" {
+		return common.NewError("password can not be empty")
+	}
+	hashedPassword, err := s.hashPassword(password)
 	if err != nil {
 		return err
 	}
+	return database.Transaction(func(tx *gorm.DB) error {
+		user := &model.User{}
+		if err := tx.Model(model.User{}).Where("id = ?", id).First(user).Error; err != nil {
+			if database.IsNotFound(err) {
+				return common.NewError("user not found")
+			}
+			return err
+		}
+		result := tx.Model(model.User{}).Where("id = ?", id).
+			Updates(map[string]any{"password": hashedPassword, "weak_password": IsWeakPassword(user.Username, password)})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return common.NewError("user not found")
+		}
+		return tx.Where("user_id = ?", id).Delete(model.LoginSession{}).Error
+	})
+}
+
+func (s *UserService) UpdateUser(id int, username string, password string) error {
+	db := database.GetDB()
+	if err := s.checkUsernameFree(username, id); err != nil {
+		return err
+	}
+	hashedPassword, err := s.hashPassword(password)
 
-	if twoFactorEnable {
-		s.settingService.SetTwoFactorEnable(false)
-		s.settingService.SetTwoFactorToken("")
+	if err != nil {
+		return err
 	}
 
 	return db.Model(model.User{}).
 		Where("id = ?", id).
-		Updates(map[string]any{"username": username, "password": hashedPassword}).
+		Updates(map[string]any{"username": username, "password": hashedPassword, "weak_password": IsWeakPassword(username, password)}).
 		Error
 }
 
@@ -101,7 +221,7 @@ func (s *UserService) UpdateFirstUser(username string, password string) error {
 	} else if password == "" {
 		return errors.New("password can not be empty")
 	}
-	hashedPassword, er := crypto.HashPasswordAsBcrypt(password)
+	hashedPassword, er := s.hashPassword(password)
 
 	if er != nil {
 		return er
@@ -113,11 +233,156 @@ func (s *UserService) UpdateFirstUser(username string, password string) error {
 	if database.IsNotFound(err) {
 		user.Username = username
 		user.Password = hashedPassword
+		user.WeakPassword = IsWeakPassword(username, password)
 		return db.Model(model.User{}).Create(user).Error
 	} else if err != nil {
 		return err
 	}
 	user.Username = username
 	user.Password = hashedPassword
-	return db.Save(user).Error
+	user.WeakPassword = IsWeakPassword(username, password)
+	if err := db.Save(user).Error; err != nil {
+		return err
+	}
+	// The credentials were reset from the command line, log out every session
+	return db.Where("user_id = ?", user.Id).Delete(model.LoginSession{}).Error
+}
+
+func (s *UserService) GetUsers() ([]*model.User, error) {
+	users := make([]*model.User, 0)
+	err := database.GetDB().Model(model.User{}).Order("id").Find(&users).Error
+	return users, err
+}
+
+func (s *UserService) AddUser(username string, password string, role string, tgChatId int64) (*model.User, error) {
+	username = strings.TrimSpace(username)
+	if username == "" {
+		return nil, common.NewError("username can not be empty")
+	}
+	if password == "" {
+		return nil, common.NewError("password can not be empty")
+	}
+	if !IsValidRole(role) {
+		return nil, common.NewError("unknown role:", role)
+	}
+	if err := s.checkUsernameFree(username, 0); err != nil {
+		return nil, err
+	}
+	hashedPassword, err := s.hashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+	user := &model.User{
+		Username:     username,
+		Password:     hashedPassword,
+		Role:         role,
+		TgChatId:     tgChatId,
+		WeakPassword: IsWeakPassword(username, password),
+	}
+	if err := database.GetDB().Create(user).Error; err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// UpdateUserRole changes the role and Telegram chat of a user. The last admin can
+// not be demoted, otherwise nobody could manage the panel anymore.
+func (s *UserService) UpdateUserRole(id int, role string, tgChatId int64) error {
+	if !IsValidRole(role) {
+		return common.NewError("unknown role:", role)
+	}
+	return database.Transaction(func(tx *gorm.DB) error {
+		user := &model.User{}
+		if err := tx.Model(model.User{}).Where("id = ?", id).First(user).Error; err != nil {
+			return err
+		}
+		if user.Role == model.RoleAdmin && role != model.RoleAdmin {
+			if err := checkOtherAdmin(tx, id); err != nil {
+				return err
+			}
+		}
+		return tx.Model(model.User{}).
+			Where("id = ?", id).
+			Updates(map[string]any{"role": role, "tg_chat_id": tgChatId}).
+			Error
+	})
+}
+
+// SetSessionLimits sets the session limits of a user that override those of
+// the settings, or removes them if nil. The timeouts apply to its sessions
+// right away, a lower most sessions from its next login.
+func (s *UserService) SetSessionLimits(id int, limits *model.SessionLimits) error {
+	if limits != nil {
+		for _, limit := range []*int{limits.IdleMinutes, limits.LifetimeMinutes, limits.MaxSessions} {
+			if limit != nil && *limit < 0 {
+				return common.NewError("session limits must not be negative")
+			}
+		}
+		if limits.IdleMinutes == nil && limits.LifetimeMinutes == nil && limits.MaxSessions == nil {
+			limits = nil
+		}
+	}
+	user := &model.User{Id: id, SessionLimits: limits}
+	result := database.GetDB().Model(user).Select("session_limits").Updates(user)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// DelUser removes a user together with its passkeys, API tokens and sessions. The inbounds
+// the user created stay, they belong to the panel.
+func (s *UserService) DelUser(id int) error {
+	return database.Transaction(func(tx *gorm.DB) error {
+		user := &model.User{}
+		if err := tx.Model(model.User{}).Where("id = ?", id).First(user).Error; err != nil {
+			return err
+		}
+		if user.Role == model.RoleAdmin {
+			if err := checkOtherAdmin(tx, id); err != nil {
+				return err
+			}
+		}
+		if err := tx.Where("user_id = ?", id).Delete(model.WebAuthnCredential{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", id).Delete(model.ApiToken{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", id).Delete(model.LoginSession{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("id = ?", id).Delete(model.User{}).Error
+	})
+}
+
+func (s *UserService) checkUsernameFree(username string, exceptId int) error {
+	var count int64
+	err := database.GetDB().Model(model.User{}).
+		Where("username = ? AND id != ?", username, exceptId).
+		Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return common.NewError("username is already taken:", username)
+	}
+	return nil
+}
+
+func checkOtherAdmin(tx *gorm.DB, id int) error {
+	var count int64
+	err := tx.Model(model.User{}).
+		Where("role = ? AND id != ?", model.RoleAdmin, id).
+		Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return common.NewError("the last admin can not be removed or demoted")
+	}
+	return nil
 }
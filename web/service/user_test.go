@@ -0,0 +1,99 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/util/crypto"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// userTestDB opens an empty database with cheap hash parameters and a user of
+// password "secret" hashed with bcrypt, as older versions stored it.
+func userTestDB(t *testing.T) (*UserService, *model.User) {
+	t.Helper()
+	db := newTestDB(t)
+	s := &UserService{}
+	s.settingService.setInt("passwordHashMemory", 1024)
+	s.settingService.setInt("passwordHashIterations", 1)
+	old, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &model.User{Username: "old", Password: string(old), Role: model.RoleAdmin}
+	if err := db.Create(user).Error; err != nil {
+		t.Fatal(err)
+	}
+	return s, user
+}
+
+func storedPassword(t *testing.T, id int) string {
+	t.Helper()
+	var user model.User
+	if err := database.GetDB().First(&user, id).Error; err != nil {
+		t.Fatal(err)
+	}
+	return user.Password
+}
+
+func TestCheckUserUpgradesOldHash(t *testing.T) {
+	s, user := userTestDB(t)
+
+	if got, reason := s.CheckUser("old", "wrong", ""); got != nil || reason != LoginReasonBadPassword {
+		t.Fatalf("a wrong password logged in: %v %q", got, reason)
+	}
+	if storedPassword(t, user.Id) != user.Password {
+		t.Fatal("a failed login changed the hash")
+	}
+
+	if got, reason := s.CheckUser("old", "secret", ""); got == nil {
+		t.Fatalf("the bcrypt password doesn't log in: %q", reason)
+	}
+	upgraded := storedPassword(t, user.Id)
+	if !crypto.IsArgon2idHash(upgraded) || !crypto.CheckPasswordHash(upgraded, "secret") {
+		t.Fatalf("the hash was not upgraded: %s", upgraded)
+	}
+
+	// Raised parameters upgrade the hash again on the next login
+	s.settingService.setInt("passwordHashIterations", 2)
+	if got, _ := s.CheckUser("old", "secret", ""); got == nil {
+		t.Fatal("the upgraded password doesn't log in")
+	}
+	raised := storedPassword(t, user.Id)
+	if raised == upgraded || crypto.NeedsRehash(raised, s.settingService.GetArgon2Params()) {
+		t.Errorf("the hash was not upgraded to the raised parameters: %s", raised)
+	}
+}
+
+func TestCheckUserPasswordResetDeadline(t *testing.T) {
+	s, user := userTestDB(t)
+	s.settingService.SetPasswordResetDeadline(time.Now().Add(-time.Hour).UnixMilli())
+
+	if got, reason := s.CheckUser("old", "secret", ""); got != nil || reason != LoginReasonPasswordReset {
+		t.Fatalf("a stale hash past the deadline logged in: %v %q", got, reason)
+	}
+	if storedPassword(t, user.Id) != user.Password {
+		t.Error("a refused login upgraded the hash")
+	}
+	stale, err := s.GetStaleUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, u := range stale {
+		found = found || u.Id == user.Id
+	}
+	if !found {
+		t.Error("the user is not listed as stale")
+	}
+
+	if err := s.ResetUserPassword(user.Id, "another secret"); err != nil {
+		t.Fatal(err)
+	}
+	if got, reason := s.CheckUser("old", "another secret", ""); got == nil {
+		t.Errorf("the reset password doesn't log in: %q", reason)
+	}
+}
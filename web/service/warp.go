@@ -2,11 +2,16 @@ package service
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
+	"regexp"
+	"strings"
 	"time"
+	"x-ui/database"
+	"x-ui/database/model"
 	"x-ui/logger"
 	"x-ui/util/common"
 )
@@ -168,3 +173,457 @@ func (s *WarpService) SetWarpLicense(license string) (string, error) {
 
 	return string(newWarpData), nil
 }
+
+const (
+	// warpTag is the tag of the outbound to WARP
+	warpTag = "warp"
+	// warpRuleRemark marks the routing rule the panel sends to WARP with
+	warpRuleRemark = "WARP"
+	warpAPITimeout = 15 * time.Second
+	// warpHandshakeTimeout bounds how long the endpoint of WARP may take to answer
+	warpHandshakeTimeout = 5 * time.Second
+)
+
+// warpLicensePattern matches the keys of WARP+ licenses
+var warpLicensePattern = regexp.MustCompile(`^[0-9A-Za-z]{8}-[0-9A-Za-z]{8}-[0-9A-Za-z]{8}$`)
+
+// WarpForm is what WARP is enabled with: a WARP+ license for the account, and
+// the domains to route through WARP.
+type WarpForm struct {
+	License string   `json:"license" form:"license"`
+	Domains []string `json:"domains" form:"domains"`
+}
+
+// WarpStatus is the account of WARP of the panel and the outbound to it.
+type WarpStatus struct {
+	Registered  bool   `json:"registered"`
+	Enabled     bool   `json:"enabled"`
+	DeviceId    string `json:"deviceId,omitempty"`
+	AccountType string `json:"accountType,omitempty"`
+	WarpPlus    bool   `json:"warpPlus"`
+	License     string `json:"license,omitempty"`
+	AddressV4   string `json:"addressV4,omitempty"`
+	AddressV6   string `json:"addressV6,omitempty"`
+	Endpoint    string `json:"endpoint,omitempty"`
+	Handshake   bool   `json:"handshake"`
+	// HandshakeError tells why the endpoint didn't answer a handshake
+	HandshakeError string `json:"handshakeError,omitempty"`
+	// Domains are those routed through WARP by the rule of the panel
+	Domains []string `json:"domains,omitempty"`
+}
+
+// warpDevice is the device of the panel, as the API of WARP returns it.
+type warpDevice struct {
+	Id      string `json:"id"`
+	Token   string `json:"token"`
+	Account struct {
+		AccountType string `json:"account_type"`
+		WarpPlus    bool   `json:"warp_plus"`
+		License     string `json:"license"`
+	} `json:"account"`
+	Config struct {
+		ClientId string `json:"client_id"`
+		Peers    []struct {
+			PublicKey string `json:"public_key"`
+			Endpoint  struct {
+				V4   string `json:"v4"`
+				V6   string `json:"v6"`
+				Host string `json:"host"`
+			} `json:"endpoint"`
+		} `json:"peers"`
+		Interface struct {
+			Addresses struct {
+				V4 string `json:"v4"`
+				V6 string `json:"v6"`
+			} `json:"addresses"`
+		} `json:"interface"`
+	} `json:"config"`
+}
+
+// warpAPIError is an error the API of WARP returned.
+type warpAPIError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// warpRequest calls the API of WARP, decoding its answer into result. Errors of
+// the API are returned as they are, for the caller to explain.
+func warpRequest(method string, path string, token string, body any, result any) (*warpAPIError, error) {
+	var reader *bytes.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+	req, err := http.NewRequest(method, "https://api.cloudflareclient.com/v0a2158/reg"+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("CF-Client-Version", "a-7.21-0721")
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	client := &http.Client{Timeout: warpAPITimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, common.NewError("the API of WARP is unreachable:", err)
+	}
+	defer resp.Body.Close()
+	buffer := &bytes.Buffer{}
+	if _, err := buffer.ReadFrom(resp.Body); err != nil {
+		return nil, err
+	}
+
+	var failure struct {
+		Success *bool          `json:"success"`
+		Errors  []warpAPIError `json:"errors"`
+	}
+	json.Unmarshal(buffer.Bytes(), &failure)
+	if resp.StatusCode >= 400 || (failure.Success != nil && !*failure.Success) {
+		if len(failure.Errors) > 0 {
+			return &failure.Errors[0], nil
+		}
+		return &warpAPIError{Code: resp.StatusCode, Message: resp.Status}, nil
+	}
+	if result != nil {
+		if err := json.Unmarshal(buffer.Bytes(), result); err != nil {
+			return nil, common.NewError("the API of WARP returned an unexpected answer:", err)
+		}
+	}
+	return nil, nil
+}
+
+// licenseError explains why WARP didn't take a WARP+ license.
+func licenseError(apiError *warpAPIError) error {
+	message := strings.ToLower(apiError.Message)
+	switch {
+	case strings.Contains(message, "too many connected devices"):
+		return common.NewError("the WARP+ license is bound to too many devices: remove one in the 1.1.1.1 app, or use another license")
+	case strings.Contains(message, "invalid"):
+		return common.NewError("WARP doesn't know the WARP+ license: check the key in the 1.1.1.1 app, under Account")
+	}
+	return common.NewErrorf("WARP refused the WARP+ license: %s (code %d)", apiError.Message, apiError.Code)
+}
+
+func (s *WarpService) getWarpAccount() (map[string]string, error) {
+	warp, err := s.SettingService.GetWarp()
+	if err != nil || warp == "" {
+		return nil, err
+	}
+	var account map[string]string
+	if err := json.Unmarshal([]byte(warp), &account); err != nil {
+		return nil, common.NewError("the stored WARP account is not valid:", err)
+	}
+	return account, nil
+}
+
+func (s *WarpService) saveWarpAccount(account map[string]string) error {
+	data, err := json.MarshalIndent(account, "", "  ")
+	if err != nil {
+		return err
+	}
+	return s.SettingService.SetWarp(string(data))
+}
+
+// registerWarp registers a new device with WARP, stored in the same way as the
+// accounts registered from the page of Xray.
+func (s *WarpService) registerWarp() (map[string]string, error) {
+	privateKey, publicKey, err := newWireguardKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	hostName, _ := os.Hostname()
+	device := &warpDevice{}
+	apiError, err := warpRequest("POST", "", "", map[string]any{
+		"key":   publicKey,
+		"tos":   time.Now().UTC().Format("2006-01-02T15:04:05.000Z"),
+		"type":  "PC",
+		"model": "x-ui",
+		"name":  hostName,
+	}, device)
+	if err != nil {
+		return nil, err
+	}
+	if apiError != nil {
+		return nil, common.NewErrorf("WARP refused to register the panel: %s (code %d)", apiError.Message, apiError.Code)
+	}
+	account := map[string]string{
+		"access_token": device.Token,
+		"device_id":    device.Id,
+		"license_key":  device.Account.License,
+		"private_key":  privateKey,
+	}
+	if err := s.saveWarpAccount(account); err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+func (s *WarpService) getWarpDevice(account map[string]string) (*warpDevice, error) {
+	device := &warpDevice{}
+	apiError, err := warpRequest("GET", "/"+account["device_id"], account["access_token"], nil, device)
+	if err != nil {
+		return nil, err
+	}
+	if apiError != nil {
+		return nil, common.NewErrorf("WARP doesn't know the device of the panel, delete the account and enable WARP again: %s (code %d)", apiError.Message, apiError.Code)
+	}
+	if len(device.Config.Peers) == 0 {
+		return nil, common.NewError("WARP returned no peer for the device")
+	}
+	return device, nil
+}
+
+// warpReserved decodes the client id WARP tells devices apart by, which goes in
+// the reserved bytes of WireGuard.
+func warpReserved(clientId string) []int {
+	decoded, _ := base64.StdEncoding.DecodeString(clientId)
+	reserved := make([]int, 0, len(decoded))
+	for _, b := range decoded {
+		reserved = append(reserved, int(b))
+	}
+	return reserved
+}
+
+// saveWarpOutbound adds the outbound to WARP to the panel, or updates it.
+func (s *WarpService) saveWarpOutbound(account map[string]string, device *warpDevice) error {
+	var addresses []string
+	if v4 := device.Config.Interface.Addresses.V4; v4 != "" {
+		addresses = append(addresses, v4+"/32")
+	}
+	if v6 := device.Config.Interface.Addresses.V6; v6 != "" {
+		addresses = append(addresses, v6+"/128")
+	}
+	peer := device.Config.Peers[0]
+	settings, err := json.MarshalIndent(map[string]any{
+		"mtu":            1420,
+		"secretKey":      account["private_key"],
+		"address":        addresses,
+		"reserved":       warpReserved(device.Config.ClientId),
+		"domainStrategy": "ForceIP",
+		"peers": []map[string]any{{
+			"publicKey": peer.PublicKey,
+			"endpoint":  peer.Endpoint.Host,
+		}},
+		"noKernelTun": false,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	var outboundService OutboundService
+	outbound := &model.Outbound{}
+	err = database.GetDB().Where("tag = ?", warpTag).First(outbound).Error
+	if database.IsNotFound(err) {
+		_, err = outboundService.AddOutbound(&model.Outbound{Tag: warpTag, Protocol: "wireguard", Settings: string(settings)})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	outbound.Protocol = "wireguard"
+	outbound.Settings = string(settings)
+	_, err = outboundService.UpdateOutbound(outbound)
+	return err
+}
+
+// getWarpRule returns the routing rule of the panel to WARP, nil if there is none.
+func getWarpRule() (*model.RoutingRule, error) {
+	rule := &model.RoutingRule{}
+	err := database.GetDB().Where("outbound_tag = ? AND remark = ?", warpTag, warpRuleRemark).First(rule).Error
+	if database.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return rule, nil
+}
+
+// EnableWarp registers the panel with WARP if it isn't yet, binds the WARP+
+// license if there is one, and adds the outbound to WARP with a routing rule for
+// the domains. A refused license leaves the account as it was.
+func (s *WarpService) EnableWarp(form *WarpForm) (*WarpStatus, error) {
+	form.License = strings.TrimSpace(form.License)
+	if form.License != "" && !warpLicensePattern.MatchString(form.License) {
+		return nil, common.NewError("a WARP+ license key is like xxxxxxxx-xxxxxxxx-xxxxxxxx")
+	}
+	domains := normalizeRuleList(form.Domains)
+	for i, domain := range domains {
+		if err := checkRuleDomain(domain); err != nil {
+			return nil, common.NewErrorf("domains[%d]: %v", i, err)
+		}
+	}
+
+	account, err := s.getWarpAccount()
+	if err != nil {
+		return nil, err
+	}
+	if account == nil {
+		if account, err = s.registerWarp(); err != nil {
+			return nil, err
+		}
+	}
+	if form.License != "" && form.License != account["license_key"] {
+		apiError, err := warpRequest("PUT", "/"+account["device_id"]+"/account", account["access_token"],
+			map[string]string{"license": form.License}, nil)
+		if err != nil {
+			return nil, err
+		}
+		if apiError != nil {
+			return nil, licenseError(apiError)
+		}
+		account["license_key"] = form.License
+		if err := s.saveWarpAccount(account); err != nil {
+			return nil, err
+		}
+	}
+
+	device, err := s.getWarpDevice(account)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.saveWarpOutbound(account, device); err != nil {
+		return nil, err
+	}
+	if len(domains) > 0 {
+		var routingService RoutingService
+		rule, err := getWarpRule()
+		if err != nil {
+			return nil, err
+		}
+		if rule == nil {
+			_, err = routingService.AddRule(&model.RoutingRule{Remark: warpRuleRemark, Domain: domains, OutboundTag: warpTag})
+		} else {
+			rule.Domain = domains
+			_, err = routingService.UpdateRule(rule)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s.GetWarpStatus()
+}
+
+// DisableWarp deletes the outbound to WARP and the routing rules of the panel
+// to it. The account is kept, to enable WARP again with the same addresses.
+func (s *WarpService) DisableWarp() error {
+	var routingService RoutingService
+	rules, err := routingService.GetRules()
+	if err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if rule.OutboundTag == warpTag {
+			if err := routingService.DelRule(rule.Id); err != nil {
+				return err
+			}
+		}
+	}
+	outbound := &model.Outbound{}
+	err = database.GetDB().Where("tag = ?", warpTag).First(outbound).Error
+	if database.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var outboundService OutboundService
+	return outboundService.DelOutbound(outbound.Id)
+}
+
+// RotateWarpKeys gives the device of the panel a new key pair, and the outbound
+// to WARP the new private key.
+func (s *WarpService) RotateWarpKeys() (*WarpStatus, error) {
+	account, err := s.getWarpAccount()
+	if err != nil {
+		return nil, err
+	}
+	if account == nil {
+		return nil, common.NewError("the panel is not registered with WARP")
+	}
+	privateKey, publicKey, err := newWireguardKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	apiError, err := warpRequest("PATCH", "/"+account["device_id"], account["access_token"],
+		map[string]string{"key": publicKey}, nil)
+	if err != nil {
+		return nil, err
+	}
+	if apiError != nil {
+		return nil, common.NewErrorf("WARP refused the new key: %s (code %d)", apiError.Message, apiError.Code)
+	}
+	account["private_key"] = privateKey
+	if err := s.saveWarpAccount(account); err != nil {
+		return nil, err
+	}
+
+	var count int64
+	if err := database.GetDB().Model(model.Outbound{}).Where("tag = ?", warpTag).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		device, err := s.getWarpDevice(account)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.saveWarpOutbound(account, device); err != nil {
+			return nil, err
+		}
+	}
+	return s.GetWarpStatus()
+}
+
+// GetWarpStatus returns the account of WARP from its API, and tries a handshake
+// with its endpoint.
+func (s *WarpService) GetWarpStatus() (*WarpStatus, error) {
+	status := &WarpStatus{}
+	var count int64
+	if err := database.GetDB().Model(model.Outbound{}).Where("tag = ?", warpTag).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	status.Enabled = count > 0
+	rule, err := getWarpRule()
+	if err != nil {
+		return nil, err
+	}
+	if rule != nil {
+		status.Domains = rule.Domain
+	}
+	account, err := s.getWarpAccount()
+	if err != nil || account == nil {
+		return status, err
+	}
+	status.Registered = true
+	status.DeviceId = account["device_id"]
+	status.License = account["license_key"]
+
+	device, err := s.getWarpDevice(account)
+	if err != nil {
+		return nil, err
+	}
+	status.AccountType = device.Account.AccountType
+	status.WarpPlus = device.Account.WarpPlus
+	status.AddressV4 = device.Config.Interface.Addresses.V4
+	status.AddressV6 = device.Config.Interface.Addresses.V6
+	peer := device.Config.Peers[0]
+	status.Endpoint = peer.Endpoint.Host
+
+	reserved := make([]byte, 0, 3)
+	for _, b := range warpReserved(device.Config.ClientId) {
+		reserved = append(reserved, byte(b))
+	}
+	err = wireguardHandshake(peer.Endpoint.Host, account["private_key"], peer.PublicKey, reserved, warpHandshakeTimeout)
+	if err != nil {
+		status.HandshakeError = strings.TrimSpace(err.Error())
+	} else {
+		status.Handshake = true
+	}
+	return status, nil
+}
@@ -0,0 +1,331 @@
+package service
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/util/common"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+const (
+	WebAuthnModePasswordless = "passwordless"
+	WebAuthnModeSecondFactor = "secondFactor"
+
+	webAuthnRPName      = "3x-ui"
+	webAuthnMaxNickname = 64
+)
+
+// WebAuthnService registers passkeys for panel users and verifies passkey logins.
+// The relying party is built per request from the RP ID and origin the controller
+// derives from the panel domain and the request.
+type WebAuthnService struct {
+	settingService SettingService
+	userService    UserService
+}
+
+// webAuthnUser adapts a panel user and its passkeys to webauthn.User.
+type webAuthnUser struct {
+	user        *model.User
+	credentials []webauthn.Credential
+}
+
+func (u *webAuthnUser) WebAuthnID() []byte {
+	return []byte(strconv.Itoa(u.user.Id))
+}
+
+func (u *webAuthnUser) WebAuthnName() string {
+	return u.user.Username
+}
+
+func (u *webAuthnUser) WebAuthnDisplayName() string {
+	return u.user.Username
+}
+
+func (u *webAuthnUser) WebAuthnCredentials() []webauthn.Credential {
+	return u.credentials
+}
+
+func (s *WebAuthnService) GetMode() string {
+	mode, err := s.settingService.GetWebAuthnMode()
+	if err != nil || mode != WebAuthnModeSecondFactor {
+		return WebAuthnModePasswordless
+	}
+	return mode
+}
+
+// RequiresPasskey reports whether a user that passed the password check still has
+// to present a passkey. Users without passkeys always log in with the password.
+func (s *WebAuthnService) RequiresPasskey(userId int) bool {
+	return s.GetMode() == WebAuthnModeSecondFactor && s.HasCredentials(userId)
+}
+
+func (s *WebAuthnService) HasCredentials(userId int) bool {
+	var count int64
+	database.GetDB().Model(model.WebAuthnCredential{}).Where("user_id = ?", userId).Count(&count)
+	return count > 0
+}
+
+// AnyCredentials reports whether passkey login should be offered on the login page.
+func (s *WebAuthnService) AnyCredentials() bool {
+	var count int64
+	database.GetDB().Model(model.WebAuthnCredential{}).Count(&count)
+	return count > 0
+}
+
+func (s *WebAuthnService) GetCredentials(userId int) ([]*model.WebAuthnCredential, error) {
+	credentials := make([]*model.WebAuthnCredential, 0)
+	err := database.GetDB().Model(model.WebAuthnCredential{}).
+		Where("user_id = ?", userId).
+		Order("id").
+		Find(&credentials).Error
+	return credentials, err
+}
+
+func (s *WebAuthnService) RenameCredential(userId int, id int, nickname string) error {
+	nickname, err := normalizeNickname(nickname)
+	if err != nil {
+		return err
+	}
+	result := database.GetDB().Model(model.WebAuthnCredential{}).
+		Where("id = ? AND user_id = ?", id, userId).
+		Update("nickname", nickname)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return common.NewError("passkey not found")
+	}
+	return nil
+}
+
+func (s *WebAuthnService) DelCredential(userId int, id int) error {
+	result := database.GetDB().
+		Where("id = ? AND user_id = ?", id, userId).
+		Delete(model.WebAuthnCredential{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return common.NewError("passkey not found")
+	}
+	return nil
+}
+
+// BeginRegistration returns the options for navigator.credentials.create and the
+// ceremony state to keep until FinishRegistration.
+func (s *WebAuthnService) BeginRegistration(userId int, rpID string, origin string) (*protocol.CredentialCreation, string, error) {
+	w, err := newWebAuthn(rpID, origin)
+	if err != nil {
+		return nil, "", err
+	}
+	user, err := s.loadUser(userId)
+	if err != nil {
+		return nil, "", err
+	}
+	options, sessionData, err := w.BeginRegistration(user,
+		webauthn.WithExclusions(webauthn.Credentials(user.credentials).CredentialDescriptors()),
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementPreferred),
+	)
+	if err != nil {
+		return nil, "", err
+	}
+	state, err := json.Marshal(sessionData)
+	if err != nil {
+		return nil, "", err
+	}
+	return options, string(state), nil
+}
+
+// FinishRegistration verifies the attestation in the request body and stores the new passkey.
+func (s *WebAuthnService) FinishRegistration(userId int, rpID string, origin string, state string, nickname string, r *http.Request) (*model.WebAuthnCredential, error) {
+	nickname, err := normalizeNickname(nickname)
+	if err != nil {
+		return nil, err
+	}
+	w, err := newWebAuthn(rpID, origin)
+	if err != nil {
+		return nil, err
+	}
+	sessionData, err := parseSessionData(state)
+	if err != nil {
+		return nil, err
+	}
+	user, err := s.loadUser(userId)
+	if err != nil {
+		return nil, err
+	}
+	credential, err := w.FinishRegistration(user, *sessionData, r)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(credential)
+	if err != nil {
+		return nil, err
+	}
+	record := &model.WebAuthnCredential{
+		UserId:       userId,
+		Nickname:     nickname,
+		CredentialId: base64.RawURLEncoding.EncodeToString(credential.ID),
+		Credential:   string(data),
+		CreatedAt:    time.Now().UnixMilli(),
+	}
+	if err := database.GetDB().Create(record).Error; err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// BeginLogin returns the options for navigator.credentials.get. With userId 0 the
+// browser may offer any discoverable passkey for this panel. ok is false if the
+// user has no passkeys, in which case the password has to be used.
+func (s *WebAuthnService) BeginLogin(userId int, rpID string, origin string) (options *protocol.CredentialAssertion, state string, ok bool, err error) {
+	w, err := newWebAuthn(rpID, origin)
+	if err != nil {
+		return nil, "", false, err
+	}
+
+	var sessionData *webauthn.SessionData
+	if userId == 0 {
+		if !s.AnyCredentials() {
+			return nil, "", false, nil
+		}
+		options, sessionData, err = w.BeginDiscoverableLogin(
+			webauthn.WithUserVerification(protocol.VerificationRequired))
+	} else {
+		user, err := s.loadUser(userId)
+		if err != nil {
+			return nil, "", false, err
+		}
+		if len(user.credentials) == 0 {
+			return nil, "", false, nil
+		}
+		options, sessionData, err = w.BeginLogin(user,
+			webauthn.WithUserVerification(protocol.VerificationPreferred))
+	}
+	if err != nil {
+		return nil, "", false, err
+	}
+	data, err := json.Marshal(sessionData)
+	if err != nil {
+		return nil, "", false, err
+	}
+	return options, string(data), true, nil
+}
+
+// FinishLogin verifies the assertion in the request body against the ceremony
+// state and returns the user it belongs to.
+func (s *WebAuthnService) FinishLogin(rpID string, origin string, state string, r *http.Request) (*model.User, error) {
+	w, err := newWebAuthn(rpID, origin)
+	if err != nil {
+		return nil, err
+	}
+	sessionData, err := parseSessionData(state)
+	if err != nil {
+		return nil, err
+	}
+
+	var user *webAuthnUser
+	var credential *webauthn.Credential
+	if len(sessionData.UserID) == 0 {
+		var found webauthn.User
+		found, credential, err = w.FinishPasskeyLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+			id, err := strconv.Atoi(string(userHandle))
+			if err != nil {
+				return nil, common.NewError("unknown passkey")
+			}
+			return s.loadUser(id)
+		}, *sessionData, r)
+		if err == nil {
+			user = found.(*webAuthnUser)
+		}
+	} else {
+		id, convErr := strconv.Atoi(string(sessionData.UserID))
+		if convErr != nil {
+			return nil, common.NewError("unknown passkey")
+		}
+		user, err = s.loadUser(id)
+		if err != nil {
+			return nil, err
+		}
+		credential, err = w.FinishLogin(user, *sessionData, r)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if credential.Authenticator.CloneWarning {
+		return nil, common.NewError("passkey signature counter went backwards, the authenticator may have been cloned")
+	}
+
+	// Keep the signature counter and flags current for the next verification
+	data, err := json.Marshal(credential)
+	if err != nil {
+		return nil, err
+	}
+	err = database.GetDB().Model(model.WebAuthnCredential{}).
+		Where("credential_id = ? AND user_id = ?", base64.RawURLEncoding.EncodeToString(credential.ID), user.user.Id).
+		Updates(map[string]any{"credential": string(data), "last_used_at": time.Now().UnixMilli()}).
+		Error
+	if err != nil {
+		return nil, err
+	}
+	return user.user, nil
+}
+
+func (s *WebAuthnService) loadUser(userId int) (*webAuthnUser, error) {
+	user, err := s.userService.GetUserById(userId)
+	if err != nil {
+		return nil, err
+	}
+	records, err := s.GetCredentials(userId)
+	if err != nil {
+		return nil, err
+	}
+	credentials := make([]webauthn.Credential, 0, len(records))
+	for _, record := range records {
+		var credential webauthn.Credential
+		if err := json.Unmarshal([]byte(record.Credential), &credential); err != nil {
+			return nil, err
+		}
+		credentials = append(credentials, credential)
+	}
+	return &webAuthnUser{user: user, credentials: credentials}, nil
+}
+
+func newWebAuthn(rpID string, origin string) (*webauthn.WebAuthn, error) {
+	return webauthn.New(&webauthn.Config{
+		RPID:          rpID,
+		RPDisplayName: webAuthnRPName,
+		RPOrigins:     []string{origin},
+	})
+}
+
+func parseSessionData(state string) (*webauthn.SessionData, error) {
+	if state == "" {
+		return nil, common.NewError("no passkey ceremony in progress")
+	}
+	sessionData := &webauthn.SessionData{}
+	if err := json.Unmarshal([]byte(state), sessionData); err != nil {
+		return nil, err
+	}
+	return sessionData, nil
+}
+
+func normalizeNickname(nickname string) (string, error) {
+	nickname = strings.TrimSpace(nickname)
+	if nickname == "" {
+		return "", common.NewError("passkey nickname can not be empty")
+	}
+	if len([]rune(nickname)) > webAuthnMaxNickname {
+		return "", common.NewErrorf("passkey nickname is longer than %d characters", webAuthnMaxNickname)
+	}
+	return nickname, nil
+}
@@ -0,0 +1,467 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"x-ui/config"
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/xray"
+
+	"github.com/google/uuid"
+)
+
+// The events posted to the webhooks.
+const (
+	WebhookClientCreated   = "client.created"
+	WebhookClientUpdated   = "client.updated"
+	WebhookClientDepleted  = "client.depleted"
+	WebhookClientExpired   = "client.expired"
+	WebhookInboundCreated  = "inbound.created"
+	WebhookXrayCrashed     = "xray.crashed"
+	WebhookLoginFailed     = "login.failed"
+	WebhookBackupCompleted = "backup.completed"
+	WebhookSubShared       = "sub.shared"
+	// WebhookBandwidthThreshold is posted when the server goes over an alert
+	// percent of a bandwidth limit, or reaches it
+	WebhookBandwidthThreshold = "bandwidth.threshold"
+	// WebhookAcmeFailed is posted when a certificate could not be issued or
+	// renewed over ACME
+	WebhookAcmeFailed = "acme.failed"
+	// WebhookNodeConflict is posted when an inbound pushed to a node was
+	// changed on the node
+	WebhookNodeConflict = "node.conflict"
+	// WebhookClientsInactive is posted weekly with the clients that became
+	// inactive for the inactivity period
+	WebhookClientsInactive = "clients.inactive"
+	// WebhookClientRejected is posted when clients are not added or changed for
+	// going over a limit of their inbound
+	WebhookClientRejected = "client.rejected"
+	// WebhookTest is posted by a test fire, whatever the events of the webhook
+	WebhookTest = "webhook.test"
+)
+
+var webhookEvents = []string{
+	WebhookClientCreated, WebhookClientUpdated, WebhookClientDepleted, WebhookClientExpired,
+	WebhookInboundCreated, WebhookXrayCrashed, WebhookLoginFailed, WebhookBackupCompleted,
+	WebhookSubShared, WebhookBandwidthThreshold, WebhookAcmeFailed, WebhookNodeConflict,
+	WebhookClientsInactive, WebhookClientRejected,
+}
+
+const (
+	// webhookTimeout bounds a post to a webhook
+	webhookTimeout = 10 * time.Second
+	// webhookMaxAttempts is how many times a delivery is posted before it
+	// fails, webhookRetryWait apart after the first attempt and twice as long
+	// after each next one, up to maxWebhookRetryWait
+	webhookMaxAttempts  = 8
+	webhookRetryWait    = 30 * time.Second
+	maxWebhookRetryWait = time.Hour
+	// webhookBatch is how many due deliveries a run posts
+	webhookBatch = 50
+	// webhookRetention is how long the finished deliveries are kept
+	webhookRetention = 7 * 24 * time.Hour
+	// webhookBodyLimit is how much of the answer of a failed post is kept
+	webhookBodyLimit = 256
+	// The deliveries listed by default, and at most
+	webhookDefaultLimit = 100
+	webhookMaxLimit     = 1000
+	// webhookSecretMask stands for the secret when it is set, the API never
+	// returns it
+	webhookSecretMask = "********"
+)
+
+// webhookLock lets a single run post the deliveries at a time.
+var webhookLock sync.Mutex
+
+// Webhook is an endpoint the events of the panel are posted to.
+type Webhook struct {
+	Name   string `json:"name"`
+	URL    string `json:"url"`
+	Enable bool   `json:"enable"`
+	// Events are those posted to the webhook, all of them if it has none
+	Events []string `json:"events"`
+}
+
+func (w *Webhook) validate() error {
+	if w.Name == "" {
+		return common.NewError("a webhook has no name")
+	}
+	if u, err := url.Parse(w.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return common.NewErrorf("the URL of %s is not an http(s) URL", w.Name)
+	}
+	for _, event := range w.Events {
+		if !slices.Contains(webhookEvents, event) {
+			return common.NewErrorf("unknown event %q of %s", event, w.Name)
+		}
+	}
+	return nil
+}
+
+// wants tells if event is posted to the webhook.
+func (w *Webhook) wants(event string) bool {
+	return w.Enable && (len(w.Events) == 0 || slices.Contains(w.Events, event))
+}
+
+// WebhookSettings are the webhooks, and the secret their payloads are signed
+// with.
+type WebhookSettings struct {
+	Secret   string    `json:"secret"`
+	Webhooks []Webhook `json:"webhooks"`
+	// Events are the events a webhook may subscribe to
+	Events []string `json:"events"`
+}
+
+// WebhookEvent is the body posted to a webhook: the event, when it happened in
+// Unix milliseconds, and a snapshot of what it happened to. Id is the same on
+// every attempt of a delivery, for the receiver to skip repeats.
+type WebhookEvent struct {
+	Id        string `json:"id"`
+	Type      string `json:"type"`
+	Timestamp int64  `json:"timestamp"`
+	Hostname  string `json:"hostname"`
+	Data      any    `json:"data"`
+}
+
+// WebhookService queues the events of the panel for the webhooks that want
+// them, and posts them.
+type WebhookService struct {
+	settingService SettingService
+}
+
+func (s *WebhookService) getWebhooks() ([]Webhook, error) {
+	value, err := s.settingService.GetWebhooks()
+	if err != nil {
+		return nil, err
+	}
+	webhooks := []Webhook{}
+	if value != "" {
+		if err := json.Unmarshal([]byte(value), &webhooks); err != nil {
+			return nil, common.NewErrorf("the webhooks are not valid: %v", err)
+		}
+	}
+	return webhooks, nil
+}
+
+// GetSettings returns the webhooks, with the mask for the secret if it is set.
+func (s *WebhookService) GetSettings() (*WebhookSettings, error) {
+	webhooks, err := s.getWebhooks()
+	if err != nil {
+		return nil, err
+	}
+	secret, err := s.settingService.GetWebhookSecret()
+	if err != nil {
+		return nil, err
+	}
+	if secret != "" {
+		secret = webhookSecretMask
+	}
+	return &WebhookSettings{Secret: secret, Webhooks: webhooks, Events: webhookEvents}, nil
+}
+
+// SaveSettings replaces the webhooks and their secret, the mask keeps the
+// secret that is set.
+func (s *WebhookService) SaveSettings(settings *WebhookSettings) error {
+	names := []string{}
+	for i := range settings.Webhooks {
+		webhook := &settings.Webhooks[i]
+		webhook.Name = strings.TrimSpace(webhook.Name)
+		webhook.URL = strings.TrimSpace(webhook.URL)
+		if slices.Contains(names, webhook.Name) {
+			return common.NewErrorf("two webhooks are named %s", webhook.Name)
+		}
+		names = append(names, webhook.Name)
+		if err := webhook.validate(); err != nil {
+			return err
+		}
+		if webhook.Events == nil {
+			webhook.Events = []string{}
+		}
+	}
+
+	secret := settings.Secret
+	if secret == webhookSecretMask {
+		stored, err := s.settingService.GetWebhookSecret()
+		if err != nil {
+			return err
+		}
+		secret = stored
+	}
+	if secret == "" && len(settings.Webhooks) > 0 {
+		return common.NewError("the webhooks need a secret to sign the payloads with")
+	}
+
+	data, err := json.Marshal(settings.Webhooks)
+	if err != nil {
+		return err
+	}
+	if err := s.settingService.SetWebhookSecret(secret); err != nil {
+		return err
+	}
+	return s.settingService.SetWebhooks(string(data))
+}
+
+// newWebhookDelivery returns a delivery of event to webhook, not saved.
+func newWebhookDelivery(webhook *Webhook, event string, data any) (*model.WebhookDelivery, error) {
+	host, _ := os.Hostname()
+	now := time.Now().UnixMilli()
+	body := WebhookEvent{Id: uuid.NewString(), Type: event, Timestamp: now, Hostname: host, Data: data}
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	return &model.WebhookDelivery{
+		Webhook:       webhook.Name,
+		Event:         event,
+		EventId:       body.Id,
+		Url:           webhook.URL,
+		Payload:       string(payload),
+		Status:        model.WebhookPending,
+		NextAttemptAt: now,
+		CreatedAt:     now,
+	}, nil
+}
+
+// Emit queues event for each webhook that wants it, with data as the snapshot
+// of what it happened to, and posts the queue. It must not be called in a
+// transaction, the queue is written apart from it.
+func (s *WebhookService) Emit(event string, data any) {
+	webhooks, err := s.getWebhooks()
+	if err != nil {
+		logger.Warning("Unable to read the webhooks:", err)
+		return
+	}
+	queued := false
+	for i := range webhooks {
+		if !webhooks[i].wants(event) {
+			continue
+		}
+		delivery, err := newWebhookDelivery(&webhooks[i], event, data)
+		if err == nil {
+			err = database.GetDB().Create(delivery).Error
+		}
+		if err != nil {
+			logger.Warningf("Unable to queue %s for the webhook %s: %v", event, webhooks[i].Name, err)
+			continue
+		}
+		queued = true
+	}
+	if queued {
+		go s.Deliver()
+	}
+}
+
+// Deliver posts the deliveries that are due, unless a run is already posting.
+// A failed post is tried again later, until it ran out of attempts.
+func (s *WebhookService) Deliver() {
+	if !webhookLock.TryLock() {
+		return
+	}
+	defer webhookLock.Unlock()
+
+	db := database.GetDB()
+	var deliveries []*model.WebhookDelivery
+	err := db.Where("status = ? AND next_attempt_at <= ?", model.WebhookPending, time.Now().UnixMilli()).
+		Order("id").Limit(webhookBatch).Find(&deliveries).Error
+	if err != nil {
+		logger.Warning("Unable to read the webhook deliveries:", err)
+		return
+	}
+	if len(deliveries) == 0 {
+		return
+	}
+	webhooks, err := s.getWebhooks()
+	if err != nil {
+		logger.Warning("Unable to read the webhooks:", err)
+		return
+	}
+	secret, err := s.settingService.GetWebhookSecret()
+	if err != nil {
+		logger.Warning("Unable to read the webhook secret:", err)
+		return
+	}
+
+	for _, delivery := range deliveries {
+		// The webhook may have changed since the event was queued
+		index := slices.IndexFunc(webhooks, func(w Webhook) bool { return w.Name == delivery.Webhook })
+		if index < 0 || !webhooks[index].Enable {
+			delivery.Status = model.WebhookFailed
+			delivery.Error = "the webhook was removed or disabled"
+		} else {
+			delivery.Url = webhooks[index].URL
+			err := s.post(delivery, secret)
+			switch {
+			case err == nil:
+				delivery.Status = model.WebhookDelivered
+			case delivery.Attempts >= webhookMaxAttempts:
+				delivery.Status = model.WebhookFailed
+				logger.Warningf("The webhook %s failed %s after %d attempts: %v", delivery.Webhook, delivery.Event, delivery.Attempts, err)
+			default:
+				wait := min(webhookRetryWait<<min(delivery.Attempts-1, 20), maxWebhookRetryWait)
+				delivery.NextAttemptAt = time.Now().Add(wait).UnixMilli()
+			}
+		}
+		if err := db.Save(delivery).Error; err != nil {
+			logger.Warning("Unable to save the webhook delivery:", err)
+		}
+	}
+}
+
+// post posts a delivery once, and writes down the answer.
+func (s *WebhookService) post(delivery *model.WebhookDelivery, secret string) error {
+	delivery.Attempts++
+	delivery.LastAttemptAt = time.Now().UnixMilli()
+	code, err := postWebhook(delivery, secret)
+	delivery.ResponseCode = code
+	delivery.Error = ""
+	if err != nil {
+		delivery.Error = err.Error()
+	}
+	return err
+}
+
+// signWebhook returns the X-XUI-Signature of body: sha256= and the hex of its
+// HMAC-SHA256 with secret.
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// postWebhook posts the payload of delivery, and returns the status code of
+// the answer. An answer other than 2xx is an error, with the start of its body.
+func postWebhook(delivery *model.WebhookDelivery, secret string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	body := []byte(delivery.Payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.Url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "3x-ui/"+config.GetVersion())
+	req.Header.Set("X-XUI-Event", delivery.Event)
+	req.Header.Set("X-XUI-Delivery", delivery.EventId)
+	if secret != "" {
+		req.Header.Set("X-XUI-Signature", signWebhook(secret, body))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp.StatusCode, nil
+	}
+	answer, _ := io.ReadAll(io.LimitReader(resp.Body, webhookBodyLimit))
+	if text := strings.TrimSpace(string(answer)); text != "" {
+		return resp.StatusCode, common.NewErrorf("%s: %s", resp.Status, text)
+	}
+	return resp.StatusCode, common.NewError(resp.Status)
+}
+
+// Test posts a test event to the saved webhook named name right away, enabled
+// or not, and returns the delivery. It is not tried again.
+func (s *WebhookService) Test(name string) (*model.WebhookDelivery, error) {
+	webhooks, err := s.getWebhooks()
+	if err != nil {
+		return nil, err
+	}
+	index := slices.IndexFunc(webhooks, func(w Webhook) bool { return w.Name == name })
+	if index < 0 {
+		return nil, common.NewErrorf("no webhook is named %s", name)
+	}
+	secret, err := s.settingService.GetWebhookSecret()
+	if err != nil {
+		return nil, err
+	}
+	delivery, err := newWebhookDelivery(&webhooks[index], WebhookTest, map[string]any{"webhook": name})
+	if err != nil {
+		return nil, err
+	}
+	delivery.Status = model.WebhookDelivered
+	if s.post(delivery, secret) != nil {
+		delivery.Status = model.WebhookFailed
+	}
+	if err := database.GetDB().Create(delivery).Error; err != nil {
+		return nil, err
+	}
+	return delivery, nil
+}
+
+// GetDeliveries returns the latest deliveries, of the webhook named webhook if
+// it isn't empty.
+func (s *WebhookService) GetDeliveries(webhook string, limit int) ([]*model.WebhookDelivery, error) {
+	if limit <= 0 {
+		limit = webhookDefaultLimit
+	} else if limit > webhookMaxLimit {
+		limit = webhookMaxLimit
+	}
+	query := database.GetDB().Model(model.WebhookDelivery{}).Order("id DESC").Limit(limit)
+	if webhook != "" {
+		query = query.Where("webhook = ?", webhook)
+	}
+	deliveries := []*model.WebhookDelivery{}
+	err := query.Find(&deliveries).Error
+	return deliveries, err
+}
+
+// Prune removes the deliveries that finished longer than the retention ago.
+func (s *WebhookService) Prune() (int64, error) {
+	cutoff := time.Now().Add(-webhookRetention).UnixMilli()
+	result := database.GetDB().Where("status <> ? AND created_at < ?", model.WebhookPending, cutoff).
+		Delete(model.WebhookDelivery{})
+	return result.RowsAffected, result.Error
+}
+
+// clientWebhookData is the snapshot of a client of inbound for its events.
+func clientWebhookData(inbound *model.Inbound, client *model.Client) map[string]any {
+	return map[string]any{
+		"inboundId":     inbound.Id,
+		"inboundRemark": inbound.Remark,
+		"client":        client,
+	}
+}
+
+// inboundWebhookData is the snapshot of an inbound for its events, without its
+// settings that hold the credentials of the clients and the keys.
+func inboundWebhookData(inbound *model.Inbound) map[string]any {
+	return map[string]any{
+		"id":         inbound.Id,
+		"remark":     inbound.Remark,
+		"enable":     inbound.Enable,
+		"protocol":   inbound.Protocol,
+		"listen":     inbound.Listen,
+		"port":       inbound.Port,
+		"tag":        inbound.Tag,
+		"total":      inbound.Total,
+		"expiryTime": inbound.ExpiryTime,
+	}
+}
+
+// emitClientsDisabled emits client.expired or client.depleted for each client
+// disabled for reaching its limit.
+func (s *WebhookService) emitClientsDisabled(traffics []xray.ClientTraffic) {
+	for i := range traffics {
+		event := WebhookClientDepleted
+		if traffics[i].ExpiryTime > 0 && traffics[i].ExpiryTime <= traffics[i].DisabledAt {
+			event = WebhookClientExpired
+		}
+		s.Emit(event, map[string]any{"traffic": &traffics[i]})
+	}
+}
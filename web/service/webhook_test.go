@@ -0,0 +1,344 @@
+package service
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/xray"
+)
+
+const webhookTestSecret = "webhook-test-secret"
+
+// webhookReceiver takes the posts of the webhooks while status is 2xx, and
+// keeps those with a valid signature.
+type webhookReceiver struct {
+	*httptest.Server
+	sync.Mutex
+	status int
+	events []WebhookEvent
+	ids    []string
+}
+
+func newWebhookReceiver(t *testing.T) *webhookReceiver {
+	r := &webhookReceiver{status: http.StatusOK}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		r.Lock()
+		defer r.Unlock()
+		r.ids = append(r.ids, req.Header.Get("X-XUI-Delivery"))
+		if req.Header.Get("X-XUI-Signature") != signWebhook(webhookTestSecret, body) {
+			http.Error(w, "bad signature", http.StatusUnauthorized)
+			return
+		}
+		if r.status >= 300 {
+			http.Error(w, "the billing is down", r.status)
+			return
+		}
+		var event WebhookEvent
+		if err := json.Unmarshal(body, &event); err != nil || req.Header.Get("X-XUI-Event") != event.Type {
+			http.Error(w, "bad event", http.StatusBadRequest)
+			return
+		}
+		r.events = append(r.events, event)
+		w.WriteHeader(r.status)
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *webhookReceiver) setStatus(status int) {
+	r.Lock()
+	r.status = status
+	r.Unlock()
+}
+
+func (r *webhookReceiver) received() []WebhookEvent {
+	r.Lock()
+	defer r.Unlock()
+	return append([]WebhookEvent{}, r.events...)
+}
+
+func webhookTestDB(t *testing.T, webhooks ...Webhook) *WebhookService {
+	t.Helper()
+	newTestDB(t)
+	s := &WebhookService{}
+	if err := s.SaveSettings(&WebhookSettings{Secret: webhookTestSecret, Webhooks: webhooks}); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// webhookDeliveries waits for the runs Emit started, and returns the
+// deliveries oldest first.
+func webhookDeliveries(t *testing.T) []*model.WebhookDelivery {
+	t.Helper()
+	webhookLock.Lock()
+	webhookLock.Unlock()
+	var deliveries []*model.WebhookDelivery
+	if err := database.GetDB().Order("id").Find(&deliveries).Error; err != nil {
+		t.Fatal(err)
+	}
+	return deliveries
+}
+
+// waitWebhooks waits until no delivery is due any more.
+func waitWebhooks(t *testing.T) []*model.WebhookDelivery {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		deliveries := webhookDeliveries(t)
+		due := false
+		for _, delivery := range deliveries {
+			due = due || (delivery.Status == model.WebhookPending && delivery.Attempts == 0)
+		}
+		if !due {
+			return deliveries
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the deliveries were not posted")
+		}
+	}
+}
+
+func TestWebhookSettings(t *testing.T) {
+	s := webhookTestDB(t)
+	settings, err := s.GetSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings.Secret != webhookSecretMask || len(settings.Webhooks) != 0 || len(settings.Events) != len(webhookEvents) {
+		t.Errorf("the settings are %+v", settings)
+	}
+
+	billing := Webhook{Name: " billing ", URL: " https://billing.example/hook ", Enable: true, Events: []string{WebhookClientDepleted}}
+	if err := s.SaveSettings(&WebhookSettings{Secret: webhookSecretMask, Webhooks: []Webhook{billing}}); err != nil {
+		t.Fatal(err)
+	}
+	if secret, _ := s.settingService.GetWebhookSecret(); secret != webhookTestSecret {
+		t.Errorf("the masked secret replaced the secret with %q", secret)
+	}
+	webhooks, err := s.getWebhooks()
+	if err != nil || len(webhooks) != 1 || webhooks[0].Name != "billing" || webhooks[0].URL != "https://billing.example/hook" {
+		t.Errorf("the webhooks are %+v, %v", webhooks, err)
+	}
+
+	tests := []struct {
+		settings WebhookSettings
+		err      string
+	}{
+		{WebhookSettings{Secret: "s", Webhooks: []Webhook{{URL: "https://a.example"}}}, "has no name"},
+		{WebhookSettings{Secret: "s", Webhooks: []Webhook{{Name: "a", URL: "a.example/hook"}}}, "not an http(s) URL"},
+		{WebhookSettings{Secret: "s", Webhooks: []Webhook{{Name: "a", URL: "https://a.example", Events: []string{"client.deleted"}}}}, `unknown event "client.deleted"`},
+		{WebhookSettings{Secret: "s", Webhooks: []Webhook{{Name: "a", URL: "https://a.example"}, {Name: " a", URL: "https://b.example"}}}, "two webhooks are named a"},
+		{WebhookSettings{Webhooks: []Webhook{{Name: "a", URL: "https://a.example"}}}, "need a secret"},
+	}
+	for _, test := range tests {
+		err := s.SaveSettings(&test.settings)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("settings %+v: error %v, want %q", test.settings, err, test.err)
+		}
+	}
+}
+
+func TestWebhookEmit(t *testing.T) {
+	receiver := newWebhookReceiver(t)
+	s := webhookTestDB(t,
+		Webhook{Name: "all", URL: receiver.URL, Enable: true},
+		Webhook{Name: "depleted", URL: receiver.URL + "/depleted", Enable: true, Events: []string{WebhookClientDepleted}},
+		Webhook{Name: "disabled", URL: receiver.URL, Enable: false},
+	)
+
+	before := time.Now().UnixMilli()
+	s.Emit(WebhookBackupCompleted, map[string]any{"name": "x-ui-20240101-000000-v2.5.0.db"})
+	s.emitClientsDisabled([]xray.ClientTraffic{
+		{Email: "depleted-1", Total: 100, Up: 100},
+		{Email: "expired-1", ExpiryTime: 1000, DisabledAt: 2000},
+	})
+	deliveries := waitWebhooks(t)
+	events := map[string]int{}
+	for _, delivery := range deliveries {
+		if delivery.Status != model.WebhookDelivered || delivery.Attempts != 1 || delivery.ResponseCode != http.StatusOK {
+			t.Errorf("the delivery is %+v", delivery)
+		}
+		events[delivery.Webhook+" "+delivery.Event]++
+	}
+	want := map[string]int{"all backup.completed": 1, "all client.depleted": 1, "all client.expired": 1, "depleted client.depleted": 1}
+	if len(events) != len(want) {
+		t.Errorf("the deliveries are %v, want %v", events, want)
+	}
+	for key, n := range want {
+		if events[key] != n {
+			t.Errorf("the deliveries are %v, want %v", events, want)
+		}
+	}
+
+	received := receiver.received()
+	if len(received) != 4 {
+		t.Fatalf("the receiver got %d events", len(received))
+	}
+	for _, event := range received {
+		if event.Id == "" || event.Timestamp < before || event.Data == nil {
+			t.Errorf("the event is %+v", event)
+		}
+		if event.Type == WebhookClientDepleted {
+			traffic, _ := event.Data.(map[string]any)["traffic"].(map[string]any)
+			if traffic["email"] != "depleted-1" {
+				t.Errorf("the snapshot of the depleted client is %v", event.Data)
+			}
+		}
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	receiver := newWebhookReceiver(t)
+	s := webhookTestDB(t, Webhook{Name: "billing", URL: receiver.URL, Enable: true})
+	receiver.setStatus(http.StatusServiceUnavailable)
+	s.Emit(WebhookLoginFailed, map[string]any{"username": "admin"})
+	delivery := waitWebhooks(t)[0]
+	if delivery.Status != model.WebhookPending || delivery.Attempts != 1 || delivery.ResponseCode != http.StatusServiceUnavailable ||
+		!strings.Contains(delivery.Error, "the billing is down") {
+		t.Fatalf("the failed delivery is %+v", delivery)
+	}
+
+	// The waits double from webhookRetryWait, each attempt posts the same event
+	for attempt := 1; attempt < webhookMaxAttempts; attempt++ {
+		want := min(webhookRetryWait<<(attempt-1), maxWebhookRetryWait)
+		if wait := time.Duration(delivery.NextAttemptAt-delivery.LastAttemptAt) * time.Millisecond; wait < want-time.Second || wait > want+time.Second {
+			t.Errorf("attempt %d waits %v, want %v", attempt, wait, want)
+		}
+		// Not due yet, it isn't posted
+		s.Deliver()
+		if again := webhookDeliveries(t)[0]; again.Attempts != attempt {
+			t.Fatalf("the delivery was posted %d times before it was due", again.Attempts)
+		}
+		if err := database.GetDB().Model(delivery).Update("next_attempt_at", 0).Error; err != nil {
+			t.Fatal(err)
+		}
+		s.Deliver()
+		delivery = webhookDeliveries(t)[0]
+	}
+	if delivery.Status != model.WebhookFailed || delivery.Attempts != webhookMaxAttempts {
+		t.Errorf("after %d attempts the delivery is %+v", webhookMaxAttempts, delivery)
+	}
+	receiver.Lock()
+	ids := receiver.ids
+	receiver.Unlock()
+	if len(ids) != webhookMaxAttempts {
+		t.Errorf("the receiver got %d posts, want %d", len(ids), webhookMaxAttempts)
+	}
+	for _, id := range ids {
+		if id != delivery.EventId {
+			t.Errorf("the posts are of the deliveries %v, want %s", ids, delivery.EventId)
+			break
+		}
+	}
+
+	// A pending delivery of a removed webhook fails, it isn't posted
+	receiver.setStatus(http.StatusOK)
+	s.Emit(WebhookLoginFailed, map[string]any{"username": "admin"})
+	waitWebhooks(t)
+	delivered := webhookDeliveries(t)[1]
+	if delivered.Status != model.WebhookDelivered {
+		t.Fatalf("the delivery is %+v", delivered)
+	}
+	if err := database.GetDB().Model(delivered).Updates(map[string]any{"status": model.WebhookPending, "next_attempt_at": 0}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveSettings(&WebhookSettings{Secret: webhookSecretMask, Webhooks: []Webhook{}}); err != nil {
+		t.Fatal(err)
+	}
+	s.Deliver()
+	if removed := webhookDeliveries(t)[1]; removed.Status != model.WebhookFailed || removed.Attempts != 1 ||
+		!strings.Contains(removed.Error, "removed or disabled") {
+		t.Errorf("the delivery of the removed webhook is %+v", removed)
+	}
+}
+
+func TestWebhookTestFire(t *testing.T) {
+	receiver := newWebhookReceiver(t)
+	s := webhookTestDB(t,
+		Webhook{Name: "billing", URL: receiver.URL, Enable: false, Events: []string{WebhookClientCreated}},
+		Webhook{Name: "broken", URL: receiver.URL + "/broken", Enable: true},
+	)
+	delivery, err := s.Test("billing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delivery.Id == 0 || delivery.Status != model.WebhookDelivered || delivery.Event != WebhookTest || delivery.ResponseCode != http.StatusOK {
+		t.Errorf("the test delivery is %+v", delivery)
+	}
+	if received := receiver.received(); len(received) != 1 || received[0].Type != WebhookTest {
+		t.Errorf("the receiver got %+v", received)
+	}
+
+	receiver.setStatus(http.StatusInternalServerError)
+	if delivery, err = s.Test("broken"); err != nil || delivery.Status != model.WebhookFailed || delivery.ResponseCode != http.StatusInternalServerError {
+		t.Errorf("the failed test delivery is %+v, %v", delivery, err)
+	}
+	if _, err := s.Test("other"); err == nil {
+		t.Error("a webhook that isn't saved was tested")
+	}
+
+	// The tests are not tried again, and are listed with the deliveries
+	s.Deliver()
+	deliveries, err := s.GetDeliveries("broken", 0)
+	if err != nil || len(deliveries) != 1 || deliveries[0].Attempts != 1 {
+		t.Errorf("the deliveries of broken are %+v, %v", deliveries, err)
+	}
+	if deliveries, _ := s.GetDeliveries("", 1); len(deliveries) != 1 || deliveries[0].Webhook != "broken" {
+		t.Errorf("the latest delivery is %+v", deliveries)
+	}
+}
+
+func TestWebhookPrune(t *testing.T) {
+	s := webhookTestDB(t)
+	old := time.Now().Add(-webhookRetention - time.Hour).UnixMilli()
+	deliveries := []*model.WebhookDelivery{
+		{Webhook: "a", Status: model.WebhookDelivered, CreatedAt: old},
+		{Webhook: "a", Status: model.WebhookFailed, CreatedAt: old},
+		{Webhook: "a", Status: model.WebhookPending, CreatedAt: old},
+		{Webhook: "a", Status: model.WebhookDelivered, CreatedAt: time.Now().UnixMilli()},
+	}
+	if err := database.GetDB().Create(deliveries).Error; err != nil {
+		t.Fatal(err)
+	}
+	if pruned, err := s.Prune(); err != nil || pruned != 2 {
+		t.Errorf("pruned %d deliveries, want 2: %v", pruned, err)
+	}
+	if left := webhookDeliveries(t); len(left) != 2 || left[0].Status != model.WebhookPending {
+		t.Errorf("the deliveries left are %+v", left)
+	}
+}
+
+func TestInboundWebhookEvents(t *testing.T) {
+	receiver := newWebhookReceiver(t)
+	webhookTestDB(t, Webhook{Name: "billing", URL: receiver.URL, Enable: true})
+	var s InboundService
+	inbound := exportTestInbounds[1]
+	inbound.Tag = InboundTag(inbound.Listen, inbound.Port)
+	if _, _, err := s.AddInbound(&inbound); err != nil {
+		t.Fatal(err)
+	}
+	waitWebhooks(t)
+
+	received := receiver.received()
+	types := []string{}
+	for _, event := range received {
+		types = append(types, event.Type)
+		data, _ := json.Marshal(event.Data)
+		// The snapshots have no credentials of the clients
+		if event.Type == WebhookInboundCreated && (strings.Contains(string(data), "0f0c2d7b") || strings.Contains(string(data), "settings")) {
+			t.Errorf("the inbound snapshot has the settings: %s", data)
+		}
+	}
+	if strings.Join(types, ",") != "inbound.created,client.created,client.created" {
+		t.Errorf("the events are %v", types)
+	}
+}
@@ -0,0 +1,173 @@
+package service
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"hash"
+	"net"
+	"time"
+
+	"x-ui/util/common"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	wireguardConstruction = "Noise_IKpsk2_25519_ChaChaPoly_BLAKE2s"
+	wireguardIdentifier   = "WireGuard v1 zx2c4 Jason@zx2c4.com"
+	wireguardLabelMac1    = "mac1----"
+	// wireguardInitiationSize and wireguardResponseSize are the sizes of the
+	// handshake messages
+	wireguardInitiationSize = 148
+	wireguardResponseSize   = 92
+)
+
+// newWireguardKeyPair generates a WireGuard key pair, in the encoding of "wg genkey".
+func newWireguardKeyPair() (string, string, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	encoding := base64.StdEncoding
+	return encoding.EncodeToString(key.Bytes()), encoding.EncodeToString(key.PublicKey().Bytes()), nil
+}
+
+func wireguardHash(data ...[]byte) []byte {
+	h, _ := blake2s.New256(nil)
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+func wireguardHMAC(key []byte, data ...[]byte) []byte {
+	mac := hmac.New(func() hash.Hash {
+		h, _ := blake2s.New256(nil)
+		return h
+	}, key)
+	for _, d := range data {
+		mac.Write(d)
+	}
+	return mac.Sum(nil)
+}
+
+// wireguardKDF2 derives a new chaining key and a key from the chaining key.
+func wireguardKDF2(chainingKey []byte, input []byte) ([]byte, []byte) {
+	t0 := wireguardHMAC(chainingKey, input)
+	t1 := wireguardHMAC(t0, []byte{1})
+	t2 := wireguardHMAC(t0, t1, []byte{2})
+	return t1, t2
+}
+
+func wireguardSeal(key []byte, plaintext []byte, ad []byte) []byte {
+	aead, _ := chacha20poly1305.New(key)
+	return aead.Seal(nil, make([]byte, chacha20poly1305.NonceSize), plaintext, ad)
+}
+
+// tai64n returns the time in the TAI64N format WireGuard timestamps handshakes in.
+func tai64n(t time.Time) []byte {
+	timestamp := make([]byte, 12)
+	binary.BigEndian.PutUint64(timestamp, uint64(0x400000000000000a+t.Unix()))
+	binary.BigEndian.PutUint32(timestamp[8:], uint32(t.Nanosecond()))
+	return timestamp
+}
+
+// newWireguardInitiation returns a handshake initiation from privateKey to
+// peerKey, with sender as the index of the initiator. Its reserved bytes are
+// those some servers, like the ones of WARP, tell clients apart by.
+func newWireguardInitiation(privateKey *ecdh.PrivateKey, peerKey *ecdh.PublicKey, sender uint32, reserved []byte) ([]byte, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	chainingKey := wireguardHash([]byte(wireguardConstruction))
+	h := wireguardHash(chainingKey, []byte(wireguardIdentifier))
+	h = wireguardHash(h, peerKey.Bytes())
+
+	msg := make([]byte, wireguardInitiationSize)
+	msg[0] = 1
+	copy(msg[1:4], reserved)
+	binary.LittleEndian.PutUint32(msg[4:8], sender)
+
+	chainingKey = wireguardHMAC(wireguardHMAC(chainingKey, ephemeral.PublicKey().Bytes()), []byte{1})
+	copy(msg[8:40], ephemeral.PublicKey().Bytes())
+	h = wireguardHash(h, msg[8:40])
+
+	shared, err := ephemeral.ECDH(peerKey)
+	if err != nil {
+		return nil, err
+	}
+	chainingKey, key := wireguardKDF2(chainingKey, shared)
+	static := wireguardSeal(key, privateKey.PublicKey().Bytes(), h)
+	copy(msg[40:88], static)
+	h = wireguardHash(h, static)
+
+	shared, err = privateKey.ECDH(peerKey)
+	if err != nil {
+		return nil, err
+	}
+	_, key = wireguardKDF2(chainingKey, shared)
+	copy(msg[88:116], wireguardSeal(key, tai64n(time.Now()), h))
+
+	mac, _ := blake2s.New128(wireguardHash([]byte(wireguardLabelMac1), peerKey.Bytes()))
+	mac.Write(msg[:116])
+	copy(msg[116:132], mac.Sum(nil))
+	return msg, nil
+}
+
+// wireguardHandshake sends a handshake initiation to a WireGuard endpoint and
+// waits for its response, which the endpoint only sends if it knows the key.
+func wireguardHandshake(endpoint string, privateKey string, peerKey string, reserved []byte, timeout time.Duration) error {
+	privateBytes, err := base64.StdEncoding.DecodeString(privateKey)
+	if err != nil {
+		return common.NewError("the private key is not valid base64:", err)
+	}
+	private, err := ecdh.X25519().NewPrivateKey(privateBytes)
+	if err != nil {
+		return common.NewError("the private key is not valid:", err)
+	}
+	peerBytes, err := base64.StdEncoding.DecodeString(peerKey)
+	if err != nil {
+		return common.NewError("the public key of the peer is not valid base64:", err)
+	}
+	peer, err := ecdh.X25519().NewPublicKey(peerBytes)
+	if err != nil {
+		return common.NewError("the public key of the peer is not valid:", err)
+	}
+
+	index := make([]byte, 4)
+	if _, err := rand.Read(index); err != nil {
+		return err
+	}
+	sender := binary.LittleEndian.Uint32(index)
+	msg, err := newWireguardInitiation(private, peer, sender, reserved)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.DialTimeout("udp", endpoint, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write(msg); err != nil {
+		return err
+	}
+	response := make([]byte, 2*wireguardResponseSize)
+	for {
+		n, err := conn.Read(response)
+		if err != nil {
+			return common.NewError("no handshake response from", endpoint+":", err)
+		}
+		// A response has type 2 and our index as its receiver
+		if n == wireguardResponseSize && response[0] == 2 && bytes.Equal(response[8:12], index) {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,417 @@
+package service
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"x-ui/database/model"
+	"x-ui/util/common"
+	"x-ui/util/random"
+
+	"github.com/goccy/go-json"
+)
+
+// defaultWireguardSubnet is the subnet the addresses of the peers of a
+// WireGuard inbound are taken from when it sets none; the first address of it
+// is the server's.
+const defaultWireguardSubnet = "10.0.0.0/24"
+
+// wireguardDNS are the DNS servers the configs of the peers point at.
+const wireguardDNS = "1.1.1.1, 1.0.0.1"
+
+// decodeWireguardKey decodes a WireGuard key, the base64 of 32 bytes.
+func decodeWireguardKey(key string) ([]byte, error) {
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(decoded) != 32 {
+		return nil, common.NewError("must be the base64 of a key of 32 bytes")
+	}
+	return decoded, nil
+}
+
+// wireguardPublicKey returns the public key of a WireGuard private key.
+func wireguardPublicKey(privateKey string) (string, error) {
+	decoded, err := decodeWireguardKey(privateKey)
+	if err != nil {
+		return "", err
+	}
+	key, err := ecdh.X25519().NewPrivateKey(decoded)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key.PublicKey().Bytes()), nil
+}
+
+// newWireguardPresharedKey generates a WireGuard preshared key, in the encoding
+// of "wg genpsk".
+func newWireguardPresharedKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// wireguardSubnet returns the subnet of the settings of a WireGuard inbound.
+func wireguardSubnet(settings map[string]any) (netip.Prefix, error) {
+	subnet, _ := settings["subnet"].(string)
+	if strings.TrimSpace(subnet) == "" {
+		subnet = defaultWireguardSubnet
+	}
+	prefix, err := netip.ParsePrefix(strings.TrimSpace(subnet))
+	if err != nil {
+		return netip.Prefix{}, common.NewErrorf("the subnet %q of the peers is not a CIDR", subnet)
+	}
+	prefix = prefix.Masked()
+	if prefix.Addr().BitLen()-prefix.Bits() < 2 {
+		return netip.Prefix{}, common.NewErrorf("the subnet %s has no room for peers", prefix)
+	}
+	return prefix, nil
+}
+
+// peerAddress parses an allowed IP of a peer, a bare address being the host
+// route of it.
+func peerAddress(value string) (netip.Prefix, error) {
+	value = strings.TrimSpace(value)
+	if !strings.Contains(value, "/") {
+		addr, err := netip.ParseAddr(value)
+		if err != nil {
+			return netip.Prefix{}, common.NewErrorf("allowed IP %q is not an address", value)
+		}
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(value)
+	if err != nil {
+		return netip.Prefix{}, common.NewErrorf("allowed IP %q is not a CIDR", value)
+	}
+	return prefix.Masked(), nil
+}
+
+// peerAllowedIPs returns the allowed IPs of a client as stored in the settings.
+func peerAllowedIPs(client map[string]any) ([]netip.Prefix, error) {
+	var values []string
+	switch items := client["allowedIPs"].(type) {
+	case nil:
+	case string:
+		values = strings.Split(items, ",")
+	case []string:
+		values = items
+	case []any:
+		for _, item := range items {
+			value, ok := item.(string)
+			if !ok {
+				return nil, common.NewError("the allowed IPs of a peer must be strings")
+			}
+			values = append(values, value)
+		}
+	default:
+		return nil, common.NewError("the allowed IPs of a peer must be a list")
+	}
+	prefixes := make([]netip.Prefix, 0, len(values))
+	for _, value := range values {
+		if strings.TrimSpace(value) == "" {
+			continue
+		}
+		prefix, err := peerAddress(value)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+// fillWireguardPeer gives a client of a WireGuard inbound the keys it lacks and
+// checks those it has: a peer with a private key gets its public key, one with
+// none gets a new pair. It returns the allowed IPs of the client.
+func fillWireguardPeer(client map[string]any) ([]netip.Prefix, error) {
+	email, _ := client["email"].(string)
+	privateKey, _ := client["privateKey"].(string)
+	publicKey, _ := client["publicKey"].(string)
+	switch {
+	case privateKey != "":
+		derived, err := wireguardPublicKey(privateKey)
+		if err != nil {
+			return nil, common.NewErrorf("the private key of peer %s %v", email, err)
+		}
+		if publicKey != "" && publicKey != derived {
+			return nil, common.NewErrorf("the public key of peer %s is not the one of its private key", email)
+		}
+		client["publicKey"] = derived
+	case publicKey != "":
+		// A peer whose private key stays on its device has no config
+		if _, err := decodeWireguardKey(publicKey); err != nil {
+			return nil, common.NewErrorf("the public key of peer %s %v", email, err)
+		}
+	default:
+		var err error
+		if client["privateKey"], client["publicKey"], err = newWireguardKeyPair(); err != nil {
+			return nil, err
+		}
+	}
+	if psk, _ := client["preSharedKey"].(string); psk != "" {
+		if _, err := decodeWireguardKey(psk); err != nil {
+			return nil, common.NewErrorf("the preshared key of peer %s %v", email, err)
+		}
+	} else {
+		delete(client, "preSharedKey")
+	}
+	if keepAlive, ok := client["keepAlive"].(float64); ok && (keepAlive < 0 || keepAlive > 65535) {
+		return nil, common.NewErrorf("the keepalive of peer %s must be between 0 and 65535 seconds", email)
+	}
+	allowedIPs, err := peerAllowedIPs(client)
+	if err != nil {
+		return nil, common.NewErrorf("peer %s: %v", email, err)
+	}
+	return allowedIPs, nil
+}
+
+// fillWireguardPeers fills the keys of clients and gives those without an
+// allowed IP the next free address of subnet. The addresses of the peers of
+// taken, the clients already in the inbound, are not given out again.
+func fillWireguardPeers(clients []any, subnet netip.Prefix, taken []any) error {
+	used := map[netip.Addr]string{
+		// The first address of the subnet is the server's
+		subnet.Addr().Next(): "the server",
+	}
+	for _, item := range taken {
+		client, ok := item.(map[string]any)
+		if !ok {
+			continue
+		}
+		email, _ := client["email"].(string)
+		allowedIPs, _ := peerAllowedIPs(client)
+		for _, prefix := range allowedIPs {
+			if prefix.IsSingleIP() {
+				used[prefix.Addr()] = email
+			}
+		}
+	}
+
+	var unassigned []map[string]any
+	for _, item := range clients {
+		client, ok := item.(map[string]any)
+		if !ok {
+			continue
+		}
+		allowedIPs, err := fillWireguardPeer(client)
+		if err != nil {
+			return err
+		}
+		if len(allowedIPs) == 0 {
+			unassigned = append(unassigned, client)
+			continue
+		}
+		email, _ := client["email"].(string)
+		values := make([]string, 0, len(allowedIPs))
+		for _, prefix := range allowedIPs {
+			if prefix.IsSingleIP() {
+				if other, ok := used[prefix.Addr()]; ok {
+					return common.NewErrorf("peer %s has the address %s of %s", email, prefix.Addr(), other)
+				}
+				used[prefix.Addr()] = email
+			}
+			values = append(values, prefix.String())
+		}
+		client["allowedIPs"] = values
+	}
+
+	next := subnet.Addr().Next()
+	for _, client := range unassigned {
+		// The network and, for IPv4, the broadcast address are not given out
+		for ; subnet.Contains(next); next = next.Next() {
+			if _, ok := used[next]; ok {
+				continue
+			}
+			if next.Is4() && !subnet.Contains(next.Next()) {
+				next = next.Next()
+			}
+			break
+		}
+		if !subnet.Contains(next) {
+			return common.NewErrorf("the subnet %s of the peers has no free address left", subnet)
+		}
+		used[next] = ""
+		client["allowedIPs"] = []string{netip.PrefixFrom(next, next.BitLen()).String()}
+	}
+	return nil
+}
+
+// legacyWireguardPeers turns the peers of a WireGuard inbound of the panel of
+// before its clients into clients, with random emails.
+func legacyWireguardPeers(settings map[string]any) {
+	peers, ok := settings["peers"].([]any)
+	delete(settings, "peers")
+	if _, hasClients := settings["clients"]; hasClients || !ok {
+		return
+	}
+	clients := make([]any, 0, len(peers))
+	for _, item := range peers {
+		peer, ok := item.(map[string]any)
+		if !ok {
+			continue
+		}
+		if _, ok := peer["email"]; !ok {
+			peer["email"] = strings.ToLower(random.Seq(8))
+		}
+		if _, ok := peer["enable"]; !ok {
+			peer["enable"] = true
+		}
+		clients = append(clients, peer)
+	}
+	settings["clients"] = clients
+}
+
+// fillWireguardSettings completes the settings of a WireGuard inbound: the
+// server gets a private key if it has none and its peers, the clients, get
+// their keys and addresses of the subnet.
+func fillWireguardSettings(settings string) (string, error) {
+	var parsed map[string]any
+	if err := json.Unmarshal([]byte(settings), &parsed); err != nil {
+		return settings, nil
+	}
+	if secretKey, _ := parsed["secretKey"].(string); secretKey == "" {
+		var err error
+		if parsed["secretKey"], _, err = newWireguardKeyPair(); err != nil {
+			return "", err
+		}
+	} else if _, err := wireguardPublicKey(secretKey); err != nil {
+		return "", common.NewError("the private key of the inbound", err)
+	}
+	subnet, err := wireguardSubnet(parsed)
+	if err != nil {
+		return "", err
+	}
+	parsed["subnet"] = subnet.String()
+	legacyWireguardPeers(parsed)
+	clients, _ := parsed["clients"].([]any)
+	if err := fillWireguardPeers(clients, subnet, nil); err != nil {
+		return "", err
+	}
+	filled, err := json.MarshalIndent(parsed, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(filled), nil
+}
+
+// fillWireguardClients fills the keys and addresses of the clients of settings
+// added to a WireGuard inbound, next to those it has.
+func fillWireguardClients(settings string, inbound *model.Inbound) (string, error) {
+	var parsed, inboundSettings map[string]any
+	if err := json.Unmarshal([]byte(settings), &parsed); err != nil {
+		return settings, nil
+	}
+	if err := json.Unmarshal([]byte(inbound.Settings), &inboundSettings); err != nil {
+		return "", err
+	}
+	subnet, err := wireguardSubnet(inboundSettings)
+	if err != nil {
+		return "", err
+	}
+	clients, _ := parsed["clients"].([]any)
+	taken, _ := inboundSettings["clients"].([]any)
+	if err := fillWireguardPeers(clients, subnet, taken); err != nil {
+		return "", err
+	}
+	filled, err := json.MarshalIndent(parsed, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(filled), nil
+}
+
+// regenerateWireguardKeys gives the server and all the peers of the settings of
+// a WireGuard inbound new keys, keeping their addresses; the preshared keys are
+// renewed for the peers that had one.
+func regenerateWireguardKeys(settings map[string]any) error {
+	legacyWireguardPeers(settings)
+	var err error
+	if settings["secretKey"], _, err = newWireguardKeyPair(); err != nil {
+		return err
+	}
+	clients, _ := settings["clients"].([]any)
+	for _, item := range clients {
+		client, ok := item.(map[string]any)
+		if !ok {
+			continue
+		}
+		if client["privateKey"], client["publicKey"], err = newWireguardKeyPair(); err != nil {
+			return err
+		}
+		if psk, _ := client["preSharedKey"].(string); psk != "" {
+			if client["preSharedKey"], err = newWireguardPresharedKey(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// WireguardConf returns the wg-quick config of the peer of a WireGuard inbound
+// with the email, to reach the server at host unless the inbound listens on an
+// address of its own.
+func (s *InboundService) WireguardConf(inbound *model.Inbound, email string, host string) (string, error) {
+	if inbound.Protocol != model.WireGuard {
+		return "", common.NewErrorf("inbound %s is not a WireGuard inbound", inbound.Remark)
+	}
+	if inbound.Listen != "" && inbound.Listen != "0.0.0.0" && inbound.Listen != "::" {
+		host = inbound.Listen
+	}
+	var settings struct {
+		Mtu       int            `json:"mtu"`
+		SecretKey string         `json:"secretKey"`
+		Clients   []model.Client `json:"clients"`
+	}
+	if err := json.Unmarshal([]byte(inbound.Settings), &settings); err != nil {
+		return "", err
+	}
+	serverKey, err := wireguardPublicKey(settings.SecretKey)
+	if err != nil {
+		return "", common.NewError("the private key of the inbound", err)
+	}
+	for _, client := range settings.Clients {
+		if client.Email != email {
+			continue
+		}
+		if client.PrivateKey == "" {
+			return "", common.NewErrorf("the private key of peer %s is not known to the panel", email)
+		}
+		addresses := make([]string, 0, len(client.AllowedIPs))
+		for _, allowedIP := range client.AllowedIPs {
+			if prefix, err := peerAddress(allowedIP); err == nil && prefix.IsSingleIP() {
+				addresses = append(addresses, allowedIP)
+			}
+		}
+		if len(addresses) == 0 {
+			return "", common.NewErrorf("peer %s has no address", email)
+		}
+
+		var conf strings.Builder
+		conf.WriteString("[Interface]\n")
+		fmt.Fprintf(&conf, "PrivateKey = %s\n", client.PrivateKey)
+		fmt.Fprintf(&conf, "Address = %s\n", strings.Join(addresses, ", "))
+		fmt.Fprintf(&conf, "DNS = %s\n", wireguardDNS)
+		if settings.Mtu > 0 {
+			fmt.Fprintf(&conf, "MTU = %d\n", settings.Mtu)
+		}
+		fmt.Fprintf(&conf, "\n# %s\n", inbound.Remark+"-"+email)
+		conf.WriteString("[Peer]\n")
+		fmt.Fprintf(&conf, "PublicKey = %s\n", serverKey)
+		if client.PreSharedKey != "" {
+			fmt.Fprintf(&conf, "PresharedKey = %s\n", client.PreSharedKey)
+		}
+		conf.WriteString("AllowedIPs = 0.0.0.0/0, ::/0\n")
+		fmt.Fprintf(&conf, "Endpoint = %s\n", net.JoinHostPort(host, strconv.Itoa(inbound.Port)))
+		if client.KeepAlive > 0 {
+			fmt.Fprintf(&conf, "PersistentKeepalive = %d\n", client.KeepAlive)
+		}
+		return conf.String(), nil
+	}
+	return "", common.NewErrorf("inbound %s has no peer %s", inbound.Remark, email)
+}
@@ -4,11 +4,18 @@ import (
 	"encoding/json"
 	"errors"
 	"runtime"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
+	"x-ui/database/model"
 	"x-ui/logger"
+	"x-ui/util/common"
 	"x-ui/xray"
 
+	"github.com/shirou/gopsutil/v4/process"
 	"go.uber.org/atomic"
 )
 
@@ -16,14 +23,24 @@ var (
 	p                 *xray.Process
 	lock              sync.Mutex
 	isNeedXrayRestart atomic.Bool // Indicates that restart was requested for Xray
+	// isRestartRequired is a restart the config can't tell, for the files Xray
+	// reads, like the certificates; it is cleared only by restarting Xray
+	isRestartRequired atomic.Bool
 	isManuallyStopped atomic.Bool // Indicates that Xray was stopped manually from the panel
-	result            string
+	// lastRestartRequest is the restart request of another process seen last
+	lastRestartRequest atomic.String
+	restartRequestSeen atomic.Bool
+	result             string
 )
 
 type XrayService struct {
-	inboundService InboundService
-	settingService SettingService
-	xrayAPI        xray.XrayAPI
+	inboundService  InboundService
+	outboundService OutboundService
+	routingService  RoutingService
+	balancerService BalancerService
+	settingService  SettingService
+	webhookService  WebhookService
+	xrayAPI         xray.XrayAPI
 }
 
 func (s *XrayService) IsXrayRunning() bool {
@@ -68,6 +85,13 @@ func (s *XrayService) GetXrayResult() string {
 	return result
 }
 
+func (s *XrayService) GetXrayUptime() uint64 {
+	if !s.IsXrayRunning() {
+		return 0
+	}
+	return p.GetUptime()
+}
+
 func (s *XrayService) GetXrayVersion() string {
 	if p == nil {
 		return "Unknown"
@@ -75,6 +99,36 @@ func (s *XrayService) GetXrayVersion() string {
 	return p.GetVersion()
 }
 
+// GetXrayConfigHash returns the hash of the config Xray runs and when it was
+// generated, in milliseconds; empty if Xray was never started.
+func (s *XrayService) GetXrayConfigHash() (string, int64) {
+	if p == nil {
+		return "", 0
+	}
+	return p.GetConfigHash(), p.GetConfigGeneratedAt().UnixMilli()
+}
+
+// GetXrayMemory returns the resident memory of the Xray process, 0 if it
+// isn't running or can't be read.
+func (s *XrayService) GetXrayMemory() uint64 {
+	if p == nil {
+		return 0
+	}
+	pid := p.GetPid()
+	if pid == 0 {
+		return 0
+	}
+	proc, err := process.NewProcess(int32(pid))
+	if err != nil {
+		return 0
+	}
+	memInfo, err := proc.MemoryInfo()
+	if err != nil {
+		return 0
+	}
+	return memInfo.RSS
+}
+
 func RemoveIndex(s []any, index int) []any {
 	return append(s[:index], s[index+1:]...)
 }
@@ -84,27 +138,88 @@ func (s *XrayService) GetXrayConfig() (*xray.Config, error) {
 	if err != nil {
 		return nil, err
 	}
+	rules, err := s.routingService.GetRules()
+	if err != nil {
+		return nil, err
+	}
+	return s.genXrayConfig(templateConfig, rules)
+}
 
+// testRoutingRules checks with "xray -test" the config the panel would generate
+// with rules as its routing rules.
+func (s *XrayService) testRoutingRules(rules []model.RoutingRule) error {
+	templateConfig, err := s.settingService.GetXrayConfigTemplate()
+	if err != nil {
+		return err
+	}
+	return s.testXrayConfig(templateConfig, rules)
+}
+
+// testXrayTemplate checks with "xray -test" the config the panel would generate
+// from templateConfig.
+func (s *XrayService) testXrayTemplate(templateConfig string) error {
+	rules, err := s.routingService.GetRules()
+	if err != nil {
+		return err
+	}
+	return s.testXrayConfig(templateConfig, rules)
+}
+
+// testXrayConfig checks a config before it is saved. Without the xray binary
+// nothing is checked.
+func (s *XrayService) testXrayConfig(templateConfig string, rules []model.RoutingRule) error {
+	xrayConfig, err := s.genXrayConfig(templateConfig, rules)
+	if err != nil {
+		return err
+	}
+	err = xray.TestConfig(xrayConfig)
+	if errors.Is(err, xray.ErrNoBinary) {
+		logger.Warning("the xray config is not checked:", err)
+		return nil
+	}
+	return err
+}
+
+func (s *XrayService) genXrayConfig(templateConfig string, rules []model.RoutingRule) (*xray.Config, error) {
 	xrayConfig := &xray.Config{}
-	err = json.Unmarshal([]byte(templateConfig), xrayConfig)
+	err := json.Unmarshal([]byte(templateConfig), xrayConfig)
 	if err != nil {
 		return nil, err
 	}
+	if err := s.outboundService.addOutbounds(xrayConfig); err != nil {
+		return nil, err
+	}
+	if err := addRoutingRules(xrayConfig, rules); err != nil {
+		return nil, err
+	}
+	if err := s.balancerService.addBalancers(xrayConfig); err != nil {
+		return nil, err
+	}
 
-	s.inboundService.AddTraffic(nil, nil)
+	s.inboundService.AddTraffic(nil, nil, nil)
 
 	inbounds, err := s.inboundService.GetAllInbounds()
 	if err != nil {
 		return nil, err
 	}
+	hasLimitIp := false
+	// Whether an inbound is only counted as a whole or has a quota of its own
+	inboundStats := false
+	// The inbounds and outbounds clients are sent to, in order, with the
+	// emails of those clients
+	var clientRoutes []clientOutbound
+	routeEmails := map[clientOutbound][]string{}
 	for _, inbound := range inbounds {
-		if !inbound.Enable {
+		if !inbound.Enable || bindErrorOf(inbound) != nil {
 			continue
 		}
 		// get settings clients
 		settings := map[string]any{}
 		json.Unmarshal([]byte(inbound.Settings), &settings)
 		clients, ok := settings["clients"].([]any)
+		if !ok || inbound.Total > 0 {
+			inboundStats = true
+		}
 		if ok {
 			// check users active or not
 			clientStats := inbound.ClientStats
@@ -131,6 +246,24 @@ func (s *XrayService) GetXrayConfig() (*xray.Config, error) {
 						continue
 					}
 				}
+				if limitIp, ok := c["limitIp"].(float64); ok && limitIp > 0 {
+					hasLimitIp = true
+				}
+				// WireGuard peers carry no email for routing rules to match
+				if outboundTag, _ := c["outboundTag"].(string); outboundTag != "" && inbound.Protocol != model.WireGuard {
+					route := clientOutbound{inbound.Tag, outboundTag}
+					if _, ok := routeEmails[route]; !ok {
+						clientRoutes = append(clientRoutes, route)
+					}
+					email, _ := c["email"].(string)
+					routeEmails[route] = append(routeEmails[route], email)
+				}
+				// WireGuard clients keep their keys, GenXrayInboundConfig makes
+				// them peers
+				if inbound.Protocol == model.WireGuard {
+					final_clients = append(final_clients, any(c))
+					continue
+				}
 				for key := range c {
 					if key != "email" && key != "id" && key != "password" && key != "flow" && key != "method" {
 						delete(c, key)
@@ -142,6 +275,13 @@ func (s *XrayService) GetXrayConfig() (*xray.Config, error) {
 				final_clients = append(final_clients, any(c))
 			}
 
+			// Clients go by email, so that the same clients make the same config
+			// whatever order they were stored in
+			slices.SortStableFunc(final_clients, func(a, b any) int {
+				emailA, _ := a.(map[string]any)["email"].(string)
+				emailB, _ := b.(map[string]any)["email"].(string)
+				return strings.Compare(emailA, emailB)
+			})
 			settings["clients"] = final_clients
 			modifiedSettings, err := json.MarshalIndent(settings, "", "  ")
 			if err != nil {
@@ -162,6 +302,7 @@ func (s *XrayService) GetXrayConfig() (*xray.Config, error) {
 			if ok1 || ok2 {
 				if ok1 {
 					delete(tlsSettings, "settings")
+					resolveAcmeCertificates(tlsSettings)
 				} else if ok2 {
 					delete(realitySettings, "settings")
 				}
@@ -179,31 +320,123 @@ func (s *XrayService) GetXrayConfig() (*xray.Config, error) {
 		inboundConfig := inbound.GenXrayInboundConfig()
 		xrayConfig.InboundConfigs = append(xrayConfig.InboundConfigs, *inboundConfig)
 	}
+	if hasLimitIp {
+		xrayConfig.LogConfig = withAccessLog(xrayConfig.LogConfig)
+	}
+	if inboundStats {
+		xrayConfig.Policy = withInboundStats(xrayConfig.Policy)
+	}
+	if err := addClientOutboundRules(xrayConfig, clientRoutes, routeEmails); err != nil {
+		return nil, err
+	}
 	return xrayConfig, nil
 }
 
-func (s *XrayService) GetXrayTraffic() ([]*xray.Traffic, []*xray.ClientTraffic, error) {
+// withInboundStats turns on the traffic counters of the inbounds in the policy
+// of Xray if they are off; the inbounds without clients are only counted by
+// them, and the quotas of the inbounds are enforced from them.
+func withInboundStats(policyConfig []byte) []byte {
+	policy := map[string]any{}
+	json.Unmarshal(policyConfig, &policy)
+	system, _ := policy["system"].(map[string]any)
+	if system == nil {
+		system = map[string]any{}
+	}
+	uplink, _ := system["statsInboundUplink"].(bool)
+	downlink, _ := system["statsInboundDownlink"].(bool)
+	if uplink && downlink {
+		return policyConfig
+	}
+	system["statsInboundUplink"] = true
+	system["statsInboundDownlink"] = true
+	policy["system"] = system
+	data, err := json.MarshalIndent(policy, "", "  ")
+	if err != nil {
+		return policyConfig
+	}
+	return data
+}
+
+// withAccessLog turns on the access log in the log config of Xray if it is off;
+// IP limits are enforced from it.
+func withAccessLog(logConfig []byte) []byte {
+	settings := map[string]any{}
+	json.Unmarshal(logConfig, &settings)
+	if access, _ := settings["access"].(string); access != "" && access != "none" {
+		return logConfig
+	}
+	settings["access"] = xray.GetDefaultAccessLogPath()
+	data, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return logConfig
+	}
+	return data
+}
+
+// GetXrayTraffic returns the traffic made since the counters of Xray were last
+// counted, with the snapshot of the counters to give AddTraffic along with it.
+func (s *XrayService) GetXrayTraffic() ([]*xray.Traffic, []*xray.ClientTraffic, *xray.CounterSnapshot, error) {
 	if !s.IsXrayRunning() {
 		err := errors.New("xray is not running")
 		logger.Debug("Attempted to fetch Xray traffic, but Xray is not running:", err)
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 	apiPort := p.GetAPIPort()
 	s.xrayAPI.Init(apiPort)
 	defer s.xrayAPI.Close()
 
-	traffic, clientTraffic, err := s.xrayAPI.GetTraffic(true)
+	counters, uptime, err := s.xrayAPI.GetCounters()
 	if err != nil {
 		logger.Debug("Failed to fetch Xray traffic:", err)
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
-	return traffic, clientTraffic, nil
+	return countTraffic(counters, uptime)
+}
+
+// PingXrayAPI checks that the running Xray answers on its API port.
+func (s *XrayService) PingXrayAPI(timeout time.Duration) error {
+	if !s.IsXrayRunning() {
+		return errors.New("xray is not running")
+	}
+	if err := s.xrayAPI.Init(p.GetAPIPort()); err != nil {
+		return err
+	}
+	defer s.xrayAPI.Close()
+	return s.xrayAPI.Ping(timeout)
+}
+
+// GetOutboundStatus returns the latest probes of the observatory of the running
+// Xray.
+func (s *XrayService) GetOutboundStatus(timeout time.Duration) ([]*xray.OutboundStatus, error) {
+	if !s.IsXrayRunning() {
+		return nil, errors.New("xray is not running")
+	}
+	if err := s.xrayAPI.Init(p.GetAPIPort()); err != nil {
+		return nil, err
+	}
+	defer s.xrayAPI.Close()
+	return s.xrayAPI.GetOutboundStatus(timeout)
 }
 
 func (s *XrayService) RestartXray(isForce bool) error {
 	lock.Lock()
 	defer lock.Unlock()
+	resetCrashLoop()
+	return s.restartXray(isForce)
+}
+
+// restartXray restarts Xray with the generated config if it changed, or if
+// isForce. A running Xray keeps its config while a changeset is open, the
+// changeset applies it when committed. Called with lock held.
+func (s *XrayService) restartXray(isForce bool) error {
 	logger.Debug("restart Xray, force:", isForce)
+	if open := OpenChangeset(); open != nil && s.IsXrayRunning() {
+		if isForce {
+			return common.NewErrorf("changeset %q (%s) is open, commit or discard it first", open.Name, open.Id)
+		}
+		logger.Debug("Xray is restarted when the changeset is committed")
+		return nil
+	}
 	isManuallyStopped.Store(false)
 
 	xrayConfig, err := s.GetXrayConfig()
@@ -211,22 +444,42 @@ func (s *XrayService) RestartXray(isForce bool) error {
 		return err
 	}
 
+	binary := s.settingService.GetXrayBinary()
+	xray.SetBinary(binary)
+
 	if s.IsXrayRunning() {
-		if !isForce && p.GetConfig().Equals(xrayConfig) && !isNeedXrayRestart.Load() {
-			logger.Debug("It does not need to restart Xray")
-			return nil
+		if !isForce && !isRestartRequired.Load() && p.GetBinary().Equals(binary) {
+			// A change that leaves the config as Xray runs it needs no restart,
+			// even if it asked for one
+			if configUnchanged(xrayConfig) {
+				isNeedXrayRestart.Store(false)
+				logger.Info("config unchanged, reload skipped")
+				return nil
+			}
+			if !isNeedXrayRestart.Load() && usersApplied(xrayConfig) {
+				logger.Debug("It does not need to restart Xray")
+				return nil
+			}
+		}
+		// A config Xray rejects would take down the running one, it stays up
+		if err := xray.TestConfig(xrayConfig); err != nil && !errors.Is(err, xray.ErrNoBinary) {
+			xray.SetBinary(p.GetBinary())
+			return err
 		}
+		p.ExpectExit()
 		p.Stop()
+		s.waitXrayStopped()
 	}
 
-	p = xray.NewProcess(xrayConfig)
-	result = ""
-	err = p.Start()
-	if err != nil {
-		return err
+	usersNeedRestart.Store(false)
+	isRestartRequired.Store(false)
+	// With the old Xray stopped, a port that isn't free is another program's
+	if s.leaveOutPortConflicts() {
+		if xrayConfig, err = s.GetXrayConfig(); err != nil {
+			return err
+		}
 	}
-
-	return nil
+	return s.startXray(xrayConfig)
 }
 
 func (s *XrayService) StopXray() error {
@@ -235,6 +488,7 @@ func (s *XrayService) StopXray() error {
 	isManuallyStopped.Store(true)
 	logger.Debug("Attempting to stop Xray...")
 	if s.IsXrayRunning() {
+		p.ExpectExit()
 		return p.Stop()
 	}
 	return errors.New("xray is not running")
@@ -244,11 +498,38 @@ func (s *XrayService) SetToNeedRestart() {
 	isNeedXrayRestart.Store(true)
 }
 
+// SetToRequireRestart has Xray restarted even if its config stays the same, for
+// a change of the files it reads.
+func (s *XrayService) SetToRequireRestart() {
+	isRestartRequired.Store(true)
+	isNeedXrayRestart.Store(true)
+}
+
 func (s *XrayService) IsNeedRestartAndSetFalse() bool {
 	return isNeedXrayRestart.CompareAndSwap(true, false)
 }
 
-// Check if Xray is not running and wasn't stopped manually, i.e. crashed
+// RequestRestart asks the panel, from another process such as the command
+// line, to apply the changes it made to the database by restarting Xray.
+func (s *XrayService) RequestRestart() error {
+	return s.settingService.SetXrayRestartRequest(strconv.FormatInt(time.Now().UnixNano(), 36))
+}
+
+// IsRestartRequested tells if another process requested a restart since the
+// last call. The first call only takes note of the current request.
+func (s *XrayService) IsRestartRequested() bool {
+	request, err := s.settingService.GetXrayRestartRequest()
+	if err != nil {
+		logger.Warning("get the restart request of xray failed:", err)
+		return false
+	}
+	seen := restartRequestSeen.Swap(true)
+	return lastRestartRequest.Swap(request) != request && seen
+}
+
+// Check if Xray is not running and wasn't stopped manually, i.e. crashed. An
+// Xray the panel stopped to restart it, for a new config or binary, exits as
+// expected and didn't crash either.
 func (s *XrayService) DidXrayCrash() bool {
-	return !s.IsXrayRunning() && !isManuallyStopped.Load()
+	return !s.IsXrayRunning() && !isManuallyStopped.Load() && (p == nil || !p.ExitExpected())
 }
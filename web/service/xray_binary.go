@@ -0,0 +1,77 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"x-ui/util/common"
+	"x-ui/web/entity"
+	"x-ui/xray"
+)
+
+// xrayConfigArgs are the arguments the panel gives Xray itself, they can't be
+// among the extra ones.
+var xrayConfigArgs = []string{"-c", "-config", "--config", "-test", "--test", "-version", "--version"}
+
+// GetXrayBinary returns how the settings have Xray run.
+func (s *SettingService) GetXrayBinary() xray.Binary {
+	binary := xray.Binary{}
+	binary.Path, _ = s.GetXrayBinaryPath()
+	binary.AssetDir, _ = s.GetXrayAssetDir()
+	binary.WorkDir, _ = s.GetXrayWorkDir()
+	args, _ := s.GetXrayArgs()
+	binary.Args = strings.Fields(args)
+	return binary
+}
+
+func checkXrayDir(name string, dir string) error {
+	if dir == "" {
+		return nil
+	}
+	if !filepath.IsAbs(dir) {
+		return common.NewErrorf("xray %s must be an absolute path: %s", name, dir)
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return common.NewErrorf("xray %s: %v", name, err)
+	}
+	if !info.IsDir() {
+		return common.NewErrorf("xray %s is not a directory: %s", name, dir)
+	}
+	return nil
+}
+
+// checkXrayBinary checks the settings of how Xray is run before they are saved:
+// the binary must run "-version" as an Xray binary, the folders must exist.
+func checkXrayBinary(allSetting *entity.AllSetting) error {
+	if path := allSetting.XrayBinaryPath; path != "" {
+		if !filepath.IsAbs(path) {
+			return common.NewErrorf("xray binary path must be an absolute path: %s", path)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return common.NewErrorf("xray binary: %v", err)
+		}
+		if !info.Mode().IsRegular() || info.Mode().Perm()&0o111 == 0 {
+			return common.NewErrorf("xray binary is not an executable file: %s", path)
+		}
+		if _, err := binaryVersion(path); err != nil {
+			return common.NewErrorf("xray binary doesn't run: %v", err)
+		}
+	}
+	if err := checkXrayDir("assets directory", allSetting.XrayAssetDir); err != nil {
+		return err
+	}
+	if err := checkXrayDir("working directory", allSetting.XrayWorkDir); err != nil {
+		return err
+	}
+	for _, arg := range strings.Fields(allSetting.XrayArgs) {
+		name, _, _ := strings.Cut(arg, "=")
+		if slices.Contains(xrayConfigArgs, name) {
+			return common.NewErrorf("xray arguments can't set %s, the panel does", name)
+		}
+	}
+	return nil
+}
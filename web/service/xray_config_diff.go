@@ -0,0 +1,223 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+
+	"x-ui/xray"
+)
+
+// ConfigDiff lists the paths of a config that a new config adds, removes or
+// changes. Paths are like "inbounds[tag=inbound-443].streamSettings.security":
+// elements of lists are named by their tag or email when they have one, by
+// their index otherwise.
+type ConfigDiff struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+	Changed []string `json:"changed"`
+}
+
+// ConfigTest is the result of checking a config with "xray -test".
+type ConfigTest struct {
+	Ok      bool   `json:"ok"`
+	Skipped bool   `json:"skipped,omitempty"`
+	Error   string `json:"error,omitempty"`
+	Output  string `json:"output,omitempty"`
+}
+
+// XrayConfigPreview is the config the panel would run Xray with, compared to the
+// one Xray runs with.
+type XrayConfigPreview struct {
+	Config  *xray.Config `json:"config"`
+	Running bool         `json:"running"`
+	Diff    ConfigDiff   `json:"diff"`
+	Test    ConfigTest   `json:"test"`
+}
+
+// configTree returns a config as the maps and lists of its JSON.
+func configTree(config *xray.Config) (any, error) {
+	if config == nil {
+		return map[string]any{}, nil
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	var tree any
+	if err := json.Unmarshal(data, &tree); err != nil {
+		return nil, err
+	}
+	return tree, nil
+}
+
+// elementKey returns the field the elements of two lists are told apart by, tag
+// or email, if every element has a different one; "" otherwise.
+func elementKey(lists ...[]any) string {
+	for _, key := range []string{"tag", "email"} {
+		unique := true
+		for _, list := range lists {
+			seen := map[string]bool{}
+			for _, element := range list {
+				object, _ := element.(map[string]any)
+				value, _ := object[key].(string)
+				if value == "" || seen[value] {
+					unique = false
+					break
+				}
+				seen[value] = true
+			}
+			if !unique {
+				break
+			}
+		}
+		if unique {
+			return key
+		}
+	}
+	return ""
+}
+
+func joinPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func (d *ConfigDiff) compare(path string, old any, new any) {
+	switch oldValue := old.(type) {
+	case map[string]any:
+		newValue, ok := new.(map[string]any)
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(oldValue)+len(newValue))
+		for key := range oldValue {
+			keys = append(keys, key)
+		}
+		for key := range newValue {
+			if _, ok := oldValue[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			oldField, inOld := oldValue[key]
+			newField, inNew := newValue[key]
+			switch {
+			case !inOld:
+				d.Added = append(d.Added, joinPath(path, key))
+			case !inNew:
+				d.Removed = append(d.Removed, joinPath(path, key))
+			default:
+				d.compare(joinPath(path, key), oldField, newField)
+			}
+		}
+		return
+	case []any:
+		newValue, ok := new.([]any)
+		if !ok {
+			break
+		}
+		d.compareLists(path, oldValue, newValue)
+		return
+	}
+	if !reflect.DeepEqual(old, new) {
+		d.Changed = append(d.Changed, path)
+	}
+}
+
+func (d *ConfigDiff) compareLists(path string, old []any, new []any) {
+	key := elementKey(old, new)
+	if key == "" {
+		for i := 0; i < len(old) || i < len(new); i++ {
+			elementPath := path + "[" + strconv.Itoa(i) + "]"
+			switch {
+			case i >= len(old):
+				d.Added = append(d.Added, elementPath)
+			case i >= len(new):
+				d.Removed = append(d.Removed, elementPath)
+			default:
+				d.compare(elementPath, old[i], new[i])
+			}
+		}
+		return
+	}
+
+	name := func(element any) string {
+		return element.(map[string]any)[key].(string)
+	}
+	elementPath := func(element any) string {
+		return fmt.Sprintf("%s[%s=%s]", path, key, name(element))
+	}
+	oldElements := map[string]any{}
+	for _, element := range old {
+		oldElements[name(element)] = element
+	}
+	newNames := map[string]bool{}
+	for _, element := range new {
+		newNames[name(element)] = true
+		if oldElement, ok := oldElements[name(element)]; ok {
+			d.compare(elementPath(element), oldElement, element)
+		} else {
+			d.Added = append(d.Added, elementPath(element))
+		}
+	}
+	for _, element := range old {
+		if !newNames[name(element)] {
+			d.Removed = append(d.Removed, elementPath(element))
+		}
+	}
+}
+
+// diffConfigs returns what applying config would change in the running config.
+func diffConfigs(running *xray.Config, config *xray.Config) (ConfigDiff, error) {
+	diff := ConfigDiff{Added: []string{}, Removed: []string{}, Changed: []string{}}
+	old, err := configTree(running)
+	if err != nil {
+		return diff, err
+	}
+	new, err := configTree(config)
+	if err != nil {
+		return diff, err
+	}
+	diff.compare("", old, new)
+	return diff, nil
+}
+
+// PreviewXrayConfig generates the config the panel would apply, checks it with
+// "xray -test" and compares it with the one Xray runs with. Nothing is applied.
+func (s *XrayService) PreviewXrayConfig() (*XrayConfigPreview, error) {
+	config, err := s.GetXrayConfig()
+	if err != nil {
+		return nil, err
+	}
+	preview := &XrayConfigPreview{Config: config, Running: s.IsXrayRunning()}
+	var running *xray.Config
+	if preview.Running {
+		running = p.GetConfig()
+	}
+	if preview.Diff, err = diffConfigs(running, config); err != nil {
+		return nil, err
+	}
+
+	err = xray.TestConfig(config)
+	var testErr *xray.TestError
+	switch {
+	case err == nil:
+		preview.Test.Ok = true
+	case errors.Is(err, xray.ErrNoBinary):
+		preview.Test.Skipped = true
+		preview.Test.Error = err.Error()
+	case errors.As(err, &testErr):
+		preview.Test.Error = testErr.Error()
+		preview.Test.Output = testErr.Output
+	default:
+		preview.Test.Error = err.Error()
+	}
+	return preview, nil
+}
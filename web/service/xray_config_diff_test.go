@@ -0,0 +1,168 @@
+package service
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"x-ui/database/model"
+	"x-ui/xray"
+
+	"github.com/goccy/go-json"
+)
+
+func parseXrayConfig(t *testing.T, data string) *xray.Config {
+	t.Helper()
+	config := &xray.Config{}
+	if err := json.Unmarshal([]byte(data), config); err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func TestDiffConfigs(t *testing.T) {
+	running := parseXrayConfig(t, `{
+		"log": {"loglevel": "warning"},
+		"inbounds": [
+			{"tag": "api", "port": 62789, "protocol": "dokodemo-door"},
+			{"tag": "inbound-443", "port": 443, "protocol": "vless",
+				"settings": {"clients": [{"email": "a", "id": "1"}, {"email": "b", "id": "2"}]},
+				"streamSettings": {"network": "tcp", "security": "reality"}},
+			{"tag": "inbound-80", "port": 80, "protocol": "vmess"}
+		],
+		"routing": {"rules": [{"outboundTag": "blocked", "ip": ["geoip:private"]}]}
+	}`)
+	config := parseXrayConfig(t, `{
+		"log": {"loglevel": "warning"},
+		"inbounds": [
+			{"tag": "inbound-443", "port": 443, "protocol": "vless",
+				"settings": {"clients": [{"email": "b", "id": "2"}, {"email": "c", "id": "3"}]},
+				"streamSettings": {"network": "ws", "security": "reality", "wsSettings": {"path": "/"}}},
+			{"tag": "api", "port": 62789, "protocol": "dokodemo-door"},
+			{"tag": "inbound-8443", "port": 8443, "protocol": "trojan"}
+		],
+		"routing": {"rules": [{"outboundTag": "direct", "ip": ["geoip:private"]}, {"outboundTag": "blocked", "protocol": ["bittorrent"]}]}
+	}`)
+	diff, err := diffConfigs(running, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ConfigDiff{
+		Added: []string{
+			"inbounds[tag=inbound-443].settings.clients[email=c]",
+			"inbounds[tag=inbound-443].streamSettings.wsSettings",
+			"inbounds[tag=inbound-8443]",
+			"routing.rules[1]",
+		},
+		Removed: []string{
+			"inbounds[tag=inbound-443].settings.clients[email=a]",
+			"inbounds[tag=inbound-80]",
+		},
+		Changed: []string{
+			"inbounds[tag=inbound-443].streamSettings.network",
+			"routing.rules[0].outboundTag",
+		},
+	}
+	for name, pair := range map[string][2][]string{
+		"added":   {diff.Added, want.Added},
+		"removed": {diff.Removed, want.Removed},
+		"changed": {diff.Changed, want.Changed},
+	} {
+		got := slices.Sorted(slices.Values(pair[0]))
+		if !slices.Equal(got, pair[1]) {
+			t.Errorf("%s %q, want %q", name, got, pair[1])
+		}
+	}
+
+	// Without a running config all of the new one is added
+	diff, err = diffConfigs(nil, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(diff.Added, "inbounds") || len(diff.Removed)+len(diff.Changed) != 0 {
+		t.Errorf("the diff with no running config is %+v", diff)
+	}
+	if diff, _ := diffConfigs(config, config); len(diff.Added)+len(diff.Removed)+len(diff.Changed) != 0 {
+		t.Errorf("a config differs from itself: %+v", diff)
+	}
+}
+
+// startFakeXray runs the fake Xray with the config the panel generates, as the
+// Xray of the panel.
+func startFakeXray(t *testing.T) *xray.Process {
+	t.Helper()
+	t.Setenv("XUI_LOG_FOLDER", t.TempDir())
+	config, err := (&XrayService{}).GetXrayConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p = xray.NewProcess(config)
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	started := p
+	t.Cleanup(func() {
+		if started.IsRunning() {
+			started.ExpectExit()
+			started.Stop()
+		}
+		if p == started {
+			p = nil
+		}
+	})
+	for deadline := time.Now().Add(5 * time.Second); !started.IsRunning(); {
+		if time.Now().After(deadline) {
+			t.Fatal("the fake xray did not start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return started
+}
+
+func TestRejectedConfigKeepsXrayRunning(t *testing.T) {
+	db := newTestDB(t)
+	fakeXray(t, "broken-security")
+	running := startFakeXray(t)
+	pid := running.GetPid()
+	hash := running.GetConfigHash()
+
+	// Stream settings Xray can't load, saved past the checks of the panel
+	inbound := &model.Inbound{
+		Remark: "broken", Enable: true, Port: 24436, Protocol: model.VLESS, Tag: "inbound-24436",
+		Settings:       `{"clients":[],"decryption":"none"}`,
+		StreamSettings: `{"network":"tcp","security":"broken-security"}`,
+	}
+	if err := db.Create(inbound).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	var s XrayService
+	preview, err := s.PreviewXrayConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !preview.Running || preview.Test.Ok || preview.Test.Skipped ||
+		!strings.Contains(preview.Test.Error, "broken-security is not valid") || !strings.Contains(preview.Test.Output, "Xray 25.1.1") {
+		t.Errorf("the preview tested %+v", preview.Test)
+	}
+	if !slices.Equal(preview.Diff.Added, []string{"inbounds[tag=inbound-24436]"}) || len(preview.Diff.Removed)+len(preview.Diff.Changed) != 0 {
+		t.Errorf("the preview diff is %+v", preview.Diff)
+	}
+
+	err = s.RestartXray(true)
+	if err == nil || !strings.Contains(err.Error(), "broken-security is not valid") {
+		t.Errorf("the restart with the rejected config gave %v", err)
+	}
+	if p != running || !running.IsRunning() || running.GetPid() != pid || running.GetConfigHash() != hash {
+		t.Error("the running xray was replaced by the rejected config")
+	}
+
+	// Once fixed the config is taken
+	if err := db.Model(inbound).Update("stream_settings", `{"network":"tcp","security":"none"}`).Error; err != nil {
+		t.Fatal(err)
+	}
+	if preview, err = s.PreviewXrayConfig(); err != nil || !preview.Test.Ok {
+		t.Errorf("the fixed config tested %+v, %v", preview.Test, err)
+	}
+}
@@ -0,0 +1,155 @@
+package service
+
+import (
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+)
+
+const (
+	// maxCrashReports are kept, the older ones are deleted with each new one
+	maxCrashReports = 100
+	// DefaultCrashReports are listed unless more are asked for
+	DefaultCrashReports = 20
+)
+
+// XrayCrashes are the last crash reports of Xray and where the restarts after
+// its crashes are at.
+type XrayCrashes struct {
+	Reports []*model.CrashReport `json:"reports"`
+	Backoff *XrayCrashBackoff    `json:"backoff"`
+}
+
+// XrayCrashBackoff is where the restarts after the crashes of Xray are at: how
+// many were made in a row, when the next one is due and whether they gave up.
+// They start over once Xray stays up for StableMinutes.
+type XrayCrashBackoff struct {
+	Restarts      int       `json:"restarts"`
+	MaxAttempts   int       `json:"maxAttempts"`
+	NextRestart   time.Time `json:"nextRestart,omitzero"`
+	GaveUp        bool      `json:"gaveUp"`
+	StableMinutes int       `json:"stableMinutes"`
+}
+
+// crashOutputSize returns how many bytes of the end of the stderr of Xray go in
+// its crash reports.
+func (s *XrayService) crashOutputSize() int {
+	kb, err := s.settingService.GetXrayCrashOutputKB()
+	if err != nil || kb < 1 {
+		kb = 16
+	}
+	return kb << 10
+}
+
+// recordCrash keeps the report of the exit of Xray the restart attempt follows,
+// if Xray exited on its own; nil otherwise.
+func (s *XrayService) recordCrash(attempt int) *model.CrashReport {
+	if p == nil || p.ExitExpected() {
+		return nil
+	}
+	code, signal, ok := p.ExitState()
+	if !ok {
+		return nil
+	}
+	report := &model.CrashReport{
+		Time:     time.Now().UnixMilli(),
+		ExitCode: code,
+		Signal:   signal,
+		Uptime:   int64(p.GetUptime()),
+		Version:  p.GetVersion(),
+		Stderr:   strings.ToValidUTF8(p.GetStderr(), "�"),
+		Attempt:  attempt,
+	}
+	db := database.GetDB()
+	if err := db.Create(report).Error; err != nil {
+		logger.Warning("Unable to save the crash report of Xray:", err)
+		return report
+	}
+	if err := db.Where("id <= ?", report.Id-maxCrashReports).Delete(&model.CrashReport{}).Error; err != nil {
+		logger.Warning("Unable to delete the old crash reports of Xray:", err)
+	}
+	return report
+}
+
+// finishCrash notes in report whether the restart after the crash brought Xray
+// back up.
+func (s *XrayService) finishCrash(report *model.CrashReport, restarted bool) {
+	report.Restarted = restarted
+	if report.Id == 0 {
+		return
+	}
+	err := database.GetDB().Model(report).Update("restarted", restarted).Error
+	if err != nil {
+		logger.Warning("Unable to update the crash report of Xray:", err)
+	}
+}
+
+// GetXrayCrashes returns the last limit crash reports of Xray, the latest
+// first, and the backoff of the restarts after them.
+func (s *XrayService) GetXrayCrashes(limit int) (*XrayCrashes, error) {
+	if limit <= 0 {
+		limit = DefaultCrashReports
+	}
+	crashes := &XrayCrashes{Reports: []*model.CrashReport{}}
+	err := database.GetDB().Model(&model.CrashReport{}).Order("id DESC").Limit(min(limit, maxCrashReports)).Find(&crashes.Reports).Error
+	if err != nil {
+		return nil, err
+	}
+
+	maxAttempts, err := s.settingService.GetXrayMaxRestartAttempts()
+	if err != nil || maxAttempts < 1 {
+		maxAttempts = 5
+	}
+	stable, err := s.settingService.GetXrayStableMinutes()
+	if err != nil || stable < 1 {
+		stable = 5
+	}
+	healthLock.Lock()
+	defer healthLock.Unlock()
+	crashes.Backoff = &XrayCrashBackoff{
+		Restarts:      crashLoop.restarts,
+		MaxAttempts:   maxAttempts,
+		GaveUp:        crashLoop.gaveUp,
+		StableMinutes: stable,
+	}
+	if crashLoop.restarts > 0 && !crashLoop.gaveUp {
+		crashes.Backoff.NextRestart = crashLoop.next
+	}
+	return crashes, nil
+}
+
+// XrayCrashed tells the admins that Xray exited on its own, with the id of its
+// crash report, and whether it was restarted or when it is tried again.
+func (t *Tgbot) XrayCrashed(report *model.CrashReport, delay time.Duration, gaveUp bool) {
+	if !t.AlertsOn(AlertXray) {
+		return
+	}
+	enabled, err := t.settingService.GetTgBotXrayRestartNotify()
+	if err != nil || !enabled {
+		return
+	}
+	exit := "exit code " + strconv.Itoa(report.ExitCode)
+	if report.Signal != "" {
+		exit = "signal " + report.Signal
+	}
+	msg := t.I18nBot("tgbot.messages.xrayCrashed", "Exit=="+exit, "Id=="+strconv.Itoa(report.Id))
+	msg += t.I18nBot("tgbot.messages.hostname", "Hostname=="+hostname)
+	if stderr := strings.TrimSpace(report.Stderr); stderr != "" {
+		lines := strings.Split(stderr, "\n")
+		lines = lines[max(len(lines)-xrayReportOutputLines, 0):]
+		msg += t.I18nBot("tgbot.messages.xrayOutput", "Output==<code>"+html.EscapeString(strings.Join(lines, "\n"))+"</code>")
+	}
+	switch {
+	case report.Restarted:
+		msg += t.I18nBot("tgbot.messages.xrayCrashRestarted", "Attempt=="+strconv.Itoa(report.Attempt))
+	case !gaveUp:
+		msg += t.I18nBot("tgbot.messages.xrayCrashRetry", "Attempt=="+strconv.Itoa(report.Attempt), "Delay=="+fmt.Sprint(delay))
+	}
+	t.SendAlert(AlertXray, msg)
+}
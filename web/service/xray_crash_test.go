@@ -0,0 +1,232 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/xray"
+)
+
+// crashTestXray puts in a new bin folder an Xray that takes every config and
+// runs until it is stopped, or crashes with SIGSEGV while $FAKE_XRAY_CRASH is
+// set. The crash loop and the process are reset after the test.
+func crashTestXray(t *testing.T) {
+	t.Helper()
+	newTestDB(t)
+	dir := t.TempDir()
+	t.Setenv("XUI_BIN_FOLDER", dir)
+	t.Setenv("XUI_LOG_FOLDER", dir)
+	t.Setenv("FAKE_XRAY_CRASH", "")
+	script := `#!/bin/sh
+case "$*" in
+*-version*) echo "Xray 25.1.1 (Xray, Penetrates Everything.)"; exit 0 ;;
+*-test*) echo "Configuration OK."; exit 0 ;;
+esac
+[ -z "$FAKE_XRAY_CRASH" ] && exec sleep 60
+i=0
+while [ $i -lt 200 ]; do echo "goroutine $i [running]:" >&2; i=$((i+1)); done
+echo "panic: runtime error: invalid memory address or nil pointer dereference" >&2
+kill -SEGV $$
+`
+	if err := os.WriteFile(filepath.Join(dir, xray.GetBinaryName()), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	s := SettingService{}
+	for key, value := range map[string]string{"xrayMaxRestartAttempts": "2", "xrayHealthCheckWindow": "1", "xrayCrashOutputKB": "1"} {
+		if err := s.setString(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() {
+		lock.Lock()
+		if p != nil && p.IsRunning() {
+			p.ExpectExit()
+			p.Stop()
+		}
+		p = nil
+		lock.Unlock()
+		resetCrashLoop()
+		isManuallyStopped.Store(false)
+		goodConfig, goodBinary = nil, nil
+		xray.SetBinary(xray.Binary{})
+	})
+}
+
+// startCrashTestXray starts the fake Xray the way the panel does and waits for
+// it to run.
+func startCrashTestXray(t *testing.T) {
+	t.Helper()
+	lock.Lock()
+	p = xray.NewProcess(&xray.Config{})
+	p.SetStderrTail(new(XrayService).crashOutputSize())
+	err := p.Start()
+	lock.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+}
+
+func waitCrashTestXray(t *testing.T) {
+	t.Helper()
+	var s XrayService
+	for deadline := time.Now().Add(10 * time.Second); s.IsXrayRunning(); time.Sleep(20 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("xray didn't exit")
+		}
+	}
+}
+
+func crashReportCount(t *testing.T) int64 {
+	t.Helper()
+	var count int64
+	if err := database.GetDB().Model(&model.CrashReport{}).Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestXrayExpectedExit(t *testing.T) {
+	crashTestXray(t)
+	var s XrayService
+
+	// Stopped from the panel
+	startCrashTestXray(t)
+	if err := s.StopXray(); err != nil {
+		t.Fatal(err)
+	}
+	waitCrashTestXray(t)
+	if s.DidXrayCrash() {
+		t.Error("the stopped Xray crashed")
+	}
+	isManuallyStopped.Store(false)
+	if s.DidXrayCrash() || s.recordCrash(1) != nil {
+		t.Error("the stop of the panel was taken for a crash")
+	}
+
+	// Restarted for its config: the old process exits as expected, the new one
+	// then crashes on its own
+	startCrashTestXray(t)
+	old := p
+	t.Setenv("FAKE_XRAY_CRASH", "1")
+	if err := s.RestartXray(true); err == nil {
+		t.Error("the crashing Xray was restarted")
+	}
+	if old.IsRunning() || !old.ExitExpected() {
+		t.Error("the restart didn't stop the old Xray as expected")
+	}
+	if p == old || p.ExitExpected() || !s.DidXrayCrash() {
+		t.Error("the crash after the restart wasn't taken for one")
+	}
+	if count := crashReportCount(t); count != 0 {
+		t.Errorf("%d crash reports were kept for the expected exits", count)
+	}
+}
+
+func TestRestartCrashedXray(t *testing.T) {
+	crashTestXray(t)
+	var s XrayService
+	t.Setenv("FAKE_XRAY_CRASH", "1")
+	startCrashTestXray(t)
+	waitCrashTestXray(t)
+	if !s.DidXrayCrash() {
+		t.Fatal("the crash wasn't taken for one")
+	}
+
+	s.RestartCrashedXray()
+	crashes, err := s.GetXrayCrashes(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(crashes.Reports) != 1 {
+		t.Fatalf("%d crash reports were kept", len(crashes.Reports))
+	}
+	report := crashes.Reports[0]
+	if report.Signal != "segmentation fault" || report.ExitCode != -1 || report.Attempt != 1 || report.Restarted || report.Version != "25.1.1" {
+		t.Errorf("the crash report is %+v", report)
+	}
+	// The end of stderr, within the size of the settings
+	if len(report.Stderr) != 1024 || !strings.HasSuffix(report.Stderr, "nil pointer dereference\n") {
+		t.Errorf("the crash report has the stderr %q", report.Stderr)
+	}
+	backoff := crashes.Backoff
+	if backoff.Restarts != 1 || backoff.MaxAttempts != 2 || backoff.GaveUp || backoff.StableMinutes != 5 ||
+		time.Until(backoff.NextRestart) <= 0 || time.Until(backoff.NextRestart) > crashRestartDelay {
+		t.Errorf("the backoff after a crash is %+v", backoff)
+	}
+
+	// Not before the backoff
+	s.RestartCrashedXray()
+	if count := crashReportCount(t); count != 1 {
+		t.Errorf("Xray was restarted during the backoff, %d crash reports", count)
+	}
+
+	// The second crash in a row gives up
+	healthLock.Lock()
+	crashLoop.next = time.Now()
+	healthLock.Unlock()
+	s.RestartCrashedXray()
+	crashes, err = s.GetXrayCrashes(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(crashes.Reports) != 2 || crashes.Reports[0].Attempt != 2 || crashes.Reports[1].Attempt != 1 {
+		t.Errorf("the crash reports are %+v", crashes.Reports)
+	}
+	if backoff := crashes.Backoff; backoff.Restarts != 2 || !backoff.GaveUp || !backoff.NextRestart.IsZero() {
+		t.Errorf("the backoff that gave up is %+v", backoff)
+	}
+	healthLock.Lock()
+	crashLoop.next = time.Now()
+	healthLock.Unlock()
+	s.RestartCrashedXray()
+	if count := crashReportCount(t); count != 2 {
+		t.Errorf("Xray was restarted after giving up, %d crash reports", count)
+	}
+
+	// A restart from the panel starts over, even if it fails the health check
+	// as the fake Xray has no API
+	t.Setenv("FAKE_XRAY_CRASH", "")
+	s.RestartXray(true)
+	if health := s.GetXrayHealth(); health.CrashRestarts != 0 || health.GaveUp {
+		t.Errorf("the restart from the panel left the crash loop %+v", health)
+	}
+}
+
+func TestCrashReportsPruned(t *testing.T) {
+	crashTestXray(t)
+	var s XrayService
+	db := database.GetDB()
+	for i := range maxCrashReports {
+		if err := db.Create(&model.CrashReport{Time: int64(i), Attempt: 1}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("FAKE_XRAY_CRASH", "1")
+	startCrashTestXray(t)
+	waitCrashTestXray(t)
+	report := s.recordCrash(1)
+	if report == nil || report.Id != maxCrashReports+1 {
+		t.Fatalf("the crash report is %+v", report)
+	}
+	if count := crashReportCount(t); count != maxCrashReports {
+		t.Errorf("%d crash reports are kept", count)
+	}
+	var oldest model.CrashReport
+	if err := db.Order("id").First(&oldest).Error; err != nil || oldest.Id != 2 {
+		t.Errorf("the oldest crash report is %d, %v", oldest.Id, err)
+	}
+
+	crashes, err := s.GetXrayCrashes(1000)
+	if err != nil || len(crashes.Reports) != maxCrashReports || crashes.Reports[0].Id != report.Id {
+		t.Errorf("all the crash reports are %d, %v", len(crashes.Reports), err)
+	}
+	if crashes, err := s.GetXrayCrashes(0); err != nil || len(crashes.Reports) != DefaultCrashReports {
+		t.Errorf("the last crash reports are %d, %v", len(crashes.Reports), err)
+	}
+}
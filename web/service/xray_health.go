@@ -0,0 +1,414 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/xray"
+)
+
+const (
+	// xrayStopTimeout bounds the wait for the old Xray to exit, so that the new
+	// one can take its ports
+	xrayStopTimeout = 10 * time.Second
+	// crashRestartDelay is the wait before a crashed Xray is restarted, doubled
+	// after each restart it crashes again after
+	crashRestartDelay    = 2 * time.Second
+	maxCrashRestartDelay = 5 * time.Minute
+	// xrayReportOutputLines of the output of Xray are sent to Telegram
+	xrayReportOutputLines = 10
+)
+
+// InboundHealth is an inbound Xray doesn't listen on.
+type InboundHealth struct {
+	xray.InboundListener
+	Error string `json:"error"`
+}
+
+// XrayRestartReport is the result of the health check of a restart of Xray.
+type XrayRestartReport struct {
+	Time          time.Time       `json:"time"`
+	Ok            bool            `json:"ok"`
+	Error         string          `json:"error,omitempty"`
+	APIError      string          `json:"apiError,omitempty"`
+	Inbounds      []InboundHealth `json:"inbounds,omitempty"`
+	Output        []string        `json:"output,omitempty"`
+	RolledBack    bool            `json:"rolledBack,omitempty"`
+	RollbackError string          `json:"rollbackError,omitempty"`
+}
+
+// XrayHealth is the last restart of Xray and the restarts of Xray after it
+// crashed.
+type XrayHealth struct {
+	LastRestart      *XrayRestartReport `json:"lastRestart"`
+	CrashRestarts    int                `json:"crashRestarts"`
+	NextCrashRestart time.Time          `json:"nextCrashRestart,omitzero"`
+	GaveUp           bool               `json:"gaveUp"`
+}
+
+var (
+	healthLock        sync.Mutex
+	lastRestartReport *XrayRestartReport
+	crashLoop         struct {
+		restarts   int
+		next       time.Time
+		gaveUp     bool
+		restarting bool
+	}
+	// goodConfig is the last config Xray ran healthy with, kept in
+	// xray.GetGoodConfigPath() through restarts of the panel
+	goodConfig *xray.Config
+	// goodBinary is how Xray was run when it last ran healthy, since the panel
+	// started
+	goodBinary *xray.Binary
+)
+
+// GetXrayHealth returns the report of the last restart of Xray and where the
+// restarts of a crashed Xray are at.
+func (s *XrayService) GetXrayHealth() *XrayHealth {
+	healthLock.Lock()
+	defer healthLock.Unlock()
+	health := &XrayHealth{
+		LastRestart:   lastRestartReport,
+		CrashRestarts: crashLoop.restarts,
+		GaveUp:        crashLoop.gaveUp,
+	}
+	if crashLoop.restarts > 0 && !crashLoop.gaveUp {
+		health.NextCrashRestart = crashLoop.next
+	}
+	return health
+}
+
+// waitXrayStopped waits for the stopped Xray to exit.
+func (s *XrayService) waitXrayStopped() {
+	deadline := time.Now().Add(xrayStopTimeout)
+	for s.IsXrayRunning() && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func loadGoodConfig() *xray.Config {
+	if goodConfig != nil {
+		return goodConfig
+	}
+	data, err := os.ReadFile(xray.GetGoodConfigPath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warning("Unable to read the last good config of Xray:", err)
+		}
+		return nil
+	}
+	config := &xray.Config{}
+	if err := json.Unmarshal(data, config); err != nil {
+		logger.Warning("Unable to read the last good config of Xray:", err)
+		return nil
+	}
+	goodConfig = config
+	return goodConfig
+}
+
+func saveGoodConfig(config *xray.Config) {
+	goodConfig = config
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err == nil {
+		err = os.WriteFile(xray.GetGoodConfigPath(), data, 0o600)
+	}
+	if err != nil {
+		logger.Warning("Unable to keep the good config of Xray:", err)
+	}
+}
+
+// checkXrayHealth waits for the started Xray to answer on its API and to listen
+// on the ports of its inbounds. It fails if Xray exits, or isn't healthy when
+// the window of the health check ends.
+func (s *XrayService) checkXrayHealth() *XrayRestartReport {
+	window, err := s.settingService.GetXrayHealthCheckWindow()
+	if err != nil || window < 1 {
+		window = 10
+	}
+	deadline := time.Now().Add(time.Duration(window) * time.Second)
+	for {
+		time.Sleep(500 * time.Millisecond)
+		report := &XrayRestartReport{Time: time.Now()}
+		if !p.IsRunning() {
+			report.Error = "xray exited"
+			reason := p.GetResult()
+			if reason != "" {
+				report.Error += ": " + reason
+			}
+			report.Inbounds = exitedInbounds(p.GetConfig(), reason)
+			report.Output = p.GetOutput()
+			return report
+		}
+
+		var problems []string
+		if p.GetAPIPort() != 0 {
+			if err := s.PingXrayAPI(time.Second); err != nil {
+				report.APIError = err.Error()
+				problems = append(problems, "the API doesn't answer: "+report.APIError)
+			}
+		}
+		for _, inbound := range p.GetConfig().InboundConfigs {
+			listener, ok := inbound.Listener()
+			if !ok {
+				continue
+			}
+			if err := xray.CheckListening(listener); err != nil {
+				report.Inbounds = append(report.Inbounds, InboundHealth{InboundListener: listener, Error: err.Error()})
+				problems = append(problems, listener.Tag+": "+err.Error())
+			}
+		}
+		if len(problems) == 0 {
+			report.Ok = true
+			return report
+		}
+		if time.Now().After(deadline) {
+			report.Error = fmt.Sprintf("xray is not healthy after %ds: %s", window, strings.Join(problems, "; "))
+			report.Output = p.GetOutput()
+			return report
+		}
+	}
+}
+
+// exitedInbounds returns the inbounds Xray exited because of: the ones it
+// names in the reason it gives, and the ones whose port is taken by another
+// process.
+func exitedInbounds(config *xray.Config, reason string) []InboundHealth {
+	var inbounds []InboundHealth
+	for _, inbound := range config.InboundConfigs {
+		listener, ok := inbound.Listener()
+		if !ok {
+			continue
+		}
+		switch {
+		case inbound.Tag != "" && (strings.Contains(reason, "tag "+inbound.Tag+" ") || strings.HasSuffix(reason, "tag "+inbound.Tag)):
+			inbounds = append(inbounds, InboundHealth{InboundListener: listener, Error: "xray failed to load it"})
+		case xray.CheckListening(listener) == nil:
+			inbounds = append(inbounds, InboundHealth{InboundListener: listener, Error: fmt.Sprintf("%s port %d is taken by another process", listener.Network, listener.Port)})
+		}
+	}
+	return inbounds
+}
+
+// startXray starts Xray with xrayConfig and checks its health. If Xray isn't
+// healthy, it is stopped and started again with the last good config, unless
+// that's the same one. Called with lock held.
+func (s *XrayService) startXray(xrayConfig *xray.Config) error {
+	p = xray.NewProcess(xrayConfig)
+	p.SetStderrTail(s.crashOutputSize())
+	result = ""
+	if err := p.Start(); err != nil {
+		return err
+	}
+
+	binary := p.GetBinary()
+	report := s.checkXrayHealth()
+	if report.Ok {
+		saveGoodConfig(xrayConfig)
+		goodBinary = &binary
+		s.setRestartReport(report)
+		return nil
+	}
+
+	logger.Warning("Xray failed its health check:", report.Error)
+	p.Stop()
+	s.waitXrayStopped()
+	// Inbounds that failed to bind are left out, for the rest to run; if Xray
+	// fails without them too, they weren't the problem
+	if leftOut := s.leaveOutFailedInbounds(report); len(leftOut) > 0 {
+		if config, err := s.GetXrayConfig(); err == nil {
+			p = xray.NewProcessWith(config, binary)
+			p.SetStderrTail(s.crashOutputSize())
+			result = ""
+			if err := p.Start(); err == nil {
+				if retried := s.checkXrayHealth(); retried.Ok {
+					for _, inbound := range leftOut {
+						reportBindError(inbound, bindErrorOf(inbound).state.Reason)
+					}
+					saveGoodConfig(config)
+					goodBinary = &binary
+					s.setRestartReport(retried)
+					return nil
+				}
+				p.Stop()
+				s.waitXrayStopped()
+			}
+		}
+		for _, inbound := range leftOut {
+			clearBindError(inbound.Id)
+		}
+	}
+	previous := loadGoodConfig()
+	if previous == nil {
+		previous = xrayConfig
+	}
+	previousBinary := binary
+	if goodBinary != nil {
+		previousBinary = *goodBinary
+	}
+	if !previous.Equals(xrayConfig) || !previousBinary.Equals(binary) {
+		logger.Info("Restoring the last good config of Xray")
+		p = xray.NewProcessWith(previous, previousBinary)
+		p.SetStderrTail(s.crashOutputSize())
+		result = ""
+		if err := p.Start(); err != nil {
+			report.RollbackError = err.Error()
+		} else if rollback := s.checkXrayHealth(); !rollback.Ok {
+			report.RollbackError = rollback.Error
+		} else {
+			report.RolledBack = true
+			xray.SetBinary(previousBinary)
+		}
+	}
+	s.setRestartReport(report)
+	go new(Tgbot).XrayRestartFailed(report)
+
+	if report.RolledBack {
+		return common.NewErrorf("%s; the previous config was restored", report.Error)
+	}
+	if report.RollbackError != "" {
+		return common.NewErrorf("%s; the previous config failed too: %s", report.Error, report.RollbackError)
+	}
+	return common.NewErrorf("%s", report.Error)
+}
+
+func (s *XrayService) setRestartReport(report *XrayRestartReport) {
+	healthLock.Lock()
+	lastRestartReport = report
+	healthLock.Unlock()
+}
+
+// resetCrashLoop forgets the restarts of a crashed Xray, once it is restarted
+// for another reason or has stayed up long enough.
+func resetCrashLoop() {
+	healthLock.Lock()
+	crashLoop.restarts = 0
+	crashLoop.next = time.Time{}
+	crashLoop.gaveUp = false
+	healthLock.Unlock()
+}
+
+// NoteXrayRunning is called while Xray runs; it ends a crash loop Xray has come
+// out of, once it stayed up for the stable minutes of the settings.
+func (s *XrayService) NoteXrayRunning() {
+	healthLock.Lock()
+	inLoop := crashLoop.restarts > 0
+	healthLock.Unlock()
+	if !inLoop {
+		return
+	}
+	minutes, err := s.settingService.GetXrayStableMinutes()
+	if err != nil || minutes < 1 {
+		minutes = 5
+	}
+	if s.GetXrayUptime() >= uint64(minutes)*60 {
+		resetCrashLoop()
+	}
+}
+
+// RestartCrashedXray restarts Xray after it crashed, waiting longer after each
+// restart it crashes again after, and giving up after the number of attempts
+// of the settings.
+func (s *XrayService) RestartCrashedXray() {
+	healthLock.Lock()
+	if crashLoop.gaveUp || crashLoop.restarting || time.Now().Before(crashLoop.next) {
+		healthLock.Unlock()
+		return
+	}
+	crashLoop.restarting = true
+	crashLoop.restarts++
+	restarts := crashLoop.restarts
+	healthLock.Unlock()
+
+	crash := s.GetXrayResult()
+	report := s.recordCrash(restarts)
+	logger.Warningf("Xray crashed, restarting it (attempt %d)", restarts)
+	lock.Lock()
+	err := s.restartXray(false)
+	lock.Unlock()
+	if err != nil {
+		logger.Error("Restart xray failed:", err)
+	}
+
+	maxAttempts, settingErr := s.settingService.GetXrayMaxRestartAttempts()
+	if settingErr != nil || maxAttempts < 1 {
+		maxAttempts = 5
+	}
+	delay := min(crashRestartDelay<<min(restarts-1, 20), maxCrashRestartDelay)
+	restarted := err == nil && s.IsXrayRunning()
+	healthLock.Lock()
+	crashLoop.restarting = false
+	crashLoop.next = time.Now().Add(delay)
+	gaveUp := restarts >= maxAttempts && !s.IsXrayRunning()
+	crashLoop.gaveUp = gaveUp
+	healthLock.Unlock()
+	payload := map[string]any{
+		"output":    crash,
+		"attempt":   restarts,
+		"restarted": restarted,
+		"gaveUp":    gaveUp,
+	}
+	if report != nil {
+		s.finishCrash(report, restarted)
+		payload["report"] = report.Id
+		go new(Tgbot).XrayCrashed(report, delay, gaveUp)
+	}
+	if gaveUp {
+		logger.Errorf("Xray crashed %d times in a row, it is no longer restarted", restarts)
+		go new(Tgbot).XrayGaveUp(restarts)
+	}
+	s.webhookService.Emit(WebhookXrayCrashed, payload)
+}
+
+// XrayRestartFailed tells the admins that Xray failed its health check
+// after a restart, and whether the previous config was restored.
+func (t *Tgbot) XrayRestartFailed(report *XrayRestartReport) {
+	if !t.AlertsOn(AlertXray) {
+		return
+	}
+	enabled, err := t.settingService.GetTgBotXrayRestartNotify()
+	if err != nil || !enabled {
+		return
+	}
+	msg := t.I18nBot("tgbot.messages.xrayRestartFailed")
+	msg += t.I18nBot("tgbot.messages.hostname", "Hostname=="+hostname)
+	msg += t.I18nBot("tgbot.messages.error", "Error=="+html.EscapeString(report.Error))
+	if output := report.Output; len(output) > 0 {
+		output = output[max(len(output)-xrayReportOutputLines, 0):]
+		msg += t.I18nBot("tgbot.messages.xrayOutput", "Output==<code>"+html.EscapeString(strings.Join(output, "\n"))+"</code>")
+	}
+	if report.RolledBack {
+		msg += t.I18nBot("tgbot.messages.xrayRolledBack")
+	} else {
+		msg += t.I18nBot("tgbot.messages.xrayNotRolledBack")
+	}
+	t.SendAlert(AlertXray, msg)
+}
+
+// XrayGaveUp tells the admins that Xray crashed too many times in a
+// row to be restarted again.
+func (t *Tgbot) XrayGaveUp(restarts int) {
+	if !t.AlertsOn(AlertXray) {
+		return
+	}
+	enabled, err := t.settingService.GetTgBotXrayRestartNotify()
+	if err != nil || !enabled {
+		return
+	}
+	msg := t.I18nBot("tgbot.messages.xrayGaveUp", "Count=="+fmt.Sprint(restarts))
+	msg += t.I18nBot("tgbot.messages.hostname", "Hostname=="+hostname)
+	if p != nil {
+		if output := p.GetOutput(); len(output) > 0 {
+			output = output[max(len(output)-xrayReportOutputLines, 0):]
+			msg += t.I18nBot("tgbot.messages.xrayOutput", "Output==<code>"+html.EscapeString(strings.Join(output, "\n"))+"</code>")
+		}
+	}
+	t.SendAlert(AlertXray, msg)
+}
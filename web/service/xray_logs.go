@@ -0,0 +1,127 @@
+package service
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+
+	"x-ui/util/common"
+	"x-ui/xray"
+)
+
+const (
+	defaultXrayLogTail = 100
+	maxXrayLogTail     = 5000
+)
+
+// XrayLogQuery is what is read of a log of Xray: the last Tail lines of the
+// log of Type, "error" or "access", at least as severe as Level and
+// containing Grep. Lines without a severity, like those of the access log,
+// aren't filtered by Level.
+type XrayLogQuery struct {
+	Type  string
+	Tail  int
+	Level string
+	Grep  string
+}
+
+// XrayLog is the tail of a log of Xray. Truncated tells that the search for
+// matching lines stopped before the start of the file.
+type XrayLog struct {
+	Type      string         `json:"type"`
+	Path      string         `json:"path"`
+	Lines     []xray.LogLine `json:"lines"`
+	Truncated bool           `json:"truncated"`
+}
+
+// check fills in the defaults of the query and checks its values.
+func (q *XrayLogQuery) check() error {
+	if q.Type == "" {
+		q.Type = "error"
+	}
+	if q.Type != "error" && q.Type != "access" {
+		return common.NewErrorf("unknown log type %q, it is error or access", q.Type)
+	}
+	if q.Tail <= 0 {
+		q.Tail = defaultXrayLogTail
+	}
+	q.Tail = min(q.Tail, maxXrayLogTail)
+	if q.Level != "" && xray.LogLevel(q.Level) < 0 {
+		return common.NewErrorf("unknown log level %q", q.Level)
+	}
+	return nil
+}
+
+// Match tells if a line of the log passes the filters of the query. The calls
+// of the API are left out of the access log.
+func (q *XrayLogQuery) Match(line xray.LogLine) bool {
+	if q.Level != "" && line.Level != "" && xray.LogLevel(line.Level) < xray.LogLevel(q.Level) {
+		return false
+	}
+	if q.Type == "access" && strings.Contains(line.Message, "api -> api") {
+		return false
+	}
+	return q.Grep == "" || strings.Contains(line.Line, q.Grep)
+}
+
+// xrayLogPath returns the file of a log of Xray, as the config Xray runs with
+// names it, or the config file when Xray isn't running. Only these files are
+// ever read.
+func (s *XrayService) xrayLogPath(kind string) (string, error) {
+	var config *xray.Config
+	if s.IsXrayRunning() {
+		config = p.GetConfig()
+	} else {
+		data, err := os.ReadFile(xray.GetConfigPath())
+		if err != nil {
+			return "", err
+		}
+		config = &xray.Config{}
+		if err := json.Unmarshal(data, config); err != nil {
+			return "", err
+		}
+	}
+	path := config.LogPath(kind)
+	if path == "" {
+		return "", common.NewErrorf("the xray config has no %s log file", kind)
+	}
+	return path, nil
+}
+
+// GetXrayLog returns the last lines of a log of Xray that match the query.
+func (s *XrayService) GetXrayLog(query XrayLogQuery) (*XrayLog, error) {
+	if err := query.check(); err != nil {
+		return nil, err
+	}
+	path, err := s.xrayLogPath(query.Type)
+	if err != nil {
+		return nil, err
+	}
+	lines, truncated, err := xray.TailLog(path, query.Tail, query.Match)
+	if err != nil {
+		return nil, err
+	}
+	return &XrayLog{Type: query.Type, Path: path, Lines: lines, Truncated: truncated}, nil
+}
+
+// FollowXrayLog opens a log of Xray to read the lines written to it from now
+// on, and returns the last lines that match the query.
+func (s *XrayService) FollowXrayLog(query *XrayLogQuery) (*xray.LogFollower, *XrayLog, error) {
+	if err := query.check(); err != nil {
+		return nil, nil, err
+	}
+	path, err := s.xrayLogPath(query.Type)
+	if err != nil {
+		return nil, nil, err
+	}
+	follower, err := xray.FollowLog(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	lines, truncated, err := follower.Tail(query.Tail, query.Match)
+	if err != nil {
+		follower.Close()
+		return nil, nil, err
+	}
+	return follower, &XrayLog{Type: query.Type, Path: path, Lines: lines, Truncated: truncated}, nil
+}
@@ -16,6 +16,10 @@ func (s *XraySettingService) SaveXraySetting(newXraySettings string) error {
 	if err := s.CheckXrayConfig(newXraySettings); err != nil {
 		return err
 	}
+	var outboundService OutboundService
+	if err := outboundService.checkTemplateOutbounds(newXraySettings); err != nil {
+		return err
+	}
 	return s.SettingService.saveSetting("xrayTemplateConfig", newXraySettings)
 }
 
@@ -0,0 +1,48 @@
+package service
+
+import "testing"
+
+func TestRestartRequiredSurvivesNeedRestart(t *testing.T) {
+	defer isRestartRequired.Store(false)
+	defer isNeedXrayRestart.Store(false)
+	var s XrayService
+
+	s.SetToRequireRestart()
+	if !s.IsNeedRestartAndSetFalse() {
+		t.Fatal("a required restart is not asked for")
+	}
+	// Taking the request, as the restart loop does, leaves the requirement for
+	// restartXray, so that an unchanged config doesn't skip it
+	if !isRestartRequired.Load() {
+		t.Fatal("the required restart was cleared with the request")
+	}
+
+	isRestartRequired.Store(false)
+	s.SetToNeedRestart()
+	if isRestartRequired.Load() {
+		t.Fatal("a restart request made the restart required")
+	}
+}
+
+func TestXrayConfigHashStable(t *testing.T) {
+	// Clients sent to outbounds make rules of their own, so that the config
+	// is generated from maps as well as from rows
+	clientOutboundTestDB(t)
+	var s XrayService
+	config, err := s.GetXrayConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := config.Hash()
+	// An unchanged database must give the hash the running Xray has, or every
+	// restart request would reload it
+	for i := range 20 {
+		again, err := s.GetXrayConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again.Hash() != hash {
+			t.Fatalf("the config generated %d more times hashes %s, want %s", i+1, again.Hash(), hash)
+		}
+	}
+}
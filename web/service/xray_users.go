@@ -0,0 +1,80 @@
+package service
+
+import (
+	"errors"
+
+	"x-ui/database/model"
+	"x-ui/xray"
+
+	"go.uber.org/atomic"
+)
+
+// usersNeedRestart is set when a change made through the API still needs a
+// restart of Xray, like a change of flow for the open connections.
+var usersNeedRestart atomic.Bool
+
+// initXrayAPI connects to the API of the running Xray, to change its inbounds
+// and users without restarting it. It fails when that isn't possible, or when
+// the settings want Xray restarted for every change; the change then needs a
+// restart, as the changes staged for a changeset do.
+func (s *InboundService) initXrayAPI() error {
+	if isStaging() {
+		return errors.New("the change is staged for a changeset")
+	}
+	if p == nil || !p.IsRunning() {
+		return errors.New("xray is not running")
+	}
+	if enabled, err := s.settingService.GetXrayApiUpdates(); err == nil && !enabled {
+		return errors.New("changes are applied by restarting xray")
+	}
+	return s.xrayApi.Init(p.GetAPIPort())
+}
+
+// apiUser returns a client of the settings of inbound as the API of Xray takes
+// it.
+func apiUser(inbound *model.Inbound, client map[string]any) map[string]any {
+	field := func(key string) string {
+		value, _ := client[key].(string)
+		return value
+	}
+	cipher := ""
+	if inbound.Protocol == model.Shadowsocks {
+		cipher = shadowsocksMethod(inbound)
+	}
+	return map[string]any{
+		"email":    field("email"),
+		"id":       field("id"),
+		"security": field("security"),
+		"flow":     field("flow"),
+		"password": field("password"),
+		"cipher":   cipher,
+	}
+}
+
+// configUnchanged tells if xrayConfig hashes the same as the config the running
+// Xray was started with and the API has changed none of its users since.
+func configUnchanged(xrayConfig *xray.Config) bool {
+	return p.GetConfigHash() == xrayConfig.Hash() && !usersNeedRestart.Load() &&
+		len(xray.UsersDrift(xray.ConfigUsers(xrayConfig))) == 0
+}
+
+// usersApplied tells if the running Xray differs from xrayConfig only by users
+// the API has already given it.
+func usersApplied(xrayConfig *xray.Config) bool {
+	return !usersNeedRestart.Load() && p.GetConfig().WithoutUsers().Equals(xrayConfig.WithoutUsers()) &&
+		len(xray.UsersDrift(xray.ConfigUsers(xrayConfig))) == 0
+}
+
+// CheckXrayUsers compares the users the running Xray has, after the changes
+// made through the API, with the users of the config the panel generates. It
+// returns how they differ.
+func (s *XrayService) CheckXrayUsers() ([]string, error) {
+	if !s.IsXrayRunning() || isNeedXrayRestart.Load() || isStaging() {
+		return nil, nil
+	}
+	xrayConfig, err := s.GetXrayConfig()
+	if err != nil {
+		return nil, err
+	}
+	return xray.UsersDrift(xray.ConfigUsers(xrayConfig)), nil
+}
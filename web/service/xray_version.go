@@ -0,0 +1,582 @@
+package service
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"x-ui/config"
+	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/xray"
+)
+
+const (
+	xrayReleasesURL      = "https://api.github.com/repos/XTLS/Xray-core/releases"
+	xrayDownloadURL      = "https://github.com/XTLS/Xray-core/releases/download/%s/%s"
+	xrayReleasesCacheTTL = time.Hour
+	xrayReleasesTimeout  = 15 * time.Second
+	xrayDownloadTimeout  = 5 * time.Minute
+	maxXrayArchiveSize   = 100 << 20
+	// xrayVersionTimeout bounds how long a binary may take to print its version
+	xrayVersionTimeout = 10 * time.Second
+	// xrayVersionsFolder of the bin folder keeps the binaries of the last versions
+	xrayVersionsFolder = "xray-versions"
+	// xrayReleasesFile of the bin folder caches the releases, for when GitHub
+	// can't be reached
+	xrayReleasesFile = "xray-releases.json"
+)
+
+var xrayVersionPattern = regexp.MustCompile(`^v\d+\.\d+\.\d+$`)
+
+var (
+	xrayReleasesLock    sync.Mutex
+	xrayReleases        []Release
+	xrayReleasesFetched time.Time
+	// xraySwitchLock is held while a version of Xray is installed
+	xraySwitchLock sync.Mutex
+)
+
+// XrayVersion is a version of Xray the panel can switch to.
+type XrayVersion struct {
+	Version     string    `json:"version"`
+	PublishedAt time.Time `json:"publishedAt,omitzero"`
+	Prerelease  bool      `json:"prerelease,omitempty"`
+	Current     bool      `json:"current"`
+	// Kept versions are in the bin folder, switching to them downloads nothing
+	Kept bool `json:"kept"`
+}
+
+// XrayVersions lists the versions of Xray. When GitHub can't be reached, it
+// lists the releases fetched last and the kept versions, and Error tells why.
+type XrayVersions struct {
+	Current   string        `json:"current"`
+	Path      string        `json:"path"`
+	Custom    bool          `json:"custom,omitempty"`
+	Running   string        `json:"running,omitempty"`
+	Versions  []XrayVersion `json:"versions"`
+	Offline   bool          `json:"offline"`
+	FetchedAt time.Time     `json:"fetchedAt,omitzero"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// parseXrayVersion returns the major, minor and patch numbers of a version of
+// Xray, with or without its "v".
+func parseXrayVersion(version string) ([3]int, bool) {
+	var numbers [3]int
+	parts := strings.Split(strings.TrimPrefix(version, "v"), ".")
+	if len(parts) != 3 {
+		return numbers, false
+	}
+	for i, part := range parts {
+		number, err := strconv.Atoi(part)
+		if err != nil {
+			return numbers, false
+		}
+		numbers[i] = number
+	}
+	return numbers, true
+}
+
+// xrayVersionAtLeast tells whether version is minimum or a later one.
+func xrayVersionAtLeast(version string, minimum string) bool {
+	numbers, ok1 := parseXrayVersion(version)
+	least, ok2 := parseXrayVersion(minimum)
+	if !ok1 || !ok2 {
+		return false
+	}
+	for i := range numbers {
+		if numbers[i] != least[i] {
+			return numbers[i] > least[i]
+		}
+	}
+	return true
+}
+
+// isSupportedXrayVersion tells whether the panel works with a release of Xray;
+// older ones lack features of its configs.
+func isSupportedXrayVersion(tag string) bool {
+	return xrayVersionAtLeast(tag, "v25.8.3")
+}
+
+// installedXrayVersion returns the version of Xray the configs are run by: the
+// running one, or else the one of the binary the settings point to. It is empty
+// if neither is known.
+func installedXrayVersion() string {
+	var xrayService XrayService
+	if xrayService.IsXrayRunning() {
+		if version := xrayService.GetXrayVersion(); version != "" && version != "Unknown" {
+			return "v" + version
+		}
+	}
+	var settingService SettingService
+	version, err := binaryVersion(settingService.GetXrayBinary().GetBinaryPath())
+	if err != nil {
+		return ""
+	}
+	return version
+}
+
+// xrayHTTPClient returns a client for GitHub, through the download proxy if
+// one is set.
+func (s *ServerService) xrayHTTPClient(timeout time.Duration) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	proxy, err := s.settingService.GetXrayDownloadProxy()
+	if err != nil {
+		return nil, err
+	}
+	if proxy != "" {
+		proxyURL, err := url.Parse(proxy)
+		if err != nil {
+			return nil, common.NewErrorf("the xray download proxy is invalid: %v", err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	return &http.Client{Transport: transport, Timeout: timeout}, nil
+}
+
+// fetchXrayReleases returns the releases of Xray, fetched at most once an hour.
+// Without GitHub it returns the releases fetched last, with the error.
+func (s *ServerService) fetchXrayReleases(refresh bool) ([]Release, time.Time, error) {
+	xrayReleasesLock.Lock()
+	defer xrayReleasesLock.Unlock()
+	if xrayReleases == nil {
+		// The releases fetched before the panel started
+		if data, err := os.ReadFile(filepath.Join(config.GetBinFolderPath(), xrayReleasesFile)); err == nil {
+			var cached struct {
+				FetchedAt time.Time `json:"fetchedAt"`
+				Releases  []Release `json:"releases"`
+			}
+			if json.Unmarshal(data, &cached) == nil {
+				xrayReleases, xrayReleasesFetched = cached.Releases, cached.FetchedAt
+			}
+		}
+	}
+	if !refresh && xrayReleases != nil && time.Since(xrayReleasesFetched) < xrayReleasesCacheTTL {
+		return xrayReleases, xrayReleasesFetched, nil
+	}
+
+	releases, err := s.downloadXrayReleases()
+	if err != nil {
+		logger.Warning("Unable to fetch the releases of Xray:", err)
+		return xrayReleases, xrayReleasesFetched, err
+	}
+	xrayReleases, xrayReleasesFetched = releases, time.Now()
+	data, err := json.Marshal(map[string]any{"fetchedAt": xrayReleasesFetched, "releases": releases})
+	if err == nil {
+		err = os.WriteFile(filepath.Join(config.GetBinFolderPath(), xrayReleasesFile), data, 0o644)
+	}
+	if err != nil {
+		logger.Warning("Unable to cache the releases of Xray:", err)
+	}
+	return xrayReleases, xrayReleasesFetched, nil
+}
+
+func (s *ServerService) downloadXrayReleases() ([]Release, error) {
+	client, err := s.xrayHTTPClient(xrayReleasesTimeout)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Get(xrayReleasesURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, common.NewErrorf("GitHub answered %s", resp.Status)
+	}
+	var releases []Release
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 16<<20)).Decode(&releases); err != nil {
+		return nil, err
+	}
+	supported := releases[:0]
+	for _, release := range releases {
+		if isSupportedXrayVersion(release.TagName) && !release.Draft {
+			supported = append(supported, release)
+		}
+	}
+	return supported, nil
+}
+
+// binaryVersion returns the version of an Xray binary, like its releases are
+// tagged.
+func binaryVersion(path string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), xrayVersionTimeout)
+	defer cancel()
+	data, err := exec.CommandContext(ctx, path, "-version").Output()
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 2 || fields[0] != "Xray" {
+		return "", common.NewErrorf("%s is not an Xray binary", filepath.Base(path))
+	}
+	return "v" + fields[1], nil
+}
+
+func xrayVersionsPath() string {
+	return filepath.Join(config.GetBinFolderPath(), xrayVersionsFolder)
+}
+
+func keptXrayBinaryPath(version string) string {
+	return filepath.Join(xrayVersionsPath(), version, xray.GetBinaryName())
+}
+
+// keptXrayVersions returns the kept versions of Xray, most recently used first.
+func keptXrayVersions() []string {
+	entries, err := os.ReadDir(xrayVersionsPath())
+	if err != nil {
+		return nil
+	}
+	type kept struct {
+		version string
+		used    time.Time
+	}
+	var versions []kept
+	for _, entry := range entries {
+		if !entry.IsDir() || !xrayVersionPattern.MatchString(entry.Name()) {
+			continue
+		}
+		info, err := os.Stat(keptXrayBinaryPath(entry.Name()))
+		if err != nil {
+			continue
+		}
+		versions = append(versions, kept{entry.Name(), info.ModTime()})
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].used.After(versions[j].used) })
+	names := make([]string, len(versions))
+	for i, v := range versions {
+		names[i] = v.version
+	}
+	return names
+}
+
+// copyExecutable copies an executable to path through a temporary file, so that
+// path is replaced at once.
+func copyExecutable(src string, path string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return writeExecutable(in, path)
+}
+
+// writeExecutable writes an executable through a temporary file of its folder,
+// renamed over path once written.
+func writeExecutable(r io.Reader, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(filepath.Dir(path), ".xray-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := io.Copy(file, io.LimitReader(r, maxXrayArchiveSize)); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(file.Name(), 0o755); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// keepXrayBinary copies an Xray binary to the kept versions, then removes the
+// versions used least recently beyond the kept count.
+func (s *ServerService) keepXrayBinary(path string, version string) {
+	keptPath := keptXrayBinaryPath(version)
+	if path != keptPath {
+		if err := copyExecutable(path, keptPath); err != nil {
+			logger.Warning("Unable to keep Xray", version+":", err)
+			return
+		}
+	}
+	now := time.Now()
+	os.Chtimes(keptPath, now, now)
+
+	count, err := s.settingService.GetXrayKeptVersions()
+	if err != nil || count < 1 {
+		count = 1
+	}
+	versions := keptXrayVersions()
+	for i := count; i < len(versions); i++ {
+		if err := os.RemoveAll(filepath.Join(xrayVersionsPath(), versions[i])); err != nil {
+			logger.Warning("Unable to remove the kept Xray", versions[i]+":", err)
+		}
+	}
+}
+
+// xrayAssetName returns the name of the release archive of Xray for this
+// system.
+func xrayAssetName() string {
+	osName := runtime.GOOS
+	arch := runtime.GOARCH
+
+	switch osName {
+	case "darwin":
+		osName = "macos"
+	}
+
+	switch arch {
+	case "amd64":
+		arch = "64"
+	case "arm64":
+		arch = "arm64-v8a"
+	case "arm":
+		goarm := "7"
+		if info, ok := debug.ReadBuildInfo(); ok {
+			for _, setting := range info.Settings {
+				if setting.Key == "GOARM" && setting.Value != "" {
+					goarm = setting.Value[:1]
+				}
+			}
+		}
+		switch goarm {
+		case "5":
+			arch = "arm32-v5"
+		case "6":
+			arch = "arm32-v6"
+		default:
+			arch = "arm32-v7a"
+		}
+	case "386":
+		arch = "32"
+	}
+	return fmt.Sprintf("Xray-%s-%s.zip", osName, arch)
+}
+
+// xrayArchiveSum returns the SHA-256 sum a release of Xray gives for one of its
+// archives.
+func xrayArchiveSum(client *http.Client, version string, assetName string) (string, error) {
+	resp, err := client.Get(fmt.Sprintf(xrayDownloadURL, version, assetName+".dgst"))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", common.NewErrorf("the checksum of %s could not be downloaded: %s", assetName, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if sum, ok := strings.CutPrefix(strings.TrimSpace(line), "SHA2-256="); ok {
+			return strings.ToLower(strings.TrimSpace(sum)), nil
+		}
+	}
+	return "", common.NewErrorf("the checksum file of %s has no SHA2-256 sum", assetName)
+}
+
+// downloadXrayBinary downloads a release of Xray and writes its binary to path
+// once the archive matches its checksum.
+func (s *ServerService) downloadXrayBinary(version string, path string) error {
+	client, err := s.xrayHTTPClient(xrayDownloadTimeout)
+	if err != nil {
+		return err
+	}
+	assetName := xrayAssetName()
+	sum, err := xrayArchiveSum(client, version, assetName)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Get(fmt.Sprintf(xrayDownloadURL, version, assetName))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return common.NewErrorf("%s of Xray %s could not be downloaded: %s", assetName, version, resp.Status)
+	}
+	archive, err := os.CreateTemp(config.GetBinFolderPath(), ".xray-*.zip")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		archive.Close()
+		os.Remove(archive.Name())
+	}()
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(archive, hash), io.LimitReader(resp.Body, maxXrayArchiveSize+1))
+	if err != nil {
+		return err
+	}
+	if size > maxXrayArchiveSize {
+		return common.NewErrorf("%s of Xray %s is too large", assetName, version)
+	}
+	if actual := hex.EncodeToString(hash.Sum(nil)); actual != sum {
+		return common.NewErrorf("%s of Xray %s doesn't match its checksum: got %s, want %s", assetName, version, actual, sum)
+	}
+
+	reader, err := zip.NewReader(archive, size)
+	if err != nil {
+		return err
+	}
+	binaryName := "xray"
+	if runtime.GOOS == "windows" {
+		binaryName = "xray.exe"
+	}
+	binary, err := reader.Open(binaryName)
+	if err != nil {
+		return common.NewErrorf("%s of Xray %s has no %s", assetName, version, binaryName)
+	}
+	defer binary.Close()
+	return writeExecutable(binary, path)
+}
+
+// GetXrayVersionList lists the releases of Xray and the kept versions. refresh
+// fetches the releases even if they were fetched in the last hour.
+func (s *ServerService) GetXrayVersionList(refresh bool) (*XrayVersions, error) {
+	releases, fetchedAt, err := s.fetchXrayReleases(refresh)
+	versions := &XrayVersions{
+		Versions:  []XrayVersion{},
+		FetchedAt: fetchedAt,
+	}
+	if err != nil {
+		versions.Offline = true
+		versions.Error = strings.TrimSpace(err.Error())
+	}
+	binary := s.settingService.GetXrayBinary()
+	versions.Path = binary.GetBinaryPath()
+	versions.Custom = binary.IsCustom()
+	versions.Current, _ = binaryVersion(versions.Path)
+	if s.xrayService.IsXrayRunning() {
+		versions.Running = "v" + s.xrayService.GetXrayVersion()
+	}
+
+	kept := map[string]bool{}
+	for _, version := range keptXrayVersions() {
+		kept[version] = true
+	}
+	listed := map[string]bool{}
+	for _, release := range releases {
+		listed[release.TagName] = true
+		versions.Versions = append(versions.Versions, XrayVersion{
+			Version:     release.TagName,
+			PublishedAt: release.PublishedAt,
+			Prerelease:  release.Prerelease,
+			Current:     release.TagName == versions.Current,
+			Kept:        kept[release.TagName],
+		})
+	}
+	for version := range kept {
+		if !listed[version] {
+			versions.Versions = append(versions.Versions, XrayVersion{
+				Version: version,
+				Current: version == versions.Current,
+				Kept:    true,
+			})
+		}
+	}
+	if len(versions.Versions) == 0 && err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+// installXrayBinary replaces the binary of Xray at path by staged and restarts
+// Xray.
+func (s *ServerService) installXrayBinary(staged string, path string) error {
+	s.xrayService.StopXray()
+	s.xrayService.waitXrayStopped()
+	if err := os.Rename(staged, path); err != nil {
+		s.xrayService.RestartXray(true)
+		return err
+	}
+	return s.xrayService.RestartXray(true)
+}
+
+// SwitchXrayVersion installs a version of Xray, from the kept versions or
+// downloaded from GitHub, and restarts Xray with it. If the new binary doesn't
+// run or Xray doesn't come up healthy, the previous binary is put back. A binary
+// the settings point to outside of the bin folder is only replaced if
+// overwriteCustom is set.
+func (s *ServerService) SwitchXrayVersion(version string, overwriteCustom bool) error {
+	if !xrayVersionPattern.MatchString(version) {
+		return common.NewErrorf("%q is not a version of Xray", version)
+	}
+	if !isSupportedXrayVersion(version) {
+		return common.NewErrorf("Xray %s is older than the panel supports", version)
+	}
+	if !xraySwitchLock.TryLock() {
+		return common.NewErrorf("another version of Xray is being installed")
+	}
+	defer xraySwitchLock.Unlock()
+
+	binary := s.settingService.GetXrayBinary()
+	if binary.IsCustom() && !overwriteCustom {
+		return common.NewErrorf("xray runs the custom binary %s, it is only replaced when told to", binary.Path)
+	}
+	binaryPath := binary.GetBinaryPath()
+	current, err := binaryVersion(binaryPath)
+	if err != nil {
+		logger.Warning("The installed Xray can't be kept:", err)
+		current = ""
+	}
+	if current == version {
+		return common.NewErrorf("Xray %s is already installed", version)
+	}
+
+	staged := filepath.Join(config.GetBinFolderPath(), ".staged-"+xray.GetBinaryName())
+	defer os.Remove(staged)
+	if _, err := os.Stat(keptXrayBinaryPath(version)); err == nil {
+		err = copyExecutable(keptXrayBinaryPath(version), staged)
+		if err != nil {
+			return err
+		}
+	} else if err := s.downloadXrayBinary(version, staged); err != nil {
+		return err
+	}
+	stagedVersion, err := binaryVersion(staged)
+	if err != nil {
+		return common.NewErrorf("the binary of Xray %s doesn't run: %v", version, err)
+	}
+	if stagedVersion != version {
+		return common.NewErrorf("the binary of Xray %s is of version %s", version, stagedVersion)
+	}
+	if current != "" {
+		s.keepXrayBinary(binaryPath, current)
+	}
+
+	logger.Infof("Switching Xray from %s to %s", current, version)
+	installErr := s.installXrayBinary(staged, binaryPath)
+	if installErr == nil {
+		s.keepXrayBinary(binaryPath, version)
+		return nil
+	}
+	if current == "" {
+		return common.NewErrorf("Xray %s failed to start: %v", version, installErr)
+	}
+
+	logger.Warningf("Xray %s failed to start, restoring %s: %v", version, current, installErr)
+	if err := copyExecutable(keptXrayBinaryPath(current), staged); err != nil {
+		return common.NewErrorf("Xray %s failed to start (%v) and %s could not be restored: %v", version, installErr, current, err)
+	}
+	if err := s.installXrayBinary(staged, binaryPath); err != nil {
+		return common.NewErrorf("Xray %s failed to start (%v), %s was restored but failed too: %v", version, installErr, current, err)
+	}
+	return common.NewErrorf("Xray %s failed to start, %s was restored: %v", version, current, installErr)
+}
@@ -1,7 +1,12 @@
 package session
 
 import (
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/gob"
+	"net/http"
+	"strings"
+	"time"
 
 	"x-ui/database/model"
 
@@ -11,31 +16,188 @@ import (
 
 const (
 	loginUserKey = "LOGIN_USER"
+	loginTimeKey = "LOGIN_TIME"
+	sessionIdKey = "SESSION_ID"
+	webAuthnKey  = "WEBAUTHN_SESSION"
+	pendingKey   = "PENDING_LOGIN"
+	pendingTTL   = 5 * time.Minute
 	defaultPath  = "/"
+
+	// refreshCookie carries the refresh token of a remember-me login, and
+	// deviceCookie the id of the device it is bound to
+	refreshCookie = "3x-ui-refresh"
+	deviceCookie  = "3x-ui-device"
+	// deviceMaxAge is how long a device keeps its id, the most browsers allow
+	deviceMaxAge  = 400 * 24 * 60 * 60
+	deviceIdBytes = 32
+
+	// requestUserKey holds the user of a request authenticated without a session,
+	// such as with an API token
+	requestUserKey = "request_user"
 )
 
 func init() {
 	gob.Register(model.User{})
+	gob.Register([]int64{})
 }
 
 func SetLoginUser(c *gin.Context, user *model.User) {
 	if user == nil {
 		return
 	}
+	// The cookie is signed but not encrypted, so it only carries who the user is;
+	// checkLogin loads the rest, including the current role, on every request
+	sessionUser := model.User{
+		Id:       user.Id,
+		Username: user.Username,
+		Role:     user.Role,
+	}
+	s := sessions.Default(c)
+	s.Set(loginUserKey, sessionUser)
+	s.Set(loginTimeKey, time.Now().UnixMilli())
+}
+
+// SetSessionId binds the cookie to its row in the login session table.
+func SetSessionId(c *gin.Context, id string) {
+	s := sessions.Default(c)
+	s.Set(sessionIdKey, id)
+}
+
+func GetSessionId(c *gin.Context) string {
+	s := sessions.Default(c)
+	id, _ := s.Get(sessionIdKey).(string)
+	return id
+}
+
+// GetLoginTime returns when the session was issued, in unix milliseconds, or 0 for
+// sessions created before the login time was recorded.
+func GetLoginTime(c *gin.Context) int64 {
+	s := sessions.Default(c)
+	loginTime, _ := s.Get(loginTimeKey).(int64)
+	return loginTime
+}
+
+// SetWebAuthnSession keeps the state of a passkey ceremony until it is finished.
+func SetWebAuthnSession(c *gin.Context, data string) {
+	s := sessions.Default(c)
+	s.Set(webAuthnKey, data)
+}
+
+// PopWebAuthnSession returns the pending ceremony state and removes it, so each
+// challenge can be answered only once.
+func PopWebAuthnSession(c *gin.Context) string {
+	s := sessions.Default(c)
+	data, _ := s.Get(webAuthnKey).(string)
+	s.Delete(webAuthnKey)
+	return data
+}
+
+// SetPendingLogin remembers a user that passed the password check but still has
+// to present a passkey.
+func SetPendingLogin(c *gin.Context, userId int) {
+	s := sessions.Default(c)
+	s.Set(pendingKey, []int64{int64(userId), time.Now().Add(pendingTTL).UnixMilli()})
+}
+
+// GetPendingLogin returns the user waiting for the passkey step, or 0 if there is
+// none or it has expired.
+func GetPendingLogin(c *gin.Context) int {
+	s := sessions.Default(c)
+	pending, ok := s.Get(pendingKey).([]int64)
+	if !ok || len(pending) != 2 || time.Now().UnixMilli() > pending[1] {
+		return 0
+	}
+	return int(pending[0])
+}
+
+func ClearPendingLogin(c *gin.Context) {
 	s := sessions.Default(c)
-	s.Set(loginUserKey, *user)
+	s.Delete(pendingKey)
 }
 
 func SetMaxAge(c *gin.Context, maxAge int) {
 	s := sessions.Default(c)
-	s.Options(sessions.Options{
+	s.Options(cookieOptions(c, maxAge))
+}
+
+// IsSecureRequest tells whether the request came over TLS, to the panel or to
+// the reverse proxy in front of it.
+func IsSecureRequest(c *gin.Context) bool {
+	return c.Request.TLS != nil || strings.EqualFold(c.GetHeader("X-Forwarded-Proto"), "https")
+}
+
+// cookieOptions are the options of the cookies of the panel: never readable by
+// scripts, only sent over TLS when the panel is reached over TLS.
+func cookieOptions(c *gin.Context, maxAge int) sessions.Options {
+	return sessions.Options{
 		Path:     defaultPath,
 		MaxAge:   maxAge,
 		HttpOnly: true,
+		Secure:   IsSecureRequest(c),
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+func setCookie(c *gin.Context, name string, value string, maxAge int) {
+	options := cookieOptions(c, maxAge)
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     options.Path,
+		MaxAge:   options.MaxAge,
+		HttpOnly: options.HttpOnly,
+		Secure:   options.Secure,
+		SameSite: options.SameSite,
 	})
 }
 
+// SetRefreshToken keeps the refresh token of a remember-me login in its cookie
+// for maxAge seconds.
+func SetRefreshToken(c *gin.Context, token string, maxAge int) {
+	setCookie(c, refreshCookie, token, maxAge)
+}
+
+func GetRefreshToken(c *gin.Context) string {
+	token, _ := c.Cookie(refreshCookie)
+	return token
+}
+
+// ClearRefreshToken removes the cookie of the refresh token, if there is one.
+func ClearRefreshToken(c *gin.Context) {
+	if GetRefreshToken(c) != "" {
+		setCookie(c, refreshCookie, "", -1)
+	}
+}
+
+func GetDeviceId(c *gin.Context) string {
+	id, _ := c.Cookie(deviceCookie)
+	return id
+}
+
+// EnsureDeviceId returns the id of the device of the request, giving it one
+// if it has none yet.
+func EnsureDeviceId(c *gin.Context) (string, error) {
+	if id := GetDeviceId(c); id != "" {
+		return id, nil
+	}
+	buf := make([]byte, deviceIdBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	id := base64.RawURLEncoding.EncodeToString(buf)
+	setCookie(c, deviceCookie, id, deviceMaxAge)
+	return id, nil
+}
+
+// SetRequestUser makes user the login user for this request only.
+func SetRequestUser(c *gin.Context, user *model.User) {
+	c.Set(requestUserKey, user)
+}
+
 func GetLoginUser(c *gin.Context) *model.User {
+	if user, ok := c.Get(requestUserKey); ok {
+		return user.(*model.User)
+	}
 	s := sessions.Default(c)
 	obj := s.Get(loginUserKey)
 	if obj == nil {
@@ -57,9 +219,5 @@ func IsLogin(c *gin.Context) bool {
 func ClearSession(c *gin.Context) {
 	s := sessions.Default(c)
 	s.Clear()
-	s.Options(sessions.Options{
-		Path:     defaultPath,
-		MaxAge:   -1,
-		HttpOnly: true,
-	})
+	s.Options(cookieOptions(c, -1))
 }
@@ -0,0 +1,186 @@
+package web
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"x-ui/logger"
+	"x-ui/web/job"
+	"x-ui/web/service"
+
+	"github.com/robfig/cron/v3"
+)
+
+// settingJob is a job scheduled by the settings, rescheduled as they change.
+type settingJob struct {
+	name string
+	// keys are the settings of its schedule
+	keys []string
+	// spec returns the cron spec to run the job on, "" for not to run it
+	spec func() (string, error)
+	// fallback is the spec the job runs on if its own is not valid, none if ""
+	fallback string
+	job      cron.Job
+}
+
+// settingJobs are the scheduled jobs of the settings, by name.
+type settingJobs struct {
+	mu      sync.Mutex
+	entries map[string]cron.EntryID
+}
+
+// enabledSpec returns the spec of a job that runs if enabled.
+func enabledSpec(enabled func() (bool, error), spec func() (string, error)) (string, error) {
+	if on, err := enabled(); err != nil || !on {
+		return "", err
+	}
+	return spec()
+}
+
+// everySpec returns the spec of a job that runs every interval of units, if
+// it's above 0.
+func everySpec(interval func() (int, error), unit time.Duration) (string, error) {
+	n, err := interval()
+	if err != nil || n <= 0 {
+		return "", err
+	}
+	return fmt.Sprintf("@every %s", time.Duration(n)*unit), nil
+}
+
+// settingJobList returns the jobs scheduled by the settings, those of the bot
+// if it is enabled.
+func (s *Server) settingJobList(tgEnabled bool) []settingJob {
+	jobs := []settingJob{
+		// check the dests of the Reality inbounds, and fall back from failing ones
+		{
+			name: "RealityMonitorJob",
+			keys: []string{"realityCheckInterval"},
+			spec: func() (string, error) { return everySpec(s.settingService.GetRealityCheckInterval, time.Minute) },
+			job:  job.NewRealityMonitorJob(),
+		},
+		// check that the enabled inbounds are reachable, and alert on those that
+		// went dark
+		{
+			name: "InboundReachabilityJob",
+			keys: []string{"inboundCheckInterval"},
+			spec: func() (string, error) { return everySpec(s.settingService.GetInboundCheckInterval, time.Minute) },
+			job:  job.NewInboundReachabilityJob(),
+		},
+		// count the connections to the inbounds
+		{
+			name: "SampleConnectionsJob",
+			keys: []string{"connectionSampleInterval"},
+			spec: func() (string, error) {
+				return everySpec(s.settingService.GetConnectionSampleInterval, time.Second)
+			},
+			job: job.NewSampleConnectionsJob(),
+		},
+		// update the geoip and geosite files
+		{
+			name: "UpdateGeodataJob",
+			keys: []string{"geodataAutoUpdate", "geodataUpdateCron"},
+			spec: func() (string, error) {
+				return enabledSpec(s.settingService.GetGeodataAutoUpdate, s.settingService.GetGeodataUpdateCron)
+			},
+			fallback: "@daily",
+			job:      job.NewUpdateGeodataJob(),
+		},
+		// vacuum and analyze the database, weekly by default
+		{
+			name: "OptimizeDbJob",
+			keys: []string{"dbAutoOptimize", "dbOptimizeCron"},
+			spec: func() (string, error) {
+				return enabledSpec(s.settingService.GetDbAutoOptimize, s.settingService.GetDbOptimizeCron)
+			},
+			job: job.NewOptimizeDbJob(),
+		},
+		// back the database up to the backup folder
+		{
+			name: "BackupJob",
+			keys: []string{"backupEnable", "backupCron"},
+			spec: func() (string, error) {
+				return enabledSpec(s.settingService.GetBackupEnable, s.settingService.GetBackupCron)
+			},
+			job: job.NewBackupJob(),
+		},
+	}
+	if !tgEnabled {
+		return jobs
+	}
+	return append(jobs,
+		// report the traffic, 8:30 every day by default
+		settingJob{
+			name: "StatsNotifyJob",
+			keys: []string{"tgRunTime"},
+			spec: func() (string, error) {
+				runtime, err := s.settingService.GetTgbotRuntime()
+				if err == nil && runtime == "" {
+					err = errors.New("no runtime")
+				}
+				return runtime, err
+			},
+			fallback: "@daily",
+			job:      job.NewStatsNotifyJob(),
+		},
+		// send the last backup to the admins
+		settingJob{
+			name: "TelegramBackupJob",
+			keys: []string{"tgBotBackupCron"},
+			spec: s.settingService.GetTgBotBackupCron,
+			job:  job.NewTelegramBackupJob(),
+		},
+		// remind the clients of their expiry
+		settingJob{
+			name: "ExpiryReminderJob",
+			keys: []string{"notifyExpiryCron"},
+			spec: s.settingService.GetNotifyExpiryCron,
+			job:  job.NewExpiryReminderJob(),
+		},
+	)
+}
+
+// scheduleSettingJob schedules j by the settings, in place of its last
+// schedule.
+func (s *Server) scheduleSettingJob(j settingJob) {
+	// Reading the settings may call the listeners, so they are read unlocked
+	spec, err := j.spec()
+	s.settingJobs.mu.Lock()
+	defer s.settingJobs.mu.Unlock()
+	if entry, ok := s.settingJobs.entries[j.name]; ok {
+		s.cron.Remove(entry)
+		delete(s.settingJobs.entries, j.name)
+	}
+	if err == nil && spec == "" {
+		return
+	}
+	if err == nil {
+		var entry cron.EntryID
+		if entry, err = s.cron.AddJob(spec, j.job); err == nil {
+			s.settingJobs.entries[j.name] = entry
+			return
+		}
+	}
+	if j.fallback == "" {
+		logger.Warningf("Add %s error: %v", j.name, err)
+		return
+	}
+	logger.Warningf("Add %s error, will run on %s: %v", j.name, j.fallback, err)
+	if entry, err := s.cron.AddJob(j.fallback, j.job); err == nil {
+		s.settingJobs.entries[j.name] = entry
+	}
+}
+
+// startSettingJobs schedules the jobs of the settings, and reschedules each as
+// the settings of its schedule change.
+func (s *Server) startSettingJobs(tgEnabled bool) {
+	s.settingJobs.entries = map[string]cron.EntryID{}
+	for _, j := range s.settingJobList(tgEnabled) {
+		s.scheduleSettingJob(j)
+		s.settingListeners = append(s.settingListeners, service.OnSettingChange(func(key, value string) {
+			logger.Infof("Rescheduling %s for the change of %s", j.name, key)
+			s.scheduleSettingJob(j)
+		}, j.keys...))
+	}
+}
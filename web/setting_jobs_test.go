@@ -0,0 +1,114 @@
+package web
+
+import (
+	"testing"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/web/service"
+
+	"github.com/robfig/cron/v3"
+)
+
+// settingJobsTestServer starts the jobs of the settings of an empty database
+// on a cron that doesn't run them.
+func settingJobsTestServer(t *testing.T) *Server {
+	t.Helper()
+	if err := database.InitDB(t.TempDir() + "/x-ui.db"); err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer()
+	s.cron = cron.New(cron.WithLocation(time.UTC), cron.WithSeconds())
+	s.startSettingJobs(true)
+	t.Cleanup(func() {
+		for _, stop := range s.settingListeners {
+			stop()
+		}
+	})
+	return s
+}
+
+// nextRun returns when the job name runs next after from, zero if it isn't
+// scheduled.
+func nextRun(s *Server, name string, from time.Time) time.Time {
+	s.settingJobs.mu.Lock()
+	defer s.settingJobs.mu.Unlock()
+	entry, ok := s.settingJobs.entries[name]
+	if !ok {
+		return time.Time{}
+	}
+	return s.cron.Entry(entry).Schedule.Next(from)
+}
+
+// changeSetting changes key in the database, as the x-ui command does, and
+// reads the settings for the change to be loaded.
+func changeSetting(t *testing.T, key string, value string) {
+	t.Helper()
+	db := database.GetDB()
+	if err := db.Where("key = ?", key).Delete(model.Setting{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create(&model.Setting{Key: key, Value: value}).Error; err != nil {
+		t.Fatal(err)
+	}
+	service.InvalidateSettings()
+	if _, err := new(service.SettingService).GetAllSetting(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSettingJobRescheduled(t *testing.T) {
+	s := settingJobsTestServer(t)
+	// Monday, March 3rd 2025
+	from := time.Date(2025, 3, 3, 0, 0, 0, 0, time.UTC)
+
+	// The database is optimized on Sundays at 4:00 by default, backups are off
+	if next := nextRun(s, "OptimizeDbJob", from); !next.Equal(time.Date(2025, 3, 9, 4, 0, 0, 0, time.UTC)) {
+		t.Errorf("OptimizeDbJob runs next at %s", next)
+	}
+	if next := nextRun(s, "BackupJob", from); !next.IsZero() {
+		t.Errorf("the disabled BackupJob runs at %s", next)
+	}
+	entries := len(s.cron.Entries())
+
+	// A new cron expression takes effect without a restart, in place of the
+	// old one
+	changeSetting(t, "dbOptimizeCron", "0 30 2 * * *")
+	if next := nextRun(s, "OptimizeDbJob", from); !next.Equal(time.Date(2025, 3, 3, 2, 30, 0, 0, time.UTC)) {
+		t.Errorf("after the change OptimizeDbJob runs next at %s", next)
+	}
+	if n := len(s.cron.Entries()); n != entries {
+		t.Errorf("%d jobs are scheduled after the change, %d before", n, entries)
+	}
+	changeSetting(t, "backupEnable", "true")
+	if next := nextRun(s, "BackupJob", from); !next.Equal(time.Date(2025, 3, 3, 3, 0, 0, 0, time.UTC)) {
+		t.Errorf("the enabled BackupJob runs next at %s", next)
+	}
+
+	// Saved by the panel
+	if err := s.settingService.SetTgbotRuntime("0 15 9 * * *"); err != nil {
+		t.Fatal(err)
+	}
+	if next := nextRun(s, "StatsNotifyJob", from); !next.Equal(time.Date(2025, 3, 3, 9, 15, 0, 0, time.UTC)) {
+		t.Errorf("after the change StatsNotifyJob runs next at %s", next)
+	}
+
+	// An expression that isn't valid falls back to that of the job, or stops it
+	// if it has none
+	if err := s.settingService.SetTgbotRuntime("not a cron"); err != nil {
+		t.Fatal(err)
+	}
+	if next := nextRun(s, "StatsNotifyJob", from); !next.Equal(time.Date(2025, 3, 4, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("with an invalid runtime StatsNotifyJob runs next at %s", next)
+	}
+	changeSetting(t, "dbOptimizeCron", "not a cron")
+	if next := nextRun(s, "OptimizeDbJob", from); !next.IsZero() {
+		t.Errorf("with an invalid cron OptimizeDbJob runs at %s", next)
+	}
+	changeSetting(t, "dbOptimizeCron", "0 0 1 * * *")
+	changeSetting(t, "dbAutoOptimize", "false")
+	if next := nextRun(s, "OptimizeDbJob", from); !next.IsZero() {
+		t.Errorf("the disabled OptimizeDbJob runs at %s", next)
+	}
+}
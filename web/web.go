@@ -4,18 +4,21 @@ import (
 	"context"
 	"crypto/tls"
 	"embed"
+	"errors"
 	"html/template"
 	"io"
 	"io/fs"
 	"net"
 	"net/http"
 	"os"
-	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"x-ui/config"
+	"x-ui/database/model"
 	"x-ui/logger"
+	"x-ui/sub"
 	"x-ui/util/common"
 	"x-ui/web/controller"
 	"x-ui/web/job"
@@ -24,7 +27,6 @@ import (
 	"x-ui/web/network"
 	"x-ui/web/service"
 
-	"github.com/gin-contrib/gzip"
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-contrib/sessions/cookie"
 	"github.com/gin-gonic/gin"
@@ -79,19 +81,39 @@ func (f *wrapAssetsFileInfo) ModTime() time.Time {
 }
 
 type Server struct {
-	httpServer *http.Server
-	listener   net.Listener
-
-	index  *controller.IndexController
-	server *controller.ServerController
-	panel  *controller.XUIController
-	api    *controller.APIController
+	httpServer   *http.Server
+	listener     net.Listener
+	certReloader *service.CertReloader
+	// listenAddress is the address of listener, see listenAddress
+	listenAddress string
+
+	index          *controller.IndexController
+	server         *controller.ServerController
+	panel          *controller.XUIController
+	api            *controller.APIController
+	metrics        *controller.MetricsController
+	health         *controller.HealthController
+	webauthn       *controller.WebAuthnController
+	clientShare    *controller.ClientShareController
+	backupDownload *controller.BackupDownloadController
+	setup          *controller.SetupController
 
 	xrayService    service.XrayService
 	settingService service.SettingService
+	userService    service.UserService
+	setupService   service.SetupService
+	inboundService service.InboundService
+	serverService  service.ServerService
 	tgbotService   service.Tgbot
 
-	cron *cron.Cron
+	cron        *cron.Cron
+	settingJobs settingJobs
+	accessLog   *logger.RotatingFile
+	// settingListeners stop the listeners of the settings the server applies
+	// live
+	settingListeners []func()
+	// tgReconnecting is whether the bot is about to reconnect
+	tgReconnecting atomic.Bool
 
 	ctx    context.Context
 	cancel context.CancelFunc
@@ -156,9 +178,56 @@ func (s *Server) initRouter() (*gin.Engine, error) {
 		gin.SetMode(gin.ReleaseMode)
 	}
 
-	engine := gin.Default()
+	// RecoveryJSON is the only recovery: the one of gin.Default would answer the
+	// aborted requests instead of letting net/http drop their connections
+	engine := gin.New()
+	if config.IsDebug() {
+		engine.Use(gin.Logger())
+	}
+
+	basePath, err := s.settingService.GetBasePath()
+	if err != nil {
+		return nil, err
+	}
+
+	trustedProxies, err := s.settingService.GetTrustedProxies()
+	if err != nil {
+		return nil, err
+	}
+	trustedProxyHeader, err := s.settingService.GetTrustedProxyHeader()
+	if err != nil {
+		return nil, err
+	}
+	if err := middleware.SetTrustedProxies(engine, trustedProxies, trustedProxyHeader); err != nil {
+		return nil, err
+	}
 
+	engine.Use(middleware.RequestID())
+	engine.Use(middleware.Metrics())
+	if err := s.initAccessLog(engine, basePath); err != nil {
+		return nil, err
+	}
 	engine.Use(middleware.RecoveryJSON())
+	allSetting, err := s.settingService.GetAllSetting()
+	if err != nil {
+		return nil, err
+	}
+	engine.Use(middleware.SlowRequests(allSetting.SlowRequestConfig(basePath)))
+	engine.Use(middleware.BodyCapture(allSetting.BodyCaptureConfig(basePath)))
+	engine.Use(middleware.SecurityHeaders(allSetting.SecurityHeadersConfig()))
+	middleware.OnPanic("tgbot", func(event middleware.PanicEvent) {
+		if event.BrokenPipe {
+			return
+		}
+		s.tgbotService.PanicNotify(service.PanicAlert{
+			RequestID: event.RequestID,
+			Method:    event.Method,
+			Path:      event.Path,
+			Route:     event.Route,
+			Error:     event.Error,
+			Stack:     event.Stack,
+		})
+	})
 
 	webDomain, err := s.settingService.GetWebDomain()
 	if err != nil {
@@ -174,11 +243,9 @@ func (s *Server) initRouter() (*gin.Engine, error) {
 		return nil, err
 	}
 
-	basePath, err := s.settingService.GetBasePath()
-	if err != nil {
-		return nil, err
+	if allSetting.CompressionEnable {
+		engine.Use(middleware.Compress(allSetting.CompressConfig()))
 	}
-	engine.Use(gzip.Gzip(gzip.DefaultCompression, gzip.WithExcludedPaths([]string{basePath + "panel/API/"})))
 	assetsBasePath := basePath + "assets/"
 
 	store := cookie.NewStore(secret)
@@ -186,6 +253,7 @@ func (s *Server) initRouter() (*gin.Engine, error) {
 	engine.Use(func(c *gin.Context) {
 		c.Set("base_path", basePath)
 	})
+	engine.Use(controller.BodyLimit(allSetting))
 	engine.Use(func(c *gin.Context) {
 		uri := c.Request.RequestURI
 		if strings.HasPrefix(uri, assetsBasePath) {
@@ -205,6 +273,8 @@ func (s *Server) initRouter() (*gin.Engine, error) {
 	}
 	engine.FuncMap["i18n"] = i18nWebFunc
 	engine.Use(locale.LocalizerMiddleware())
+	engine.Use(controller.MaintenanceGuard())
+	engine.Use(controller.SetupGuard())
 
 	// set static files and template
 	if config.IsDebug() {
@@ -228,27 +298,142 @@ func (s *Server) initRouter() (*gin.Engine, error) {
 	// Apply the redirect middleware (`/xui` to `/panel`)
 	engine.Use(middleware.RedirectMiddleware(basePath))
 
+	// The CA asks for the HTTP-01 challenges at the root, whatever the base
+	// path
+	engine.GET("/.well-known/acme-challenge/:token", controller.AcmeChallenge)
+
 	g := engine.Group(basePath)
 
 	s.index = controller.NewIndexController(g)
+	s.setup = controller.NewSetupController(g)
 	s.server = controller.NewServerController(g)
 	s.panel = controller.NewXUIController(g)
 	s.api = controller.NewAPIController(g)
+	s.metrics = controller.NewMetricsController(g)
+	s.health = controller.NewHealthController(g)
+	s.backupDownload = controller.NewBackupDownloadController(g)
+	s.clientShare = controller.NewClientShareController(g)
+	s.webauthn = controller.NewWebAuthnController(g, s.index)
+
+	for _, route := range controller.UndocumentedApiV2Routes(engine.Routes(), basePath) {
+		logger.Warning("The OpenAPI document and the routes of the v2 API differ at", route)
+	}
 
 	return engine, nil
 }
 
+func (s *Server) initAccessLog(engine *gin.Engine, basePath string) error {
+	enabled, err := s.settingService.GetAccessLogEnable()
+	if err != nil || !enabled {
+		return err
+	}
+	maxSize, err := s.settingService.GetAccessLogMaxSize()
+	if err != nil {
+		return err
+	}
+	maxBackups, err := s.settingService.GetAccessLogMaxBackups()
+	if err != nil {
+		return err
+	}
+	maxAge, err := s.settingService.GetAccessLogMaxAge()
+	if err != nil {
+		return err
+	}
+	exclude, err := s.settingService.GetAccessLogExclude()
+	if err != nil {
+		return err
+	}
+	path, err := s.settingService.GetAccessLogPath()
+	if err != nil {
+		return err
+	}
+
+	var excluded []string
+	for _, prefix := range strings.Split(exclude, ",") {
+		if prefix = strings.TrimSpace(prefix); prefix != "" {
+			excluded = append(excluded, prefix)
+		}
+	}
+
+	s.accessLog = logger.NewRotatingFile(path, maxSize, maxBackups, maxAge)
+	engine.Use(middleware.AccessLog(s.accessLog, basePath, excluded))
+	return nil
+}
+
+// initAuthLog opens the login audit log used by fail2ban; it shares the rotation
+// limits of the access log.
+func (s *Server) initAuthLog() error {
+	maxSize, err := s.settingService.GetAccessLogMaxSize()
+	if err != nil {
+		return err
+	}
+	maxBackups, err := s.settingService.GetAccessLogMaxBackups()
+	if err != nil {
+		return err
+	}
+	maxAge, err := s.settingService.GetAccessLogMaxAge()
+	if err != nil {
+		return err
+	}
+	path, err := s.settingService.GetAuthLogPath()
+	if err != nil {
+		return err
+	}
+	logger.SetAuthLog(logger.NewRotatingFile(path, maxSize, maxBackups, maxAge))
+	return nil
+}
+
+// initAppLog persists the log lines of the panel from the level set, for the
+// log viewer; it shares the rotation limits of the access log.
+func (s *Server) initAppLog() error {
+	name, err := s.settingService.GetAppLogLevel()
+	if err != nil {
+		return err
+	}
+	if name == "off" {
+		logger.SetAppLog(nil, 0)
+		return nil
+	}
+	level, err := logger.ParseLevel(name)
+	if err != nil {
+		return err
+	}
+	maxSize, err := s.settingService.GetAccessLogMaxSize()
+	if err != nil {
+		return err
+	}
+	maxBackups, err := s.settingService.GetAccessLogMaxBackups()
+	if err != nil {
+		return err
+	}
+	maxAge, err := s.settingService.GetAccessLogMaxAge()
+	if err != nil {
+		return err
+	}
+	logger.SetAppLog(logger.NewRotatingFile(config.GetAppLogPath(), maxSize, maxBackups, maxAge), level)
+	return nil
+}
+
 func (s *Server) startTask() {
-	err := s.xrayService.RestartXray(true)
+	// Xray kept running through a restart is only restarted if its config changed
+	err := s.xrayService.RestartXray(!s.xrayService.IsXrayRunning())
 	if err != nil {
 		logger.Warning("start xray failed:", err)
 	}
 	// Check whether xray is running every second
 	s.cron.AddJob("@every 1s", job.NewCheckXrayRunningJob())
 
-	// Check if xray needs to be restarted every 30 seconds
+	// Check every minute that the users changed through the API of xray match the panel
+	s.cron.AddJob("@every 1m", job.NewCheckXrayUsersJob())
+
+	// Switch the scheduled inbounds on the minute, when their windows start and end
+	s.cron.AddJob("0 * * * * *", job.NewInboundScheduleJob())
+
+	// Check if xray needs to be restarted every 30 seconds, also for the changes
+	// of the command line, which requested it in the database
+	s.xrayService.IsRestartRequested()
 	s.cron.AddFunc("@every 30s", func() {
-		if s.xrayService.IsNeedRestartAndSetFalse() {
+		if s.xrayService.IsNeedRestartAndSetFalse() || s.xrayService.IsRestartRequested() {
 			err := s.xrayService.RestartXray(false)
 			if err != nil {
 				logger.Error("restart xray failed:", err)
@@ -265,35 +450,96 @@ func (s *Server) startTask() {
 	// check client ips from log file every 10 sec
 	s.cron.AddJob("@every 10s", job.NewCheckClientIpJob())
 
+	// sample the status of the server for the dashboard and its history on the
+	// interval of the settings
+	statusInterval, err := s.settingService.GetStatusSampleInterval()
+	if err != nil || statusInterval <= 0 {
+		statusInterval = 2
+	}
+	s.cron.Schedule(cron.Every(time.Duration(statusInterval)*time.Second), job.NewSampleStatusJob(time.Duration(statusInterval)*time.Second))
+
+	// count the traffic of the server against its bandwidth limits
+	s.cron.AddJob("@every 30s", job.NewCheckBandwidthJob())
+
+	// write the connections and the traffic of the clients by country
+	s.cron.AddJob("@every 1m", job.NewFlushGeoStatsJob())
+
+	// lift the blocks of the connection limits of inbounds as they expire,
+	// checking every minute
+	s.cron.AddJob("@every 1m", job.NewExpireConnBlocksJob())
+
 	// check client ips from log file every day
 	s.cron.AddJob("@daily", job.NewClearLogsJob())
 
-	// Make a traffic condition every day, 8:30
-	var entry cron.EntryID
+	// prune audit log entries past the retention every day
+	s.cron.AddJob("@daily", job.NewPruneAuditLogJob())
+
+	// prune the traffic history past the retention every day
+	s.cron.AddJob("@daily", job.NewPruneTrafficHistoryJob())
+
+	// prune the status history past the retention every day
+	s.cron.AddJob("@daily", job.NewPruneStatusHistoryJob())
+
+	// prune the geo stats past the retention every day
+	s.cron.AddJob("@daily", job.NewPruneGeoStatsJob())
+
+	// issue the missing ACME certificates and renew those expiring within 30
+	// days every day
+	s.cron.AddJob("@daily", job.NewRenewAcmeJob())
+
+	// reload the certificates whose files changed every 10 seconds
+	s.cron.AddJob("@every 10s", job.NewReloadCertsJob())
+
+	// push the changes of the inbounds and the clients to the nodes, and pull
+	// their traffic, checking every 10 seconds
+	s.cron.AddJob("@every 10s", job.NewNodeSyncJob())
+
+	// warn the Telegram admins about the critical security findings once, after
+	// the bot had a minute to start
+	time.AfterFunc(time.Minute, job.NewSecurityAlertJob().Run)
+
+	// purge the deleted inbounds and clients past the retention every day
+	s.cron.AddJob("@daily", job.NewPurgeTrashJob())
+
+	// reset client traffics by their reset policies at midnight, and once now
+	// for resets missed while the panel was down
+	resetClientTrafficJob := job.NewResetClientTrafficJob()
+	s.cron.AddJob("@daily", resetClientTrafficJob)
+	go resetClientTrafficJob.Run()
+
+	// delete clients disabled for longer than the grace period every hour, the
+	// backlog a run is capped at is worked off within hours
+	s.cron.AddJob("@hourly", job.NewCleanupClientsJob())
+
+	// report the clients that became inactive every week
+	s.cron.AddJob("@weekly", job.NewInactiveClientsReportJob())
+
+	// save the subscription fetches often, since the sub server only queues
+	// them, and remove the ones past the retention every day
+	s.cron.AddJob("@every 10s", job.NewSubAccessJob())
+	s.cron.AddJob("@daily", job.NewPruneSubAccessJob())
+
+	// remove expired login sessions every hour
+	s.cron.AddJob("@hourly", job.NewPruneLoginSessionsJob())
+
+	// post the webhook deliveries that are due, the retries of failed ones
+	// among them, and remove the finished ones past the retention every day
+	s.cron.AddJob("@every 5s", job.NewWebhookJob())
+	s.cron.AddJob("@daily", job.NewPruneWebhookDeliveriesJob())
+
+	// Check CPU load and alert the admins if threshold passes
+	if cpuThreshold, err := s.settingService.GetTgCpu(); err == nil && cpuThreshold > 0 {
+		s.cron.AddJob("@every 10s", job.NewCheckCpuJob())
+	}
+
+	// schedule the jobs of the settings, and the bot's if it's enabled
 	isTgbotenabled, err := s.settingService.GetTgbotEnabled()
-	if (err == nil) && (isTgbotenabled) {
-		runtime, err := s.settingService.GetTgbotRuntime()
-		if err != nil || runtime == "" {
-			logger.Errorf("Add NewStatsNotifyJob error[%s], Runtime[%s] invalid, will run default", err, runtime)
-			runtime = "@daily"
-		}
-		logger.Infof("Tg notify enabled,run at %s", runtime)
-		_, err = s.cron.AddJob(runtime, job.NewStatsNotifyJob())
-		if err != nil {
-			logger.Warning("Add NewStatsNotifyJob error", err)
-			return
-		}
+	isTgbotenabled = err == nil && isTgbotenabled
+	s.startSettingJobs(isTgbotenabled)
 
+	if isTgbotenabled {
 		// check for Telegram bot callback query hash storage reset
 		s.cron.AddJob("@every 2m", job.NewCheckHashStorageJob())
-
-		// Check CPU load and alarm to TgBot if threshold passes
-		cpuThreshold, err := s.settingService.GetTgCpu()
-		if (err == nil) && (cpuThreshold > 0) {
-			s.cron.AddJob("@every 10s", job.NewCheckCpuJob())
-		}
-	} else {
-		s.cron.Remove(entry)
 	}
 }
 
@@ -305,6 +551,28 @@ func (s *Server) Start() (err error) {
 		}
 	}()
 
+	logFormat, err := s.settingService.GetLogFormat()
+	if err != nil {
+		return err
+	}
+	logger.SetFormat(logFormat)
+
+	if err := s.initAuthLog(); err != nil {
+		return err
+	}
+	if err := s.initAppLog(); err != nil {
+		return err
+	}
+
+	if err := s.userService.MigrateTwoFactor(); err != nil {
+		logger.Warning("Unable to migrate two-factor authentication:", err)
+	}
+	if err := s.setupService.InitSetup(); err != nil {
+		logger.Warning("Unable to check the setup of the panel:", err)
+	} else if s.setupService.Pending() {
+		logger.Warning("The panel is not set up yet, open its setup page or run \"x-ui setup -print-credentials\"")
+	}
+
 	loc, err := s.settingService.GetTimeLocation()
 	if err != nil {
 		return err
@@ -317,6 +585,52 @@ func (s *Server) Start() (err error) {
 		return err
 	}
 
+	webEnable, err := s.settingService.GetWebEnable()
+	if err != nil {
+		return err
+	}
+	if webEnable {
+		if err := s.listen(engine); err != nil {
+			return err
+		}
+	} else {
+		// The jobs, Xray and the bot keep running, the panel is back with
+		// "x-ui setting -webEnable true"
+		logger.Warning("Web server is disabled, the panel is not listening")
+	}
+
+	s.tgbotService.SetHostname()
+	s.startTask()
+
+	isTgbotenabled, err := s.settingService.GetTgbotEnabled()
+	if (err == nil) && (isTgbotenabled) {
+		service.SetShareLinker(s.shareLink)
+		tgBot := s.tgbotService.NewTgbot()
+		tgBot.Start(i18nFS)
+		s.settingListeners = append(s.settingListeners,
+			service.OnSettingChange(s.reconnectTgBot, "tgBotToken", "tgBotProxy", "tgBotAPIServer"))
+	}
+
+	return nil
+}
+
+// reconnectTgBot reconnects the bot a second after a setting of its connection
+// changed, once for the settings saved together. The bot keeps polling with
+// its old connection until it reconnects.
+func (s *Server) reconnectTgBot(key, value string) {
+	if !s.tgReconnecting.CompareAndSwap(false, true) {
+		return
+	}
+	time.AfterFunc(time.Second, func() {
+		s.tgReconnecting.Store(false)
+		if err := s.tgbotService.Reconnect(); err != nil {
+			logger.Warning("Unable to reconnect the Telegram bot:", err)
+		}
+	})
+}
+
+// listen serves engine on the listener of the panel.
+func (s *Server) listen(engine http.Handler) error {
 	certFile, err := s.settingService.GetCertFile()
 	if err != nil {
 		return err
@@ -333,17 +647,34 @@ func (s *Server) Start() (err error) {
 	if err != nil {
 		return err
 	}
-	listenAddr := net.JoinHostPort(listen, strconv.Itoa(port))
-	listener, err := net.Listen("tcp", listenAddr)
+	socketMode, err := s.settingService.GetSocketMode()
+	if err != nil {
+		return err
+	}
+	socketOwner, err := s.settingService.GetSocketOwner()
 	if err != nil {
 		return err
 	}
-	if certFile != "" || keyFile != "" {
-		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	address := listenAddress(listen, port)
+	listener := takeHandoff(address)
+	if listener == nil {
+		listener, err = network.Listen(listen, port, socketMode, socketOwner)
+		if err != nil {
+			return err
+		}
+	}
+	if socketPath, ok := network.UnixSocketPath(listen); ok {
+		// TLS is up to the reverse proxy in front of the socket
+		logger.Info("Web server running HTTP on unix socket", socketPath)
+	} else if certFile != "" || keyFile != "" {
+		// The certificate is reloaded when its files change
+		reloader, err := service.NewCertReloader("panel", certFile, keyFile)
 		if err == nil {
 			c := &tls.Config{
-				Certificates: []tls.Certificate{cert},
+				GetCertificate: reloader.GetCertificate,
 			}
+			service.RegisterCertReloader(reloader)
+			s.certReloader = reloader
 			listener = network.NewAutoHttpsListener(listener)
 			listener = tls.NewListener(listener, c)
 			logger.Info("Web server running HTTPS on", listener.Addr())
@@ -355,6 +686,7 @@ func (s *Server) Start() (err error) {
 		logger.Info("Web server running HTTP on", listener.Addr())
 	}
 	s.listener = listener
+	s.listenAddress = address
 
 	s.httpServer = &http.Server{
 		Handler: engine,
@@ -363,35 +695,87 @@ func (s *Server) Start() (err error) {
 	go func() {
 		s.httpServer.Serve(listener)
 	}()
+	return nil
+}
 
-	s.startTask()
-
-	isTgbotenabled, err := s.settingService.GetTgbotEnabled()
-	if (err == nil) && (isTgbotenabled) {
-		tgBot := s.tgbotService.NewTgbot()
-		tgBot.Start(i18nFS)
+// shareLink returns the share links of a client the Telegram bot created.
+func (s *Server) shareLink(inbound *model.Inbound, email string, host string) string {
+	remarkModel, err := s.settingService.GetRemarkModel()
+	if err != nil || remarkModel == "" {
+		remarkModel = "-ieo"
 	}
-
-	return nil
+	return sub.NewSubService(false, remarkModel).GetLink(inbound, email, host)
 }
 
+// Stop shuts the panel down for good, Xray included.
 func (s *Server) Stop() error {
-	s.cancel()
-	s.xrayService.StopXray()
-	if s.cron != nil {
-		s.cron.Stop()
-	}
-	if s.tgbotService.IsRunning() {
-		s.tgbotService.Stop()
+	return s.stop(true)
+}
+
+// StopForRestart shuts the panel down before it is started again in the same
+// process. Xray keeps running through the restart if the panel is set up so.
+func (s *Server) StopForRestart() error {
+	keepXray, err := s.settingService.GetXrayKeepOnRestart()
+	if err != nil {
+		logger.Warning("get xrayKeepOnRestart failed:", err)
 	}
+	return s.stop(!keepXray)
+}
+
+// stop drains the in-flight requests first, so that no change is left half
+// applied, then stops the jobs, saves the last traffic statistics and stops Xray.
+func (s *Server) stop(stopXray bool) error {
+	timeout := s.settingService.GetShutdownTimeout()
 	var err1 error
 	var err2 error
 	if s.httpServer != nil {
-		err1 = s.httpServer.Shutdown(s.ctx)
+		err1 = network.Shutdown("Web server", s.httpServer, timeout)
 	}
 	if s.listener != nil {
-		err2 = s.listener.Close()
+		if err := s.listener.Close(); !errors.Is(err, net.ErrClosed) {
+			err2 = err
+		}
+	}
+	if s.certReloader != nil {
+		service.UnregisterCertReloader(s.certReloader)
 	}
+	for _, stop := range s.settingListeners {
+		stop()
+	}
+	if s.cron != nil {
+		logger.Info("Web server: stopping background jobs")
+		select {
+		case <-s.cron.Stop().Done():
+		case <-time.After(timeout):
+			logger.Warning("Web server: background jobs still running after", timeout)
+		}
+	}
+	if s.tgbotService.IsRunning() {
+		s.tgbotService.Stop()
+	}
+	if s.xrayService.IsXrayRunning() {
+		logger.Info("Web server: saving traffic statistics")
+		job.NewXrayTrafficJob().Run()
+		if stopXray {
+			logger.Info("Web server: stopping Xray")
+			s.xrayService.StopXray()
+		} else {
+			logger.Info("Web server: keeping Xray running")
+		}
+	}
+	if err := s.inboundService.FlushTraffic(); err != nil {
+		logger.Warning("Web server: saving traffic statistics failed:", err)
+	}
+	job.NewSubAccessJob().Run()
+	if err := s.serverService.FlushStatusHistory(); err != nil {
+		logger.Warning("Web server: saving status history failed:", err)
+	}
+	job.NewFlushGeoStatsJob().Run()
+	s.cancel()
+	if s.accessLog != nil {
+		s.accessLog.Close()
+	}
+	logger.Info("Web server: stopped")
 	return common.Combine(err1, err2)
 }
 
@@ -399,6 +783,15 @@ func (s *Server) GetCtx() context.Context {
 	return s.ctx
 }
 
+// GetListenAddr returns the address the panel listens on, nil while it
+// doesn't.
+func (s *Server) GetListenAddr() net.Addr {
+	if s.listener == nil || s.ctx.Err() != nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
 func (s *Server) GetCron() *cron.Cron {
 	return s.cron
 }
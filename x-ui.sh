@@ -248,6 +248,11 @@ check_config() {
 
     local existing_webBasePath=$(echo "$info" | grep -Eo 'webBasePath: .+' | awk '{print $2}')
     local existing_port=$(echo "$info" | grep -Eo 'port: .+' | awk '{print $2}')
+    local existing_socket=$(echo "$info" | grep -Eo 'socket: .+' | awk '{print $2}')
+    if [[ -n "$existing_socket" ]]; then
+        echo -e "${green}Panel listens on unix socket ${existing_socket}, open it through your reverse proxy at ${existing_webBasePath}${plain}"
+        return
+    fi
     local existing_cert=$(/usr/local/x-ui/x-ui setting -getCert true | grep -Eo 'cert: .+' | awk '{print $2}')
     local server_ip=$(curl -s --max-time 3 https://api.ipify.org)
     if [ -z "$server_ip" ]; then
@@ -554,6 +559,7 @@ show_status() {
     0)
         echo -e "Panel state: ${green}Running${plain}"
         show_enable_status
+        show_listen_status
         ;;
     1)
         echo -e "Panel state: ${yellow}Not Running${plain}"
@@ -566,6 +572,16 @@ show_status() {
     show_xray_status
 }
 
+show_listen_status() {
+    local info=$(/usr/local/x-ui/x-ui setting -show true 2>/dev/null)
+    local socket=$(echo "$info" | grep -Eo 'socket: .+' | awk '{print $2}')
+    if [[ -n "$socket" ]]; then
+        echo -e "Panel socket: ${green}${socket}${plain}"
+    else
+        echo -e "Panel port: ${green}$(echo "$info" | grep -Eo 'port: .+' | awk '{print $2}')${plain}"
+    fi
+}
+
 show_enable_status() {
     check_enabled
     if [[ $? == 0 ]]; then
@@ -1747,6 +1763,8 @@ show_usage() {
 │  ${blue}x-ui disable${plain}      - Disable Autostart on OS Startup  │
 │  ${blue}x-ui log${plain}          - Check logs                       │
 │  ${blue}x-ui banlog${plain}       - Check Fail2ban ban logs          │
+│  ${blue}x-ui maintenance${plain}  - Maintenance Mode on|off|status   │
+│  ${blue}x-ui setup${plain}        - First-Run Setup                  │
 │  ${blue}x-ui update${plain}       - Update                           │
 │  ${blue}x-ui legacy${plain}       - legacy version                   │
 │  ${blue}x-ui install${plain}      - Install                          │
@@ -1909,6 +1927,12 @@ if [[ $# > 0 ]]; then
     "banlog")
         check_install 0 && show_banlog 0
         ;;
+    "maintenance")
+        check_install 0 && /usr/local/x-ui/x-ui maintenance "${@:2}"
+        ;;
+    "setup")
+        check_install 0 && /usr/local/x-ui/x-ui setup "${@:2}"
+        ;;
     "update")
         check_install 0 && update 0
         ;;
@@ -5,12 +5,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"regexp"
+	"strings"
 	"time"
 	"math"
 
 	"x-ui/logger"
 	"x-ui/util/common"
 
+	observatoryService "github.com/xtls/xray-core/app/observatory/command"
 	"github.com/xtls/xray-core/app/proxyman/command"
 	statsService "github.com/xtls/xray-core/app/stats/command"
 	"github.com/xtls/xray-core/common/protocol"
@@ -22,14 +24,27 @@ import (
 	"github.com/xtls/xray-core/proxy/vless"
 	"github.com/xtls/xray-core/proxy/vmess"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 )
 
 type XrayAPI struct {
-	HandlerServiceClient *command.HandlerServiceClient
-	StatsServiceClient   *statsService.StatsServiceClient
-	grpcClient           *grpc.ClientConn
-	isConnected          bool
+	HandlerServiceClient     *command.HandlerServiceClient
+	StatsServiceClient       *statsService.StatsServiceClient
+	ObservatoryServiceClient *observatoryService.ObservatoryServiceClient
+	grpcClient               *grpc.ClientConn
+	isConnected              bool
+}
+
+// OutboundStatus is the latest probe of an outbound by the observatory of Xray.
+type OutboundStatus struct {
+	Tag       string `json:"tag"`
+	Alive     bool   `json:"alive"`
+	Delay     int64  `json:"delay"`
+	LastError string `json:"lastError,omitempty"`
+	LastSeen  int64  `json:"lastSeen"`
+	LastTry   int64  `json:"lastTry"`
 }
 
 func (x *XrayAPI) Init(apiPort int) error {
@@ -48,9 +63,11 @@ func (x *XrayAPI) Init(apiPort int) error {
 
 	hsClient := command.NewHandlerServiceClient(conn)
 	ssClient := statsService.NewStatsServiceClient(conn)
+	osClient := observatoryService.NewObservatoryServiceClient(conn)
 
 	x.HandlerServiceClient = &hsClient
 	x.StatsServiceClient = &ssClient
+	x.ObservatoryServiceClient = &osClient
 
 	return nil
 }
@@ -61,6 +78,7 @@ func (x *XrayAPI) Close() {
 	}
 	x.HandlerServiceClient = nil
 	x.StatsServiceClient = nil
+	x.ObservatoryServiceClient = nil
 	x.isConnected = false
 }
 
@@ -81,6 +99,12 @@ func (x *XrayAPI) AddInbound(inbound []byte) error {
 	inboundConfig := command.AddInboundRequest{Inbound: config}
 
 	_, err = client.AddInbound(context.Background(), &inboundConfig)
+	if err == nil {
+		applied := new(InboundConfig)
+		if json.Unmarshal(inbound, applied) == nil {
+			setAppliedInbound(applied)
+		}
+	}
 
 	return err
 }
@@ -90,6 +114,9 @@ func (x *XrayAPI) DelInbound(tag string) error {
 	_, err := client.RemoveInbound(context.Background(), &command.RemoveInboundRequest{
 		Tag: tag,
 	})
+	if err == nil {
+		removeAppliedInbound(tag)
+	}
 	return err
 }
 
@@ -103,7 +130,7 @@ func (x *XrayAPI) AddUser(Protocol string, inboundTag string, user map[string]an
 	case "vless":
 		account = serial.ToTypedMessage(&vless.Account{
 			Id:   user["id"].(string),
-			Flow: user["flow"].(string),
+			Flow: vlessFlow(user["flow"].(string)),
 		})
 	case "trojan":
 		account = serial.ToTypedMessage(&trojan.Account{
@@ -135,6 +162,9 @@ func (x *XrayAPI) AddUser(Protocol string, inboundTag string, user map[string]an
 				Email: user["email"].(string),
 			})
 		}
+	case "wireguard":
+		// The peers of a WireGuard inbound are only set by its config
+		return fmt.Errorf("the peers of WireGuard inbound %s can't be added through the API", inboundTag)
 	default:
 		return nil
 	}
@@ -150,6 +180,9 @@ func (x *XrayAPI) AddUser(Protocol string, inboundTag string, user map[string]an
 			},
 		}),
 	})
+	if err == nil {
+		setAppliedUser(inboundTag, user["email"].(string), userKey(Protocol, user))
+	}
 	return err
 }
 
@@ -165,20 +198,78 @@ func (x *XrayAPI) RemoveUser(inboundTag, email string) error {
 
 	_, err := (*x.HandlerServiceClient).AlterInbound(ctx, req)
 	if err != nil {
+		// A user Xray doesn't have is as good as removed
+		if strings.Contains(err.Error(), fmt.Sprintf("User %s not found.", email)) {
+			removeAppliedUser(inboundTag, email)
+		}
 		return fmt.Errorf("failed to remove user: %w", err)
 	}
+	removeAppliedUser(inboundTag, email)
 
 	return nil
 }
 
+// Ping makes a cheap call to the stats service, to check that the API answers.
+func (x *XrayAPI) Ping(timeout time.Duration) error {
+	if x.StatsServiceClient == nil {
+		return common.NewError("xray api is not initialized")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	_, err := (*x.StatsServiceClient).GetSysStats(ctx, &statsService.SysStatsRequest{})
+	return err
+}
+
+// GetOutboundStatus returns the latest probes of the observatory, which only
+// answers if the config has an observatory and ObservatoryService in its API.
+func (x *XrayAPI) GetOutboundStatus(timeout time.Duration) ([]*OutboundStatus, error) {
+	if x.ObservatoryServiceClient == nil {
+		return nil, common.NewError("xray api is not initialized")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	resp, err := (*x.ObservatoryServiceClient).GetOutboundStatus(ctx, &observatoryService.GetOutboundStatusRequest{})
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]*OutboundStatus, 0, len(resp.GetStatus().GetStatus()))
+	for _, status := range resp.GetStatus().GetStatus() {
+		statuses = append(statuses, &OutboundStatus{
+			Tag:       status.OutboundTag,
+			Alive:     status.Alive,
+			Delay:     status.Delay,
+			LastError: status.LastErrorReason,
+			LastSeen:  status.LastSeenTime,
+			LastTry:   status.LastTryTime,
+		})
+	}
+	return statuses, nil
+}
+
+// GetOnlineIPs returns the IPs a client is connected from, with when they were
+// last seen in seconds. Xray only keeps them with statsUserOnline in its policy,
+// a client it has none for has none.
+func (x *XrayAPI) GetOnlineIPs(email string, timeout time.Duration) (map[string]int64, error) {
+	if x.StatsServiceClient == nil {
+		return nil, common.NewError("xray api is not initialized")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	resp, err := (*x.StatsServiceClient).GetStatsOnlineIpList(ctx, &statsService.GetStatsRequest{Name: "user>>>" + email + ">>>online"})
+	if status.Code(err) == codes.NotFound {
+		return map[string]int64{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return resp.GetIps(), nil
+}
+
 func (x *XrayAPI) GetTraffic(reset bool) ([]*Traffic, []*ClientTraffic, error) {
 	if x.grpcClient == nil {
 		return nil, nil, common.NewError("xray api is not initialized")
 	}
 
-	trafficRegex := regexp.MustCompile(`(inbound|outbound)>>>([^>]+)>>>traffic>>>(downlink|uplink)`)
-	clientTrafficRegex := regexp.MustCompile(`user>>>([^>]+)>>>traffic>>>(downlink|uplink)`)
-
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
 	defer cancel()
 
@@ -192,17 +283,57 @@ func (x *XrayAPI) GetTraffic(reset bool) ([]*Traffic, []*ClientTraffic, error) {
 		return nil, nil, err
 	}
 
+	counters := make(map[string]int64, len(resp.GetStat()))
+	for _, stat := range resp.GetStat() {
+		counters[stat.Name] = stat.Value
+	}
+	traffics, clientTraffics := TrafficFromCounters(counters)
+	return traffics, clientTraffics, nil
+}
+
+// GetCounters returns the values of all the stat counters of Xray without
+// resetting them, and how long Xray has been running, which tells when they
+// started from zero.
+func (x *XrayAPI) GetCounters() (map[string]int64, time.Duration, error) {
+	if x.StatsServiceClient == nil {
+		return nil, 0, common.NewError("xray api is not initialized")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	sys, err := (*x.StatsServiceClient).GetSysStats(ctx, &statsService.SysStatsRequest{})
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := (*x.StatsServiceClient).QueryStats(ctx, &statsService.QueryStatsRequest{})
+	if err != nil {
+		logger.Debug("Failed to query Xray stats:", err)
+		return nil, 0, err
+	}
+	counters := make(map[string]int64, len(resp.GetStat()))
+	for _, stat := range resp.GetStat() {
+		counters[stat.Name] = stat.Value
+	}
+	return counters, time.Duration(sys.GetUptime()) * time.Second, nil
+}
+
+// TrafficFromCounters returns the traffic of the inbounds, the outbounds and
+// the clients among stat counters of Xray, by their names.
+func TrafficFromCounters(counters map[string]int64) ([]*Traffic, []*ClientTraffic) {
+	trafficRegex := regexp.MustCompile(`(inbound|outbound)>>>([^>]+)>>>traffic>>>(downlink|uplink)`)
+	clientTrafficRegex := regexp.MustCompile(`user>>>([^>]+)>>>traffic>>>(downlink|uplink)`)
+
 	tagTrafficMap := make(map[string]*Traffic)
 	emailTrafficMap := make(map[string]*ClientTraffic)
 
-	for _, stat := range resp.GetStat() {
-		if matches := trafficRegex.FindStringSubmatch(stat.Name); len(matches) == 4 {
-			processTraffic(matches, stat.Value, tagTrafficMap)
-		} else if matches := clientTrafficRegex.FindStringSubmatch(stat.Name); len(matches) == 3 {
-			processClientTraffic(matches, stat.Value, emailTrafficMap)
+	for name, value := range counters {
+		if matches := trafficRegex.FindStringSubmatch(name); len(matches) == 4 {
+			processTraffic(matches, value, tagTrafficMap)
+		} else if matches := clientTrafficRegex.FindStringSubmatch(name); len(matches) == 3 {
+			processClientTraffic(matches, value, emailTrafficMap)
 		}
 	}
-	return mapToSlice(tagTrafficMap), mapToSlice(emailTrafficMap), nil
+	return mapToSlice(tagTrafficMap), mapToSlice(emailTrafficMap)
 }
 
 func processTraffic(matches []string, value int64, trafficMap map[string]*Traffic) {
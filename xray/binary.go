@@ -0,0 +1,89 @@
+package xray
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"x-ui/config"
+)
+
+// Binary is how Xray is run: its executable, the folder it takes its geo files
+// from, the folder it runs in and the arguments added to its command line.
+// Empty fields keep the defaults of the panel; a custom executable takes the
+// geo files of the bin folder unless told otherwise.
+type Binary struct {
+	Path     string   `json:"path,omitempty"`
+	AssetDir string   `json:"assetDir,omitempty"`
+	WorkDir  string   `json:"workDir,omitempty"`
+	Args     []string `json:"args,omitempty"`
+}
+
+var (
+	binaryLock sync.RWMutex
+	binary     Binary
+)
+
+// SetBinary sets how Xray is run from its next start on.
+func SetBinary(b Binary) {
+	binaryLock.Lock()
+	binary = b
+	binaryLock.Unlock()
+}
+
+// GetBinary returns how Xray is run.
+func GetBinary() Binary {
+	binaryLock.RLock()
+	defer binaryLock.RUnlock()
+	return binary
+}
+
+// GetBinaryPath returns the executable of Xray: the one of the settings, or the
+// one in the bin folder of the panel.
+func (b Binary) GetBinaryPath() string {
+	if b.Path != "" {
+		return b.Path
+	}
+	return GetDefaultBinaryPath()
+}
+
+// IsCustom tells if the executable is another one than the one the panel
+// installs.
+func (b Binary) IsCustom() bool {
+	return b.Path != "" && b.Path != GetDefaultBinaryPath()
+}
+
+func (b Binary) Equals(other Binary) bool {
+	return b.GetBinaryPath() == other.GetBinaryPath() && b.AssetDir == other.AssetDir &&
+		b.WorkDir == other.WorkDir && slices.Equal(b.Args, other.Args)
+}
+
+// absPath makes a path of the panel absolute, for Xray running in another
+// folder.
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+// command returns the command running Xray with args, in its folder and with
+// its geo files. The extra arguments aren't added; paths among args must be
+// absolute.
+func (b Binary) command(ctx context.Context, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, absPath(b.GetBinaryPath()), args...)
+	cmd.Dir = b.WorkDir
+	assetDir := b.AssetDir
+	if assetDir == "" && b.IsCustom() {
+		// Xray looks for its geo files next to itself, the panel keeps them in
+		// its bin folder
+		assetDir = config.GetBinFolderPath()
+	}
+	if assetDir != "" {
+		cmd.Env = append(os.Environ(), "XRAY_LOCATION_ASSET="+absPath(assetDir))
+	}
+	return cmd
+}
@@ -0,0 +1,71 @@
+package xray
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"time"
+
+	"x-ui/config"
+	"x-ui/util/common"
+)
+
+// configTestTimeout bounds how long Xray may take to check a config
+const configTestTimeout = 15 * time.Second
+
+// ErrNoBinary is returned by TestConfig when the Xray binary isn't installed.
+var ErrNoBinary = errors.New("the xray binary is not installed")
+
+// TestError is returned by TestConfig when Xray rejects a config. Output is all
+// Xray printed, the error is its last line, the reason.
+type TestError struct {
+	Output string
+}
+
+func (e *TestError) Error() string {
+	lines := strings.Split(strings.TrimSpace(e.Output), "\n")
+	return "xray rejected the config: " + strings.TrimSpace(lines[len(lines)-1])
+}
+
+// TestConfig checks a config with "xray -test" before it is applied, returning
+// the reason Xray gives if the config doesn't load.
+func TestConfig(xrayConfig *Config) error {
+	binary := GetBinary()
+	if _, err := os.Stat(binary.GetBinaryPath()); err != nil {
+		return ErrNoBinary
+	}
+	data, err := json.MarshalIndent(xrayConfig, "", "  ")
+	if err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(config.GetBinFolderPath(), "config-test-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	file.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), configTestTimeout)
+	defer cancel()
+	cmd := binary.command(ctx, append([]string{"-test", "-c", absPath(file.Name())}, binary.Args...)...)
+	if cmd.Dir == "" {
+		cmd.Dir = config.GetBinFolderPath()
+	}
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Run(); err != nil {
+		if out.Len() == 0 {
+			return common.NewErrorf("xray failed to check the config: %v", err)
+		}
+		return &TestError{Output: out.String()}
+	}
+	return nil
+}
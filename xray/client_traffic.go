@@ -1,5 +1,7 @@
 package xray
 
+import "encoding/json"
+
 type ClientTraffic struct {
 	Id         int    `json:"id" form:"id" gorm:"primaryKey;autoIncrement"`
 	InboundId  int    `json:"inboundId" form:"inboundId"`
@@ -10,4 +12,49 @@ type ClientTraffic struct {
 	ExpiryTime int64  `json:"expiryTime" form:"expiryTime"`
 	Total      int64  `json:"total" form:"total"`
 	Reset      int    `json:"reset" form:"reset" gorm:"default:0"`
+	// Tags mirrors the tags of the client, as ",tag1,tag2," for querying
+	Tags string `json:"-" form:"-"`
+	// DisabledReason tells why the client is off: "quota" or "expiry" if it was
+	// disabled for depletion, "admin" if it was disabled in its settings,
+	// "iplimit" if it connected from more IPs than it may
+	DisabledReason string `json:"disabledReason,omitempty" form:"-"`
+	// DisabledAt is when the client was disabled for DisabledReason
+	DisabledAt int64 `json:"disabledAt,omitempty" form:"-"`
+	// LastReset is when the traffic was last zeroed by the reset policy of
+	// the client
+	LastReset int64 `json:"lastReset,omitempty" form:"-"`
+	// LastNotifiedThreshold is the highest traffic notification threshold, in
+	// percent, the client is past; it follows the usage down after a reset
+	LastNotifiedThreshold int `json:"-" form:"-"`
+	// LastNotifiedExpiry is the lowest expiry reminder threshold, in days, the
+	// client was reminded of for the expiry of LastExpiryNotice
+	LastNotifiedExpiry int `json:"-" form:"-"`
+	// LastExpiryNotice is the expiry time the client was last reminded of; a
+	// renewal changes the expiry, which starts the reminders over
+	LastExpiryNotice int64 `json:"-" form:"-"`
+	// LastSeen is when the client last passed traffic or connected, in
+	// milliseconds
+	LastSeen int64 `json:"lastSeen,omitempty" form:"-"`
+	// LastSubFetch is when the subscription of the client was last fetched,
+	// in milliseconds, and LastUserAgent the app it was fetched by
+	LastSubFetch  int64  `json:"lastSubFetch,omitempty" form:"-"`
+	LastUserAgent string `json:"lastUserAgent,omitempty" form:"-"`
+	// CreatedAt is when the client was added, in milliseconds; 0 for the
+	// clients added before it was kept
+	CreatedAt int64 `json:"createdAt,omitempty" form:"-" gorm:"autoCreateTime:milli"`
+	// CarriedOver is the unused traffic of the last period a reset with carry
+	// over added to Total, which is the totalGB of the client with it
+	CarriedOver int64 `json:"carriedOver" form:"-"`
+	// NextReset is when the reset policy zeroes the traffic next, if it has one
+	NextReset int64 `json:"nextReset,omitempty" form:"-" gorm:"-"`
+	// BaseQuota and EffectiveQuota are the quota of the client without and
+	// with what was carried over to it, filled in as it is marshaled
+	BaseQuota      int64 `json:"baseQuota" form:"-" gorm:"-"`
+	EffectiveQuota int64 `json:"effectiveQuota" form:"-" gorm:"-"`
+}
+
+func (t ClientTraffic) MarshalJSON() ([]byte, error) {
+	type clientTraffic ClientTraffic
+	t.BaseQuota, t.EffectiveQuota = t.Total-t.CarriedOver, t.Total
+	return json.Marshal(clientTraffic(t))
 }
@@ -2,6 +2,9 @@ package xray
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 
 	"x-ui/util/json_util"
 )
@@ -23,6 +26,29 @@ type Config struct {
 	Metrics          json_util.RawMessage `json:"metrics"`
 }
 
+// Hash returns the SHA-256 of the config in hex, over its JSON with the keys of
+// all objects sorted, so that configs alike but for the order of their keys or
+// their spacing hash the same.
+func (c *Config) Hash() string {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return ""
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var canonical any
+	if err := decoder.Decode(&canonical); err != nil {
+		return ""
+	}
+	// encoding/json marshals the keys of maps sorted
+	data, err = json.Marshal(canonical)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
 func (c *Config) Equals(other *Config) bool {
 	if len(c.InboundConfigs) != len(other.InboundConfigs) {
 		return false
@@ -62,6 +88,12 @@ func (c *Config) Equals(other *Config) bool {
 	if !bytes.Equal(c.FakeDNS, other.FakeDNS) {
 		return false
 	}
+	if !bytes.Equal(c.Observatory, other.Observatory) {
+		return false
+	}
+	if !bytes.Equal(c.BurstObservatory, other.BurstObservatory) {
+		return false
+	}
 	if !bytes.Equal(c.Metrics, other.Metrics) {
 		return false
 	}
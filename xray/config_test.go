@@ -0,0 +1,73 @@
+package xray
+
+import (
+	"testing"
+
+	"x-ui/util/json_util"
+)
+
+func testConfig(settings string, log string) *Config {
+	return &Config{
+		LogConfig: json_util.RawMessage(log),
+		InboundConfigs: []InboundConfig{{
+			Listen:   json_util.RawMessage(`"0.0.0.0"`),
+			Port:     json_util.RawMessage(`443`),
+			Protocol: "vless",
+			Settings: json_util.RawMessage(settings),
+			Tag:      "inbound-443",
+		}},
+	}
+}
+
+func TestConfigHashDeterministic(t *testing.T) {
+	config := testConfig(`{"clients":[{"id":"a","email":"x"}],"decryption":"none"}`, `{"loglevel":"warning"}`)
+	hash := config.Hash()
+	if hash == "" {
+		t.Fatal("empty hash")
+	}
+	for i := 0; i < 100; i++ {
+		if again := config.Hash(); again != hash {
+			t.Fatalf("hash %d = %s, want %s", i, again, hash)
+		}
+	}
+}
+
+func TestConfigHashCanonical(t *testing.T) {
+	base := testConfig(`{"clients":[{"id":"a","email":"x"}],"decryption":"none"}`, `{"loglevel":"warning","access":"none"}`)
+	tests := []struct {
+		name   string
+		config *Config
+		same   bool
+	}{
+		{"keys reordered", testConfig(`{"decryption":"none","clients":[{"email":"x","id":"a"}]}`, `{"access":"none","loglevel":"warning"}`), true},
+		{"spacing", testConfig("{ \"clients\" : [ {\"id\":\"a\", \"email\":\"x\"} ],\n \"decryption\":\"none\" }", `{"loglevel": "warning", "access": "none"}`), true},
+		{"value changed", testConfig(`{"clients":[{"id":"b","email":"x"}],"decryption":"none"}`, `{"loglevel":"warning","access":"none"}`), false},
+		{"log changed", testConfig(`{"clients":[{"id":"a","email":"x"}],"decryption":"none"}`, `{"loglevel":"debug","access":"none"}`), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if same := test.config.Hash() == base.Hash(); same != test.same {
+				t.Errorf("same hash = %v, want %v", same, test.same)
+			}
+		})
+	}
+}
+
+func TestConfigHashArrayOrder(t *testing.T) {
+	// The order of arrays means something to Xray, the first routing rule that
+	// matches wins, so configs alike but for it must reload it
+	a := testConfig(`{"clients":[{"id":"a","email":"x"},{"id":"b","email":"y"}],"decryption":"none"}`, `{}`)
+	b := testConfig(`{"clients":[{"id":"b","email":"y"},{"id":"a","email":"x"}],"decryption":"none"}`, `{}`)
+	if a.Hash() == b.Hash() {
+		t.Error("configs with the clients reordered hash the same")
+	}
+}
+
+func TestConfigHashKeepsNumbers(t *testing.T) {
+	// Numbers beyond the precision of a float64 must not collapse
+	a := testConfig(`{"level":9007199254740993}`, `{}`)
+	b := testConfig(`{"level":9007199254740992}`, `{}`)
+	if a.Hash() == b.Hash() {
+		t.Error("configs with different large numbers hash the same")
+	}
+}
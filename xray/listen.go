@@ -0,0 +1,140 @@
+package xray
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"x-ui/util/common"
+)
+
+// InboundListener is the address and the port an inbound listens on.
+type InboundListener struct {
+	Tag     string `json:"tag"`
+	Listen  string `json:"listen,omitempty"`
+	Port    int    `json:"port"`
+	Network string `json:"network"`
+}
+
+// Listener returns where the inbound listens. It returns false for inbounds on
+// unix sockets and on ports the panel can't read, like the "env:" ones; of a
+// range or a list of ports, only the first one is returned.
+func (c *InboundConfig) Listener() (InboundListener, bool) {
+	listener := InboundListener{Tag: c.Tag, Network: "tcp"}
+	if len(c.Listen) > 0 {
+		json.Unmarshal(c.Listen, &listener.Listen)
+	}
+	if strings.HasPrefix(listener.Listen, "/") || strings.HasPrefix(listener.Listen, "@") {
+		return listener, false
+	}
+
+	var port any
+	if err := json.Unmarshal(c.Port, &port); err != nil {
+		return listener, false
+	}
+	switch port := port.(type) {
+	case float64:
+		listener.Port = int(port)
+	case string:
+		first, _, _ := strings.Cut(port, ",")
+		first, _, _ = strings.Cut(first, "-")
+		listener.Port, _ = strconv.Atoi(strings.TrimSpace(first))
+	}
+	if listener.Port <= 0 || listener.Port > 65535 {
+		return listener, false
+	}
+
+	if c.udpOnly() {
+		listener.Network = "udp"
+	}
+	return listener, true
+}
+
+// udpOnly tells if the inbound only listens on UDP.
+func (c *InboundConfig) udpOnly() bool {
+	switch c.Protocol {
+	case "wireguard", "hysteria":
+		return true
+	}
+	var stream struct {
+		Network string `json:"network"`
+	}
+	json.Unmarshal(c.StreamSettings, &stream)
+	if stream.Network == "kcp" {
+		return true
+	}
+	var settings struct {
+		Network string `json:"network"`
+	}
+	json.Unmarshal(c.Settings, &settings)
+	return settings.Network == "udp"
+}
+
+// CheckListening checks that something listens on the port of listener, on any
+// address. Where /proc/net can't be read, TCP ports are checked by connecting
+// to them and UDP ports aren't checked.
+func CheckListening(listener InboundListener) error {
+	ports, err := procListeningPorts(listener.Network)
+	if err == nil {
+		if !ports[listener.Port] {
+			return common.NewErrorf("nothing listens on %s port %d", listener.Network, listener.Port)
+		}
+		return nil
+	}
+	if listener.Network != "tcp" {
+		return nil
+	}
+
+	host := listener.Listen
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(listener.Port)), time.Second)
+	if err != nil {
+		return common.NewErrorf("nothing listens on %s port %d: %v", listener.Network, listener.Port, err)
+	}
+	conn.Close()
+	return nil
+}
+
+// procListeningPorts returns the ports of the sockets listening on network,
+// from the tables of /proc/net.
+func procListeningPorts(network string) (map[int]bool, error) {
+	// TCP sockets that listen are in the state LISTEN, UDP ones in the state CLOSE
+	state := "0A"
+	if network == "udp" {
+		state = "07"
+	}
+	ports := map[int]bool{}
+	read := false
+	for _, name := range []string{network, network + "6"} {
+		file, err := os.Open("/proc/net/" + name)
+		if err != nil {
+			continue
+		}
+		read = true
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 4 || fields[3] != state {
+				continue
+			}
+			_, hexPort, ok := strings.Cut(fields[1], ":")
+			if !ok {
+				continue
+			}
+			if port, err := strconv.ParseInt(hexPort, 16, 32); err == nil {
+				ports[int(port)] = true
+			}
+		}
+		file.Close()
+	}
+	if !read {
+		return nil, common.NewErrorf("/proc/net/%s can't be read", network)
+	}
+	return ports, nil
+}
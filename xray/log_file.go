@@ -0,0 +1,278 @@
+package xray
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"x-ui/util/common"
+)
+
+const (
+	// logChunkSize is how much of a log file is read at once
+	logChunkSize = 64 * 1024
+	// maxLogScan is how far from its end a log file is searched for the lines
+	// of a tail, so that a rare match doesn't read a whole access log
+	maxLogScan = 64 * 1024 * 1024
+	// maxLogLine is the longest line kept of a log file, longer ones are cut
+	maxLogLine = 64 * 1024
+)
+
+// logLevels are the severities of the error log of Xray, from the lowest.
+var logLevels = []string{"debug", "info", "warning", "error"}
+
+// LogLevel returns the rank of a severity of the error log, or -1 if it isn't
+// one.
+func LogLevel(level string) int {
+	for i, name := range logLevels {
+		if strings.EqualFold(level, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// LogPath returns the file the config has Xray write a log to, kind being
+// "access" or "error". It returns "" if the log is disabled or written to the
+// output of Xray.
+func (c *Config) LogPath(kind string) string {
+	var log map[string]any
+	if json.Unmarshal(c.LogConfig, &log) != nil {
+		return ""
+	}
+	path, _ := log[kind].(string)
+	if path == "none" {
+		return ""
+	}
+	return path
+}
+
+// LogLine is a line of a log of Xray, with its time and its severity when it
+// starts with them, like "2025/08/03 12:00:00.123456 [Warning] message".
+type LogLine struct {
+	Time    time.Time `json:"time,omitzero"`
+	Level   string    `json:"level,omitempty"`
+	Message string    `json:"message"`
+	Line    string    `json:"line"`
+}
+
+// ParseLogLine splits a line of a log of Xray into its time, its severity and
+// its message; what it doesn't start with is left empty.
+func ParseLogLine(line string) LogLine {
+	logLine := LogLine{Message: line, Line: line}
+	for _, layout := range []string{"2006/01/02 15:04:05.000000", "2006/01/02 15:04:05"} {
+		if len(line) < len(layout) {
+			continue
+		}
+		t, err := time.ParseInLocation(layout, line[:len(layout)], time.Local)
+		if err != nil {
+			continue
+		}
+		logLine.Time = t
+		logLine.Message = strings.TrimSpace(line[len(layout):])
+		break
+	}
+	if rest, ok := strings.CutPrefix(logLine.Message, "["); ok {
+		if level, message, ok := strings.Cut(rest, "]"); ok && LogLevel(level) >= 0 {
+			logLine.Level = strings.ToLower(level)
+			logLine.Message = strings.TrimSpace(message)
+		}
+	}
+	return logLine
+}
+
+// tailFile returns the last count lines of the first end bytes of file that
+// match, oldest first. It reads the file backwards by chunks, and stops after
+// maxLogScan bytes; truncated tells then that older lines might match too.
+func tailFile(file *os.File, end int64, count int, match func(LogLine) bool) (lines []LogLine, truncated bool, err error) {
+	lines = []LogLine{}
+	var (
+		chunk   = make([]byte, logChunkSize)
+		partial []byte
+		offset  = end
+	)
+	keep := func(data []byte) bool {
+		line := strings.TrimSpace(string(data))
+		if len(line) > maxLogLine {
+			line = line[:maxLogLine]
+		}
+		if line == "" {
+			return false
+		}
+		logLine := ParseLogLine(line)
+		if match == nil || match(logLine) {
+			lines = append(lines, logLine)
+		}
+		return len(lines) >= count
+	}
+
+	full := false
+	for offset > 0 && !full {
+		if end-offset >= maxLogScan {
+			truncated = true
+			break
+		}
+		size := min(int64(logChunkSize), offset)
+		offset -= size
+		if _, err := file.ReadAt(chunk[:size], offset); err != nil && err != io.EOF {
+			return nil, false, err
+		}
+		data := append(chunk[:size:size], partial...)
+		// Every line of data but the first one is complete, the first one might
+		// go on in the chunk before
+		for {
+			i := bytes.LastIndexByte(data, '\n')
+			if i < 0 {
+				break
+			}
+			if full = keep(data[i+1:]); full {
+				break
+			}
+			data = data[:i]
+		}
+		if len(data) > maxLogLine {
+			data = data[len(data)-maxLogLine:]
+		}
+		partial = append([]byte(nil), data...)
+	}
+	if !full && !truncated && offset == 0 {
+		keep(partial)
+	}
+
+	for i, j := 0, len(lines)-1; i < j; i, j = i+1, j-1 {
+		lines[i], lines[j] = lines[j], lines[i]
+	}
+	return lines, truncated, nil
+}
+
+// TailLog returns the last count lines of a log file that match, oldest
+// first, without reading the whole file.
+func TailLog(path string, count int, match func(LogLine) bool) ([]LogLine, bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, false, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, false, err
+	}
+	return tailFile(file, info.Size(), count, match)
+}
+
+// LogFollower reads the lines written to a log file after it was opened. When
+// the file is rotated, the rest of the old file is read, then the new file from
+// its start.
+type LogFollower struct {
+	path    string
+	file    *os.File
+	info    os.FileInfo
+	offset  int64
+	partial []byte
+}
+
+// FollowLog opens a log file to read what is written to it from now on.
+func FollowLog(path string) (*LogFollower, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	f := &LogFollower{path: path, file: file, info: info, offset: info.Size()}
+	// A line being written is read whole once it ends
+	start := max(f.offset-maxLogLine, 0)
+	last := make([]byte, f.offset-start)
+	if _, err := file.ReadAt(last, start); err == nil || err == io.EOF {
+		if i := bytes.LastIndexByte(last, '\n'); i >= 0 {
+			f.offset = start + int64(i) + 1
+		} else if start == 0 {
+			f.offset = 0
+		}
+	}
+	return f, nil
+}
+
+// Tail returns the last count lines that match, written before the follower
+// was opened.
+func (f *LogFollower) Tail(count int, match func(LogLine) bool) ([]LogLine, bool, error) {
+	return tailFile(f.file, f.offset, count, match)
+}
+
+// Next returns the lines written since the last call.
+func (f *LogFollower) Next() ([]LogLine, error) {
+	lines, err := f.read()
+	if err != nil {
+		return lines, err
+	}
+
+	info, err := os.Stat(f.path)
+	if err != nil {
+		// Between the rename and the new file of a rotation
+		return lines, nil
+	}
+	switch {
+	case !os.SameFile(info, f.info):
+		file, err := os.Open(f.path)
+		if err != nil {
+			return lines, nil
+		}
+		if info, err = file.Stat(); err != nil {
+			file.Close()
+			return lines, nil
+		}
+		f.file.Close()
+		f.file, f.info, f.offset, f.partial = file, info, 0, nil
+	case info.Size() < f.offset:
+		// Truncated in place, like by copytruncate
+		f.offset, f.partial = 0, nil
+	default:
+		return lines, nil
+	}
+	more, err := f.read()
+	return append(lines, more...), err
+}
+
+func (f *LogFollower) read() ([]LogLine, error) {
+	var lines []LogLine
+	chunk := make([]byte, logChunkSize)
+	for {
+		n, err := f.file.ReadAt(chunk, f.offset)
+		f.offset += int64(n)
+		data := append(f.partial, chunk[:n]...)
+		for {
+			i := bytes.IndexByte(data, '\n')
+			if i < 0 {
+				break
+			}
+			if line := strings.TrimSpace(string(data[:i])); line != "" {
+				if len(line) > maxLogLine {
+					line = line[:maxLogLine]
+				}
+				lines = append(lines, ParseLogLine(line))
+			}
+			data = data[i+1:]
+		}
+		if len(data) > maxLogLine {
+			data = data[:maxLogLine]
+		}
+		f.partial = append(f.partial[:0:0], data...)
+		if err != nil && err != io.EOF {
+			return lines, common.NewErrorf("read %s: %v", f.path, err)
+		}
+		if n < len(chunk) {
+			return lines, nil
+		}
+	}
+}
+
+// Close closes the log file.
+func (f *LogFollower) Close() error {
+	return f.file.Close()
+}
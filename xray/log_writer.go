@@ -3,6 +3,7 @@ package xray
 import (
 	"regexp"
 	"strings"
+	"sync"
 
 	"x-ui/logger"
 )
@@ -11,8 +12,70 @@ func NewLogWriter() *LogWriter {
 	return &LogWriter{}
 }
 
+// logTailLines is how many lines of its output are kept of Xray, for the
+// reports of failed starts
+const logTailLines = 50
+
+// DefaultStderrTailSize is how many bytes of the end of its stderr a process
+// keeps unless told otherwise.
+const DefaultStderrTailSize = 16 << 10
+
+// tailBuffer keeps the last size bytes written to it.
+type tailBuffer struct {
+	lock sync.Mutex
+	size int
+	data []byte
+}
+
+func newTailBuffer(size int) *tailBuffer {
+	return &tailBuffer{size: max(size, 0)}
+}
+
+func (b *tailBuffer) Write(m []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if len(m) >= b.size {
+		b.data = append(b.data[:0], m[len(m)-b.size:]...)
+		return len(m), nil
+	}
+	if over := len(b.data) + len(m) - b.size; over > 0 {
+		b.data = append(b.data[:0], b.data[over:]...)
+	}
+	b.data = append(b.data, m...)
+	return len(m), nil
+}
+
+func (b *tailBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return string(b.data)
+}
+
 type LogWriter struct {
 	lastLine string
+
+	tailLock sync.Mutex
+	tail     []string
+}
+
+// Tail returns the last lines Xray printed.
+func (lw *LogWriter) Tail() []string {
+	lw.tailLock.Lock()
+	defer lw.tailLock.Unlock()
+	return append([]string(nil), lw.tail...)
+}
+
+func (lw *LogWriter) keep(message string) {
+	lw.tailLock.Lock()
+	defer lw.tailLock.Unlock()
+	for line := range strings.SplitSeq(message, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lw.tail = append(lw.tail, line)
+		}
+	}
+	if len(lw.tail) > logTailLines {
+		lw.tail = append([]string(nil), lw.tail[len(lw.tail)-logTailLines:]...)
+	}
 }
 
 func (lw *LogWriter) Write(m []byte) (n int, err error) {
@@ -20,6 +83,7 @@ func (lw *LogWriter) Write(m []byte) (n int, err error) {
 
 	// Convert the data to a string
 	message := strings.TrimSpace(string(m))
+	lw.keep(message)
 
 	// Check if the message contains a crash
 	if crashRegex.MatchString(message) {
@@ -2,13 +2,18 @@ package xray
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"os"
 	"os/exec"
 	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -21,14 +26,26 @@ func GetBinaryName() string {
 	return fmt.Sprintf("xray-%s-%s", runtime.GOOS, runtime.GOARCH)
 }
 
-func GetBinaryPath() string {
+// GetDefaultBinaryPath is where the panel installs Xray
+func GetDefaultBinaryPath() string {
 	return config.GetBinFolderPath() + "/" + GetBinaryName()
 }
 
+// GetBinaryPath returns the executable Xray is run with
+func GetBinaryPath() string {
+	return GetBinary().GetBinaryPath()
+}
+
 func GetConfigPath() string {
 	return config.GetBinFolderPath() + "/config.json"
 }
 
+// GetGoodConfigPath is where the last config Xray ran healthy with is kept, to
+// go back to when a new one fails
+func GetGoodConfigPath() string {
+	return config.GetBinFolderPath() + "/config.good.json"
+}
+
 func GetGeositePath() string {
 	return config.GetBinFolderPath() + "/geosite.dat"
 }
@@ -49,6 +66,12 @@ func GetIPLimitBannedPrevLogPath() string {
 	return config.GetLogFolder() + "/3xipl-banned.prev.log"
 }
 
+// GetDefaultAccessLogPath is where the access log is written if the Xray config
+// has none but IP limits need one
+func GetDefaultAccessLogPath() string {
+	return config.GetLogFolder() + "/access.log"
+}
+
 func GetAccessPersistentLogPath() string {
 	return config.GetLogFolder() + "/3xipl-ap.log"
 }
@@ -90,51 +113,75 @@ type Process struct {
 }
 
 func NewProcess(xrayConfig *Config) *Process {
-	p := &Process{newProcess(xrayConfig)}
+	return NewProcessWith(xrayConfig, GetBinary())
+}
+
+// NewProcessWith returns a process running Xray as binary tells, rather than as
+// the settings do.
+func NewProcessWith(xrayConfig *Config, binary Binary) *Process {
+	p := &Process{newProcess(xrayConfig, binary)}
 	runtime.SetFinalizer(p, stopProcess)
 	return p
 }
 
 type process struct {
-	cmd *exec.Cmd
-
 	version string
 	apiPort int
 
-	onlineClients []string
-
 	config    *Config
+	binary    Binary
 	logWriter *LogWriter
-	exitErr   error
 	startTime time.Time
+
+	// lock guards what the goroutine running cmd records of it: the process
+	// once it started, and how and when it exited
+	lock       sync.Mutex
+	running    *os.Process
+	exited     bool
+	exitCode   int
+	exitSignal string
+	exitErr    error
+	exitTime   time.Time
+
+	// configHash is the Hash of config, generatedAt when config was made
+	configHash  string
+	generatedAt time.Time
+
+	// stderr keeps the end of what Xray wrote to stderr, for crash reports
+	stderr *tailBuffer
+	// exitExpected is set when the panel stops the process to restart or stop
+	// Xray, its exit is no crash then
+	exitExpected atomic.Bool
 }
 
-func newProcess(config *Config) *process {
+func newProcess(config *Config, binary Binary) *process {
 	return &process{
-		version:   "Unknown",
-		config:    config,
-		logWriter: NewLogWriter(),
-		startTime: time.Now(),
+		version:     "Unknown",
+		config:      config,
+		binary:      binary,
+		logWriter:   NewLogWriter(),
+		configHash:  config.Hash(),
+		generatedAt: time.Now(),
+		startTime:   time.Now(),
+		stderr:      newTailBuffer(DefaultStderrTailSize),
 	}
 }
 
 func (p *process) IsRunning() bool {
-	if p.cmd == nil || p.cmd.Process == nil {
-		return false
-	}
-	if p.cmd.ProcessState == nil {
-		return true
-	}
-	return false
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.running != nil && !p.exited
 }
 
 func (p *process) GetErr() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
 	return p.exitErr
 }
 
 func (p *process) GetResult() string {
-	if len(p.logWriter.lastLine) == 0 && p.exitErr != nil {
-		return p.exitErr.Error()
+	if err := p.GetErr(); len(p.logWriter.lastLine) == 0 && err != nil {
+		return err.Error()
 	}
 	return p.logWriter.lastLine
 }
@@ -151,29 +198,119 @@ func (p *Process) GetConfig() *Config {
 	return p.config
 }
 
-func (p *Process) GetOnlineClients() []string {
-	return p.onlineClients
+// GetConfigHash returns the Hash of the config the process runs.
+func (p *Process) GetConfigHash() string {
+	return p.configHash
+}
+
+// GetConfigGeneratedAt returns when the config the process runs was generated.
+func (p *Process) GetConfigGeneratedAt() time.Time {
+	return p.generatedAt
+}
+
+// GetBinary returns how the process runs Xray.
+func (p *Process) GetBinary() Binary {
+	return p.binary
 }
 
-func (p *Process) SetOnlineClients(users []string) {
-	p.onlineClients = users
+// GetOutput returns the last lines the process printed.
+func (p *Process) GetOutput() []string {
+	return p.logWriter.Tail()
 }
 
+// GetUptime returns how long the process has run, or ran until it exited.
 func (p *Process) GetUptime() uint64 {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !p.exitTime.IsZero() {
+		return uint64(p.exitTime.Sub(p.startTime).Seconds())
+	}
 	return uint64(time.Since(p.startTime).Seconds())
 }
 
+// SetStderrTail sets how many bytes of the end of its stderr the process
+// keeps, before it starts.
+func (p *Process) SetStderrTail(size int) {
+	p.stderr = newTailBuffer(size)
+}
+
+// GetStderr returns the end of what the process wrote to stderr.
+func (p *Process) GetStderr() string {
+	return p.stderr.String()
+}
+
+// ExpectExit marks the next exit of the process as one the panel asks for, to
+// restart or stop Xray, so that it isn't taken for a crash.
+func (p *process) ExpectExit() {
+	p.exitExpected.Store(true)
+}
+
+// ExitExpected tells whether the panel stopped the process, rather than it
+// exiting on its own.
+func (p *process) ExitExpected() bool {
+	return p.exitExpected.Load()
+}
+
+// ExitState returns how the process exited: its exit code, and the signal
+// that ended it if one did. ok is false while it runs or if it never ran.
+func (p *process) ExitState() (code int, signal string, ok bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !p.exited {
+		return 0, "", false
+	}
+	return p.exitCode, p.exitSignal, true
+}
+
+// GetPid returns the id of the process the panel started, 0 if it isn't running.
+func (p *process) GetPid() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.running == nil || p.exited {
+		return 0
+	}
+	return p.running.Pid
+}
+
+// run runs cmd to its exit and records how it exited.
+func (p *process) run(cmd *exec.Cmd) {
+	err := cmd.Start()
+	if err == nil {
+		p.lock.Lock()
+		p.running = cmd.Process
+		p.lock.Unlock()
+		err = cmd.Wait()
+	}
+
+	p.lock.Lock()
+	p.exitTime = time.Now()
+	if state := cmd.ProcessState; state != nil {
+		p.exited = true
+		p.exitCode = state.ExitCode()
+		if status, isWait := state.Sys().(syscall.WaitStatus); isWait && status.Signaled() {
+			p.exitSignal = status.Signal().String()
+		}
+	}
+	if err != nil {
+		p.exitErr = err
+	}
+	p.lock.Unlock()
+	if err != nil {
+		logger.Error("Failure in running xray-core:", err)
+	}
+}
+
 func (p *process) refreshAPIPort() {
 	for _, inbound := range p.config.InboundConfigs {
 		if inbound.Tag == "api" {
-			p.apiPort = inbound.Port
+			p.apiPort, _ = strconv.Atoi(string(inbound.Port))
 			break
 		}
 	}
 }
 
 func (p *process) refreshVersion() {
-	cmd := exec.Command(GetBinaryPath(), "-version")
+	cmd := p.binary.command(context.Background(), "-version")
 	data, err := cmd.Output()
 	if err != nil {
 		p.version = "Unknown"
@@ -195,7 +332,9 @@ func (p *process) Start() (err error) {
 	defer func() {
 		if err != nil {
 			logger.Error("Failure in running xray-core process: ", err)
+			p.lock.Lock()
 			p.exitErr = err
+			p.lock.Unlock()
 		}
 	}()
 
@@ -215,19 +354,13 @@ func (p *process) Start() (err error) {
 		return common.NewErrorf("Failed to write configuration file: %v", err)
 	}
 
-	cmd := exec.Command(GetBinaryPath(), "-c", configPath)
-	p.cmd = cmd
+	cmd := p.binary.command(context.Background(), append([]string{"-c", absPath(configPath)}, p.binary.Args...)...)
+	resetAppliedUsers(p.config)
 
 	cmd.Stdout = p.logWriter
-	cmd.Stderr = p.logWriter
+	cmd.Stderr = io.MultiWriter(p.logWriter, p.stderr)
 
-	go func() {
-		err := cmd.Run()
-		if err != nil {
-			logger.Error("Failure in running xray-core:", err)
-			p.exitErr = err
-		}
-	}()
+	go p.run(cmd)
 
 	p.refreshVersion()
 	p.refreshAPIPort()
@@ -236,14 +369,20 @@ func (p *process) Start() (err error) {
 }
 
 func (p *process) Stop() error {
-	if !p.IsRunning() {
+	p.lock.Lock()
+	running := p.running
+	if p.exited {
+		running = nil
+	}
+	p.lock.Unlock()
+	if running == nil {
 		return errors.New("xray is not running")
 	}
-	
+
 	if runtime.GOOS == "windows" {
-		return p.cmd.Process.Kill()
+		return running.Kill()
 	} else {
-		return p.cmd.Process.Signal(syscall.SIGTERM)
+		return running.Signal(syscall.SIGTERM)
 	}
 }
 
@@ -0,0 +1,128 @@
+package xray
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTailBuffer(t *testing.T) {
+	b := newTailBuffer(8)
+	for _, m := range []string{"abc", "def", "ghi"} {
+		if n, err := b.Write([]byte(m)); n != len(m) || err != nil {
+			t.Fatalf("writing %q wrote %d, %v", m, n, err)
+		}
+	}
+	if s := b.String(); s != "bcdefghi" {
+		t.Errorf("the tail is %q", s)
+	}
+	b.Write([]byte("0123456789"))
+	if s := b.String(); s != "23456789" {
+		t.Errorf("the tail of a long write is %q", s)
+	}
+	empty := newTailBuffer(-1)
+	empty.Write([]byte("lost"))
+	if s := empty.String(); s != "" {
+		t.Errorf("a tail of no size keeps %q", s)
+	}
+}
+
+// startTestProcess starts with a fake Xray crashing with SIGSEGV after writing
+// its stderr, or running until it is stopped.
+func startTestProcess(t *testing.T, crash bool) *Process {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("XUI_BIN_FOLDER", dir)
+	t.Setenv("XUI_LOG_FOLDER", dir)
+	script := `#!/bin/sh
+[ "$1" = "-version" ] && { echo "Xray 25.1.1 (Xray, Penetrates Everything.)"; exit 0; }
+exec sleep 60
+`
+	if crash {
+		script = `#!/bin/sh
+[ "$1" = "-version" ] && { echo "Xray 25.1.1 (Xray, Penetrates Everything.)"; exit 0; }
+i=0
+while [ $i -lt 100 ]; do echo "goroutine $i [running]:" >&2; i=$((i+1)); done
+echo "panic: runtime error: invalid memory address or nil pointer dereference" >&2
+kill -SEGV $$
+`
+	}
+	if err := os.WriteFile(filepath.Join(dir, GetBinaryName()), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	SetBinary(Binary{})
+	p := NewProcess(&Config{})
+	p.SetStderrTail(256)
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if p.IsRunning() {
+			p.Stop()
+		}
+	})
+	return p
+}
+
+func waitTestProcess(t *testing.T, p *Process) {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); p.IsRunning(); time.Sleep(20 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the process didn't exit")
+		}
+	}
+}
+
+func TestProcessCrash(t *testing.T) {
+	p := startTestProcess(t, true)
+	waitTestProcess(t, p)
+
+	code, signal, ok := p.ExitState()
+	if !ok || code != -1 || signal != "segmentation fault" {
+		t.Errorf("the process exited with %d, %q, %v", code, signal, ok)
+	}
+	if p.ExitExpected() {
+		t.Error("the crash was expected")
+	}
+	// The end of stderr, up to the size of the tail
+	stderr := p.GetStderr()
+	if len(stderr) != 256 || !strings.HasSuffix(stderr, "nil pointer dereference\n") || strings.Contains(stderr, "goroutine 0 ") {
+		t.Errorf("the stderr of the crash is %q", stderr)
+	}
+	uptime := p.GetUptime()
+	time.Sleep(1100 * time.Millisecond)
+	if p.GetUptime() != uptime {
+		t.Error("the uptime of the exited process still grows")
+	}
+	if p.GetVersion() != "25.1.1" {
+		t.Errorf("the version is %q", p.GetVersion())
+	}
+}
+
+func TestProcessExpectedExit(t *testing.T) {
+	p := startTestProcess(t, false)
+	time.Sleep(100 * time.Millisecond)
+	if !p.IsRunning() {
+		t.Fatal("the process isn't running")
+	}
+	if _, _, ok := p.ExitState(); ok {
+		t.Error("the running process has an exit state")
+	}
+	p.ExpectExit()
+	if err := p.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	waitTestProcess(t, p)
+	if !p.ExitExpected() {
+		t.Error("the stop wasn't expected")
+	}
+	if _, signal, ok := p.ExitState(); !ok || signal != "terminated" {
+		t.Errorf("the stopped process exited with %q, %v", signal, ok)
+	}
+	// Each process starts out crashing unexpectedly
+	if NewProcess(&Config{}).ExitExpected() {
+		t.Error("a new process expects its exit")
+	}
+}
@@ -0,0 +1,55 @@
+package xray
+
+import (
+	"time"
+)
+
+// counterStartTolerance is how far apart two reads of when Xray started may
+// be and still be of the same process, its uptime being whole seconds
+const counterStartTolerance = 10 * time.Second
+
+// CounterSnapshot is the last value of each stat counter of Xray that was
+// counted as traffic, with when the Xray process it was read from started.
+type CounterSnapshot struct {
+	Started  time.Time
+	Counters map[string]int64
+}
+
+// CounterDeltas is how much each stat counter grew between two reads.
+type CounterDeltas struct {
+	Deltas map[string]int64
+	// Restarted tells that Xray restarted since the snapshot, all its counters
+	// started from zero again
+	Restarted bool
+	// Resets are the counters lower than in the snapshot of the same process,
+	// reset by something else than the panel
+	Resets []string
+}
+
+// Deltas returns how much the counters observed from an Xray process started
+// at started grew since the snapshot. A counter that started from zero since,
+// because Xray restarted or because it went back, grew by its whole value,
+// so a delta is never negative.
+func (s *CounterSnapshot) Deltas(started time.Time, observed map[string]int64) *CounterDeltas {
+	deltas := &CounterDeltas{Deltas: make(map[string]int64, len(observed))}
+	sameProcess := s != nil && !s.Started.IsZero()
+	if sameProcess {
+		diff := started.Sub(s.Started)
+		sameProcess = diff < counterStartTolerance && diff > -counterStartTolerance
+	}
+	deltas.Restarted = !sameProcess
+	for name, value := range observed {
+		if !sameProcess {
+			deltas.Deltas[name] = value
+			continue
+		}
+		last := s.Counters[name]
+		if value < last {
+			deltas.Resets = append(deltas.Resets, name)
+			deltas.Deltas[name] = value
+			continue
+		}
+		deltas.Deltas[name] = value - last
+	}
+	return deltas
+}
@@ -0,0 +1,81 @@
+package xray
+
+import (
+	"maps"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestCounterSnapshotDeltas(t *testing.T) {
+	started := time.Date(2024, 5, 20, 12, 0, 0, 0, time.UTC)
+	snapshot := &CounterSnapshot{Started: started, Counters: map[string]int64{"a": 100, "b": 50, "gone": 10}}
+	tests := []struct {
+		name      string
+		snapshot  *CounterSnapshot
+		started   time.Time
+		observed  map[string]int64
+		deltas    map[string]int64
+		restarted bool
+		resets    []string
+	}{
+		{
+			"no snapshot", nil, started, map[string]int64{"a": 100},
+			map[string]int64{"a": 100}, true, nil,
+		},
+		{
+			"same process", snapshot, started.Add(time.Second), map[string]int64{"a": 150, "b": 50, "new": 5},
+			map[string]int64{"a": 50, "b": 0, "new": 5}, false, nil,
+		},
+		{
+			// The uptime of Xray is whole seconds, the start read back moves a bit
+			"start within tolerance", snapshot, started.Add(-9 * time.Second), map[string]int64{"a": 120},
+			map[string]int64{"a": 20}, false, nil,
+		},
+		{
+			"counter reset", snapshot, started, map[string]int64{"a": 30, "b": 60},
+			map[string]int64{"a": 30, "b": 10}, false, []string{"a"},
+		},
+		{
+			"xray restarted", snapshot, started.Add(time.Hour), map[string]int64{"a": 30, "b": 60},
+			map[string]int64{"a": 30, "b": 60}, true, nil,
+		},
+		{
+			"no start saved", &CounterSnapshot{Counters: map[string]int64{"a": 100}}, started, map[string]int64{"a": 120},
+			map[string]int64{"a": 120}, true, nil,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			deltas := test.snapshot.Deltas(test.started, test.observed)
+			if !maps.Equal(deltas.Deltas, test.deltas) || deltas.Restarted != test.restarted ||
+				!slices.Equal(deltas.Resets, test.resets) {
+				t.Errorf("deltas %v restarted %v resets %v, want %v %v %v",
+					deltas.Deltas, deltas.Restarted, deltas.Resets, test.deltas, test.restarted, test.resets)
+			}
+		})
+	}
+}
+
+func TestTrafficFromCounters(t *testing.T) {
+	traffics, clientTraffics := TrafficFromCounters(map[string]int64{
+		"inbound>>>inbound-443>>>traffic>>>uplink":   10,
+		"inbound>>>inbound-443>>>traffic>>>downlink": 20,
+		"outbound>>>direct>>>traffic>>>downlink":     30,
+		"user>>>alice>>>traffic>>>uplink":            1,
+		"user>>>alice>>>traffic>>>downlink":          2,
+		"user>>>alice>>>online":                      1,
+	})
+	if len(traffics) != 2 || len(clientTraffics) != 1 {
+		t.Fatalf("%d traffics and %d client traffics, want 2 and 1", len(traffics), len(clientTraffics))
+	}
+	for _, traffic := range traffics {
+		if traffic.IsInbound && (traffic.Tag != "inbound-443" || traffic.Up != 10 || traffic.Down != 20) ||
+			traffic.IsOutbound && (traffic.Tag != "direct" || traffic.Up != 0 || traffic.Down != 30) {
+			t.Errorf("traffic %+v", traffic)
+		}
+	}
+	if client := clientTraffics[0]; client.Email != "alice" || client.Up != 1 || client.Down != 2 {
+		t.Errorf("client traffic %+v", client)
+	}
+}
@@ -0,0 +1,203 @@
+package xray
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+)
+
+// appliedUsers are the users the running Xray has, by inbound tag and email, as
+// the panel set them: from its config when it started, then through the API.
+// Each user is kept as the key it authenticates with.
+var (
+	appliedUsersLock sync.Mutex
+	appliedUsers     = map[string]map[string]string{}
+)
+
+// userProtocol tells if the users of inbounds of protocol are changed through
+// the API.
+func userProtocol(protocol string) bool {
+	switch protocol {
+	case "vmess", "vless", "trojan", "shadowsocks":
+		return true
+	}
+	return false
+}
+
+// vlessFlow returns the flow an inbound takes for the flow of a client; the
+// "-udp443" variant is only for clients.
+func vlessFlow(flow string) string {
+	if flow == "xtls-rprx-vision-udp443" {
+		return "xtls-rprx-vision"
+	}
+	return flow
+}
+
+// userKey returns what a user of an inbound of protocol authenticates with.
+func userKey(protocol string, user map[string]any) string {
+	field := func(key string) string {
+		value, _ := user[key].(string)
+		return value
+	}
+	switch protocol {
+	case "vmess":
+		return field("id")
+	case "vless":
+		return field("id") + " " + vlessFlow(field("flow"))
+	case "trojan", "shadowsocks":
+		return field("password")
+	}
+	return ""
+}
+
+func inboundUsers(inbound *InboundConfig) map[string]string {
+	var settings struct {
+		Clients []map[string]any `json:"clients"`
+	}
+	json.Unmarshal(inbound.Settings, &settings)
+	users := map[string]string{}
+	for _, client := range settings.Clients {
+		if email, _ := client["email"].(string); email != "" {
+			users[email] = userKey(inbound.Protocol, client)
+		}
+	}
+	return users
+}
+
+// ConfigUsers returns the users of the inbounds of config, by inbound tag and
+// email.
+func ConfigUsers(config *Config) map[string]map[string]string {
+	users := map[string]map[string]string{}
+	for i := range config.InboundConfigs {
+		inbound := &config.InboundConfigs[i]
+		if userProtocol(inbound.Protocol) && inbound.Tag != "" {
+			users[inbound.Tag] = inboundUsers(inbound)
+		}
+	}
+	return users
+}
+
+// AppliedUsers returns the users the running Xray has, by inbound tag and email.
+func AppliedUsers() map[string]map[string]string {
+	appliedUsersLock.Lock()
+	defer appliedUsersLock.Unlock()
+	users := make(map[string]map[string]string, len(appliedUsers))
+	for tag, inboundUsers := range appliedUsers {
+		users[tag] = make(map[string]string, len(inboundUsers))
+		for email, key := range inboundUsers {
+			users[tag][email] = key
+		}
+	}
+	return users
+}
+
+func resetAppliedUsers(config *Config) {
+	users := ConfigUsers(config)
+	appliedUsersLock.Lock()
+	appliedUsers = users
+	appliedUsersLock.Unlock()
+}
+
+func setAppliedUser(tag string, email string, key string) {
+	appliedUsersLock.Lock()
+	defer appliedUsersLock.Unlock()
+	if appliedUsers[tag] == nil {
+		appliedUsers[tag] = map[string]string{}
+	}
+	appliedUsers[tag][email] = key
+}
+
+func removeAppliedUser(tag string, email string) {
+	appliedUsersLock.Lock()
+	defer appliedUsersLock.Unlock()
+	delete(appliedUsers[tag], email)
+}
+
+func setAppliedInbound(inbound *InboundConfig) {
+	if !userProtocol(inbound.Protocol) || inbound.Tag == "" {
+		return
+	}
+	users := inboundUsers(inbound)
+	appliedUsersLock.Lock()
+	appliedUsers[inbound.Tag] = users
+	appliedUsersLock.Unlock()
+}
+
+func removeAppliedInbound(tag string) {
+	appliedUsersLock.Lock()
+	delete(appliedUsers, tag)
+	appliedUsersLock.Unlock()
+}
+
+// UsersDrift returns how the users the running Xray has differ from users, by
+// inbound tag and email; nothing if they are the same.
+func UsersDrift(users map[string]map[string]string) []string {
+	applied := AppliedUsers()
+	tags := make([]string, 0, len(users)+len(applied))
+	for tag := range users {
+		tags = append(tags, tag)
+	}
+	for tag := range applied {
+		if _, ok := users[tag]; !ok {
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+
+	var drift []string
+	for _, tag := range tags {
+		want, wanted := users[tag]
+		have, has := applied[tag]
+		switch {
+		case !has:
+			drift = append(drift, tag+": the inbound is missing")
+			continue
+		case !wanted:
+			drift = append(drift, tag+": the inbound shouldn't be there")
+			continue
+		}
+		emails := make([]string, 0, len(want)+len(have))
+		for email := range want {
+			emails = append(emails, email)
+		}
+		for email := range have {
+			if _, ok := want[email]; !ok {
+				emails = append(emails, email)
+			}
+		}
+		sort.Strings(emails)
+		for _, email := range emails {
+			wantKey, wanted := want[email]
+			haveKey, has := have[email]
+			switch {
+			case !has:
+				drift = append(drift, tag+": "+email+" is missing")
+			case !wanted:
+				drift = append(drift, tag+": "+email+" shouldn't be there")
+			case wantKey != haveKey:
+				drift = append(drift, tag+": "+email+" has another key")
+			}
+		}
+	}
+	return drift
+}
+
+// WithoutUsers returns a copy of the config without the users of its inbounds,
+// to compare configs whatever their users.
+func (c *Config) WithoutUsers() *Config {
+	config := *c
+	config.InboundConfigs = make([]InboundConfig, len(c.InboundConfigs))
+	for i, inbound := range c.InboundConfigs {
+		if userProtocol(inbound.Protocol) {
+			settings := map[string]any{}
+			if json.Unmarshal(inbound.Settings, &settings) == nil {
+				delete(settings, "clients")
+				if data, err := json.Marshal(settings); err == nil {
+					inbound.Settings = data
+				}
+			}
+		}
+		config.InboundConfigs[i] = inbound
+	}
+	return &config
+}